@@ -0,0 +1,109 @@
+//go:build cgo
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"unsafe"
+
+	"github.com/Amul-Thantharate/pixellock/pkg/pixellock"
+)
+
+// The statuses the exported functions return, as the CLI exits with them.
+// export.go repeats them for C as PIXELLOCK_* macros.
+const (
+	statusOK           = 0
+	statusFailure      = 1
+	statusWrongKey     = 3
+	statusInvalidKey   = 4
+	statusNotEncrypted = 5
+	statusUnsupported  = 6
+	statusNoPayload    = 7
+)
+
+// maxInput bounds the length a caller may pass, so that a negative or
+// corrupt length is refused rather than read past its buffer.
+const maxInput = 1 << 40
+
+// errNilBuffer is returned for a NULL buffer with a length.
+var errNilBuffer = errors.New("NULL buffer with a non-zero length")
+
+// goBytes copies the n bytes at p, which the caller keeps, into Go memory.
+// A NULL p is an empty buffer when n is zero.
+func goBytes(p unsafe.Pointer, n int) ([]byte, error) {
+	switch {
+	case n < 0 || n > maxInput:
+		return nil, fmt.Errorf("invalid buffer length %d", n)
+	case n == 0:
+		return []byte{}, nil
+	case p == nil:
+		return nil, errNilBuffer
+	}
+	return bytes.Clone(unsafe.Slice((*byte)(p), n)), nil
+}
+
+// status returns the status a call that failed with err returns.
+func status(err error) int {
+	var unsupportedCipher *pixellock.UnsupportedCipherError
+	switch {
+	case err == nil:
+		return statusOK
+	case errors.Is(err, pixellock.ErrAuthenticationFailed):
+		return statusWrongKey
+	case errors.Is(err, pixellock.ErrInvalidKeySize):
+		return statusInvalidKey
+	case errors.Is(err, pixellock.ErrNotEncryptedFile):
+		return statusNotEncrypted
+	case errors.As(err, &unsupportedCipher), errors.Is(err, pixellock.ErrUnsupportedFormat):
+		return statusUnsupported
+	case errors.Is(err, pixellock.ErrNoPayload):
+		return statusNoPayload
+	}
+	return statusFailure
+}
+
+// checkKey returns an error unless key is a pixellock key.
+func checkKey(key []byte) error {
+	if len(key) != pixellock.KeySize {
+		return fmt.Errorf("%w: key must be %d bytes", pixellock.ErrInvalidKeySize, pixellock.KeySize)
+	}
+	return nil
+}
+
+// encrypt implements PixellockEncrypt.
+func encrypt(data, key []byte) ([]byte, error) {
+	if err := checkKey(key); err != nil {
+		return nil, err
+	}
+	var out bytes.Buffer
+	if err := pixellock.EncryptImage(context.Background(), key, &out, bytes.NewReader(data)); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// decrypt implements PixellockDecrypt.
+func decrypt(data, key []byte) ([]byte, error) {
+	if err := checkKey(key); err != nil {
+		return nil, err
+	}
+	var out bytes.Buffer
+	if err := pixellock.DecryptImage(context.Background(), key, &out, bytes.NewReader(data)); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// stegoReveal implements PixellockStegoReveal.
+func stegoReveal(data []byte, password string) ([]byte, error) {
+	opts := pixellock.DefaultStegoOptions
+	opts.Password = password
+	p, err := pixellock.RevealPayloadFrom(bytes.NewReader(data), opts)
+	if err != nil {
+		return nil, err
+	}
+	return p.Data, nil
+}
@@ -0,0 +1,182 @@
+//go:build cgo
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"unsafe"
+
+	"github.com/Amul-Thantharate/pixellock/pkg/pixellock"
+)
+
+// faceFixture is a photo from the library's test data.
+const faceFixture = "../pkg/pixellock/testdata/face.jpg"
+
+func TestGoBytes(t *testing.T) {
+	data := []byte("caller's buffer")
+	got, err := goBytes(unsafe.Pointer(&data[0]), len(data))
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("goBytes = %q, %v", got, err)
+	}
+	data[0] = 'C'
+	if got[0] != 'c' {
+		t.Error("goBytes shares the caller's buffer")
+	}
+
+	if got, err := goBytes(nil, 0); err != nil || got == nil || len(got) != 0 {
+		t.Errorf("goBytes(NULL, 0) = %v, %v; want an empty buffer", got, err)
+	}
+	if _, err := goBytes(nil, 4); !errors.Is(err, errNilBuffer) {
+		t.Errorf("goBytes(NULL, 4) = %v, want errNilBuffer", err)
+	}
+	for _, n := range []int{-1, maxInput + 1} {
+		if _, err := goBytes(unsafe.Pointer(&data[0]), n); err == nil {
+			t.Errorf("goBytes accepted length %d", n)
+		}
+	}
+}
+
+func TestStatus(t *testing.T) {
+	for err, want := range map[error]int{
+		nil:                                      statusOK,
+		errors.New("disk full"):                  statusFailure,
+		pixellock.ErrAuthenticationFailed:        statusWrongKey,
+		pixellock.ErrInvalidKeySize:              statusInvalidKey,
+		pixellock.ErrNotEncryptedFile:            statusNotEncrypted,
+		pixellock.ErrUnsupportedFormat:           statusUnsupported,
+		&pixellock.UnsupportedCipherError{ID: 9}: statusUnsupported,
+		pixellock.ErrNoPayload:                   statusNoPayload,
+		fmt.Errorf("wrapped: %w", pixellock.ErrAuthenticationFailed): statusWrongKey,
+	} {
+		if got := status(err); got != want {
+			t.Errorf("status(%v) = %d, want %d", err, got, want)
+		}
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	face, err := os.ReadFile(faceFixture)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	key := make([]byte, pixellock.KeySize)
+	rand.Read(key)
+
+	encrypted, err := encrypt(face, key)
+	if err != nil {
+		t.Fatalf("encrypt failed: %v", err)
+	}
+	png, err := decrypt(encrypted, key)
+	if err != nil {
+		t.Fatalf("decrypt failed: %v", err)
+	}
+	if pixellock.OriginalFormat(png) != "jpeg" {
+		t.Errorf("decrypted image does not record its JPEG origin")
+	}
+
+	if _, err := decrypt(encrypted, key[:16]); status(err) != statusInvalidKey {
+		t.Errorf("decrypt with a short key = %v, want status %d", err, statusInvalidKey)
+	}
+	if _, err := decrypt(face, key); status(err) != statusNotEncrypted {
+		t.Errorf("decrypt of an image = %v, want status %d", err, statusNotEncrypted)
+	}
+	if _, err := stegoReveal(png, ""); status(err) != statusNoPayload {
+		t.Errorf("stegoReveal of a clean image = %v, want status %d", err, statusNoPayload)
+	}
+}
+
+// TestConcurrentCalls runs calls from many goroutines at once; run it with
+// -race.
+func TestConcurrentCalls(t *testing.T) {
+	face, err := os.ReadFile(faceFixture)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			key := make([]byte, pixellock.KeySize)
+			rand.Read(key)
+			for range 3 {
+				encrypted, err := encrypt(face, key)
+				if err != nil {
+					t.Errorf("encrypt failed: %v", err)
+					return
+				}
+				if _, err := decrypt(encrypted, key); err != nil {
+					t.Errorf("decrypt failed: %v", err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// TestCtypes builds the shared library and calls it from Python, through
+// test_pixellock.py.
+func TestCtypes(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds the shared library")
+	}
+	python, err := exec.LookPath("python3")
+	if err != nil {
+		t.Skip("python3 is not installed")
+	}
+	dir := t.TempDir()
+	lib := filepath.Join(dir, "libpixellock.so")
+	if out, err := exec.Command("go", "build", "-buildmode=c-shared", "-o", lib, ".").CombinedOutput(); err != nil {
+		t.Fatalf("go build failed: %v\n%s", err, out)
+	}
+	header, err := os.ReadFile(filepath.Join(dir, "libpixellock.h"))
+	if err != nil || !strings.Contains(string(header), "memory ownership") {
+		t.Errorf("header does not document memory ownership: %v", err)
+	}
+
+	face, err := os.ReadFile(faceFixture)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "face.jpg"), face, 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	cover := filepath.Join(dir, "cover.png")
+	if err := pixellock.SaveImage(cover, faceImage(t), pixellock.SaveOptions{Format: "png"}); err != nil {
+		t.Fatalf("SaveImage failed: %v", err)
+	}
+	opts := pixellock.DefaultStegoOptions
+	opts.Password = "hunter2"
+	if err := pixellock.HidePayload(cover, filepath.Join(dir, "stego.png"), pixellock.Payload{Data: []byte("meet at noon")}, opts, "png"); err != nil {
+		t.Fatalf("HidePayload failed: %v", err)
+	}
+
+	if out, err := exec.Command(python, "test_pixellock.py", lib, dir).CombinedOutput(); err != nil {
+		t.Fatalf("test_pixellock.py failed: %v\n%s", err, out)
+	}
+}
+
+// faceImage returns the pixels of the face fixture, 8 bits per channel as
+// stego covers need.
+func faceImage(t *testing.T) *image.NRGBA {
+	t.Helper()
+	img, err := pixellock.LoadImage(faceFixture)
+	if err != nil {
+		t.Fatalf("LoadImage failed: %v", err)
+	}
+	dst := image.NewNRGBA(img.Bounds())
+	draw.Draw(dst, dst.Bounds(), img, img.Bounds().Min, draw.Src)
+	return dst
+}
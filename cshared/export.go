@@ -0,0 +1,119 @@
+//go:build cgo
+
+// Command cshared exports pixellock to C, and so to any language with a C
+// foreign function interface, such as Python's ctypes. Build it with
+//
+//	go build -buildmode=c-shared -o libpixellock.so ./cshared
+//
+// which also writes libpixellock.h, declaring the functions below along
+// with the memory ownership rules in the comment that follows.
+package main
+
+/*
+#include <stdlib.h>
+#include <stdint.h>
+
+// pixellock: memory ownership
+//
+// Input buffers are only read, and only during the call: the caller keeps
+// them, and may free or reuse them once the call returns. A NULL input is
+// allowed when its length is 0.
+//
+// On success a call returns PIXELLOCK_OK and sets *out to a buffer of
+// *outLen bytes allocated by the library; *errText is set to NULL. On
+// failure it returns one of the other statuses and sets *errText to a
+// NUL-terminated message allocated by the library; *out is set to NULL and
+// *outLen to 0.
+// Either way the caller owns what was allocated, and must release it with
+// PixellockFree, and with nothing else. PixellockFree(NULL) does nothing.
+//
+// Calls hold no shared state: any number may run at once, from any
+// threads.
+
+#define PIXELLOCK_OK 0
+#define PIXELLOCK_ERR_FAILURE 1       // Any other failure
+#define PIXELLOCK_ERR_WRONG_KEY 3     // Wrong key, or corrupted data
+#define PIXELLOCK_ERR_INVALID_KEY 4   // The key is not 32 bytes
+#define PIXELLOCK_ERR_NOT_ENCRYPTED 5 // Not encrypted by pixellock
+#define PIXELLOCK_ERR_UNSUPPORTED 6   // Unsupported image format or cipher
+#define PIXELLOCK_ERR_NO_PAYLOAD 7    // No stego payload found
+*/
+import "C"
+
+import "unsafe"
+
+func main() {}
+
+// call runs fn on the input buffer and key and hands its result to the C
+// caller as the memory ownership rules say.
+func call(in unsafe.Pointer, inLen C.size_t, fn func(data []byte) ([]byte, error), out *unsafe.Pointer, outLen *C.size_t, errText **C.char) C.int {
+	*out, *outLen, *errText = nil, 0, nil
+	data, err := goBytes(in, int(inLen))
+	var result []byte
+	if err == nil {
+		result, err = fn(data)
+	}
+	if err != nil {
+		*errText = C.CString(err.Error())
+		return C.int(status(err))
+	}
+	// malloc(0) may return NULL, which reads as no output
+	*out = C.malloc(C.size_t(max(len(result), 1)))
+	if len(result) > 0 {
+		copy(unsafe.Slice((*byte)(*out), len(result)), result)
+	}
+	*outLen = C.size_t(len(result))
+	return C.int(statusOK)
+}
+
+// PixellockEncrypt encrypts the image file in in with the 32-byte key,
+// giving the file pixellock encrypt writes.
+//
+//export PixellockEncrypt
+func PixellockEncrypt(in unsafe.Pointer, inLen C.size_t, key unsafe.Pointer, keyLen C.size_t, out *unsafe.Pointer, outLen *C.size_t, errText **C.char) C.int {
+	k, err := goBytes(key, int(keyLen))
+	return call(in, inLen, func(data []byte) ([]byte, error) {
+		if err != nil {
+			return nil, err
+		}
+		return encrypt(data, k)
+	}, out, outLen, errText)
+}
+
+// PixellockDecrypt decrypts the file in in, encrypted by pixellock, with
+// the 32-byte key, giving the image as encryption stored it: a PNG, or an
+// animated GIF, multi-page TIFF or HEIF image in its own format.
+//
+//export PixellockDecrypt
+func PixellockDecrypt(in unsafe.Pointer, inLen C.size_t, key unsafe.Pointer, keyLen C.size_t, out *unsafe.Pointer, outLen *C.size_t, errText **C.char) C.int {
+	k, err := goBytes(key, int(keyLen))
+	return call(in, inLen, func(data []byte) ([]byte, error) {
+		if err != nil {
+			return nil, err
+		}
+		return decrypt(data, k)
+	}, out, outLen, errText)
+}
+
+// PixellockStegoReveal gives the payload hidden in the stego image file in
+// in. password, a NUL-terminated string, opens an encrypted payload; NULL
+// or "" is none.
+//
+//export PixellockStegoReveal
+func PixellockStegoReveal(in unsafe.Pointer, inLen C.size_t, password *C.char, out *unsafe.Pointer, outLen *C.size_t, errText **C.char) C.int {
+	var pw string
+	if password != nil {
+		pw = C.GoString(password)
+	}
+	return call(in, inLen, func(data []byte) ([]byte, error) {
+		return stegoReveal(data, pw)
+	}, out, outLen, errText)
+}
+
+// PixellockFree releases a buffer or error message allocated by the
+// library.
+//
+//export PixellockFree
+func PixellockFree(p unsafe.Pointer) {
+	C.free(p)
+}
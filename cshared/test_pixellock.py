@@ -0,0 +1,114 @@
+"""Calls libpixellock through ctypes, as TestCtypes runs it:
+
+    python3 test_pixellock.py libpixellock.so dir
+
+dir holds face.jpg, to encrypt and decrypt, and stego.png, hiding "meet at
+noon" with the password hunter2.
+"""
+
+import ctypes
+import os
+import sys
+import threading
+
+PIXELLOCK_OK = 0
+PIXELLOCK_ERR_WRONG_KEY = 3
+PIXELLOCK_ERR_INVALID_KEY = 4
+PIXELLOCK_ERR_NOT_ENCRYPTED = 5
+PIXELLOCK_ERR_UNSUPPORTED = 6
+PIXELLOCK_ERR_NO_PAYLOAD = 7
+
+lib = ctypes.CDLL(sys.argv[1])
+out_params = [ctypes.POINTER(ctypes.c_void_p), ctypes.POINTER(ctypes.c_size_t), ctypes.POINTER(ctypes.c_void_p)]
+for fn in (lib.PixellockEncrypt, lib.PixellockDecrypt):
+    fn.argtypes = [ctypes.c_char_p, ctypes.c_size_t, ctypes.c_char_p, ctypes.c_size_t] + out_params
+    fn.restype = ctypes.c_int
+lib.PixellockStegoReveal.argtypes = [ctypes.c_char_p, ctypes.c_size_t, ctypes.c_char_p] + out_params
+lib.PixellockStegoReveal.restype = ctypes.c_int
+lib.PixellockFree.argtypes = [ctypes.c_void_p]
+lib.PixellockFree.restype = None
+
+
+def call(fn, *args):
+    """Returns the status, output and error message of fn, freeing both."""
+    out, out_len, err = ctypes.c_void_p(), ctypes.c_size_t(), ctypes.c_void_p()
+    status = fn(*args, ctypes.byref(out), ctypes.byref(out_len), ctypes.byref(err))
+    try:
+        data = ctypes.string_at(out, out_len.value) if out else None
+        message = ctypes.string_at(err).decode() if err else None
+    finally:
+        lib.PixellockFree(out)
+        lib.PixellockFree(err)
+    if status == PIXELLOCK_OK:
+        assert data is not None and message is None, (data, message)
+    else:
+        assert data is None and out_len.value == 0 and message, (status, out_len.value, message)
+    return status, data, message
+
+
+def encrypt(data, key):
+    return call(lib.PixellockEncrypt, data, len(data), key, len(key))
+
+
+def decrypt(data, key):
+    return call(lib.PixellockDecrypt, data, len(data), key, len(key))
+
+
+def main():
+    directory = sys.argv[2]
+    with open(os.path.join(directory, "face.jpg"), "rb") as f:
+        face = f.read()
+    with open(os.path.join(directory, "stego.png"), "rb") as f:
+        stego = f.read()
+    key = os.urandom(32)
+
+    status, encrypted, message = encrypt(face, key)
+    assert status == PIXELLOCK_OK, message
+    status, png, message = decrypt(encrypted, key)
+    assert status == PIXELLOCK_OK, message
+    assert png.startswith(b"\x89PNG"), png[:8]
+    with open(os.path.join(directory, "decrypted.png"), "wb") as f:
+        f.write(png)
+
+    status, _, message = decrypt(encrypted, os.urandom(32))
+    assert status == PIXELLOCK_ERR_WRONG_KEY, (status, message)
+    status, _, message = decrypt(encrypted, b"short")
+    assert status == PIXELLOCK_ERR_INVALID_KEY, (status, message)
+    status, _, message = decrypt(face, key)
+    assert status == PIXELLOCK_ERR_NOT_ENCRYPTED, (status, message)
+    status, _, message = call(lib.PixellockEncrypt, None, 0, key, len(key))
+    assert status == PIXELLOCK_ERR_UNSUPPORTED, (status, message)
+
+    status, payload, message = call(lib.PixellockStegoReveal, stego, len(stego), b"hunter2")
+    assert status == PIXELLOCK_OK, message
+    assert payload == b"meet at noon", payload
+    status, _, message = call(lib.PixellockStegoReveal, stego, len(stego), None)
+    assert status != PIXELLOCK_OK, payload
+    status, _, message = call(lib.PixellockStegoReveal, png, len(png), None)
+    assert status == PIXELLOCK_ERR_NO_PAYLOAD, (status, message)
+
+    # Calls from many threads at once, each with its own key
+    failures = []
+
+    def worker():
+        try:
+            own = os.urandom(32)
+            for _ in range(5):
+                status, enc, message = encrypt(face, own)
+                assert status == PIXELLOCK_OK, message
+                status, dec, message = decrypt(enc, own)
+                assert status == PIXELLOCK_OK, message
+                assert dec == png, "decrypted image differs between threads"
+        except Exception as e:  # Reported by the main thread
+            failures.append(e)
+
+    threads = [threading.Thread(target=worker) for _ in range(8)]
+    for t in threads:
+        t.start()
+    for t in threads:
+        t.join()
+    assert not failures, failures
+
+
+if __name__ == "__main__":
+    main()
@@ -1,35 +1,64 @@
 package main
 
 import (
-	"bytes"
-	"crypto/aes"
-	"crypto/cipher"
-	"crypto/rand"
+	"cmp"
+	"context"
+	"crypto/tls"
 	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"image"
-	"image/color"
-	"image/draw"
-	"image/jpeg"
-	"image/png"
 	"io"
+	"io/fs"
 	"io/ioutil"
 	"log"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
+	"os/exec"
+	"os/signal"
 	"path/filepath"
 	"runtime"
+	"runtime/debug"
+	"slices"
+	"strconv"
 	"strings"
-	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
 
+	"github.com/Amul-Thantharate/pixellock/pkg/catalog"
+	"github.com/Amul-Thantharate/pixellock/pkg/clipboard"
+	"github.com/Amul-Thantharate/pixellock/pkg/daemon"
+	"github.com/Amul-Thantharate/pixellock/pkg/gallery"
+	"github.com/Amul-Thantharate/pixellock/pkg/githook"
+	"github.com/Amul-Thantharate/pixellock/pkg/ipfs"
+	"github.com/Amul-Thantharate/pixellock/pkg/mount"
+	"github.com/Amul-Thantharate/pixellock/pkg/parity"
+	"github.com/Amul-Thantharate/pixellock/pkg/pixellock"
+	"github.com/Amul-Thantharate/pixellock/pkg/s3"
+	"github.com/Amul-Thantharate/pixellock/pkg/server"
+	"github.com/Amul-Thantharate/pixellock/pkg/sftp"
 	gookitcolor "github.com/gookit/color" // Renamed to avoid conflict
 	"github.com/urfave/cli/v2"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 )
 
 // Constants
 const (
 	Version  = "v1.0.0"           // Updated Version
 	Author   = "Amul Thantharate" // Tool Author
-	KeySize  = 32                 // AES-256 key size (32 bytes)
 	AsciiArt = `
        _          _ _            _    
  _ __ (_)_  _____| | | ___   ___| | __
@@ -39,166 +68,133 @@ const (
 |_|   
  Image Encryption Tool
 `
-	EncryptedExtension = ".enc"
-	StegoMessageLimit  = 1000 // Maximum message length for steganography
 )
 
-// Helper Functions
+// logger is given what the library logs: errors and warnings to standard
+// error, or to the file of the global --log-file flag, and with --verbose
+// debug messages too.
+var logger = slog.New(slog.NewTextHandler(os.Stderr, nil))
 
-// GenerateRandomKey generates a random AES key.
-func GenerateRandomKey() ([]byte, error) {
-	key := make([]byte, KeySize)
-	_, err := rand.Read(key)
-	if err != nil {
-		return nil, fmt.Errorf("failed to generate key: %w", err)
-	}
-	return key, nil
-}
-
-// Encrypt encrypts data using AES-256 GCM.
-func Encrypt(key []byte, plaintext []byte) ([]byte, error) {
-	block, err := aes.NewCipher(key)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create cipher: %w", err)
-	}
-
-	aesGCM, err := cipher.NewGCM(block)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create GCM: %w", err)
-	}
-
-	nonce := make([]byte, aesGCM.NonceSize())
-	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
-		return nil, fmt.Errorf("failed to create nonce: %w", err)
-	}
-
-	ciphertext := aesGCM.Seal(nonce, nonce, plaintext, nil)
-	return ciphertext, nil
-}
-
-// Decrypt decrypts data using AES-256 GCM.
-func Decrypt(key []byte, ciphertext []byte) ([]byte, error) {
-	block, err := aes.NewCipher(key)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create cipher: %w", err)
-	}
+// tracerProvider records the spans of the command, exported to the
+// collector of the global --otel-endpoint flag or of the OTEL_*
+// environment variables, and is the global TracerProvider the library
+// starts its spans with; nil, tracing nothing, when neither gives one.
+var tracerProvider *sdktrace.TracerProvider
 
-	aesGCM, err := cipher.NewGCM(block)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create GCM: %w", err)
-	}
-
-	nonceSize := aesGCM.NonceSize()
-	if len(ciphertext) < nonceSize {
-		return nil, fmt.Errorf("ciphertext too short")
-	}
+// untracedCommands serve until stopped, so rather than a span of their
+// own they trace each request or job.
+var untracedCommands = map[string]bool{"serve": true, "gallery": true, "daemon": true}
 
-	nonce, ciphertext := ciphertext[:nonceSize], ciphertext[nonceSize:]
-	plaintext, err := aesGCM.Open(nil, nonce, ciphertext, nil)
-	if err != nil {
-		return nil, fmt.Errorf("failed to open GCM: %w", err)
-	}
-
-	return plaintext, nil
-}
+// defaultOTLPEndpoint is the address of a local collector's OTLP/HTTP
+// receiver.
+const defaultOTLPEndpoint = "http://localhost:4318"
 
-// LoadImage loads an image from a file.
-func LoadImage(filename string) (image.Image, error) {
-	f, err := os.Open(filename)
-	if err != nil {
-		return nil, fmt.Errorf("failed to open image: %w", err)
+// newTracerProvider returns the TracerProvider the global flags and the
+// environment ask for, or nil when tracing is off. It is on when endpoint,
+// the base URL of a collector, is given, an endpoint is set in the
+// environment, or OTEL_TRACES_EXPORTER is otlp, unless OTEL_SDK_DISABLED is
+// true. OTEL_TRACES_EXPORTER=none turns off all but endpoint. The exporter
+// reads the rest of its configuration, such as OTEL_EXPORTER_OTLP_HEADERS,
+// from the environment, and the resource OTEL_SERVICE_NAME and
+// OTEL_RESOURCE_ATTRIBUTES.
+func newTracerProvider(endpoint string) (*sdktrace.TracerProvider, error) {
+	if disabled, _ := strconv.ParseBool(os.Getenv("OTEL_SDK_DISABLED")); disabled {
+		return nil, nil
 	}
-	defer f.Close()
-
-	img, _, err := image.Decode(f)
-	if err != nil {
-		return nil, fmt.Errorf("failed to decode image: %w", err)
+	if endpoint == "" {
+		switch exporters := os.Getenv("OTEL_TRACES_EXPORTER"); {
+		case exporters == "none":
+			return nil, nil
+		case exporters == "":
+			if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+				return nil, nil
+			}
+		case !slices.Contains(strings.Split(exporters, ","), "otlp"):
+			return nil, fmt.Errorf("OTEL_TRACES_EXPORTER=%s: only the otlp exporter is supported", exporters)
+		}
 	}
-	return img, nil
-}
-
-// SaveImage saves an image to a file.  Supports PNG and JPEG.
-func SaveImage(filename string, img image.Image, outputFormat string) error {
-	f, err := os.Create(filename)
-	if err != nil {
-		return fmt.Errorf("failed to create image file: %w", err)
+	protocol := cmp.Or(os.Getenv("OTEL_EXPORTER_OTLP_TRACES_PROTOCOL"), os.Getenv("OTEL_EXPORTER_OTLP_PROTOCOL"))
+	if protocol != "" && protocol != "http/protobuf" && protocol != "http/json" {
+		return nil, fmt.Errorf("OTLP protocol %s is not supported; spans are sent over HTTP, which a collector's OTLP/HTTP receiver takes", protocol)
 	}
-	defer f.Close()
 
-	switch strings.ToLower(outputFormat) {
-	case "jpg", "jpeg":
-		opt := &jpeg.Options{Quality: 90} // Adjust quality as needed (0-100)
-		err = jpeg.Encode(f, img, opt)
-		if err != nil {
-			return fmt.Errorf("failed to encode image to JPEG: %w", err)
+	var opts []otlptracehttp.Option
+	if endpoint != "" {
+		u := strings.TrimSuffix(endpoint, "/")
+		if !strings.HasSuffix(u, "/v1/traces") {
+			u += "/v1/traces"
 		}
-	default: // Default to PNG
-		err = png.Encode(f, img)
-		if err != nil {
-			return fmt.Errorf("failed to encode image to PNG: %w", err)
+		if parsed, err := url.ParseRequestURI(u); err != nil {
+			return nil, fmt.Errorf("bad OTLP endpoint: %w", err)
+		} else if parsed.Scheme != "http" && parsed.Scheme != "https" {
+			return nil, fmt.Errorf("bad OTLP endpoint %s: want an http or https URL", endpoint)
 		}
+		opts = append(opts, otlptracehttp.WithEndpointURL(u))
 	}
-	return nil
-}
-
-// SaveImage saves an image to a file with default format PNG.  Supports PNG and JPEG.
-func SaveImageDefault(filename string, img image.Image) error {
-	f, err := os.Create(filename)
+	exporter, err := otlptracehttp.New(context.Background(), opts...)
 	if err != nil {
-		return fmt.Errorf("failed to create image file: %w", err)
+		return nil, err
 	}
-	defer f.Close()
-
-	err = png.Encode(f, img)
+	res, err := resource.New(context.Background(),
+		resource.WithAttributes(attribute.String("service.name", "pixellock"), attribute.String("service.version", Version)),
+		resource.WithFromEnv(),
+	)
 	if err != nil {
-		return fmt.Errorf("failed to encode image to PNG: %w", err)
+		return nil, err
 	}
-
-	return nil
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) { logger.Warn("failed to export spans", "err", err) }))
+	return sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res)), nil
 }
 
-// ImageToBytes converts an image to a byte slice.
-func ImageToBytes(img image.Image) ([]byte, error) {
-	// Encode the image to PNG in memory
-	buf := new(bytes.Buffer) // Import "bytes"
-	err := png.Encode(buf, img)
-	if err != nil {
-		return nil, fmt.Errorf("failed to encode image to bytes: %w", err)
-	}
-
-	return buf.Bytes(), nil
+// fromEnvironment returns a copy of ctx holding the span propagated in the
+// TRACEPARENT environment variable, or ctx when there is none that parses.
+func fromEnvironment(ctx context.Context) context.Context {
+	return propagation.TraceContext{}.Extract(ctx, propagation.MapCarrier{"traceparent": strings.TrimSpace(os.Getenv("TRACEPARENT"))})
 }
 
-// BytesToImage converts a byte slice to an image.
-func BytesToImage(data []byte) (image.Image, error) {
-	r := bytes.NewReader(data) // Import "bytes"
-	img, err := png.Decode(r)
-	if err != nil {
-		return nil, fmt.Errorf("failed to decode bytes to image: %w", err)
+// traceCommands wraps the actions of cmds and their subcommands, other
+// than untracedCommands, to run in a span named after the command,
+// beneath that of the TRACEPARENT environment variable when it is set.
+func traceCommands(cmds []*cli.Command) {
+	for _, cmd := range cmds {
+		if untracedCommands[cmd.Name] {
+			continue
+		}
+		traceCommands(cmd.Subcommands)
+		if cmd.Action == nil {
+			continue
+		}
+		action := cmd.Action
+		cmd.Action = func(c *cli.Context) (err error) {
+			ctx, span := otel.Tracer(pixellock.ScopeName).Start(fromEnvironment(c.Context), "pixellock "+c.Command.FullName())
+			defer func() {
+				if err != nil {
+					span.RecordError(err)
+					span.SetStatus(codes.Error, err.Error())
+				}
+				span.End()
+			}()
+			c.Context = ctx
+			return action(c)
+		}
 	}
-	return img, nil
 }
 
-func isImageFile(filename string) bool {
-	f, err := os.Open(filename)
-	if err != nil {
-		return false // Or log the error
+// newLogger returns the logger the global flags ask for, and the file it
+// writes to, if any, to be closed once the command is done.
+func newLogger(verbose bool, logFile string) (*slog.Logger, *os.File, error) {
+	opts := &slog.HandlerOptions{Level: slog.LevelInfo}
+	if verbose {
+		opts.Level, opts.AddSource = slog.LevelDebug, true
 	}
-	defer f.Close()
-
-	_, format, err := image.DecodeConfig(f)
-	if err != nil {
-		return false // Or log the error
+	if logFile == "" {
+		return slog.New(slog.NewTextHandler(os.Stderr, opts)), nil, nil
 	}
-
-	// List of supported formats
-	supportedFormats := []string{"jpeg", "jpg", "png", "gif", "bmp", "tiff"}
-	for _, supportedFormat := range supportedFormats {
-		if strings.ToLower(format) == supportedFormat {
-			return true
-		}
+	f, err := os.OpenFile(logFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open log file: %w", err)
 	}
-	return false
+	return slog.New(slog.NewTextHandler(f, opts)), f, nil
 }
 
 // CLI Commands
@@ -222,12 +218,13 @@ var encryptCmd = &cli.Command{
 			Value:   "encrypted_output", // Default output directory/file prefix
 			Usage:   "Output encrypted image file or directory",
 		},
-		&cli.StringFlag{
+		secret(&cli.StringFlag{
 			Name:    "key",
 			Aliases: []string{"k"},
 			Value:   "",
 			Usage:   "Encryption key (base64 encoded). If not provided, a new key will be generated and printed/saved.",
-		},
+		}),
+		pasteKeyFlag(),
 		&cli.StringFlag{
 			Name:  "keyfile",
 			Usage: "File to save the generated key to (if no key is provided). If specified, the key will be saved here after generation.",
@@ -249,19 +246,208 @@ var encryptCmd = &cli.Command{
 			Usage: "Overwrite existing files in the output directory without warning.",
 			Value: false,
 		},
+		&cli.StringFlag{
+			Name:  "metadata",
+			Value: pixellock.MetadataPreserve,
+			Usage: "EXIF metadata of JPEG, PNG and TIFF images: preserve carries it, encrypted, to the decrypted image; strip drops it, turning the image upright first",
+		},
+		&cli.StringFlag{
+			Name:  "mode",
+			Value: pixellock.ModeCipher,
+			Usage: "cipher encrypts images into opaque files; scramble writes a viewable PNG (named *" + pixellock.ScrambledExtension + " in directories) whose shuffled, masked pixels look like noise. Scrambling keeps no EXIF metadata and is weaker than cipher",
+		},
+		&cli.StringSliceFlag{
+			Name:  "region",
+			Usage: "Only encrypt the pixels inside this rectangle, given as x,y,width,height (repeatable), replacing them with noise in a PNG (named *" + pixellock.RedactedExtension + " in directories) that stays viewable elsewhere. Regions are clipped to the image; redacting keeps no EXIF metadata",
+		},
+		&cli.StringFlag{
+			Name:  "detect",
+			Usage: "Find the regions to encrypt, as --region does: faces redacts every face found. An image with none found is left unencrypted, with a warning",
+		},
+		&cli.Float64Flag{
+			Name:  "face-margin",
+			Value: pixellock.DefaultFaceMargin,
+			Usage: "Widen each face found by --detect faces by this fraction of its size on every side",
+		},
+		&cli.BoolFlag{
+			Name:  "require-detection",
+			Usage: "Fail instead of warning when --detect finds nothing in an image",
+		},
+		&cli.IntFlag{
+			Name:  "thumbnail",
+			Usage: "Write an UNENCRYPTED JPEG preview of each image, at most this many pixels on its longer side, next to its output (named *" + pixellock.ThumbnailExtension + "). It deliberately leaks a low-resolution copy of the image",
+		},
+		&cli.BoolFlag{
+			Name:  "thumbnail-embed",
+			Usage: "Embed the --thumbnail preview, still unencrypted, at the start of the encrypted file instead",
+		},
+		&cli.BoolFlag{
+			Name:  "no-thumbnail",
+			Usage: "Write no preview, even with --thumbnail",
+		},
+		&cli.IntFlag{
+			Name:  "tile",
+			Usage: "Encrypt very large images in tiles of this many pixels a side, each encrypted on its own, so decrypt can read a region without the whole image (e.g. 4096)",
+		},
+		&cli.BoolFlag{
+			Name:  "tile-dir",
+			Usage: "Write a --tile image as a directory of tile files instead of a single file",
+		},
+		&cli.BoolFlag{
+			Name:  "metadata-only",
+			Usage: "Encrypt only the EXIF, XMP and IPTC metadata of a JPEG or PNG, leaving its pixels public; the output is the same image without them, named for its format",
+		},
+		&cli.BoolFlag{
+			Name:  "metadata-sidecar",
+			Usage: "With --metadata-only, write the encrypted metadata to a sidecar named like the output plus " + pixellock.MetadataSidecarExtension + " instead of into the image",
+		},
+		&cli.DurationFlag{
+			Name:  "timeout",
+			Value: pixellock.DefaultHTTPTimeout,
+			Usage: "When --input is an http(s):// URL, how long its download may take",
+		},
+		&cli.StringFlag{
+			Name:  "user-agent",
+			Value: pixellock.DefaultHTTPUserAgent + "/" + Version,
+			Usage: "When --input is an http(s):// URL, the User-Agent header of its requests",
+		},
+		&cli.Int64Flag{
+			Name:  "max-download-bytes",
+			Value: pixellock.DefaultHTTPMaxBytes,
+			Usage: "When --input is an http(s):// URL, the largest download taken",
+		},
+		&cli.IntFlag{
+			Name:  "retries",
+			Value: pixellock.DefaultHTTPRetries,
+			Usage: "When --input is an http(s):// URL, how many times a request that fails to connect, times out, or is answered 429 or 5xx is retried",
+		},
+		&cli.BoolFlag{
+			Name:  "publish-ipfs",
+			Usage: "Add each encrypted file to an IPFS node, recording its CID in the --ipfs-manifest",
+		},
+		ipfsAPIFlag(),
+		&cli.BoolFlag{
+			Name:  "ipfs-pin",
+			Usage: "With --publish-ipfs, pin the files added on the node",
+		},
+		&cli.StringFlag{
+			Name:  "ipfs-manifest",
+			Usage: "With --publish-ipfs, the manifest to record the CIDs in, updating it if it exists; " + pixellock.IPFSManifestName + " in the output directory by default",
+		},
+		&cli.BoolFlag{
+			Name:  "dedupe",
+			Usage: "Encrypt each distinct image once: a duplicate of one encrypted already, found by the hash of its plaintext, is linked or referred to as --dedupe-mode says",
+		},
+		&cli.StringFlag{
+			Name:  "dedupe-mode",
+			Value: pixellock.DedupeLink,
+			Usage: "With --dedupe, " + pixellock.DedupeLink + " makes a duplicate a hard link to the encrypted file, or a reference where it cannot; " + pixellock.DedupeReference + " only records it in " + pixellock.DedupeManifestName + " in the output directory, which decrypt reads",
+		},
+		&cli.StringFlag{
+			Name:  "dedupe-index",
+			Usage: "With --dedupe, a file recording the images encrypted, so that later runs find duplicates of them too; updated if it exists",
+		},
+		shardSizeFlag("Pack the encrypted files into a shard set, the --output directory, of shards of this size (e.g. 64MiB) with an encrypted index, which decrypt reads files from one at a time; a set there already is appended to, replacing files of the same path"),
+		&cli.Float64Flag{
+			Name:  "max-unreadable",
+			Value: pixellock.DefaultMaxUnreadable,
+			Usage: "Of a directory, the fraction of the files found that may be unreadable, as when it is not mounted, past which they are listed and nothing is encrypted; 1 encrypts what can be read",
+		},
+		skipExistingFlag(),
+		identityFlag(),
+		knownHostsFlag(),
+		insecureIgnoreHostKeyFlag(),
+		workersFlag(),
+		progressFlag(),
+		metricsOutFlag(),
 	},
 	Action: func(c *cli.Context) error {
 		inputPath := c.String("input")
 		outputPath := c.String("output")
-		keyBase64 := c.String("key")
+		keyBase64, err := keyOrPastedKey(c)
+		if err != nil {
+			return err
+		}
 		keyFile := c.String("keyfile")
 		printKey := c.Bool("print-key")
 		recursive := c.Bool("recursive")
-		overwrite := c.Bool("overwrite")
+		overwrite, err := overwriteFromFlags(c)
+		if err != nil {
+			return err
+		}
+		opts := pixellock.EncryptOptions{
+			Metadata:         c.String("metadata"),
+			Mode:             c.String("mode"),
+			Detect:           c.String("detect"),
+			FaceMargin:       c.Float64("face-margin"),
+			RequireDetection: c.Bool("require-detection"),
+			Thumbnail:        c.Int("thumbnail"),
+			EmbedThumbnail:   c.Bool("thumbnail-embed"),
+			Tile:             c.Int("tile"),
+			TileDir:          c.Bool("tile-dir"),
+			MetadataOnly:     c.Bool("metadata-only"),
+			MetadataSidecar:  c.Bool("metadata-sidecar"),
+			MaxUnreadable:    c.Float64("max-unreadable"),
+			MaxPixels:        maxPixels(c),
+		}
+		if opts.MaxUnreadable <= 0 {
+			return fmt.Errorf("invalid --max-unreadable %g: must be more than 0, and at most 1", opts.MaxUnreadable)
+		}
+		if c.Bool("no-thumbnail") {
+			opts.Thumbnail, opts.EmbedThumbnail = 0, false
+		}
+		if c.Bool("dedupe") {
+			// References are recorded in the output directory, or that of
+			// the output file
+			root := outputPath
+			if info, err := os.Stat(inputPath); err == nil && !info.IsDir() {
+				root = filepath.Dir(outputPath)
+			}
+			if opts.Dedupe, err = pixellock.NewDeduper(c.String("dedupe-mode"), root, c.String("dedupe-index")); err != nil {
+				return err
+			}
+		} else if c.IsSet("dedupe-mode") || c.IsSet("dedupe-index") {
+			return fmt.Errorf("--dedupe-mode and --dedupe-index need --dedupe")
+		}
+		shardSize, err := shardSizeFromFlag(c, outputPath)
+		if err != nil {
+			return err
+		}
+		if shardSize > 0 && (opts.Dedupe != nil || opts.TileDir || c.Bool("publish-ipfs")) {
+			return fmt.Errorf("--shard-size packs files into shards, which --dedupe, --tile-dir and --publish-ipfs cannot be used with")
+		}
+		for _, s := range c.StringSlice("region") {
+			r, err := pixellock.ParseStegoRegion(s)
+			if err != nil {
+				return err
+			}
+			opts.Regions = append(opts.Regions, r)
+		}
+		if err := opts.Check(); err != nil {
+			return err
+		}
+		progress, finish, err := progressFromFlag(c)
+		if err != nil {
+			return err
+		}
+		metrics, writeMetrics := metricsFromFlag(c)
+		done := "Image encrypted"
+		if opts.MetadataOnly {
+			done = "Metadata encrypted"
+		}
+		opts.Progress = metrics.Progress(pixellock.PhaseEncrypt, reportFiles(done, progress))
+		defer finish()
+		defer writeMetrics()
+		var publisher *ipfsPublisher
+		if c.Bool("publish-ipfs") {
+			if publisher, err = newIPFSPublisher(c, outputPath); err != nil {
+				return err
+			}
+			opts.Progress = publisher.Progress(opts.Progress)
+		}
 
 		// Get key
 		var key []byte
-		var err error
 
 		// Check environment variable first
 		if keyBase64 == "" {
@@ -273,7 +459,7 @@ var encryptCmd = &cli.Command{
 
 		if keyBase64 == "" {
 			// Generate a new key
-			key, err = GenerateRandomKey()
+			key, err = pixellock.GenerateRandomKey()
 			if err != nil {
 				gookitcolor.Red.Println(fmt.Errorf("failed to generate key: %w", err))
 				return err
@@ -307,9 +493,9 @@ var encryptCmd = &cli.Command{
 				gookitcolor.Red.Println(fmt.Errorf("failed to decode key: %w", err))
 				return err
 			}
-			if len(key) != KeySize {
-				gookitcolor.Red.Println("invalid key size: key must be %d bytes when base64 decoded", KeySize)
-				return fmt.Errorf("invalid key size: key must be %d bytes when base64 decoded", KeySize)
+			if len(key) != pixellock.KeySize {
+				gookitcolor.Red.Println("invalid key size: key must be %d bytes when base64 decoded", pixellock.KeySize)
+				return fmt.Errorf("%w: key must be %d bytes when base64 decoded", pixellock.ErrInvalidKeySize, pixellock.KeySize)
 			}
 			if printKey {
 				gookitcolor.Green.Println("Using provided Key (base64 encoded):", base64.StdEncoding.EncodeToString(key))
@@ -317,110 +503,234 @@ var encryptCmd = &cli.Command{
 		}
 
 		// Check if the input is a file or a directory
-		fileInfo, err := os.Stat(inputPath)
+		fsys, err := transferFS(c, inputPath, outputPath)
+		if err != nil {
+			return err
+		}
+		fileInfo, err := fsys.Stat(inputPath)
 		if err != nil {
 			log.Printf("failed to stat input path: %v", err) // Use log for errors early
 			return err
 		}
+		// A URL is encrypted into the output directory, named as its
+		// server names it, unless the output names the file
+		if pixellock.IsHTTPURL(inputPath) && urlOutputIsDir(c, outputPath) {
+			outputPath = filepath.Join(outputPath, fileInfo.Name()+pixellock.EncryptedExtension)
+		}
+		// A shard set is packed from the files encrypted to a directory
+		// beside it
+		var shardSet, staging string
+		if shardSize > 0 {
+			shardSet = c.String("output")
+			if err := os.MkdirAll(filepath.Dir(filepath.Clean(shardSet)), 0o755); err != nil {
+				return err
+			}
+			if staging, err = os.MkdirTemp(filepath.Dir(filepath.Clean(shardSet)), ".pixellock-shards-*"); err != nil {
+				return err
+			}
+			defer os.RemoveAll(staging)
+			outputPath = staging
+			if !fileInfo.IsDir() {
+				outputPath = filepath.Join(staging, fileInfo.Name()+pixellock.EncryptedExtension)
+			}
+		}
 
+		encryptor, err := pixellock.NewEncryptor(
+			pixellock.WithEncryptOptions(opts),
+			pixellock.WithKey(key),
+			pixellock.WithOverwritePolicy(overwritePolicy(overwrite)),
+			pixellock.WithRecursive(recursive),
+			pixellock.WithWorkers(c.Int("workers")),
+			pixellock.WithLogger(logger),
+			pixellock.WithFS(fsys),
+		)
+		if err != nil {
+			return err
+		}
 		if fileInfo.IsDir() {
+			if opts.MetadataOnly {
+				return fmt.Errorf("--metadata-only encrypts a single image, not a directory")
+			}
 			// Process directory
-			return encryptDirectory(inputPath, outputPath, key, recursive, overwrite)
+			err = encryptor.ProcessDir(c.Context, inputPath, outputPath)
 		} else {
 			// Process single file
-			return encryptFile(inputPath, outputPath, key, overwrite)
+			err = encryptor.ProcessFile(c.Context, inputPath, outputPath)
+		}
+		if shardSet != "" {
+			// Pack what was encrypted, even when some files failed
+			n, packErr := pixellock.WriteShards(c.Context, key, staging, shardSet, pixellock.ShardOptions{Size: shardSize, Encrypted: true, Logger: logger})
+			if err = errors.Join(err, packErr); packErr == nil {
+				gookitcolor.Green.Printf("Packed %d files into the shard set %s\n", n, shardSet)
+			}
+		}
+		if opts.Dedupe != nil {
+			// Record what was encrypted, even when some files failed
+			if saveErr := opts.Dedupe.Save(); saveErr != nil {
+				err = errors.Join(err, saveErr)
+			} else if stats := opts.Dedupe.Stats(); stats.Duplicates > 0 {
+				gookitcolor.Green.Printf("Deduplicated %d images, saving %d bytes\n", stats.Duplicates, stats.Saved)
+			}
+		}
+		if publisher != nil {
+			// Publish what was encrypted, even when some files failed
+			err = errors.Join(err, publisher.Publish(c.Context, fileInfo.IsDir()))
 		}
+		return err
 	},
 }
 
-func encryptFile(inputFilename, outputFilename string, key []byte, overwrite bool) error {
-	// Check if the output file exists and if overwriting is allowed
-	if _, err := os.Stat(outputFilename); err == nil && !overwrite {
-		// File exists and overwrite is not allowed
-		gookitcolor.Yellow.Printf("Output file %s already exists.  Overwrite with --overwrite flag.\n", outputFilename)
-		return nil
+// ipfsAPIFlag is the flag of the IPFS node's API of the commands that
+// reach one.
+func ipfsAPIFlag() cli.Flag {
+	return &cli.StringFlag{
+		Name:  "ipfs-api",
+		Usage: "URL of the API of the IPFS node; $" + ipfs.EndpointEnv + ", or " + ipfs.DefaultEndpoint + " when it is not set",
 	}
+}
 
-	// Load image
-	img, err := LoadImage(inputFilename)
-	if err != nil {
-		log.Printf("failed to load image: %v", err) // Use log for errors
-		return err
+// ipfsClient returns the client of the IPFS node --ipfs-api names.
+func ipfsClient(c *cli.Context) (*ipfs.Client, error) {
+	cfg := ipfs.LoadConfig()
+	if endpoint := c.String("ipfs-api"); endpoint != "" {
+		cfg.Endpoint = endpoint
 	}
+	return ipfs.New(cfg)
+}
+
+// An ipfsPublisher collects the files an encrypt command writes, from its
+// progress events, and publishes them to IPFS once it is done.
+type ipfsPublisher struct {
+	client   *ipfs.Client
+	output   string
+	manifest string
+	pin      bool
+	written  []string
+}
 
-	// Convert image to bytes
-	imgBytes, err := ImageToBytes(img)
+// newIPFSPublisher returns the publisher of the files encrypt writes to
+// output, as its flags say.
+func newIPFSPublisher(c *cli.Context, output string) (*ipfsPublisher, error) {
+	if pixellock.IsS3URL(output) || pixellock.IsSFTPURL(output) {
+		return nil, errors.New("--publish-ipfs adds local files to IPFS, not remote ones")
+	}
+	client, err := ipfsClient(c)
 	if err != nil {
-		log.Printf("failed to convert image to bytes: %v", err) // Use log for errors
-		return err
+		return nil, err
 	}
+	return &ipfsPublisher{client: client, output: output, manifest: c.String("ipfs-manifest"), pin: c.Bool("ipfs-pin")}, nil
+}
 
-	// Encrypt the image bytes
-	ciphertext, err := Encrypt(key, imgBytes)
-	if err != nil {
-		log.Printf("failed to encrypt: %v", err) // Use log for errors
-		return err
+// Progress returns the callback recording each file written, then passing
+// its event on to next.
+func (p *ipfsPublisher) Progress(next func(pixellock.Event)) func(pixellock.Event) {
+	// The callback is given one event at a time, so needs no lock
+	return func(e pixellock.Event) {
+		if e.Phase == pixellock.PhaseWrite && e.Err == nil {
+			p.written = append(p.written, e.Output)
+		}
+		if next != nil {
+			next(e)
+		}
 	}
+}
 
-	// Save the encrypted data to a new file
-	err = os.MkdirAll(filepath.Dir(outputFilename), os.ModeDir|0755) // Ensure output directory exists
+// Publish adds the files written to IPFS and records them in the
+// manifest. Their paths are relative to the output directory, or to the
+// directory of the output file when a single image was encrypted.
+func (p *ipfsPublisher) Publish(ctx context.Context, dir bool) error {
+	root := p.output
+	if !dir {
+		root = filepath.Dir(p.output)
+	}
+	manifestName := p.manifest
+	if manifestName == "" {
+		manifestName = filepath.Join(root, pixellock.IPFSManifestName)
+	}
+	manifest, err := pixellock.ReadIPFSManifest(manifestName)
+	if errors.Is(err, os.ErrNotExist) {
+		manifest, err = &pixellock.IPFSManifest{}, nil
+	}
 	if err != nil {
-		log.Printf("failed to create output directory: %v", err) // Use log for errors
 		return err
 	}
-
-	err = ioutil.WriteFile(outputFilename, ciphertext, 0644)
-	if err != nil {
-		log.Printf("failed to write encrypted data to file: %v", err) // Use log for errors
+	files, err := pixellock.PublishIPFS(ctx, p.client, root, p.written, p.pin)
+	for _, f := range files {
+		logger.Info("published to IPFS", "path", f.Path, "cid", f.CID, "pinned", f.Pinned)
+	}
+	if len(files) == 0 {
 		return err
 	}
-
-	gookitcolor.Cyan.Println("Image encrypted and saved to:", outputFilename)
-	return nil
+	manifest.Set(files...)
+	if writeErr := manifest.WriteFile(manifestName); writeErr != nil {
+		return errors.Join(err, writeErr)
+	}
+	gookitcolor.Green.Printf("Published %d files to IPFS, listed in %s\n", len(files), manifestName)
+	return err
 }
 
-func encryptDirectory(inputDir, outputDir string, key []byte, recursive bool, overwrite bool) error {
-	var wg sync.WaitGroup
-	err := filepath.Walk(inputDir, func(path string, info os.FileInfo, err error) error {
+// fetchCmd downloads and decrypts the files a manifest of --publish-ipfs
+// lists.
+var fetchCmd = &cli.Command{
+	Name:      "fetch",
+	Usage:     "Download the files published with encrypt --publish-ipfs from IPFS and decrypt them into a directory",
+	ArgsUsage: "[<manifest>]",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:    "manifest",
+			Aliases: []string{"m"},
+			Usage:   "Manifest of the files to fetch, instead of the argument",
+		},
+		&cli.StringFlag{
+			Name:    "output",
+			Aliases: []string{"o"},
+			Value:   "decrypted_output",
+			Usage:   "Directory to decrypt the files into, laid out as the manifest lists them",
+		},
+		secret(&cli.StringFlag{
+			Name:    "key",
+			Aliases: []string{"k"},
+			Usage:   "Encryption key (base64 encoded); required unless --paste-key is given",
+		}),
+		pasteKeyFlag(),
+		ipfsAPIFlag(),
+		&cli.BoolFlag{
+			Name:  "overwrite",
+			Usage: "Overwrite existing files in the output directory without warning.",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		name := c.String("manifest")
+		switch {
+		case name == "" && c.NArg() == 1:
+			name = c.Args().First()
+		case name == "" || c.NArg() > 0:
+			return fmt.Errorf("fetch takes one manifest, with --manifest or as its argument after the flags, got %d arguments", c.NArg())
+		}
+		key, err := archiveKey(c)
 		if err != nil {
-			return err // Propagate the error
+			return err
 		}
-
-		if info.IsDir() && path != inputDir && !recursive {
-			return filepath.SkipDir // Skip subdirectories if not recursive
+		manifest, err := pixellock.ReadIPFSManifest(name)
+		if err != nil {
+			return err
 		}
-
-		if !info.IsDir() { // Only check files
-			if isImageFile(path) { // Use the file path
-				// Construct the output filename
-				relPath, err := filepath.Rel(inputDir, path)
-				if err != nil {
-					log.Printf("failed to get relative path: %v", err)
-					return err
-				}
-
-				outputFilename := filepath.Join(outputDir, relPath+EncryptedExtension) // Append .enc extension
-
-				wg.Add(1)
-				go func(p, o string) {
-					defer wg.Done()
-					err := encryptFile(p, o, key, overwrite)
-					if err != nil {
-						log.Printf("Error encrypting %s: %v\n", p, err)
-					}
-				}(path, outputFilename) // Encrypt each image file
-			}
+		client, err := ipfsClient(c)
+		if err != nil {
+			return err
 		}
-		return nil
-	})
-	wg.Wait() // Wait for all goroutines to complete
-
-	if err != nil {
-		log.Printf("error walking the path %s: %v", inputDir, err)
-		return err
-	}
-
-	return nil
+		decryptor, err := pixellock.NewDecryptor(
+			pixellock.WithKey(key),
+			pixellock.WithOverwritePolicy(overwritePolicy(c.Bool("overwrite"))),
+			pixellock.WithMaxPixels(maxPixels(c)),
+			pixellock.WithProgress(reportFiles("Image decrypted", nil)),
+			pixellock.WithLogger(logger),
+		)
+		if err != nil {
+			return err
+		}
+		return pixellock.FetchIPFS(c.Context, client, manifest, decryptor, c.String("output"))
+	},
 }
 
 // decryptCmd decrypts an image.
@@ -428,7 +738,7 @@ var decryptCmd = &cli.Command{
 	Name:    "decrypt",
 	Aliases: []string{"d"},
 	Usage:   "Decrypt an image or a directory of images",
-	Flags: []cli.Flag{
+	Flags: append([]cli.Flag{
 		&cli.StringFlag{
 			Name:     "input",
 			Aliases:  []string{"i"},
@@ -440,15 +750,15 @@ var decryptCmd = &cli.Command{
 			Name:    "output",
 			Aliases: []string{"o"},
 			Value:   "decrypted_output",
-			Usage:   "Output decrypted image file or directory",
-		},
-		&cli.StringFlag{
-			Name:     "key",
-			Aliases:  []string{"k"},
-			Value:    "",
-			Usage:    "Encryption key (base64 encoded)",
-			Required: true, // Key is now required for decryption
+			Usage:   "Output decrypted image file or directory; - writes a single image to standard output, and data-uri writes it there as a data URI",
 		},
+		secret(&cli.StringFlag{
+			Name:    "key",
+			Aliases: []string{"k"},
+			Value:   "",
+			Usage:   "Encryption key (base64 encoded); required unless --paste-key is given",
+		}),
+		pasteKeyFlag(),
 		&cli.BoolFlag{
 			Name:    "recursive",
 			Aliases: []string{"r"},
@@ -457,7 +767,7 @@ var decryptCmd = &cli.Command{
 		},
 		&cli.StringFlag{
 			Name:  "encrypted-ext",
-			Value: EncryptedExtension, // Default encrypted extension
+			Value: pixellock.EncryptedExtension, // Default encrypted extension
 			Usage: "The extension of encrypted files (e.g., .enc, .xyz)",
 		},
 		&cli.BoolFlag{
@@ -467,133 +777,546 @@ var decryptCmd = &cli.Command{
 		},
 		&cli.StringFlag{ // New flag for output format
 			Name:  "output-format",
-			Value: "png", // Default output format
-			Usage: "Output image format (png, jpg, jpeg)",
+			Usage: "Output image format (png, jpg, jpeg, gif, webp, tiff, bmp, ppm, pgm, heic for HEIC/HEIF images, or original or auto for the format the image was encrypted from, the default, with the extension of the output file fixed to match). WebP is always written lossless, BMP drops transparency, other formats keep only the first frame of an animation; TIFF uses deflate unless written as tiff:none or tiff:lzw, and PPM and PGM are binary unless written as ppm:ascii or pgm:ascii",
 		},
-	},
+		&cli.IntFlag{
+			Name:  "quality",
+			Value: pixellock.DefaultJPEGQuality,
+			Usage: "JPEG quality of the output image, from 1 (smallest) to 100 (best)",
+		},
+		&cli.StringFlag{
+			Name:  "png-compression",
+			Value: pixellock.PNGCompressionDefault,
+			Usage: "PNG compression of the output image: none, fast, default or best. Faster levels write larger files",
+		},
+		&cli.StringFlag{
+			Name:  "metadata",
+			Value: pixellock.MetadataPreserve,
+			Usage: "EXIF metadata carried by the encrypted image: preserve attaches it to JPEG, PNG and TIFF output; strip drops it, turning the image upright first",
+		},
+		&cli.StringFlag{
+			Name:  "mode",
+			Value: pixellock.ModeCipher,
+			Usage: "Mode the images were encrypted with: cipher or scramble. Scrambled and redacted images are recognized either way; scramble makes directories default to the " + pixellock.ScrambledExtension + " extension",
+		},
+		&cli.StringFlag{
+			Name:  "resize",
+			Usage: "Scale the decrypted image to fit WIDTHxHEIGHT, keeping its aspect ratio; leave out a side, as in 2048x or x768, to only bound the other, or scale by a percentage, as in 50%",
+		},
+		&cli.BoolFlag{
+			Name:  "allow-upscale",
+			Usage: "Let --resize enlarge images smaller than its size; they are left as they are otherwise",
+		},
+		&cli.BoolFlag{
+			Name:  "auto-orient",
+			Usage: "Turn the image upright for its EXIF orientation even when the EXIF metadata is kept, which then records it as upright",
+		},
+		&cli.StringFlag{
+			Name:  "tile-region",
+			Usage: "Decrypt only the region x,y,width,height of an image encrypted with --tile, reading just the tiles covering it",
+		},
+		&cli.BoolFlag{
+			Name:  "split-pages",
+			Usage: "Write each page of a multi-page TIFF to its own file, named like scan_p001.png, instead of one multi-page TIFF",
+		},
+		&cli.BoolFlag{
+			Name:  "base64",
+			Usage: "With --output -, write the image base64 encoded",
+		},
+		&cli.IntFlag{
+			Name:  "max-bytes",
+			Value: pixellock.DefaultMaxStdoutBytes,
+			Usage: "Refuse to write an image larger than this many bytes to standard output; 0 for no limit",
+		},
+		&cli.BoolFlag{
+			Name:  "metadata-only",
+			Usage: "Attach the metadata encrypted with encrypt --metadata-only, from the image or its " + pixellock.MetadataSidecarExtension + " sidecar, back to the image, provided its pixels are unchanged",
+		},
+		&cli.StringSliceFlag{
+			Name:  "tag",
+			Usage: "Decrypt only the files of a directory with this tag, as key=value, or key alone for any value (repeatable); see pixellock tag",
+		},
+		shardPathFlag("decrypt"),
+		skipExistingFlag(),
+		identityFlag(),
+		knownHostsFlag(),
+		insecureIgnoreHostKeyFlag(),
+		workersFlag(),
+		progressFlag(),
+		metricsOutFlag(),
+	}, watermarkFlags("watermark-")...),
 	Action: func(c *cli.Context) error {
 		inputPath := c.String("input")
 		outputPath := c.String("output")
-		keyBase64 := c.String("key")
 		recursive := c.Bool("recursive")
 		encryptedExt := c.String("encrypted-ext")
-		overwrite := c.Bool("overwrite")
-		outputFormat := c.String("output-format") // Retrieve output format
-
-		// Decode the key from base64
-		key, err := base64.StdEncoding.DecodeString(keyBase64)
+		overwrite, err := overwriteFromFlags(c)
 		if err != nil {
-			log.Printf("failed to decode key: %v", err)
 			return err
 		}
-
-		if len(key) != KeySize {
-			log.Printf("invalid key size: key must be %d bytes when base64 decoded", KeySize)
-			return fmt.Errorf("invalid key size: key must be %d bytes when base64 decoded", KeySize)
-		}
+		mode := c.String("mode")
+		save := pixellock.SaveOptions{Format: c.String("output-format"), Quality: c.Int("quality"), PNGCompression: c.String("png-compression"), Metadata: c.String("metadata"), AutoOrient: c.Bool("auto-orient"), SplitPages: c.Bool("split-pages"), MetadataOnly: c.Bool("metadata-only"), MaxPixels: maxPixels(c)}
+		if s := c.String("resize"); s != "" {
+			var err error
+			if save.Resize, err = pixellock.ParseResize(s); err != nil {
+				return err
+			}
+			save.Resize.AllowUpscale = c.Bool("allow-upscale")
+		}
+		keyBase64, err := keyOrPastedKey(c)
+		if err != nil {
+			return err
+		}
+		if keyBase64 == "" {
+			return errors.New("no key: give it with --key or --paste-key")
+		}
+		if save.Tags, err = pixellock.ParseTags(c.StringSlice("tag")); err != nil {
+			return err
+		}
+		if save.Watermark, err = watermarkFromFlags(c, "watermark-"); err != nil {
+			return err
+		}
+		if s := c.String("tile-region"); s != "" {
+			if save.TileRegion, err = pixellock.ParseTileRegion(s); err != nil {
+				return err
+			}
+		}
+		progress, finish, err := progressFromFlag(c)
+		if err != nil {
+			return err
+		}
+		metrics, writeMetrics := metricsFromFlag(c)
+		done := "Image decrypted"
+		if save.MetadataOnly {
+			done = "Metadata decrypted"
+		}
+		save.Progress = metrics.Progress(pixellock.PhaseDecrypt, reportFiles(done, progress))
+		defer finish()
+		defer writeMetrics()
+
+		// Decode the key from base64
+		key, err := base64.StdEncoding.DecodeString(keyBase64)
+		if err != nil {
+			log.Printf("failed to decode key: %v", err)
+			return err
+		}
+
+		if len(key) != pixellock.KeySize {
+			log.Printf("invalid key size: key must be %d bytes when base64 decoded", pixellock.KeySize)
+			return fmt.Errorf("%w: key must be %d bytes when base64 decoded", pixellock.ErrInvalidKeySize, pixellock.KeySize)
+		}
+		if err := pixellock.CheckJPEGQuality(save.Quality); err != nil {
+			return err
+		}
+		if err := pixellock.CheckPNGCompression(save.PNGCompression); err != nil {
+			return err
+		}
+		if err := pixellock.CheckMetadataMode(save.Metadata); err != nil {
+			return err
+		}
+		if err := pixellock.CheckMode(mode); err != nil {
+			return err
+		}
+		if mode == pixellock.ModeScramble && !c.IsSet("encrypted-ext") {
+			encryptedExt = pixellock.ScrambledExtension
+		}
 
 		// Check if the input is a file or a directory
-		fileInfo, err := os.Stat(inputPath)
+		fsys, err := transferFS(c, inputPath, outputPath)
+		if err != nil {
+			return err
+		}
+		fileInfo, err := fsys.Stat(inputPath)
 		if err != nil {
 			log.Printf("failed to stat input path: %v", err)
 			return err
 		}
 
-		if fileInfo.IsDir() {
+		if c.Bool("base64") && outputPath != pixellock.StdoutOutput {
+			return fmt.Errorf("--base64 needs --output %s", pixellock.StdoutOutput)
+		}
+		if err := save.CheckMetadataOnly(); err != nil {
+			return err
+		}
+		if save.MetadataOnly && pixellock.IsStdoutOutput(outputPath) {
+			return fmt.Errorf("--metadata-only writes the image to a file, not to standard output")
+		}
+		if (pixellock.IsS3URL(inputPath) || pixellock.IsSFTPURL(inputPath)) && pixellock.IsStdoutOutput(outputPath) {
+			return fmt.Errorf("only a local file can be decrypted to standard output")
+		}
+		decryptor, err := pixellock.NewDecryptor(
+			pixellock.WithSaveOptions(save),
+			pixellock.WithKey(key),
+			pixellock.WithOverwritePolicy(overwritePolicy(overwrite)),
+			pixellock.WithRecursive(recursive),
+			pixellock.WithWorkers(c.Int("workers")),
+			pixellock.WithEncryptedExtension(encryptedExt),
+			pixellock.WithLogger(logger),
+			pixellock.WithFS(fsys),
+		)
+		if err != nil {
+			return err
+		}
+		if fileInfo.IsDir() && pixellock.IsShardSet(inputPath) {
+			if len(save.Tags) > 0 || pixellock.IsStdoutOutput(outputPath) || save.MetadataOnly {
+				return fmt.Errorf("a shard set is decrypted to a directory, without --tag or --metadata-only")
+			}
+			return decryptShards(c, key, inputPath, outputPath, save)
+		} else if c.IsSet("path") {
+			return fmt.Errorf("--path picks files of a shard set, and %s is not one", inputPath)
+		}
+		if len(save.Tags) > 0 && (!fileInfo.IsDir() || pixellock.IsTiled(inputPath)) {
+			return fmt.Errorf("--tag picks files of a directory, not a single file")
+		}
+		if fileInfo.IsDir() && !pixellock.IsTiled(inputPath) {
+			if save.MetadataOnly {
+				return fmt.Errorf("--metadata-only decrypts a single image, not a directory")
+			}
+			if pixellock.IsStdoutOutput(outputPath) {
+				return fmt.Errorf("only a single file can be decrypted to standard output")
+			}
 			// Process directory
-			return decryptDirectory(inputPath, outputPath, key, recursive, encryptedExt, overwrite, outputFormat)
+			return decryptor.ProcessDir(c.Context, inputPath, outputPath)
+		} else if pixellock.IsStdoutOutput(outputPath) {
+			// Write the image alone to standard output
+			return decryptToStdout(inputPath, outputPath, key, save, c.Bool("base64"), c.Int("max-bytes"))
 		} else {
 			// Process single file
-			return decryptFile(inputPath, outputPath, key, overwrite, outputFormat)
+			return decryptor.ProcessFile(c.Context, inputPath, outputPath)
 		}
 	},
 }
 
-func decryptFile(inputFilename, outputFilename string, key []byte, overwrite bool, outputFormat string) error {
-	// Check if the output file exists and if overwriting is allowed
-	if _, err := os.Stat(outputFilename); err == nil && !overwrite {
-		// File exists and overwrite is not allowed
-		gookitcolor.Yellow.Printf("Output file %s already exists.  Overwrite with --overwrite flag.\n", outputFilename)
-		return nil
-	}
-	// Read the encrypted data from the file
-	ciphertext, err := ioutil.ReadFile(inputFilename)
+// decryptShards decrypts the images of the shard set in dir, or those
+// --path picks, to the directory output.
+func decryptShards(c *cli.Context, key []byte, dir, output string, save pixellock.SaveOptions) error {
+	set, err := pixellock.OpenShards(c.Context, dir, key)
 	if err != nil {
-		log.Printf("failed to read encrypted file: %v", err)
 		return err
 	}
-
-	// Decrypt the data
-	plaintext, err := Decrypt(key, ciphertext)
+	entries, err := set.Select(c.StringSlice("path"))
 	if err != nil {
-		log.Printf("failed to decrypt: %v", err)
 		return err
 	}
+	save.Logger = logger
+	return set.Decrypt(c.Context, entries, output, c.Bool("overwrite"), save)
+}
 
-	// Convert the decrypted bytes back to an image
-	img, err := BytesToImage(plaintext)
-	if err != nil {
-		log.Printf("failed to convert decrypted bytes to image: %v", err)
-		return err
+// workersFlag is the flag of the number of files encrypted or decrypted at
+// once.
+func workersFlag() cli.Flag {
+	return &cli.IntFlag{
+		Name:    "workers",
+		Aliases: []string{"jobs"},
+		Usage:   "Files processed concurrently in a directory, each downloaded and uploaded on its own when in S3 (default: number of CPUs)",
+	}
+}
+
+// skipExistingFlag is the flag of encrypt and decrypt leaving the outputs
+// there already alone, as they do without --overwrite.
+func skipExistingFlag() cli.Flag {
+	return &cli.BoolFlag{
+		Name:  "skip-existing",
+		Usage: "Leave the outputs there already alone, to resume a run that was interrupted; files left unfinished are written again. The default, but refuses --overwrite",
 	}
+}
+
+// overwriteFromFlags returns whether --overwrite is set, failing when
+// --skip-existing is too.
+func overwriteFromFlags(c *cli.Context) (bool, error) {
+	if c.Bool("overwrite") && c.Bool("skip-existing") {
+		return false, errors.New("--overwrite and --skip-existing cannot be used together")
+	}
+	return c.Bool("overwrite"), nil
+}
+
+// identityFlag is the flag of the private key sftp:// URLs authenticate
+// with.
+func identityFlag() cli.Flag {
+	return &cli.StringFlag{
+		Name:  "identity",
+		Usage: "When --input or --output is an sftp:// URL, the private key `FILE` to authenticate with, before the keys of the SSH agent",
+	}
+}
+
+// knownHostsFlag is the flag of the known_hosts files sftp:// servers are
+// checked against.
+func knownHostsFlag() cli.Flag {
+	return &cli.StringSliceFlag{
+		Name:  "known-hosts",
+		Usage: "When --input or --output is an sftp:// URL, a known_hosts `FILE` to check the server's host key against (repeatable); ~/.ssh/known_hosts by default",
+	}
+}
+
+// insecureIgnoreHostKeyFlag is the flag accepting any host key of an
+// sftp:// server.
+func insecureIgnoreHostKeyFlag() cli.Flag {
+	return &cli.BoolFlag{
+		Name:  "insecure-ignore-hostkey",
+		Usage: "When --input or --output is an sftp:// URL, accept any host key rather than checking it against known_hosts, so that whoever intercepts the connection sees the files",
+	}
+}
+
+// maxPixelsFlag limits the pixels of the images encrypted, decrypted and
+// converted.
+var maxPixelsFlag = &cli.Int64Flag{
+	Name:  "max-pixels",
+	Value: pixellock.DefaultMaxPixels,
+	Usage: "Refuse images claiming more than this many pixels, width by height, rather than decoding them to encrypt, decrypt or convert; 0 for no limit",
+}
+
+// maxPixels returns the MaxPixels option of maxPixelsFlag, whose 0 lifts
+// the limit; the library default when the app has no such flag.
+func maxPixels(c *cli.Context) int64 {
+	if n := c.Int64(maxPixelsFlag.Name); n != 0 || !c.IsSet(maxPixelsFlag.Name) {
+		return n
+	}
+	return -1
+}
+
+// overwritePolicy returns the policy of the --overwrite flag.
+func overwritePolicy(overwrite bool) pixellock.OverwritePolicy {
+	if overwrite {
+		return pixellock.OverwriteReplace
+	}
+	return pixellock.OverwriteSkip
+}
 
-	// Save the decrypted image to a file
-	err = os.MkdirAll(filepath.Dir(outputFilename), os.ModeDir|0755) // Ensure output directory exists
+// decryptToStdout decrypts the file at inputFilename and writes the image to
+// standard output as output says, with every note going to standard error,
+// so that standard output carries nothing but the image.
+func decryptToStdout(inputFilename, output string, key []byte, save pixellock.SaveOptions, asBase64 bool, maxBytes int) error {
+	data, format, notes, err := pixellock.DecryptImageBytes(inputFilename, key, save)
+	for _, note := range notes {
+		fmt.Fprintf(os.Stderr, "%s: %s.\n", inputFilename, note)
+	}
 	if err != nil {
-		log.Printf("failed to create output directory: %v", err)
+		log.Printf("failed to decrypt: %v", err)
 		return err
 	}
-
-	err = SaveImage(outputFilename, img, outputFormat) // Pass outputFormat to SaveImage
+	out, err := pixellock.StdoutImage(data, format, output, asBase64, maxBytes)
 	if err != nil {
-		log.Printf("failed to save decrypted image: %v", err)
 		return err
 	}
-
-	gookitcolor.Cyan.Println("Image decrypted and saved to:", outputFilename)
-	return nil
+	_, err = os.Stdout.Write(out)
+	return err
 }
 
-func decryptDirectory(inputDir, outputDir string, key []byte, recursive bool, encryptedExt string, overwrite bool, outputFormat string) error {
-	var wg sync.WaitGroup
-	err := filepath.Walk(inputDir, func(path string, info os.FileInfo, err error) error {
+var archiveCmd = &cli.Command{
+	Name:  "archive",
+	Usage: "Archive a whole directory, files of any kind, as one encrypted file",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:     "input",
+			Aliases:  []string{"i"},
+			Usage:    "Directory to archive",
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:     "output",
+			Aliases:  []string{"o"},
+			Usage:    "Archive file to write, conventionally " + pixellock.ArchiveExtension + "; - writes it to standard output",
+			Required: true,
+		},
+		secret(&cli.StringFlag{
+			Name:    "key",
+			Aliases: []string{"k"},
+			Usage:   "Encryption key (base64 encoded); required unless --paste-key is given",
+		}),
+		pasteKeyFlag(),
+		&cli.BoolFlag{
+			Name:  "images-only",
+			Usage: "Archive only the images pixellock can load, and the directories",
+		},
+		&cli.BoolFlag{
+			Name:  "overwrite",
+			Usage: "Overwrite the archive file if it exists.",
+		},
+		shardSizeFlag("Pack the files into a shard set, the --output directory, of shards of this size (e.g. 64MiB) with an encrypted index, which extract reads files from one at a time; a set there already is appended to, replacing files of the same path"),
+	},
+	Action: func(c *cli.Context) error {
+		input, output := c.String("input"), c.String("output")
+		key, err := archiveKey(c)
 		if err != nil {
-			return err // Propagate the error
+			return err
 		}
-
-		if info.IsDir() && path != inputDir && !recursive {
-			return filepath.SkipDir // Skip subdirectories if not recursive
+		if rel, err := filepath.Rel(input, output); err == nil && filepath.IsLocal(rel) {
+			return fmt.Errorf("the archive cannot be written inside %s, the directory it archives", input)
 		}
-
-		if !info.IsDir() && strings.HasSuffix(info.Name(), encryptedExt) { // Decrypt only .enc files
-			// Construct the output filename
-			relPath, err := filepath.Rel(inputDir, path)
+		shardSize, err := shardSizeFromFlag(c, output)
+		if err != nil {
+			return err
+		}
+		if shardSize > 0 {
+			n, err := pixellock.WriteShards(c.Context, key, input, output, pixellock.ShardOptions{Size: shardSize, ImagesOnly: c.Bool("images-only"), Logger: logger})
 			if err != nil {
-				log.Printf("failed to get relative path: %v", err)
 				return err
 			}
+			gookitcolor.Green.Printf("Packed %d files into the shard set %s\n", n, output)
+			return nil
+		}
+		opts := pixellock.ArchiveOptions{ImagesOnly: c.Bool("images-only"), Logger: logger}
+		if pixellock.IsStdoutOutput(output) {
+			return pixellock.WriteArchive(c.Context, key, os.Stdout, input, opts)
+		}
+		if _, err := os.Stat(output); err == nil && !c.Bool("overwrite") {
+			return fmt.Errorf("%s already exists; overwrite it with --overwrite", output)
+		}
+		f, err := os.Create(output)
+		if err != nil {
+			return err
+		}
+		err = pixellock.WriteArchive(c.Context, key, f, input, opts)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			// Half an archive is of no use
+			os.Remove(output)
+			return err
+		}
+		return nil
+	},
+}
 
-			outputFilename := filepath.Join(outputDir, strings.TrimSuffix(relPath, encryptedExt)) // Remove .enc extension
+var extractCmd = &cli.Command{
+	Name:      "extract",
+	Usage:     "Extract an archive or shard set written by archive, or list what it holds",
+	ArgsUsage: "[<archive>]",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:    "input",
+			Aliases: []string{"i"},
+			Usage:   "Archive or shard set directory to extract, instead of the argument; - reads an archive from standard input",
+		},
+		&cli.StringFlag{
+			Name:    "output",
+			Aliases: []string{"o"},
+			Value:   "extracted_output",
+			Usage:   "Directory to extract the archive into",
+		},
+		secret(&cli.StringFlag{
+			Name:    "key",
+			Aliases: []string{"k"},
+			Usage:   "Encryption key (base64 encoded); required unless --paste-key is given",
+		}),
+		pasteKeyFlag(),
+		&cli.BoolFlag{
+			Name:  "list",
+			Usage: "List the files and directories in the archive instead of extracting it",
+		},
+		&cli.BoolFlag{
+			Name:  "overwrite",
+			Usage: "Overwrite existing files in the output directory without warning.",
+		},
+		shardPathFlag("extract"),
+	},
+	Action: func(c *cli.Context) error {
+		name := c.String("input")
+		switch {
+		case name == "" && c.NArg() == 1:
+			name = c.Args().First()
+		case name == "" || c.NArg() > 0:
+			return fmt.Errorf("extract takes one archive, with --input or as its argument after the flags, got %d arguments", c.NArg())
+		}
+		key, err := archiveKey(c)
+		if err != nil {
+			return err
+		}
+		if pixellock.IsShardSet(name) {
+			return extractShards(c, key, name)
+		} else if c.IsSet("path") {
+			return fmt.Errorf("--path picks files of a shard set, and %s is not one", name)
+		}
+		src := io.Reader(os.Stdin)
+		if name != "-" {
+			f, err := os.Open(name)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			src = f
+		}
+		if c.Bool("list") {
+			return pixellock.ListArchive(c.Context, key, src, func(e pixellock.ArchiveEntry) error {
+				fmt.Printf("%s %10d %s %s\n", e.Mode, e.Size, e.ModTime.Format(time.DateTime), e.Name)
+				return nil
+			})
+		}
+		opts := pixellock.ArchiveOptions{Logger: logger}
+		return pixellock.ExtractArchive(c.Context, key, src, c.String("output"), c.Bool("overwrite"), opts)
+	},
+}
 
-			wg.Add(1)
-			go func(p, o string) {
-				defer wg.Done()
-				err := decryptFile(p, o, key, overwrite, outputFormat) // Pass outputFormat
-				if err != nil {
-					log.Printf("Error decrypting %s: %v\n", p, err)
-				}
-			}(path, outputFilename) // Decrypt each image file
+// extractShards extracts the files of the shard set in dir, or those
+// --path picks, or lists them.
+func extractShards(c *cli.Context, key []byte, dir string) error {
+	set, err := pixellock.OpenShards(c.Context, dir, key)
+	if err != nil {
+		return err
+	}
+	entries, err := set.Select(c.StringSlice("path"))
+	if err != nil {
+		return err
+	}
+	if c.Bool("list") {
+		for _, e := range entries {
+			fmt.Printf("%s %10d %s %s\n", e.Mode, e.Size, e.ModTime.Format(time.DateTime), e.Path)
 		}
 		return nil
-	})
+	}
+	return set.Extract(c.Context, entries, c.String("output"), c.Bool("overwrite"), logger)
+}
+
+// shardSizeFlag is the --shard-size flag of the commands that write shard
+// sets, with usage.
+func shardSizeFlag(usage string) cli.Flag {
+	return &cli.StringFlag{
+		Name:  "shard-size",
+		Usage: usage,
+	}
+}
 
-	wg.Wait()
+// shardSizeFromFlag returns the size of --shard-size, or 0 when it is not
+// given, checking that output, where the shard set goes, is a local
+// directory.
+func shardSizeFromFlag(c *cli.Context, output string) (int64, error) {
+	s := c.String("shard-size")
+	if s == "" {
+		return 0, nil
+	}
+	size, err := parseByteSize(s)
 	if err != nil {
-		log.Printf("error walking the path %s: %v", inputDir, err)
-		return err
+		return 0, fmt.Errorf("invalid shard size %q: %w", s, err)
+	}
+	if size < pixellock.MinShardSize {
+		return 0, fmt.Errorf("invalid shard size %q: must be at least %d bytes", s, pixellock.MinShardSize)
+	}
+	if pixellock.IsStdoutOutput(output) || pixellock.IsS3URL(output) || pixellock.IsSFTPURL(output) || pixellock.IsHTTPURL(output) {
+		return 0, fmt.Errorf("--shard-size writes a shard set to a local directory, not %s", output)
 	}
+	return size, nil
+}
 
-	return nil
+// shardPathFlag is the --path flag of the commands that read shard sets.
+func shardPathFlag(command string) cli.Flag {
+	return &cli.StringSliceFlag{
+		Name:  "path",
+		Usage: "With a shard set, " + command + " only this file or directory of it (repeatable), reading just the shards it is in",
+	}
+}
+
+// archiveKey returns the key of archive and extract, given with --key or
+// --paste-key.
+func archiveKey(c *cli.Context) ([]byte, error) {
+	keyBase64, err := keyOrPastedKey(c)
+	if err != nil {
+		return nil, err
+	}
+	if keyBase64 == "" {
+		return nil, errors.New("no key: give it with --key or --paste-key")
+	}
+	return pixellock.DecodeKey(keyBase64)
 }
 
 var keygenCmd = &cli.Command{
@@ -605,17 +1328,34 @@ var keygenCmd = &cli.Command{
 			Value: "",
 			Usage: "File to save the generated key to",
 		},
+		&cli.StringFlag{
+			Name:  "keyring",
+			Usage: "Save the generated key in the keyring under this name, for --key-from keyring:NAME",
+		},
+		copyFlag("Copy the key to the clipboard instead of printing it"),
+		clearAfterFlag(),
 	},
 	Action: func(c *cli.Context) error {
 		keyFile := c.String("output")
-		key, err := GenerateRandomKey()
+		key, err := pixellock.GenerateRandomKey()
 		if err != nil {
 			log.Printf("failed to generate key: %v", err)
 			return err
 		}
-
 		keyBase64Encoded := base64.StdEncoding.EncodeToString(key)
 
+		if name := c.String("keyring"); name != "" {
+			path, err := pixellock.WriteKeyring(name, key)
+			if err != nil {
+				return err
+			}
+			gookitcolor.Green.Println("Key saved to keyring:", path)
+			if c.Bool("copy") {
+				return copyToClipboard(c, "Key", keyBase64Encoded)
+			}
+			return nil
+		}
+
 		if keyFile != "" {
 			// Save the key to a file
 			err = ioutil.WriteFile(keyFile, []byte(keyBase64Encoded), 0600) // Permissions 0600: read/write for owner only
@@ -623,168 +1363,3349 @@ var keygenCmd = &cli.Command{
 				log.Printf("failed to save key to file: %v", err)
 				return err
 			}
-			gookitcolor.Green.Println("Generated Key (base64 encoded):", keyBase64Encoded)
-			gookitcolor.Green.Println("Key saved to file:", keyFile)
+		}
+		if c.Bool("copy") {
+			err = copyToClipboard(c, "Key", keyBase64Encoded)
 		} else {
 			gookitcolor.Green.Println("Generated Key (base64 encoded):", keyBase64Encoded)
 		}
-
-		return nil
+		if keyFile != "" {
+			gookitcolor.Green.Println("Key saved to file:", keyFile)
+		}
+		return err
 	},
 }
 
-// steganographyCmd implements steganography features
-var steganographyCmd = &cli.Command{
-	Name:  "stego",
-	Usage: "Hide or reveal a message within an image using steganography",
+// keyCmd hides a key inside a cover image and recovers it again
+var keyCmd = &cli.Command{
+	Name:  "key",
+	Usage: "Back up an encryption key inside an innocuous image",
 	Subcommands: []*cli.Command{
 		{
 			Name:  "hide",
-			Usage: "Hide a message within an image",
+			Usage: "Hide a key file inside a cover image, scattered and encrypted with a password",
 			Flags: []cli.Flag{
 				&cli.StringFlag{
-					Name:     "input",
-					Aliases:  []string{"i"},
-					Value:    "",
-					Usage:    "Input image file",
+					Name:     "keyfile",
+					Usage:    "Key file to hide, as written by keygen",
 					Required: true,
 				},
 				&cli.StringFlag{
-					Name:     "output",
-					Aliases:  []string{"o"},
-					Value:    "stego_output.png",
-					Usage:    "Output stego image file",
+					Name:     "cover",
+					Usage:    "Cover image to hide the key in",
 					Required: true,
 				},
 				&cli.StringFlag{
-					Name:     "message",
-					Aliases:  []string{"m"},
-					Value:    "",
-					Usage:    "Message to hide",
+					Name:     "output",
+					Aliases:  []string{"o"},
+					Usage:    "Output image; its extension picks a lossless format (png when none)",
 					Required: true,
 				},
-				&cli.StringFlag{ // New flag for output format
-					Name:  "output-format",
-					Value: "png", // Default output format
-					Usage: "Output image format (png, jpg, jpeg)",
-				},
+				secret(&cli.StringFlag{
+					Name:     "password",
+					Usage:    "Password protecting the hidden key",
+					Required: true,
+				}),
 			},
 			Action: func(c *cli.Context) error {
-				inputPath := c.String("input")
-				outputPath := c.String("output")
-				message := c.String("message")
-				outputFormat := c.String("output-format")
-
-				if len(message) > StegoMessageLimit {
-					gookitcolor.Red.Println("Message too long. Max message length is", StegoMessageLimit, "characters.")
-					return fmt.Errorf("message too long. Max message length is %d characters", StegoMessageLimit)
+				output := c.String("output")
+				outputFormat := strings.ToLower(strings.TrimPrefix(filepath.Ext(output), "."))
+				if outputFormat == "" {
+					outputFormat = "png"
 				}
-
-				return hideMessage(inputPath, outputPath, message, outputFormat)
+				key, err := pixellock.ReadKeyfile(c.String("keyfile"))
+				if err != nil {
+					gookitcolor.Red.Println(err)
+					return err
+				}
+				if err := pixellock.HideKey(c.String("cover"), output, key, c.String("password"), outputFormat); err != nil {
+					gookitcolor.Red.Println(err)
+					return err
+				}
+				gookitcolor.Green.Println("Key hidden in", output, "and verified")
+				gookitcolor.Yellow.Println("WARNING: this image may be the only copy of the key. Keep another backup.")
+				gookitcolor.Yellow.Println("WARNING: resizing, recompressing or converting the image to a lossy format destroys the key; many photo and chat services do this on upload.")
+				return nil
 			},
 		},
 		{
-			Name:  "reveal",
-			Usage: "Reveal a hidden message from an image",
+			Name:  "recover",
+			Usage: "Recover a key hidden with key hide",
 			Flags: []cli.Flag{
 				&cli.StringFlag{
-					Name:     "input",
-					Aliases:  []string{"i"},
-					Value:    "",
-					Usage:    "Input stego image file",
+					Name:     "from-image",
+					Usage:    "Image the key is hidden in",
 					Required: true,
 				},
+				secret(&cli.StringFlag{
+					Name:     "password",
+					Usage:    "Password the key was hidden with",
+					Required: true,
+				}),
+				&cli.StringFlag{
+					Name:    "output",
+					Aliases: []string{"o"},
+					Usage:   "Save the key to this key file instead of printing it",
+				},
 			},
 			Action: func(c *cli.Context) error {
-				inputPath := c.String("input")
-				message, err := revealMessage(inputPath)
+				key, err := pixellock.RecoverKey(c.String("from-image"), c.String("password"))
 				if err != nil {
-					gookitcolor.Red.Println(fmt.Errorf("failed to reveal message: %w", err))
+					gookitcolor.Red.Println(err)
+					return err
+				}
+				keyBase64Encoded := base64.StdEncoding.EncodeToString(key)
+				keyFile := c.String("output")
+				if keyFile == "" {
+					gookitcolor.Green.Println("Recovered Key (base64 encoded):", keyBase64Encoded)
+					return nil
+				}
+				if err := os.WriteFile(keyFile, []byte(keyBase64Encoded), 0600); err != nil {
+					log.Printf("failed to save key to file: %v", err)
 					return err
 				}
-				gookitcolor.Green.Println("Hidden Message:", message)
+				gookitcolor.Green.Println("Key saved to file:", keyFile)
 				return nil
 			},
 		},
 	},
 }
 
-// hideMessage hides a message within an image using LSB steganography
-// hideMessage hides a message within an image using LSB steganography
-func hideMessage(inputFilename, outputFilename, message string, outputFormat string) error {
-	img, err := LoadImage(inputFilename)
-	if err != nil {
-		log.Printf("failed to load image: %v", err)
-		return err
-	}
-
-	// Convert to RGBA
-	b := img.Bounds()
-	rgbaImg := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
-	draw.Draw(rgbaImg, rgbaImg.Bounds(), img, b.Min, draw.Src)
-
-	bounds := rgbaImg.Bounds()
-	width, height := bounds.Max.X, bounds.Max.Y
-	message += "\x00" // Null terminate the message
-
-	messageIndex := 0
-	for y := 0; y < height; y++ {
-		for x := 0; x < width; x++ {
-			if messageIndex < len(message) {
-				r, g, b, a := rgbaImg.At(x, y).RGBA()
-				// Modify the least significant bit of the red channel to store the message
-				r = (r &^ 1) | uint32(message[messageIndex]>>7)
-				g = (g &^ 1) | uint32((message[messageIndex]>>6)&1)
-				b = (b &^ 1) | uint32((message[messageIndex]>>5)&1)
-				a = (a &^ 1) | uint32((message[messageIndex]>>4)&1)
-				rgbaImg.SetRGBA(x, y, color.RGBA{uint8(r), uint8(g), uint8(b), uint8(a)})
-				messageIndex++
-			}
+var infoCmd = &cli.Command{
+	Name:  "info",
+	Usage: "Describe an encrypted file without its key, or the image inside it too given the key",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:     "input",
+			Aliases:  []string{"i"},
+			Usage:    "Encrypted file",
+			Required: true,
+		},
+		secret(&cli.StringFlag{
+			Name:    "key",
+			Aliases: []string{"k"},
+			Usage:   "Decryption key (base64 encoded), to also describe the image, its format, size and pages, and read the file's tags",
+		}),
+	},
+	Action: func(c *cli.Context) error {
+		input := c.String("input")
+		info, err := pixellock.InspectEncrypted(input)
+		if err != nil {
+			gookitcolor.Red.Println(err)
+			return err
+		}
+		gookitcolor.Cyan.Printf("%s: %s, %d bytes\n", input, info.Kind, info.Size)
+		if info.Tagged && c.String("key") == "" {
+			fmt.Println("Tags: encrypted; give -k to read them")
+		}
+		switch {
+		case info.Thumbnail == image.Point{}:
+			fmt.Println("Thumbnail: none")
+		case info.ThumbnailFile != "":
+			fmt.Printf("Thumbnail: %dx%d, in %s\n", info.Thumbnail.X, info.Thumbnail.Y, info.ThumbnailFile)
+		default:
+			fmt.Printf("Thumbnail: %dx%d, embedded\n", info.Thumbnail.X, info.Thumbnail.Y)
+		}
+		if c.String("key") == "" {
+			return nil
+		}
+
+		key, err := pixellock.DecodeKey(c.String("key"))
+		if err != nil {
+			gookitcolor.Red.Println(err)
+			return err
+		}
+		decrypted, err := pixellock.InspectDecrypted(input, key)
+		if err != nil {
+			gookitcolor.Red.Println(err)
+			return err
+		}
+		if decrypted.Size == (image.Point{}) {
+			fmt.Printf("Image: %s\n", decrypted.Format)
+		} else {
+			fmt.Printf("Image: %s, %dx%d\n", decrypted.Format, decrypted.Size.X, decrypted.Size.Y)
+		}
+		fmt.Printf("Pages: %d\n", decrypted.Pages)
+		if !decrypted.Taken.IsZero() {
+			fmt.Printf("Taken: %s\n", decrypted.Taken.Format(time.DateTime))
+		}
+		if info.Tagged {
+			tags, err := pixellock.ReadTags(input, key)
+			if err != nil {
+				gookitcolor.Red.Println(err)
+				return err
+			}
+			fmt.Printf("Tags: %s\n", tags)
+		}
+		return nil
+	},
+}
+
+var thumbsCmd = &cli.Command{
+	Name:  "thumbs",
+	Usage: "Regenerate the unencrypted previews of encrypted images, given their key",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:     "input",
+			Aliases:  []string{"i"},
+			Usage:    "Encrypted file or directory",
+			Required: true,
+		},
+		secret(&cli.StringFlag{
+			Name:     "key",
+			Aliases:  []string{"k"},
+			Usage:    "Decryption key (base64 encoded)",
+			Required: true,
+		}),
+		&cli.IntFlag{
+			Name:  "size",
+			Value: pixellock.DefaultThumbnailSize,
+			Usage: "Longer side of the previews, in pixels",
+		},
+		&cli.BoolFlag{
+			Name:  "embed",
+			Usage: "Embed the previews, unencrypted, in the encrypted files instead of writing them next to them",
+		},
+		&cli.BoolFlag{
+			Name:    "recursive",
+			Aliases: []string{"r"},
+			Usage:   "Recursively search subdirectories for encrypted files.",
+		},
+		&cli.StringFlag{
+			Name:  "encrypted-ext",
+			Value: pixellock.EncryptedExtension,
+			Usage: "Extension of the encrypted files in a directory",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		key, err := pixellock.DecodeKey(c.String("key"))
+		if err != nil {
+			gookitcolor.Red.Println(err)
+			return err
+		}
+		size, embed := c.Int("size"), c.Bool("embed")
+		if err := pixellock.CheckThumbnailSize(size); err != nil {
+			return err
+		}
+
+		input, recursive, ext := c.String("input"), c.Bool("recursive"), c.String("encrypted-ext")
+		var files []string
+		err = filepath.Walk(input, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() && path != input && !recursive {
+				return filepath.SkipDir
+			}
+			if !info.IsDir() && (path == input || strings.HasSuffix(path, ext)) {
+				files = append(files, path)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		var failed int
+		for _, file := range files {
+			written, err := pixellock.RegenerateThumbnail(file, key, size, embed)
+			if err != nil {
+				gookitcolor.Red.Printf("%s: %v\n", file, err)
+				failed++
+				continue
+			}
+			gookitcolor.Cyan.Println("Thumbnail written to:", written)
+		}
+		if failed > 0 {
+			return fmt.Errorf("%d of %d thumbnails failed", failed, len(files))
+		}
+		return nil
+	},
+}
+
+var compareCmd = &cli.Command{
+	Name:      "compare",
+	Usage:     "Measure how faithfully one image, or directory of images, reproduces another",
+	ArgsUsage: "<a> <b>",
+	Flags: []cli.Flag{
+		secret(&cli.StringFlag{
+			Name:    "key",
+			Aliases: []string{"k"},
+			Usage:   "Key (base64 encoded) to decrypt encrypted files with, in memory",
+		}),
+		&cli.Float64Flag{
+			Name:  "threshold",
+			Usage: "Fail when the SSIM of any pair is below this bound (up to 1, for identical images)",
+		},
+		&cli.BoolFlag{
+			Name:    "recursive",
+			Aliases: []string{"r"},
+			Usage:   "Recursively compare subdirectories.",
+		},
+		&cli.StringFlag{
+			Name:  "encrypted-ext",
+			Value: pixellock.EncryptedExtension,
+			Usage: "Extension of encrypted files, ignored when pairing files of two directories",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		if c.NArg() != 2 {
+			return fmt.Errorf("compare takes two images or directories, got %d arguments", c.NArg())
+		}
+		a, b := c.Args().Get(0), c.Args().Get(1)
+		var key []byte
+		if c.String("key") != "" {
+			var err error
+			if key, err = pixellock.DecodeKey(c.String("key")); err != nil {
+				gookitcolor.Red.Println(err)
+				return err
+			}
+		}
+
+		pairs := [][2]string{{a, b}}
+		if info, err := os.Stat(a); err == nil && info.IsDir() {
+			var unmatched []string
+			pairs, unmatched, err = pixellock.PairTrees(a, b, c.Bool("recursive"), c.String("encrypted-ext"))
+			if err != nil {
+				gookitcolor.Red.Println(err)
+				return err
+			}
+			for _, path := range unmatched {
+				gookitcolor.Yellow.Printf("%s: no counterpart in the other directory\n", path)
+			}
+		}
+
+		threshold := c.Float64("threshold")
+		var failed, below int
+		for _, pair := range pairs {
+			cmp, err := pixellock.CompareFiles(pair[0], pair[1], key)
+			if err != nil {
+				gookitcolor.Red.Println(err)
+				failed++
+				continue
+			}
+			exact := "differ"
+			if cmp.Identical {
+				exact = "identical"
+			}
+			fmt.Printf("%s vs %s: %s, PSNR %s, SSIM %.4f\n", pair[0], pair[1], exact, pixellock.FormatPSNR(cmp.PSNR), cmp.SSIM)
+			if c.IsSet("threshold") && cmp.SSIM < threshold {
+				gookitcolor.Yellow.Printf("%s: SSIM %.4f is below the threshold of %.4f\n", pair[1], cmp.SSIM, threshold)
+				below++
+			}
+		}
+		switch {
+		case failed > 0:
+			return fmt.Errorf("%d of %d comparisons failed", failed, len(pairs))
+		case below > 0:
+			return fmt.Errorf("%d of %d comparisons are below the threshold", below, len(pairs))
+		}
+		return nil
+	},
+}
+
+// errTreesDiffer is the error of diff when the trees differ, which exits
+// with exitDifferent.
+var errTreesDiffer = errors.New("the trees differ")
+
+var diffCmd = &cli.Command{
+	Name:  "diff",
+	Usage: "Compare two directories of encrypted files, such as an archive and its replica, by the paths of their files",
+	Description: "Reports the files only in one tree, and those in both that differ in size or SHA-256 hash. With the key,\n" +
+		"files that differ are decrypted in memory to tell whether their images do too: the same image encrypted twice\n" +
+		"differs in its nonces, which --content counts as equal. Exits with status 0 when the trees are the same, 2 when\n" +
+		"they differ, and 1 when a file could not be compared.",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:     "left",
+			Usage:    "One directory to compare",
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:     "right",
+			Usage:    "The other directory to compare",
+			Required: true,
+		},
+		secret(&cli.StringFlag{
+			Name:    "key",
+			Aliases: []string{"k"},
+			Usage:   "Key (base64 encoded) to compare the images of files that differ with; IMAGE_ENCRYPTION_KEY when neither this nor --key-from is given",
+		}),
+		&cli.StringFlag{
+			Name:  "key-from",
+			Usage: "Read the key from env:NAME, file:PATH or keyring:NAME",
+		},
+		&cli.BoolFlag{
+			Name:  "content",
+			Usage: "Count files whose images are the same as equal, though the files differ; needs the key",
+		},
+		&cli.BoolFlag{
+			Name:  "json",
+			Usage: "Print the differences as JSON",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		key, err := serviceKey(c)
+		if err != nil {
+			return err
+		}
+		if c.Bool("content") && key == nil {
+			return errors.New("--content compares the images of files, which takes the key: give it with --key, --key-from or IMAGE_ENCRYPTION_KEY")
+		}
+		left, right := c.String("left"), c.String("right")
+		diffs, err := pixellock.DiffTrees(c.Context, left, right, key)
+		if err != nil {
+			return err
+		}
+		if c.Bool("content") {
+			diffs = slices.DeleteFunc(diffs, func(d pixellock.TreeDifference) bool { return d.Kind == pixellock.TreeSameContent })
+		}
+		if c.Bool("json") {
+			if diffs == nil {
+				diffs = []pixellock.TreeDifference{}
+			}
+			if err := json.NewEncoder(os.Stdout).Encode(diffs); err != nil {
+				return err
+			}
+		} else if len(diffs) > 0 {
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "KIND\tPATH\tLEFT\tRIGHT\tDETAIL")
+			for _, d := range diffs {
+				sizes := [2]string{"-", "-"}
+				if d.Kind != pixellock.TreeOnlyRight {
+					sizes[0] = strconv.FormatInt(d.LeftSize, 10)
+				}
+				if d.Kind != pixellock.TreeOnlyLeft {
+					sizes[1] = strconv.FormatInt(d.RightSize, 10)
+				}
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", d.Kind, d.Path, sizes[0], sizes[1], d.Detail)
+			}
+			w.Flush()
+		}
+		failed := 0
+		for _, d := range diffs {
+			if d.Kind == pixellock.TreeError {
+				failed++
+			}
+		}
+		switch {
+		case failed > 0:
+			return fmt.Errorf("%d of the files could not be compared", failed)
+		case len(diffs) > 0:
+			return fmt.Errorf("%w: %s and %s have %d differences", errTreesDiffer, left, right, len(diffs))
+		}
+		if !c.Bool("json") {
+			gookitcolor.Green.Printf("%s and %s are the same\n", left, right)
+		}
+		return nil
+	},
+}
+
+var convertCmd = &cli.Command{
+	Name:  "convert",
+	Usage: "Convert an image or a directory of images to another format, without encryption",
+	Flags: append([]cli.Flag{
+		&cli.StringFlag{
+			Name:     "input",
+			Aliases:  []string{"i"},
+			Usage:    "Input image file or directory",
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:     "output",
+			Aliases:  []string{"o"},
+			Usage:    "Output image file or directory",
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:  "output-format",
+			Usage: "Output image format (png, jpg, jpeg, gif, webp, tiff, bmp, ppm, pgm); taken from the output extension for a single file, and required for a directory. Animated GIFs stay animated only when converted to gif without --resize",
+		},
+		&cli.IntFlag{
+			Name:  "quality",
+			Value: pixellock.DefaultJPEGQuality,
+			Usage: "JPEG quality of the output image, from 1 (smallest) to 100 (best)",
+		},
+		&cli.StringFlag{
+			Name:  "png-compression",
+			Value: pixellock.PNGCompressionDefault,
+			Usage: "PNG compression of the output image: none, fast, default or best. Faster levels write larger files",
+		},
+		&cli.StringFlag{
+			Name:  "metadata",
+			Value: pixellock.MetadataPreserve,
+			Usage: "EXIF metadata of the input: preserve attaches it to JPEG, PNG and TIFF output; strip drops it, turning the image upright first",
+		},
+		&cli.StringFlag{
+			Name:  "resize",
+			Usage: "Scale the image to fit WIDTHxHEIGHT, keeping its aspect ratio; leave out a side, as in 1024x or x768, to only bound the other, or scale by a percentage, as in 50%",
+		},
+		&cli.BoolFlag{
+			Name:  "allow-upscale",
+			Usage: "Let --resize enlarge images smaller than its size; they are left as they are otherwise",
+		},
+		&cli.BoolFlag{
+			Name:  "auto-orient",
+			Usage: "Turn the image upright for its EXIF orientation even when the EXIF metadata is kept, which then records it as upright",
+		},
+		&cli.BoolFlag{
+			Name:  "overwrite",
+			Usage: "Overwrite existing output files.",
+		},
+	}, stegoBatchFlags()...),
+	Action: func(c *cli.Context) error {
+		inputPath, outputPath := c.String("input"), c.String("output")
+		opts := pixellock.ConvertOptions{
+			Save:      pixellock.SaveOptions{Format: c.String("output-format"), Quality: c.Int("quality"), PNGCompression: c.String("png-compression"), Metadata: c.String("metadata"), AutoOrient: c.Bool("auto-orient"), MaxPixels: maxPixels(c)},
+			Overwrite: c.Bool("overwrite"),
+		}
+		if err := pixellock.CheckJPEGQuality(opts.Save.Quality); err != nil {
+			return err
+		}
+		if err := pixellock.CheckPNGCompression(opts.Save.PNGCompression); err != nil {
+			return err
+		}
+		if err := pixellock.CheckMetadataMode(opts.Save.Metadata); err != nil {
+			return err
+		}
+		if s := c.String("resize"); s != "" {
+			var err error
+			if opts.Save.Resize, err = pixellock.ParseResize(s); err != nil {
+				return err
+			}
+			opts.Save.Resize.AllowUpscale = c.Bool("allow-upscale")
+		}
+
+		if info, err := os.Stat(inputPath); err == nil && info.IsDir() {
+			results, err := pixellock.ConvertDirectory(inputPath, outputPath, opts, stegoBatchFromFlags(c))
+			if err != nil {
+				gookitcolor.Red.Println(err)
+				return err
+			}
+			failed := 0
+			for _, r := range results {
+				if r.Err != nil {
+					failed++
+					gookitcolor.Red.Printf("  %s: %v\n", r.Input, r.Err)
+					continue
+				}
+				if r.Note != "" {
+					gookitcolor.Yellow.Printf("  %s: %s.\n", r.Input, r.Note)
+				}
+				gookitcolor.Cyan.Printf("  %s -> %s\n", r.Input, r.Output)
+			}
+			fmt.Printf("Converted %d of %d images.\n", len(results)-failed, len(results))
+			if failed > 0 {
+				return fmt.Errorf("failed to convert %d images", failed)
+			}
+			return nil
+		}
+
+		note, err := pixellock.ConvertFile(inputPath, outputPath, opts)
+		if err != nil {
+			gookitcolor.Red.Println(err)
+			return err
+		}
+		if note != "" {
+			gookitcolor.Yellow.Printf("%s: %s.\n", inputPath, note)
+		}
+		gookitcolor.Cyan.Println("Image converted and saved to:", outputPath)
+		return nil
+	},
+}
+
+// watermarkCmd draws a visible watermark on an image
+var watermarkCmd = &cli.Command{
+	Name:  "watermark",
+	Usage: "Draw a visible text or image watermark on an image, without encryption",
+	Flags: append([]cli.Flag{
+		&cli.StringFlag{
+			Name:     "input",
+			Aliases:  []string{"i"},
+			Usage:    "Input image file",
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:     "output",
+			Aliases:  []string{"o"},
+			Usage:    "Output image file",
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:  "output-format",
+			Usage: "Output image format (png, jpg, jpeg, gif, webp, tiff, bmp, ppm, pgm); taken from the output extension when not given",
+		},
+		&cli.IntFlag{
+			Name:  "quality",
+			Value: pixellock.DefaultJPEGQuality,
+			Usage: "JPEG quality of the output image, from 1 (smallest) to 100 (best)",
+		},
+		&cli.StringFlag{
+			Name:  "metadata",
+			Value: pixellock.MetadataPreserve,
+			Usage: "EXIF metadata of the input: preserve attaches it to JPEG, PNG and TIFF output; strip drops it",
+		},
+		&cli.BoolFlag{
+			Name:  "overwrite",
+			Usage: "Overwrite an existing output file.",
+		},
+	}, watermarkFlags("")...),
+	Action: func(c *cli.Context) error {
+		inputPath, outputPath := c.String("input"), c.String("output")
+		opts := pixellock.ConvertOptions{
+			Save:      pixellock.SaveOptions{Format: c.String("output-format"), Quality: c.Int("quality"), Metadata: c.String("metadata"), MaxPixels: maxPixels(c)},
+			Overwrite: c.Bool("overwrite"),
+		}
+		if err := pixellock.CheckJPEGQuality(opts.Save.Quality); err != nil {
+			return err
+		}
+		if err := pixellock.CheckMetadataMode(opts.Save.Metadata); err != nil {
+			return err
+		}
+		var err error
+		if opts.Save.Watermark, err = watermarkFromFlags(c, ""); err != nil {
+			return err
+		} else if opts.Save.Watermark == nil {
+			return fmt.Errorf("give the watermark with --text or --image")
+		}
+
+		note, err := pixellock.ConvertFile(inputPath, outputPath, opts)
+		if err != nil {
+			gookitcolor.Red.Println(err)
+			return err
+		}
+		if note != "" {
+			gookitcolor.Yellow.Printf("%s: %s.\n", inputPath, note)
+		}
+		gookitcolor.Cyan.Println("Watermarked image saved to:", outputPath)
+		return nil
+	},
+}
+
+var contactSheetCmd = &cli.Command{
+	Name:  "contactsheet",
+	Usage: "Review a directory of images, encrypted or not, as a grid of captioned thumbnails",
+	Flags: append([]cli.Flag{
+		&cli.StringFlag{
+			Name:     "input",
+			Aliases:  []string{"i"},
+			Usage:    "Directory of images or encrypted images",
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:    "output",
+			Aliases: []string{"o"},
+			Value:   "contactsheet.jpg",
+			Usage:   "Contact sheet image; several sheets are numbered, as in contactsheet_p002.jpg",
+		},
+		secret(&cli.StringFlag{
+			Name:    "key",
+			Aliases: []string{"k"},
+			Usage:   "Decryption key (base64 encoded) for the encrypted images, which are decrypted in memory only; without it only images that are not encrypted are shown",
+		}),
+		&cli.IntFlag{
+			Name:  "columns",
+			Value: pixellock.DefaultContactSheetColumns,
+			Usage: "Thumbnails across a sheet",
+		},
+		&cli.IntFlag{
+			Name:  "rows",
+			Value: pixellock.DefaultContactSheetRows,
+			Usage: "Rows of thumbnails on a sheet before another sheet is started",
+		},
+		&cli.IntFlag{
+			Name:  "cell",
+			Value: pixellock.DefaultContactSheetCell,
+			Usage: "Side, in pixels, of the square each thumbnail is fit in",
+		},
+		&cli.StringFlag{
+			Name:  "output-format",
+			Usage: "Contact sheet format (png, jpg, jpeg, gif, webp, tiff, bmp, ppm, pgm); taken from the output extension when not given",
+		},
+		&cli.IntFlag{
+			Name:  "quality",
+			Value: pixellock.DefaultJPEGQuality,
+			Usage: "JPEG quality of the contact sheet, from 1 (smallest) to 100 (best)",
+		},
+		&cli.StringFlag{
+			Name:  "encrypted-ext",
+			Value: pixellock.EncryptedExtension,
+			Usage: "Extension of the encrypted files in the directory",
+		},
+		&cli.BoolFlag{
+			Name:  "overwrite",
+			Usage: "Overwrite existing contact sheets.",
+		},
+	}, stegoBatchFlags()...),
+	Action: func(c *cli.Context) error {
+		opts := pixellock.ContactSheetOptions{
+			EncryptedExt: c.String("encrypted-ext"),
+			Columns:      c.Int("columns"),
+			Rows:         c.Int("rows"),
+			Cell:         c.Int("cell"),
+		}
+		if c.String("key") != "" {
+			key, err := pixellock.DecodeKey(c.String("key"))
+			if err != nil {
+				gookitcolor.Red.Println(err)
+				return err
+			}
+			opts.Key = key
+		}
+		if err := opts.Check(); err != nil {
+			return err
+		}
+		save := pixellock.SaveOptions{Format: c.String("output-format"), Quality: c.Int("quality")}
+		if err := pixellock.CheckJPEGQuality(save.Quality); err != nil {
+			return err
+		}
+
+		names, cells, err := pixellock.WriteContactSheets(c.String("input"), c.String("output"), opts, save, stegoBatchFromFlags(c), c.Bool("overwrite"))
+		failed := 0
+		for _, cell := range cells {
+			if cell.Err != nil {
+				failed++
+				gookitcolor.Yellow.Printf("  %s: %v\n", cell.Input, cell.Err)
+			}
+		}
+		if err != nil {
+			gookitcolor.Red.Println(err)
+			return err
+		}
+		for _, name := range names {
+			gookitcolor.Cyan.Println("Contact sheet saved to:", name)
+		}
+		fmt.Printf("Showed %d images; %d could not be read and have placeholders.\n", len(cells)-failed, failed)
+		return nil
+	},
+}
+
+// redactCmd scrubs the metadata of images before they are shared
+var redactCmd = &cli.Command{
+	Name:  "redact",
+	Usage: "Remove the EXIF, XMP, IPTC and other metadata of an image or a directory of images, rewriting JPEGs and PNGs without recompressing them",
+	Flags: append([]cli.Flag{
+		&cli.StringFlag{
+			Name:     "input",
+			Aliases:  []string{"i"},
+			Usage:    "Input image file or directory",
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:     "output",
+			Aliases:  []string{"o"},
+			Usage:    "Output image file or directory",
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:  "keep",
+			Usage: "Comma-separated metadata to keep: orientation keeps the EXIF orientation alone, icc the ICC color profile",
+		},
+		&cli.BoolFlag{
+			Name:  "report",
+			Usage: "List the metadata removed from each image",
+		},
+		&cli.BoolFlag{
+			Name:  "overwrite",
+			Usage: "Overwrite existing output files.",
+		},
+	}, stegoBatchFlags()...),
+	Action: func(c *cli.Context) error {
+		inputPath, outputPath := c.String("input"), c.String("output")
+		keep, err := pixellock.ParseKeep(c.String("keep"))
+		if err != nil {
+			return err
+		}
+		opts := pixellock.ScrubOptions{Keep: keep, Overwrite: c.Bool("overwrite")}
+
+		if info, err := os.Stat(inputPath); err == nil && info.IsDir() {
+			results, err := pixellock.ScrubDirectory(inputPath, outputPath, opts, stegoBatchFromFlags(c))
+			if err != nil {
+				gookitcolor.Red.Println(err)
+				return err
+			}
+			failed := 0
+			for _, r := range results {
+				if r.Err != nil {
+					failed++
+					gookitcolor.Red.Printf("  %s: %v\n", r.Input, r.Err)
+					continue
+				}
+				if r.Note != "" {
+					gookitcolor.Yellow.Printf("  %s: %s.\n", r.Input, r.Note)
+				}
+				gookitcolor.Cyan.Printf("  %s -> %s\n", r.Input, r.Output)
+				if c.Bool("report") {
+					printRemoved("    ", r.Removed)
+				}
+			}
+			fmt.Printf("Scrubbed %d of %d images.\n", len(results)-failed, len(results))
+			if failed > 0 {
+				return fmt.Errorf("failed to scrub %d images", failed)
+			}
+			return nil
+		}
+
+		removed, note, err := pixellock.ScrubFile(inputPath, outputPath, opts)
+		if err != nil {
+			gookitcolor.Red.Println(err)
+			return err
+		}
+		if note != "" {
+			gookitcolor.Yellow.Printf("%s: %s.\n", inputPath, note)
+		}
+		gookitcolor.Cyan.Println("Scrubbed image saved to:", outputPath)
+		if c.Bool("report") {
+			printRemoved("  ", removed)
+		}
+		return nil
+	},
+}
+
+// printRemoved lists the metadata removed from an image, each item on its
+// own line after indent.
+func printRemoved(indent string, removed []string) {
+	if len(removed) == 0 {
+		fmt.Printf("%sno metadata removed\n", indent)
+	}
+	for _, item := range removed {
+		fmt.Printf("%sremoved %s\n", indent, item)
+	}
+}
+
+// steganographyCmd implements steganography features
+var steganographyCmd = &cli.Command{
+	Name:  "stego",
+	Usage: "Hide or reveal a message within an image using steganography",
+	Subcommands: []*cli.Command{
+		{
+			Name:  "hide",
+			Usage: "Hide a message within an image",
+			Flags: append([]cli.Flag{
+				&cli.StringFlag{
+					Name:    "input",
+					Aliases: []string{"i"},
+					Value:   "",
+					Usage:   "Input image file, or a directory to hide the payload in every image under it; --output is then a directory",
+				},
+				&cli.StringFlag{
+					Name:  "covers",
+					Value: "",
+					Usage: "Directory or glob of cover images to split the payload across instead of --input; --output is then a directory",
+				},
+				&cli.StringFlag{
+					Name:     "output",
+					Aliases:  []string{"o"},
+					Value:    "stego_output.png",
+					Usage:    "Output stego image file",
+					Required: true,
+				},
+				secret(&cli.StringFlag{
+					Name:    "message",
+					Aliases: []string{"m"},
+					Value:   "",
+					Usage:   "Message to hide",
+				}),
+				&cli.StringFlag{
+					Name:  "message-file",
+					Value: "",
+					Usage: "Read the message verbatim from this file, or from standard input when -, instead of --message",
+				},
+				&cli.StringFlag{
+					Name:  "file",
+					Value: "",
+					Usage: "File to hide instead of a message (its name and hash are embedded too)",
+				},
+				secret(&cli.StringFlag{
+					Name:    "key",
+					Aliases: []string{"k"},
+					Value:   "",
+					Usage:   "Encrypt the payload with this key (base64 encoded) before embedding",
+				}),
+				secret(&cli.StringFlag{
+					Name:  "password",
+					Value: "",
+					Usage: "Encrypt the payload with a key derived from this password before embedding",
+				}),
+				secret(&cli.StringFlag{
+					Name:  "decoy-message",
+					Value: "",
+					Usage: "Also hide this innocuous message, revealed by --decoy-password, in the pixels the real payload leaves free; requires --password or --key",
+				}),
+				&cli.StringFlag{
+					Name:  "decoy-file",
+					Value: "",
+					Usage: "File to hide as the decoy instead of --decoy-message",
+				},
+				secret(&cli.StringFlag{
+					Name:  "decoy-password",
+					Value: "",
+					Usage: "Password that reveals the decoy and nothing else",
+				}),
+				&cli.StringFlag{ // New flag for output format
+					Name:  "output-format",
+					Value: "png", // Default output format
+					Usage: "Output image format (png, gif, webp, tiff, bmp, jpg, jpeg). WebP is always written lossless, BMP only for opaque covers and RGB channels; TIFF uses deflate unless written as tiff:none or tiff:lzw. GIF, WebP and TIFF covers default to their own format, GIF keeping its animation. Lossy formats are refused unless --force-lossy is set; ignored with --method dct, exif or palette",
+				},
+				&cli.StringFlag{
+					Name:  "method",
+					Value: pixellock.StegoMethodLSB,
+					Usage: "Embedding method: lsb (pixel bits, lossless output), dct (JPEG coefficients, JPEG output), exif (JPEG or PNG metadata, pixels and format untouched) or palette (palette indices of a GIF or indexed PNG, which stays indexed)",
+				},
+				&cli.IntFlag{
+					Name:  "density",
+					Value: pixellock.DefaultStegoOptions.Density,
+					Usage: "Low bits used per color channel (1-4); higher values hold more but alter the image more. Recorded in the image, so reveal detects it",
+				},
+				&cli.StringFlag{
+					Name:  "channels",
+					Value: pixellock.ChannelsRGB.String(),
+					Usage: "Channels whose low bits carry the payload, e.g. rgb, rgba, b or rb. Alpha is left alone unless listed. Recorded in the image, so reveal detects it",
+				},
+				&cli.BoolFlag{
+					Name:  "scatter",
+					Usage: "Spread the payload over pixels in an order derived from --password or --key",
+					Value: false,
+				},
+				&cli.BoolFlag{
+					Name:  "adaptive",
+					Usage: "Embed into the most textured pixels first and leave flat areas untouched, which is harder to detect; capacity then depends on the image. Recorded in the image, so reveal detects it",
+					Value: false,
+				},
+				&cli.BoolFlag{
+					Name:  "skip-transparent",
+					Usage: "Leave fully transparent pixels (and the alpha channel) untouched in covers that have them, so optimizers that clear invisible pixels keep the payload. Recorded in the image",
+					Value: true,
+				},
+				&cli.StringFlag{
+					Name:  "max-fill",
+					Value: "100%",
+					Usage: "Use at most this share of the image capacity, e.g. 50% or 0.5; less is harder to detect",
+				},
+				&cli.BoolFlag{
+					Name:  "compress",
+					Usage: "Deflate the payload before embedding so more fits; stored raw when that does not help. Recorded in the image, so reveal decompresses it",
+					Value: false,
+				},
+				&cli.BoolFlag{
+					Name:  "force-lossy",
+					Usage: "Allow a lossy output format even though it will likely destroy the payload",
+					Value: false,
+				},
+				&cli.IntFlag{
+					Name:  "quality",
+					Value: pixellock.DefaultJPEGQuality,
+					Usage: "JPEG quality, from 1 (smallest) to 100 (best), of a JPEG output and of a cover re-encoded as a JPEG for --method dct",
+				},
+				&cli.StringSliceFlag{
+					Name:  "region",
+					Usage: "Only embed in the pixels inside this rectangle, given as x,y,width,height (repeatable). Recorded in the image, so reveal finds it",
+				},
+				&cli.StringSliceFlag{
+					Name:  "exclude-region",
+					Usage: "Never touch the pixels inside this rectangle, given as x,y,width,height (repeatable)",
+				},
+			}, stegoBatchFlags()...),
+			Action: func(c *cli.Context) error {
+				inputPath := c.String("input")
+				outputPath := c.String("output")
+				message := c.String("message")
+				messageFile := c.String("message-file")
+				payloadFile := c.String("file")
+				outputFormat := c.String("output-format")
+				coversPattern := c.String("covers")
+
+				if !c.IsSet("output-format") && inputPath != "" {
+					if format, err := pixellock.DetectImageFormat(inputPath); err == nil && (format == "gif" || format == "webp" || format == "tiff") {
+						outputFormat = format
+					}
+				}
+
+				if (inputPath == "") == (coversPattern == "") {
+					gookitcolor.Red.Println("Exactly one of --input or --covers is required.")
+					return fmt.Errorf("exactly one of --input or --covers is required")
+				}
+				sources := 0
+				for _, source := range []string{message, messageFile, payloadFile} {
+					if source != "" {
+						sources++
+					}
+				}
+				if sources != 1 {
+					gookitcolor.Red.Println("Exactly one of --message, --message-file or --file is required.")
+					return fmt.Errorf("exactly one of --message, --message-file or --file is required")
+				}
+
+				opts, err := stegoOptionsFromFlags(c)
+				if err != nil {
+					gookitcolor.Red.Println(err)
+					return err
+				}
+				opts.Method = c.String("method")
+				opts.Density = c.Int("density")
+				opts.Scatter = c.Bool("scatter")
+				opts.Adaptive = c.Bool("adaptive")
+				opts.SkipTransparent = c.Bool("skip-transparent")
+				opts.Compress = c.Bool("compress")
+				opts.JPEGQuality = c.Int("quality")
+				if err := pixellock.CheckJPEGQuality(opts.JPEGQuality); err != nil {
+					gookitcolor.Red.Println(err)
+					return err
+				}
+				if opts.Regions, opts.ExcludeRegions, err = stegoRegionsFromFlags(c); err != nil {
+					gookitcolor.Red.Println(err)
+					return err
+				}
+				if opts.MaxFill, err = parseMaxFill(c.String("max-fill")); err != nil {
+					gookitcolor.Red.Println(err)
+					return err
+				}
+				if opts.Channels, err = pixellock.ParseStegoChannels(c.String("channels")); err != nil {
+					gookitcolor.Red.Println(err)
+					return err
+				}
+				if err := opts.Validate(); err != nil {
+					gookitcolor.Red.Println(err)
+					return err
+				}
+				opts.AllowLossy = c.Bool("force-lossy")
+				if opts.AllowLossy && opts.Method != pixellock.StegoMethodDCT && opts.Method != pixellock.StegoMethodEXIF && opts.Method != pixellock.StegoMethodPalette && pixellock.IsLossyFormat(outputFormat) {
+					gookitcolor.Yellow.Println("WARNING: saving as", outputFormat, "will likely destroy the hidden payload.")
+				}
+				if opts.Method == pixellock.StegoMethodDCT || pixellock.IsLossyFormat(outputFormat) {
+					logger.Debug("writing JPEG", "quality", opts.JPEGQuality)
+				}
+
+				payload := pixellock.Payload{Data: []byte(message)}
+				switch {
+				case payloadFile != "":
+					if payload, err = pixellock.ReadPayloadFile(payloadFile); err != nil {
+						log.Printf("failed to read payload file: %v", err)
+						return err
+					}
+				case messageFile != "":
+					if payload, err = pixellock.ReadMessageFile(messageFile); err != nil {
+						gookitcolor.Red.Println(err)
+						return err
+					}
+				}
+				if opts.Compress {
+					reportCompression(payload)
+				}
+
+				if decoyPassword := c.String("decoy-password"); decoyPassword != "" || c.String("decoy-message") != "" || c.String("decoy-file") != "" {
+					if info, err := os.Stat(inputPath); coversPattern != "" || err == nil && info.IsDir() {
+						gookitcolor.Red.Println("A decoy can only be hidden in a single --input image.")
+						return fmt.Errorf("a decoy can only be hidden in a single --input image")
+					}
+					decoy := pixellock.Payload{Data: []byte(c.String("decoy-message"))}
+					if decoyFile := c.String("decoy-file"); decoyFile != "" {
+						if decoy, err = pixellock.ReadPayloadFile(decoyFile); err != nil {
+							gookitcolor.Red.Println(err)
+							return err
+						}
+					}
+					if err := pixellock.HideDeniable(inputPath, outputPath, decoy, payload, decoyPassword, opts, outputFormat); err != nil {
+						gookitcolor.Red.Println(err)
+						return err
+					}
+					gookitcolor.Cyan.Println("Payload and decoy hidden and saved to:", outputPath)
+					return nil
+				}
+
+				if coversPattern != "" {
+					covers, err := pixellock.StegoImagePaths(coversPattern)
+					if err != nil {
+						gookitcolor.Red.Println(err)
+						return err
+					}
+					written, err := pixellock.HideSplit(covers, outputPath, payload, opts, outputFormat)
+					if err != nil {
+						gookitcolor.Red.Println(err)
+						return err
+					}
+					gookitcolor.Cyan.Printf("Payload split across %d images:\n", len(written))
+					for _, path := range written {
+						fmt.Println(" ", path)
+					}
+					return nil
+				}
+
+				if info, err := os.Stat(inputPath); err == nil && info.IsDir() {
+					results, err := pixellock.HideDirectory(inputPath, outputPath, payload, opts, outputFormat, stegoBatchFromFlags(c))
+					if err != nil {
+						gookitcolor.Red.Println(err)
+						return err
+					}
+					failed := 0
+					for _, r := range results {
+						if r.Err != nil {
+							failed++
+							gookitcolor.Red.Printf("  %s: %v\n", r.Input, r.Err)
+							continue
+						}
+						gookitcolor.Cyan.Printf("  %s -> %s\n", r.Input, r.Output)
+					}
+					fmt.Printf("Payload hidden in %d of %d images.\n", len(results)-failed, len(results))
+					if failed > 0 {
+						return fmt.Errorf("failed to hide payload in %d images", failed)
+					}
+					return nil
+				}
+
+				if err := pixellock.HidePayload(inputPath, outputPath, payload, opts, outputFormat); err != nil {
+					gookitcolor.Red.Println(err)
+					return err
+				}
+				gookitcolor.Cyan.Println("Payload hidden and saved to:", outputPath)
+				return nil
+			},
+		},
+		{
+			Name:  "reveal",
+			Usage: "Reveal a hidden message from an image",
+			Flags: append([]cli.Flag{
+				&cli.StringSliceFlag{
+					Name:     "input",
+					Aliases:  []string{"i"},
+					Usage:    "Input stego image file; repeat it, or give a directory, to reveal several images or reassemble a payload split across them",
+					Required: true,
+				},
+				&cli.StringFlag{
+					Name:    "output",
+					Aliases: []string{"o"},
+					Value:   "",
+					Usage:   "Write the payload to this file, or into this directory using the embedded filename; - writes it to standard output, as --raw does, and data-uri writes an image payload there as a data URI",
+				},
+				secret(&cli.StringFlag{
+					Name:    "key",
+					Aliases: []string{"k"},
+					Value:   "",
+					Usage:   "Key (base64 encoded) used to decrypt an encrypted payload",
+				}),
+				secret(&cli.StringFlag{
+					Name:  "password",
+					Value: "",
+					Usage: "Password used to decrypt an encrypted payload",
+				}),
+				&cli.BoolFlag{
+					Name:  "ignore-checksum",
+					Usage: "Dump the raw embedded bytes even if the payload fails its checksum",
+					Value: false,
+				},
+				&cli.BoolFlag{
+					Name:  "raw",
+					Usage: "Write the exact payload bytes to standard output, without decoration, so they can be piped",
+					Value: false,
+				},
+				&cli.BoolFlag{
+					Name:  "base64",
+					Usage: "With --raw or --output -, write the payload base64 encoded",
+				},
+				&cli.IntFlag{
+					Name:  "max-bytes",
+					Value: pixellock.DefaultMaxStdoutBytes,
+					Usage: "Refuse to write a payload larger than this many bytes to standard output; 0 for no limit",
+				},
+				&cli.BoolFlag{
+					Name:  "legacy",
+					Usage: "Read images without a payload header as null-terminated messages hidden by pixellock before it had one; any image yields some bytes this way",
+					Value: false,
+				},
+				copyFlag("Copy the revealed message to the clipboard instead of printing it"),
+				clearAfterFlag(),
+			}, stegoBatchFlags()...),
+			Action: func(c *cli.Context) error {
+				outputPath := c.String("output")
+				// With --raw, or output to standard output, stdout carries
+				// only the payload, so warnings go to stderr.
+				raw := c.Bool("raw") || pixellock.IsStdoutOutput(outputPath)
+				if c.Bool("base64") && (!raw || outputPath == pixellock.DataURIOutput) {
+					return fmt.Errorf("--base64 needs --raw or --output %s", pixellock.StdoutOutput)
+				}
+				if c.Bool("copy") && (raw || outputPath != "") {
+					return errors.New("--copy copies a message in place of printing it, so cannot be given with --output or --raw")
+				}
+				warn := func(format string, a ...any) {
+					if raw {
+						fmt.Fprintf(os.Stderr, format, a...)
+						return
+					}
+					gookitcolor.Yellow.Printf(format, a...)
+				}
+				opts, err := stegoOptionsFromFlags(c)
+				if err != nil {
+					gookitcolor.Red.Println(err)
+					return err
+				}
+
+				batch := stegoBatchFromFlags(c)
+				var inputPaths []string
+				for _, input := range c.StringSlice("input") {
+					if info, err := os.Stat(input); err == nil && info.IsDir() {
+						paths, err := pixellock.StegoBatchFiles(input, batch)
+						if err != nil {
+							gookitcolor.Red.Println(err)
+							return err
+						}
+						inputPaths = append(inputPaths, paths...)
+						continue
+					}
+					inputPaths = append(inputPaths, input)
+				}
+				for _, inputPath := range inputPaths {
+					if format, err := pixellock.DetectImageFormat(inputPath); err == nil && pixellock.IsLossyFormat(format) {
+						warn("WARNING: %s is a %s image; lossy compression has likely destroyed any payload not hidden with --method dct or exif.\n", inputPath, format)
+					}
+				}
+
+				opts.IgnoreChecksum = c.Bool("ignore-checksum")
+				opts.Legacy = c.Bool("legacy")
+				if len(inputPaths) == 0 {
+					gookitcolor.Red.Println("No images found.")
+					return fmt.Errorf("no images found")
+				}
+				var payload pixellock.Payload
+				if len(inputPaths) == 1 {
+					payload, err = pixellock.RevealPayload(inputPaths[0], opts)
+				} else {
+					results := pixellock.RevealFiles(inputPaths, opts, batch.Workers)
+					fragments, whole := stegoFragmentInputs(results)
+					if whole > 0 || len(fragments) == 0 {
+						if c.Bool("copy") {
+							return errors.New("--copy copies the message of a single image, or of one split across several")
+						}
+						return revealBatch(results, outputPath)
+					}
+					payload, err = pixellock.RevealSplit(fragments, opts)
+				}
+				if errors.Is(err, pixellock.ErrNoPayload) && opts.Key == nil && opts.Password == "" {
+					warn("No pixellock payload found. Use --legacy to read a message hidden by an older version of pixellock.\n")
+					return err
+				}
+				if err != nil {
+					gookitcolor.Red.Println(fmt.Errorf("failed to reveal message: %w", err))
+					return err
+				}
+				if payload.Legacy {
+					warn("WARNING: no payload header found; the bytes below were read with the legacy layout and may be noise.\n")
+				}
+				if payload.ChecksumFailed {
+					warn("WARNING: payload failed its checksum; showing the raw embedded bytes.\n")
+				}
+
+				// An image payload can be inlined in a web page as a data URI
+				if outputPath == pixellock.DataURIOutput {
+					format, err := pixellock.ImageDataFormat(payload.Data)
+					if err != nil {
+						err = fmt.Errorf("the payload cannot be written as a data URI: %w", err)
+						fmt.Fprintln(os.Stderr, err)
+						return err
+					}
+					out, err := pixellock.StdoutImage(payload.Data, format, outputPath, false, c.Int("max-bytes"))
+					if err != nil {
+						fmt.Fprintln(os.Stderr, err)
+						return err
+					}
+					_, err = os.Stdout.Write(out)
+					return err
+				}
+
+				if outputPath != "" && outputPath != pixellock.StdoutOutput {
+					written, err := pixellock.WritePayload(payload, outputPath)
+					if err != nil {
+						gookitcolor.Red.Println(err)
+						return err
+					}
+					gookitcolor.Cyan.Println("Payload saved to:", written)
+					return nil
+				}
+
+				if raw {
+					out, err := pixellock.StdoutImage(payload.Data, "", pixellock.StdoutOutput, c.Bool("base64"), c.Int("max-bytes"))
+					if err != nil {
+						fmt.Fprintln(os.Stderr, err)
+						return err
+					}
+					_, err = os.Stdout.Write(out)
+					return err
+				}
+				if payload.ChecksumFailed {
+					fmt.Print(hex.Dump(payload.Data))
+					return nil
+				}
+				if payload.IsFile() {
+					gookitcolor.Yellow.Printf("Payload is a file (%s, %d bytes). Use --output to save it.\n", payload.Filename, len(payload.Data))
+					return fmt.Errorf("payload is a file; use --output to save it")
+				}
+				if c.Bool("copy") {
+					return copyToClipboard(c, "Hidden message", string(payload.Data))
+				}
+				gookitcolor.Green.Println("Hidden Message:", string(payload.Data))
+				return nil
+			},
+		},
+		{
+			Name:  "capacity",
+			Usage: "Show how many bytes can be hidden in an image",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:     "input",
+					Aliases:  []string{"i"},
+					Value:    "",
+					Usage:    "Input cover image file",
+					Required: true,
+				},
+				&cli.IntFlag{
+					Name:  "density",
+					Value: pixellock.DefaultStegoOptions.Density,
+					Usage: "Low bits used per color channel (1-4)",
+				},
+				&cli.StringFlag{
+					Name:  "channels",
+					Value: pixellock.ChannelsRGB.String(),
+					Usage: "Channels whose low bits carry the payload, e.g. rgb, rgba or b",
+				},
+				&cli.BoolFlag{
+					Name:  "skip-transparent",
+					Usage: "Exclude fully transparent pixels from embedding",
+					Value: true,
+				},
+				&cli.BoolFlag{
+					Name:  "adaptive",
+					Usage: "Count only the textured pixels adaptive embedding uses",
+					Value: false,
+				},
+				&cli.StringFlag{
+					Name:  "method",
+					Value: pixellock.StegoMethodLSB,
+					Usage: "Embedding method: lsb, dct, exif or palette",
+				},
+				&cli.StringSliceFlag{
+					Name:  "region",
+					Usage: "Count only the pixels inside this rectangle, given as x,y,width,height (repeatable)",
+				},
+				&cli.StringSliceFlag{
+					Name:  "exclude-region",
+					Usage: "Leave out the pixels inside this rectangle, given as x,y,width,height (repeatable)",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				inputPath := c.String("input")
+				channels, err := pixellock.ParseStegoChannels(c.String("channels"))
+				if err != nil {
+					gookitcolor.Red.Println(err)
+					return err
+				}
+				opts := pixellock.StegoOptions{
+					Density:         c.Int("density"),
+					Channels:        channels,
+					SkipTransparent: c.Bool("skip-transparent"),
+					Adaptive:        c.Bool("adaptive"),
+					Method:          c.String("method"),
+				}
+				if opts.Regions, opts.ExcludeRegions, err = stegoRegionsFromFlags(c); err != nil {
+					gookitcolor.Red.Println(err)
+					return err
+				}
+				if err := opts.Validate(); err != nil {
+					gookitcolor.Red.Println(err)
+					return err
+				}
+
+				img, err := pixellock.LoadImage(inputPath)
+				if err != nil {
+					log.Printf("failed to load image: %v", err)
+					return err
+				}
+
+				capacity, err := pixellock.StegoFileCapacity(inputPath, opts)
+				if err != nil {
+					gookitcolor.Red.Println(err)
+					return err
+				}
+
+				b := img.Bounds()
+				gookitcolor.Cyan.Printf("Image: %s (%dx%d)\n", inputPath, b.Dx(), b.Dy())
+				gookitcolor.Green.Printf("Capacity: %d bytes (%s)\n", capacity, opts.Method)
+				gookitcolor.Yellow.Printf("Payload header overhead: %d bytes\n", pixellock.StegoHeaderSize)
+				return nil
+			},
+		},
+		{
+			Name:  "detect",
+			Usage: "Check images for signs of LSB steganography",
+			Flags: append([]cli.Flag{
+				&cli.StringFlag{
+					Name:     "input",
+					Aliases:  []string{"i"},
+					Value:    "",
+					Usage:    "Image file or directory to check",
+					Required: true,
+				},
+				&cli.BoolFlag{
+					Name:  "json",
+					Usage: "Print the results as JSON",
+					Value: false,
+				},
+			}, stegoBatchFlags()...),
+			Action: func(c *cli.Context) error {
+				inputPath := c.String("input")
+				batch := stegoBatchFromFlags(c)
+				inputPaths := []string{inputPath}
+				if info, err := os.Stat(inputPath); err == nil && info.IsDir() {
+					paths, err := pixellock.StegoBatchFiles(inputPath, batch)
+					if err != nil {
+						gookitcolor.Red.Println(err)
+						return err
+					}
+					inputPaths = paths
+				}
+				results := pixellock.AnalyzeStegoFiles(inputPaths, batch.Workers)
+
+				if c.Bool("json") {
+					type detectResult struct {
+						File  string `json:"file"`
+						Error string `json:"error,omitempty"`
+						Code  string `json:"code,omitempty"`
+						*pixellock.StegoAnalysis
+					}
+					out := make([]detectResult, len(results))
+					for i, r := range results {
+						out[i].File = r.Input
+						if r.Err != nil {
+							out[i].Error, out[i].Code = r.Err.Error(), string(pixellock.ErrorCodeOf(r.Err))
+							continue
+						}
+						out[i].StegoAnalysis = &r.Analysis
+					}
+					enc := json.NewEncoder(os.Stdout)
+					enc.SetIndent("", "  ")
+					return enc.Encode(out)
+				}
+
+				for _, r := range results {
+					if r.Err != nil {
+						gookitcolor.Red.Printf("%s: %v\n", r.Input, r.Err)
+						continue
+					}
+					printStegoAnalysis(r.Input, r.Analysis)
+				}
+				return nil
+			},
+		},
+		{
+			Name:  "scan",
+			Usage: "Search an image for payloads hidden with unknown parameters",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:     "input",
+					Aliases:  []string{"i"},
+					Value:    "",
+					Usage:    "Image file to search",
+					Required: true,
+				},
+				&cli.StringFlag{
+					Name:  "passwords",
+					Value: "",
+					Usage: "File of passwords to try, one per line, for scattered and encrypted payloads",
+				},
+				&cli.IntFlag{
+					Name:  "jobs",
+					Usage: "Parameter combinations tried concurrently (default: number of CPUs)",
+					Value: 0,
+				},
+				&cli.Float64Flag{
+					Name:  "min-text",
+					Usage: "Share of printable bytes a payload without a pixellock header needs to be reported",
+					Value: pixellock.DefaultScanMinText,
+				},
+			},
+			Action: func(c *cli.Context) error {
+				inputPath := c.String("input")
+				opts := pixellock.StegoScanOptions{Workers: c.Int("jobs"), MinText: c.Float64("min-text")}
+				if passwordFile := c.String("passwords"); passwordFile != "" {
+					passwords, err := readPasswordList(passwordFile)
+					if err != nil {
+						gookitcolor.Red.Println(err)
+						return err
+					}
+					opts.Passwords = passwords
+				}
+
+				img, err := pixellock.LoadImage(inputPath)
+				if err != nil {
+					gookitcolor.Red.Println(err)
+					return err
+				}
+				opts.Progress = func(done, total int) {
+					fmt.Fprintf(os.Stderr, "\rTried %d of %d parameter combinations", done, total)
+				}
+				candidates := pixellock.ScanStego(img, opts)
+				fmt.Fprintln(os.Stderr)
+
+				if len(candidates) == 0 {
+					gookitcolor.Yellow.Println("No candidate payloads found.")
+					return nil
+				}
+				for _, cand := range candidates {
+					printScanCandidate(cand)
+				}
+				return nil
+			},
+		},
+		{
+			Name:  "wipe",
+			Usage: "Overwrite the low bits a payload could hide in, so nothing can be revealed from the image",
+			Flags: append([]cli.Flag{
+				&cli.StringFlag{
+					Name:     "input",
+					Aliases:  []string{"i"},
+					Value:    "",
+					Usage:    "Image file or directory to wipe",
+					Required: true,
+				},
+				&cli.StringFlag{
+					Name:     "output",
+					Aliases:  []string{"o"},
+					Value:    "",
+					Usage:    "Wiped PNG image, or directory for the wiped images of an input directory",
+					Required: true,
+				},
+				&cli.StringFlag{
+					Name:  "mode",
+					Value: pixellock.StegoWipeRandom,
+					Usage: "How to overwrite the low bits: random or zero",
+				},
+				&cli.IntFlag{
+					Name:  "depth",
+					Value: 1,
+					Usage: "Low bits overwritten per channel (1-4); match the --density of the payload to remove all of it",
+				},
+				&cli.StringFlag{
+					Name:  "channels",
+					Value: pixellock.ChannelsRGB.String(),
+					Usage: "Channels to wipe, e.g. rgb or rgba",
+				},
+				&cli.BoolFlag{
+					Name:  "skip-transparent",
+					Usage: "Leave fully transparent pixels untouched, as stego hide does by default",
+					Value: true,
+				},
+			}, stegoBatchFlags()...),
+			Action: func(c *cli.Context) error {
+				inputPath := c.String("input")
+				outputPath := c.String("output")
+				mode := c.String("mode")
+				opts := pixellock.StegoOptions{
+					Density:         c.Int("depth"),
+					SkipTransparent: c.Bool("skip-transparent"),
+				}
+				var err error
+				if opts.Channels, err = pixellock.ParseStegoChannels(c.String("channels")); err != nil {
+					gookitcolor.Red.Println(err)
+					return err
+				}
+
+				report := func(input string, a pixellock.StegoAnalysis) {
+					if a.Pixellock() {
+						gookitcolor.Yellow.Printf("%s: pixellock payload detected (version %d) and wiped\n", input, a.PixellockVersion)
+						return
+					}
+					gookitcolor.Cyan.Printf("%s: no pixellock payload detected; wiped anyway\n", input)
+				}
+
+				if info, err := os.Stat(inputPath); err == nil && info.IsDir() {
+					results, err := pixellock.WipeDirectory(inputPath, outputPath, opts, mode, stegoBatchFromFlags(c))
+					if err != nil {
+						gookitcolor.Red.Println(err)
+						return err
+					}
+					failed := 0
+					for _, r := range results {
+						if r.Err != nil {
+							failed++
+							gookitcolor.Red.Printf("%s: %v\n", r.Input, r.Err)
+							continue
+						}
+						report(r.Input, r.Analysis)
+					}
+					fmt.Printf("Wiped %d of %d images into %s.\n", len(results)-failed, len(results), outputPath)
+					if failed > 0 {
+						return fmt.Errorf("failed to wipe %d images", failed)
+					}
+					return nil
+				}
+
+				analysis, err := pixellock.WipeStego(inputPath, outputPath, opts, mode)
+				if err != nil {
+					gookitcolor.Red.Println(err)
+					return err
+				}
+				report(inputPath, analysis)
+				gookitcolor.Cyan.Println("Wiped image saved to:", outputPath)
+				return nil
+			},
+		},
+		{
+			Name:  "diff",
+			Usage: "Show where two images of the same size differ, such as a cover and its stego image",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:     "original",
+					Value:    "",
+					Usage:    "Original image",
+					Required: true,
+				},
+				&cli.StringFlag{
+					Name:     "modified",
+					Value:    "",
+					Usage:    "Modified image to compare against the original",
+					Required: true,
+				},
+				&cli.StringFlag{
+					Name:    "output",
+					Aliases: []string{"o"},
+					Value:   "",
+					Usage:   "Save a PNG heatmap of the changed pixels here; black is unchanged, blue to red is a growing change",
+				},
+				&cli.StringFlag{
+					Name:  "channel",
+					Value: pixellock.ChannelsRGBA.String(),
+					Usage: "Channels to compare, e.g. b or rgb",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				channels, err := pixellock.ParseStegoChannels(c.String("channel"))
+				if err != nil {
+					gookitcolor.Red.Println(err)
+					return err
+				}
+				output := c.String("output")
+				d, err := pixellock.DiffImageFiles(c.String("original"), c.String("modified"), output, channels)
+				if err != nil {
+					gookitcolor.Red.Println(err)
+					return err
+				}
+
+				fmt.Printf("Changed pixels: %d of %d (%.2f%%)\n", d.Changed, d.Pixels, 100*float64(d.Changed)/float64(max(d.Pixels, 1)))
+				fmt.Printf("Max channel delta: %d\n", d.MaxDelta)
+				if math.IsInf(d.PSNR, 1) {
+					fmt.Println("PSNR: infinite (identical)")
+				} else {
+					fmt.Printf("PSNR: %.2f dB\n", d.PSNR)
+				}
+				if output != "" {
+					gookitcolor.Cyan.Println("Heatmap saved to:", output)
+				}
+				return nil
+			},
+		},
+	},
+}
+
+// errorsCmd documents the error codes of --progress json and stego detect
+// --json
+var errorsCmd = &cli.Command{
+	Name:  "errors",
+	Usage: "Document the error codes given in JSON output",
+	Subcommands: []*cli.Command{
+		{
+			Name:  "list",
+			Usage: "List the error codes, whether retrying may help, and what each means",
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:  "json",
+					Usage: "Print the codes as a JSON array",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				codes := pixellock.ErrorCodes()
+				if c.Bool("json") {
+					enc := json.NewEncoder(os.Stdout)
+					enc.SetIndent("", "  ")
+					return enc.Encode(codes)
+				}
+				w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+				fmt.Fprintln(w, "CODE\tRETRYABLE\tDESCRIPTION")
+				for _, code := range codes {
+					fmt.Fprintf(w, "%s\t%t\t%s\n", code.Code, code.Retryable, code.Description)
+				}
+				return w.Flush()
+			},
+		},
+	},
+}
+
+var serveCmd = &cli.Command{
+	Name:  "serve",
+	Usage: "Serve encryption, decryption and steganography over HTTP, and gRPC",
+	Description: "Serves POST /v1/encrypt, /v1/decrypt, /v1/stego/hide and /v1/stego/reveal, each taking the image as the request body\n" +
+		"or as the part named image of a multipart body. Failures are answered with a JSON body holding their error code.\n" +
+		"GET /metrics gives the metrics of the images encrypted and decrypted, for Prometheus to scrape.\n" +
+		"With --grpc, the pixellock.v1 gRPC service is served too, streaming large payloads in chunks.",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "listen",
+			Value: ":8080",
+			Usage: "Address to listen on",
+		},
+		&cli.StringFlag{
+			Name:  "grpc",
+			Usage: "Address to serve the pixellock.v1 gRPC service on as well, such as :9090",
+		},
+		secret(&cli.StringFlag{
+			Name:    "key",
+			Aliases: []string{"k"},
+			Usage:   "Encryption key (base64 encoded); IMAGE_ENCRYPTION_KEY when neither this nor --key-from is given",
+		}),
+		&cli.StringFlag{
+			Name:  "key-from",
+			Usage: "Read the key from env:NAME, file:PATH or keyring:NAME, a key saved with keygen --keyring",
+		},
+		&cli.BoolFlag{
+			Name:  "allow-key-override",
+			Usage: "Let requests give their own key in the " + server.KeyHeader + " header",
+		},
+		&cli.Int64Flag{
+			Name:  "max-body-bytes",
+			Value: server.DefaultMaxBodyBytes,
+			Usage: "Largest request body taken",
+		},
+		&cli.IntFlag{
+			Name:  "max-concurrent",
+			Usage: "Requests handled at once, beyond which they are refused as busy (default: number of CPUs)",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		key, err := serviceKey(c)
+		if err != nil {
+			return err
+		}
+		srv, err := server.New(server.Config{
+			Key:              key,
+			AllowKeyOverride: c.Bool("allow-key-override"),
+			MaxBodyBytes:     c.Int64("max-body-bytes"),
+			MaxConcurrent:    c.Int("max-concurrent"),
+			Stego:            pixellock.DefaultStegoOptions,
+			Logger:           logger,
+			Metrics:          pixellock.NewMetrics(),
+		})
+		if err != nil {
+			return err
+		}
+		addr := c.String("grpc")
+		if addr == "" {
+			gookitcolor.Green.Println("Serving on", c.String("listen"))
+			return server.ListenAndServe(c.Context, c.String("listen"), srv)
+		}
+
+		// Either server failing stops the other
+		ctx, cancel := context.WithCancel(c.Context)
+		defer cancel()
+		errc := make(chan error, 2)
+		go func() { errc <- server.ListenAndServe(ctx, c.String("listen"), srv) }()
+		go func() { errc <- server.ListenAndServeGRPC(ctx, addr, srv) }()
+		gookitcolor.Green.Println("Serving on", c.String("listen"), "and gRPC on", addr)
+		err = <-errc
+		cancel()
+		return errors.Join(err, <-errc)
+	},
+}
+
+var galleryCmd = &cli.Command{
+	Name:  "gallery",
+	Usage: "Browse a directory of encrypted images from a web browser, decrypted in memory",
+	Description: "Serves an index of the directory, with thumbnails, and each image decrypted as it is asked for. Nothing decrypted\n" +
+		"is written to disk. Away from a loopback address, a password (--user and --password) or a token is required.",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:     "input",
+			Aliases:  []string{"i"},
+			Usage:    "Directory of encrypted images",
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:  "listen",
+			Value: "127.0.0.1:8443",
+			Usage: "Address to listen on",
+		},
+		secret(&cli.StringFlag{
+			Name:    "key",
+			Aliases: []string{"k"},
+			Usage:   "Encryption key (base64 encoded); IMAGE_ENCRYPTION_KEY when neither this nor --key-from is given",
+		}),
+		&cli.StringFlag{
+			Name:  "key-from",
+			Usage: "Read the key from env:NAME, file:PATH or keyring:NAME, a key saved with keygen --keyring",
+		},
+		&cli.StringFlag{
+			Name:  "user",
+			Usage: "Username asked for with HTTP basic authentication, with --password",
+		},
+		secret(&cli.StringFlag{
+			Name:  "password",
+			Usage: "Password asked for with HTTP basic authentication; PIXELLOCK_GALLERY_PASSWORD when not given",
+		}),
+		secret(&cli.StringFlag{
+			Name:  "token",
+			Usage: "Token taken as a bearer token, or in a link with ?" + gallery.TokenParam + "=",
+		}),
+		&cli.BoolFlag{
+			Name:  "generate-token",
+			Usage: "Make a random token, and print the link that gives it",
+		},
+		&cli.BoolFlag{
+			Name:  "tls",
+			Usage: "Serve HTTPS with a self-signed certificate made at startup, printing its fingerprint",
+		},
+		&cli.IntFlag{
+			Name:  "thumbnail-size",
+			Value: pixellock.DefaultThumbnailSize,
+			Usage: "Longer side of thumbnails, in pixels",
+		},
+		&cli.IntFlag{
+			Name:  "thumbnail-cache",
+			Value: gallery.DefaultThumbnailCacheEntries,
+			Usage: "Thumbnails kept in memory",
+		},
+		&cli.Int64Flag{
+			Name:  "cache-size",
+			Value: pixellock.DefaultDecryptedCacheSize,
+			Usage: "Bytes of decrypted images kept in memory; none when negative",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		key, err := serviceKey(c)
+		if err != nil {
+			return err
+		}
+		if key == nil {
+			return errors.New("no key: give it with --key or --key-from, or in IMAGE_ENCRYPTION_KEY")
+		}
+		listen := c.String("listen")
+		host, port, err := net.SplitHostPort(listen)
+		if err != nil {
+			return fmt.Errorf("invalid --listen address %q: %w", listen, err)
+		}
+		password := c.String("password")
+		if password == "" {
+			password = os.Getenv("PIXELLOCK_GALLERY_PASSWORD")
+		}
+		token := c.String("token")
+		if c.Bool("generate-token") {
+			random, err := pixellock.GenerateRandomKey()
+			if err != nil {
+				return err
+			}
+			token = base64.RawURLEncoding.EncodeToString(random)
+		}
+		ip := net.ParseIP(host)
+		loopback := host == "localhost" || ip != nil && ip.IsLoopback()
+		if !loopback && token == "" && c.String("user") == "" {
+			return fmt.Errorf("%s is reachable from other machines: give --user and --password, or --token or --generate-token", listen)
+		}
+		g, err := gallery.New(gallery.Config{
+			Dir:                   c.String("input"),
+			Key:                   key,
+			CacheSize:             c.Int64("cache-size"),
+			ThumbnailSize:         c.Int("thumbnail-size"),
+			ThumbnailCacheEntries: c.Int("thumbnail-cache"),
+			Username:              c.String("user"),
+			Password:              password,
+			Token:                 token,
+			Logger:                logger,
+		})
+		if err != nil {
+			return err
+		}
+		scheme := "http"
+		var config *tls.Config
+		if c.Bool("tls") {
+			hosts := []string{"localhost", "127.0.0.1", "::1"}
+			if name, err := os.Hostname(); err == nil {
+				hosts = append(hosts, name)
+			}
+			if host != "" && !slices.Contains(hosts, host) {
+				hosts = append(hosts, host)
+			}
+			var fingerprint string
+			if config, fingerprint, err = gallery.SelfSignedTLS(hosts); err != nil {
+				return err
+			}
+			scheme = "https"
+			gookitcolor.Yellow.Println("Self-signed certificate, SHA-256 fingerprint:", fingerprint)
+		}
+		if host == "" || ip != nil && ip.IsUnspecified() {
+			host = "localhost"
+		}
+		link := scheme + "://" + net.JoinHostPort(host, port) + "/"
+		if c.Bool("generate-token") {
+			link += "?" + gallery.TokenParam + "=" + token
+		}
+		gookitcolor.Green.Println("Serving the gallery on", link)
+		return gallery.ListenAndServe(c.Context, listen, g, config)
+	},
+}
+
+var mountCmd = &cli.Command{
+	Name:      "mount",
+	Usage:     "Mount a directory of encrypted images read-only with FUSE, each decrypted as it is read",
+	ArgsUsage: "<mountpoint>",
+	Description: "Each encrypted file appears under its name without the encrypted extension, and is decrypted in memory when it\n" +
+		"is first read; listing a directory decrypts nothing. A file that fails to decrypt, as with another key, fails to\n" +
+		"read with an I/O error, and is logged. Unmounts on Ctrl-C. Needs FUSE: /dev/fuse, and fusermount or root, on\n" +
+		"Linux; macFUSE on macOS.",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:     "input",
+			Aliases:  []string{"i"},
+			Usage:    "Directory of encrypted images",
+			Required: true,
+		},
+		secret(&cli.StringFlag{
+			Name:    "key",
+			Aliases: []string{"k"},
+			Usage:   "Encryption key (base64 encoded); IMAGE_ENCRYPTION_KEY when neither this nor --key-from is given",
+		}),
+		&cli.StringFlag{
+			Name:  "key-from",
+			Usage: "Read the key from env:NAME, file:PATH or keyring:NAME, a key saved with keygen --keyring",
+		},
+		&cli.StringFlag{
+			Name:  "encrypted-ext",
+			Value: pixellock.EncryptedExtension,
+			Usage: "Extension of the encrypted files",
+		},
+		&cli.Int64Flag{
+			Name:  "cache-size",
+			Value: pixellock.DefaultDecryptedCacheSize,
+			Usage: "Bytes of decrypted images kept in memory; none when negative",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		if c.NArg() != 1 {
+			return fmt.Errorf("mount takes one mountpoint, got %d arguments", c.NArg())
+		}
+		key, err := requiredServiceKey(c)
+		if err != nil {
+			return err
+		}
+		mountpoint := c.Args().First()
+		gookitcolor.Green.Printf("Mounting %s at %s; press Ctrl-C to unmount\n", c.String("input"), mountpoint)
+		return mount.Serve(c.Context, mountpoint, mount.Config{
+			Dir:          c.String("input"),
+			Key:          key,
+			EncryptedExt: c.String("encrypted-ext"),
+			CacheSize:    c.Int64("cache-size"),
+			Logger:       logger,
+		})
+	},
+}
+
+// serviceKey returns the key of serve, gallery, mount, daemon, catalog build and tag: that of
+// --key, read from --key-from, or in IMAGE_ENCRYPTION_KEY, or nil when none is given.
+func serviceKey(c *cli.Context) ([]byte, error) {
+	switch {
+	case c.String("key") != "":
+		return pixellock.DecodeKey(c.String("key"))
+	case c.String("key-from") != "":
+		return pixellock.ReadKeySource(c.String("key-from"))
+	case os.Getenv("IMAGE_ENCRYPTION_KEY") != "":
+		return pixellock.DecodeKey(os.Getenv("IMAGE_ENCRYPTION_KEY"))
+	}
+	return nil, nil
+}
+
+// requiredServiceKey returns the key serviceKey does, or an error when none
+// is given.
+func requiredServiceKey(c *cli.Context) ([]byte, error) {
+	key, err := serviceKey(c)
+	if err == nil && key == nil {
+		err = errors.New("no key: give it with --key, --key-from or IMAGE_ENCRYPTION_KEY")
+	}
+	return key, err
+}
+
+// defaultSocket is the socket daemon listens on and ctl connects to.
+const defaultSocket = "/run/pixellock.sock"
+
+// socketFlag is the flag of the daemon's socket.
+func socketFlag() cli.Flag {
+	return &cli.StringFlag{
+		Name:  "socket",
+		Value: defaultSocket,
+		Usage: "Unix socket of the daemon",
+	}
+}
+
+var daemonCmd = &cli.Command{
+	Name:  "daemon",
+	Usage: "Run encryption and decryption jobs sent over a Unix socket, with a key loaded once",
+	Description: "Listens on --socket, which only its owner may use, for the jobs pixellock ctl submits. The key is loaded at start,\n" +
+		"and loaded again on SIGHUP; jobs already submitted keep the key they were submitted with. SIGTERM and SIGINT drain\n" +
+		"the daemon: it takes no more jobs and stops once those queued are done. Under systemd, Type=notify is supported.",
+	Flags: []cli.Flag{
+		socketFlag(),
+		secret(&cli.StringFlag{
+			Name:    "key",
+			Aliases: []string{"k"},
+			Usage:   "Encryption key (base64 encoded); IMAGE_ENCRYPTION_KEY when neither this nor --key-from is given",
+		}),
+		&cli.StringFlag{
+			Name:  "key-from",
+			Usage: "Read the key from env:NAME, file:PATH or keyring:NAME, again on SIGHUP",
+		},
+		&cli.IntFlag{
+			Name:  "workers",
+			Usage: "Jobs run at once (default: number of CPUs)",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		loadKey := func() ([]byte, error) {
+			key, err := serviceKey(c)
+			if err == nil && key == nil {
+				err = errors.New("no key: give it with --key, --key-from or IMAGE_ENCRYPTION_KEY")
+			}
+			return key, err
+		}
+		d, err := daemon.New(daemon.Config{LoadKey: loadKey, Workers: c.Int("workers"), Logger: logger})
+		if err != nil {
+			return err
+		}
+		l, err := daemon.Listen(c.String("socket"))
+		if err != nil {
+			return err
+		}
+		served := make(chan error, 1)
+		go func() { served <- d.Serve(l) }()
+		gookitcolor.Green.Println("Listening on", c.String("socket"))
+		if err := daemon.Notify("READY=1"); err != nil {
+			logger.Warn("failed to notify systemd", "err", err)
+		}
+
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGHUP, syscall.SIGTERM)
+		defer signal.Stop(signals)
+		ctx := c.Context
+		for {
+			select {
+			case err := <-served:
+				return err
+			case sig := <-signals:
+				if sig == syscall.SIGHUP {
+					daemon.Notify("RELOADING=1")
+					if err := d.Reload(); err != nil {
+						logger.Error("reload failed, keeping the key loaded before", "err", err)
+					} else {
+						logger.Info("key reloaded")
+					}
+					daemon.Notify("READY=1")
+					continue
+				}
+			case <-ctx.Done():
+				ctx = context.Background() // Interrupted once
+			}
+			logger.Info("draining")
+			daemon.Notify("STOPPING=1")
+			go d.Drain(context.Background())
+		}
+	},
+}
+
+var ctlCmd = &cli.Command{
+	Name:  "ctl",
+	Usage: "Control a running daemon",
+	Flags: []cli.Flag{socketFlag()},
+	Subcommands: []*cli.Command{
+		{
+			Name:  "status",
+			Usage: "Show the state of the daemon and of its recent jobs",
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:  "json",
+					Usage: "Print the status as JSON",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				resp, err := daemon.Call(c.Context, c.String("socket"), daemon.Request{Command: daemon.CommandStatus})
+				if err != nil {
+					return err
+				}
+				if c.Bool("json") {
+					return json.NewEncoder(os.Stdout).Encode(resp.Status)
+				}
+				printDaemonStatus(*resp.Status)
+				return nil
+			},
+		},
+		{
+			Name:  "submit",
+			Usage: "Submit a job, or a batch of them, to the daemon",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:  "op",
+					Usage: "Operation of the job: encrypt or decrypt",
+				},
+				&cli.StringFlag{
+					Name:    "input",
+					Aliases: []string{"i"},
+					Usage:   "File or directory to encrypt or decrypt",
+				},
+				&cli.StringFlag{
+					Name:    "output",
+					Aliases: []string{"o"},
+					Usage:   "File or directory to write",
+				},
+				&cli.BoolFlag{
+					Name:    "recursive",
+					Aliases: []string{"r"},
+					Usage:   "Descend into the subdirectories of a directory",
+				},
+				&cli.BoolFlag{
+					Name:  "overwrite",
+					Usage: "Overwrite existing output files",
+				},
+				&cli.StringFlag{
+					Name:  "jobs",
+					Usage: "Submit the JSON array of jobs in this file, - for standard input, instead of one given by the flags",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				var jobs []daemon.Job
+				if name := c.String("jobs"); name != "" {
+					var data []byte
+					var err error
+					if name == "-" {
+						data, err = io.ReadAll(os.Stdin)
+					} else {
+						data, err = os.ReadFile(name)
+					}
+					if err != nil {
+						return err
+					}
+					if err := json.Unmarshal(data, &jobs); err != nil {
+						return fmt.Errorf("bad jobs in %s: %w", name, err)
+					}
+				} else {
+					jobs = []daemon.Job{{Op: c.String("op"), Input: c.String("input"), Output: c.String("output"), Recursive: c.Bool("recursive"), Overwrite: c.Bool("overwrite")}}
+				}
+				// The daemon runs in a directory of its own, and traces the
+				// jobs beneath this command
+				carrier := propagation.MapCarrier{}
+				propagation.TraceContext{}.Inject(c.Context, carrier)
+				traceParent := carrier.Get("traceparent")
+				for i := range jobs {
+					if jobs[i].TraceParent == "" {
+						jobs[i].TraceParent = traceParent
+					}
+					for _, p := range []*string{&jobs[i].Input, &jobs[i].Output} {
+						if *p == "" {
+							continue
+						}
+						abs, err := filepath.Abs(*p)
+						if err != nil {
+							return err
+						}
+						*p = abs
+					}
+				}
+				resp, err := daemon.Call(c.Context, c.String("socket"), daemon.Request{Command: daemon.CommandSubmit, Jobs: jobs})
+				if err != nil {
+					return err
+				}
+				for _, id := range resp.IDs {
+					fmt.Println(id)
+				}
+				return nil
+			},
+		},
+		{
+			Name:  "drain",
+			Usage: "Stop the daemon once the jobs it has are done, waiting until it has",
+			Action: func(c *cli.Context) error {
+				resp, err := daemon.Call(c.Context, c.String("socket"), daemon.Request{Command: daemon.CommandDrain})
+				if err != nil {
+					return err
+				}
+				printDaemonStatus(*resp.Status)
+				return nil
+			},
+		},
+	},
+}
+
+// catalogDBFlag is the flag of a catalog's database file.
+func catalogDBFlag() cli.Flag {
+	return &cli.StringFlag{
+		Name:     "db",
+		Usage:    "SQLite database file of the catalog",
+		Required: true,
+	}
+}
+
+var catalogCmd = &cli.Command{
+	Name:  "catalog",
+	Usage: "Keep an SQLite catalog of a directory of encrypted files, to find images without decrypting them all",
+	Subcommands: []*cli.Command{
+		{
+			Name:  "build",
+			Usage: "Catalog the encrypted files of a directory, or bring the catalog up to date",
+			Description: "Decrypts each file to record the original name, format, dimensions and capture date of its image, with the\n" +
+				"size, modification time and SHA-256 hash of the file and the fingerprint of the key. Files whose size and\n" +
+				"modification time are those cataloged are not decrypted again, and entries of files gone are dropped.",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:     "input",
+					Aliases:  []string{"i"},
+					Usage:    "Directory of encrypted files, searched recursively",
+					Required: true,
+				},
+				catalogDBFlag(),
+				secret(&cli.StringFlag{
+					Name:    "key",
+					Aliases: []string{"k"},
+					Usage:   "Decryption key (base64 encoded); IMAGE_ENCRYPTION_KEY when neither this nor --key-from is given",
+				}),
+				&cli.StringFlag{
+					Name:  "key-from",
+					Usage: "Read the key from env:NAME, file:PATH or keyring:NAME",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				key, err := requiredServiceKey(c)
+				if err != nil {
+					return err
+				}
+				cat, err := catalog.Open(c.String("db"))
+				if err != nil {
+					return err
+				}
+				stats, err := cat.Build(c.Context, c.String("input"), key)
+				if saveErr := cat.Save(c.String("db")); saveErr != nil {
+					return errors.Join(err, saveErr)
+				}
+				if err != nil {
+					return err
+				}
+				gookitcolor.Green.Printf("Cataloged %s: %d added, %d updated, %d unchanged, %d removed\n", cat.Dir, stats.Added, stats.Updated, stats.Unchanged, stats.Removed)
+				if stats.Failed > 0 {
+					gookitcolor.Red.Println(stats.Failures)
+					return fmt.Errorf("%d of the files could not be cataloged", stats.Failed)
+				}
+				return nil
+			},
+		},
+		{
+			Name:  "search",
+			Usage: "List the cataloged files whose images match all the flags given",
+			Flags: []cli.Flag{
+				catalogDBFlag(),
+				&cli.StringFlag{
+					Name:  "name",
+					Usage: "Glob the original file name matches, regardless of case, such as \"DSC_10*\"",
+				},
+				&cli.StringFlag{
+					Name:  "after",
+					Usage: "Taken on or after this date, such as 2024-03-01, or time, such as \"2024-03-01 14:30:00\"",
+				},
+				&cli.StringFlag{
+					Name:  "before",
+					Usage: "Taken before this date or time",
+				},
+				&cli.StringFlag{
+					Name:  "format",
+					Usage: "Format of the original image, such as jpeg",
+				},
+				&cli.StringSliceFlag{
+					Name:  "tag",
+					Usage: "Tagged with this tag, as key=value, or key alone for any value (repeatable)",
+				},
+				&cli.BoolFlag{
+					Name:  "json",
+					Usage: "Print the entries as JSON, with their paths relative to the directory",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				cat, err := catalog.Open(c.String("db"))
+				if err != nil {
+					return err
+				}
+				q := catalog.Query{Name: c.String("name"), Format: c.String("format")}
+				if q.Tags, err = pixellock.ParseTags(c.StringSlice("tag")); err != nil {
+					return err
+				}
+				for _, bound := range []struct {
+					flag string
+					t    *time.Time
+				}{{"after", &q.After}, {"before", &q.Before}} {
+					if s := c.String(bound.flag); s != "" {
+						if *bound.t, err = catalog.ParseTime(s); err != nil {
+							return fmt.Errorf("--%s: %w", bound.flag, err)
+						}
+					}
+				}
+				found, err := cat.Search(q)
+				if err != nil {
+					return err
+				}
+				if c.Bool("json") {
+					if found == nil {
+						found = []catalog.Entry{} // An empty array, not null
+					}
+					return json.NewEncoder(os.Stdout).Encode(found)
+				}
+				w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+				fmt.Fprintln(w, "FILE\tNAME\tFORMAT\tSIZE\tTAKEN\tTAGS")
+				for _, e := range found {
+					size, taken := "", ""
+					if e.Width > 0 {
+						size = fmt.Sprintf("%dx%d", e.Width, e.Height)
+					}
+					if !e.Taken.IsZero() {
+						taken = e.Taken.Format(time.DateTime)
+					}
+					fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", filepath.Join(cat.Dir, filepath.FromSlash(e.Path)), e.Name, e.Format, size, taken, e.Tags)
+				}
+				return w.Flush()
+			},
+		},
+		{
+			Name:  "verify",
+			Usage: "Report the files of the directory that are missing from, new to, or changed since the catalog",
+			Description: "A file whose size and modification time match is hashed, unless --quick is given, to tell whether its\n" +
+				"contents changed all the same. Exits with status 1 when there is any difference.",
+			Flags: []cli.Flag{
+				catalogDBFlag(),
+				&cli.StringFlag{
+					Name:    "input",
+					Aliases: []string{"i"},
+					Usage:   "Directory to compare the catalog with (default: the directory it was built from)",
+				},
+				&cli.BoolFlag{
+					Name:  "quick",
+					Usage: "Compare sizes and modification times only, without hashing the files",
+				},
+				&cli.BoolFlag{
+					Name:  "json",
+					Usage: "Print the differences as JSON",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				cat, err := catalog.Open(c.String("db"))
+				if err != nil {
+					return err
+				}
+				dir := c.String("input")
+				if dir == "" {
+					dir = cat.Dir
+				}
+				if dir == "" {
+					return errors.New("the catalog is empty; give the directory with --input")
+				}
+				diffs, err := cat.Verify(c.Context, dir, c.Bool("quick"))
+				if err != nil {
+					return err
+				}
+				if c.Bool("json") {
+					if diffs == nil {
+						diffs = []catalog.Difference{}
+					}
+					if err := json.NewEncoder(os.Stdout).Encode(diffs); err != nil {
+						return err
+					}
+				} else {
+					w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+					for _, d := range diffs {
+						fmt.Fprintf(w, "%s\t%s\t%s\n", d.Kind, d.Path, d.Detail)
+					}
+					w.Flush()
+				}
+				if len(diffs) > 0 {
+					return fmt.Errorf("%s does not match the catalog", dir)
+				}
+				if !c.Bool("json") {
+					gookitcolor.Green.Printf("The catalog matches %s\n", dir)
+				}
+				return nil
+			},
+		},
+	},
+}
+
+// tagFlags are the flags of a tag subcommand: the tags, used as tagUsage
+// says, and the key, with those of serviceKey.
+func tagFlags(tagUsage string) []cli.Flag {
+	return []cli.Flag{
+		&cli.StringSliceFlag{
+			Name:  "tag",
+			Usage: tagUsage,
+		},
+		secret(&cli.StringFlag{
+			Name:    "key",
+			Aliases: []string{"k"},
+			Usage:   "Key of the files (base64 encoded); IMAGE_ENCRYPTION_KEY when neither this nor --key-from is given",
+		}),
+		&cli.StringFlag{
+			Name:  "key-from",
+			Usage: "Read the key from env:NAME, file:PATH or keyring:NAME",
+		},
+		&cli.BoolFlag{
+			Name:    "recursive",
+			Aliases: []string{"r"},
+			Usage:   "Take the encrypted files of the subdirectories of a directory given too",
+		},
+	}
+}
+
+// tagFiles returns the files the arguments of c name: each encrypted file
+// of a directory, and of its subdirectories with --recursive, in its place.
+func tagFiles(c *cli.Context) ([]string, error) {
+	if c.NArg() == 0 {
+		return nil, errors.New("no files: give the encrypted files, or directories of them, after the flags")
+	}
+	var files []string
+	for _, arg := range c.Args().Slice() {
+		info, err := os.Stat(arg)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			files = append(files, arg)
+			continue
+		}
+		walk := pixellock.WalkSource(arg, c.Bool("recursive"), func(path string, info fs.FileInfo) bool {
+			return strings.HasSuffix(path, pixellock.EncryptedExtension)
+		})
+		err = walk(c.Context, func(path string) bool {
+			files = append(files, path)
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+// editTags changes the tags of each file the arguments of c name with
+// edit, which reports whether it changed them, writing back those it
+// changed and printing the tags of every file.
+func editTags(c *cli.Context, edit func(tags pixellock.Tags) bool) error {
+	key, err := requiredServiceKey(c)
+	if err != nil {
+		return err
+	}
+	files, err := tagFiles(c)
+	if err != nil {
+		return err
+	}
+	failed := 0
+	for _, name := range files {
+		tags, err := pixellock.ReadTags(name, key)
+		if tags == nil {
+			tags = pixellock.Tags{}
+		}
+		if err == nil && edit(tags) {
+			err = pixellock.WriteTags(name, key, tags)
+		}
+		if err != nil {
+			gookitcolor.Red.Printf("%s: %v\n", name, err)
+			failed++
+			continue
+		}
+		if len(tags) == 0 {
+			fmt.Printf("%s: no tags\n", name)
+		} else {
+			fmt.Printf("%s: %s\n", name, tags)
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of the files could not be tagged", failed)
+	}
+	return nil
+}
+
+// A taggedFile is a file as tag list --json prints it.
+type taggedFile struct {
+	Path string         `json:"path"`
+	Tags pixellock.Tags `json:"tags"`
+}
+
+var tagCmd = &cli.Command{
+	Name:  "tag",
+	Usage: "Label encrypted files with tags, such as client=acme, to pick them out without decrypting them",
+	Description: "Tags are sealed with the key inside each file, between its thumbnail and its ciphertext. Changing them\n" +
+		"rewrites the tags alone; the encrypted image is copied byte for byte. decrypt --tag and catalog search --tag\n" +
+		"pick files out by their tags.",
+	Subcommands: []*cli.Command{
+		{
+			Name:      "add",
+			Usage:     "Add tags to files, replacing the values of any they have already",
+			ArgsUsage: "<file or directory>...",
+			Flags:     tagFlags("Tag to add, as key=value (repeatable)"),
+			Action: func(c *cli.Context) error {
+				add, err := pixellock.ParseTags(c.StringSlice("tag"))
+				if err == nil && len(add) == 0 {
+					err = errors.New("no tags: give them with --tag key=value")
+				}
+				if err == nil {
+					err = add.Check()
+				}
+				if err != nil {
+					return err
+				}
+				return editTags(c, func(tags pixellock.Tags) bool {
+					changed := false
+					for k, v := range add {
+						if old, ok := tags[k]; !ok || old != v {
+							tags[k], changed = v, true
+						}
+					}
+					return changed
+				})
+			},
+		},
+		{
+			Name:      "rm",
+			Usage:     "Remove tags from files",
+			ArgsUsage: "<file or directory>...",
+			Flags:     tagFlags("Tag to remove, as key=value, or key alone whatever its value (repeatable)"),
+			Action: func(c *cli.Context) error {
+				remove, err := pixellock.ParseTags(c.StringSlice("tag"))
+				if err == nil && len(remove) == 0 {
+					err = errors.New("no tags: give them with --tag key=value, or --tag key")
+				}
+				if err != nil {
+					return err
+				}
+				return editTags(c, func(tags pixellock.Tags) bool {
+					changed := false
+					for k, v := range remove {
+						if old, ok := tags[k]; ok && (v == "" || old == v) {
+							delete(tags, k)
+							changed = true
+						}
+					}
+					return changed
+				})
+			},
+		},
+		{
+			Name:      "list",
+			Usage:     "List the tags of files",
+			ArgsUsage: "<file or directory>...",
+			Flags: append(tagFlags("List only the files with this tag, as key=value, or key alone for any value (repeatable)"),
+				&cli.BoolFlag{
+					Name:  "json",
+					Usage: "Print the files and their tags as JSON",
+				},
+			),
+			Action: func(c *cli.Context) error {
+				want, err := pixellock.ParseTags(c.StringSlice("tag"))
+				if err != nil {
+					return err
+				}
+				key, err := requiredServiceKey(c)
+				if err != nil {
+					return err
+				}
+				files, err := tagFiles(c)
+				if err != nil {
+					return err
+				}
+				listed := []taggedFile{}
+				failed := 0
+				for _, name := range files {
+					tags, err := pixellock.ReadTags(name, key)
+					if err != nil {
+						fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+						failed++
+						continue
+					}
+					if tags.Match(want) {
+						listed = append(listed, taggedFile{Path: name, Tags: tags})
+					}
+				}
+				if c.Bool("json") {
+					if err := json.NewEncoder(os.Stdout).Encode(listed); err != nil {
+						return err
+					}
+				} else {
+					w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+					fmt.Fprintln(w, "FILE\tTAGS")
+					for _, f := range listed {
+						fmt.Fprintf(w, "%s\t%s\n", f.Path, f.Tags)
+					}
+					w.Flush()
+				}
+				if failed > 0 {
+					return fmt.Errorf("the tags of %d of the files could not be read", failed)
+				}
+				return nil
+			},
+		},
+	},
+}
+
+// parityDirFlag is the --parity-dir flag of the parity subcommands.
+func parityDirFlag() cli.Flag {
+	return &cli.StringFlag{
+		Name:  "parity-dir",
+		Usage: "Directory the parity is kept in, such as on another disk; " + parity.DirName + " in the input directory by default",
+	}
+}
+
+var parityCmd = &cli.Command{
+	Name:  "parity",
+	Usage: "Keep Reed-Solomon recovery data of a directory of encrypted files, to rebuild files damaged or lost",
+	Description: "Like PAR2, parity create cuts the files of a directory into blocks and computes parity blocks of them, kept with\n" +
+		"an index of SHA-256 hashes of each file and block. parity repair finds the files missing or damaged since, by\n" +
+		"their hashes, and rebuilds them byte for byte, as long as no more blocks are damaged than there are parity\n" +
+		"blocks intact. Files are read a stripe at a time, so memory stays bounded however large they are.",
+	Subcommands: []*cli.Command{
+		{
+			Name:  "create",
+			Usage: "Compute the parity of the files of a directory, replacing any parity there",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:     "input",
+					Aliases:  []string{"i"},
+					Usage:    "Directory of encrypted files, covered recursively",
+					Required: true,
+				},
+				&cli.StringFlag{
+					Name:  "redundancy",
+					Value: "10%",
+					Usage: "Size of the parity as a share of the files, from 1% to 100%: about how much of them can be rebuilt",
+				},
+				parityDirFlag(),
+			},
+			Action: func(c *cli.Context) error {
+				redundancy, err := parseRedundancy(c.String("redundancy"))
+				if err != nil {
+					return err
+				}
+				idx, err := parity.Create(c.Context, c.String("input"), parity.Options{Redundancy: redundancy, ParityDir: c.String("parity-dir")})
+				if err != nil {
+					return err
+				}
+				gookitcolor.Green.Printf("Created parity of %d files (%d bytes): %d parity blocks of %d bytes for %d data blocks\n",
+					len(idx.Files), idx.Size(), len(idx.Parity), idx.BlockSize, len(idx.Blocks))
+				return nil
+			},
+		},
+		{
+			Name:  "repair",
+			Usage: "Rebuild the files of a directory missing or damaged since its parity was created",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:     "input",
+					Aliases:  []string{"i"},
+					Usage:    "Directory of encrypted files the parity was created of",
+					Required: true,
+				},
+				parityDirFlag(),
+				&cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "Report the damage, repairing none",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				report, err := parity.Repair(c.Context, c.String("input"), parity.RepairOptions{
+					ParityDir: c.String("parity-dir"),
+					DryRun:    c.Bool("dry-run"),
+				})
+				for _, path := range report.Damaged {
+					fmt.Printf("  %s\n", path)
+				}
+				if err != nil {
+					return err
+				}
+				switch {
+				case len(report.Damaged) == 0 && report.DamagedParity == 0:
+					gookitcolor.Green.Printf("All %d files are intact\n", report.Files)
+				case c.Bool("dry-run"):
+					gookitcolor.Yellow.Printf("%d of %d files and %d parity blocks are damaged, and can be repaired\n", len(report.Damaged), report.Files, report.DamagedParity)
+				default:
+					gookitcolor.Green.Printf("Repaired %d of %d files and %d parity blocks\n", len(report.Damaged), report.Files, report.DamagedParity)
+				}
+				return nil
+			},
+		},
+	},
+}
+
+var hookCmd = &cli.Command{
+	Name:  "hook",
+	Usage: "Keep unencrypted images out of a Git repository",
+	Subcommands: []*cli.Command{
+		{
+			Name:  "check",
+			Usage: "Fail if the repository tracks, or with --staged is about to commit, an unencrypted image",
+			Description: "Images named in " + githook.AllowFile + " at the top of the repository, a glob on each line, are allowed,\n" +
+				"as are those --allow matches. A glob with a slash matches the whole path, such as docs/*.png, and one\n" +
+				"without matches the file name, such as *.svg.",
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:  "staged",
+					Usage: "Check the files staged for commit rather than every tracked file",
+				},
+				&cli.StringSliceFlag{
+					Name:  "allow",
+					Usage: "Allow the images whose path matches this glob (repeatable)",
+				},
+				&cli.BoolFlag{
+					Name:  "auto-encrypt",
+					Usage: "Encrypt the images found, and stage the encrypted files in their place, instead of failing",
+				},
+				secret(&cli.StringFlag{
+					Name:    "key",
+					Aliases: []string{"k"},
+					Usage:   "Key (base64 encoded) for --auto-encrypt; IMAGE_ENCRYPTION_KEY when neither this nor --key-from is given",
+				}),
+				&cli.StringFlag{
+					Name:  "key-from",
+					Usage: "Read the key for --auto-encrypt from env:NAME, file:PATH or keyring:NAME",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				repo, err := githook.Open(c.Context, ".")
+				if err != nil {
+					return err
+				}
+				list := repo.Tracked
+				if c.Bool("staged") {
+					list = repo.Staged
+				}
+				files, err := list(c.Context)
+				if err != nil {
+					return err
+				}
+				allow, err := repo.Allowlist()
+				if err != nil {
+					return err
+				}
+				found, err := repo.Unencrypted(c.Context, files, append(allow, c.StringSlice("allow")...))
+				if err != nil || len(found) == 0 {
+					return err
+				}
+				if !c.Bool("auto-encrypt") {
+					for _, name := range found {
+						gookitcolor.Red.Printf("%s: unencrypted image\n", name)
+					}
+					return fmt.Errorf("unencrypted images found: %d; encrypt them, or allow them in %s", len(found), githook.AllowFile)
+				}
+				key, err := serviceKey(c)
+				if err != nil {
+					return err
+				}
+				if key == nil {
+					return errors.New("no key for --auto-encrypt: give it with --key, --key-from or IMAGE_ENCRYPTION_KEY")
+				}
+				encrypted, err := repo.EncryptStaged(c.Context, key, found)
+				for i, name := range encrypted {
+					gookitcolor.Green.Printf("%s: encrypted to %s, which is staged in its place\n", found[i], name)
+				}
+				if err != nil {
+					return err
+				}
+				gookitcolor.Yellow.Println("The images are left in the working tree, untracked; add them to .gitignore, or delete them.")
+				return nil
+			},
+		},
+		{
+			Name:  "install",
+			Usage: "Install the pre-commit hook that runs hook check --staged",
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:  "auto-encrypt",
+					Usage: "Have the hook encrypt the images it finds instead of refusing the commit",
+				},
+				&cli.StringFlag{
+					Name:  "key-from",
+					Usage: "Key source the hook encrypts with, env:NAME, file:PATH or keyring:NAME; IMAGE_ENCRYPTION_KEY otherwise",
+				},
+				&cli.BoolFlag{
+					Name:  "force",
+					Usage: "Replace a pre-commit hook that pixellock did not install",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				repo, err := githook.Open(c.Context, ".")
+				if err != nil {
+					return err
+				}
+				exe, err := os.Executable()
+				if err != nil {
+					return err
+				}
+				command := shellQuote(exe) + " hook check --staged"
+				if c.Bool("auto-encrypt") {
+					command += " --auto-encrypt"
+					if source := c.String("key-from"); source != "" {
+						command += " --key-from " + shellQuote(source)
+					}
+				}
+				hook, err := repo.Install(c.Context, command, c.Bool("force"))
+				if err != nil {
+					return err
+				}
+				gookitcolor.Green.Println("Installed", hook)
+				return nil
+			},
+		},
+	},
+}
+
+// shellQuote quotes s as one word for sh.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// printDaemonStatus prints the status of a daemon, and its jobs as a
+// table.
+func printDaemonStatus(s daemon.Status) {
+	fmt.Printf("State: %s, since %s\n", s.State, s.Started.Format(time.DateTime))
+	fmt.Printf("Key loaded: %s\n", s.KeyLoaded.Format(time.DateTime))
+	fmt.Printf("Jobs: %d queued, %d running, %d done, %d failed\n", s.Queued, s.Running, s.Done, s.Failed)
+	if len(s.Jobs) == 0 {
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tOP\tSTATE\tINPUT\tOUTPUT\tERROR")
+	for _, j := range s.Jobs {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\n", j.ID, j.Op, j.State, j.Input, j.Output, j.Error)
+	}
+	w.Flush()
+}
+
+// reportCompression tells the user how much --compress shrinks payload, or
+// that it is stored uncompressed because deflating it does not help.
+// Encryption adds the same overhead either way, so sizes are compared
+// without it.
+func reportCompression(payload pixellock.Payload) {
+	raw, _, err := pixellock.PayloadSize(payload, pixellock.StegoOptions{})
+	if err != nil {
+		return
+	}
+	size, compressed, err := pixellock.PayloadSize(payload, pixellock.StegoOptions{Compress: true})
+	if err != nil {
+		return
+	}
+	if !compressed {
+		gookitcolor.Yellow.Println("Compression does not help this payload; storing it uncompressed.")
+		return
+	}
+	gookitcolor.Cyan.Printf("Payload compressed from %d to %d bytes.\n", raw, size)
+}
+
+// printStegoAnalysis prints the steganalysis verdict for one image.
+func printStegoAnalysis(input string, a pixellock.StegoAnalysis) {
+	verdictColor := gookitcolor.Green
+	switch a.Verdict {
+	case pixellock.VerdictSuspicious:
+		verdictColor = gookitcolor.Yellow
+	case pixellock.VerdictLikelyStego:
+		verdictColor = gookitcolor.Red
+	}
+	verdictColor.Printf("%s: %s (score %.2f)\n", input, a.Verdict, a.Score)
+	if a.Pixellock() {
+		gookitcolor.Cyan.Printf("  pixellock payload header found (version %d)\n", a.PixellockVersion)
+	}
+	for _, ch := range a.Channels {
+		if ch.Anomalous {
+			fmt.Printf("  channel %s anomalous: chi-square %.2f over %.0f%% of the image, RS estimate %.2f\n", ch.Channel, ch.ChiSquare, ch.EmbeddedFraction*100, ch.RS)
 		}
 	}
+}
+
+// printScanCandidate prints where a candidate payload of stego scan was
+// found and a preview of it.
+func printScanCandidate(cand pixellock.StegoScanCandidate) {
+	where := fmt.Sprintf("%s layout, density %d, channels %s", cand.Layout, cand.Density, cand.Channels)
+	if cand.SkipTransparent {
+		where += ", transparent pixels skipped"
+	}
+	if cand.Scattered {
+		where += ", scattered"
+	}
+	if cand.Password != "" {
+		where += fmt.Sprintf(", password %q", cand.Password)
+	}
+	switch {
+	case cand.Err != nil:
+		gookitcolor.Yellow.Printf("%s: %v\n", where, cand.Err)
+		return
+	case cand.Verified():
+		gookitcolor.Green.Printf("%s: verified pixellock payload\n", where)
+	default:
+		gookitcolor.Cyan.Printf("%s: %.0f%% printable text\n", where, cand.TextScore*100)
+	}
+	if cand.Payload.IsFile() {
+		fmt.Printf("  file %s (%d bytes)\n", cand.Payload.Filename, len(cand.Payload.Data))
+		return
+	}
+	preview := string(cand.Payload.Data)
+	if len(preview) > 80 {
+		preview = preview[:80] + "..."
+	}
+	fmt.Printf("  %q (%d bytes)\n", preview, len(cand.Payload.Data))
+}
 
-	err = os.MkdirAll(filepath.Dir(outputFilename), os.ModeDir|0755) // Ensure output directory exists
+// readPasswordList reads the passwords in filename, one per line, skipping
+// blank lines.
+func readPasswordList(filename string) ([]string, error) {
+	data, err := os.ReadFile(filename)
 	if err != nil {
-		log.Printf("failed to create output directory: %v", err)
-		return err
+		return nil, fmt.Errorf("failed to read password list: %w", err)
 	}
+	var passwords []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimRight(line, "\r"); line != "" {
+			passwords = append(passwords, line)
+		}
+	}
+	return passwords, nil
+}
 
-	err = SaveImage(outputFilename, rgbaImg, outputFormat) // Save using the specified output format
-	if err != nil {
-		log.Printf("failed to encode stego image: %v", err)
-		return err
+// Ways --progress reports the progress of encryption and decryption.
+const (
+	progressBarOutput  = "bar"
+	progressJSONOutput = "json"
+)
+
+// progressFlag returns the --progress flag of encrypt and decrypt.
+func progressFlag() cli.Flag {
+	return &cli.StringFlag{
+		Name:  "progress",
+		Usage: "Report progress on standard error: " + progressBarOutput + " for a progress bar, " + progressJSONOutput + " for a JSON object per event",
+	}
+}
+
+// progressEvent is a pixellock.Event as --progress json prints it.
+type progressEvent struct {
+	Phase  string `json:"phase"`
+	Path   string `json:"path"`
+	Output string `json:"output,omitempty"`
+	Done   int64  `json:"done,omitempty"`
+	Total  int64  `json:"total,omitempty"`
+	Error  string `json:"error,omitempty"`
+	Code   string `json:"code,omitempty"` // The pixellock.ErrorCode of Error
+	Cipher string `json:"cipher,omitempty"`
+}
+
+// newProgressEvent returns e as --progress json prints it.
+func newProgressEvent(e pixellock.Event) progressEvent {
+	out := progressEvent{Phase: e.Phase, Path: e.Path, Output: e.Output, Done: e.Done, Total: e.Total, Cipher: e.Cipher}
+	if e.Err != nil {
+		out.Error, out.Code = e.Err.Error(), string(pixellock.ErrorCodeOf(e.Err))
+	}
+	return out
+}
+
+// progressFromFlag returns the Progress callback --progress asks for, nil
+// without it, and a function to call once the events have all been given
+// to it.
+func progressFromFlag(c *cli.Context) (func(pixellock.Event), func(), error) {
+	switch c.String("progress") {
+	case "":
+		return nil, func() {}, nil
+	case progressJSONOutput:
+		enc := json.NewEncoder(os.Stderr)
+		return func(e pixellock.Event) {
+			enc.Encode(newProgressEvent(e))
+		}, func() {}, nil
+	case progressBarOutput:
+		bar := &progressBar{finished: map[string]bool{}}
+		return bar.update, bar.finish, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown --progress %q; use %s or %s", c.String("progress"), progressBarOutput, progressJSONOutput)
+	}
+}
+
+// reportFiles returns a Progress callback printing to standard output each
+// file written, as done says it was, and each left alone because it
+// exists, then passing the event to next unless it is nil.
+func reportFiles(done string, next func(pixellock.Event)) func(pixellock.Event) {
+	return func(e pixellock.Event) {
+		switch {
+		case e.Phase == pixellock.PhaseWrite && e.Err == nil:
+			fmt.Printf("%s and saved to: %s\n", done, e.Output)
+		case e.Phase == pixellock.PhaseSkip && errors.Is(e.Err, pixellock.ErrOutputExists):
+			fmt.Printf("Output file %s already exists.  Overwrite with --overwrite flag.\n", e.Output)
+		}
+		if next != nil {
+			next(e)
+		}
+	}
+}
+
+// metricsOutFlag returns the --metrics-out flag of encrypt and decrypt.
+func metricsOutFlag() cli.Flag {
+	return &cli.StringFlag{
+		Name:  "metrics-out",
+		Usage: "Write the metrics of the run to `FILE` once it is done, in the Prometheus text format",
+	}
+}
+
+// metricsFromFlag returns the Metrics --metrics-out asks for, nil without
+// it, and a function writing them to its file once the events have all
+// been counted.
+func metricsFromFlag(c *cli.Context) (*pixellock.Metrics, func()) {
+	path := c.String("metrics-out")
+	if path == "" {
+		return nil, func() {}
+	}
+	metrics := pixellock.NewMetrics()
+	return metrics, func() {
+		var text strings.Builder
+		metrics.WriteTo(&text)
+		if err := os.WriteFile(path, []byte(text.String()), 0644); err != nil {
+			logger.Error("failed to write metrics", "path", path, "err", err)
+		}
+	}
+}
+
+// progressBarWidth is the characters of the bar --progress bar draws.
+const progressBarWidth = 30
+
+// progressBar draws the progress of encryption or decryption on standard
+// error, as --progress bar asks: of the files of a directory, once it has
+// been searched, or of the bytes of a single file.
+type progressBar struct {
+	files       int64           // Files of the directory, once searched
+	finished    map[string]bool // Files written or failed
+	done, total int64           // Bytes of the latest file
+	drawn       bool
+}
+
+// update redraws the bar for e.
+func (b *progressBar) update(e pixellock.Event) {
+	switch {
+	case e.Phase == pixellock.PhaseScan:
+		b.files = e.Total
+	case e.Err != nil || e.Phase == pixellock.PhaseWrite:
+		b.finished[e.Path] = true
+	default:
+		b.done, b.total = e.Done, e.Total
+	}
+
+	var fraction float64
+	var label string
+	switch {
+	case b.files > 0:
+		fraction, label = float64(len(b.finished))/float64(b.files), fmt.Sprintf("%d/%d files", len(b.finished), b.files)
+	case e.Phase == pixellock.PhaseScan:
+		fraction, label = 0, fmt.Sprintf("%d files found", e.Done)
+	case len(b.finished) > 0:
+		fraction, label = 1, "done"
+	case b.total > 0:
+		fraction, label = float64(b.done)/float64(b.total), fmt.Sprintf("%.1f/%.1f MB", float64(b.done)/1e6, float64(b.total)/1e6)
+	}
+	filled := int(fraction * progressBarWidth)
+	fmt.Fprintf(os.Stderr, "\r[%s%s] %3.0f%% %s\033[K", strings.Repeat("=", filled), strings.Repeat(" ", progressBarWidth-filled), fraction*100, label)
+	b.drawn = true
+}
+
+// finish ends the line the bar is drawn on.
+func (b *progressBar) finish() {
+	if b.drawn {
+		fmt.Fprintln(os.Stderr)
+	}
+}
+
+// watermarkFlags returns the flags describing a watermark, each name
+// starting with prefix.
+func watermarkFlags(prefix string) []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:  prefix + "text",
+			Usage: "Text of a visible watermark, drawn in white with a dark shadow",
+		},
+		&cli.StringFlag{
+			Name:  prefix + "image",
+			Usage: "Image, such as a logo, drawn as a visible watermark instead of text",
+		},
+		&cli.StringFlag{
+			Name:  prefix + "position",
+			Value: pixellock.DefaultWatermarkPosition,
+			Usage: "Where the watermark is placed: tl, t, tr, l, c, r, bl, b or br",
+		},
+		&cli.Float64Flag{
+			Name:  prefix + "opacity",
+			Value: pixellock.DefaultWatermarkOpacity,
+			Usage: "Opacity of the watermark, from 0 to 1",
+		},
+		&cli.Float64Flag{
+			Name:  prefix + "scale",
+			Value: pixellock.DefaultWatermarkScale,
+			Usage: "Width of the watermark as a fraction of the image width",
+		},
+		&cli.Float64Flag{
+			Name:  prefix + "margin",
+			Value: pixellock.DefaultWatermarkMargin,
+			Usage: "Space kept between the watermark and the edges, as a fraction of the shorter side of the image",
+		},
+		&cli.BoolFlag{
+			Name:  prefix + "tile",
+			Usage: "Repeat the watermark across the whole image instead of placing it once",
+		},
+	}
+}
+
+// watermarkFromFlags builds the watermark described by watermarkFlags, or
+// returns nil when neither its text nor its image is given.
+func watermarkFromFlags(c *cli.Context, prefix string) (*pixellock.Watermark, error) {
+	if c.String(prefix+"text") == "" && c.String(prefix+"image") == "" {
+		return nil, nil
+	}
+	return pixellock.NewWatermark(pixellock.WatermarkOptions{
+		Text:     c.String(prefix + "text"),
+		Image:    c.String(prefix + "image"),
+		Position: c.String(prefix + "position"),
+		Opacity:  c.Float64(prefix + "opacity"),
+		Scale:    c.Float64(prefix + "scale"),
+		Margin:   c.Float64(prefix + "margin"),
+		Tile:     c.Bool(prefix + "tile"),
+	})
+}
+
+// stegoBatchFlags returns the flags selecting the images processed when a
+// stego subcommand is given a directory.
+func stegoBatchFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.BoolFlag{
+			Name:    "recursive",
+			Aliases: []string{"r"},
+			Usage:   "Recursively search subdirectories of a directory input for images.",
+			Value:   false,
+		},
+		&cli.StringSliceFlag{
+			Name:  "include",
+			Usage: "Only process images whose name matches this glob (repeatable)",
+		},
+		&cli.StringSliceFlag{
+			Name:  "exclude",
+			Usage: "Skip images whose name matches this glob (repeatable)",
+		},
+		&cli.IntFlag{
+			Name:  "workers",
+			Usage: "Images processed concurrently, and goroutines each large image is processed on (default: number of CPUs)",
+			Value: 0,
+		},
+	}
+}
+
+// stegoBatchFromFlags builds batch options from stegoBatchFlags.
+func stegoBatchFromFlags(c *cli.Context) pixellock.StegoBatchOptions {
+	return pixellock.StegoBatchOptions{
+		Recursive: c.Bool("recursive"),
+		Include:   c.StringSlice("include"),
+		Exclude:   c.StringSlice("exclude"),
+		Workers:   c.Int("workers"),
+	}
+}
+
+// stegoRegionsFromFlags parses the --region and --exclude-region flags.
+func stegoRegionsFromFlags(c *cli.Context) (include, exclude []image.Rectangle, err error) {
+	for _, s := range c.StringSlice("region") {
+		r, err := pixellock.ParseStegoRegion(s)
+		if err != nil {
+			return nil, nil, err
+		}
+		include = append(include, r)
+	}
+	for _, s := range c.StringSlice("exclude-region") {
+		r, err := pixellock.ParseStegoRegion(s)
+		if err != nil {
+			return nil, nil, err
+		}
+		exclude = append(exclude, r)
+	}
+	return include, exclude, nil
+}
+
+// stegoFragmentInputs returns the inputs holding a fragment of a split
+// payload and the number holding a whole payload.
+func stegoFragmentInputs(results []pixellock.StegoBatchResult) (fragments []string, whole int) {
+	for _, r := range results {
+		if r.Err != nil {
+			continue
+		}
+		if _, _, ok := r.Payload.Fragment(); ok {
+			fragments = append(fragments, r.Input)
+		} else {
+			whole++
+		}
+	}
+	return fragments, whole
+}
+
+// revealBatch prints a per-image table of revealed payloads. With an output
+// directory, each payload is written there, named after its image.
+func revealBatch(results []pixellock.StegoBatchResult, outputDir string) error {
+	if outputDir != "" {
+		if err := os.MkdirAll(outputDir, os.ModeDir|0755); err != nil {
+			gookitcolor.Red.Println("failed to create output directory:", err)
+			return err
+		}
+	}
+
+	found := 0
+	for _, r := range results {
+		switch {
+		case errors.Is(r.Err, pixellock.ErrNoPayload):
+			gookitcolor.Yellow.Printf("  %s: no payload\n", r.Input)
+			continue
+		case r.Err != nil:
+			gookitcolor.Red.Printf("  %s: %v\n", r.Input, r.Err)
+			continue
+		}
+		found++
+
+		p := r.Payload
+		if index, total, ok := p.Fragment(); ok {
+			gookitcolor.Cyan.Printf("  %s: fragment %d of %d\n", r.Input, index, total)
+			continue
+		}
+		if outputDir != "" {
+			base := strings.TrimSuffix(filepath.Base(r.Input), filepath.Ext(r.Input))
+			name := base + ".txt"
+			if p.IsFile() {
+				name = base + "_" + filepath.Base(p.Filename)
+			}
+			written, err := pixellock.WritePayload(p, filepath.Join(outputDir, name))
+			if err != nil {
+				gookitcolor.Red.Printf("  %s: %v\n", r.Input, err)
+				continue
+			}
+			gookitcolor.Cyan.Printf("  %s -> %s\n", r.Input, written)
+			continue
+		}
+		switch {
+		case p.ChecksumFailed:
+			gookitcolor.Yellow.Printf("  %s: checksum failed (%d raw bytes)\n", r.Input, len(p.Data))
+		case p.IsFile():
+			gookitcolor.Cyan.Printf("  %s: file %s (%d bytes)\n", r.Input, p.Filename, len(p.Data))
+		default:
+			gookitcolor.Green.Printf("  %s: %s\n", r.Input, string(p.Data))
+		}
 	}
-	gookitcolor.Cyan.Println("Message hidden and saved to:", outputFilename)
+	fmt.Printf("Payloads found in %d of %d images.\n", found, len(results))
 	return nil
 }
 
-// revealMessage reveals a hidden message from an image
-func revealMessage(inputFilename string) (string, error) {
-	img, err := LoadImage(inputFilename)
+// parseMaxFill parses a --max-fill value, either a percentage such as 50%
+// or a fraction such as 0.5, into StegoOptions.MaxFill.
+func parseMaxFill(s string) (float64, error) {
+	value, percent := strings.CutSuffix(strings.TrimSpace(s), "%")
+	fill, err := strconv.ParseFloat(value, 64)
 	if err != nil {
-		log.Printf("failed to load image: %v", err)
-		return "", err
+		return 0, fmt.Errorf("invalid max fill %q: %w", s, err)
+	}
+	if percent {
+		fill /= 100
 	}
+	if fill <= 0 || fill > 1 {
+		return 0, fmt.Errorf("invalid max fill %q: must be above 0%% and at most 100%%", s)
+	}
+	return fill, nil
+}
 
-	// Convert to RGBA
-	b := img.Bounds()
-	rgbaImg := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
-	draw.Draw(rgbaImg, rgbaImg.Bounds(), img, b.Min, draw.Src)
+// parseRedundancy parses a --redundancy value, either a percentage such as
+// 10% or a fraction such as 0.1, into parity.Options.Redundancy.
+func parseRedundancy(s string) (float64, error) {
+	value, percent := strings.CutSuffix(strings.TrimSpace(s), "%")
+	redundancy, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid redundancy %q: %w", s, err)
+	}
+	if percent {
+		redundancy /= 100
+	}
+	if redundancy < 0.01 || redundancy > 1 {
+		return 0, fmt.Errorf("invalid redundancy %q: must be from 1%% to 100%%", s)
+	}
+	return redundancy, nil
+}
 
-	bounds := rgbaImg.Bounds()
-	width, height := bounds.Max.X, bounds.Max.Y
+// byteUnits are the units of parseByteSize, by their suffixes.
+var byteUnits = map[string]int64{
+	"": 1, "B": 1,
+	"K": 1 << 10, "KIB": 1 << 10, "KB": 1000,
+	"M": 1 << 20, "MIB": 1 << 20, "MB": 1000 * 1000,
+	"G": 1 << 30, "GIB": 1 << 30, "GB": 1000 * 1000 * 1000,
+}
 
-	var messageBits bytes.Buffer
-	for y := 0; y < height; y++ {
-		for x := 0; x < width; x++ {
-			r, g, b, a := rgbaImg.At(x, y).RGBA()
-			messageBits.WriteByte(uint8(((r & 1) << 7) | ((g & 1) << 6) | ((b & 1) << 5) | ((a & 1) << 4))) // Extract LSB of each channel
+// parseByteSize parses a size such as 64MiB, 500MB or 1048576: a whole
+// number of bytes, KiB, MiB or GiB (K, M and G for short), or KB, MB or
+// GB, which are powers of 1000.
+func parseByteSize(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	i := strings.IndexFunc(s, func(r rune) bool { return r < '0' || r > '9' })
+	if i < 0 {
+		i = len(s)
+	}
+	unit, ok := byteUnits[strings.ToUpper(strings.TrimSpace(s[i:]))]
+	if !ok {
+		return 0, fmt.Errorf("unknown unit %q", s[i:])
+	}
+	n, err := strconv.ParseInt(s[:i], 10, 64)
+	if err != nil {
+		return 0, errors.New("not a whole number of bytes")
+	}
+	if n > math.MaxInt64/unit {
+		return 0, errors.New("too large")
+	}
+	return n * unit, nil
+}
 
+// stegoOptionsFromFlags builds stego options from the --key and --password
+// flags of a stego subcommand.
+func stegoOptionsFromFlags(c *cli.Context) (pixellock.StegoOptions, error) {
+	opts := pixellock.DefaultStegoOptions
+	if keyBase64 := c.String("key"); keyBase64 != "" {
+		key, err := pixellock.DecodeKey(keyBase64)
+		if err != nil {
+			return opts, err
 		}
+		opts.Key = key
 	}
-	message := messageBits.String()
-	message = strings.Split(message, "\x00")[0] // Read until null terminator
-	return message, nil
+	opts.Password = c.String("password")
+	opts.Workers = c.Int("workers")
+	return opts, nil
+}
+
+// commands are the commands of pixellock.
+var commands = []*cli.Command{
+	encryptCmd,
+	decryptCmd,
+	archiveCmd,
+	extractCmd,
+	fetchCmd,
+	keygenCmd,
+	keyCmd,
+	infoCmd,
+	thumbsCmd,
+	compareCmd,
+	diffCmd,
+	convertCmd,
+	watermarkCmd,
+	contactSheetCmd,
+	redactCmd,
+	steganographyCmd,
+	errorsCmd,
+	serveCmd,
+	galleryCmd,
+	mountCmd,
+	daemonCmd,
+	ctlCmd,
+	hookCmd,
+	catalogCmd,
+	tagCmd,
+	parityCmd,
+	clipboardClearCmd,
 }
 
 // main function
@@ -799,41 +4720,61 @@ func main() {
 		Aliases: []string{"h"},
 		Usage:   "Show help",
 	}
+	var logFile *os.File // Set by --log-file, closed once the command is done
 	app := &cli.App{
 		Name:    "pixellock",
 		Usage:   "Encrypt, decrypt, and hide messages within images using AES-256 GCM and steganography",
 		Version: Version, //Set the version from the constant
+		// Slice flags are repeated rather than comma separated, as values
+		// such as --region x,y,width,height contain commas themselves
+		DisableSliceFlagSeparator: true,
 		Authors: []*cli.Author{
 			{
 				Name:  Author, // Set the Author from constant
 				Email: "",     // Can add an email here
 			},
 		},
-		Commands: []*cli.Command{
-			encryptCmd,
-			decryptCmd,
-			keygenCmd,
-			steganographyCmd,
-		},
+		Commands: commands,
 		Flags: []cli.Flag{
 			&cli.BoolFlag{
 				Name:  "verbose",
 				Value: false,
 				Usage: "Enable verbose logging",
 			},
+			&cli.StringFlag{
+				Name:  "log-file",
+				Usage: "Append log messages to this file instead of standard error",
+			},
+			&cli.StringFlag{
+				Name:  "otel-endpoint",
+				Usage: "Export OpenTelemetry traces over OTLP/HTTP to the collector at this URL, such as " + defaultOTLPEndpoint + " (default: from the OTEL_EXPORTER_OTLP_* environment variables)",
+			},
 			&cli.BoolFlag{
 				Name:    "about",
 				Aliases: []string{"a"},
 				Usage:   "About this tool",
 			},
+			maxPixelsFlag,
+			debugPanicFlag,
 		},
 		Before: func(c *cli.Context) error {
-			// Print AsciiArt on startup
-			gookitcolor.HiBlue.Println(AsciiArt)
+			// Print AsciiArt on startup, unless the output is piped
+			if info, err := os.Stdout.Stat(); err == nil && info.Mode()&os.ModeCharDevice != 0 {
+				gookitcolor.HiBlue.Println(AsciiArt)
+			}
+
+			l, f, err := newLogger(c.Bool("verbose"), c.String("log-file"))
+			if err != nil {
+				return err
+			}
+			logger, logFile = l, f
+			logger.Debug("verbose mode enabled")
 
-			if c.Bool("verbose") {
-				log.SetFlags(log.LstdFlags | log.Lshortfile) // Enhanced logging
-				log.Println("Verbose mode enabled")
+			if tracerProvider, err = newTracerProvider(c.String("otel-endpoint")); err != nil {
+				return err
+			}
+			if tracerProvider != nil {
+				otel.SetTracerProvider(tracerProvider)
 			}
 
 			if c.Bool("about") {
@@ -848,9 +4789,385 @@ func main() {
 			return nil
 		},
 	}
+	traceCommands(app.Commands)
+
+	// Ctrl-C cancels the command, which stops without leaving the files it
+	// was writing half written
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	err := runApp(ctx, app, os.Args)
+	stop()
+	if tracerProvider != nil {
+		// Export the spans left, without holding up the exit for long
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		if err := tracerProvider.Shutdown(ctx); err != nil {
+			logger.Warn("failed to export spans", "err", err)
+		}
+		cancel()
+	}
+	if logFile != nil {
+		logFile.Close()
+	}
+	if panics := pixellock.Panics(err); len(panics) > 0 {
+		if report, rerr := writeCrashReport("", err, os.Args); rerr == nil {
+			fmt.Fprintf(os.Stderr, "pixellock hit a bug. A crash report has been written to %s; please attach it to a bug report.\n", report)
+		} else {
+			fmt.Fprintf(os.Stderr, "pixellock hit a bug, and the crash report could not be written: %v\n", rerr)
+		}
+	}
+	if errors.Is(err, context.Canceled) {
+		fmt.Fprintln(os.Stderr, "Interrupted.")
+		os.Exit(exitInterrupted)
+	}
+	if err != nil {
+		status, hint := exitStatus(err)
+		log.Print(err)
+		if hint != "" {
+			fmt.Fprintln(os.Stderr, hint)
+		}
+		os.Exit(status)
+	}
+}
+
+// Exit statuses, distinct for the failures scripts may want to tell apart
+const (
+	exitFailure      = 1
+	exitDifferent    = 2  // diff found the trees differ
+	exitWrongKey     = 3  // The key is wrong or the file corrupt
+	exitInvalidKey   = 4  // The key is not a key at all
+	exitNotEncrypted = 5  // The input was not encrypted by pixellock
+	exitUnsupported  = 6  // The input is in a format or cipher pixellock cannot read
+	exitInternal     = 70 // pixellock panicked, a bug; a crash report is written
+	exitInterrupted  = 130
+)
+
+// exitStatus returns the status pixellock exits with for err, and a hint
+// to print with it, if any.
+func exitStatus(err error) (int, string) {
+	var unsupportedCipher *pixellock.UnsupportedCipherError
+	switch {
+	case len(pixellock.Panics(err)) > 0:
+		return exitInternal, ""
+	case errors.Is(err, context.Canceled):
+		return exitInterrupted, ""
+	case errors.Is(err, errTreesDiffer):
+		return exitDifferent, ""
+	case errors.Is(err, pixellock.ErrAuthenticationFailed):
+		return exitWrongKey, "The key is wrong, or the file has been corrupted."
+	case errors.Is(err, pixellock.ErrInvalidKeySize):
+		return exitInvalidKey, fmt.Sprintf("A key is %d bytes, base64 encoded; make one with pixellock keygen.", pixellock.KeySize)
+	case errors.Is(err, pixellock.ErrNotEncryptedFile):
+		return exitNotEncrypted, "The input was not encrypted by pixellock; encrypt it first."
+	case errors.As(err, &unsupportedCipher), errors.Is(err, pixellock.ErrUnsupportedFormat):
+		return exitUnsupported, ""
+	case errors.Is(err, pixellock.ErrTooManyUnreadable):
+		return exitFailure, "Check that the directory is mounted and readable, or raise --max-unreadable to encrypt the files that can be read."
+	case errors.Is(err, pixellock.ErrImageTooLarge):
+		return exitFailure, "To process larger images, raise --max-pixels, or set it to 0 for no limit."
+	}
+	return exitFailure, ""
+}
+
+// runApp runs app with args, returning a panic of the command, on this
+// goroutine, as a *pixellock.PanicError. The library recovers the panics
+// of its own workers.
+func runApp(ctx context.Context, app *cli.App, args []string) (err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			err = &pixellock.PanicError{Value: v, Stack: debug.Stack()}
+		}
+	}()
+	return app.RunContext(ctx, args)
+}
+
+// redacted replaces the values of secretFlags in crash reports.
+const redacted = "REDACTED"
+
+// secretFlags are the names of the flags whose values a crash report
+// leaves out, those marked with secret.
+var secretFlags = map[string]bool{}
+
+// secret marks flag as holding a secret, such as a key, password or hidden
+// message, that crash reports leave out, and returns it.
+func secret[F cli.Flag](flag F) F {
+	for _, name := range flag.Names() {
+		secretFlags[name] = true
+	}
+	return flag
+}
+
+// redactArgs returns args with the values of secretFlags redacted, given
+// as -k VALUE, --key VALUE or --key=VALUE.
+func redactArgs(args []string) []string {
+	args = slices.Clone(args)
+	for i := 1; i < len(args); i++ {
+		if !strings.HasPrefix(args[i], "-") {
+			continue
+		}
+		name, _, hasValue := strings.Cut(strings.TrimLeft(args[i], "-"), "=")
+		switch {
+		case !secretFlags[name]:
+		case hasValue:
+			args[i] = args[i][:strings.Index(args[i], "=")+1] + redacted
+		case i+1 < len(args):
+			i++
+			args[i] = redacted
+		}
+	}
+	return args
+}
+
+// writeCrashReport writes a report of the panics in err, run with args, to
+// a new file in dir, or the temporary directory when dir is empty, for
+// attaching to a bug report, and returns its name.
+func writeCrashReport(dir string, err error, args []string) (string, error) {
+	f, ferr := os.CreateTemp(dir, "pixellock-crash-*.txt")
+	if ferr != nil {
+		return "", ferr
+	}
+	fmt.Fprintf(f, "pixellock %s crash report, %s\n", Version, time.Now().UTC().Format(time.RFC3339))
+	fmt.Fprintf(f, "Go version: %s\n", runtime.Version())
+	fmt.Fprintf(f, "Operating system: %s %s\n", runtime.GOOS, runtime.GOARCH)
+	fmt.Fprintf(f, "Command: %s\n", strings.Join(redactArgs(args), " "))
+	fmt.Fprintf(f, "\nError:\n%v\n", err)
+	panics := pixellock.Panics(err)
+	for i, p := range panics {
+		fmt.Fprintf(f, "\nPanic %d of %d: %v\n%s", i+1, len(panics), p.Value, p.Stack)
+	}
+	if cerr := f.Close(); cerr != nil {
+		return "", cerr
+	}
+	return f.Name(), nil
+}
+
+// copyFlag returns the --copy flag of the commands that can copy what
+// they would print, as usage says, to the clipboard.
+func copyFlag(usage string) cli.Flag {
+	return &cli.BoolFlag{Name: "copy", Usage: usage}
+}
+
+// defaultClearAfter is how long a text copied with --copy stays on the
+// clipboard by default.
+const defaultClearAfter = 30 * time.Second
+
+// clearAfterFlag returns the --clear-after flag going with --copy.
+func clearAfterFlag() cli.Flag {
+	return &cli.DurationFlag{
+		Name:  "clear-after",
+		Value: defaultClearAfter,
+		Usage: "With --copy, clear the clipboard after this long unless something else has been copied since; 0 leaves it",
+	}
+}
+
+// pasteKeyFlag returns the --paste-key flag of encrypt and decrypt.
+func pasteKeyFlag() cli.Flag {
+	return &cli.BoolFlag{
+		Name:  "paste-key",
+		Usage: "Read the key (base64 encoded) from the clipboard, keeping it out of the command line",
+	}
+}
+
+// systemClipboard returns the clipboard --copy and --paste-key use.
+var systemClipboard = clipboard.System
+
+// keyOrPastedKey returns the base64 encoded key of --key or, with
+// --paste-key, the one on the clipboard. Neither gives "".
+func keyOrPastedKey(c *cli.Context) (string, error) {
+	if !c.Bool("paste-key") {
+		return c.String("key"), nil
+	}
+	if c.String("key") != "" {
+		return "", errors.New("give the key with --key or --paste-key, not both")
+	}
+	cb, err := systemClipboard()
+	if err != nil {
+		return "", fmt.Errorf("--paste-key: %w", err)
+	}
+	text, err := cb.Read()
+	if err != nil {
+		return "", fmt.Errorf("--paste-key: %w", err)
+	}
+	// The clipboard may hold anything, which is not repeated in errors
+	text = strings.TrimSpace(text)
+	if _, err := pixellock.DecodeKey(text); err != nil {
+		return "", fmt.Errorf("--paste-key: the clipboard holds no key: %w", err)
+	}
+	return text, nil
+}
+
+// copyToClipboard copies text, the thing named what, to the clipboard and,
+// as --clear-after asks, has it cleared later by a process of its own, so
+// that the command need not wait.
+func copyToClipboard(c *cli.Context, what, text string) error {
+	cb, err := systemClipboard()
+	if err != nil {
+		return err
+	}
+	if err := cb.Write(text); err != nil {
+		return err
+	}
+	after := c.Duration("clear-after")
+	if after <= 0 {
+		gookitcolor.Green.Printf("%s copied to the clipboard.\n", what)
+		return nil
+	}
+	if err := startClipboardClear(clipboard.Digest(text), after); err != nil {
+		return fmt.Errorf("%s copied to the clipboard, but it will not be cleared: %w", what, err)
+	}
+	gookitcolor.Green.Printf("%s copied to the clipboard; it will be cleared in %s.\n", what, after)
+	return nil
+}
 
-	err := app.Run(os.Args)
+// startClipboardClear starts the hidden clipboard-clear command, clearing
+// the clipboard after the time given if the text on it still has digest.
+// The digest is given on its standard input rather than as an argument,
+// where other users could see it.
+var startClipboardClear = func(digest string, after time.Duration) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	_, err = io.WriteString(w, digest)
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+	cmd := exec.Command(exe, clipboardClearCmd.Name, "--after", after.String())
+	cmd.Stdin = r
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	return cmd.Process.Release()
+}
+
+// clipboardClearCmd clears the clipboard for --copy once --clear-after
+// has passed, unless something else has been copied since.
+var clipboardClearCmd = &cli.Command{
+	Name:   "clipboard-clear",
+	Hidden: true,
+	Flags: []cli.Flag{
+		&cli.DurationFlag{Name: "after"},
+	},
+	Action: func(c *cli.Context) error {
+		digest, err := io.ReadAll(io.LimitReader(os.Stdin, 128))
+		if err != nil {
+			return err
+		}
+		time.Sleep(c.Duration("after"))
+		cb, err := systemClipboard()
+		if err != nil {
+			return err
+		}
+		_, err = clipboard.ClearIfUnchanged(cb, strings.TrimSpace(string(digest)))
+		return err
+	},
+}
+
+// debugPanicFlag makes pixellock panic on purpose, to try out recovery
+// from panics and crash reports.
+var debugPanicFlag = &cli.StringFlag{
+	Name:   "debug-panic",
+	Usage:  "Panic while writing any file whose name contains this, to test crash reports",
+	Hidden: true,
+}
+
+// debugPanicFS returns the filesystem encryption and decryption write
+// through: the operating system's, panicking as --debug-panic asks.
+func debugPanicFS(c *cli.Context) pixellock.FileSystem {
+	if name := c.String(debugPanicFlag.Name); name != "" {
+		return panicFS{name: name}
+	}
+	return pixellock.OSFS{}
+}
+
+// transferFS returns the filesystem encrypting or decrypting input to
+// output goes through: debugPanicFS's, with s3://bucket/key URLs read from
+// and written to S3 when either is one, as the AWS configuration of the
+// environment and ~/.aws says, sftp://user@host/path URLs read from and
+// written to SFTP servers as the SSH flags say, and an http:// or https://
+// input of encrypt downloaded as its flags say. URLs of other schemes are
+// refused rather than taken for local paths.
+func transferFS(c *cli.Context, input, output string) (pixellock.FileSystem, error) {
+	switch {
+	case pixellock.IsHTTPURL(output):
+		return nil, fmt.Errorf("%s: http(s):// paths are not supported as output; URLs are only read", output)
+	case pixellock.IsHTTPURL(input) && c.Command.Name != "encrypt":
+		return nil, fmt.Errorf("%s: http(s):// paths are not supported by %s; only encrypt reads URLs", input, c.Command.Name)
+	}
+	for _, name := range []string{input, output} {
+		scheme, _, ok := strings.Cut(name, "://")
+		if ok && len(scheme) > 1 && !strings.ContainsAny(scheme, `/\`) && !pixellock.IsS3URL(name) && !pixellock.IsSFTPURL(name) && !pixellock.IsHTTPURL(name) {
+			if scheme == "ipfs" {
+				return nil, fmt.Errorf("%s: ipfs:// paths are not supported; encrypt to a local directory with --publish-ipfs to add the files to IPFS, and read them back with fetch", name)
+			}
+			return nil, fmt.Errorf("%s: %s:// paths are not supported; only s3:// and sftp:// URLs are read and written remotely, and http(s):// URLs read by encrypt", name, scheme)
+		}
+	}
+	fsys := debugPanicFS(c)
+	if pixellock.IsS3URL(input) || pixellock.IsS3URL(output) {
+		cfg, err := s3.LoadConfig()
+		if err != nil {
+			return nil, err
+		}
+		client, err := s3.New(cfg)
+		if err != nil {
+			return nil, err
+		}
+		fsys = &pixellock.S3FS{Client: client, Local: fsys}
+	}
+	if pixellock.IsSFTPURL(input) || pixellock.IsSFTPURL(output) {
+		pool, err := sftp.New(sftp.Config{
+			Identity:              c.String("identity"),
+			KnownHosts:            c.StringSlice("known-hosts"),
+			InsecureIgnoreHostKey: c.Bool("insecure-ignore-hostkey"),
+		})
+		if err != nil {
+			return nil, err
+		}
+		fsys = &pixellock.SFTPFS{Client: pool, Local: fsys}
+	}
+	if pixellock.IsHTTPURL(input) {
+		retries := c.Int("retries")
+		if retries == 0 {
+			retries = -1 // An HTTPFS takes 0 for its default
+		}
+		fsys = &pixellock.HTTPFS{
+			Client:    &http.Client{Timeout: c.Duration("timeout")},
+			UserAgent: c.String("user-agent"),
+			MaxBytes:  c.Int64("max-download-bytes"),
+			Retries:   retries,
+			Local:     fsys,
+		}
+	}
+	return fsys, nil
+}
+
+// urlOutputIsDir reports whether the output of encrypting a URL is the
+// directory to write it into: one that exists, ends with a separator, or
+// the default.
+func urlOutputIsDir(c *cli.Context, output string) bool {
+	if info, err := os.Stat(output); err == nil && info.IsDir() {
+		return true
+	}
+	return !c.IsSet("output") || strings.HasSuffix(output, "/") || strings.HasSuffix(output, string(filepath.Separator))
+}
+
+// panicFS is the operating system's filesystem, except that creating a
+// file whose name contains name panics.
+type panicFS struct {
+	pixellock.OSFS
+	name string
+}
+
+func (p panicFS) Create(name string) (io.WriteCloser, error) {
+	if strings.Contains(filepath.Base(name), p.name) {
+		panic("--debug-panic " + p.name + ": creating " + name)
 	}
+	return p.OSFS.Create(name)
 }
@@ -0,0 +1,991 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"io/fs"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Amul-Thantharate/pixellock/pkg/catalog"
+	"github.com/Amul-Thantharate/pixellock/pkg/clipboard"
+	"github.com/Amul-Thantharate/pixellock/pkg/ipfs"
+	"github.com/Amul-Thantharate/pixellock/pkg/parity"
+	"github.com/Amul-Thantharate/pixellock/pkg/pixellock"
+	"github.com/urfave/cli/v2"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// faceFixture is a photo from the library's test data.
+const faceFixture = "pkg/pixellock/testdata/face.jpg"
+
+func TestNoThumbnail(t *testing.T) {
+	key, _ := pixellock.GenerateRandomKey()
+	dir := t.TempDir()
+	encrypted := filepath.Join(dir, "face.enc")
+	app := &cli.App{Commands: []*cli.Command{encryptCmd}}
+	args := []string{"pixellock", "encrypt", "-i", faceFixture, "-o", encrypted, "-k", base64.StdEncoding.EncodeToString(key),
+		"--thumbnail", "64", "--thumbnail-embed", "--no-thumbnail"}
+	if err := app.Run(args); err != nil {
+		t.Fatalf("encrypt failed: %v", err)
+	}
+	data, err := os.ReadFile(encrypted)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	if thumb, _ := pixellock.SplitThumbnail(data); thumb != nil {
+		t.Error("--no-thumbnail embedded a thumbnail")
+	}
+	if _, err := os.Stat(pixellock.ThumbnailPath(encrypted)); !os.IsNotExist(err) {
+		t.Errorf("--no-thumbnail wrote a thumbnail: %v", err)
+	}
+	if info, err := pixellock.InspectEncrypted(encrypted); err != nil || info.Thumbnail != (image.Point{}) {
+		t.Errorf("InspectEncrypted gave %+v, %v; want no thumbnail", info, err)
+	}
+}
+
+func TestProgressJSON(t *testing.T) {
+	key, _ := pixellock.GenerateRandomKey()
+	encrypted := filepath.Join(t.TempDir(), "face.enc")
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Pipe failed: %v", err)
+	}
+	stderr := os.Stderr
+	os.Stderr = w
+	app := &cli.App{Commands: []*cli.Command{encryptCmd}}
+	err = app.Run([]string{"pixellock", "encrypt", "-i", faceFixture, "-o", encrypted, "-k", base64.StdEncoding.EncodeToString(key), "--progress", "json"})
+	os.Stderr = stderr
+	w.Close()
+	if err != nil {
+		t.Fatalf("encrypt failed: %v", err)
+	}
+
+	// Each line is an event, ending with the file written
+	var events []progressEvent
+	for scanner := bufio.NewScanner(r); scanner.Scan(); {
+		var e progressEvent
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatalf("line %q is not an event: %v", scanner.Text(), err)
+		}
+		events = append(events, e)
+	}
+	if len(events) < 2 || events[0].Phase != pixellock.PhaseEncrypt {
+		t.Fatalf("events %+v do not start with encryption", events)
+	}
+	if last := events[len(events)-1]; last.Phase != pixellock.PhaseWrite || last.Output != encrypted {
+		t.Errorf("last event %+v, want %s written", last, encrypted)
+	}
+
+	err = app.Run([]string{"pixellock", "encrypt", "-i", faceFixture, "-o", encrypted, "-k", base64.StdEncoding.EncodeToString(key), "--progress", "dots"})
+	if err == nil {
+		t.Error("encrypt with --progress dots succeeded")
+	}
+}
+
+func TestExitStatus(t *testing.T) {
+	key, _ := pixellock.GenerateRandomKey()
+	wrongKey, _ := pixellock.GenerateRandomKey()
+	dir := t.TempDir()
+	encrypted := filepath.Join(dir, "face.enc")
+	app := &cli.App{Commands: []*cli.Command{encryptCmd, decryptCmd}, Flags: []cli.Flag{maxPixelsFlag}}
+	if err := app.Run([]string{"pixellock", "encrypt", "-i", faceFixture, "-o", encrypted, "-k", base64.StdEncoding.EncodeToString(key)}); err != nil {
+		t.Fatalf("encrypt failed: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		args []string
+		want int
+	}{
+		{"wrong key", []string{"decrypt", "-i", encrypted, "-o", filepath.Join(dir, "out1.png"), "-k", base64.StdEncoding.EncodeToString(wrongKey)}, exitWrongKey},
+		{"short key", []string{"decrypt", "-i", encrypted, "-o", filepath.Join(dir, "out2.png"), "-k", base64.StdEncoding.EncodeToString(key[:16])}, exitInvalidKey},
+		{"not encrypted", []string{"decrypt", "-i", faceFixture, "-o", filepath.Join(dir, "out3.png"), "-k", base64.StdEncoding.EncodeToString(key)}, exitNotEncrypted},
+		{"not an image", []string{"encrypt", "-i", "main.go", "-o", filepath.Join(dir, "main.enc"), "-k", base64.StdEncoding.EncodeToString(key)}, exitUnsupported},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := app.Run(append([]string{"pixellock"}, test.args...))
+			if err == nil {
+				t.Fatal("succeeded")
+			}
+			if status, _ := exitStatus(err); status != test.want {
+				t.Errorf("exit status %d for %v, want %d", status, err, test.want)
+			}
+		})
+	}
+
+	err := app.Run([]string{"pixellock", "--max-pixels", "1", "encrypt", "-i", faceFixture, "-o", filepath.Join(dir, "large.enc"), "-k", base64.StdEncoding.EncodeToString(key)})
+	if status, hint := exitStatus(err); status != exitFailure || !strings.Contains(hint, "--max-pixels") {
+		t.Errorf("exit status %d and hint %q for %v, want %d and a hint of --max-pixels", status, hint, err, exitFailure)
+	}
+}
+
+// captureStderr returns what run writes to standard error.
+func captureStderr(t *testing.T, run func()) []byte {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Pipe failed: %v", err)
+	}
+	stderr := os.Stderr
+	os.Stderr = w
+	done := make(chan []byte)
+	go func() {
+		data, _ := io.ReadAll(r)
+		done <- data
+	}()
+	run()
+	os.Stderr = stderr
+	w.Close()
+	return <-done
+}
+
+func TestProgressJSONErrorCodes(t *testing.T) {
+	key, _ := pixellock.GenerateRandomKey()
+	wrongKey, _ := pixellock.GenerateRandomKey()
+	dir := t.TempDir()
+	encrypted, decrypted := filepath.Join(dir, "enc"), filepath.Join(dir, "dec")
+	os.MkdirAll(decrypted, 0755)
+	face, err := os.ReadFile(faceFixture)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	app := &cli.App{Commands: []*cli.Command{encryptCmd, decryptCmd}}
+	encrypt := func(name string, key []byte) {
+		if err := app.Run([]string{"pixellock", "encrypt", "-i", faceFixture, "-o", filepath.Join(encrypted, name+".enc"), "-k", base64.StdEncoding.EncodeToString(key)}); err != nil {
+			t.Fatalf("encrypt failed: %v", err)
+		}
+	}
+	encrypt("wrong-key.jpg", wrongKey)
+	encrypt("exists.jpg", key)
+	if err := os.WriteFile(filepath.Join(encrypted, "plain.jpg.enc"), face, 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(decrypted, "exists.jpg"), face, 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+
+	stderr := captureStderr(t, func() {
+		err = app.Run([]string{"pixellock", "decrypt", "-i", encrypted, "-o", decrypted, "-k", base64.StdEncoding.EncodeToString(key), "--progress", "json"})
+	})
+	if err != nil {
+		t.Fatalf("decrypt failed: %v", err)
+	}
+	codes := map[string]string{}
+	for scanner := bufio.NewScanner(bytes.NewReader(stderr)); scanner.Scan(); {
+		var e progressEvent
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatalf("line %q is not an event: %v", scanner.Text(), err)
+		}
+		if e.Error != "" {
+			codes[filepath.Base(e.Path)] = e.Code
+		}
+	}
+	want := map[string]string{
+		"wrong-key.jpg.enc": string(pixellock.CodeKeyMismatch),
+		"plain.jpg.enc":     string(pixellock.CodeNotEncrypted),
+		"exists.jpg.enc":    string(pixellock.CodeOutputExists),
+	}
+	if !maps.Equal(codes, want) {
+		t.Errorf("files failed with codes %v, want %v", codes, want)
+	}
+
+	// An error no code classes is given the generic one, not none
+	e := newProgressEvent(pixellock.Event{Phase: pixellock.PhaseDecrypt, Path: "x.enc", Err: errors.New("something unforeseen")})
+	if e.Code != string(pixellock.CodeUnknown) {
+		t.Errorf("unknown error given code %q, want %s", e.Code, pixellock.CodeUnknown)
+	}
+	if e := newProgressEvent(pixellock.Event{Phase: pixellock.PhaseWrite, Path: "x.enc"}); e.Code != "" {
+		t.Errorf("event without an error given code %q", e.Code)
+	}
+}
+
+func TestErrorsList(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Pipe failed: %v", err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	app := &cli.App{Commands: []*cli.Command{errorsCmd}}
+	err = app.Run([]string{"pixellock", "errors", "list", "--json"})
+	os.Stdout = stdout
+	w.Close()
+	if err != nil {
+		t.Fatalf("errors list failed: %v", err)
+	}
+	var listed []pixellock.ErrorCodeInfo
+	if err := json.NewDecoder(r).Decode(&listed); err != nil {
+		t.Fatalf("errors list --json gave no JSON: %v", err)
+	}
+	if !slices.Equal(listed, pixellock.ErrorCodes()) {
+		t.Errorf("errors list gave %+v, want %+v", listed, pixellock.ErrorCodes())
+	}
+}
+
+// TestRemoteSchemes checks that URLs of schemes other than s3 and sftp are
+// refused, not taken for local paths, and that sftp ones need a key.
+func TestRemoteSchemes(t *testing.T) {
+	key, _ := pixellock.GenerateRandomKey()
+	encodedKey := base64.StdEncoding.EncodeToString(key)
+	app := &cli.App{Commands: []*cli.Command{encryptCmd, decryptCmd}}
+	for _, args := range [][]string{
+		{"encrypt", "-i", "ftp://user@host/photos", "-o", t.TempDir()},
+		{"encrypt", "-i", faceFixture, "-o", "ftp://user@host/encrypted"},
+		{"decrypt", "-i", "https://example.com/photo.enc", "-o", t.TempDir()},
+	} {
+		err := app.Run(append([]string{"pixellock"}, append(args, "-k", encodedKey)...))
+		if err == nil || !strings.Contains(err.Error(), "paths are not supported") {
+			t.Errorf("%v: %v, want the scheme refused", args, err)
+		}
+	}
+
+	t.Setenv("SSH_AUTH_SOCK", "")
+	err := app.Run([]string{"pixellock", "encrypt", "-i", faceFixture, "-o", "sftp://user@host/encrypted", "-k", encodedKey})
+	if err == nil || !strings.Contains(err.Error(), "no SSH key") {
+		t.Errorf("encrypt to sftp:// with no key = %v", err)
+	}
+	err = app.Run([]string{"pixellock", "encrypt", "-i", faceFixture, "-o", t.TempDir(), "--overwrite", "--skip-existing", "-k", encodedKey})
+	if err == nil || !strings.Contains(err.Error(), "cannot be used together") {
+		t.Errorf("encrypt --overwrite --skip-existing = %v", err)
+	}
+}
+
+func TestMetricsOut(t *testing.T) {
+	key, _ := pixellock.GenerateRandomKey()
+	encodedKey := base64.StdEncoding.EncodeToString(key)
+	dir := t.TempDir()
+	encrypted, metrics := filepath.Join(dir, "face.enc"), filepath.Join(dir, "metrics.prom")
+	app := &cli.App{Commands: []*cli.Command{encryptCmd, decryptCmd}}
+	if err := app.Run([]string{"pixellock", "encrypt", "-i", faceFixture, "-o", encrypted, "-k", encodedKey, "--metrics-out", metrics}); err != nil {
+		t.Fatalf("encrypt failed: %v", err)
+	}
+	data, err := os.ReadFile(metrics)
+	if err != nil {
+		t.Fatalf("no metrics written: %v", err)
+	}
+	for _, want := range []string{
+		`pixellock_files_total{op="encrypt",result="ok"} 1`,
+		`pixellock_crypto_operations_total{op="encrypt",cipher="aes-256-gcm"} 1`,
+	} {
+		if !strings.Contains(string(data), want+"\n") {
+			t.Errorf("no %s in metrics:\n%s", want, data)
+		}
+	}
+}
+
+func TestArchiveCommands(t *testing.T) {
+	key, _ := pixellock.GenerateRandomKey()
+	encodedKey := base64.StdEncoding.EncodeToString(key)
+	dir := t.TempDir()
+	input := filepath.Join(dir, "tree")
+	os.MkdirAll(filepath.Join(input, "bin"), 0o755)
+	os.WriteFile(filepath.Join(input, "bin", "run.sh"), []byte("#!/bin/sh\n"), 0o755)
+	archive, output := filepath.Join(dir, "tree.penc"), filepath.Join(dir, "out")
+	app := &cli.App{Commands: []*cli.Command{archiveCmd, extractCmd}}
+	if err := app.Run([]string{"pixellock", "archive", "-i", input, "-o", archive, "-k", encodedKey}); err != nil {
+		t.Fatalf("archive failed: %v", err)
+	}
+	if err := app.Run([]string{"pixellock", "archive", "-i", input, "-o", archive, "-k", encodedKey}); err == nil {
+		t.Error("archive over an existing archive succeeded without --overwrite")
+	}
+	if err := app.Run([]string{"pixellock", "archive", "-i", input, "-o", filepath.Join(input, "self.penc"), "-k", encodedKey}); err == nil {
+		t.Error("archive into the directory archived succeeded")
+	}
+	if err := app.Run([]string{"pixellock", "extract", "-o", output, "-k", encodedKey, archive}); err != nil {
+		t.Fatalf("extract failed: %v", err)
+	}
+	info, err := os.Stat(filepath.Join(output, "bin", "run.sh"))
+	if err != nil {
+		t.Fatalf("not extracted: %v", err)
+	}
+	if runtime.GOOS != "windows" && info.Mode().Perm() != 0o755 {
+		t.Errorf("extracted with mode %v, want -rwxr-xr-x", info.Mode())
+	}
+	if err := app.Run([]string{"pixellock", "extract", archive, "-o", output}); err == nil {
+		t.Error("extract with flags after the archive succeeded")
+	}
+}
+
+func TestIPFSCommands(t *testing.T) {
+	// An IPFS node serving add and cat, giving files their index as CIDs
+	var blocks [][]byte
+	node := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v0/add":
+			f, _, err := r.FormFile("file")
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			data, _ := io.ReadAll(f)
+			blocks = append(blocks, data)
+			fmt.Fprintf(w, `{"Hash":"bafy%d"}`, len(blocks)-1)
+		case "/api/v0/cat":
+			i, err := strconv.Atoi(strings.TrimPrefix(r.URL.Query().Get("arg"), "bafy"))
+			if err != nil || i >= len(blocks) {
+				http.Error(w, `{"Message":"not found"}`, http.StatusInternalServerError)
+				return
+			}
+			w.Write(blocks[i])
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer node.Close()
+	t.Setenv(ipfs.EndpointEnv, node.URL)
+
+	key, _ := pixellock.GenerateRandomKey()
+	encodedKey := base64.StdEncoding.EncodeToString(key)
+	dir := t.TempDir()
+	input := filepath.Join(dir, "photos")
+	os.MkdirAll(filepath.Join(input, "2024"), 0o755)
+	data, _ := os.ReadFile(faceFixture)
+	os.WriteFile(filepath.Join(input, "2024", "face.jpg"), data, 0o644)
+	encrypted, output := filepath.Join(dir, "enc"), filepath.Join(dir, "out")
+	app := &cli.App{Commands: []*cli.Command{encryptCmd, fetchCmd}}
+	if err := app.Run([]string{"pixellock", "encrypt", "-i", input, "-o", encrypted, "-k", encodedKey, "-r", "--publish-ipfs"}); err != nil {
+		t.Fatalf("encrypt failed: %v", err)
+	}
+	manifest, err := pixellock.ReadIPFSManifest(filepath.Join(encrypted, pixellock.IPFSManifestName))
+	if err != nil {
+		t.Fatalf("no manifest: %v", err)
+	}
+	if len(manifest.Files) != 1 || manifest.Files[0].Path != "2024/face.jpg.enc" || manifest.Files[0].CID != "bafy0" {
+		t.Errorf("the manifest lists %+v", manifest.Files)
+	}
+	if err := app.Run([]string{"pixellock", "fetch", "-o", output, "-k", encodedKey, filepath.Join(encrypted, pixellock.IPFSManifestName)}); err != nil {
+		t.Fatalf("fetch failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(output, "2024", "face.jpg")); err != nil {
+		t.Errorf("not fetched: %v", err)
+	}
+	if err := app.Run([]string{"pixellock", "encrypt", "-i", input, "-o", "ipfs://photos", "-k", encodedKey}); err == nil || !strings.Contains(err.Error(), "--publish-ipfs") {
+		t.Errorf("encrypt to ipfs:// = %v, want a pointer to --publish-ipfs", err)
+	}
+}
+
+func TestCatalogCommands(t *testing.T) {
+	key, _ := pixellock.GenerateRandomKey()
+	encodedKey := base64.StdEncoding.EncodeToString(key)
+	dir := t.TempDir()
+	input, encrypted := filepath.Join(dir, "photos"), filepath.Join(dir, "enc")
+	os.MkdirAll(filepath.Join(input, "2024"), 0o755)
+	data, _ := os.ReadFile(faceFixture)
+	os.WriteFile(filepath.Join(input, "2024", "face.jpg"), data, 0o644)
+	db := filepath.Join(dir, "catalog.db")
+	app := &cli.App{Commands: []*cli.Command{encryptCmd, catalogCmd}}
+	if err := app.Run([]string{"pixellock", "encrypt", "-i", input, "-o", encrypted, "-k", encodedKey, "-r"}); err != nil {
+		t.Fatalf("encrypt failed: %v", err)
+	}
+	if err := app.Run([]string{"pixellock", "catalog", "build", "-i", encrypted, "--db", db, "-k", encodedKey}); err != nil {
+		t.Fatalf("catalog build failed: %v", err)
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Pipe failed: %v", err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	err = app.Run([]string{"pixellock", "catalog", "search", "--db", db, "--name", "FACE.*", "--format", "jpeg", "--json"})
+	os.Stdout = stdout
+	w.Close()
+	if err != nil {
+		t.Fatalf("catalog search failed: %v", err)
+	}
+	var found []catalog.Entry
+	if err := json.NewDecoder(r).Decode(&found); err != nil {
+		t.Fatalf("catalog search --json gave no JSON: %v", err)
+	}
+	if len(found) != 1 || found[0].Path != "2024/face.jpg.enc" || found[0].Name != "face.jpg" {
+		t.Errorf("catalog search found %+v", found)
+	}
+	if err := app.Run([]string{"pixellock", "catalog", "search", "--db", db, "--after", "March"}); err == nil {
+		t.Error("catalog search with a bad time succeeded")
+	}
+
+	if err := app.Run([]string{"pixellock", "catalog", "verify", "--db", db}); err != nil {
+		t.Errorf("catalog verify of the directory built from failed: %v", err)
+	}
+	os.Remove(filepath.Join(encrypted, "2024", "face.jpg.enc"))
+	if err := app.Run([]string{"pixellock", "catalog", "verify", "--db", db, "--quick"}); err == nil || !strings.Contains(err.Error(), "does not match") {
+		t.Errorf("catalog verify after a file was removed = %v", err)
+	}
+}
+
+func TestTagCommands(t *testing.T) {
+	key, _ := pixellock.GenerateRandomKey()
+	encodedKey := base64.StdEncoding.EncodeToString(key)
+	dir := t.TempDir()
+	input, encrypted, output := filepath.Join(dir, "photos"), filepath.Join(dir, "enc"), filepath.Join(dir, "out")
+	os.MkdirAll(filepath.Join(input, "2024"), 0o755)
+	data, _ := os.ReadFile(faceFixture)
+	for _, name := range []string{"a.jpg", "b.jpg", filepath.Join("2024", "c.jpg")} {
+		os.WriteFile(filepath.Join(input, name), data, 0o644)
+	}
+	app := &cli.App{Commands: []*cli.Command{encryptCmd, decryptCmd, tagCmd}}
+	if err := app.Run([]string{"pixellock", "encrypt", "-i", input, "-o", encrypted, "-k", encodedKey, "-r"}); err != nil {
+		t.Fatalf("encrypt failed: %v", err)
+	}
+	a, c := filepath.Join(encrypted, "a.jpg.enc"), filepath.Join(encrypted, "2024", "c.jpg.enc")
+	before, _ := os.ReadFile(a)
+	if err := app.Run([]string{"pixellock", "tag", "add", "--tag", "client=acme", "--tag", "status=new", "-k", encodedKey, a, c}); err != nil {
+		t.Fatalf("tag add failed: %v", err)
+	}
+	if err := app.Run([]string{"pixellock", "tag", "rm", "--tag", "status", "-k", encodedKey, c}); err != nil {
+		t.Fatalf("tag rm failed: %v", err)
+	}
+	// The tags go in between the header and the ciphertext, leaving both be
+	after, _ := os.ReadFile(a)
+	header := 0
+	for header < min(len(before), len(after)) && before[header] == after[header] {
+		header++
+	}
+	if len(after) <= len(before) || !bytes.HasSuffix(after, before[header:]) {
+		t.Error("tagging changed the ciphertext")
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Pipe failed: %v", err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	err = app.Run([]string{"pixellock", "tag", "list", "--tag", "client=acme", "--json", "-k", encodedKey, "-r", encrypted})
+	os.Stdout = stdout
+	w.Close()
+	if err != nil {
+		t.Fatalf("tag list failed: %v", err)
+	}
+	var listed []taggedFile
+	if err := json.NewDecoder(r).Decode(&listed); err != nil {
+		t.Fatalf("tag list --json gave no JSON: %v", err)
+	}
+	if len(listed) != 2 || listed[0].Path != c || listed[0].Tags.String() != "client=acme" || listed[1].Tags.String() != "client=acme, status=new" {
+		t.Errorf("tag list listed %+v", listed)
+	}
+
+	if err := app.Run([]string{"pixellock", "decrypt", "-i", encrypted, "-o", output, "-k", encodedKey, "-r", "--tag", "client=acme"}); err != nil {
+		t.Fatalf("decrypt --tag failed: %v", err)
+	}
+	var decrypted []string
+	filepath.WalkDir(output, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			rel, _ := filepath.Rel(output, path)
+			decrypted = append(decrypted, filepath.ToSlash(rel))
+		}
+		return err
+	})
+	if want := []string{"2024/c.jpg", "a.jpg"}; !slices.Equal(decrypted, want) {
+		t.Errorf("decrypt --tag decrypted %v, want %v", decrypted, want)
+	}
+	if err := app.Run([]string{"pixellock", "decrypt", "-i", a, "-o", output, "-k", encodedKey, "--tag", "client=acme"}); err == nil {
+		t.Error("decrypt --tag of a single file succeeded")
+	}
+	if err := app.Run([]string{"pixellock", "tag", "add", "--tag", "status", "-k", encodedKey, a}); err == nil {
+		t.Error("tag add of a tag without a value succeeded")
+	}
+}
+
+func TestParityCommands(t *testing.T) {
+	key, _ := pixellock.GenerateRandomKey()
+	encodedKey := base64.StdEncoding.EncodeToString(key)
+	dir := t.TempDir()
+	input, encrypted := filepath.Join(dir, "photos"), filepath.Join(dir, "enc")
+	os.MkdirAll(input, 0o755)
+	data, _ := os.ReadFile(faceFixture)
+	for _, name := range []string{"a.jpg", "b.jpg", "c.jpg", "d.jpg"} {
+		os.WriteFile(filepath.Join(input, name), data, 0o644)
+	}
+	app := &cli.App{Commands: []*cli.Command{encryptCmd, parityCmd}}
+	if err := app.Run([]string{"pixellock", "encrypt", "-i", input, "-o", encrypted, "-k", encodedKey}); err != nil {
+		t.Fatalf("encrypt failed: %v", err)
+	}
+	if err := app.Run([]string{"pixellock", "parity", "create", "-i", encrypted, "--redundancy", "150%"}); err == nil {
+		t.Error("parity create with a redundancy of 150% succeeded")
+	}
+	if err := app.Run([]string{"pixellock", "parity", "create", "-i", encrypted, "--redundancy", "30%"}); err != nil {
+		t.Fatalf("parity create failed: %v", err)
+	}
+
+	originals := map[string][]byte{}
+	for _, name := range []string{"a.jpg.enc", "b.jpg.enc"} {
+		originals[name], _ = os.ReadFile(filepath.Join(encrypted, name))
+	}
+	corrupt := slices.Clone(originals["a.jpg.enc"])
+	corrupt[len(corrupt)/2] ^= 0x80
+	os.WriteFile(filepath.Join(encrypted, "a.jpg.enc"), corrupt, 0o644)
+	os.Remove(filepath.Join(encrypted, "b.jpg.enc"))
+	if err := app.Run([]string{"pixellock", "parity", "repair", "-i", encrypted}); err != nil {
+		t.Fatalf("parity repair failed: %v", err)
+	}
+	for name, want := range originals {
+		if got, err := os.ReadFile(filepath.Join(encrypted, name)); err != nil || !bytes.Equal(got, want) {
+			t.Errorf("parity repair left %s not as it was: %v", name, err)
+		}
+	}
+
+	for _, name := range []string{"a.jpg.enc", "b.jpg.enc", "c.jpg.enc"} {
+		os.Remove(filepath.Join(encrypted, name))
+	}
+	err := app.Run([]string{"pixellock", "parity", "repair", "-i", encrypted})
+	if !errors.Is(err, parity.ErrTooDamaged) {
+		t.Errorf("parity repair of too much damage gave %v", err)
+	}
+}
+
+func TestDedupeCommands(t *testing.T) {
+	key, _ := pixellock.GenerateRandomKey()
+	encodedKey := base64.StdEncoding.EncodeToString(key)
+	dir := t.TempDir()
+	input, encrypted, decrypted := filepath.Join(dir, "photos"), filepath.Join(dir, "enc"), filepath.Join(dir, "dec")
+	data, _ := os.ReadFile(faceFixture)
+	paths := []string{"face.jpg", "2024/face.jpg", "2024/copy/face again.jpg"}
+	for _, path := range paths {
+		name := filepath.Join(input, filepath.FromSlash(path))
+		os.MkdirAll(filepath.Dir(name), 0o755)
+		os.WriteFile(name, data, 0o644)
+	}
+	index := filepath.Join(dir, "dedupe.json")
+	app := &cli.App{Commands: []*cli.Command{encryptCmd, decryptCmd}}
+	if err := app.Run([]string{"pixellock", "encrypt", "-i", input, "-o", encrypted, "-k", encodedKey, "-r", "--dedupe-mode", "reference"}); err == nil {
+		t.Error("encrypt with --dedupe-mode but not --dedupe succeeded")
+	}
+	if err := app.Run([]string{"pixellock", "encrypt", "-i", input, "-o", encrypted, "-k", encodedKey, "-r", "--dedupe", "--dedupe-mode", "reference", "--dedupe-index", index}); err != nil {
+		t.Fatalf("encrypt --dedupe failed: %v", err)
+	}
+	var written []string
+	filepath.WalkDir(encrypted, func(name string, d fs.DirEntry, err error) error {
+		if err == nil && strings.HasSuffix(name, pixellock.EncryptedExtension) {
+			written = append(written, name)
+		}
+		return err
+	})
+	if len(written) != 1 {
+		t.Errorf("encrypt --dedupe wrote %d encrypted files, want 1", len(written))
+	}
+	if _, err := os.Stat(index); err != nil {
+		t.Errorf("encrypt --dedupe wrote no index: %v", err)
+	}
+
+	if err := app.Run([]string{"pixellock", "decrypt", "-i", encrypted, "-o", decrypted, "-k", encodedKey, "-r"}); err != nil {
+		t.Fatalf("decrypt failed: %v", err)
+	}
+	var first []byte
+	for _, path := range paths {
+		got, err := os.ReadFile(filepath.Join(decrypted, filepath.FromSlash(path)))
+		if err != nil {
+			t.Errorf("decrypt did not restore %s: %v", path, err)
+		} else if first == nil {
+			first = got
+		} else if !bytes.Equal(got, first) {
+			t.Errorf("%s decrypted is not as its duplicates", path)
+		}
+	}
+}
+
+func TestShardCommands(t *testing.T) {
+	key, _ := pixellock.GenerateRandomKey()
+	encodedKey := base64.StdEncoding.EncodeToString(key)
+	dir := t.TempDir()
+	input, set, images := filepath.Join(dir, "docs"), filepath.Join(dir, "set"), filepath.Join(dir, "images")
+	os.MkdirAll(filepath.Join(input, "sub"), 0o755)
+	os.WriteFile(filepath.Join(input, "a.txt"), []byte("alpha"), 0o644)
+	os.WriteFile(filepath.Join(input, "sub", "b.txt"), []byte("beta"), 0o644)
+	data, _ := os.ReadFile(faceFixture)
+	os.MkdirAll(filepath.Join(images, "2024"), 0o755)
+	os.WriteFile(filepath.Join(images, "2024", "face.jpg"), data, 0o644)
+
+	app := &cli.App{Commands: []*cli.Command{encryptCmd, decryptCmd, archiveCmd, extractCmd}}
+	for _, size := range []string{"64", "ten", "-1MiB"} {
+		if err := app.Run([]string{"pixellock", "archive", "-i", input, "-o", set, "-k", encodedKey, "--shard-size", size}); err == nil {
+			t.Errorf("archive --shard-size %s succeeded", size)
+		}
+	}
+	if err := app.Run([]string{"pixellock", "archive", "-i", input, "-o", set, "-k", encodedKey, "--shard-size", "64KiB"}); err != nil {
+		t.Fatalf("archive --shard-size failed: %v", err)
+	}
+	out := filepath.Join(dir, "out")
+	if err := app.Run([]string{"pixellock", "extract", "-o", out, "-k", encodedKey, "--path", "sub/b.txt", set}); err != nil {
+		t.Fatalf("extract --path failed: %v", err)
+	}
+	if got, err := os.ReadFile(filepath.Join(out, "sub", "b.txt")); err != nil || string(got) != "beta" {
+		t.Errorf("extract --path gave %q, %v", got, err)
+	}
+	if _, err := os.Stat(filepath.Join(out, "a.txt")); err == nil {
+		t.Error("extract --path extracted a file not picked")
+	}
+
+	// Encrypted images packed, and one decrypted from the set
+	encrypted := filepath.Join(dir, "encrypted")
+	if err := app.Run([]string{"pixellock", "encrypt", "-i", images, "-o", encrypted, "-k", encodedKey, "-r", "--shard-size", "1MiB"}); err != nil {
+		t.Fatalf("encrypt --shard-size failed: %v", err)
+	}
+	if !pixellock.IsShardSet(encrypted) {
+		t.Fatal("encrypt --shard-size wrote no shard set")
+	}
+	if leftover, _ := filepath.Glob(filepath.Join(dir, ".pixellock-shards-*")); len(leftover) != 0 {
+		t.Errorf("encrypt --shard-size left %v behind", leftover)
+	}
+	decrypted := filepath.Join(dir, "decrypted")
+	if err := app.Run([]string{"pixellock", "decrypt", "-i", encrypted, "-o", decrypted, "-k", encodedKey, "--path", "2024"}); err != nil {
+		t.Fatalf("decrypt of a shard set failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(decrypted, "2024", "face.jpg")); err != nil {
+		t.Errorf("decrypt of a shard set did not restore the image: %v", err)
+	}
+	if err := app.Run([]string{"pixellock", "decrypt", "-i", images, "-o", decrypted, "-k", encodedKey, "--path", "2024"}); err == nil {
+		t.Error("decrypt --path of a directory that is not a shard set succeeded")
+	}
+}
+
+func TestDiffCommand(t *testing.T) {
+	key, _ := pixellock.GenerateRandomKey()
+	encodedKey := base64.StdEncoding.EncodeToString(key)
+	dir := t.TempDir()
+	left, right := filepath.Join(dir, "left"), filepath.Join(dir, "right")
+	app := &cli.App{Commands: []*cli.Command{encryptCmd, diffCmd}}
+	// The same image encrypted into each tree, under other nonces
+	for _, out := range []string{left, right} {
+		if err := app.Run([]string{"pixellock", "encrypt", "-i", faceFixture, "-o", filepath.Join(out, "face.jpg.enc"), "-k", encodedKey}); err != nil {
+			t.Fatalf("encrypt failed: %v", err)
+		}
+	}
+
+	tests := []struct {
+		name string
+		args []string
+		want int // Exit status, 0 for success
+	}{
+		{"ciphertexts", []string{"--left", left, "--right", right}, exitDifferent},
+		{"content", []string{"--left", left, "--right", right, "-k", encodedKey, "--content"}, 0},
+		{"content without a key", []string{"--left", left, "--right", right, "--content"}, exitFailure},
+		{"same tree", []string{"--left", left, "--right", left, "--json"}, 0},
+	}
+	check := func(t *testing.T, args []string, want int) {
+		t.Helper()
+		err := app.Run(append([]string{"pixellock", "diff"}, args...))
+		if status, _ := exitStatus(err); err != nil && status != want || err == nil && want != 0 {
+			t.Errorf("diff %v gave %v, want exit status %d", args, err, want)
+		}
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("IMAGE_ENCRYPTION_KEY", "")
+			check(t, test.args, test.want)
+		})
+	}
+
+	// A file that cannot be decrypted is an error, not a difference
+	os.WriteFile(filepath.Join(right, "face.jpg.enc"), []byte("damaged"), 0o644)
+	check(t, []string{"--left", left, "--right", right, "-k", encodedKey, "--content"}, exitFailure)
+}
+
+func TestURLInput(t *testing.T) {
+	face, _ := os.ReadFile(faceFixture)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/photos/face.jpg":
+			w.Write(face)
+		case "/readme.jpg":
+			io.WriteString(w, "not an image")
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	key, _ := pixellock.GenerateRandomKey()
+	encodedKey := base64.StdEncoding.EncodeToString(key)
+	dir := t.TempDir()
+	app := &cli.App{Commands: []*cli.Command{encryptCmd, decryptCmd}}
+	if err := app.Run([]string{"pixellock", "encrypt", "-i", srv.URL + "/photos/face.jpg", "-o", dir + string(filepath.Separator), "-k", encodedKey}); err != nil {
+		t.Fatalf("encrypt failed: %v", err)
+	}
+	encrypted := filepath.Join(dir, "face.jpg"+pixellock.EncryptedExtension)
+	if err := app.Run([]string{"pixellock", "decrypt", "-i", encrypted, "-o", filepath.Join(dir, "face.jpg"), "-k", encodedKey}); err != nil {
+		t.Fatalf("decrypt of the download failed: %v", err)
+	}
+	for _, path := range []string{"/missing.jpg", "/readme.jpg"} {
+		err := app.Run([]string{"pixellock", "encrypt", "-i", srv.URL + path, "-o", dir, "-k", encodedKey, "--retries", "0"})
+		if err == nil {
+			t.Errorf("encrypt of %s succeeded", path)
+		}
+	}
+}
+
+func TestTraceCommands(t *testing.T) {
+	for _, env := range []string{"OTEL_EXPORTER_OTLP_ENDPOINT", "OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", "OTEL_TRACES_EXPORTER", "OTEL_SDK_DISABLED"} {
+		t.Setenv(env, "")
+	}
+	if tp, err := newTracerProvider(""); tp != nil || err != nil {
+		t.Errorf("without an endpoint newTracerProvider returned %v, %v; want tracing off", tp, err)
+	}
+	t.Setenv("OTEL_TRACES_EXPORTER", "zipkin")
+	if _, err := newTracerProvider(""); err == nil {
+		t.Error("newTracerProvider took an exporter other than otlp")
+	}
+	t.Setenv("OTEL_TRACES_EXPORTER", "")
+	if _, err := newTracerProvider("localhost:4318"); err == nil {
+		t.Error("newTracerProvider took an endpoint that is no URL")
+	}
+	if tp, err := newTracerProvider("http://localhost:4318"); tp == nil || err != nil {
+		t.Errorf("with an endpoint newTracerProvider returned %v, %v; want tracing on", tp, err)
+	} else {
+		tp.Shutdown(t.Context())
+	}
+
+	// The commands start their spans, and the library its own beneath
+	// them, with the global TracerProvider
+	exporter := tracetest.NewInMemoryExporter()
+	saved := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+	t.Cleanup(func() { otel.SetTracerProvider(saved) })
+	t.Setenv("TRACEPARENT", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+
+	encrypt := *encryptCmd // Wrapped apart from the other tests' encryptCmd
+	traceCommands([]*cli.Command{&encrypt})
+	key, _ := pixellock.GenerateRandomKey()
+	app := &cli.App{Commands: []*cli.Command{&encrypt}}
+	output := filepath.Join(t.TempDir(), "face.jpg"+pixellock.EncryptedExtension)
+	if err := app.Run([]string{"pixellock", "encrypt", "-i", faceFixture, "-o", output, "-k", base64.StdEncoding.EncodeToString(key)}); err != nil {
+		t.Fatalf("encrypt failed: %v", err)
+	}
+
+	var root tracetest.SpanStub
+	beneath := map[trace.SpanID][]string{}
+	for _, span := range exporter.GetSpans() {
+		if span.Name == "pixellock encrypt" {
+			root = span
+		}
+		beneath[span.Parent.SpanID()] = append(beneath[span.Parent.SpanID()], span.Name)
+	}
+	if root.SpanContext.TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" || root.Parent.SpanID().String() != "00f067aa0ba902b7" {
+		t.Errorf("the command is not traced beneath TRACEPARENT: %+v", root)
+	}
+	if files := beneath[root.SpanContext.SpanID()]; !slices.Equal(files, []string{pixellock.SpanEncryptFile}) {
+		t.Errorf("the spans beneath the command are %v, want %s", files, pixellock.SpanEncryptFile)
+	}
+}
+
+func TestHookCheck(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	face, err := filepath.Abs(faceFixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	t.Chdir(dir)
+	data, _ := os.ReadFile(face)
+	os.WriteFile("scan.jpg", data, 0o644)
+	for _, args := range [][]string{{"init", "--quiet"}, {"add", "scan.jpg"}} {
+		if out, err := exec.Command("git", args...).CombinedOutput(); err != nil {
+			t.Fatalf("git %s failed: %v: %s", args[0], err, out)
+		}
+	}
+	app := &cli.App{Commands: []*cli.Command{hookCmd}}
+	if err := app.Run([]string{"pixellock", "hook", "check", "--staged"}); err == nil {
+		t.Error("hook check of a staged image succeeded")
+	}
+	if err := app.Run([]string{"pixellock", "hook", "check", "--staged", "--allow", "*.jpg"}); err != nil {
+		t.Errorf("hook check of an allowed image failed: %v", err)
+	}
+	key, _ := pixellock.GenerateRandomKey()
+	t.Setenv("IMAGE_ENCRYPTION_KEY", base64.StdEncoding.EncodeToString(key))
+	if err := app.Run([]string{"pixellock", "hook", "check", "--staged", "--auto-encrypt"}); err != nil {
+		t.Fatalf("hook check --auto-encrypt failed: %v", err)
+	}
+	if err := app.Run([]string{"pixellock", "hook", "check", "--staged"}); err != nil {
+		t.Errorf("hook check after --auto-encrypt failed: %v", err)
+	}
+}
+
+// fakeClipboard replaces the system clipboard with one in memory for the
+// test, and records the digests of the texts to be cleared later.
+func fakeClipboard(t *testing.T) (*clipboard.Memory, *[]string) {
+	cb := &clipboard.Memory{}
+	var cleared []string
+	system, start := systemClipboard, startClipboardClear
+	systemClipboard = func() (clipboard.Clipboard, error) { return cb, nil }
+	startClipboardClear = func(digest string, after time.Duration) error {
+		cleared = append(cleared, digest)
+		return nil
+	}
+	t.Cleanup(func() { systemClipboard, startClipboardClear = system, start })
+	return cb, &cleared
+}
+
+func TestClipboard(t *testing.T) {
+	cb, cleared := fakeClipboard(t)
+	dir := t.TempDir()
+	app := &cli.App{Commands: []*cli.Command{keygenCmd, encryptCmd, decryptCmd, steganographyCmd}}
+	if err := app.Run([]string{"pixellock", "keygen", "--copy"}); err != nil {
+		t.Fatalf("keygen --copy failed: %v", err)
+	}
+	encodedKey, _ := cb.Read()
+	if _, err := pixellock.DecodeKey(encodedKey); err != nil {
+		t.Fatalf("keygen --copy copied %q: %v", encodedKey, err)
+	}
+	if len(*cleared) != 1 || (*cleared)[0] != clipboard.Digest(encodedKey) {
+		t.Errorf("clipboard cleared of %v, want the key", *cleared)
+	}
+
+	encrypted, decrypted := filepath.Join(dir, "face.enc"), filepath.Join(dir, "face.png")
+	if err := app.Run([]string{"pixellock", "encrypt", "-i", faceFixture, "-o", encrypted, "--paste-key"}); err != nil {
+		t.Fatalf("encrypt --paste-key failed: %v", err)
+	}
+	if err := app.Run([]string{"pixellock", "decrypt", "-i", encrypted, "-o", decrypted, "--paste-key"}); err != nil {
+		t.Fatalf("decrypt --paste-key failed: %v", err)
+	}
+	if err := app.Run([]string{"pixellock", "decrypt", "-i", encrypted, "-o", decrypted, "--paste-key", "-k", encodedKey}); err == nil {
+		t.Error("decrypt with both --key and --paste-key succeeded")
+	}
+	cb.Write("not a key")
+	err := app.Run([]string{"pixellock", "decrypt", "-i", encrypted, "-o", decrypted, "--paste-key", "--overwrite"})
+	if err == nil || strings.Contains(err.Error(), "not a key") {
+		t.Errorf("decrypt --paste-key of other text gave %v, want it refused without repeating it", err)
+	}
+
+	stego := filepath.Join(dir, "stego.png")
+	if err := app.Run([]string{"pixellock", "stego", "hide", "-i", faceFixture, "-o", stego, "-m", "meet at noon"}); err != nil {
+		t.Fatalf("stego hide failed: %v", err)
+	}
+	if err := app.Run([]string{"pixellock", "stego", "reveal", "-i", stego, "--copy", "--clear-after", "0"}); err != nil {
+		t.Fatalf("stego reveal --copy failed: %v", err)
+	}
+	if text, _ := cb.Read(); text != "meet at noon" {
+		t.Errorf("stego reveal --copy copied %q", text)
+	}
+	if len(*cleared) != 1 {
+		t.Errorf("--clear-after 0 still cleared the clipboard: %v", *cleared)
+	}
+}
+
+func TestDebugPanic(t *testing.T) {
+	key, _ := pixellock.GenerateRandomKey()
+	encodedKey := base64.StdEncoding.EncodeToString(key)
+	dir := t.TempDir()
+	input, output := filepath.Join(dir, "in"), filepath.Join(dir, "out")
+	face, err := os.ReadFile(faceFixture)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	os.MkdirAll(input, 0755)
+	for _, name := range []string{"a.jpg", "b.jpg", "c.jpg"} {
+		if err := os.WriteFile(filepath.Join(input, name), face, 0644); err != nil {
+			t.Fatalf("WriteFile failed: %v", err)
+		}
+	}
+
+	// The batch finishes the other files, and fails
+	app := &cli.App{Commands: []*cli.Command{encryptCmd}, Flags: []cli.Flag{debugPanicFlag}}
+	args := []string{"pixellock", "--debug-panic", "b.jpg", "encrypt", "-i", input, "-o", output, "--key=" + encodedKey}
+	err = runApp(t.Context(), app, args)
+	if status, _ := exitStatus(err); status != exitInternal {
+		t.Errorf("exit status %d for %v, want %d", status, err, exitInternal)
+	}
+	for _, name := range []string{"a.jpg.enc", "c.jpg.enc"} {
+		if _, err := os.Stat(filepath.Join(output, name)); err != nil {
+			t.Errorf("%s not encrypted after another file panicked: %v", name, err)
+		}
+	}
+
+	reports := t.TempDir()
+	report, err := writeCrashReport(reports, err, args)
+	if err != nil {
+		t.Fatalf("writeCrashReport failed: %v", err)
+	}
+	if filepath.Dir(report) != reports {
+		t.Errorf("report written to %s, not %s", report, reports)
+	}
+	data, err := os.ReadFile(report)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	for _, want := range []string{Version, runtime.GOOS + " " + runtime.GOARCH, "--key=" + redacted, "Panic 1 of 1", "panicFS.Create"} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("report has no %q:\n%s", want, data)
+		}
+	}
+	if strings.Contains(string(data), encodedKey) {
+		t.Error("report has the key")
+	}
+
+	// A panic of the command itself is recovered too
+	app = &cli.App{Commands: []*cli.Command{{Name: "crash", Action: func(*cli.Context) error { panic("crash") }}}}
+	if err := runApp(t.Context(), app, []string{"pixellock", "crash"}); len(pixellock.Panics(err)) != 1 {
+		t.Errorf("runApp gave %v, want the panic", err)
+	}
+}
+
+func TestRedactArgs(t *testing.T) {
+	args := []string{"pixellock", "encrypt", "-k", "secret", "--key", "secret", "--password=secret", "-i", "key", "--keyfile", "key.txt", "-k"}
+	want := []string{"pixellock", "encrypt", "-k", redacted, "--key", redacted, "--password=" + redacted, "-i", "key", "--keyfile", "key.txt", "-k"}
+	if got := redactArgs(args); !slices.Equal(got, want) {
+		t.Errorf("redactArgs = %q, want %q", got, want)
+	}
+	if args[3] != "secret" {
+		t.Error("redactArgs changed its argument")
+	}
+
+	args = []string{"pixellock", "stego", "hide", "--decoy-password=secret", "--decoy-password", "secret", "--message", "secret", "--decoy-message=secret"}
+	want = []string{"pixellock", "stego", "hide", "--decoy-password=" + redacted, "--decoy-password", redacted, "--message", redacted, "--decoy-message=" + redacted}
+	if got := redactArgs(args); !slices.Equal(got, want) {
+		t.Errorf("redactArgs = %q, want %q", got, want)
+	}
+	args = []string{"pixellock", "gallery", "--token", "secret", "--password=secret"}
+	want = []string{"pixellock", "gallery", "--token", redacted, "--password=" + redacted}
+	if got := redactArgs(args); !slices.Equal(got, want) {
+		t.Errorf("redactArgs = %q, want %q", got, want)
+	}
+}
+
+// TestSecretFlags checks that every flag that takes a key, password,
+// token or message is marked with secret, so crash reports leave it out.
+func TestSecretFlags(t *testing.T) {
+	var check func(path string, cmds []*cli.Command)
+	check = func(path string, cmds []*cli.Command) {
+		for _, cmd := range cmds {
+			for _, flag := range cmd.Flags {
+				if _, ok := flag.(*cli.BoolFlag); ok {
+					continue
+				}
+				name := flag.Names()[0]
+				words := strings.Split(name, "-")
+				switch words[len(words)-1] {
+				case "key", "password", "token", "message":
+					for _, n := range flag.Names() {
+						if !secretFlags[n] {
+							t.Errorf("%s %s: --%s is not marked secret", path, cmd.Name, n)
+						}
+					}
+				}
+			}
+			check(path+" "+cmd.Name, cmd.Subcommands)
+		}
+	}
+	check("pixellock", commands)
+}
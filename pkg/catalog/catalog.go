@@ -0,0 +1,367 @@
+// Package catalog keeps a catalog of a directory of encrypted files: the
+// original name, format, dimensions and capture date of the image in each,
+// found by decrypting it once, and the file's tags, so that an image can be found again
+// without decrypting every file.
+//
+// A catalog is an SQLite database, with a row of each file in its files
+// table, which the sqlite3 shell can query too, but should not change:
+// pixellock reads and writes it whole, with package sqlite, and refuses a
+// catalog given an index, view, trigger or table of its own. Building it
+// again only decrypts the files that changed since.
+package catalog
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Amul-Thantharate/pixellock/pkg/pixellock"
+	"github.com/Amul-Thantharate/pixellock/pkg/sqlite"
+)
+
+// The catalog's database: its application_id, "PLKC", and the version of
+// its schema, its user_version. Those of version 1 have no tags column,
+// and are read as if none of their files had tags.
+const (
+	applicationID = 0x504c4b43
+	schemaVersion = 2
+)
+
+// filesSQL declares the files table, a row of each file. Its columns are
+// in the order of Entry's fields.
+const filesSQL = `CREATE TABLE files (
+	path TEXT NOT NULL,        -- Of the encrypted file, relative to the directory, / separated
+	name TEXT NOT NULL,        -- Of the image before it was encrypted
+	format TEXT NOT NULL,
+	width INTEGER,
+	height INTEGER,
+	taken TEXT,                -- YYYY-MM-DD HH:MM:SS, in the camera's time; NULL when not recorded
+	size INTEGER NOT NULL,     -- Of the encrypted file, in bytes
+	mod_time INTEGER NOT NULL, -- Of the encrypted file, in nanoseconds since 1970
+	key_fingerprint TEXT NOT NULL,
+	sha256 TEXT NOT NULL,      -- Of the encrypted file
+	tags TEXT                  -- A JSON object of the file's tags; NULL when it has none
+)`
+
+// infoSQL declares the info table, of the directory cataloged.
+const infoSQL = `CREATE TABLE info (key TEXT NOT NULL, value TEXT)`
+
+// takenLayout is the layout of the taken column, which SQLite's date and
+// time functions take.
+const takenLayout = time.DateTime
+
+// An Entry is what a catalog records of an encrypted file.
+type Entry struct {
+	// Path is the path of the file within the directory, / separated.
+	Path string `json:"path"`
+
+	// Name is the name of the image it was encrypted from: the file's
+	// name without its .enc extension.
+	Name string `json:"name"`
+
+	// Format is the format of that image, as pixellock.OriginalFormat
+	// gives it, and Width and Height its size, or zero when it cannot be
+	// decoded, as for HEIF.
+	Format string `json:"format"`
+	Width  int    `json:"width,omitzero"`
+	Height int    `json:"height,omitzero"`
+
+	// Taken is when the photo was taken, as pixellock.EXIFTime gives it
+	// from the metadata kept with it; zero when it does not say.
+	Taken time.Time `json:"taken,omitzero"`
+
+	// Size, ModTime and SHA256, a hex hash of its contents, are of the
+	// encrypted file, for telling when it changes.
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	SHA256  string    `json:"sha256"`
+
+	// KeyFingerprint is the pixellock.KeyFingerprint of the key the file
+	// was decrypted with.
+	KeyFingerprint string `json:"key_fingerprint"`
+
+	// Tags are the tags of the file, as pixellock.ReadTags reads them.
+	Tags pixellock.Tags `json:"tags,omitempty"`
+}
+
+// A Catalog is the entries of the encrypted files of a directory.
+type Catalog struct {
+	// Dir is the directory, as Build was last given it, made absolute.
+	Dir string
+
+	entries []Entry // In order of Path
+}
+
+// Open reads the catalog in the database file named name, or returns an
+// empty catalog when there is no such file.
+func Open(name string) (*Catalog, error) {
+	db, err := sqlite.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	c := &Catalog{}
+	if len(db.Tables) == 0 {
+		return c, nil
+	}
+	files, info := db.Table("files"), db.Table("info")
+	switch {
+	case db.ApplicationID != applicationID || files == nil:
+		return nil, fmt.Errorf("%s is not a pixellock catalog", name)
+	case db.UserVersion > schemaVersion:
+		return nil, fmt.Errorf("%s is a catalog of a newer pixellock, of version %d", name, db.UserVersion)
+	}
+	// Saving it would drop any other table
+	for _, t := range db.Tables {
+		if t != files && t != info {
+			return nil, fmt.Errorf("%s has the table %s, which a pixellock catalog does not; drop it, or catalog into another file", name, t.Name)
+		}
+	}
+	if info != nil {
+		for _, row := range info.Rows {
+			if key, value := text(row.Values, 0), text(row.Values, 1); key == "dir" {
+				c.Dir = value
+			}
+		}
+	}
+	for _, row := range files.Rows {
+		v := row.Values
+		e := Entry{
+			Path:           text(v, 0),
+			Name:           text(v, 1),
+			Format:         text(v, 2),
+			Width:          int(integer(v, 3)),
+			Height:         int(integer(v, 4)),
+			Size:           integer(v, 6),
+			ModTime:        time.Unix(0, integer(v, 7)),
+			KeyFingerprint: text(v, 8),
+			SHA256:         text(v, 9),
+		}
+		if tags := text(v, 10); tags != "" {
+			if err := json.Unmarshal([]byte(tags), &e.Tags); err != nil {
+				return nil, fmt.Errorf("%s: bad tags of %s: %w", name, e.Path, err)
+			}
+		}
+		if taken := text(v, 5); taken != "" {
+			if e.Taken, err = time.Parse(takenLayout, taken); err != nil {
+				return nil, fmt.Errorf("%s: bad time taken of %s: %w", name, e.Path, err)
+			}
+		}
+		c.entries = append(c.entries, e)
+	}
+	slices.SortFunc(c.entries, func(a, b Entry) int { return strings.Compare(a.Path, b.Path) })
+	return c, nil
+}
+
+// text returns values[i] when it is text, and "" otherwise.
+func text(values []any, i int) string {
+	if i < len(values) {
+		s, _ := values[i].(string)
+		return s
+	}
+	return ""
+}
+
+// integer returns values[i] when it is an integer, and 0 otherwise.
+func integer(values []any, i int) int64 {
+	if i < len(values) {
+		n, _ := values[i].(int64)
+		return n
+	}
+	return 0
+}
+
+// Save writes the catalog to the database file named name, replacing it.
+func (c *Catalog) Save(name string) error {
+	files := &sqlite.Table{Name: "files", SQL: filesSQL}
+	for i, e := range c.entries {
+		var taken, tags any
+		if !e.Taken.IsZero() {
+			taken = e.Taken.Format(takenLayout)
+		}
+		if len(e.Tags) > 0 {
+			data, _ := json.Marshal(e.Tags)
+			tags = string(data)
+		}
+		files.Rows = append(files.Rows, sqlite.Row{ID: int64(i + 1), Values: []any{
+			e.Path, e.Name, e.Format, e.Width, e.Height, taken, e.Size, e.ModTime.UnixNano(), e.KeyFingerprint, e.SHA256, tags,
+		}})
+	}
+	info := &sqlite.Table{Name: "info", SQL: infoSQL, Rows: []sqlite.Row{{ID: 1, Values: []any{"dir", c.Dir}}}}
+	return sqlite.WriteFile(name, &sqlite.Database{
+		Tables:        []*sqlite.Table{files, info},
+		UserVersion:   schemaVersion,
+		ApplicationID: applicationID,
+	})
+}
+
+// Entries returns the entries of the catalog, in order of their paths.
+func (c *Catalog) Entries() []Entry {
+	return slices.Clone(c.entries)
+}
+
+// Entry returns the entry of the file at path within the directory.
+func (c *Catalog) Entry(path string) (Entry, bool) {
+	i, ok := slices.BinarySearchFunc(c.entries, path, func(e Entry, path string) int { return strings.Compare(e.Path, path) })
+	if !ok {
+		return Entry{}, false
+	}
+	return c.entries[i], true
+}
+
+// Stats are what Build did.
+type Stats struct {
+	Added     int // Files not cataloged before
+	Updated   int // Files that changed since they were cataloged
+	Unchanged int // Files left as they were cataloged
+	Removed   int // Entries of files no longer in the directory
+
+	// Failed is the number of files that could not be cataloged, as
+	// those encrypted with another key cannot, and Failures joins their
+	// errors, each a *pixellock.PathError.
+	Failed   int
+	Failures error
+}
+
+// Build catalogs the encrypted files in dir and its subdirectories,
+// decrypting them with key, and drops the entries of files no longer
+// there. A file whose size and modification time are those it was
+// cataloged with is taken to be unchanged, and not decrypted again. A
+// file that fails to decrypt is left out, and Build goes on to the rest.
+// It returns an error only when the directory cannot be read or ctx is
+// done, when the entries of files not reached are kept.
+func (c *Catalog) Build(ctx context.Context, dir string, key []byte) (Stats, error) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return Stats{}, err
+	}
+	if info, err := os.Stat(abs); err != nil {
+		return Stats{}, err
+	} else if !info.IsDir() {
+		return Stats{}, fmt.Errorf("%s is not a directory", dir)
+	}
+	c.Dir = abs
+	fingerprint := pixellock.KeyFingerprint(key)
+
+	var (
+		mu        sync.Mutex
+		stats     Stats
+		seen      = map[string]bool{}
+		unchanged = map[string]bool{}
+		updated   = map[string]Entry{}
+	)
+	batch := pixellock.BatchProcessor{
+		Source: pixellock.WalkSource(abs, true, isEncrypted),
+		Op:     "catalog",
+		Operation: func(ctx context.Context, name string) (string, error) {
+			rel, err := filepath.Rel(abs, name)
+			if err != nil {
+				return "", err
+			}
+			rel = filepath.ToSlash(rel)
+			mu.Lock()
+			seen[rel] = true
+			old, cataloged := c.Entry(rel)
+			mu.Unlock()
+			info, err := os.Stat(name)
+			if err != nil {
+				return "", err
+			}
+			if cataloged && old.Size == info.Size() && old.ModTime.Equal(info.ModTime()) {
+				mu.Lock()
+				unchanged[rel] = true
+				mu.Unlock()
+				return "", nil
+			}
+
+			e, err := describe(name, info, key)
+			if err != nil {
+				return "", err
+			}
+			e.Path, e.KeyFingerprint = rel, fingerprint
+			mu.Lock()
+			updated[rel] = e
+			mu.Unlock()
+			return "", nil
+		},
+	}
+	results, wait := batch.Run(ctx)
+	for range results {
+	}
+	summary := wait()
+	stats.Failed, stats.Failures = summary.Failed, summary.Failures
+
+	// The entry of a file that changed, and then failed, is dropped, as
+	// is that of a file gone. Unless the walk was cut short, when those
+	// of the files it did not reach are kept.
+	var entries []Entry
+	for _, e := range c.entries {
+		switch _, replaced := updated[e.Path]; {
+		case replaced:
+			stats.Updated++
+		case unchanged[e.Path], !seen[e.Path] && summary.Err != nil:
+			entries = append(entries, e)
+		case !seen[e.Path]:
+			stats.Removed++
+		}
+	}
+	for _, e := range updated {
+		entries = append(entries, e)
+	}
+	stats.Added = len(updated) - stats.Updated
+	stats.Unchanged = len(unchanged)
+	slices.SortFunc(entries, func(a, b Entry) int { return strings.Compare(a.Path, b.Path) })
+	c.entries = entries
+	return stats, summary.Err
+}
+
+// isEncrypted reports whether the file name is one a catalog lists: an
+// encrypted file, by its extension.
+func isEncrypted(name string, info fs.FileInfo) bool {
+	return info.Mode().IsRegular() && strings.HasSuffix(name, pixellock.EncryptedExtension)
+}
+
+// describe decrypts the encrypted file name, of info, with key and returns
+// its entry, with its tags, but for its path and key.
+func describe(name string, info fs.FileInfo, key []byte) (Entry, error) {
+	e := Entry{
+		Name:    strings.TrimSuffix(info.Name(), pixellock.EncryptedExtension),
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+	}
+	image, err := pixellock.InspectDecrypted(name, key)
+	if err != nil {
+		return Entry{}, err
+	}
+	e.Format, e.Width, e.Height, e.Taken = image.Format, image.Size.X, image.Size.Y, image.Taken
+	if e.Tags, err = pixellock.ReadTags(name, key); err != nil {
+		return Entry{}, err
+	}
+	if e.SHA256, err = hashFile(name); err != nil {
+		return Entry{}, err
+	}
+	return e, nil
+}
+
+// hashFile returns the SHA-256 hash, in hex, of the file name.
+func hashFile(name string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
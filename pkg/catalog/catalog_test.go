@@ -0,0 +1,293 @@
+package catalog
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Amul-Thantharate/pixellock/pkg/pixellock"
+	"github.com/Amul-Thantharate/pixellock/pkg/sqlite"
+)
+
+// writePhoto writes a width x height image to name, a JPEG recording that
+// it was taken at taken unless taken is empty, and a PNG when the name
+// says so.
+func writePhoto(t *testing.T, name string, width, height int, taken string) {
+	t.Helper()
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(i * 7)
+	}
+	var buf bytes.Buffer
+	var err error
+	if strings.HasSuffix(name, ".png") {
+		err = png.Encode(&buf, img)
+	} else {
+		err = jpeg.Encode(&buf, img, nil)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	if taken != "" {
+		// A little-endian EXIF block of a DateTime alone
+		exif := binary.LittleEndian.AppendUint32([]byte("II*\x00"), 8)
+		exif = binary.LittleEndian.AppendUint16(exif, 1)
+		exif = binary.LittleEndian.AppendUint16(exif, 306)
+		exif = binary.LittleEndian.AppendUint16(exif, 2)
+		exif = binary.LittleEndian.AppendUint32(exif, 20)
+		exif = binary.LittleEndian.AppendUint32(exif, 26)
+		exif = binary.LittleEndian.AppendUint32(exif, 0)
+		exif = append(exif, taken+"\x00"...)
+		if data, err = pixellock.AttachEXIF(data, "jpeg", exif); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(name, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// encryptPhoto writes a photo as writePhoto does, and encrypts it with key
+// into the same path of dir with .enc added.
+func encryptPhoto(t *testing.T, dir, path string, key []byte, width, height int, taken string) {
+	t.Helper()
+	plain := filepath.Join(t.TempDir(), filepath.Base(path))
+	writePhoto(t, plain, width, height, taken)
+	encrypted := filepath.Join(dir, filepath.FromSlash(path)+pixellock.EncryptedExtension)
+	if err := os.MkdirAll(filepath.Dir(encrypted), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := pixellock.EncryptFile(t.Context(), plain, encrypted, key, true, pixellock.EncryptOptions{}); err != nil {
+		t.Fatalf("EncryptFile of %s failed: %v", path, err)
+	}
+}
+
+// paths returns the paths of entries, or of differences, as kind: path.
+func paths[T Entry | Difference](items []T) string {
+	var out []string
+	for _, item := range items {
+		switch item := any(item).(type) {
+		case Entry:
+			out = append(out, item.Path)
+		case Difference:
+			out = append(out, item.Kind+": "+item.Path)
+		}
+	}
+	return strings.Join(out, ", ")
+}
+
+func TestCatalog(t *testing.T) {
+	dir := t.TempDir()
+	key, _ := pixellock.GenerateRandomKey()
+	other, _ := pixellock.GenerateRandomKey()
+	encryptPhoto(t, dir, "2024/DSC_1042.jpg", key, 40, 30, "2024:03:14 10:00:00")
+	encryptPhoto(t, dir, "2024/DSC_1043.jpg", key, 40, 30, "2024:03:31 23:59:59")
+	encryptPhoto(t, dir, "2024/DSC_2001.jpg", key, 40, 30, "2024:07:01 08:00:00")
+	encryptPhoto(t, dir, "scans/receipt.png", key, 20, 50, "")
+	encryptPhoto(t, dir, "shared/other.jpg", other, 8, 8, "")
+	if err := pixellock.WriteTags(filepath.Join(dir, "2024", "DSC_1043.jpg.enc"), key, pixellock.Tags{"client": "acme"}); err != nil {
+		t.Fatal(err)
+	}
+	db := filepath.Join(t.TempDir(), "catalog.db")
+
+	c, err := Open(db)
+	if err != nil || len(c.Entries()) != 0 {
+		t.Fatalf("Open of a missing catalog gave %d entries, %v", len(c.Entries()), err)
+	}
+	stats, err := c.Build(t.Context(), dir, key)
+	if err != nil {
+		t.Fatalf("Build failed: %v", err)
+	}
+	if stats.Added != 4 || stats.Failed != 1 || !strings.Contains(stats.Failures.Error(), "other.jpg.enc") {
+		t.Errorf("Build gave %+v, want 4 added and other.jpg, of another key, failed", stats)
+	}
+	if err := c.Save(db); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+
+	// The catalog reads back as it was built
+	if c, err = Open(db); err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	e, ok := c.Entry("2024/DSC_1042.jpg.enc")
+	want := Entry{Path: "2024/DSC_1042.jpg.enc", Name: "DSC_1042.jpg", Format: "jpeg", Width: 40, Height: 30,
+		Taken: time.Date(2024, 3, 14, 10, 0, 0, 0, time.UTC), KeyFingerprint: pixellock.KeyFingerprint(key)}
+	info, _ := os.Stat(filepath.Join(dir, "2024", "DSC_1042.jpg.enc"))
+	if !ok || e.Size != info.Size() || !e.ModTime.Equal(info.ModTime()) || len(e.SHA256) != 64 {
+		t.Errorf("entry of DSC_1042 is %+v", e)
+	}
+	e.Size, e.ModTime, e.SHA256 = 0, time.Time{}, ""
+	if got, _ := json.Marshal(e); !bytes.Equal(got, must(json.Marshal(want))) {
+		t.Errorf("entry of DSC_1042 is %s, want %s", got, must(json.Marshal(want)))
+	}
+	if c.Dir != dir {
+		t.Errorf("the catalog is of %s, want %s", c.Dir, dir)
+	}
+	if e, _ := c.Entry("2024/DSC_1043.jpg.enc"); e.Tags["client"] != "acme" {
+		t.Errorf("the entry of DSC_1043 has tags %v", e.Tags)
+	}
+
+	for _, search := range []struct {
+		q    Query
+		want string
+	}{
+		{Query{Name: "dsc_10*"}, "2024/DSC_1042.jpg.enc, 2024/DSC_1043.jpg.enc"},
+		{Query{After: date(t, "2024-03-01"), Before: date(t, "2024-04-01")}, "2024/DSC_1042.jpg.enc, 2024/DSC_1043.jpg.enc"},
+		{Query{Name: "DSC_*", After: date(t, "2024-03-20")}, "2024/DSC_1043.jpg.enc, 2024/DSC_2001.jpg.enc"},
+		{Query{Before: date(t, "2024-03-14 10:00:00")}, ""},
+		{Query{Format: "PNG"}, "scans/receipt.png.enc"},
+		{Query{Tags: pixellock.Tags{"client": "acme"}}, "2024/DSC_1043.jpg.enc"},
+		{Query{Name: "DSC_2*", Tags: pixellock.Tags{"client": ""}}, ""},
+		{Query{}, "2024/DSC_1042.jpg.enc, 2024/DSC_1043.jpg.enc, 2024/DSC_2001.jpg.enc, scans/receipt.png.enc"},
+	} {
+		found, err := c.Search(search.q)
+		if err != nil || paths(found) != search.want {
+			t.Errorf("Search(%+v) found %q, %v; want %q", search.q, paths(found), err, search.want)
+		}
+	}
+	if _, err := c.Search(Query{Name: "DSC_[1"}); err == nil {
+		t.Error("Search with a bad pattern succeeded")
+	}
+
+	// Built again, the files are left alone
+	if stats, err := c.Build(t.Context(), dir, key); err != nil || stats.Unchanged != 4 || stats.Added+stats.Updated+stats.Removed != 0 {
+		t.Errorf("Build of an unchanged directory gave %+v, %v", stats, err)
+	}
+	if diffs, err := c.Verify(t.Context(), dir, false); err != nil || paths(diffs) != "new: shared/other.jpg.enc" {
+		t.Errorf("Verify of an unchanged directory found %q, %v", paths(diffs), err)
+	}
+
+	// Then the tree changes
+	os.Remove(filepath.Join(dir, "2024", "DSC_2001.jpg.enc"))
+	encryptPhoto(t, dir, "2024/DSC_1043.jpg", key, 60, 40, "2024:03:31 23:59:59")
+	encryptPhoto(t, dir, "2025/DSC_0001.jpg", key, 40, 30, "2025:01:01 00:00:00")
+	encryptPhoto(t, dir, "2024/DSC_1042.jpg", other, 40, 30, "2024:03:14 10:00:00")
+	receipt := filepath.Join(dir, "scans", "receipt.png.enc")
+	info, _ = os.Stat(receipt)
+	data, _ := os.ReadFile(receipt)
+	data[len(data)-1] ^= 1
+	os.WriteFile(receipt, data, 0644)
+	os.Chtimes(receipt, info.ModTime(), info.ModTime())
+
+	diffs, err := c.Verify(t.Context(), dir, false)
+	if err != nil {
+		t.Fatalf("Verify failed: %v", err)
+	}
+	if want := "changed: 2024/DSC_1042.jpg.enc, changed: 2024/DSC_1043.jpg.enc, missing: 2024/DSC_2001.jpg.enc, new: 2025/DSC_0001.jpg.enc, changed: scans/receipt.png.enc, new: shared/other.jpg.enc"; paths(diffs) != want {
+		t.Errorf("Verify found %q, want %q", paths(diffs), want)
+	}
+	if diffs, _ := c.Verify(t.Context(), dir, true); strings.Contains(paths(diffs), "receipt") {
+		t.Error("a quick Verify hashed the files")
+	}
+
+	// And the catalog is built again, dropping the file that no longer
+	// decrypts. Build goes by size and modification time, so leaves the
+	// receipt to Verify.
+	stats, err = c.Build(t.Context(), dir, key)
+	if err != nil {
+		t.Fatalf("Build failed: %v", err)
+	}
+	if stats.Added != 1 || stats.Updated != 1 || stats.Removed != 1 || stats.Unchanged != 1 || stats.Failed != 2 {
+		t.Errorf("Build of the changed directory gave %+v", stats)
+	}
+	if e, _ := c.Entry("2024/DSC_1043.jpg.enc"); e.Width != 60 {
+		t.Errorf("the updated entry has width %d, want 60", e.Width)
+	}
+	if diffs, _ := c.Verify(t.Context(), dir, false); paths(diffs) != "new: 2024/DSC_1042.jpg.enc, changed: scans/receipt.png.enc, new: shared/other.jpg.enc" {
+		t.Errorf("Verify after rebuilding found %q", paths(diffs))
+	}
+}
+
+func TestOpenOther(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "other.db")
+	db := &sqlite.Database{Tables: []*sqlite.Table{{Name: "files", SQL: "CREATE TABLE files (x)"}}}
+	if err := sqlite.WriteFile(name, db); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(name); err == nil || !strings.Contains(err.Error(), "not a pixellock catalog") {
+		t.Errorf("Open of another program's database returned %v", err)
+	}
+
+	// A catalog of version 1, without tags, reads as one without any
+	files := &sqlite.Table{Name: "files", SQL: "CREATE TABLE files (path, name, format, width, height, taken, size, mod_time, key_fingerprint, sha256)", Rows: []sqlite.Row{
+		{ID: 1, Values: []any{"a.jpg.enc", "a.jpg", "jpeg", int64(4), int64(3), nil, int64(100), int64(0), "fp", "hash"}},
+	}}
+	db = &sqlite.Database{Tables: []*sqlite.Table{files}, UserVersion: 1, ApplicationID: applicationID}
+	if err := sqlite.WriteFile(name, db); err != nil {
+		t.Fatal(err)
+	}
+	if c, err := Open(name); err != nil || len(c.Entries()) != 1 || c.Entries()[0].Tags != nil {
+		t.Errorf("Open of a version 1 catalog gave %v", err)
+	}
+	// One given a table of another program is refused, not saved without
+	// it
+	db.Tables = append(db.Tables, &sqlite.Table{Name: "notes", SQL: "CREATE TABLE notes (text)"})
+	if err := sqlite.WriteFile(name, db); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(name); err == nil || !strings.Contains(err.Error(), "has the table notes") {
+		t.Errorf("Open of a catalog with another table returned %v", err)
+	}
+	os.WriteFile(name, []byte("not a database"), 0644)
+	if _, err := Open(name); err == nil {
+		t.Error("Open of a text file succeeded")
+	}
+}
+
+func TestSQLite3Query(t *testing.T) {
+	if _, err := exec.LookPath("sqlite3"); err != nil {
+		t.Skip("sqlite3 is not installed")
+	}
+	dir := t.TempDir()
+	key, _ := pixellock.GenerateRandomKey()
+	encryptPhoto(t, dir, "DSC_1042.jpg", key, 40, 30, "2024:03:14 10:00:00")
+	encryptPhoto(t, dir, "DSC_2001.jpg", key, 40, 30, "2024:07:01 08:00:00")
+	if err := pixellock.WriteTags(filepath.Join(dir, "DSC_2001.jpg.enc"), key, pixellock.Tags{"client": "acme"}); err != nil {
+		t.Fatal(err)
+	}
+	c, _ := Open(filepath.Join(dir, "missing.db"))
+	if _, err := c.Build(t.Context(), dir, key); err != nil {
+		t.Fatal(err)
+	}
+	db := filepath.Join(t.TempDir(), "catalog.db")
+	if err := c.Save(db); err != nil {
+		t.Fatal(err)
+	}
+	out, err := exec.Command("sqlite3", db, "SELECT name, width FROM files WHERE taken >= '2024-03-01' AND taken < date('2024-03-01', '+1 month')").CombinedOutput()
+	if got := strings.TrimSpace(string(out)); err != nil || got != "DSC_1042.jpg|40" {
+		t.Errorf("sqlite3 found %q, %v; want DSC_1042.jpg|40", got, err)
+	}
+	out, err = exec.Command("sqlite3", db, "SELECT name FROM files WHERE json_extract(tags, '$.client') = 'acme'").CombinedOutput()
+	if got := strings.TrimSpace(string(out)); err != nil || got != "DSC_2001.jpg" {
+		t.Errorf("sqlite3 found %q, %v; want DSC_2001.jpg", got, err)
+	}
+}
+
+func date(t *testing.T, s string) time.Time {
+	t.Helper()
+	d, err := ParseTime(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func must[T any](v T, err error) T {
+	if err != nil {
+		panic(err)
+	}
+	return v
+}
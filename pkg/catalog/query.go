@@ -0,0 +1,150 @@
+package catalog
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/Amul-Thantharate/pixellock/pkg/pixellock"
+)
+
+// A Query picks the entries of a catalog Search returns. A field left
+// zero picks every entry.
+type Query struct {
+	// Name is a pattern the original name matches, as path.Match takes
+	// it, without regard to case.
+	Name string
+
+	// After and Before bound when the photo was taken: at or after After,
+	// and before Before. An entry without a time taken matches neither.
+	After, Before time.Time
+
+	// Format is the format of the image, such as jpeg.
+	Format string
+
+	// Tags are tags the file has, each with its value, or with any value
+	// when that is empty, as pixellock.Tags.Match takes them.
+	Tags pixellock.Tags
+}
+
+// Search returns the entries q picks, in order of their paths.
+func (c *Catalog) Search(q Query) ([]Entry, error) {
+	pattern := strings.ToLower(q.Name)
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, fmt.Errorf("bad name pattern %q: %w", q.Name, err)
+	}
+	var found []Entry
+	for _, e := range c.entries {
+		if q.Name != "" {
+			if ok, _ := path.Match(pattern, strings.ToLower(e.Name)); !ok {
+				continue
+			}
+		}
+		if !q.After.IsZero() && (e.Taken.IsZero() || e.Taken.Before(q.After)) {
+			continue
+		}
+		if !q.Before.IsZero() && (e.Taken.IsZero() || !e.Taken.Before(q.Before)) {
+			continue
+		}
+		if q.Format != "" && !strings.EqualFold(e.Format, q.Format) {
+			continue
+		}
+		if !e.Tags.Match(q.Tags) {
+			continue
+		}
+		found = append(found, e)
+	}
+	return found, nil
+}
+
+// ParseTime parses a time a photo was taken, given as a date, 2024-03-01,
+// or a date and time, 2024-03-01 14:30:00 or 2024-03-01T14:30:00, in the
+// camera's time as Entry.Taken is.
+func ParseTime(s string) (time.Time, error) {
+	for _, layout := range []string{time.DateOnly, time.DateTime, "2006-01-02T15:04:05"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("bad time %q: give a date, such as 2024-03-01, or a date and time, such as 2024-03-01 14:30:00", s)
+}
+
+// The kinds of Difference.
+const (
+	DiffMissing = "missing" // Cataloged, but not in the directory
+	DiffNew     = "new"     // In the directory, but not cataloged
+	DiffChanged = "changed" // Not as it was cataloged
+)
+
+// A Difference is a file of the directory that does not match the catalog.
+type Difference struct {
+	Path string `json:"path"` // Within the directory, / separated
+	Kind string `json:"kind"`
+
+	// Detail says what changed of a file that did: its size,
+	// modification time or contents.
+	Detail string `json:"detail,omitempty"`
+}
+
+// Verify compares the catalog with the encrypted files in dir, and
+// returns the differences, in order of their paths. The contents of a
+// file whose size and modification time are those cataloged are hashed,
+// unless quick is set, to tell when they changed all the same.
+func (c *Catalog) Verify(ctx context.Context, dir string, quick bool) ([]Difference, error) {
+	var diffs []Difference
+	seen := map[string]bool{}
+	err := filepath.WalkDir(dir, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if !isEncrypted(name, info) {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, name)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		seen[rel] = true
+		e, ok := c.Entry(rel)
+		switch {
+		case !ok:
+			diffs = append(diffs, Difference{Path: rel, Kind: DiffNew})
+		case e.Size != info.Size():
+			diffs = append(diffs, Difference{Path: rel, Kind: DiffChanged, Detail: fmt.Sprintf("size %d, cataloged as %d", info.Size(), e.Size)})
+		case !e.ModTime.Equal(info.ModTime()):
+			diffs = append(diffs, Difference{Path: rel, Kind: DiffChanged, Detail: fmt.Sprintf("modified %s, cataloged as %s", info.ModTime().Format(time.DateTime), e.ModTime.Format(time.DateTime))})
+		case !quick:
+			sum, err := hashFile(name)
+			if err != nil {
+				return err
+			}
+			if sum != e.SHA256 {
+				diffs = append(diffs, Difference{Path: rel, Kind: DiffChanged, Detail: "contents differ, with the same size and modification time"})
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range c.entries {
+		if !seen[e.Path] {
+			diffs = append(diffs, Difference{Path: e.Path, Kind: DiffMissing})
+		}
+	}
+	slices.SortFunc(diffs, func(a, b Difference) int { return strings.Compare(a.Path, b.Path) })
+	return diffs, nil
+}
@@ -0,0 +1,166 @@
+// Package clipboard reads and writes the system clipboard, through the
+// tool each platform has for it: pbcopy and pbpaste on macOS, PowerShell
+// on Windows, and wl-copy and wl-paste, xclip or xsel elsewhere. A host
+// with none of them, or no display, has no clipboard, and ErrUnavailable
+// is returned.
+package clipboard
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// ErrUnavailable is returned when there is no clipboard to use, as on a
+// server with no display.
+var ErrUnavailable = errors.New("clipboard unavailable (headless)")
+
+// A Clipboard holds a text that is copied to it and pasted from it.
+type Clipboard interface {
+	// Read returns the text on the clipboard.
+	Read() (string, error)
+
+	// Write replaces the text on the clipboard with text; an empty text
+	// clears it.
+	Write(text string) error
+}
+
+// Digest returns the SHA-256 of text in hex, by which ClearIfUnchanged
+// recognizes a text without it being kept.
+func Digest(text string) string {
+	sum := sha256.Sum256([]byte(text))
+	return hex.EncodeToString(sum[:])
+}
+
+// ClearIfUnchanged clears cb if the text on it has the Digest digest, and
+// reports whether it did. A text copied there since is left alone.
+func ClearIfUnchanged(cb Clipboard, digest string) (bool, error) {
+	text, err := cb.Read()
+	if err != nil {
+		return false, err
+	}
+	if Digest(text) != digest {
+		return false, nil
+	}
+	if err := cb.Write(""); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Memory is a Clipboard held in memory, for tests. Its zero value is an
+// empty clipboard, and it can be used by several goroutines at once.
+type Memory struct {
+	mu   sync.Mutex
+	text string
+}
+
+func (m *Memory) Read() (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.text, nil
+}
+
+func (m *Memory) Write(text string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.text = text
+	return nil
+}
+
+// command is a Clipboard run by the commands of a tool, which take the
+// text on standard input and give it on standard output.
+type command struct {
+	copy, paste []string
+}
+
+// tools are the clipboard tools tried, on platforms other than macOS and
+// Windows, in order, with the environment variable of the display each
+// needs.
+var tools = []struct {
+	display string
+	command
+}{
+	{"WAYLAND_DISPLAY", command{copy: []string{"wl-copy"}, paste: []string{"wl-paste", "--no-newline"}}},
+	{"DISPLAY", command{copy: []string{"xclip", "-selection", "clipboard", "-in"}, paste: []string{"xclip", "-selection", "clipboard", "-out"}}},
+	{"DISPLAY", command{copy: []string{"xsel", "--clipboard", "--input"}, paste: []string{"xsel", "--clipboard", "--output"}}},
+}
+
+// System returns the clipboard of the system. It returns ErrUnavailable,
+// naming the tools it looked for, when there is none.
+func System() (Clipboard, error) {
+	switch runtime.GOOS {
+	case "darwin":
+		return lookup(command{copy: []string{"pbcopy"}, paste: []string{"pbpaste"}})
+	case "windows":
+		return lookup(command{
+			copy:  []string{"powershell", "-NoProfile", "-Command", "$input | Set-Clipboard"},
+			paste: []string{"powershell", "-NoProfile", "-Command", "Get-Clipboard -Raw"},
+		})
+	}
+	var tried []string
+	for _, tool := range tools {
+		if os.Getenv(tool.display) == "" {
+			continue
+		}
+		if cb, err := lookup(tool.command); err == nil {
+			return cb, nil
+		}
+		tried = append(tried, tool.copy[0])
+	}
+	if len(tried) == 0 {
+		return nil, fmt.Errorf("%w: no display; neither WAYLAND_DISPLAY nor DISPLAY is set", ErrUnavailable)
+	}
+	return nil, fmt.Errorf("%w: none of %s is installed", ErrUnavailable, strings.Join(tried, ", "))
+}
+
+// lookup returns c if its tools are installed.
+func lookup(c command) (Clipboard, error) {
+	for _, name := range []string{c.copy[0], c.paste[0]} {
+		if _, err := exec.LookPath(name); err != nil {
+			return nil, fmt.Errorf("%w: %s is not installed", ErrUnavailable, name)
+		}
+	}
+	return c, nil
+}
+
+func (c command) Read() (string, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command(c.paste[0], c.paste[1:]...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to paste from the clipboard: %s: %w", c.paste[0], toolError(err, &stderr))
+	}
+	if runtime.GOOS == "windows" {
+		out = bytes.TrimSuffix(out, []byte("\r\n"))
+	}
+	return string(out), nil
+}
+
+func (c command) Write(text string) error {
+	var stderr bytes.Buffer
+	cmd := exec.Command(c.copy[0], c.copy[1:]...)
+	cmd.Stdin = strings.NewReader(text)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("failed to copy to the clipboard: %s: %w", c.copy[0], toolError(err, &stderr))
+	}
+	return nil
+}
+
+// toolError returns the failure of a clipboard tool, err, with what it
+// wrote to stderr.
+func toolError(err error, stderr *bytes.Buffer) error {
+	if msg := strings.TrimSpace(stderr.String()); msg != "" {
+		return fmt.Errorf("%w: %s", err, msg)
+	}
+	return err
+}
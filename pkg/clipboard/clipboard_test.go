@@ -0,0 +1,69 @@
+package clipboard
+
+import (
+	"errors"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestClearIfUnchanged(t *testing.T) {
+	cb := &Memory{}
+	cb.Write("secret key")
+	digest := Digest("secret key")
+	if cleared, err := ClearIfUnchanged(cb, digest); !cleared || err != nil {
+		t.Errorf("ClearIfUnchanged = %v, %v; want it cleared", cleared, err)
+	}
+	if text, _ := cb.Read(); text != "" {
+		t.Errorf("clipboard holds %q after clearing", text)
+	}
+
+	// Something copied since is left alone
+	cb.Write("shopping list")
+	if cleared, err := ClearIfUnchanged(cb, digest); cleared || err != nil {
+		t.Errorf("ClearIfUnchanged of other text = %v, %v; want it left", cleared, err)
+	}
+	if text, _ := cb.Read(); text != "shopping list" {
+		t.Errorf("clipboard holds %q, want the text copied since", text)
+	}
+}
+
+func TestSystemHeadless(t *testing.T) {
+	if runtime.GOOS == "darwin" || runtime.GOOS == "windows" {
+		t.Skip("the clipboard of", runtime.GOOS, "needs no display")
+	}
+	t.Setenv("WAYLAND_DISPLAY", "")
+	t.Setenv("DISPLAY", "")
+	if _, err := System(); !errors.Is(err, ErrUnavailable) {
+		t.Errorf("System with no display = %v, want ErrUnavailable", err)
+	}
+
+	// A display without the tools has no clipboard either
+	t.Setenv("DISPLAY", ":0")
+	t.Setenv("PATH", t.TempDir())
+	if _, err := System(); !errors.Is(err, ErrUnavailable) {
+		t.Errorf("System without the tools = %v, want ErrUnavailable", err)
+	}
+}
+
+// TestCommand checks that a command clipboard gives the tools the text on
+// standard input and takes it from their standard output.
+func TestCommand(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs sh")
+	}
+	file := filepath.Join(t.TempDir(), "clipboard")
+	cb := command{copy: []string{"sh", "-c", `cat > "$0"`, file}, paste: []string{"cat", file}}
+	if err := cb.Write("line one\nline two"); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if text, err := cb.Read(); err != nil || text != "line one\nline two" {
+		t.Errorf("Read = %q, %v", text, err)
+	}
+
+	failing := command{copy: []string{"sh", "-c", "echo no display >&2; exit 1"}}
+	if err := failing.Write("text"); err == nil || !strings.Contains(err.Error(), "no display") {
+		t.Errorf("Write with a failing tool = %v, want its message", err)
+	}
+}
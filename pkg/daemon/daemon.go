@@ -0,0 +1,524 @@
+// Package daemon runs pixellock as a long-lived process, which loads its
+// key once and encrypts and decrypts the files it is sent as jobs over a
+// Unix socket.
+//
+// A connection to the socket carries one request, a JSON Request on a
+// line, and is answered with one JSON Response on a line. The commands
+// of a request are:
+//
+//	status  the state of the daemon and of its recent jobs
+//	submit  queue the jobs of the request, answered with their IDs
+//	drain   take no more jobs and, once those queued are done, stop;
+//	        answered when the daemon has stopped
+//
+// Jobs are run by a pool of workers in the order they were submitted.
+// A job is encrypted or decrypted with the key loaded when it was
+// submitted, so that reloading the key does not change the jobs queued
+// or running.
+package daemon
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"runtime"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/Amul-Thantharate/pixellock/pkg/pixellock"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// The commands of a Request.
+const (
+	CommandStatus = "status"
+	CommandSubmit = "submit"
+	CommandDrain  = "drain"
+)
+
+// The operations of a Job.
+const (
+	OpEncrypt = "encrypt"
+	OpDecrypt = "decrypt"
+)
+
+// The states of a Job, and of the daemon: a daemon is StateRunning until
+// it is draining, then StateDraining until its jobs are done.
+const (
+	StateQueued   = "queued"
+	StateRunning  = "running"
+	StateDone     = "done"
+	StateFailed   = "failed"
+	StateDraining = "draining"
+)
+
+// maxFinished bounds the finished jobs Status reports, the oldest of which
+// are forgotten first.
+const maxFinished = 100
+
+// requestTimeout bounds how long a connection has to send its request.
+const requestTimeout = 10 * time.Second
+
+// ErrDraining is the error of a job submitted once the daemon is
+// draining.
+var ErrDraining = errors.New("the daemon is draining and takes no more jobs")
+
+// A Job is a file or directory to encrypt or decrypt.
+type Job struct {
+	// ID is given to the job by the daemon when it is submitted.
+	ID int64 `json:"id,omitempty"`
+
+	// Op is OpEncrypt or OpDecrypt.
+	Op string `json:"op"`
+
+	// Input is the file or directory to encrypt or decrypt, and Output
+	// the file or directory written, as the encrypt and decrypt commands
+	// take them. Relative paths are relative to the daemon's working
+	// directory.
+	Input  string `json:"input"`
+	Output string `json:"output"`
+
+	// Recursive descends into the subdirectories of a directory.
+	Recursive bool `json:"recursive,omitempty"`
+
+	// Overwrite replaces output files that exist, which are otherwise
+	// left alone.
+	Overwrite bool `json:"overwrite,omitempty"`
+
+	// TraceParent is the W3C traceparent of the span the job was
+	// submitted in, which the job's span is started beneath. A job
+	// without one, or with one that does not parse, starts a trace.
+	TraceParent string `json:"traceparent,omitempty"`
+}
+
+// JobStatus is the state of a Job, with why it failed when it did.
+type JobStatus struct {
+	Job
+	State string              `json:"state"`
+	Code  pixellock.ErrorCode `json:"code,omitempty"`
+	Error string              `json:"error,omitempty"`
+}
+
+// Status is the state of a daemon.
+type Status struct {
+	State   string    `json:"state"`
+	Started time.Time `json:"started"`
+
+	// KeyLoaded is when the key was last loaded, at start or by Reload.
+	KeyLoaded time.Time `json:"key_loaded"`
+
+	// The jobs in each state since the daemon started.
+	Queued  int `json:"queued"`
+	Running int `json:"running"`
+	Done    int `json:"done"`
+	Failed  int `json:"failed"`
+
+	// Jobs are those queued and running, and the last finished, in the
+	// order they were submitted.
+	Jobs []JobStatus `json:"jobs"`
+}
+
+// A Request is what a connection asks of the daemon.
+type Request struct {
+	Command string `json:"command"`
+	Jobs    []Job  `json:"jobs,omitempty"`
+}
+
+// A Response answers a Request: with the IDs of the jobs submitted, or the
+// status, or why it failed.
+type Response struct {
+	IDs    []int64             `json:"ids,omitempty"`
+	Status *Status             `json:"status,omitempty"`
+	Code   pixellock.ErrorCode `json:"code,omitempty"`
+	Error  string              `json:"error,omitempty"`
+}
+
+// A Config configures a Daemon.
+type Config struct {
+	// LoadKey returns the key jobs are run with. It is called by New and
+	// again by Reload.
+	LoadKey func() ([]byte, error)
+
+	// Workers is the number of jobs run at once; runtime.NumCPU() when 0.
+	Workers int
+
+	// Logger is given the jobs as they finish; nothing is logged when it
+	// is nil.
+	Logger pixellock.Logger
+
+	// TracerProvider records a span of each job, and of the files it
+	// encrypts or decrypts; the global one of otel.GetTracerProvider when
+	// nil, which traces nothing until otel.SetTracerProvider is called.
+	TracerProvider trace.TracerProvider
+}
+
+// A Daemon runs the jobs submitted to it, until it has drained.
+type Daemon struct {
+	cfg     Config
+	started time.Time
+
+	mu        sync.Mutex
+	cond      *sync.Cond // Signaled when a job is queued or draining starts
+	key       []byte
+	keyLoaded time.Time
+	draining  bool
+	nextID    int64
+	queue     []*job
+	jobs      []*job // Queued, running and the last finished
+	counts    map[string]int
+
+	drained   chan struct{} // Closed once draining and every job is done
+	drainOnce sync.Once
+}
+
+// job is a Job with its state.
+type job struct {
+	JobStatus
+	key []byte
+}
+
+// New returns the Daemon configured by cfg, with its key loaded and its
+// workers waiting for jobs.
+func New(cfg Config) (*Daemon, error) {
+	if cfg.LoadKey == nil {
+		return nil, errors.New("a daemon needs a key")
+	}
+	if cfg.Workers <= 0 {
+		cfg.Workers = runtime.NumCPU()
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = slog.New(slog.DiscardHandler)
+	}
+	if cfg.TracerProvider == nil {
+		cfg.TracerProvider = otel.GetTracerProvider()
+	}
+	d := &Daemon{cfg: cfg, started: time.Now(), counts: map[string]int{}, drained: make(chan struct{})}
+	d.cond = sync.NewCond(&d.mu)
+	if err := d.Reload(); err != nil {
+		return nil, err
+	}
+	for range cfg.Workers {
+		go d.work()
+	}
+	return d, nil
+}
+
+// Reload loads the key again, which the jobs submitted from now on are
+// run with. The jobs queued and running keep the key they were submitted
+// with. When the key fails to load, the one loaded before is kept.
+func (d *Daemon) Reload() error {
+	key, err := d.cfg.LoadKey()
+	if err == nil && len(key) != pixellock.KeySize {
+		err = fmt.Errorf("%w: key must be %d bytes", pixellock.ErrInvalidKeySize, pixellock.KeySize)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to load key: %w", err)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.key, d.keyLoaded = key, time.Now()
+	return nil
+}
+
+// Submit queues jobs, all of them or, when one is invalid or the daemon is
+// draining, none, and returns their IDs.
+func (d *Daemon) Submit(jobs []Job) ([]int64, error) {
+	for i, j := range jobs {
+		if j.Op != OpEncrypt && j.Op != OpDecrypt {
+			return nil, badRequest("job %d: op must be %s or %s, not %q", i, OpEncrypt, OpDecrypt, j.Op)
+		}
+		if j.Input == "" || j.Output == "" {
+			return nil, badRequest("job %d: needs an input and an output", i)
+		}
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.draining {
+		return nil, ErrDraining
+	}
+	var ids []int64
+	for _, j := range jobs {
+		d.nextID++
+		j.ID = d.nextID
+		queued := &job{JobStatus: JobStatus{Job: j, State: StateQueued}, key: d.key}
+		d.queue = append(d.queue, queued)
+		d.jobs = append(d.jobs, queued)
+		d.counts[StateQueued]++
+		ids = append(ids, j.ID)
+	}
+	d.cond.Broadcast()
+	return ids, nil
+}
+
+// Status returns the state of the daemon.
+func (d *Daemon) Status() Status {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	s := Status{
+		State:     StateRunning,
+		Started:   d.started,
+		KeyLoaded: d.keyLoaded,
+		Queued:    d.counts[StateQueued],
+		Running:   d.counts[StateRunning],
+		Done:      d.counts[StateDone],
+		Failed:    d.counts[StateFailed],
+		Jobs:      []JobStatus{},
+	}
+	if d.draining {
+		s.State = StateDraining
+	}
+	for _, j := range d.jobs {
+		s.Jobs = append(s.Jobs, j.JobStatus)
+	}
+	return s
+}
+
+// Drain stops the daemon taking jobs and waits until those queued and
+// running are done, or ctx is done.
+func (d *Daemon) Drain(ctx context.Context) error {
+	d.mu.Lock()
+	if !d.draining {
+		d.draining = true
+		d.cond.Broadcast()
+		d.checkDrained()
+	}
+	d.mu.Unlock()
+	select {
+	case <-d.drained:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Drained returns a channel closed once the daemon has drained.
+func (d *Daemon) Drained() <-chan struct{} {
+	return d.drained
+}
+
+// checkDrained closes drained once the daemon is draining with no job
+// left. d.mu must be held.
+func (d *Daemon) checkDrained() {
+	if d.draining && len(d.queue) == 0 && d.counts[StateRunning] == 0 {
+		d.drainOnce.Do(func() { close(d.drained) })
+	}
+}
+
+// work runs the queued jobs, one at a time, until the daemon has drained.
+func (d *Daemon) work() {
+	for {
+		d.mu.Lock()
+		for len(d.queue) == 0 && !d.draining {
+			d.cond.Wait()
+		}
+		if len(d.queue) == 0 {
+			d.mu.Unlock()
+			return
+		}
+		j := d.queue[0]
+		d.queue = d.queue[1:]
+		d.setState(j, StateRunning)
+		d.mu.Unlock()
+
+		err := d.run(j)
+		if err != nil {
+			d.cfg.Logger.Error("job failed", "id", j.ID, "op", j.Op, "path", j.Input, "err", err)
+		} else {
+			d.cfg.Logger.Info("job done", "id", j.ID, "op", j.Op, "path", j.Input)
+		}
+
+		d.mu.Lock()
+		if err != nil {
+			j.Code, j.Error = pixellock.ErrorCodeOf(err), err.Error()
+			d.setState(j, StateFailed)
+		} else {
+			d.setState(j, StateDone)
+		}
+		d.forget()
+		d.checkDrained()
+		d.mu.Unlock()
+	}
+}
+
+// setState moves j on to state, the finished staying counted. d.mu must
+// be held.
+func (d *Daemon) setState(j *job, state string) {
+	d.counts[j.State]--
+	j.State = state
+	d.counts[state]++
+}
+
+// forget drops the oldest finished jobs beyond maxFinished. d.mu must be
+// held.
+func (d *Daemon) forget() {
+	finished := 0
+	for _, j := range d.jobs {
+		if j.State == StateDone || j.State == StateFailed {
+			finished++
+		}
+	}
+	d.jobs = slices.DeleteFunc(d.jobs, func(j *job) bool {
+		if finished > maxFinished && (j.State == StateDone || j.State == StateFailed) {
+			finished--
+			return true
+		}
+		return false
+	})
+}
+
+// run encrypts or decrypts the file or directory of j.
+func (d *Daemon) run(j *job) (err error) {
+	ctx := propagation.TraceContext{}.Extract(context.Background(), propagation.MapCarrier{"traceparent": j.TraceParent})
+	ctx, span := d.cfg.TracerProvider.Tracer(pixellock.ScopeName).Start(ctx, "job",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			attribute.Int64("pixellock.job.id", j.ID),
+			attribute.String("pixellock.job.op", j.Op),
+			attribute.String(pixellock.AttrInput, j.Input),
+			attribute.String(pixellock.AttrOutput, j.Output),
+		),
+	)
+	defer func() {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}()
+
+	info, err := os.Stat(j.Input)
+	if err != nil {
+		return err
+	}
+	policy := pixellock.OverwriteSkip
+	if j.Overwrite {
+		policy = pixellock.OverwriteReplace
+	}
+	type processor interface {
+		ProcessFile(ctx context.Context, input, output string) error
+		ProcessDir(ctx context.Context, input, output string) error
+	}
+	var p processor
+	if j.Op == OpEncrypt {
+		p, err = pixellock.NewEncryptor(
+			pixellock.WithKey(j.key),
+			pixellock.WithOverwritePolicy(policy),
+			pixellock.WithRecursive(j.Recursive),
+			pixellock.WithLogger(d.cfg.Logger),
+			pixellock.WithTracerProvider(d.cfg.TracerProvider),
+		)
+	} else {
+		p, err = pixellock.NewDecryptor(
+			pixellock.WithKey(j.key),
+			pixellock.WithOverwritePolicy(policy),
+			pixellock.WithRecursive(j.Recursive),
+			pixellock.WithLogger(d.cfg.Logger),
+			pixellock.WithTracerProvider(d.cfg.TracerProvider),
+		)
+	}
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return p.ProcessDir(ctx, j.Input, j.Output)
+	}
+	return p.ProcessFile(ctx, j.Input, j.Output)
+}
+
+// requestError is a failure of a request itself, rather than of a job.
+type requestError struct {
+	msg string
+}
+
+func (e *requestError) Error() string                  { return e.msg }
+func (e *requestError) ErrorCode() pixellock.ErrorCode { return pixellock.CodeBadRequest }
+
+func badRequest(format string, args ...any) error {
+	return &requestError{msg: fmt.Sprintf(format, args...)}
+}
+
+// errorResponse returns the Response of a request that failed with err.
+func errorResponse(err error) Response {
+	code := pixellock.ErrorCodeOf(err)
+	if errors.Is(err, ErrDraining) {
+		code = pixellock.CodeBusy
+	}
+	return Response{Code: code, Error: err.Error()}
+}
+
+// Serve answers the requests of the connections l accepts until the
+// daemon has drained, then closes l and returns once every request has
+// been answered.
+func (d *Daemon) Serve(l net.Listener) error {
+	var conns sync.WaitGroup
+	defer conns.Wait()
+	go func() {
+		<-d.drained
+		l.Close()
+	}()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			select {
+			case <-d.drained:
+				return nil
+			default:
+				return err
+			}
+		}
+		conns.Add(1)
+		go func() {
+			defer conns.Done()
+			defer conn.Close()
+			d.handle(conn)
+		}()
+	}
+}
+
+// handle answers the request of conn.
+func (d *Daemon) handle(conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(requestTimeout))
+	line, err := bufio.NewReader(conn).ReadBytes('\n')
+	if err != nil && len(line) == 0 {
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	var req Request
+	var resp Response
+	if err := json.Unmarshal(line, &req); err != nil {
+		resp = errorResponse(badRequest("bad request: %v", err))
+	} else {
+		resp = d.answer(req)
+	}
+	json.NewEncoder(conn).Encode(resp)
+}
+
+// answer returns the Response to req.
+func (d *Daemon) answer(req Request) Response {
+	switch req.Command {
+	case CommandStatus:
+		status := d.Status()
+		return Response{Status: &status}
+	case CommandSubmit:
+		ids, err := d.Submit(req.Jobs)
+		if err != nil {
+			return errorResponse(err)
+		}
+		return Response{IDs: ids}
+	case CommandDrain:
+		d.Drain(context.Background())
+		status := d.Status()
+		return Response{Status: &status}
+	}
+	return errorResponse(badRequest("unknown command %q", req.Command))
+}
@@ -0,0 +1,288 @@
+package daemon
+
+import (
+	"context"
+	"errors"
+	"image"
+	"image/png"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/Amul-Thantharate/pixellock/pkg/pixellock"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// shortTempDir returns a temporary directory with a path short enough for
+// a Unix socket in it, which t.TempDir's may not be.
+func shortTempDir(t *testing.T) string {
+	t.Helper()
+	dir, err := os.MkdirTemp("", "pxd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+// startDaemon starts a daemon with the key *key, serving on a socket in
+// dir, and returns the socket and a channel given the error Serve returns.
+func startDaemon(t *testing.T, dir string, key *[]byte) (*Daemon, string, <-chan error) {
+	t.Helper()
+	d, err := New(Config{Workers: 2, LoadKey: func() ([]byte, error) { return *key, nil }})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	socket := filepath.Join(dir, "pixellock.sock")
+	l, err := Listen(socket)
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- d.Serve(l) }()
+	t.Cleanup(func() { d.Drain(context.Background()) })
+	return d, socket, served
+}
+
+// waitIdle waits until the daemon on socket has no job queued or running,
+// and returns its status.
+func waitIdle(t *testing.T, socket string) Status {
+	t.Helper()
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		resp, err := Call(t.Context(), socket, Request{Command: CommandStatus})
+		if err != nil {
+			t.Fatalf("status failed: %v", err)
+		}
+		if resp.Status.Queued == 0 && resp.Status.Running == 0 {
+			return *resp.Status
+		}
+	}
+	t.Fatal("the jobs did not finish")
+	return Status{}
+}
+
+func TestDaemon(t *testing.T) {
+	dir := shortTempDir(t)
+	photo := filepath.Join(dir, "photo.png")
+	writePNG(t, photo)
+	key, _ := pixellock.GenerateRandomKey()
+	d, socket, served := startDaemon(t, dir, &key)
+
+	if info, err := os.Stat(socket); err != nil || runtime.GOOS != "windows" && info.Mode().Perm() != SocketMode {
+		t.Errorf("socket has mode %v, %v; want %v", info.Mode(), err, SocketMode)
+	}
+	if _, err := Listen(socket); err == nil {
+		t.Error("Listen on the socket of a running daemon succeeded")
+	}
+
+	encrypted, decrypted := filepath.Join(dir, "photo.png.enc"), filepath.Join(dir, "photo.png")
+	resp, err := Call(t.Context(), socket, Request{Command: CommandSubmit, Jobs: []Job{
+		{Op: OpEncrypt, Input: photo, Output: encrypted},
+		{Op: OpEncrypt, Input: filepath.Join(dir, "missing.png"), Output: filepath.Join(dir, "missing.enc")},
+	}})
+	if err != nil {
+		t.Fatalf("submit failed: %v", err)
+	}
+	if len(resp.IDs) != 2 {
+		t.Errorf("submit gave IDs %v, want 2", resp.IDs)
+	}
+	status := waitIdle(t, socket)
+	if status.State != StateRunning || status.Done != 1 || status.Failed != 1 || len(status.Jobs) != 2 {
+		t.Errorf("status = %+v, want 1 done and 1 failed", status)
+	}
+	if failed := status.Jobs[1]; failed.ID != resp.IDs[1] || failed.State != StateFailed || failed.Error == "" {
+		t.Errorf("the missing input's job is %+v, want it failed", failed)
+	}
+
+	// A job submitted after a reload is run with the key loaded then
+	other, _ := pixellock.GenerateRandomKey()
+	key = other
+	if err := d.Reload(); err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+	os.Remove(photo)
+	if _, err := Call(t.Context(), socket, Request{Command: CommandSubmit, Jobs: []Job{{Op: OpDecrypt, Input: encrypted, Output: decrypted}}}); err != nil {
+		t.Fatalf("submit failed: %v", err)
+	}
+	status = waitIdle(t, socket)
+	if last := status.Jobs[len(status.Jobs)-1]; last.State != StateFailed || last.Code != pixellock.CodeKeyMismatch {
+		t.Errorf("decrypting with the reloaded key gave %+v, want a key mismatch", last)
+	}
+
+	_, err = Call(t.Context(), socket, Request{Command: CommandSubmit, Jobs: []Job{{Op: "shred", Input: photo, Output: photo}}})
+	if pixellock.ErrorCodeOf(err) != pixellock.CodeBadRequest {
+		t.Errorf("submit of an unknown op = %v, want %s", err, pixellock.CodeBadRequest)
+	}
+	if _, err := Call(t.Context(), socket, Request{Command: "restart"}); pixellock.ErrorCodeOf(err) != pixellock.CodeBadRequest {
+		t.Errorf("unknown command = %v, want %s", err, pixellock.CodeBadRequest)
+	}
+
+	resp, err = Call(t.Context(), socket, Request{Command: CommandDrain})
+	if err != nil || resp.Status.State != StateDraining {
+		t.Errorf("drain = %+v, %v", resp.Status, err)
+	}
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Errorf("Serve failed: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Serve did not return once drained")
+	}
+	if _, err := d.Submit([]Job{{Op: OpEncrypt, Input: photo, Output: encrypted}}); !errors.Is(err, ErrDraining) {
+		t.Errorf("Submit once drained = %v, want ErrDraining", err)
+	}
+}
+
+func TestDaemonDrain(t *testing.T) {
+	dir := shortTempDir(t)
+	key, _ := pixellock.GenerateRandomKey()
+	d, socket, _ := startDaemon(t, dir, &key)
+	var jobs []Job
+	for i := range 8 {
+		name := filepath.Join(dir, "photo"+string(rune('a'+i))+".png")
+		writePNG(t, name)
+		jobs = append(jobs, Job{Op: OpEncrypt, Input: name, Output: name + pixellock.EncryptedExtension})
+	}
+	if _, err := Call(t.Context(), socket, Request{Command: CommandSubmit, Jobs: jobs}); err != nil {
+		t.Fatalf("submit failed: %v", err)
+	}
+	// As SIGTERM drains the daemon
+	if err := d.Drain(t.Context()); err != nil {
+		t.Fatalf("Drain failed: %v", err)
+	}
+	if status := d.Status(); status.Done != len(jobs) || status.Queued != 0 || status.Running != 0 {
+		t.Errorf("drained with status %+v, want every job done", status)
+	}
+	for _, j := range jobs {
+		if _, err := os.Stat(j.Output); err != nil {
+			t.Errorf("%s was not encrypted: %v", j.Input, err)
+		}
+	}
+	select {
+	case <-d.Drained():
+	default:
+		t.Error("Drained is not closed")
+	}
+}
+
+func TestDaemonTracing(t *testing.T) {
+	dir := t.TempDir()
+	photo := filepath.Join(dir, "photo.png")
+	writePNG(t, photo)
+	key, _ := pixellock.GenerateRandomKey()
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	d, err := New(Config{Workers: 1, LoadKey: func() ([]byte, error) { return key, nil }, TracerProvider: tp})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	const parent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	_, err = d.Submit([]Job{
+		{Op: OpEncrypt, Input: photo, Output: photo + pixellock.EncryptedExtension, TraceParent: parent},
+		{Op: OpDecrypt, Input: filepath.Join(dir, "missing.png.enc"), Output: filepath.Join(dir, "out.png")},
+	})
+	if err != nil {
+		t.Fatalf("Submit failed: %v", err)
+	}
+	if err := d.Drain(t.Context()); err != nil {
+		t.Fatalf("Drain failed: %v", err)
+	}
+
+	jobs := map[int64]tracetest.SpanStub{}
+	parents := map[trace.SpanID]string{}
+	for _, span := range exporter.GetSpans() {
+		if span.Name == "job" {
+			for _, kv := range span.Attributes {
+				if kv.Key == "pixellock.job.id" {
+					jobs[kv.Value.AsInt64()] = span
+				}
+			}
+		}
+		parents[span.Parent.SpanID()] = span.Name
+	}
+	if len(jobs) != 2 {
+		t.Fatalf("%d job spans, want 2", len(jobs))
+	}
+	if encrypt := jobs[1]; encrypt.SpanContext.TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" || encrypt.Parent.SpanID().String() != "00f067aa0ba902b7" || encrypt.SpanKind != trace.SpanKindConsumer {
+		t.Errorf("the job is not beneath its traceparent: %+v", encrypt)
+	}
+	if name := parents[jobs[1].SpanContext.SpanID()]; name != pixellock.SpanEncryptFile {
+		t.Errorf("the span beneath the encrypt job is %q, want %s", name, pixellock.SpanEncryptFile)
+	}
+	if failed := jobs[2]; failed.Parent.IsValid() || failed.Status.Code != codes.Error {
+		t.Errorf("the failed job without a traceparent has span %+v", failed)
+	}
+}
+
+func TestListenStale(t *testing.T) {
+	dir := shortTempDir(t)
+	socket := filepath.Join(dir, "pixellock.sock")
+	l, err := Listen(socket)
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	// Left behind, as by a daemon that was killed
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+	l, err = Listen(socket)
+	if err != nil {
+		t.Fatalf("Listen over a stale socket failed: %v", err)
+	}
+	l.Close()
+
+	file := filepath.Join(dir, "file")
+	os.WriteFile(file, nil, 0o600)
+	if _, err := Listen(file); err == nil {
+		t.Error("Listen over a file succeeded")
+	}
+}
+
+func TestNotify(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no unixgram sockets")
+	}
+	socket := filepath.Join(shortTempDir(t), "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("ListenUnixgram failed: %v", err)
+	}
+	defer conn.Close()
+	t.Setenv("NOTIFY_SOCKET", socket)
+	if err := Notify("READY=1"); err != nil {
+		t.Fatalf("Notify failed: %v", err)
+	}
+	buf := make([]byte, 64)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := conn.Read(buf)
+	if err != nil || string(buf[:n]) != "READY=1" {
+		t.Errorf("the service manager got %q, %v", buf[:n], err)
+	}
+
+	t.Setenv("NOTIFY_SOCKET", "")
+	if err := Notify("READY=1"); err != nil {
+		t.Errorf("Notify without a service manager = %v", err)
+	}
+}
+
+// writePNG writes a small PNG to name.
+func writePNG(t *testing.T, name string) {
+	t.Helper()
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, fs.FileMode(0o644))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	img := image.NewRGBA(image.Rect(0, 0, 8, 8))
+	img.Pix[0] = 200
+	if err := png.Encode(f, img); err != nil {
+		t.Fatal(err)
+	}
+}
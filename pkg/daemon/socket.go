@@ -0,0 +1,120 @@
+package daemon
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Amul-Thantharate/pixellock/pkg/pixellock"
+)
+
+// SocketMode is the permissions of the socket Listen creates: its owner
+// alone may connect.
+const SocketMode fs.FileMode = 0o600
+
+// Listen listens on the Unix socket at path, readable and writable by its
+// owner alone. A socket left at path by a daemon that has stopped is
+// replaced, but one that a daemon still listens on is not, nor is any
+// other file.
+func Listen(path string) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode().Type() != fs.ModeSocket {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("a daemon is already listening on %s", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	var l net.Listener
+	err := withUmask(0o777&^int(SocketMode), func() (err error) {
+		l, err = net.Listen("unix", path)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, SocketMode); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// Call sends req to the daemon listening on the socket at path, and
+// returns its response. A response carrying an error is returned with it
+// as a *ResponseError.
+func Call(ctx context.Context, path string, req Request) (Response, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "unix", path)
+	if err != nil {
+		return Response{}, fmt.Errorf("no daemon on %s: %w", path, err)
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return Response{}, err
+	}
+	var resp Response
+	line, err := bufio.NewReader(conn).ReadBytes('\n')
+	if err == nil {
+		err = json.Unmarshal(line, &resp)
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			return Response{}, ctx.Err()
+		}
+		return Response{}, fmt.Errorf("bad response from the daemon: %w", err)
+	}
+	if resp.Error != "" {
+		return resp, &ResponseError{Response: resp}
+	}
+	return resp, nil
+}
+
+// A ResponseError is a Response carrying the error of a request.
+type ResponseError struct {
+	Response
+}
+
+func (e *ResponseError) Error() string { return e.Response.Error }
+
+// ErrorCode returns the code of the error, for pixellock.ErrorCodeOf.
+func (e *ResponseError) ErrorCode() pixellock.ErrorCode { return e.Code }
+
+// Notify sends state, such as "READY=1", to the service manager that
+// started the process, as sd_notify(3) does, when NOTIFY_SOCKET names its
+// socket; it does nothing otherwise.
+func Notify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	if name, ok := strings.CutPrefix(socket, "@"); ok {
+		// An abstract socket
+		socket = "\x00" + name
+	} else if !strings.HasPrefix(socket, "/") {
+		return errors.New("NOTIFY_SOCKET is not a Unix socket")
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return fmt.Errorf("failed to notify the service manager: %w", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return fmt.Errorf("failed to notify the service manager: %w", err)
+	}
+	return nil
+}
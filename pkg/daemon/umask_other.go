@@ -0,0 +1,8 @@
+//go:build !unix
+
+package daemon
+
+// withUmask calls fn, there being no umask on this platform.
+func withUmask(mask int, fn func() error) error {
+	return fn()
+}
@@ -0,0 +1,15 @@
+//go:build unix
+
+package daemon
+
+import "syscall"
+
+// withUmask calls fn with the umask of the process set to mask, so that
+// the files fn creates are never more open than mask allows, and restores
+// it after. The umask is the process's, so files created at once by other
+// goroutines get it too.
+func withUmask(mask int, fn func() error) error {
+	old := syscall.Umask(mask)
+	defer syscall.Umask(old)
+	return fn()
+}
@@ -0,0 +1,421 @@
+// Package gallery serves a directory of encrypted images to a browser,
+// decrypted in memory as they are asked for, so that no image is ever
+// written to disk unencrypted.
+//
+// The pages are:
+//
+//	GET /                the index of the directory
+//	GET /dir/{path}      the index of a directory below it
+//	GET /image/{path}    an image, decrypted, with Range requests served
+//	GET /thumb/{path}    a JPEG thumbnail of an image
+//
+// Images and directories are named as pixellock.DecryptedFS shows them:
+// without the encrypted extension, and with that of the image's format
+// added when the name has another. Requests may need a password, with
+// HTTP basic authentication, or a token.
+package gallery
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"errors"
+	"html/template"
+	"image"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Amul-Thantharate/pixellock/pkg/pixellock"
+)
+
+// DefaultThumbnailCacheEntries is the number of thumbnails a Gallery keeps
+// when Config.ThumbnailCacheEntries is 0.
+const DefaultThumbnailCacheEntries = 1024
+
+// TokenParam is the query parameter a token may be given in, once, by a
+// link to the gallery; the browser is then given it as the cookie
+// TokenCookie, to be sent with the requests that follow.
+const (
+	TokenParam  = "token"
+	TokenCookie = "pixellock_gallery"
+)
+
+// readHeaderTimeout bounds how long ListenAndServe waits for the headers
+// of a request, and shutdownTimeout how long it lets the requests being
+// handled finish once it is done.
+const (
+	readHeaderTimeout = 10 * time.Second
+	shutdownTimeout   = 30 * time.Second
+)
+
+// A Config configures a Gallery.
+type Config struct {
+	// Dir is the directory of encrypted images, read from FS, the
+	// operating system's filesystem when nil.
+	Dir string
+	FS  pixellock.FileSystem
+
+	// Key is the key the images are decrypted with.
+	Key []byte
+
+	// CacheSize bounds the bytes of decrypted images kept in memory, as
+	// pixellock.DecryptedFSOptions.CacheSize does.
+	CacheSize int64
+
+	// ThumbnailSize is the longer side of thumbnails, in pixels;
+	// pixellock.DefaultThumbnailSize when 0. ThumbnailCacheEntries is the
+	// number kept in memory, the least recently shown dropped first;
+	// DefaultThumbnailCacheEntries when 0.
+	ThumbnailSize         int
+	ThumbnailCacheEntries int
+
+	// Username and Password, when set, are asked for with HTTP basic
+	// authentication. Token, when set, is taken as well, as a bearer token
+	// in the Authorization header, in TokenParam or in TokenCookie. With
+	// neither, anyone reaching the gallery can see the images.
+	Username, Password string
+	Token              string
+
+	// Logger is given the images that fail to decrypt; nothing is logged
+	// when it is nil.
+	Logger pixellock.Logger
+}
+
+// A Gallery is the http.Handler of the pages of a directory of encrypted
+// images. It can serve several requests at once.
+type Gallery struct {
+	cfg    Config
+	fsys   *pixellock.DecryptedFS
+	thumbs *thumbCache
+	mux    *http.ServeMux
+}
+
+// New returns the Gallery configured by cfg.
+func New(cfg Config) (*Gallery, error) {
+	if (cfg.Username == "") != (cfg.Password == "") {
+		return nil, errors.New("basic authentication needs both a username and a password")
+	}
+	if cfg.ThumbnailSize == 0 {
+		cfg.ThumbnailSize = pixellock.DefaultThumbnailSize
+	}
+	if err := pixellock.CheckThumbnailSize(cfg.ThumbnailSize); err != nil {
+		return nil, err
+	}
+	if cfg.ThumbnailCacheEntries <= 0 {
+		cfg.ThumbnailCacheEntries = DefaultThumbnailCacheEntries
+	}
+	fsys, err := pixellock.NewDecryptedFS(cfg.Dir, cfg.Key, pixellock.DecryptedFSOptions{FS: cfg.FS, CacheSize: cfg.CacheSize, Logger: cfg.Logger})
+	if err != nil {
+		return nil, err
+	}
+	g := &Gallery{cfg: cfg, fsys: fsys, thumbs: newThumbCache(cfg.ThumbnailCacheEntries), mux: http.NewServeMux()}
+	g.mux.HandleFunc("GET /{$}", g.index)
+	g.mux.HandleFunc("GET /dir/{path...}", g.index)
+	g.mux.HandleFunc("GET /image/{path...}", g.image)
+	g.mux.HandleFunc("GET /thumb/{path...}", g.thumbnail)
+	return g, nil
+}
+
+// ServeHTTP serves the request r, once it is authenticated.
+func (g *Gallery) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Decrypted images are kept out of the browser's cache on disk
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if !g.authenticate(w, r) {
+		return
+	}
+	g.mux.ServeHTTP(w, r)
+}
+
+// equal reports whether a and b are equal, taking the same time whatever
+// they hold.
+func equal(a, b string) bool {
+	ha, hb := sha256.Sum256([]byte(a)), sha256.Sum256([]byte(b))
+	return subtle.ConstantTimeCompare(ha[:], hb[:]) == 1
+}
+
+// authenticate reports whether r may be served, answering it when it may
+// not. A request giving the token in TokenParam is answered with a
+// redirect to its URL without it, setting TokenCookie.
+func (g *Gallery) authenticate(w http.ResponseWriter, r *http.Request) bool {
+	if g.cfg.Token != "" {
+		if bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok && equal(bearer, g.cfg.Token) {
+			return true
+		}
+		if c, err := r.Cookie(TokenCookie); err == nil && equal(c.Value, g.cfg.Token) {
+			return true
+		}
+		query := r.URL.Query()
+		if query.Has(TokenParam) && equal(query.Get(TokenParam), g.cfg.Token) {
+			http.SetCookie(w, &http.Cookie{
+				Name: TokenCookie, Value: g.cfg.Token, Path: "/",
+				HttpOnly: true, Secure: r.TLS != nil, SameSite: http.SameSiteStrictMode,
+			})
+			query.Del(TokenParam)
+			u := *r.URL
+			u.RawQuery = query.Encode()
+			http.Redirect(w, r, u.RequestURI(), http.StatusSeeOther)
+			return false
+		}
+	}
+	if g.cfg.Username != "" {
+		if user, password, ok := r.BasicAuth(); ok && equal(user, g.cfg.Username) && equal(password, g.cfg.Password) {
+			return true
+		}
+		w.Header().Set("WWW-Authenticate", `Basic realm="pixellock gallery", charset="UTF-8"`)
+	}
+	if g.cfg.Token == "" && g.cfg.Username == "" {
+		return true
+	}
+	http.Error(w, "authentication required", http.StatusUnauthorized)
+	return false
+}
+
+// requestPath returns the path of the image or directory r asks for, in
+// the gallery's filesystem, or "." for the top directory.
+func requestPath(r *http.Request) (string, bool) {
+	p := strings.TrimSuffix(r.PathValue("path"), "/")
+	if p == "" {
+		return ".", true
+	}
+	return p, fs.ValidPath(p)
+}
+
+// link returns the URL of the page of name under prefix.
+func link(prefix, name string) string {
+	return (&url.URL{Path: prefix + name}).EscapedPath()
+}
+
+// fail answers r with err, logging it when it is no fault of the client's.
+func (g *Gallery) fail(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, fs.ErrNotExist) || errors.Is(err, fs.ErrInvalid) {
+		http.NotFound(w, r)
+		return
+	}
+	if g.cfg.Logger != nil {
+		g.cfg.Logger.Error("request failed", "path", r.URL.Path, "err", err)
+	}
+	status := http.StatusInternalServerError
+	if pixellock.ErrorCodeOf(err) == pixellock.CodeKeyMismatch {
+		status = http.StatusUnprocessableEntity
+	}
+	http.Error(w, "failed to decrypt: "+string(pixellock.ErrorCodeOf(err)), status)
+}
+
+// An entry is a directory or image on an index page.
+type entry struct {
+	Name, URL, Thumb string
+}
+
+var indexTemplate = template.Must(template.New("index").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Title}}</title>
+<style>
+body { font-family: sans-serif; margin: 1em; background: #f4f4f4; }
+ul { list-style: none; padding: 0; }
+.grid { display: grid; grid-template-columns: repeat(auto-fill, minmax({{.Size}}px, 1fr)); gap: 1em; }
+.grid a { display: flex; flex-direction: column; align-items: center; color: inherit; text-decoration: none; }
+.grid img { max-width: {{.Size}}px; max-height: {{.Size}}px; background: #fff; }
+.grid span { font-size: small; word-break: break-all; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<ul>
+{{if .Parent}}<li><a href="{{.Parent}}">..</a></li>{{end}}
+{{range .Dirs}}<li><a href="{{.URL}}">{{.Name}}/</a></li>
+{{end}}</ul>
+<div class="grid">
+{{range .Images}}<a href="{{.URL}}"><img src="{{.Thumb}}" alt="{{.Name}}" loading="lazy"><span>{{.Name}}</span></a>
+{{end}}</div>
+</body>
+</html>
+`))
+
+// index serves the index of a directory: its directories, and the
+// thumbnails of its images, each linking to the image.
+func (g *Gallery) index(w http.ResponseWriter, r *http.Request) {
+	dir, ok := requestPath(r)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	entries, err := fs.ReadDir(g.fsys, dir)
+	if err != nil {
+		g.fail(w, r, err)
+		return
+	}
+	page := struct {
+		Title, Parent string
+		Size          int
+		Dirs, Images  []entry
+	}{Title: "/", Size: g.cfg.ThumbnailSize}
+	prefix := ""
+	if dir != "." {
+		page.Title, prefix = "/"+dir, dir+"/"
+		page.Parent = "/"
+		if parent := path.Dir(dir); parent != "." {
+			page.Parent = link("/dir/", parent)
+		}
+	}
+	for _, e := range entries {
+		p := prefix + e.Name()
+		if e.IsDir() {
+			page.Dirs = append(page.Dirs, entry{Name: e.Name(), URL: link("/dir/", p)})
+		} else {
+			page.Images = append(page.Images, entry{Name: e.Name(), URL: link("/image/", p), Thumb: link("/thumb/", p)})
+		}
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := indexTemplate.Execute(w, page); err != nil && g.cfg.Logger != nil {
+		g.cfg.Logger.Error("failed to write index", "path", r.URL.Path, "err", err)
+	}
+}
+
+// contentType returns the MIME type of the decrypted image data, by the
+// format it was encrypted in.
+func contentType(data []byte) string {
+	if _, format, err := image.DecodeConfig(bytes.NewReader(data)); err == nil {
+		return pixellock.ImageMIMEType(format)
+	}
+	if pixellock.IsHEIFData(data) {
+		return pixellock.ImageMIMEType("heif")
+	}
+	return http.DetectContentType(data)
+}
+
+// read returns the path, information and decrypted data of the image r
+// asks for, or answers r and returns false when it cannot.
+func (g *Gallery) read(w http.ResponseWriter, r *http.Request) (string, fs.FileInfo, []byte, bool) {
+	name, ok := requestPath(r)
+	if !ok || name == "." {
+		http.NotFound(w, r)
+		return "", nil, nil, false
+	}
+	info, err := g.fsys.Stat(name)
+	if err == nil && info.IsDir() {
+		err = fs.ErrNotExist
+	}
+	var data []byte
+	if err == nil {
+		data, err = fs.ReadFile(g.fsys, name)
+	}
+	if err != nil {
+		g.fail(w, r, err)
+		return "", nil, nil, false
+	}
+	return name, info, data, true
+}
+
+// image serves an image, decrypted, in the format it was encrypted in.
+func (g *Gallery) image(w http.ResponseWriter, r *http.Request) {
+	name, info, data, ok := g.read(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", contentType(data))
+	// ServeContent answers Range and conditional requests
+	http.ServeContent(w, r, path.Base(name), info.ModTime(), bytes.NewReader(data))
+}
+
+// thumbnail serves the thumbnail of an image, made the first time it is
+// asked for and kept.
+func (g *Gallery) thumbnail(w http.ResponseWriter, r *http.Request) {
+	name, _ := requestPath(r)
+	thumb, ok := g.thumbs.get(name)
+	if !ok {
+		_, _, data, ok := g.read(w, r)
+		if !ok {
+			return
+		}
+		var err error
+		if thumb, err = pixellock.MakeThumbnail(data, g.cfg.ThumbnailSize); err != nil {
+			http.Error(w, "no thumbnail: "+err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		g.thumbs.add(name, thumb)
+	}
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Write(thumb)
+}
+
+// A thumbCache keeps a number of thumbnails, dropping the least recently
+// used first.
+type thumbCache struct {
+	mu      sync.Mutex
+	limit   int
+	order   *list.List // Of *cachedThumb, the most recently used first
+	entries map[string]*list.Element
+	made    int // Thumbnails added, for tests
+}
+
+type cachedThumb struct {
+	name string
+	data []byte
+}
+
+func newThumbCache(limit int) *thumbCache {
+	return &thumbCache{limit: limit, order: list.New(), entries: map[string]*list.Element{}}
+}
+
+func (c *thumbCache) get(name string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[name]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(e)
+	return e.Value.(*cachedThumb).data, true
+}
+
+// add keeps data as the thumbnail of name, dropping the least recently
+// used beyond the limit.
+func (c *thumbCache) add(name string, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.made++
+	if e, ok := c.entries[name]; ok {
+		e.Value.(*cachedThumb).data = data
+		c.order.MoveToFront(e)
+		return
+	}
+	c.entries[name] = c.order.PushFront(&cachedThumb{name: name, data: data})
+	for c.order.Len() > c.limit {
+		dropped := c.order.Remove(c.order.Back()).(*cachedThumb)
+		delete(c.entries, dropped.name)
+	}
+}
+
+// ListenAndServe serves g on addr, with TLS when config is not nil, until
+// ctx is done, then lets the requests being handled finish.
+func ListenAndServe(ctx context.Context, addr string, g *Gallery, config *tls.Config) error {
+	srv := &http.Server{Addr: addr, Handler: g, ReadHeaderTimeout: readHeaderTimeout, TLSConfig: config}
+	errc := make(chan error, 1)
+	go func() {
+		if config != nil {
+			errc <- srv.ListenAndServeTLS("", "")
+		} else {
+			errc <- srv.ListenAndServe()
+		}
+	}()
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+	shutdown, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	return srv.Shutdown(shutdown)
+}
@@ -0,0 +1,248 @@
+package gallery
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"image"
+	"image/png"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Amul-Thantharate/pixellock/pkg/pixellock"
+)
+
+// galleryFixture encrypts PNGs with key into a new directory, and returns
+// it and the PNG of each name they are shown under: photo.png,
+// trip/day.png, and scan.jpg.png for scan.jpg, whose name is not its
+// format. broken.png is encrypted with another key.
+func galleryFixture(t *testing.T, key []byte) (string, map[string][]byte) {
+	t.Helper()
+	dir := t.TempDir()
+	other, _ := pixellock.GenerateRandomKey()
+	images := map[string][]byte{}
+	for i, name := range []string{"photo.png", "trip/day.png", "scan.jpg", "broken.png"} {
+		img := image.NewNRGBA(image.Rect(0, 0, 40, 30))
+		for p := range img.Pix {
+			img.Pix[p] = byte(p*7 + i)
+		}
+		var plain, encrypted bytes.Buffer
+		png.Encode(&plain, img)
+		k := key
+		if name == "broken.png" {
+			k = other
+		}
+		if err := pixellock.EncryptImage(t.Context(), k, &encrypted, bytes.NewReader(plain.Bytes())); err != nil {
+			t.Fatal(err)
+		}
+		file := filepath.Join(dir, filepath.FromSlash(name)+pixellock.EncryptedExtension)
+		os.MkdirAll(filepath.Dir(file), 0o755)
+		if err := os.WriteFile(file, encrypted.Bytes(), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if filepath.Ext(name) != ".png" {
+			name += ".png"
+		}
+		images[name] = plain.Bytes()
+	}
+	return dir, images
+}
+
+// get requests path from g with the headers of header, as name:value.
+func get(g *Gallery, path string, header ...string) *http.Response {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	for _, h := range header {
+		name, value, _ := strings.Cut(h, ":")
+		req.Header.Set(name, value)
+	}
+	w := httptest.NewRecorder()
+	g.ServeHTTP(w, req)
+	return w.Result()
+}
+
+func body(resp *http.Response) string {
+	data, _ := io.ReadAll(resp.Body)
+	return string(data)
+}
+
+// samePixels reports whether the PNGs a and b hold the same pixels.
+func samePixels(t *testing.T, a string, b []byte) bool {
+	t.Helper()
+	imgA, errA := png.Decode(strings.NewReader(a))
+	imgB, errB := png.Decode(bytes.NewReader(b))
+	if errA != nil || errB != nil {
+		return false
+	}
+	return bytes.Equal(imgA.(*image.NRGBA).Pix, imgB.(*image.NRGBA).Pix)
+}
+
+func TestGallery(t *testing.T) {
+	key, _ := pixellock.GenerateRandomKey()
+	dir, images := galleryFixture(t, key)
+	// Anything written to the temporary directory from here on is caught
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+
+	g, err := New(Config{Dir: dir, Key: key, Token: "s3cret"})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	auth := "Authorization:Bearer s3cret"
+
+	resp := get(g, "/", auth)
+	index := body(resp)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/html; charset=utf-8" {
+		t.Fatalf("index = %s, %s", resp.Status, resp.Header.Get("Content-Type"))
+	}
+	for _, want := range []string{`href="/dir/trip"`, `src="/thumb/photo.png"`, `href="/image/scan.jpg.png"`} {
+		if !strings.Contains(index, want) {
+			t.Errorf("the index has no %s:\n%s", want, index)
+		}
+	}
+	if resp := get(g, "/dir/trip", auth); !strings.Contains(body(resp), `src="/thumb/trip/day.png"`) {
+		t.Errorf("the index of trip = %s", resp.Status)
+	}
+
+	for name, data := range images {
+		if name == "broken.png" {
+			continue
+		}
+		resp := get(g, "/image/"+name, auth)
+		if !samePixels(t, body(resp), data) || resp.Header.Get("Content-Type") != "image/png" {
+			t.Errorf("%s served as %s, not the PNG encrypted", name, resp.Header.Get("Content-Type"))
+		}
+		if resp.Header.Get("Cache-Control") != "no-store" {
+			t.Errorf("%s may be cached by the browser", name)
+		}
+	}
+	resp = get(g, "/image/photo.png", auth, "Range:bytes=1-3")
+	if got := body(resp); resp.StatusCode != http.StatusPartialContent || got != "PNG" {
+		t.Errorf("range of photo.png = %s %q, want 206 PNG", resp.Status, got)
+	}
+	if resp := get(g, "/image/broken.png", auth); resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("image with another key = %s, want 422", resp.Status)
+	}
+	for _, path := range []string{"/image/missing.png", "/image/trip", "/thumb/trip"} {
+		if resp := get(g, path, auth); resp.StatusCode != http.StatusNotFound {
+			t.Errorf("%s = %s, want 404", path, resp.Status)
+		}
+	}
+
+	entries, _ := os.ReadDir(tmp)
+	if len(entries) != 0 {
+		t.Errorf("files written to the temporary directory: %v", entries)
+	}
+}
+
+func TestGalleryAuth(t *testing.T) {
+	key, _ := pixellock.GenerateRandomKey()
+	dir, _ := galleryFixture(t, key)
+	g, err := New(Config{Dir: dir, Key: key, Username: "me", Password: "pw", Token: "s3cret"})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	for _, path := range []string{"/", "/image/photo.png", "/thumb/photo.png"} {
+		resp := get(g, path)
+		if resp.StatusCode != http.StatusUnauthorized || resp.Header.Get("WWW-Authenticate") == "" {
+			t.Errorf("%s without credentials = %s", path, resp.Status)
+		}
+	}
+	req := httptest.NewRequest(http.MethodGet, "/image/photo.png", nil)
+	req.SetBasicAuth("me", "wrong")
+	w := httptest.NewRecorder()
+	g.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("a wrong password = %d, want 401", w.Code)
+	}
+	req.SetBasicAuth("me", "pw")
+	w = httptest.NewRecorder()
+	g.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("basic authentication = %d, want 200", w.Code)
+	}
+	if resp := get(g, "/", "Authorization:Bearer guess"); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("a wrong token = %s, want 401", resp.Status)
+	}
+
+	// A token in a link is swapped for a cookie
+	resp := get(g, "/dir/trip?token=s3cret")
+	if resp.StatusCode != http.StatusSeeOther || resp.Header.Get("Location") != "/dir/trip" {
+		t.Fatalf("token link = %s to %q", resp.Status, resp.Header.Get("Location"))
+	}
+	cookies := resp.Cookies()
+	if len(cookies) != 1 || cookies[0].Name != TokenCookie || !cookies[0].HttpOnly {
+		t.Fatalf("token link set cookies %v", cookies)
+	}
+	if resp := get(g, "/dir/trip", "Cookie:"+cookies[0].String()); resp.StatusCode != http.StatusOK {
+		t.Errorf("with the cookie = %s, want 200", resp.Status)
+	}
+
+	if _, err := New(Config{Dir: dir, Key: key, Username: "me"}); err == nil {
+		t.Error("New with a username and no password succeeded")
+	}
+}
+
+func TestThumbnailCache(t *testing.T) {
+	key, _ := pixellock.GenerateRandomKey()
+	dir, _ := galleryFixture(t, key)
+	g, err := New(Config{Dir: dir, Key: key, ThumbnailSize: 16, ThumbnailCacheEntries: 2})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	thumb := func(name string) {
+		t.Helper()
+		resp := get(g, "/thumb/"+name)
+		img, format, err := image.Decode(resp.Body)
+		if err != nil || format != "jpeg" || img.Bounds().Dx() != 16 {
+			t.Fatalf("thumbnail of %s = %s, %s, %v", name, resp.Status, format, err)
+		}
+	}
+	thumb("photo.png")
+	thumb("photo.png")
+	if g.thumbs.made != 1 {
+		t.Errorf("made %d thumbnails of one image shown twice, want 1", g.thumbs.made)
+	}
+	// The least recently shown is dropped for a third
+	thumb("trip/day.png")
+	thumb("photo.png")
+	thumb("scan.jpg.png")
+	thumb("photo.png")
+	thumb("trip/day.png")
+	if g.thumbs.made != 4 {
+		t.Errorf("made %d thumbnails, want 4", g.thumbs.made)
+	}
+	if resp := get(g, "/thumb/broken.png"); resp.StatusCode == http.StatusOK {
+		t.Error("thumbnail of an image with another key served")
+	}
+}
+
+func TestSelfSignedTLS(t *testing.T) {
+	config, fingerprint, err := SelfSignedTLS([]string{"127.0.0.1", "gallery.local"})
+	if err != nil {
+		t.Fatalf("SelfSignedTLS failed: %v", err)
+	}
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.TLS = config
+	srv.StartTLS()
+	defer srv.Close()
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	resp, err := client.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	resp.Body.Close()
+	cert := resp.TLS.PeerCertificates[0]
+	sum := sha256.Sum256(cert.Raw)
+	if hex.EncodeToString(sum[:]) != fingerprint {
+		t.Errorf("fingerprint %s is not of the certificate served", fingerprint)
+	}
+	if cert.VerifyHostname("gallery.local") != nil || cert.VerifyHostname("127.0.0.1") != nil {
+		t.Errorf("the certificate is for %v %v", cert.DNSNames, cert.IPAddresses)
+	}
+}
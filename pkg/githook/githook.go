@@ -0,0 +1,226 @@
+// Package githook keeps unencrypted images out of a Git repository that
+// should hold only encrypted files. It finds the images staged for commit,
+// or tracked, that are not allowlisted, encrypts them in their place, and
+// installs the pre-commit hook that refuses them.
+//
+// It runs the git command, which must be installed, so that the index is
+// read as Git itself reads it, within a hook too.
+package githook
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/Amul-Thantharate/pixellock/pkg/pixellock"
+)
+
+// AllowFile is the file at the top of a repository listing the images it
+// may hold unencrypted, a glob on each line, as Allowed matches them.
+// Blank lines and lines starting with # are ignored.
+const AllowFile = ".pixellock-allow"
+
+// A Repo is a Git repository, worked on through the git command.
+type Repo struct {
+	// Dir is the top of its working tree.
+	Dir string
+}
+
+// Open returns the repository dir is in.
+func Open(ctx context.Context, dir string) (*Repo, error) {
+	out, err := git(ctx, dir, "rev-parse", "--show-toplevel")
+	if err != nil {
+		return nil, err
+	}
+	return &Repo{Dir: strings.TrimSpace(string(out))}, nil
+}
+
+// git runs git in dir with args and returns what it writes to stdout.
+func git(ctx context.Context, dir string, args ...string) ([]byte, error) {
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = dir
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			err = fmt.Errorf("%w: %s", err, msg)
+		}
+		return nil, fmt.Errorf("git %s: %w", args[0], err)
+	}
+	return out, nil
+}
+
+// names splits the NUL-terminated names git lists with -z.
+func names(out []byte) []string {
+	var list []string
+	for _, name := range bytes.Split(out, []byte{0}) {
+		if len(name) > 0 {
+			list = append(list, string(name))
+		}
+	}
+	return list
+}
+
+// Staged returns the files added, copied, modified or renamed in the index,
+// to be committed, as slash-separated paths from the top of the working
+// tree. Deleted files are not.
+func (r *Repo) Staged(ctx context.Context) ([]string, error) {
+	out, err := git(ctx, r.Dir, "diff", "--cached", "--name-only", "--diff-filter=ACMR", "-z")
+	if err != nil {
+		return nil, err
+	}
+	return names(out), nil
+}
+
+// Tracked returns every file in the index.
+func (r *Repo) Tracked(ctx context.Context) ([]string, error) {
+	out, err := git(ctx, r.Dir, "ls-files", "--cached", "-z")
+	if err != nil {
+		return nil, err
+	}
+	return names(out), nil
+}
+
+// StagedData returns the data of the file name as the index holds it,
+// which may differ from the working tree.
+func (r *Repo) StagedData(ctx context.Context, name string) ([]byte, error) {
+	return git(ctx, r.Dir, "cat-file", "blob", ":"+name)
+}
+
+// Allowlist returns the globs of the repository's AllowFile, none when it
+// has none.
+func (r *Repo) Allowlist() ([]string, error) {
+	f, err := os.Open(filepath.Join(r.Dir, AllowFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var patterns []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if _, err := path.Match(line, ""); err != nil {
+			return nil, fmt.Errorf("%s: bad pattern %q: %w", AllowFile, line, err)
+		}
+		patterns = append(patterns, line)
+	}
+	return patterns, scanner.Err()
+}
+
+// Allowed reports whether the slash-separated path name matches one of
+// patterns: a glob with a slash matches the whole path, such as
+// docs/*.png, and one without matches the base name, such as *.svg.
+func Allowed(name string, patterns []string) bool {
+	for _, pattern := range patterns {
+		target := name
+		if !strings.Contains(pattern, "/") {
+			target = path.Base(name)
+		}
+		if ok, _ := path.Match(pattern, target); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// isImage reports whether data is an image pixellock can load, as no file
+// pixellock encrypted is.
+func isImage(data []byte) bool {
+	_, _, err := image.DecodeConfig(bytes.NewReader(data))
+	return err == nil
+}
+
+// Unencrypted returns those of files whose data in the index is an
+// unencrypted image pixellock can load, other than those allow matches.
+func (r *Repo) Unencrypted(ctx context.Context, files, allow []string) ([]string, error) {
+	var found []string
+	for _, name := range files {
+		if Allowed(name, allow) {
+			continue
+		}
+		data, err := r.StagedData(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		if isImage(data) {
+			found = append(found, name)
+		}
+	}
+	return found, nil
+}
+
+// EncryptStaged encrypts the images files as the index holds them, with
+// key, each to the file of its name with pixellock.EncryptedExtension
+// added, which it stages in place of the image. The images are left in
+// the working tree, untracked, and the encrypted files returned.
+func (r *Repo) EncryptStaged(ctx context.Context, key []byte, files []string) ([]string, error) {
+	var encrypted []string
+	for _, name := range files {
+		data, err := r.StagedData(ctx, name)
+		if err != nil {
+			return encrypted, err
+		}
+		output := name + pixellock.EncryptedExtension
+		var buf bytes.Buffer
+		if err := pixellock.EncryptImage(ctx, key, &buf, bytes.NewReader(data)); err != nil {
+			return encrypted, fmt.Errorf("failed to encrypt %s: %w", name, err)
+		}
+		if err := os.WriteFile(filepath.Join(r.Dir, filepath.FromSlash(output)), buf.Bytes(), 0o644); err != nil {
+			return encrypted, err
+		}
+		if _, err := git(ctx, r.Dir, "rm", "--cached", "--quiet", "--", name); err != nil {
+			return encrypted, err
+		}
+		if _, err := git(ctx, r.Dir, "add", "--", output); err != nil {
+			return encrypted, err
+		}
+		encrypted = append(encrypted, output)
+	}
+	return encrypted, nil
+}
+
+// hookMarker marks the pre-commit hooks Install writes, which it may
+// replace.
+const hookMarker = "# Installed by pixellock hook install"
+
+// Install writes the pre-commit hook of the repository, where Git looks
+// for it, to run command, such as "pixellock hook check --staged", and
+// returns its path. A hook that Install did not write is left alone, and
+// an error returned, unless force is set.
+func (r *Repo) Install(ctx context.Context, command string, force bool) (string, error) {
+	out, err := git(ctx, r.Dir, "rev-parse", "--git-path", "hooks/pre-commit")
+	if err != nil {
+		return "", err
+	}
+	hook := strings.TrimSpace(string(out))
+	if !filepath.IsAbs(hook) {
+		hook = filepath.Join(r.Dir, hook)
+	}
+	if old, err := os.ReadFile(hook); err == nil && !bytes.Contains(old, []byte(hookMarker)) && !force {
+		return "", fmt.Errorf("%s exists and was not installed by pixellock; replace it with --force", hook)
+	}
+	if err := os.MkdirAll(filepath.Dir(hook), 0o755); err != nil {
+		return "", err
+	}
+	script := "#!/bin/sh\n" + hookMarker + ": refuses commits of unencrypted images.\nexec " + command + "\n"
+	if err := os.WriteFile(hook, []byte(script), 0o755); err != nil {
+		return "", err
+	}
+	// WriteFile keeps the mode of a hook that was there
+	return hook, os.Chmod(hook, 0o755)
+}
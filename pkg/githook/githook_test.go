@@ -0,0 +1,163 @@
+package githook
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/Amul-Thantharate/pixellock/pkg/pixellock"
+)
+
+// testRepo returns a new repository with files written to its working
+// tree and staged: a PNG for each name ending .png, and text otherwise.
+func testRepo(t *testing.T, files ...string) *Repo {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	dir := t.TempDir()
+	if _, err := git(t.Context(), dir, "init", "--quiet"); err != nil {
+		t.Fatal(err)
+	}
+	r, err := Open(t.Context(), dir)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	for _, name := range files {
+		writeFile(t, r, name, pngData(t))
+		if !strings.HasSuffix(name, ".png") {
+			writeFile(t, r, name, []byte("text"))
+		}
+		if _, err := git(t.Context(), dir, "add", "--", name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return r
+}
+
+func writeFile(t *testing.T, r *Repo, name string, data []byte) {
+	t.Helper()
+	name = filepath.Join(r.Dir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(name, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func pngData(t *testing.T) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, 4, 4))); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestUnencrypted(t *testing.T) {
+	r := testRepo(t, "README.md", "scans/raw.png", "docs/logo.png", "icons/app.png")
+	key, _ := pixellock.GenerateRandomKey()
+	var encrypted bytes.Buffer
+	pixellock.EncryptImage(t.Context(), key, &encrypted, bytes.NewReader(pngData(t)))
+	writeFile(t, r, "scans/safe.png.enc", encrypted.Bytes())
+	git(t.Context(), r.Dir, "add", "--", "scans/safe.png.enc")
+	// The working tree no longer has the image, but the index does
+	writeFile(t, r, "icons/app.png", []byte("text"))
+
+	staged, err := r.Staged(t.Context())
+	if err != nil {
+		t.Fatalf("Staged failed: %v", err)
+	}
+	writeFile(t, r, AllowFile, []byte("# Logos are public\ndocs/*.png\n\n"))
+	allow, err := r.Allowlist()
+	if err != nil {
+		t.Fatalf("Allowlist failed: %v", err)
+	}
+	found, err := r.Unencrypted(t.Context(), staged, allow)
+	if err != nil {
+		t.Fatalf("Unencrypted failed: %v", err)
+	}
+	if want := []string{"icons/app.png", "scans/raw.png"}; !slices.Equal(found, want) {
+		t.Errorf("found %v, want %v", found, want)
+	}
+
+	// Nothing to find
+	r = testRepo(t, "README.md")
+	staged, _ = r.Staged(t.Context())
+	if found, err := r.Unencrypted(t.Context(), staged, nil); err != nil || len(found) != 0 {
+		t.Errorf("found %v, %v in a repository without images", found, err)
+	}
+}
+
+func TestAllowed(t *testing.T) {
+	patterns := []string{"*.svg", "docs/*.png"}
+	for name, want := range map[string]bool{
+		"logo.svg":          true,
+		"assets/logo.svg":   true,
+		"docs/diagram.png":  true,
+		"docs/sub/deep.png": false,
+		"scans/docs.png":    false,
+	} {
+		if got := Allowed(name, patterns); got != want {
+			t.Errorf("Allowed(%s) = %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestEncryptStaged(t *testing.T) {
+	r := testRepo(t, "scans/raw.png")
+	key, _ := pixellock.GenerateRandomKey()
+	encrypted, err := r.EncryptStaged(t.Context(), key, []string{"scans/raw.png"})
+	if err != nil {
+		t.Fatalf("EncryptStaged failed: %v", err)
+	}
+	if want := []string{"scans/raw.png.enc"}; !slices.Equal(encrypted, want) {
+		t.Errorf("encrypted %v, want %v", encrypted, want)
+	}
+	staged, _ := r.Staged(t.Context())
+	if !slices.Equal(staged, encrypted) {
+		t.Errorf("staged %v, want only the encrypted file", staged)
+	}
+	data, _ := r.StagedData(t.Context(), "scans/raw.png.enc")
+	var decrypted bytes.Buffer
+	if err := pixellock.DecryptImage(t.Context(), key, &decrypted, bytes.NewReader(data)); err != nil {
+		t.Errorf("the staged file does not decrypt: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(r.Dir, "scans", "raw.png")); err != nil {
+		t.Errorf("the image was removed from the working tree: %v", err)
+	}
+}
+
+func TestInstall(t *testing.T) {
+	r := testRepo(t)
+	hook, err := r.Install(t.Context(), "pixellock hook check --staged", false)
+	if err != nil {
+		t.Fatalf("Install failed: %v", err)
+	}
+	script, _ := os.ReadFile(hook)
+	if !strings.Contains(string(script), "exec pixellock hook check --staged\n") {
+		t.Errorf("hook is %q", script)
+	}
+	if info, _ := os.Stat(hook); runtime.GOOS != "windows" && info.Mode().Perm()&0o111 == 0 {
+		t.Errorf("hook has mode %v, not executable", info.Mode())
+	}
+	// Its own hook is replaced, another only with force
+	if _, err := r.Install(t.Context(), "pixellock hook check", false); err != nil {
+		t.Errorf("Install over its own hook failed: %v", err)
+	}
+	os.WriteFile(hook, []byte("#!/bin/sh\nmake lint\n"), 0o755)
+	if _, err := r.Install(t.Context(), "pixellock hook check", false); err == nil {
+		t.Error("Install over another hook succeeded")
+	}
+	if _, err := r.Install(t.Context(), "pixellock hook check", true); err != nil {
+		t.Errorf("Install with force failed: %v", err)
+	}
+}
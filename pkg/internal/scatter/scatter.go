@@ -0,0 +1,55 @@
+// Package scatter draws the pseudorandom permutations of pixels and blocks
+// shared by the stego engine and image scrambling.
+package scatter
+
+import "math/rand/v2"
+
+// Order is a pseudorandom permutation of the indices 0 to N-1. Entries are
+// produced on demand by a Fisher-Yates shuffle driven by ChaCha8, so only
+// the indices actually used are ever materialized.
+type Order struct {
+	N int // Number of indices being permuted
+
+	rng     *rand.ChaCha8
+	perm    []int       // Permutation entries produced so far
+	swapped map[int]int // Values displaced by the shuffle, by position
+}
+
+// New returns the permutation of n indices for seed.
+func New(seed [32]byte, n int) *Order {
+	return &Order{N: n, rng: rand.NewChaCha8(seed), swapped: make(map[int]int)}
+}
+
+// At returns the index at position i of the permutation.
+func (o *Order) At(i int) int {
+	for len(o.perm) <= i {
+		k := len(o.perm)
+		j := k + o.uniform(o.N-k)
+		vk, vj := o.value(k), o.value(j)
+		o.swapped[j] = vk
+		delete(o.swapped, k)
+		o.perm = append(o.perm, vj)
+	}
+	return o.perm[i]
+}
+
+// value returns the element currently at position i of the shuffled array.
+func (o *Order) value(i int) int {
+	if v, ok := o.swapped[i]; ok {
+		return v
+	}
+	return i
+}
+
+// uniform returns a uniformly distributed integer in [0, n). The rejection
+// sampling is done here rather than with rand.Rand so the sequence depends
+// only on the ChaCha8 stream.
+func (o *Order) uniform(n int) int {
+	bound := uint64(n)
+	limit := -bound % bound // 2^64 mod n
+	for {
+		if v := o.rng.Uint64(); v >= limit {
+			return int(v % bound)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+// Package ipfs is a client of the HTTP RPC API of an IPFS node, such as
+// Kubo's, making the requests pixellock.PublishIPFS and
+// pixellock.FetchIPFS need to add encrypted files to the node, pin them,
+// and read them back.
+package ipfs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/Amul-Thantharate/pixellock/pkg/pixellock"
+)
+
+// DefaultEndpoint is the address of the API of a local node.
+const DefaultEndpoint = "http://127.0.0.1:5001"
+
+// EndpointEnv is the environment variable LoadConfig takes the endpoint
+// from.
+const EndpointEnv = "PIXELLOCK_IPFS_API"
+
+// Config configures a Client.
+type Config struct {
+	// Endpoint is the URL of the node's API, without its /api/v0 path;
+	// DefaultEndpoint when empty.
+	Endpoint string
+
+	// HTTPClient sends the requests; http.DefaultClient when nil.
+	HTTPClient *http.Client
+}
+
+// LoadConfig returns the Config of the node whose API EndpointEnv names,
+// or of a local node when it names none.
+func LoadConfig() Config {
+	return Config{Endpoint: os.Getenv(EndpointEnv)}
+}
+
+// A Client makes requests to the API of an IPFS node as its Config says.
+// It is a pixellock.IPFSClient, and can be used by several goroutines at
+// once.
+type Client struct {
+	endpoint *url.URL
+	http     *http.Client
+}
+
+var _ pixellock.IPFSClient = (*Client)(nil)
+
+// New returns a Client configured by cfg.
+func New(cfg Config) (*Client, error) {
+	if cfg.Endpoint == "" {
+		cfg.Endpoint = DefaultEndpoint
+	}
+	endpoint, err := url.Parse(cfg.Endpoint)
+	if err != nil || endpoint.Host == "" || endpoint.Scheme != "http" && endpoint.Scheme != "https" {
+		return nil, fmt.Errorf("invalid IPFS API endpoint %q", cfg.Endpoint)
+	}
+	client := cfg.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &Client{endpoint: endpoint, http: client}, nil
+}
+
+// An Error is a failure the node responded with.
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("IPFS node responded %d: %s", e.StatusCode, e.Message)
+}
+
+// responseError returns the error of resp, whose status is not 200.
+func responseError(resp *http.Response) error {
+	e := &Error{StatusCode: resp.StatusCode}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	var body struct{ Message string }
+	if json.Unmarshal(data, &body) == nil && body.Message != "" {
+		e.Message = body.Message
+	} else {
+		e.Message = strings.TrimSpace(string(data))
+	}
+	if e.Message == "" {
+		e.Message = http.StatusText(resp.StatusCode)
+	}
+	return e
+}
+
+// do posts body, of type contentType, to the command cmd of the API with
+// query, and returns the response when its status is 200.
+func (c *Client) do(ctx context.Context, cmd string, query url.Values, contentType string, body io.Reader) (*http.Response, error) {
+	u := *c.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/api/v0/" + cmd
+	u.RawQuery = query.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, responseError(resp)
+	}
+	return resp, nil
+}
+
+// Add adds the data read from r to the node, as a file named name, without
+// pinning it, and returns its CID, of version 1.
+func (c *Client) Add(ctx context.Context, name string, r io.Reader) (string, error) {
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		part, err := mw.CreateFormFile("file", name)
+		if err == nil {
+			_, err = io.Copy(part, r)
+		}
+		if err == nil {
+			err = mw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	query := url.Values{"pin": {"false"}, "cid-version": {"1"}, "quieter": {"true"}}
+	resp, err := c.do(ctx, "add", query, mw.FormDataContentType(), pr)
+	// Ends the goroutine if the request stopped reading
+	pr.CloseWithError(errors.New("request ended"))
+	if err != nil {
+		return "", fmt.Errorf("failed to add %s to IPFS: %w", name, err)
+	}
+	defer resp.Body.Close()
+	var added struct{ Hash string }
+	if err := json.NewDecoder(resp.Body).Decode(&added); err != nil {
+		return "", fmt.Errorf("failed to add %s to IPFS: bad response: %w", name, err)
+	}
+	if added.Hash == "" {
+		return "", fmt.Errorf("failed to add %s to IPFS: no CID in the response", name)
+	}
+	return added.Hash, nil
+}
+
+// Pin pins cid on the node.
+func (c *Client) Pin(ctx context.Context, cid string) error {
+	resp, err := c.do(ctx, "pin/add", url.Values{"arg": {cid}}, "", nil)
+	if err != nil {
+		return fmt.Errorf("failed to pin %s: %w", cid, err)
+	}
+	defer resp.Body.Close()
+	_, err = io.Copy(io.Discard, resp.Body)
+	return err
+}
+
+// Cat returns the data of cid for reading.
+func (c *Client) Cat(ctx context.Context, cid string) (io.ReadCloser, error) {
+	resp, err := c.do(ctx, "cat", url.Values{"arg": {cid}}, "", nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s from IPFS: %w", cid, err)
+	}
+	return resp.Body, nil
+}
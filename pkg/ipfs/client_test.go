@@ -0,0 +1,119 @@
+package ipfs
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// fakeNode serves the add, pin/add and cat commands of the API of an IPFS
+// node, giving each file the hex SHA-256 of its data as its CID.
+type fakeNode struct {
+	mu     sync.Mutex
+	blocks map[string][]byte
+	pinned map[string]bool
+}
+
+func (n *fakeNode) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	fail := func(msg string) {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"Message": msg, "Type": "error"})
+	}
+	cid := r.URL.Query().Get("arg")
+	switch r.URL.Path {
+	case "/api/v0/add":
+		if r.URL.Query().Get("pin") != "false" {
+			fail("add pinned the file")
+			return
+		}
+		f, header, err := r.FormFile("file")
+		if err != nil {
+			fail(err.Error())
+			return
+		}
+		data, _ := io.ReadAll(f)
+		sum := sha256.Sum256(data)
+		cid := hex.EncodeToString(sum[:])
+		n.blocks[cid] = data
+		json.NewEncoder(w).Encode(map[string]string{"Name": header.Filename, "Hash": cid})
+	case "/api/v0/pin/add":
+		if n.blocks[cid] == nil {
+			fail("not found")
+			return
+		}
+		n.pinned[cid] = true
+		json.NewEncoder(w).Encode(map[string][]string{"Pins": {cid}})
+	case "/api/v0/cat":
+		data, ok := n.blocks[cid]
+		if !ok {
+			fail("block was not found locally (offline): ipld: could not find " + cid)
+			return
+		}
+		w.Write(data)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestClient(t *testing.T) {
+	node := &fakeNode{blocks: map[string][]byte{}, pinned: map[string]bool{}}
+	server := httptest.NewServer(node)
+	defer server.Close()
+	client, err := New(Config{Endpoint: server.URL})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+
+	data := bytes.Repeat([]byte("encrypted"), 10000)
+	cid, err := client.Add(t.Context(), "photo.png.enc", bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Add failed: %v", err)
+	}
+	if node.pinned[cid] {
+		t.Error("Add pinned the file")
+	}
+	if err := client.Pin(t.Context(), cid); err != nil || !node.pinned[cid] {
+		t.Errorf("Pin = %v, pinned %v", err, node.pinned[cid])
+	}
+	r, err := client.Cat(t.Context(), cid)
+	if err != nil {
+		t.Fatalf("Cat failed: %v", err)
+	}
+	got, _ := io.ReadAll(r)
+	r.Close()
+	if !bytes.Equal(got, data) {
+		t.Errorf("Cat gave %d bytes, want the %d added", len(got), len(data))
+	}
+
+	_, err = client.Cat(t.Context(), "missing")
+	var e *Error
+	if !errors.As(err, &e) || e.StatusCode != http.StatusInternalServerError || e.Message == "" {
+		t.Errorf("Cat of a missing CID = %v, want the node's error", err)
+	}
+}
+
+func TestNew(t *testing.T) {
+	for _, endpoint := range []string{"127.0.0.1:5001", "ftp://node", "http://"} {
+		if _, err := New(Config{Endpoint: endpoint}); err == nil {
+			t.Errorf("New with the endpoint %q succeeded", endpoint)
+		}
+	}
+	t.Setenv(EndpointEnv, "")
+	c, err := New(LoadConfig())
+	if err != nil || c.endpoint.String() != DefaultEndpoint {
+		t.Errorf("New without an endpoint = %v, %v; want %s", c, err, DefaultEndpoint)
+	}
+}
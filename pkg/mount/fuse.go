@@ -0,0 +1,188 @@
+//go:build linux || darwin || freebsd
+
+package mount
+
+import (
+	"context"
+	"errors"
+	"io"
+	iofs "io/fs"
+	"path"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/Amul-Thantharate/pixellock/pkg/pixellock"
+)
+
+// cacheTimeout is how long the kernel keeps what it is told of names and
+// sizes, which change as files are decrypted.
+const cacheTimeout = time.Second
+
+// A Server serves the view of a directory of encrypted images mounted
+// with FUSE.
+type Server struct {
+	server *fuse.Server
+}
+
+// Mount mounts the view of cfg at mountpoint, an existing directory,
+// returning once it is mounted.
+func Mount(mountpoint string, cfg Config) (*Server, error) {
+	view, err := cfg.view()
+	if err != nil {
+		return nil, err
+	}
+	timeout := cacheTimeout
+	server, err := fs.Mount(mountpoint, &node{view: view, name: "."}, &fs.Options{
+		MountOptions: fuse.MountOptions{
+			FsName:      "pixellock",
+			Name:        "pixellock",
+			DirectMount: true, // Without fusermount when root
+		},
+		EntryTimeout: &timeout,
+		AttrTimeout:  &timeout,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Server{server: server}, nil
+}
+
+// Unmount unmounts the view, which fails while files of it are open.
+func (s *Server) Unmount() error {
+	return s.server.Unmount()
+}
+
+// Wait waits until the view is unmounted.
+func (s *Server) Wait() {
+	s.server.Wait()
+}
+
+// A node is a file or directory of the view, by its path in it.
+type node struct {
+	fs.Inode
+	view *pixellock.DecryptedFS
+	name string
+}
+
+var (
+	_ fs.NodeLookuper  = (*node)(nil)
+	_ fs.NodeReaddirer = (*node)(nil)
+	_ fs.NodeGetattrer = (*node)(nil)
+	_ fs.NodeOpener    = (*node)(nil)
+)
+
+// errno returns the errno of err, from the view.
+func errno(err error) syscall.Errno {
+	switch {
+	case errors.Is(err, iofs.ErrNotExist):
+		return syscall.ENOENT
+	case errors.Is(err, iofs.ErrPermission):
+		return syscall.EACCES
+	case errors.Is(err, iofs.ErrInvalid):
+		return syscall.EINVAL
+	}
+	return syscall.EIO
+}
+
+// fileMode returns the type bits of the mode of info.
+func fileMode(info iofs.FileInfo) uint32 {
+	if info.IsDir() {
+		return fuse.S_IFDIR
+	}
+	return fuse.S_IFREG
+}
+
+// setAttr sets out to the attributes of info.
+func setAttr(out *fuse.Attr, info iofs.FileInfo) {
+	out.Mode = fileMode(info) | uint32(info.Mode().Perm())
+	out.Size = uint64(info.Size())
+	out.Blocks = (out.Size + 511) / 512
+	out.Nlink = 1
+	modTime := info.ModTime()
+	out.SetTimes(nil, &modTime, &modTime)
+}
+
+func (n *node) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	child := path.Join(n.name, name)
+	info, err := n.view.Stat(child)
+	if err != nil {
+		return nil, errno(err)
+	}
+	setAttr(&out.Attr, info)
+	return n.NewInode(ctx, &node{view: n.view, name: child}, fs.StableAttr{Mode: fileMode(info)}), 0
+}
+
+// Readdir lists the directory, decrypting nothing.
+func (n *node) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
+	entries, err := n.view.ReadDir(n.name)
+	if err != nil {
+		return nil, errno(err)
+	}
+	list := make([]fuse.DirEntry, len(entries))
+	for i, entry := range entries {
+		list[i] = fuse.DirEntry{Name: entry.Name(), Mode: fuse.S_IFREG}
+		if entry.IsDir() {
+			list[i].Mode = fuse.S_IFDIR
+		}
+	}
+	return fs.NewListDirStream(list), 0
+}
+
+// Getattr gives the attributes of the file, whose size is that of its
+// data, or of its encrypted file until it has been decrypted when
+// pixellock.DecryptedFS.KnowsSize says that is not known.
+func (n *node) Getattr(ctx context.Context, fh fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	info, err := n.view.Stat(n.name)
+	if err != nil {
+		return errno(err)
+	}
+	setAttr(&out.Attr, info)
+	return 0
+}
+
+// Open opens the file for reading, refusing to open it for writing.
+func (n *node) Open(ctx context.Context, flags uint32) (fs.FileHandle, uint32, syscall.Errno) {
+	if flags&(syscall.O_WRONLY|syscall.O_RDWR|syscall.O_TRUNC) != 0 {
+		return nil, 0, syscall.EROFS
+	}
+	f, err := n.view.Open(n.name)
+	if err != nil {
+		return nil, 0, errno(err)
+	}
+	// When the size is not that of the data until it is decrypted, reads
+	// go to the file rather than stopping at it, bypassing the page cache
+	var openFlags uint32
+	if !n.view.KnowsSize(n.name) {
+		openFlags = fuse.FOPEN_DIRECT_IO
+	}
+	return &handle{f: f}, openFlags, 0
+}
+
+// A handle is a file of the view open for reading, decrypted as it is
+// first read.
+type handle struct {
+	f iofs.File
+}
+
+var (
+	_ fs.FileReader   = (*handle)(nil)
+	_ fs.FileReleaser = (*handle)(nil)
+)
+
+// Read reads the data at off, or fails with EIO when the file fails to
+// decrypt, as with another key.
+func (h *handle) Read(ctx context.Context, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	n, err := h.f.(io.ReaderAt).ReadAt(dest, off)
+	if err != nil && err != io.EOF {
+		return nil, syscall.EIO
+	}
+	return fuse.ReadResultData(dest[:n]), 0
+}
+
+func (h *handle) Release(ctx context.Context) syscall.Errno {
+	h.f.Close()
+	return 0
+}
@@ -0,0 +1,20 @@
+//go:build !(linux || darwin || freebsd)
+
+package mount
+
+// A Server serves the view of a directory of encrypted images mounted
+// with FUSE, which this platform does not have.
+type Server struct{}
+
+// Mount fails with ErrUnsupported.
+func Mount(mountpoint string, cfg Config) (*Server, error) {
+	return nil, ErrUnsupported
+}
+
+// Unmount fails with ErrUnsupported.
+func (s *Server) Unmount() error {
+	return ErrUnsupported
+}
+
+// Wait returns at once.
+func (s *Server) Wait() {}
@@ -0,0 +1,77 @@
+// Package mount mounts a directory of encrypted images with FUSE, as the
+// read-only view of pixellock.DecryptedFS, so that any program can browse
+// them: each file appears under its name without the encrypted extension,
+// with that of its format added when the name has another, and is
+// decrypted in memory as it is read. Nothing decrypted is written to disk.
+//
+// Mounting needs FUSE: /dev/fuse and fusermount, or root, on Linux; macFUSE
+// on macOS. It is not supported on other platforms.
+package mount
+
+import (
+	"context"
+	"errors"
+
+	"github.com/Amul-Thantharate/pixellock/pkg/pixellock"
+)
+
+// ErrUnsupported is returned by Mount on platforms without FUSE.
+var ErrUnsupported = errors.New("mounting needs FUSE, which this platform does not have")
+
+// Config configures a mount.
+type Config struct {
+	// Dir is the directory of encrypted images, read from FS, the
+	// operating system's filesystem when nil.
+	Dir string
+	FS  pixellock.FileSystem
+
+	// Key is the key the images are decrypted with.
+	Key []byte
+
+	// EncryptedExt is the extension of the encrypted files;
+	// pixellock.EncryptedExtension when empty.
+	EncryptedExt string
+
+	// CacheSize bounds the bytes of decrypted images kept in memory, as
+	// pixellock.DecryptedFSOptions.CacheSize does.
+	CacheSize int64
+
+	// Logger is given the images that fail to decrypt, which fail to read
+	// with EIO; nothing is logged when it is nil.
+	Logger pixellock.Logger
+}
+
+// view returns the DecryptedFS of cfg.
+func (cfg Config) view() (*pixellock.DecryptedFS, error) {
+	return pixellock.NewDecryptedFS(cfg.Dir, cfg.Key, pixellock.DecryptedFSOptions{
+		FS:           cfg.FS,
+		EncryptedExt: cfg.EncryptedExt,
+		CacheSize:    cfg.CacheSize,
+		Logger:       cfg.Logger,
+	})
+}
+
+// Serve mounts the view of cfg at mountpoint and serves it until ctx is
+// done, then unmounts it, or until it is unmounted otherwise, as with
+// umount.
+func Serve(ctx context.Context, mountpoint string, cfg Config) error {
+	s, err := Mount(mountpoint, cfg)
+	if err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	go func() {
+		s.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+	if err := s.Unmount(); err != nil {
+		return err
+	}
+	<-done
+	return nil
+}
@@ -0,0 +1,231 @@
+package mount
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sync"
+	"syscall"
+	"testing"
+
+	"github.com/Amul-Thantharate/pixellock/pkg/pixellock"
+)
+
+// recordingLogger records the messages logged as errors.
+type recordingLogger struct {
+	mu     sync.Mutex
+	errors []string
+}
+
+func (l *recordingLogger) Debug(string, ...any) {}
+func (l *recordingLogger) Info(string, ...any)  {}
+func (l *recordingLogger) Warn(string, ...any)  {}
+
+func (l *recordingLogger) Error(msg string, keyvals ...any) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.errors = append(l.errors, msg)
+}
+
+func (l *recordingLogger) count() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.errors)
+}
+
+// mountFixture encrypts images with key into a new directory, and returns
+// it: the PNGs photo.png and trip/day.png, the JPEG shot.jpg, and the PNG
+// broken.png encrypted with another key.
+func mountFixture(t *testing.T, key []byte) string {
+	t.Helper()
+	dir := t.TempDir()
+	other, _ := pixellock.GenerateRandomKey()
+	for i, name := range []string{"photo.png", "trip/day.png", "shot.jpg", "broken.png"} {
+		img := image.NewNRGBA(image.Rect(0, 0, 40, 30))
+		for p := range img.Pix {
+			img.Pix[p] = byte(p*7 + i)
+		}
+		var plain, encrypted bytes.Buffer
+		if path.Ext(name) == ".jpg" {
+			jpeg.Encode(&plain, img, nil)
+		} else {
+			png.Encode(&plain, img)
+		}
+		k := key
+		if name == "broken.png" {
+			k = other
+		}
+		if err := pixellock.EncryptImage(t.Context(), k, &encrypted, &plain); err != nil {
+			t.Fatal(err)
+		}
+		file := filepath.Join(dir, filepath.FromSlash(name)+pixellock.EncryptedExtension)
+		os.MkdirAll(filepath.Dir(file), 0o755)
+		if err := os.WriteFile(file, encrypted.Bytes(), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestMount(t *testing.T) {
+	if testing.Short() {
+		t.Skip("mounts with FUSE")
+	}
+	key, _ := pixellock.GenerateRandomKey()
+	dir := mountFixture(t, key)
+	mountpoint := t.TempDir()
+	var logged recordingLogger
+	s, err := Mount(mountpoint, Config{Dir: dir, Key: key, Logger: &logged})
+	if err != nil {
+		t.Skip("cannot mount with FUSE:", err)
+	}
+	defer func() {
+		if err := s.Unmount(); err != nil {
+			t.Errorf("Unmount failed: %v", err)
+		}
+		s.Wait()
+	}()
+
+	entries, err := os.ReadDir(mountpoint)
+	if err != nil {
+		t.Fatalf("ReadDir failed: %v", err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	// The JPEG, stored as a PNG, is shown as one
+	if want := []string{"broken.png", "photo.png", "shot.jpg.png", "trip"}; !slices.Equal(names, want) {
+		t.Errorf("listed %v, want %v", names, want)
+	}
+	if n := logged.count(); n != 0 {
+		t.Errorf("listing logged %d errors", n)
+	}
+
+	// Each file reads as decrypting it directly gives it, at the size it
+	// is listed with before it is read
+	for name, source := range map[string]string{"photo.png": "photo.png", "trip/day.png": "trip/day.png", "shot.jpg.png": "shot.jpg"} {
+		listed, err := os.Stat(filepath.Join(mountpoint, filepath.FromSlash(name)))
+		if err != nil {
+			t.Fatalf("Stat(%s) failed: %v", name, err)
+		}
+		got, err := os.ReadFile(filepath.Join(mountpoint, filepath.FromSlash(name)))
+		if err != nil {
+			t.Fatalf("ReadFile(%s) failed: %v", name, err)
+		}
+		if listed.Size() != int64(len(got)) {
+			t.Errorf("%s was listed at %d bytes, not %d", name, listed.Size(), len(got))
+		}
+		encrypted, _ := os.ReadFile(filepath.Join(dir, filepath.FromSlash(source)+pixellock.EncryptedExtension))
+		var want bytes.Buffer
+		if err := pixellock.DecryptImage(t.Context(), key, &want, bytes.NewReader(encrypted)); err != nil {
+			t.Fatalf("DecryptImage failed: %v", err)
+		}
+		if sha256.Sum256(got) != sha256.Sum256(want.Bytes()) {
+			t.Errorf("%s differs from its direct decryption", name)
+		}
+	}
+
+	// The JPEG reads as the image DecryptFile writes, as a PNG: its default
+	// of the original format would encode it again, with loss
+	got := decodePNG(t, filepath.Join(mountpoint, "shot.jpg.png"))
+	decrypted := filepath.Join(t.TempDir(), "shot.png")
+	if err := pixellock.DecryptFile(t.Context(), filepath.Join(dir, "shot.jpg"+pixellock.EncryptedExtension), decrypted, key, false, pixellock.SaveOptions{Format: "png"}); err != nil {
+		t.Fatalf("DecryptFile failed: %v", err)
+	}
+	if want := decodePNG(t, decrypted); !sameImage(got, want) {
+		t.Error("shot.jpg.png differs from the image DecryptFile writes")
+	}
+
+	// A file of another key is listed, but fails to read
+	if _, err := os.ReadFile(filepath.Join(mountpoint, "broken.png")); !errors.Is(err, syscall.EIO) {
+		t.Errorf("reading a file of another key = %v, want EIO", err)
+	}
+	if n := logged.count(); n == 0 {
+		t.Error("the file of another key was not logged")
+	}
+
+	if f, err := os.OpenFile(filepath.Join(mountpoint, "photo.png"), os.O_WRONLY, 0); err == nil {
+		f.Close()
+		t.Error("opened a file for writing")
+	}
+}
+
+// decodePNG decodes the PNG file name.
+func decodePNG(t *testing.T, name string) image.Image {
+	t.Helper()
+	data, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("decoding %s failed: %v", filepath.Base(name), err)
+	}
+	return img
+}
+
+// sameImage reports whether a and b have the same bounds and colors.
+func sameImage(a, b image.Image) bool {
+	if a.Bounds() != b.Bounds() {
+		return false
+	}
+	for y := a.Bounds().Min.Y; y < a.Bounds().Max.Y; y++ {
+		for x := a.Bounds().Min.X; x < a.Bounds().Max.X; x++ {
+			r1, g1, b1, a1 := a.At(x, y).RGBA()
+			r2, g2, b2, a2 := b.At(x, y).RGBA()
+			if r1 != r2 || g1 != g2 || b1 != b2 || a1 != a2 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func TestServe(t *testing.T) {
+	if testing.Short() {
+		t.Skip("mounts with FUSE")
+	}
+	key, _ := pixellock.GenerateRandomKey()
+	dir := mountFixture(t, key)
+	mountpoint := t.TempDir()
+	// Whether FUSE can be mounted here at all
+	s, err := Mount(mountpoint, Config{Dir: dir, Key: key})
+	if err != nil {
+		t.Skip("cannot mount with FUSE:", err)
+	}
+	if err := s.Unmount(); err != nil {
+		t.Fatalf("Unmount failed: %v", err)
+	}
+	s.Wait()
+
+	ctx, cancel := context.WithCancel(t.Context())
+	served := make(chan error, 1)
+	go func() { served <- Serve(ctx, mountpoint, Config{Dir: dir, Key: key}) }()
+	// Serve returns once the context is done, as on SIGINT, unmounted
+	for {
+		if _, err := os.Stat(filepath.Join(mountpoint, "photo.png")); err == nil {
+			break
+		}
+		select {
+		case err := <-served:
+			t.Fatalf("Serve returned before it was canceled: %v", err)
+		default:
+		}
+	}
+	cancel()
+	if err := <-served; err != nil {
+		t.Fatalf("Serve failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(mountpoint, "photo.png")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("after Serve, Stat of the mount = %v, want it unmounted", err)
+	}
+}
@@ -0,0 +1,109 @@
+package parity
+
+import "errors"
+
+// Arithmetic in GF(2^8), the field of bytes, with the polynomial
+// x^8 + x^4 + x^3 + x^2 + 1 that Reed-Solomon codes commonly use. Adding
+// is XOR; multiplying goes by the tables of logarithms and powers of the
+// generator 2.
+
+var (
+	expTable [510]byte // 2^i, twice over so that a sum of two logarithms needs no modulus
+	logTable [256]byte
+
+	// mulTable[c][b] is c*b, for multiplying a shard by c a byte at a
+	// time.
+	mulTable [256][256]byte
+)
+
+func init() {
+	x := 1
+	for i := range 255 {
+		expTable[i], expTable[i+255] = byte(x), byte(x)
+		logTable[x] = byte(i)
+		if x <<= 1; x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	for c := 1; c < 256; c++ {
+		for b := 1; b < 256; b++ {
+			mulTable[c][b] = expTable[int(logTable[c])+int(logTable[b])]
+		}
+	}
+}
+
+// inverse returns 1/a, for a not 0.
+func inverse(a byte) byte {
+	return expTable[255-int(logTable[a])]
+}
+
+// mulAdd adds c times src to dst, which is at least as long.
+func mulAdd(dst, src []byte, c byte) {
+	switch c {
+	case 0:
+	case 1:
+		for i, b := range src {
+			dst[i] ^= b
+		}
+	default:
+		t := &mulTable[c]
+		for i, b := range src {
+			dst[i] ^= t[b]
+		}
+	}
+}
+
+// parityMatrix returns the rows of the m parity blocks of k data blocks: a
+// Cauchy matrix, 1/(x_i + y_j) with x_i = k+i and y_j = j, so that any k
+// of the data and parity blocks determine the rest. k+m must not exceed
+// 256.
+func parityMatrix(k, m int) [][]byte {
+	rows := make([][]byte, m)
+	for i := range rows {
+		rows[i] = make([]byte, k)
+		for j := range rows[i] {
+			rows[i][j] = inverse(byte(k+i) ^ byte(j))
+		}
+	}
+	return rows
+}
+
+// invert returns the inverse of the square matrix a, which it changes.
+func invert(a [][]byte) ([][]byte, error) {
+	n := len(a)
+	inv := make([][]byte, n)
+	for i := range inv {
+		inv[i] = make([]byte, n)
+		inv[i][i] = 1
+	}
+	for col := range n {
+		pivot := col
+		for pivot < n && a[pivot][col] == 0 {
+			pivot++
+		}
+		if pivot == n {
+			return nil, errors.New("singular matrix")
+		}
+		a[col], a[pivot] = a[pivot], a[col]
+		inv[col], inv[pivot] = inv[pivot], inv[col]
+		if c := inverse(a[col][col]); c != 1 {
+			scale(a[col], c)
+			scale(inv[col], c)
+		}
+		for row := range n {
+			if c := a[row][col]; row != col && c != 0 {
+				mulAdd(a[row], a[col], c)
+				mulAdd(inv[row], inv[col], c)
+			}
+		}
+	}
+	return inv, nil
+}
+
+// scale multiplies row by c.
+func scale(row []byte, c byte) {
+	t := &mulTable[c]
+	for i, b := range row {
+		row[i] = t[b]
+	}
+}
@@ -0,0 +1,766 @@
+// Package parity keeps recovery data of a directory of encrypted files, as
+// PAR2 does, so that files damaged or lost since can be rebuilt as they
+// were.
+//
+// The files of the directory are taken in order of their paths as one
+// stream, cut into data blocks of one size, the last padded with zeros.
+// Create computes parity blocks of them by a Reed-Solomon code, in
+// GF(2^8), and keeps them in a parity directory, with an index of the
+// files and the SHA-256 hashes of each file and block. Any data blocks
+// that no longer match their hashes, as many as there are parity blocks
+// intact, can be rebuilt from the rest by Repair. Both go through the data
+// a stripe of each block at a time, so that the memory they use is
+// bounded however large the files are.
+package parity
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// DirName is the directory, within the directory of the files, that
+// Create keeps the parity in unless told otherwise.
+const DirName = ".pixellock-parity"
+
+// IndexName is the name of the index in the parity directory.
+const IndexName = "index.json"
+
+// indexVersion is the version of the index Create writes.
+const indexVersion = 1
+
+// maxShards bounds the data and parity blocks together: the code's field
+// has no more elements to tell them apart.
+const maxShards = 256
+
+// minBlockSize bounds the size of a block from below, so that small
+// directories are not cut into many tiny blocks.
+const minBlockSize = 4 << 10
+
+// stripeSize is how much of each block is read at a time.
+const stripeSize = 64 << 10
+
+// ErrTooDamaged is returned by Repair when more blocks are damaged than
+// the parity left can rebuild.
+var ErrTooDamaged = errors.New("too damaged to repair")
+
+// An Index is what Create records of a directory in its parity directory.
+type Index struct {
+	Version int `json:"version"`
+
+	// BlockSize is the size of each block, data or parity.
+	BlockSize int64 `json:"block_size"`
+
+	// Files are the files covered, in order of their paths, which is
+	// that of the stream the data blocks are cut from.
+	Files []File `json:"files"`
+
+	// Blocks are the hex SHA-256 hashes of the data blocks, without the
+	// padding of the last, and Parity those of the parity blocks.
+	Blocks []string `json:"blocks"`
+	Parity []string `json:"parity"`
+}
+
+// A File is a file covered by an Index.
+type File struct {
+	// Path is the path of the file within the directory, / separated.
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// Size returns the size of the files covered, together.
+func (idx *Index) Size() int64 {
+	var n int64
+	for _, f := range idx.Files {
+		n += f.Size
+	}
+	return n
+}
+
+// Options configure Create.
+type Options struct {
+	// Redundancy is the size of the parity as a fraction of that of the
+	// files, from 0.01 to 1: about the share of the files that can be
+	// rebuilt.
+	Redundancy float64
+
+	// ParityDir is the directory the parity is kept in; DirName within
+	// the directory of the files when empty.
+	ParityDir string
+}
+
+// parityDir returns the parity directory of dir that parityDir names.
+func parityDir(dir, parityDir string) string {
+	if parityDir == "" {
+		return filepath.Join(dir, DirName)
+	}
+	return parityDir
+}
+
+// Create computes the parity of the files in dir and its subdirectories,
+// but for the parity directory, and writes it with its index to the
+// parity directory, replacing any parity there. It reads the files twice:
+// once to hash them, and once to compute the parity.
+func Create(ctx context.Context, dir string, opts Options) (*Index, error) {
+	if opts.Redundancy < 0.01 || opts.Redundancy > 1 {
+		return nil, fmt.Errorf("bad redundancy %g%%: give it from 1%% to 100%%", opts.Redundancy*100)
+	}
+	pdir := parityDir(dir, opts.ParityDir)
+	files, err := listFiles(dir, pdir)
+	if err != nil {
+		return nil, err
+	}
+	idx := &Index{Version: indexVersion, Files: files}
+	size := idx.Size()
+	if size == 0 {
+		return nil, fmt.Errorf("no data in %s to protect", dir)
+	}
+	k, m := layout(size, opts.Redundancy)
+	idx.BlockSize = (size + int64(k) - 1) / int64(k)
+	k = int((size + idx.BlockSize - 1) / idx.BlockSize)
+	if idx.Blocks, err = hashFiles(ctx, dir, idx); err != nil {
+		return nil, err
+	}
+
+	// The parity is written to a new directory beside the old, which
+	// replaces it once it is whole
+	tmp := pdir + ".new"
+	if err := os.RemoveAll(tmp); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(tmp, 0755); err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+	rows := make([]int, m)
+	for i := range rows {
+		rows[i] = i
+	}
+	if idx.Parity, err = writeParity(ctx, dir, tmp, idx, parityMatrix(k, m), rows); err != nil {
+		return nil, err
+	}
+	data, _ := json.MarshalIndent(idx, "", "  ")
+	if err := os.WriteFile(filepath.Join(tmp, IndexName), append(data, '\n'), 0644); err != nil {
+		return nil, err
+	}
+	old := pdir + ".old"
+	if err := os.RemoveAll(old); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(pdir, old); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	if err := os.Rename(tmp, pdir); err != nil {
+		return nil, err
+	}
+	return idx, os.RemoveAll(old)
+}
+
+// layout returns how many data blocks, k, and parity blocks, m, files of
+// size bytes are cut into with redundancy: as many data blocks as fit
+// within maxShards with their parity, but none smaller than minBlockSize.
+func layout(size int64, redundancy float64) (k, m int) {
+	k = int(min((size+minBlockSize-1)/minBlockSize, maxShards))
+	for ; ; k-- {
+		m = max(1, int(math.Ceil(float64(k)*redundancy-1e-9)))
+		if k+m <= maxShards {
+			return k, m
+		}
+	}
+}
+
+// listFiles returns the regular files in dir and its subdirectories, but
+// for those in pdir, in order of their paths, with their sizes.
+func listFiles(dir, pdir string) ([]File, error) {
+	var files []File
+	skip := []string{filepath.Clean(pdir), filepath.Clean(pdir) + ".new", filepath.Clean(pdir) + ".old"}
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if slices.Contains(skip, filepath.Clean(path)) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		files = append(files, File{Path: filepath.ToSlash(rel), Size: info.Size()})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	slices.SortFunc(files, func(a, b File) int { return strings.Compare(a.Path, b.Path) })
+	return files, nil
+}
+
+// hashFiles reads the files of idx, in dir, in order, setting the hash of
+// each, and returns the hashes of the data blocks.
+func hashFiles(ctx context.Context, dir string, idx *Index) ([]string, error) {
+	var blocks []string
+	block := sha256.New()
+	var filled int64 // Of the block
+	buf := make([]byte, stripeSize)
+	for i := range idx.Files {
+		file := &idx.Files[i]
+		f, err := os.Open(filepath.Join(dir, filepath.FromSlash(file.Path)))
+		if err != nil {
+			return nil, err
+		}
+		h := sha256.New()
+		var n int64
+		for {
+			if err := ctx.Err(); err != nil {
+				f.Close()
+				return nil, err
+			}
+			c, err := f.Read(buf)
+			if n += int64(c); n > file.Size {
+				f.Close()
+				return nil, fmt.Errorf("%s changed while it was read", file.Path)
+			}
+			h.Write(buf[:c])
+			for data := buf[:c]; len(data) > 0; {
+				c := min(int64(len(data)), idx.BlockSize-filled)
+				block.Write(data[:c])
+				data, filled = data[c:], filled+c
+				if filled == idx.BlockSize {
+					blocks = append(blocks, hex.EncodeToString(block.Sum(nil)))
+					block.Reset()
+					filled = 0
+				}
+			}
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				f.Close()
+				return nil, err
+			}
+		}
+		f.Close()
+		if n != file.Size {
+			return nil, fmt.Errorf("%s changed while it was read", file.Path)
+		}
+		file.SHA256 = hex.EncodeToString(h.Sum(nil))
+	}
+	if filled > 0 {
+		blocks = append(blocks, hex.EncodeToString(block.Sum(nil)))
+	}
+	return blocks, nil
+}
+
+// shardName returns the name of the file of parity block i.
+func shardName(i int) string {
+	return fmt.Sprintf("parity-%03d.bin", i)
+}
+
+// writeParity computes the parity blocks rows of the data blocks of idx,
+// in dir, by the rows of matrix, and writes them to the directory pdir. It
+// returns the hashes of the blocks written, in the order of rows.
+func writeParity(ctx context.Context, dir, pdir string, idx *Index, matrix [][]byte, rows []int) ([]string, error) {
+	k := len(idx.Blocks)
+	readers := make([]*rangeReader, k)
+	for j := range readers {
+		readers[j] = newBlockReader(dir, idx, j)
+		defer readers[j].Close()
+	}
+	outs := make([]*os.File, len(rows))
+	hashes := make([]hash.Hash, len(rows))
+	for i, row := range rows {
+		f, err := os.Create(filepath.Join(pdir, shardName(row)))
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		outs[i], hashes[i] = f, sha256.New()
+	}
+	in := make([]byte, min(stripeSize, idx.BlockSize))
+	parity := make([][]byte, len(rows))
+	for i := range parity {
+		parity[i] = make([]byte, len(in))
+	}
+	for off := int64(0); off < idx.BlockSize; off += int64(len(in)) {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		n := min(int64(len(in)), idx.BlockSize-off)
+		for i := range parity {
+			clear(parity[i][:n])
+		}
+		for j, r := range readers {
+			if err := r.readStripe(in[:n]); err != nil {
+				return nil, err
+			}
+			for i, row := range rows {
+				mulAdd(parity[i][:n], in[:n], matrix[row][j])
+			}
+		}
+		for i, out := range outs {
+			if _, err := out.Write(parity[i][:n]); err != nil {
+				return nil, err
+			}
+			hashes[i].Write(parity[i][:n])
+		}
+	}
+	sums := make([]string, len(rows))
+	for i, out := range outs {
+		if err := out.Close(); err != nil {
+			return nil, err
+		}
+		sums[i] = hex.EncodeToString(hashes[i].Sum(nil))
+	}
+	return sums, nil
+}
+
+// A rangeReader reads a range of the stream of the files of an index, in
+// order, from the files in its directory.
+type rangeReader struct {
+	dir      string
+	idx      *Index
+	pos, end int64 // In the stream
+	i        int   // The file pos is in
+	start    int64 // Of file i in the stream
+	f        *os.File
+}
+
+// newBlockReader returns a reader of data block j of idx, in dir.
+func newBlockReader(dir string, idx *Index, j int) *rangeReader {
+	pos := int64(j) * idx.BlockSize
+	return &rangeReader{dir: dir, idx: idx, pos: pos, end: min(pos+idx.BlockSize, idx.Size())}
+}
+
+// Read reads from the files, failing on one missing or shorter than its
+// size.
+func (r *rangeReader) Read(p []byte) (int, error) {
+	for r.i < len(r.idx.Files) && r.start+r.idx.Files[r.i].Size <= r.pos {
+		r.start += r.idx.Files[r.i].Size
+		r.i++
+		r.Close()
+	}
+	if r.pos >= r.end || r.i == len(r.idx.Files) {
+		return 0, io.EOF
+	}
+	file := r.idx.Files[r.i]
+	if r.f == nil {
+		f, err := os.Open(filepath.Join(r.dir, filepath.FromSlash(file.Path)))
+		if err != nil {
+			return 0, err
+		}
+		r.f = f
+	}
+	n := int(min(int64(len(p)), r.end-r.pos, r.start+file.Size-r.pos))
+	n, err := r.f.ReadAt(p[:n], r.pos-r.start)
+	r.pos += int64(n)
+	if err == io.EOF {
+		err = fmt.Errorf("%s is shorter than it was: %w", file.Path, io.ErrUnexpectedEOF)
+	}
+	return n, err
+}
+
+// readStripe fills p with what comes next of the range, padded with zeros
+// past its end.
+func (r *rangeReader) readStripe(p []byte) error {
+	n, err := io.ReadFull(r, p[:min(int64(len(p)), max(0, r.end-r.pos))])
+	if err != nil {
+		return err
+	}
+	clear(p[n:])
+	return nil
+}
+
+// Close closes the file open, if any.
+func (r *rangeReader) Close() error {
+	if r.f == nil {
+		return nil
+	}
+	err := r.f.Close()
+	r.f = nil
+	return err
+}
+
+// ReadIndex reads the index of the parity directory pdir of dir: DirName
+// within dir when pdir is empty.
+func ReadIndex(dir, pdir string) (*Index, error) {
+	data, err := os.ReadFile(filepath.Join(parityDir(dir, pdir), IndexName))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("no parity of %s: create it first", dir)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var idx Index
+	if err := json.Unmarshal(data, &idx); err != nil {
+		return nil, fmt.Errorf("bad parity index: %w", err)
+	}
+	switch {
+	case idx.Version > indexVersion:
+		return nil, fmt.Errorf("parity index of a newer pixellock, of version %d", idx.Version)
+	case idx.BlockSize <= 0, len(idx.Blocks) == 0, len(idx.Parity) == 0,
+		len(idx.Blocks)+len(idx.Parity) > maxShards,
+		int64(len(idx.Blocks)) != (idx.Size()+idx.BlockSize-1)/idx.BlockSize:
+		return nil, errors.New("bad parity index")
+	}
+	for _, f := range idx.Files {
+		if !filepath.IsLocal(filepath.FromSlash(f.Path)) {
+			return nil, fmt.Errorf("bad parity index: bad path %q", f.Path)
+		}
+	}
+	return &idx, nil
+}
+
+// A Report is what Repair found, and did.
+type Report struct {
+	// Files is the number of files the parity covers.
+	Files int
+
+	// Damaged are the paths of the files missing, or no longer as they
+	// were, which Repair rebuilt unless told not to.
+	Damaged []string
+
+	// DamagedBlocks and DamagedParity are the numbers of data and parity
+	// blocks that no longer match their hashes.
+	DamagedBlocks int
+	DamagedParity int
+}
+
+// RepairOptions configure Repair.
+type RepairOptions struct {
+	// ParityDir is the directory the parity is kept in, as Create was
+	// given it.
+	ParityDir string
+
+	// DryRun finds the damage but repairs none.
+	DryRun bool
+}
+
+// Repair checks the files of dir that the parity covers against their
+// hashes and rebuilds those missing or damaged from the rest and the
+// parity, writing each beside itself and renaming it into place once it
+// matches its hash. Parity blocks damaged are written again too. Files
+// not covered, added since the parity was created, are left alone. When
+// more data blocks are damaged than there are parity blocks intact, it
+// returns an error wrapping ErrTooDamaged, and changes nothing.
+func Repair(ctx context.Context, dir string, opts RepairOptions) (Report, error) {
+	pdir := parityDir(dir, opts.ParityDir)
+	idx, err := ReadIndex(dir, opts.ParityDir)
+	if err != nil {
+		return Report{}, err
+	}
+	report := Report{Files: len(idx.Files)}
+	damaged, blocks, err := scan(ctx, dir, idx)
+	if err != nil {
+		return report, err
+	}
+	var good []int // Parity blocks intact
+	var bad []int
+	for i, sum := range idx.Parity {
+		got, err := hashPath(filepath.Join(pdir, shardName(i)))
+		if err == nil && got == sum {
+			good = append(good, i)
+		} else {
+			bad = append(bad, i)
+		}
+	}
+	for _, i := range damaged {
+		report.Damaged = append(report.Damaged, idx.Files[i].Path)
+	}
+	report.DamagedBlocks, report.DamagedParity = len(blocks), len(bad)
+	if len(blocks) > len(good) {
+		return report, fmt.Errorf("%w: %d of the %d data blocks are damaged, and %d parity blocks are left to rebuild them",
+			ErrTooDamaged, len(blocks), len(idx.Blocks), len(good))
+	}
+	if opts.DryRun {
+		return report, nil
+	}
+	if len(damaged) > 0 {
+		if err := rebuild(ctx, dir, pdir, idx, damaged, blocks, good); err != nil {
+			return report, err
+		}
+	}
+	if len(bad) > 0 {
+		k, m := len(idx.Blocks), len(idx.Parity)
+		sums, err := writeParity(ctx, dir, pdir, idx, parityMatrix(k, m), bad)
+		if err != nil {
+			return report, err
+		}
+		for i, row := range bad {
+			if sums[i] != idx.Parity[row] {
+				return report, fmt.Errorf("parity block %d rebuilt does not match its hash", row)
+			}
+		}
+	}
+	return report, nil
+}
+
+// scan reads the files of idx, in dir, in order, and returns the files
+// missing or not matching their hashes and the data blocks not matching
+// theirs, each in order.
+func scan(ctx context.Context, dir string, idx *Index) (files, blocks []int, err error) {
+	bad := make([]bool, len(idx.Blocks))
+	block := sha256.New()
+	var pos int64 // In the stream
+	buf := make([]byte, stripeSize)
+	for i, file := range idx.Files {
+		if err := ctx.Err(); err != nil {
+			return nil, nil, err
+		}
+		name := filepath.Join(dir, filepath.FromSlash(file.Path))
+		info, err := os.Stat(name)
+		if err != nil || !info.Mode().IsRegular() || info.Size() != file.Size {
+			// The blocks it falls in cannot be hashed
+			files = append(files, i)
+			block.Reset()
+			if file.Size > 0 {
+				for j := pos / idx.BlockSize; j <= (pos+file.Size-1)/idx.BlockSize; j++ {
+					bad[j] = true
+				}
+			}
+			pos += file.Size
+			continue
+		}
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, nil, err
+		}
+		h := sha256.New()
+		r := &rangeReader{dir: dir, idx: idx, pos: pos, end: pos + file.Size, i: i, start: pos, f: f}
+		for {
+			n, err := r.Read(buf)
+			h.Write(buf[:n])
+			for data := buf[:n]; len(data) > 0; {
+				j := pos / idx.BlockSize
+				c := min(int64(len(data)), (j+1)*idx.BlockSize-pos)
+				block.Write(data[:c])
+				data, pos = data[c:], pos+c
+				if pos%idx.BlockSize == 0 || pos == idx.Size() {
+					if !bad[j] && hex.EncodeToString(block.Sum(nil)) != idx.Blocks[j] {
+						bad[j] = true
+					}
+					block.Reset()
+				}
+			}
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				r.Close()
+				return nil, nil, err
+			}
+		}
+		r.Close()
+		if hex.EncodeToString(h.Sum(nil)) != file.SHA256 {
+			files = append(files, i)
+		}
+	}
+	for j, b := range bad {
+		if b {
+			blocks = append(blocks, j)
+		}
+	}
+	return files, blocks, nil
+}
+
+// rebuild rebuilds the files damaged of idx, in dir, from the data blocks
+// intact and parity blocks good, in pdir.
+func rebuild(ctx context.Context, dir, pdir string, idx *Index, damaged, blocks, good []int) error {
+	k := len(idx.Blocks)
+	lost := make([]bool, k)
+	for _, j := range blocks {
+		lost[j] = true
+	}
+
+	// Any k blocks intact determine the data: those data blocks that are,
+	// and as many parity blocks as there are data blocks lost. The rows of
+	// the inverse of their matrix rebuild the data blocks lost from them.
+	var sources []io.Reader
+	var matrix [][]byte
+	parity := parityMatrix(k, len(idx.Parity))
+	for j := range k {
+		if !lost[j] {
+			r := newBlockReader(dir, idx, j)
+			defer r.Close()
+			sources = append(sources, r)
+			row := make([]byte, k)
+			row[j] = 1
+			matrix = append(matrix, row)
+		}
+	}
+	for _, i := range good[:len(blocks)] {
+		f, err := os.Open(filepath.Join(pdir, shardName(i)))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		sources = append(sources, f)
+		matrix = append(matrix, slices.Clone(parity[i]))
+	}
+	inv, err := invert(matrix)
+	if err != nil {
+		return err
+	}
+
+	// Each file damaged is written anew beside itself: the parts of it in
+	// blocks intact copied from it, and the rest as it is rebuilt
+	outs := make([]*os.File, len(damaged))
+	defer func() {
+		for _, out := range outs {
+			if out != nil {
+				out.Close()
+				os.Remove(out.Name())
+			}
+		}
+	}()
+	starts := make([]int64, len(idx.Files))
+	for i := 1; i < len(starts); i++ {
+		starts[i] = starts[i-1] + idx.Files[i-1].Size
+	}
+	for n, i := range damaged {
+		file := idx.Files[i]
+		name := filepath.Join(dir, filepath.FromSlash(file.Path))
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			return err
+		}
+		mode := fs.FileMode(0644)
+		if info, err := os.Stat(name); err == nil {
+			mode = info.Mode().Perm()
+		}
+		out, err := os.OpenFile(name+".repair", os.O_RDWR|os.O_CREATE|os.O_TRUNC, mode)
+		if err != nil {
+			return err
+		}
+		outs[n] = out
+		if err := out.Truncate(file.Size); err != nil {
+			return err
+		}
+		if err := copyIntact(name, out, starts[i], file.Size, idx.BlockSize, lost); err != nil {
+			return err
+		}
+	}
+
+	in := make([]byte, min(stripeSize, idx.BlockSize))
+	rebuilt := make([][]byte, len(blocks))
+	for i := range rebuilt {
+		rebuilt[i] = make([]byte, len(in))
+	}
+	for off := int64(0); len(blocks) > 0 && off < idx.BlockSize; off += int64(len(in)) {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		n := min(int64(len(in)), idx.BlockSize-off)
+		for i := range rebuilt {
+			clear(rebuilt[i][:n])
+		}
+		for s, src := range sources {
+			if r, ok := src.(*rangeReader); ok {
+				err = r.readStripe(in[:n])
+			} else {
+				_, err = io.ReadFull(src, in[:n])
+			}
+			if err != nil {
+				return err
+			}
+			for i, j := range blocks {
+				mulAdd(rebuilt[i][:n], in[:n], inv[j][s])
+			}
+		}
+		for i, j := range blocks {
+			pos := int64(j)*idx.BlockSize + off // Of the stripe in the stream
+			for o, f := range damaged {
+				lo, hi := max(pos, starts[f]), min(pos+n, starts[f]+idx.Files[f].Size)
+				if lo >= hi {
+					continue
+				}
+				if _, err := outs[o].WriteAt(rebuilt[i][lo-pos:hi-pos], lo-starts[f]); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	for o, i := range damaged {
+		out := outs[o]
+		file := idx.Files[i]
+		if _, err := out.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		h := sha256.New()
+		if _, err := io.Copy(h, out); err != nil {
+			return err
+		}
+		if hex.EncodeToString(h.Sum(nil)) != file.SHA256 {
+			return fmt.Errorf("%s rebuilt does not match its hash", file.Path)
+		}
+		if err := out.Close(); err != nil {
+			return err
+		}
+		outs[o] = nil
+		name := filepath.Join(dir, filepath.FromSlash(file.Path))
+		if err := os.Rename(name+".repair", name); err != nil {
+			os.Remove(name + ".repair")
+			return err
+		}
+	}
+	return nil
+}
+
+// copyIntact copies to out the parts of the file name, of size bytes at
+// start in the stream, that fall in blocks not lost. Those that do not,
+// when it is missing or of another size, are all of it.
+func copyIntact(name string, out *os.File, start, size, blockSize int64, lost []bool) error {
+	if size == 0 {
+		return nil
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return nil // All of it is lost
+	}
+	defer f.Close()
+	for j := start / blockSize; j <= (start+size-1)/blockSize; j++ {
+		if lost[j] {
+			continue
+		}
+		lo, hi := max(j*blockSize, start)-start, min((j+1)*blockSize, start+size)-start
+		if _, err := io.Copy(io.NewOffsetWriter(out, lo), io.NewSectionReader(f, lo, hi-lo)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hashPath returns the SHA-256 hash, in hex, of the file name.
+func hashPath(name string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
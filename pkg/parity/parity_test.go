@@ -0,0 +1,205 @@
+package parity
+
+import (
+	"bytes"
+	"errors"
+	"maps"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestInvert(t *testing.T) {
+	for _, k := range []int{1, 3, 10} {
+		// The rows of some data blocks and some parity blocks, as Repair
+		// takes them
+		parity := parityMatrix(k, 4)
+		var a [][]byte
+		for j := range k - min(k, 4) {
+			row := make([]byte, k)
+			row[j] = 1
+			a = append(a, row)
+		}
+		for _, row := range parity[:min(k, 4)] {
+			a = append(a, slices.Clone(row))
+		}
+		orig := make([][]byte, k)
+		for i := range a {
+			orig[i] = slices.Clone(a[i])
+		}
+		inv, err := invert(a)
+		if err != nil {
+			t.Fatalf("invert of %d rows failed: %v", k, err)
+		}
+		for i := range k {
+			for j := range k {
+				var sum byte
+				for n := range k {
+					sum ^= mulTable[inv[i][n]][orig[n][j]]
+				}
+				if i == j && sum != 1 || i != j && sum != 0 {
+					t.Fatalf("inverse of %d rows is not: (%d, %d) of the product is %d", k, i, j, sum)
+				}
+			}
+		}
+	}
+	if _, err := invert([][]byte{{1, 2}, {1, 2}}); err == nil {
+		t.Error("invert of a singular matrix succeeded")
+	}
+}
+
+// writeFiles writes files of random data of the sizes given to dir,
+// returning their contents by path.
+func writeFiles(t *testing.T, dir string, sizes map[string]int) map[string][]byte {
+	t.Helper()
+	rng := rand.New(rand.NewPCG(1, 2))
+	files := map[string][]byte{}
+	for _, path := range slices.Sorted(maps.Keys(sizes)) {
+		data := make([]byte, sizes[path])
+		for i := range data {
+			data[i] = byte(rng.Uint32())
+		}
+		name := filepath.Join(dir, filepath.FromSlash(path))
+		os.MkdirAll(filepath.Dir(name), 0755)
+		if err := os.WriteFile(name, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		files[path] = data
+	}
+	return files
+}
+
+// checkFiles fails unless the files of dir are those given.
+func checkFiles(t *testing.T, dir string, files map[string][]byte) {
+	t.Helper()
+	for path, want := range files {
+		got, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(path)))
+		if err != nil || !bytes.Equal(got, want) {
+			t.Errorf("%s is not as it was: %v", path, err)
+		}
+	}
+}
+
+func TestRepair(t *testing.T) {
+	dir := t.TempDir()
+	files := writeFiles(t, dir, map[string]int{
+		"a.jpg.enc":        300 << 10,
+		"b.png.enc":        40 << 10,
+		"c.jpg.enc":        1000,
+		"empty.enc":        0,
+		"sub/d.heic.enc":   250 << 10,
+		"sub/d.thumb.jpg":  3000,
+		"sub/e.jpeg.enc":   123457,
+		"sub/f.webp.enc":   1,
+		"sub/deep/g.enc":   80 << 10,
+		"sub/deep/h.enc":   77777,
+		"sub/deep/i.enc":   5000,
+		"sub/deep/j.enc":   64 << 10,
+		"sub/deep/kk.enc":  64<<10 + 1,
+		"sub/deep/zz.enc":  9,
+		"sub/deep/zzz.enc": 100 << 10,
+	})
+	idx, err := Create(t.Context(), dir, Options{Redundancy: 0.2})
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	if len(idx.Files) != len(files) || len(idx.Parity) < len(idx.Blocks)/5 {
+		t.Fatalf("Create covered %d files with %d data and %d parity blocks", len(idx.Files), len(idx.Blocks), len(idx.Parity))
+	}
+	if again, err := ReadIndex(dir, ""); err != nil || again.BlockSize != idx.BlockSize {
+		t.Fatalf("ReadIndex gave %+v, %v", again, err)
+	}
+	if report, err := Repair(t.Context(), dir, RepairOptions{}); err != nil || len(report.Damaged) != 0 || report.DamagedBlocks != 0 {
+		t.Fatalf("Repair of files intact gave %+v, %v", report, err)
+	}
+
+	// One file corrupted, another deleted, and the empty one too
+	corrupt := filepath.Join(dir, "a.jpg.enc")
+	data, _ := os.ReadFile(corrupt)
+	data[100<<10] ^= 0xff
+	data[100<<10+1] ^= 0x01
+	os.WriteFile(corrupt, data, 0644)
+	os.Remove(filepath.Join(dir, "sub", "e.jpeg.enc"))
+	os.Remove(filepath.Join(dir, "empty.enc"))
+	// And a parity block
+	os.WriteFile(filepath.Join(dir, DirName, shardName(0)), []byte("junk"), 0644)
+
+	report, err := Repair(t.Context(), dir, RepairOptions{DryRun: true})
+	if want := []string{"a.jpg.enc", "empty.enc", "sub/e.jpeg.enc"}; err != nil || !slices.Equal(report.Damaged, want) || report.DamagedParity != 1 {
+		t.Fatalf("Repair dry run gave %+v, %v; want damaged %v", report, err, want)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "sub", "e.jpeg.enc")); err == nil {
+		t.Fatal("Repair dry run rebuilt a file")
+	}
+	if _, err := Repair(t.Context(), dir, RepairOptions{}); err != nil {
+		t.Fatalf("Repair failed: %v", err)
+	}
+	checkFiles(t, dir, files)
+	if report, err := Repair(t.Context(), dir, RepairOptions{DryRun: true}); err != nil || len(report.Damaged) != 0 || report.DamagedParity != 0 {
+		t.Errorf("after Repair, a dry run gave %+v, %v", report, err)
+	}
+
+	// Damage beyond the parity fails, and leaves the files as they are
+	for _, path := range []string{"a.jpg.enc", "sub/d.heic.enc"} {
+		os.Remove(filepath.Join(dir, filepath.FromSlash(path)))
+	}
+	_, err = Repair(t.Context(), dir, RepairOptions{})
+	if !errors.Is(err, ErrTooDamaged) || !strings.Contains(err.Error(), "parity blocks are left") {
+		t.Fatalf("Repair of too much damage gave %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "a.jpg.enc")); err == nil {
+		t.Error("Repair of too much damage wrote a file")
+	}
+}
+
+func TestCreate(t *testing.T) {
+	dir, pdir := t.TempDir(), filepath.Join(t.TempDir(), "parity")
+	files := writeFiles(t, dir, map[string]int{"a.enc": 10, "b.enc": 20})
+	if _, err := Create(t.Context(), dir, Options{Redundancy: 2}); err == nil {
+		t.Error("Create with a redundancy of 200% succeeded")
+	}
+	if _, err := Create(t.Context(), t.TempDir(), Options{Redundancy: 0.1}); err == nil {
+		t.Error("Create of an empty directory succeeded")
+	}
+	if _, err := Repair(t.Context(), dir, RepairOptions{}); err == nil {
+		t.Error("Repair without parity succeeded")
+	}
+
+	// Parity kept elsewhere, created again over the old
+	for range 2 {
+		idx, err := Create(t.Context(), dir, Options{Redundancy: 0.1, ParityDir: pdir})
+		if err != nil {
+			t.Fatalf("Create failed: %v", err)
+		}
+		if len(idx.Blocks) != 1 || len(idx.Parity) != 1 || idx.BlockSize != 30 {
+			t.Errorf("Create gave %d data blocks and %d parity of %d bytes", len(idx.Blocks), len(idx.Parity), idx.BlockSize)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, DirName)); err == nil {
+		t.Error("Create wrote to the directory of the files")
+	}
+	os.Remove(filepath.Join(dir, "b.enc"))
+	if _, err := Repair(t.Context(), dir, RepairOptions{ParityDir: pdir}); err != nil {
+		t.Fatalf("Repair failed: %v", err)
+	}
+	checkFiles(t, dir, files)
+
+	for _, test := range []struct {
+		size int64
+		r    float64
+		k, m int
+	}{
+		{1, 0.1, 1, 1},
+		{100 << 10, 0.1, 25, 3},
+		{1 << 30, 0.1, 232, 24},
+		{1 << 30, 1, 128, 128},
+		{1 << 30, 0.01, 253, 3},
+	} {
+		if k, m := layout(test.size, test.r); k != test.k || m != test.m {
+			t.Errorf("layout(%d, %g) = %d, %d; want %d, %d", test.size, test.r, k, m, test.k, test.m)
+		}
+	}
+}
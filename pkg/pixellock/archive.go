@@ -0,0 +1,315 @@
+package pixellock
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// An archive is a whole directory as one encrypted file: a tar of it,
+// compressed with gzip, encrypted as a stream by EncryptStream. It is
+// written and read as it is streamed, so neither the directory nor the
+// archive is ever held in memory.
+
+// ArchiveExtension is the extension of the archives the CLI writes.
+const ArchiveExtension = ".penc"
+
+// ArchiveOptions configure WriteArchive and ExtractArchive.
+type ArchiveOptions struct {
+	// ImagesOnly leaves out of an archive the files that are not images
+	// pixellock can load. Directories are archived all the same.
+	ImagesOnly bool
+
+	// Logger is given the files left out of an archive, and those left
+	// alone when extracting it.
+	Logger Logger
+}
+
+// An ArchiveEntry is a file or directory in an archive.
+type ArchiveEntry struct {
+	// Name is the slash-separated path of the entry in the directory
+	// archived.
+	Name string
+
+	Mode    fs.FileMode
+	Size    int64
+	ModTime time.Time
+}
+
+// WriteArchive archives the directory dir, with the regular files and
+// directories in it, to dst encrypted with key. Other files, such as
+// symbolic links, are left out and logged. The permissions of each are
+// kept, and once ctx is done it returns ctx.Err().
+func WriteArchive(ctx context.Context, key []byte, dst io.Writer, dir string, opts ArchiveOptions) error {
+	return pathError("archive", dir, writeArchive(ctx, newKeyCipher(key), dst, dir, opts))
+}
+
+func writeArchive(ctx context.Context, keys *keyCipher, dst io.Writer, dir string, opts ArchiveOptions) error {
+	if info, err := os.Stat(dir); err != nil {
+		return err
+	} else if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		err := writeTar(ctx, pw, dir, opts)
+		pw.CloseWithError(err)
+		done <- err
+	}()
+	err := encryptStream(ctx, AESGCM, keys, dst, pr)
+	pr.CloseWithError(err)
+	return firstError(<-done, err)
+}
+
+// firstError returns the error of the two ends of a pipe that caused the
+// other's, other, which its end failed with once the pipe was closed with
+// cause.
+func firstError(other, cause error) error {
+	if other != nil && !errors.Is(other, cause) {
+		return other
+	}
+	return cause
+}
+
+// writeTar writes the tar of dir to w, compressed.
+func writeTar(ctx context.Context, w io.Writer, dir string, opts ArchiveOptions) error {
+	logger := orNop(opts.Logger)
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	err := filepath.WalkDir(dir, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if name == dir {
+			return nil
+		}
+		switch {
+		case d.IsDir():
+		case !d.Type().IsRegular():
+			logger.Warn("left out of the archive, not a regular file", "path", name)
+			return nil
+		case opts.ImagesOnly && !isImageFile(name):
+			logger.Debug("left out of the archive, not an image", "path", name)
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, name)
+		if err != nil {
+			return err
+		}
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(rel)
+		if d.IsDir() {
+			header.Name += "/"
+			return tw.WriteHeader(header)
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if _, err := io.Copy(tw, f); err != nil {
+			return fmt.Errorf("failed to archive %s: %w", name, err)
+		}
+		return nil
+	})
+	if err == nil {
+		err = tw.Close()
+	}
+	if err == nil {
+		err = gz.Close()
+	}
+	return err
+}
+
+// ListArchive decrypts the archive read from src with key and calls fn
+// with each of its entries in turn, stopping at the first error it returns.
+// The whole archive is read and authenticated, so its entries are only all
+// there when it returns nil.
+func ListArchive(ctx context.Context, key []byte, src io.Reader, fn func(ArchiveEntry) error) error {
+	return readArchive(ctx, newKeyCipher(key), src, func(header *tar.Header, _ io.Reader) error {
+		info := header.FileInfo()
+		return fn(ArchiveEntry{Name: header.Name, Mode: info.Mode(), Size: header.Size, ModTime: header.ModTime})
+	})
+}
+
+// ExtractArchive decrypts the archive read from src with key into the
+// directory dir, which it creates if need be, restoring the permissions
+// of its files and directories. An existing file is left alone, and
+// logged, unless overwrite is set. No entry is written outside dir,
+// whatever its name, and an archive that fails to authenticate, having
+// been modified or truncated, fails once the entries before the damage
+// are extracted.
+func ExtractArchive(ctx context.Context, key []byte, src io.Reader, dir string, overwrite bool, opts ArchiveOptions) error {
+	return pathError("extract", dir, extractArchive(ctx, newKeyCipher(key), src, dir, overwrite, opts))
+}
+
+func extractArchive(ctx context.Context, keys *keyCipher, src io.Reader, dir string, overwrite bool, opts ArchiveOptions) error {
+	logger := orNop(opts.Logger)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		return err
+	}
+	defer root.Close()
+
+	// Directories get their permissions last, as those that cannot be
+	// written would refuse their files
+	type dirMode struct {
+		name string
+		mode fs.FileMode
+	}
+	var dirs []dirMode
+	err = readArchive(ctx, keys, src, func(header *tar.Header, r io.Reader) error {
+		name := path.Clean(strings.TrimSuffix(header.Name, "/"))
+		if !filepath.IsLocal(filepath.FromSlash(name)) {
+			return fmt.Errorf("archive entry %q is outside the directory", header.Name)
+		}
+		name = filepath.FromSlash(name)
+		mode := header.FileInfo().Mode().Perm()
+		switch header.Typeflag {
+		case tar.TypeDir:
+			dirs = append(dirs, dirMode{name, mode})
+			return mkdirAllIn(root, name)
+		case tar.TypeReg:
+			if err := mkdirAllIn(root, filepath.Dir(name)); err != nil {
+				return err
+			}
+			return extractFile(root, name, mode, r, overwrite, logger)
+		}
+		logger.Warn("left out of the extraction, not a regular file", "path", header.Name)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, d := range slices.Backward(dirs) {
+		f, err := root.Open(d.name)
+		if err != nil {
+			return err
+		}
+		err = f.Chmod(d.mode)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// extractFile writes the file name in root, with mode, from r.
+func extractFile(root *os.Root, name string, mode fs.FileMode, r io.Reader, overwrite bool, logger Logger) error {
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if !overwrite {
+		flags |= os.O_EXCL
+	}
+	f, err := root.OpenFile(name, flags, mode)
+	if errors.Is(err, fs.ErrExist) {
+		logger.Warn("file exists, left alone", "path", name)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if err == nil {
+		// The mode it was created with lost the bits the umask has
+		err = f.Chmod(mode)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to extract %s: %w", name, err)
+	}
+	return nil
+}
+
+// mkdirAllIn creates the directory name in root, and any parents it
+// needs.
+func mkdirAllIn(root *os.Root, name string) error {
+	if name == "." {
+		return nil
+	}
+	if info, err := root.Stat(name); err == nil {
+		if !info.IsDir() {
+			return fmt.Errorf("%s is not a directory", name)
+		}
+		return nil
+	}
+	if err := mkdirAllIn(root, filepath.Dir(name)); err != nil {
+		return err
+	}
+	if err := root.Mkdir(name, 0o755); err != nil && !errors.Is(err, fs.ErrExist) {
+		return err
+	}
+	return nil
+}
+
+// readArchive decrypts the archive src as it reads it, calling fn with the
+// header of each entry and the reader of its data, then reads the rest so
+// that the whole of it is authenticated.
+func readArchive(ctx context.Context, keys *keyCipher, src io.Reader, fn func(*tar.Header, io.Reader) error) error {
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		err := decryptStream(ctx, keys, pw, src)
+		pw.CloseWithError(err)
+		done <- err
+	}()
+	err := readTar(pr, fn)
+	pr.CloseWithError(err)
+	return firstError(<-done, err)
+}
+
+// readTar calls fn with each entry of the compressed tar read from r.
+func readTar(r io.Reader, fn func(*tar.Header, io.Reader) error) error {
+	gz, err := gzip.NewReader(r)
+	if errors.Is(err, gzip.ErrHeader) {
+		return errors.New("not an archive")
+	} else if err != nil {
+		return err
+	}
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read archive: %w", err)
+		}
+		if err := fn(header, tr); err != nil {
+			return err
+		}
+	}
+	if _, err := io.Copy(io.Discard, gz); err != nil {
+		return fmt.Errorf("failed to read archive: %w", err)
+	}
+	return gz.Close()
+}
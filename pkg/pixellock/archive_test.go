@@ -0,0 +1,214 @@
+package pixellock
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"image"
+	"image/png"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"testing"
+)
+
+// archiveFixture writes a tree to archive in a temporary directory: nested
+// directories, an empty one, an executable and an image.
+func archiveFixture(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	var img bytes.Buffer
+	png.Encode(&img, image.NewRGBA(image.Rect(0, 0, 4, 4)))
+	for name, data := range map[string][]byte{
+		"notes.txt":          []byte("notes"),
+		"a/b/photo.png":      img.Bytes(),
+		"a/run.sh":           []byte("#!/bin/sh\necho hi\n"),
+		"a/b/c/big.bin":      bytes.Repeat([]byte("pixellock"), 20000),
+		"empty/.placeholder": nil,
+	} {
+		name = filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(name, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.Remove(filepath.Join(dir, "empty", ".placeholder"))
+	if err := os.Chmod(filepath.Join(dir, "a", "run.sh"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// archiveTree returns the files and directories under dir, with their
+// permissions and the data of each file.
+func archiveTree(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	tree := map[string]string{}
+	err := filepath.WalkDir(dir, func(name string, d fs.DirEntry, err error) error {
+		if err != nil || name == dir {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, name)
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		entry := info.Mode().String()
+		if !d.IsDir() {
+			data, err := os.ReadFile(name)
+			if err != nil {
+				return err
+			}
+			entry += " " + string(data)
+		}
+		tree[filepath.ToSlash(rel)] = entry
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tree
+}
+
+func TestArchive(t *testing.T) {
+	key, _ := GenerateRandomKey()
+	dir := archiveFixture(t)
+	var archive bytes.Buffer
+	if err := WriteArchive(t.Context(), key, &archive, dir, ArchiveOptions{}); err != nil {
+		t.Fatalf("WriteArchive failed: %v", err)
+	}
+	if !IsStreamData(archive.Bytes()) || bytes.Contains(archive.Bytes(), []byte("echo hi")) {
+		t.Error("the archive is not encrypted")
+	}
+
+	var names []string
+	err := ListArchive(t.Context(), key, bytes.NewReader(archive.Bytes()), func(e ArchiveEntry) error {
+		names = append(names, e.Name)
+		if e.Name == "a/run.sh" && e.Mode.Perm()&0o111 == 0 {
+			t.Errorf("%s is listed as %v, not executable", e.Name, e.Mode)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("ListArchive failed: %v", err)
+	}
+	want := []string{"a/", "a/b/", "a/b/c/", "a/b/c/big.bin", "a/b/photo.png", "a/run.sh", "empty/", "notes.txt"}
+	if !slices.Equal(names, want) {
+		t.Errorf("listed %v, want %v", names, want)
+	}
+
+	out := filepath.Join(t.TempDir(), "out")
+	if err := ExtractArchive(t.Context(), key, bytes.NewReader(archive.Bytes()), out, false, ArchiveOptions{}); err != nil {
+		t.Fatalf("ExtractArchive failed: %v", err)
+	}
+	got, orig := archiveTree(t, out), archiveTree(t, dir)
+	for name, entry := range orig {
+		if runtime.GOOS == "windows" {
+			break
+		}
+		if got[name] != entry {
+			t.Errorf("%s extracted as %.40q, want %.40q", name, got[name], entry)
+		}
+	}
+	if len(got) != len(orig) {
+		t.Errorf("extracted %d entries, want %d", len(got), len(orig))
+	}
+
+	// Existing files are left alone without overwrite
+	notes := filepath.Join(out, "notes.txt")
+	os.WriteFile(notes, []byte("changed"), 0o644)
+	var logged recordingLogger
+	if err := ExtractArchive(t.Context(), key, bytes.NewReader(archive.Bytes()), out, false, ArchiveOptions{Logger: &logged}); err != nil {
+		t.Fatalf("ExtractArchive failed: %v", err)
+	}
+	if data, _ := os.ReadFile(notes); string(data) != "changed" {
+		t.Error("an existing file was overwritten")
+	}
+	if !logged.has("warn: file exists, left alone notes.txt") {
+		t.Errorf("the file left alone was not logged: %v", logged.records)
+	}
+	if err := ExtractArchive(t.Context(), key, bytes.NewReader(archive.Bytes()), out, true, ArchiveOptions{}); err != nil {
+		t.Fatalf("ExtractArchive failed: %v", err)
+	}
+	if data, _ := os.ReadFile(notes); string(data) != "notes" {
+		t.Error("an existing file was not overwritten")
+	}
+}
+
+func TestArchiveImagesOnly(t *testing.T) {
+	key, _ := GenerateRandomKey()
+	dir := archiveFixture(t)
+	var archive bytes.Buffer
+	if err := WriteArchive(t.Context(), key, &archive, dir, ArchiveOptions{ImagesOnly: true}); err != nil {
+		t.Fatalf("WriteArchive failed: %v", err)
+	}
+	var files []string
+	ListArchive(t.Context(), key, &archive, func(e ArchiveEntry) error {
+		if !e.Mode.IsDir() {
+			files = append(files, e.Name)
+		}
+		return nil
+	})
+	if want := []string{"a/b/photo.png"}; !slices.Equal(files, want) {
+		t.Errorf("archived %v, want %v", files, want)
+	}
+}
+
+func TestArchiveDamaged(t *testing.T) {
+	key, _ := GenerateRandomKey()
+	var archive bytes.Buffer
+	if err := WriteArchive(t.Context(), key, &archive, archiveFixture(t), ArchiveOptions{}); err != nil {
+		t.Fatalf("WriteArchive failed: %v", err)
+	}
+	list := func(data []byte, key []byte) error {
+		return ListArchive(t.Context(), key, bytes.NewReader(data), func(ArchiveEntry) error { return nil })
+	}
+
+	other, _ := GenerateRandomKey()
+	if err := list(archive.Bytes(), other); !errors.Is(err, ErrAuthenticationFailed) {
+		t.Errorf("ListArchive with another key = %v, want ErrAuthenticationFailed", err)
+	}
+	truncated := archive.Bytes()[:archive.Len()-100]
+	if err := list(truncated, key); !errors.Is(err, ErrAuthenticationFailed) {
+		t.Errorf("ListArchive of a truncated archive = %v, want ErrAuthenticationFailed", err)
+	}
+	var stream bytes.Buffer
+	EncryptStream(t.Context(), key, &stream, bytes.NewReader([]byte("not a tar")))
+	if err := list(stream.Bytes(), key); err == nil {
+		t.Error("ListArchive of a stream that is not an archive succeeded")
+	}
+	if err := list([]byte("plain"), key); !errors.Is(err, ErrNotEncryptedFile) {
+		t.Errorf("ListArchive of plain data = %v, want ErrNotEncryptedFile", err)
+	}
+}
+
+func TestExtractArchiveOutside(t *testing.T) {
+	key, _ := GenerateRandomKey()
+	for _, name := range []string{"../evil.txt", "/evil.txt", "a/../../evil.txt"} {
+		var plain bytes.Buffer
+		gz := gzip.NewWriter(&plain)
+		tw := tar.NewWriter(gz)
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: 4, Typeflag: tar.TypeReg})
+		tw.Write([]byte("evil"))
+		tw.Close()
+		gz.Close()
+		var archive bytes.Buffer
+		if err := EncryptStream(t.Context(), key, &archive, &plain); err != nil {
+			t.Fatal(err)
+		}
+
+		parent := t.TempDir()
+		out := filepath.Join(parent, "out")
+		if err := ExtractArchive(t.Context(), key, &archive, out, false, ArchiveOptions{}); err == nil {
+			t.Errorf("extracting %s succeeded", name)
+		}
+		if _, err := os.Stat(filepath.Join(parent, "evil.txt")); err == nil {
+			t.Errorf("%s was written outside the directory", name)
+		}
+	}
+}
@@ -0,0 +1,7 @@
+package pixellock
+
+// AVIF images can be loaded, and so encrypted, hidden in and analyzed, but
+// not written: SaveImage has no AVIF encoder, so decrypting an AVIF gives a
+// PNG or JPEG. The decoder runs libavif compiled to WebAssembly, or the
+// system libavif when one is installed, so no cgo is needed.
+import _ "github.com/gen2brain/avif" // Register the AVIF decoder with image.Decode
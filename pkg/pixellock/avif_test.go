@@ -0,0 +1,73 @@
+package pixellock
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// The fixture is a 32x24 gradient, lossy encoded, so it is compared with
+// its own decoding rather than the gradient.
+const avifFixture = "testdata/gradient.avif"
+
+func TestAVIFDecode(t *testing.T) {
+	if !isImageFile(avifFixture) {
+		t.Error("isImageFile should return true for AVIF file")
+	}
+	if format, err := DetectImageFormat(avifFixture); err != nil || format != "avif" {
+		t.Errorf("DetectImageFormat = %q, %v; want avif", format, err)
+	}
+	img, err := LoadImage(avifFixture)
+	if err != nil {
+		t.Fatalf("LoadImage failed: %v", err)
+	}
+	if size := img.Bounds().Size(); size.X != 32 || size.Y != 24 {
+		t.Errorf("decoded size %v, want 32x24", size)
+	}
+}
+
+func TestAVIFEncryptDecrypt(t *testing.T) {
+	want, err := LoadImage(avifFixture)
+	if err != nil {
+		t.Fatalf("LoadImage failed: %v", err)
+	}
+	key, err := GenerateRandomKey()
+	if err != nil {
+		t.Fatalf("GenerateRandomKey failed: %v", err)
+	}
+	tempDir := t.TempDir()
+	encrypted := filepath.Join(tempDir, "photo.avif.enc")
+	if err := EncryptFile(t.Context(), avifFixture, encrypted, key, false, EncryptOptions{Metadata: MetadataPreserve}); err != nil {
+		t.Fatalf("EncryptFile failed: %v", err)
+	}
+	ciphertext, err := os.ReadFile(encrypted)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	plaintext, err := decryptData(newKeyCipher(key), skipFormat(ciphertext))
+	if err != nil {
+		t.Fatalf("decryptData failed: %v", err)
+	}
+	if format := recordedFormat(plaintext); format != "avif" {
+		t.Errorf("recorded format %q, want avif", format)
+	}
+
+	// With no AVIF encoder, the original format falls back to PNG.
+	for _, outputFormat := range []string{"png", OriginalOutputFormat} {
+		decrypted := filepath.Join(tempDir, outputFormat+".png")
+		if err := DecryptFile(t.Context(), encrypted, decrypted, key, false, SaveOptions{Format: outputFormat}); err != nil {
+			t.Fatalf("DecryptFile(t.Context(), %s) failed: %v", outputFormat, err)
+		}
+		if format, err := DetectImageFormat(decrypted); err != nil || format != "png" {
+			t.Errorf("%s: decrypted format %q, %v; want png", outputFormat, format, err)
+		}
+		got, err := LoadImage(decrypted)
+		if err != nil {
+			t.Fatalf("LoadImage failed: %v", err)
+		}
+		if !bytes.Equal(asNRGBA(got).Pix, asNRGBA(want).Pix) {
+			t.Errorf("%s: decrypted image differs from the decoded AVIF", outputFormat)
+		}
+	}
+}
@@ -0,0 +1,246 @@
+package pixellock
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"path/filepath"
+	"sync"
+)
+
+// A BatchSource produces the paths of a batch, calling yield with each in
+// turn until it returns false, which it does once ctx is done. It returns
+// why it could not produce them all, if it could not.
+type BatchSource func(ctx context.Context, yield func(path string) bool) error
+
+// FileSource returns a source of paths, in order.
+func FileSource(paths []string) BatchSource {
+	return func(ctx context.Context, yield func(string) bool) error {
+		for _, path := range paths {
+			if !yield(path) {
+				return ctx.Err()
+			}
+		}
+		return nil
+	}
+}
+
+// ChannelSource returns a source of the paths received from paths, until
+// it is closed.
+func ChannelSource(paths <-chan string) BatchSource {
+	return func(ctx context.Context, yield func(string) bool) error {
+		for {
+			select {
+			case path, ok := <-paths:
+				if !ok {
+					return nil
+				}
+				if !yield(path) {
+					return ctx.Err()
+				}
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+}
+
+// WalkSource returns a source of the files in dir, and in its
+// subdirectories when recursive is set, in walk order. When match is not
+// nil, only the files it accepts are produced.
+func WalkSource(dir string, recursive bool, match func(path string, info fs.FileInfo) bool) BatchSource {
+	return WalkSourceFS(OSFS{}, dir, recursive, match)
+}
+
+// WalkSourceFS is WalkSource for a directory of fsys. The paths produced
+// join dir and the names under it as filepath.Join does, keeping an
+// s3:// URL whole.
+func WalkSourceFS(fsys FileSystem, dir string, recursive bool, match func(path string, info fs.FileInfo) bool) BatchSource {
+	return func(ctx context.Context, yield func(string) bool) error {
+		return walkDir(fsys, dir, func(path string, info fs.FileInfo) error {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if info.IsDir() {
+				if path != dir && !recursive {
+					return filepath.SkipDir // Skip subdirectories if not recursive
+				}
+				return nil
+			}
+			if match != nil && !match(path, info) {
+				return nil
+			}
+			if !yield(path) {
+				return ctx.Err()
+			}
+			return nil
+		})
+	}
+}
+
+// walkDir calls fn with dir and everything under it in fsys, in lexical
+// order, as filepath.Walk does, stopping at the first error but skipping
+// a directory for filepath.SkipDir.
+func walkDir(fsys FileSystem, dir string, fn func(path string, info fs.FileInfo) error) error {
+	info, err := fsys.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if err := fn(dir, info); err != nil || !info.IsDir() {
+		if err == filepath.SkipDir {
+			return nil
+		}
+		return err
+	}
+	entries, err := fsys.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		path := joinName(dir, entry.Name())
+		if info.IsDir() {
+			err = walkDir(fsys, path, fn)
+		} else {
+			err = fn(path, info)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// collectSource returns the paths produced by source.
+func collectSource(ctx context.Context, source BatchSource) ([]string, error) {
+	var paths []string
+	err := source(ctx, func(path string) bool {
+		paths = append(paths, path)
+		return ctx.Err() == nil
+	})
+	return paths, err
+}
+
+// BatchResult is the outcome of a batch for one path.
+type BatchResult struct {
+	Input  string
+	Output string // What the operation wrote, if it says
+	Err    error
+}
+
+// BatchSummary is the outcome of a whole batch.
+type BatchSummary struct {
+	Succeeded int // Paths the operation succeeded on
+	Failed    int // Paths it failed on
+
+	// Failures joins the errors of the paths that failed, each a
+	// *PathError naming its path, or is nil when none did.
+	Failures error
+
+	// Err is why the batch stopped before the source was done: ctx.Err()
+	// or the source's error. The paths not reached are in neither count.
+	Err error
+}
+
+// A BatchProcessor runs an operation on each path of a source, on a
+// bounded pool of workers.
+type BatchProcessor struct {
+	Source BatchSource
+
+	// Operation processes the file at path, returning what it wrote, if
+	// anything, and why it failed. Once ctx is done it should return
+	// soon, with ctx.Err(). It is called by several goroutines at once. A
+	// panic fails the path with a *PanicError, and the batch goes on.
+	Operation func(ctx context.Context, path string) (output string, err error)
+
+	// Op names the operation in the errors of Failures; "process" when
+	// empty.
+	Op string
+
+	// Workers is the number of paths processed at once;
+	// runtime.NumCPU() when 0.
+	Workers int
+}
+
+// Run starts the batch, returning the results of the paths, in the order
+// they finish, and a function that waits for the batch to end and returns
+// its summary. The results must be received until the channel is closed,
+// which it is before the summary is returned. Once ctx is done no more
+// paths are started, and the operations running are left to return.
+func (b *BatchProcessor) Run(ctx context.Context) (<-chan BatchResult, func() BatchSummary) {
+	op := b.Op
+	if op == "" {
+		op = "process"
+	}
+	paths := make(chan string)
+	results := make(chan BatchResult)
+	done := make(chan struct{})
+	var (
+		summary   BatchSummary
+		failures  []error
+		sourceErr error
+		mu        sync.Mutex
+		wg        sync.WaitGroup
+	)
+
+	// The source feeds the workers until it is done, or ctx is
+	go func() {
+		defer close(paths)
+		sourceErr = b.Source(ctx, func(path string) bool {
+			select {
+			case paths <- path:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		})
+	}()
+
+	for range workerCount(b.Workers) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for path := range paths {
+				if ctx.Err() != nil {
+					continue // Drain the paths already given, without starting them
+				}
+				output, err := b.operate(ctx, path)
+				mu.Lock()
+				switch {
+				case err == nil:
+					summary.Succeeded++
+				case ctx.Err() != nil && errors.Is(err, ctx.Err()):
+					// Abandoned, not failed
+				default:
+					summary.Failed++
+					failures = append(failures, pathError(op, path, err))
+				}
+				mu.Unlock()
+				results <- BatchResult{Input: path, Output: output, Err: err}
+			}
+		}()
+	}
+	go func() {
+		defer close(done)
+		wg.Wait()
+		summary.Failures = errors.Join(failures...)
+		summary.Err = sourceErr
+		if ctx.Err() != nil {
+			summary.Err = ctx.Err()
+		}
+		close(results)
+	}()
+	return results, func() BatchSummary {
+		<-done
+		return summary
+	}
+}
+
+// operate calls the operation on path, recovering a panic as a *PanicError.
+func (b *BatchProcessor) operate(ctx context.Context, path string) (output string, err error) {
+	defer recoverPanic(&err)
+	return b.Operation(ctx, path)
+}
@@ -0,0 +1,190 @@
+package pixellock
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// runBatch runs b, returning its results sorted by input, and its summary.
+func runBatch(ctx context.Context, b *BatchProcessor) ([]BatchResult, BatchSummary) {
+	results, wait := b.Run(ctx)
+	var got []BatchResult
+	for r := range results {
+		got = append(got, r)
+	}
+	slices.SortFunc(got, func(a, b BatchResult) int { return strings.Compare(a.Input, b.Input) })
+	return got, wait()
+}
+
+// numberedPaths returns the paths p00 to p(n-1).
+func numberedPaths(n int) []string {
+	paths := make([]string, n)
+	for i := range paths {
+		paths[i] = fmt.Sprintf("p%02d", i)
+	}
+	return paths
+}
+
+func TestBatchProcessorConcurrency(t *testing.T) {
+	defer checkGoroutines(t)()
+	var inFlight, maxInFlight atomic.Int32
+	b := &BatchProcessor{
+		Source:  FileSource(numberedPaths(24)),
+		Workers: 3,
+		Operation: func(ctx context.Context, path string) (string, error) {
+			n := inFlight.Add(1)
+			defer inFlight.Add(-1)
+			for m := maxInFlight.Load(); n > m && !maxInFlight.CompareAndSwap(m, n); m = maxInFlight.Load() {
+			}
+			time.Sleep(5 * time.Millisecond)
+			return path + ".out", nil
+		},
+	}
+	results, summary := runBatch(t.Context(), b)
+	if maxInFlight.Load() != 3 {
+		t.Errorf("%d paths processed at once, want 3", maxInFlight.Load())
+	}
+	if len(results) != 24 || summary.Succeeded != 24 || summary.Failed != 0 || summary.Failures != nil || summary.Err != nil {
+		t.Fatalf("%d results, summary %+v; want 24 successes", len(results), summary)
+	}
+	for i, r := range results {
+		if want := numberedPaths(24)[i]; r.Input != want || r.Output != want+".out" || r.Err != nil {
+			t.Errorf("result %+v, want %s written to %s.out", r, want, want)
+		}
+	}
+}
+
+func TestBatchProcessorErrors(t *testing.T) {
+	errOdd := errors.New("odd")
+	b := &BatchProcessor{
+		Source: FileSource(numberedPaths(10)),
+		Op:     "encrypt",
+		Operation: func(ctx context.Context, path string) (string, error) {
+			if path[len(path)-1]%2 == 1 {
+				return "", errOdd
+			}
+			if path == "p04" {
+				return "", ErrUnsupportedFormat
+			}
+			return path, nil
+		},
+	}
+	results, summary := runBatch(t.Context(), b)
+
+	// A failure does not stop the others, and each is in the summary
+	if len(results) != 10 || summary.Succeeded != 4 || summary.Failed != 6 || summary.Err != nil {
+		t.Fatalf("%d results, summary %+v; want 4 successes and 6 failures", len(results), summary)
+	}
+	if !errors.Is(summary.Failures, errOdd) || !errors.Is(summary.Failures, ErrUnsupportedFormat) {
+		t.Errorf("failures %v do not match the errors returned", summary.Failures)
+	}
+	var pe *PathError
+	if !errors.As(summary.Failures, &pe) || pe.Op != "encrypt" {
+		t.Errorf("failures %v are not PathErrors for encrypt", summary.Failures)
+	}
+	for _, r := range results {
+		if (r.Err != nil) != (r.Input[len(r.Input)-1]%2 == 1 || r.Input == "p04") {
+			t.Errorf("result %+v", r)
+		}
+	}
+
+	// The source's error ends the batch, after the paths it gave
+	errSource := errors.New("source failed")
+	b.Source = func(ctx context.Context, yield func(string) bool) error {
+		yield("p00")
+		return errSource
+	}
+	results, summary = runBatch(t.Context(), b)
+	if len(results) != 1 || summary.Succeeded != 1 || !errors.Is(summary.Err, errSource) {
+		t.Errorf("%d results, summary %+v; want one success and the source's error", len(results), summary)
+	}
+}
+
+func TestBatchProcessorCancel(t *testing.T) {
+	defer checkGoroutines(t)()
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+
+	// An endless channel of paths, cancelled after a few are done
+	paths := make(chan string)
+	go func() {
+		defer close(paths)
+		for i := 0; ; i++ {
+			select {
+			case paths <- fmt.Sprint(i):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	var started atomic.Int32
+	b := &BatchProcessor{
+		Source:  ChannelSource(paths),
+		Workers: 2,
+		Operation: func(ctx context.Context, path string) (string, error) {
+			if started.Add(1) == 5 {
+				cancel()
+			}
+			select {
+			case <-ctx.Done():
+				return "", fmt.Errorf("abandoned: %w", ctx.Err())
+			case <-time.After(time.Millisecond):
+				return path, nil
+			}
+		},
+	}
+	results, summary := runBatch(ctx, b)
+
+	// Nothing is started once ctx is done, and the abandoned paths are
+	// not failures
+	if n := started.Load(); n > 6 {
+		t.Errorf("%d paths started, want at most 6", n)
+	}
+	if len(results) != int(started.Load()) {
+		t.Errorf("%d results for %d paths started", len(results), started.Load())
+	}
+	if summary.Err != context.Canceled || summary.Failed != 0 || summary.Failures != nil {
+		t.Errorf("summary %+v, want context.Canceled and no failures", summary)
+	}
+	if summary.Succeeded > len(results) || summary.Succeeded < 4 {
+		t.Errorf("%d successes of %d results", summary.Succeeded, len(results))
+	}
+}
+
+func TestWalkSource(t *testing.T) {
+	fsys, dir := &MemFS{}, "walk"
+	for _, name := range []string{"a.png", "b.txt", "sub/c.png"} {
+		memWrite(t, fsys, filepath.Join(dir, name), nil)
+	}
+	png := func(path string, info fs.FileInfo) bool { return filepath.Ext(path) == ".png" }
+
+	for _, test := range []struct {
+		recursive bool
+		match     func(string, fs.FileInfo) bool
+		want      []string
+	}{
+		{false, nil, []string{"a.png", "b.txt"}},
+		{false, png, []string{"a.png"}},
+		{true, png, []string{"a.png", "sub/c.png"}},
+	} {
+		got, err := collectSource(t.Context(), WalkSourceFS(fsys, dir, test.recursive, test.match))
+		if err != nil {
+			t.Fatalf("WalkSourceFS failed: %v", err)
+		}
+		for i := range got {
+			got[i], _ = filepath.Rel(dir, got[i])
+			got[i] = filepath.ToSlash(got[i])
+		}
+		if !slices.Equal(got, test.want) {
+			t.Errorf("WalkSourceFS(recursive %t) = %v, want %v", test.recursive, got, test.want)
+		}
+	}
+}
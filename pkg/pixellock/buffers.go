@@ -0,0 +1,80 @@
+package pixellock
+
+import (
+	"bytes"
+	"image"
+	"io"
+	"sync"
+)
+
+// maxPooledBuffer bounds the buffers kept for reuse, so that one huge image
+// does not hold its memory for the rest of a batch.
+const maxPooledBuffer = 64 << 20
+
+// imageBuffers holds the buffers images are read and encoded into for
+// encryption, shared by the workers of a directory, so that a batch reuses
+// them rather than leaving a file's worth of garbage per image.
+var imageBuffers sync.Pool
+
+// getImageBuffer returns an empty buffer from imageBuffers with room for
+// at least size bytes. A buffer larger than imageBuffers keeps is made to
+// size, as growing one to it would take up to twice that.
+func getImageBuffer(size int) *bytes.Buffer {
+	if size > maxPooledBuffer {
+		return bytes.NewBuffer(make([]byte, 0, size))
+	}
+	buf, _ := imageBuffers.Get().(*bytes.Buffer)
+	if buf == nil {
+		buf = new(bytes.Buffer)
+	}
+	buf.Reset()
+	buf.Grow(size)
+	return buf
+}
+
+// putImageBuffer returns buf to imageBuffers. Nothing may use buf, or any
+// bytes it gave, afterwards: every write of them must have returned.
+func putImageBuffer(buf *bytes.Buffer) {
+	if buf.Cap() <= maxPooledBuffer {
+		imageBuffers.Put(buf)
+	}
+}
+
+// encodedSizeHint is the room to make for an image of bounds r encoded as
+// a fast PNG, which is seldom more than its pixels at 8 bits per channel.
+func encodedSizeHint(r image.Rectangle) int {
+	return r.Dx() * r.Dy() * 4
+}
+
+// readImageBuffer reads r to its end into a buffer from imageBuffers, with
+// room for size bytes made first.
+func readImageBuffer(r io.Reader, size int64) (*bytes.Buffer, error) {
+	buf := getImageBuffer(int(size) + bytes.MinRead)
+	if _, err := buf.ReadFrom(r); err != nil {
+		putImageBuffer(buf)
+		return nil, err
+	}
+	return buf, nil
+}
+
+// chunkBuffers holds the buffers streams read and seal their chunks in.
+var chunkBuffers sync.Pool
+
+// getChunkBuffer returns a buffer of n bytes from chunkBuffers.
+func getChunkBuffer(n int) *[]byte {
+	if b, _ := chunkBuffers.Get().(*[]byte); b != nil && cap(*b) >= n {
+		*b = (*b)[:n]
+		return b
+	}
+	b := make([]byte, n)
+	return &b
+}
+
+// putChunkBuffer returns b to chunkBuffers, once nothing uses it. The
+// buffers of streams with chunks larger than EncryptStream writes are left
+// to the garbage collector.
+func putChunkBuffer(b *[]byte) {
+	if cap(*b) <= 2*streamChunkSize {
+		chunkBuffers.Put(b)
+	}
+}
@@ -0,0 +1,85 @@
+package pixellock
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"math/rand/v2"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime/debug"
+	"strings"
+	"testing"
+)
+
+// peakMemoryEnv names the image TestPeakMemory encrypts and decrypts in
+// the process it starts to measure.
+const peakMemoryEnv = "PIXELLOCK_PEAK_MEMORY_IMAGE"
+
+// TestPeakMemory encrypts and decrypts an image of noise, which no PNG
+// compresses, in a process of its own, with the garbage collector held
+// back to a memory limit of twice the image's pixels, and checks the most
+// memory the process held. Encoding the image whole beside the file read,
+// as encryption did, or decrypting it whole beside the image, takes three
+// times the pixels; a process doing so holds more than the limit.
+func TestPeakMemory(t *testing.T) {
+	if name := os.Getenv(peakMemoryEnv); name != "" {
+		key := make([]byte, KeySize)
+		encrypted := name + EncryptedExtension
+		if err := EncryptFile(t.Context(), name, encrypted, key, true, EncryptOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		if err := DecryptFile(t.Context(), encrypted, name+".out.png", key, true, SaveOptions{PNGCompression: PNGCompressionNone}); err != nil {
+			t.Fatal(err)
+		}
+		// The peak of the process's own memory, which unlike its resource
+		// usage leaves out that of the process it was started from
+		status, err := os.ReadFile("/proc/self/status")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var peak int64
+		for line := range strings.Lines(string(status)) {
+			if _, err := fmt.Sscanf(line, "VmHWM: %d kB", &peak); err == nil {
+				break
+			}
+		}
+		peak <<= 10
+		if limit := debug.SetMemoryLimit(-1); peak > limit+48<<20 {
+			t.Errorf("held %d MiB, over the limit of %d MiB", peak>>20, limit>>20)
+		}
+		t.Logf("held %d MiB", peak>>20)
+		return
+	}
+	if testing.Short() {
+		t.Skip("encrypts an image of 144 MB")
+	}
+	if raceEnabled {
+		t.Skip("the race detector's memory counts toward the peak")
+	}
+
+	const side = 6000
+	img := image.NewNRGBA(image.Rect(0, 0, side, side))
+	rng := rand.New(rand.NewPCG(1, 2))
+	for i := range img.Pix {
+		img.Pix[i] = byte(rng.Uint32())
+	}
+	pixels := int64(len(img.Pix))
+	name := filepath.Join(t.TempDir(), "noise.png")
+	var buf bytes.Buffer
+	if err := EncodePNG(&buf, img, PNGCompressionNone); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(name, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestPeakMemory$", "-test.v")
+	cmd.Env = append(os.Environ(), peakMemoryEnv+"="+name, "GOGC=off", fmt.Sprintf("GOMEMLIMIT=%d", 2*pixels+32<<20))
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("encrypting and decrypting %d MiB of pixels failed: %v\n%s", pixels>>20, err, out)
+	}
+	t.Logf("encrypting and decrypting %d MiB of pixels:\n%s", pixels>>20, out)
+}
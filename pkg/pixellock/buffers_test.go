@@ -0,0 +1,189 @@
+package pixellock
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// benchBatchFixture writes n distinct images of size by size pixels to the
+// directory in of dir, returning it and the bytes of their pixels.
+func benchBatchFixture(tb testing.TB, dir string, n, size int) (string, int64) {
+	tb.Helper()
+	in := filepath.Join(dir, "in")
+	if err := os.MkdirAll(in, 0755); err != nil {
+		tb.Fatal(err)
+	}
+	var total int64
+	for i := range n {
+		img := image.NewNRGBA(image.Rect(0, 0, size, size))
+		for j := range img.Pix {
+			img.Pix[j] = byte(j/4%size + j*(i+3)%11) // Gradient with some noise
+		}
+		name := filepath.Join(in, fmt.Sprintf("img%d.png", i))
+		if err := SaveImage(name, img, SaveOptions{Format: "png"}); err != nil {
+			tb.Fatal(err)
+		}
+		total += int64(len(img.Pix))
+	}
+	return in, total
+}
+
+// TestPooledBuffers encrypts distinct images on several workers, twice,
+// so that pooled buffers are reused, and checks that each decrypts to its
+// own pixels, as it would not were a buffer reused while still written.
+func TestPooledBuffers(t *testing.T) {
+	key, _ := GenerateRandomKey()
+	fsys := &MemFS{}
+	images := make([]*image.NRGBA, 12)
+	for i := range images {
+		images[i] = image.NewNRGBA(image.Rect(0, 0, 40+i, 30))
+		for j := range images[i].Pix {
+			images[i].Pix[j] = byte(j * (i + 1))
+		}
+		memImage(t, fsys, filepath.Join("in", fmt.Sprintf("img%d.png", i)), images[i])
+	}
+	for range 2 {
+		if err := EncryptDirectory(t.Context(), "in", "enc", key, false, true, EncryptOptions{Workers: 4, FS: fsys}); err != nil {
+			t.Fatalf("EncryptDirectory failed: %v", err)
+		}
+		if err := DecryptDirectory(t.Context(), "enc", "dec", key, false, EncryptedExtension, true, SaveOptions{Workers: 4, FS: fsys}); err != nil {
+			t.Fatalf("DecryptDirectory failed: %v", err)
+		}
+		for i, want := range images {
+			got, err := LoadImageFS(fsys, filepath.Join("dec", fmt.Sprintf("img%d.png", i)))
+			if err != nil || !samePixels(got, want) {
+				t.Errorf("img%d.png does not decrypt to its pixels: %v", i, err)
+			}
+		}
+	}
+
+	// What is returned to callers is theirs, not the pool's
+	dir := t.TempDir()
+	name := filepath.Join(dir, "img.png")
+	createImageFile(t, name)
+	first, err := ReadImageForEncryption(name, MetadataPreserve)
+	if err != nil {
+		t.Fatalf("ReadImageForEncryption failed: %v", err)
+	}
+	want := bytes.Clone(first)
+	second, _ := ReadImageForEncryption(name, MetadataPreserve)
+	clear(second)
+	if !bytes.Equal(first, want) {
+		t.Error("ReadImageForEncryption returned memory it reused")
+	}
+}
+
+// TestPlainImageEncode checks that an image encoded for encryption as it
+// is written has the bytes it had encoded whole, with its format and EXIF
+// metadata added after, so that deduplication finds it the same.
+func TestPlainImageEncode(t *testing.T) {
+	img, exif := redTestImage(), gpsEXIF()
+	var buf bytes.Buffer
+	if err := EncodePNG(&buf, img, PNGCompressionFast); err != nil {
+		t.Fatalf("EncodePNG failed: %v", err)
+	}
+	want, err := SetOriginalFormat(buf.Bytes(), "jpeg")
+	if err == nil {
+		want, err = AttachEXIF(want, "png", exif)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got bytes.Buffer
+	if err := (plainImage{img: img, format: "jpeg", exif: exif}).encode(&got); err != nil {
+		t.Fatalf("encode failed: %v", err)
+	}
+	if !bytes.Equal(got.Bytes(), want) {
+		t.Error("encode differs from the image encoded whole")
+	}
+
+	// The chunks followed across writes of a byte, less the image data,
+	// are what ReadEXIF and ResolveOutputFormat read
+	var chunks bytes.Buffer
+	w := &pngChunkWriter{w: &chunks, skip: func(typ string) bool { return typ == "IDAT" }}
+	for i := range want {
+		w.Write(want[i : i+1])
+	}
+	if got, _ := ReadEXIF(chunks.Bytes()); !bytes.Equal(got, exif) {
+		t.Error("the chunks but the image data lost the EXIF metadata")
+	}
+	if format, _, _ := ResolveOutputFormat(chunks.Bytes(), ""); format != "jpeg" {
+		t.Errorf("the chunks but the image data give the format %q, want jpeg", format)
+	}
+	if config, _, err := image.DecodeConfig(bytes.NewReader(chunks.Bytes())); err != nil || config.Width != img.Bounds().Dx() {
+		t.Errorf("the chunks but the image data give %+v, %v", config, err)
+	}
+}
+
+// BenchmarkEncryptBatch encrypts a directory of images on parallel
+// workers, as a batch was before buffers were pooled, allocating every
+// buffer afresh and the whole ciphertext at once, and as EncryptDirectory
+// does now.
+func BenchmarkEncryptBatch(b *testing.B) {
+	key, _ := GenerateRandomKey()
+	dir := b.TempDir()
+	in, size := benchBatchFixture(b, dir, 16, 512)
+	out := filepath.Join(dir, "out")
+	os.MkdirAll(out, 0755)
+	paths, err := collectSource(b.Context(), WalkSource(in, false, nil))
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	pipelines := []struct {
+		name    string
+		encrypt func() error
+	}{
+		{"unpooled", func() error {
+			batch := BatchProcessor{
+				Source: FileSource(paths),
+				Operation: func(ctx context.Context, path string) (string, error) {
+					raw, err := os.ReadFile(path)
+					if err != nil {
+						return "", err
+					}
+					img, format, err := image.Decode(bytes.NewReader(raw))
+					if err != nil {
+						return "", err
+					}
+					data, err := ImageToBytes(img)
+					if err != nil {
+						return "", err
+					}
+					if data, err = SetOriginalFormat(data, format); err != nil {
+						return "", err
+					}
+					ciphertext, err := Encrypt(key, data)
+					if err != nil {
+						return "", err
+					}
+					output := filepath.Join(out, filepath.Base(path)+EncryptedExtension)
+					return output, os.WriteFile(output, ciphertext, 0644)
+				},
+			}
+			results, wait := batch.Run(b.Context())
+			for range results {
+			}
+			return wait().Failures
+		}},
+		{"EncryptDirectory", func() error {
+			return EncryptDirectory(b.Context(), in, out, key, false, true, EncryptOptions{})
+		}},
+	}
+	for _, p := range pipelines {
+		b.Run(p.name, func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(size)
+			for i := 0; i < b.N; i++ {
+				if err := p.encrypt(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,175 @@
+package pixellock
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"fmt"
+	"sync"
+)
+
+// A CipherSuite is an authenticated cipher that streams can be encrypted
+// with. Its ID is recorded in the header of each stream, and picks the
+// suite the stream is decrypted with, so a suite's ID must never change
+// once files have been encrypted with it. A suite may also have a Name
+// method, giving the name CipherName reports it by.
+type CipherSuite interface {
+	// ID identifies the suite in stream headers. It is not zero.
+	ID() byte
+
+	// KeySize is the size of the keys the suite takes, both the user's
+	// key and the data key of each stream.
+	KeySize() int
+
+	// NewAEAD returns the cipher for key, whose nonces must be at least
+	// minSuiteNonceSize bytes. The files of a batch share the cipher of
+	// the user's key, so it must be safe for several goroutines to use at
+	// once, as the ciphers of crypto/cipher are.
+	NewAEAD(key []byte) (cipher.AEAD, error)
+}
+
+// minSuiteNonceSize is the smallest nonce a suite can have: a stream's
+// chunk nonces hold a 64-bit index and a flag.
+const minSuiteNonceSize = 12
+
+// AESGCM is the AES-256 GCM suite, which Encrypt, and EncryptStream unless
+// given another, use.
+var AESGCM CipherSuite = aesGCMSuite{}
+
+// aesGCMSuite is the CipherSuite of AES-256 GCM.
+type aesGCMSuite struct{}
+
+func (aesGCMSuite) ID() byte     { return 1 }
+func (aesGCMSuite) KeySize() int { return KeySize }
+func (aesGCMSuite) Name() string { return "aes-256-gcm" }
+
+func (aesGCMSuite) NewAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	aesGCM, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create GCM: %w", err)
+	}
+	return aesGCM, nil
+}
+
+// UnsupportedCipherError is returned for a stream encrypted with a cipher
+// suite that is not registered, such as one added by a later version.
+type UnsupportedCipherError struct {
+	ID byte
+}
+
+func (e *UnsupportedCipherError) Error() string {
+	return fmt.Sprintf("unsupported cipher %d; upgrade pixellock to decrypt this file", e.ID)
+}
+
+// ErrorCode returns CodeUnsupportedCipher, the code ErrorCodeOf gives e.
+func (e *UnsupportedCipherError) ErrorCode() ErrorCode {
+	return CodeUnsupportedCipher
+}
+
+var (
+	cipherSuitesMu sync.RWMutex
+	cipherSuites   = map[byte]CipherSuite{}
+)
+
+func init() {
+	RegisterCipherSuite(AESGCM)
+}
+
+// RegisterCipherSuite makes suite available to decrypt the streams whose
+// header names its ID. It panics if the ID is zero or taken already, as
+// two suites cannot share one.
+func RegisterCipherSuite(suite CipherSuite) {
+	cipherSuitesMu.Lock()
+	defer cipherSuitesMu.Unlock()
+	id := suite.ID()
+	if id == 0 {
+		panic("pixellock: cipher suite ID 0 is reserved")
+	}
+	if _, ok := cipherSuites[id]; ok {
+		panic(fmt.Sprintf("pixellock: cipher suite %d registered twice", id))
+	}
+	cipherSuites[id] = suite
+}
+
+// LookupCipherSuite returns the suite registered with id, or an
+// *UnsupportedCipherError if there is none.
+func LookupCipherSuite(id byte) (CipherSuite, error) {
+	cipherSuitesMu.RLock()
+	defer cipherSuitesMu.RUnlock()
+	suite, ok := cipherSuites[id]
+	if !ok {
+		return nil, &UnsupportedCipherError{ID: id}
+	}
+	return suite, nil
+}
+
+// CipherName returns the name of suite in events and metrics: the one its
+// Name method gives, or "cipher-" and its ID when it has none.
+func CipherName(suite CipherSuite) string {
+	if named, ok := suite.(interface{ Name() string }); ok {
+		return named.Name()
+	}
+	return fmt.Sprintf("cipher-%d", suite.ID())
+}
+
+// cipherName is CipherName, or "" for a nil suite.
+func cipherName(suite CipherSuite) string {
+	if suite == nil {
+		return ""
+	}
+	return CipherName(suite)
+}
+
+// newSuiteAEAD returns the cipher of suite for key, checking the key and
+// nonce sizes.
+func newSuiteAEAD(suite CipherSuite, key []byte) (cipher.AEAD, error) {
+	if len(key) != suite.KeySize() {
+		return nil, fmt.Errorf("%w: cipher %d takes a %d-byte key, not %d bytes", ErrInvalidKeySize, suite.ID(), suite.KeySize(), len(key))
+	}
+	aead, err := suite.NewAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	if aead.NonceSize() < minSuiteNonceSize {
+		return nil, fmt.Errorf("cipher %d has a %d-byte nonce, under %d bytes", suite.ID(), aead.NonceSize(), minSuiteNonceSize)
+	}
+	return aead, nil
+}
+
+// A keyCipher is a key with the ciphers made of it so far, one per suite,
+// so that the files of a batch share a key schedule rather than each
+// making its own. Like the ciphers, it can be used by several goroutines
+// at once.
+type keyCipher struct {
+	key   []byte
+	mu    sync.Mutex
+	aeads map[byte]cipher.AEAD
+}
+
+// newKeyCipher returns the keyCipher of key, which makes no cipher until
+// one is asked for.
+func newKeyCipher(key []byte) *keyCipher {
+	return &keyCipher{key: key}
+}
+
+// aead returns the cipher of suite for k's key, as newSuiteAEAD makes it,
+// making it the first time alone.
+func (k *keyCipher) aead(suite CipherSuite) (cipher.AEAD, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if aead, ok := k.aeads[suite.ID()]; ok {
+		return aead, nil
+	}
+	aead, err := newSuiteAEAD(suite, k.key)
+	if err != nil {
+		return nil, err
+	}
+	if k.aeads == nil {
+		k.aeads = make(map[byte]cipher.AEAD)
+	}
+	k.aeads[suite.ID()] = aead
+	return aead, nil
+}
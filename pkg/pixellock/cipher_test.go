@@ -0,0 +1,137 @@
+package pixellock
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// xorSuite is a toy cipher suite, XORing data with the key and nonce and
+// tagging it with a hash of them, to test suites other than AES-GCM go
+// through the same machinery. It is not secure.
+type xorSuite struct{}
+
+func (xorSuite) ID() byte     { return 0xfe }
+func (xorSuite) KeySize() int { return 16 }
+
+func (xorSuite) NewAEAD(key []byte) (cipher.AEAD, error) {
+	return xorAEAD{key: bytes.Clone(key)}, nil
+}
+
+type xorAEAD struct{ key []byte }
+
+func (xorAEAD) NonceSize() int { return 12 }
+func (xorAEAD) Overhead() int  { return 8 }
+
+func (a xorAEAD) xor(nonce, data []byte) []byte {
+	out := make([]byte, len(data))
+	for i, b := range data {
+		out[i] = b ^ a.key[i%len(a.key)] ^ nonce[i%len(nonce)]
+	}
+	return out
+}
+
+func (a xorAEAD) tag(nonce, ciphertext, additionalData []byte) []byte {
+	h := sha256.New()
+	for _, b := range [][]byte{a.key, nonce, additionalData, ciphertext} {
+		h.Write(b)
+	}
+	return h.Sum(nil)[:a.Overhead()]
+}
+
+func (a xorAEAD) Seal(dst, nonce, plaintext, additionalData []byte) []byte {
+	ciphertext := a.xor(nonce, plaintext)
+	return append(append(dst, ciphertext...), a.tag(nonce, ciphertext, additionalData)...)
+}
+
+func (a xorAEAD) Open(dst, nonce, ciphertext, additionalData []byte) ([]byte, error) {
+	if len(ciphertext) < a.Overhead() {
+		return nil, errors.New("xor: ciphertext too short")
+	}
+	ciphertext, tag := ciphertext[:len(ciphertext)-a.Overhead()], ciphertext[len(ciphertext)-a.Overhead():]
+	if !bytes.Equal(tag, a.tag(nonce, ciphertext, additionalData)) {
+		return nil, errors.New("xor: message authentication failed")
+	}
+	return append(dst, a.xor(nonce, ciphertext)...), nil
+}
+
+var registerXOR sync.Once
+
+func TestCipherSuites(t *testing.T) {
+	registerXOR.Do(func() { RegisterCipherSuite(xorSuite{}) })
+	if suite, err := LookupCipherSuite(AESGCM.ID()); err != nil || suite != AESGCM {
+		t.Errorf("LookupCipherSuite(%d) = %v, %v; want AESGCM", AESGCM.ID(), suite, err)
+	}
+
+	// A registered suite round-trips through the stream format, named in
+	// its header
+	key := []byte("0123456789abcdef")
+	data := streamChunks(2*streamChunkSize + 10)
+	var stream bytes.Buffer
+	if err := EncryptStreamWith(t.Context(), xorSuite{}, key, &stream, bytes.NewReader(data)); err != nil {
+		t.Fatalf("EncryptStreamWith failed: %v", err)
+	}
+	if id := stream.Bytes()[len(streamMagic)]; id != (xorSuite{}).ID() {
+		t.Errorf("stream header names cipher %d, want %d", id, xorSuite{}.ID())
+	}
+	if bytes.Contains(stream.Bytes(), data[:64]) {
+		t.Error("the stream holds the plaintext")
+	}
+	var out bytes.Buffer
+	if err := DecryptStream(t.Context(), key, &out, bytes.NewReader(stream.Bytes())); err != nil {
+		t.Fatalf("DecryptStream failed: %v", err)
+	}
+	if !bytes.Equal(out.Bytes(), data) {
+		t.Error("DecryptStream gave other data")
+	}
+
+	// Its tags are checked, and its key size kept to
+	tampered := bytes.Clone(stream.Bytes())
+	tampered[len(tampered)-20] ^= 1
+	if err := DecryptStream(t.Context(), key, &bytes.Buffer{}, bytes.NewReader(tampered)); err == nil {
+		t.Error("DecryptStream of a tampered stream succeeded")
+	}
+	aesKey, _ := GenerateRandomKey()
+	if err := DecryptStream(t.Context(), aesKey, &bytes.Buffer{}, bytes.NewReader(stream.Bytes())); err == nil {
+		t.Error("DecryptStream with a key of the wrong size succeeded")
+	}
+
+	// A suite cannot take a registered ID, or zero
+	for _, suite := range []CipherSuite{xorSuite{}, AESGCM, zeroSuite{}} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("RegisterCipherSuite of ID %d did not panic", suite.ID())
+				}
+			}()
+			RegisterCipherSuite(suite)
+		}()
+	}
+}
+
+// zeroSuite is AES-GCM under the reserved ID.
+type zeroSuite struct{ aesGCMSuite }
+
+func (zeroSuite) ID() byte { return 0 }
+
+func TestUnsupportedCipher(t *testing.T) {
+	key, _ := GenerateRandomKey()
+	stream, _ := encryptTestStream(t, key, []byte("from a later version"))
+	stream[len(streamMagic)] = 0xfd
+
+	err := DecryptStream(t.Context(), key, &bytes.Buffer{}, bytes.NewReader(stream))
+	var unsupported *UnsupportedCipherError
+	if !errors.As(err, &unsupported) || unsupported.ID != 0xfd {
+		t.Fatalf("DecryptStream gave %v, want an UnsupportedCipherError for cipher 253", err)
+	}
+	if !strings.Contains(err.Error(), "upgrade pixellock") {
+		t.Errorf("error %q does not say to upgrade", err)
+	}
+	if _, err := decryptData(newKeyCipher(key), stream); !errors.As(err, &unsupported) {
+		t.Errorf("decryptData gave %v, want an UnsupportedCipherError", err)
+	}
+}
@@ -0,0 +1,230 @@
+package pixellock
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Comparison measures how faithfully one image reproduces another of the
+// same size.
+type Comparison struct {
+	Identical bool    // Every pixel is equal, at full depth
+	PSNR      float64 // Peak signal-to-noise ratio in dB over all channels; +Inf for identical images
+	SSIM      float64 // Mean structural similarity of the luminance; 1 for identical images, down to -1
+}
+
+// ssimWindow is the side of the square windows SSIM is computed over, and
+// ssimStride the step between them. ssimC1 and ssimC2 stabilize the
+// division, with the constants of Wang et al. for 8-bit values.
+const (
+	ssimWindow = 8
+	ssimStride = 4
+	ssimC1     = (0.01 * 255) * (0.01 * 255)
+	ssimC2     = (0.03 * 255) * (0.03 * 255)
+)
+
+// CompareImages compares b against a, which must have the same size.
+func CompareImages(a, b image.Image) (Comparison, error) {
+	ab, bb := a.Bounds(), b.Bounds()
+	if ab.Dx() != bb.Dx() || ab.Dy() != bb.Dy() {
+		return Comparison{}, fmt.Errorf("images differ in size: %dx%d against %dx%d", ab.Dx(), ab.Dy(), bb.Dx(), bb.Dy())
+	}
+	d, err := DiffImages(a, b, ChannelsRGBA)
+	if err != nil {
+		return Comparison{}, err
+	}
+	c := Comparison{Identical: d.Changed == 0, PSNR: d.PSNR, SSIM: ssim(luma(a), luma(b), ab.Dx(), ab.Dy())}
+	if c.Identical && (is16Bit(a) || is16Bit(b)) {
+		// DiffImages compares 8-bit values
+		c.Identical = sameDeepPixels(a, b)
+	}
+	return c, nil
+}
+
+// luma returns the luminance of every pixel of img, in raster order.
+func luma(img image.Image) []float64 {
+	m := asNRGBA(img)
+	w, h := m.Rect.Dx(), m.Rect.Dy()
+	l := make([]float64, 0, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			p := m.Pix[y*m.Stride+x*4:]
+			l = append(l, 0.299*float64(p[0])+0.587*float64(p[1])+0.114*float64(p[2]))
+		}
+	}
+	return l
+}
+
+// ssim returns the mean SSIM of the w by h luminance planes a and b over
+// windows of ssimWindow pixels, narrowed to fit smaller images.
+func ssim(a, b []float64, w, h int) float64 {
+	win := min(ssimWindow, w, h)
+	if win == 0 {
+		return 1
+	}
+	n := float64(win * win)
+	var sum float64
+	var windows int
+	for y0 := 0; y0+win <= h; y0 += ssimStride {
+		for x0 := 0; x0+win <= w; x0 += ssimStride {
+			var ma, mb, va, vb, cov float64
+			for y := y0; y < y0+win; y++ {
+				for x := x0; x < x0+win; x++ {
+					ma += a[y*w+x]
+					mb += b[y*w+x]
+				}
+			}
+			ma, mb = ma/n, mb/n
+			for y := y0; y < y0+win; y++ {
+				for x := x0; x < x0+win; x++ {
+					da, db := a[y*w+x]-ma, b[y*w+x]-mb
+					va += da * da
+					vb += db * db
+					cov += da * db
+				}
+			}
+			va, vb, cov = va/n, vb/n, cov/n
+			sum += (2*ma*mb + ssimC1) * (2*cov + ssimC2) / ((ma*ma + mb*mb + ssimC1) * (va + vb + ssimC2))
+			windows++
+		}
+	}
+	return sum / float64(windows)
+}
+
+// sameDeepPixels reports whether a and b, of the same size, hold the same
+// colors at 16 bits per channel.
+func sameDeepPixels(a, b image.Image) bool {
+	ab, bb := a.Bounds(), b.Bounds()
+	for y := 0; y < ab.Dy(); y++ {
+		for x := 0; x < ab.Dx(); x++ {
+			ca := color.NRGBA64Model.Convert(a.At(ab.Min.X+x, ab.Min.Y+y))
+			cb := color.NRGBA64Model.Convert(b.At(bb.Min.X+x, bb.Min.Y+y))
+			if ca != cb {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// LoadComparable loads the image at filename for CompareImages. With a
+// key, an encrypted, redacted or scrambled file is decrypted in memory;
+// without one, it is refused.
+func LoadComparable(filename string, key []byte) (image.Image, error) {
+	plain := ImageFileError(filename)
+	if key == nil {
+		if plain != nil {
+			return nil, fmt.Errorf("%s: %w; give the key to compare an encrypted file", filename, plain)
+		}
+		return LoadImage(filename)
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read image: %w", err)
+	}
+	switch {
+	case IsRedacted(data):
+		data, err = Unredact(key, data)
+	case IsScrambled(data):
+		data, err = Unscramble(key, data)
+	case plain != nil:
+		_, ciphertext := SplitThumbnail(data)
+		data, err = decryptData(newKeyCipher(key), skipTags(skipFormat(ciphertext)))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	img, err := BytesToImage(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	return img, nil
+}
+
+// CompareFiles compares the image at filename b against the one at a,
+// loading each with LoadComparable.
+func CompareFiles(a, b string, key []byte) (Comparison, error) {
+	imgA, err := LoadComparable(a, key)
+	if err != nil {
+		return Comparison{}, err
+	}
+	imgB, err := LoadComparable(b, key)
+	if err != nil {
+		return Comparison{}, err
+	}
+	c, err := CompareImages(imgA, imgB)
+	if err != nil {
+		return Comparison{}, fmt.Errorf("cannot compare %s with %s: %w", a, b, err)
+	}
+	return c, nil
+}
+
+// PairTrees pairs the files of directories a and b by their path relative
+// to each, ignoring a trailing encryptedExt so that an encrypted tree pairs
+// with the tree it was encrypted from. Subdirectories are searched when
+// recursive is set. It returns the pairs, sorted by path, and the paths
+// found in only one of the trees.
+func PairTrees(a, b string, recursive bool, encryptedExt string) (pairs [][2]string, unmatched []string, err error) {
+	list := func(root string) (map[string]string, error) {
+		files := make(map[string]string)
+		err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() {
+				if path != root && !recursive {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if strings.HasSuffix(path, ThumbnailExtension) {
+				return nil
+			}
+			rel, err := filepath.Rel(root, path)
+			if err != nil {
+				return err
+			}
+			files[strings.TrimSuffix(rel, encryptedExt)] = path
+			return nil
+		})
+		return files, err
+	}
+	filesA, err := list(a)
+	if err != nil {
+		return nil, nil, err
+	}
+	filesB, err := list(b)
+	if err != nil {
+		return nil, nil, err
+	}
+	for rel, pathA := range filesA {
+		if pathB, ok := filesB[rel]; ok {
+			pairs = append(pairs, [2]string{pathA, pathB})
+		} else {
+			unmatched = append(unmatched, pathA)
+		}
+	}
+	for rel, pathB := range filesB {
+		if _, ok := filesA[rel]; !ok {
+			unmatched = append(unmatched, pathB)
+		}
+	}
+	slices.SortFunc(pairs, func(p, q [2]string) int { return strings.Compare(p[0], q[0]) })
+	slices.Sort(unmatched)
+	return pairs, unmatched, nil
+}
+
+// FormatPSNR returns psnr for display, which is infinite for identical
+// images.
+func FormatPSNR(psnr float64) string {
+	if math.IsInf(psnr, 1) {
+		return "infinite"
+	}
+	return fmt.Sprintf("%.2f dB", psnr)
+}
@@ -0,0 +1,93 @@
+package pixellock
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCompareImages(t *testing.T) {
+	img := faceNRGBA(t)
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 50}); err != nil {
+		t.Fatalf("jpeg.Encode failed: %v", err)
+	}
+	recompressed, err := jpeg.Decode(&buf)
+	if err != nil {
+		t.Fatalf("jpeg.Decode failed: %v", err)
+	}
+
+	same, err := CompareImages(img, faceNRGBA(t))
+	if err != nil {
+		t.Fatalf("CompareImages failed: %v", err)
+	}
+	if !same.Identical || !math.IsInf(same.PSNR, 1) || same.SSIM != 1 {
+		t.Errorf("identical images gave %+v", same)
+	}
+
+	lossy, err := CompareImages(img, recompressed)
+	if err != nil {
+		t.Fatalf("CompareImages failed: %v", err)
+	}
+	if lossy.Identical || lossy.PSNR < 25 || lossy.PSNR > 50 || lossy.SSIM < 0.8 || lossy.SSIM >= 1 {
+		t.Errorf("JPEG-recompressed copy gave %+v", lossy)
+	}
+
+	if _, err := CompareImages(img, photoNRGBA(t)); err == nil {
+		t.Error("CompareImages accepted images of different sizes")
+	}
+
+	// Depth beyond 8 bits counts
+	deep := deepTestImages()["nrgba64"].(*image.NRGBA64)
+	shifted := image.NewNRGBA64(deep.Rect)
+	copy(shifted.Pix, deep.Pix)
+	shifted.Pix[1] ^= 1 // Low byte of the first red value
+	if c, err := CompareImages(deep, shifted); err != nil || c.Identical {
+		t.Errorf("16-bit images differing in a low byte gave %+v, %v", c, err)
+	}
+}
+
+func TestCompareFiles(t *testing.T) {
+	key, err := GenerateRandomKey()
+	if err != nil {
+		t.Fatalf("GenerateRandomKey failed: %v", err)
+	}
+	plain, encrypted := t.TempDir(), t.TempDir()
+	for _, name := range []string{"a.png", "b.png"} {
+		if err := SaveImage(filepath.Join(plain, name), faceNRGBA(t), SaveOptions{Format: "png"}); err != nil {
+			t.Fatalf("SaveImage failed: %v", err)
+		}
+	}
+	if err := EncryptDirectory(t.Context(), plain, encrypted, key, false, false, EncryptOptions{}); err != nil {
+		t.Fatalf("EncryptDirectory failed: %v", err)
+	}
+	enc := filepath.Join(encrypted, "a.png"+EncryptedExtension)
+
+	// An encrypted file is decrypted in memory given the key
+	c, err := CompareFiles(filepath.Join(plain, "a.png"), enc, key)
+	if err != nil {
+		t.Fatalf("CompareFiles failed: %v", err)
+	}
+	if !c.Identical {
+		t.Errorf("decrypted image differs from the original: %+v", c)
+	}
+	if _, err := CompareFiles(filepath.Join(plain, "a.png"), enc, nil); err == nil {
+		t.Error("CompareFiles read an encrypted file without the key")
+	}
+
+	// Trees pair by relative path, past the encrypted extension
+	if err := os.WriteFile(filepath.Join(plain, "c.png"), nil, 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	pairs, unmatched, err := PairTrees(plain, encrypted, false, EncryptedExtension)
+	if err != nil {
+		t.Fatalf("PairTrees failed: %v", err)
+	}
+	if len(pairs) != 2 || pairs[0][1] != enc || len(unmatched) != 1 || filepath.Base(unmatched[0]) != "c.png" {
+		t.Errorf("PairTrees gave %v, unmatched %v", pairs, unmatched)
+	}
+}
@@ -0,0 +1,292 @@
+package pixellock
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+)
+
+// A contact sheet shows the images of a directory as a grid of thumbnails,
+// each captioned with its file name, so that an encrypted archive can be
+// reviewed at a glance. Encrypted images are decrypted in memory and never
+// written out on their own. An image that cannot be read or decrypted gets
+// a placeholder cell rather than stopping the sheet.
+
+// Defaults for the layout of a contact sheet.
+const (
+	DefaultContactSheetColumns = 6
+	DefaultContactSheetRows    = 8 // Rows of a sheet before the next one starts
+	DefaultContactSheetCell    = 256
+	maxContactSheetCell        = 2048
+)
+
+// Colors of a contact sheet.
+var (
+	contactSheetBackground  = color.NRGBA{0x20, 0x20, 0x20, 0xff}
+	contactSheetText        = color.NRGBA{0xdd, 0xdd, 0xdd, 0xff}
+	contactSheetPlaceholder = color.NRGBA{0x6b, 0x1f, 0x1f, 0xff} // The cell of an image that failed
+)
+
+// ContactSheetOptions control how contact sheets are made.
+type ContactSheetOptions struct {
+	// Key decrypts the files named with EncryptedExt, which are left out
+	// when it is nil; images that are not encrypted are shown either way.
+	Key          []byte
+	EncryptedExt string // EncryptedExtension when empty
+
+	Columns int // Cells across a sheet; DefaultContactSheetColumns when zero
+	Rows    int // Rows of cells on a sheet; DefaultContactSheetRows when zero
+	Cell    int // Side of the square each thumbnail fits in; DefaultContactSheetCell when zero
+}
+
+// withDefaults returns o with its zero fields set to their defaults.
+func (o ContactSheetOptions) withDefaults() ContactSheetOptions {
+	if o.EncryptedExt == "" {
+		o.EncryptedExt = EncryptedExtension
+	}
+	if o.Columns == 0 {
+		o.Columns = DefaultContactSheetColumns
+	}
+	if o.Rows == 0 {
+		o.Rows = DefaultContactSheetRows
+	}
+	if o.Cell == 0 {
+		o.Cell = DefaultContactSheetCell
+	}
+	return o
+}
+
+// Check returns an error unless the options describe a contact sheet.
+func (o ContactSheetOptions) Check() error {
+	if o.Columns < 0 || o.Rows < 0 {
+		return fmt.Errorf("invalid contact sheet of %d columns and %d rows: must not be negative", o.Columns, o.Rows)
+	}
+	if o.Cell < 0 || o.Cell > maxContactSheetCell {
+		return fmt.Errorf("invalid cell size %d: must be between 1 and %d pixels", o.Cell, maxContactSheetCell)
+	}
+	return nil
+}
+
+// ContactSheetCell is the outcome for one image of a contact sheet.
+type ContactSheetCell struct {
+	Input string
+	Sheet int   // Index of the sheet the image is on
+	Err   error // Why the image could not be shown; its cell holds a placeholder
+}
+
+// contactSheetLayout is the geometry of the sheets made under some options.
+type contactSheetLayout struct {
+	opts    ContactSheetOptions
+	pad     int // Space around and between cells
+	caption int // Height of the caption under each thumbnail
+	face    font.Face
+}
+
+func newContactSheetLayout(opts ContactSheetOptions) (*contactSheetLayout, error) {
+	f, err := opentype.Parse(goregular.TTF)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the caption font: %w", err)
+	}
+	face, err := opentype.NewFace(f, &opentype.FaceOptions{Size: max(float64(opts.Cell)/18, 9), DPI: 72, Hinting: font.HintingFull})
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the caption font: %w", err)
+	}
+	pad := max(opts.Cell/32, 4)
+	return &contactSheetLayout{opts: opts, pad: pad, caption: face.Metrics().Height.Ceil() + pad/2, face: face}, nil
+}
+
+// size returns the size of a sheet of n cells.
+func (l *contactSheetLayout) size(n int) image.Point {
+	cols := min(n, l.opts.Columns)
+	rows := (n + l.opts.Columns - 1) / l.opts.Columns
+	return image.Pt(cols*(l.opts.Cell+l.pad)+l.pad, rows*(l.opts.Cell+l.caption+l.pad)+l.pad)
+}
+
+// cell returns the square the thumbnail of cell i of a sheet fits in.
+func (l *contactSheetLayout) cell(i int) image.Rectangle {
+	at := image.Pt(l.pad+i%l.opts.Columns*(l.opts.Cell+l.pad), l.pad+i/l.opts.Columns*(l.opts.Cell+l.caption+l.pad))
+	return image.Rectangle{at, at.Add(image.Pt(l.opts.Cell, l.opts.Cell))}
+}
+
+// text draws s centered in r, cut short with an ellipsis to fit its width.
+func (l *contactSheetLayout) text(dst draw.Image, r image.Rectangle, s string) {
+	runes := []rune(s)
+	for n := len(runes); n > 0 && font.MeasureString(l.face, s).Ceil() > r.Dx(); n-- {
+		s = string(runes[:n-1]) + "..."
+	}
+	m := l.face.Metrics()
+	d := font.Drawer{Dst: dst, Src: image.NewUniform(contactSheetText), Face: l.face}
+	d.Dot = fixed.Point26_6{
+		X: fixed.I(r.Min.X + (r.Dx()-d.MeasureString(s).Ceil())/2),
+		Y: fixed.I(r.Min.Y+(r.Dy()-m.Height.Ceil())/2) + m.Ascent,
+	}
+	d.DrawString(s)
+}
+
+// ContactSheetFiles returns the files under dir a contact sheet shows under
+// opts: the images selected by batch and, given a key, the encrypted files,
+// in walk order. The thumbnails written next to encrypted files are left
+// out.
+func ContactSheetFiles(dir string, opts ContactSheetOptions, batch StegoBatchOptions) ([]string, error) {
+	opts = opts.withDefaults()
+	var files []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if path != dir && !batch.Recursive {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		ok, err := batch.matches(info.Name())
+		if err != nil {
+			return fmt.Errorf("invalid filter pattern: %w", err)
+		}
+		switch {
+		case !ok || strings.HasSuffix(path, ThumbnailExtension):
+		case opts.Key != nil && strings.HasSuffix(path, opts.EncryptedExt):
+			files = append(files, path)
+		case isImageFile(path):
+			files = append(files, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error walking the path %s: %w", dir, err)
+	}
+	return files, nil
+}
+
+// contactSheetThumbnail returns the image in the file named filename,
+// decrypted when it is encrypted, turned upright and fit in a square of
+// opts.Cell pixels a side. Encrypted files are decrypted with the ciphers
+// of opts.Key made by keys.
+func contactSheetThumbnail(filename string, opts ContactSheetOptions, keys *keyCipher) (image.Image, error) {
+	var img image.Image
+	var data []byte
+	var err error
+	if opts.Key != nil && strings.HasSuffix(filename, opts.EncryptedExt) {
+		if img, data, _, err = decryptFileData(context.Background(), OSFS{}, nil, filename, keys, SaveOptions{}, true); err != nil {
+			return nil, err
+		}
+	} else if data, err = os.ReadFile(filename); err != nil {
+		return nil, fmt.Errorf("failed to read image: %w", err)
+	}
+	if img == nil {
+		if img, err = BytesToImage(data); err != nil { // The first frame or page
+			return nil, err
+		}
+	}
+	if exif, err := ReadEXIF(data); err == nil && exif != nil {
+		img = Orient(img, EXIFOrientation(exif))
+	}
+	return Resize{Box: image.Pt(opts.Cell, opts.Cell)}.Apply(img, 1), nil
+}
+
+// MakeContactSheets returns contact sheets of the images under inputDir
+// selected by batch, as ContactSheetFiles finds them, with opts.Columns by
+// opts.Rows cells each, and the outcome for each image. Images are read,
+// decrypted and downscaled on a pool of batch.Workers workers, and only
+// their thumbnails kept.
+func MakeContactSheets(inputDir string, opts ContactSheetOptions, batch StegoBatchOptions) ([]image.Image, []ContactSheetCell, error) {
+	if err := opts.Check(); err != nil {
+		return nil, nil, err
+	}
+	opts = opts.withDefaults()
+	files, err := ContactSheetFiles(inputDir, opts, batch)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(files) == 0 {
+		return nil, nil, fmt.Errorf("no images found in %s", inputDir)
+	}
+	layout, err := newContactSheetLayout(opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer layout.face.Close()
+
+	thumbs := make([]image.Image, len(files))
+	cells := make([]ContactSheetCell, len(files))
+	keys := newKeyCipher(opts.Key)
+	runParallel(len(files), batch.Workers, func(i int) {
+		defer recoverPanic(&cells[i].Err)
+		thumbs[i], cells[i].Err = contactSheetThumbnail(files[i], opts, keys)
+	})
+
+	perSheet := opts.Columns * opts.Rows
+	var sheets []image.Image
+	for start := 0; start < len(files); start += perSheet {
+		n := min(perSheet, len(files)-start)
+		sheet := image.NewNRGBA(image.Rectangle{Max: layout.size(n)})
+		draw.Draw(sheet, sheet.Rect, image.NewUniform(contactSheetBackground), image.Point{}, draw.Src)
+		for i := range n {
+			cells[start+i].Input, cells[start+i].Sheet = files[start+i], len(sheets)
+			r := layout.cell(i)
+			if thumb := thumbs[start+i]; cells[start+i].Err == nil {
+				size := thumb.Bounds().Size()
+				at := r.Min.Add(r.Size().Sub(size).Div(2))
+				draw.Draw(sheet, image.Rectangle{at, at.Add(size)}, thumb, thumb.Bounds().Min, draw.Over)
+			} else {
+				draw.Draw(sheet, r, image.NewUniform(contactSheetPlaceholder), image.Point{}, draw.Src)
+				layout.text(sheet, r, "no preview")
+			}
+			caption := image.Rect(r.Min.X, r.Max.Y, r.Max.X, r.Max.Y+layout.caption)
+			layout.text(sheet, caption, filepath.Base(files[start+i]))
+		}
+		sheets = append(sheets, sheet)
+	}
+	return sheets, cells, nil
+}
+
+// WriteContactSheets makes the contact sheets of inputDir with
+// MakeContactSheets and writes them with SaveImage in the format of save,
+// or of the extension of output when save names none: to output when there
+// is one sheet, and otherwise to the names PageFilename gives for each.
+// Existing files are refused unless overwrite is set. It returns the names
+// written and the outcome for each image.
+func WriteContactSheets(inputDir, output string, opts ContactSheetOptions, save SaveOptions, batch StegoBatchOptions, overwrite bool) ([]string, []ContactSheetCell, error) {
+	format, err := convertFormat(output, ConvertOptions{Save: save})
+	if err != nil {
+		return nil, nil, err
+	}
+	save.Format = format
+	sheets, cells, err := MakeContactSheets(inputDir, opts, batch)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	names := []string{output}
+	if len(sheets) > 1 {
+		names = make([]string, len(sheets))
+		for i := range sheets {
+			names[i] = PageFilename(output, i+1, format)
+		}
+	}
+	for _, name := range names {
+		if _, err := os.Stat(name); err == nil && !overwrite {
+			return nil, cells, outputExistsError(name)
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(output), os.ModeDir|0755); err != nil {
+		return nil, cells, fmt.Errorf("failed to create output directory: %w", err)
+	}
+	for i, sheet := range sheets {
+		if err := SaveImage(names[i], sheet, save); err != nil {
+			return names[:i], cells, err
+		}
+	}
+	return names, cells, nil
+}
@@ -0,0 +1,120 @@
+package pixellock
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestContactSheet(t *testing.T) {
+	key, err := GenerateRandomKey()
+	if err != nil {
+		t.Fatalf("GenerateRandomKey failed: %v", err)
+	}
+
+	// A dozen solid images of different sizes and shades, two of every
+	// three encrypted, and a file that does not decrypt
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "archive")
+	shades := make(map[string]color.NRGBA)
+	for i := range 12 {
+		c := color.NRGBA{uint8(20 * i), uint8(200 - 10*i), 90, 255}
+		name := fmt.Sprintf("img%02d.png", i)
+		plain := filepath.Join(archive, name)
+		if err := os.MkdirAll(archive, 0755); err != nil {
+			t.Fatalf("MkdirAll failed: %v", err)
+		}
+		if err := SaveImage(plain, solidNRGBA(40+10*i, 90-5*i, c), SaveOptions{Format: "png"}); err != nil {
+			t.Fatalf("SaveImage failed: %v", err)
+		}
+		if i%3 != 0 {
+			if err := EncryptFile(t.Context(), plain, plain+EncryptedExtension, key, false, EncryptOptions{}); err != nil {
+				t.Fatalf("EncryptFile failed: %v", err)
+			}
+			os.Remove(plain)
+			name += EncryptedExtension
+		}
+		shades[name] = c
+	}
+	corrupt := filepath.Join(archive, "corrupt.png"+EncryptedExtension)
+	if err := os.WriteFile(corrupt, []byte("not a ciphertext at all, just some bytes"), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+
+	opts := ContactSheetOptions{Key: key, Columns: 5, Rows: 2, Cell: 64}
+	sheets, cells, err := MakeContactSheets(archive, opts, StegoBatchOptions{Workers: 3})
+	if err != nil {
+		t.Fatalf("MakeContactSheets failed: %v", err)
+	}
+
+	// Thirteen images make a sheet of two full rows and one of a row of
+	// three
+	if len(sheets) != 2 || len(cells) != 13 {
+		t.Fatalf("%d sheets of %d cells; want 2 of 13", len(sheets), len(cells))
+	}
+	layout, err := newContactSheetLayout(opts.withDefaults())
+	if err != nil {
+		t.Fatalf("newContactSheetLayout failed: %v", err)
+	}
+	pad := layout.pad
+	for i, want := range []image.Point{
+		{5*(64+pad) + pad, 2*(64+layout.caption+pad) + pad},
+		{3*(64+pad) + pad, 1*(64+layout.caption+pad) + pad},
+	} {
+		if got := sheets[i].Bounds().Size(); got != want {
+			t.Errorf("sheet %d is %v; want %v", i+1, got, want)
+		}
+	}
+
+	perSheet := 0
+	for i, cell := range cells {
+		if i > 0 && cell.Sheet != cells[i-1].Sheet {
+			perSheet = i
+		}
+		center := layout.cell(i - perSheet).Min.Add(image.Pt(32, 32))
+		got := color.NRGBAModel.Convert(sheets[cell.Sheet].At(center.X, center.Y))
+		name := filepath.Base(cell.Input)
+		if cell.Input == corrupt {
+			if cell.Err == nil {
+				t.Error("the corrupt file decrypted")
+			}
+			corner := layout.cell(i - perSheet).Min.Add(image.Pt(1, 1))
+			if c := sheets[cell.Sheet].At(corner.X, corner.Y); c != contactSheetPlaceholder {
+				t.Errorf("the corrupt file has no placeholder: %v", c)
+			}
+			continue
+		}
+		if cell.Err != nil {
+			t.Errorf("%s: %v", name, cell.Err)
+		} else if got != shades[name] {
+			t.Errorf("%s: cell shows %v; want %v", name, got, shades[name])
+		}
+	}
+
+	// Without a key only the plain images are shown
+	_, cells, err = MakeContactSheets(archive, ContactSheetOptions{Cell: 32}, StegoBatchOptions{})
+	if err != nil {
+		t.Fatalf("MakeContactSheets without a key failed: %v", err)
+	}
+	if len(cells) != 4 {
+		t.Errorf("%d cells without a key; want the 4 plain images", len(cells))
+	}
+
+	// Written as numbered sheets when there are several
+	names, _, err := WriteContactSheets(archive, filepath.Join(dir, "sheet.jpg"), opts, SaveOptions{}, StegoBatchOptions{}, false)
+	if err != nil {
+		t.Fatalf("WriteContactSheets failed: %v", err)
+	}
+	if len(names) != 2 || !strings.HasSuffix(names[1], "sheet_p002.jpg") {
+		t.Errorf("sheets written as %v", names)
+	}
+	for _, name := range names {
+		if format, err := DetectImageFormat(name); err != nil || format != "jpeg" {
+			t.Errorf("%s: written as %q, %v", name, format, err)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package pixellock
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ConvertOptions control how ConvertFile converts an image.
+type ConvertOptions struct {
+	// Save is how the converted image is written, scaled and turned.
+	// Without a Format, it is taken from the extension of the output
+	// file.
+	Save SaveOptions
+
+	Overwrite bool // Replace an existing output file
+}
+
+// convertFormat returns the format ConvertFile writes output in under
+// opts.
+func convertFormat(output string, opts ConvertOptions) (string, error) {
+	format := opts.Save.Format
+	if format == "" {
+		if format = strings.ToLower(strings.TrimPrefix(filepath.Ext(output), ".")); format == "" {
+			return "", fmt.Errorf("%s has no extension to take the output format from; give one", output)
+		}
+	}
+	if err := CheckOutputFormat(format); err != nil {
+		return "", err
+	}
+	return format, nil
+}
+
+// ConvertFile writes the image at input to output in another format, as
+// SaveImage writes it, carrying its EXIF metadata unless opts.Save strips
+// it. An animated GIF stays animated when converted to GIF unscaled and
+// without a watermark; otherwise only its first frame is converted, which
+// the returned note says. A multi-page TIFF keeps its pages alike when
+// converted to TIFF. HEIF images cannot be converted.
+func ConvertFile(input, output string, opts ConvertOptions) (note string, err error) {
+	format, err := convertFormat(output, opts)
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(output); err == nil && !opts.Overwrite {
+		return "", outputExistsError(output)
+	}
+	if err := os.MkdirAll(filepath.Dir(output), os.ModeDir|0755); err != nil {
+		return "", fmt.Errorf("failed to create output directory: %w", err)
+	}
+
+	animated, ok, err := AnimatedGIFBytes(input)
+	if err != nil {
+		return "", err
+	}
+	if f, _ := SplitImageFormat(format); ok && f == "gif" && opts.Save.Resize.IsZero() && opts.Save.Watermark == nil {
+		return "", os.WriteFile(output, animated, 0644)
+	} else if ok {
+		note = fmt.Sprintf("it is an animated GIF; only its first frame is converted to %s", format)
+	}
+
+	img, err := loadImage(OSFS{}, input, opts.Save.MaxPixels)
+	if err != nil {
+		return "", err
+	}
+	raw, err := os.ReadFile(input)
+	if err != nil {
+		return "", fmt.Errorf("failed to read image: %w", err)
+	}
+
+	// Multi-page TIFFs keep every page as TIFFs, and give their first
+	// page in other formats
+	if f, option := SplitImageFormat(format); IsMultiPageTIFFData(raw) && (f == "tiff" || f == "tif") && opts.Save.Resize.IsZero() && opts.Save.Watermark == nil {
+		if option == "" {
+			option = DefaultTIFFCompression
+		}
+		pages, err := reencodeTIFFPages(raw, opts.Save.Metadata, option)
+		if err != nil {
+			return "", err
+		}
+		return "", os.WriteFile(output, pages, 0644)
+	} else if IsMultiPageTIFFData(raw) {
+		note = fmt.Sprintf("it is a multi-page TIFF; only its first page is converted to %s", format)
+	}
+	save := opts.Save
+	save.Format = format
+	if save.EXIF, err = ReadEXIF(raw); err != nil {
+		return "", err
+	}
+	return note, SaveImage(output, img, save)
+}
+
+// ConvertDirectory converts every image under inputDir selected by batch
+// with ConvertFile, writing each to the same relative path under outputDir
+// with the extension of the output format, which opts.Save must name. A
+// failure on one image is recorded in its result and does not stop the
+// batch.
+func ConvertDirectory(inputDir, outputDir string, opts ConvertOptions, batch StegoBatchOptions) ([]StegoBatchResult, error) {
+	if opts.Save.Format == "" {
+		return nil, fmt.Errorf("converting a directory needs an output format")
+	}
+	if err := CheckOutputFormat(opts.Save.Format); err != nil {
+		return nil, err
+	}
+	files, err := StegoBatchFiles(inputDir, batch)
+	if err != nil {
+		return nil, err
+	}
+
+	ext := "." + ImageFormatExtension(opts.Save.Format)
+	return runStegoBatch(files, batch.Workers, func(input string) StegoBatchResult {
+		result := StegoBatchResult{Input: input}
+		relPath, err := filepath.Rel(inputDir, input)
+		if err != nil {
+			result.Err = fmt.Errorf("failed to get relative path: %w", err)
+			return result
+		}
+		output := filepath.Join(outputDir, strings.TrimSuffix(relPath, filepath.Ext(relPath))+ext)
+		if result.Note, result.Err = ConvertFile(input, output, opts); result.Err == nil {
+			result.Output = output
+		}
+		return result
+	}), nil
+}
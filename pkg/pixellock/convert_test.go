@@ -0,0 +1,158 @@
+package pixellock
+
+import (
+	"image"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestConvertFormats(t *testing.T) {
+	src := t.TempDir()
+	img := grayTestImage(24, 16)
+	formats := []string{"png", "jpg", "gif", "webp", "tiff", "bmp"}
+	for _, from := range formats {
+		if err := SaveImage(filepath.Join(src, "in."+from), img, SaveOptions{Format: from}); err != nil {
+			t.Fatalf("SaveImage %s failed: %v", from, err)
+		}
+	}
+
+	dir := t.TempDir()
+	for _, from := range formats {
+		for _, to := range formats {
+			output := filepath.Join(dir, from+"-to."+to)
+			if _, err := ConvertFile(filepath.Join(src, "in."+from), output, ConvertOptions{}); err != nil {
+				t.Errorf("%s to %s: ConvertFile failed: %v", from, to, err)
+				continue
+			}
+			want := map[string]string{"jpg": "jpeg"}[to]
+			if want == "" {
+				want = to
+			}
+			if format, err := DetectImageFormat(output); err != nil || format != want {
+				t.Errorf("%s to %s: wrote %q, %v", from, to, format, err)
+			}
+			got, err := LoadImage(output)
+			if err != nil {
+				t.Fatalf("LoadImage failed: %v", err)
+			}
+			if got.Bounds().Size() != img.Rect.Size() {
+				t.Errorf("%s to %s: size %v, want %v", from, to, got.Bounds().Size(), img.Rect.Size())
+			}
+			// Gray values survive every format but JPEG and GIF, which
+			// quantizes them to its palette
+			lossy := func(f string) bool { return f == "jpg" || f == "gif" }
+			if !lossy(from) && !lossy(to) && !samePixels(asNRGBA(got), asNRGBA(img)) {
+				t.Errorf("%s to %s: pixels changed", from, to)
+			}
+		}
+	}
+
+	// The output format can also be given, and must be known
+	named := filepath.Join(dir, "named.img")
+	if _, err := ConvertFile(filepath.Join(src, "in.png"), named, ConvertOptions{Save: SaveOptions{Format: "bmp"}}); err != nil {
+		t.Errorf("ConvertFile with a format failed: %v", err)
+	} else if format, _ := DetectImageFormat(named); format != "bmp" {
+		t.Errorf("wrote %q, want bmp", format)
+	}
+	if _, err := ConvertFile(filepath.Join(src, "in.png"), filepath.Join(dir, "out.xyz"), ConvertOptions{}); err == nil {
+		t.Error("ConvertFile accepted an unknown output extension")
+	}
+	if _, err := ConvertFile(filepath.Join(src, "in.png"), named, ConvertOptions{Save: SaveOptions{Format: "png"}}); err == nil {
+		t.Error("ConvertFile overwrote a file without Overwrite")
+	}
+}
+
+func TestConvertAnimatedGIF(t *testing.T) {
+	input := animatedGIF(t)
+	dir := t.TempDir()
+
+	kept := filepath.Join(dir, "kept.gif")
+	if note, err := ConvertFile(input, kept, ConvertOptions{}); err != nil || note != "" {
+		t.Fatalf("ConvertFile to gif = %q, %v", note, err)
+	}
+	if g := decodeGIFFile(t, kept); len(g.Image) != 3 {
+		t.Errorf("GIF to GIF kept %d frames, want 3", len(g.Image))
+	}
+
+	note, err := ConvertFile(input, filepath.Join(dir, "frame.png"), ConvertOptions{})
+	if err != nil {
+		t.Fatalf("ConvertFile to png failed: %v", err)
+	}
+	if !strings.Contains(note, "first frame") {
+		t.Errorf("no note that only the first frame is converted: %q", note)
+	}
+}
+
+func TestConvertResize(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "in.png")
+	if err := SaveImage(input, photoNRGBA(t), SaveOptions{Format: "png"}); err != nil {
+		t.Fatalf("SaveImage failed: %v", err)
+	}
+	b := photoNRGBA(t).Rect
+	for s, want := range map[string]image.Point{
+		"40x":   {40, b.Dy() * 40 / b.Dx()},
+		"x20":   {b.Dx() * 20 / b.Dy(), 20},
+		"40x10": {b.Dx() * 10 / b.Dy(), 10},
+	} {
+		box, err := ParseResize(s)
+		if err != nil {
+			t.Fatalf("ParseResize(%q) failed: %v", s, err)
+		}
+		output := filepath.Join(dir, s+".png")
+		if _, err := ConvertFile(input, output, ConvertOptions{Save: SaveOptions{Resize: box}}); err != nil {
+			t.Fatalf("%s: ConvertFile failed: %v", s, err)
+		}
+		got, err := LoadImage(output)
+		if err != nil {
+			t.Fatalf("LoadImage failed: %v", err)
+		}
+		if size := got.Bounds().Size(); abs(size.X-want.X) > 1 || abs(size.Y-want.Y) > 1 {
+			t.Errorf("%s: resized to %v, want %v", s, size, want)
+		}
+	}
+}
+
+func TestConvertDirectory(t *testing.T) {
+	in, out := t.TempDir(), t.TempDir()
+	if err := os.MkdirAll(filepath.Join(in, "sub"), 0755); err != nil {
+		t.Fatalf("MkdirAll failed: %v", err)
+	}
+	for _, name := range []string{"a.png", "b.jpg", "notes.png", filepath.Join("sub", "c.webp")} {
+		if err := SaveImage(filepath.Join(in, name), grayTestImage(8, 8), SaveOptions{Format: strings.TrimPrefix(filepath.Ext(name), ".")}); err != nil {
+			t.Fatalf("SaveImage failed: %v", err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(in, "readme.txt"), []byte("not an image"), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+
+	opts := ConvertOptions{Save: SaveOptions{Format: "tiff"}}
+	if _, err := ConvertDirectory(in, out, ConvertOptions{}, StegoBatchOptions{}); err == nil {
+		t.Error("ConvertDirectory accepted no output format")
+	}
+	results, err := ConvertDirectory(in, out, opts, StegoBatchOptions{Recursive: true, Exclude: []string{"notes.*"}})
+	if err != nil {
+		t.Fatalf("ConvertDirectory failed: %v", err)
+	}
+	var written []string
+	for _, r := range results {
+		if r.Err != nil {
+			t.Errorf("%s: %v", r.Input, r.Err)
+			continue
+		}
+		rel, _ := filepath.Rel(out, r.Output)
+		written = append(written, rel)
+	}
+	want := []string{"a.tiff", "b.tiff", filepath.Join("sub", "c.tiff")}
+	if strings.Join(written, " ") != strings.Join(want, " ") {
+		t.Errorf("wrote %v, want %v", written, want)
+	}
+	for _, rel := range want {
+		if format, err := DetectImageFormat(filepath.Join(out, rel)); err != nil || format != "tiff" {
+			t.Errorf("%s: format %q, %v", rel, format, err)
+		}
+	}
+}
@@ -0,0 +1,274 @@
+package pixellock
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"io/fs"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Decrypted images, and images revealed from stego payloads, can be written
+// to standard output instead of a file, so that a web page can inline them
+// without a temporary file: as they are, base64 encoded, or as a data URI.
+
+// Outputs that write to standard output instead of a file.
+const (
+	StdoutOutput  = "-"        // The image bytes, or base64 with --base64
+	DataURIOutput = "data-uri" // A data:image/...;base64 URI
+)
+
+// IsStdoutOutput reports whether output names standard output rather than
+// a file.
+func IsStdoutOutput(output string) bool {
+	return output == StdoutOutput || output == DataURIOutput
+}
+
+// DefaultMaxStdoutBytes bounds the images and payloads written to standard
+// output, before base64 encoding, so that a huge image does not flood the
+// pipe.
+const DefaultMaxStdoutBytes = 16 << 20
+
+// imageMIMETypes maps image formats to their MIME types.
+var imageMIMETypes = map[string]string{
+	"png":  "image/png",
+	"jpeg": "image/jpeg",
+	"jpg":  "image/jpeg",
+	"gif":  "image/gif",
+	"webp": "image/webp",
+	"tiff": "image/tiff",
+	"tif":  "image/tiff",
+	"bmp":  "image/bmp",
+	"ppm":  "image/x-portable-pixmap",
+	"pgm":  "image/x-portable-graymap",
+	"heif": "image/heif",
+	"heic": "image/heic",
+	"avif": "image/avif",
+}
+
+// ImageMIMEType returns the MIME type of images written in outputFormat, or
+// application/octet-stream for an unknown format.
+func ImageMIMEType(outputFormat string) string {
+	format, _ := SplitImageFormat(outputFormat)
+	if format == "" {
+		format = "png"
+	}
+	if mime, ok := imageMIMETypes[format]; ok {
+		return mime
+	}
+	return "application/octet-stream"
+}
+
+// DataURI returns data as a base64 data URI of the given MIME type.
+func DataURI(data []byte, mimeType string) string {
+	return "data:" + mimeType + ";base64," + base64.StdEncoding.EncodeToString(data)
+}
+
+// ImageDataFormat returns the format of the image held by data, such as the
+// payload of a stego image, or an error when it is no image pixellock can
+// read.
+func ImageDataFormat(data []byte) (string, error) {
+	if IsHEIFData(data) {
+		return "heif", nil
+	}
+	_, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return "", fmt.Errorf("not an image: %w", err)
+	}
+	return format, nil
+}
+
+// StdoutImage returns what is written to standard output for the image
+// data, in format, under output: a data URI for DataURIOutput, or data
+// itself for StdoutOutput, base64 encoded when asBase64 is set. Text ends
+// with a newline. Data larger than maxBytes is refused, unless maxBytes is
+// zero.
+func StdoutImage(data []byte, format, output string, asBase64 bool, maxBytes int) ([]byte, error) {
+	if maxBytes < 0 {
+		return nil, fmt.Errorf("invalid maximum of %d bytes: must not be negative", maxBytes)
+	}
+	if maxBytes > 0 && len(data) > maxBytes {
+		return nil, fmt.Errorf("%d bytes is more than the maximum of %d for standard output; raise --max-bytes, or write to a file", len(data), maxBytes)
+	}
+	switch {
+	case output == DataURIOutput:
+		return []byte(DataURI(data, ImageMIMEType(format)) + "\n"), nil
+	case output != StdoutOutput:
+		return nil, fmt.Errorf("%s is not standard output (want %s or %s)", output, StdoutOutput, DataURIOutput)
+	case asBase64:
+		return []byte(base64.StdEncoding.EncodeToString(data) + "\n"), nil
+	}
+	return data, nil
+}
+
+// decryptFileData decrypts the encrypted file named filename in fsys with
+// the key of keys, emitting decrypt events to q as it reads it, and returning
+// ctx.Err() once ctx is done. It returns the decrypted data or, for a
+// tiled file, which only OSFS holds, the image within save.TileRegion and
+// the metadata PNG in place of the data, with the cipher suite of a stream.
+// Images claiming more pixels than save.MaxPixels allows are not decoded.
+// With decode set, the PNG of a stream is decoded as it is decrypted,
+// rather than held whole beside its image: img is the image, and data the
+// PNG without its image data, whose chunks ReadEXIF, ResolveOutputFormat
+// and image.DecodeConfig read as they would the whole. The image is only
+// returned once the whole stream is authenticated.
+func decryptFileData(ctx context.Context, fsys FileSystem, q *eventQueue, filename string, keys *keyCipher, save SaveOptions, decode bool) (img image.Image, data []byte, suite CipherSuite, err error) {
+	region := save.TileRegion
+	if _, ok := fsys.(OSFS); ok && IsTiled(filename) {
+		_, span := startPhase(ctx, SpanDecrypt)
+		img, data, err = DecryptTiled(filename, keys.key, region)
+		endSpan(span, err)
+		return img, data, nil, err
+	}
+	if !region.Empty() {
+		return nil, nil, nil, fmt.Errorf("%s is not tiled; --tile-region needs an image encrypted with --tile", filename)
+	}
+	_, load := startPhase(ctx, SpanLoad)
+	f, r, err := openEncrypted(fsys, q, filename, load)
+	endSpan(load, err)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer f.Close()
+
+	// A stream is decrypted as it is read; redacted and scrambled images
+	// and files encrypted whole are read first
+	suite = peekStreamSuite(r)
+	_, span := startPhase(ctx, SpanDecrypt)
+	if suite != nil {
+		span.SetAttributes(attribute.String(AttrCipher, CipherName(suite)))
+	}
+	if decode && suite != nil {
+		img, data, err = decodeStream(ctx, keys, r, save.MaxPixels)
+		endSpan(span, err)
+		return img, data, suite, err
+	}
+	var buf bytes.Buffer
+	err = decryptImage(ctx, keys, &buf, r, save.MaxPixels)
+	endSpan(span, err)
+	return nil, buf.Bytes(), suite, err
+}
+
+// decodeStream decrypts the stream read from r with the key of keys,
+// decoding the image as it goes when it is a PNG, as decryptFileData does
+// with decode set. Any other image is returned as data alone.
+func decodeStream(ctx context.Context, keys *keyCipher, r io.Reader, maxPixels int64) (img image.Image, data []byte, err error) {
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		err := decryptStream(ctx, keys, pw, r)
+		pw.CloseWithError(err)
+		done <- err
+	}()
+	plain := bufio.NewReader(pr)
+	if magic, _ := plain.Peek(len(pngSignature)); bytes.Equal(magic, pngSignature) {
+		var chunks bytes.Buffer
+		tee := io.TeeReader(plain, &pngChunkWriter{w: &chunks, skip: func(typ string) bool { return typ == "IDAT" }})
+		img, _, err = decodeImage(tee, maxPixels)
+		if err == nil {
+			// The chunks after the image, and the end of the stream,
+			// which authenticates it
+			_, err = io.Copy(io.Discard, tee)
+		} else {
+			err = fmt.Errorf("failed to decode bytes to image: %w", err)
+		}
+		data = chunks.Bytes()
+	} else {
+		var buf bytes.Buffer
+		_, err = buf.ReadFrom(plain)
+		data = buf.Bytes()
+	}
+	pr.CloseWithError(err) // Stopping the decryption when decoding failed
+	if derr := <-done; derr != nil && (err == nil || !errors.Is(derr, err)) {
+		return nil, nil, derr
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return img, data, nil
+}
+
+// openEncrypted opens the encrypted file filename in fsys, and returns it
+// with a reader of it past any embedded thumbnail and tags, emitting its
+// decrypt events to q as it is read, and setting AttrBytesRead of span to
+// its size.
+func openEncrypted(fsys FileSystem, q *eventQueue, filename string, span trace.Span) (fs.File, *bufio.Reader, error) {
+	f, err := fsys.Open(filename)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read encrypted file: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, fmt.Errorf("failed to read encrypted file: %w", err)
+	}
+	span.SetAttributes(attribute.Int64(AttrBytesRead, info.Size()))
+	r := bufio.NewReader(&progressReader{r: f, q: q, event: Event{Phase: PhaseDecrypt, Path: filename, Total: info.Size()}})
+	if err := skipHeader(r); err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return f, r, nil
+}
+
+// DecryptImageBytes decrypts the encrypted file named filename with key and
+// returns the image encoded in memory as decryption would write it to a
+// file under save, and the format it is in. The notes say how the image
+// differs from what was encrypted, as decryption prints them.
+func DecryptImageBytes(filename string, key []byte, save SaveOptions) (data []byte, format string, notes []string, err error) {
+	if save.SplitPages {
+		return nil, "", nil, fmt.Errorf("pages cannot be split on standard output")
+	}
+	decoded, plaintext, _, err := decryptFileData(context.Background(), OSFS{}, nil, filename, newKeyCipher(key), save, true)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	format, _, note := ResolveOutputFormat(plaintext, save.Format)
+	if note != "" {
+		notes = append(notes, note)
+	}
+
+	// Animated GIFs, multi-page TIFFs and HEIF images are given as they
+	// were encrypted, in their own format
+	if decoded == nil && KeepsEncryptedBytes(plaintext, format) {
+		if save.Watermark != nil {
+			return nil, "", notes, fmt.Errorf("cannot watermark %s: it is written as it was encrypted", filename)
+		}
+		if !save.Resize.IsZero() {
+			notes = append(notes, "it is written as it was encrypted, without resizing")
+		}
+		return plaintext, format, notes, nil
+	}
+	switch {
+	case IsGIFData(plaintext):
+		notes = append(notes, fmt.Sprintf("it is an animated GIF; only its first frame is written as %s", format))
+	case IsMultiPageTIFFData(plaintext):
+		notes = append(notes, fmt.Sprintf("it is a multi-page TIFF; only its first page is written as %s", format))
+	}
+
+	img := decoded
+	if img == nil {
+		if img, err = bytesToImage(plaintext, save.MaxPixels); errors.Is(err, ErrHEIFDecoding) {
+			err = fmt.Errorf("%w; decrypt with --output-format %s to restore the HEIF file", err, OriginalOutputFormat)
+		}
+		if err != nil {
+			return nil, "", notes, err
+		}
+	}
+	if save.EXIF, err = ReadEXIF(plaintext); err != nil {
+		return nil, "", notes, err
+	}
+	save.Format = format
+	var buf bytes.Buffer
+	if err := EncodeImage(&buf, img, save); err != nil {
+		return nil, "", notes, err
+	}
+	return buf.Bytes(), format, notes, nil
+}
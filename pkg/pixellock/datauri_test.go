@@ -0,0 +1,116 @@
+package pixellock
+
+import (
+	"bytes"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// decodeDataURI returns the MIME type and data of a base64 data URI, as a
+// browser would read it.
+func decodeDataURI(t *testing.T, uri []byte) (string, []byte) {
+	t.Helper()
+	s, ok := strings.CutPrefix(strings.TrimSuffix(string(uri), "\n"), "data:")
+	mime, encoded, found := strings.Cut(s, ";base64,")
+	if !ok || !found {
+		t.Fatalf("not a base64 data URI: %.40q", uri)
+	}
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		t.Fatalf("data URI does not decode: %v", err)
+	}
+	return mime, data
+}
+
+func TestDecryptDataURI(t *testing.T) {
+	key, err := GenerateRandomKey()
+	if err != nil {
+		t.Fatalf("GenerateRandomKey failed: %v", err)
+	}
+	dir := t.TempDir()
+	original := filepath.Join(dir, "photo.png")
+	if err := SaveImage(original, photoNRGBA(t), SaveOptions{Format: "png"}); err != nil {
+		t.Fatalf("SaveImage failed: %v", err)
+	}
+	encrypted := filepath.Join(dir, "photo.png.enc")
+	if err := EncryptFile(t.Context(), original, encrypted, key, false, EncryptOptions{}); err != nil {
+		t.Fatalf("EncryptFile failed: %v", err)
+	}
+
+	for _, tc := range []struct {
+		format, mime string
+	}{
+		{"", "image/png"}, // The original format
+		{"jpeg", "image/jpeg"},
+		{"webp", "image/webp"},
+	} {
+		decrypted := filepath.Join(dir, "decrypted"+tc.format)
+		if err := DecryptFile(t.Context(), encrypted, decrypted, key, false, SaveOptions{Format: tc.format}); err != nil {
+			t.Fatalf("%q: DecryptFile failed: %v", tc.format, err)
+		}
+		if tc.format == "" {
+			decrypted += ".png"
+		}
+		want, err := LoadImage(decrypted)
+		if err != nil {
+			t.Fatalf("%q: LoadImage failed: %v", tc.format, err)
+		}
+
+		data, format, notes, err := DecryptImageBytes(encrypted, key, SaveOptions{Format: tc.format})
+		if err != nil || len(notes) != 0 {
+			t.Fatalf("%q: DecryptImageBytes failed: %v, %v", tc.format, err, notes)
+		}
+		uri, err := StdoutImage(data, format, DataURIOutput, false, DefaultMaxStdoutBytes)
+		if err != nil {
+			t.Fatalf("%q: StdoutImage failed: %v", tc.format, err)
+		}
+		mime, inlined := decodeDataURI(t, uri)
+		if mime != tc.mime {
+			t.Errorf("%q: MIME type %s; want %s", tc.format, mime, tc.mime)
+		}
+		got, err := BytesToImage(inlined)
+		if err != nil {
+			t.Fatalf("%q: the data URI holds no image: %v", tc.format, err)
+		}
+		if !samePixels(got, want) {
+			t.Errorf("%q: the data URI differs from the decrypted file", tc.format)
+		}
+
+		// --base64 with --output - gives the same bytes without the prefix
+		blob, err := StdoutImage(data, format, StdoutOutput, true, 0)
+		if err != nil {
+			t.Fatalf("%q: StdoutImage failed: %v", tc.format, err)
+		}
+		if decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(blob))); err != nil || !bytes.Equal(decoded, inlined) {
+			t.Errorf("%q: the base64 blob differs from the data URI (%v)", tc.format, err)
+		}
+	}
+
+	if _, err := StdoutImage(make([]byte, 100), "png", DataURIOutput, false, 99); err == nil {
+		t.Error("StdoutImage wrote more than the maximum")
+	}
+	if _, _, _, err := DecryptImageBytes(encrypted, key, SaveOptions{SplitPages: true}); err == nil {
+		t.Error("DecryptImageBytes split pages onto standard output")
+	}
+}
+
+func TestImageDataFormat(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "logo.gif")
+	if err := SaveImage(path, palettedTestImage(8, 8), SaveOptions{Format: "gif"}); err != nil {
+		t.Fatalf("SaveImage failed: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	if format, err := ImageDataFormat(data); err != nil || ImageMIMEType(format) != "image/gif" {
+		t.Errorf("ImageDataFormat gave %q, %v", format, err)
+	}
+	if _, err := ImageDataFormat([]byte("a hidden message")); err == nil {
+		t.Error("ImageDataFormat took text for an image")
+	}
+}
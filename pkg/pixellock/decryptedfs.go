@@ -0,0 +1,549 @@
+package pixellock
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"container/list"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image/png"
+	"io"
+	"io/fs"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultDecryptedCacheSize is the bytes of decrypted files a DecryptedFS
+// keeps when DecryptedFSOptions.CacheSize is 0.
+const DefaultDecryptedCacheSize = 256 << 20
+
+// DecryptedFSOptions configure a DecryptedFS.
+type DecryptedFSOptions struct {
+	// FS is the filesystem the encrypted files are read from; the
+	// operating system's when nil.
+	FS FileSystem
+
+	// EncryptedExt is the extension of the encrypted files, which their
+	// names are shown without; EncryptedExtension when empty.
+	EncryptedExt string
+
+	// CacheSize bounds the bytes of the decrypted files kept to be read
+	// again, the least recently read dropped first;
+	// DefaultDecryptedCacheSize when 0, and none kept when negative.
+	CacheSize int64
+
+	// Logger is given the files that fail to decrypt.
+	Logger Logger
+}
+
+// A DecryptedFS is a read-only view of a directory of encrypted files in
+// which each appears decrypted, as a mount of the directory would show it.
+// Other files are left out. The data of a file is the image as encryption
+// stored it, as DecryptImage gives it: a PNG, or an animated GIF,
+// multi-page TIFF or HEIF image in its own format. A file appears under
+// the name it has without its encrypted extension when that is the
+// extension of its data, and with the extension of its data added when
+// not, so a JPEG encrypted as a PNG appears as photo.jpg.png.
+//
+// Listing a directory decrypts nothing: the format and size of each file
+// are read from the header of its encrypted file. A redacted, scrambled or
+// tiled image is the exception, whose size is that of the encrypted file
+// until it has been read; KnowsSize tells them apart. A file is decrypted
+// as it is first read, whole; one that fails to decrypt, such as one
+// encrypted with another key, is listed, but reading it fails with the
+// decryption error, which is logged.
+//
+// It can be used by several goroutines at once.
+type DecryptedFS struct {
+	fsys   FileSystem
+	dir    string
+	ext    string
+	keys   *keyCipher
+	logger Logger
+	cache  *decryptedCache
+
+	mu      sync.Mutex
+	headers map[string]sourceHeader // By the path of the encrypted file
+}
+
+var (
+	_ fs.ReadDirFS = (*DecryptedFS)(nil)
+	_ fs.StatFS    = (*DecryptedFS)(nil)
+)
+
+// NewDecryptedFS returns the DecryptedFS of the encrypted files in dir,
+// decrypted with key.
+func NewDecryptedFS(dir string, key []byte, opts DecryptedFSOptions) (*DecryptedFS, error) {
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("%w: key must be %d bytes", ErrInvalidKeySize, KeySize)
+	}
+	fsys := orOS(opts.FS)
+	info, err := fsys.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", dir)
+	}
+	ext := cmp.Or(opts.EncryptedExt, EncryptedExtension)
+	size := opts.CacheSize
+	if size == 0 {
+		size = DefaultDecryptedCacheSize
+	}
+	return &DecryptedFS{
+		fsys:    fsys,
+		dir:     dir,
+		ext:     ext,
+		keys:    newKeyCipher(key),
+		logger:  orNop(opts.Logger),
+		cache:   newDecryptedCache(max(size, 0)),
+		headers: map[string]sourceHeader{},
+	}, nil
+}
+
+// source returns the encrypted file or directory of name, a valid path
+// of the view.
+func (d *DecryptedFS) source(name string) string {
+	if name == "." {
+		return d.dir
+	}
+	return joinName(d.dir, name)
+}
+
+// Stat returns the FileInfo of the file or directory name.
+func (d *DecryptedFS) Stat(name string) (fs.FileInfo, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrInvalid}
+	}
+	if info, err := d.fsys.Stat(d.source(name)); err == nil && info.IsDir() {
+		return decryptedInfo{FileInfo: info, name: path.Base(name)}, nil
+	}
+	_, info, h, ok := d.lookup(name)
+	if !ok {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	return d.fileInfo(name, info, h), nil
+}
+
+// KnowsSize reports whether the file name is shown with the size of its
+// data before it has been read, which it is unless it is a redacted,
+// scrambled or tiled image.
+func (d *DecryptedFS) KnowsSize(name string) bool {
+	if !fs.ValidPath(name) {
+		return false
+	}
+	_, _, h, ok := d.lookup(name)
+	return ok && h.size >= 0
+}
+
+// lookup returns the path of the encrypted file shown as the file name, a
+// valid path of the view, with its info and header: that of name itself,
+// or of name without the extension its data was given.
+func (d *DecryptedFS) lookup(name string) (source string, info fs.FileInfo, h sourceHeader, ok bool) {
+	plains := []string{name}
+	if ext := path.Ext(name); ext != "" && ext != path.Base(name) {
+		plains = append(plains, strings.TrimSuffix(name, ext))
+	}
+	for _, plain := range plains {
+		var err error
+		source = d.source(plain) + d.ext
+		info, err = d.fsys.Stat(source)
+		if err != nil || info.IsDir() {
+			continue
+		}
+		h = d.header(source, info)
+		if servedName(path.Base(plain), h.format) == path.Base(name) {
+			return source, info, h, true
+		}
+	}
+	return "", nil, sourceHeader{}, false
+}
+
+// fileInfo returns the FileInfo of the file name, whose encrypted file
+// has info and header h, sized as decrypted when that is known.
+func (d *DecryptedFS) fileInfo(name string, info fs.FileInfo, h sourceHeader) fs.FileInfo {
+	size := h.size
+	if size < 0 {
+		size = info.Size()
+		if known, ok := d.cache.size(name); ok {
+			size = known
+		}
+	}
+	return decryptedInfo{FileInfo: info, name: path.Base(name), size: size, sized: true}
+}
+
+// servedName returns the name the file plain, whose data is of format, is
+// shown under: plain when its extension is one of format's, and plain with
+// format's extension added when not.
+func servedName(plain, format string) string {
+	exts := imageFormatExtensions[format]
+	if len(exts) == 0 || slices.Contains(exts, strings.ToLower(path.Ext(plain))) {
+		return plain
+	}
+	return plain + exts[0]
+}
+
+// A sourceHeader is what the header of an encrypted file tells of its
+// data without decrypting it: its format, and its size, or -1 when that
+// cannot be told.
+type sourceHeader struct {
+	format  string
+	size    int64
+	modTime time.Time // Of the encrypted file when the header was read
+	encSize int64
+}
+
+// header returns the sourceHeader of the encrypted file source, which has
+// info, reading it unless that was done since the file last changed.
+func (d *DecryptedFS) header(source string, info fs.FileInfo) sourceHeader {
+	d.mu.Lock()
+	h, ok := d.headers[source]
+	d.mu.Unlock()
+	if ok && h.modTime.Equal(info.ModTime()) && h.encSize == info.Size() {
+		return h
+	}
+	h = d.readHeader(source, info.Size())
+	h.modTime, h.encSize = info.ModTime(), info.Size()
+	d.mu.Lock()
+	d.headers[source] = h
+	d.mu.Unlock()
+	return h
+}
+
+// readHeader reads the sourceHeader of the encrypted file source, of size
+// bytes. A file encrypted before its format was recorded is taken to hold
+// the format its name has, if that is one kept as it is, and a PNG if not.
+func (d *DecryptedFS) readHeader(source string, size int64) sourceHeader {
+	h := sourceHeader{format: "png", size: -1}
+	switch strings.ToLower(path.Ext(strings.TrimSuffix(source, d.ext))) {
+	case ".gif":
+		h.format = "gif"
+	case ".tif", ".tiff":
+		h.format = "tiff"
+	case ".heic", ".heif":
+		h.format = "heif"
+	}
+	f, err := d.fsys.Open(source)
+	if err != nil {
+		return h
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	thumbnail := embeddedThumbnailSize(r)
+	if _, err := r.Discard(thumbnail); err != nil {
+		return h
+	}
+	formatSize := embeddedFormatSize(r)
+	format, err := readFormat(r)
+	if err != nil {
+		return h
+	}
+	h.format = cmp.Or(format, h.format)
+	tags, err := readSealedTags(r)
+	if err != nil {
+		return h
+	}
+	header := int64(thumbnail + formatSize)
+	if tags != nil {
+		header += int64(len(tagsMagic) + 4 + len(tags))
+	}
+	h.size = plainSize(r, size-header)
+	return h
+}
+
+// plainSize returns the size of the data the ciphertext of n bytes r
+// starts with decrypts to: from the framing of a stream, or the nonce and
+// tag of data encrypted whole. It returns -1 for a redacted, scrambled or
+// tiled image, which is encoded again as it is decrypted.
+func plainSize(r *bufio.Reader, n int64) int64 {
+	if header, _ := r.Peek(streamHeaderSize + 4); IsStreamData(header) {
+		if len(header) < streamHeaderSize+4 {
+			return -1
+		}
+		suite, err := LookupCipherSuite(header[len(streamMagic)])
+		if err != nil {
+			return -1
+		}
+		aead, err := newSuiteAEAD(suite, make([]byte, suite.KeySize()))
+		if err != nil {
+			return -1
+		}
+		chunkSize := int64(binary.BigEndian.Uint32(header[len(streamMagic)+1:]))
+		overhead := int64(aead.Overhead())
+		body := n - int64(len(header)) - int64(binary.BigEndian.Uint32(header[streamHeaderSize:]))
+		if chunkSize <= 0 || body < overhead {
+			return -1
+		}
+		// Every chunk is full but the last, which holds the rest, and
+		// is empty only when all of the data is
+		chunks := (body-overhead-1)/(chunkSize+overhead) + 1
+		return body - chunks*overhead
+	}
+	if start, _ := r.Peek(512); isImageData(start) || bytes.HasPrefix(start, []byte(tiledMagic)) {
+		return -1
+	}
+	aead, err := AESGCM.NewAEAD(make([]byte, AESGCM.KeySize()))
+	if err != nil || n < int64(aead.NonceSize()+aead.Overhead()) {
+		return -1
+	}
+	return n - int64(aead.NonceSize()+aead.Overhead())
+}
+
+// ReadDir returns the entries of the directory name: its directories, and
+// its encrypted files under their decrypted names, sorted by name.
+func (d *DecryptedFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+	entries, err := d.fsys.ReadDir(d.source(name))
+	if err != nil {
+		return nil, err
+	}
+	var out []fs.DirEntry
+	for _, entry := range entries {
+		plain, ok := strings.CutSuffix(entry.Name(), d.ext)
+		if !entry.IsDir() && (!ok || plain == "") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		if entry.IsDir() {
+			out = append(out, fs.FileInfoToDirEntry(decryptedInfo{FileInfo: info, name: entry.Name()}))
+			continue
+		}
+		h := d.header(d.source(path.Join(name, plain))+d.ext, info)
+		served := path.Join(name, servedName(plain, h.format))
+		out = append(out, fs.FileInfoToDirEntry(d.fileInfo(served, info, h)))
+	}
+	slices.SortFunc(out, func(a, b fs.DirEntry) int { return strings.Compare(a.Name(), b.Name()) })
+	return out, nil
+}
+
+// Open opens the file or directory name. A file is not decrypted until it
+// is read.
+func (d *DecryptedFS) Open(name string) (fs.File, error) {
+	info, err := d.Stat(name)
+	if err != nil {
+		if cause := errors.Unwrap(err); cause != nil {
+			err = cause
+		}
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	if info.IsDir() {
+		entries, err := d.ReadDir(name)
+		if err != nil {
+			return nil, err
+		}
+		return &decryptedDir{info: info, entries: entries}, nil
+	}
+	source, _, _, ok := d.lookup(name)
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return &decryptedFile{fsys: d, name: name, source: source, info: info}, nil
+}
+
+// decrypt returns the decrypted data of the file name, whose encrypted
+// file is source, from the cache when it is there.
+func (d *DecryptedFS) decrypt(name, source string) ([]byte, error) {
+	if data, ok := d.cache.get(name); ok {
+		return data, nil
+	}
+	tiled, data, _, err := decryptFileData(context.Background(), d.fsys, nil, source, d.keys, SaveOptions{}, false)
+	if err == nil && tiled != nil {
+		var buf bytes.Buffer
+		err = png.Encode(&buf, tiled)
+		data = buf.Bytes()
+	}
+	if err != nil {
+		d.logger.Error("failed to decrypt", "path", source, "err", err)
+		return nil, err
+	}
+	d.cache.add(name, data)
+	return data, nil
+}
+
+// decryptedInfo is the FileInfo of a file or directory of a DecryptedFS:
+// that of its encrypted file under its decrypted name, with the size of
+// its decrypted data when sized.
+type decryptedInfo struct {
+	fs.FileInfo
+	name  string
+	size  int64
+	sized bool
+}
+
+func (i decryptedInfo) Name() string { return i.name }
+
+func (i decryptedInfo) Size() int64 {
+	if i.sized {
+		return i.size
+	}
+	return i.FileInfo.Size()
+}
+
+func (i decryptedInfo) Mode() fs.FileMode {
+	if i.IsDir() {
+		return fs.ModeDir | 0555
+	}
+	return 0444
+}
+
+// decryptedFile is an open file of a DecryptedFS, decrypted on its first
+// read.
+type decryptedFile struct {
+	fsys   *DecryptedFS
+	name   string
+	source string
+	info   fs.FileInfo
+	mu     sync.Mutex
+	r      *bytes.Reader
+	err    error
+}
+
+// reader returns the reader of the decrypted data, decrypting it first.
+func (f *decryptedFile) reader() (*bytes.Reader, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.r == nil && f.err == nil {
+		data, err := f.fsys.decrypt(f.name, f.source)
+		if err != nil {
+			f.err = &fs.PathError{Op: "read", Path: f.name, Err: err}
+		} else {
+			f.r = bytes.NewReader(data)
+		}
+	}
+	return f.r, f.err
+}
+
+func (f *decryptedFile) Stat() (fs.FileInfo, error) {
+	if size, ok := f.fsys.cache.size(f.name); ok {
+		return decryptedInfo{FileInfo: f.info, name: f.info.Name(), size: size, sized: true}, nil
+	}
+	return f.info, nil
+}
+
+func (f *decryptedFile) Read(b []byte) (int, error) {
+	r, err := f.reader()
+	if err != nil {
+		return 0, err
+	}
+	return r.Read(b)
+}
+
+func (f *decryptedFile) ReadAt(b []byte, off int64) (int, error) {
+	r, err := f.reader()
+	if err != nil {
+		return 0, err
+	}
+	return r.ReadAt(b, off)
+}
+
+func (f *decryptedFile) Seek(offset int64, whence int) (int64, error) {
+	r, err := f.reader()
+	if err != nil {
+		return 0, err
+	}
+	return r.Seek(offset, whence)
+}
+
+func (f *decryptedFile) Close() error { return nil }
+
+// decryptedDir is an open directory of a DecryptedFS.
+type decryptedDir struct {
+	info    fs.FileInfo
+	entries []fs.DirEntry
+}
+
+func (d *decryptedDir) Stat() (fs.FileInfo, error) { return d.info, nil }
+func (d *decryptedDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.Name(), Err: errors.New("is a directory")}
+}
+func (d *decryptedDir) Close() error { return nil }
+
+func (d *decryptedDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if n <= 0 {
+		entries := d.entries
+		d.entries = nil
+		return entries, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	n = min(n, len(d.entries))
+	entries := d.entries[:n]
+	d.entries = d.entries[n:]
+	return entries, nil
+}
+
+// A decryptedCache keeps the decrypted data of files up to a number of
+// bytes, dropping the least recently used first, and the sizes of every
+// file decrypted.
+type decryptedCache struct {
+	mu      sync.Mutex
+	limit   int64
+	used    int64
+	order   *list.List // Of *cachedFile, the most recently used first
+	entries map[string]*list.Element
+	sizes   map[string]int64
+}
+
+type cachedFile struct {
+	name string
+	data []byte
+}
+
+func newDecryptedCache(limit int64) *decryptedCache {
+	return &decryptedCache{limit: limit, order: list.New(), entries: map[string]*list.Element{}, sizes: map[string]int64{}}
+}
+
+func (c *decryptedCache) get(name string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[name]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(e)
+	return e.Value.(*cachedFile).data, true
+}
+
+// size returns the size of the decrypted data of name, if it has been
+// decrypted.
+func (c *decryptedCache) size(name string) (int64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	size, ok := c.sizes[name]
+	return size, ok
+}
+
+// add keeps data as the file name, unless it is larger than the cache,
+// dropping others to make room.
+func (c *decryptedCache) add(name string, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sizes[name] = int64(len(data))
+	if int64(len(data)) > c.limit {
+		return
+	}
+	if e, ok := c.entries[name]; ok {
+		c.used -= int64(len(e.Value.(*cachedFile).data))
+		c.order.Remove(e)
+	}
+	for c.used+int64(len(data)) > c.limit {
+		last := c.order.Back()
+		dropped := c.order.Remove(last).(*cachedFile)
+		delete(c.entries, dropped.name)
+		c.used -= int64(len(dropped.data))
+	}
+	c.entries[name] = c.order.PushFront(&cachedFile{name: name, data: data})
+	c.used += int64(len(data))
+}
@@ -0,0 +1,207 @@
+package pixellock
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io/fs"
+	"path/filepath"
+	"slices"
+	"testing"
+	"testing/fstest"
+)
+
+// decryptedFSFixture encrypts the images of progressFixture, n of them,
+// into the directory enc of the filesystem returned, one of them in a
+// subdirectory, another with a key other than the one returned, and
+// leaves a file that is not encrypted there too.
+func decryptedFSFixture(t *testing.T, n int) (*MemFS, []byte) {
+	t.Helper()
+	key, _ := GenerateRandomKey()
+	fsys, input := progressFixture(t, n)
+	for i, name := range []string{"img0.png", "sub/img1.png"} {
+		if i >= n {
+			break
+		}
+		src := filepath.Join(input, filepath.Base(name))
+		if err := EncryptFile(t.Context(), src, filepath.Join("enc", name+EncryptedExtension), key, false, EncryptOptions{FS: fsys}); err != nil {
+			t.Fatalf("EncryptFile failed: %v", err)
+		}
+	}
+	other, _ := GenerateRandomKey()
+	if err := EncryptFile(t.Context(), filepath.Join(input, "img0.png"), filepath.Join("enc", "other.png"+EncryptedExtension), other, false, EncryptOptions{FS: fsys}); err != nil {
+		t.Fatalf("EncryptFile failed: %v", err)
+	}
+	memWrite(t, fsys, filepath.Join("enc", "notes.txt"), []byte("not encrypted"))
+	return fsys, key
+}
+
+func TestDecryptedFS(t *testing.T) {
+	fsys, key := decryptedFSFixture(t, 2)
+	var logged recordingLogger
+	dfs, err := NewDecryptedFS("enc", key, DecryptedFSOptions{FS: fsys, Logger: &logged})
+	if err != nil {
+		t.Fatalf("NewDecryptedFS failed: %v", err)
+	}
+
+	entries, err := fs.ReadDir(dfs, ".")
+	if err != nil {
+		t.Fatalf("ReadDir failed: %v", err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	if want := []string{"img0.png", "other.png", "sub"}; !slices.Equal(names, want) {
+		t.Errorf("listed %v, want %v", names, want)
+	}
+	if len(logged.records) != 0 {
+		t.Errorf("listing decrypted files: %v", logged.records)
+	}
+
+	// Each file reads as decrypting it directly gives it, at the size it
+	// was listed with
+	for _, name := range []string{"img0.png", "sub/img1.png"} {
+		listed, err := fs.Stat(dfs, name)
+		if err != nil {
+			t.Fatalf("Stat(%s) failed: %v", name, err)
+		}
+		if !dfs.KnowsSize(name) {
+			t.Errorf("the size of %s is not known before it is read", name)
+		}
+		got, err := fs.ReadFile(dfs, name)
+		if err != nil {
+			t.Fatalf("ReadFile(%s) failed: %v", name, err)
+		}
+		encrypted, _ := fs.ReadFile(fsys, filepath.Join("enc", name+EncryptedExtension))
+		var want bytes.Buffer
+		if err := DecryptImage(t.Context(), key, &want, bytes.NewReader(encrypted)); err != nil {
+			t.Fatalf("DecryptImage failed: %v", err)
+		}
+		if sha256.Sum256(got) != sha256.Sum256(want.Bytes()) {
+			t.Errorf("%s differs from its direct decryption", name)
+		}
+		if listed.Size() != int64(len(got)) {
+			t.Errorf("%s was listed at %d bytes, not %d", name, listed.Size(), len(got))
+		}
+	}
+
+	// A file of another key is listed, but cannot be read
+	f, err := dfs.Open("other.png")
+	if err != nil {
+		t.Fatalf("Open of a file of another key failed: %v", err)
+	}
+	defer f.Close()
+	if _, err := f.Read(make([]byte, 10)); ErrorCodeOf(err) != CodeKeyMismatch {
+		t.Errorf("Read of a file of another key = %v, want a key mismatch", err)
+	}
+	if !logged.has("error: failed to decrypt other.png.enc") {
+		t.Errorf("the failure was not logged: %v", logged.records)
+	}
+
+	for _, name := range []string{"notes.txt", "img0.png.enc", "missing.png", "../enc/img0.png"} {
+		if _, err := dfs.Open(name); err == nil {
+			t.Errorf("Open(%s) succeeded", name)
+		}
+	}
+}
+
+func TestDecryptedFSConformance(t *testing.T) {
+	fsys, key := decryptedFSFixture(t, 2)
+	fsys.Remove(filepath.Join("enc", "other.png"+EncryptedExtension))
+	dfs, err := NewDecryptedFS("enc", key, DecryptedFSOptions{FS: fsys})
+	if err != nil {
+		t.Fatalf("NewDecryptedFS failed: %v", err)
+	}
+	if err := fstest.TestFS(dfs, "img0.png", "sub/img1.png"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDecryptedFSFormats(t *testing.T) {
+	key, _ := GenerateRandomKey()
+	dir := t.TempDir()
+	encrypt := func(src, name string, opts EncryptOptions) {
+		t.Helper()
+		if err := EncryptFile(t.Context(), src, filepath.Join(dir, name+EncryptedExtension), key, false, opts); err != nil {
+			t.Fatalf("EncryptFile failed: %v", err)
+		}
+	}
+	encrypt(faceFixture, "face.jpg", EncryptOptions{Thumbnail: 64, EmbedThumbnail: true})
+	encrypt("testdata/scan3.tiff", "scan.tiff", EncryptOptions{})
+	encrypt(faceFixture, "scrambled.jpg", EncryptOptions{Mode: ModeScramble})
+	if err := WriteTags(filepath.Join(dir, "face.jpg"+EncryptedExtension), key, Tags{"client": "acme"}); err != nil {
+		t.Fatalf("WriteTags failed: %v", err)
+	}
+	dfs, err := NewDecryptedFS(dir, key, DecryptedFSOptions{})
+	if err != nil {
+		t.Fatalf("NewDecryptedFS failed: %v", err)
+	}
+
+	// A JPEG is stored as a PNG, and shown as one; a multi-page TIFF is
+	// kept as it is
+	entries, err := fs.ReadDir(dfs, ".")
+	if err != nil {
+		t.Fatalf("ReadDir failed: %v", err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	if want := []string{"face.jpg.png", "scan.tiff", "scrambled.jpg.png"}; !slices.Equal(names, want) {
+		t.Errorf("listed %v, want %v", names, want)
+	}
+	if _, err := dfs.Open("face.jpg"); err == nil {
+		t.Error("Open of a JPEG under its own name succeeded")
+	}
+	for _, name := range []string{"face.jpg.png", "scan.tiff"} {
+		listed, _ := fs.Stat(dfs, name)
+		got, err := fs.ReadFile(dfs, name)
+		if err != nil {
+			t.Fatalf("ReadFile(%s) failed: %v", name, err)
+		}
+		if listed.Size() != int64(len(got)) {
+			t.Errorf("%s was listed at %d bytes, not %d", name, listed.Size(), len(got))
+		}
+	}
+	if got, _ := fs.ReadFile(dfs, "face.jpg.png"); !bytes.HasPrefix(got, pngSignature) {
+		t.Error("face.jpg.png is not a PNG")
+	}
+	if got, _ := fs.ReadFile(dfs, "scan.tiff"); !IsMultiPageTIFFData(got) {
+		t.Error("scan.tiff is not the multi-page TIFF")
+	}
+
+	// A scrambled image is encoded again as it is decrypted
+	if dfs.KnowsSize("scrambled.jpg.png") {
+		t.Error("the size of a scrambled image is known before it is read")
+	}
+	got, err := fs.ReadFile(dfs, "scrambled.jpg.png")
+	if err != nil {
+		t.Fatalf("ReadFile of a scrambled image failed: %v", err)
+	}
+	if info, _ := fs.Stat(dfs, "scrambled.jpg.png"); info.Size() != int64(len(got)) {
+		t.Errorf("scrambled.jpg.png is %d bytes once read, not %d", info.Size(), len(got))
+	}
+}
+
+func TestDecryptedCache(t *testing.T) {
+	c := newDecryptedCache(10)
+	c.add("a", make([]byte, 4))
+	c.add("b", make([]byte, 4))
+	c.get("a") // b is now the least recently used
+	c.add("c", make([]byte, 4))
+	if _, ok := c.get("b"); ok {
+		t.Error("the least recently used file was kept")
+	}
+	for _, name := range []string{"a", "c"} {
+		if _, ok := c.get(name); !ok {
+			t.Errorf("%s was dropped", name)
+		}
+	}
+	c.add("big", make([]byte, 11))
+	if _, ok := c.get("big"); ok || c.used != 8 {
+		t.Errorf("a file larger than the cache was kept, or made room: %d bytes used", c.used)
+	}
+	if size, ok := c.size("big"); !ok || size != 11 {
+		t.Errorf("size of a file not kept = %d, %v", size, ok)
+	}
+}
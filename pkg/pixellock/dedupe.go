@@ -0,0 +1,349 @@
+package pixellock
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The modes of a Deduper: DedupeLink makes a duplicate a hard link to the
+// encrypted file it duplicates, falling back to a reference where the
+// filesystem cannot link; DedupeReference records it in the manifest of
+// references alone.
+const (
+	DedupeLink      = "link"
+	DedupeReference = "reference"
+)
+
+// DedupeManifestName is the name of the manifest of references a Deduper
+// writes to its root directory, which DecryptDirectory reads.
+const DedupeManifestName = "dedupe-manifest.json"
+
+// dedupeIndexVersion is the version of the index a Deduper saves.
+const dedupeIndexVersion = 1
+
+// CheckDedupeMode returns an error unless mode is a mode of a Deduper.
+func CheckDedupeMode(mode string) error {
+	switch mode {
+	case DedupeLink, DedupeReference:
+		return nil
+	}
+	return fmt.Errorf("invalid dedupe mode %q: must be %s or %s", mode, DedupeLink, DedupeReference)
+}
+
+// A DedupeManifest lists the references of a directory of encrypted files:
+// files that were not written, each the duplicate of an encrypted file
+// that was.
+type DedupeManifest struct {
+	// References gives, by the path of each file not written, the
+	// encrypted file it duplicates. Both are relative to the directory
+	// and / separated, but for a file outside it, which is absolute.
+	References map[string]string `json:"references"`
+}
+
+// ReadDedupeManifest reads the manifest of references in the directory
+// dir of fsys, or returns an empty one when there is none. The paths of
+// its references must all be local, as filepath.IsLocal says.
+func ReadDedupeManifest(fsys FileSystem, dir string) (*DedupeManifest, error) {
+	m := &DedupeManifest{References: map[string]string{}}
+	name := joinName(dir, DedupeManifestName)
+	data, err := fs.ReadFile(fsys, name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("%s: bad manifest: %w", name, err)
+	}
+	if m.References == nil {
+		m.References = map[string]string{}
+	}
+	for path, target := range m.References {
+		if !filepath.IsLocal(filepath.FromSlash(path)) || target == "" {
+			return nil, fmt.Errorf("%s: bad reference %q, %q", name, path, target)
+		}
+	}
+	return m, nil
+}
+
+// Target returns the name of the encrypted file the reference at path
+// stands for, in the directory dir.
+func (m *DedupeManifest) Target(dir, path string) string {
+	target := m.References[path]
+	if filepath.IsAbs(target) {
+		return target
+	}
+	return joinName(dir, filepath.FromSlash(target))
+}
+
+// A Deduper finds the images an encryption duplicates, by the SHA-256
+// hash of the plaintext stored, so that a duplicate is not encrypted
+// again: it becomes a hard link to the encrypted file it duplicates, or a
+// reference to it in the manifest of its root directory, as its mode
+// says. It knows the images encrypted with it, and, with an index file,
+// those of the runs before, whose encrypted files are taken to be
+// unchanged while their size and modification time are. Only images
+// encrypted with the same key, cipher and embedded thumbnail are taken
+// for duplicates. Save writes its index and manifest once encryption is
+// done. A Deduper can be used by several goroutines at once.
+type Deduper struct {
+	mode, root, index string
+
+	mu       sync.Mutex
+	entries  map[dedupeKey]dedupeEntry
+	pending  map[dedupeKey]chan struct{} // Closed once the image being encrypted is
+	manifest *DedupeManifest
+	stats    DedupeStats
+}
+
+// DedupeStats are what a Deduper found.
+type DedupeStats struct {
+	Duplicates int   // Images not encrypted again
+	Saved      int64 // Bytes of the encrypted files not written for them
+}
+
+// A dedupeKey is what makes images duplicates: the hash of their
+// plaintext, and the key, cipher and embedded thumbnail they are
+// encrypted with.
+type dedupeKey struct {
+	SHA256         string `json:"sha256"`
+	KeyFingerprint string `json:"key_fingerprint"`
+	Cipher         string `json:"cipher"`
+	Thumbnail      int    `json:"thumbnail,omitempty"`
+}
+
+// A dedupeEntry is an image encrypted, as the index file records it.
+type dedupeEntry struct {
+	dedupeKey
+	Output  string    `json:"output"` // Absolute
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+// NewDeduper returns a Deduper in mode whose references are recorded in
+// the manifest of the directory root, updating any there. When index is
+// not empty, it is the index file of the images encrypted before, read
+// if it exists.
+func NewDeduper(mode, root, index string) (*Deduper, error) {
+	if err := CheckDedupeMode(mode); err != nil {
+		return nil, err
+	}
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	d := &Deduper{mode: mode, root: root, index: index, entries: map[dedupeKey]dedupeEntry{}, pending: map[dedupeKey]chan struct{}{}}
+	if d.manifest, err = ReadDedupeManifest(OSFS{}, root); err != nil {
+		return nil, err
+	}
+	if index == "" {
+		return d, nil
+	}
+	data, err := os.ReadFile(index)
+	if errors.Is(err, fs.ErrNotExist) {
+		return d, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var file struct {
+		Version int           `json:"version"`
+		Files   []dedupeEntry `json:"files"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("%s: bad dedupe index: %w", index, err)
+	}
+	if file.Version > dedupeIndexVersion {
+		return nil, fmt.Errorf("%s: dedupe index of a newer pixellock, of version %d", index, file.Version)
+	}
+	for _, e := range file.Files {
+		d.entries[e.dedupeKey] = e
+	}
+	return d, nil
+}
+
+// Stats returns what d found so far.
+func (d *Deduper) Stats() DedupeStats {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.stats
+}
+
+// Save writes the manifest of references to the root directory, when
+// there are any or it is there already, and the index file, if d has one.
+func (d *Deduper) Save() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	manifest := filepath.Join(d.root, DedupeManifestName)
+	if len(d.manifest.References) > 0 || exists(OSFS{}, manifest) {
+		if err := os.MkdirAll(d.root, 0o755); err != nil {
+			return err
+		}
+		if err := writeJSON(manifest, d.manifest); err != nil {
+			return err
+		}
+	}
+	if d.index == "" {
+		return nil
+	}
+	entries := slices.SortedFunc(maps.Values(d.entries), func(a, b dedupeEntry) int { return strings.Compare(a.Output, b.Output) })
+	return writeJSON(d.index, map[string]any{"version": dedupeIndexVersion, "files": entries})
+}
+
+// writeJSON writes v as indented JSON to the file name, beside it first
+// and renamed into place.
+func writeJSON(name string, v any) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := name + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0o644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, name); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// key returns the dedupeKey of the plaintext encrypted with the key of
+// keys as opts says.
+func (d *Deduper) key(plaintext []byte, keys *keyCipher, opts EncryptOptions) dedupeKey {
+	sum := sha256.Sum256(plaintext)
+	return dedupeKey{
+		SHA256:         hex.EncodeToString(sum[:]),
+		KeyFingerprint: KeyFingerprint(keys.key),
+		Cipher:         CipherName(opts.cipherSuite()),
+		Thumbnail:      opts.Thumbnail,
+	}
+}
+
+// claim looks up the image of key, to be encrypted to output. When it
+// duplicates an image encrypted already, claim makes output a link or
+// reference to that and returns its encrypted file. Otherwise it returns
+// "" and done, which the caller must call once it has encrypted the image,
+// or failed to, with the error. A duplicate of an image being encrypted
+// waits for it. Falling back from a link to a reference is logged to
+// logger.
+func (d *Deduper) claim(key dedupeKey, output string, logger Logger) (original string, done func(error), err error) {
+	output, err = filepath.Abs(output)
+	if err != nil {
+		return "", nil, err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for {
+		if e, ok := d.entries[key]; ok && e.Output != output {
+			if info, err := os.Stat(e.Output); err == nil && info.Size() == e.Size && info.ModTime().Equal(e.ModTime) {
+				if err := d.duplicate(e.Output, output, logger); err != nil {
+					return "", nil, err
+				}
+				d.stats.Duplicates++
+				d.stats.Saved += e.Size
+				return e.Output, nil, nil
+			}
+			delete(d.entries, key) // Changed or gone since
+		}
+		wait, ok := d.pending[key]
+		if !ok {
+			break
+		}
+		d.mu.Unlock()
+		<-wait
+		d.mu.Lock()
+	}
+	finished := make(chan struct{})
+	d.pending[key] = finished
+	return "", func(err error) {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		delete(d.pending, key)
+		close(finished)
+		if err != nil {
+			return
+		}
+		if info, err := os.Stat(output); err == nil && info.Mode().IsRegular() {
+			d.entries[key] = dedupeEntry{dedupeKey: key, Output: output, Size: info.Size(), ModTime: info.ModTime()}
+			if path, ok := d.relative(output); ok {
+				delete(d.manifest.References, path)
+			}
+		}
+	}, nil
+}
+
+// duplicate makes output, which must not exist unless it is to be
+// replaced, a link or reference to the encrypted file original.
+func (d *Deduper) duplicate(original, output string, logger Logger) error {
+	path, ok := d.relative(output)
+	if d.mode == DedupeLink || !ok {
+		if err := os.MkdirAll(filepath.Dir(output), 0o755); err != nil {
+			return err
+		}
+		os.Remove(output)
+		err := os.Link(original, output)
+		if err == nil || !ok {
+			if ok {
+				delete(d.manifest.References, path)
+			}
+			return err
+		}
+		logger.Warn("cannot link to the original; recording a reference instead", "path", output, "original", original, "err", err)
+	}
+	if err := os.Remove(output); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	target, ok := d.relative(original)
+	if !ok {
+		target = original
+	}
+	d.manifest.References[path] = target
+	return nil
+}
+
+// relative returns the path of name within the root directory, /
+// separated, and whether it is within it.
+func (d *Deduper) relative(name string) (string, bool) {
+	rel, err := filepath.Rel(d.root, name)
+	if err != nil || !filepath.IsLocal(rel) {
+		return "", false
+	}
+	return filepath.ToSlash(rel), true
+}
+
+// dedupeReferences returns the references of the manifest in the
+// directory dir of fsys whose paths end with ext, and are in dir itself
+// unless recursive is set, and whose encrypted files match accepts. They
+// are given by the name each reference would have in dir, as a file, and
+// name the encrypted file it stands for. A reference whose path holds a
+// file is left out, the file being decrypted itself.
+func dedupeReferences(fsys FileSystem, dir string, recursive bool, ext string, match func(target string) bool) (map[string]string, error) {
+	m, err := ReadDedupeManifest(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+	refs := map[string]string{}
+	for path := range m.References {
+		name := joinName(dir, filepath.FromSlash(path))
+		if !strings.HasSuffix(path, ext) || !recursive && strings.Contains(path, "/") || exists(fsys, name) {
+			continue
+		}
+		if target := m.Target(dir, path); match(target) {
+			refs[name] = target
+		}
+	}
+	return refs, nil
+}
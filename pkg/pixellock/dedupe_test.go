@@ -0,0 +1,181 @@
+package pixellock
+
+import (
+	"bytes"
+	"image"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// dedupeTree writes a tree of five images, three copies of the face
+// fixture and two of a red square, to dir, returning their paths.
+func dedupeTree(t *testing.T, dir string) []string {
+	t.Helper()
+	face, _ := os.ReadFile(faceFixture)
+	paths := []string{"a/face.jpg", "b/face copy.jpg", "c/d/face.jpg", "red.png", "e/red2.png"}
+	for _, path := range paths {
+		name := filepath.Join(dir, filepath.FromSlash(path))
+		os.MkdirAll(filepath.Dir(name), 0o755)
+		if strings.HasPrefix(filepath.Base(path), "red") {
+			createImageFile(t, name)
+		} else if err := os.WriteFile(name, face, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return paths
+}
+
+// outputFiles returns the regular files under dir, by path, but for the
+// manifest of references.
+func outputFiles(t *testing.T, dir string) map[string]os.FileInfo {
+	t.Helper()
+	files := map[string]os.FileInfo{}
+	filepath.WalkDir(dir, func(name string, d fs.DirEntry, err error) error {
+		if err == nil && d.Type().IsRegular() && d.Name() != DedupeManifestName {
+			rel, _ := filepath.Rel(dir, name)
+			files[filepath.ToSlash(rel)], _ = d.Info()
+		}
+		return err
+	})
+	return files
+}
+
+// checkDecryptedTree decrypts the encrypted tree in dir and fails unless
+// every image of paths comes back, each duplicate as its original.
+func checkDecryptedTree(t *testing.T, key []byte, dir string, paths []string) {
+	t.Helper()
+	out := t.TempDir()
+	if err := DecryptDirectory(t.Context(), dir, out, key, true, EncryptedExtension, false, SaveOptions{}); err != nil {
+		t.Fatalf("DecryptDirectory failed: %v", err)
+	}
+	originals := map[bool][]byte{}
+	for _, path := range paths {
+		data, err := os.ReadFile(filepath.Join(out, filepath.FromSlash(path)))
+		if err != nil {
+			t.Errorf("%s was not decrypted: %v", path, err)
+			continue
+		}
+		red := strings.HasPrefix(filepath.Base(path), "red")
+		if originals[red] == nil {
+			originals[red] = data
+		} else if !bytes.Equal(data, originals[red]) {
+			t.Errorf("%s decrypted is not as its duplicates", path)
+		}
+		if img, _, err := image.Decode(bytes.NewReader(data)); err != nil || red && img.Bounds().Dx() != 10 || !red && img.Bounds().Dx() != 320 {
+			t.Errorf("%s decrypted is not its image: %v", path, err)
+		}
+	}
+}
+
+func TestDedupe(t *testing.T) {
+	key, _ := GenerateRandomKey()
+	input := t.TempDir()
+	paths := dedupeTree(t, input)
+
+	t.Run("link", func(t *testing.T) {
+		out := t.TempDir()
+		d, err := NewDeduper(DedupeLink, out, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := EncryptDirectory(t.Context(), input, out, key, true, false, EncryptOptions{Dedupe: d}); err != nil {
+			t.Fatalf("EncryptDirectory failed: %v", err)
+		}
+		files := outputFiles(t, out)
+		if len(files) != len(paths) {
+			t.Fatalf("wrote %d files, want %d", len(files), len(paths))
+		}
+		var distinct []os.FileInfo
+		var total int64
+	files:
+		for _, info := range files {
+			for _, other := range distinct {
+				if os.SameFile(info, other) {
+					continue files
+				}
+			}
+			distinct = append(distinct, info)
+			total += info.Size()
+		}
+		if stats := d.Stats(); len(distinct) != 2 || stats.Duplicates != 3 {
+			t.Errorf("wrote %d distinct files, with %d duplicates; want 2 and 3", len(distinct), stats.Duplicates)
+		}
+		if stats := d.Stats(); stats.Saved <= 0 || stats.Saved >= 3*total {
+			t.Errorf("saved %d bytes, of %d written", stats.Saved, total)
+		}
+		checkDecryptedTree(t, key, out, paths)
+	})
+
+	t.Run("reference", func(t *testing.T) {
+		out, index := t.TempDir(), filepath.Join(t.TempDir(), "dedupe.json")
+		d, err := NewDeduper(DedupeReference, out, index)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := EncryptDirectory(t.Context(), input, out, key, true, false, EncryptOptions{Dedupe: d}); err != nil {
+			t.Fatalf("EncryptDirectory failed: %v", err)
+		}
+		if err := d.Save(); err != nil {
+			t.Fatalf("Save failed: %v", err)
+		}
+		// The two distinct images alone are written
+		files := outputFiles(t, out)
+		var total int64
+		for _, info := range files {
+			total += info.Size()
+		}
+		if len(files) != 2 || d.Stats().Saved < total {
+			t.Fatalf("wrote %d files of %d bytes, saving %d; want the 2 distinct images alone", len(files), total, d.Stats().Saved)
+		}
+		m, err := ReadDedupeManifest(OSFS{}, out)
+		if err != nil || len(m.References) != 3 {
+			t.Fatalf("ReadDedupeManifest gave %v, %v", m, err)
+		}
+		checkDecryptedTree(t, key, out, paths)
+
+		// A later run finds the images of this one, by the index, and
+		// refers to them where they are
+		again := t.TempDir()
+		d, err = NewDeduper(DedupeReference, again, index)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := EncryptDirectory(t.Context(), input, again, key, true, false, EncryptOptions{Dedupe: d}); err != nil {
+			t.Fatalf("EncryptDirectory failed: %v", err)
+		}
+		if err := d.Save(); err != nil {
+			t.Fatal(err)
+		}
+		if files := outputFiles(t, again); len(files) != 0 || d.Stats().Duplicates != len(paths) {
+			t.Errorf("a run with the index wrote %d files, with %d duplicates", len(files), d.Stats().Duplicates)
+		}
+		checkDecryptedTree(t, key, again, paths)
+
+		// Nor is an image taken for a duplicate under another key
+		other, _ := GenerateRandomKey()
+		d, _ = NewDeduper(DedupeReference, t.TempDir(), index)
+		if err := EncryptFile(t.Context(), filepath.Join(input, "red.png"), filepath.Join(t.TempDir(), "red.png.enc"), other, false, EncryptOptions{Dedupe: d}); err != nil {
+			t.Fatal(err)
+		}
+		if d.Stats().Duplicates != 0 {
+			t.Error("an image encrypted with another key was taken for a duplicate")
+		}
+	})
+
+	for _, opts := range []EncryptOptions{
+		{Thumbnail: 64},
+		{Mode: ModeScramble},
+		{Regions: []image.Rectangle{image.Rect(0, 0, 5, 5)}},
+	} {
+		opts.Dedupe = &Deduper{}
+		if opts.Check() == nil {
+			t.Errorf("Check of deduplication with %+v succeeded", opts)
+		}
+	}
+	if _, err := NewDeduper("copy", t.TempDir(), ""); err == nil {
+		t.Error("NewDeduper with a bad mode succeeded")
+	}
+}
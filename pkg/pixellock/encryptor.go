@@ -0,0 +1,247 @@
+package pixellock
+
+import (
+	"context"
+	"fmt"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// OverwritePolicy says what an Encryptor or Decryptor does about an output
+// file that exists already.
+type OverwritePolicy int
+
+const (
+	OverwriteSkip    OverwritePolicy = iota // Leave it alone, skipping the input
+	OverwriteReplace                        // Replace it
+)
+
+// An Encryptor encrypts images, as EncryptFile and EncryptDirectory do,
+// with the key and options it was made with by NewEncryptor. It can be
+// used by several goroutines at once.
+type Encryptor struct {
+	key       []byte
+	keys      *keyCipher // The ciphers of key, shared by every file
+	overwrite OverwritePolicy
+	recursive bool
+	opts      EncryptOptions
+}
+
+// A Decryptor decrypts files encrypted by an Encryptor, as DecryptFile and
+// DecryptDirectory do, with the key and options it was made with by
+// NewDecryptor. It can be used by several goroutines at once.
+type Decryptor struct {
+	key          []byte
+	keys         *keyCipher // The ciphers of key, shared by every file
+	overwrite    OverwritePolicy
+	recursive    bool
+	encryptedExt string
+	save         SaveOptions
+}
+
+// An EncryptorOption configures an Encryptor.
+type EncryptorOption interface {
+	applyEncryptor(*Encryptor)
+}
+
+// A DecryptorOption configures a Decryptor.
+type DecryptorOption interface {
+	applyDecryptor(*Decryptor)
+}
+
+// An Option configures an Encryptor or a Decryptor alike.
+type Option interface {
+	EncryptorOption
+	DecryptorOption
+}
+
+// processorSettings are the settings Encryptors and Decryptors share.
+type processorSettings struct {
+	key       *[]byte
+	overwrite *OverwritePolicy
+	recursive *bool
+	workers   *int
+	maxPixels *int64
+	progress  *func(Event)
+	logger    *Logger
+	fsys      *FileSystem
+	tracer    *trace.TracerProvider
+}
+
+type sharedOption func(processorSettings)
+
+func (o sharedOption) applyEncryptor(e *Encryptor) {
+	o(processorSettings{&e.key, &e.overwrite, &e.recursive, &e.opts.Workers, &e.opts.MaxPixels, &e.opts.Progress, &e.opts.Logger, &e.opts.FS, &e.opts.TracerProvider})
+}
+
+func (o sharedOption) applyDecryptor(d *Decryptor) {
+	o(processorSettings{&d.key, &d.overwrite, &d.recursive, &d.save.Workers, &d.save.MaxPixels, &d.save.Progress, &d.save.Logger, &d.save.FS, &d.save.TracerProvider})
+}
+
+type encryptorOption func(*Encryptor)
+
+func (o encryptorOption) applyEncryptor(e *Encryptor) { o(e) }
+
+type decryptorOption func(*Decryptor)
+
+func (o decryptorOption) applyDecryptor(d *Decryptor) { o(d) }
+
+// WithKey sets the key, which must be given.
+func WithKey(key []byte) Option {
+	return sharedOption(func(s processorSettings) { *s.key = key })
+}
+
+// WithOverwritePolicy sets what is done about output files that exist
+// already; OverwriteSkip by default.
+func WithOverwritePolicy(policy OverwritePolicy) Option {
+	return sharedOption(func(s processorSettings) { *s.overwrite = policy })
+}
+
+// WithRecursive makes ProcessDir descend into subdirectories.
+func WithRecursive(recursive bool) Option {
+	return sharedOption(func(s processorSettings) { *s.recursive = recursive })
+}
+
+// WithWorkers sets the number of files ProcessDir works on at once;
+// runtime.NumCPU() by default.
+func WithWorkers(n int) Option {
+	return sharedOption(func(s processorSettings) { *s.workers = n })
+}
+
+// WithMaxPixels sets the most pixels, width by height, an image may claim
+// to be decoded, as the MaxPixels field of EncryptOptions and SaveOptions
+// does; DefaultMaxPixels by default, and any when negative.
+func WithMaxPixels(n int64) Option {
+	return sharedOption(func(s processorSettings) { *s.maxPixels = n })
+}
+
+// WithProgress sets the callback given the Events of each file, as the
+// Progress field of EncryptOptions and SaveOptions is.
+func WithProgress(progress func(Event)) Option {
+	return sharedOption(func(s processorSettings) { *s.progress = progress })
+}
+
+// WithLogger sets the Logger given what is logged, as the Logger field of
+// EncryptOptions and SaveOptions is; nothing is logged by default.
+func WithLogger(logger Logger) Option {
+	return sharedOption(func(s processorSettings) { *s.logger = logger })
+}
+
+// WithFS sets the filesystem files are read from and written to, as the
+// FS field of EncryptOptions and SaveOptions does; OSFS by default.
+func WithFS(fsys FileSystem) Option {
+	return sharedOption(func(s processorSettings) { *s.fsys = fsys })
+}
+
+// WithTracerProvider sets the TracerProvider the spans of each directory
+// and file are started with, as the TracerProvider field of EncryptOptions
+// and SaveOptions does; the global one by default.
+func WithTracerProvider(tp trace.TracerProvider) Option {
+	return sharedOption(func(s processorSettings) { *s.tracer = tp })
+}
+
+// WithEncryptOptions sets every option of encryption at once, in place of
+// any set by the options before it.
+func WithEncryptOptions(opts EncryptOptions) EncryptorOption {
+	return encryptorOption(func(e *Encryptor) { e.opts = opts })
+}
+
+// WithCipher sets the suite images are encrypted with; AESGCM by default.
+func WithCipher(suite CipherSuite) EncryptorOption {
+	return encryptorOption(func(e *Encryptor) { e.opts.Cipher = suite })
+}
+
+// WithSaveOptions sets every option images are written with at once, in
+// place of any set by the options before it.
+func WithSaveOptions(save SaveOptions) DecryptorOption {
+	return decryptorOption(func(d *Decryptor) { d.save = save })
+}
+
+// WithOutputFormat sets the format images are written in, one of
+// OutputFormats; the format each was encrypted from by default.
+func WithOutputFormat(format string) DecryptorOption {
+	return decryptorOption(func(d *Decryptor) { d.save.Format = format })
+}
+
+// WithCompression sets the compression of PNG output, one of the
+// PNGCompression constants; PNGCompressionDefault by default.
+func WithCompression(compression string) DecryptorOption {
+	return decryptorOption(func(d *Decryptor) { d.save.PNGCompression = compression })
+}
+
+// WithEncryptedExtension sets the extension of the files ProcessDir
+// decrypts, which is taken off their outputs; EncryptedExtension by
+// default.
+func WithEncryptedExtension(ext string) DecryptorOption {
+	return decryptorOption(func(d *Decryptor) { d.encryptedExt = ext })
+}
+
+// WithTags sets the tags of the files ProcessDir decrypts, leaving out
+// those without them, as SaveOptions.Tags does; every file by default.
+func WithTags(tags Tags) DecryptorOption {
+	return decryptorOption(func(d *Decryptor) { d.save.Tags = tags })
+}
+
+// NewEncryptor returns an Encryptor configured by opts, applied in order.
+// Those not given default to what EncryptFile does with zero
+// EncryptOptions.
+func NewEncryptor(opts ...EncryptorOption) (*Encryptor, error) {
+	e := &Encryptor{}
+	for _, opt := range opts {
+		opt.applyEncryptor(e)
+	}
+	if suite := e.opts.cipherSuite(); len(e.key) != suite.KeySize() {
+		return nil, fmt.Errorf("%w: cipher %d takes a %d-byte key, given %d bytes", ErrInvalidKeySize, suite.ID(), suite.KeySize(), len(e.key))
+	}
+	if err := e.opts.Check(); err != nil {
+		return nil, err
+	}
+	e.keys = newKeyCipher(e.key)
+	return e, nil
+}
+
+// ProcessFile encrypts the image at input to output, as EncryptFile does.
+func (e *Encryptor) ProcessFile(ctx context.Context, input, output string) error {
+	q := newEventQueue(e.opts.Progress)
+	defer q.close()
+	return pathError("encrypt", input, encryptFile(ctx, input, output, e.keys, e.overwrite == OverwriteReplace, e.opts, nil, q))
+}
+
+// ProcessDir encrypts the images in the directory input to the directory
+// output, as EncryptDirectory does.
+func (e *Encryptor) ProcessDir(ctx context.Context, input, output string) error {
+	return encryptDirectory(ctx, input, output, e.keys, e.recursive, e.overwrite == OverwriteReplace, e.opts)
+}
+
+// NewDecryptor returns a Decryptor configured by opts, applied in order.
+// Those not given default to what DecryptFile does with zero SaveOptions.
+func NewDecryptor(opts ...DecryptorOption) (*Decryptor, error) {
+	d := &Decryptor{encryptedExt: EncryptedExtension}
+	for _, opt := range opts {
+		opt.applyDecryptor(d)
+	}
+	if len(d.key) == 0 {
+		return nil, fmt.Errorf("%w: no key given", ErrInvalidKeySize)
+	}
+	if err := d.save.Check(); err != nil {
+		return nil, err
+	}
+	if err := d.save.CheckMetadataOnly(); err != nil {
+		return nil, err
+	}
+	d.keys = newKeyCipher(d.key)
+	return d, nil
+}
+
+// ProcessFile decrypts the file at input to output, as DecryptFile does.
+func (d *Decryptor) ProcessFile(ctx context.Context, input, output string) error {
+	q := newEventQueue(d.save.Progress)
+	defer q.close()
+	return pathError("decrypt", input, decryptFile(ctx, input, output, d.keys, d.overwrite == OverwriteReplace, d.save, q))
+}
+
+// ProcessDir decrypts the files in the directory input to the directory
+// output, as DecryptDirectory does.
+func (d *Decryptor) ProcessDir(ctx context.Context, input, output string) error {
+	return decryptDirectory(ctx, input, output, d.keys, d.recursive, d.encryptedExt, d.overwrite == OverwriteReplace, d.save)
+}
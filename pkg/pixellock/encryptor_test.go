@@ -0,0 +1,354 @@
+package pixellock
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"errors"
+	"fmt"
+	"image"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// readFile returns the contents of the file at filename in fsys.
+func readFile(t *testing.T, fsys fs.FS, filename string) []byte {
+	t.Helper()
+	data, err := fs.ReadFile(fsys, filename)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	return data
+}
+
+// checkSameEncryption checks that the files of fsys encrypted at a and b,
+// with their random nonces, are the same size and decrypt to the same data.
+func checkSameEncryption(t *testing.T, fsys fs.FS, key []byte, a, b string) {
+	t.Helper()
+	dataA, dataB := readFile(t, fsys, a), readFile(t, fsys, b)
+	if len(dataA) != len(dataB) {
+		t.Errorf("%s is %d bytes, %s %d", a, len(dataA), b, len(dataB))
+	}
+	plainA, err := decryptData(newKeyCipher(key), skipFormat(dataA))
+	if err != nil {
+		t.Fatalf("decrypting %s failed: %v", a, err)
+	}
+	plainB, err := decryptData(newKeyCipher(key), skipFormat(dataB))
+	if err != nil {
+		t.Fatalf("decrypting %s failed: %v", b, err)
+	}
+	if !bytes.Equal(plainA, plainB) {
+		t.Errorf("%s and %s decrypt to other data", a, b)
+	}
+}
+
+func TestEncryptorDefaults(t *testing.T) {
+	key, _ := GenerateRandomKey()
+	dir := t.TempDir()
+	png := filepath.Join(dir, "red.png")
+	createImageFile(t, png)
+	enc, err := NewEncryptor(WithKey(key))
+	if err != nil {
+		t.Fatalf("NewEncryptor failed: %v", err)
+	}
+	dec, err := NewDecryptor(WithKey(key))
+	if err != nil {
+		t.Fatalf("NewDecryptor failed: %v", err)
+	}
+
+	// Each file is encrypted and decrypted as the functions do it
+	for _, input := range []string{png, "testdata/face.jpg", "testdata/scan3.tiff", "testdata/frame.ppm"} {
+		name := filepath.Base(input)
+		old, new := filepath.Join(dir, "old", name+".enc"), filepath.Join(dir, "new", name+".enc")
+		if err := EncryptFile(t.Context(), input, old, key, false, EncryptOptions{}); err != nil {
+			t.Fatalf("EncryptFile of %s failed: %v", input, err)
+		}
+		if err := enc.ProcessFile(t.Context(), input, new); err != nil {
+			t.Fatalf("ProcessFile of %s failed: %v", input, err)
+		}
+		checkSameEncryption(t, OSFS{}, key, old, new)
+
+		oldOut, newOut := filepath.Join(dir, "old", name), filepath.Join(dir, "new", name)
+		if err := DecryptFile(t.Context(), old, oldOut, key, false, SaveOptions{}); err != nil {
+			t.Fatalf("DecryptFile of %s failed: %v", old, err)
+		}
+		if err := dec.ProcessFile(t.Context(), old, newOut); err != nil {
+			t.Fatalf("ProcessFile of %s failed: %v", old, err)
+		}
+		if !bytes.Equal(readFile(t, OSFS{}, oldOut), readFile(t, OSFS{}, newOut)) {
+			t.Errorf("%s decrypted to other images", name)
+		}
+	}
+}
+
+func TestEncryptorDirectories(t *testing.T) {
+	key, _ := GenerateRandomKey()
+	fsys, input := progressFixture(t, 3)
+	enc, err := NewEncryptor(WithKey(key), WithFS(fsys))
+	if err != nil {
+		t.Fatalf("NewEncryptor failed: %v", err)
+	}
+	dec, err := NewDecryptor(WithKey(key), WithFS(fsys))
+	if err != nil {
+		t.Fatalf("NewDecryptor failed: %v", err)
+	}
+
+	// Each directory is encrypted and decrypted as the functions do it
+	oldDir, newDir := "olddir", "newdir"
+	if err := EncryptDirectory(t.Context(), input, oldDir, key, false, false, EncryptOptions{FS: fsys}); err != nil {
+		t.Fatalf("EncryptDirectory failed: %v", err)
+	}
+	if err := enc.ProcessDir(t.Context(), input, newDir); err != nil {
+		t.Fatalf("ProcessDir failed: %v", err)
+	}
+	encrypted, _ := fs.Glob(fsys, oldDir+"/*")
+	if found, _ := fs.Glob(fsys, newDir+"/*"); len(found) != len(encrypted) || len(found) != 3 {
+		t.Fatalf("ProcessDir wrote %v, want the 3 files of %v", found, encrypted)
+	}
+	for _, old := range encrypted {
+		checkSameEncryption(t, fsys, key, old, filepath.Join(newDir, filepath.Base(old)))
+	}
+	oldOut, newOut := "olddec", "newdec"
+	if err := DecryptDirectory(t.Context(), oldDir, oldOut, key, false, EncryptedExtension, false, SaveOptions{FS: fsys}); err != nil {
+		t.Fatalf("DecryptDirectory failed: %v", err)
+	}
+	if err := dec.ProcessDir(t.Context(), oldDir, newOut); err != nil {
+		t.Fatalf("ProcessDir failed: %v", err)
+	}
+	for _, old := range encrypted {
+		name := filepath.Base(old[:len(old)-len(EncryptedExtension)])
+		if !bytes.Equal(readFile(t, fsys, filepath.Join(oldOut, name)), readFile(t, fsys, filepath.Join(newOut, name))) {
+			t.Errorf("%s decrypted to other images", name)
+		}
+	}
+}
+
+func TestEncryptorOptions(t *testing.T) {
+	key, _ := GenerateRandomKey()
+	dir := t.TempDir()
+	input := filepath.Join(dir, "red.png")
+	createImageFile(t, input)
+	output := filepath.Join(dir, "red.png.enc")
+	if err := os.WriteFile(output, []byte("existing"), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+
+	// An existing output is skipped unless replacing is asked for
+	enc, _ := NewEncryptor(WithKey(key))
+	if err := enc.ProcessFile(t.Context(), input, output); err != nil {
+		t.Fatalf("ProcessFile failed: %v", err)
+	}
+	if data := readFile(t, OSFS{}, output); string(data) != "existing" {
+		t.Error("ProcessFile replaced an existing output")
+	}
+	enc, _ = NewEncryptor(WithKey(key), WithOverwritePolicy(OverwriteReplace))
+	if err := enc.ProcessFile(t.Context(), input, output); err != nil {
+		t.Fatalf("ProcessFile failed: %v", err)
+	}
+	if data := readFile(t, OSFS{}, output); string(data) == "existing" {
+		t.Error("ProcessFile did not replace an existing output")
+	}
+
+	// The output format and compression reach the image written
+	dec, err := NewDecryptor(WithKey(key), WithOutputFormat("jpg"), WithCompression(PNGCompressionBest), WithWorkers(2))
+	if err != nil {
+		t.Fatalf("NewDecryptor failed: %v", err)
+	}
+	if dec.save.Format != "jpg" || dec.save.PNGCompression != PNGCompressionBest || dec.save.Workers != 2 {
+		t.Errorf("NewDecryptor gave save options %+v", dec.save)
+	}
+	decrypted := filepath.Join(dir, "red.jpg")
+	if err := dec.ProcessFile(t.Context(), output, decrypted); err != nil {
+		t.Fatalf("ProcessFile failed: %v", err)
+	}
+	if format, err := DetectImageFormat(decrypted); err != nil || format != "jpeg" {
+		t.Errorf("ProcessFile wrote %q (%v), want a JPEG", format, err)
+	}
+
+	// Another cipher is named in the file, and decrypts with its key
+	registerXOR.Do(func() { RegisterCipherSuite(xorSuite{}) })
+	xorKey := []byte("0123456789abcdef")
+	enc, err = NewEncryptor(WithKey(xorKey), WithCipher(xorSuite{}))
+	if err != nil {
+		t.Fatalf("NewEncryptor failed: %v", err)
+	}
+	xorOutput := filepath.Join(dir, "xor.enc")
+	if err := enc.ProcessFile(t.Context(), input, xorOutput); err != nil {
+		t.Fatalf("ProcessFile failed: %v", err)
+	}
+	if id := skipFormat(readFile(t, OSFS{}, xorOutput))[len(streamMagic)]; id != (xorSuite{}).ID() {
+		t.Errorf("the file names cipher %d, want %d", id, xorSuite{}.ID())
+	}
+	dec, _ = NewDecryptor(WithKey(xorKey))
+	if err := dec.ProcessFile(t.Context(), xorOutput, filepath.Join(dir, "xor.png")); err != nil {
+		t.Fatalf("ProcessFile failed: %v", err)
+	}
+
+	// Options are checked when the Encryptor or Decryptor is made
+	if _, err := NewEncryptor(); !errors.Is(err, ErrInvalidKeySize) {
+		t.Errorf("NewEncryptor without a key gave %v, want ErrInvalidKeySize", err)
+	}
+	if _, err := NewEncryptor(WithKey(key), WithCipher(xorSuite{})); !errors.Is(err, ErrInvalidKeySize) {
+		t.Errorf("NewEncryptor with a key of the wrong size gave %v, want ErrInvalidKeySize", err)
+	}
+	if _, err := NewEncryptor(WithKey(key), WithCipher(xorSuite{}), WithEncryptOptions(EncryptOptions{Mode: ModeScramble})); err != nil {
+		t.Errorf("NewEncryptor gave %v, though WithEncryptOptions replaced the cipher", err)
+	}
+	if _, err := NewEncryptor(WithKey(xorKey), WithEncryptOptions(EncryptOptions{Mode: ModeScramble}), WithCipher(xorSuite{})); err == nil {
+		t.Error("NewEncryptor of a scrambling Encryptor with another cipher succeeded")
+	}
+	if _, err := NewDecryptor(); !errors.Is(err, ErrInvalidKeySize) {
+		t.Errorf("NewDecryptor without a key gave %v, want ErrInvalidKeySize", err)
+	}
+	if _, err := NewDecryptor(WithKey(key), WithCompression("huge")); err == nil {
+		t.Error("NewDecryptor with an unknown compression succeeded")
+	}
+}
+
+// countingSuite is AESGCM, counting the ciphers it makes.
+type countingSuite struct {
+	CipherSuite
+	made atomic.Int32
+}
+
+func (s *countingSuite) NewAEAD(key []byte) (cipher.AEAD, error) {
+	s.made.Add(1)
+	return s.CipherSuite.NewAEAD(key)
+}
+
+// TestKeyCipherShared makes the cipher of a key from many goroutines at
+// once, and checks that it is made once and shared, beside the cipher of
+// the random data key each stream needs its own of, and that streams
+// sealed and opened with it at once, as the workers of a batch do, come
+// out whole. Run it with -race.
+func TestKeyCipherShared(t *testing.T) {
+	key, _ := GenerateRandomKey()
+	suite := &countingSuite{CipherSuite: AESGCM}
+	keys := newKeyCipher(key)
+	var wg sync.WaitGroup
+	errs := make([]error, 16)
+	for i := range errs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			data := bytes.Repeat([]byte{byte(i)}, 1000*i)
+			for range 20 {
+				var sealed, opened bytes.Buffer
+				if err := encryptStream(t.Context(), suite, keys, &sealed, bytes.NewReader(data)); err != nil {
+					errs[i] = err
+					return
+				}
+				if err := decryptStream(t.Context(), keys, &opened, &sealed); err != nil {
+					errs[i] = err
+					return
+				}
+				if !bytes.Equal(opened.Bytes(), data) {
+					errs[i] = fmt.Errorf("stream %d decrypted to other data", i)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if err := errors.Join(errs...); err != nil {
+		t.Fatal(err)
+	}
+	if n, streams := suite.made.Load(), int32(len(errs)*20); n != streams+1 {
+		t.Errorf("%d ciphers were made for %d streams, want one for the key and one for each stream", n, streams)
+	}
+}
+
+// TestEncryptorSharedCipher encrypts and decrypts many images on several
+// workers with one Encryptor and Decryptor, whose ciphers they share, and
+// checks that each comes out as it went in. Run it with -race.
+func TestEncryptorSharedCipher(t *testing.T) {
+	key, _ := GenerateRandomKey()
+	fsys := &MemFS{}
+	for i := range 32 {
+		img := image.NewNRGBA(image.Rect(0, 0, 8, 8))
+		for j := range img.Pix {
+			img.Pix[j] = byte(i*31 + j)
+		}
+		memImage(t, fsys, fmt.Sprintf("in/img%d.png", i), img)
+	}
+	enc, err := NewEncryptor(WithKey(key), WithFS(fsys), WithWorkers(8))
+	if err != nil {
+		t.Fatalf("NewEncryptor failed: %v", err)
+	}
+	dec, err := NewDecryptor(WithKey(key), WithFS(fsys), WithWorkers(8))
+	if err != nil {
+		t.Fatalf("NewDecryptor failed: %v", err)
+	}
+	if err := enc.ProcessDir(t.Context(), "in", "enc"); err != nil {
+		t.Fatalf("ProcessDir failed: %v", err)
+	}
+	if err := dec.ProcessDir(t.Context(), "enc", "dec"); err != nil {
+		t.Fatalf("ProcessDir failed: %v", err)
+	}
+	for i := range 32 {
+		name := fmt.Sprintf("img%d.png", i)
+		want, _, err := image.Decode(bytes.NewReader(memRead(t, fsys, "in/"+name)))
+		if err != nil {
+			t.Fatalf("Decode failed: %v", err)
+		}
+		got, _, err := image.Decode(bytes.NewReader(memRead(t, fsys, "dec/"+name)))
+		if err != nil {
+			t.Fatalf("decrypted %s does not decode: %v", name, err)
+		}
+		if got.Bounds().Size() != want.Bounds().Size() || !sameDeepPixels(want, got) {
+			t.Errorf("%s decrypted to other pixels", name)
+		}
+	}
+}
+
+// BenchmarkSmallFiles encrypts many small images, making the cipher of
+// the key for each as EncryptFile does, and once for them all as an
+// Encryptor does. The streams alone show the saving without the cost of
+// coding the images around it.
+func BenchmarkSmallFiles(b *testing.B) {
+	key, _ := GenerateRandomKey()
+	fsys := &MemFS{}
+	const files = 200
+	for i := range files {
+		img := image.NewNRGBA(image.Rect(0, 0, 4, 4))
+		img.Pix[0] = byte(i)
+		memImage(b, fsys, fmt.Sprintf("in/img%d.png", i), img)
+	}
+	enc, err := NewEncryptor(WithKey(key), WithFS(fsys), WithOverwritePolicy(OverwriteReplace))
+	if err != nil {
+		b.Fatal(err)
+	}
+	opts := EncryptOptions{FS: fsys}
+	data := bytes.Repeat([]byte{1}, 256)
+
+	for _, bench := range []struct {
+		name    string
+		encrypt func(i int) error
+	}{
+		{"stream/per-file", func(int) error {
+			return EncryptStream(b.Context(), key, &bytes.Buffer{}, bytes.NewReader(data))
+		}},
+		{"stream/shared", func(int) error {
+			return encryptStream(b.Context(), AESGCM, enc.keys, &bytes.Buffer{}, bytes.NewReader(data))
+		}},
+		{"file/per-file", func(i int) error {
+			return EncryptFile(b.Context(), fmt.Sprintf("in/img%d.png", i), fmt.Sprintf("out/img%d.enc", i), key, true, opts)
+		}},
+		{"file/shared", func(i int) error {
+			return enc.ProcessFile(b.Context(), fmt.Sprintf("in/img%d.png", i), fmt.Sprintf("out/img%d.enc", i))
+		}},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			fsys.MkdirAll("out", 0755)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if err := bench.encrypt(i % files); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
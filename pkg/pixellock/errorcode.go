@@ -0,0 +1,137 @@
+package pixellock
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"syscall"
+
+	"github.com/Amul-Thantharate/pixellock/pkg/stego"
+)
+
+// An ErrorCode names a class of failure, for programs deciding what to do
+// about one rather than showing it. Codes are stable across releases:
+// once given out, a code keeps its meaning and is never reused, though
+// the messages of the errors it classes may change.
+type ErrorCode string
+
+// The error codes ErrorCodeOf gives.
+const (
+	CodeKeyMismatch       ErrorCode = "E_KEY_MISMATCH"
+	CodeKeyRequired       ErrorCode = "E_KEY_REQUIRED"
+	CodeInvalidKey        ErrorCode = "E_INVALID_KEY"
+	CodeNotEncrypted      ErrorCode = "E_NOT_ENCRYPTED"
+	CodeNotImage          ErrorCode = "E_NOT_IMAGE"
+	CodeUnsupportedCipher ErrorCode = "E_UNSUPPORTED_CIPHER"
+	CodeImageTooLarge     ErrorCode = "E_IMAGE_TOO_LARGE"
+	CodeOutputExists      ErrorCode = "E_OUTPUT_EXISTS"
+	CodeTooManyUnreadable ErrorCode = "E_TOO_MANY_UNREADABLE"
+	CodeNotFound          ErrorCode = "E_NOT_FOUND"
+	CodePermission        ErrorCode = "E_PERMISSION"
+	CodeIOTransient       ErrorCode = "E_IO_TRANSIENT"
+	CodeCanceled          ErrorCode = "E_CANCELED"
+	CodeNoPayload         ErrorCode = "E_NO_PAYLOAD"
+	CodePayloadTooLarge   ErrorCode = "E_PAYLOAD_TOO_LARGE"
+	CodePayloadCorrupted  ErrorCode = "E_PAYLOAD_CORRUPTED"
+	CodeBadRequest        ErrorCode = "E_BAD_REQUEST"
+	CodeRequestTooLarge   ErrorCode = "E_REQUEST_TOO_LARGE"
+	CodeBusy              ErrorCode = "E_BUSY"
+	CodeInternal          ErrorCode = "E_INTERNAL"
+	CodeUnknown           ErrorCode = "E_UNKNOWN"
+)
+
+// ErrorCodeInfo describes an error code, as ErrorCodes lists them.
+type ErrorCodeInfo struct {
+	Code        ErrorCode `json:"code"`
+	Retryable   bool      `json:"retryable"` // Trying again may succeed
+	Description string    `json:"description"`
+}
+
+// errorCodes are the error codes, in the order ErrorCodeOf tries them,
+// with the sentinel errors each classes. It is the one place codes are
+// defined: ErrorCodes, Retryable and Description all read it.
+var errorCodes = []struct {
+	ErrorCodeInfo
+	errs []error
+}{
+	{ErrorCodeInfo{CodeCanceled, true, "The operation was canceled or ran out of time before it finished"}, []error{context.Canceled, context.DeadlineExceeded}},
+	{ErrorCodeInfo{CodeKeyMismatch, false, "The key or password is wrong, or the encrypted data was modified"}, []error{ErrAuthenticationFailed, stego.ErrAuthenticationFailed}},
+	{ErrorCodeInfo{CodeKeyRequired, false, "The hidden payload is encrypted, and no key was given"}, []error{ErrPayloadEncrypted}},
+	{ErrorCodeInfo{CodeInvalidKey, false, "The key is not a key at all, such as one of the wrong size"}, []error{ErrInvalidKeySize}},
+	{ErrorCodeInfo{CodeNotEncrypted, false, "The input was not encrypted by pixellock"}, []error{ErrNotEncryptedFile}},
+	{ErrorCodeInfo{CodeNotImage, false, "The input is not an image in a supported format"}, []error{ErrUnsupportedFormat}},
+	{ErrorCodeInfo{CodeUnsupportedCipher, false, "The file is encrypted with a cipher this version does not know"}, nil},
+	{ErrorCodeInfo{CodeImageTooLarge, false, "The image claims more pixels than --max-pixels allows"}, []error{ErrImageTooLarge}},
+	{ErrorCodeInfo{CodeOutputExists, false, "An output file exists already, and overwriting was not asked for"}, []error{ErrOutputExists}},
+	{ErrorCodeInfo{CodeTooManyUnreadable, false, "So many files of a directory could not be read, as when it is not mounted, that none was processed"}, []error{ErrTooManyUnreadable}},
+	{ErrorCodeInfo{CodeNoPayload, false, "No hidden payload was found in the image"}, []error{ErrNoPayload}},
+	{ErrorCodeInfo{CodePayloadTooLarge, false, "The payload does not fit in the cover image"}, []error{ErrPayloadTooLarge}},
+	{ErrorCodeInfo{CodePayloadCorrupted, false, "The hidden payload failed its checksum or hash, or a fragment of it is missing"}, []error{ErrPayloadCorrupted, ErrPayloadHashMismatch, ErrMissingFragment}},
+	{ErrorCodeInfo{CodeNotFound, false, "An input file or directory does not exist"}, []error{fs.ErrNotExist}},
+	{ErrorCodeInfo{CodePermission, false, "A file could not be read or written for lack of permission"}, []error{fs.ErrPermission}},
+	{ErrorCodeInfo{CodeIOTransient, true, "Reading or writing failed in a way that may pass, such as a timeout or a busy resource"}, []error{os.ErrDeadlineExceeded, syscall.EAGAIN, syscall.EINTR, syscall.EBUSY, syscall.ETIMEDOUT}},
+	{ErrorCodeInfo{CodeBadRequest, false, "A request to the server is malformed, such as one missing its image"}, nil},
+	{ErrorCodeInfo{CodeRequestTooLarge, false, "A request to the server is over its size limit"}, nil},
+	{ErrorCodeInfo{CodeBusy, true, "The server is handling as many requests as it may at once"}, nil},
+	{ErrorCodeInfo{CodeInternal, false, "pixellock failed unexpectedly, a bug to report with the crash report the CLI writes"}, nil},
+	{ErrorCodeInfo{CodeUnknown, false, "Any other failure"}, nil},
+}
+
+// ErrorCodes returns every error code, with whether it is retryable and
+// what it means.
+func ErrorCodes() []ErrorCodeInfo {
+	infos := make([]ErrorCodeInfo, len(errorCodes))
+	for i, c := range errorCodes {
+		infos[i] = c.ErrorCodeInfo
+	}
+	return infos
+}
+
+// info returns the description of c, or of CodeUnknown when c is not a
+// code.
+func (c ErrorCode) info() ErrorCodeInfo {
+	for _, e := range errorCodes {
+		if e.Code == c {
+			return e.ErrorCodeInfo
+		}
+	}
+	return errorCodes[len(errorCodes)-1].ErrorCodeInfo
+}
+
+// Retryable reports whether trying again after a failure of code c may
+// succeed.
+func (c ErrorCode) Retryable() bool {
+	return c.info().Retryable
+}
+
+// Description says what failures of code c are.
+func (c ErrorCode) Description() string {
+	return c.info().Description
+}
+
+// ErrorCodeOf returns the code of err: the code of the first error in its
+// chain with an ErrorCode method, such as *UnsupportedCipherError, or
+// that a sentinel error it matches with errors.Is is classed under, or
+// CodeUnknown when none is. It returns "" for a nil err alone.
+func ErrorCodeOf(err error) ErrorCode {
+	if err == nil {
+		return ""
+	}
+	var coded interface{ ErrorCode() ErrorCode }
+	if errors.As(err, &coded) {
+		return coded.ErrorCode()
+	}
+	for _, c := range errorCodes {
+		for _, target := range c.errs {
+			if errors.Is(err, target) {
+				return c.Code
+			}
+		}
+	}
+	var timeout interface{ Timeout() bool }
+	if errors.As(err, &timeout) && timeout.Timeout() {
+		return CodeIOTransient
+	}
+	return CodeUnknown
+}
@@ -0,0 +1,137 @@
+package pixellock
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// timeoutError is an error that says it is a timeout, as network errors
+// do.
+type timeoutError struct{}
+
+func (timeoutError) Error() string { return "i/o timeout" }
+func (timeoutError) Timeout() bool { return true }
+
+func TestErrorCodeOf(t *testing.T) {
+	key, _ := GenerateRandomKey()
+	wrongKey, _ := GenerateRandomKey()
+	dir := t.TempDir()
+
+	image := filepath.Join(dir, "image.png")
+	createImageFile(t, image)
+	encrypted := image + EncryptedExtension
+	if err := EncryptFile(t.Context(), image, encrypted, key, false, EncryptOptions{}); err != nil {
+		t.Fatalf("EncryptFile failed: %v", err)
+	}
+	text := filepath.Join(dir, "notes.txt")
+	if err := os.WriteFile(text, []byte("not an image"), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	canceled, cancel := context.WithCancel(t.Context())
+	cancel()
+
+	tests := []struct {
+		name string
+		call func() error
+		want ErrorCode
+	}{
+		{"DecryptFile with the wrong key", func() error {
+			return DecryptFile(t.Context(), encrypted, filepath.Join(dir, "out1.png"), wrongKey, false, SaveOptions{})
+		}, CodeKeyMismatch},
+		{"DecryptFile with a short key", func() error {
+			return DecryptFile(t.Context(), encrypted, filepath.Join(dir, "out2.png"), key[:16], false, SaveOptions{})
+		}, CodeInvalidKey},
+		{"DecryptFile of an image", func() error {
+			return DecryptFile(t.Context(), image, filepath.Join(dir, "out3.png"), key, false, SaveOptions{})
+		}, CodeNotEncrypted},
+		{"EncryptFile of a text file", func() error {
+			return EncryptFile(t.Context(), text, text+EncryptedExtension, key, false, EncryptOptions{})
+		}, CodeNotImage},
+		{"EncryptFile of a missing file", func() error {
+			return EncryptFile(t.Context(), filepath.Join(dir, "missing.png"), filepath.Join(dir, "missing.enc"), key, false, EncryptOptions{})
+		}, CodeNotFound},
+		{"EncryptFile canceled", func() error {
+			return EncryptFile(canceled, image, filepath.Join(dir, "canceled.enc"), key, true, EncryptOptions{})
+		}, CodeCanceled},
+		{"ConvertFile to an existing file", func() error {
+			_, err := ConvertFile(encrypted, image, ConvertOptions{})
+			return err
+		}, CodeOutputExists},
+		{"RevealPayload of a plain image", func() error {
+			_, err := RevealPayload(image, DefaultStegoOptions)
+			return err
+		}, CodeNoPayload},
+		{"a cipher of a later version", func() error {
+			return fmt.Errorf("decrypt: %w", &UnsupportedCipherError{ID: 200})
+		}, CodeUnsupportedCipher},
+		{"a busy file", func() error {
+			return &PathError{Op: "open", Path: image, Err: syscall.EBUSY}
+		}, CodeIOTransient},
+		{"a timeout", func() error {
+			return fmt.Errorf("read: %w", timeoutError{})
+		}, CodeIOTransient},
+		{"anything else", func() error {
+			return errors.New("something unforeseen")
+		}, CodeUnknown},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.call()
+			if code := ErrorCodeOf(err); code != test.want {
+				t.Errorf("ErrorCodeOf(%v) = %q, want %q", err, code, test.want)
+			}
+		})
+	}
+
+	if code := ErrorCodeOf(nil); code != "" {
+		t.Errorf("ErrorCodeOf(nil) = %q, want none", code)
+	}
+	if err := DecryptFile(t.Context(), encrypted, filepath.Join(dir, "out4.png"), wrongKey, false, SaveOptions{}); ErrorCodeOf(err).Retryable() {
+		t.Errorf("%v is retryable", err)
+	}
+	if err := (&PathError{Op: "read", Path: image, Err: syscall.EAGAIN}); !ErrorCodeOf(err).Retryable() {
+		t.Errorf("%v is not retryable", err)
+	}
+}
+
+func TestErrorCodes(t *testing.T) {
+	seen := map[ErrorCode]bool{}
+	for _, info := range ErrorCodes() {
+		if seen[info.Code] {
+			t.Errorf("%s listed twice", info.Code)
+		}
+		seen[info.Code] = true
+		if info.Description == "" || info.Code.Description() != info.Description || info.Code.Retryable() != info.Retryable {
+			t.Errorf("%s is listed as %+v but describes itself as %q, retryable %t", info.Code, info, info.Code.Description(), info.Code.Retryable())
+		}
+	}
+	for _, code := range []ErrorCode{CodeKeyMismatch, CodeNotImage, CodeOutputExists, CodeIOTransient, CodeUnknown} {
+		if !seen[code] {
+			t.Errorf("%s not listed", code)
+		}
+	}
+	if ErrorCode("E_MADE_UP").Description() != CodeUnknown.Description() {
+		t.Error("a code not listed is not described as unknown")
+	}
+}
+
+// TestErrorCodeSentinels checks that every sentinel error a code classes
+// is given that code, and not one listed before it.
+func TestErrorCodeSentinels(t *testing.T) {
+	for _, c := range errorCodes {
+		for _, err := range c.errs {
+			if code := ErrorCodeOf(&PathError{Op: "op", Path: "file", Err: err}); code != c.Code {
+				t.Errorf("ErrorCodeOf(%v) = %s, want %s", err, code, c.Code)
+			}
+		}
+	}
+	if !errors.Is(outputExistsError("x"), ErrOutputExists) || errors.Is(outputExistsError("x"), fs.ErrExist) {
+		t.Error("outputExistsError does not match ErrOutputExists alone")
+	}
+}
@@ -0,0 +1,88 @@
+package pixellock
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+)
+
+var (
+	// ErrAuthenticationFailed is returned when data cannot be decrypted,
+	// either because the key is wrong or the data was modified.
+	ErrAuthenticationFailed = errors.New("authentication failed: wrong key or corrupted data")
+	// ErrInvalidKeySize is returned for a key of the wrong size for its
+	// cipher.
+	ErrInvalidKeySize = errors.New("invalid key size")
+	// ErrNotEncryptedFile is returned when decrypting a file, or data,
+	// that pixellock did not encrypt, such as an image as it is.
+	ErrNotEncryptedFile = errors.New("not a file encrypted by pixellock")
+	// ErrUnsupportedFormat is returned for a file that is not an image in
+	// a format pixellock can load.
+	ErrUnsupportedFormat = errors.New("not an image in a supported format")
+	// ErrImageTooLarge is returned for an image whose header claims more
+	// pixels than the MaxPixels of the options allow.
+	ErrImageTooLarge = errors.New("image too large")
+	// ErrOutputExists is matched by the errors for an output file that
+	// exists already when overwriting was not asked for.
+	ErrOutputExists = errors.New("output file exists")
+)
+
+// outputExistsError is the error for the output file it names existing
+// already, which errors.Is matches to ErrOutputExists.
+type outputExistsError string
+
+func (e outputExistsError) Error() string {
+	return "output file " + string(e) + " already exists; overwrite with --overwrite"
+}
+
+func (e outputExistsError) Is(target error) bool {
+	return target == ErrOutputExists
+}
+
+// PathError records the file an operation failed on, and why. The
+// file functions, such as EncryptFile and LoadImage, return their errors
+// as one, which errors.Is and errors.As see through to the cause.
+type PathError struct {
+	Op   string // The operation, such as "encrypt" or "load"
+	Path string
+	Err  error
+}
+
+func (e *PathError) Error() string {
+	return e.Op + " " + e.Path + ": " + e.Err.Error()
+}
+
+func (e *PathError) Unwrap() error {
+	return e.Err
+}
+
+// pathError returns err as a *PathError for op on path, or as it is when
+// it is nil, is a context's error, or names path already.
+func pathError(op, path string, err error) error {
+	var pe *PathError
+	switch {
+	case err == nil, err == context.Canceled, err == context.DeadlineExceeded:
+		return err
+	case errors.As(err, &pe) && pe.Path == path:
+		return err
+	}
+	return &PathError{Op: op, Path: path, Err: err}
+}
+
+// openError returns the error of opening path as a *PathError, with the
+// cause of the *fs.PathError a FileSystem gives, or the error itself when
+// it wraps none.
+func openError(path string, err error) error {
+	if cause := errors.Unwrap(err); cause != nil {
+		err = cause
+	}
+	return pathError("open", path, err)
+}
+
+// isImageData reports whether data is an image a registered decoder
+// recognizes, as data pixellock encrypted never is.
+func isImageData(data []byte) bool {
+	_, _, err := image.DecodeConfig(bytes.NewReader(data))
+	return err == nil
+}
@@ -0,0 +1,122 @@
+package pixellock
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// checkPathError checks that err is a *PathError for op on path.
+func checkPathError(t *testing.T, err error, op, path string) {
+	t.Helper()
+	var pe *PathError
+	if !errors.As(err, &pe) {
+		t.Errorf("error %v is not a PathError", err)
+		return
+	}
+	if pe.Op != op || pe.Path != path {
+		t.Errorf("PathError is for %s %s, want %s %s", pe.Op, pe.Path, op, path)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	key, _ := GenerateRandomKey()
+	wrongKey, _ := GenerateRandomKey()
+	shortKey := key[:16]
+	dir := t.TempDir()
+
+	image := filepath.Join(dir, "image.png")
+	createImageFile(t, image)
+	encrypted := image + EncryptedExtension
+	if err := EncryptFile(t.Context(), image, encrypted, key, false, EncryptOptions{}); err != nil {
+		t.Fatalf("EncryptFile failed: %v", err)
+	}
+	text := filepath.Join(dir, "notes.txt")
+	if err := os.WriteFile(text, []byte("not an image"), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	missing := filepath.Join(dir, "missing.png")
+
+	ciphertext, err := Encrypt(key, []byte("secret"))
+	if err != nil {
+		t.Fatalf("Encrypt failed: %v", err)
+	}
+	tampered := bytes.Clone(ciphertext)
+	tampered[len(tampered)-1] ^= 1
+
+	tests := []struct {
+		name string
+		call func() error
+		want error
+	}{
+		{"Decrypt with the wrong key", func() error {
+			_, err := Decrypt(wrongKey, ciphertext)
+			return err
+		}, ErrAuthenticationFailed},
+		{"Decrypt of tampered data", func() error {
+			_, err := Decrypt(key, tampered)
+			return err
+		}, ErrAuthenticationFailed},
+		{"Decrypt of truncated data", func() error {
+			_, err := Decrypt(key, ciphertext[:10])
+			return err
+		}, ErrAuthenticationFailed},
+		{"Encrypt with a short key", func() error {
+			_, err := Encrypt(shortKey, []byte("secret"))
+			return err
+		}, ErrInvalidKeySize},
+		{"Decrypt with a short key", func() error {
+			_, err := Decrypt(shortKey, ciphertext)
+			return err
+		}, ErrInvalidKeySize},
+		{"EncryptStream with a short key", func() error {
+			return EncryptStream(t.Context(), shortKey, &bytes.Buffer{}, bytes.NewReader([]byte("secret")))
+		}, ErrInvalidKeySize},
+		{"DecodeKey of a short key", func() error {
+			_, err := DecodeKey(base64.StdEncoding.EncodeToString(shortKey))
+			return err
+		}, ErrInvalidKeySize},
+		{"DecryptStream of data not a stream", func() error {
+			return DecryptStream(t.Context(), key, &bytes.Buffer{}, bytes.NewReader([]byte("not a stream at all")))
+		}, ErrNotEncryptedFile},
+		{"DecryptFile of an image", func() error {
+			return DecryptFile(t.Context(), image, filepath.Join(dir, "out1.png"), key, false, SaveOptions{})
+		}, ErrNotEncryptedFile},
+		{"DecryptFile with the wrong key", func() error {
+			return DecryptFile(t.Context(), encrypted, filepath.Join(dir, "out2.png"), wrongKey, false, SaveOptions{})
+		}, ErrAuthenticationFailed},
+		{"LoadImage of a text file", func() error {
+			_, err := LoadImage(text)
+			return err
+		}, ErrUnsupportedFormat},
+		{"LoadImage of a missing file", func() error {
+			_, err := LoadImage(missing)
+			return err
+		}, fs.ErrNotExist},
+		{"EncryptFile of a text file", func() error {
+			return EncryptFile(t.Context(), text, text+EncryptedExtension, key, false, EncryptOptions{})
+		}, ErrUnsupportedFormat},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := test.call(); !errors.Is(err, test.want) {
+				t.Errorf("got %v, want %v", err, test.want)
+			}
+		})
+	}
+
+	// The file functions name the file and what they were doing to it, the
+	// innermost operation on the file winning
+	_, err = LoadImage(text)
+	checkPathError(t, err, "decode", text)
+	_, err = LoadImage(missing)
+	checkPathError(t, err, "open", missing)
+	err = EncryptFile(t.Context(), text, text+EncryptedExtension, key, false, EncryptOptions{})
+	checkPathError(t, err, "decode", text)
+	err = DecryptFile(t.Context(), image, filepath.Join(dir, "out3.png"), key, false, SaveOptions{})
+	checkPathError(t, err, "decrypt", image)
+}
@@ -0,0 +1,591 @@
+package pixellock
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"io"
+	"maps"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Decoding and re-encoding an image drops its metadata, so the EXIF block
+// of a JPEG, PNG or TIFF is carried separately: encryption stores it in an
+// eXIf chunk of the PNG it encrypts, and SaveImage attaches it to the
+// decrypted image again. An EXIF block is a little TIFF file: a header and
+// image file directories (IFDs) of tagged values.
+
+// Metadata modes for encrypting and decrypting images.
+const (
+	MetadataPreserve = "preserve" // Carry the EXIF metadata over
+	MetadataStrip    = "strip"    // Drop it, turning the image upright first
+)
+
+// CheckMetadataMode returns an error unless mode is a metadata mode, or
+// empty for MetadataPreserve.
+func CheckMetadataMode(mode string) error {
+	switch mode {
+	case "", MetadataPreserve, MetadataStrip:
+		return nil
+	}
+	return fmt.Errorf("unknown metadata mode %q (want %s or %s)", mode, MetadataPreserve, MetadataStrip)
+}
+
+// exifHeader starts the APP1 segment of a JPEG that carries EXIF.
+const exifHeader = "Exif\x00\x00"
+
+// EXIF and TIFF tags handled specially.
+const (
+	exifOrientation      = 274
+	exifDateTime         = 306
+	exifIFDPointer       = 34665
+	gpsIFDPointer        = 34853
+	interopPointer       = 40965
+	exifDateTimeOriginal = 36867 // Of the EXIF IFD
+)
+
+// exifTimeLayout is the layout of the times EXIF records.
+const exifTimeLayout = "2006:01:02 15:04:05"
+
+// exifMetadataTags are the tags of the first IFD of a TIFF that describe
+// the picture rather than its pixel layout. They are the ones copied
+// between a TIFF file and an EXIF block.
+var exifMetadataTags = []uint16{
+	270,   // ImageDescription
+	271,   // Make
+	272,   // Model
+	274,   // Orientation
+	305,   // Software
+	306,   // DateTime
+	315,   // Artist
+	33432, // Copyright
+	exifIFDPointer,
+	gpsIFDPointer,
+}
+
+// exifEntry is one tagged value of an IFD. Values are held little-endian,
+// whatever the byte order of the file they came from.
+type exifEntry struct {
+	tag, typ uint16
+	count    uint32
+	value    []byte
+	sub      []exifEntry // The IFD a pointer tag points to
+}
+
+// exifTypeSize returns the size of one value of an EXIF field type and the
+// size of the units whose byte order depends on the file, or 0 for an
+// unknown type.
+func exifTypeSize(typ uint16) (size, unit int) {
+	switch typ {
+	case 1, 2, 6, 7: // BYTE, ASCII, SBYTE, UNDEFINED
+		return 1, 1
+	case 3, 8: // SHORT, SSHORT
+		return 2, 2
+	case 4, 9, 11, 13: // LONG, SLONG, FLOAT, IFD
+		return 4, 4
+	case 5, 10: // RATIONAL, SRATIONAL
+		return 8, 4
+	case 12: // DOUBLE
+		return 8, 8
+	}
+	return 0, 0
+}
+
+// tiffByteOrder returns the byte order of TIFF-structured data and the
+// offset of its first IFD.
+func tiffByteOrder(data []byte) (binary.ByteOrder, uint32, error) {
+	if len(data) < 8 {
+		return nil, 0, fmt.Errorf("EXIF data truncated")
+	}
+	var order binary.ByteOrder
+	switch string(data[:4]) {
+	case "II*\x00":
+		order = binary.LittleEndian
+	case "MM\x00*":
+		order = binary.BigEndian
+	default:
+		return nil, 0, fmt.Errorf("not TIFF-structured data")
+	}
+	return order, order.Uint32(data[4:]), nil
+}
+
+// parseEXIF returns the entries of the first IFD of the TIFF-structured
+// data, with the IFDs of the EXIF and GPS pointers read into their sub
+// entries. Entries of unknown types, and pointers to other IFDs, are left
+// out.
+func parseEXIF(data []byte) ([]exifEntry, error) {
+	order, offset, err := tiffByteOrder(data)
+	if err != nil {
+		return nil, err
+	}
+	return parseIFD(data, order, offset, 0)
+}
+
+func parseIFD(data []byte, order binary.ByteOrder, offset uint32, depth int) ([]exifEntry, error) {
+	if uint64(offset)+2 > uint64(len(data)) {
+		return nil, fmt.Errorf("EXIF directory out of range")
+	}
+	n := int(order.Uint16(data[offset:]))
+	pos := int(offset) + 2
+	if pos+12*n > len(data) {
+		return nil, fmt.Errorf("EXIF directory truncated")
+	}
+	var entries []exifEntry
+	for i := 0; i < n; i, pos = i+1, pos+12 {
+		e := exifEntry{tag: order.Uint16(data[pos:]), typ: order.Uint16(data[pos+2:]), count: order.Uint32(data[pos+4:])}
+		size, unit := exifTypeSize(e.typ)
+		if size == 0 || e.tag == interopPointer || e.typ == 13 {
+			continue
+		}
+		length := uint64(size) * uint64(e.count)
+		raw := data[pos+8 : pos+12]
+		if length > 4 {
+			at := uint64(order.Uint32(raw))
+			if at+length > uint64(len(data)) {
+				return nil, fmt.Errorf("EXIF value of tag %d out of range", e.tag)
+			}
+			raw = data[at : at+length]
+		}
+		e.value = make([]byte, length)
+		copy(e.value, raw)
+		if order == binary.BigEndian {
+			for j := 0; j < len(e.value); j += unit {
+				slices.Reverse(e.value[j : j+unit])
+			}
+		}
+
+		if e.tag == exifIFDPointer || e.tag == gpsIFDPointer {
+			if depth > 0 || e.count != 1 || unit != 4 {
+				continue
+			}
+			sub, err := parseIFD(data, order, binary.LittleEndian.Uint32(e.value), depth+1)
+			if err != nil {
+				return nil, err
+			}
+			if len(sub) == 0 {
+				continue
+			}
+			e.sub = sub
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// appendIFD appends an IFD holding entries, sorted by tag, to the
+// TIFF-structured data out, followed by the values too large for their
+// entries and the IFDs of pointer entries. Offsets are from the start of
+// out.
+func appendIFD(out []byte, entries []exifEntry) []byte {
+	entries = slices.Clone(entries)
+	sort.Slice(entries, func(i, j int) bool { return entries[i].tag < entries[j].tag })
+	if len(out)%2 != 0 {
+		out = append(out, 0) // IFDs start on a word boundary
+	}
+
+	valuesOffset := len(out) + 2 + 12*len(entries) + 4
+	var values []byte
+	pointers := make(map[int][]exifEntry) // Offset of the value to patch, and the IFD it points to
+	out = binary.LittleEndian.AppendUint16(out, uint16(len(entries)))
+	for _, e := range entries {
+		out = binary.LittleEndian.AppendUint16(out, e.tag)
+		out = binary.LittleEndian.AppendUint16(out, e.typ)
+		out = binary.LittleEndian.AppendUint32(out, e.count)
+		switch {
+		case e.sub != nil:
+			pointers[len(out)] = e.sub
+			out = append(out, 0, 0, 0, 0)
+		case len(e.value) <= 4:
+			out = append(out, e.value...)
+			out = append(out, make([]byte, 4-len(e.value))...)
+		default:
+			out = binary.LittleEndian.AppendUint32(out, uint32(valuesOffset+len(values)))
+			values = append(values, e.value...)
+			if len(values)%2 != 0 {
+				values = append(values, 0)
+			}
+		}
+	}
+	out = binary.LittleEndian.AppendUint32(out, 0) // No further IFDs
+	out = append(out, values...)
+
+	for _, at := range slices.Sorted(maps.Keys(pointers)) {
+		if len(out)%2 != 0 {
+			out = append(out, 0)
+		}
+		binary.LittleEndian.PutUint32(out[at:], uint32(len(out)))
+		out = appendIFD(out, pointers[at])
+	}
+	return out
+}
+
+// marshalEXIF returns a little-endian EXIF block holding entries in its
+// first IFD.
+func marshalEXIF(entries []exifEntry) []byte {
+	return appendIFD(binary.LittleEndian.AppendUint32([]byte("II*\x00"), 8), entries)
+}
+
+// findEXIF returns the entry with tag among entries, or nil.
+func findEXIF(entries []exifEntry, tag uint16) *exifEntry {
+	for i := range entries {
+		if entries[i].tag == tag {
+			return &entries[i]
+		}
+	}
+	return nil
+}
+
+// metadataEntries returns the entries among those of a first IFD that
+// exifMetadataTags lists.
+func metadataEntries(entries []exifEntry) []exifEntry {
+	var kept []exifEntry
+	for _, e := range entries {
+		if slices.Contains(exifMetadataTags, e.tag) {
+			kept = append(kept, e)
+		}
+	}
+	return kept
+}
+
+// ReadEXIF returns the EXIF block of the JPEG, PNG or TIFF image data, or
+// nil when it has none. The block of a TIFF is built from the metadata tags
+// of its first IFD.
+func ReadEXIF(data []byte) ([]byte, error) {
+	var exif []byte
+	switch {
+	case bytes.HasPrefix(data, pngSignature):
+		err := pngChunks(data, func(typ string, start, end int) bool {
+			if typ == "eXIf" {
+				exif = slices.Clone(data[start+8 : end-4])
+			}
+			return exif == nil
+		})
+		return exif, err
+	case len(data) >= 2 && data[0] == 0xff && data[1] == jpegSOI:
+		err := jpegMetadataSegments(data, func(marker byte, start, end int) bool {
+			if marker == jpegAPP1 && bytes.HasPrefix(data[start+4:end], []byte(exifHeader)) {
+				exif = slices.Clone(data[start+4+len(exifHeader) : end])
+			}
+			return exif == nil
+		})
+		return exif, err
+	}
+	if _, _, err := tiffByteOrder(data); err != nil {
+		return nil, nil // Not a format that carries EXIF
+	}
+	entries, err := parseEXIF(data)
+	if err != nil {
+		return nil, err
+	}
+	if entries = metadataEntries(entries); len(entries) == 0 {
+		return nil, nil
+	}
+	return marshalEXIF(entries), nil
+}
+
+// exifSegment returns the JPEG APP1 segment holding the EXIF block exif.
+func exifSegment(exif []byte) ([]byte, error) {
+	if len(exifHeader)+len(exif) > maxJPEGSegment {
+		return nil, fmt.Errorf("EXIF block of %d bytes does not fit in a JPEG segment", len(exif))
+	}
+	segment := append([]byte{0xff, jpegAPP1, 0, 0}, exifHeader...)
+	segment = append(segment, exif...)
+	binary.BigEndian.PutUint16(segment[2:], uint16(len(segment)-2))
+	return segment, nil
+}
+
+// exifWriter returns a writer that writes a PNG or JPEG, as the encoders
+// of EncodeImage write them, on to w with the EXIF block exif attached as
+// AttachEXIF attaches it, without holding the image. It returns nil for
+// the other formats, to which the image is attached whole.
+func exifWriter(w io.Writer, format string, exif []byte) (io.Writer, error) {
+	switch format, _ = SplitImageFormat(format); format {
+	case "png", "":
+		chunk := pngChunk("eXIf", exif)
+		return &pngChunkWriter{
+			w:    w,
+			skip: func(typ string) bool { return typ == "eXIf" },
+			insert: func(typ string) []byte {
+				if typ != "IDAT" || chunk == nil {
+					return nil
+				}
+				defer func() { chunk = nil }() // Before the first alone
+				return chunk
+			},
+		}, nil
+	case "jpeg", "jpg":
+		// The encoder writes no APP0 segment for the EXIF to follow, so it
+		// comes straight after the start of the image
+		segment, err := exifSegment(exif)
+		if err != nil {
+			return nil, err
+		}
+		return &insertWriter{w: w, at: 2, data: segment}, nil
+	}
+	return nil, nil
+}
+
+// An insertWriter writes what is written to it on to w, with data
+// inserted after the first at bytes.
+type insertWriter struct {
+	w    io.Writer
+	at   int
+	data []byte
+}
+
+func (i *insertWriter) Write(b []byte) (int, error) {
+	if i.data == nil {
+		return i.w.Write(b)
+	}
+	c := min(len(b), i.at)
+	n, err := i.w.Write(b[:c])
+	i.at -= n
+	if err != nil || i.at > 0 {
+		return n, err
+	}
+	if _, err := i.w.Write(i.data); err != nil {
+		return n, err
+	}
+	i.data = nil
+	m, err := i.w.Write(b[c:])
+	return n + m, err
+}
+
+// exifFormats are the output formats AttachEXIF writes EXIF into.
+var exifFormats = []string{"jpeg", "jpg", "png", "tiff", "tif"}
+
+// AttachEXIF returns a copy of the image data, encoded in format, carrying
+// the EXIF block exif in place of any it had. Only JPEG, PNG and TIFF can
+// carry one.
+func AttachEXIF(data []byte, format string, exif []byte) ([]byte, error) {
+	var out bytes.Buffer
+	switch format, _ = SplitImageFormat(format); format {
+	case "png", "": // An empty format means png, as for SaveImage
+		// eXIf must come before the image data
+		out.Write(pngSignature)
+		inserted := false
+		err := pngChunks(data, func(typ string, start, end int) bool {
+			if typ == "eXIf" {
+				return true
+			}
+			if typ == "IDAT" && !inserted {
+				out.Write(pngChunk("eXIf", exif))
+				inserted = true
+			}
+			out.Write(data[start:end])
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+		return out.Bytes(), nil
+	case "jpeg", "jpg":
+		segment, err := exifSegment(exif)
+		if err != nil {
+			return nil, err
+		}
+		out.Write(data[:2])
+		inserted := false
+		pos := 2
+		err = jpegMetadataSegments(data, func(marker byte, start, end int) bool {
+			if !inserted && marker != jpegAPP0 {
+				out.Write(segment)
+				inserted = true
+			}
+			pos = end
+			if marker == jpegAPP1 && bytes.HasPrefix(data[start+4:end], []byte(exifHeader)) {
+				return true // Drop the previous EXIF
+			}
+			out.Write(data[start:end])
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+		if !inserted {
+			out.Write(segment)
+		}
+		out.Write(data[pos:])
+		return out.Bytes(), nil
+	case "tiff", "tif":
+		// The metadata joins the first IFD, which is rewritten at the end of
+		// the file, still followed by the IFDs of any further pages; the old
+		// one is left unreferenced.
+		order, first, err := tiffByteOrder(data)
+		if err != nil || order != binary.LittleEndian {
+			return nil, fmt.Errorf("only little-endian TIFFs can take EXIF metadata")
+		}
+		entries, err := parseEXIF(data)
+		if err != nil {
+			return nil, err
+		}
+		next, err := tiffNextIFD(data, order, first)
+		if err != nil {
+			return nil, err
+		}
+		meta, err := parseEXIF(exif)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range metadataEntries(meta) {
+			if findEXIF(entries, e.tag) == nil {
+				entries = append(entries, e)
+			}
+		}
+		tiff := slices.Clone(data)
+		if len(tiff)%2 != 0 {
+			tiff = append(tiff, 0)
+		}
+		ifd := len(tiff)
+		binary.LittleEndian.PutUint32(tiff[4:], uint32(ifd))
+		tiff = appendIFD(tiff, entries)
+		binary.LittleEndian.PutUint32(tiff[ifd+2+12*len(entries):], next)
+		return tiff, nil
+	}
+	return nil, fmt.Errorf("%s images cannot carry EXIF metadata", format)
+}
+
+// UprightEXIF returns the EXIF block with its orientation set to upright,
+// for an image Orient has turned.
+func UprightEXIF(exif []byte) ([]byte, error) {
+	entries, err := parseEXIF(exif)
+	if err != nil {
+		return nil, err
+	}
+	e := findEXIF(entries, exifOrientation)
+	if e == nil {
+		return exif, nil
+	}
+	e.typ, e.count, e.value = 3, 1, binary.LittleEndian.AppendUint16(nil, 1) // SHORT
+	return marshalEXIF(entries), nil
+}
+
+// EXIFOrientation returns the orientation recorded in the EXIF block, from
+// 1, upright, to 8, or 1 when it records none.
+func EXIFOrientation(exif []byte) int {
+	entries, err := parseEXIF(exif)
+	if err != nil {
+		return 1
+	}
+	e := findEXIF(entries, exifOrientation)
+	if e == nil || e.typ != 3 || len(e.value) < 2 {
+		return 1
+	}
+	if o := int(binary.LittleEndian.Uint16(e.value)); o >= 1 && o <= 8 {
+		return o
+	}
+	return 1
+}
+
+// EXIFTime returns when the photo was taken, as the EXIF block records it:
+// its DateTimeOriginal, or its DateTime when it has none, and whether it
+// records either. EXIF gives the camera's local time without its zone, so
+// the time is returned as that time in UTC.
+func EXIFTime(exif []byte) (time.Time, bool) {
+	entries, err := parseEXIF(exif)
+	if err != nil {
+		return time.Time{}, false
+	}
+	var e *exifEntry
+	if ifd := findEXIF(entries, exifIFDPointer); ifd != nil {
+		e = findEXIF(ifd.sub, exifDateTimeOriginal)
+	}
+	if e == nil {
+		e = findEXIF(entries, exifDateTime)
+	}
+	if e == nil || e.typ != 2 { // ASCII
+		return time.Time{}, false
+	}
+	t, err := time.Parse(exifTimeLayout, strings.TrimRight(string(e.value), "\x00 "))
+	return t, err == nil
+}
+
+// Orient returns img turned upright for an EXIF orientation, as a viewer
+// honoring the orientation would show it. Orientations 5 to 8 swap the
+// width and height. Grayscale, paletted and 16-bit images keep their color
+// model.
+func Orient(img image.Image, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return img
+	}
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	sr, dr := image.Rect(0, 0, w, h), image.Rect(0, 0, dw, dh)
+	var src, dst draw.Image
+	paletted, _ := img.(*image.Paletted)
+	switch {
+	case paletted != nil:
+		src, dst = image.NewPaletted(sr, paletted.Palette), image.NewPaletted(dr, paletted.Palette)
+	case img.ColorModel() == color.GrayModel:
+		src, dst = image.NewGray(sr), image.NewGray(dr)
+	case img.ColorModel() == color.Gray16Model:
+		src, dst = image.NewGray16(sr), image.NewGray16(dr)
+	case is16Bit(img):
+		src, dst = image.NewNRGBA64(sr), image.NewNRGBA64(dr)
+	default:
+		src, dst = image.NewNRGBA(sr), image.NewNRGBA(dr)
+	}
+	if paletted != nil {
+		// Copy the indices, which drawing would look up in the palette again
+		for y := 0; y < h; y++ {
+			copy(src.(*image.Paletted).Pix[y*w:], paletted.Pix[paletted.PixOffset(b.Min.X, b.Min.Y+y):][:w])
+		}
+	} else {
+		draw.Draw(src, sr, img, b.Min, draw.Src)
+	}
+	srcPix, srcStride := pixBuffer(src)
+	dstPix, dstStride := pixBuffer(dst)
+	bpp := srcStride / max(w, 1) // Bytes per pixel
+
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			var sx, sy int
+			switch orientation {
+			case 2: // Mirrored
+				sx, sy = w-1-x, y
+			case 3: // Upside down
+				sx, sy = w-1-x, h-1-y
+			case 4: // Mirrored upside down
+				sx, sy = x, h-1-y
+			case 5: // Mirrored, turned a quarter counterclockwise
+				sx, sy = y, x
+			case 6: // Turned a quarter counterclockwise
+				sx, sy = y, h-1-x
+			case 7: // Mirrored, turned a quarter clockwise
+				sx, sy = w-1-y, h-1-x
+			case 8: // Turned a quarter clockwise
+				sx, sy = w-1-y, x
+			}
+			s := sy*srcStride + sx*bpp
+			copy(dstPix[y*dstStride+x*bpp:], srcPix[s:s+bpp])
+		}
+	}
+	return dst
+}
+
+// pixBuffer returns the pixel bytes and stride of an image made by Orient.
+func pixBuffer(img draw.Image) ([]byte, int) {
+	switch m := img.(type) {
+	case *image.Gray:
+		return m.Pix, m.Stride
+	case *image.Paletted:
+		return m.Pix, m.Stride
+	case *image.Gray16:
+		return m.Pix, m.Stride
+	case *image.NRGBA64:
+		return m.Pix, m.Stride
+	case *image.NRGBA:
+		return m.Pix, m.Stride
+	}
+	panic(fmt.Sprintf("unexpected image type %T", img))
+}
@@ -0,0 +1,245 @@
+package pixellock
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testDateTimeOriginal = "2024:05:01 12:34:56"
+
+// exifFixture returns a big-endian EXIF block, as cameras write them, with
+// a Make, an Orientation of 6 and a DateTimeOriginal in the EXIF IFD.
+func exifFixture() []byte {
+	be := binary.BigEndian
+	entry := func(b []byte, tag, typ uint16, count uint32, value []byte) []byte {
+		b = be.AppendUint16(b, tag)
+		b = be.AppendUint16(b, typ)
+		b = be.AppendUint32(b, count)
+		return append(b, value...)
+	}
+	b := be.AppendUint32([]byte("MM\x00*"), 8)
+	b = be.AppendUint16(b, 3) // IFD0 at 8, its values from 50
+	b = entry(b, 271, 2, 6, be.AppendUint32(nil, 50))
+	b = entry(b, exifOrientation, 3, 1, []byte{0, 6, 0, 0})
+	b = entry(b, exifIFDPointer, 4, 1, be.AppendUint32(nil, 56))
+	b = be.AppendUint32(b, 0)
+	b = append(b, "Pixel\x00"...)
+	b = be.AppendUint16(b, 1) // EXIF IFD at 56, its value from 74
+	b = entry(b, 36867, 2, 20, be.AppendUint32(nil, 74))
+	b = be.AppendUint32(b, 0)
+	return append(b, testDateTimeOriginal+"\x00"...)
+}
+
+// exifPhoto writes a 40x24 JPEG carrying exifFixture, whose pixels are
+// stored turned a quarter counterclockwise, and returns its path.
+func exifPhoto(t *testing.T) string {
+	t.Helper()
+	img := image.NewNRGBA(image.Rect(0, 0, 40, 24))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(i * 3)
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, nil); err != nil {
+		t.Fatalf("jpeg.Encode failed: %v", err)
+	}
+	data := buf.Bytes()
+	segment := binary.BigEndian.AppendUint16([]byte{0xff, jpegAPP1}, uint16(2+len(exifHeader)+len(exifFixture())))
+	segment = append(append(segment, exifHeader...), exifFixture()...)
+	data = append(append(append([]byte{}, data[:2]...), segment...), data[2:]...)
+
+	path := filepath.Join(t.TempDir(), "IMG_0001.jpg")
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	return path
+}
+
+// fileEXIF returns the orientation and DateTimeOriginal in the EXIF of the
+// image file at path, and false when it has no EXIF.
+func fileEXIF(t *testing.T, path string) (orientation int, dateTimeOriginal string, ok bool) {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	exif, err := ReadEXIF(data)
+	if err != nil {
+		t.Fatalf("%s: ReadEXIF failed: %v", path, err)
+	}
+	if exif == nil {
+		return 0, "", false
+	}
+	entries, err := parseEXIF(exif)
+	if err != nil {
+		t.Fatalf("%s: parseEXIF failed: %v", path, err)
+	}
+	if p := findEXIF(entries, exifIFDPointer); p != nil {
+		if e := findEXIF(p.sub, 36867); e != nil {
+			dateTimeOriginal = strings.TrimRight(string(e.value), "\x00")
+		}
+	}
+	return EXIFOrientation(exif), dateTimeOriginal, true
+}
+
+func imageSize(t *testing.T, path string) image.Point {
+	t.Helper()
+	img, err := LoadImage(path)
+	if err != nil {
+		t.Fatalf("LoadImage failed: %v", err)
+	}
+	return img.Bounds().Size()
+}
+
+func TestEXIFPreserved(t *testing.T) {
+	photo := exifPhoto(t)
+	key, err := GenerateRandomKey()
+	if err != nil {
+		t.Fatalf("GenerateRandomKey failed: %v", err)
+	}
+	dir := t.TempDir()
+	encrypted := filepath.Join(dir, "IMG_0001.jpg.enc")
+	if err := EncryptFile(t.Context(), photo, encrypted, key, false, EncryptOptions{Metadata: MetadataPreserve}); err != nil {
+		t.Fatalf("EncryptFile failed: %v", err)
+	}
+
+	info, err := InspectDecrypted(encrypted, key)
+	if err != nil {
+		t.Fatalf("InspectDecrypted failed: %v", err)
+	}
+	if want := time.Date(2024, 5, 1, 12, 34, 56, 0, time.UTC); !info.Taken.Equal(want) {
+		t.Errorf("InspectDecrypted gave the time taken as %v, want %v", info.Taken, want)
+	}
+
+	stored := image.Pt(40, 24)
+	for _, format := range []string{"jpeg", "png", "tiff"} {
+		decrypted := filepath.Join(dir, "decrypted."+format)
+		if err := DecryptFile(t.Context(), encrypted, decrypted, key, false, SaveOptions{Format: format}); err != nil {
+			t.Fatalf("%s: DecryptFile failed: %v", format, err)
+		}
+		orientation, taken, ok := fileEXIF(t, decrypted)
+		if !ok || orientation != 6 || taken != testDateTimeOriginal {
+			t.Errorf("%s: EXIF orientation %d, DateTimeOriginal %q, present %v; want 6, %q", format, orientation, taken, ok, testDateTimeOriginal)
+		}
+		// The orientation is kept, so the pixels must not be turned too.
+		if size := imageSize(t, decrypted); size != stored {
+			t.Errorf("%s: decrypted size %v, want the stored %v", format, size, stored)
+		}
+	}
+
+	// A TIFF carries its metadata in its own IFD, which is read back too.
+	tiffEncrypted := filepath.Join(dir, "decrypted.tiff.enc")
+	if err := EncryptFile(t.Context(), filepath.Join(dir, "decrypted.tiff"), tiffEncrypted, key, false, EncryptOptions{Metadata: MetadataPreserve}); err != nil {
+		t.Fatalf("EncryptFile(t.Context(), tiff) failed: %v", err)
+	}
+	fromTIFF := filepath.Join(dir, "from_tiff.jpg")
+	if err := DecryptFile(t.Context(), tiffEncrypted, fromTIFF, key, false, SaveOptions{Format: "jpeg"}); err != nil {
+		t.Fatalf("DecryptFile(t.Context(), tiff) failed: %v", err)
+	}
+	if orientation, taken, ok := fileEXIF(t, fromTIFF); !ok || orientation != 6 || taken != testDateTimeOriginal {
+		t.Errorf("from TIFF: EXIF orientation %d, DateTimeOriginal %q, present %v", orientation, taken, ok)
+	}
+
+	// WebP output cannot carry the orientation, so the pixels are turned.
+	upright := filepath.Join(dir, "decrypted.webp")
+	if err := DecryptFile(t.Context(), encrypted, upright, key, false, SaveOptions{Format: "webp"}); err != nil {
+		t.Fatalf("webp: DecryptFile failed: %v", err)
+	}
+	if size := imageSize(t, upright); size != image.Pt(24, 40) {
+		t.Errorf("webp: decrypted size %v, want it turned upright to 24x40", size)
+	}
+}
+
+func TestEXIFTime(t *testing.T) {
+	if taken, ok := EXIFTime(exifFixture()); !ok || taken.Format(exifTimeLayout) != testDateTimeOriginal {
+		t.Errorf("EXIFTime gave %v, %v; want the DateTimeOriginal", taken, ok)
+	}
+	// Without a DateTimeOriginal, the DateTime is taken
+	dateTime := exifEntry{tag: exifDateTime, typ: 2, count: 20, value: []byte("2023:12:31 23:59:00\x00")}
+	if taken, ok := EXIFTime(marshalEXIF([]exifEntry{dateTime})); !ok || taken != time.Date(2023, 12, 31, 23, 59, 0, 0, time.UTC) {
+		t.Errorf("EXIFTime gave %v, %v; want the DateTime", taken, ok)
+	}
+	orientation := exifEntry{tag: exifOrientation, typ: 3, count: 1, value: []byte{1, 0}}
+	if taken, ok := EXIFTime(marshalEXIF([]exifEntry{orientation})); ok {
+		t.Errorf("EXIFTime of a block without a time gave %v", taken)
+	}
+}
+
+func TestEXIFStripped(t *testing.T) {
+	photo := exifPhoto(t)
+	key, err := GenerateRandomKey()
+	if err != nil {
+		t.Fatalf("GenerateRandomKey failed: %v", err)
+	}
+	dir := t.TempDir()
+
+	// Stripped when encrypting
+	encrypted := filepath.Join(dir, "stripped.enc")
+	if err := EncryptFile(t.Context(), photo, encrypted, key, false, EncryptOptions{Metadata: MetadataStrip}); err != nil {
+		t.Fatalf("EncryptFile failed: %v", err)
+	}
+	decrypted := filepath.Join(dir, "stripped.jpg")
+	if err := DecryptFile(t.Context(), encrypted, decrypted, key, false, SaveOptions{Format: "jpeg"}); err != nil {
+		t.Fatalf("DecryptFile failed: %v", err)
+	}
+	if _, _, ok := fileEXIF(t, decrypted); ok {
+		t.Error("strip at encryption kept the EXIF")
+	}
+	if size := imageSize(t, decrypted); size != image.Pt(24, 40) {
+		t.Errorf("strip at encryption: size %v, want it turned upright to 24x40", size)
+	}
+
+	// Stripped when decrypting
+	encrypted = filepath.Join(dir, "preserved.enc")
+	if err := EncryptFile(t.Context(), photo, encrypted, key, false, EncryptOptions{Metadata: MetadataPreserve}); err != nil {
+		t.Fatalf("EncryptFile failed: %v", err)
+	}
+	decrypted = filepath.Join(dir, "preserved.png")
+	if err := DecryptFile(t.Context(), encrypted, decrypted, key, false, SaveOptions{Format: "png", Metadata: MetadataStrip}); err != nil {
+		t.Fatalf("DecryptFile failed: %v", err)
+	}
+	if _, _, ok := fileEXIF(t, decrypted); ok {
+		t.Error("strip at decryption kept the EXIF")
+	}
+	if size := imageSize(t, decrypted); size != image.Pt(24, 40) {
+		t.Errorf("strip at decryption: size %v, want it turned upright to 24x40", size)
+	}
+
+	if err := CheckMetadataMode("keep"); err == nil {
+		t.Error("CheckMetadataMode accepted an unknown mode")
+	}
+}
+
+func TestOrient(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 3, 2))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(i)
+	}
+	at := func(img image.Image, x, y int) uint8 {
+		n := asNRGBA(img)
+		return n.Pix[n.PixOffset(x, y)]
+	}
+
+	// Orientation 6 is stored turned counterclockwise, so the bottom-left
+	// pixel becomes the top-left one.
+	if got := Orient(img, 6); got.Bounds().Size() != image.Pt(2, 3) || at(got, 0, 0) != at(img, 0, 1) {
+		t.Errorf("Orient(6) gave size %v and top-left %d", got.Bounds().Size(), at(got, 0, 0))
+	}
+	if got := Orient(img, 3); at(got, 0, 0) != at(img, 2, 1) {
+		t.Errorf("Orient(3) top-left %d, want the bottom-right pixel", at(got, 0, 0))
+	}
+	for _, pair := range [][2]int{{2, 2}, {3, 3}, {4, 4}, {5, 5}, {6, 8}, {7, 7}, {8, 6}} {
+		if got := asNRGBA(Orient(Orient(img, pair[0]), pair[1])); !bytes.Equal(got.Pix, img.Pix) {
+			t.Errorf("Orient(%d) then Orient(%d) does not restore the image", pair[0], pair[1])
+		}
+	}
+	if Orient(img, 1) != image.Image(img) {
+		t.Error("Orient(1) changed the image")
+	}
+}
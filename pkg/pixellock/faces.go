@@ -0,0 +1,114 @@
+package pixellock
+
+import (
+	_ "embed"
+	"fmt"
+	"image"
+	"math"
+	"sync"
+
+	pigo "github.com/esimov/pigo/core"
+)
+
+// DetectFaces is the --detect value that finds the regions to redact with
+// the face detector.
+const DetectFaces = "faces"
+
+// DefaultFaceMargin is the fraction of its size by which a detected face is
+// widened on every side, so that hair, ears and chin are redacted too.
+const DefaultFaceMargin = 0.2
+
+// facefinderCascade is the face classification cascade shipped with pigo,
+// a pure-Go port of the pico detector.
+//
+//go:embed cascade/facefinder
+var facefinderCascade []byte
+
+// Detector settings: faces from minFaceSize pixels up to the size of the
+// image are searched for, and detections scoring at least minFaceScore are
+// kept once overlapping ones are merged.
+const (
+	minFaceSize     = 20
+	minFaceScore    = 5
+	faceShiftFactor = 0.1
+	faceScaleFactor = 1.1
+	faceIoU         = 0.2
+)
+
+var (
+	faceClassifier     *pigo.Pigo
+	faceClassifierErr  error
+	faceClassifierOnce sync.Once
+)
+
+// CheckDetect returns an error unless detect is DetectFaces, or empty for
+// none.
+func CheckDetect(detect string) error {
+	if detect != "" && detect != DetectFaces {
+		return fmt.Errorf("unknown detection %q (want %s)", detect, DetectFaces)
+	}
+	return nil
+}
+
+// FindFaces returns the bounding boxes of the faces in img, relative to its
+// top-left corner, each widened by margin times its size on every side and
+// clipped to the image.
+func FindFaces(img image.Image, margin float64) ([]image.Rectangle, error) {
+	faceClassifierOnce.Do(func() {
+		faceClassifier, faceClassifierErr = pigo.NewPigo().Unpack(facefinderCascade)
+	})
+	if faceClassifierErr != nil {
+		return nil, fmt.Errorf("failed to load the face cascade: %w", faceClassifierErr)
+	}
+	if margin < 0 {
+		return nil, fmt.Errorf("invalid face margin %g: must not be negative", margin)
+	}
+
+	b := img.Bounds()
+	params := pigo.CascadeParams{
+		MinSize:     minFaceSize,
+		MaxSize:     max(b.Dx(), b.Dy()),
+		ShiftFactor: faceShiftFactor,
+		ScaleFactor: faceScaleFactor,
+		ImageParams: pigo.ImageParams{
+			Pixels: pigo.RgbToGrayscale(toNRGBA(img)),
+			Rows:   b.Dy(),
+			Cols:   b.Dx(),
+			Dim:    b.Dx(),
+		},
+	}
+	detections := faceClassifier.ClusterDetections(faceClassifier.RunCascade(params, 0), faceIoU)
+
+	frame := image.Rect(0, 0, b.Dx(), b.Dy())
+	var faces []image.Rectangle
+	for _, d := range detections {
+		if d.Q < minFaceScore {
+			continue
+		}
+		half := int(math.Ceil(float64(d.Scale) * (0.5 + margin)))
+		face := image.Rect(d.Col-half, d.Row-half, d.Col+half, d.Row+half).Intersect(frame)
+		if !face.Empty() {
+			faces = append(faces, face)
+		}
+	}
+	return faces, nil
+}
+
+// FindFacesInData returns FindFaces for the image in data, as
+// ReadImageForEncryption gives it.
+func FindFacesInData(data []byte, margin float64) ([]image.Rectangle, error) {
+	return findFacesInData(data, margin, 0)
+}
+
+// findFacesInData is FindFacesInData of an image of no more pixels than
+// maxPixels allows.
+func findFacesInData(data []byte, margin float64, maxPixels int64) ([]image.Rectangle, error) {
+	if IsGIFData(data) || IsHEIFData(data) {
+		return nil, fmt.Errorf("faces cannot be found in animated GIFs and HEIF images")
+	}
+	img, err := bytesToImage(data, maxPixels)
+	if err != nil {
+		return nil, err
+	}
+	return FindFaces(img, margin)
+}
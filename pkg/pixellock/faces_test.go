@@ -0,0 +1,140 @@
+package pixellock
+
+import (
+	"image"
+	"image/draw"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// faceFixture is a portrait with one face, from the pigo repository (MIT).
+const faceFixture = "testdata/face.jpg"
+
+// faceNRGBA returns the face fixture, and twoFacesNRGBA two copies of it
+// side by side.
+func faceNRGBA(t *testing.T) *image.NRGBA {
+	t.Helper()
+	img, err := LoadImage(faceFixture)
+	if err != nil {
+		t.Fatalf("LoadImage failed: %v", err)
+	}
+	return toNRGBA(img)
+}
+
+func twoFacesNRGBA(t *testing.T) *image.NRGBA {
+	t.Helper()
+	face := faceNRGBA(t)
+	w, h := face.Rect.Dx(), face.Rect.Dy()
+	img := image.NewNRGBA(image.Rect(0, 0, 2*w, h))
+	draw.Draw(img, face.Rect, face, image.Point{}, draw.Src)
+	draw.Draw(img, face.Rect.Add(image.Pt(w, 0)), face, image.Point{}, draw.Src)
+	return img
+}
+
+func TestFindFaces(t *testing.T) {
+	for name, tc := range map[string]struct {
+		img  image.Image
+		want int
+	}{
+		"none": {photoNRGBA(t), 0},
+		"one":  {faceNRGBA(t), 1},
+		"two":  {twoFacesNRGBA(t), 2},
+	} {
+		faces, err := FindFaces(tc.img, DefaultFaceMargin)
+		if err != nil {
+			t.Fatalf("%s: FindFaces failed: %v", name, err)
+		}
+		if len(faces) != tc.want {
+			t.Errorf("%s: found %d faces, want %d", name, len(faces), tc.want)
+		}
+		for _, f := range faces {
+			if !f.In(tc.img.Bounds()) {
+				t.Errorf("%s: face %v reaches past the image", name, f)
+			}
+		}
+	}
+
+	// A margin widens the face
+	bare, _ := FindFaces(faceNRGBA(t), 0)
+	wide, _ := FindFaces(faceNRGBA(t), DefaultFaceMargin)
+	if len(bare) != 1 || len(wide) != 1 || !bare[0].In(wide[0]) || bare[0] == wide[0] {
+		t.Errorf("margin did not widen the face: %v, %v", bare, wide)
+	}
+	if _, err := FindFaces(faceNRGBA(t), -1); err == nil {
+		t.Error("FindFaces accepted a negative margin")
+	}
+}
+
+func TestDetectFacesEncrypt(t *testing.T) {
+	key, err := GenerateRandomKey()
+	if err != nil {
+		t.Fatalf("GenerateRandomKey failed: %v", err)
+	}
+	dir := t.TempDir()
+	opts := EncryptOptions{Detect: DetectFaces, FaceMargin: DefaultFaceMargin}
+
+	redacted := filepath.Join(dir, "face"+RedactedExtension)
+	if err := EncryptFile(t.Context(), faceFixture, redacted, key, false, opts); err != nil {
+		t.Fatalf("EncryptFile failed: %v", err)
+	}
+	data, err := os.ReadFile(redacted)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	if !IsRedacted(data) {
+		t.Fatal("image with a face was not redacted")
+	}
+	restored := filepath.Join(dir, "restored.png")
+	if err := DecryptFile(t.Context(), redacted, restored, key, false, SaveOptions{Format: "png"}); err != nil {
+		t.Fatalf("DecryptFile failed: %v", err)
+	}
+	got, err := LoadImage(restored)
+	if err != nil {
+		t.Fatalf("LoadImage failed: %v", err)
+	}
+	if !samePixels(asNRGBA(got), faceNRGBA(t)) {
+		t.Error("restored image differs from the original")
+	}
+
+	// No face: nothing is written, unless detection is required
+	none := filepath.Join(dir, "street.png")
+	if err := SaveImage(none, photoNRGBA(t), SaveOptions{Format: "png"}); err != nil {
+		t.Fatalf("SaveImage failed: %v", err)
+	}
+	skipped := filepath.Join(dir, "street"+RedactedExtension)
+	if err := EncryptFile(t.Context(), none, skipped, key, false, opts); err != nil {
+		t.Fatalf("EncryptFile failed: %v", err)
+	}
+	if _, err := os.Stat(skipped); !os.IsNotExist(err) {
+		t.Errorf("image with no face was written: %v", err)
+	}
+	opts.RequireDetection = true
+	if err := EncryptFile(t.Context(), none, skipped, key, false, opts); err == nil {
+		t.Error("EncryptFile accepted an image with no face when detection is required")
+	}
+
+	if err := (EncryptOptions{Detect: "plates"}).Check(); err == nil {
+		t.Error("Check accepted an unknown detection")
+	}
+	if err := (EncryptOptions{Detect: DetectFaces, Mode: ModeScramble}).Check(); err == nil {
+		t.Error("Check accepted detection with the scramble mode")
+	}
+}
+
+func TestDetectFacesDirectory(t *testing.T) {
+	key, _ := GenerateRandomKey()
+	fsys, in, out := &MemFS{}, "in", "out"
+	memImage(t, fsys, filepath.Join(in, "two.png"), twoFacesNRGBA(t))
+	memImage(t, fsys, filepath.Join(in, "street.png"), photoNRGBA(t))
+	opts := EncryptOptions{Detect: DetectFaces, FaceMargin: DefaultFaceMargin, FS: fsys}
+	if err := EncryptDirectory(t.Context(), in, out, key, false, false, opts); err != nil {
+		t.Fatalf("EncryptDirectory failed: %v", err)
+	}
+	if _, err := fsys.Stat(filepath.Join(out, "two.png"+RedactedExtension)); err != nil {
+		t.Errorf("image with faces not redacted: %v", err)
+	}
+	if _, err := fsys.Stat(filepath.Join(out, "street.png"+RedactedExtension)); !os.IsNotExist(err) {
+		t.Errorf("image with no face was written: %v", err)
+	}
+}
@@ -0,0 +1,82 @@
+package pixellock
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+)
+
+// A FileSystem is where the file functions read and write: the operating
+// system's, OSFS, unless their options name another, such as a MemFS. It
+// is an fs.FS, with the writes encryption and decryption make added, but
+// takes names as the os package does, slash or OS separated, absolute or
+// relative, rather than only those fs.ValidPath accepts. A FileSystem can
+// be used by several goroutines at once.
+type FileSystem interface {
+	fs.StatFS
+	fs.ReadDirFS
+
+	// Create creates or truncates the file name, whose directory must
+	// exist, as os.Create does.
+	Create(name string) (io.WriteCloser, error)
+
+	// MkdirAll creates the directory name and any parents it needs, as
+	// os.MkdirAll does.
+	MkdirAll(name string, perm fs.FileMode) error
+
+	// Remove removes the file or empty directory name.
+	Remove(name string) error
+
+	// Rename moves the file oldname to newname, replacing any file there.
+	Rename(oldname, newname string) error
+}
+
+// OSFS is the FileSystem of the operating system, used when options name
+// none.
+type OSFS struct{}
+
+func (OSFS) Open(name string) (fs.File, error)            { return os.Open(name) }
+func (OSFS) Stat(name string) (fs.FileInfo, error)        { return os.Stat(name) }
+func (OSFS) ReadDir(name string) ([]fs.DirEntry, error)   { return os.ReadDir(name) }
+func (OSFS) Create(name string) (io.WriteCloser, error)   { return os.Create(name) }
+func (OSFS) MkdirAll(name string, perm fs.FileMode) error { return os.MkdirAll(name, perm) }
+func (OSFS) Remove(name string) error                     { return os.Remove(name) }
+func (OSFS) Rename(oldname, newname string) error         { return os.Rename(oldname, newname) }
+
+// orOS returns fsys, or OSFS when fsys is nil.
+func orOS(fsys FileSystem) FileSystem {
+	if fsys == nil {
+		return OSFS{}
+	}
+	return fsys
+}
+
+// needOS returns an error unless fsys is the operating system's, for the
+// features that read and write through the os package alone.
+func needOS(fsys FileSystem, feature string) error {
+	if _, ok := fsys.(OSFS); !ok {
+		return fmt.Errorf("%s needs the operating system's filesystem", feature)
+	}
+	return nil
+}
+
+// writeFile writes data to the file name in fsys, as os.WriteFile does.
+func writeFile(fsys FileSystem, name string, data []byte) error {
+	f, err := fsys.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// exists reports whether name is there in fsys, as the output files that
+// are left alone without overwriting are checked for.
+func exists(fsys FileSystem, name string) bool {
+	_, err := fsys.Stat(name)
+	return err == nil
+}
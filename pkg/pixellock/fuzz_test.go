@@ -0,0 +1,111 @@
+package pixellock
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// fuzzKey is the key the fuzz targets decrypt with, and their seeds are
+// encrypted with, so that mutations of the seeds reach past the headers.
+var fuzzKey = []byte("0123456789abcdef0123456789abcdef")
+
+// fuzzImage writes a PNG of w by h pixels of varied colors to dir and
+// returns its name.
+func fuzzImage(f *testing.F, dir string, w, h int) string {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := range h {
+		for x := range w {
+			img.SetNRGBA(x, y, color.NRGBA{uint8(x * 7), uint8(y * 5), uint8(x ^ y), 255})
+		}
+	}
+	name := filepath.Join(dir, "cover.png")
+	file, err := os.Create(name)
+	if err != nil {
+		f.Fatalf("Create failed: %v", err)
+	}
+	defer file.Close()
+	if err := png.Encode(file, img); err != nil {
+		f.Fatalf("Encode failed: %v", err)
+	}
+	return name
+}
+
+// addFileSeed adds the file at filename to the corpus of f.
+func addFileSeed(f *testing.F, filename string) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		f.Fatalf("seed: %v", err)
+	}
+	f.Add(data)
+}
+
+// FuzzDecryptFile decrypts arbitrary files as decrypt and info read them,
+// which must fail cleanly rather than panic or allocate without bound.
+func FuzzDecryptFile(f *testing.F) {
+	dir := f.TempDir()
+	cover := fuzzImage(f, dir, 40, 40)
+	for i, opts := range []EncryptOptions{
+		{},
+		{Thumbnail: 16, EmbedThumbnail: true},
+		{Regions: []image.Rectangle{image.Rect(2, 2, 20, 12)}},
+		{Mode: ModeScramble},
+		{Tile: MinTileSize},
+		{MetadataOnly: true},
+	} {
+		output := filepath.Join(dir, "seed"+string(rune('a'+i))+".png")
+		if err := EncryptFile(context.Background(), cover, output, fuzzKey, true, opts); err != nil {
+			f.Fatalf("seed %d: %v", i, err)
+		}
+		addFileSeed(f, output)
+	}
+	data, _ := os.ReadFile(cover)
+	if legacy, err := Encrypt(fuzzKey, data); err == nil {
+		f.Add(legacy)
+	}
+	f.Add([]byte(streamMagic))
+	f.Add([]byte(tiledMagic))
+	f.Add([]byte(thumbnailMagic))
+
+	input, output := filepath.Join(dir, "fuzz.enc"), filepath.Join(dir, "fuzz.png")
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if err := os.WriteFile(input, data, 0644); err != nil {
+			t.Fatalf("WriteFile failed: %v", err)
+		}
+		InspectEncrypted(input)
+		decryptFileData(context.Background(), OSFS{}, nil, input, newKeyCipher(fuzzKey), SaveOptions{}, false)
+		DecryptMetadataFile(input, output, fuzzKey)
+	})
+}
+
+// FuzzRevealPayload reveals arbitrary images, which must fail cleanly
+// rather than panic or allocate without bound.
+func FuzzRevealPayload(f *testing.F) {
+	dir := f.TempDir()
+	cover := fuzzImage(f, dir, 48, 48)
+	payload := Payload{Data: []byte("a hidden message, long enough to compress well well well well"), Filename: "notes.txt"}
+	for i, opts := range []StegoOptions{
+		DefaultStegoOptions,
+		{Density: 2, SkipTransparent: true, Compress: true},
+		{Density: 1, Regions: []image.Rectangle{image.Rect(0, 0, 40, 40)}, ExcludeRegions: []image.Rectangle{image.Rect(4, 4, 8, 8)}},
+		{Density: 1, Method: StegoMethodEXIF},
+	} {
+		output := filepath.Join(dir, "seed"+string(rune('a'+i))+".png")
+		if err := HidePayload(cover, output, payload, opts, "png"); err != nil {
+			f.Fatalf("seed %d: %v", i, err)
+		}
+		addFileSeed(f, output)
+	}
+	input := filepath.Join(dir, "fuzz.png")
+	opts := StegoOptions{Density: 1, SkipTransparent: true, Legacy: true}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if err := os.WriteFile(input, data, 0644); err != nil {
+			t.Fatalf("WriteFile failed: %v", err)
+		}
+		revealFile(input, opts)
+	})
+}
@@ -0,0 +1,146 @@
+package pixellock
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"os"
+	"slices"
+)
+
+// HEIC and other HEIF images hold HEVC coded pixels, which pixellock cannot
+// decode. Their container is parsed instead: image.DecodeConfig reports
+// their size, so they are recognized as images, and encryption keeps their
+// bytes as they are, so decryption gives back the identical file.
+
+// ErrHEIFDecoding is returned when the pixels of a HEIF image are needed.
+var ErrHEIFDecoding = errors.New("HEIC/HEIF pixel decoding is not available in this build")
+
+// heifBrands are the ftyp brands of HEIF images coded with HEVC.
+var heifBrands = []string{"heic", "heix", "heim", "heis", "hevc", "hevx"}
+
+func init() {
+	for _, brand := range append(slices.Clone(heifBrands), "mif1", "msf1") {
+		image.RegisterFormat("heif", "????ftyp"+brand, decodeHEIF, decodeHEIFConfig)
+	}
+}
+
+// IsHEIFData reports whether data starts with the ftyp box of a HEIF image
+// coded with HEVC.
+func IsHEIFData(data []byte) bool {
+	if len(data) < 16 || string(data[4:8]) != "ftyp" {
+		return false
+	}
+	end := min(int(binary.BigEndian.Uint32(data)), len(data))
+	if slices.Contains(heifBrands, string(data[8:12])) {
+		return true
+	}
+	// Generic HEIF brands name the codec among the compatible brands,
+	// which follow the minor version.
+	if major := string(data[8:12]); major != "mif1" && major != "msf1" {
+		return false
+	}
+	for i := 16; i+4 <= end; i += 4 {
+		if slices.Contains(heifBrands, string(data[i:i+4])) {
+			return true
+		}
+	}
+	return false
+}
+
+// HEIFBytes returns the contents of the file at filename and true when it is
+// a HEIF image, and false for any other file.
+func HEIFBytes(filename string) ([]byte, bool, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to open image: %w", err)
+	}
+	defer f.Close()
+	header := make([]byte, 256)
+	n, _ := io.ReadFull(f, header)
+	if !IsHEIFData(header[:n]) {
+		return nil, false, nil
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to read image: %w", err)
+	}
+	return data, true, nil
+}
+
+func decodeHEIF(io.Reader) (image.Image, error) {
+	return nil, ErrHEIFDecoding
+}
+
+// decodeHEIFConfig returns the size of the largest image in the image
+// spatial extents properties of the HEIF container, which is that of the
+// primary image rather than of a thumbnail or tile.
+func decodeHEIFConfig(r io.Reader) (image.Config, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return image.Config{}, err
+	}
+	if !IsHEIFData(data) {
+		return image.Config{}, fmt.Errorf("not a HEIF image coded with HEVC")
+	}
+	var config image.Config
+	heifBoxes(data, func(typ string, body []byte) bool {
+		if typ != "meta" || len(body) < 4 {
+			return true
+		}
+		heifBoxes(body[4:], func(typ string, body []byte) bool { // Skip version and flags
+			if typ != "iprp" {
+				return true
+			}
+			heifBoxes(body, func(typ string, body []byte) bool {
+				if typ != "ipco" {
+					return true
+				}
+				heifBoxes(body, func(typ string, body []byte) bool {
+					if typ == "ispe" && len(body) >= 12 {
+						w, h := int(binary.BigEndian.Uint32(body[4:])), int(binary.BigEndian.Uint32(body[8:]))
+						if w*h > config.Width*config.Height {
+							config.Width, config.Height = w, h
+						}
+					}
+					return true
+				})
+				return false
+			})
+			return false
+		})
+		return false
+	})
+	if config.Width == 0 || config.Height == 0 {
+		return image.Config{}, fmt.Errorf("HEIF image has no image size")
+	}
+	config.ColorModel = color.NRGBAModel
+	return config, nil
+}
+
+// heifBoxes calls fn with the type and body of each ISO base media file
+// format box in data, until fn returns false or a box is truncated.
+func heifBoxes(data []byte, fn func(typ string, body []byte) bool) {
+	for len(data) >= 8 {
+		size, header := uint64(binary.BigEndian.Uint32(data)), 8
+		switch size {
+		case 0: // The box runs to the end
+			size = uint64(len(data))
+		case 1: // A 64-bit size follows the type
+			if len(data) < 16 {
+				return
+			}
+			size, header = binary.BigEndian.Uint64(data[8:]), 16
+		}
+		if size < uint64(header) || size > uint64(len(data)) {
+			return
+		}
+		if !fn(string(data[4:8]), data[header:size]) {
+			return
+		}
+		data = data[size:]
+	}
+}
@@ -0,0 +1,136 @@
+package pixellock
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// heifBox returns an ISO base media file format box.
+func heifBox(typ string, body ...[]byte) []byte {
+	b := binary.BigEndian.AppendUint32(nil, 0)
+	b = append(b, typ...)
+	for _, part := range body {
+		b = append(b, part...)
+	}
+	binary.BigEndian.PutUint32(b, uint32(len(b)))
+	return b
+}
+
+// heicFixture writes the container of a HEIC with a 4032x3024 primary image
+// and a 320x240 thumbnail, whose coded pixels are stand-in bytes, and
+// returns its path.
+func heicFixture(t *testing.T, major string, compatible ...string) string {
+	t.Helper()
+	ftyp := append([]byte(major), 0, 0, 0, 0)
+	for _, brand := range compatible {
+		ftyp = append(ftyp, brand...)
+	}
+	ispe := func(w, h uint32) []byte {
+		body := binary.BigEndian.AppendUint32(make([]byte, 4), w) // Version and flags, then the size
+		return heifBox("ispe", binary.BigEndian.AppendUint32(body, h))
+	}
+	data := heifBox("ftyp", ftyp)
+	data = append(data, heifBox("meta", make([]byte, 4),
+		heifBox("hdlr", make([]byte, 24)),
+		heifBox("iprp", heifBox("ipco", ispe(320, 240), ispe(4032, 3024))))...)
+	data = append(data, heifBox("mdat", bytes.Repeat([]byte{0x26, 0x01, 0xaf}, 500))...)
+
+	path := filepath.Join(t.TempDir(), "IMG_0001.HEIC")
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	return path
+}
+
+func TestHEIFDetection(t *testing.T) {
+	for _, brands := range [][]string{{"heic", "mif1", "heic"}, {"mif1", "mif1", "heic"}, {"heix"}} {
+		path := heicFixture(t, brands[0], brands[1:]...)
+		if !isImageFile(path) {
+			t.Errorf("%v: isImageFile should return true for HEIC file", brands)
+		}
+		if format, err := DetectImageFormat(path); err != nil || format != "heif" {
+			t.Errorf("%v: DetectImageFormat = %q, %v; want heif", brands, format, err)
+		}
+		f, _ := os.Open(path)
+		config, _, err := image.DecodeConfig(f)
+		f.Close()
+		if err != nil || config.Width != 4032 || config.Height != 3024 {
+			t.Errorf("%v: DecodeConfig = %dx%d, %v; want the primary image's 4032x3024", brands, config.Width, config.Height, err)
+		}
+		if _, err := LoadImage(path); !errors.Is(err, ErrHEIFDecoding) {
+			t.Errorf("%v: LoadImage error = %v, want ErrHEIFDecoding", brands, err)
+		}
+	}
+
+	// An AVIF also carries the generic brand, but not an HEVC one.
+	if IsHEIFData(heifBox("ftyp", []byte("mif1\x00\x00\x00\x00mif1avif"))) {
+		t.Error("IsHEIFData accepted an AVIF")
+	}
+}
+
+func TestHEIFEncryptDecrypt(t *testing.T) {
+	input := heicFixture(t, "heic", "mif1", "heic")
+	original, err := os.ReadFile(input)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	key, err := GenerateRandomKey()
+	if err != nil {
+		t.Fatalf("GenerateRandomKey failed: %v", err)
+	}
+	tempDir := t.TempDir()
+	encrypted := filepath.Join(tempDir, "IMG_0001.HEIC.enc")
+	if err := EncryptFile(t.Context(), input, encrypted, key, false, EncryptOptions{Metadata: MetadataPreserve}); err != nil {
+		t.Fatalf("EncryptFile failed: %v", err)
+	}
+
+	for _, outputFormat := range []string{OriginalOutputFormat, "heic"} {
+		decrypted := filepath.Join(tempDir, outputFormat+".heic")
+		if err := DecryptFile(t.Context(), encrypted, decrypted, key, false, SaveOptions{Format: outputFormat}); err != nil {
+			t.Fatalf("DecryptFile(t.Context(), %s) failed: %v", outputFormat, err)
+		}
+		got, err := os.ReadFile(decrypted)
+		if err != nil {
+			t.Fatalf("ReadFile failed: %v", err)
+		}
+		if !bytes.Equal(got, original) {
+			t.Errorf("%s: decrypted HEIC differs from the original bytes", outputFormat)
+		}
+	}
+
+	decrypted := filepath.Join(tempDir, "converted.png")
+	err = DecryptFile(t.Context(), encrypted, decrypted, key, false, SaveOptions{Format: "png"})
+	if !errors.Is(err, ErrHEIFDecoding) || !strings.Contains(err.Error(), OriginalOutputFormat) {
+		t.Errorf("DecryptFile(t.Context(), png) error = %v, want ErrHEIFDecoding naming the original output format", err)
+	}
+	if _, err := os.Stat(decrypted); !os.IsNotExist(err) {
+		t.Errorf("refused decrypt still wrote %s", decrypted)
+	}
+}
+
+func TestImageFileError(t *testing.T) {
+	dir := t.TempDir()
+	text := filepath.Join(dir, "notes.txt")
+	if err := os.WriteFile(text, []byte("not an image"), 0o644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	if err := ImageFileError(text); err == nil || !strings.Contains(err.Error(), "supported format") {
+		t.Errorf("ImageFileError(text) = %v", err)
+	}
+	truncated := filepath.Join(dir, "cut.png")
+	if err := os.WriteFile(truncated, pngSignature, 0o644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	if err := ImageFileError(truncated); err == nil || !strings.Contains(err.Error(), "unreadable") {
+		t.Errorf("ImageFileError(truncated) = %v", err)
+	}
+	if err := ImageFileError(heicFixture(t, "heic")); err != nil {
+		t.Errorf("ImageFileError(heic) = %v", err)
+	}
+}
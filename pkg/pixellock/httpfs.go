@@ -0,0 +1,328 @@
+package pixellock
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"io/fs"
+	"math/rand/v2"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Defaults of an HTTPFS.
+const (
+	DefaultHTTPTimeout    = 60 * time.Second
+	DefaultHTTPMaxBytes   = 256 << 20
+	DefaultHTTPRetries    = 3
+	DefaultHTTPRetryDelay = 500 * time.Millisecond
+	DefaultHTTPUserAgent  = "pixellock"
+)
+
+// maxHTTPRetryDelay bounds the wait before a retry, however long a
+// Retry-After header asks for.
+const maxHTTPRetryDelay = 30 * time.Second
+
+// httpPeekBytes bounds what an HTTPFS reads of a download to learn that
+// it is an image before going on.
+const httpPeekBytes = 1 << 20
+
+// IsHTTPURL reports whether name is an http:// or https:// URL, which an
+// HTTPFS reads.
+func IsHTTPURL(name string) bool {
+	return strings.HasPrefix(name, "http://") || strings.HasPrefix(name, "https://")
+}
+
+// An HTTPFS is a FileSystem reading images from http:// and https:// URLs,
+// and other names from Local. A URL is a file, read as it is downloaded,
+// which cannot be written. Redirects are followed, and requests that fail
+// to connect, time out, or are answered 429 or 5xx are retried, waiting
+// longer each time. A download that is not an image, as its first bytes
+// show, fails before the rest is read.
+//
+// The name of a URL's file is the filename of its Content-Disposition
+// header, or else the last element of its path.
+type HTTPFS struct {
+	// Client sends the requests; one following redirects, with a timeout
+	// of DefaultHTTPTimeout, when nil.
+	Client *http.Client
+
+	// UserAgent is the User-Agent header of requests;
+	// DefaultHTTPUserAgent when empty.
+	UserAgent string
+
+	// MaxBytes bounds a download; DefaultHTTPMaxBytes when 0.
+	MaxBytes int64
+
+	// Retries is the number of times a request is retried;
+	// DefaultHTTPRetries when 0, and none when negative. The first retry
+	// waits about RetryDelay, DefaultHTTPRetryDelay when 0, or as long as
+	// the server's Retry-After header says, and each after twice as long.
+	Retries    int
+	RetryDelay time.Duration
+
+	Local FileSystem // The FileSystem of other names; OSFS when nil
+}
+
+func (h *HTTPFS) local() FileSystem { return orOS(h.Local) }
+
+// defaultHTTPClient is the Client of an HTTPFS that names none.
+var defaultHTTPClient = &http.Client{Timeout: DefaultHTTPTimeout}
+
+func (h *HTTPFS) client() *http.Client {
+	if h.Client == nil {
+		return defaultHTTPClient
+	}
+	return h.Client
+}
+
+func (h *HTTPFS) maxBytes() int64 {
+	if h.MaxBytes <= 0 {
+		return DefaultHTTPMaxBytes
+	}
+	return h.MaxBytes
+}
+
+// errReadOnlyURL is the error of writing a URL.
+var errReadOnlyURL = fmt.Errorf("URLs are read, not written: %w", fs.ErrPermission)
+
+// An HTTPError is a response whose status is not a success.
+type HTTPError struct {
+	StatusCode int
+	Status     string
+	retryAfter time.Duration // As the Retry-After header asked
+}
+
+func (e *HTTPError) Error() string { return "server responded " + e.Status }
+
+// Is makes an HTTPError of 404 or 410 match fs.ErrNotExist.
+func (e *HTTPError) Is(target error) bool {
+	return target == fs.ErrNotExist && (e.StatusCode == http.StatusNotFound || e.StatusCode == http.StatusGone)
+}
+
+// retryable reports whether a request failing with err may succeed if
+// retried: the server is throttling it or failed on its side, or its
+// connection failed.
+func (e *HTTPError) retryable() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500 && e.StatusCode != http.StatusNotImplemented
+}
+
+// httpRetryable reports whether a request failing with err may succeed if
+// retried.
+func httpRetryable(err error) bool {
+	var e *HTTPError
+	if errors.As(err, &e) {
+		return e.retryable()
+	}
+	var invalid url.InvalidHostError
+	return !errors.As(err, &invalid)
+}
+
+// do sends a request of method for the URL name, retrying it as h says,
+// and returns the response once it succeeds, whose body the caller must
+// close.
+func (h *HTTPFS) do(method, name string) (*http.Response, error) {
+	retries := h.Retries
+	if retries == 0 {
+		retries = DefaultHTTPRetries
+	}
+	delay := h.RetryDelay
+	if delay <= 0 {
+		delay = DefaultHTTPRetryDelay
+	}
+	userAgent := h.UserAgent
+	if userAgent == "" {
+		userAgent = DefaultHTTPUserAgent
+	}
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequest(method, name, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("User-Agent", userAgent)
+		resp, err := h.client().Do(req)
+		if err == nil {
+			if resp.StatusCode < 300 {
+				return resp, nil
+			}
+			err = httpError(resp)
+		}
+		if attempt >= retries || !httpRetryable(err) {
+			return nil, err
+		}
+		wait := delay/2 + rand.N(delay/2+1)
+		var e *HTTPError
+		if errors.As(err, &e) && e.retryAfter > 0 {
+			wait = min(e.retryAfter, maxHTTPRetryDelay)
+		}
+		time.Sleep(wait)
+		delay = min(delay*2, maxHTTPRetryDelay)
+	}
+}
+
+// httpError returns the error of resp, closing its body.
+func httpError(resp *http.Response) error {
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	e := &HTTPError{StatusCode: resp.StatusCode, Status: resp.Status}
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+		e.retryAfter = time.Duration(seconds) * time.Second
+	}
+	return e
+}
+
+// urlInfo returns the information of the file of the URL name, from the
+// headers of resp.
+func urlInfo(name string, resp *http.Response) memInfo {
+	info := memInfo{name: urlFilename(name, resp.Header.Get("Content-Disposition")), size: max(resp.ContentLength, 0)}
+	if t, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		info.modTime = t
+	}
+	return info
+}
+
+// urlFilename returns the name of the file of the URL name: the filename
+// of its Content-Disposition header, or else the last element of its
+// path, or index.html when there is none.
+func urlFilename(name, disposition string) string {
+	if _, params, err := mime.ParseMediaType(disposition); err == nil {
+		if filename := path.Base(strings.ReplaceAll(params["filename"], `\`, "/")); filename != "." && filename != "/" && filename != ".." {
+			return filename
+		}
+	}
+	if u, err := url.Parse(name); err == nil {
+		if base := path.Base(u.Path); base != "." && base != "/" && base != ".." {
+			return base
+		}
+	}
+	return "index.html"
+}
+
+// Stat returns the information of the file or directory name. The size of
+// a URL's file is 0 when the server does not give it.
+func (h *HTTPFS) Stat(name string) (fs.FileInfo, error) {
+	if !IsHTTPURL(name) {
+		return h.local().Stat(name)
+	}
+	resp, err := h.do(http.MethodHead, name)
+	var e *HTTPError
+	if errors.As(err, &e) && (e.StatusCode == http.StatusMethodNotAllowed || e.StatusCode == http.StatusNotImplemented) {
+		// The server takes no HEAD requests, so Open finds out the rest
+		return memInfo{name: urlFilename(name, "")}, nil
+	}
+	if err != nil {
+		return nil, pathError("stat", name, err)
+	}
+	resp.Body.Close()
+	if resp.ContentLength > h.maxBytes() {
+		return nil, pathError("stat", name, fmt.Errorf("%d bytes to download, more than the limit of %d", resp.ContentLength, h.maxBytes()))
+	}
+	return urlInfo(name, resp), nil
+}
+
+// ReadDir returns the entries of the directory name. A URL is not a
+// directory.
+func (h *HTTPFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if IsHTTPURL(name) {
+		return nil, pathError("readdir", name, errors.New("a URL is not a directory"))
+	}
+	return h.local().ReadDir(name)
+}
+
+// An httpFile is a URL's file of an HTTPFS open for reading.
+type httpFile struct {
+	info memInfo
+	io.Reader
+	body io.Closer
+}
+
+func (f *httpFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *httpFile) Close() error               { return f.body.Close() }
+
+// limitedReader reads from r, failing once more than n bytes are read.
+type limitedReader struct {
+	r     io.Reader
+	n     int64
+	limit int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.n < 0 {
+		return 0, fmt.Errorf("download is larger than the limit of %d bytes", l.limit)
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	if l.n < 0 {
+		return n, fmt.Errorf("download is larger than the limit of %d bytes", l.limit)
+	}
+	return n, err
+}
+
+// Open opens the file or directory name for reading. A URL's file is read
+// as it is downloaded, once its first bytes show that it is an image.
+func (h *HTTPFS) Open(name string) (fs.File, error) {
+	if !IsHTTPURL(name) {
+		return h.local().Open(name)
+	}
+	resp, err := h.do(http.MethodGet, name)
+	if err != nil {
+		return nil, pathError("open", name, err)
+	}
+	if resp.ContentLength > h.maxBytes() {
+		resp.Body.Close()
+		return nil, pathError("open", name, fmt.Errorf("%d bytes to download, more than the limit of %d", resp.ContentLength, h.maxBytes()))
+	}
+	body := &limitedReader{r: resp.Body, n: h.maxBytes(), limit: h.maxBytes()}
+
+	// Keep what the image's header is decoded from, to be read again
+	var head bytes.Buffer
+	_, _, err = image.DecodeConfig(io.TeeReader(io.LimitReader(body, httpPeekBytes), &head))
+	if err != nil && !IsHEIFData(head.Bytes()) {
+		resp.Body.Close()
+		if body.n < 0 {
+			return nil, pathError("open", name, fmt.Errorf("download is larger than the limit of %d bytes", body.limit))
+		}
+		return nil, pathError("open", name, fmt.Errorf("%w: the download is %s, not an image", ErrUnsupportedFormat, http.DetectContentType(head.Bytes())))
+	}
+	return &httpFile{info: urlInfo(name, resp), Reader: io.MultiReader(&head, body), body: resp.Body}, nil
+}
+
+// Create creates or truncates the file name, which cannot be a URL.
+func (h *HTTPFS) Create(name string) (io.WriteCloser, error) {
+	if IsHTTPURL(name) {
+		return nil, pathError("create", name, errReadOnlyURL)
+	}
+	return h.local().Create(name)
+}
+
+// MkdirAll creates the directory name and any parents it needs, which
+// cannot be a URL.
+func (h *HTTPFS) MkdirAll(name string, perm fs.FileMode) error {
+	if IsHTTPURL(name) {
+		return pathError("mkdir", name, errReadOnlyURL)
+	}
+	return h.local().MkdirAll(name, perm)
+}
+
+// Remove removes the file or empty directory name, which cannot be a URL.
+func (h *HTTPFS) Remove(name string) error {
+	if IsHTTPURL(name) {
+		return pathError("remove", name, errReadOnlyURL)
+	}
+	return h.local().Remove(name)
+}
+
+// Rename moves the file oldname to newname, neither of which can be a URL.
+func (h *HTTPFS) Rename(oldname, newname string) error {
+	if IsHTTPURL(oldname) || IsHTTPURL(newname) {
+		return pathError("rename", oldname, errReadOnlyURL)
+	}
+	return h.local().Rename(oldname, newname)
+}
@@ -0,0 +1,159 @@
+package pixellock
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/png"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// httpFixture serves a PNG at /photo.png and /download, which names it
+// holiday.png, a redirect to it at /redirect, and a 404, a text file, a
+// server failing twice before serving the PNG, and one taking no HEAD
+// requests. It returns the server, the PNG, and the User-Agents of the
+// requests, as they are made.
+func httpFixture(t *testing.T) (*httptest.Server, []byte, *[]string) {
+	t.Helper()
+	img := image.NewNRGBA(image.Rect(0, 0, 32, 32))
+	for i := range img.Pix {
+		img.Pix[i] = byte(i)
+	}
+	var buf bytes.Buffer
+	png.Encode(&buf, img)
+	data := buf.Bytes()
+	var mu sync.Mutex
+	var agents []string
+	failures := 2
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		agents = append(agents, r.UserAgent())
+		switch r.URL.Path {
+		case "/photo.png":
+			w.Write(data)
+		case "/download":
+			w.Header().Set("Content-Disposition", `attachment; filename="../holiday.png"`)
+			w.Write(data)
+		case "/redirect":
+			http.Redirect(w, r, "/photo.png", http.StatusFound)
+		case "/notes.png":
+			w.Header().Set("Content-Type", "text/plain")
+			io.WriteString(w, "not an image at all")
+		case "/flaky.png":
+			if failures > 0 {
+				failures--
+				http.Error(w, "try again", http.StatusServiceUnavailable)
+				return
+			}
+			w.Write(data)
+		case "/nohead.png":
+			if r.Method == http.MethodHead {
+				http.Error(w, "no", http.StatusMethodNotAllowed)
+				return
+			}
+			w.Write(data)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv, data, &agents
+}
+
+func TestHTTPFS(t *testing.T) {
+	srv, data, agents := httpFixture(t)
+	h := &HTTPFS{UserAgent: "intake/1", RetryDelay: time.Millisecond}
+	var status *HTTPError
+	if _, err := (&HTTPFS{Retries: -1}).Stat(srv.URL + "/flaky.png"); !errors.As(err, &status) || status.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Stat without retries = %v, want the 503", err)
+	}
+
+	for path, want := range map[string]string{
+		"/photo.png":  "photo.png",
+		"/download":   "holiday.png",
+		"/redirect":   "redirect",
+		"/nohead.png": "nohead.png",
+		"/flaky.png":  "flaky.png",
+	} {
+		info, err := h.Stat(srv.URL + path)
+		if err != nil || info.Name() != want || info.IsDir() {
+			t.Errorf("Stat(%s) = %v, %v; want a file named %s", path, info, err, want)
+		}
+	}
+	if got := urlFilename("https://example.com/?page=2", ""); got != "index.html" {
+		t.Errorf("a URL without a path is named %s", got)
+	}
+
+	for _, path := range []string{"/photo.png", "/redirect", "/download", "/nohead.png"} {
+		f, err := h.Open(srv.URL + path)
+		if err != nil {
+			t.Errorf("Open(%s) failed: %v", path, err)
+			continue
+		}
+		got, err := io.ReadAll(f)
+		f.Close()
+		if err != nil || !bytes.Equal(got, data) {
+			t.Errorf("%s read %d bytes, %v; want the %d of the PNG", path, len(got), err, len(data))
+		}
+	}
+	if got := (*agents)[len(*agents)-1]; got != "intake/1" {
+		t.Errorf("requests were made by %q", got)
+	}
+
+	if _, err := h.Open(srv.URL + "/missing.png"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Open of a 404 = %v, want fs.ErrNotExist", err)
+	}
+	if _, err := h.Open(srv.URL + "/notes.png"); !errors.Is(err, ErrUnsupportedFormat) || !strings.Contains(err.Error(), "text/plain") {
+		t.Errorf("Open of text = %v, want ErrUnsupportedFormat", err)
+	}
+	small := &HTTPFS{MaxBytes: int64(len(data) / 2)}
+	if _, err := small.Stat(srv.URL + "/photo.png"); err == nil {
+		t.Error("Stat of a download over the limit succeeded")
+	}
+	f, err := small.Open(srv.URL + "/nohead.png")
+	if err == nil {
+		_, err = io.ReadAll(f)
+		f.Close()
+	}
+	if err == nil {
+		t.Error("reading a download over the limit succeeded")
+	}
+	if _, err := h.Create(srv.URL + "/photo.png"); !errors.Is(err, fs.ErrPermission) {
+		t.Errorf("Create of a URL = %v, want fs.ErrPermission", err)
+	}
+}
+
+func TestEncryptURL(t *testing.T) {
+	srv, data, _ := httpFixture(t)
+	key, _ := GenerateRandomKey()
+	dir := t.TempDir()
+	encryptor, err := NewEncryptor(WithKey(key), WithFS(&HTTPFS{RetryDelay: time.Millisecond}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted := filepath.Join(dir, "photo.png.enc")
+	if err := encryptor.ProcessFile(t.Context(), srv.URL+"/redirect", encrypted); err != nil {
+		t.Fatalf("ProcessFile failed: %v", err)
+	}
+	decrypted := filepath.Join(dir, "photo.png")
+	if err := DecryptFile(t.Context(), encrypted, decrypted, key, false, SaveOptions{}); err != nil {
+		t.Fatalf("DecryptFile failed: %v", err)
+	}
+	want, _ := png.Decode(bytes.NewReader(data))
+	if got, _ := decodeFile(t, decrypted); !bytes.Equal(got.(*image.NRGBA).Pix, want.(*image.NRGBA).Pix) {
+		t.Error("the URL decrypted to another image")
+	}
+
+	if err := encryptor.ProcessFile(t.Context(), srv.URL+"/notes.png", filepath.Join(dir, "notes.enc")); ErrorCodeOf(err) != CodeNotImage {
+		t.Errorf("encrypting text = %v, want %s", err, CodeNotImage)
+	}
+}
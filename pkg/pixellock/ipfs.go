@@ -0,0 +1,199 @@
+package pixellock
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// IPFSManifestName is the name of the manifest the encrypt command writes
+// in its output directory when it publishes the files to IPFS.
+const IPFSManifestName = "ipfs-manifest.json"
+
+// An IPFSClient adds files to an IPFS node, pins them, and reads them
+// back, for PublishIPFS and FetchIPFS. An IPFSClient can be used by
+// several goroutines at once.
+type IPFSClient interface {
+	// Add adds the data read from r, of the file name, to the node,
+	// without pinning it, and returns its CID.
+	Add(ctx context.Context, name string, r io.Reader) (cid string, err error)
+
+	// Pin pins cid on the node, so that its garbage collection keeps it.
+	Pin(ctx context.Context, cid string) error
+
+	// Cat returns the data of cid for reading.
+	Cat(ctx context.Context, cid string) (io.ReadCloser, error)
+}
+
+// An IPFSFile is a file published to IPFS, as an IPFSManifest lists it.
+type IPFSFile struct {
+	Path   string `json:"path"` // Slash-separated, relative to the directory published
+	CID    string `json:"cid"`
+	Size   int64  `json:"size"`
+	Pinned bool   `json:"pinned,omitempty"`
+}
+
+// An IPFSManifest lists the encrypted files of a directory published to
+// IPFS, from which FetchIPFS assembles the directory again.
+type IPFSManifest struct {
+	Files []IPFSFile `json:"files"`
+}
+
+// ReadIPFSManifest reads the manifest in the file name. Its paths must
+// all be local, as filepath.IsLocal says, for it to be read.
+func ReadIPFSManifest(name string) (*IPFSManifest, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var m IPFSManifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("%s: bad manifest: %w", name, err)
+	}
+	for _, f := range m.Files {
+		if f.CID == "" || !filepath.IsLocal(filepath.FromSlash(f.Path)) {
+			return nil, fmt.Errorf("%s: bad manifest entry %q, %q", name, f.Path, f.CID)
+		}
+	}
+	return &m, nil
+}
+
+// WriteFile writes m to the file name, replacing it.
+func (m *IPFSManifest) WriteFile(name string) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(name, append(data, '\n'), 0o644)
+}
+
+// Set adds files to m, each replacing the file of its path already
+// listed, and keeps the list sorted by path.
+func (m *IPFSManifest) Set(files ...IPFSFile) {
+	for _, f := range files {
+		i, found := slices.BinarySearchFunc(m.Files, f.Path, func(f IPFSFile, path string) int {
+			return strings.Compare(f.Path, path)
+		})
+		if found {
+			m.Files[i] = f
+		} else {
+			m.Files = slices.Insert(m.Files, i, f)
+		}
+	}
+}
+
+// PublishIPFS adds the files outputs, in the directory root, to IPFS
+// through client, and pins them when pin is set. An output that is a
+// directory, as a tiled image is written to, has each file in it added.
+// It returns the files added, with their paths relative to root, and the
+// errors of those that were not, joined.
+func PublishIPFS(ctx context.Context, client IPFSClient, root string, outputs []string, pin bool) ([]IPFSFile, error) {
+	var files []string
+	var errs []error
+	for _, output := range outputs {
+		err := filepath.WalkDir(output, func(name string, d fs.DirEntry, err error) error {
+			if err == nil && d.Type().IsRegular() {
+				files = append(files, name)
+			}
+			return err
+		})
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	var published []IPFSFile
+	for _, name := range files {
+		if err := ctx.Err(); err != nil {
+			return published, err
+		}
+		f, err := publishIPFS(ctx, client, root, name, pin)
+		if err != nil {
+			errs = append(errs, pathError("publish", name, err))
+			continue
+		}
+		published = append(published, f)
+	}
+	return published, errors.Join(errs...)
+}
+
+// publishIPFS adds the file name, in the directory root, to IPFS.
+func publishIPFS(ctx context.Context, client IPFSClient, root, name string, pin bool) (IPFSFile, error) {
+	rel, err := filepath.Rel(root, name)
+	if err != nil || !filepath.IsLocal(rel) {
+		return IPFSFile{}, fmt.Errorf("not in the directory %s", root)
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return IPFSFile{}, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return IPFSFile{}, err
+	}
+	cid, err := client.Add(ctx, filepath.Base(name), f)
+	if err != nil {
+		return IPFSFile{}, err
+	}
+	if pin {
+		if err := client.Pin(ctx, cid); err != nil {
+			return IPFSFile{}, err
+		}
+	}
+	return IPFSFile{Path: filepath.ToSlash(rel), CID: cid, Size: info.Size(), Pinned: pin}, nil
+}
+
+// FetchIPFS downloads the files of m from IPFS through client, into a
+// temporary directory as m lays them out, and decrypts them with d to the
+// directory output, as d's ProcessDir does with recursion.
+func FetchIPFS(ctx context.Context, client IPFSClient, m *IPFSManifest, d *Decryptor, output string) error {
+	tmp, err := os.MkdirTemp("", "pixellock-ipfs-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	for _, f := range m.Files {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fetchIPFS(ctx, client, f, tmp); err != nil {
+			return pathError("fetch", f.Path, err)
+		}
+	}
+	return decryptDirectory(ctx, tmp, output, d.keys, true, d.encryptedExt, d.overwrite == OverwriteReplace, d.save)
+}
+
+// fetchIPFS downloads f to its path in the directory dir.
+func fetchIPFS(ctx context.Context, client IPFSClient, f IPFSFile, dir string) error {
+	if !filepath.IsLocal(filepath.FromSlash(f.Path)) {
+		return fmt.Errorf("path is not local")
+	}
+	name := filepath.Join(dir, filepath.FromSlash(f.Path))
+	if err := os.MkdirAll(filepath.Dir(name), 0o700); err != nil {
+		return err
+	}
+	r, err := client.Cat(ctx, f.CID)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	w, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(w, r)
+	if closeErr := w.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && n != f.Size {
+		err = fmt.Errorf("fetched %d bytes of %s, want %d", n, f.CID, f.Size)
+	}
+	return err
+}
@@ -0,0 +1,152 @@
+package pixellock
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+)
+
+// fakeIPFS is an IPFS node in memory, numbering the files added to it.
+type fakeIPFS struct {
+	mu     sync.Mutex
+	blocks map[string][]byte
+	pinned map[string]bool
+}
+
+func (n *fakeIPFS) Add(ctx context.Context, name string, r io.Reader) (string, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	cid := fmt.Sprintf("bafy%d", len(n.blocks))
+	n.blocks[cid] = data
+	return cid, nil
+}
+
+func (n *fakeIPFS) Pin(ctx context.Context, cid string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.pinned[cid] = true
+	return nil
+}
+
+func (n *fakeIPFS) Cat(ctx context.Context, cid string) (io.ReadCloser, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	data, ok := n.blocks[cid]
+	if !ok {
+		return nil, fmt.Errorf("no block %s", cid)
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func TestIPFS(t *testing.T) {
+	dir := t.TempDir()
+	for i, name := range []string{"photo.png", "trip/day1.png"} {
+		img := image.NewNRGBA(image.Rect(0, 0, 4, 4))
+		img.Pix[0], img.Pix[3] = byte(100+i), 255
+		var buf bytes.Buffer
+		png.Encode(&buf, img)
+		name = filepath.Join(dir, "in", filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(name), 0o755)
+		if err := os.WriteFile(name, buf.Bytes(), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	key, _ := GenerateRandomKey()
+	var outputs []string
+	encryptor, err := NewEncryptor(WithKey(key), WithRecursive(true), WithEncryptOptions(EncryptOptions{
+		Progress: func(e Event) {
+			if e.Phase == PhaseWrite {
+				outputs = append(outputs, e.Output)
+			}
+		},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted := filepath.Join(dir, "enc")
+	if err := encryptor.ProcessDir(t.Context(), filepath.Join(dir, "in"), encrypted); err != nil {
+		t.Fatalf("ProcessDir failed: %v", err)
+	}
+
+	node := &fakeIPFS{blocks: map[string][]byte{}, pinned: map[string]bool{}}
+	files, err := PublishIPFS(t.Context(), node, encrypted, outputs, true)
+	if err != nil {
+		t.Fatalf("PublishIPFS failed: %v", err)
+	}
+	var m IPFSManifest
+	m.Set(files...)
+	manifest := filepath.Join(encrypted, IPFSManifestName)
+	if err := m.WriteFile(manifest); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	read, err := ReadIPFSManifest(manifest)
+	if err != nil {
+		t.Fatalf("ReadIPFSManifest failed: %v", err)
+	}
+	var paths []string
+	for _, f := range read.Files {
+		paths = append(paths, f.Path)
+		data, _ := os.ReadFile(filepath.Join(encrypted, filepath.FromSlash(f.Path)))
+		if !bytes.Equal(node.blocks[f.CID], data) || f.Size != int64(len(data)) || !f.Pinned || !node.pinned[f.CID] {
+			t.Errorf("%s is listed as %+v, not the file added and pinned", f.Path, f)
+		}
+	}
+	if want := []string{"photo.png.enc", "trip/day1.png.enc"}; !slices.Equal(paths, want) {
+		t.Errorf("the manifest lists %v, want %v", paths, want)
+	}
+
+	// Publishing again replaces the entries of the same paths
+	m.Set(IPFSFile{Path: "photo.png.enc", CID: "bafynew"}, IPFSFile{Path: "a.png.enc", CID: "bafya"})
+	if len(m.Files) != 3 || m.Files[0].Path != "a.png.enc" || m.Files[1].CID != "bafynew" {
+		t.Errorf("Set gave %+v", m.Files)
+	}
+
+	decryptor, err := NewDecryptor(WithKey(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := filepath.Join(dir, "out")
+	if err := FetchIPFS(t.Context(), node, read, decryptor, out); err != nil {
+		t.Fatalf("FetchIPFS failed: %v", err)
+	}
+	for i, name := range []string{"photo.png", "trip/day1.png"} {
+		f, err := os.Open(filepath.Join(out, filepath.FromSlash(name)))
+		if err != nil {
+			t.Errorf("%s was not fetched: %v", name, err)
+			continue
+		}
+		img, _, err := image.Decode(f)
+		f.Close()
+		if err != nil {
+			t.Errorf("%s does not decode: %v", name, err)
+		} else if r, _, _, _ := img.At(0, 0).RGBA(); r>>8 != uint32(100+i) {
+			t.Errorf("%s decrypted to another image", name)
+		}
+	}
+
+	// A CID the node does not have
+	read.Files[0].CID = "bafymissing"
+	if err := FetchIPFS(t.Context(), node, read, decryptor, t.TempDir()); err == nil {
+		t.Error("FetchIPFS of a missing CID succeeded")
+	}
+}
+
+func TestReadIPFSManifestOutside(t *testing.T) {
+	name := filepath.Join(t.TempDir(), IPFSManifestName)
+	os.WriteFile(name, []byte(`{"files":[{"path":"../escape.png.enc","cid":"bafy0","size":1}]}`), 0o644)
+	if _, err := ReadIPFSManifest(name); err == nil {
+		t.Error("ReadIPFSManifest of a path outside the directory succeeded")
+	}
+}
@@ -0,0 +1,707 @@
+package pixellock
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"sort"
+)
+
+// This file implements just enough of baseline JPEG to read the quantized
+// DCT coefficients of an image and write them back out unchanged apart from
+// any edits, which the stdlib codec cannot do. Only sequential Huffman
+// coded 8-bit frames (SOF0/SOF1) are supported; progressive and arithmetic
+// coded files are rejected with ErrUnsupportedJPEG.
+
+// ErrUnsupportedJPEG is returned for JPEG files the coefficient codec cannot
+// handle, such as progressive or arithmetic coded images.
+var ErrUnsupportedJPEG = errors.New("unsupported JPEG: only baseline Huffman coded images are supported")
+
+// JPEG markers used by the coefficient codec.
+const (
+	jpegSOF0 = 0xc0
+	jpegSOF1 = 0xc1
+	jpegDHT  = 0xc4
+	jpegRST0 = 0xd0
+	jpegRST7 = 0xd7
+	jpegSOI  = 0xd8
+	jpegEOI  = 0xd9
+	jpegSOS  = 0xda
+	jpegDQT  = 0xdb
+	jpegDRI  = 0xdd
+)
+
+// jpegComponent holds the quantized coefficients of one color component.
+// Coefficients are stored per block in zigzag order.
+type jpegComponent struct {
+	id      byte
+	h, v    int // Sampling factors
+	blocksX int // Blocks per row, padded to whole MCUs
+	blocksY int // Block rows, padded to whole MCUs
+	codedX  int // Blocks per row present in a non-interleaved scan
+	codedY  int // Block rows present in a non-interleaved scan
+	coeffs  []int32
+}
+
+// block returns the 64 coefficients of block (bx, by).
+func (c *jpegComponent) block(bx, by int) []int32 {
+	i := (by*c.blocksX + bx) * 64
+	return c.coeffs[i : i+64]
+}
+
+// jpegCoefficients is a decoded baseline JPEG kept in the coefficient domain.
+type jpegCoefficients struct {
+	width, height int
+	hmax, vmax    int
+	mcusX, mcusY  int
+	comps         []*jpegComponent
+	// segments holds the marker segments (APPn, COM, DQT, SOF) to copy
+	// verbatim when the image is written back out.
+	segments [][]byte
+}
+
+// jpegHuffman is a Huffman table in the form used by the decoder.
+type jpegHuffman struct {
+	maxCode [17]int32
+	valPtr  [17]int32
+	minCode [17]int32
+	values  []byte
+}
+
+func newJPEGHuffman(counts [16]byte, values []byte) *jpegHuffman {
+	h := &jpegHuffman{values: values}
+	code, k := int32(0), int32(0)
+	for l := 1; l <= 16; l++ {
+		n := int32(counts[l-1])
+		h.valPtr[l] = k
+		h.minCode[l] = code
+		code += n
+		k += n
+		if n == 0 {
+			h.maxCode[l] = -1
+		} else {
+			h.maxCode[l] = code - 1
+		}
+		code <<= 1
+	}
+	return h
+}
+
+// jpegBitReader reads entropy coded data, removing byte stuffing.
+type jpegBitReader struct {
+	data   []byte
+	pos    int
+	acc    uint32
+	bits   int
+	marker bool // A marker was reached; further reads return zero bits
+}
+
+func (r *jpegBitReader) fill() {
+	for r.bits <= 24 {
+		var b byte
+		if !r.marker && r.pos < len(r.data) {
+			b = r.data[r.pos]
+			if b == 0xff {
+				if r.pos+1 < len(r.data) && r.data[r.pos+1] == 0x00 {
+					r.pos += 2
+				} else {
+					r.marker = true
+					b = 0
+				}
+			} else {
+				r.pos++
+			}
+		}
+		r.acc |= uint32(b) << (24 - r.bits)
+		r.bits += 8
+	}
+}
+
+func (r *jpegBitReader) readBits(n int) int32 {
+	if n == 0 {
+		return 0
+	}
+	r.fill()
+	v := int32(r.acc >> (32 - n))
+	r.acc <<= n
+	r.bits -= n
+	return v
+}
+
+func (r *jpegBitReader) decode(h *jpegHuffman) (byte, error) {
+	code := int32(0)
+	for l := 1; l <= 16; l++ {
+		code = code<<1 | r.readBits(1)
+		if code <= h.maxCode[l] {
+			i := h.valPtr[l] + code - h.minCode[l]
+			if int(i) >= len(h.values) {
+				break
+			}
+			return h.values[i], nil
+		}
+	}
+	return 0, fmt.Errorf("invalid Huffman code in JPEG scan")
+}
+
+// restart discards buffered bits and skips the RSTn marker that must follow.
+func (r *jpegBitReader) restart() error {
+	r.acc, r.bits, r.marker = 0, 0, false
+	if r.pos+1 >= len(r.data) || r.data[r.pos] != 0xff || r.data[r.pos+1] < jpegRST0 || r.data[r.pos+1] > jpegRST7 {
+		return fmt.Errorf("missing JPEG restart marker")
+	}
+	r.pos += 2
+	return nil
+}
+
+// extend converts an n-bit magnitude into a signed coefficient value.
+func extend(v int32, n int) int32 {
+	if n == 0 {
+		return 0
+	}
+	if v < 1<<(n-1) {
+		return v - (1 << n) + 1
+	}
+	return v
+}
+
+// readJPEGCoefficients parses a baseline JPEG into its coefficients.
+func readJPEGCoefficients(data []byte) (*jpegCoefficients, error) {
+	if len(data) < 2 || data[0] != 0xff || data[1] != jpegSOI {
+		return nil, fmt.Errorf("not a JPEG file")
+	}
+
+	jc := &jpegCoefficients{}
+	var dc, ac [4]*jpegHuffman
+	restartInterval := 0
+	pos := 2
+	for {
+		for pos < len(data) && data[pos] != 0xff {
+			pos++ // Skip stray bytes between segments
+		}
+		for pos < len(data) && data[pos] == 0xff {
+			pos++ // Skip fill bytes
+		}
+		if pos >= len(data) {
+			return nil, fmt.Errorf("JPEG ended before EOI")
+		}
+		marker := data[pos]
+		pos++
+		if marker == jpegEOI {
+			break
+		}
+		if marker >= jpegRST0 && marker <= jpegRST7 {
+			continue
+		}
+		if pos+2 > len(data) {
+			return nil, fmt.Errorf("JPEG segment truncated")
+		}
+		length := int(binary.BigEndian.Uint16(data[pos:]))
+		if length < 2 || pos+length > len(data) {
+			return nil, fmt.Errorf("JPEG segment truncated")
+		}
+		seg := data[pos+2 : pos+length]
+		raw := data[pos-2 : pos+length]
+		pos += length
+
+		switch {
+		case marker == jpegSOF0 || marker == jpegSOF1:
+			if jc.comps != nil {
+				return nil, fmt.Errorf("JPEG has two frame headers")
+			}
+			if err := jc.parseFrame(seg, 4*len(data)); err != nil {
+				return nil, err
+			}
+			jc.segments = append(jc.segments, raw)
+		case marker >= 0xc2 && marker <= 0xcf && marker != jpegDHT && marker != 0xc8 && marker != 0xcc:
+			return nil, ErrUnsupportedJPEG
+		case marker == jpegDHT:
+			for len(seg) > 0 {
+				if len(seg) < 17 {
+					return nil, fmt.Errorf("JPEG DHT segment truncated")
+				}
+				class, id := seg[0]>>4, seg[0]&0x0f
+				var counts [16]byte
+				copy(counts[:], seg[1:17])
+				total := 0
+				for _, n := range counts {
+					total += int(n)
+				}
+				if id > 3 || class > 1 || len(seg) < 17+total {
+					return nil, fmt.Errorf("invalid JPEG DHT segment")
+				}
+				h := newJPEGHuffman(counts, append([]byte(nil), seg[17:17+total]...))
+				if class == 0 {
+					dc[id] = h
+				} else {
+					ac[id] = h
+				}
+				seg = seg[17+total:]
+			}
+		case marker == jpegDRI:
+			if len(seg) < 2 {
+				return nil, fmt.Errorf("JPEG DRI segment truncated")
+			}
+			restartInterval = int(binary.BigEndian.Uint16(seg))
+		case marker == jpegSOS:
+			if jc.comps == nil {
+				return nil, fmt.Errorf("JPEG scan before frame header")
+			}
+			n, err := jc.decodeScan(seg, data[pos:], dc, ac, restartInterval)
+			if err != nil {
+				return nil, err
+			}
+			pos += n
+		case marker == jpegDQT || (marker >= 0xe0 && marker <= 0xef) || marker == 0xfe:
+			jc.segments = append(jc.segments, raw)
+		}
+	}
+
+	if jc.comps == nil {
+		return nil, fmt.Errorf("JPEG has no frame header")
+	}
+	return jc, nil
+}
+
+// parseFrame reads the frame header seg, allocating the coefficients of at
+// most maxBlocks blocks: a baseline scan codes each block in two bits at
+// least, a DC difference and an end of block, so a JPEG of n bytes holds
+// no more than 4n.
+func (jc *jpegCoefficients) parseFrame(seg []byte, maxBlocks int) error {
+	if len(seg) < 6 || seg[0] != 8 {
+		return ErrUnsupportedJPEG
+	}
+	jc.height = int(binary.BigEndian.Uint16(seg[1:]))
+	jc.width = int(binary.BigEndian.Uint16(seg[3:]))
+	n := int(seg[5])
+	if jc.width == 0 || jc.height == 0 || n == 0 || n > 4 || len(seg) < 6+3*n {
+		return fmt.Errorf("invalid JPEG frame header")
+	}
+
+	jc.hmax, jc.vmax = 1, 1
+	for i := 0; i < n; i++ {
+		c := seg[6+3*i:]
+		comp := &jpegComponent{id: c[0], h: int(c[1] >> 4), v: int(c[1] & 0x0f)}
+		if comp.h < 1 || comp.h > 4 || comp.v < 1 || comp.v > 4 {
+			return fmt.Errorf("invalid JPEG sampling factors")
+		}
+		jc.hmax = max(jc.hmax, comp.h)
+		jc.vmax = max(jc.vmax, comp.v)
+		jc.comps = append(jc.comps, comp)
+	}
+
+	jc.mcusX = (jc.width + 8*jc.hmax - 1) / (8 * jc.hmax)
+	jc.mcusY = (jc.height + 8*jc.vmax - 1) / (8 * jc.vmax)
+	if err := checkPixels(jc.width, jc.height, 0); err != nil {
+		return err
+	}
+	blocks := 0
+	for _, comp := range jc.comps {
+		blocks += jc.mcusX * comp.h * jc.mcusY * comp.v
+	}
+	if blocks > maxBlocks {
+		return fmt.Errorf("invalid JPEG frame header: %dx%d pixels in %d bytes", jc.width, jc.height, maxBlocks/4)
+	}
+	for _, comp := range jc.comps {
+		comp.blocksX = jc.mcusX * comp.h
+		comp.blocksY = jc.mcusY * comp.v
+		compW := (jc.width*comp.h + jc.hmax - 1) / jc.hmax
+		compH := (jc.height*comp.v + jc.vmax - 1) / jc.vmax
+		comp.codedX = (compW + 7) / 8
+		comp.codedY = (compH + 7) / 8
+		comp.coeffs = make([]int32, comp.blocksX*comp.blocksY*64)
+	}
+	return nil
+}
+
+// scanBlocks calls fn for every block of a scan over comps, in the order the
+// blocks are coded. A single-component scan is non-interleaved and covers
+// only the component's coded blocks; otherwise blocks are visited MCU by
+// MCU.
+func (jc *jpegCoefficients) scanBlocks(comps []*jpegComponent, fn func(ci int, block []int32, mcu int) error) error {
+	if len(comps) == 1 {
+		c := comps[0]
+		for by := 0; by < c.codedY; by++ {
+			for bx := 0; bx < c.codedX; bx++ {
+				if err := fn(0, c.block(bx, by), by*c.codedX+bx); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+
+	for my := 0; my < jc.mcusY; my++ {
+		for mx := 0; mx < jc.mcusX; mx++ {
+			for ci, c := range comps {
+				for v := 0; v < c.v; v++ {
+					for h := 0; h < c.h; h++ {
+						if err := fn(ci, c.block(mx*c.h+h, my*c.v+v), my*jc.mcusX+mx); err != nil {
+							return err
+						}
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// decodeScan decodes one scan whose header is seg and whose entropy coded
+// data starts at data. It returns the number of bytes consumed.
+func (jc *jpegCoefficients) decodeScan(seg, data []byte, dc, ac [4]*jpegHuffman, restartInterval int) (int, error) {
+	if len(seg) < 1 || len(seg) < 1+2*int(seg[0])+3 {
+		return 0, fmt.Errorf("JPEG scan header truncated")
+	}
+	n := int(seg[0])
+	comps := make([]*jpegComponent, n)
+	dcTables := make([]*jpegHuffman, n)
+	acTables := make([]*jpegHuffman, n)
+	for i := 0; i < n; i++ {
+		id, sel := seg[1+2*i], seg[2+2*i]
+		for _, c := range jc.comps {
+			if c.id == id {
+				comps[i] = c
+			}
+		}
+		if comps[i] == nil || dc[sel>>4&3] == nil || ac[sel&3] == nil {
+			return 0, fmt.Errorf("JPEG scan references unknown component or table")
+		}
+		dcTables[i], acTables[i] = dc[sel>>4&3], ac[sel&3]
+	}
+
+	r := &jpegBitReader{data: data}
+	preds := make([]int32, n)
+	lastMCU := 0
+	err := jc.scanBlocks(comps, func(ci int, block []int32, mcu int) error {
+		if restartInterval > 0 && mcu != lastMCU && mcu%restartInterval == 0 {
+			if err := r.restart(); err != nil {
+				return err
+			}
+			clear(preds)
+		}
+		lastMCU = mcu
+
+		t, err := r.decode(dcTables[ci])
+		if err != nil {
+			return err
+		}
+		if t > 11 {
+			return fmt.Errorf("invalid JPEG DC coefficient size")
+		}
+		preds[ci] += extend(r.readBits(int(t)), int(t))
+		block[0] = preds[ci]
+
+		for k := 1; k < 64; k++ {
+			rs, err := r.decode(acTables[ci])
+			if err != nil {
+				return err
+			}
+			run, size := int(rs>>4), int(rs&0x0f)
+			if size == 0 {
+				if run != 15 {
+					break
+				}
+				k += 15
+				continue
+			}
+			k += run
+			if k > 63 {
+				return fmt.Errorf("invalid JPEG AC run length")
+			}
+			block[k] = extend(r.readBits(size), size)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	// Leave the reader at the marker that ends the scan.
+	pos := r.pos
+	for pos+1 < len(data) && !(data[pos] == 0xff && data[pos+1] != 0x00 && (data[pos+1] < jpegRST0 || data[pos+1] > jpegRST7)) {
+		pos++
+	}
+	return pos, nil
+}
+
+// jpegBitWriter writes entropy coded data with byte stuffing.
+type jpegBitWriter struct {
+	buf  bytes.Buffer
+	acc  uint32
+	bits int
+}
+
+func (w *jpegBitWriter) writeBits(v uint32, n int) {
+	for n > 0 {
+		take := min(n, 8)
+		n -= take
+		w.acc = w.acc<<take | (v>>n)&(1<<take-1)
+		w.bits += take
+		for w.bits >= 8 {
+			b := byte(w.acc >> (w.bits - 8))
+			w.buf.WriteByte(b)
+			if b == 0xff {
+				w.buf.WriteByte(0x00)
+			}
+			w.bits -= 8
+		}
+	}
+}
+
+func (w *jpegBitWriter) flush() {
+	if w.bits > 0 {
+		w.writeBits(1<<(8-w.bits)-1, 8-w.bits)
+	}
+}
+
+// jpegEncoderTable maps symbols to Huffman codes.
+type jpegEncoderTable struct {
+	counts [16]byte
+	values []byte
+	code   [256]uint32
+	size   [256]int
+}
+
+// buildJPEGHuffman derives a length-limited Huffman table from symbol
+// frequencies, following JPEG Annex K.2.
+func buildJPEGHuffman(freq [256]int) *jpegEncoderTable {
+	var f [257]int
+	copy(f[:], freq[:])
+	f[256] = 1 // Reserve a code so no real code is all ones
+	var codesize [257]int
+	var others [257]int
+	for i := range others {
+		others[i] = -1
+	}
+
+	for {
+		c1, c2 := -1, -1
+		for i := 0; i < 257; i++ {
+			if f[i] == 0 {
+				continue
+			}
+			if c1 < 0 || f[i] <= f[c1] {
+				c2, c1 = c1, i
+			} else if c2 < 0 || f[i] <= f[c2] {
+				c2 = i
+			}
+		}
+		if c2 < 0 {
+			break
+		}
+		f[c1] += f[c2]
+		f[c2] = 0
+		codesize[c1]++
+		for others[c1] >= 0 {
+			c1 = others[c1]
+			codesize[c1]++
+		}
+		others[c1] = c2
+		codesize[c2]++
+		for others[c2] >= 0 {
+			c2 = others[c2]
+			codesize[c2]++
+		}
+	}
+
+	var bits [33]int
+	for i := 0; i < 257; i++ {
+		if codesize[i] > 0 {
+			bits[codesize[i]]++
+		}
+	}
+	for i := 32; i > 16; i-- {
+		for bits[i] > 0 {
+			j := i - 2
+			for bits[j] == 0 {
+				j--
+			}
+			bits[i] -= 2
+			bits[i-1]++
+			bits[j+1] += 2
+			bits[j]--
+		}
+	}
+	for i := 16; i > 0; i-- {
+		if bits[i] > 0 {
+			bits[i]-- // Drop the reserved code
+			break
+		}
+	}
+
+	t := &jpegEncoderTable{}
+	syms := make([]int, 0, 256)
+	for i := 0; i < 256; i++ {
+		if codesize[i] > 0 {
+			syms = append(syms, i)
+		}
+	}
+	sort.SliceStable(syms, func(a, b int) bool { return codesize[syms[a]] < codesize[syms[b]] })
+	for _, s := range syms {
+		t.values = append(t.values, byte(s))
+	}
+
+	code, k := uint32(0), 0
+	for l := 1; l <= 16; l++ {
+		t.counts[l-1] = byte(bits[l])
+		for i := 0; i < bits[l]; i++ {
+			t.code[t.values[k]] = code
+			t.size[t.values[k]] = l
+			code++
+			k++
+		}
+		code <<= 1
+	}
+	return t
+}
+
+// bitLength returns the JPEG magnitude category of v.
+func bitLength(v int32) int {
+	if v < 0 {
+		v = -v
+	}
+	n := 0
+	for v > 0 {
+		n++
+		v >>= 1
+	}
+	return n
+}
+
+// encodeScan entropy codes every component in a single scan. When tables is
+// nil it only counts symbol frequencies into stats.
+func (jc *jpegCoefficients) encodeScan(w *jpegBitWriter, tables [4]*jpegEncoderTable, stats *[4][256]int) error {
+	preds := make([]int32, len(jc.comps))
+	emit := func(class int, sym byte) {
+		if tables[class] == nil {
+			stats[class][sym]++
+			return
+		}
+		w.writeBits(tables[class].code[sym], tables[class].size[sym])
+	}
+	extra := func(v int32, n int) {
+		if tables[0] == nil || n == 0 {
+			return
+		}
+		if v < 0 {
+			v--
+		}
+		w.writeBits(uint32(v)&(1<<n-1), n)
+	}
+
+	return jc.scanBlocks(jc.comps, func(ci int, block []int32, _ int) error {
+		// Luma uses tables 0 (DC) and 1 (AC); chroma uses 2 and 3.
+		dcClass, acClass := 0, 1
+		if ci > 0 {
+			dcClass, acClass = 2, 3
+		}
+
+		diff := block[0] - preds[ci]
+		preds[ci] = block[0]
+		n := bitLength(diff)
+		if n > 11 {
+			return fmt.Errorf("JPEG DC coefficient out of range")
+		}
+		emit(dcClass, byte(n))
+		extra(diff, n)
+
+		run := 0
+		for k := 1; k < 64; k++ {
+			if block[k] == 0 {
+				run++
+				continue
+			}
+			for run > 15 {
+				emit(acClass, 0xf0)
+				run -= 16
+			}
+			n := bitLength(block[k])
+			if n > 10 {
+				return fmt.Errorf("JPEG AC coefficient out of range")
+			}
+			emit(acClass, byte(run<<4|n))
+			extra(block[k], n)
+			run = 0
+		}
+		if run > 0 {
+			emit(acClass, 0x00)
+		}
+		return nil
+	})
+}
+
+// writeJPEGCoefficients encodes jc as a baseline JPEG with optimized Huffman
+// tables in a single interleaved scan.
+func writeJPEGCoefficients(jc *jpegCoefficients) ([]byte, error) {
+	var stats [4][256]int
+	if err := jc.encodeScan(nil, [4]*jpegEncoderTable{}, &stats); err != nil {
+		return nil, err
+	}
+	var tables [4]*jpegEncoderTable
+	for i := range tables {
+		if i >= 2 && len(jc.comps) == 1 {
+			break
+		}
+		tables[i] = buildJPEGHuffman(stats[i])
+	}
+
+	var out bytes.Buffer
+	out.Write([]byte{0xff, jpegSOI})
+	for _, seg := range jc.segments {
+		out.Write(seg)
+	}
+
+	var dht bytes.Buffer
+	for i, t := range tables {
+		if t == nil {
+			continue
+		}
+		class, id := byte(i%2), byte(i/2)
+		dht.WriteByte(class<<4 | id)
+		dht.Write(t.counts[:])
+		dht.Write(t.values)
+	}
+	writeJPEGSegment(&out, jpegDHT, dht.Bytes())
+
+	sos := []byte{byte(len(jc.comps))}
+	for i, c := range jc.comps {
+		sel := byte(0x00)
+		if i > 0 {
+			sel = 0x11
+		}
+		sos = append(sos, c.id, sel)
+	}
+	sos = append(sos, 0, 63, 0)
+	writeJPEGSegment(&out, jpegSOS, sos)
+
+	if tables[2] == nil {
+		tables[2], tables[3] = tables[0], tables[1]
+	}
+	w := &jpegBitWriter{}
+	if err := jc.encodeScan(w, tables, nil); err != nil {
+		return nil, err
+	}
+	w.flush()
+	out.Write(w.buf.Bytes())
+	out.Write([]byte{0xff, jpegEOI})
+	return out.Bytes(), nil
+}
+
+func writeJPEGSegment(out *bytes.Buffer, marker byte, payload []byte) {
+	out.Write([]byte{0xff, marker})
+	binary.Write(out, binary.BigEndian, uint16(len(payload)+2))
+	out.Write(payload)
+}
+
+// jpegCoefficientsFromImage encodes img as a baseline JPEG at the given
+// quality and returns its coefficients.
+func jpegCoefficientsFromImage(img image.Image, quality int) (*jpegCoefficients, error) {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality}); err != nil {
+		return nil, fmt.Errorf("failed to encode image to JPEG: %w", err)
+	}
+	return readJPEGCoefficients(buf.Bytes())
+}
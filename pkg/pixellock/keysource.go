@@ -0,0 +1,96 @@
+package pixellock
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// KeyringEnv is the environment variable naming the keyring directory in
+// place of the default, pixellock/keyring in the user's configuration
+// directory.
+const KeyringEnv = "PIXELLOCK_KEYRING"
+
+// KeyringDir returns the directory of the keyring, which holds a key file
+// for each key named in it, as keygen --keyring writes them.
+func KeyringDir() (string, error) {
+	if dir := os.Getenv(KeyringEnv); dir != "" {
+		return dir, nil
+	}
+	config, err := os.UserConfigDir()
+	if err != nil {
+		return "", fmt.Errorf("no keyring directory: %w; set %s", err, KeyringEnv)
+	}
+	return filepath.Join(config, "pixellock", "keyring"), nil
+}
+
+// KeyringPath returns the key file of the key name in the keyring.
+func KeyringPath(name string) (string, error) {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return "", fmt.Errorf("invalid keyring key name %q", name)
+	}
+	dir, err := KeyringDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, name+".key"), nil
+}
+
+// WriteKeyring saves key in the keyring under name, creating the keyring
+// directory readable by its owner alone. A key already saved under name is
+// left alone, and an error returned.
+func WriteKeyring(name string, key []byte) (string, error) {
+	path, err := KeyringPath(name)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return "", fmt.Errorf("failed to create keyring: %w", err)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", fmt.Errorf("failed to save key to keyring: %w", err)
+	}
+	_, err = f.Write([]byte(base64.StdEncoding.EncodeToString(key)))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to save key to keyring: %w", err)
+	}
+	return path, nil
+}
+
+// ReadKeySource reads the key named by source, one of:
+//
+//	env:NAME      the base64 encoded key in the environment variable NAME
+//	file:PATH     the key file at PATH, as ReadKeyfile reads it
+//	keyring:NAME  the key saved in the keyring under NAME
+func ReadKeySource(source string) ([]byte, error) {
+	kind, name, ok := strings.Cut(source, ":")
+	if !ok || name == "" {
+		return nil, fmt.Errorf("invalid key source %q: want env:NAME, file:PATH or keyring:NAME", source)
+	}
+	switch kind {
+	case "env":
+		value := os.Getenv(name)
+		if value == "" {
+			return nil, fmt.Errorf("environment variable %s holds no key", name)
+		}
+		return DecodeKey(strings.TrimSpace(value))
+	case "file":
+		return ReadKeyfile(name)
+	case "keyring":
+		path, err := KeyringPath(name)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := os.Stat(path); err != nil {
+			return nil, fmt.Errorf("no key %q in the keyring: %w", name, err)
+		}
+		return ReadKeyfile(path)
+	}
+	return nil, fmt.Errorf("invalid key source %q: want env:NAME, file:PATH or keyring:NAME", source)
+}
@@ -0,0 +1,42 @@
+package pixellock
+
+import (
+	"bytes"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadKeySource(t *testing.T) {
+	t.Setenv(KeyringEnv, filepath.Join(t.TempDir(), "keyring"))
+	key, _ := GenerateRandomKey()
+	encoded := base64.StdEncoding.EncodeToString(key)
+
+	t.Setenv("PIXELLOCK_TEST_KEY", encoded+"\n")
+	keyFile := filepath.Join(t.TempDir(), "test.key")
+	if err := os.WriteFile(keyFile, []byte(encoded), 0600); err != nil {
+		t.Fatal(err)
+	}
+	path, err := WriteKeyring("web", key)
+	if err != nil {
+		t.Fatalf("WriteKeyring failed: %v", err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("keyring key file %s: %v, %v", path, info.Mode(), err)
+	}
+	if _, err := WriteKeyring("web", key); err == nil {
+		t.Error("WriteKeyring replaced a key")
+	}
+
+	for _, source := range []string{"env:PIXELLOCK_TEST_KEY", "file:" + keyFile, "keyring:web"} {
+		if got, err := ReadKeySource(source); err != nil || !bytes.Equal(got, key) {
+			t.Errorf("ReadKeySource(%q) = %v, %v", source, got, err)
+		}
+	}
+	for _, source := range []string{"", "web", "env:", "env:PIXELLOCK_NO_SUCH_KEY", "file:/no/such/file", "keyring:missing", "keyring:../web", "vault:web"} {
+		if _, err := ReadKeySource(source); err == nil {
+			t.Errorf("ReadKeySource(%q) succeeded", source)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package pixellock
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"io"
+)
+
+// DefaultMaxPixels is the most pixels, width by height, an image may claim
+// to be decoded, unless the MaxPixels of the options say otherwise: 268
+// megapixels, or 1 GiB decoded at 8 bits per channel. An image whose
+// header claims more fails with ErrImageTooLarge rather than being
+// allocated for, so that a small file claiming huge dimensions cannot
+// exhaust memory.
+const DefaultMaxPixels = 1 << 28
+
+// readExactlyChunk is the most readExactly allocates before data arrives.
+const readExactlyChunk = 64 << 10
+
+// pixelLimit returns the limit a MaxPixels option of maxPixels sets:
+// DefaultMaxPixels for 0, and none, as 0, when negative.
+func pixelLimit(maxPixels int64) int64 {
+	switch {
+	case maxPixels == 0:
+		return DefaultMaxPixels
+	case maxPixels < 0:
+		return 0
+	}
+	return maxPixels
+}
+
+// checkPixels returns ErrImageTooLarge for an image of width by height
+// pixels over the limit of maxPixels, as pixelLimit gives it.
+func checkPixels(width, height int, maxPixels int64) error {
+	limit := pixelLimit(maxPixels)
+	if width < 0 || height < 0 || limit > 0 && int64(width)*int64(height) > limit {
+		return fmt.Errorf("%w: %dx%d pixels, over the limit of %d", ErrImageTooLarge, width, height, limit)
+	}
+	return nil
+}
+
+// checkImageHeader returns ErrImageTooLarge when the header of the image
+// read from r claims more pixels than maxPixels allows. Data that is not an
+// image is left for decoding to report.
+func checkImageHeader(r io.Reader, maxPixels int64) error {
+	config, _, err := image.DecodeConfig(r)
+	if err != nil {
+		return nil
+	}
+	return checkPixels(config.Width, config.Height, maxPixels)
+}
+
+// decodeImage decodes the image read from r, as image.Decode does, once its
+// header has passed checkImageHeader. The header is read once, and kept to
+// decode from.
+func decodeImage(r io.Reader, maxPixels int64) (image.Image, string, error) {
+	var head bytes.Buffer
+	if err := checkImageHeader(io.TeeReader(r, &head), maxPixels); err != nil {
+		return nil, "", err
+	}
+	return image.Decode(io.MultiReader(&head, r))
+}
+
+// readExactly reads n bytes from r, growing its buffer as they arrive
+// rather than allocating n up front, so that a length field claiming more
+// than r holds costs no more memory than r does. It returns
+// io.ErrUnexpectedEOF when r ends first.
+func readExactly(r io.Reader, n int64) ([]byte, error) {
+	if n < 0 {
+		return nil, fmt.Errorf("negative length %d", n)
+	}
+	var buf bytes.Buffer
+	buf.Grow(int(min(n, readExactlyChunk)))
+	if _, err := io.CopyN(&buf, r, n); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,294 @@
+package pixellock
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// hugePNG returns a small PNG whose header claims it is width by height.
+func hugePNG(t *testing.T, width, height uint32) []byte {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, 4, 4))); err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+	data := buf.Bytes()
+	ihdr := data[len(pngSignature)+4:] // Type, then width and height
+	binary.BigEndian.PutUint32(ihdr[4:], width)
+	binary.BigEndian.PutUint32(ihdr[8:], height)
+	binary.BigEndian.PutUint32(ihdr[17:], crc32.ChecksumIEEE(ihdr[:17]))
+	return data
+}
+
+func TestImageTooLarge(t *testing.T) {
+	data := hugePNG(t, 100000, 100000)
+	if _, err := BytesToImage(data); !errors.Is(err, ErrImageTooLarge) {
+		t.Errorf("BytesToImage = %v, want ErrImageTooLarge", err)
+	}
+	scrambled, err := addPNGText(data, scrambleKeyword, scrambleVersion)
+	if err != nil {
+		t.Fatalf("addPNGText failed: %v", err)
+	}
+	if _, err := Unscramble(fuzzKey, scrambled); !errors.Is(err, ErrImageTooLarge) {
+		t.Errorf("Unscramble = %v, want ErrImageTooLarge", err)
+	}
+
+	filename := filepath.Join(t.TempDir(), "huge.png")
+	if err := os.WriteFile(filename, data, 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	_, err = RevealPayload(filename, DefaultStegoOptions)
+	if !errors.Is(err, ErrImageTooLarge) {
+		t.Errorf("RevealPayload = %v, want ErrImageTooLarge", err)
+	}
+	checkPathError(t, err, "decode", filename)
+	_, err = RevealSplit([]string{filename}, DefaultStegoOptions)
+	if !errors.Is(err, ErrImageTooLarge) {
+		t.Errorf("RevealSplit = %v, want ErrImageTooLarge", err)
+	}
+
+	// At the limit is not too large
+	if err := checkPixels(1<<14, 1<<14, 0); err != nil {
+		t.Errorf("checkPixels(16384, 16384) = %v", err)
+	}
+	if err := checkPixels(1<<14, 1<<14+1, 0); !errors.Is(err, ErrImageTooLarge) {
+		t.Errorf("checkPixels(16384, 16385) = %v, want ErrImageTooLarge", err)
+	}
+	if _, err := BytesToImage(hugePNG(t, 4, 4)); err != nil {
+		t.Errorf("BytesToImage of a small PNG failed: %v", err)
+	}
+}
+
+func TestReadExactly(t *testing.T) {
+	got, err := readExactly(strings.NewReader("0123456789"), 4)
+	if err != nil || string(got) != "0123" {
+		t.Errorf("readExactly = %q, %v; want \"0123\"", got, err)
+	}
+	if _, err := readExactly(strings.NewReader("0123"), 5); err != io.ErrUnexpectedEOF {
+		t.Errorf("readExactly past the end = %v, want io.ErrUnexpectedEOF", err)
+	}
+	if _, err := readExactly(strings.NewReader(""), -1); err == nil {
+		t.Error("readExactly of a negative length succeeded")
+	}
+
+	// A length claiming a terabyte costs no more than the data there is
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	if _, err := readExactly(strings.NewReader("0123"), 1<<40); err != io.ErrUnexpectedEOF {
+		t.Errorf("readExactly of 1 TiB = %v, want io.ErrUnexpectedEOF", err)
+	}
+	runtime.ReadMemStats(&after)
+	if n := after.TotalAlloc - before.TotalAlloc; n > 1<<20 {
+		t.Errorf("readExactly of 1 TiB allocated %d bytes", n)
+	}
+}
+
+func TestPNMLimits(t *testing.T) {
+	for _, data := range []string{
+		"P5 30000 30000 255\n0123",
+		"P5 30000 30000 65535\n0123",
+		"P2 30000 30000 255\n1 2 3",
+		"P6 100000 100000 255\n0123",
+	} {
+		if _, err := decodePNM(strings.NewReader(data)); err == nil {
+			t.Errorf("decodePNM(%q) succeeded", data)
+		}
+	}
+}
+
+func TestTiledLimits(t *testing.T) {
+	dir := t.TempDir()
+	original := filepath.Join(dir, "image.png")
+	if err := SaveImage(original, largeTestImage(100, 70), SaveOptions{Format: "png"}); err != nil {
+		t.Fatalf("SaveImage failed: %v", err)
+	}
+	encrypted := filepath.Join(dir, "image.png"+EncryptedExtension)
+	if err := EncryptFile(t.Context(), original, encrypted, fuzzKey, true, EncryptOptions{Tile: MinTileSize}); err != nil {
+		t.Fatalf("EncryptFile failed: %v", err)
+	}
+	data, err := os.ReadFile(encrypted)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+
+	// The index of 12 bytes a tile follows the fixed header and the two
+	// blobs
+	blobs := len(tiledMagic) + 12
+	index := blobs
+	for range 2 {
+		index += 4 + int(binary.BigEndian.Uint32(data[index:]))
+	}
+	cols, rows := tiledHeader{Width: 100, Height: 70, TileSize: MinTileSize}.grid()
+	indexEnd := index + 12*cols*rows
+
+	for _, test := range []struct {
+		name   string
+		modify func([]byte) []byte
+		want   string
+	}{
+		{"huge blob", func(d []byte) []byte {
+			binary.BigEndian.PutUint32(d[blobs:], 0xffffffff)
+			return d
+		}, "header field"},
+		{"cut blob", func(d []byte) []byte { return d[:blobs+10] }, "header is cut short"},
+		{"short file", func(d []byte) []byte { return d[:index+5] }, "an index of"},
+		{"cut index", func(d []byte) []byte { return d[:indexEnd-5] }, "index is cut short"},
+		{"tile offset", func(d []byte) []byte {
+			binary.BigEndian.PutUint64(d[index:], 1<<62)
+			return d
+		}, "past the end"},
+		{"tile length", func(d []byte) []byte {
+			binary.BigEndian.PutUint32(d[index+8:], 0xffffffff)
+			return d
+		}, "past the end"},
+		{"tile grid", func(d []byte) []byte {
+			binary.BigEndian.PutUint32(d[len(tiledMagic):], 0xffffffff)
+			return d
+		}, "corrupt tiled file"},
+	} {
+		corrupt := filepath.Join(dir, "corrupt"+EncryptedExtension)
+		if err := os.WriteFile(corrupt, test.modify(bytes.Clone(data)), 0644); err != nil {
+			t.Fatalf("WriteFile failed: %v", err)
+		}
+		if _, _, err := DecryptTiled(corrupt, fuzzKey, image.Rectangle{}); err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: DecryptTiled = %v, want an error about %q", test.name, err, test.want)
+		}
+	}
+}
+
+func TestJPEGFrameLimits(t *testing.T) {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, largeTestImage(64, 48), nil); err != nil {
+		t.Fatalf("jpeg.Encode failed: %v", err)
+	}
+	data := buf.Bytes()
+	var sofStart, sofEnd int
+	jpegMetadataSegments(data, func(marker byte, start, end int) bool {
+		if marker >= 0xc0 && marker <= 0xc2 {
+			sofStart, sofEnd = start, end
+			return false
+		}
+		return true
+	})
+	if sofEnd == 0 {
+		t.Fatal("no frame header in the JPEG")
+	}
+	if _, err := readJPEGCoefficients(data); err != nil {
+		t.Fatalf("readJPEGCoefficients failed: %v", err)
+	}
+
+	// A frame of 65535x65535 pixels is more than the pixel limit
+	huge := bytes.Clone(data)
+	binary.BigEndian.PutUint16(huge[sofStart+5:], 0xffff)
+	binary.BigEndian.PutUint16(huge[sofStart+7:], 0xffff)
+	if _, err := readJPEGCoefficients(huge); !errors.Is(err, ErrImageTooLarge) {
+		t.Errorf("readJPEGCoefficients of 65535x65535 = %v, want ErrImageTooLarge", err)
+	}
+
+	// Under the pixel limit, but more blocks than the data could code
+	large := bytes.Clone(data)
+	binary.BigEndian.PutUint16(large[sofStart+5:], 8000)
+	binary.BigEndian.PutUint16(large[sofStart+7:], 8000)
+	if _, err := readJPEGCoefficients(large); err == nil || !strings.Contains(err.Error(), "frame header") {
+		t.Errorf("readJPEGCoefficients of 8000x8000 = %v, want an invalid frame header", err)
+	}
+
+	twice := append(bytes.Clone(data[:sofEnd]), data[sofStart:]...)
+	if _, err := readJPEGCoefficients(twice); err == nil || !strings.Contains(err.Error(), "two frame headers") {
+		t.Errorf("readJPEGCoefficients with two frame headers = %v", err)
+	}
+}
+
+// TestMaxPixels checks that an image claiming more than MaxPixels fails
+// alone, as a batch is encrypted or decrypted, and that the limit can be
+// raised or lifted.
+func TestMaxPixels(t *testing.T) {
+	key, _ := GenerateRandomKey()
+	fsys := &MemFS{}
+	bomb := hugePNG(t, 100000, 100000)
+	memWrite(t, fsys, "in/bomb.png", bomb)
+	memImage(t, fsys, "in/red.png", redTestImage())
+
+	if _, err := LoadImageFS(fsys, "in/bomb.png"); !errors.Is(err, ErrImageTooLarge) {
+		t.Errorf("LoadImageFS = %v, want ErrImageTooLarge", err)
+	} else {
+		checkPathError(t, err, "decode", "in/bomb.png")
+	}
+	if err := imageFileError(fsys, "in/bomb.png"); !errors.Is(err, ErrImageTooLarge) {
+		t.Errorf("imageFileError = %v, want ErrImageTooLarge", err)
+	}
+
+	// The bomb fails, and the image beside it is encrypted and decrypted
+	var failed []string
+	progress := func(e Event) {
+		if errors.Is(e.Err, ErrImageTooLarge) {
+			failed = append(failed, e.Path)
+		}
+	}
+	if err := EncryptDirectory(t.Context(), "in", "enc", key, false, false, EncryptOptions{FS: fsys, Progress: progress}); err != nil {
+		t.Fatalf("EncryptDirectory failed: %v", err)
+	}
+	var enc bytes.Buffer
+	if err := EncryptStream(t.Context(), key, &enc, bytes.NewReader(bomb)); err != nil {
+		t.Fatalf("EncryptStream failed: %v", err)
+	}
+	memWrite(t, fsys, "enc/bomb.png.enc", enc.Bytes())
+	if err := DecryptDirectory(t.Context(), "enc", "dec", key, false, EncryptedExtension, false, SaveOptions{FS: fsys, Progress: progress}); err != nil {
+		t.Fatalf("DecryptDirectory failed: %v", err)
+	}
+	if want := []string{"in/bomb.png", "enc/bomb.png.enc"}; !slices.Equal(failed, want) {
+		t.Errorf("failed with ErrImageTooLarge: %q, want %q", failed, want)
+	}
+	if got, err := LoadImageFS(fsys, "dec/red.png"); err != nil || !samePixels(got, redTestImage()) {
+		t.Errorf("red.png does not decrypt to its pixels beside the bomb: %v", err)
+	}
+	if _, err := fs.Stat(fsys, "dec/bomb.png"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("the bomb was decrypted: %v", err)
+	}
+
+	// The limit is set by the options of each call, and lifted when
+	// negative
+	if _, err := loadImage(fsys, "in/red.png", 99); !errors.Is(err, ErrImageTooLarge) {
+		t.Errorf("loadImage of 100 pixels over a limit of 99 = %v, want ErrImageTooLarge", err)
+	}
+	if err := DecryptFile(t.Context(), "enc/red.png.enc", "dec/red99.png", key, false, SaveOptions{FS: fsys, MaxPixels: 99}); !errors.Is(err, ErrImageTooLarge) {
+		t.Errorf("DecryptFile of 100 pixels over a limit of 99 = %v, want ErrImageTooLarge", err)
+	}
+	if err := EncryptFile(t.Context(), "in/red.png", "enc/red99.png.enc", key, false, EncryptOptions{FS: fsys, MaxPixels: 99}); !errors.Is(err, ErrImageTooLarge) {
+		t.Errorf("EncryptFile of 100 pixels over a limit of 99 = %v, want ErrImageTooLarge", err)
+	}
+	if _, err := loadImage(fsys, "in/red.png", 100); err != nil {
+		t.Errorf("loadImage of 100 pixels at a limit of 100 failed: %v", err)
+	}
+	if err := checkPixels(1<<20, 1<<20, -1); err != nil {
+		t.Errorf("checkPixels with no limit = %v", err)
+	}
+
+	// Encryptors with different limits do not share them
+	small, err := NewEncryptor(WithKey(key), WithFS(fsys), WithMaxPixels(99))
+	if err != nil {
+		t.Fatalf("NewEncryptor failed: %v", err)
+	}
+	large, err := NewEncryptor(WithKey(key), WithFS(fsys), WithMaxPixels(100))
+	if err != nil {
+		t.Fatalf("NewEncryptor failed: %v", err)
+	}
+	if err := large.ProcessFile(t.Context(), "in/red.png", "enc/large.png.enc"); err != nil {
+		t.Errorf("ProcessFile at a limit of 100 failed: %v", err)
+	}
+	if err := small.ProcessFile(t.Context(), "in/red.png", "enc/small.png.enc"); !errors.Is(err, ErrImageTooLarge) {
+		t.Errorf("ProcessFile over a limit of 99 = %v, want ErrImageTooLarge", err)
+	}
+}
@@ -0,0 +1,31 @@
+package pixellock
+
+// A Logger receives what encryption and decryption log, at four levels,
+// each message with alternating keys and values adding to it, as
+// log/slog takes them. A *slog.Logger is one. Loggers are called from the
+// goroutines of directories encrypted or decrypted at once, so must be
+// safe for concurrent use.
+//
+// The library logs to no other logger: without one, nothing is logged.
+type Logger interface {
+	Debug(msg string, keyvals ...any)
+	Info(msg string, keyvals ...any)
+	Warn(msg string, keyvals ...any)
+	Error(msg string, keyvals ...any)
+}
+
+// nopLogger logs nothing, standing in for a nil Logger.
+type nopLogger struct{}
+
+func (nopLogger) Debug(string, ...any) {}
+func (nopLogger) Info(string, ...any)  {}
+func (nopLogger) Warn(string, ...any)  {}
+func (nopLogger) Error(string, ...any) {}
+
+// orNop returns l, or a Logger logging nothing when l is nil.
+func orNop(l Logger) Logger {
+	if l == nil {
+		return nopLogger{}
+	}
+	return l
+}
@@ -0,0 +1,162 @@
+package pixellock
+
+import (
+	"context"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// recordingLogger keeps the messages logged to it, by level.
+type recordingLogger struct {
+	mu      sync.Mutex
+	records []string
+}
+
+func (l *recordingLogger) record(level, msg string, keyvals []any) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		if keyvals[i] == "path" {
+			msg += " " + filepath.Base(keyvals[i+1].(string))
+		}
+	}
+	l.records = append(l.records, level+": "+msg)
+}
+
+func (l *recordingLogger) Debug(msg string, keyvals ...any) { l.record("debug", msg, keyvals) }
+func (l *recordingLogger) Info(msg string, keyvals ...any)  { l.record("info", msg, keyvals) }
+func (l *recordingLogger) Warn(msg string, keyvals ...any)  { l.record("warn", msg, keyvals) }
+func (l *recordingLogger) Error(msg string, keyvals ...any) { l.record("error", msg, keyvals) }
+
+func (l *recordingLogger) has(record string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, r := range l.records {
+		if r == record {
+			return true
+		}
+	}
+	return false
+}
+
+// panicWriter panics when anything is written to it.
+type panicWriter struct{}
+
+func (panicWriter) Write(p []byte) (int, error) {
+	panic("package-level log written: " + string(p))
+}
+
+// panicOnPackageLog makes anything written to the package-level loggers of
+// log and log/slog panic, until the test is done.
+func panicOnPackageLog(t *testing.T) {
+	defaultLogger, writer, flags := slog.Default(), log.Writer(), log.Flags()
+	slog.SetDefault(slog.New(slog.NewTextHandler(panicWriter{}, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	log.SetOutput(panicWriter{})
+	t.Cleanup(func() {
+		slog.SetDefault(defaultLogger)
+		log.SetOutput(writer)
+		log.SetFlags(flags)
+	})
+}
+
+// failOnStdout fails the test if anything is written to standard output
+// until it is done.
+func failOnStdout(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Pipe failed: %v", err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	written := make(chan []byte)
+	go func() {
+		data, _ := io.ReadAll(r)
+		written <- data
+	}()
+	t.Cleanup(func() {
+		os.Stdout = stdout
+		w.Close()
+		if data := <-written; len(data) > 0 {
+			t.Errorf("written to standard output: %q", data)
+		}
+	})
+}
+
+// TestNoPackageLog runs encryption and decryption of directories, failing
+// on some files and skipping others, and checks that what they log goes to
+// their Logger alone, or nowhere without one, and that nothing is printed.
+func TestNoPackageLog(t *testing.T) {
+	panicOnPackageLog(t)
+	failOnStdout(t)
+	face, err := os.ReadFile(faceFixture)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	fsys, in, encrypted, decrypted := &MemFS{}, "in", "enc", "dec"
+	memWrite(t, fsys, filepath.Join(in, "face.jpg"), face)
+	memWrite(t, fsys, filepath.Join(in, "truncated.jpg"), face[:len(face)/2]) // Its header reads, its pixels do not
+	memWrite(t, fsys, filepath.Join(in, "notes.txt"), []byte("not an image"))
+	key, _ := GenerateRandomKey()
+	ctx := context.Background()
+
+	for _, logger := range []*recordingLogger{nil, {}} {
+		var l Logger
+		if logger != nil {
+			l = logger
+		}
+		if err := EncryptDirectory(ctx, in, encrypted, key, false, true, EncryptOptions{Logger: l, FS: fsys, Thumbnail: 32}); err != nil {
+			t.Fatalf("EncryptDirectory failed: %v", err)
+		}
+		if err := EncryptFile(ctx, filepath.Join(in, "face.jpg"), filepath.Join(encrypted, "face.jpg.enc"), key, false, EncryptOptions{Logger: l, FS: fsys}); err != nil {
+			t.Fatalf("EncryptFile over an existing file failed: %v", err)
+		}
+		memWrite(t, fsys, filepath.Join(encrypted, "corrupt.enc"), face)
+		if err := DecryptDirectory(ctx, encrypted, decrypted, key, false, EncryptedExtension, true, SaveOptions{Format: "jpeg", Logger: l, FS: fsys}); err != nil {
+			t.Fatalf("DecryptDirectory failed: %v", err)
+		}
+		if logger == nil {
+			continue
+		}
+		for _, want := range []string{"error: failed to read image truncated.jpg", "error: failed to decrypt corrupt.enc", "debug: writing JPEG face.jpg", "info: skipping notes.txt"} {
+			if !logger.has(want) {
+				t.Errorf("%q not logged; logged %q", want, logger.records)
+			}
+		}
+	}
+
+	// Hiding and revealing log nothing at all
+	dir := t.TempDir()
+	cover, stego := filepath.Join(dir, "cover.png"), filepath.Join(dir, "stego.png")
+	if err := SaveImage(cover, newTestNRGBA(64, 64), SaveOptions{Format: "png"}); err != nil {
+		t.Fatalf("SaveImage failed: %v", err)
+	}
+	if err := HidePayload(cover, stego, Payload{Data: []byte("quiet")}, DefaultStegoOptions, "png"); err != nil {
+		t.Fatalf("HidePayload failed: %v", err)
+	}
+	if p, err := RevealPayload(stego, DefaultStegoOptions); err != nil || string(p.Data) != "quiet" {
+		t.Errorf("RevealPayload = %q, %v", p.Data, err)
+	}
+}
+
+func TestWithLogger(t *testing.T) {
+	panicOnPackageLog(t)
+	key, _ := GenerateRandomKey()
+	logger := &recordingLogger{}
+	enc, err := NewEncryptor(WithKey(key), WithLogger(logger))
+	if err != nil {
+		t.Fatalf("NewEncryptor failed: %v", err)
+	}
+	dir := t.TempDir()
+	missing := filepath.Join(dir, "missing.jpg")
+	if err := enc.ProcessFile(context.Background(), missing, filepath.Join(dir, "missing.enc")); err == nil {
+		t.Fatal("ProcessFile of a missing file succeeded")
+	}
+	if !logger.has("error: failed to read image missing.jpg") {
+		t.Errorf("the Encryptor's logger got %q", logger.records)
+	}
+}
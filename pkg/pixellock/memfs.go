@@ -0,0 +1,273 @@
+package pixellock
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A MemFS is a FileSystem held in memory, for tests and for files that
+// never touch a disk. Names are cleaned, so "a/../b", "./b" and "/b" are
+// all the file b; its root, ".", always exists. The zero MemFS is empty
+// and ready to use.
+type MemFS struct {
+	mu    sync.Mutex
+	files map[string]*memFile // By cleaned name
+	dirs  map[string]bool
+}
+
+// memFile is a file of a MemFS. Writes replace it rather than change it,
+// so that files open for reading keep what they opened.
+type memFile struct {
+	data    []byte
+	modTime time.Time
+}
+
+// memName returns the name MemFS keeps name under.
+func memName(name string) string {
+	name = strings.TrimLeft(path.Clean(filepath.ToSlash(name)), "/")
+	if name == "" {
+		return "."
+	}
+	return name
+}
+
+// memInfo is the fs.FileInfo of a file or directory of a MemFS.
+type memInfo struct {
+	name    string
+	size    int64
+	dir     bool
+	modTime time.Time
+}
+
+func (i memInfo) Name() string       { return path.Base(i.name) }
+func (i memInfo) Size() int64        { return i.size }
+func (i memInfo) ModTime() time.Time { return i.modTime }
+func (i memInfo) IsDir() bool        { return i.dir }
+func (i memInfo) Sys() any           { return nil }
+
+func (i memInfo) Mode() fs.FileMode {
+	if i.dir {
+		return fs.ModeDir | 0755
+	}
+	return 0644
+}
+
+// stat returns the information of the cleaned name, with m.mu held.
+func (m *MemFS) stat(name string) (memInfo, bool) {
+	if f, ok := m.files[name]; ok {
+		return memInfo{name: name, size: int64(len(f.data)), modTime: f.modTime}, true
+	}
+	if name == "." || m.dirs[name] {
+		return memInfo{name: name, dir: true}, true
+	}
+	return memInfo{}, false
+}
+
+// isDir reports whether the cleaned name is a directory, with m.mu held.
+func (m *MemFS) isDir(name string) bool {
+	info, ok := m.stat(name)
+	return ok && info.dir
+}
+
+// Stat returns the information of the file or directory name.
+func (m *MemFS) Stat(name string) (fs.FileInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	info, ok := m.stat(memName(name))
+	if !ok {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	return info, nil
+}
+
+// ReadDir returns the entries of the directory name, sorted by name.
+func (m *MemFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	dir := memName(name)
+	if !m.isDir(dir) {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+	var entries []fs.DirEntry
+	add := func(child string) {
+		if child != "." && path.Dir(child) == dir {
+			info, _ := m.stat(child)
+			entries = append(entries, fs.FileInfoToDirEntry(info))
+		}
+	}
+	for child := range m.files {
+		add(child)
+	}
+	for child := range m.dirs {
+		add(child)
+	}
+	slices.SortFunc(entries, func(a, b fs.DirEntry) int { return strings.Compare(a.Name(), b.Name()) })
+	return entries, nil
+}
+
+// Open opens the file or directory name for reading.
+func (m *MemFS) Open(name string) (fs.File, error) {
+	m.mu.Lock()
+	clean := memName(name)
+	info, ok := m.stat(clean)
+	var data []byte
+	if f := m.files[clean]; f != nil {
+		data = f.data
+	}
+	m.mu.Unlock()
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	if info.dir {
+		entries, err := m.ReadDir(name)
+		if err != nil {
+			return nil, err
+		}
+		return &memDir{info: info, entries: entries}, nil
+	}
+	return &memReader{info: info, Reader: bytes.NewReader(data)}, nil
+}
+
+// Create creates or truncates the file name, whose directory must exist.
+// What is written to it appears once it is closed.
+func (m *MemFS) Create(name string) (io.WriteCloser, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	clean := memName(name)
+	if m.isDir(clean) || !m.isDir(path.Dir(clean)) {
+		return nil, &fs.PathError{Op: "create", Path: name, Err: fs.ErrInvalid}
+	}
+	m.put(clean, nil)
+	return &memWriter{fs: m, name: clean}, nil
+}
+
+// put sets the cleaned name to a file of data, with m.mu held.
+func (m *MemFS) put(name string, data []byte) {
+	if m.files == nil {
+		m.files = make(map[string]*memFile)
+	}
+	m.files[name] = &memFile{data: data, modTime: time.Now()}
+}
+
+// MkdirAll creates the directory name and any parents it needs.
+func (m *MemFS) MkdirAll(name string, perm fs.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var missing []string
+	for dir := memName(name); !m.isDir(dir); dir = path.Dir(dir) {
+		if _, ok := m.files[dir]; ok {
+			return &fs.PathError{Op: "mkdir", Path: name, Err: fs.ErrExist}
+		}
+		missing = append(missing, dir)
+	}
+	if m.dirs == nil {
+		m.dirs = make(map[string]bool)
+	}
+	for _, dir := range missing {
+		m.dirs[dir] = true
+	}
+	return nil
+}
+
+// Remove removes the file or empty directory name.
+func (m *MemFS) Remove(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	clean := memName(name)
+	if _, ok := m.files[clean]; ok {
+		delete(m.files, clean)
+		return nil
+	}
+	if !m.dirs[clean] {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+	for child := range m.files {
+		if strings.HasPrefix(child, clean+"/") {
+			return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrExist}
+		}
+	}
+	for child := range m.dirs {
+		if strings.HasPrefix(child, clean+"/") {
+			return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrExist}
+		}
+	}
+	delete(m.dirs, clean)
+	return nil
+}
+
+// Rename moves the file oldname to newname, replacing any file there.
+func (m *MemFS) Rename(oldname, newname string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	from, to := memName(oldname), memName(newname)
+	f, ok := m.files[from]
+	if !ok {
+		return &fs.PathError{Op: "rename", Path: oldname, Err: fs.ErrNotExist}
+	}
+	if m.isDir(to) || !m.isDir(path.Dir(to)) {
+		return &fs.PathError{Op: "rename", Path: newname, Err: fs.ErrInvalid}
+	}
+	delete(m.files, from)
+	m.files[to] = f
+	return nil
+}
+
+// memReader is a file of a MemFS open for reading.
+type memReader struct {
+	info memInfo
+	*bytes.Reader
+}
+
+func (r *memReader) Stat() (fs.FileInfo, error) { return r.info, nil }
+func (r *memReader) Close() error               { return nil }
+
+// memDir is a directory of a MemFS open for reading.
+type memDir struct {
+	info    memInfo
+	entries []fs.DirEntry
+}
+
+func (d *memDir) Stat() (fs.FileInfo, error) { return d.info, nil }
+func (d *memDir) Close() error               { return nil }
+
+func (d *memDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.name, Err: fs.ErrInvalid}
+}
+
+func (d *memDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if n <= 0 {
+		entries := d.entries
+		d.entries = nil
+		return entries, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	n = min(n, len(d.entries))
+	entries := d.entries[:n]
+	d.entries = d.entries[n:]
+	return entries, nil
+}
+
+// memWriter is a file of a MemFS open for writing, written on Close.
+type memWriter struct {
+	fs   *MemFS
+	name string
+	buf  bytes.Buffer
+}
+
+func (w *memWriter) Write(p []byte) (int, error) { return w.buf.Write(p) }
+
+func (w *memWriter) Close() error {
+	w.fs.mu.Lock()
+	defer w.fs.mu.Unlock()
+	w.fs.put(w.name, bytes.Clone(w.buf.Bytes()))
+	return nil
+}
@@ -0,0 +1,117 @@
+package pixellock
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"io/fs"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+)
+
+// redTestImage returns the 10x10 red image createImageFile writes.
+func redTestImage() *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, 10, 10))
+	for i := 0; i < len(img.Pix); i += 4 {
+		img.SetRGBA(i/4%10, i/40, color.RGBA{255, 0, 0, 255})
+	}
+	return img
+}
+
+// memWrite writes data to the file name in fsys, creating its directory.
+func memWrite(t testing.TB, fsys *MemFS, name string, data []byte) {
+	t.Helper()
+	if err := fsys.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		t.Fatalf("MkdirAll failed: %v", err)
+	}
+	if err := writeFile(fsys, name, data); err != nil {
+		t.Fatalf("writeFile failed: %v", err)
+	}
+}
+
+// memImage writes img to the file name in fsys as a PNG, creating its
+// directory.
+func memImage(t testing.TB, fsys *MemFS, name string, img image.Image) {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := EncodeImage(&buf, img, SaveOptions{Format: "png"}); err != nil {
+		t.Fatalf("EncodeImage failed: %v", err)
+	}
+	memWrite(t, fsys, name, buf.Bytes())
+}
+
+// memRead returns the file name in fsys.
+func memRead(t testing.TB, fsys *MemFS, name string) []byte {
+	t.Helper()
+	data, err := fs.ReadFile(fsys, name)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	return data
+}
+
+func TestMemFS(t *testing.T) {
+	fsys := &MemFS{}
+	memWrite(t, fsys, "a.txt", []byte("a"))
+	memWrite(t, fsys, "dir/b.txt", []byte("b"))
+	memWrite(t, fsys, "dir/sub/c.txt", []byte("c"))
+	if err := fsys.MkdirAll("empty", 0755); err != nil {
+		t.Fatalf("MkdirAll failed: %v", err)
+	}
+
+	// fs.Sub refuses the names fs.ValidPath does, which MemFS takes
+	sub, _ := fs.Sub(fsys, "dir")
+	if err := fstest.TestFS(sub, "b.txt", "sub/c.txt"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Names are taken as the os package takes them
+	for _, name := range []string{"/dir/b.txt", "./dir/b.txt", "dir/sub/../b.txt", filepath.Join("dir", "b.txt")} {
+		if data := memRead(t, fsys, name); string(data) != "b" {
+			t.Errorf("%s = %q, want b", name, data)
+		}
+	}
+
+	// Writes appear once closed
+	w, err := fsys.Create("dir/b.txt")
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	w.Write([]byte("new"))
+	if data := memRead(t, fsys, "dir/b.txt"); len(data) != 0 {
+		t.Errorf("file being written reads %q, want it empty", data)
+	}
+	w.Close()
+	if data := memRead(t, fsys, "dir/b.txt"); string(data) != "new" {
+		t.Errorf("file written reads %q", data)
+	}
+
+	if err := fsys.Rename("dir/b.txt", "moved.txt"); err != nil {
+		t.Fatalf("Rename failed: %v", err)
+	}
+	if _, err := fsys.Stat("dir/b.txt"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("renamed file still there: %v", err)
+	}
+	if data := memRead(t, fsys, "moved.txt"); string(data) != "new" {
+		t.Errorf("renamed file reads %q", data)
+	}
+
+	// Files need their directory, as on disk
+	for name, err := range map[string]error{
+		"create missing/x":   func() error { _, err := fsys.Create("missing/x"); return err }(),
+		"create dir":         func() error { _, err := fsys.Create("dir"); return err }(),
+		"mkdir under a file": fsys.MkdirAll("a.txt/x", 0755),
+		"rename to missing":  fsys.Rename("a.txt", "missing/a.txt"),
+		"remove non-empty":   fsys.Remove("dir"),
+		"remove missing":     fsys.Remove("missing"),
+	} {
+		if err == nil {
+			t.Errorf("%s succeeded", name)
+		}
+	}
+	if err := fsys.Remove("empty"); err != nil {
+		t.Errorf("Remove of an empty directory failed: %v", err)
+	}
+}
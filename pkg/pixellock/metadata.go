@@ -0,0 +1,359 @@
+package pixellock
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"os"
+	"path/filepath"
+)
+
+// Metadata-only encryption leaves the pixels of a JPEG or PNG public and
+// encrypts its metadata alone: the EXIF, XMP and IPTC segments of a JPEG,
+// and the eXIf, text and tIME chunks of a PNG, which hold GPS positions,
+// capture times and device serials. They are cut out byte for byte and
+// kept, encrypted, in a record that either goes back into the image, in
+// APP15 segments of a JPEG or a metadataChunk chunk of a PNG, or into a
+// sidecar file. Every other byte of the image is copied as it is.
+//
+// The record is a SHA-256 hash of the decoded pixels followed by the
+// encrypted metadata, with the hash as additional data, so the metadata is
+// only attached again to an image whose pixels are unchanged. The metadata
+// is the big-endian uint32 length of what went before the image data,
+// that, then what went after it, so each goes back where it was.
+
+// MetadataSidecarExtension is appended to the name of an image to name the
+// sidecar holding its encrypted metadata.
+const MetadataSidecarExtension = ".meta.enc"
+
+// metadataChunk is the type of the PNG chunk holding the encrypted
+// metadata: ancillary, private and unsafe to copy, like redactChunk.
+const metadataChunk = "pxMD"
+
+// metadataSegmentHeader starts each APP15 segment holding a piece of the
+// encrypted metadata of a JPEG.
+const metadataSegmentHeader = "pixellock metadata\x00"
+
+// metadataSidecarMagic starts a sidecar file.
+const metadataSidecarMagic = "PXLKMETA"
+
+// JPEG markers of the IPTC segment and of the segments holding the
+// encrypted metadata.
+const (
+	jpegAPP13 = 0xed
+	jpegAPP15 = 0xef
+)
+
+// isMetadataSegment reports whether a JPEG segment with marker is metadata
+// that metadata-only encryption takes out: EXIF and XMP in APP1, IPTC in
+// APP13.
+func isMetadataSegment(marker byte) bool {
+	return marker == jpegAPP1 || marker == jpegAPP13
+}
+
+// isMetadataChunk reports whether a PNG chunk of type typ is metadata that
+// metadata-only encryption takes out. Text chunks carry XMP and IPTC as
+// well as plain text.
+func isMetadataChunk(typ string) bool {
+	switch typ {
+	case "eXIf", "tEXt", "zTXt", "iTXt", "tIME":
+		return true
+	}
+	return false
+}
+
+// pixelHash returns a SHA-256 hash of the size and pixels of img, which
+// stays the same however the file holding it is rewritten, as long as
+// the pixels do.
+func pixelHash(img image.Image) []byte {
+	b := img.Bounds()
+	h := sha256.New()
+	binary.Write(h, binary.BigEndian, [2]uint32{uint32(b.Dx()), uint32(b.Dy())})
+	row := make([]byte, 0, 8*b.Dx())
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		row = row[:0]
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := color.NRGBA64Model.Convert(img.At(x, y)).(color.NRGBA64)
+			for _, v := range []uint16{c.R, c.G, c.B, c.A} {
+				row = binary.BigEndian.AppendUint16(row, v)
+			}
+		}
+		h.Write(row)
+	}
+	return h.Sum(nil)
+}
+
+// splitMetadata returns the JPEG or PNG data without its metadata, the
+// metadata segments or chunks cut out of it, in order, and the format of
+// the image. The metadata is framed as the record holds it. The encrypted
+// metadata record of data, if any, is returned apart and left out of both.
+func splitMetadata(data []byte) (public, metadata, record []byte, format string, err error) {
+	var out bytes.Buffer
+	var before, after []byte
+	switch {
+	case bytes.HasPrefix(data, pngSignature):
+		format = "png"
+		out.Write(pngSignature)
+		seenIDAT := false
+		err = pngChunks(data, func(typ string, start, end int) bool {
+			seenIDAT = seenIDAT || typ == "IDAT"
+			switch {
+			case typ == metadataChunk:
+				record = append(record, data[start+8:end-4]...)
+			case isMetadataChunk(typ) && seenIDAT:
+				after = append(after, data[start:end]...)
+			case isMetadataChunk(typ):
+				before = append(before, data[start:end]...)
+			default:
+				out.Write(data[start:end])
+			}
+			return true
+		})
+	case len(data) >= 2 && data[0] == 0xff && data[1] == jpegSOI:
+		format = "jpeg"
+		out.Write(data[:2])
+		pos := 2
+		err = jpegMetadataSegments(data, func(marker byte, start, end int) bool {
+			switch {
+			case marker == jpegAPP15 && bytes.HasPrefix(data[start+4:end], []byte(metadataSegmentHeader)):
+				record = append(record, data[start+4+len(metadataSegmentHeader):end]...)
+			case isMetadataSegment(marker):
+				before = append(before, data[start:end]...)
+			default:
+				out.Write(data[start:end])
+			}
+			pos = end
+			return true
+		})
+		out.Write(data[pos:])
+	default:
+		format, _ := ImageDataFormat(data)
+		return nil, nil, nil, "", fmt.Errorf("metadata-only encryption needs a JPEG or PNG image, not %s", formatName(format))
+	}
+	if err != nil {
+		return nil, nil, nil, "", err
+	}
+	if len(before)+len(after) > 0 {
+		metadata = binary.BigEndian.AppendUint32(nil, uint32(len(before)))
+		metadata = append(append(metadata, before...), after...)
+	}
+	return out.Bytes(), metadata, record, format, nil
+}
+
+// formatName returns format, or "an unknown format" when it is empty.
+func formatName(format string) string {
+	if format == "" {
+		return "an unknown format"
+	}
+	return format
+}
+
+// insertMetadata returns the JPEG or PNG data, as splitMetadata gives it,
+// with the segments or chunks of before inserted where metadata goes: in
+// a JPEG after its JFIF header, in a PNG right before its first IDAT
+// chunk. The chunks of after go right before the IEND chunk of a PNG.
+func insertMetadata(data, before, after []byte, format string) ([]byte, error) {
+	var out bytes.Buffer
+	inserted := false
+	var err error
+	if format == "png" {
+		out.Write(pngSignature)
+		err = pngChunks(data, func(typ string, start, end int) bool {
+			if !inserted && typ == "IDAT" {
+				out.Write(before)
+				inserted = true
+			}
+			if typ == "IEND" {
+				out.Write(after)
+			}
+			out.Write(data[start:end])
+			return true
+		})
+	} else {
+		if len(after) > 0 {
+			return nil, fmt.Errorf("JPEG metadata cannot follow the image data")
+		}
+		out.Write(data[:2])
+		pos := 2
+		err = jpegMetadataSegments(data, func(marker byte, start, end int) bool {
+			if marker != jpegAPP0 {
+				return false
+			}
+			out.Write(data[start:end])
+			pos = end
+			return true
+		})
+		out.Write(before)
+		out.Write(data[pos:])
+		inserted = true
+	}
+	if err == nil && !inserted {
+		err = fmt.Errorf("PNG has no image data")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// metadataRecordData returns the segments or chunks that hold the
+// encrypted metadata record in an image of format.
+func metadataRecordData(record []byte, format string) []byte {
+	if format == "png" {
+		return pngChunk(metadataChunk, record)
+	}
+	var out bytes.Buffer
+	for piece := maxJPEGSegment - len(metadataSegmentHeader); len(record) > 0; {
+		n := min(piece, len(record))
+		writeJPEGSegment(&out, jpegAPP15, append([]byte(metadataSegmentHeader), record[:n]...))
+		record = record[n:]
+	}
+	return out.Bytes()
+}
+
+// EncryptMetadata returns the JPEG or PNG data with its metadata taken out
+// and encrypted with key, keyed to a hash of its pixels. The encrypted
+// record goes into the image, or, when sidecar is set, into the sidecar
+// data returned, which the image then goes without. An image with no
+// metadata gets an empty record.
+func EncryptMetadata(key, data []byte, sidecar bool) (public, sidecarData []byte, err error) {
+	public, metadata, record, format, err := splitMetadata(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	if record != nil {
+		return nil, nil, fmt.Errorf("the metadata of the image is encrypted already")
+	}
+	img, err := BytesToImage(public)
+	if err != nil {
+		return nil, nil, err
+	}
+	hash := pixelHash(img)
+	ciphertext, err := EncryptWithAAD(key, metadata, append([]byte(metadataSidecarMagic), hash...))
+	if err != nil {
+		return nil, nil, err
+	}
+	record = append(hash, ciphertext...)
+	if sidecar {
+		return public, append([]byte(metadataSidecarMagic), record...), nil
+	}
+	if format == "png" && len(record) > maxPNGMetadata {
+		return nil, nil, fmt.Errorf("%d bytes of metadata is more than a PNG chunk holds; encrypt it into a sidecar with --metadata-sidecar", len(metadata))
+	}
+	// The record goes after the JFIF header of a JPEG, and right before
+	// the IEND chunk of a PNG
+	before, after := metadataRecordData(record, format), []byte(nil)
+	if format == "png" {
+		before, after = after, before
+	}
+	if public, err = insertMetadata(public, before, after, format); err != nil {
+		return nil, nil, err
+	}
+	return public, nil, nil
+}
+
+// DecryptMetadata returns the JPEG or PNG data with the metadata encrypted
+// by EncryptMetadata decrypted with key and attached again, from the
+// record embedded in data or, when sidecarData is not nil, from the
+// sidecar. It fails when the pixels of data are not the ones the metadata
+// was encrypted with.
+func DecryptMetadata(key, data, sidecarData []byte) ([]byte, error) {
+	public, metadata, record, format, err := splitMetadata(data)
+	if err != nil {
+		return nil, err
+	}
+	if sidecarData != nil {
+		if !bytes.HasPrefix(sidecarData, []byte(metadataSidecarMagic)) {
+			return nil, fmt.Errorf("not a metadata sidecar: %w", ErrNotEncryptedFile)
+		}
+		record = sidecarData[len(metadataSidecarMagic):]
+	}
+	if record == nil {
+		return nil, fmt.Errorf("%w: the image has no encrypted metadata; it was not encrypted with --metadata-only, or its metadata is in a %s sidecar", ErrNotEncryptedFile, MetadataSidecarExtension)
+	}
+	if len(record) < sha256.Size {
+		return nil, fmt.Errorf("encrypted metadata truncated")
+	}
+	if len(metadata) > 0 {
+		return nil, fmt.Errorf("the image has metadata of its own, added since its metadata was encrypted")
+	}
+	img, err := BytesToImage(public)
+	if err != nil {
+		return nil, err
+	}
+	hash := record[:sha256.Size]
+	if !bytes.Equal(pixelHash(img), hash) {
+		return nil, fmt.Errorf("the pixels have changed since the metadata was encrypted; it is not attached to a different image")
+	}
+	if metadata, err = DecryptWithAAD(key, record[sha256.Size:], append([]byte(metadataSidecarMagic), hash...)); err != nil {
+		return nil, err
+	}
+	if len(metadata) == 0 {
+		return public, nil
+	}
+	if len(metadata) < 4 || uint64(binary.BigEndian.Uint32(metadata)) > uint64(len(metadata)-4) {
+		return nil, fmt.Errorf("encrypted metadata corrupt")
+	}
+	split := 4 + int(binary.BigEndian.Uint32(metadata))
+	return insertMetadata(public, metadata[4:split], metadata[split:], format)
+}
+
+// EncryptMetadataFile encrypts the metadata of the JPEG or PNG at
+// inputFilename with EncryptMetadata and writes the image to
+// outputFilename, which must be named for its format, and any sidecar to
+// outputFilename with MetadataSidecarExtension appended.
+func EncryptMetadataFile(inputFilename, outputFilename string, key []byte, sidecar bool) error {
+	data, err := os.ReadFile(inputFilename)
+	if err != nil {
+		return fmt.Errorf("failed to read image: %w", err)
+	}
+	public, sidecarData, err := EncryptMetadata(key, data, sidecar)
+	if err != nil {
+		return err
+	}
+	format, _ := ImageDataFormat(public)
+	if named := WithImageExtension(outputFilename, format); named != outputFilename {
+		return fmt.Errorf("%s: the image stays a %s with its metadata encrypted; name the output like %s", outputFilename, format, filepath.Base(named))
+	}
+	if err := os.MkdirAll(filepath.Dir(outputFilename), os.ModeDir|0755); err != nil {
+		return fmt.Errorf("failed to create output directory: %w", err)
+	}
+	if err := os.WriteFile(outputFilename, public, 0644); err != nil {
+		return fmt.Errorf("failed to write image: %w", err)
+	}
+	if sidecarData != nil {
+		if err := os.WriteFile(outputFilename+MetadataSidecarExtension, sidecarData, 0644); err != nil {
+			return fmt.Errorf("failed to write metadata sidecar: %w", err)
+		}
+	}
+	return nil
+}
+
+// DecryptMetadataFile attaches the metadata encrypted by
+// EncryptMetadataFile to the image at inputFilename with DecryptMetadata,
+// reading it from the sidecar next to the image when there is one, and
+// writes the image to outputFilename.
+func DecryptMetadataFile(inputFilename, outputFilename string, key []byte) error {
+	data, err := os.ReadFile(inputFilename)
+	if err != nil {
+		return fmt.Errorf("failed to read image: %w", err)
+	}
+	sidecarData, err := os.ReadFile(inputFilename + MetadataSidecarExtension)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read metadata sidecar: %w", err)
+	}
+	restored, err := DecryptMetadata(key, data, sidecarData)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(outputFilename), os.ModeDir|0755); err != nil {
+		return fmt.Errorf("failed to create output directory: %w", err)
+	}
+	if err := os.WriteFile(outputFilename, restored, 0644); err != nil {
+		return fmt.Errorf("failed to write image: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,186 @@
+package pixellock
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image/color"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testGPSDatum is the GPSMapDatum of gpsEXIF, looked for in the public
+// copy of a photo.
+const testGPSDatum = "WGS-84 pixellock test datum"
+
+// gpsEXIF returns EXIF metadata with a camera make, a device serial and a
+// GPS position.
+func gpsEXIF() []byte {
+	return marshalEXIF([]exifEntry{
+		{tag: 271, typ: 2, count: 6, value: []byte("Pixel\x00")},
+		{tag: exifIFDPointer, typ: 4, count: 1, sub: []exifEntry{
+			{tag: 42033, typ: 2, count: 10, value: []byte("SN-447102\x00")}, // BodySerialNumber
+		}},
+		{tag: gpsIFDPointer, typ: 4, count: 1, sub: []exifEntry{
+			{tag: 1, typ: 2, count: 2, value: []byte("N\x00")},                                            // GPSLatitudeRef
+			{tag: 18, typ: 2, count: uint32(len(testGPSDatum) + 1), value: []byte(testGPSDatum + "\x00")}, // GPSMapDatum
+		}},
+	})
+}
+
+// metadataPhotos writes a JPEG carrying gpsEXIF, XMP and IPTC, and a PNG
+// carrying gpsEXIF and XMP, and returns their paths.
+func metadataPhotos(t *testing.T, dir string) []string {
+	t.Helper()
+	img := photoNRGBA(t)
+	xmp := pngITXt(xmpKeyword, []byte(`<x:xmpmeta><rdf:Description exif:GPSLatitude="48,51.5N"/></x:xmpmeta>`))
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, nil); err != nil {
+		t.Fatalf("jpeg.Encode failed: %v", err)
+	}
+	jpg, err := AttachEXIF(buf.Bytes(), "jpeg", gpsEXIF())
+	if err != nil {
+		t.Fatalf("AttachEXIF failed: %v", err)
+	}
+	var segments bytes.Buffer
+	writeJPEGSegment(&segments, jpegAPP1, append([]byte(xmpNamespace), xmp[len(xmpKeyword)+5:]...))
+	writeJPEGSegment(&segments, jpegAPP13, []byte("Photoshop 3.0\x008BIM\x04\x04\x00\x00\x00\x00\x00\x0b\x1c\x02\x5a\x00\x05Paris"))
+	jpg = append(append(append([]byte{}, jpg[:2]...), segments.Bytes()...), jpg[2:]...)
+
+	buf.Reset()
+	if err := EncodeImage(&buf, img, SaveOptions{Format: "png", EXIF: gpsEXIF()}); err != nil {
+		t.Fatalf("EncodeImage failed: %v", err)
+	}
+	png := buf.Bytes()
+	iend := len(png) - 12
+	png = append(append(append([]byte{}, png[:iend]...), pngChunk("iTXt", xmp)...), png[iend:]...)
+
+	var paths []string
+	for name, data := range map[string][]byte{"photo.jpg": jpg, "photo.png": png} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatalf("WriteFile failed: %v", err)
+		}
+		paths = append(paths, path)
+	}
+	return paths
+}
+
+func TestMetadataOnly(t *testing.T) {
+	key, err := GenerateRandomKey()
+	if err != nil {
+		t.Fatalf("GenerateRandomKey failed: %v", err)
+	}
+	other, err := GenerateRandomKey()
+	if err != nil {
+		t.Fatalf("GenerateRandomKey failed: %v", err)
+	}
+	dir := t.TempDir()
+	for _, original := range metadataPhotos(t, dir) {
+		want, err := os.ReadFile(original)
+		if err != nil {
+			t.Fatalf("ReadFile failed: %v", err)
+		}
+		for _, sidecar := range []bool{false, true} {
+			name := filepath.Base(original)
+			if sidecar {
+				name = "sidecar-" + name
+			}
+			public := filepath.Join(dir, "public", name)
+			if err := EncryptFile(t.Context(), original, public, key, false, EncryptOptions{MetadataOnly: true, MetadataSidecar: sidecar}); err != nil {
+				t.Fatalf("%s: EncryptFile failed: %v", name, err)
+			}
+
+			// The public copy has the same pixels and none of the metadata
+			data, err := os.ReadFile(public)
+			if err != nil {
+				t.Fatalf("%s: ReadFile failed: %v", name, err)
+			}
+			if exif, err := ReadEXIF(data); err != nil || exif != nil {
+				t.Errorf("%s: the public copy has EXIF (%v)", name, err)
+			}
+			for _, secret := range []string{testGPSDatum, "SN-447102", "GPSLatitude", "Paris"} {
+				if bytes.Contains(data, []byte(secret)) {
+					t.Errorf("%s: the public copy holds %q", name, secret)
+				}
+			}
+			got, err := LoadImage(public)
+			if err != nil {
+				t.Fatalf("%s: LoadImage failed: %v", name, err)
+			}
+			if img, _ := LoadImage(original); !samePixels(got, img) {
+				t.Errorf("%s: the pixels changed", name)
+			}
+			if _, err := os.Stat(public + MetadataSidecarExtension); (err == nil) != sidecar {
+				t.Errorf("%s: sidecar written is %v; want %v", name, err == nil, sidecar)
+			}
+
+			// Decryption gives back the original file, byte for byte
+			restored := filepath.Join(dir, "restored", name)
+			if err := DecryptFile(t.Context(), public, restored, key, false, SaveOptions{MetadataOnly: true}); err != nil {
+				t.Fatalf("%s: DecryptFile failed: %v", name, err)
+			}
+			if data, err := os.ReadFile(restored); err != nil || !bytes.Equal(data, want) {
+				t.Errorf("%s: the restored file differs from the original (%v)", name, err)
+			}
+			exif, err := ReadEXIF(want)
+			if err != nil {
+				t.Fatalf("%s: ReadEXIF failed: %v", name, err)
+			}
+			entries, err := parseEXIF(exif)
+			if err != nil {
+				t.Fatalf("%s: parseEXIF failed: %v", name, err)
+			}
+			if gps := findEXIF(entries, gpsIFDPointer); gps == nil || findEXIF(gps.sub, 18) == nil {
+				t.Errorf("%s: the GPS tags did not come back", name)
+			}
+
+			if err := DecryptMetadataFile(public, filepath.Join(dir, "wrong", name), other); err == nil {
+				t.Errorf("%s: decrypted with the wrong key", name)
+			}
+		}
+	}
+
+	// Metadata is only attached to the pixels it was encrypted with
+	jpg, err := os.ReadFile(filepath.Join(dir, "photo.jpg"))
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	public, sidecar, err := EncryptMetadata(key, jpg, true)
+	if err != nil {
+		t.Fatalf("EncryptMetadata failed: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, solidNRGBA(40, 30, color.NRGBA{200, 10, 10, 255}), nil); err != nil {
+		t.Fatalf("jpeg.Encode failed: %v", err)
+	}
+	if _, err := DecryptMetadata(key, buf.Bytes(), sidecar); err == nil {
+		t.Error("metadata attached to a different image")
+	}
+	if _, _, err := EncryptMetadata(key, public, false); err != nil {
+		t.Errorf("EncryptMetadata refused an image without metadata: %v", err)
+	}
+	embedded, _, err := EncryptMetadata(key, jpg, false)
+	if err != nil {
+		t.Fatalf("EncryptMetadata failed: %v", err)
+	}
+	if _, _, err := EncryptMetadata(key, embedded, false); err == nil {
+		t.Error("encrypted the metadata of an image twice")
+	}
+
+	// Only JPEGs and PNGs, and only to an output named for the format
+	if _, _, err := EncryptMetadata(key, binary.BigEndian.AppendUint32([]byte("GIF89a"), 0), false); err == nil {
+		t.Error("EncryptMetadata took a GIF")
+	}
+	if err := EncryptFile(t.Context(), filepath.Join(dir, "photo.png"), filepath.Join(dir, "photo.png.enc"), key, false, EncryptOptions{MetadataOnly: true}); err == nil {
+		t.Error("metadata-only encryption wrote a PNG named .enc")
+	}
+	if err := (EncryptOptions{MetadataOnly: true, Mode: ModeScramble}).Check(); err == nil {
+		t.Error("metadata-only encryption combined with scrambling")
+	}
+	if err := (SaveOptions{MetadataOnly: true, Format: "webp"}).CheckMetadataOnly(); err == nil {
+		t.Error("metadata-only decryption took an output format")
+	}
+}
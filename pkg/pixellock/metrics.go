@@ -0,0 +1,280 @@
+package pixellock
+
+import (
+	"bytes"
+	"cmp"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The metrics a Metrics collects, by the names they are exported under.
+// Dashboards and alerts are built on these names and their labels, so
+// they never change once released; metrics are only ever added. The op
+// label of each is PhaseEncrypt or PhaseDecrypt.
+const (
+	// MetricFiles counts the files done, by op and result, one of the
+	// Result constants.
+	MetricFiles = "pixellock_files_total"
+
+	// MetricFileDuration is the histogram of the seconds each file
+	// written took, by op.
+	MetricFileDuration = "pixellock_file_duration_seconds"
+
+	// MetricFileSize is the histogram of the bytes read of each file
+	// written, by op.
+	MetricFileSize = "pixellock_file_size_bytes"
+
+	// MetricFilesInFlight is the gauge of the files being encrypted or
+	// decrypted, by op.
+	MetricFilesInFlight = "pixellock_files_in_flight"
+
+	// MetricCryptoOperations counts the streams encrypted and decrypted,
+	// by op and cipher, the CipherName of their suite.
+	MetricCryptoOperations = "pixellock_crypto_operations_total"
+)
+
+// Results of files, the result label of MetricFiles.
+const (
+	ResultOK      = "ok"      // The file was written
+	ResultFailed  = "failed"  // The file failed
+	ResultSkipped = "skipped" // The file was left alone, its output existing
+)
+
+// MetricsContentType is the media type of the text Metrics.WriteTo
+// writes, version 0.0.4 of the Prometheus exposition format.
+const MetricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// The upper bounds of the buckets of MetricFileDuration and
+// MetricFileSize.
+var (
+	durationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+	sizeBuckets     = []float64{1 << 10, 1 << 12, 1 << 14, 1 << 16, 1 << 18, 1 << 20, 1 << 22, 1 << 24, 1 << 26, 1 << 28, 1 << 30}
+)
+
+// A histogram counts the values observed into buckets.
+type histogram struct {
+	counts []uint64 // Of the values in each bucket alone, and over the last
+	sum    float64
+}
+
+func (h *histogram) observe(buckets []float64, v float64) {
+	if h.counts == nil {
+		h.counts = make([]uint64, len(buckets)+1)
+	}
+	i, _ := slices.BinarySearch(buckets, v)
+	h.counts[i]++
+	h.sum += v
+}
+
+// Metrics collects the metrics of the files encrypted and decrypted, from
+// the Events of a Progress callback, as Progress returns, or as Start is
+// told of them, and writes them for Prometheus to scrape. It is safe for
+// several goroutines to use at once. A nil *Metrics collects nothing.
+type Metrics struct {
+	mu        sync.Mutex
+	files     map[[2]string]uint64 // By op and result
+	inFlight  map[string]int64
+	durations map[string]*histogram
+	sizes     map[string]*histogram
+	crypto    map[[2]string]uint64 // By op and cipher
+}
+
+// NewMetrics returns a Metrics with nothing counted.
+func NewMetrics() *Metrics {
+	return &Metrics{
+		files:     map[[2]string]uint64{},
+		inFlight:  map[string]int64{},
+		durations: map[string]*histogram{},
+		sizes:     map[string]*histogram{},
+		crypto:    map[[2]string]uint64{},
+	}
+}
+
+// Start counts a file of op as in flight, and returns the function to call
+// once it is done, with the bytes read of it, the CipherName of the suite
+// of a stream or "" for anything else, and why it failed if it did.
+func (m *Metrics) Start(op string) func(size int64, cipher string, err error) {
+	if m == nil {
+		return func(int64, string, error) {}
+	}
+	m.begin(op)
+	start := time.Now()
+	return func(size int64, cipher string, err error) {
+		result := ResultOK
+		if err != nil {
+			result = ResultFailed
+		}
+		m.end(op, result, time.Since(start), size, cipher)
+	}
+}
+
+func (m *Metrics) begin(op string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.inFlight[op]++
+}
+
+// end counts a file of op, begun before, as done with result.
+func (m *Metrics) end(op, result string, d time.Duration, size int64, cipher string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.inFlight[op]--
+	m.files[[2]string{op, result}]++
+	if result != ResultOK {
+		return
+	}
+	if m.durations[op] == nil {
+		m.durations[op], m.sizes[op] = &histogram{}, &histogram{}
+	}
+	m.durations[op].observe(durationBuckets, d.Seconds())
+	m.sizes[op].observe(sizeBuckets, float64(size))
+	if cipher != "" {
+		m.crypto[[2]string{op, cipher}]++
+	}
+}
+
+// fileTiming is a file in flight as Progress sees it.
+type fileTiming struct {
+	start time.Time
+	size  int64
+}
+
+// Progress returns a Progress callback counting the files of op,
+// PhaseEncrypt or PhaseDecrypt, from their Events, and passing each event
+// on to next unless it is nil. A file is in flight from its first event to
+// the one ending it, and its duration is the time between them as they are
+// given to the callback. A file is counted once, by its first write, however
+// many pages it is written as, so the callback is for a single run of
+// files.
+func (m *Metrics) Progress(op string, next func(Event)) func(Event) {
+	if m == nil {
+		return next
+	}
+	// The callback is given one event at a time, so needs no lock of its own
+	inFlight := map[string]*fileTiming{}
+	done := map[string]bool{}
+	return func(e Event) {
+		if e.Phase != PhaseScan && !done[e.Path] {
+			f := inFlight[e.Path]
+			if f == nil {
+				f = &fileTiming{start: time.Now()}
+				inFlight[e.Path] = f
+				m.begin(op)
+			}
+			f.size = max(f.size, e.Total)
+			result := ""
+			switch {
+			case e.Phase == PhaseSkip:
+				result = ResultSkipped
+			case e.Err != nil:
+				result = ResultFailed
+			case e.Phase == PhaseWrite:
+				result = ResultOK
+			}
+			if result != "" {
+				delete(inFlight, e.Path)
+				done[e.Path] = true
+				m.end(op, result, time.Since(f.start), f.size, e.Cipher)
+			}
+		}
+		if next != nil {
+			next(e)
+		}
+	}
+}
+
+// WriteTo writes the metrics to w in the Prometheus text format, typed by
+// MetricsContentType. The files of both ops and every result are written
+// from the start, counted or not.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	var buf bytes.Buffer
+	if m != nil {
+		m.mu.Lock()
+		m.write(&buf)
+		m.mu.Unlock()
+	}
+	return buf.WriteTo(w)
+}
+
+var metricOps = []string{PhaseEncrypt, PhaseDecrypt}
+
+func (m *Metrics) write(buf *bytes.Buffer) {
+	metricHeader(buf, MetricFiles, "counter", "Files encrypted or decrypted, by result.")
+	for _, op := range metricOps {
+		for _, result := range []string{ResultOK, ResultFailed, ResultSkipped} {
+			metricSample(buf, MetricFiles, metricLabels("op", op, "result", result), float64(m.files[[2]string{op, result}]))
+		}
+	}
+
+	metricHeader(buf, MetricFilesInFlight, "gauge", "Files being encrypted or decrypted.")
+	for _, op := range metricOps {
+		metricSample(buf, MetricFilesInFlight, metricLabels("op", op), float64(m.inFlight[op]))
+	}
+
+	metricHeader(buf, MetricFileDuration, "histogram", "Seconds taken by each file written.")
+	for _, op := range metricOps {
+		writeHistogram(buf, MetricFileDuration, op, durationBuckets, m.durations[op])
+	}
+	metricHeader(buf, MetricFileSize, "histogram", "Bytes read of each file written.")
+	for _, op := range metricOps {
+		writeHistogram(buf, MetricFileSize, op, sizeBuckets, m.sizes[op])
+	}
+
+	metricHeader(buf, MetricCryptoOperations, "counter", "Streams encrypted or decrypted, by cipher suite.")
+	keys := make([][2]string, 0, len(m.crypto))
+	for key := range m.crypto {
+		keys = append(keys, key)
+	}
+	slices.SortFunc(keys, func(a, b [2]string) int {
+		return cmp.Or(cmp.Compare(a[0], b[0]), cmp.Compare(a[1], b[1]))
+	})
+	for _, key := range keys {
+		metricSample(buf, MetricCryptoOperations, metricLabels("op", key[0], "cipher", key[1]), float64(m.crypto[key]))
+	}
+}
+
+func metricHeader(buf *bytes.Buffer, name, typ, help string) {
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func metricSample(buf *bytes.Buffer, name, labels string, v float64) {
+	fmt.Fprintf(buf, "%s{%s} %s\n", name, labels, strconv.FormatFloat(v, 'g', -1, 64))
+}
+
+// labelEscaper escapes label values as the text format has them.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// metricLabels returns the labels of a sample, given as name, value pairs,
+// with the values escaped.
+func metricLabels(pairs ...string) string {
+	var b strings.Builder
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, `%s="%s"`, pairs[i], labelEscaper.Replace(pairs[i+1]))
+	}
+	return b.String()
+}
+
+// writeHistogram writes the buckets, sum and count of h, the histogram of
+// op, as cumulative counts. A nil h has counted nothing.
+func writeHistogram(buf *bytes.Buffer, name, op string, buckets []float64, h *histogram) {
+	if h == nil {
+		h = &histogram{counts: make([]uint64, len(buckets)+1)}
+	}
+	var count uint64
+	for i, bound := range buckets {
+		count += h.counts[i]
+		metricSample(buf, name+"_bucket", metricLabels("op", op, "le", strconv.FormatFloat(bound, 'g', -1, 64)), float64(count))
+	}
+	count += h.counts[len(buckets)]
+	metricSample(buf, name+"_bucket", metricLabels("op", op, "le", "+Inf"), float64(count))
+	metricSample(buf, name+"_sum", metricLabels("op", op), h.sum)
+	metricSample(buf, name+"_count", metricLabels("op", op), float64(count))
+}
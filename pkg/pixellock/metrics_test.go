@@ -0,0 +1,112 @@
+package pixellock
+
+import (
+	"errors"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// scrapeMetric returns the value of the sample, its name and labels as
+// WriteTo writes them, in text.
+func scrapeMetric(t *testing.T, text, sample string) float64 {
+	t.Helper()
+	for _, line := range strings.Split(text, "\n") {
+		if value, ok := strings.CutPrefix(line, sample+" "); ok {
+			v, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				t.Fatalf("bad sample %q: %v", line, err)
+			}
+			return v
+		}
+	}
+	t.Fatalf("no sample %s in:\n%s", sample, text)
+	return 0
+}
+
+func TestMetrics(t *testing.T) {
+	key, _ := GenerateRandomKey()
+	fsys, input := progressFixture(t, 3)
+	metrics := NewMetrics()
+	opts := EncryptOptions{FS: fsys, Progress: metrics.Progress(PhaseEncrypt, nil)}
+	if err := EncryptDirectory(t.Context(), input, "enc", key, false, false, opts); err != nil {
+		t.Fatalf("EncryptDirectory failed: %v", err)
+	}
+	notImage := filepath.Join(input, "notes.txt")
+	memWrite(t, fsys, notImage, []byte("not an image"))
+	if err := EncryptFile(t.Context(), notImage, notImage+EncryptedExtension, key, false, opts); err == nil {
+		t.Fatal("EncryptFile of a text file succeeded")
+	}
+	// Again, leaving the files encrypted alone
+	opts.Progress = metrics.Progress(PhaseEncrypt, nil)
+	if err := EncryptDirectory(t.Context(), input, "enc", key, false, false, opts); err != nil {
+		t.Fatalf("EncryptDirectory failed: %v", err)
+	}
+	var passed int
+	save := SaveOptions{FS: fsys, Progress: metrics.Progress(PhaseDecrypt, func(Event) { passed++ })}
+	if err := DecryptDirectory(t.Context(), "enc", "dec", key, false, EncryptedExtension, false, save); err != nil {
+		t.Fatalf("DecryptDirectory failed: %v", err)
+	}
+	if passed == 0 {
+		t.Error("the events were not passed on")
+	}
+
+	var text strings.Builder
+	metrics.WriteTo(&text)
+	for sample, want := range map[string]float64{
+		`pixellock_files_total{op="encrypt",result="ok"}`:                      3,
+		`pixellock_files_total{op="encrypt",result="failed"}`:                  1,
+		`pixellock_files_total{op="encrypt",result="skipped"}`:                 3,
+		`pixellock_files_total{op="decrypt",result="ok"}`:                      3,
+		`pixellock_files_total{op="decrypt",result="failed"}`:                  0,
+		`pixellock_files_in_flight{op="encrypt"}`:                              0,
+		`pixellock_files_in_flight{op="decrypt"}`:                              0,
+		`pixellock_file_duration_seconds_count{op="encrypt"}`:                  3,
+		`pixellock_file_duration_seconds_bucket{op="decrypt",le="+Inf"}`:       3,
+		`pixellock_file_size_bytes_count{op="decrypt"}`:                        3,
+		`pixellock_crypto_operations_total{op="encrypt",cipher="aes-256-gcm"}`: 3,
+		`pixellock_crypto_operations_total{op="decrypt",cipher="aes-256-gcm"}`: 3,
+	} {
+		if got := scrapeMetric(t, text.String(), sample); got != want {
+			t.Errorf("%s = %v, want %v", sample, got, want)
+		}
+	}
+}
+
+func TestMetricsStart(t *testing.T) {
+	metrics := NewMetrics()
+	done := metrics.Start(PhaseDecrypt)
+	var text strings.Builder
+	metrics.WriteTo(&text)
+	if v := scrapeMetric(t, text.String(), `pixellock_files_in_flight{op="decrypt"}`); v != 1 {
+		t.Errorf("files in flight = %v, want 1", v)
+	}
+	done(2000, "", errors.New("failed"))
+	metrics.Start(PhaseDecrypt)(5000, "cipher-7", nil)
+
+	text.Reset()
+	metrics.WriteTo(&text)
+	for sample, want := range map[string]float64{
+		`pixellock_files_in_flight{op="decrypt"}`:                           0,
+		`pixellock_files_total{op="decrypt",result="failed"}`:               1,
+		`pixellock_files_total{op="decrypt",result="ok"}`:                   1,
+		`pixellock_file_size_bytes_bucket{op="decrypt",le="4096"}`:          0,
+		`pixellock_file_size_bytes_bucket{op="decrypt",le="16384"}`:         1,
+		`pixellock_file_size_bytes_sum{op="decrypt"}`:                       5000,
+		`pixellock_crypto_operations_total{op="decrypt",cipher="cipher-7"}`: 1,
+		`pixellock_files_total{op="encrypt",result="ok"}`:                   0,
+		`pixellock_file_duration_seconds_count{op="encrypt"}`:               0,
+	} {
+		if got := scrapeMetric(t, text.String(), sample); got != want {
+			t.Errorf("%s = %v, want %v", sample, got, want)
+		}
+	}
+
+	// A nil Metrics collects nothing
+	var none *Metrics
+	none.Start(PhaseEncrypt)(1, "", nil)
+	if none.Progress(PhaseEncrypt, nil) != nil {
+		t.Error("a nil Metrics made a callback")
+	}
+}
@@ -0,0 +1,7 @@
+//go:build !race
+
+package pixellock
+
+// raceEnabled reports whether the tests are built with the race detector,
+// whose shadow memory makes measures of memory meaningless.
+const raceEnabled = false
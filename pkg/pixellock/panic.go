@@ -0,0 +1,56 @@
+package pixellock
+
+import (
+	"errors"
+	"fmt"
+	"runtime/debug"
+)
+
+// PanicError is the error of a file whose processing panicked, a bug in
+// pixellock or in code given to it, such as a FileSystem. The file and
+// batch functions recover the panic as one, so that a batch goes on with
+// its other files.
+type PanicError struct {
+	Value any    // What was passed to panic
+	Stack []byte // The stack of the goroutine that panicked
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("panic: %v", e.Value)
+}
+
+// ErrorCode returns CodeInternal, the code ErrorCodeOf gives e.
+func (e *PanicError) ErrorCode() ErrorCode {
+	return CodeInternal
+}
+
+// recoverPanic, deferred, recovers a panic of the function deferring it,
+// setting *err to it as a *PanicError.
+func recoverPanic(err *error) {
+	if v := recover(); v != nil {
+		*err = &PanicError{Value: v, Stack: debug.Stack()}
+	}
+}
+
+// Panics returns the *PanicError values in err, which may join several
+// and wrap each, as the directory functions return them.
+func Panics(err error) []*PanicError {
+	var panics []*PanicError
+	var walk func(error)
+	walk = func(err error) {
+		var pe *PanicError
+		switch e := err.(type) {
+		case nil:
+		case interface{ Unwrap() []error }:
+			for _, err := range e.Unwrap() {
+				walk(err)
+			}
+		default:
+			if errors.As(err, &pe) {
+				panics = append(panics, pe)
+			}
+		}
+	}
+	walk(err)
+	return panics
+}
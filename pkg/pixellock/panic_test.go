@@ -0,0 +1,89 @@
+package pixellock
+
+import (
+	"context"
+	"errors"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// panicMemFS is a MemFS on which creating a file named name panics.
+type panicMemFS struct {
+	*MemFS
+	name string
+}
+
+func (p panicMemFS) Create(name string) (io.WriteCloser, error) {
+	if strings.HasPrefix(filepath.Base(name), p.name) {
+		panic("creating " + name)
+	}
+	return p.MemFS.Create(name)
+}
+
+func TestBatchPanic(t *testing.T) {
+	batch := BatchProcessor{
+		Source:  FileSource([]string{"a", "b", "c"}),
+		Workers: 2,
+		Operation: func(ctx context.Context, path string) (string, error) {
+			if path == "b" {
+				panic("bad file")
+			}
+			return path + ".out", nil
+		},
+	}
+	results, wait := batch.Run(t.Context())
+	for r := range results {
+		var pe *PanicError
+		if r.Input == "b" && (!errors.As(r.Err, &pe) || pe.Value != "bad file" || !strings.Contains(string(pe.Stack), "TestBatchPanic")) {
+			t.Errorf("panicking path gave %v, want a PanicError with its stack", r.Err)
+		}
+	}
+	if summary := wait(); summary.Succeeded != 2 || summary.Failed != 1 {
+		t.Errorf("summary %+v, want 2 succeeded and 1 failed", summary)
+	}
+}
+
+func TestDirectoryPanic(t *testing.T) {
+	key, _ := GenerateRandomKey()
+	mem, input := progressFixture(t, 3)
+	fsys := panicMemFS{MemFS: mem, name: "img1"}
+	var events []Event
+	opts := EncryptOptions{FS: fsys, Progress: func(e Event) { events = append(events, e) }}
+	err := EncryptDirectory(t.Context(), input, "enc", key, false, false, opts)
+	panics := Panics(err)
+	if len(panics) != 1 || ErrorCodeOf(err) != CodeInternal {
+		t.Fatalf("EncryptDirectory gave %v, want the one panic", err)
+	}
+	checkPathError(t, err.(interface{ Unwrap() []error }).Unwrap()[0], "encrypt", filepath.Join(input, "img1.png"))
+	for _, name := range []string{"img0.png.enc", "img2.png.enc"} {
+		if !exists(mem, filepath.Join("enc", name)) {
+			t.Errorf("%s not encrypted after another file panicked", name)
+		}
+	}
+	failed := false
+	for _, e := range events {
+		failed = failed || e.Path == filepath.Join(input, "img1.png") && errors.As(e.Err, new(*PanicError))
+	}
+	if !failed {
+		t.Error("no event reports the panic")
+	}
+
+	// A file on its own gives its panic too
+	err = EncryptFile(t.Context(), filepath.Join(input, "img1.png"), "img1.enc", key, false, EncryptOptions{FS: fsys})
+	if len(Panics(err)) != 1 {
+		t.Errorf("EncryptFile gave %v, want its panic", err)
+	}
+}
+
+func TestPanics(t *testing.T) {
+	a, b := &PanicError{Value: "a"}, &PanicError{Value: "b"}
+	err := errors.Join(&PathError{Op: "encrypt", Path: "a", Err: a}, errors.New("other"), errors.Join(b))
+	if panics := Panics(err); len(panics) != 2 || panics[0] != a || panics[1] != b {
+		t.Errorf("Panics gave %v, want both", panics)
+	}
+	if panics := Panics(nil); panics != nil {
+		t.Errorf("Panics(nil) = %v", panics)
+	}
+}
@@ -0,0 +1,36 @@
+package pixellock
+
+import "github.com/Amul-Thantharate/pixellock/pkg/stego"
+
+// Stego header flags; see package stego.
+const (
+	StegoFlagFile       = stego.FlagFile
+	StegoFlagEncrypted  = stego.FlagEncrypted
+	StegoFlagPassword   = stego.FlagPassword
+	StegoFlagCompressed = stego.FlagCompressed
+	StegoFlagSkipAlpha  = stego.FlagSkipAlpha
+	StegoFlagFragment   = stego.FlagFragment
+	StegoFlagRegion     = stego.FlagRegion
+)
+
+var (
+	// ErrPayloadHashMismatch is returned when an extracted file does not
+	// match the hash recorded when it was embedded.
+	ErrPayloadHashMismatch = stego.ErrPayloadHashMismatch
+	// ErrPayloadEncrypted is returned when revealing an encrypted payload
+	// without a key or password.
+	ErrPayloadEncrypted = stego.ErrPayloadEncrypted
+	// ErrPayloadCorrupted is returned when a payload fails its checksum.
+	ErrPayloadCorrupted = stego.ErrPayloadCorrupted
+)
+
+// Payload is the content carried by a stego image.
+type Payload = stego.Payload
+
+// PayloadSize returns the number of bytes p occupies once encoded,
+// compressed and encrypted for embedding with opts, not counting the stego
+// header, and whether compression was applied: it is skipped when it would
+// barely make the payload smaller.
+func PayloadSize(p Payload, opts StegoOptions) (size int, compressed bool, err error) {
+	return stego.PayloadSize(p, opts.engine()...)
+}
@@ -0,0 +1,102 @@
+package pixellock
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func binaryFixture() []byte {
+	data := make([]byte, 300)
+	for i := range data {
+		data[i] = byte(i * 31)
+	}
+	data[10], data[11] = 0x00, 0x00
+	return data
+}
+
+func TestMessageFileRoundTrip(t *testing.T) {
+	message := []byte("first line\r\nsecond line\r\n\r\n\x00\xff trailing\r\n")
+	path := filepath.Join(t.TempDir(), "message.txt")
+	if err := os.WriteFile(path, message, 0o644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	p, err := ReadMessageFile(path)
+	if err != nil {
+		t.Fatalf("ReadMessageFile failed: %v", err)
+	}
+	if p.IsFile() {
+		t.Errorf("message file read as a file payload named %q", p.Filename)
+	}
+
+	img := newTestNRGBA(32, 32)
+	if err := hideInImage(img, p, DefaultStegoOptions); err != nil {
+		t.Fatalf("hideInImage failed: %v", err)
+	}
+	got, err := revealFromImage(img, DefaultStegoOptions)
+	if err != nil {
+		t.Fatalf("revealFromImage failed: %v", err)
+	}
+	if !bytes.Equal(got.Data, message) {
+		t.Errorf("message = %q, want %q", got.Data, message)
+	}
+}
+
+func TestMessageFromPipe(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Pipe failed: %v", err)
+	}
+	message := bytes.Repeat([]byte("piped\n"), 12000) // More than a pipe buffers at once
+	go func() {
+		w.Write(message)
+		w.Close()
+	}()
+	p, err := ReadMessage(r)
+	r.Close()
+	if err != nil {
+		t.Fatalf("ReadMessage failed: %v", err)
+	}
+
+	img := newTestNRGBA(512, 512)
+	if err := hideInImage(img, p, DefaultStegoOptions); err != nil {
+		t.Fatalf("hideInImage failed: %v", err)
+	}
+	got, err := revealFromImage(img, DefaultStegoOptions)
+	if err != nil {
+		t.Fatalf("revealFromImage failed: %v", err)
+	}
+	if !bytes.Equal(got.Data, message) {
+		t.Error("piped message did not round trip")
+	}
+}
+
+func TestWritePayload(t *testing.T) {
+	tempDir := t.TempDir()
+	p := Payload{Data: binaryFixture(), Filename: "report.pdf"}
+
+	path, err := WritePayload(p, tempDir)
+	if err != nil {
+		t.Fatalf("WritePayload to directory failed: %v", err)
+	}
+	if path != filepath.Join(tempDir, "report.pdf") {
+		t.Errorf("WritePayload wrote to %s, want embedded filename", path)
+	}
+	written, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read written payload: %v", err)
+	}
+	if !bytes.Equal(written, p.Data) {
+		t.Errorf("written payload does not match")
+	}
+
+	explicit := filepath.Join(tempDir, "renamed.bin")
+	if path, err = WritePayload(p, explicit); err != nil || path != explicit {
+		t.Errorf("WritePayload to file = %s, %v; want %s", path, err, explicit)
+	}
+
+	if _, err := WritePayload(Payload{Data: []byte("text")}, tempDir); err == nil {
+		t.Error("WritePayload accepted a directory for a payload without a filename")
+	}
+}
@@ -0,0 +1,1849 @@
+// Package pixellock encrypts images with AES-256-GCM and hides data in
+// them with steganography. It holds everything the pixellock command does,
+// so that a Go program can encrypt and decrypt images without running it:
+// GenerateRandomKey, Encrypt and Decrypt work on bytes, LoadImage,
+// SaveImage, ImageToBytes and BytesToImage on images, and EncryptFile,
+// DecryptFile, EncryptDirectory and DecryptDirectory on files as the
+// encrypt and decrypt commands do.
+package pixellock
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"io"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/image/bmp"
+)
+
+const (
+	KeySize            = 32 // AES-256 key size (32 bytes)
+	EncryptedExtension = ".enc"
+	SaltSize           = 16      // Salt size for password-derived keys
+	KDFIterations      = 200_000 // PBKDF2-SHA256 iterations for password-derived keys
+)
+
+// GenerateRandomKey generates a random AES key.
+func GenerateRandomKey() ([]byte, error) {
+	key := make([]byte, KeySize)
+	_, err := rand.Read(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate key: %w", err)
+	}
+	return key, nil
+}
+
+// DecodeKey decodes a base64 encoded key and checks its size.
+func DecodeKey(keyBase64 string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(keyBase64)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode key: %w", err)
+	}
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("%w: key must be %d bytes when base64 decoded", ErrInvalidKeySize, KeySize)
+	}
+	return key, nil
+}
+
+// KeyFingerprint returns a short name of key, which tells keys apart
+// without giving away anything of them: 16 hex digits of a SHA-256 hash
+// of the key.
+func KeyFingerprint(key []byte) string {
+	sum := sha256.Sum256(append([]byte("pixellock key fingerprint\x00"), key...))
+	return hex.EncodeToString(sum[:8])
+}
+
+// DeriveKey derives an AES key from a password using PBKDF2-SHA256.
+func DeriveKey(password string, salt []byte) ([]byte, error) {
+	key, err := pbkdf2.Key(sha256.New, password, salt, KDFIterations, KeySize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive key: %w", err)
+	}
+	return key, nil
+}
+
+// Encrypt encrypts data using AES-256 GCM.
+func Encrypt(key []byte, plaintext []byte) ([]byte, error) {
+	return EncryptWithAAD(key, plaintext, nil)
+}
+
+// EncryptWithAAD encrypts data using AES-256 GCM, authenticating
+// additionalData along with it, which DecryptWithAAD must be given again.
+func EncryptWithAAD(key, plaintext, additionalData []byte) ([]byte, error) {
+	aesGCM, err := newSuiteAEAD(AESGCM, key)
+	if err != nil {
+		return nil, err
+	}
+	return sealWithAAD(aesGCM, plaintext, additionalData)
+}
+
+// sealWithAAD seals plaintext with aead under a random nonce, which it
+// returns in front of the ciphertext.
+func sealWithAAD(aead cipher.AEAD, plaintext, additionalData []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, fmt.Errorf("failed to create nonce: %w", err)
+	}
+
+	ciphertext := aead.Seal(nonce, nonce, plaintext, additionalData)
+	return ciphertext, nil
+}
+
+// Decrypt decrypts data using AES-256 GCM.
+func Decrypt(key []byte, ciphertext []byte) ([]byte, error) {
+	return DecryptWithAAD(key, ciphertext, nil)
+}
+
+// DecryptWithAAD decrypts data encrypted by EncryptWithAAD with the same
+// additional data.
+func DecryptWithAAD(key, ciphertext, additionalData []byte) ([]byte, error) {
+	aesGCM, err := newSuiteAEAD(AESGCM, key)
+	if err != nil {
+		return nil, err
+	}
+	return openWithAAD(aesGCM, ciphertext, additionalData)
+}
+
+// openWithAAD opens ciphertext sealed by sealWithAAD.
+func openWithAAD(aead cipher.AEAD, ciphertext, additionalData []byte) ([]byte, error) {
+	nonceSize := aead.NonceSize()
+	if len(ciphertext) < nonceSize+aead.Overhead() {
+		return nil, fmt.Errorf("ciphertext too short: %w", ErrAuthenticationFailed)
+	}
+
+	nonce, ciphertext := ciphertext[:nonceSize], ciphertext[nonceSize:]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, additionalData)
+	if err != nil {
+		return nil, ErrAuthenticationFailed
+	}
+	return plaintext, nil
+}
+
+// LoadImage loads an image from a file. An image claiming more than
+// DefaultMaxPixels fails with ErrImageTooLarge, before any is decoded.
+func LoadImage(filename string) (image.Image, error) {
+	return LoadImageFS(OSFS{}, filename)
+}
+
+// LoadImageFS loads an image from a file in fsys.
+func LoadImageFS(fsys FileSystem, filename string) (image.Image, error) {
+	return loadImage(fsys, filename, 0)
+}
+
+// loadImage is LoadImageFS refusing images over the limit of maxPixels,
+// as pixelLimit gives it.
+func loadImage(fsys FileSystem, filename string, maxPixels int64) (image.Image, error) {
+	f, err := fsys.Open(filename)
+	if err != nil {
+		return nil, openError(filename, err)
+	}
+	defer f.Close()
+
+	img, _, err := decodeImage(f, maxPixels)
+	if errors.Is(err, image.ErrFormat) {
+		err = ErrUnsupportedFormat
+	}
+	if err != nil {
+		return nil, &PathError{Op: "decode", Path: filename, Err: err}
+	}
+	return img, nil
+}
+
+// is16Bit reports whether img holds 16 bits per channel, as 16-bit PNGs and
+// TIFFs decode to.
+func is16Bit(img image.Image) bool {
+	switch img.ColorModel() {
+	case color.RGBA64Model, color.NRGBA64Model, color.Gray16Model:
+		return true
+	}
+	return false
+}
+
+// DetectImageFormat returns the format name of an image file, as reported by
+// the registered decoders (e.g. "png", "jpeg").
+func DetectImageFormat(filename string) (string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", fmt.Errorf("failed to open image: %w", err)
+	}
+	defer f.Close()
+
+	_, format, err := image.DecodeConfig(f)
+	if err != nil {
+		return "", fmt.Errorf("failed to decode image: %w", err)
+	}
+	return format, nil
+}
+
+// IsLossyFormat reports whether SaveImage would encode outputFormat with a
+// lossy codec.
+func IsLossyFormat(outputFormat string) bool {
+	switch format, _ := SplitImageFormat(outputFormat); format {
+	case "jpg", "jpeg":
+		return true
+	}
+	return false
+}
+
+// OutputFormats lists the output formats SaveImage writes. An empty format
+// means png.
+var OutputFormats = []string{"png", "jpg", "jpeg", "gif", "webp", "tif", "tiff", "bmp", "ppm", "pgm"}
+
+// CheckOutputFormat returns an error if SaveImage cannot write outputFormat
+// or does not understand its option. Only TIFF takes one, its compression,
+// and PPM and PGM, their encoding.
+func CheckOutputFormat(outputFormat string) error {
+	format, option := SplitImageFormat(outputFormat)
+	if format != "" && !slices.Contains(OutputFormats, format) {
+		return fmt.Errorf("unknown output format %q (want one of %s)", format, strings.Join(OutputFormats, ", "))
+	}
+	switch {
+	case format == "tif" || format == "tiff":
+		if option != "" {
+			return checkTIFFCompression(option)
+		}
+	case format == "ppm" || format == "pgm":
+		if option != "" {
+			return checkPNMEncoding(option)
+		}
+	case option != "":
+		return fmt.Errorf("output format %s takes no options", format)
+	}
+	return nil
+}
+
+// DefaultJPEGQuality is the quality of JPEG output when none is given.
+const DefaultJPEGQuality = 90
+
+// SaveOptions control how SaveImage encodes an image.
+type SaveOptions struct {
+	Format  string // Output format, one of OutputFormats with an optional option; png when empty
+	Quality int    // JPEG quality (1-100); DefaultJPEGQuality when zero
+
+	// PNGCompression is the compression of PNG output, one of the
+	// PNGCompression constants; PNGCompressionDefault when empty.
+	PNGCompression string
+
+	// EXIF is the EXIF block of the image, attached to JPEG, PNG and TIFF
+	// output unless Metadata is MetadataStrip. When it is not attached,
+	// the image is turned upright for the orientation it records instead.
+	EXIF     []byte
+	Metadata string // MetadataPreserve when empty
+
+	// AutoOrient turns the image upright even when its EXIF is attached,
+	// which then records it as upright.
+	AutoOrient bool
+
+	// Resize scales the image after it is turned.
+	Resize Resize
+
+	// TileRegion, when not empty, is the only part of a tiled image that
+	// decryption reads and writes. SaveImage ignores it.
+	TileRegion image.Rectangle
+
+	// Watermark is drawn on the image after it is scaled. The image is
+	// turned upright first, as for AutoOrient, so the watermark reads the
+	// right way up.
+	Watermark *Watermark
+
+	// SplitPages, when set, makes decryption write each page of a
+	// multi-page TIFF to its own file with SavePages. SaveImage ignores
+	// it.
+	SplitPages bool
+
+	// MetadataOnly, when set, makes decryption attach the metadata
+	// encrypted by EncryptMetadataFile back to the image, with
+	// DecryptMetadataFile, rather than decrypt an encrypted image.
+	// SaveImage ignores it.
+	MetadataOnly bool
+
+	// Verbose is ignored.
+	//
+	// Deprecated: decryption logs the JPEG quality images are written at
+	// to Logger, at debug level.
+	Verbose bool
+
+	// Workers is the number of files DecryptDirectory decrypts at once;
+	// runtime.NumCPU() when 0. SaveImage ignores it.
+	Workers int
+
+	// MaxPixels is the most pixels, width by height, a decrypted image may
+	// claim to be decoded; DefaultMaxPixels when 0, and any when negative.
+	MaxPixels int64
+
+	// Tags, when set, makes DecryptDirectory decrypt only the files with
+	// each of them, as Tags.Match picks them, reading no more than the
+	// tags of the others. SaveImage ignores it.
+	Tags Tags
+
+	// Progress, when set, is given the Events of decryption on a goroutine
+	// of its own, so that it cannot hold decryption up. Calls never
+	// overlap. SaveImage ignores it.
+	Progress func(Event)
+
+	// Logger, when set, is given what decryption logs; nothing is logged
+	// otherwise. SaveImage ignores it.
+	Logger Logger
+
+	// FS is the filesystem files are read from and written to; OSFS when
+	// nil.
+	FS FileSystem
+
+	// TracerProvider starts the spans of decryption; the global one when
+	// nil. SaveImage ignores it.
+	TracerProvider trace.TracerProvider
+}
+
+// ApplyMetadata returns the image and EXIF block SaveImage writes for img
+// under o: the EXIF of o when it is attached, or no EXIF and img turned
+// upright, then img scaled by o.Resize and watermarked.
+func (o SaveOptions) ApplyMetadata(img image.Image) (image.Image, []byte) {
+	img, exif := o.orient(img)
+	orientation := 1
+	if exif != nil {
+		orientation = EXIFOrientation(exif)
+	}
+	img = o.Resize.Apply(img, orientation)
+	if o.Watermark != nil {
+		img = o.Watermark.Apply(img)
+	}
+	return img, exif
+}
+
+// orient returns img, turned upright unless its EXIF is attached as it is,
+// and the EXIF block attached.
+func (o SaveOptions) orient(img image.Image) (image.Image, []byte) {
+	if o.EXIF == nil {
+		return img, nil
+	}
+	format, _ := SplitImageFormat(o.Format)
+	if format == "" {
+		format = "png"
+	}
+	switch {
+	case o.Metadata == MetadataStrip || !slices.Contains(exifFormats, format):
+		return Orient(img, EXIFOrientation(o.EXIF)), nil
+	case o.AutoOrient || o.Watermark != nil:
+		// A block that cannot be rewritten is dropped rather than have
+		// viewers turn the image a second time
+		upright, err := UprightEXIF(o.EXIF)
+		if err != nil {
+			upright = nil
+		}
+		return Orient(img, EXIFOrientation(o.EXIF)), upright
+	}
+	return img, o.EXIF
+}
+
+// JPEGQuality returns the JPEG quality of o, applying the default.
+func (o SaveOptions) JPEGQuality() int {
+	if o.Quality == 0 {
+		return DefaultJPEGQuality
+	}
+	return o.Quality
+}
+
+// CheckJPEGQuality returns an error unless quality is between 1 and 100.
+func CheckJPEGQuality(quality int) error {
+	if quality < 1 || quality > 100 {
+		return fmt.Errorf("invalid JPEG quality %d: must be between 1 and 100", quality)
+	}
+	return nil
+}
+
+// SaveImage saves an image to a file in opts.FS, in the format and JPEG
+// quality of opts. Supports PNG, JPEG, GIF, lossless WebP, BMP, PPM, PGM
+// and TIFF, whose compression follows a colon, as in "tiff:lzw".
+func SaveImage(filename string, img image.Image, opts SaveOptions) error {
+	if err := opts.Check(); err != nil {
+		return err
+	}
+	f, err := orOS(opts.FS).Create(filename)
+	if err != nil {
+		return fmt.Errorf("failed to create image file: %w", err)
+	}
+	defer f.Close()
+	return EncodeImage(f, img, opts)
+}
+
+// Check returns an error unless the options are valid.
+func (o SaveOptions) Check() error {
+	if err := CheckOutputFormat(o.Format); err != nil {
+		return err
+	}
+	if o.Quality != 0 {
+		if err := CheckJPEGQuality(o.Quality); err != nil {
+			return err
+		}
+	}
+	if err := CheckPNGCompression(o.PNGCompression); err != nil {
+		return err
+	}
+	return CheckMetadataMode(o.Metadata)
+}
+
+// CheckMetadataOnly returns an error when o sets MetadataOnly along with
+// options that change the image, which metadata-only decryption writes
+// as it is.
+func (o SaveOptions) CheckMetadataOnly() error {
+	if o.MetadataOnly && (o.Format != "" || !o.Resize.IsZero() || o.Watermark != nil || o.SplitPages || !o.TileRegion.Empty()) {
+		return fmt.Errorf("--metadata-only writes the image as it is; it takes no --output-format, --resize, watermark, --split-pages or --tile-region")
+	}
+	return nil
+}
+
+// EncodeImage writes img to w as SaveImage writes it to a file.
+func EncodeImage(w io.Writer, img image.Image, opts SaveOptions) error {
+	if err := opts.Check(); err != nil {
+		return err
+	}
+
+	// EXIF metadata is attached to a PNG or JPEG as it is written, and to
+	// other formats once encoded into memory
+	img, exif := opts.ApplyMetadata(img)
+	var buf bytes.Buffer
+	out := w
+	if exif != nil {
+		stream, err := exifWriter(w, opts.Format, exif)
+		if err != nil {
+			return fmt.Errorf("failed to attach EXIF metadata: %w", err)
+		}
+		if w = stream; stream == nil {
+			w = &buf
+		}
+	}
+
+	var err error
+	format, option := SplitImageFormat(opts.Format)
+	switch format {
+	case "jpg", "jpeg":
+		opt := &jpeg.Options{Quality: opts.JPEGQuality()}
+		err = jpeg.Encode(w, img, opt)
+		if err != nil {
+			return fmt.Errorf("failed to encode image to JPEG: %w", err)
+		}
+	case "gif": // Exact for paletted images, others are quantized
+		err = gif.Encode(w, img, nil)
+		if err != nil {
+			return fmt.Errorf("failed to encode image to GIF: %w", err)
+		}
+	case "webp": // Always lossless
+		err = EncodeWebP(w, img)
+		if err != nil {
+			return fmt.Errorf("failed to encode image to WebP: %w", err)
+		}
+	case "tif", "tiff":
+		if option == "" {
+			option = DefaultTIFFCompression
+		}
+		err = EncodeTIFF(w, img, option)
+		if err != nil {
+			return fmt.Errorf("failed to encode image to TIFF: %w", err)
+		}
+	case "bmp":
+		err = bmp.Encode(w, img)
+		if err != nil {
+			return fmt.Errorf("failed to encode image to BMP: %w", err)
+		}
+	case "ppm", "pgm":
+		if option == "" {
+			option = DefaultPNMEncoding
+		}
+		err = EncodePNM(w, img, format, option)
+		if err != nil {
+			return fmt.Errorf("failed to encode image to PNM: %w", err)
+		}
+	default: // Default to PNG
+		err = EncodePNG(w, img, opts.PNGCompression)
+		if err != nil {
+			return fmt.Errorf("failed to encode image to PNG: %w", err)
+		}
+	}
+	if w == &buf {
+		data, err := AttachEXIF(buf.Bytes(), format, exif)
+		if err != nil {
+			return fmt.Errorf("failed to attach EXIF metadata: %w", err)
+		}
+		if _, err := out.Write(data); err != nil {
+			return fmt.Errorf("failed to write image file: %w", err)
+		}
+	}
+	return nil
+}
+
+// ImageToBytes converts an image to a byte slice.
+func ImageToBytes(img image.Image) ([]byte, error) {
+	// Encode the image to PNG in memory. The bytes are encrypted, so
+	// encoding fast matters more than a small result
+	buf := new(bytes.Buffer) // Import "bytes"
+	err := EncodePNG(buf, img, PNGCompressionFast)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode image to bytes: %w", err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// BytesToImage converts a byte slice to an image, refusing one claiming
+// more than DefaultMaxPixels as LoadImage does.
+func BytesToImage(data []byte) (image.Image, error) {
+	return bytesToImage(data, 0)
+}
+
+// bytesToImage is BytesToImage refusing images over the limit of
+// maxPixels, as pixelLimit gives it.
+func bytesToImage(data []byte, maxPixels int64) (image.Image, error) {
+	img, _, err := decodeImage(bytes.NewReader(data), maxPixels)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode bytes to image: %w", err)
+	}
+	return img, nil
+}
+
+// OriginalOutputFormat and AutoOutputFormat are the output formats that
+// restore the format an image was encrypted from, as an empty one does.
+const (
+	OriginalOutputFormat = "original"
+	AutoOutputFormat     = "auto"
+)
+
+// originalFormatKeyword is the keyword of the PNG tEXt chunk recording the
+// format an encrypted image was read from.
+const originalFormatKeyword = "pixellock:original-format"
+
+// SetOriginalFormat returns a copy of the PNG data that records format as
+// the format the image was read from.
+func SetOriginalFormat(pngData []byte, format string) ([]byte, error) {
+	return addPNGText(pngData, originalFormatKeyword, format)
+}
+
+// addPNGText returns a copy of the PNG data with a tEXt chunk holding
+// keyword and text added at its end.
+func addPNGText(pngData []byte, keyword, text string) ([]byte, error) {
+	return addPNGChunk(pngData, pngChunk("tEXt", []byte(keyword+"\x00"+text)))
+}
+
+// addPNGChunk returns a copy of the PNG data with chunk, as pngChunk makes
+// it, added before its IEND chunk.
+func addPNGChunk(pngData, chunk []byte) ([]byte, error) {
+	var out bytes.Buffer
+	out.Write(pngSignature)
+	err := pngChunks(pngData, func(typ string, start, end int) bool {
+		if typ == "IEND" {
+			out.Write(chunk)
+		}
+		out.Write(pngData[start:end])
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// pngChunkBody returns the body of the first chunk of type typ in the PNG
+// data, and false when it has none.
+func pngChunkBody(pngData []byte, typ string) (body []byte, ok bool) {
+	pngChunks(pngData, func(t string, start, end int) bool {
+		if t != typ {
+			return true
+		}
+		body, ok = pngData[start+8:end-4], true
+		return false
+	})
+	return body, ok
+}
+
+// pngText returns the text of the first tEXt chunk with keyword in the PNG
+// data, and false when it has none.
+func pngText(pngData []byte, keyword string) (text string, ok bool) {
+	pngChunks(pngData, func(typ string, start, end int) bool {
+		k, t, _ := bytes.Cut(pngData[start+8:end-4], []byte{0})
+		if typ != "tEXt" || string(k) != keyword {
+			return true
+		}
+		text, ok = string(t), true
+		return false
+	})
+	return text, ok
+}
+
+// OriginalFormat returns the format recorded by SetOriginalFormat in the PNG
+// data. It returns png when none is recorded or SaveImage cannot write the
+// recorded format, as for AVIF, and gif, tiff or heif for the data of an
+// animated GIF, a multi-page TIFF or a HEIF image.
+func OriginalFormat(pngData []byte) string {
+	switch {
+	case IsGIFData(pngData):
+		return "gif"
+	case IsMultiPageTIFFData(pngData):
+		return "tiff"
+	case IsHEIFData(pngData):
+		return "heif"
+	}
+	switch format := strings.ToLower(recordedFormat(pngData)); format {
+	case "jpeg", "gif", "webp", "tiff", "bmp", "ppm", "pgm":
+		return format
+	}
+	return "png"
+}
+
+// ResolveOutputFormat returns the format to write decrypted data in:
+// outputFormat itself, or the format the image was encrypted from, and true,
+// when outputFormat is empty, original or auto. The note explains why the
+// image is written as png instead when its format cannot be restored.
+func ResolveOutputFormat(data []byte, outputFormat string) (format string, restored bool, note string) {
+	if outputFormat != "" && !strings.EqualFold(outputFormat, OriginalOutputFormat) && !strings.EqualFold(outputFormat, AutoOutputFormat) {
+		return outputFormat, false, ""
+	}
+	format = OriginalFormat(data)
+	switch recorded := recordedFormat(data); {
+	case IsGIFData(data) || IsMultiPageTIFFData(data) || IsHEIFData(data):
+	case recorded == "":
+		note = "no format was recorded when it was encrypted, so it is written as png"
+	case format != strings.ToLower(recorded):
+		note = fmt.Sprintf("it was encrypted from %s, which pixellock cannot write, so it is written as png", recorded)
+	}
+	return format, true, note
+}
+
+// imageFormatExtensions maps image formats to the file extension written
+// for them and the ones accepted as already matching.
+var imageFormatExtensions = map[string][]string{
+	"png":  {".png"},
+	"jpeg": {".jpg", ".jpeg"},
+	"jpg":  {".jpg", ".jpeg"},
+	"gif":  {".gif"},
+	"webp": {".webp"},
+	"tiff": {".tiff", ".tif"},
+	"tif":  {".tif", ".tiff"},
+	"bmp":  {".bmp"},
+	"ppm":  {".ppm", ".pnm"},
+	"pgm":  {".pgm", ".pnm"},
+	"heif": {".heic", ".heif"},
+	"heic": {".heic", ".heif"},
+	"avif": {".avif"},
+}
+
+// WithImageExtension returns filename with the extension of outputFormat,
+// replacing an extension that names another format. It returns filename
+// unchanged when its extension already matches or the format is unknown.
+func WithImageExtension(filename, outputFormat string) string {
+	format, _ := SplitImageFormat(outputFormat)
+	exts, ok := imageFormatExtensions[format]
+	ext := filepath.Ext(filename)
+	if !ok || slices.Contains(exts, strings.ToLower(ext)) {
+		return filename
+	}
+	if _, known := imageFormatExtensions[strings.ToLower(strings.TrimPrefix(ext, "."))]; !known {
+		ext = "" // Keep a dot that is part of the name, such as in scan.v2
+	}
+	return strings.TrimSuffix(filename, ext) + exts[0]
+}
+
+// recordedFormat returns the format recorded by SetOriginalFormat in the PNG
+// data, or an empty string.
+func recordedFormat(pngData []byte) string {
+	format, _ := pngText(pngData, originalFormatKeyword)
+	return format
+}
+
+// AnimatedGIFBytes returns the GIF at filename re-encoded with all of its
+// frames, delays, disposal methods and loop count, and true, when it is a
+// GIF with more than one frame. It returns false for any other image.
+func AnimatedGIFBytes(filename string) ([]byte, bool, error) {
+	if format, err := DetectImageFormat(filename); err != nil || format != "gif" {
+		return nil, false, nil
+	}
+	raw, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to open image: %w", err)
+	}
+	return animatedGIFData(raw)
+}
+
+// animatedGIFData is AnimatedGIFBytes for the image in raw.
+func animatedGIFData(raw []byte) ([]byte, bool, error) {
+	if !bytes.HasPrefix(raw, gifSignature) {
+		return nil, false, nil
+	}
+	g, err := gif.DecodeAll(bytes.NewReader(raw))
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to decode GIF: %w", err)
+	}
+	if len(g.Image) < 2 {
+		return nil, false, nil
+	}
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, g); err != nil {
+		return nil, false, fmt.Errorf("failed to encode GIF: %w", err)
+	}
+	return buf.Bytes(), true, nil
+}
+
+// MultiPageTIFFBytes returns the TIFF at filename re-encoded losslessly with
+// all of its pages, in order, and true, when it is a TIFF with more than one
+// page. It returns false for any other image. The EXIF metadata of the
+// first page is kept unless metadata is MetadataStrip, in which case every
+// page is turned upright for its own orientation instead.
+func MultiPageTIFFBytes(filename, metadata string) ([]byte, bool, error) {
+	if format, err := DetectImageFormat(filename); err != nil || format != "tiff" {
+		return nil, false, nil
+	}
+	raw, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to read image: %w", err)
+	}
+	return multiPageTIFFData(raw, metadata)
+}
+
+// multiPageTIFFData is MultiPageTIFFBytes for the image in raw.
+func multiPageTIFFData(raw []byte, metadata string) ([]byte, bool, error) {
+	if !IsMultiPageTIFFData(raw) {
+		return nil, false, nil
+	}
+	data, err := reencodeTIFFPages(raw, metadata, TIFFCompressionDeflate)
+	if err != nil {
+		return nil, false, err
+	}
+	return data, true, nil
+}
+
+// IsGIFData reports whether decrypted data holds an animated GIF, which
+// encryption keeps as a GIF, rather than a PNG.
+func IsGIFData(data []byte) bool {
+	return bytes.HasPrefix(data, []byte("GIF8"))
+}
+
+// KeepsEncryptedBytes reports whether decrypted data that holds an image in
+// its own format, an animated GIF, a multi-page TIFF or a HEIF image, is
+// written as it is for outputFormat.
+func KeepsEncryptedBytes(data []byte, outputFormat string) bool {
+	format, _ := SplitImageFormat(outputFormat)
+	switch {
+	case IsGIFData(data):
+		return format == "gif"
+	case IsMultiPageTIFFData(data):
+		return format == "tiff" || format == "tif"
+	case IsHEIFData(data):
+		return format == "heif" || format == "heic"
+	}
+	return false
+}
+
+// EncryptOptions control how an image is encrypted.
+type EncryptOptions struct {
+	Metadata string // MetadataPreserve when empty
+	Mode     string // ModeCipher when empty
+
+	// Regions, when set, are the only rectangles encrypted, with Redact;
+	// the rest of the image stays viewable.
+	Regions []image.Rectangle
+
+	// Detect, when DetectFaces, adds the faces FindFaces finds, widened
+	// by FaceMargin, to Regions. An image with no regions then is left
+	// unencrypted, or fails with RequireDetection.
+	Detect           string
+	FaceMargin       float64
+	RequireDetection bool
+
+	// Thumbnail, when set, is the longer side of an unencrypted JPEG
+	// preview written next to the encrypted file, or embedded in it with
+	// EmbedThumbnail.
+	Thumbnail      int
+	EmbedThumbnail bool
+
+	// Tile, when set, encrypts the image with EncryptTiled, in tiles of
+	// this many pixels a side, written as a directory of tile files with
+	// TileDir.
+	Tile    int
+	TileDir bool
+
+	// MetadataOnly encrypts the metadata of a JPEG or PNG alone, with
+	// EncryptMetadataFile, leaving its pixels public. The encrypted
+	// metadata goes into the image, or into a sidecar with
+	// MetadataSidecar.
+	MetadataOnly    bool
+	MetadataSidecar bool
+
+	// Cipher is the suite the stream EncryptFile writes is encrypted
+	// with; AESGCM when nil. Tiled, redacted, scrambled and metadata-only
+	// images are encrypted with AES-GCM, and take no other.
+	Cipher CipherSuite
+
+	// Workers is the number of images EncryptDirectory encrypts at once;
+	// runtime.NumCPU() when 0.
+	Workers int
+
+	// MaxPixels is the most pixels, width by height, an image may claim
+	// to be decoded; DefaultMaxPixels when 0, and any when negative.
+	MaxPixels int64
+
+	// MaxUnreadable is the fraction of the files EncryptDirectory finds
+	// that may be unreadable, past which it fails with an
+	// *UnreadableError before encrypting any; DefaultMaxUnreadable when 0.
+	// 1 encrypts what can be read however little that is.
+	MaxUnreadable float64
+
+	// Dedupe, when set, finds the images that duplicate one encrypted
+	// already, which are linked or referred to instead of encrypted
+	// again. It takes whole images alone, with no thumbnail but an
+	// embedded one, and needs OSFS.
+	Dedupe *Deduper
+
+	// Progress, when set, is given the Events of encryption on a goroutine
+	// of its own, so that it cannot hold encryption up. Calls never
+	// overlap.
+	Progress func(Event)
+
+	// Logger, when set, is given what encryption logs; nothing is logged
+	// otherwise.
+	Logger Logger
+
+	// FS is the filesystem images are read from and written to; OSFS when
+	// nil. Tiled and metadata-only encryption need OSFS.
+	FS FileSystem
+
+	// TracerProvider starts the spans of encryption; the global one when
+	// nil.
+	TracerProvider trace.TracerProvider
+}
+
+// cipherSuite returns the suite the options encrypt streams with.
+func (o EncryptOptions) cipherSuite() CipherSuite {
+	if o.Cipher == nil {
+		return AESGCM
+	}
+	return o.Cipher
+}
+
+// redacts reports whether the options encrypt regions of the image.
+func (o EncryptOptions) redacts() bool {
+	return len(o.Regions) > 0 || o.Detect != ""
+}
+
+// encodesAsEncrypted reports whether an image is encrypted whole and
+// nothing more is made of it, so that it can be encoded as it is encrypted
+// rather than held in memory encoded.
+func (o EncryptOptions) encodesAsEncrypted() bool {
+	return !o.redacts() && o.Mode != ModeScramble && o.Thumbnail == 0 && o.Dedupe == nil
+}
+
+// Check returns an error unless the options are valid and compatible.
+func (o EncryptOptions) Check() error {
+	if err := CheckMetadataMode(o.Metadata); err != nil {
+		return err
+	}
+	if err := CheckMode(o.Mode); err != nil {
+		return err
+	}
+	if err := CheckDetect(o.Detect); err != nil {
+		return err
+	}
+	if o.FaceMargin < 0 {
+		return fmt.Errorf("invalid face margin %g: must not be negative", o.FaceMargin)
+	}
+	if o.redacts() && o.Mode == ModeScramble {
+		return fmt.Errorf("regions cannot be combined with the %s mode", ModeScramble)
+	}
+	if o.Thumbnail != 0 {
+		if err := CheckThumbnailSize(o.Thumbnail); err != nil {
+			return err
+		}
+	}
+	if o.EmbedThumbnail && o.Thumbnail == 0 {
+		return fmt.Errorf("an embedded thumbnail needs a thumbnail size")
+	}
+	if o.Thumbnail > 0 && (o.redacts() || o.Mode == ModeScramble) {
+		return fmt.Errorf("redacted and scrambled images are viewable already and take no thumbnail")
+	}
+	if o.MaxUnreadable < 0 || o.MaxUnreadable > 1 {
+		return fmt.Errorf("invalid unreadable fraction %g: must be from 0 to 1", o.MaxUnreadable)
+	}
+	if o.Tile < 0 || o.Tile > 0 && o.Tile < MinTileSize {
+		return fmt.Errorf("invalid tile size %d: must be at least %d", o.Tile, MinTileSize)
+	}
+	if o.TileDir && o.Tile == 0 {
+		return fmt.Errorf("a tile directory needs a tile size")
+	}
+	if o.Tile > 0 && (o.redacts() || o.Mode == ModeScramble || o.Thumbnail > 0) {
+		return fmt.Errorf("tiled images cannot be redacted, scrambled or given a thumbnail")
+	}
+	if o.Cipher != nil && o.Cipher != AESGCM && (o.redacts() || o.Mode == ModeScramble || o.Tile > 0 || o.MetadataOnly) {
+		return fmt.Errorf("only whole images can be encrypted with cipher %d; tiled, redacted, scrambled and metadata-only images use AES-GCM", o.Cipher.ID())
+	}
+	if o.MetadataSidecar && !o.MetadataOnly {
+		return fmt.Errorf("a metadata sidecar needs --metadata-only")
+	}
+	if o.MetadataOnly && (o.redacts() || o.Mode == ModeScramble || o.Thumbnail > 0 || o.Tile > 0) {
+		return fmt.Errorf("metadata-only encryption leaves the pixels alone; it cannot be combined with regions, scrambling, thumbnails or tiles")
+	}
+	if o.Dedupe != nil && (o.redacts() || o.Mode == ModeScramble || o.Tile > 0 || o.MetadataOnly) {
+		return fmt.Errorf("deduplication takes whole images; it cannot be combined with regions, scrambling, tiles or metadata-only encryption")
+	}
+	if o.Dedupe != nil && o.Thumbnail > 0 && !o.EmbedThumbnail {
+		return fmt.Errorf("deduplication cannot link a thumbnail written next to its output; embed it instead")
+	}
+	return nil
+}
+
+// CheckOutput refuses an output file named for a lossy format when the
+// options write a viewable PNG, which must not be recompressed lossily
+// without losing the image.
+func (o EncryptOptions) CheckOutput(filename string) error {
+	if !o.redacts() && o.Mode != ModeScramble {
+		return nil
+	}
+	if format := strings.TrimPrefix(filepath.Ext(filename), "."); IsLossyFormat(format) {
+		return fmt.Errorf("%s: redacted and scrambled images are lossless PNGs; name the output .png", filename)
+	}
+	return nil
+}
+
+// StoredMetadata returns the EXIF metadata mode the image is read with.
+// Redacted and scrambled images can be read by anyone, so they keep no
+// EXIF metadata, and are turned upright as viewers show them.
+func (o EncryptOptions) StoredMetadata() string {
+	if o.redacts() || o.Mode == ModeScramble {
+		return MetadataStrip
+	}
+	return o.Metadata
+}
+
+// ReadImageForEncryption returns the bytes encryption stores for the image
+// at filename: a PNG recording the format the image was read from, or the
+// image in its own format for HEIF images, which cannot be decoded, and
+// animated GIFs and multi-page TIFFs, whose frames and pages a PNG cannot
+// hold. The PNG carries the EXIF
+// metadata of a JPEG, PNG or TIFF unless metadata is MetadataStrip, in
+// which case the image is turned upright for its orientation instead.
+func ReadImageForEncryption(filename, metadata string) ([]byte, error) {
+	data, release, err := readImageForEncryption(OSFS{}, filename, metadata, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return bytes.Clone(data), nil
+}
+
+// readImageForEncryption is ReadImageForEncryption for a file in fsys,
+// read and encoded into pooled buffers: the bytes it returns may only be
+// used until release is called, which must be once they no longer are.
+func readImageForEncryption(fsys FileSystem, filename, metadata string, maxPixels int64) (data []byte, release func(), err error) {
+	f, err := fsys.Open(filename)
+	if err != nil {
+		return nil, nil, openError(filename, err)
+	}
+	defer f.Close()
+	var size int64
+	if info, err := f.Stat(); err == nil {
+		size = info.Size()
+	}
+	raw, err := readImageBuffer(f, size)
+	if err != nil {
+		return nil, nil, &PathError{Op: "read", Path: filename, Err: err}
+	}
+	encoded := getImageBuffer(0) // Grown once the image's size is known
+	release = func() {
+		putImageBuffer(raw)
+		putImageBuffer(encoded)
+	}
+	data, err = imageForEncryption(raw.Bytes(), metadata, maxPixels, encoded)
+	if err != nil {
+		release()
+		return nil, nil, pathError("decode", filename, err)
+	}
+	return data, release, nil
+}
+
+// openImageForEncryption is readImageForEncryption for an image that is
+// encrypted as it is read: the reader returned encodes the PNG as it is
+// read, from the image decoded, rather than into memory first, and the
+// file read is let go of once decoded. Its bytes are those
+// ReadImageForEncryption returns. q is given encrypt events as they are
+// read, of a Total that is a guess until the last. The reader must be
+// closed once done with, read to its end or not.
+func openImageForEncryption(fsys FileSystem, filename, metadata string, maxPixels int64, q *eventQueue) (*imageReader, error) {
+	f, err := fsys.Open(filename)
+	if err != nil {
+		return nil, openError(filename, err)
+	}
+	defer f.Close()
+	var size int64
+	if info, err := f.Stat(); err == nil {
+		size = info.Size()
+	}
+	raw, err := readImageBuffer(f, size)
+	if err != nil {
+		return nil, &PathError{Op: "read", Path: filename, Err: err}
+	}
+	p, err := decodeForEncryption(raw.Bytes(), metadata, maxPixels)
+	if err != nil {
+		putImageBuffer(raw)
+		return nil, pathError("decode", filename, err)
+	}
+	r := &imageReader{read: int64(raw.Len()), format: "png", q: q, event: Event{Phase: PhaseEncrypt, Path: filename, Total: int64(len(p.data))}}
+	if p.img == nil {
+		r.format = storedFormat(p.data)
+		r.r, r.release = bytes.NewReader(p.data), func() { putImageBuffer(raw) }
+		return r, nil
+	}
+	putImageBuffer(raw)
+	r.event.Total = int64(encodedSizeHint(p.img.Bounds()))
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		var err error
+		defer close(done)
+		defer func() { pw.CloseWithError(err) }()
+		defer recoverPanic(&err)
+		err = p.encode(pw)
+	}()
+	r.r, r.release = pr, func() {
+		pr.CloseWithError(errImageUnread)
+		<-done
+	}
+	return r, nil
+}
+
+// errImageUnread stops the encoding of an image whose reader is closed
+// before its end.
+var errImageUnread = errors.New("image not read")
+
+// An imageReader reads the bytes encryption stores for an image, as
+// openImageForEncryption opens them.
+type imageReader struct {
+	r       io.Reader
+	read    int64  // Bytes of the image file
+	format  string // Of the bytes, as storedFormat gives it
+	release func()
+	q       *eventQueue
+	event   Event
+	ended   bool
+}
+
+func (r *imageReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.event.Done += int64(n)
+	switch {
+	case err == io.EOF && !r.ended:
+		r.event.Total, r.ended = r.event.Done, true // Known at last
+	case n == 0:
+		return n, err
+	case r.event.Done >= r.event.Total:
+		r.event.Total = r.event.Done + 1
+	}
+	r.q.emit(r.event)
+	return n, err
+}
+
+func (r *imageReader) Close() error {
+	r.release()
+	return nil
+}
+
+// imageForEncryption is ReadImageForEncryption for the image file read
+// into raw, encoding a PNG into the empty buffer buf. The bytes it returns
+// may be those of raw or buf.
+func imageForEncryption(raw []byte, metadata string, maxPixels int64, buf *bytes.Buffer) ([]byte, error) {
+	p, err := decodeForEncryption(raw, metadata, maxPixels)
+	if err != nil || p.img == nil {
+		return p.data, err
+	}
+	buf.Grow(encodedSizeHint(p.img.Bounds()))
+	if err := p.encode(buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// A plainImage is an image as encryption reads it: data, stored as it is,
+// or else img, stored as a PNG recording format and carrying exif.
+type plainImage struct {
+	data   []byte
+	img    image.Image
+	format string
+	exif   []byte
+}
+
+// decodeForEncryption reads the image file read into raw for encryption,
+// as ReadImageForEncryption does, but for encoding a decoded image. The
+// data it returns may be that of raw; the image does not hold it.
+func decodeForEncryption(raw []byte, metadata string, maxPixels int64) (plainImage, error) {
+	// HEIF images are encrypted as they are
+	if IsHEIFData(raw) {
+		return plainImage{data: raw}, nil
+	}
+
+	// Animated GIFs are encrypted as GIFs, keeping every frame
+	data, ok, err := animatedGIFData(raw)
+	if err != nil || ok {
+		return plainImage{data: data}, err
+	}
+
+	// Multi-page TIFFs are encrypted as TIFFs, keeping every page
+	data, ok, err = multiPageTIFFData(raw, metadata)
+	if err != nil || ok {
+		return plainImage{data: data}, err
+	}
+
+	img, format, err := decodeImage(bytes.NewReader(raw), maxPixels)
+	if errors.Is(err, image.ErrFormat) {
+		err = ErrUnsupportedFormat
+	}
+	if err != nil {
+		return plainImage{}, err
+	}
+	exif, err := ReadEXIF(raw)
+	if err != nil {
+		return plainImage{}, err
+	}
+	if exif != nil && metadata == MetadataStrip {
+		img, exif = Orient(img, EXIFOrientation(exif)), nil
+	}
+	switch img.(type) {
+	case *image.YCbCr, *image.CMYK:
+		// JPEGs have 8 bits per channel, which the PNG encoder would widen
+		// to 16 for these color models
+		img = toNRGBA(img)
+	}
+	return plainImage{img: img, format: format, exif: exif}, nil
+}
+
+// encode writes the image of p to w as a fast PNG, with its EXIF metadata
+// in an eXIf chunk before the image data and the format it was read from
+// recorded after, so that decryption can restore it.
+func (p plainImage) encode(w io.Writer) error {
+	var exif []byte
+	if p.exif != nil {
+		exif = pngChunk("eXIf", p.exif)
+	}
+	chunks := &pngChunkWriter{w: w, insert: func(typ string) []byte {
+		switch {
+		case typ == "IDAT" && exif != nil:
+			defer func() { exif = nil }() // Before the first alone
+			return exif
+		case typ == "IEND":
+			return pngChunk("tEXt", []byte(originalFormatKeyword+"\x00"+p.format))
+		}
+		return nil
+	}}
+	if err := EncodePNG(chunks, p.img, PNGCompressionFast); err != nil {
+		return fmt.Errorf("failed to encode image to bytes: %w", err)
+	}
+	return nil
+}
+
+// EncryptImage reads an image file from src and writes it to dst encrypted
+// with key, as EncryptFile does with no options: the file written decrypts
+// with DecryptFile or DecryptImage. Nothing touches the filesystem, and
+// the image is held in memory whole. Once ctx is done it returns
+// ctx.Err().
+func EncryptImage(ctx context.Context, key []byte, dst io.Writer, src io.Reader) error {
+	raw, err := io.ReadAll(src)
+	if err != nil {
+		return fmt.Errorf("failed to read image: %w", err)
+	}
+	buf := getImageBuffer(0)
+	defer putImageBuffer(buf)
+	data, err := imageForEncryption(raw, MetadataPreserve, 0, buf)
+	if err != nil {
+		return err
+	}
+	if _, err := dst.Write(formatBlock(storedFormat(data))); err != nil {
+		return fmt.Errorf("failed to write: %w", err)
+	}
+	return EncryptStream(ctx, key, dst, bytes.NewReader(data))
+}
+
+// ImageFileError returns why the file at filename is not an image pixellock
+// can load, or nil if it is one.
+func ImageFileError(filename string) error {
+	return imageFileError(OSFS{}, filename)
+}
+
+func isImageFile(filename string) bool {
+	// Any format with a registered decoder can be loaded
+	return ImageFileError(filename) == nil
+}
+
+// imageFileError is ImageFileError for a file in fsys.
+func imageFileError(fsys FileSystem, filename string) error {
+	_, err := probeImage(fsys, filename, 0)
+	return err
+}
+
+// EncryptFile encrypts the image at inputFilename with key, as opts says,
+// and writes it to outputFilename, creating its directory. An existing
+// output file is left alone unless overwrite is set. Progress and notes
+// are printed to standard output, as the encrypt command shows them. Once
+// ctx is done it returns ctx.Err(), leaving no output file behind.
+func EncryptFile(ctx context.Context, inputFilename, outputFilename string, key []byte, overwrite bool, opts EncryptOptions) error {
+	q := newEventQueue(opts.Progress)
+	defer q.close()
+	return pathError("encrypt", inputFilename, encryptFile(ctx, inputFilename, outputFilename, newKeyCipher(key), overwrite, opts, nil, q))
+}
+
+// encryptFile is EncryptFile with the ciphers of the key made by keys,
+// emitting its events to q. probe, when set, is the header of the image
+// read as its directory was walked.
+func encryptFile(ctx context.Context, inputFilename, outputFilename string, keys *keyCipher, overwrite bool, opts EncryptOptions, probe *imageProbe, q *eventQueue) (err error) {
+	logger, fsys := orNop(opts.Logger), orOS(opts.FS)
+	ctx, span := tracer(opts.TracerProvider).Start(ctx, SpanEncryptFile, trace.WithAttributes(attribute.String(AttrInput, inputFilename), attribute.String(AttrOutput, outputFilename)))
+	defer func() { endSpan(span, err) }()
+	defer func() {
+		if err != nil {
+			q.emit(Event{Phase: PhaseEncrypt, Path: inputFilename, Err: err})
+		}
+	}()
+	defer recoverPanic(&err)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	// Check if the output file exists and if overwriting is allowed
+	if exists(fsys, outputFilename) && !overwrite {
+		// File exists and overwrite is not allowed
+		q.emit(Event{Phase: PhaseSkip, Path: inputFilename, Output: outputFilename, Err: outputExistsError(outputFilename)})
+		span.SetAttributes(attribute.Bool(AttrSkipped, true))
+		return nil
+	}
+
+	// Redacted and scrambled images are written as PNGs
+	if err := opts.CheckOutput(outputFilename); err != nil {
+		return err
+	}
+
+	// An image whose header, read as its directory was walked, claims too
+	// many pixels is not opened again
+	if probe != nil {
+		if err := checkPixels(probe.Width, probe.Height, opts.MaxPixels); err != nil {
+			return pathError("decode", inputFilename, err)
+		}
+	}
+
+	// Only the metadata is encrypted, leaving the pixels as they are
+	if opts.MetadataOnly {
+		if err := needOS(fsys, "metadata-only encryption"); err != nil {
+			return err
+		}
+		if err := EncryptMetadataFile(inputFilename, outputFilename, keys.key, opts.MetadataSidecar); err != nil {
+			logger.Error("failed to encrypt metadata", "path", inputFilename, "err", err)
+			return err
+		}
+		q.emit(Event{Phase: PhaseWrite, Path: inputFilename, Output: outputFilename})
+		return nil
+	}
+
+	// Very large images are encrypted a tile at a time
+	if opts.Tile > 0 {
+		if err := needOS(fsys, "tiled encryption"); err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(outputFilename), os.ModeDir|0755); err != nil {
+			logger.Error("failed to create output directory", "path", inputFilename, "err", err)
+			return err
+		}
+		if err := EncryptTiled(inputFilename, outputFilename, keys.key, opts); err != nil {
+			logger.Error("failed to encrypt", "path", inputFilename, "err", err)
+			return err
+		}
+		q.emit(Event{Phase: PhaseWrite, Path: inputFilename, Output: outputFilename})
+		return nil
+	}
+
+	// Read the image, as a PNG or, when a PNG cannot hold it, as it is. An
+	// image to be encrypted whole, and nothing else, is encoded as it is
+	// encrypted, holding no more than the image decoded
+	_, load := startPhase(ctx, SpanLoad)
+	var imgBytes []byte
+	var plain *imageReader
+	if opts.encodesAsEncrypted() {
+		plain, err = openImageForEncryption(fsys, inputFilename, opts.StoredMetadata(), opts.MaxPixels, q)
+		if err == nil {
+			load.SetAttributes(attribute.Int64(AttrBytesRead, plain.read))
+			defer plain.Close()
+		}
+	} else {
+		var release func()
+		imgBytes, release, err = readImageForEncryption(fsys, inputFilename, opts.StoredMetadata(), opts.MaxPixels)
+		load.SetAttributes(attribute.Int(AttrBytesRead, len(imgBytes)))
+		if err == nil {
+			defer release() // Once every write of imgBytes has returned
+		}
+	}
+	endSpan(load, err)
+	if err != nil {
+		logger.Error("failed to read image", "path", inputFilename, "err", err)
+		return err
+	}
+
+	// An image encrypted already is linked or referred to instead
+	if opts.Dedupe != nil {
+		if err := needOS(fsys, "deduplication"); err != nil {
+			return err
+		}
+		original, done, err := opts.Dedupe.claim(opts.Dedupe.key(imgBytes, keys, opts), outputFilename, logger)
+		if err != nil {
+			logger.Error("failed to deduplicate", "path", inputFilename, "err", err)
+			return err
+		}
+		if original != "" {
+			if exists(fsys, outputFilename) {
+				q.emit(Event{Phase: PhaseWrite, Path: inputFilename, Output: outputFilename})
+			} else {
+				q.emit(Event{Phase: PhaseSkip, Path: inputFilename, Output: outputFilename}) // A reference stands for it
+			}
+			logger.Info("duplicate image; a link or reference stands for it", "path", inputFilename, "original", original, "output", outputFilename)
+			return nil
+		}
+		defer func() { done(err) }()
+	}
+
+	// Add the faces found to the regions to redact, leaving an image with
+	// none unencrypted
+	if opts.Detect == DetectFaces {
+		faces, err := findFacesInData(imgBytes, opts.FaceMargin, opts.MaxPixels)
+		if err != nil {
+			logger.Error("failed to detect faces", "path", inputFilename, "err", err)
+			return err
+		}
+		logger.Info("faces found", "path", inputFilename, "faces", len(faces))
+		if len(faces) == 0 && len(opts.Regions) == 0 {
+			if opts.RequireDetection {
+				return fmt.Errorf("%s: no faces found", inputFilename)
+			}
+			logger.Warn("no faces found; left unencrypted", "path", inputFilename)
+			return nil
+		}
+		opts.Regions = slices.Concat(opts.Regions, faces)
+	}
+
+	// Encrypt only the regions of the image, or scramble it into a
+	// viewable PNG; the whole image is encrypted as it is written
+	var ciphertext []byte
+	if len(opts.Regions) > 0 || opts.Mode == ModeScramble {
+		_, span := startPhase(ctx, SpanEncrypt)
+		if len(opts.Regions) > 0 {
+			ciphertext, err = redact(keys.key, imgBytes, opts.Regions, opts.MaxPixels)
+		} else {
+			ciphertext, err = scramble(keys.key, imgBytes, opts.MaxPixels)
+		}
+		endSpan(span, err)
+	}
+	if err != nil {
+		logger.Error("failed to encrypt", "path", inputFilename, "err", err)
+		return err
+	}
+
+	// Make the unencrypted preview, which an image that cannot be decoded
+	// goes without
+	var thumb, embedded []byte
+	if opts.Thumbnail > 0 {
+		if thumb, err = makeThumbnail(imgBytes, opts.Thumbnail, opts.MaxPixels); err != nil {
+			logger.Warn("no thumbnail", "path", inputFilename, "err", err)
+		} else if opts.EmbedThumbnail {
+			embedded, thumb = EmbedThumbnail(thumb, nil), nil
+		}
+	}
+
+	// Save the encrypted data to a new file
+	err = fsys.MkdirAll(filepath.Dir(outputFilename), os.ModeDir|0755) // Ensure output directory exists
+	if err != nil {
+		logger.Error("failed to create output directory", "path", inputFilename, "err", err)
+		return err
+	}
+
+	encrypted := Event{Phase: PhaseEncrypt, Path: inputFilename, Total: int64(len(imgBytes))}
+	if ciphertext != nil {
+		encrypted.Done = encrypted.Total
+		q.emit(encrypted)
+	}
+	var src io.Reader = &progressReader{r: bytes.NewReader(imgBytes), q: q, event: encrypted}
+	if plain != nil {
+		src = plain // Which gives its own events
+	}
+	if ciphertext == nil {
+		format := storedFormat(imgBytes)
+		if plain != nil {
+			format = plain.format
+		}
+		embedded = append(embedded, formatBlock(format)...)
+	}
+	err = writeEncrypted(ctx, fsys, outputFilename, opts.cipherSuite(), keys, embedded, ciphertext, src)
+	if err != nil && errors.Is(err, ctx.Err()) {
+		return err
+	}
+	if err != nil {
+		logger.Error("failed to write encrypted data to file", "path", inputFilename, "err", err)
+		return err
+	}
+	if thumb != nil {
+		if err := writeFile(fsys, ThumbnailPath(outputFilename), thumb); err != nil {
+			logger.Error("failed to write thumbnail", "path", inputFilename, "err", err)
+			return err
+		}
+	}
+	written := Event{Phase: PhaseWrite, Path: inputFilename, Output: outputFilename}
+	if ciphertext == nil {
+		written.Cipher = CipherName(opts.cipherSuite())
+	}
+	q.emit(written)
+	return nil
+}
+
+// writeEncrypted writes the file named filename in fsys: embedded, the
+// thumbnail and format in front of the ciphertext, then the ciphertext or,
+// when there is none, what is read from plaintext encrypted with suite and
+// the key of keys by EncryptStreamWith as it is written. The file is
+// written beside filename first and renamed into place, so that a failure,
+// or ctx being done, leaves neither a partial file nor the temporary one.
+func writeEncrypted(ctx context.Context, fsys FileSystem, filename string, suite CipherSuite, keys *keyCipher, embedded, ciphertext []byte, plaintext io.Reader) (err error) {
+	tmp := filename + ".tmp"
+	f, err := fsys.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	if _, err = w.Write(embedded); err == nil {
+		if ciphertext != nil {
+			_, err = w.Write(ciphertext)
+		} else {
+			_, span := startPhase(ctx, SpanEncrypt, attribute.String(AttrCipher, CipherName(suite)))
+			err = encryptStream(ctx, suite, keys, w, plaintext)
+			endSpan(span, err)
+		}
+	}
+	_, span := startPhase(ctx, SpanWrite)
+	defer func() { endSpan(span, err) }()
+	if err == nil {
+		err = w.Flush()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = fsys.Rename(tmp, filename)
+	}
+	if err != nil {
+		fsys.Remove(tmp)
+		return err
+	}
+	setBytesWritten(span, fsys, filename)
+	return nil
+}
+
+// writeWhole writes the file filename in fsys with write, through a
+// temporary file renamed to it once written, so that a write cut short,
+// as by an interrupted run, leaves no file there to be taken for whole.
+func writeWhole(fsys FileSystem, filename string, write func(io.Writer) error) error {
+	tmp := filename + ".tmp"
+	f, err := fsys.Create(tmp)
+	if err != nil {
+		return err
+	}
+	err = write(f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = fsys.Rename(tmp, filename)
+	}
+	if err != nil {
+		fsys.Remove(tmp)
+	}
+	return err
+}
+
+// EncryptDirectory encrypts every image in inputDir, and its
+// subdirectories when recursive is set, with EncryptFile, writing each to
+// the same relative path under outputDir with EncryptedExtension, or the
+// extension of redacted or scrambled images, appended. A failure on one
+// image is logged to opts.Logger and does not stop the others; a panic on
+// one does not either, but is returned, as a *PanicError for each image
+// joined, once the others are done. Once ctx is done no more images are
+// started, those being encrypted are abandoned without output, and it
+// returns ctx.Err().
+func EncryptDirectory(ctx context.Context, inputDir, outputDir string, key []byte, recursive bool, overwrite bool, opts EncryptOptions) error {
+	return encryptDirectory(ctx, inputDir, outputDir, newKeyCipher(key), recursive, overwrite, opts)
+}
+
+// encryptDirectory is EncryptDirectory with the ciphers of the key made by
+// keys, which every image shares.
+func encryptDirectory(ctx context.Context, inputDir, outputDir string, keys *keyCipher, recursive bool, overwrite bool, opts EncryptOptions) (err error) {
+	ext := EncryptedExtension
+	switch {
+	case len(opts.Regions) > 0 || opts.Detect != "":
+		ext = RedactedExtension
+	case opts.Mode == ModeScramble:
+		ext = ScrambledExtension
+	}
+	ctx, span := tracer(opts.TracerProvider).Start(ctx, SpanEncryptDirectory, trace.WithAttributes(attribute.String(AttrInput, inputDir), attribute.String(AttrOutput, outputDir)))
+	defer func() { endSpan(span, err) }()
+	q := newEventQueue(opts.Progress)
+	defer q.close()
+	logger, fsys := orNop(opts.Logger), orOS(opts.FS)
+	// Read the header of each file once, as it is found, keeping it for
+	// encryption. An image too large to decode is kept, to fail as the
+	// others are encrypted
+	probes := map[string]imageProbe{}
+	var unreadableFiles []error
+	files, err := collectSource(ctx, WalkSourceFS(fsys, inputDir, recursive, func(path string, info fs.FileInfo) bool {
+		// Any format with a registered decoder can be loaded
+		probe, err := probeImage(fsys, path, opts.MaxPixels)
+		if unreadable(err) {
+			unreadableFiles = append(unreadableFiles, pathError("read", path, err))
+		}
+		if err != nil && !errors.Is(err, ErrImageTooLarge) {
+			// Say why, so files are not left out silently
+			logger.Info("skipping", "path", path, "err", err)
+			return false
+		}
+		probes[path] = probe
+		q.emit(Event{Phase: PhaseScan, Path: path, Done: int64(len(probes))})
+		return true
+	}))
+	if err == nil {
+		// So many unreadable files are likely a filesystem not mounted,
+		// reported before anything is encrypted
+		if err := checkUnreadable(inputDir, len(files), unreadableFiles, opts.maxUnreadable()); err != nil {
+			return err
+		}
+		q.emit(Event{Phase: PhaseScan, Path: inputDir, Done: int64(len(files)), Total: int64(len(files))})
+	}
+	span.SetAttributes(attribute.Int(AttrFiles, len(files)))
+
+	// Encrypt each image file found, on a worker per CPU unless opts says
+	// otherwise
+	batch := BatchProcessor{
+		Source:  FileSource(files),
+		Op:      "encrypt",
+		Workers: opts.Workers,
+		Operation: func(ctx context.Context, input string) (string, error) {
+			relPath, err := filepath.Rel(inputDir, input)
+			if err != nil {
+				return "", fmt.Errorf("failed to get relative path: %w", err)
+			}
+			output := joinName(outputDir, relPath+ext) // Append .enc, .redacted.png or .scrambled.png
+			probe := probes[input]
+			return output, encryptFile(ctx, input, output, keys, overwrite, opts, &probe, q)
+		},
+	}
+	var panics []error
+	results, wait := batch.Run(ctx)
+	for r := range results {
+		if r.Err != nil && ctx.Err() == nil {
+			logger.Error("failed to encrypt", "path", r.Input, "err", r.Err)
+		}
+		if len(Panics(r.Err)) > 0 {
+			panics = append(panics, pathError("encrypt", r.Input, r.Err))
+		}
+	}
+	wait()
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err != nil {
+		logger.Error("failed to walk directory", "path", inputDir, "err", err)
+		return err
+	}
+
+	return errors.Join(panics...)
+}
+
+// DecryptFile decrypts the file at inputFilename, encrypted by
+// EncryptFile, with key and writes the image to outputFilename as save
+// says, restoring the format it was encrypted from unless save names
+// another, in which case the extension of outputFilename is fixed to
+// match. An existing output file is left alone unless overwrite is set.
+// Progress and notes are printed to standard output, as the decrypt
+// command shows them. Once ctx is done it returns ctx.Err() without
+// writing the image.
+func DecryptFile(ctx context.Context, inputFilename, outputFilename string, key []byte, overwrite bool, save SaveOptions) error {
+	q := newEventQueue(save.Progress)
+	defer q.close()
+	return pathError("decrypt", inputFilename, decryptFile(ctx, inputFilename, outputFilename, newKeyCipher(key), overwrite, save, q))
+}
+
+// decryptFile is DecryptFile with the ciphers of the key made by keys,
+// emitting its events to q.
+func decryptFile(ctx context.Context, inputFilename, outputFilename string, keys *keyCipher, overwrite bool, save SaveOptions, q *eventQueue) (err error) {
+	logger, fsys := orNop(save.Logger), orOS(save.FS)
+	ctx, span := tracer(save.TracerProvider).Start(ctx, SpanDecryptFile, trace.WithAttributes(attribute.String(AttrInput, inputFilename), attribute.String(AttrOutput, outputFilename)))
+	defer func() { endSpan(span, err) }()
+	defer func() {
+		if err != nil {
+			q.emit(Event{Phase: PhaseDecrypt, Path: inputFilename, Err: err})
+		}
+	}()
+	defer recoverPanic(&err)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	// Check if the output file exists and if overwriting is allowed
+	if exists(fsys, outputFilename) && !overwrite {
+		// File exists and overwrite is not allowed
+		q.emit(Event{Phase: PhaseSkip, Path: inputFilename, Output: outputFilename, Err: outputExistsError(outputFilename)})
+		span.SetAttributes(attribute.Bool(AttrSkipped, true))
+		return nil
+	}
+
+	// Only the metadata was encrypted; the image is written as it is with
+	// it attached again
+	if save.MetadataOnly {
+		if err := needOS(fsys, "metadata-only decryption"); err != nil {
+			return err
+		}
+		if err := DecryptMetadataFile(inputFilename, outputFilename, keys.key); err != nil {
+			logger.Error("failed to decrypt metadata", "path", inputFilename, "err", err)
+			return err
+		}
+		q.emit(Event{Phase: PhaseWrite, Path: inputFilename, Output: outputFilename})
+		return nil
+	}
+
+	// Tiled images are decrypted tile by tile, only the tiles covering the
+	// region when one is given; their metadata comes in place of the image.
+	// A PNG is decoded as it is decrypted, leaving its metadata likewise
+	decoded, plaintext, suite, err := decryptFileData(ctx, fsys, q, inputFilename, keys, save, true)
+	if err != nil && errors.Is(err, ctx.Err()) {
+		return err
+	}
+	if err != nil {
+		logger.Error("failed to decrypt", "path", inputFilename, "err", err)
+		return err
+	}
+
+	// What is left writes the image out, in the format asked for
+	_, write := startPhase(ctx, SpanWrite)
+	defer func() { endSpan(write, err) }()
+
+	// A multi-page TIFF is written a page to a file when asked to
+	if save.SplitPages && IsMultiPageTIFFData(plaintext) {
+		if err := fsys.MkdirAll(filepath.Dir(outputFilename), os.ModeDir|0755); err != nil {
+			logger.Error("failed to create output directory", "path", inputFilename, "err", err)
+			return err
+		}
+		pages, err := SavePages(outputFilename, plaintext, overwrite, save)
+		if err != nil {
+			logger.Error("failed to save decrypted pages", "path", inputFilename, "err", err)
+			return err
+		}
+		for _, page := range pages {
+			q.emit(Event{Phase: PhaseWrite, Path: inputFilename, Output: page, Cipher: cipherName(suite)})
+		}
+		return nil
+	}
+
+	// Without a format, or with original or auto, restore the format the
+	// image was encrypted from, in a file with the matching extension
+	outputFormat, restored, note := ResolveOutputFormat(plaintext, save.Format)
+	if note != "" {
+		logger.Info(note, "path", inputFilename)
+	}
+	if renamed := WithImageExtension(outputFilename, outputFormat); restored && renamed != outputFilename {
+		outputFilename = renamed
+		if exists(fsys, outputFilename) && !overwrite {
+			q.emit(Event{Phase: PhaseSkip, Path: inputFilename, Output: outputFilename, Err: outputExistsError(outputFilename)})
+			span.SetAttributes(attribute.Bool(AttrSkipped, true), attribute.String(AttrOutput, outputFilename))
+			return nil
+		}
+		span.SetAttributes(attribute.String(AttrOutput, outputFilename))
+	}
+
+	// Animated GIFs, multi-page TIFFs and HEIF images were encrypted in
+	// their own format, in which they are written back byte for byte. An
+	// animated GIF gives its first frame in other formats, and a multi-page
+	// TIFF its first page; a HEIF image cannot be converted.
+	keepBytes := KeepsEncryptedBytes(plaintext, outputFormat)
+	var img image.Image
+	if !keepBytes {
+		if IsGIFData(plaintext) {
+			logger.Warn("animated GIF; only its first frame is saved, unless the output format is gif", "path", inputFilename, "format", outputFormat)
+		}
+		if IsMultiPageTIFFData(plaintext) {
+			logger.Warn("multi-page TIFF; only its first page is saved, unless the output format is tiff or its pages are split", "path", inputFilename, "format", outputFormat)
+		}
+
+		// Convert the decrypted bytes back to an image
+		if decoded != nil {
+			img = decoded
+		} else {
+			img, err = bytesToImage(plaintext, save.MaxPixels)
+		}
+		if errors.Is(err, ErrHEIFDecoding) {
+			err = fmt.Errorf("%w; decrypt with --output-format %s to restore the HEIF file", err, OriginalOutputFormat)
+		}
+		if err != nil {
+			logger.Error("failed to convert decrypted bytes to image", "path", inputFilename, "err", err)
+			return err
+		}
+
+		// The EXIF metadata was carried alongside the pixels
+		if save.EXIF, err = ReadEXIF(plaintext); err != nil {
+			logger.Error("failed to read EXIF metadata", "path", inputFilename, "err", err)
+			return err
+		}
+		plaintext = nil // Free to be collected as the image is written
+	}
+
+	// Save the decrypted image to a file
+	err = fsys.MkdirAll(filepath.Dir(outputFilename), os.ModeDir|0755) // Ensure output directory exists
+	if err != nil {
+		logger.Error("failed to create output directory", "path", inputFilename, "err", err)
+		return err
+	}
+
+	if keepBytes {
+		if save.Watermark != nil {
+			return fmt.Errorf("cannot watermark %s: it is written as it was encrypted", inputFilename)
+		}
+		if !save.Resize.IsZero() {
+			logger.Info("written as it was encrypted, without resizing", "path", inputFilename)
+		}
+		err = writeWhole(fsys, outputFilename, func(w io.Writer) error {
+			_, err := w.Write(plaintext)
+			return err
+		})
+	} else {
+		if IsLossyFormat(outputFormat) {
+			logger.Debug("writing JPEG", "path", outputFilename, "quality", save.JPEGQuality())
+		}
+		save.Format = outputFormat
+		err = writeWhole(fsys, outputFilename, func(w io.Writer) error { return EncodeImage(w, img, save) })
+	}
+	if err != nil {
+		logger.Error("failed to save decrypted image", "path", inputFilename, "err", err)
+		return err
+	}
+
+	setBytesWritten(write, fsys, outputFilename)
+	q.emit(Event{Phase: PhaseWrite, Path: inputFilename, Output: outputFilename, Cipher: cipherName(suite)})
+	return nil
+}
+
+// DecryptDirectory decrypts every file in inputDir named with
+// encryptedExt, and in its subdirectories when recursive is set, with
+// DecryptFile, writing each to the same relative path under outputDir
+// without the extension. The references of a DedupeManifest in inputDir
+// are decrypted as if they were the files they stand for. When save.Tags
+// is set, only the files with those tags are decrypted, and a file whose
+// tags cannot be read is logged and left alone. A failure on one file is logged to save.Logger
+// and does not stop the others; a panic on one does not either, but is
+// returned, as a *PanicError for each file joined, once the others are
+// done. Once ctx is done no more files are started, those being
+// decrypted are abandoned without output, and it returns ctx.Err().
+func DecryptDirectory(ctx context.Context, inputDir, outputDir string, key []byte, recursive bool, encryptedExt string, overwrite bool, save SaveOptions) error {
+	return decryptDirectory(ctx, inputDir, outputDir, newKeyCipher(key), recursive, encryptedExt, overwrite, save)
+}
+
+// decryptDirectory is DecryptDirectory with the ciphers of the key made by
+// keys, which every file shares.
+func decryptDirectory(ctx context.Context, inputDir, outputDir string, keys *keyCipher, recursive bool, encryptedExt string, overwrite bool, save SaveOptions) (err error) {
+	ctx, span := tracer(save.TracerProvider).Start(ctx, SpanDecryptDirectory, trace.WithAttributes(attribute.String(AttrInput, inputDir), attribute.String(AttrOutput, outputDir)))
+	defer func() { endSpan(span, err) }()
+	q := newEventQueue(save.Progress)
+	defer q.close()
+	found := 0
+	logger := orNop(save.Logger)
+	files, err := collectSource(ctx, WalkSourceFS(orOS(save.FS), inputDir, recursive, func(path string, info fs.FileInfo) bool {
+		if !strings.HasSuffix(info.Name(), encryptedExt) { // Decrypt only .enc files
+			return false
+		}
+		if len(save.Tags) > 0 {
+			tags, err := readTags(orOS(save.FS), path, keys)
+			if err != nil {
+				logger.Error("failed to read tags", "path", path, "err", err)
+				return false
+			}
+			if !tags.Match(save.Tags) {
+				return false
+			}
+		}
+		found++
+		q.emit(Event{Phase: PhaseScan, Path: path, Done: int64(found)})
+		return true
+	}))
+
+	// The references deduplication left in place of duplicates are
+	// decrypted from the files they stand for, to their own paths
+	var refs map[string]string
+	if err == nil {
+		refs, err = dedupeReferences(orOS(save.FS), inputDir, recursive, encryptedExt, func(target string) bool {
+			if len(save.Tags) == 0 {
+				return true
+			}
+			tags, err := readTags(orOS(save.FS), target, keys)
+			return err == nil && tags.Match(save.Tags)
+		})
+		for _, ref := range slices.Sorted(maps.Keys(refs)) {
+			files = append(files, ref)
+		}
+	}
+	if err == nil {
+		q.emit(Event{Phase: PhaseScan, Path: inputDir, Done: int64(len(files)), Total: int64(len(files))})
+	}
+	span.SetAttributes(attribute.Int(AttrFiles, len(files)))
+
+	// Decrypt each file found, on a worker per CPU unless save says
+	// otherwise
+	batch := BatchProcessor{
+		Source:  FileSource(files),
+		Op:      "decrypt",
+		Workers: save.Workers,
+		Operation: func(ctx context.Context, input string) (string, error) {
+			relPath, err := filepath.Rel(inputDir, input)
+			if err != nil {
+				return "", fmt.Errorf("failed to get relative path: %w", err)
+			}
+			output := joinName(outputDir, strings.TrimSuffix(relPath, encryptedExt)) // Remove .enc extension
+			if target, ok := refs[input]; ok {
+				input = target
+			}
+			return output, decryptFile(ctx, input, output, keys, overwrite, save, q)
+		},
+	}
+	var panics []error
+	results, wait := batch.Run(ctx)
+	for r := range results {
+		if r.Err != nil && ctx.Err() == nil {
+			logger.Error("failed to decrypt", "path", r.Input, "err", r.Err)
+		}
+		if len(Panics(r.Err)) > 0 {
+			panics = append(panics, pathError("decrypt", r.Input, r.Err))
+		}
+	}
+	wait()
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err != nil {
+		logger.Error("failed to walk directory", "path", inputDir, "err", err)
+		return err
+	}
+
+	return errors.Join(panics...)
+}
@@ -0,0 +1,620 @@
+package pixellock
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/image/bmp"
+)
+
+func TestGenerateRandomKey(t *testing.T) {
+	key, err := GenerateRandomKey()
+	if err != nil {
+		t.Fatalf("GenerateRandomKey failed: %v", err)
+	}
+	if len(key) != KeySize {
+		t.Errorf("Generated key has incorrect size: got %d, want %d", len(key), KeySize)
+	}
+}
+
+func TestKeyFingerprint(t *testing.T) {
+	key, _ := GenerateRandomKey()
+	other, _ := GenerateRandomKey()
+	fingerprint := KeyFingerprint(key)
+	if len(fingerprint) != 16 || fingerprint != KeyFingerprint(slices.Clone(key)) || fingerprint == KeyFingerprint(other) {
+		t.Errorf("KeyFingerprint gave %q for one key and %q for another", fingerprint, KeyFingerprint(other))
+	}
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	key, err := GenerateRandomKey()
+	if err != nil {
+		t.Fatalf("GenerateRandomKey failed: %v", err)
+	}
+
+	plaintext := []byte("This is a test message.")
+
+	ciphertext, err := Encrypt(key, plaintext)
+	if err != nil {
+		t.Fatalf("Encrypt failed: %v", err)
+	}
+
+	decrypted, err := Decrypt(key, ciphertext)
+	if err != nil {
+		t.Fatalf("Decrypt failed: %v", err)
+	}
+
+	if !bytes.Equal(plaintext, decrypted) {
+		t.Errorf("Decrypted text does not match plaintext: got %s, want %s", string(decrypted), string(plaintext))
+	}
+}
+
+func createImageFile(t testing.TB, filename string) {
+	img := image.NewRGBA(image.Rect(0, 0, 10, 10))
+	colorRed := color.RGBA{255, 0, 0, 255}
+	for x := 0; x < 10; x++ {
+		for y := 0; y < 10; y++ {
+			img.SetRGBA(x, y, colorRed)
+		}
+	}
+	f, err := os.Create(filename)
+	if err != nil {
+		t.Fatalf("Failed to create test image file: %v", err)
+	}
+	defer f.Close()
+
+	err = png.Encode(f, img)
+	if err != nil {
+		t.Fatalf("Failed to encode test image: %v", err)
+	}
+}
+
+func TestIsImageFile(t *testing.T) {
+	tempDir := t.TempDir()
+
+	pngFile := filepath.Join(tempDir, "test.png")
+	createImageFile(t, pngFile)
+	if !isImageFile(pngFile) {
+		t.Errorf("isImageFile should return true for PNG file")
+	}
+
+	txtFile := filepath.Join(tempDir, "test.txt")
+	err := ioutil.WriteFile(txtFile, []byte("not an image"), 0644)
+	if err != nil {
+		t.Fatalf("failed to create file")
+	}
+	if isImageFile(txtFile) {
+		t.Errorf("isImageFile should return false for a non-image file")
+	}
+}
+
+func TestBMPEncryptDecrypt(t *testing.T) {
+	tempDir := t.TempDir()
+	original := filepath.Join(tempDir, "photo.bmp")
+	img := image.NewRGBA(image.Rect(0, 0, 13, 7))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(i * 37)
+		if i%4 == 3 {
+			img.Pix[i] = 0xff
+		}
+	}
+	f, err := os.Create(original)
+	if err != nil {
+		t.Fatalf("Failed to create test image file: %v", err)
+	}
+	if err := bmp.Encode(f, img); err != nil {
+		t.Fatalf("Failed to encode test image: %v", err)
+	}
+	f.Close()
+	if !isImageFile(original) {
+		t.Errorf("isImageFile should return true for BMP file")
+	}
+
+	key, err := GenerateRandomKey()
+	if err != nil {
+		t.Fatalf("GenerateRandomKey failed: %v", err)
+	}
+	encrypted := filepath.Join(tempDir, "photo.bmp.enc")
+	decrypted := filepath.Join(tempDir, "decrypted.bmp")
+	if err := EncryptFile(t.Context(), original, encrypted, key, false, EncryptOptions{Metadata: MetadataPreserve}); err != nil {
+		t.Fatalf("EncryptFile failed: %v", err)
+	}
+	if err := DecryptFile(t.Context(), encrypted, decrypted, key, false, SaveOptions{Format: "bmp"}); err != nil {
+		t.Fatalf("DecryptFile failed: %v", err)
+	}
+	if format, err := DetectImageFormat(decrypted); err != nil || format != "bmp" {
+		t.Errorf("DetectImageFormat = %q, %v; want bmp", format, err)
+	}
+	got, err := LoadImage(decrypted)
+	if err != nil {
+		t.Fatalf("LoadImage failed: %v", err)
+	}
+	if !bytes.Equal(asNRGBA(got).Pix, asNRGBA(img).Pix) {
+		t.Error("decrypted BMP differs from the original")
+	}
+}
+
+func TestCheckOutputFormatUnknown(t *testing.T) {
+	for _, format := range []string{"png", "", "BMP", "jpeg", "webp"} {
+		if err := CheckOutputFormat(format); err != nil {
+			t.Errorf("CheckOutputFormat(%q) failed: %v", format, err)
+		}
+	}
+	out := filepath.Join(t.TempDir(), "image.xyz")
+	if err := SaveImage(out, image.NewNRGBA(image.Rect(0, 0, 2, 2)), SaveOptions{Format: "xyz"}); err == nil {
+		t.Error("SaveImage accepted an unknown format")
+	}
+	if _, err := os.Stat(out); !os.IsNotExist(err) {
+		t.Errorf("refused SaveImage still wrote %s", out)
+	}
+}
+
+func TestAnimatedGIFEncryptDecrypt(t *testing.T) {
+	input := animatedGIF(t)
+	want := decodeGIFFile(t, input)
+	key, err := GenerateRandomKey()
+	if err != nil {
+		t.Fatalf("GenerateRandomKey failed: %v", err)
+	}
+	tempDir := t.TempDir()
+	encrypted := filepath.Join(tempDir, "cover.gif.enc")
+	if err := EncryptFile(t.Context(), input, encrypted, key, false, EncryptOptions{Metadata: MetadataPreserve}); err != nil {
+		t.Fatalf("EncryptFile failed: %v", err)
+	}
+
+	for _, outputFormat := range []string{"gif", OriginalOutputFormat} {
+		decrypted := filepath.Join(tempDir, outputFormat+".gif")
+		if err := DecryptFile(t.Context(), encrypted, decrypted, key, false, SaveOptions{Format: outputFormat}); err != nil {
+			t.Fatalf("DecryptFile(t.Context(), %s) failed: %v", outputFormat, err)
+		}
+		got := decodeGIFFile(t, decrypted)
+		if len(got.Image) != len(want.Image) || !slices.Equal(got.Delay, want.Delay) || !slices.Equal(got.Disposal, want.Disposal) || got.LoopCount != want.LoopCount {
+			t.Fatalf("%s: %d frames, delays %v, disposal %v, loop %d; want %d, %v, %v, %d", outputFormat,
+				len(got.Image), got.Delay, got.Disposal, got.LoopCount, len(want.Image), want.Delay, want.Disposal, want.LoopCount)
+		}
+		for i := range want.Image {
+			if !bytes.Equal(asNRGBA(got.Image[i]).Pix, asNRGBA(want.Image[i]).Pix) {
+				t.Errorf("%s: frame %d differs", outputFormat, i)
+			}
+		}
+	}
+
+	// Other formats get the first frame.
+	decrypted := filepath.Join(tempDir, "first.png")
+	if err := DecryptFile(t.Context(), encrypted, decrypted, key, false, SaveOptions{Format: "png"}); err != nil {
+		t.Fatalf("DecryptFile(t.Context(), png) failed: %v", err)
+	}
+	first, err := LoadImage(decrypted)
+	if err != nil {
+		t.Fatalf("LoadImage failed: %v", err)
+	}
+	if !bytes.Equal(asNRGBA(first).Pix, asNRGBA(want.Image[0]).Pix) {
+		t.Error("png output is not the first frame")
+	}
+
+	// Other images are encrypted as PNGs, as before.
+	if _, animated, err := AnimatedGIFBytes(filepath.Join(tempDir, "first.png")); err != nil || animated {
+		t.Errorf("AnimatedGIFBytes(png) = %v, %v", animated, err)
+	}
+}
+
+func TestDecryptRestoresOriginalFormat(t *testing.T) {
+	tempDir := t.TempDir()
+	key, err := GenerateRandomKey()
+	if err != nil {
+		t.Fatalf("GenerateRandomKey failed: %v", err)
+	}
+	photo := filepath.Join(tempDir, "photo.jpg")
+	f, err := os.Create(photo)
+	if err != nil {
+		t.Fatalf("Failed to create test image file: %v", err)
+	}
+	if err := jpeg.Encode(f, photoNRGBA(t), nil); err != nil {
+		t.Fatalf("Failed to encode test image: %v", err)
+	}
+	f.Close()
+	icon := filepath.Join(tempDir, "icon.gif")
+	f, err = os.Create(icon)
+	if err != nil {
+		t.Fatalf("Failed to create test image file: %v", err)
+	}
+	paletted := image.NewPaletted(image.Rect(0, 0, 9, 5), color.Palette{color.Black, color.White, color.RGBA{0, 128, 255, 255}})
+	for i := range paletted.Pix {
+		paletted.Pix[i] = uint8(i % 3)
+	}
+	if err := gif.Encode(f, paletted, nil); err != nil {
+		t.Fatalf("Failed to encode test image: %v", err)
+	}
+	f.Close()
+	drawing := filepath.Join(tempDir, "drawing.png")
+	createImageFile(t, drawing)
+
+	for input, want := range map[string]string{photo: "jpeg", icon: "gif", drawing: "png"} {
+		encrypted := input + ".enc"
+		if err := EncryptFile(t.Context(), input, encrypted, key, false, EncryptOptions{Metadata: MetadataPreserve}); err != nil {
+			t.Fatalf("EncryptFile(t.Context(), %s) failed: %v", input, err)
+		}
+		for _, outputFormat := range []string{"", AutoOutputFormat} {
+			// The output is named for png, as the decrypt command used to
+			// default to.
+			decrypted := filepath.Join(tempDir, outputFormat+"decrypted_"+filepath.Base(input)+".png")
+			if err := DecryptFile(t.Context(), encrypted, decrypted, key, true, SaveOptions{Format: outputFormat}); err != nil {
+				t.Fatalf("DecryptFile(t.Context(), %s, %q) failed: %v", input, outputFormat, err)
+			}
+			written := WithImageExtension(decrypted, want)
+			if format, err := DetectImageFormat(written); err != nil || format != want {
+				t.Errorf("%s, %s: %s has format %q, %v; want %s", input, outputFormat, written, format, err, want)
+			}
+			if written != decrypted {
+				if _, err := os.Stat(decrypted); !os.IsNotExist(err) {
+					t.Errorf("%s, %s: also wrote %s", input, outputFormat, decrypted)
+				}
+			}
+		}
+	}
+
+	decrypted := filepath.Join(tempDir, "converted.png")
+	if err := DecryptFile(t.Context(), photo+".enc", decrypted, key, false, SaveOptions{Format: "png"}); err != nil {
+		t.Fatalf("DecryptFile(t.Context(), png) failed: %v", err)
+	}
+	if format, err := DetectImageFormat(decrypted); err != nil || format != "png" {
+		t.Errorf("explicit png output has format %q, %v", format, err)
+	}
+}
+
+func TestResolveOutputFormat(t *testing.T) {
+	// Files encrypted before the format was recorded hold an untagged PNG.
+	legacy, err := ImageToBytes(grayTestImage(8, 8))
+	if err != nil {
+		t.Fatalf("ImageToBytes failed: %v", err)
+	}
+	format, restored, note := ResolveOutputFormat(legacy, "")
+	if format != "png" || !restored || !strings.Contains(note, "no format was recorded") {
+		t.Errorf("legacy data resolved to %q, %v, %q", format, restored, note)
+	}
+	avif, err := SetOriginalFormat(legacy, "avif")
+	if err != nil {
+		t.Fatalf("SetOriginalFormat failed: %v", err)
+	}
+	if format, _, note := ResolveOutputFormat(avif, OriginalOutputFormat); format != "png" || !strings.Contains(note, "avif") {
+		t.Errorf("avif data resolved to %q, note %q", format, note)
+	}
+	tagged, err := SetOriginalFormat(legacy, "tiff")
+	if err != nil {
+		t.Fatalf("SetOriginalFormat failed: %v", err)
+	}
+	if format, restored, note := ResolveOutputFormat(tagged, "Auto"); format != "tiff" || !restored || note != "" {
+		t.Errorf("tiff data resolved to %q, %v, %q", format, restored, note)
+	}
+	if format, restored, _ := ResolveOutputFormat(tagged, "bmp"); format != "bmp" || restored {
+		t.Errorf("explicit bmp resolved to %q, %v", format, restored)
+	}
+}
+
+func TestWithImageExtension(t *testing.T) {
+	for _, tc := range []struct{ filename, format, want string }{
+		{"out/photo.png", "jpeg", "out/photo.jpg"},
+		{"photo.JPEG", "jpeg", "photo.JPEG"},
+		{"scan.tif", "tiff:lzw", "scan.tif"},
+		{"icon.png", "gif", "icon.gif"},
+		{"IMG_0001", "heif", "IMG_0001.heic"},
+		{"notes.v2", "png", "notes.v2.png"},
+		{"photo.png", "unknown", "photo.png"},
+	} {
+		if got := WithImageExtension(tc.filename, tc.format); got != tc.want {
+			t.Errorf("WithImageExtension(%q, %q) = %q, want %q", tc.filename, tc.format, got, tc.want)
+		}
+	}
+}
+
+func TestSaveImageJPEGQuality(t *testing.T) {
+	tempDir := t.TempDir()
+	img := photoNRGBA(t)
+	sizes := make(map[int]int64)
+	for _, quality := range []int{30, 95} {
+		out := filepath.Join(tempDir, "photo.jpg")
+		if err := SaveImage(out, img, SaveOptions{Format: "jpeg", Quality: quality}); err != nil {
+			t.Fatalf("SaveImage(quality %d) failed: %v", quality, err)
+		}
+		info, err := os.Stat(out)
+		if err != nil {
+			t.Fatalf("Stat failed: %v", err)
+		}
+		sizes[quality] = info.Size()
+		got, err := LoadImage(out)
+		if err != nil {
+			t.Fatalf("quality %d: LoadImage failed: %v", quality, err)
+		}
+		if got.Bounds() != img.Bounds() {
+			t.Errorf("quality %d: decoded bounds %v, want %v", quality, got.Bounds(), img.Bounds())
+		}
+	}
+	if sizes[30] >= sizes[95] {
+		t.Errorf("quality 30 gave %d bytes, quality 95 %d; want the lower quality smaller", sizes[30], sizes[95])
+	}
+
+	for _, quality := range []int{-1, 101} {
+		if err := SaveImage(filepath.Join(tempDir, "bad.jpg"), img, SaveOptions{Format: "jpeg", Quality: quality}); err == nil {
+			t.Errorf("SaveImage accepted quality %d", quality)
+		}
+	}
+	if err := CheckJPEGQuality(0); err == nil {
+		t.Error("CheckJPEGQuality accepted 0")
+	}
+	opts := DefaultStegoOptions
+	opts.JPEGQuality = 101
+	if err := opts.Validate(); err == nil {
+		t.Error("Validate accepted JPEG quality 101")
+	}
+}
+
+// deepTestImages returns 16-bit gradients whose low bytes vary, so any
+// reduction to 8 bits shows.
+func deepTestImages() map[string]image.Image {
+	rgba := image.NewRGBA64(image.Rect(0, 0, 64, 48))
+	nrgba := image.NewNRGBA64(rgba.Rect)
+	gray := image.NewGray16(rgba.Rect)
+	for y := 0; y < 48; y++ {
+		for x := 0; x < 64; x++ {
+			rgba.SetRGBA64(x, y, color.RGBA64{uint16(x * 1021), uint16(y * 1361), uint16((x+y)*577 + 1), 0xffff})
+			nrgba.SetNRGBA64(x, y, color.NRGBA64{uint16(x * 1021), uint16(y * 1361), 0x1234, uint16(0xffff - x*y*13)})
+			gray.SetGray16(x, y, color.Gray16{uint16(x*1000 + y*7)})
+		}
+	}
+	return map[string]image.Image{"rgba64": rgba, "nrgba64": nrgba, "gray16": gray}
+}
+
+func TestSixteenBitEncryptDecrypt(t *testing.T) {
+	key, err := GenerateRandomKey()
+	if err != nil {
+		t.Fatalf("GenerateRandomKey failed: %v", err)
+	}
+	for name, img := range deepTestImages() {
+		dir := t.TempDir()
+		original := filepath.Join(dir, "scan.png")
+		f, err := os.Create(original)
+		if err != nil {
+			t.Fatalf("Failed to create test image file: %v", err)
+		}
+		if err := png.Encode(f, img); err != nil {
+			t.Fatalf("Failed to encode test image: %v", err)
+		}
+		f.Close()
+
+		encrypted := filepath.Join(dir, "scan.png.enc")
+		if err := EncryptFile(t.Context(), original, encrypted, key, false, EncryptOptions{Metadata: MetadataPreserve}); err != nil {
+			t.Fatalf("%s: EncryptFile failed: %v", name, err)
+		}
+		for _, format := range []string{"png", "tiff:lzw"} {
+			decrypted := filepath.Join(dir, "decrypted."+ImageFormatExtension(format))
+			if err := DecryptFile(t.Context(), encrypted, decrypted, key, false, SaveOptions{Format: format}); err != nil {
+				t.Fatalf("%s, %s: DecryptFile failed: %v", name, format, err)
+			}
+			if format == "png" {
+				data, err := os.ReadFile(decrypted)
+				if err != nil {
+					t.Fatalf("ReadFile failed: %v", err)
+				}
+				if depth := data[24]; depth != 16 { // The bit depth in IHDR
+					t.Errorf("%s: decrypted PNG has bit depth %d, want 16", name, depth)
+				}
+			}
+			got, err := LoadImage(decrypted)
+			if err != nil {
+				t.Fatalf("%s, %s: LoadImage failed: %v", name, format, err)
+			}
+			if !samePixels(got, img) {
+				t.Errorf("%s, %s: decrypted pixels differ from the 16-bit original", name, format)
+			}
+		}
+	}
+}
+
+// TestDecryptKeepsColorModel decrypts grayscale and paletted images, which
+// must come back in their own color model rather than as true color, and
+// so no larger than they went in. Stripping their EXIF turns them upright,
+// which must keep the color model too.
+func TestDecryptKeepsColorModel(t *testing.T) {
+	key, err := GenerateRandomKey()
+	if err != nil {
+		t.Fatalf("GenerateRandomKey failed: %v", err)
+	}
+	// Noise, which compresses alike however it is turned
+	noise := func(pix []uint8) {
+		x := uint32(1)
+		for i := range pix {
+			x = x*1664525 + 1013904223
+			pix[i] = uint8(x >> 24)
+		}
+	}
+	gray, paletted := grayTestImage(300, 200), palettedTestImage(300, 200)
+	noise(gray.Pix)
+	noise(paletted.Pix)
+	for name, img := range map[string]image.Image{
+		"gray":     gray,
+		"gray16":   deepTestImages()["gray16"],
+		"paletted": paletted,
+	} {
+		dir := t.TempDir()
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, img); err != nil {
+			t.Fatalf("Failed to encode test image: %v", err)
+		}
+		data, err := AttachEXIF(buf.Bytes(), "png", exifFixture())
+		if err != nil {
+			t.Fatalf("AttachEXIF failed: %v", err)
+		}
+		original := filepath.Join(dir, name+".png")
+		if err := os.WriteFile(original, data, 0o644); err != nil {
+			t.Fatalf("WriteFile failed: %v", err)
+		}
+
+		for _, metadata := range []string{MetadataPreserve, MetadataStrip} {
+			encrypted := filepath.Join(dir, metadata+".enc")
+			if err := EncryptFile(t.Context(), original, encrypted, key, false, EncryptOptions{Metadata: metadata}); err != nil {
+				t.Fatalf("%s, %s: EncryptFile failed: %v", name, metadata, err)
+			}
+			for _, format := range []string{"png", "tiff"} {
+				decrypted := filepath.Join(dir, metadata+"."+ImageFormatExtension(format))
+				if err := DecryptFile(t.Context(), encrypted, decrypted, key, false, SaveOptions{Format: format}); err != nil {
+					t.Fatalf("%s, %s, %s: DecryptFile failed: %v", name, metadata, format, err)
+				}
+				got, err := LoadImage(decrypted)
+				if err != nil {
+					t.Fatalf("%s, %s, %s: LoadImage failed: %v", name, metadata, format, err)
+				}
+				if fmt.Sprintf("%T", got) != fmt.Sprintf("%T", img) {
+					t.Errorf("%s, %s, %s: decrypted as %T, want %T", name, metadata, format, got, img)
+				}
+				if format != "png" {
+					continue
+				}
+				info, err := os.Stat(decrypted)
+				if err != nil {
+					t.Fatalf("Stat failed: %v", err)
+				}
+				if limit := len(data) * 5 / 4; info.Size() > int64(limit) {
+					t.Errorf("%s, %s: decrypted PNG is %d bytes, over %d for a %d byte original", name, metadata, info.Size(), limit, len(data))
+				}
+			}
+		}
+	}
+}
+
+// checkGoroutines returns a function that fails t if goroutines started
+// since checkGoroutines was called are still running a second after it
+// is called, printing their stacks, as a leak detector would.
+func checkGoroutines(t *testing.T) func() {
+	before := runtime.NumGoroutine()
+	return func() {
+		t.Helper()
+		for deadline := time.Now().Add(time.Second); runtime.NumGoroutine() > before; time.Sleep(10 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				buf := make([]byte, 1<<20)
+				t.Errorf("%d goroutines leaked:\n%s", runtime.NumGoroutine()-before, buf[:runtime.Stack(buf, true)])
+				return
+			}
+		}
+	}
+}
+
+// cancelOnFile cancels once a file named with ext appears in the
+// directory dir of fsys, and stops looking when the returned function is
+// called.
+func cancelOnFile(fsys fs.FS, dir, ext string, cancel context.CancelFunc) (stop func()) {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			if found, _ := fs.Glob(fsys, dir+"/*"+ext); len(found) > 0 {
+				cancel()
+				return
+			}
+			select {
+			case <-done:
+				return
+			case <-time.After(time.Millisecond):
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+func TestDirectoryCancel(t *testing.T) {
+	key, err := GenerateRandomKey()
+	if err != nil {
+		t.Fatalf("GenerateRandomKey failed: %v", err)
+	}
+	fsys := &MemFS{}
+	input, encrypted, decrypted := "in", "enc", "dec"
+	const images = 24
+	for i := range images {
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, largeTestImage(600+i, 400)); err != nil {
+			t.Fatalf("Encode failed: %v", err)
+		}
+		memWrite(t, fsys, filepath.Join(input, fmt.Sprintf("img%02d.png", i)), buf.Bytes())
+	}
+	opts, save := EncryptOptions{FS: fsys}, SaveOptions{FS: fsys}
+
+	// A context done already starts nothing
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := EncryptDirectory(ctx, input, encrypted, key, false, false, opts); err != context.Canceled {
+		t.Errorf("EncryptDirectory with a canceled context gave %v, want %v", err, context.Canceled)
+	}
+	if _, err := fsys.Stat(encrypted); !os.IsNotExist(err) {
+		t.Errorf("EncryptDirectory with a canceled context wrote output: %v", err)
+	}
+
+	// Canceled mid-batch, each directory returns promptly, leaving only
+	// whole files and no goroutines behind
+	check := func(name, out, ext string, run func(context.Context) error, whole func(string) error) {
+		t.Helper()
+		leaked := checkGoroutines(t)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		stop := cancelOnFile(fsys, out, ext, cancel)
+		err := run(ctx)
+		canceled := time.Now()
+		stop()
+		if err != context.Canceled {
+			t.Fatalf("%s gave %v, want %v", name, err, context.Canceled)
+		}
+		if since := time.Since(canceled); since > 2*time.Second {
+			t.Errorf("%s took %v to return", name, since)
+		}
+		leaked()
+
+		entries, err := fsys.ReadDir(out)
+		if err != nil {
+			t.Fatalf("ReadDir failed: %v", err)
+		}
+		if len(entries) == 0 || len(entries) >= images {
+			t.Errorf("%s wrote %d of %d files, want some but not all", name, len(entries), images)
+		}
+		for _, e := range entries {
+			if !strings.HasSuffix(e.Name(), ext) {
+				t.Errorf("%s left %s", name, e.Name())
+			} else if err := whole(filepath.Join(out, e.Name())); err != nil {
+				t.Errorf("%s wrote a partial %s: %v", name, e.Name(), err)
+			}
+		}
+	}
+	check("EncryptDirectory", encrypted, EncryptedExtension, func(ctx context.Context) error {
+		return EncryptDirectory(ctx, input, encrypted, key, false, false, opts)
+	}, func(path string) error {
+		return DecryptImage(t.Context(), key, io.Discard, bytes.NewReader(memRead(t, fsys, path)))
+	})
+
+	// Decrypt a whole set of encrypted files, rather than what was left
+	if err := EncryptDirectory(t.Context(), input, encrypted, key, false, true, opts); err != nil {
+		t.Fatalf("EncryptDirectory failed: %v", err)
+	}
+	check("DecryptDirectory", decrypted, ".png", func(ctx context.Context) error {
+		return DecryptDirectory(ctx, encrypted, decrypted, key, false, EncryptedExtension, false, save)
+	}, func(path string) error {
+		_, err := LoadImageFS(fsys, path)
+		return err
+	})
+}
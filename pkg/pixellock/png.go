@@ -0,0 +1,128 @@
+package pixellock
+
+import (
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"sync"
+)
+
+// PNG compressions EncodePNG accepts.
+const (
+	PNGCompressionNone    = "none"
+	PNGCompressionFast    = "fast"
+	PNGCompressionDefault = "default"
+	PNGCompressionBest    = "best"
+)
+
+// pngCompressionLevels maps the PNG compressions to their encoder levels.
+var pngCompressionLevels = map[string]png.CompressionLevel{
+	PNGCompressionNone:    png.NoCompression,
+	PNGCompressionFast:    png.BestSpeed,
+	PNGCompressionDefault: png.DefaultCompression,
+	PNGCompressionBest:    png.BestCompression,
+}
+
+// CheckPNGCompression returns an error unless compression is one EncodePNG
+// accepts, or empty for the default.
+func CheckPNGCompression(compression string) error {
+	if _, ok := pngCompressionLevels[compression]; !ok && compression != "" {
+		return fmt.Errorf("unknown PNG compression %q (want %s, %s, %s or %s)", compression, PNGCompressionNone, PNGCompressionFast, PNGCompressionDefault, PNGCompressionBest)
+	}
+	return nil
+}
+
+// pngBufferPool shares encoder buffers between PNG encodes, including those
+// of concurrent directory workers, so batch runs do not allocate fresh
+// compressor state for every image.
+type pngBufferPool struct {
+	pool sync.Pool
+}
+
+func (p *pngBufferPool) Get() *png.EncoderBuffer {
+	b, _ := p.pool.Get().(*png.EncoderBuffer)
+	return b
+}
+
+func (p *pngBufferPool) Put(b *png.EncoderBuffer) {
+	p.pool.Put(b)
+}
+
+var pngBuffers = new(pngBufferPool)
+
+// EncodePNG writes img to w as a PNG with the given compression, the
+// default when empty.
+func EncodePNG(w io.Writer, img image.Image, compression string) error {
+	if err := CheckPNGCompression(compression); err != nil {
+		return err
+	}
+	if compression == "" {
+		compression = PNGCompressionDefault
+	}
+	enc := png.Encoder{CompressionLevel: pngCompressionLevels[compression], BufferPool: pngBuffers}
+	return enc.Encode(w, img)
+}
+
+// A pngChunkWriter follows the chunks of a PNG written to it, in writes
+// of any size, and writes the PNG on to w: without the chunks whose type
+// skip, if set, reports, and with what insert, if set, returns for a
+// chunk written before it. A PNG can be filtered so on its way to a file
+// or cipher, without being held whole.
+type pngChunkWriter struct {
+	w      io.Writer
+	skip   func(typ string) bool
+	insert func(typ string) []byte
+
+	signature int    // Bytes of the signature written
+	header    []byte // Of the chunk begun, until it is whole
+	left      int64  // Bytes of the chunk's body and CRC to come
+	skipping  bool   // The chunk is left out
+}
+
+func (p *pngChunkWriter) Write(b []byte) (int, error) {
+	n := len(b)
+	for len(b) > 0 {
+		switch {
+		case p.signature < len(pngSignature):
+			c := min(len(b), len(pngSignature)-p.signature)
+			if _, err := p.w.Write(b[:c]); err != nil {
+				return n - len(b), err
+			}
+			p.signature += c
+			b = b[c:]
+		case p.left == 0:
+			c := min(len(b), 8-len(p.header))
+			p.header = append(p.header, b[:c]...)
+			b = b[c:]
+			if len(p.header) < 8 {
+				continue
+			}
+			typ := string(p.header[4:8])
+			p.left = int64(binary.BigEndian.Uint32(p.header)) + 4
+			p.skipping = p.skip != nil && p.skip(typ)
+			if p.insert != nil {
+				if _, err := p.w.Write(p.insert(typ)); err != nil {
+					return n - len(b), err
+				}
+			}
+			if !p.skipping {
+				if _, err := p.w.Write(p.header); err != nil {
+					return n - len(b), err
+				}
+			}
+			p.header = p.header[:0]
+		default:
+			c := int(min(int64(len(b)), p.left))
+			if !p.skipping {
+				if _, err := p.w.Write(b[:c]); err != nil {
+					return n - len(b), err
+				}
+			}
+			p.left -= int64(c)
+			b = b[c:]
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,110 @@
+package pixellock
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"sync"
+	"testing"
+)
+
+func TestEncodePNGLevels(t *testing.T) {
+	for name, img := range map[string]image.Image{
+		"photo":       photoNRGBA(t),
+		"gray":        grayTestImage(90, 60),
+		"transparent": newTransparentNRGBA(33, 17),
+	} {
+		sizes := make(map[string]int)
+		for _, compression := range []string{"", PNGCompressionNone, PNGCompressionFast, PNGCompressionDefault, PNGCompressionBest} {
+			var buf bytes.Buffer
+			if err := EncodePNG(&buf, img, compression); err != nil {
+				t.Fatalf("%s, %q: EncodePNG failed: %v", name, compression, err)
+			}
+			sizes[compression] = buf.Len()
+			got, err := png.Decode(&buf)
+			if err != nil {
+				t.Fatalf("%s, %q: png.Decode failed: %v", name, compression, err)
+			}
+			if !samePixels(got, img) {
+				t.Errorf("%s, %q: pixels changed in the PNG round trip", name, compression)
+			}
+		}
+		if sizes[PNGCompressionNone] <= sizes[PNGCompressionBest] {
+			t.Errorf("%s: no compression gave %d bytes, best %d", name, sizes[PNGCompressionNone], sizes[PNGCompressionBest])
+		}
+	}
+
+	if err := EncodePNG(new(bytes.Buffer), grayTestImage(4, 4), "max"); err == nil {
+		t.Error("EncodePNG accepted an unknown compression")
+	}
+	if err := SaveImage(t.TempDir()+"/out.png", grayTestImage(4, 4), SaveOptions{PNGCompression: "max"}); err == nil {
+		t.Error("SaveImage accepted an unknown PNG compression")
+	}
+}
+
+// TestEncodePNGConcurrent encodes from several goroutines at once, as the
+// directory workers do, sharing the encoder buffer pool.
+func TestEncodePNGConcurrent(t *testing.T) {
+	images := []image.Image{photoNRGBA(t), grayTestImage(120, 80), newTransparentNRGBA(40, 40)}
+	var wg sync.WaitGroup
+	for i := 0; i < 24; i++ {
+		wg.Add(1)
+		go func(img image.Image) {
+			defer wg.Done()
+			data, err := ImageToBytes(img)
+			if err != nil {
+				t.Errorf("ImageToBytes failed: %v", err)
+				return
+			}
+			got, err := BytesToImage(data)
+			if err != nil || !samePixels(got, img) {
+				t.Errorf("pooled PNG does not round-trip: %v", err)
+			}
+		}(images[i%len(images)])
+	}
+	wg.Wait()
+}
+
+// BenchmarkImageToBytesBatch encodes a batch of large images on parallel
+// workers, as EncryptDirectory does, with the former default-level encoder
+// and with ImageToBytes, which encodes fast into pooled buffers.
+func BenchmarkImageToBytesBatch(b *testing.B) {
+	batch := make([]image.Image, 8)
+	for i := range batch {
+		img := image.NewNRGBA(image.Rect(0, 0, 2000, 1500))
+		for j := range img.Pix {
+			img.Pix[j] = byte(j/4%2000 + j*(i+3)%11) // Gradient with some noise
+		}
+		batch[i] = img
+	}
+	encoders := []struct {
+		name   string
+		encode func(img image.Image) error
+	}{
+		{"png.Encode", func(img image.Image) error {
+			return png.Encode(new(bytes.Buffer), img)
+		}},
+		{"ImageToBytes", func(img image.Image) error {
+			_, err := ImageToBytes(img)
+			return err
+		}},
+	}
+	for _, enc := range encoders {
+		b.Run(enc.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				var wg sync.WaitGroup
+				for _, img := range batch {
+					wg.Add(1)
+					go func(img image.Image) {
+						defer wg.Done()
+						if err := enc.encode(img); err != nil {
+							b.Errorf("%s failed: %v", enc.name, err)
+						}
+					}(img)
+				}
+				wg.Wait()
+			}
+		})
+	}
+}
@@ -0,0 +1,288 @@
+package pixellock
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"strconv"
+)
+
+// Netpbm images, as scientific tools write them, are read and written
+// here: PGM grayscale and PPM color images, with samples either as binary
+// (P5, P6) or as ASCII numbers (P2, P3). A maximum sample value above 255
+// gives 16-bit images; values are scaled to the full range of 8 or 16 bits.
+
+func init() {
+	for _, magic := range []string{"P2", "P5"} {
+		image.RegisterFormat("pgm", magic, decodePNM, decodePNMConfig)
+	}
+	for _, magic := range []string{"P3", "P6"} {
+		image.RegisterFormat("ppm", magic, decodePNM, decodePNMConfig)
+	}
+}
+
+// PNM encodings EncodePNM accepts.
+const (
+	PNMEncodingBinary = "binary"
+	PNMEncodingASCII  = "ascii"
+)
+
+// DefaultPNMEncoding is the encoding of a "ppm" or "pgm" output format that
+// names none.
+const DefaultPNMEncoding = PNMEncodingBinary
+
+// maxPNMPixels bounds the images decodePNM allocates for, so a corrupt
+// header cannot ask for more memory than any real image needs.
+const maxPNMPixels = 1 << 30
+
+// checkPNMEncoding returns an error unless encoding is a PNM encoding.
+func checkPNMEncoding(encoding string) error {
+	if encoding != PNMEncodingBinary && encoding != PNMEncodingASCII {
+		return fmt.Errorf("unknown PNM encoding %q (want %s or %s)", encoding, PNMEncodingBinary, PNMEncodingASCII)
+	}
+	return nil
+}
+
+// pnmHeader is the header of a Netpbm image.
+type pnmHeader struct {
+	magic         string
+	width, height int
+	maxVal        int
+}
+
+// gray reports whether the image is a PGM.
+func (h pnmHeader) gray() bool { return h.magic == "P2" || h.magic == "P5" }
+
+// ascii reports whether the samples are ASCII numbers.
+func (h pnmHeader) ascii() bool { return h.magic == "P2" || h.magic == "P3" }
+
+// colorModel returns the color model of the decoded image.
+func (h pnmHeader) colorModel() color.Model {
+	switch {
+	case h.gray() && h.maxVal > 255:
+		return color.Gray16Model
+	case h.gray():
+		return color.GrayModel
+	case h.maxVal > 255:
+		return color.RGBA64Model
+	}
+	return color.RGBAModel
+}
+
+// isPNMSpace reports whether c is whitespace in a Netpbm image.
+func isPNMSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\v' || c == '\f'
+}
+
+// readPNMNumber reads a decimal number from r, skipping whitespace and
+// comments before it and the one whitespace byte after it.
+func readPNMNumber(r *bufio.Reader) (int, error) {
+	c, err := r.ReadByte()
+	for ; err == nil; c, err = r.ReadByte() {
+		if c == '#' {
+			if _, err = r.ReadString('\n'); err != nil {
+				break
+			}
+		} else if !isPNMSpace(c) {
+			break
+		}
+	}
+	if err != nil {
+		return 0, err
+	}
+	n, digits := 0, 0
+	for ; err == nil && c >= '0' && c <= '9'; c, err = r.ReadByte() {
+		if n, digits = n*10+int(c-'0'), digits+1; n > 1<<31 {
+			return 0, fmt.Errorf("number too large")
+		}
+	}
+	if digits == 0 {
+		return 0, fmt.Errorf("unexpected %q", c)
+	}
+	if err == nil && !isPNMSpace(c) {
+		r.UnreadByte()
+	}
+	return n, nil
+}
+
+// readPNMHeader reads the header of a Netpbm image, up to its samples.
+func readPNMHeader(r *bufio.Reader) (pnmHeader, error) {
+	magic := make([]byte, 2)
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return pnmHeader{}, fmt.Errorf("invalid PNM image: %w", err)
+	}
+	h := pnmHeader{magic: string(magic)}
+	switch h.magic {
+	case "P2", "P3", "P5", "P6":
+	default:
+		return pnmHeader{}, fmt.Errorf("unsupported PNM image type %q", h.magic)
+	}
+	for _, v := range []*int{&h.width, &h.height, &h.maxVal} {
+		n, err := readPNMNumber(r)
+		if err != nil {
+			return pnmHeader{}, fmt.Errorf("invalid PNM header: %v", err)
+		}
+		*v = n
+	}
+	if h.width < 1 || h.height < 1 || h.width*h.height > maxPNMPixels {
+		return pnmHeader{}, fmt.Errorf("invalid PNM image size %dx%d", h.width, h.height)
+	}
+	if h.maxVal < 1 || h.maxVal > 0xffff {
+		return pnmHeader{}, fmt.Errorf("invalid PNM maximum value %d: must be between 1 and 65535", h.maxVal)
+	}
+	return h, nil
+}
+
+func decodePNMConfig(r io.Reader) (image.Config, error) {
+	h, err := readPNMHeader(bufio.NewReader(r))
+	if err != nil {
+		return image.Config{}, err
+	}
+	return image.Config{ColorModel: h.colorModel(), Width: h.width, Height: h.height}, nil
+}
+
+func decodePNM(r io.Reader) (image.Image, error) {
+	br := bufio.NewReader(r)
+	h, err := readPNMHeader(br)
+	if err != nil {
+		return nil, err
+	}
+
+	// Read every sample, scaled in place to 8 or 16 bits
+	channels := 3
+	if h.gray() {
+		channels = 1
+	}
+	deep := h.maxVal > 255
+	size := 1
+	if deep {
+		size = 2
+	}
+	// Binary samples are read before the image is allocated for, so that
+	// a header claiming more than the file holds costs nothing
+	n := h.width * h.height * channels * size
+	var samples []byte
+	if h.ascii() {
+		samples = make([]byte, 0, min(n, readExactlyChunk))
+	} else if samples, err = readExactly(br, int64(n)); err != nil {
+		return nil, fmt.Errorf("invalid PNM image: the samples are cut short")
+	}
+	top := 255
+	if deep {
+		top = 0xffff
+	}
+	for i := 0; i < h.width*h.height*channels; i++ {
+		var v int
+		switch {
+		case h.ascii():
+			if v, err = readPNMNumber(br); err != nil {
+				return nil, fmt.Errorf("invalid PNM image: %v", err)
+			}
+		case deep:
+			v = int(binary.BigEndian.Uint16(samples[2*i:]))
+		default:
+			v = int(samples[i])
+		}
+		if v > h.maxVal {
+			return nil, fmt.Errorf("invalid PNM image: sample %d above the maximum value %d", v, h.maxVal)
+		}
+		if h.maxVal != top {
+			v = (v*top + h.maxVal/2) / h.maxVal
+		}
+		switch {
+		case h.ascii() && deep:
+			samples = binary.BigEndian.AppendUint16(samples, uint16(v))
+		case h.ascii():
+			samples = append(samples, uint8(v))
+		case deep:
+			binary.BigEndian.PutUint16(samples[2*i:], uint16(v))
+		default:
+			samples[i] = uint8(v)
+		}
+	}
+
+	rect := image.Rect(0, 0, h.width, h.height)
+	switch {
+	case h.gray() && deep:
+		return &image.Gray16{Pix: samples, Stride: 2 * h.width, Rect: rect}, nil
+	case h.gray():
+		return &image.Gray{Pix: samples, Stride: h.width, Rect: rect}, nil
+	}
+	// Spread RGB over RGBA, with every pixel opaque
+	if deep {
+		rgba := image.NewRGBA64(rect)
+		for i, j := 0, 0; i < len(samples); i, j = i+6, j+8 {
+			copy(rgba.Pix[j:j+6], samples[i:i+6])
+			rgba.Pix[j+6], rgba.Pix[j+7] = 0xff, 0xff
+		}
+		return rgba, nil
+	}
+	rgba := image.NewRGBA(rect)
+	for i, j := 0, 0; i < len(samples); i, j = i+3, j+4 {
+		copy(rgba.Pix[j:j+3], samples[i:i+3])
+		rgba.Pix[j+3] = 0xff
+	}
+	return rgba, nil
+}
+
+// EncodePNM writes img to w as a Netpbm image: a PGM when format is "pgm",
+// converting color images to grayscale, or a PPM when it is "ppm", with
+// binary or ASCII samples by encoding. Samples are 16 bits for 16-bit
+// images. Netpbm has no alpha channel, so transparency is dropped.
+func EncodePNM(w io.Writer, img image.Image, format, encoding string) error {
+	if err := checkPNMEncoding(encoding); err != nil {
+		return err
+	}
+	gray := format == "pgm"
+	if !gray && format != "ppm" {
+		return fmt.Errorf("unknown PNM format %q (want ppm or pgm)", format)
+	}
+	ascii := encoding == PNMEncodingASCII
+	magic := map[[2]bool]string{{true, false}: "P5", {true, true}: "P2", {false, false}: "P6", {false, true}: "P3"}[[2]bool{gray, ascii}]
+	maxVal := 255
+	if is16Bit(img) {
+		maxVal = 0xffff
+	}
+
+	b := img.Bounds()
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "%s\n%d %d\n%d\n", magic, b.Dx(), b.Dy(), maxVal)
+	var samples []uint16
+	n := 0 // Samples on the current ASCII line
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			samples = samples[:0]
+			if gray {
+				samples = append(samples, color.Gray16Model.Convert(img.At(x, y)).(color.Gray16).Y)
+			} else {
+				c := color.NRGBA64Model.Convert(img.At(x, y)).(color.NRGBA64)
+				samples = append(samples, c.R, c.G, c.B)
+			}
+			for _, v := range samples {
+				if maxVal == 255 {
+					v >>= 8
+				}
+				switch {
+				case ascii:
+					sep := byte(' ')
+					if n++; n%16 == 0 {
+						sep = '\n'
+					}
+					bw.WriteString(strconv.Itoa(int(v)))
+					bw.WriteByte(sep)
+				case maxVal == 255:
+					bw.WriteByte(byte(v))
+				default:
+					bw.Write(binary.BigEndian.AppendUint16(nil, v))
+				}
+			}
+		}
+	}
+	if ascii && n%16 != 0 {
+		bw.WriteByte('\n')
+	}
+	return bw.Flush()
+}
@@ -0,0 +1,147 @@
+package pixellock
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// PNM fixtures in testdata, 16x12 each.
+var pnmFixtures = map[string]color.Model{
+	"testdata/scan.pgm":   color.GrayModel,   // P5 with a comment
+	"testdata/scan16.pgm": color.Gray16Model, // P5 with samples up to 65535
+	"testdata/frame.ppm":  color.RGBAModel,   // P6
+}
+
+func TestDecodePNM(t *testing.T) {
+	for fixture, model := range pnmFixtures {
+		if !isImageFile(fixture) {
+			t.Errorf("%s: not taken for an image", fixture)
+		}
+		img, err := LoadImage(fixture)
+		if err != nil {
+			t.Fatalf("%s: LoadImage failed: %v", fixture, err)
+		}
+		if img.ColorModel() != model || img.Bounds() != image.Rect(0, 0, 16, 12) {
+			t.Errorf("%s: decoded %T of %v", fixture, img, img.Bounds())
+		}
+	}
+	img, _ := LoadImage("testdata/frame.ppm")
+	if c := img.At(3, 2); c != (color.RGBA{48, 42, 18, 255}) {
+		t.Errorf("frame.ppm pixel (3, 2) is %v", c)
+	}
+	img, _ = LoadImage("testdata/scan16.pgm")
+	if c := img.At(3, 2); c != (color.Gray16{3*4099 + 2*257}) {
+		t.Errorf("scan16.pgm pixel (3, 2) is %v", c)
+	}
+
+	// ASCII samples, with comments, scaled from a maximum of 15
+	ascii := "P3\n# two pixels\n2 1\n15\n15 0 0 # red\n 0 5 15\n"
+	img, err := BytesToImage([]byte(ascii))
+	if err != nil {
+		t.Fatalf("decoding P3 failed: %v", err)
+	}
+	if a, b := img.At(0, 0), img.At(1, 0); a != (color.RGBA{255, 0, 0, 255}) || b != (color.RGBA{0, 85, 255, 255}) {
+		t.Errorf("P3 decoded to %v and %v", a, b)
+	}
+	img, err = BytesToImage([]byte("P2 2 2 1000 0 1000 500 250"))
+	if err != nil {
+		t.Fatalf("decoding P2 failed: %v", err)
+	}
+	if c := img.At(0, 1); img.ColorModel() != color.Gray16Model || c != (color.Gray16{32768}) {
+		t.Errorf("P2 with a maximum of 1000 decoded to %v, %v", img.ColorModel(), c)
+	}
+
+	for _, bad := range []string{
+		"P6\n2 2\n255\nabc",    // Cut short
+		"P5\n0 2\n255\n",       // Zero width
+		"P5\n1 1\n70000\n\x00", // Maximum too large
+		"P2\n1 1\n10\n11\n",    // Sample above the maximum
+		"P3\n1 1\n255\nx\n",    // Not a number
+	} {
+		if _, err := BytesToImage([]byte(bad)); err == nil {
+			t.Errorf("decoded %q", bad)
+		}
+	}
+}
+
+func TestEncodePNM(t *testing.T) {
+	for name, img := range map[string]image.Image{
+		"gray":   grayTestImage(30, 20),
+		"gray16": deepTestImages()["gray16"],
+		"rgb":    photoNRGBA(t),
+		"rgb16":  deepTestImages()["rgba64"],
+	} {
+		format := "ppm"
+		if img.ColorModel() == color.GrayModel || img.ColorModel() == color.Gray16Model {
+			format = "pgm"
+		}
+		for _, encoding := range []string{PNMEncodingBinary, PNMEncodingASCII} {
+			var buf bytes.Buffer
+			if err := EncodePNM(&buf, img, format, encoding); err != nil {
+				t.Fatalf("%s, %s: EncodePNM failed: %v", name, encoding, err)
+			}
+			got, err := BytesToImage(buf.Bytes())
+			if err != nil {
+				t.Fatalf("%s, %s: decoding failed: %v", name, encoding, err)
+			}
+			if !samePixels(got, img) {
+				t.Errorf("%s, %s: pixels changed", name, encoding)
+			}
+		}
+	}
+	if err := CheckOutputFormat("ppm:ascii"); err != nil {
+		t.Errorf("CheckOutputFormat(ppm:ascii) failed: %v", err)
+	}
+	if err := CheckOutputFormat("pgm:raw"); err == nil {
+		t.Error("CheckOutputFormat accepted pgm:raw")
+	}
+}
+
+func TestPNMRoundTrip(t *testing.T) {
+	key, err := GenerateRandomKey()
+	if err != nil {
+		t.Fatalf("GenerateRandomKey failed: %v", err)
+	}
+	dir := t.TempDir()
+	for fixture := range pnmFixtures {
+		want, err := LoadImage(fixture)
+		if err != nil {
+			t.Fatalf("LoadImage failed: %v", err)
+		}
+		name := filepath.Base(fixture)
+
+		// Encrypted and decrypted back to the format it came in
+		encrypted := filepath.Join(dir, name+EncryptedExtension)
+		if err := EncryptFile(t.Context(), fixture, encrypted, key, false, EncryptOptions{}); err != nil {
+			t.Fatalf("%s: EncryptFile failed: %v", name, err)
+		}
+		decrypted := filepath.Join(dir, "decrypted", strings.TrimSuffix(name, filepath.Ext(name))+".png")
+		if err := DecryptFile(t.Context(), encrypted, decrypted, key, false, SaveOptions{}); err != nil {
+			t.Fatalf("%s: DecryptFile failed: %v", name, err)
+		}
+		restored := filepath.Join(dir, "decrypted", name)
+		if format, err := DetectImageFormat(restored); err != nil || format != strings.TrimPrefix(filepath.Ext(name), ".") {
+			t.Errorf("%s: decrypted to %q, %v", name, format, err)
+		}
+		if got, err := LoadImage(restored); err != nil || !samePixels(got, want) {
+			t.Errorf("%s: decrypted pixels differ (%v)", name, err)
+		}
+
+		// Converted to PNG and back
+		png := filepath.Join(dir, "converted", name+".png")
+		if _, err := ConvertFile(fixture, png, ConvertOptions{}); err != nil {
+			t.Fatalf("%s: ConvertFile to png failed: %v", name, err)
+		}
+		back := filepath.Join(dir, "converted", name)
+		if _, err := ConvertFile(png, back, ConvertOptions{}); err != nil {
+			t.Fatalf("%s: ConvertFile from png failed: %v", name, err)
+		}
+		if got, err := LoadImage(back); err != nil || !samePixels(got, want) {
+			t.Errorf("%s: converted pixels differ (%v)", name, err)
+		}
+	}
+}
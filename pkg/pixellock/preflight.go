@@ -0,0 +1,124 @@
+package pixellock
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"strings"
+)
+
+// DefaultMaxUnreadable is the fraction of the files found that may be
+// unreadable before EncryptDirectory gives up, when EncryptOptions leaves
+// MaxUnreadable zero.
+const DefaultMaxUnreadable = 0.5
+
+// ErrTooManyUnreadable is matched by the *UnreadableError a directory
+// fails with before anything in it is encrypted.
+var ErrTooManyUnreadable = errors.New("too many unreadable files")
+
+// maxUnreportedUnreadable is the most unreadable files an UnreadableError
+// lists.
+const maxUnreportedUnreadable = 10
+
+// An UnreadableError reports the files of a directory that could not be
+// read, when there were more than EncryptOptions allows: as when the
+// filesystem they are on is not mounted, or not readable. Nothing in the
+// directory is encrypted then.
+type UnreadableError struct {
+	Dir        string
+	Found      int     // The files found that are images or could not be read
+	Unreadable []error // A *PathError for each file that could not be read
+}
+
+func (e *UnreadableError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d of %d files in %s are unreadable, so nothing was encrypted; is it mounted and readable?", len(e.Unreadable), e.Found, e.Dir)
+	for i, err := range e.Unreadable {
+		if i == maxUnreportedUnreadable {
+			fmt.Fprintf(&b, "\n  and %d more", len(e.Unreadable)-i)
+			break
+		}
+		fmt.Fprintf(&b, "\n  %v", err)
+	}
+	return b.String()
+}
+
+func (e *UnreadableError) Is(target error) bool {
+	return target == ErrTooManyUnreadable
+}
+
+// maxUnreadable returns the fraction of MaxUnreadable the options allow.
+func (o EncryptOptions) maxUnreadable() float64 {
+	if o.MaxUnreadable == 0 {
+		return DefaultMaxUnreadable
+	}
+	return o.MaxUnreadable
+}
+
+// checkUnreadable returns an *UnreadableError when more than the fraction
+// max of the found files of dir, those probed as images and those
+// unreadable, are unreadable.
+func checkUnreadable(dir string, images int, unreadable []error, max float64) error {
+	found := images + len(unreadable)
+	if len(unreadable) == 0 || float64(len(unreadable)) <= max*float64(found) {
+		return nil
+	}
+	return &UnreadableError{Dir: dir, Found: found, Unreadable: unreadable}
+}
+
+// An imageProbe is what the header of an image file says of it, read as
+// its directory is walked, for encryption to use rather than read again.
+type imageProbe struct {
+	image.Config
+	Format string
+}
+
+// probeImage reads the header of the image file filename in fsys. It fails
+// with ErrUnsupportedFormat for a file that is not an image, and with
+// ErrImageTooLarge, and the probe, for an image over the limit of
+// maxPixels; any other error means the file could not be read, as
+// unreadable reports.
+func probeImage(fsys FileSystem, filename string, maxPixels int64) (imageProbe, error) {
+	f, err := fsys.Open(filename)
+	if err != nil {
+		return imageProbe{}, openError(filename, err)
+	}
+	defer f.Close()
+
+	// A failed read looks like an unknown format to DecodeConfig, which
+	// reads no further once it cannot match one
+	r := &errorReader{r: f}
+	config, format, err := image.DecodeConfig(r)
+	switch {
+	case r.err != nil:
+		return imageProbe{}, &PathError{Op: "read", Path: filename, Err: r.err}
+	case errors.Is(err, image.ErrFormat):
+		return imageProbe{}, ErrUnsupportedFormat
+	case err != nil:
+		return imageProbe{}, fmt.Errorf("unreadable image: %w", err)
+	}
+	p := imageProbe{Config: config, Format: format}
+	return p, checkPixels(config.Width, config.Height, maxPixels)
+}
+
+// unreadable reports whether err, from probeImage, means the file could
+// not be read, rather than that it is not an image or too large to be one.
+func unreadable(err error) bool {
+	return err != nil && !errors.Is(err, ErrUnsupportedFormat) && !errors.Is(err, ErrImageTooLarge)
+}
+
+// errorReader reads r, keeping the first error other than io.EOF that it
+// gives.
+type errorReader struct {
+	r   io.Reader
+	err error
+}
+
+func (r *errorReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err != nil && err != io.EOF && r.err == nil {
+		r.err = err
+	}
+	return n, err
+}
@@ -0,0 +1,152 @@
+package pixellock
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+)
+
+// probeMemFS is a MemFS that counts the files opened, and on which those
+// named in fail fail to open or to read, as on a filesystem not mounted:
+// fs.ErrPermission fails the open with an *fs.PathError, syscall.EIO the
+// reads, and any other error the open as it is.
+type probeMemFS struct {
+	*MemFS
+	mu     sync.Mutex
+	opened map[string]int
+	fail   map[string]error
+}
+
+func (p *probeMemFS) Open(name string) (fs.File, error) {
+	p.mu.Lock()
+	p.opened[name]++
+	p.mu.Unlock()
+	switch err := p.fail[name]; {
+	case errors.Is(err, fs.ErrPermission):
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	case errors.Is(err, syscall.EIO):
+		f, err := p.MemFS.Open(name)
+		return failingFile{f}, err
+	case err != nil:
+		return nil, err
+	}
+	return p.MemFS.Open(name)
+}
+
+// failingFile is a file whose reads fail.
+type failingFile struct {
+	fs.File
+}
+
+func (failingFile) Read([]byte) (int, error) {
+	return 0, syscall.EIO
+}
+
+func newProbeMemFS(t *testing.T, images int, fail map[string]error) *probeMemFS {
+	mem, _ := progressFixture(t, images)
+	memWrite(t, mem, "in/notes.txt", []byte("not an image"))
+	return &probeMemFS{MemFS: mem, opened: map[string]int{}, fail: fail}
+}
+
+func TestProbeOnce(t *testing.T) {
+	key, _ := GenerateRandomKey()
+	fsys := newProbeMemFS(t, 3, nil)
+	memWrite(t, fsys.MemFS, "in/bomb.png", hugePNG(t, 100000, 100000))
+	if err := EncryptDirectory(t.Context(), "in", "enc", key, false, false, EncryptOptions{FS: fsys}); err != nil {
+		t.Fatalf("EncryptDirectory failed: %v", err)
+	}
+
+	// Probed as found, then read once to be encrypted; the others are
+	// left once their headers are read
+	want := map[string]int{"in/notes.txt": 1, "in/bomb.png": 1}
+	for i := range 3 {
+		want[fmt.Sprintf("in/img%d.png", i)] = 2
+	}
+	for name, n := range want {
+		if got := fsys.opened[name]; got != n {
+			t.Errorf("%s opened %d times, want %d", name, got, n)
+		}
+	}
+	if exists(fsys, "enc/bomb.png.enc") {
+		t.Error("the bomb was encrypted")
+	}
+}
+
+func TestUnreadableThreshold(t *testing.T) {
+	key, _ := GenerateRandomKey()
+	fail := map[string]error{
+		"in/img0.png": fs.ErrPermission,
+		"in/img1.png": syscall.EIO,
+		"in/img2.png": fs.ErrPermission,
+	}
+
+	// 3 of 4 files unreadable, with the text file not counted, is over
+	// the default half: nothing is encrypted, and each file is listed
+	fsys := newProbeMemFS(t, 4, fail)
+	err := EncryptDirectory(t.Context(), "in", "enc", key, false, false, EncryptOptions{FS: fsys})
+	var ue *UnreadableError
+	if !errors.As(err, &ue) || !errors.Is(err, ErrTooManyUnreadable) || ErrorCodeOf(err) != CodeTooManyUnreadable {
+		t.Fatalf("EncryptDirectory = %v, want an UnreadableError", err)
+	}
+	if ue.Found != 4 || len(ue.Unreadable) != 3 {
+		t.Errorf("UnreadableError of %d files of %d, want 3 of 4", len(ue.Unreadable), ue.Found)
+	}
+	for name, cause := range fail {
+		if !strings.Contains(err.Error(), name) {
+			t.Errorf("%s is not listed in %q", name, err)
+		}
+		if !errors.Is(errors.Join(ue.Unreadable...), cause) {
+			t.Errorf("the cause of %s, %v, is not kept", name, cause)
+		}
+	}
+	if exists(fsys, "enc") {
+		t.Error("files were encrypted before failing")
+	}
+	if fsys.opened["in/img3.png"] != 1 {
+		t.Errorf("in/img3.png opened %d times, want once to probe it", fsys.opened["in/img3.png"])
+	}
+
+	// At the threshold, or with it raised, what can be read is encrypted
+	for _, test := range []struct {
+		images        int
+		maxUnreadable float64
+	}{{6, 0}, {4, 1}} {
+		fsys := newProbeMemFS(t, test.images, fail)
+		opts := EncryptOptions{FS: fsys, MaxUnreadable: test.maxUnreadable}
+		if err := EncryptDirectory(t.Context(), "in", "enc", key, false, false, opts); err != nil {
+			t.Errorf("EncryptDirectory of %d images with %g unreadable failed: %v", test.images, test.maxUnreadable, err)
+		}
+		for i := 3; i < test.images; i++ {
+			if name := filepath.Join("enc", fmt.Sprintf("img%d.png.enc", i)); !exists(fsys, name) {
+				t.Errorf("%s was not encrypted", name)
+			}
+		}
+	}
+
+	if err := (EncryptOptions{MaxUnreadable: 1.5}).Check(); err == nil {
+		t.Error("Check accepted an unreadable fraction of 1.5")
+	}
+}
+
+// TestUnwrappedOpenError checks the errors of a FileSystem whose Open
+// fails with an error wrapping nothing, which are reported as they are.
+func TestUnwrappedOpenError(t *testing.T) {
+	key, _ := GenerateRandomKey()
+	gone := errors.New("share went away")
+	fsys := newProbeMemFS(t, 2, map[string]error{"in/img0.png": gone, "in/img1.png": gone})
+	err := EncryptDirectory(t.Context(), "in", "enc", key, false, false, EncryptOptions{FS: fsys})
+	if !errors.Is(err, ErrTooManyUnreadable) || !errors.Is(errors.Join(err.(*UnreadableError).Unreadable...), gone) {
+		t.Fatalf("EncryptDirectory = %v, want an UnreadableError of %v", err, gone)
+	}
+	if want := "open in/img0.png: share went away"; !strings.Contains(err.Error(), want) {
+		t.Errorf("UnreadableError %q does not report %q", err, want)
+	}
+	if _, err := LoadImageFS(fsys, "in/img1.png"); err == nil || err.Error() != "open in/img1.png: share went away" {
+		t.Errorf("LoadImageFS = %v, want the open failing", err)
+	}
+}
@@ -0,0 +1,145 @@
+package pixellock
+
+import (
+	"io"
+	"slices"
+	"sync"
+)
+
+// Phases of the progress events of encryption and decryption.
+const (
+	PhaseScan    = "scan"    // A directory is being searched for files
+	PhaseEncrypt = "encrypt" // A file is being encrypted
+	PhaseDecrypt = "decrypt" // A file is being decrypted
+	PhaseWrite   = "write"   // A file has been written
+	PhaseSkip    = "skip"    // A file has been left alone, its output existing, or a reference made to its duplicate
+)
+
+// An Event reports the progress of EncryptFile, DecryptFile and the
+// directory functions to the Progress callback of their options.
+//
+// A directory gives a scan event for each file it finds, with Done the
+// number found so far, and when it has found them all, one for itself
+// with Done and Total that number. Then each file gives encrypt or
+// decrypt events as its bytes are read, with Done the bytes read of
+// Total, and ends with a write event, with Output the file written, or an
+// event with Err set. A file whose output exists already, without
+// overwriting, gives a skip event instead, with Output that file and Err
+// matching ErrOutputExists, and is not counted as failed. A file's events
+// come in that order, but the events of files encrypted at once are
+// interleaved. The write event of a file encrypted or decrypted as a
+// stream names the cipher suite it was in Cipher.
+type Event struct {
+	Phase  string // One of the Phase constants
+	Path   string // The input file, or directory for scan events
+	Output string // The file written, for write events
+	Done   int64
+	Total  int64
+	Err    error  // Why the file failed or was skipped, ending its events
+	Cipher string // The CipherName of the suite of a stream, for its write event
+}
+
+// partial reports whether e is a count of bytes read before the last, the
+// events a queue can best spare.
+func (e Event) partial() bool {
+	return e.Err == nil && (e.Phase == PhaseEncrypt || e.Phase == PhaseDecrypt) && e.Done < e.Total
+}
+
+// maxQueuedEvents bounds the events waiting for a slow Progress callback.
+const maxQueuedEvents = 256
+
+// An eventQueue calls a Progress callback with the events emitted to it,
+// in order, on a goroutine of its own, so that a slow callback never holds
+// up encryption. When maxQueuedEvents are waiting, the oldest partial one
+// is dropped for each new one, or the oldest of any when none is partial.
+// A nil queue drops every event.
+type eventQueue struct {
+	progress func(Event)
+	mu       sync.Mutex
+	events   []Event
+	closed   bool
+	wake     chan struct{}
+	done     chan struct{}
+}
+
+// newEventQueue returns a queue calling progress, or nil when progress is.
+func newEventQueue(progress func(Event)) *eventQueue {
+	if progress == nil {
+		return nil
+	}
+	q := &eventQueue{progress: progress, wake: make(chan struct{}, 1), done: make(chan struct{})}
+	go q.deliver()
+	return q
+}
+
+// emit queues e without waiting for the callback.
+func (q *eventQueue) emit(e Event) {
+	if q == nil {
+		return
+	}
+	q.mu.Lock()
+	if len(q.events) >= maxQueuedEvents {
+		i := max(slices.IndexFunc(q.events, Event.partial), 0)
+		q.events = slices.Delete(q.events, i, i+1)
+	}
+	q.events = append(q.events, e)
+	q.mu.Unlock()
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// close waits for the callback to be given the events queued, after which
+// no more may be emitted.
+func (q *eventQueue) close() {
+	if q == nil {
+		return
+	}
+	q.mu.Lock()
+	q.closed = true
+	q.mu.Unlock()
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	<-q.done
+}
+
+// deliver calls the callback with each event queued until the queue is
+// closed and empty.
+func (q *eventQueue) deliver() {
+	defer close(q.done)
+	for {
+		q.mu.Lock()
+		events, closed := q.events, q.closed
+		q.events = nil
+		q.mu.Unlock()
+		for _, e := range events {
+			q.progress(e)
+		}
+		if closed {
+			return
+		}
+		if len(events) == 0 {
+			<-q.wake
+		}
+	}
+}
+
+// progressReader reads from r, emitting event with Done advanced by each
+// read to q.
+type progressReader struct {
+	r     io.Reader
+	q     *eventQueue
+	event Event
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	if n > 0 {
+		p.event.Done += int64(n)
+		p.q.emit(p.event)
+	}
+	return n, err
+}
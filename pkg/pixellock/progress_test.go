@@ -0,0 +1,187 @@
+package pixellock
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// progressFixture writes n small images to the directory in of a MemFS
+// and returns both.
+func progressFixture(t *testing.T, n int) (*MemFS, string) {
+	fsys := &MemFS{}
+	for i := range n {
+		memImage(t, fsys, filepath.Join("in", fmt.Sprintf("img%d.png", i)), redTestImage())
+	}
+	return fsys, "in"
+}
+
+// checkEventOrder checks that the scan events of dir come first, ending
+// with one for dir itself, and that each file's events count its bytes up
+// in phase and end with it written to the output want gives it.
+func checkEventOrder(t *testing.T, events []Event, dir, phase string, want func(path string) string) {
+	t.Helper()
+	scans := 0
+	for scans < len(events) && events[scans].Phase == PhaseScan {
+		scans++
+	}
+	if scans == 0 || events[scans-1].Path != dir || events[scans-1].Total != int64(scans-1) {
+		t.Fatalf("scan events %+v do not end with the directory and its %d files", events[:scans], scans-1)
+	}
+	byFile := map[string][]Event{}
+	for _, e := range events[scans:] {
+		if e.Phase == PhaseScan {
+			t.Errorf("scan event %+v after the scan", e)
+		}
+		byFile[e.Path] = append(byFile[e.Path], e)
+	}
+	if len(byFile) != scans-1 {
+		t.Errorf("events for %d files, want %d", len(byFile), scans-1)
+	}
+	for path, events := range byFile {
+		last := events[len(events)-1]
+		if last.Phase != PhaseWrite || last.Output != want(path) || last.Err != nil {
+			t.Errorf("%s: last event %+v, want it written to %s", path, last, want(path))
+		}
+		var done int64
+		for _, e := range events[:len(events)-1] {
+			if e.Phase != phase || e.Done < done || e.Done > e.Total {
+				t.Errorf("%s: event %+v out of order", path, e)
+			}
+			done = e.Done
+		}
+		if prev := events[len(events)-2]; prev.Done != prev.Total {
+			t.Errorf("%s: written after %d of %d bytes", path, prev.Done, prev.Total)
+		}
+	}
+}
+
+func TestProgressEvents(t *testing.T) {
+	key, _ := GenerateRandomKey()
+	fsys, input := progressFixture(t, 3)
+	encrypted := "enc"
+	var events []Event
+	opts := EncryptOptions{Progress: func(e Event) { events = append(events, e) }, FS: fsys}
+	if err := EncryptDirectory(t.Context(), input, encrypted, key, false, false, opts); err != nil {
+		t.Fatalf("EncryptDirectory failed: %v", err)
+	}
+	checkEventOrder(t, events, input, PhaseEncrypt, func(path string) string {
+		return filepath.Join(encrypted, filepath.Base(path)+EncryptedExtension)
+	})
+
+	decrypted := "dec"
+	events = nil
+	save := SaveOptions{Progress: func(e Event) { events = append(events, e) }, FS: fsys}
+	if err := DecryptDirectory(t.Context(), encrypted, decrypted, key, false, EncryptedExtension, false, save); err != nil {
+		t.Fatalf("DecryptDirectory failed: %v", err)
+	}
+	checkEventOrder(t, events, encrypted, PhaseDecrypt, func(path string) string {
+		return filepath.Join(decrypted, filepath.Base(path[:len(path)-len(EncryptedExtension)]))
+	})
+
+	// A failure ends the file's events
+	events = nil
+	notImage := filepath.Join(input, "notes.txt")
+	memWrite(t, fsys, notImage, []byte("not an image"))
+	if err := EncryptFile(t.Context(), notImage, notImage+".enc", key, false, opts); err == nil {
+		t.Fatal("EncryptFile of a text file succeeded")
+	}
+	if len(events) != 1 || events[0].Err == nil || events[0].Path != notImage {
+		t.Errorf("EncryptFile of a text file gave events %+v, want its error", events)
+	}
+
+	// A file left alone, its output existing, gives a skip event alone
+	events = nil
+	img := filepath.Join(input, "img0.png")
+	output := filepath.Join(encrypted, "img0.png"+EncryptedExtension)
+	if err := EncryptFile(t.Context(), img, output, key, false, opts); err != nil {
+		t.Fatalf("EncryptFile failed: %v", err)
+	}
+	if len(events) != 1 || events[0].Phase != PhaseSkip || events[0].Output != output || !errors.Is(events[0].Err, ErrOutputExists) {
+		t.Errorf("EncryptFile to an existing file gave events %+v, want it skipped", events)
+	}
+}
+
+func TestProgressSlowConsumer(t *testing.T) {
+	key, _ := GenerateRandomKey()
+	fsys, input := progressFixture(t, 8)
+	encrypted := "enc"
+
+	// The callback is held up until every file is written
+	release := make(chan struct{})
+	var events []Event
+	opts := EncryptOptions{Progress: func(e Event) {
+		<-release
+		events = append(events, e)
+	}, FS: fsys}
+	returned := make(chan error)
+	go func() {
+		returned <- EncryptDirectory(t.Context(), input, encrypted, key, false, false, opts)
+	}()
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if found, _ := fs.Glob(fsys, encrypted+"/*"+EncryptedExtension); len(found) == 8 {
+			break
+		}
+		if time.Now().After(deadline) {
+			close(release)
+			t.Fatal("the workers waited for the callback")
+		}
+	}
+	close(release)
+	if err := <-returned; err != nil {
+		t.Fatalf("EncryptDirectory failed: %v", err)
+	}
+	checkEventOrder(t, events, input, PhaseEncrypt, func(path string) string {
+		return filepath.Join(encrypted, filepath.Base(path)+EncryptedExtension)
+	})
+}
+
+func TestEventQueueDropsOldest(t *testing.T) {
+	release := make(chan struct{})
+	var got []Event
+	q := newEventQueue(func(e Event) {
+		<-release
+		got = append(got, e)
+	})
+
+	// Emitting never waits, however far behind the callback is
+	start := time.Now()
+	const n = 10 * maxQueuedEvents
+	for i := range n {
+		e := Event{Phase: PhaseEncrypt, Path: "a", Done: int64(i), Total: n}
+		if i%100 == 99 {
+			e = Event{Phase: PhaseWrite, Path: "a", Done: int64(i)}
+		}
+		q.emit(e)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("emitting took %v", elapsed)
+	}
+	close(release)
+	q.close()
+
+	// The oldest partial events are dropped first, and the rest kept in
+	// order
+	if len(got) > maxQueuedEvents+1 {
+		t.Errorf("%d events delivered, want at most %d", len(got), maxQueuedEvents+1)
+	}
+	if !slices.IsSortedFunc(got, func(a, b Event) int { return int(a.Done - b.Done) }) {
+		t.Error("events delivered out of order")
+	}
+	writes := 0
+	for _, e := range got {
+		if e.Phase == PhaseWrite {
+			writes++
+		}
+	}
+	if writes != n/100 {
+		t.Errorf("%d write events delivered, want all %d", writes, n/100)
+	}
+	if last := got[len(got)-1]; last.Done != n-1 {
+		t.Errorf("last event delivered %+v, want the last emitted", last)
+	}
+}
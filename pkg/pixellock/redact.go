@@ -0,0 +1,197 @@
+package pixellock
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"image"
+)
+
+// A redacted image is a PNG whose pixels inside the redacted regions are
+// replaced with noise, while the rest of the image stays viewable. The
+// original pixels are kept, encrypted, in a redactChunk chunk: a count of
+// regions, every region as big-endian uint16 x, y, width and height, then
+// the NRGBA bytes of each pixel inside any region, in raster order, so
+// overlapping regions store their shared pixels once.
+
+// RedactedExtension is appended to the images a directory run redacts.
+const RedactedExtension = ".redacted.png"
+
+// redactChunk is the type of the PNG chunk holding the encrypted regions of
+// a redacted image: ancillary, private and unsafe to copy, so editors that
+// change the image drop it rather than keep stale pixels.
+const redactChunk = "pxRG"
+
+// maxRedactRegions is the most regions an image can have redacted.
+const maxRedactRegions = 0xffff
+
+// IsRedacted reports whether data is a PNG redacted by Redact.
+func IsRedacted(data []byte) bool {
+	_, ok := pngChunkBody(data, redactChunk)
+	return ok
+}
+
+// ClipRegions returns regions clipped to the bounds b of an image, so that
+// regions reaching past an edge redact up to it. It fails when a region
+// lies outside the image altogether.
+func ClipRegions(regions []image.Rectangle, b image.Rectangle) ([]image.Rectangle, error) {
+	if len(regions) > maxRedactRegions {
+		return nil, fmt.Errorf("too many regions: at most %d", maxRedactRegions)
+	}
+	frame := image.Rect(0, 0, b.Dx(), b.Dy())
+	clipped := make([]image.Rectangle, len(regions))
+	for i, r := range regions {
+		if clipped[i] = r.Intersect(frame); clipped[i].Empty() {
+			return nil, fmt.Errorf("region %s lies outside the %dx%d image", regionString(r), b.Dx(), b.Dy())
+		}
+	}
+	return clipped, nil
+}
+
+// Redact returns the PNG data, as ReadImageForEncryption gives it, with the
+// pixels inside regions replaced by noise and their original values stored
+// encrypted with key. Regions reaching past the edges of the image are
+// clipped to it. The format recorded in data is kept; its EXIF metadata is
+// not, as it would be readable by anyone, so data should have been read
+// with MetadataStrip, turning it upright as the regions are given.
+func Redact(key, data []byte, regions []image.Rectangle) ([]byte, error) {
+	return redact(key, data, regions, 0)
+}
+
+// redact is Redact of an image of no more pixels than maxPixels allows.
+func redact(key, data []byte, regions []image.Rectangle, maxPixels int64) ([]byte, error) {
+	if len(regions) == 0 {
+		return nil, fmt.Errorf("no regions to redact")
+	}
+	if IsGIFData(data) || IsHEIFData(data) {
+		return nil, fmt.Errorf("animated GIFs and HEIF images cannot be redacted; encrypt them whole")
+	}
+	img, err := bytesToImage(data, maxPixels)
+	if err != nil {
+		return nil, err
+	}
+	if is16Bit(img) {
+		return nil, fmt.Errorf("16-bit images cannot be redacted, as the result is 8 bits per channel; encrypt them whole")
+	}
+	nrgbaImg := toNRGBA(img)
+	if regions, err = ClipRegions(regions, nrgbaImg.Rect); err != nil {
+		return nil, err
+	}
+
+	record := binary.BigEndian.AppendUint16(nil, uint16(len(regions)))
+	for _, r := range regions {
+		for _, v := range []int{r.Min.X, r.Min.Y, r.Dx(), r.Dy()} {
+			record = binary.BigEndian.AppendUint16(record, uint16(v))
+		}
+	}
+	var offsets []int
+	forRegionPixels(nrgbaImg, regions, func(i int) {
+		record = append(record, nrgbaImg.Pix[i:i+4]...)
+		offsets = append(offsets, i)
+	})
+	encrypted, err := Encrypt(key, record)
+	if err != nil {
+		return nil, err
+	}
+
+	// Noise in place of the color, keeping the alpha of every pixel
+	noise := make([]byte, 3*len(offsets))
+	if _, err := rand.Read(noise); err != nil {
+		return nil, fmt.Errorf("failed to generate noise: %w", err)
+	}
+	for n, i := range offsets {
+		copy(nrgbaImg.Pix[i:i+3], noise[3*n:])
+	}
+	return redactedPNG(nrgbaImg, data, redactChunk, encrypted)
+}
+
+// Unredact returns the PNG data of the image Redact redacted into data
+// with key, with the original pixels of its regions restored.
+func Unredact(key, data []byte) ([]byte, error) {
+	return unredact(key, data, 0)
+}
+
+// unredact is Unredact of an image of no more pixels than maxPixels allows.
+func unredact(key, data []byte, maxPixels int64) ([]byte, error) {
+	encrypted, ok := pngChunkBody(data, redactChunk)
+	if !ok {
+		return nil, fmt.Errorf("not a redacted image: %w", ErrNotEncryptedFile)
+	}
+	record, err := Decrypt(key, encrypted)
+	if err != nil {
+		return nil, err
+	}
+	img, err := bytesToImage(data, maxPixels)
+	if err != nil {
+		return nil, err
+	}
+	nrgbaImg := toNRGBA(img)
+
+	if len(record) < 2 {
+		return nil, fmt.Errorf("redacted regions truncated")
+	}
+	count := int(binary.BigEndian.Uint16(record))
+	record = record[2:]
+	if len(record) < count*regionRectSize {
+		return nil, fmt.Errorf("redacted regions truncated")
+	}
+	regions := make([]image.Rectangle, count)
+	for i := range regions {
+		v := func(k int) int { return int(binary.BigEndian.Uint16(record[i*regionRectSize+2*k:])) }
+		regions[i] = image.Rect(v(0), v(1), v(0)+v(2), v(1)+v(3))
+		if !regions[i].In(nrgbaImg.Rect) {
+			return nil, fmt.Errorf("redacted region %s lies outside the image", regionString(regions[i]))
+		}
+	}
+	pixels := record[count*regionRectSize:]
+	var n int
+	forRegionPixels(nrgbaImg, regions, func(i int) {
+		if n+4 <= len(pixels) {
+			copy(nrgbaImg.Pix[i:i+4], pixels[n:n+4])
+		}
+		n += 4
+	})
+	if n != len(pixels) {
+		return nil, fmt.Errorf("redacted regions hold %d pixel bytes, want %d", len(pixels), n)
+	}
+	return redactedPNG(nrgbaImg, data, "", nil)
+}
+
+// forRegionPixels calls fn with the Pix offset of every pixel of img inside
+// any of regions, once each, in raster order.
+func forRegionPixels(img *image.NRGBA, regions []image.Rectangle, fn func(i int)) {
+	var bounds image.Rectangle
+	for _, r := range regions {
+		bounds = bounds.Union(r)
+	}
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			p := image.Pt(x, y)
+			for _, r := range regions {
+				if p.In(r) {
+					fn(img.PixOffset(x, y))
+					break
+				}
+			}
+		}
+	}
+}
+
+// redactedPNG encodes img as a PNG carrying the format recorded in the PNG
+// data it was decoded from, and a chunk of type typ holding body unless typ
+// is empty.
+func redactedPNG(img *image.NRGBA, from []byte, typ string, body []byte) ([]byte, error) {
+	out, err := ImageToBytes(img)
+	if err != nil {
+		return nil, err
+	}
+	if format := recordedFormat(from); format != "" {
+		if out, err = SetOriginalFormat(out, format); err != nil {
+			return nil, err
+		}
+	}
+	if typ != "" {
+		out, err = addPNGChunk(out, pngChunk(typ, body))
+	}
+	return out, err
+}
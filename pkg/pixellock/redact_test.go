@@ -0,0 +1,108 @@
+package pixellock
+
+import (
+	"bytes"
+	"image"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRedactRegions(t *testing.T) {
+	key, err := GenerateRandomKey()
+	if err != nil {
+		t.Fatalf("GenerateRandomKey failed: %v", err)
+	}
+	dir := t.TempDir()
+	img := photoNRGBA(t)
+	b := img.Bounds()
+	original := filepath.Join(dir, "street.png")
+	if err := SaveImage(original, img, SaveOptions{Format: "png"}); err != nil {
+		t.Fatalf("SaveImage failed: %v", err)
+	}
+
+	// A face and a plate overlapping it, the plate running past the right
+	// edge, which clips it
+	face := image.Rect(10, 8, 40, 30)
+	plate := image.Rect(30, 20, b.Dx()+15, 36)
+	redacted := filepath.Join(dir, "street"+RedactedExtension)
+	opts := EncryptOptions{Metadata: MetadataPreserve, Regions: []image.Rectangle{face, plate}}
+	if err := EncryptFile(t.Context(), original, redacted, key, false, opts); err != nil {
+		t.Fatalf("EncryptFile failed: %v", err)
+	}
+	data, err := os.ReadFile(redacted)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	if !IsRedacted(data) {
+		t.Fatal("redacted file is not marked as redacted")
+	}
+	loaded, err := BytesToImage(data)
+	if err != nil {
+		t.Fatalf("BytesToImage failed: %v", err)
+	}
+	got := asNRGBA(loaded)
+
+	var changed int
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			p := image.Pt(x, y)
+			want, have := img.Pix[img.PixOffset(x, y):][:4], got.Pix[got.PixOffset(x, y):][:4]
+			if !p.In(face) && !p.In(plate) {
+				if !bytes.Equal(have, want) {
+					t.Fatalf("pixel %v outside the regions changed", p)
+				}
+			} else if !bytes.Equal(have, want) {
+				changed++
+			}
+		}
+	}
+	if inside := face.Dx()*face.Dy() + plate.Intersect(b).Dx()*plate.Dy() - face.Intersect(plate).Dx()*face.Intersect(plate).Dy(); changed < inside*9/10 {
+		t.Errorf("only %d of the %d redacted pixels changed", changed, inside)
+	}
+
+	decrypted := filepath.Join(dir, "restored.png")
+	if err := DecryptFile(t.Context(), redacted, decrypted, key, false, SaveOptions{Format: "png"}); err != nil {
+		t.Fatalf("DecryptFile failed: %v", err)
+	}
+	restored, err := LoadImage(decrypted)
+	if err != nil {
+		t.Fatalf("LoadImage failed: %v", err)
+	}
+	if !samePixels(asNRGBA(restored), img) {
+		t.Error("restored image differs from the original")
+	}
+
+	otherKey, _ := GenerateRandomKey()
+	if _, err := Unredact(otherKey, data); err == nil {
+		t.Error("Unredact accepted the wrong key")
+	}
+}
+
+func TestRedactRefusals(t *testing.T) {
+	key, _ := GenerateRandomKey()
+	dir := t.TempDir()
+	original := filepath.Join(dir, "in.png")
+	if err := SaveImage(original, grayTestImage(20, 20), SaveOptions{Format: "png"}); err != nil {
+		t.Fatalf("SaveImage failed: %v", err)
+	}
+	regions := []image.Rectangle{image.Rect(2, 2, 6, 6)}
+
+	if err := EncryptFile(t.Context(), original, filepath.Join(dir, "out.jpg"), key, false, EncryptOptions{Regions: regions}); err == nil {
+		t.Error("EncryptFile wrote a redacted image as a JPEG")
+	}
+	if err := (EncryptOptions{Mode: ModeScramble, Regions: regions}).Check(); err == nil {
+		t.Error("Check accepted regions with the scramble mode")
+	}
+	outside := []image.Rectangle{image.Rect(30, 30, 40, 40)}
+	if err := EncryptFile(t.Context(), original, filepath.Join(dir, "out.png"), key, false, EncryptOptions{Regions: outside}); err == nil {
+		t.Error("EncryptFile accepted a region outside the image")
+	}
+	plain, err := ImageToBytes(grayTestImage(8, 8))
+	if err != nil {
+		t.Fatalf("ImageToBytes failed: %v", err)
+	}
+	if _, err := Unredact(key, plain); err == nil {
+		t.Error("Unredact accepted an image that is not redacted")
+	}
+}
@@ -0,0 +1,108 @@
+package pixellock
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"strconv"
+	"strings"
+
+	"golang.org/x/image/draw"
+)
+
+// Resize scales an image, to fit a box or by a percentage, keeping its
+// aspect ratio. The zero Resize leaves images as they are.
+type Resize struct {
+	// Box is the size the image is scaled to fit, as viewers show it,
+	// turned upright; a zero side places no limit.
+	Box image.Point
+
+	Percent      float64 // Scale by this percentage instead of to Box, when set
+	AllowUpscale bool    // Enlarge images smaller than Box, or by over 100%
+}
+
+// ParseResize parses a resize given as WIDTHxHEIGHT, with either side left
+// out to only bound the other, as in 1024x or x768, or as a percentage, as
+// in 50%.
+func ParseResize(s string) (Resize, error) {
+	if p, ok := strings.CutSuffix(s, "%"); ok {
+		percent, err := strconv.ParseFloat(p, 64)
+		if err != nil || percent <= 0 || math.IsInf(percent, 0) {
+			return Resize{}, fmt.Errorf("invalid size %q: the percentage must be a positive number", s)
+		}
+		return Resize{Percent: percent}, nil
+	}
+	w, h, ok := strings.Cut(strings.ToLower(s), "x")
+	if !ok || w == "" && h == "" {
+		return Resize{}, fmt.Errorf("invalid size %q: want WIDTHxHEIGHT, WIDTHx, xHEIGHT or a percentage", s)
+	}
+	var r Resize
+	for _, side := range []struct {
+		s string
+		v *int
+	}{{w, &r.Box.X}, {h, &r.Box.Y}} {
+		if side.s == "" {
+			continue
+		}
+		n, err := strconv.Atoi(side.s)
+		if err != nil || n < 1 {
+			return Resize{}, fmt.Errorf("invalid size %q: sides must be positive numbers of pixels", s)
+		}
+		*side.v = n
+	}
+	return r, nil
+}
+
+// IsZero reports whether r leaves images as they are.
+func (r Resize) IsZero() bool {
+	return r.Box == (image.Point{}) && r.Percent == 0
+}
+
+// Apply returns img scaled by r with Catmull-Rom, keeping its color model
+// for grayscale and 16-bit images. The box is turned for orientations 5 to
+// 8, which viewers show with the width and height swapped. An image r would
+// enlarge without AllowUpscale is returned as it is.
+func (r Resize) Apply(img image.Image, orientation int) image.Image {
+	b := img.Bounds()
+	var scale float64
+	switch {
+	case r.Percent > 0:
+		scale = r.Percent / 100
+	case r.Box != (image.Point{}):
+		box := r.Box
+		if orientation >= 5 {
+			box.X, box.Y = box.Y, box.X
+		}
+		scale = math.Inf(1)
+		if box.X > 0 {
+			scale = float64(box.X) / float64(b.Dx())
+		}
+		if box.Y > 0 {
+			scale = min(scale, float64(box.Y)/float64(b.Dy()))
+		}
+	default:
+		return img
+	}
+	if scale > 1 && !r.AllowUpscale {
+		return img
+	}
+	size := image.Rect(0, 0, max(int(math.Round(float64(b.Dx())*scale)), 1), max(int(math.Round(float64(b.Dy())*scale)), 1))
+	if size.Size() == b.Size() {
+		return img
+	}
+
+	var dst draw.Image
+	switch {
+	case img.ColorModel() == color.GrayModel:
+		dst = image.NewGray(size)
+	case img.ColorModel() == color.Gray16Model:
+		dst = image.NewGray16(size)
+	case is16Bit(img):
+		dst = image.NewNRGBA64(size)
+	default:
+		dst = image.NewNRGBA(size)
+	}
+	draw.CatmullRom.Scale(dst, size, img, b, draw.Src, nil)
+	return dst
+}
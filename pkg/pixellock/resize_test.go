@@ -0,0 +1,100 @@
+package pixellock
+
+import (
+	"image"
+	"path/filepath"
+	"testing"
+)
+
+func TestDecryptResize(t *testing.T) {
+	key, err := GenerateRandomKey()
+	if err != nil {
+		t.Fatalf("GenerateRandomKey failed: %v", err)
+	}
+	dir := t.TempDir()
+	original := filepath.Join(dir, "photo.png")
+	if err := SaveImage(original, photoNRGBA(t), SaveOptions{Format: "png"}); err != nil {
+		t.Fatalf("SaveImage failed: %v", err)
+	}
+	encrypted := filepath.Join(dir, "photo.png.enc")
+	if err := EncryptFile(t.Context(), original, encrypted, key, false, EncryptOptions{}); err != nil {
+		t.Fatalf("EncryptFile failed: %v", err)
+	}
+
+	// The photo is 641x481
+	for _, tc := range []struct {
+		spec    string
+		upscale bool
+		want    image.Point
+	}{
+		{"320x", false, image.Pt(320, 240)},
+		{"x240", false, image.Pt(320, 240)},
+		{"400x100", false, image.Pt(133, 100)},
+		{"50%", false, image.Pt(321, 241)},
+		{"2000x", false, image.Pt(641, 481)},
+		{"200%", false, image.Pt(641, 481)},
+		{"2000x", true, image.Pt(2000, 1501)},
+	} {
+		r, err := ParseResize(tc.spec)
+		if err != nil {
+			t.Fatalf("ParseResize(%q) failed: %v", tc.spec, err)
+		}
+		r.AllowUpscale = tc.upscale
+		decrypted := filepath.Join(dir, "decrypted.png")
+		if err := DecryptFile(t.Context(), encrypted, decrypted, key, true, SaveOptions{Format: "png", Resize: r}); err != nil {
+			t.Fatalf("%s: DecryptFile failed: %v", tc.spec, err)
+		}
+		if size := imageSize(t, decrypted); size != tc.want {
+			t.Errorf("%s (upscale %v): decrypted size %v, want %v", tc.spec, tc.upscale, size, tc.want)
+		}
+	}
+
+	for _, spec := range []string{"", "x", "100", "0x10", "-5x", "0%", "abc%"} {
+		if _, err := ParseResize(spec); err == nil {
+			t.Errorf("ParseResize accepted %q", spec)
+		}
+	}
+}
+
+func TestDecryptAutoOrient(t *testing.T) {
+	key, err := GenerateRandomKey()
+	if err != nil {
+		t.Fatalf("GenerateRandomKey failed: %v", err)
+	}
+	dir := t.TempDir()
+	encrypted := filepath.Join(dir, "IMG_0001.jpg.enc")
+	if err := EncryptFile(t.Context(), exifPhoto(t), encrypted, key, false, EncryptOptions{Metadata: MetadataPreserve}); err != nil {
+		t.Fatalf("EncryptFile failed: %v", err)
+	}
+	height20, err := ParseResize("x20")
+	if err != nil {
+		t.Fatalf("ParseResize failed: %v", err)
+	}
+
+	// The portrait is stored 40x24 with an orientation of 6
+	for _, tc := range []struct {
+		name        string
+		save        SaveOptions
+		size        image.Point
+		orientation int
+	}{
+		{"auto-orient", SaveOptions{AutoOrient: true}, image.Pt(24, 40), 1},
+		{"auto-orient and resize", SaveOptions{AutoOrient: true, Resize: height20}, image.Pt(12, 20), 1},
+		{"resize", SaveOptions{Resize: height20}, image.Pt(20, 12), 6}, // 20 high as viewers show it
+	} {
+		for _, format := range []string{"jpeg", "png"} {
+			tc.save.Format = format
+			decrypted := filepath.Join(dir, "decrypted."+format)
+			if err := DecryptFile(t.Context(), encrypted, decrypted, key, true, tc.save); err != nil {
+				t.Fatalf("%s, %s: DecryptFile failed: %v", tc.name, format, err)
+			}
+			if size := imageSize(t, decrypted); size != tc.size {
+				t.Errorf("%s, %s: size %v, want %v", tc.name, format, size, tc.size)
+			}
+			orientation, taken, ok := fileEXIF(t, decrypted)
+			if !ok || orientation != tc.orientation || taken != testDateTimeOriginal {
+				t.Errorf("%s, %s: EXIF orientation %d, DateTimeOriginal %q, present %v; want %d", tc.name, format, orientation, taken, ok, tc.orientation)
+			}
+		}
+	}
+}
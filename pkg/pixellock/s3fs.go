@@ -0,0 +1,361 @@
+package pixellock
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// S3Scheme begins the names of objects in S3, s3://bucket/key, as an S3FS
+// takes them.
+const S3Scheme = "s3://"
+
+// DefaultS3PartSize is the size of the parts an S3FS uploads files larger
+// than it in, which S3 needs to be at least 5 MiB.
+const DefaultS3PartSize = 8 << 20
+
+// IsS3URL reports whether name is an s3://bucket/key URL.
+func IsS3URL(name string) bool {
+	return strings.HasPrefix(name, S3Scheme)
+}
+
+// s3Path splits the bucket and key out of name, reporting whether it names
+// an object in S3 at all. filepath.Join cleans s3://bucket into s3:/bucket,
+// so one slash is enough. The key of a bucket itself is empty.
+func s3Path(name string) (bucket, key string, ok bool) {
+	rest, ok := strings.CutPrefix(filepath.ToSlash(name), "s3:/")
+	if !ok {
+		return "", "", false
+	}
+	rest = path.Clean("/" + rest)[1:]
+	bucket, key, _ = strings.Cut(rest, "/")
+	return bucket, key, true
+}
+
+// joinName joins the name under dir, as filepath.Join does but keeping an
+// s3:// or sftp:// URL whole.
+func joinName(dir, name string) string {
+	if bucket, key, ok := s3Path(dir); ok {
+		return S3Scheme + path.Join(bucket, key, filepath.ToSlash(name))
+	}
+	if server, p, ok := sftpPath(dir); ok {
+		return sftpURL(server, path.Join(p, filepath.ToSlash(name)))
+	}
+	return filepath.Join(dir, name)
+}
+
+// An S3Object is an object listed in a bucket.
+type S3Object struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// An S3Client makes the requests of an S3FS to S3, or to anything standing
+// in for it. Keys have no leading slash. An S3Client can be used by several
+// goroutines at once.
+type S3Client interface {
+	// List returns the objects of bucket whose keys begin with prefix and,
+	// when delimiter is not empty, the prefixes ending in it that group
+	// the keys holding it after prefix, as ListObjectsV2 does. Those past
+	// the first limit objects and prefixes may be left out, or none are
+	// when limit is 0.
+	List(bucket, prefix, delimiter string, limit int) (objects []S3Object, prefixes []string, err error)
+
+	// Head returns the object key, or an error matching fs.ErrNotExist
+	// when there is none.
+	Head(bucket, key string) (S3Object, error)
+
+	// Get returns the object key for reading, or an error matching
+	// fs.ErrNotExist when there is none.
+	Get(bucket, key string) (io.ReadCloser, S3Object, error)
+
+	// Put writes data to the object key.
+	Put(bucket, key string, data []byte) error
+
+	// CreateUpload starts a multipart upload to the object key, returning
+	// its ID. UploadPart uploads its parts, numbered from 1, returning the
+	// ETag of each; CompleteUpload joins them, in order, into the object,
+	// and AbortUpload drops them.
+	CreateUpload(bucket, key string) (uploadID string, err error)
+	UploadPart(bucket, key, uploadID string, part int, data []byte) (etag string, err error)
+	CompleteUpload(bucket, key, uploadID string, etags []string) error
+	AbortUpload(bucket, key, uploadID string) error
+
+	// Copy copies the object srcKey of srcBucket to dstKey of dstBucket.
+	Copy(srcBucket, srcKey, dstBucket, dstKey string) error
+
+	// Delete deletes the object key, if there is one.
+	Delete(bucket, key string) error
+}
+
+// An S3FS is a FileSystem of the objects of S3, named by s3://bucket/key
+// URLs, and of the files of Local, named any other way, so that images can
+// be encrypted from S3, to S3 or both. The directories of a bucket are the
+// prefixes ending in a slash of its keys, so that s3://bucket/photos holds
+// s3://bucket/photos/a.jpg; writing a file creates them, and a directory
+// with nothing in it does not exist. Files are written as they are closed,
+// in parts of PartSize when larger.
+type S3FS struct {
+	Client   S3Client
+	Local    FileSystem // The FileSystem of other names; OSFS when nil
+	PartSize int        // DefaultS3PartSize when 0
+}
+
+func (s *S3FS) local() FileSystem { return orOS(s.Local) }
+
+// errNoBucket is the error of a name with no bucket, such as s3://.
+var errNoBucket = errors.New("no bucket named")
+
+// s3Error returns err as the error of op on name.
+func s3Error(op, name string, err error) error {
+	return &fs.PathError{Op: op, Path: name, Err: err}
+}
+
+// s3Info returns the information of obj.
+func s3Info(obj S3Object) memInfo {
+	return memInfo{name: obj.Key, size: obj.Size, modTime: obj.ModTime}
+}
+
+// dirPrefix returns the prefix of the keys under the directory key.
+func dirPrefix(key string) string {
+	if key == "" {
+		return ""
+	}
+	return key + "/"
+}
+
+// Stat returns the information of the file or directory name.
+func (s *S3FS) Stat(name string) (fs.FileInfo, error) {
+	bucket, key, ok := s3Path(name)
+	switch {
+	case !ok:
+		return s.local().Stat(name)
+	case bucket == "":
+		return nil, s3Error("stat", name, errNoBucket)
+	case key == "":
+		return memInfo{name: bucket, dir: true}, nil
+	}
+	obj, err := s.Client.Head(bucket, key)
+	if err == nil {
+		return s3Info(obj), nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, s3Error("stat", name, err)
+	}
+	objects, prefixes, err := s.Client.List(bucket, dirPrefix(key), "/", 1)
+	if err != nil {
+		return nil, s3Error("stat", name, err)
+	}
+	if len(objects) == 0 && len(prefixes) == 0 {
+		return nil, s3Error("stat", name, fs.ErrNotExist)
+	}
+	return memInfo{name: key, dir: true}, nil
+}
+
+// ReadDir returns the entries of the directory name, sorted by name.
+func (s *S3FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	bucket, key, ok := s3Path(name)
+	switch {
+	case !ok:
+		return s.local().ReadDir(name)
+	case bucket == "":
+		return nil, s3Error("readdir", name, errNoBucket)
+	}
+	prefix := dirPrefix(key)
+	objects, prefixes, err := s.Client.List(bucket, prefix, "/", 0)
+	if err != nil {
+		return nil, s3Error("readdir", name, err)
+	}
+	var entries []fs.DirEntry
+	for _, obj := range objects {
+		if obj.Key != prefix { // The placeholder of an empty directory
+			entries = append(entries, fs.FileInfoToDirEntry(s3Info(obj)))
+		}
+	}
+	for _, p := range prefixes {
+		entries = append(entries, fs.FileInfoToDirEntry(memInfo{name: strings.TrimSuffix(p, "/"), dir: true}))
+	}
+	if len(entries) == 0 && key != "" {
+		return nil, s3Error("readdir", name, fs.ErrNotExist)
+	}
+	slices.SortFunc(entries, func(a, b fs.DirEntry) int { return strings.Compare(a.Name(), b.Name()) })
+	return entries, nil
+}
+
+// s3Reader is an object of an S3FS open for reading.
+type s3Reader struct {
+	info memInfo
+	io.ReadCloser
+}
+
+func (r *s3Reader) Stat() (fs.FileInfo, error) { return r.info, nil }
+
+// Open opens the file or directory name for reading. A file is read as it
+// is downloaded.
+func (s *S3FS) Open(name string) (fs.File, error) {
+	bucket, key, ok := s3Path(name)
+	switch {
+	case !ok:
+		return s.local().Open(name)
+	case bucket == "":
+		return nil, s3Error("open", name, errNoBucket)
+	}
+	if key != "" {
+		body, obj, err := s.Client.Get(bucket, key)
+		if err == nil {
+			return &s3Reader{info: s3Info(obj), ReadCloser: body}, nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return nil, s3Error("open", name, err)
+		}
+	}
+	entries, err := s.ReadDir(name)
+	if err != nil {
+		return nil, s3Error("open", name, fs.ErrNotExist)
+	}
+	return &memDir{info: memInfo{name: path.Join(bucket, key), dir: true}, entries: entries}, nil
+}
+
+// Create creates or replaces the file name. What is written to it is
+// uploaded in parts as it fills them, and appears once it is closed.
+func (s *S3FS) Create(name string) (io.WriteCloser, error) {
+	bucket, key, ok := s3Path(name)
+	switch {
+	case !ok:
+		return s.local().Create(name)
+	case bucket == "" || key == "":
+		return nil, s3Error("create", name, fs.ErrInvalid)
+	}
+	partSize := s.PartSize
+	if partSize <= 0 {
+		partSize = DefaultS3PartSize
+	}
+	return &s3Writer{client: s.Client, name: name, bucket: bucket, key: key, partSize: partSize}, nil
+}
+
+// MkdirAll creates the directory name. The directories of S3 need no
+// creating.
+func (s *S3FS) MkdirAll(name string, perm fs.FileMode) error {
+	if _, _, ok := s3Path(name); ok {
+		return nil
+	}
+	return s.local().MkdirAll(name, perm)
+}
+
+// Remove removes the file name.
+func (s *S3FS) Remove(name string) error {
+	bucket, key, ok := s3Path(name)
+	if !ok {
+		return s.local().Remove(name)
+	}
+	if err := s.Client.Delete(bucket, key); err != nil {
+		return s3Error("remove", name, err)
+	}
+	return nil
+}
+
+// Rename moves the file oldname to newname, replacing any file there. An
+// object is copied within S3, then deleted; a file cannot be moved between
+// S3 and Local.
+func (s *S3FS) Rename(oldname, newname string) error {
+	oldBucket, oldKey, oldS3 := s3Path(oldname)
+	newBucket, newKey, newS3 := s3Path(newname)
+	switch {
+	case !oldS3 && !newS3:
+		return s.local().Rename(oldname, newname)
+	case oldS3 != newS3:
+		return &fs.PathError{Op: "rename", Path: oldname, Err: fmt.Errorf("cannot move to %s between S3 and local files", newname)}
+	}
+	if err := s.Client.Copy(oldBucket, oldKey, newBucket, newKey); err != nil {
+		return s3Error("rename", oldname, err)
+	}
+	if err := s.Client.Delete(oldBucket, oldKey); err != nil {
+		return s3Error("rename", oldname, err)
+	}
+	return nil
+}
+
+// s3Writer is an object of an S3FS open for writing. It holds a part at a
+// time, uploading each as it fills and the last as it is closed; one of a
+// single part is put whole instead.
+type s3Writer struct {
+	client      S3Client
+	name        string
+	bucket, key string
+	partSize    int
+	buf         []byte
+	uploadID    string
+	etags       []string
+	err         error // The first failure, after which the upload is abandoned
+}
+
+func (w *s3Writer) Write(p []byte) (int, error) {
+	written := 0
+	for w.err == nil && written < len(p) {
+		if w.buf == nil {
+			w.buf = make([]byte, 0, w.partSize)
+		}
+		n := min(len(p)-written, w.partSize-len(w.buf))
+		w.buf = append(w.buf, p[written:written+n]...)
+		written += n
+		if len(w.buf) == w.partSize {
+			w.err = w.uploadPart()
+		}
+	}
+	return written, w.err
+}
+
+// uploadPart uploads the part held, starting the upload with the first.
+func (w *s3Writer) uploadPart() error {
+	if w.uploadID == "" {
+		id, err := w.client.CreateUpload(w.bucket, w.key)
+		if err != nil {
+			return s3Error("write", w.name, err)
+		}
+		w.uploadID = id
+	}
+	etag, err := w.client.UploadPart(w.bucket, w.key, w.uploadID, len(w.etags)+1, w.buf)
+	if err != nil {
+		return s3Error("write", w.name, err)
+	}
+	w.etags = append(w.etags, etag)
+	w.buf = w.buf[:0]
+	return nil
+}
+
+// Close uploads what is held and completes the upload, or abandons it
+// after a failure.
+func (w *s3Writer) Close() error {
+	err := w.err
+	switch {
+	case err != nil:
+	case w.uploadID == "":
+		if err = w.client.Put(w.bucket, w.key, w.buf); err != nil {
+			err = s3Error("write", w.name, err)
+		}
+	case len(w.buf) > 0:
+		err = w.uploadPart()
+	}
+	if w.uploadID != "" {
+		if err == nil {
+			if err = w.client.CompleteUpload(w.bucket, w.key, w.uploadID, w.etags); err != nil {
+				err = s3Error("write", w.name, err)
+			}
+		}
+		if err != nil {
+			w.client.AbortUpload(w.bucket, w.key, w.uploadID)
+		}
+	}
+	w.buf, w.uploadID = nil, ""
+	if w.err == nil {
+		w.err = fs.ErrClosed
+	}
+	return err
+}
@@ -0,0 +1,372 @@
+package pixellock
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"io/fs"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeS3 is an S3Client of buckets held in memory.
+type fakeS3 struct {
+	mu      sync.Mutex
+	buckets map[string]map[string][]byte
+	uploads map[string]map[int][]byte // Parts by upload ID
+	nextID  int
+	parts   int // Parts uploaded
+}
+
+func newFakeS3(buckets ...string) *fakeS3 {
+	s := &fakeS3{buckets: map[string]map[string][]byte{}, uploads: map[string]map[int][]byte{}}
+	for _, b := range buckets {
+		s.buckets[b] = map[string][]byte{}
+	}
+	return s
+}
+
+func (s *fakeS3) bucket(name string) (map[string][]byte, error) {
+	b, ok := s.buckets[name]
+	if !ok {
+		return nil, fmt.Errorf("no bucket %s: %w", name, fs.ErrNotExist)
+	}
+	return b, nil
+}
+
+func (s *fakeS3) List(bucket, prefix, delimiter string, limit int) ([]S3Object, []string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, err := s.bucket(bucket)
+	if err != nil {
+		return nil, nil, err
+	}
+	var objects []S3Object
+	var prefixes []string
+	for _, key := range slices.Sorted(func(yield func(string) bool) {
+		for key := range b {
+			if !yield(key) {
+				return
+			}
+		}
+	}) {
+		rest, ok := strings.CutPrefix(key, prefix)
+		if !ok {
+			continue
+		}
+		if i := strings.Index(rest, delimiter); delimiter != "" && i >= 0 {
+			if p := prefix + rest[:i+len(delimiter)]; !slices.Contains(prefixes, p) {
+				prefixes = append(prefixes, p)
+			}
+		} else {
+			objects = append(objects, S3Object{Key: key, Size: int64(len(b[key])), ModTime: time.Unix(1, 0)})
+		}
+		if limit > 0 && len(objects)+len(prefixes) >= limit {
+			break
+		}
+	}
+	return objects, prefixes, nil
+}
+
+func (s *fakeS3) Head(bucket, key string) (S3Object, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, err := s.bucket(bucket)
+	if err != nil {
+		return S3Object{}, err
+	}
+	data, ok := b[key]
+	if !ok {
+		return S3Object{}, fmt.Errorf("no key %s: %w", key, fs.ErrNotExist)
+	}
+	return S3Object{Key: key, Size: int64(len(data))}, nil
+}
+
+func (s *fakeS3) Get(bucket, key string) (io.ReadCloser, S3Object, error) {
+	obj, err := s.Head(bucket, key)
+	if err != nil {
+		return nil, S3Object{}, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return io.NopCloser(bytes.NewReader(s.buckets[bucket][key])), obj, nil
+}
+
+func (s *fakeS3) Put(bucket, key string, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, err := s.bucket(bucket)
+	if err != nil {
+		return err
+	}
+	b[key] = bytes.Clone(data)
+	return nil
+}
+
+func (s *fakeS3) CreateUpload(bucket, key string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.bucket(bucket); err != nil {
+		return "", err
+	}
+	s.nextID++
+	id := fmt.Sprint(s.nextID)
+	s.uploads[id] = map[int][]byte{}
+	return id, nil
+}
+
+func (s *fakeS3) UploadPart(bucket, key, uploadID string, part int, data []byte) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	parts, ok := s.uploads[uploadID]
+	if !ok {
+		return "", errors.New("NoSuchUpload")
+	}
+	parts[part] = bytes.Clone(data)
+	s.parts++
+	return fmt.Sprintf("etag-%d", part), nil
+}
+
+func (s *fakeS3) CompleteUpload(bucket, key, uploadID string, etags []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	parts, ok := s.uploads[uploadID]
+	if !ok {
+		return errors.New("NoSuchUpload")
+	}
+	var data []byte
+	for i, etag := range etags {
+		if etag != fmt.Sprintf("etag-%d", i+1) {
+			return fmt.Errorf("InvalidPart: %s", etag)
+		}
+		data = append(data, parts[i+1]...)
+	}
+	delete(s.uploads, uploadID)
+	s.buckets[bucket][key] = data
+	return nil
+}
+
+func (s *fakeS3) AbortUpload(bucket, key, uploadID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.uploads, uploadID)
+	return nil
+}
+
+func (s *fakeS3) Copy(srcBucket, srcKey, dstBucket, dstKey string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	src, err := s.bucket(srcBucket)
+	if err != nil {
+		return err
+	}
+	dst, err := s.bucket(dstBucket)
+	if err != nil {
+		return err
+	}
+	data, ok := src[srcKey]
+	if !ok {
+		return fmt.Errorf("no key %s: %w", srcKey, fs.ErrNotExist)
+	}
+	dst[dstKey] = data
+	return nil
+}
+
+func (s *fakeS3) Delete(bucket, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, err := s.bucket(bucket)
+	if err != nil {
+		return err
+	}
+	delete(b, key)
+	return nil
+}
+
+func TestS3Path(t *testing.T) {
+	for _, tc := range []struct {
+		name, bucket, key string
+		ok                bool
+	}{
+		{"s3://bucket/photos/a.jpg", "bucket", "photos/a.jpg", true},
+		{"s3:/bucket/photos/a.jpg", "bucket", "photos/a.jpg", true}, // As filepath.Join leaves it
+		{"s3://bucket/photos/", "bucket", "photos", true},
+		{"s3://bucket", "bucket", "", true},
+		{"s3://", "", "", true},
+		{"photos/a.jpg", "", "", false},
+	} {
+		bucket, key, ok := s3Path(tc.name)
+		if bucket != tc.bucket || key != tc.key || ok != tc.ok {
+			t.Errorf("s3Path(%q) = %q, %q, %v, want %q, %q, %v", tc.name, bucket, key, ok, tc.bucket, tc.key, tc.ok)
+		}
+	}
+	if got := joinName("s3://bucket/photos", "a.jpg"); got != "s3://bucket/photos/a.jpg" {
+		t.Errorf("joinName = %q", got)
+	}
+}
+
+func TestS3FS(t *testing.T) {
+	client := newFakeS3("bucket")
+	local := &MemFS{}
+	fsys := &S3FS{Client: client, Local: local, PartSize: 8}
+
+	// Small files are put whole, larger ones in parts
+	writeFile(fsys, "s3://bucket/photos/a.jpg", []byte("small"))
+	big := bytes.Repeat([]byte("0123456789"), 3)
+	if err := writeFile(fsys, "s3://bucket/photos/sub/b.jpg", big); err != nil {
+		t.Fatalf("writing a file of several parts failed: %v", err)
+	}
+	if client.parts != 4 || !bytes.Equal(client.buckets["bucket"]["photos/sub/b.jpg"], big) {
+		t.Errorf("uploaded %d parts of %q", client.parts, client.buckets["bucket"]["photos/sub/b.jpg"])
+	}
+
+	info, err := fsys.Stat("s3://bucket/photos/a.jpg")
+	if err != nil || info.IsDir() || info.Size() != 5 || info.Name() != "a.jpg" {
+		t.Errorf("Stat of a file = %v, %v", info, err)
+	}
+	for _, dir := range []string{"s3://bucket", "s3://bucket/photos", "s3:/bucket/photos/sub/"} {
+		if info, err := fsys.Stat(dir); err != nil || !info.IsDir() {
+			t.Errorf("Stat(%q) = %v, %v, want a directory", dir, info, err)
+		}
+	}
+	if _, err := fsys.Stat("s3://bucket/nothing"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Stat of nothing: %v", err)
+	}
+
+	entries, err := fsys.ReadDir("s3://bucket/photos")
+	if err != nil {
+		t.Fatalf("ReadDir failed: %v", err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, fmt.Sprintf("%s %v", e.Name(), e.IsDir()))
+	}
+	if want := []string{"a.jpg false", "sub true"}; !slices.Equal(names, want) {
+		t.Errorf("ReadDir = %v, want %v", names, want)
+	}
+
+	f, err := fsys.Open("s3://bucket/photos/a.jpg")
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	data, _ := io.ReadAll(f)
+	f.Close()
+	if string(data) != "small" {
+		t.Errorf("read %q", data)
+	}
+
+	if err := fsys.Rename("s3://bucket/photos/a.jpg", "s3://bucket/photos/c.jpg"); err != nil {
+		t.Fatalf("Rename failed: %v", err)
+	}
+	if exists(fsys, "s3://bucket/photos/a.jpg") || !exists(fsys, "s3://bucket/photos/c.jpg") {
+		t.Error("Rename left the object where it was")
+	}
+	if err := fsys.Rename("s3://bucket/photos/c.jpg", "c.jpg"); err == nil {
+		t.Error("Rename from S3 to a local file succeeded")
+	}
+	if err := fsys.Remove("s3://bucket/photos/c.jpg"); err != nil || exists(fsys, "s3://bucket/photos/c.jpg") {
+		t.Errorf("Remove: %v", err)
+	}
+
+	// Other names are those of Local
+	if err := writeFile(fsys, "local.txt", []byte("here")); err != nil || string(memRead(t, local, "local.txt")) != "here" {
+		t.Errorf("writing a local file: %v", err)
+	}
+}
+
+// TestS3EncryptDirectory encrypts images from one bucket to another and
+// decrypts them to local files, with an object that cannot be read failing
+// alone.
+func TestS3EncryptDirectory(t *testing.T) {
+	key, _ := GenerateRandomKey()
+	client := newFakeS3("in", "out")
+	local := &MemFS{}
+	fsys := &S3FS{Client: client, Local: local, PartSize: 5 << 20}
+	images := map[string]*image.NRGBA{}
+	for _, name := range []string{"photos/a.png", "photos/b.png", "photos/trip/c.png", "photos/broken.png"} {
+		img := image.NewNRGBA(image.Rect(0, 0, 16, 12))
+		for j := range img.Pix {
+			img.Pix[j] = byte(len(name) + j)
+		}
+		memImage(t, local, "src/"+name, img)
+		if err := client.Put("in", name, memRead(t, local, "src/"+name)); err != nil {
+			t.Fatal(err)
+		}
+		images[name] = img
+	}
+	client.Put("in", "photos/notes.txt", []byte("not an image"))
+	client.Put("in", "elsewhere/d.png", memRead(t, local, "src/photos/a.png"))
+
+	var mu sync.Mutex
+	failed := map[string]error{}
+	progress := func(e Event) {
+		if e.Err != nil {
+			mu.Lock()
+			failed[e.Path] = e.Err
+			mu.Unlock()
+		}
+	}
+	enc, err := NewEncryptor(WithKey(key), WithFS(fsys), WithWorkers(4), WithRecursive(true), WithProgress(progress))
+	if err != nil {
+		t.Fatalf("NewEncryptor failed: %v", err)
+	}
+	found := 0
+	fsys.Client = &failAfterScan{fakeS3: client, key: "photos/broken.png", found: &found}
+	if err := enc.ProcessDir(t.Context(), "s3://in/photos", "s3://out/enc"); err != nil {
+		t.Fatalf("ProcessDir failed: %v", err)
+	}
+	if len(failed) != 1 || failed["s3://in/photos/broken.png"] == nil {
+		t.Errorf("failures %v, want s3://in/photos/broken.png alone", failed)
+	}
+	var keys []string
+	for k := range client.buckets["out"] {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	if want := []string{"enc/a.png.enc", "enc/b.png.enc", "enc/trip/c.png.enc"}; !slices.Equal(keys, want) {
+		t.Errorf("encrypted %v, want %v", keys, want)
+	}
+
+	dec, err := NewDecryptor(WithKey(key), WithFS(fsys), WithRecursive(true))
+	if err != nil {
+		t.Fatalf("NewDecryptor failed: %v", err)
+	}
+	if err := dec.ProcessDir(t.Context(), "s3://out/enc", "dec"); err != nil {
+		t.Fatalf("ProcessDir failed: %v", err)
+	}
+	for _, name := range []string{"a.png", "b.png", "trip/c.png"} {
+		got, _, err := image.Decode(bytes.NewReader(memRead(t, local, "dec/"+name)))
+		if err != nil {
+			t.Fatalf("decrypted %s does not decode: %v", name, err)
+		}
+		if !sameDeepPixels(images["photos/"+name], got) {
+			t.Errorf("%s decrypted to other pixels", name)
+		}
+	}
+}
+
+// failAfterScan is a fakeS3 whose object key can be read once, as the
+// images of a directory are found, and fails after.
+type failAfterScan struct {
+	*fakeS3
+	key   string
+	found *int
+}
+
+func (f *failAfterScan) Get(bucket, key string) (io.ReadCloser, S3Object, error) {
+	if key == f.key {
+		f.fakeS3.mu.Lock()
+		*f.found++
+		fail := *f.found > 1
+		f.fakeS3.mu.Unlock()
+		if fail {
+			return nil, S3Object{}, errors.New("SlowDown: please reduce your request rate")
+		}
+	}
+	return f.fakeS3.Get(bucket, key)
+}
@@ -0,0 +1,181 @@
+package pixellock
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"math/rand/v2"
+
+	"github.com/Amul-Thantharate/pixellock/pkg/internal/scatter"
+)
+
+// Modes of the encrypt and decrypt commands. ModeCipher encrypts the image
+// into an opaque file with AES-GCM; ModeScramble keeps it a viewable PNG
+// whose pixels look like noise.
+const (
+	ModeCipher   = "cipher"
+	ModeScramble = "scramble"
+)
+
+// ScrambledExtension is appended to the images a directory run scrambles,
+// and is the encrypted extension decrypt looks for in scramble mode.
+const ScrambledExtension = ".scrambled.png"
+
+// scrambleKeyword is the keyword of the PNG tEXt chunk marking a scrambled
+// image, and scrambleVersion its text.
+const (
+	scrambleKeyword = "pixellock:scramble"
+	scrambleVersion = "1"
+)
+
+// scrambleBlockSize is the side, in pixels, of the blocks ModeScramble
+// shuffles. Pixels past the last whole block of a row or column are only
+// masked.
+const scrambleBlockSize = 8
+
+// CheckMode returns an error unless mode is ModeCipher or ModeScramble, or
+// empty for the default.
+func CheckMode(mode string) error {
+	switch mode {
+	case "", ModeCipher, ModeScramble:
+		return nil
+	}
+	return fmt.Errorf("unknown mode %q (want %s or %s)", mode, ModeCipher, ModeScramble)
+}
+
+// IsScrambled reports whether data is a PNG marked as scrambled by Scramble.
+func IsScrambled(data []byte) bool {
+	_, ok := pngText(data, scrambleKeyword)
+	return ok
+}
+
+// Scramble returns the PNG data, as ReadImageForEncryption gives it,
+// scrambled with key: its blocks of pixels are shuffled and its red, green
+// and blue channels masked, both with streams derived from key and the
+// image dimensions, and it is marked as scrambled. The result is a normal
+// PNG that looks like noise. The format recorded in data is kept; its EXIF
+// metadata is not, as it would be readable by anyone.
+//
+// Scrambling is not encryption: images of the same size scrambled with one
+// key share the shuffle and mask, and alpha is left as it is.
+func Scramble(key, data []byte) ([]byte, error) {
+	return scramble(key, data, 0)
+}
+
+// scramble is Scramble of an image of no more pixels than maxPixels allows.
+func scramble(key, data []byte, maxPixels int64) ([]byte, error) {
+	if IsGIFData(data) || IsHEIFData(data) {
+		return nil, fmt.Errorf("animated GIFs and HEIF images cannot be scrambled; use the %s mode", ModeCipher)
+	}
+	img, err := bytesToImage(data, maxPixels)
+	if err != nil {
+		return nil, err
+	}
+	if is16Bit(img) {
+		return nil, fmt.Errorf("16-bit images cannot be scrambled, as the result is 8 bits per channel; use the %s mode", ModeCipher)
+	}
+	nrgbaImg := toNRGBA(img)
+	shuffleBlocks(nrgbaImg, scrambleSeed(key, nrgbaImg.Rect, "blocks"), false)
+	maskChannels(nrgbaImg, scrambleSeed(key, nrgbaImg.Rect, "mask"))
+
+	scrambled, err := ImageToBytes(nrgbaImg)
+	if err != nil {
+		return nil, err
+	}
+	if format := recordedFormat(data); format != "" {
+		if scrambled, err = SetOriginalFormat(scrambled, format); err != nil {
+			return nil, err
+		}
+	}
+	return addPNGText(scrambled, scrambleKeyword, scrambleVersion)
+}
+
+// Unscramble returns the PNG data of the image Scramble scrambled into
+// data with key, recording the same format.
+func Unscramble(key, data []byte) ([]byte, error) {
+	return unscramble(key, data, 0)
+}
+
+// unscramble is Unscramble of an image of no more pixels than maxPixels
+// allows.
+func unscramble(key, data []byte, maxPixels int64) ([]byte, error) {
+	version, ok := pngText(data, scrambleKeyword)
+	if !ok {
+		return nil, fmt.Errorf("not a scrambled image: %w", ErrNotEncryptedFile)
+	}
+	if version != scrambleVersion {
+		return nil, fmt.Errorf("unsupported scramble version %q", version)
+	}
+	img, err := bytesToImage(data, maxPixels)
+	if err != nil {
+		return nil, err
+	}
+	nrgbaImg := toNRGBA(img)
+	maskChannels(nrgbaImg, scrambleSeed(key, nrgbaImg.Rect, "mask"))
+	shuffleBlocks(nrgbaImg, scrambleSeed(key, nrgbaImg.Rect, "blocks"), true)
+
+	unscrambled, err := ImageToBytes(nrgbaImg)
+	if err != nil {
+		return nil, err
+	}
+	if format := recordedFormat(data); format != "" {
+		return SetOriginalFormat(unscrambled, format)
+	}
+	return unscrambled, nil
+}
+
+// scrambleSeed returns the seed of a scramble stream for key and an image
+// with bounds r: an HMAC of the image dimensions and the purpose of the
+// stream, so that the block shuffle and the mask differ.
+func scrambleSeed(key []byte, r image.Rectangle, purpose string) [32]byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("pixellock scramble " + purpose))
+	mac.Write(binary.BigEndian.AppendUint32(binary.BigEndian.AppendUint32(nil, uint32(r.Dx())), uint32(r.Dy())))
+	var seed [32]byte
+	copy(seed[:], mac.Sum(nil))
+	return seed
+}
+
+// shuffleBlocks moves the whole blocks of img, in raster order, so that
+// position i holds the block at position i of the permutation drawn from
+// seed, or moves them back again when reverse is set.
+func shuffleBlocks(img *image.NRGBA, seed [32]byte, reverse bool) {
+	columns := img.Rect.Dx() / scrambleBlockSize
+	order := scatter.New(seed, columns*(img.Rect.Dy()/scrambleBlockSize))
+	if order.N == 0 {
+		return
+	}
+	src := append([]uint8(nil), img.Pix...)
+	rowBytes := scrambleBlockSize * 4
+	for i := 0; i < order.N; i++ {
+		from, to := order.At(i), i
+		if reverse {
+			from, to = to, from
+		}
+		fx, fy := from%columns*scrambleBlockSize, from/columns*scrambleBlockSize
+		tx, ty := to%columns*scrambleBlockSize, to/columns*scrambleBlockSize
+		for y := 0; y < scrambleBlockSize; y++ {
+			f := (fy+y)*img.Stride + fx*4
+			t := (ty+y)*img.Stride + tx*4
+			copy(img.Pix[t:t+rowBytes], src[f:f+rowBytes])
+		}
+	}
+}
+
+// maskChannels XORs the red, green and blue channels of img with the
+// ChaCha8 stream of seed, which undoes an earlier mask with the same seed.
+func maskChannels(img *image.NRGBA, seed [32]byte) {
+	rng := rand.NewChaCha8(seed)
+	mask := make([]byte, img.Rect.Dx()*3)
+	for y := 0; y < img.Rect.Dy(); y++ {
+		rng.Read(mask)
+		row := img.Pix[y*img.Stride : y*img.Stride+img.Rect.Dx()*4]
+		for x := 0; x < img.Rect.Dx(); x++ {
+			row[x*4] ^= mask[x*3]
+			row[x*4+1] ^= mask[x*3+1]
+			row[x*4+2] ^= mask[x*3+2]
+		}
+	}
+}
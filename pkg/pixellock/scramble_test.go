@@ -0,0 +1,152 @@
+package pixellock
+
+import (
+	"bytes"
+	"image"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// scrambledPixels scrambles img with key and returns the scrambled PNG data.
+func scrambledPixels(t *testing.T, key []byte, img image.Image) []byte {
+	t.Helper()
+	data, err := ImageToBytes(img)
+	if err != nil {
+		t.Fatalf("ImageToBytes failed: %v", err)
+	}
+	scrambled, err := Scramble(key, data)
+	if err != nil {
+		t.Fatalf("Scramble failed: %v", err)
+	}
+	return scrambled
+}
+
+func TestScrambleRoundTrip(t *testing.T) {
+	key, err := GenerateRandomKey()
+	if err != nil {
+		t.Fatalf("GenerateRandomKey failed: %v", err)
+	}
+	for name, img := range map[string]image.Image{
+		"photo":       photoNRGBA(t),
+		"transparent": newTransparentNRGBA(33, 17), // Partial blocks at both edges
+		"gray":        grayTestImage(90, 60),
+		"tiny":        grayTestImage(5, 3), // No whole block at all
+	} {
+		dir := t.TempDir()
+		original := filepath.Join(dir, name+".png")
+		if err := SaveImage(original, img, SaveOptions{Format: "png"}); err != nil {
+			t.Fatalf("SaveImage failed: %v", err)
+		}
+		scrambled := filepath.Join(dir, name+ScrambledExtension)
+		if err := EncryptFile(t.Context(), original, scrambled, key, false, EncryptOptions{Metadata: MetadataPreserve, Mode: ModeScramble}); err != nil {
+			t.Fatalf("%s: EncryptFile failed: %v", name, err)
+		}
+
+		// The scrambled file is a normal PNG, marked as scrambled
+		if format, err := DetectImageFormat(scrambled); err != nil || format != "png" {
+			t.Errorf("%s: scrambled file has format %q, %v; want png", name, format, err)
+		}
+		data, err := os.ReadFile(scrambled)
+		if err != nil {
+			t.Fatalf("ReadFile failed: %v", err)
+		}
+		if !IsScrambled(data) {
+			t.Errorf("%s: scrambled file is not marked as scrambled", name)
+		}
+		noise, err := LoadImage(scrambled)
+		if err != nil {
+			t.Fatalf("%s: LoadImage failed: %v", name, err)
+		}
+		if samePixels(asNRGBA(noise), asNRGBA(img)) {
+			t.Errorf("%s: scrambling left the pixels as they were", name)
+		}
+
+		decrypted := filepath.Join(dir, "decrypted.png")
+		if err := DecryptFile(t.Context(), scrambled, decrypted, key, false, SaveOptions{Format: "png"}); err != nil {
+			t.Fatalf("%s: DecryptFile failed: %v", name, err)
+		}
+		got, err := LoadImage(decrypted)
+		if err != nil {
+			t.Fatalf("%s: LoadImage failed: %v", name, err)
+		}
+		if !samePixels(asNRGBA(got), asNRGBA(img)) {
+			t.Errorf("%s: unscrambled pixels differ from the original", name)
+		}
+	}
+}
+
+func TestScrambleKeys(t *testing.T) {
+	img := photoNRGBA(t)
+	key1, _ := GenerateRandomKey()
+	key2, _ := GenerateRandomKey()
+
+	first := scrambledPixels(t, key1, img)
+	if again := scrambledPixels(t, key1, img); !bytes.Equal(first, again) {
+		t.Error("scrambling twice with one key gave different images")
+	}
+	other := scrambledPixels(t, key2, img)
+	a, err := BytesToImage(first)
+	if err != nil {
+		t.Fatalf("BytesToImage failed: %v", err)
+	}
+	b, err := BytesToImage(other)
+	if err != nil {
+		t.Fatalf("BytesToImage failed: %v", err)
+	}
+	if samePixels(a, b) {
+		t.Error("two keys gave the same scramble")
+	}
+
+	// The wrong key does not restore the image
+	unscrambled, err := Unscramble(key2, first)
+	if err != nil {
+		t.Fatalf("Unscramble failed: %v", err)
+	}
+	if wrong, err := BytesToImage(unscrambled); err != nil || samePixels(wrong, img) {
+		t.Errorf("the wrong key restored the image: %v", err)
+	}
+}
+
+func TestScrambleRefusals(t *testing.T) {
+	key, _ := GenerateRandomKey()
+	deep, err := ImageToBytes(deepTestImages()["rgba64"])
+	if err != nil {
+		t.Fatalf("ImageToBytes failed: %v", err)
+	}
+	if _, err := Scramble(key, deep); err == nil {
+		t.Error("Scramble accepted a 16-bit image")
+	}
+	plain, err := ImageToBytes(grayTestImage(16, 16))
+	if err != nil {
+		t.Fatalf("ImageToBytes failed: %v", err)
+	}
+	if _, err := Unscramble(key, plain); err == nil {
+		t.Error("Unscramble accepted an image that is not scrambled")
+	}
+	if err := CheckMode("shuffle"); err == nil {
+		t.Error("CheckMode accepted an unknown mode")
+	}
+	if err := CheckMode(""); err != nil {
+		t.Errorf("CheckMode rejected the default mode: %v", err)
+	}
+}
+
+func TestScrambleDirectory(t *testing.T) {
+	key, _ := GenerateRandomKey()
+	fsys, in, out := &MemFS{}, "in", "out"
+	memImage(t, fsys, filepath.Join(in, "a.png"), photoNRGBA(t))
+	if err := EncryptDirectory(t.Context(), in, out, key, false, false, EncryptOptions{Metadata: MetadataPreserve, Mode: ModeScramble, FS: fsys}); err != nil {
+		t.Fatalf("EncryptDirectory failed: %v", err)
+	}
+	if _, err := fsys.Stat(filepath.Join(out, "a.png"+ScrambledExtension)); err != nil {
+		t.Errorf("scrambled file not written: %v", err)
+	}
+	restored := "restored"
+	if err := DecryptDirectory(t.Context(), out, restored, key, false, ScrambledExtension, false, SaveOptions{FS: fsys}); err != nil {
+		t.Fatalf("DecryptDirectory failed: %v", err)
+	}
+	if got, err := LoadImageFS(fsys, filepath.Join(restored, "a.png")); err != nil || !samePixels(asNRGBA(got), photoNRGBA(t)) {
+		t.Errorf("unscrambled directory image differs: %v", err)
+	}
+}
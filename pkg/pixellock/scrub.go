@@ -0,0 +1,323 @@
+package pixellock
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Scrubbing removes the metadata of an image before it is shared: EXIF,
+// with its GPS position and embedded thumbnail, XMP, IPTC, ICC profiles,
+// comments and PNG text. JPEGs and PNGs are rewritten a segment or chunk
+// at a time, so their compressed pixel data is copied byte for byte; what
+// they keep is listed rather than what they drop, so metadata pixellock
+// does not know of goes too. Other formats are re-encoded without their
+// metadata.
+
+// Metadata fields that scrubbing can be told to keep.
+const (
+	KeepOrientation = "orientation" // The EXIF orientation, alone in a new EXIF block
+	KeepICC         = "icc"         // The ICC color profile
+)
+
+// keepFields are the fields ParseKeep accepts.
+var keepFields = []string{KeepOrientation, KeepICC}
+
+// ParseKeep parses a comma-separated list of fields to keep, such as
+// "orientation,icc".
+func ParseKeep(s string) ([]string, error) {
+	var keep []string
+	for _, field := range strings.Split(s, ",") {
+		field = strings.ToLower(strings.TrimSpace(field))
+		if field == "" {
+			continue
+		}
+		if !slices.Contains(keepFields, field) {
+			return nil, fmt.Errorf("invalid field to keep %q (want %s)", field, strings.Join(keepFields, " or "))
+		}
+		keep = append(keep, field)
+	}
+	return keep, nil
+}
+
+// ScrubOptions control how metadata is scrubbed.
+type ScrubOptions struct {
+	Keep      []string // Fields kept, from ParseKeep
+	Overwrite bool     // Replace an existing output file
+}
+
+func (o ScrubOptions) keeps(field string) bool {
+	return slices.Contains(o.Keep, field)
+}
+
+// jfifHeaderSize is the size of the body of a JFIF APP0 segment without
+// a thumbnail.
+const jfifHeaderSize = 14
+
+// JPEG markers of the ICC profile, of the Adobe segment, which says how
+// the color components are stored, and of comments.
+const (
+	jpegAPP2  = 0xe2
+	jpegAPP14 = 0xee
+	jpegCOM   = 0xfe
+)
+
+// pngKeptChunks are the ancillary PNG chunks that scrubbing keeps, as they
+// say how the pixels are shown or, for APNG, hold frames; critical chunks
+// are always kept.
+var pngKeptChunks = []string{"tRNS", "gAMA", "cHRM", "sRGB", "sBIT", "bKGD", "pHYs", "hIST", "cICP", "mDCV", "cLLI", "acTL", "fcTL", "fdAT"}
+
+// describeEXIF returns how the report names an EXIF block.
+func describeEXIF(exif []byte) string {
+	entries, err := parseEXIF(exif)
+	if err != nil {
+		return "EXIF"
+	}
+	var with []string
+	if findEXIF(entries, gpsIFDPointer) != nil {
+		with = append(with, "GPS location")
+	}
+	order, offset, _ := tiffByteOrder(exif)
+	if next, err := tiffNextIFD(exif, order, offset); err == nil && next != 0 {
+		with = append(with, "embedded thumbnail")
+	}
+	if len(with) == 0 {
+		return "EXIF"
+	}
+	return "EXIF (" + strings.Join(with, ", ") + ")"
+}
+
+// orientationEXIF returns an EXIF block holding the orientation of exif
+// alone, or nil when it records none.
+func orientationEXIF(exif []byte) []byte {
+	entries, err := parseEXIF(exif)
+	if err != nil {
+		return nil
+	}
+	if e := findEXIF(entries, exifOrientation); e != nil {
+		return marshalEXIF([]exifEntry{*e})
+	}
+	return nil
+}
+
+// scrubJPEG returns the JPEG data with every segment before its first
+// scan dropped but the JFIF header, without its thumbnail, the Adobe
+// segment, the tables and frame header, and the ICC profile when kept,
+// and what was removed.
+func scrubJPEG(data []byte, opts ScrubOptions) (out []byte, removed []string, exif []byte, err error) {
+	var buf bytes.Buffer
+	buf.Write(data[:2])
+	pos := 2
+	err = jpegMetadataSegments(data, func(marker byte, start, end int) bool {
+		body := data[start+4 : end]
+		pos = end
+		switch {
+		case marker == jpegAPP0 && bytes.HasPrefix(body, []byte("JFIF\x00")):
+			if len(body) > jfifHeaderSize {
+				removed = append(removed, "JFIF thumbnail")
+				header := slices.Clone(body[:jfifHeaderSize])
+				header[12], header[13] = 0, 0 // No thumbnail width and height
+				writeJPEGSegment(&buf, jpegAPP0, header)
+				return true
+			}
+		case marker == jpegAPP0 && bytes.HasPrefix(body, []byte("JFXX\x00")):
+			removed = append(removed, "JFIF thumbnail")
+			return true
+		case marker == jpegAPP1 && bytes.HasPrefix(body, []byte(exifHeader)):
+			exif = body[len(exifHeader):]
+			removed = append(removed, describeEXIF(exif))
+			return true
+		case marker == jpegAPP1 && bytes.HasPrefix(body, []byte("http://ns.adobe.com/")):
+			removed = append(removed, "XMP")
+			return true
+		case marker == jpegAPP2 && bytes.HasPrefix(body, []byte("ICC_PROFILE\x00")):
+			if !opts.keeps(KeepICC) {
+				removed = append(removed, "ICC profile")
+				return true
+			}
+		case marker == jpegAPP2 && bytes.HasPrefix(body, []byte("MPF\x00")):
+			removed = append(removed, "MPF preview images")
+			return true
+		case marker == jpegAPP13:
+			removed = append(removed, "IPTC")
+			return true
+		case marker == jpegAPP14:
+		case marker == jpegCOM:
+			removed = append(removed, "comment")
+			return true
+		case marker >= jpegAPP0 && marker <= jpegAPP15:
+			removed = append(removed, fmt.Sprintf("APP%d segment", marker-jpegAPP0))
+			return true
+		}
+		buf.Write(data[start:end])
+		return true
+	})
+	buf.Write(data[pos:])
+	return buf.Bytes(), removed, exif, err
+}
+
+// pngTextKeyword returns the keyword of a tEXt, zTXt or iTXt chunk body.
+func pngTextKeyword(body []byte) string {
+	keyword, _, _ := bytes.Cut(body, []byte{0})
+	return string(keyword)
+}
+
+// scrubPNG returns the PNG data with every ancillary chunk dropped but
+// those pngKeptChunks lists, and the ICC profile when kept, and what was
+// removed.
+func scrubPNG(data []byte, opts ScrubOptions) (out []byte, removed []string, exif []byte, err error) {
+	var buf bytes.Buffer
+	buf.Write(pngSignature)
+	err = pngChunks(data, func(typ string, start, end int) bool {
+		body := data[start+8 : end-4]
+		switch {
+		case typ[0] >= 'A' && typ[0] <= 'Z', slices.Contains(pngKeptChunks, typ):
+		case typ == "iCCP" && opts.keeps(KeepICC):
+		case typ == "iCCP":
+			removed = append(removed, "ICC profile")
+			return true
+		case typ == "eXIf":
+			exif = body
+			removed = append(removed, describeEXIF(exif))
+			return true
+		case typ == "iTXt" && pngTextKeyword(body) == xmpKeyword:
+			removed = append(removed, "XMP")
+			return true
+		case (typ == "tEXt" || typ == "zTXt" || typ == "iTXt") && strings.EqualFold(pngTextKeyword(body), "Raw profile type iptc"):
+			removed = append(removed, "IPTC")
+			return true
+		case typ == "tEXt" || typ == "zTXt" || typ == "iTXt":
+			removed = append(removed, fmt.Sprintf("text %q", pngTextKeyword(body)))
+			return true
+		case typ == "tIME":
+			removed = append(removed, "modification time")
+			return true
+		default:
+			removed = append(removed, typ+" chunk")
+			return true
+		}
+		buf.Write(data[start:end])
+		return true
+	})
+	return buf.Bytes(), removed, exif, err
+}
+
+// ScrubMetadata returns the JPEG or PNG data with its metadata removed
+// losslessly, keeping the fields opts.Keep names, and what was removed, in
+// the order found.
+func ScrubMetadata(data []byte, opts ScrubOptions) ([]byte, []string, error) {
+	var out, exif []byte
+	var removed []string
+	var format string
+	var err error
+	switch {
+	case bytes.HasPrefix(data, pngSignature):
+		format = "png"
+		out, removed, exif, err = scrubPNG(data, opts)
+	case len(data) >= 2 && data[0] == 0xff && data[1] == jpegSOI:
+		format = "jpeg"
+		out, removed, exif, err = scrubJPEG(data, opts)
+	default:
+		return nil, nil, fmt.Errorf("only JPEG and PNG images are scrubbed losslessly")
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if orientation := orientationEXIF(exif); orientation != nil && opts.keeps(KeepOrientation) {
+		if out, err = AttachEXIF(out, format, orientation); err != nil {
+			return nil, nil, err
+		}
+		// Only part of the EXIF was removed
+		if i := slices.Index(removed, describeEXIF(exif)); i >= 0 {
+			removed[i] = strings.Replace(removed[i], "EXIF", "EXIF but its orientation", 1)
+		}
+	}
+	return out, compactRemoved(removed), nil
+}
+
+// compactRemoved returns removed with repeated items listed once, with a
+// count, in the order they were first found.
+func compactRemoved(removed []string) []string {
+	var items []string
+	counts := make(map[string]int)
+	for _, item := range removed {
+		if counts[item] == 0 {
+			items = append(items, item)
+		}
+		counts[item]++
+	}
+	for i, item := range items {
+		if counts[item] > 1 {
+			items[i] = fmt.Sprintf("%s (x%d)", item, counts[item])
+		}
+	}
+	return items
+}
+
+// ScrubFile writes the image at input to output without its metadata, as
+// ScrubMetadata scrubs it for a JPEG or PNG; other images are re-encoded
+// in their own format with ConvertFile, which strips their metadata,
+// turning them upright, as the returned note says. It returns what was
+// removed.
+func ScrubFile(input, output string, opts ScrubOptions) (removed []string, note string, err error) {
+	if _, err := os.Stat(output); err == nil && !opts.Overwrite {
+		return nil, "", outputExistsError(output)
+	}
+	data, err := os.ReadFile(input)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read image: %w", err)
+	}
+	format, err := DetectImageFormat(input)
+	if err != nil {
+		return nil, "", err
+	}
+	if format != "jpeg" && format != "png" {
+		convert := ConvertOptions{Save: SaveOptions{Format: format, Metadata: MetadataStrip}, Overwrite: opts.Overwrite}
+		if note, err = ConvertFile(input, output, convert); err != nil {
+			return nil, note, err
+		}
+		if note == "" {
+			note = fmt.Sprintf("it is a %s, so it was re-encoded rather than rewritten in place", format)
+		}
+		return []string{"all metadata"}, note, nil
+	}
+
+	scrubbed, removed, err := ScrubMetadata(data, opts)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(output), os.ModeDir|0755); err != nil {
+		return nil, "", fmt.Errorf("failed to create output directory: %w", err)
+	}
+	if err := os.WriteFile(output, scrubbed, 0644); err != nil {
+		return nil, "", fmt.Errorf("failed to write image: %w", err)
+	}
+	return removed, "", nil
+}
+
+// ScrubDirectory scrubs every image under inputDir selected by batch with
+// ScrubFile, writing each to the same relative path under outputDir. A
+// failure on one image is recorded in its result and does not stop the
+// batch.
+func ScrubDirectory(inputDir, outputDir string, opts ScrubOptions, batch StegoBatchOptions) ([]StegoBatchResult, error) {
+	files, err := StegoBatchFiles(inputDir, batch)
+	if err != nil {
+		return nil, err
+	}
+	return runStegoBatch(files, batch.Workers, func(input string) StegoBatchResult {
+		result := StegoBatchResult{Input: input}
+		relPath, err := filepath.Rel(inputDir, input)
+		if err != nil {
+			result.Err = fmt.Errorf("failed to get relative path: %w", err)
+			return result
+		}
+		output := filepath.Join(outputDir, relPath)
+		if result.Removed, result.Note, result.Err = ScrubFile(input, output, opts); result.Err == nil {
+			result.Output = output
+		}
+		return result
+	}), nil
+}
@@ -0,0 +1,132 @@
+package pixellock
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// jpegScan returns the JPEG data from its first scan on: the compressed
+// pixels.
+func jpegScan(t *testing.T, data []byte) []byte {
+	t.Helper()
+	pos := 2
+	if err := jpegMetadataSegments(data, func(marker byte, start, end int) bool {
+		pos = end
+		return true
+	}); err != nil {
+		t.Fatalf("jpegMetadataSegments failed: %v", err)
+	}
+	return data[pos:]
+}
+
+func TestScrubJPEG(t *testing.T) {
+	dir := t.TempDir()
+	photo := filepath.Join(dir, "photo.jpg")
+	metadataPhotos(t, dir)
+	data, err := os.ReadFile(photo)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+
+	// An ICC profile and a comment besides the EXIF, XMP and IPTC
+	var segments bytes.Buffer
+	writeJPEGSegment(&segments, jpegAPP2, []byte("ICC_PROFILE\x00\x01\x01not really a profile"))
+	writeJPEGSegment(&segments, jpegCOM, []byte("shot from the balcony"))
+	data = append(append(append([]byte{}, data[:2]...), segments.Bytes()...), data[2:]...)
+
+	scrubbed, removed, err := ScrubMetadata(data, ScrubOptions{})
+	if err != nil {
+		t.Fatalf("ScrubMetadata failed: %v", err)
+	}
+	if exif, err := ReadEXIF(scrubbed); err != nil || exif != nil {
+		t.Errorf("the scrubbed image has EXIF (%v)", err)
+	}
+	for _, secret := range []string{testGPSDatum, "SN-447102", "GPSLatitude", "Paris", "ICC_PROFILE", "balcony"} {
+		if bytes.Contains(scrubbed, []byte(secret)) {
+			t.Errorf("the scrubbed image holds %q", secret)
+		}
+	}
+	for _, want := range []string{"EXIF (GPS location)", "XMP", "IPTC", "ICC profile", "comment"} {
+		if !slices.Contains(removed, want) {
+			t.Errorf("the report %q leaves out %q", removed, want)
+		}
+	}
+
+	// The compressed pixels are copied byte for byte
+	if !bytes.Equal(jpegScan(t, scrubbed), jpegScan(t, data)) {
+		t.Error("the compressed pixel data changed")
+	}
+
+	// Kept fields survive
+	kept, removed, err := ScrubMetadata(data, ScrubOptions{Keep: []string{KeepICC}})
+	if err != nil {
+		t.Fatalf("ScrubMetadata keeping the profile failed: %v", err)
+	}
+	if !bytes.Contains(kept, []byte("ICC_PROFILE")) || slices.Contains(removed, "ICC profile") {
+		t.Error("the ICC profile was removed")
+	}
+}
+
+func TestScrubKeepOrientation(t *testing.T) {
+	photo := exifPhoto(t)
+	output := filepath.Join(t.TempDir(), "upright.jpg")
+	removed, note, err := ScrubFile(photo, output, ScrubOptions{Keep: []string{KeepOrientation}})
+	if err != nil || note != "" {
+		t.Fatalf("ScrubFile failed: %v, %q", err, note)
+	}
+	orientation, date, ok := fileEXIF(t, output)
+	if !ok || orientation != 6 || date != "" {
+		t.Errorf("kept EXIF has orientation %d and date %q (%v); want the orientation alone", orientation, date, ok)
+	}
+	if !slices.Contains(removed, "EXIF but its orientation") {
+		t.Errorf("the report %q does not say the EXIF was partly kept", removed)
+	}
+	if _, _, err := ScrubFile(photo, output, ScrubOptions{}); err == nil {
+		t.Error("ScrubFile overwrote its output")
+	}
+	if _, err := ParseKeep("orientation,gps"); err == nil {
+		t.Error("ParseKeep took gps")
+	}
+}
+
+func TestScrubDirectory(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "in")
+	if err := os.MkdirAll(input, 0755); err != nil {
+		t.Fatalf("MkdirAll failed: %v", err)
+	}
+	metadataPhotos(t, input)
+	if err := SaveImage(filepath.Join(input, "scan.tiff"), grayTestImage(16, 12), SaveOptions{Format: "tiff", EXIF: gpsEXIF()}); err != nil {
+		t.Fatalf("SaveImage failed: %v", err)
+	}
+
+	results, err := ScrubDirectory(input, filepath.Join(dir, "out"), ScrubOptions{}, StegoBatchOptions{Workers: 2})
+	if err != nil {
+		t.Fatalf("ScrubDirectory failed: %v", err)
+	}
+	if len(results) != 3 {
+		t.Fatalf("%d results; want 3", len(results))
+	}
+	for _, r := range results {
+		if r.Err != nil {
+			t.Fatalf("%s: %v", r.Input, r.Err)
+		}
+		data, err := os.ReadFile(r.Output)
+		if err != nil {
+			t.Fatalf("ReadFile failed: %v", err)
+		}
+		if exif, err := ReadEXIF(data); err != nil || exif != nil || bytes.Contains(data, []byte(testGPSDatum)) {
+			t.Errorf("%s: metadata left after scrubbing (%v)", r.Output, err)
+		}
+		want, _ := LoadImage(r.Input)
+		if got, err := LoadImage(r.Output); err != nil || !samePixels(got, want) {
+			t.Errorf("%s: pixels changed (%v)", r.Output, err)
+		}
+		if filepath.Ext(r.Input) == ".tiff" && r.Note == "" {
+			t.Errorf("%s: no note that it was re-encoded", r.Input)
+		}
+	}
+}
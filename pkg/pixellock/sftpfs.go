@@ -0,0 +1,185 @@
+package pixellock
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// SFTPScheme begins the names of files on SFTP servers,
+// sftp://user@host/path, as an SFTPFS takes them.
+const SFTPScheme = "sftp://"
+
+// IsSFTPURL reports whether name is an sftp://user@host/path URL.
+func IsSFTPURL(name string) bool {
+	return strings.HasPrefix(name, SFTPScheme)
+}
+
+// sftpPath splits the server, user@host with an optional :port, and the
+// path on it out of name, reporting whether it names a file on an SFTP
+// server at all. As with s3Path, one slash after the scheme is enough. The
+// path is absolute, except that one beginning /~ is in the home directory
+// of the user, and relative to it.
+func sftpPath(name string) (server, p string, ok bool) {
+	rest, ok := strings.CutPrefix(filepath.ToSlash(name), "sftp:/")
+	if !ok {
+		return "", "", false
+	}
+	server, p, _ = strings.Cut(strings.TrimPrefix(rest, "/"), "/")
+	p = path.Clean("/" + p)
+	if p == "/~" || strings.HasPrefix(p, "/~/") {
+		p = path.Clean("." + p[2:])
+	}
+	return server, p, true
+}
+
+// sftpURL returns the URL of the path p on server, as sftpPath splits it.
+func sftpURL(server, p string) string {
+	if !path.IsAbs(p) {
+		p = path.Join("/~", p)
+	}
+	return SFTPScheme + server + p
+}
+
+// An SFTPClient reaches the SFTP servers of an SFTPFS. It can be used by
+// several goroutines at once.
+type SFTPClient interface {
+	// Server returns the FileSystem of the files of server, user@host with
+	// an optional :port, named by their paths there. It is called for
+	// each file, so should keep its connections to reuse.
+	Server(server string) (FileSystem, error)
+}
+
+// An SFTPFS is a FileSystem of the files of SFTP servers, named by
+// sftp://user@host/path URLs, and of the files of Local, named any other
+// way, so that images can be encrypted from an SFTP server, to one or both.
+// Files are read and written as they are transferred, and MkdirAll creates
+// the directories of a server as it does locally.
+type SFTPFS struct {
+	Client SFTPClient
+	Local  FileSystem // The FileSystem of other names; OSFS when nil
+}
+
+func (s *SFTPFS) local() FileSystem { return orOS(s.Local) }
+
+// errNoServer is the error of a name with no server, such as sftp:///path.
+var errNoServer = errors.New("no server named")
+
+// sftpError returns err as the error of op on name, in place of the path
+// on the server it may give.
+func sftpError(op, name string, err error) error {
+	var pe *fs.PathError
+	if errors.As(err, &pe) {
+		err = pe.Err
+	}
+	return &fs.PathError{Op: op, Path: name, Err: err}
+}
+
+// server returns the FileSystem of the server name is on, and the path of
+// name there, or that of Local and name itself for other names.
+func (s *SFTPFS) server(op, name string) (FileSystem, string, error) {
+	server, p, ok := sftpPath(name)
+	switch {
+	case !ok:
+		return s.local(), name, nil
+	case server == "":
+		return nil, "", sftpError(op, name, errNoServer)
+	}
+	fsys, err := s.Client.Server(server)
+	if err != nil {
+		return nil, "", sftpError(op, name, err)
+	}
+	return fsys, p, nil
+}
+
+// remoteError returns err as the error of op on name when name is on a
+// server, and as it is otherwise.
+func remoteError(op, name string, err error) error {
+	if _, _, ok := sftpPath(name); err == nil || !ok {
+		return err
+	}
+	return sftpError(op, name, err)
+}
+
+// Stat returns the information of the file or directory name.
+func (s *SFTPFS) Stat(name string) (fs.FileInfo, error) {
+	fsys, p, err := s.server("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := fsys.Stat(p)
+	return info, remoteError("stat", name, err)
+}
+
+// ReadDir returns the entries of the directory name, sorted by name.
+func (s *SFTPFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	fsys, p, err := s.server("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := fsys.ReadDir(p)
+	return entries, remoteError("readdir", name, err)
+}
+
+// Open opens the file name for reading, which is read as it is
+// downloaded.
+func (s *SFTPFS) Open(name string) (fs.File, error) {
+	fsys, p, err := s.server("open", name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := fsys.Open(p)
+	return f, remoteError("open", name, err)
+}
+
+// Create creates or truncates the file name, which is uploaded as it is
+// written.
+func (s *SFTPFS) Create(name string) (io.WriteCloser, error) {
+	fsys, p, err := s.server("create", name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := fsys.Create(p)
+	return f, remoteError("create", name, err)
+}
+
+// MkdirAll creates the directory name and any parents it needs, on a
+// server as locally.
+func (s *SFTPFS) MkdirAll(name string, perm fs.FileMode) error {
+	fsys, p, err := s.server("mkdir", name)
+	if err != nil {
+		return err
+	}
+	return remoteError("mkdir", name, fsys.MkdirAll(p, perm))
+}
+
+// Remove removes the file or empty directory name.
+func (s *SFTPFS) Remove(name string) error {
+	fsys, p, err := s.server("remove", name)
+	if err != nil {
+		return err
+	}
+	return remoteError("remove", name, fsys.Remove(p))
+}
+
+// Rename moves the file oldname to newname, replacing any file there. A
+// file cannot be moved between servers, or between a server and Local.
+func (s *SFTPFS) Rename(oldname, newname string) error {
+	oldServer, _, oldSFTP := sftpPath(oldname)
+	newServer, newPath, newSFTP := sftpPath(newname)
+	if oldSFTP != newSFTP || oldServer != newServer {
+		return &fs.PathError{Op: "rename", Path: oldname, Err: fmt.Errorf("cannot move to %s on another server", newname)}
+	}
+	fsys, oldPath, err := s.server("rename", oldname)
+	if err != nil {
+		return err
+	}
+	if !newSFTP {
+		newPath = newname
+	}
+	return remoteError("rename", oldname, fsys.Rename(oldPath, newPath))
+}
@@ -0,0 +1,99 @@
+package pixellock
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeSFTP is an SFTPClient of servers held in memory, which refuses
+// the user refused.
+type fakeSFTP struct {
+	mu      sync.Mutex
+	servers map[string]*MemFS
+}
+
+func (s *fakeSFTP) Server(server string) (FileSystem, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if strings.HasPrefix(server, "refused@") {
+		return nil, errors.New("ssh: unable to authenticate")
+	}
+	if s.servers[server] == nil {
+		s.servers[server] = &MemFS{}
+	}
+	return s.servers[server], nil
+}
+
+func TestSFTPPath(t *testing.T) {
+	for _, test := range []struct {
+		name, server, path string
+	}{
+		{"sftp://me@host/srv/photos", "me@host", "/srv/photos"},
+		{"sftp://me@host:2222/srv/photos/../enc/", "me@host:2222", "/srv/enc"},
+		{"sftp:/me@host/srv", "me@host", "/srv"}, // As filepath.Join leaves it
+		{"sftp://host", "host", "/"},
+		{"sftp://me@host/~/photos", "me@host", "photos"},
+		{"sftp://me@host/~", "me@host", "."},
+	} {
+		server, p, ok := sftpPath(test.name)
+		if !ok || server != test.server || p != test.path {
+			t.Errorf("sftpPath(%q) = %q, %q, %v, want %q, %q", test.name, server, p, ok, test.server, test.path)
+		}
+	}
+	if _, _, ok := sftpPath("photos/sftp://host"); ok {
+		t.Error("sftpPath took a local path")
+	}
+	for dir, want := range map[string]string{
+		"sftp://me@host/srv":   "sftp://me@host/srv/2024/a.png",
+		"sftp://me@host/~/enc": "sftp://me@host/~/enc/2024/a.png",
+		"sftp://me@host/~":     "sftp://me@host/~/2024/a.png",
+	} {
+		if got := joinName(dir, "2024/a.png"); got != want {
+			t.Errorf("joinName(%q) = %q, want %q", dir, got, want)
+		}
+	}
+}
+
+func TestSFTPFS(t *testing.T) {
+	key, _ := GenerateRandomKey()
+	local, in := progressFixture(t, 3)
+	client := &fakeSFTP{servers: map[string]*MemFS{}}
+	fsys := &SFTPFS{Client: client, Local: local}
+
+	if err := EncryptDirectory(t.Context(), in, "sftp://me@host:2222/srv/enc", key, false, false, EncryptOptions{FS: fsys}); err != nil {
+		t.Fatalf("EncryptDirectory to a server failed: %v", err)
+	}
+	remote := client.servers["me@host:2222"]
+	for i := range 3 {
+		if name := fmt.Sprintf("srv/enc/img%d.png.enc", i); !exists(remote, name) {
+			t.Errorf("%s was not written to the server", name)
+		}
+	}
+	if err := DecryptDirectory(t.Context(), "sftp://me@host:2222/srv/enc", "dec", key, false, EncryptedExtension, false, SaveOptions{FS: fsys}); err != nil {
+		t.Fatalf("DecryptDirectory from a server failed: %v", err)
+	}
+	if !exists(local, "dec/img2.png") {
+		t.Error("dec/img2.png was not decrypted")
+	}
+
+	// Errors name the URL
+	_, err := fsys.Stat("sftp://me@host:2222/srv/missing")
+	if !errors.Is(err, fs.ErrNotExist) || !strings.Contains(err.Error(), "sftp://me@host:2222/srv/missing") {
+		t.Errorf("Stat of a missing file = %v", err)
+	}
+	if _, err := fsys.Open("sftp://refused@host/srv"); err == nil || !strings.Contains(err.Error(), "open sftp://refused@host/srv: ssh: unable to authenticate") {
+		t.Errorf("Open on a server refusing the user = %v", err)
+	}
+	if _, err := fsys.Stat("sftp:///srv"); !errors.Is(err, errNoServer) {
+		t.Errorf("Stat with no server = %v", err)
+	}
+	for _, newname := range []string{"sftp://me@other/srv/a.enc", "dec/a.enc"} {
+		if err := fsys.Rename("sftp://me@host:2222/srv/enc/img0.png.enc", newname); err == nil {
+			t.Errorf("Rename to %s succeeded", newname)
+		}
+	}
+}
@@ -0,0 +1,610 @@
+package pixellock
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// A shard set is a directory of files packed into shards of one size, for
+// tools that sync many uniform objects better than a mix of small and
+// large files. Each file is a record, written after the one before it in
+// the shard files data-000001.pxs, data-000002.pxs and so on, and running
+// on into the next shard when it does not fit in what is left of one, so
+// that every shard but the last is the shard size. The index, index.pxs,
+// encrypted with the key as a stream, gives the shard, offset and length
+// of each record, and its SHA-256 hash, so that a file is read with
+// ranged reads of the shards it is in alone. Records are files encrypted
+// as streams, as archive writes them, or encrypted files as encrypt
+// writes them, packed as they are. A later run appends to the set,
+// carrying on from the end of its last shard.
+
+// ShardIndexName is the name of the index of a shard set.
+const ShardIndexName = "index.pxs"
+
+// DefaultShardSize is the size of the shards WriteShards writes when
+// ShardOptions names none.
+const DefaultShardSize = 64 << 20
+
+// MinShardSize bounds the size of shards from below.
+const MinShardSize = 64 << 10
+
+// shardIndexVersion is the version of the index WriteShards writes.
+const shardIndexVersion = 1
+
+// ShardOptions configure WriteShards.
+type ShardOptions struct {
+	// Size is the size of each shard; DefaultShardSize when 0. A set
+	// appended to keeps the size it was written with, and fails with
+	// another.
+	Size int64
+
+	// Encrypted packs the files as they are, being encrypted files as
+	// encrypt writes them, rather than encrypting each as a stream. A set
+	// holds one kind of record or the other.
+	Encrypted bool
+
+	// ImagesOnly packs only the images pixellock can load.
+	ImagesOnly bool
+
+	// Logger is given the files left out of the set.
+	Logger Logger
+}
+
+// A ShardEntry is a file of a shard set, and where its record is.
+type ShardEntry struct {
+	// Path is the slash-separated path of the file in the directory
+	// packed.
+	Path    string      `json:"path"`
+	Mode    fs.FileMode `json:"mode"`
+	ModTime time.Time   `json:"mod_time"`
+	Size    int64       `json:"size"` // Of the file
+
+	// Shard is the number of the shard the record starts in, from 1, and
+	// Offset where in it. Length is that of the record, which goes on in
+	// the shards after when it is longer than what is left of its shard.
+	Shard  int   `json:"shard"`
+	Offset int64 `json:"offset"`
+	Length int64 `json:"length"`
+
+	// SHA256 is the hex hash of the record.
+	SHA256 string `json:"sha256"`
+}
+
+// shardIndex is the index of a shard set, as it is kept encrypted.
+type shardIndex struct {
+	Version   int          `json:"version"`
+	ShardSize int64        `json:"shard_size"`
+	Encrypted bool         `json:"encrypted"`
+	Shards    int          `json:"shards"` // Written, the last End bytes long
+	End       int64        `json:"end"`
+	Files     []ShardEntry `json:"files"` // In order of Path
+}
+
+// shardName returns the name of shard n of the set in dir.
+func shardName(dir string, n int) string {
+	return filepath.Join(dir, fmt.Sprintf("data-%06d.pxs", n))
+}
+
+// IsShardSet reports whether dir is a shard set, having its index.
+func IsShardSet(dir string) bool {
+	info, err := os.Stat(filepath.Join(dir, ShardIndexName))
+	return err == nil && info.Mode().IsRegular()
+}
+
+// readShardIndex reads the index of the set in dir with the key of keys.
+func readShardIndex(ctx context.Context, dir string, keys *keyCipher) (*shardIndex, error) {
+	f, err := os.Open(filepath.Join(dir, ShardIndexName))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var data bytes.Buffer
+	if err := decryptStream(ctx, keys, &data, f); err != nil {
+		return nil, fmt.Errorf("failed to read shard index: %w", err)
+	}
+	var idx shardIndex
+	if err := json.Unmarshal(data.Bytes(), &idx); err != nil {
+		return nil, fmt.Errorf("bad shard index: %w", err)
+	}
+	if idx.Version > shardIndexVersion {
+		return nil, fmt.Errorf("shard index of a newer pixellock, of version %d", idx.Version)
+	}
+	if idx.ShardSize < MinShardSize || idx.End < 0 || idx.End > idx.ShardSize {
+		return nil, errors.New("bad shard index")
+	}
+	for _, e := range idx.Files {
+		if !filepath.IsLocal(filepath.FromSlash(e.Path)) || e.Shard < 1 || e.Shard > idx.Shards ||
+			e.Offset < 0 || e.Offset >= idx.ShardSize || e.Length < 0 {
+			return nil, fmt.Errorf("bad shard index entry %q", e.Path)
+		}
+	}
+	return &idx, nil
+}
+
+// write writes the index to the set in dir, encrypted with the key of
+// keys, beside its place first and renamed into it.
+func (idx *shardIndex) write(ctx context.Context, dir string, keys *keyCipher) error {
+	data, err := json.Marshal(idx)
+	if err != nil {
+		return err
+	}
+	name := filepath.Join(dir, ShardIndexName)
+	tmp := name + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	err = encryptStream(ctx, AESGCM, keys, f, bytes.NewReader(data))
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, name)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// WriteShards packs the regular files in dir and its subdirectories into
+// the shard set in shardDir, encrypted with key, creating it or appending
+// to it. A file already in the set is replaced by the new record of it;
+// the old record stays where it is, unread. Other files, such as symbolic
+// links, are left out and logged, as are empty directories. The index is
+// written once every record is, so that a set cut short by a failure or
+// ctx being done is the set as it was, and the records written past its
+// end are written over by the next run. It returns the number of files
+// packed.
+func WriteShards(ctx context.Context, key []byte, dir, shardDir string, opts ShardOptions) (int, error) {
+	n, err := writeShards(ctx, newKeyCipher(key), dir, shardDir, opts)
+	return n, pathError("pack", dir, err)
+}
+
+func writeShards(ctx context.Context, keys *keyCipher, dir, shardDir string, opts ShardOptions) (int, error) {
+	logger := orNop(opts.Logger)
+	size := opts.Size
+	if size == 0 {
+		size = DefaultShardSize
+	}
+	if size < MinShardSize {
+		return 0, fmt.Errorf("invalid shard size %d: must be at least %d", size, MinShardSize)
+	}
+	if info, err := os.Stat(dir); err != nil {
+		return 0, err
+	} else if !info.IsDir() {
+		return 0, fmt.Errorf("%s is not a directory", dir)
+	}
+	if rel, err := filepath.Rel(dir, shardDir); err == nil && (filepath.IsLocal(rel) || rel == ".") {
+		return 0, fmt.Errorf("the shard set cannot be written inside %s, the directory it packs", dir)
+	}
+	idx := &shardIndex{Version: shardIndexVersion, ShardSize: size, Encrypted: opts.Encrypted}
+	if IsShardSet(shardDir) {
+		old, err := readShardIndex(ctx, shardDir, keys)
+		if err != nil {
+			return 0, err
+		}
+		switch {
+		case old.ShardSize != size:
+			return 0, fmt.Errorf("the shard set in %s has shards of %d bytes, not %d", shardDir, old.ShardSize, size)
+		case old.Encrypted != opts.Encrypted:
+			return 0, fmt.Errorf("the shard set in %s holds other records: encrypt and archive sets cannot be mixed", shardDir)
+		}
+		idx = old
+	} else if err := os.MkdirAll(shardDir, 0o755); err != nil {
+		return 0, err
+	}
+
+	w := &shardWriter{dir: shardDir, size: size, shard: idx.Shards, end: idx.End}
+	defer w.close()
+	var added []ShardEntry
+	err := filepath.WalkDir(dir, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		switch {
+		case d.IsDir():
+			return nil
+		case !d.Type().IsRegular():
+			logger.Warn("left out of the shards, not a regular file", "path", name)
+			return nil
+		case opts.ImagesOnly && !isImageFile(name):
+			logger.Debug("left out of the shards, not an image", "path", name)
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, name)
+		if err != nil {
+			return err
+		}
+		e, err := w.add(ctx, keys, name, opts.Encrypted)
+		if err != nil {
+			return fmt.Errorf("failed to pack %s: %w", name, err)
+		}
+		e.Path, e.Mode, e.ModTime, e.Size = filepath.ToSlash(rel), info.Mode().Perm(), info.ModTime(), info.Size()
+		added = append(added, e)
+		return nil
+	})
+	if err == nil {
+		err = w.close()
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	for _, e := range added {
+		i, found := slices.BinarySearchFunc(idx.Files, e.Path, func(e ShardEntry, path string) int { return strings.Compare(e.Path, path) })
+		if found {
+			idx.Files[i] = e
+		} else {
+			idx.Files = slices.Insert(idx.Files, i, e)
+		}
+	}
+	idx.Shards, idx.End = w.shard, w.end
+	return len(added), idx.write(ctx, shardDir, keys)
+}
+
+// A shardWriter writes records to the shards of a set, after the end
+// bytes of shard, the last.
+type shardWriter struct {
+	dir   string
+	size  int64
+	shard int
+	end   int64
+	f     *os.File // Of shard, once opened
+}
+
+// add writes the record of the file name to the shards: the file itself
+// when encrypted is set, and the file encrypted as a stream otherwise. It
+// returns the entry of the record, but for the file's path and info.
+func (w *shardWriter) add(ctx context.Context, keys *keyCipher, name string, encrypted bool) (ShardEntry, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return ShardEntry{}, err
+	}
+	defer f.Close()
+	if w.shard == 0 || w.end == w.size {
+		if err := w.next(); err != nil {
+			return ShardEntry{}, err
+		}
+	} else if w.f == nil {
+		// The last shard of the set, cut back to where its index ends
+		if w.f, err = os.OpenFile(shardName(w.dir, w.shard), os.O_RDWR|os.O_CREATE, 0o644); err != nil {
+			return ShardEntry{}, err
+		}
+		if err := w.f.Truncate(w.end); err != nil {
+			return ShardEntry{}, err
+		}
+		if _, err := w.f.Seek(w.end, io.SeekStart); err != nil {
+			return ShardEntry{}, err
+		}
+	}
+	e := ShardEntry{Shard: w.shard, Offset: w.end}
+	h := sha256.New()
+	rec := &recordWriter{w: w, h: h}
+	if encrypted {
+		_, err = io.Copy(rec, f)
+	} else {
+		err = encryptStream(ctx, AESGCM, keys, rec, f)
+	}
+	if err != nil {
+		return ShardEntry{}, err
+	}
+	e.Length, e.SHA256 = rec.n, hex.EncodeToString(h.Sum(nil))
+	return e, nil
+}
+
+// next starts the next shard.
+func (w *shardWriter) next() error {
+	if err := w.close(); err != nil {
+		return err
+	}
+	f, err := os.Create(shardName(w.dir, w.shard+1))
+	if err != nil {
+		return err
+	}
+	w.f, w.shard, w.end = f, w.shard+1, 0
+	return nil
+}
+
+// close syncs and closes the shard open, if any.
+func (w *shardWriter) close() error {
+	if w.f == nil {
+		return nil
+	}
+	err := w.f.Sync()
+	if cerr := w.f.Close(); err == nil {
+		err = cerr
+	}
+	w.f = nil
+	return err
+}
+
+// A recordWriter writes a record to the shards of w, hashing it.
+type recordWriter struct {
+	w *shardWriter
+	h hash.Hash
+	n int64
+}
+
+func (r *recordWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if r.w.end == r.w.size {
+			if err := r.w.next(); err != nil {
+				return written, err
+			}
+		}
+		c := int(min(int64(len(p)), r.w.size-r.w.end))
+		n, err := r.w.f.Write(p[:c])
+		r.h.Write(p[:n])
+		r.w.end += int64(n)
+		r.n += int64(n)
+		written += n
+		p = p[n:]
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// errRecordUnread stops the decryption of a record whose file is not
+// written.
+var errRecordUnread = errors.New("record not read")
+
+// A ShardSet is a shard set opened for reading.
+type ShardSet struct {
+	dir  string
+	keys *keyCipher
+	idx  *shardIndex
+}
+
+// OpenShards opens the shard set in dir, reading its index with key.
+func OpenShards(ctx context.Context, dir string, key []byte) (*ShardSet, error) {
+	keys := newKeyCipher(key)
+	idx, err := readShardIndex(ctx, dir, keys)
+	if err != nil {
+		return nil, pathError("open", dir, err)
+	}
+	return &ShardSet{dir: dir, keys: keys, idx: idx}, nil
+}
+
+// Entries returns the files of the set, in order of their paths.
+func (s *ShardSet) Entries() []ShardEntry {
+	return slices.Clone(s.idx.Files)
+}
+
+// Encrypted reports whether the records of the set are encrypted files
+// packed as they are, as encrypt packs them.
+func (s *ShardSet) Encrypted() bool {
+	return s.idx.Encrypted
+}
+
+// ShardSize returns the size of the shards of the set.
+func (s *ShardSet) ShardSize() int64 {
+	return s.idx.ShardSize
+}
+
+// Entry returns the entry of the file at path.
+func (s *ShardSet) Entry(path string) (ShardEntry, bool) {
+	i, ok := slices.BinarySearchFunc(s.idx.Files, path, func(e ShardEntry, path string) int { return strings.Compare(e.Path, path) })
+	if !ok {
+		return ShardEntry{}, false
+	}
+	return s.idx.Files[i], true
+}
+
+// Select returns the entries of paths, each a file of the set or a
+// directory of files in it, or all of them when paths is empty.
+func (s *ShardSet) Select(paths []string) ([]ShardEntry, error) {
+	if len(paths) == 0 {
+		return s.Entries(), nil
+	}
+	var entries []ShardEntry
+	for _, p := range paths {
+		p = path.Clean(filepath.ToSlash(p))
+		found := false
+		for _, e := range s.idx.Files {
+			if e.Path == p || strings.HasPrefix(e.Path, p+"/") || p == "." {
+				entries = append(entries, e)
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("%s is not in the shard set", p)
+		}
+	}
+	slices.SortFunc(entries, func(a, b ShardEntry) int { return strings.Compare(a.Path, b.Path) })
+	return slices.CompactFunc(entries, func(a, b ShardEntry) bool { return a.Path == b.Path }), nil
+}
+
+// OpenRecord returns a reader of the record of e, read from the shards it
+// is in alone, which fails at its end unless the record matches its hash.
+func (s *ShardSet) OpenRecord(e ShardEntry) (io.ReadCloser, error) {
+	var readers []io.Reader
+	var files []*os.File
+	closeAll := func() error {
+		var errs []error
+		for _, f := range files {
+			errs = append(errs, f.Close())
+		}
+		return errors.Join(errs...)
+	}
+	for n, off, left := e.Shard, e.Offset, e.Length; left > 0 || len(readers) == 0; n, off = n+1, 0 {
+		if n > s.idx.Shards {
+			closeAll()
+			return nil, fmt.Errorf("record of %s runs past the last shard", e.Path)
+		}
+		f, err := os.Open(shardName(s.dir, n))
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		files = append(files, f)
+		c := min(left, s.idx.ShardSize-off)
+		readers = append(readers, io.NewSectionReader(f, off, c))
+		left -= c
+	}
+	return &recordReader{r: io.MultiReader(readers...), h: sha256.New(), want: e.SHA256, path: e.Path, length: e.Length, close: closeAll}, nil
+}
+
+// A recordReader reads a record, checking its length and hash at its end.
+type recordReader struct {
+	r      io.Reader
+	h      hash.Hash
+	want   string
+	path   string
+	length int64
+	n      int64
+	close  func() error
+}
+
+func (r *recordReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.h.Write(p[:n])
+	r.n += int64(n)
+	if err == io.EOF && (r.n != r.length || hex.EncodeToString(r.h.Sum(nil)) != r.want) {
+		return n, fmt.Errorf("record of %s is damaged: it does not match its hash", r.path)
+	}
+	return n, err
+}
+
+func (r *recordReader) Close() error {
+	return r.close()
+}
+
+// Extract writes the files of entries to the directory dir, which it
+// creates if need be: each decrypted, or, in a set of encrypted files, as
+// it is. An existing file is left alone, and logged, unless overwrite is
+// set. No file is written outside dir, whatever its path.
+func (s *ShardSet) Extract(ctx context.Context, entries []ShardEntry, dir string, overwrite bool, logger Logger) error {
+	return pathError("extract", dir, s.extract(ctx, entries, dir, overwrite, orNop(logger)))
+}
+
+func (s *ShardSet) extract(ctx context.Context, entries []ShardEntry, dir string, overwrite bool, logger Logger) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		return err
+	}
+	defer root.Close()
+	for _, e := range entries {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		name := filepath.FromSlash(e.Path)
+		if err := mkdirAllIn(root, filepath.Dir(name)); err != nil {
+			return err
+		}
+		rec, err := s.OpenRecord(e)
+		if err != nil {
+			return err
+		}
+		if s.idx.Encrypted {
+			err = extractFile(root, name, e.Mode, rec, overwrite, logger)
+		} else {
+			pr, pw := io.Pipe()
+			done := make(chan error, 1)
+			go func() {
+				err := decryptStream(ctx, s.keys, pw, rec)
+				pw.CloseWithError(err)
+				done <- err
+			}()
+			err = extractFile(root, name, e.Mode, pr, overwrite, logger)
+			// A file left alone is not read
+			pr.CloseWithError(errRecordUnread)
+			if derr := <-done; !errors.Is(derr, errRecordUnread) {
+				err = firstError(derr, err)
+			}
+		}
+		rec.Close()
+		if err != nil {
+			return pathError("extract", e.Path, err)
+		}
+	}
+	return nil
+}
+
+// Decrypt decrypts the encrypted images of entries, of a set of encrypted
+// files, to the same paths under outputDir without EncryptedExtension, as
+// DecryptDirectory does. Each record is staged in a temporary file beside
+// its output, still encrypted, and decrypted from there with DecryptFile.
+// A failure on one image is logged to save.Logger and does not stop the
+// others, but is returned with theirs, joined.
+func (s *ShardSet) Decrypt(ctx context.Context, entries []ShardEntry, outputDir string, overwrite bool, save SaveOptions) error {
+	if !s.idx.Encrypted {
+		return errors.New("the shard set holds an archive; extract it instead")
+	}
+	logger := orNop(save.Logger)
+	var errs []error
+	for _, e := range entries {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !strings.HasSuffix(e.Path, EncryptedExtension) {
+			continue
+		}
+		output := filepath.Join(outputDir, filepath.FromSlash(strings.TrimSuffix(e.Path, EncryptedExtension)))
+		if err := s.decrypt(ctx, e, output, overwrite, save); err != nil {
+			logger.Error("failed to decrypt", "path", e.Path, "err", err)
+			errs = append(errs, pathError("decrypt", e.Path, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// decrypt decrypts the image of e to output.
+func (s *ShardSet) decrypt(ctx context.Context, e ShardEntry, output string, overwrite bool, save SaveOptions) error {
+	if !filepath.IsLocal(filepath.FromSlash(e.Path)) {
+		return fmt.Errorf("shard entry %q is outside the directory", e.Path)
+	}
+	if err := os.MkdirAll(filepath.Dir(output), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(output), ".pxs-*"+EncryptedExtension)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	rec, err := s.OpenRecord(e)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	_, err = io.Copy(tmp, rec)
+	rec.Close()
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	save.FS = nil
+	return DecryptFile(ctx, tmp.Name(), output, s.keys.key, overwrite, save)
+}
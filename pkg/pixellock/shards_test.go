@@ -0,0 +1,208 @@
+package pixellock
+
+import (
+	"bytes"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// shardTree writes files of random data of the sizes given to dir,
+// returning their contents by path.
+func shardTree(t *testing.T, dir string, seed uint64, sizes map[string]int) map[string][]byte {
+	t.Helper()
+	rng := rand.New(rand.NewPCG(seed, seed))
+	files := map[string][]byte{}
+	for path, size := range sizes {
+		data := make([]byte, size)
+		for i := range data {
+			data[i] = byte(rng.Uint32())
+		}
+		name := filepath.Join(dir, filepath.FromSlash(path))
+		os.MkdirAll(filepath.Dir(name), 0o755)
+		if err := os.WriteFile(name, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		files[path] = data
+	}
+	return files
+}
+
+// checkShardSet fails unless the shard set in dir holds files, each
+// extracted as it was, and every shard but the last is the shard size.
+func checkShardSet(t *testing.T, key []byte, dir string, files map[string][]byte) {
+	t.Helper()
+	s, err := OpenShards(t.Context(), dir, key)
+	if err != nil {
+		t.Fatalf("OpenShards failed: %v", err)
+	}
+	entries := s.Entries()
+	if len(entries) != len(files) {
+		t.Errorf("shard set has %d files, want %d", len(entries), len(files))
+	}
+	for path, want := range files {
+		e, ok := s.Entry(path)
+		if !ok {
+			t.Errorf("%s is not in the shard set", path)
+			continue
+		}
+		// Each file alone, read from its own shards
+		out := t.TempDir()
+		if err := s.Extract(t.Context(), []ShardEntry{e}, out, false, nil); err != nil {
+			t.Errorf("Extract of %s failed: %v", path, err)
+			continue
+		}
+		got, err := os.ReadFile(filepath.Join(out, filepath.FromSlash(path)))
+		if err != nil || !bytes.Equal(got, want) {
+			t.Errorf("%s extracted is not as it was: %v", path, err)
+		}
+		if written, _ := os.ReadDir(out); len(written) != 1 {
+			t.Errorf("Extract of %s wrote %d entries", path, len(written))
+		}
+	}
+	shards, _ := filepath.Glob(filepath.Join(dir, "data-*.pxs"))
+	for i, name := range shards {
+		info, err := os.Stat(name)
+		if err != nil || i < len(shards)-1 && info.Size() != s.ShardSize() || info.Size() > s.ShardSize() {
+			t.Errorf("shard %s is %d bytes, of shards of %d", name, info.Size(), s.ShardSize())
+		}
+	}
+}
+
+func TestShards(t *testing.T) {
+	key, _ := GenerateRandomKey()
+	input, set := t.TempDir(), filepath.Join(t.TempDir(), "set")
+	files := shardTree(t, input, 1, map[string]int{
+		"a.bin":          100 << 10,
+		"b.bin":          10,
+		"empty":          0,
+		"sub/c.bin":      200 << 10,
+		"sub/deep/d.bin": 3000,
+	})
+	opts := ShardOptions{Size: MinShardSize}
+	n, err := WriteShards(t.Context(), key, input, set, opts)
+	if err != nil || n != len(files) {
+		t.Fatalf("WriteShards gave %d, %v", n, err)
+	}
+	checkShardSet(t, key, set, files)
+
+	// A second batch appended, replacing one file and adding others
+	second := t.TempDir()
+	more := shardTree(t, second, 2, map[string]int{
+		"b.bin":       70 << 10,
+		"e.bin":       5,
+		"sub/f.bin":   90 << 10,
+		"new/g/h.bin": 1,
+	})
+	before, _ := filepath.Glob(filepath.Join(set, "data-*.pxs"))
+	if n, err := WriteShards(t.Context(), key, second, set, opts); err != nil || n != len(more) {
+		t.Fatalf("WriteShards of a second batch gave %d, %v", n, err)
+	}
+	after, _ := filepath.Glob(filepath.Join(set, "data-*.pxs"))
+	if len(after) <= len(before) {
+		t.Errorf("appending wrote no shards: %d before, %d after", len(before), len(after))
+	}
+	for path, data := range more {
+		files[path] = data
+	}
+	checkShardSet(t, key, set, files)
+
+	s, _ := OpenShards(t.Context(), set, key)
+	if sub, err := s.Select([]string{"sub"}); err != nil || len(sub) != 3 {
+		t.Errorf("Select of sub gave %d entries, %v", len(sub), err)
+	}
+	if _, err := s.Select([]string{"missing.bin"}); err == nil {
+		t.Error("Select of a file not in the set succeeded")
+	}
+
+	// An existing file is left alone unless overwriting
+	out := t.TempDir()
+	os.WriteFile(filepath.Join(out, "e.bin"), []byte("mine"), 0o644)
+	e, _ := s.Entry("e.bin")
+	if err := s.Extract(t.Context(), []ShardEntry{e}, out, false, nil); err != nil {
+		t.Fatalf("Extract over an existing file failed: %v", err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(out, "e.bin")); string(data) != "mine" {
+		t.Error("Extract overwrote an existing file")
+	}
+
+	// A damaged record fails its hash
+	shard := filepath.Join(set, "data-000001.pxs")
+	data, _ := os.ReadFile(shard)
+	data[100] ^= 0xff
+	os.WriteFile(shard, data, 0o644)
+	if err := s.Extract(t.Context(), s.Entries(), t.TempDir(), false, nil); err == nil {
+		t.Error("Extract of a damaged record succeeded")
+	}
+
+	// Nor can a set be appended to with other shards, another kind of
+	// record or another key
+	if _, err := WriteShards(t.Context(), key, second, set, ShardOptions{Size: 2 * MinShardSize}); err == nil {
+		t.Error("WriteShards with another shard size succeeded")
+	}
+	if _, err := WriteShards(t.Context(), key, second, set, ShardOptions{Size: MinShardSize, Encrypted: true}); err == nil {
+		t.Error("WriteShards of encrypted files to an archive set succeeded")
+	}
+	other, _ := GenerateRandomKey()
+	if _, err := WriteShards(t.Context(), other, second, set, opts); err == nil {
+		t.Error("WriteShards with another key succeeded")
+	}
+	if _, err := WriteShards(t.Context(), key, input, t.TempDir(), ShardOptions{Size: 1000}); err == nil {
+		t.Error("WriteShards with shards too small succeeded")
+	}
+}
+
+func TestShardsEncrypted(t *testing.T) {
+	key, _ := GenerateRandomKey()
+	input, encrypted, set := t.TempDir(), t.TempDir(), t.TempDir()
+	paths := dedupeTree(t, input)
+	if err := EncryptDirectory(t.Context(), input, encrypted, key, true, false, EncryptOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := WriteShards(t.Context(), key, encrypted, set, ShardOptions{Size: MinShardSize, Encrypted: true}); err != nil {
+		t.Fatalf("WriteShards failed: %v", err)
+	}
+	s, err := OpenShards(t.Context(), set, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.Encrypted() || len(s.Entries()) != len(paths) {
+		t.Fatalf("shard set has %d entries, encrypted %v", len(s.Entries()), s.Encrypted())
+	}
+
+	// One image alone
+	entries, err := s.Select([]string{"c/d/face.jpg.enc"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := t.TempDir()
+	if err := s.Decrypt(t.Context(), entries, out, false, SaveOptions{Format: "jpeg"}); err != nil {
+		t.Fatalf("Decrypt failed: %v", err)
+	}
+	written := outputFiles(t, out)
+	if _, ok := written["c/d/face.jpg"]; !ok || len(written) != 1 {
+		t.Errorf("Decrypt of one image wrote %d files", len(written))
+	}
+
+	// And every one
+	checkDecryptedShards(t, s, paths)
+}
+
+// checkDecryptedShards decrypts the images of s and fails unless each of
+// paths comes back.
+func checkDecryptedShards(t *testing.T, s *ShardSet, paths []string) {
+	t.Helper()
+	out := t.TempDir()
+	if err := s.Decrypt(t.Context(), s.Entries(), out, false, SaveOptions{}); err != nil {
+		t.Fatalf("Decrypt failed: %v", err)
+	}
+	for _, path := range paths {
+		if _, err := os.Stat(filepath.Join(out, filepath.FromSlash(path))); err != nil {
+			t.Errorf("%s was not decrypted: %v", path, err)
+		}
+	}
+	if len(outputFiles(t, out)) != len(paths) {
+		t.Errorf("Decrypt wrote %d files, want %d", len(outputFiles(t, out)), len(paths))
+	}
+}
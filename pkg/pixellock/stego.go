@@ -0,0 +1,543 @@
+package pixellock
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Amul-Thantharate/pixellock/pkg/stego"
+)
+
+// The steganography engine lives in package stego, which works on images in
+// memory; the functions here load covers from and save stego images to
+// files, and add the carriers other than pixels: JPEG coefficients,
+// metadata and palette indices.
+
+// Stego payload format versions; see package stego.
+const (
+	StegoVersionLegacy     = stego.VersionLegacy
+	StegoVersionTerminated = stego.VersionTerminated
+	StegoVersionLength     = stego.VersionLength
+	StegoVersionChecksum   = stego.VersionChecksum
+	StegoVersion           = stego.Version
+)
+
+// StegoHeaderSize is the encoded size of a current stego header.
+const StegoHeaderSize = stego.HeaderSize
+
+var (
+	// ErrPayloadTooLarge is returned when a payload does not fit in the
+	// cover image.
+	ErrPayloadTooLarge = stego.ErrPayloadTooLarge
+	// ErrLossyFormat is returned when a stego image would be saved in a
+	// lossy format that destroys the embedded bits.
+	ErrLossyFormat = errors.New("lossy output format would destroy the hidden payload")
+	// Err16BitCover is returned when a cover has 16 bits per channel, which
+	// hiding would reduce to 8.
+	Err16BitCover = stego.Err16BitCover
+	// ErrNoPayload is returned when an image carries no payload that can be
+	// found with the given options.
+	ErrNoPayload = stego.ErrNoPayload
+)
+
+// StegoChannels is a set of color channels of a pixel.
+type StegoChannels = stego.Channels
+
+// Color channels, combined into a StegoChannels mask.
+const (
+	ChannelR     = stego.ChannelR
+	ChannelG     = stego.ChannelG
+	ChannelB     = stego.ChannelB
+	ChannelA     = stego.ChannelA
+	ChannelsRGB  = stego.ChannelsRGB
+	ChannelsRGBA = stego.ChannelsRGBA
+)
+
+// ParseStegoChannels parses a set of channels written as letters, such as
+// "rgb" or "ga", in any order and case.
+func ParseStegoChannels(s string) (StegoChannels, error) {
+	return stego.ParseChannels(s)
+}
+
+// StegoOptions controls which pixels and bits carry a stego payload and
+// how the payload is protected.
+type StegoOptions struct {
+	Density  int           // Low bits used per channel (1-4)
+	Channels StegoChannels // Channels carrying payload bits; ChannelsRGB when zero
+	Key      []byte        // AES-256 key used to encrypt the payload
+	Password string        // Password used to derive the payload key (takes precedence over Key)
+
+	// Scatter spreads the payload over pixels in an order derived from the
+	// key or password instead of filling them from the top-left.
+	Scatter bool
+
+	// SkipTransparent leaves fully transparent pixels out of the embedding,
+	// so optimizers that zero the color of invisible pixels do not destroy
+	// the payload. It only has an effect on covers with transparent pixels,
+	// and there also keeps the payload out of the alpha channel.
+	SkipTransparent bool
+
+	// Adaptive embeds the body into the most textured pixels first and
+	// leaves flat areas, where changes stand out to steganalysis,
+	// untouched. The capacity then depends on the image content.
+	Adaptive bool
+
+	// Regions restricts embedding to the pixels inside these rectangles,
+	// and ExcludeRegions keeps it out of the pixels inside those. Both are
+	// in pixels from the top-left corner of the image, and are recorded in
+	// the payload header so reveal walks the same pixels unprompted.
+	Regions        []image.Rectangle
+	ExcludeRegions []image.Rectangle
+
+	// Method selects how bits are embedded: StegoMethodLSB (the default
+	// when empty) or StegoMethodDCT.
+	Method string
+
+	// Compress deflates the payload before encrypting and embedding it,
+	// unless that would barely make it smaller.
+	Compress bool
+
+	// MaxFill caps the share of the capacity a payload may use, between 0
+	// and 1; 0 means no cap. Altering fewer pixels makes the payload
+	// harder to detect.
+	MaxFill float64
+
+	// Legacy reads images without a payload header as version 1 payloads,
+	// the null-terminated layout written before the header existed. Any
+	// image yields some bytes that way, so without it such images get
+	// ErrNoPayload.
+	Legacy bool
+
+	// IgnoreChecksum returns the raw body of a payload that fails its
+	// checksum instead of an error, for forensic inspection.
+	IgnoreChecksum bool
+
+	// AllowLossy permits saving the stego image in a lossy format, which
+	// almost certainly destroys the payload.
+	AllowLossy bool
+
+	// JPEGQuality is the quality (1-100) of a JPEG stego image, and of a
+	// cover re-encoded as a JPEG for StegoMethodDCT; DefaultJPEGQuality
+	// when zero.
+	JPEGQuality int
+
+	// Workers is the number of goroutines the bits of a large image are
+	// embedded and extracted on; runtime.NumCPU() when 0. The stego image
+	// is the same for any number.
+	Workers int
+}
+
+// DefaultStegoOptions matches the layout written by HideMessage.
+var DefaultStegoOptions = StegoOptions{Density: 1, SkipTransparent: true}
+
+// Validate reports whether o describes a supported layout.
+func (o StegoOptions) Validate() error {
+	if err := stego.Validate(o.engine()...); err != nil {
+		return err
+	}
+	switch o.Method {
+	case "", StegoMethodLSB, StegoMethodDCT, StegoMethodEXIF, StegoMethodPalette:
+	default:
+		return fmt.Errorf("invalid stego method %q: must be %s, %s, %s or %s", o.Method, StegoMethodLSB, StegoMethodDCT, StegoMethodEXIF, StegoMethodPalette)
+	}
+	if o.Scatter && (o.Method == StegoMethodDCT || o.Method == StegoMethodEXIF || o.Method == StegoMethodPalette) {
+		return fmt.Errorf("scatter is not supported with the %s method", o.Method)
+	}
+	if o.Adaptive && (o.Method == StegoMethodDCT || o.Method == StegoMethodEXIF || o.Method == StegoMethodPalette) {
+		return fmt.Errorf("adaptive embedding is not supported with the %s method", o.Method)
+	}
+	if o.hasRegions() && o.Method != "" && o.Method != StegoMethodLSB {
+		return fmt.Errorf("regions are not supported with the %s method", o.Method)
+	}
+	if o.JPEGQuality != 0 {
+		if err := CheckJPEGQuality(o.JPEGQuality); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// engine returns the stego package options matching o.
+func (o StegoOptions) engine() []stego.Option {
+	return []stego.Option{
+		stego.WithDensity(o.Density),
+		stego.WithChannels(o.Channels),
+		stego.WithKey(o.Key),
+		stego.WithPassword(o.Password),
+		stego.WithScatter(o.Scatter),
+		stego.WithSkipTransparent(o.SkipTransparent),
+		stego.WithAdaptive(o.Adaptive),
+		stego.WithRegions(o.Regions...),
+		stego.WithExcludeRegions(o.ExcludeRegions...),
+		stego.WithCompression(o.Compress),
+		stego.WithMaxFill(o.MaxFill),
+		stego.WithLegacy(o.Legacy),
+		stego.WithIgnoreChecksum(o.IgnoreChecksum),
+		stego.WithWorkers(o.Workers),
+	}
+}
+
+// hasRegions reports whether o constrains embedding to regions.
+func (o StegoOptions) hasRegions() bool {
+	return len(o.Regions) > 0 || len(o.ExcludeRegions) > 0
+}
+
+// channels returns the channels that carry payload bits.
+func (o StegoOptions) channels() StegoChannels {
+	if o.Channels == 0 {
+		return ChannelsRGB
+	}
+	return o.Channels
+}
+
+// saveOptions returns the options SaveImage writes a stego image in
+// outputFormat with.
+func (o StegoOptions) saveOptions(outputFormat string) SaveOptions {
+	return SaveOptions{Format: outputFormat, Quality: o.JPEGQuality}
+}
+
+// StegoCapacity returns the largest payload, in bytes, that fits in img
+// with opts once the payload header has been accounted for. It returns 0
+// when the image cannot even hold the header or opts are invalid.
+func StegoCapacity(img image.Image, opts StegoOptions) int {
+	capacity, _ := stego.Capacity(img, opts.engine()...)
+	return capacity
+}
+
+// StegoFileCapacity returns the largest payload, in bytes, that fits in the
+// image at filename using the method selected by opts. GIFs report the
+// capacity of the palette indices of all their frames, as used when they
+// are kept as GIFs.
+func StegoFileCapacity(filename string, opts StegoOptions) (int, error) {
+	if opts.Method == StegoMethodDCT {
+		jc, err := loadJPEGCover(filename, opts.saveOptions("jpeg").JPEGQuality())
+		if err != nil {
+			return 0, err
+		}
+		return dctCapacity(jc), nil
+	}
+	if opts.Method == StegoMethodEXIF {
+		return metadataFileCapacity(filename)
+	}
+	if opts.Method == StegoMethodPalette {
+		return paletteFileCapacity(filename)
+	}
+	if capacity, ok, err := gifFileCapacity(filename); ok || err != nil {
+		return capacity, err
+	}
+
+	img, err := LoadImage(filename)
+	if err != nil {
+		return 0, err
+	}
+	return stego.Capacity(img, opts.engine()...)
+}
+
+// loadStegoCover loads the cover at filename, refusing 16-bit images whose
+// precision hiding would reduce.
+func loadStegoCover(filename string) (image.Image, error) {
+	img, err := LoadImage(filename)
+	if err != nil {
+		return nil, err
+	}
+	return img, checkStegoCoverDepth(img)
+}
+
+// checkStegoCoverDepth refuses a cover of 16 bits per channel, which
+// hiding would reduce to 8.
+func checkStegoCoverDepth(img image.Image) error {
+	if is16Bit(img) {
+		return fmt.Errorf("%w: hiding would reduce the image to 8 bits per channel; convert it to 8 bits first", Err16BitCover)
+	}
+	return nil
+}
+
+// toNRGBA copies img into a new NRGBA image anchored at the origin. Stego
+// works on non-premultiplied values, as PNG stores them: premultiplying
+// would shift the colors of semi-transparent pixels and, at low alpha,
+// collapse the bits hidden in them.
+func toNRGBA(img image.Image) *image.NRGBA {
+	b := img.Bounds()
+	nrgbaImg := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(nrgbaImg, nrgbaImg.Bounds(), img, b.Min, draw.Src)
+	return nrgbaImg
+}
+
+// asNRGBA returns img itself when it is already an *image.NRGBA, avoiding the
+// copy made by toNRGBA when the image is only read.
+func asNRGBA(img image.Image) *image.NRGBA {
+	if nrgbaImg, ok := img.(*image.NRGBA); ok {
+		return nrgbaImg
+	}
+	return toNRGBA(img)
+}
+
+// HideMessage hides a message within an image using LSB steganography.
+func HideMessage(inputFilename, outputFilename, message string, outputFormat string) error {
+	return HidePayload(inputFilename, outputFilename, Payload{Data: []byte(message)}, DefaultStegoOptions, outputFormat)
+}
+
+// ReadPayloadFile reads a file to be hidden, keeping its name.
+func ReadPayloadFile(payloadFilename string) (Payload, error) {
+	data, err := os.ReadFile(payloadFilename)
+	if err != nil {
+		return Payload{}, fmt.Errorf("failed to read payload file: %w", err)
+	}
+	return Payload{Data: data, Filename: payloadFilename}, nil
+}
+
+// ReadMessage reads a message to be hidden from r, byte for byte: line
+// endings, trailing newlines and binary content are kept as they are.
+func ReadMessage(r io.Reader) (Payload, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return Payload{}, fmt.Errorf("failed to read message: %w", err)
+	}
+	return Payload{Data: data}, nil
+}
+
+// ReadMessageFile reads a message to be hidden from filename, or from
+// standard input when filename is "-". Unlike ReadPayloadFile it does not
+// keep the name, so reveal shows the payload as a message.
+func ReadMessageFile(filename string) (Payload, error) {
+	if filename == "-" {
+		return ReadMessage(os.Stdin)
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		return Payload{}, fmt.Errorf("failed to read message file: %w", err)
+	}
+	defer f.Close()
+	return ReadMessage(f)
+}
+
+// HidePayload hides p within the image at inputFilename and saves the
+// result to outputFilename. With the gif output format the cover must be a
+// GIF, and the payload is spread over all of its frames.
+func HidePayload(inputFilename, outputFilename string, p Payload, opts StegoOptions, outputFormat string) error {
+	if err := opts.Validate(); err != nil {
+		return err
+	}
+	if opts.Method == StegoMethodDCT {
+		// DCT payloads survive JPEG encoding, so the output is always a JPEG.
+		return hideDCT(inputFilename, outputFilename, p, opts)
+	}
+	if opts.Method == StegoMethodEXIF {
+		// Metadata leaves the file as it is, so the cover format is kept.
+		return hideMetadata(inputFilename, outputFilename, p, opts)
+	}
+	if opts.Method == StegoMethodPalette {
+		// Swapping palette indices keeps the cover indexed and in its format.
+		return hidePalette(inputFilename, outputFilename, p, opts)
+	}
+	if strings.EqualFold(outputFormat, "gif") {
+		// Spread over the frames of a GIF cover, keeping its animation.
+		return hideGIF(inputFilename, outputFilename, p, opts)
+	}
+	if err := checkStegoOutputFormat(outputFormat, opts); err != nil {
+		return err
+	}
+
+	img, err := loadStegoCover(inputFilename)
+	if err != nil {
+		return err
+	}
+	if err := checkStegoCoverAlpha(img, outputFormat); err != nil {
+		return err
+	}
+	// Grayscale covers come back grayscale, with the payload in their gray values
+	stegoImg, err := stego.EmbedPayload(img, p, opts.engine()...)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(outputFilename), os.ModeDir|0755) // Ensure output directory exists
+	if err != nil {
+		return fmt.Errorf("failed to create output directory: %w", err)
+	}
+
+	err = SaveImage(outputFilename, stegoImg, opts.saveOptions(outputFormat)) // Save using the specified output format
+	if err != nil {
+		return fmt.Errorf("failed to encode stego image: %w", err)
+	}
+	return nil
+}
+
+// HidePayloadTo is HidePayload for the cover image file read from r,
+// writing the stego image to w in outputFormat. The cover is held in
+// memory whole, and nothing touches the filesystem. Only the LSB method is
+// supported, and not GIF output, as the others rework the cover file
+// rather than its pixels.
+func HidePayloadTo(w io.Writer, r io.Reader, p Payload, opts StegoOptions, outputFormat string) error {
+	if err := opts.Validate(); err != nil {
+		return err
+	}
+	if opts.Method != "" && opts.Method != StegoMethodLSB {
+		return fmt.Errorf("the %s method needs a cover file; use HidePayload", opts.Method)
+	}
+	if format, _ := SplitImageFormat(outputFormat); format == "gif" {
+		return fmt.Errorf("hiding in a GIF needs a cover file; use HidePayload")
+	}
+	if err := checkStegoOutputFormat(outputFormat, opts); err != nil {
+		return err
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("failed to read image: %w", err)
+	}
+	img, err := BytesToImage(data)
+	if errors.Is(err, image.ErrFormat) {
+		err = ErrUnsupportedFormat
+	}
+	if err != nil {
+		return err
+	}
+	if err := checkStegoCoverDepth(img); err != nil {
+		return err
+	}
+	if err := checkStegoCoverAlpha(img, outputFormat); err != nil {
+		return err
+	}
+	stegoImg, err := stego.EmbedPayload(img, p, opts.engine()...)
+	if err != nil {
+		return err
+	}
+	if err := EncodeImage(w, stegoImg, opts.saveOptions(outputFormat)); err != nil {
+		return fmt.Errorf("failed to encode stego image: %w", err)
+	}
+	return nil
+}
+
+// checkStegoOutputFormat refuses lossy output formats for LSB stego images
+// unless opts allows them, and formats without alpha when the alpha channel
+// carries payload bits.
+func checkStegoOutputFormat(outputFormat string, opts StegoOptions) error {
+	if IsLossyFormat(outputFormat) && !opts.AllowLossy {
+		return fmt.Errorf("%w: %s compression discards the low bits that carry the payload; use a lossless format such as png", ErrLossyFormat, outputFormat)
+	}
+	if format, _ := SplitImageFormat(outputFormat); format == "bmp" && opts.channels()&ChannelA != 0 {
+		return fmt.Errorf("BMP files do not keep the alpha channel, so it cannot carry payload bits; hide in the RGB channels or use a format such as png")
+	}
+	return nil
+}
+
+// checkStegoCoverAlpha refuses a cover with transparent pixels when
+// outputFormat would drop its alpha channel, since the payload layout
+// depends on which pixels are transparent.
+func checkStegoCoverAlpha(img image.Image, outputFormat string) error {
+	if format, _ := SplitImageFormat(outputFormat); format == "bmp" && !asNRGBA(img).Opaque() {
+		return fmt.Errorf("BMP files do not keep transparency, which the cover has; use a format such as png")
+	}
+	return nil
+}
+
+// RevealMessage reveals a hidden message from an image.
+func RevealMessage(inputFilename string) (string, error) {
+	p, err := RevealPayload(inputFilename, DefaultStegoOptions)
+	if err != nil {
+		return "", err
+	}
+	return string(p.Data), nil
+}
+
+// RevealPayload extracts the payload hidden in an image, decrypting it with
+// the key or password in opts when needed. Payloads stored in metadata,
+// baseline JPEGs carrying a DCT payload, and GIFs and indexed PNGs carrying
+// one in their palette indices are detected automatically; everything else is read with the LSB
+// method.
+func RevealPayload(inputFilename string, opts StegoOptions) (Payload, error) {
+	p, err := revealFile(inputFilename, opts)
+	return assembleSingle(p, err, opts)
+}
+
+// RevealPayloadFrom is RevealPayload for the image file read from r, which
+// it holds in memory whole. Nothing touches the filesystem.
+func RevealPayloadFrom(r io.Reader, opts StegoOptions) (Payload, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return Payload{}, fmt.Errorf("failed to read image: %w", err)
+	}
+	p, err := revealData(data, opts)
+	return assembleSingle(p, err, opts)
+}
+
+// assembleSingle returns the payload p revealed from a single image: a
+// payload that fitted in a single cover of a split is complete.
+func assembleSingle(p Payload, err error, opts StegoOptions) (Payload, error) {
+	if _, _, ok := p.Fragment(); err != nil || !ok {
+		return p, err
+	}
+	return stego.Assemble([]Payload{p}, opts.engine()...)
+}
+
+// revealFile reads the metadata, DCT, palette or LSB payload, or the
+// fragment of a split payload, hidden in an image file.
+func revealFile(inputFilename string, opts StegoOptions) (Payload, error) {
+	data, err := os.ReadFile(inputFilename)
+	if err != nil {
+		return Payload{}, openError(inputFilename, err)
+	}
+	p, err := revealData(data, opts)
+	if errors.Is(err, ErrImageTooLarge) || errors.Is(err, ErrUnsupportedFormat) {
+		err = pathError("decode", inputFilename, err)
+	}
+	return p, err
+}
+
+// revealData is revealFile for the image file read into data.
+func revealData(data []byte, opts StegoOptions) (Payload, error) {
+	if p, ok, err := revealMetadata(data, opts); ok || err != nil {
+		return p, err
+	}
+	if p, ok, err := revealDCT(data, opts); ok || err != nil {
+		return p, err
+	}
+	// Both the palette and the LSB methods decode every pixel
+	if err := checkImageHeader(bytes.NewReader(data), 0); err != nil {
+		return Payload{}, err
+	}
+	if p, ok, err := revealPalette(data, opts); ok || err != nil {
+		return p, err
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if errors.Is(err, image.ErrFormat) {
+		err = ErrUnsupportedFormat
+	}
+	if err != nil {
+		return Payload{}, err
+	}
+	return stego.ExtractPayload(img, opts.engine()...)
+}
+
+// revealImageFile reads the LSB payload or fragment hidden in an image file.
+func revealImageFile(inputFilename string, opts StegoOptions) (Payload, error) {
+	img, err := LoadImage(inputFilename)
+	if err != nil {
+		return Payload{}, err
+	}
+	return stego.ExtractPayload(img, opts.engine()...)
+}
+
+// WritePayload saves the data of a revealed payload to outputPath. When
+// outputPath is an existing directory and p carries a file, the embedded
+// filename is used inside it.
+func WritePayload(p Payload, outputPath string) (string, error) {
+	if info, err := os.Stat(outputPath); err == nil && info.IsDir() {
+		name := filepath.Base(p.Filename)
+		if !p.IsFile() || name == "." || name == ".." || name == string(filepath.Separator) {
+			return "", fmt.Errorf("%s is a directory and the payload has no filename", outputPath)
+		}
+		outputPath = filepath.Join(outputPath, name)
+	}
+
+	if err := os.WriteFile(outputPath, p.Data, 0644); err != nil {
+		return "", fmt.Errorf("failed to write payload: %w", err)
+	}
+	return outputPath, nil
+}
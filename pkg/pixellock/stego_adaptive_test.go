@@ -0,0 +1,27 @@
+package pixellock
+
+import (
+	"crypto/rand"
+	"testing"
+)
+
+func TestAdaptiveHarderToDetect(t *testing.T) {
+	for _, density := range []int{1, 2} {
+		sequential := StegoOptions{Density: density}
+		adaptive := StegoOptions{Density: density, Adaptive: true}
+		data := make([]byte, StegoCapacity(photoNRGBA(t), adaptive)/3)
+		rand.Read(data)
+
+		scores := map[bool]float64{}
+		for _, opts := range []StegoOptions{sequential, adaptive} {
+			cover := photoNRGBA(t)
+			if err := hideInImage(cover, Payload{Data: data}, opts); err != nil {
+				t.Fatalf("density %d: hideInImage failed: %v", density, err)
+			}
+			scores[opts.Adaptive] = AnalyzeStego(cover).Score
+		}
+		if scores[true] >= scores[false] {
+			t.Errorf("density %d: adaptive score %.3f, sequential %.3f; want adaptive lower", density, scores[true], scores[false])
+		}
+	}
+}
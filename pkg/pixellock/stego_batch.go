@@ -0,0 +1,181 @@
+package pixellock
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// StegoBatchOptions selects the images processed by a stego batch and how
+// many are processed at once.
+type StegoBatchOptions struct {
+	Recursive bool     // Descend into subdirectories
+	Include   []string // Only process files whose name matches one of these globs
+	Exclude   []string // Skip files whose name matches one of these globs
+	Workers   int      // Images processed concurrently; runtime.NumCPU() when 0
+}
+
+// StegoBatchResult is the outcome of a stego batch for one image.
+type StegoBatchResult struct {
+	Input    string
+	Output   string        // Image written by HideDirectory or WipeDirectory
+	Payload  Payload       // Payload found by RevealFiles
+	Analysis StegoAnalysis // Steganalysis by AnalyzeStegoFiles, or before WipeDirectory
+	Note     string        // Warning about an image processed anyway, from ConvertDirectory or ScrubDirectory
+	Removed  []string      // Metadata removed by ScrubDirectory
+	Err      error
+}
+
+// matches reports whether name passes the include and exclude filters.
+func (o StegoBatchOptions) matches(name string) (bool, error) {
+	for _, pattern := range o.Exclude {
+		if ok, err := filepath.Match(pattern, name); err != nil || ok {
+			return false, err
+		}
+	}
+	if len(o.Include) == 0 {
+		return true, nil
+	}
+	for _, pattern := range o.Include {
+		if ok, err := filepath.Match(pattern, name); err != nil || ok {
+			return ok, err
+		}
+	}
+	return false, nil
+}
+
+// StegoBatchFiles returns the images under dir selected by opts, in walk
+// order.
+func StegoBatchFiles(dir string, opts StegoBatchOptions) ([]string, error) {
+	var files []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if path != dir && !opts.Recursive {
+				return filepath.SkipDir // Skip subdirectories if not recursive
+			}
+			return nil
+		}
+
+		ok, err := opts.matches(info.Name())
+		if err != nil {
+			return fmt.Errorf("invalid filter pattern: %w", err)
+		}
+		if ok && isImageFile(path) {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error walking the path %s: %w", dir, err)
+	}
+	return files, nil
+}
+
+// runStegoBatch calls fn for each input on a pool of workers and returns the
+// results in input order. A panic in fn fails its input with a *PanicError.
+func runStegoBatch(inputs []string, workers int, fn func(input string) StegoBatchResult) []StegoBatchResult {
+	results := make([]StegoBatchResult, len(inputs))
+	runParallel(len(inputs), workers, func(i int) {
+		defer recoverPanic(&results[i].Err)
+		results[i] = StegoBatchResult{Input: inputs[i]}
+		results[i] = fn(inputs[i])
+	})
+	return results
+}
+
+// workerCount returns the number of workers a pool of workers has:
+// runtime.NumCPU() when workers is 0.
+func workerCount(workers int) int {
+	if workers <= 0 {
+		return runtime.NumCPU()
+	}
+	return workers
+}
+
+// runParallel calls fn with each of 0 to n-1 on a pool of workers;
+// runtime.NumCPU() of them when workers is 0.
+func runParallel(n, workers int, fn func(i int)) {
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < min(workerCount(workers), n); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				fn(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+}
+
+// HideDirectory hides p in every image under inputDir selected by batch,
+// writing each stego image to the same relative path under outputDir with
+// the extension of the output format, or its own with StegoMethodEXIF and
+// StegoMethodPalette. A failure on one image, such as a cover too small for
+// the payload, is recorded in its result and does not stop the batch.
+func HideDirectory(inputDir, outputDir string, p Payload, opts StegoOptions, outputFormat string, batch StegoBatchOptions) ([]StegoBatchResult, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	if opts.Method != StegoMethodDCT && opts.Method != StegoMethodEXIF && opts.Method != StegoMethodPalette {
+		if err := checkStegoOutputFormat(outputFormat, opts); err != nil {
+			return nil, err
+		}
+	}
+	files, err := StegoBatchFiles(inputDir, batch)
+	if err != nil {
+		return nil, err
+	}
+
+	ext := "." + ImageFormatExtension(outputFormat)
+	if opts.Method == StegoMethodDCT {
+		ext = ".jpg"
+	}
+	return runStegoBatch(files, batch.Workers, func(input string) StegoBatchResult {
+		result := StegoBatchResult{Input: input}
+		relPath, err := filepath.Rel(inputDir, input)
+		if err != nil {
+			result.Err = fmt.Errorf("failed to get relative path: %w", err)
+			return result
+		}
+		output := filepath.Join(outputDir, strings.TrimSuffix(relPath, filepath.Ext(relPath))+ext)
+		if opts.Method == StegoMethodEXIF || opts.Method == StegoMethodPalette {
+			output = filepath.Join(outputDir, relPath) // The cover format is kept
+		}
+		if result.Err = HidePayload(input, output, p, opts, outputFormat); result.Err == nil {
+			result.Output = output
+		}
+		return result
+	}), nil
+}
+
+// RevealFiles reveals the payload of each input. Images without a payload
+// header get ErrNoPayload unless opts.Legacy is set; fragments of a split
+// payload are returned as they are, see Payload.Fragment.
+func RevealFiles(inputs []string, opts StegoOptions, workers int) []StegoBatchResult {
+	return runStegoBatch(inputs, workers, func(input string) StegoBatchResult {
+		p, err := revealFile(input, opts)
+		return StegoBatchResult{Input: input, Payload: p, Err: err}
+	})
+}
+
+// RevealDirectory reveals the payload of every image under dir selected by
+// batch, as RevealFiles does.
+func RevealDirectory(dir string, opts StegoOptions, batch StegoBatchOptions) ([]StegoBatchResult, error) {
+	files, err := StegoBatchFiles(dir, batch)
+	if err != nil {
+		return nil, err
+	}
+	return RevealFiles(files, opts, batch.Workers), nil
+}
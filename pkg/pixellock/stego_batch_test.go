@@ -0,0 +1,110 @@
+package pixellock
+
+import (
+	"errors"
+	"image"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// batchFixture builds a small tree of JPEG covers:
+//
+//	a.jpg, skip.jpg, tiny.jpg (too small), notes.txt, sub/b.jpg
+func batchFixture(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0755); err != nil {
+		t.Fatalf("Mkdir failed: %v", err)
+	}
+	photo := photoCover(t, 85)
+	for _, name := range []string{"a.jpg", "skip.jpg", filepath.Join("sub", "b.jpg")} {
+		if err := os.WriteFile(filepath.Join(dir, name), photo, 0644); err != nil {
+			t.Fatalf("WriteFile failed: %v", err)
+		}
+	}
+
+	tiny, err := os.Create(filepath.Join(dir, "tiny.jpg"))
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	defer tiny.Close()
+	if err := jpeg.Encode(tiny, image.NewGray(image.Rect(0, 0, 8, 8)), nil); err != nil {
+		t.Fatalf("jpeg.Encode failed: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("not an image"), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	return dir
+}
+
+func TestStegoBatchFiles(t *testing.T) {
+	dir := batchFixture(t)
+	tests := []struct {
+		opts StegoBatchOptions
+		want []string
+	}{
+		{StegoBatchOptions{}, []string{"a.jpg", "skip.jpg", "tiny.jpg"}},
+		{StegoBatchOptions{Recursive: true, Exclude: []string{"skip*"}}, []string{"a.jpg", filepath.Join("sub", "b.jpg"), "tiny.jpg"}},
+		{StegoBatchOptions{Recursive: true, Include: []string{"b.*", "tiny.*"}}, []string{filepath.Join("sub", "b.jpg"), "tiny.jpg"}},
+	}
+	for _, tt := range tests {
+		files, err := StegoBatchFiles(dir, tt.opts)
+		if err != nil {
+			t.Fatalf("StegoBatchFiles(%+v) failed: %v", tt.opts, err)
+		}
+		if len(files) != len(tt.want) {
+			t.Fatalf("StegoBatchFiles(%+v) = %v, want %v", tt.opts, files, tt.want)
+		}
+		for i, f := range files {
+			if f != filepath.Join(dir, tt.want[i]) {
+				t.Errorf("StegoBatchFiles(%+v)[%d] = %s, want %s", tt.opts, i, f, tt.want[i])
+			}
+		}
+	}
+}
+
+func TestStegoBatchHideReveal(t *testing.T) {
+	dir := batchFixture(t)
+	outputDir := filepath.Join(t.TempDir(), "out")
+	opts := StegoOptions{Density: 1, Method: StegoMethodDCT}
+	batch := StegoBatchOptions{Recursive: true, Exclude: []string{"skip*"}, Workers: 2}
+
+	results, err := HideDirectory(dir, outputDir, Payload{Data: []byte("(c) Example Shop")}, opts, "png", batch)
+	if err != nil {
+		t.Fatalf("HideDirectory failed: %v", err)
+	}
+	if len(results) != 3 {
+		t.Fatalf("HideDirectory returned %d results, want 3", len(results))
+	}
+	for _, r := range results[:2] {
+		if r.Err != nil || r.Output == "" {
+			t.Errorf("%s: Output = %q, Err = %v; want a stego image", r.Input, r.Output, r.Err)
+		}
+	}
+	if tiny := results[2]; !errors.Is(tiny.Err, ErrPayloadTooLarge) || tiny.Output != "" {
+		t.Errorf("%s: Err = %v, want ErrPayloadTooLarge", tiny.Input, tiny.Err)
+	}
+	if _, err := os.Stat(filepath.Join(outputDir, "sub", "b.jpg")); err != nil {
+		t.Errorf("nested stego image not written under the output directory: %v", err)
+	}
+
+	revealed, err := RevealDirectory(outputDir, DefaultStegoOptions, batch)
+	if err != nil {
+		t.Fatalf("RevealDirectory failed: %v", err)
+	}
+	if len(revealed) != 2 {
+		t.Fatalf("RevealDirectory returned %d results, want 2", len(revealed))
+	}
+	for _, r := range revealed {
+		if r.Err != nil || string(r.Payload.Data) != "(c) Example Shop" {
+			t.Errorf("%s: revealed %q, %v", r.Input, r.Payload.Data, r.Err)
+		}
+	}
+
+	clean := RevealFiles([]string{filepath.Join(dir, "tiny.jpg")}, DefaultStegoOptions, 1)
+	if !errors.Is(clean[0].Err, ErrNoPayload) {
+		t.Errorf("clean image Err = %v, want ErrNoPayload", clean[0].Err)
+	}
+}
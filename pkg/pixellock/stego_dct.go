@@ -0,0 +1,195 @@
+package pixellock
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/Amul-Thantharate/pixellock/pkg/stego"
+)
+
+// Stego embedding methods.
+const (
+	// StegoMethodLSB hides payload bits in the low bits of pixel channels
+	// and needs a lossless output format.
+	StegoMethodLSB = "lsb"
+	// StegoMethodDCT hides payload bits in the quantized DCT coefficients of
+	// a JPEG, so the stego image stays a JPEG.
+	StegoMethodDCT = "dct"
+	// StegoMethodEXIF stores the payload in the metadata of a JPEG or PNG,
+	// leaving its pixels untouched.
+	StegoMethodEXIF = "exif"
+	// StegoMethodPalette hides payload bits in the palette indices of a GIF
+	// or indexed PNG, which stays indexed with the same palette.
+	StegoMethodPalette = "palette"
+)
+
+// dctUsable reports whether a coefficient can carry a payload bit. As in
+// JSteg, DC terms and AC values 0 and 1 are skipped: changing their low bit
+// would create or remove zeros, which the extractor could not tell apart
+// from unused coefficients. Every other value keeps its usability when its
+// low bit changes (2 and 3 swap, as do -1 and -2). Values below -1022 are
+// skipped too, since -1023 would become -1024, outside the baseline range.
+func dctUsable(k int, v int32) bool {
+	return k > 0 && v != 0 && v != 1 && v > -1023
+}
+
+// dctCoefficients calls fn with each usable coefficient of jc in embedding
+// order: components in frame order, coded blocks in raster order, then AC
+// coefficients in zigzag order. It stops when fn returns false.
+func dctCoefficients(jc *jpegCoefficients, fn func(v *int32) bool) {
+	for _, c := range jc.comps {
+		for by := 0; by < c.codedY; by++ {
+			for bx := 0; bx < c.codedX; bx++ {
+				block := c.block(bx, by)
+				for k := 1; k < 64; k++ {
+					if dctUsable(k, block[k]) && !fn(&block[k]) {
+						return
+					}
+				}
+			}
+		}
+	}
+}
+
+// dctRawCapacity returns how many whole bytes, header included, fit in the
+// usable coefficients of jc.
+func dctRawCapacity(jc *jpegCoefficients) int {
+	n := 0
+	dctCoefficients(jc, func(*int32) bool { n++; return true })
+	return n / 8
+}
+
+// dctCapacity is the DCT counterpart of StegoCapacity.
+func dctCapacity(jc *jpegCoefficients) int {
+	raw := dctRawCapacity(jc)
+	if raw < StegoHeaderSize {
+		return 0
+	}
+	return raw - StegoHeaderSize
+}
+
+// embedDCT writes data MSB-first into the low bit of the usable
+// coefficients of jc and returns the number of bytes written.
+func embedDCT(jc *jpegCoefficients, data []byte) int {
+	bit := 0
+	dctCoefficients(jc, func(v *int32) bool {
+		if bit == len(data)*8 {
+			return false
+		}
+		b := int32(data[bit/8]>>(7-bit%8)) & 1
+		*v = *v&^1 | b
+		bit++
+		return true
+	})
+	return bit / 8
+}
+
+// extractDCT reads n bytes starting at byte offset off, reversing embedDCT.
+// Fewer bytes are returned if the coefficients run out first.
+func extractDCT(jc *jpegCoefficients, off, n int) []byte {
+	out := make([]byte, 0, n)
+	var by byte
+	bit := 0
+	dctCoefficients(jc, func(v *int32) bool {
+		if bit >= off*8 {
+			by = by<<1 | byte(*v&1)
+			if (bit+1)%8 == 0 {
+				out = append(out, by)
+				if len(out) == n {
+					return false
+				}
+			}
+		}
+		bit++
+		return true
+	})
+	return out
+}
+
+// hideInJPEG embeds p into the coefficients of jc behind the same stego
+// header used for pixels.
+func hideInJPEG(jc *jpegCoefficients, p Payload, opts StegoOptions) error {
+	framed, err := stego.Frame(p, dctRawCapacity(jc), opts.engine()...)
+	if err != nil {
+		return err
+	}
+	embedDCT(jc, framed)
+	return nil
+}
+
+// dctPayloadVersion returns the format version of the stego header jc
+// starts with, and whether it starts with one.
+func dctPayloadVersion(jc *jpegCoefficients) (int, bool) {
+	return stego.FrameVersion(extractDCT(jc, 0, stego.FramePrefixSize))
+}
+
+// hasDCTPayload reports whether jc starts with a pixellock stego header.
+func hasDCTPayload(jc *jpegCoefficients) bool {
+	_, ok := dctPayloadVersion(jc)
+	return ok
+}
+
+// revealFromJPEG extracts a payload hidden by hideInJPEG.
+func revealFromJPEG(jc *jpegCoefficients, opts StegoOptions) (Payload, error) {
+	if !hasDCTPayload(jc) {
+		return Payload{}, fmt.Errorf("no DCT stego payload found")
+	}
+	read := func(off, n int) []byte { return extractDCT(jc, off, n) }
+	return stego.ReadFrame(read, dctRawCapacity(jc), opts.engine()...)
+}
+
+// loadJPEGCover returns the coefficients of the image at filename. Baseline
+// JPEGs are used as they are; anything else, including progressive JPEGs,
+// is decoded and re-encoded as a baseline JPEG of the given quality first.
+func loadJPEGCover(filename string, quality int) (*jpegCoefficients, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open image: %w", err)
+	}
+	if jc, err := readJPEGCoefficients(data); err == nil {
+		return jc, nil
+	}
+
+	img, err := LoadImage(filename)
+	if err != nil {
+		return nil, err
+	}
+	return jpegCoefficientsFromImage(img, quality)
+}
+
+// hideDCT implements HidePayload for StegoMethodDCT.
+func hideDCT(inputFilename, outputFilename string, p Payload, opts StegoOptions) error {
+	jc, err := loadJPEGCover(inputFilename, opts.saveOptions("jpeg").JPEGQuality())
+	if err != nil {
+		return err
+	}
+	if err := hideInJPEG(jc, p, opts); err != nil {
+		return err
+	}
+	data, err := writeJPEGCoefficients(jc)
+	if err != nil {
+		return fmt.Errorf("failed to encode stego image: %w", err)
+	}
+
+	err = os.MkdirAll(filepath.Dir(outputFilename), os.ModeDir|0755) // Ensure output directory exists
+	if err != nil {
+		return fmt.Errorf("failed to create output directory: %w", err)
+	}
+	if err := os.WriteFile(outputFilename, data, 0644); err != nil {
+		return fmt.Errorf("failed to write stego image: %w", err)
+	}
+	return nil
+}
+
+// revealDCT returns the DCT payload hidden in the image file read into
+// data. ok is false when the file is not a baseline JPEG carrying a DCT payload,
+// in which case the caller should fall back to the LSB method.
+func revealDCT(data []byte, opts StegoOptions) (p Payload, ok bool, err error) {
+	jc, err := readJPEGCoefficients(data)
+	if err != nil || !hasDCTPayload(jc) {
+		return Payload{}, false, nil
+	}
+	p, err = revealFromJPEG(jc, opts)
+	return p, true, err
+}
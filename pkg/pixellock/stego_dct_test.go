@@ -0,0 +1,164 @@
+package pixellock
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// photoCover loads a crop of a sample photograph and encodes it as a
+// baseline JPEG at the given quality.
+func photoCover(t *testing.T, quality int) []byte {
+	t.Helper()
+	img, err := LoadImage(filepath.Join("..", "..", "images", "2.jpg"))
+	if err != nil {
+		t.Fatalf("failed to load sample photo: %v", err)
+	}
+	crop := toNRGBA(img).SubImage(image.Rect(400, 200, 1041, 681))
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, crop, &jpeg.Options{Quality: quality}); err != nil {
+		t.Fatalf("jpeg.Encode failed: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestJPEGCoefficientsRoundTrip(t *testing.T) {
+	gray := image.NewGray(image.Rect(0, 0, 37, 21))
+	for i := range gray.Pix {
+		gray.Pix[i] = byte(i * 5)
+	}
+	var grayJPEG bytes.Buffer
+	if err := jpeg.Encode(&grayJPEG, gray, nil); err != nil {
+		t.Fatalf("jpeg.Encode failed: %v", err)
+	}
+
+	for name, data := range map[string][]byte{"color": photoCover(t, 75), "gray": grayJPEG.Bytes()} {
+		jc, err := readJPEGCoefficients(data)
+		if err != nil {
+			t.Fatalf("%s: readJPEGCoefficients failed: %v", name, err)
+		}
+		out, err := writeJPEGCoefficients(jc)
+		if err != nil {
+			t.Fatalf("%s: writeJPEGCoefficients failed: %v", name, err)
+		}
+		again, err := readJPEGCoefficients(out)
+		if err != nil {
+			t.Fatalf("%s: re-reading written JPEG failed: %v", name, err)
+		}
+		for i, c := range jc.comps {
+			for by := 0; by < c.codedY; by++ {
+				for bx := 0; bx < c.codedX; bx++ {
+					if !slices.Equal(c.block(bx, by), again.comps[i].block(bx, by)) {
+						t.Fatalf("%s: coefficients of component %d block (%d,%d) changed", name, i, bx, by)
+					}
+				}
+			}
+		}
+
+		want, _ := jpeg.Decode(bytes.NewReader(data))
+		got, err := jpeg.Decode(bytes.NewReader(out))
+		if err != nil {
+			t.Fatalf("%s: image/jpeg cannot decode written JPEG: %v", name, err)
+		}
+		if got.Bounds() != want.Bounds() {
+			t.Errorf("%s: bounds = %v, want %v", name, got.Bounds(), want.Bounds())
+		}
+	}
+}
+
+func TestReadJPEGCoefficientsRejectsProgressive(t *testing.T) {
+	data, err := os.ReadFile(filepath.Join("..", "..", "images", "2.jpg"))
+	if err != nil {
+		t.Fatalf("failed to read sample photo: %v", err)
+	}
+	if _, err := readJPEGCoefficients(data); !errors.Is(err, ErrUnsupportedJPEG) {
+		t.Errorf("readJPEGCoefficients error = %v, want ErrUnsupportedJPEG", err)
+	}
+}
+
+func TestDCTStegoRoundTrip(t *testing.T) {
+	for _, quality := range []int{50, 90} {
+		jc, err := readJPEGCoefficients(photoCover(t, quality))
+		if err != nil {
+			t.Fatalf("q%d: readJPEGCoefficients failed: %v", quality, err)
+		}
+		capacity := dctCapacity(jc)
+		if capacity < len(binaryFixture()) {
+			t.Fatalf("q%d: capacity %d too small for test payload", quality, capacity)
+		}
+
+		p := Payload{Data: binaryFixture(), Filename: "notes.bin"}
+		if err := hideInJPEG(jc, p, StegoOptions{Density: 1, Password: "hunter2"}); err != nil {
+			t.Fatalf("q%d: hideInJPEG failed: %v", quality, err)
+		}
+		out, err := writeJPEGCoefficients(jc)
+		if err != nil {
+			t.Fatalf("q%d: writeJPEGCoefficients failed: %v", quality, err)
+		}
+		if _, err := jpeg.Decode(bytes.NewReader(out)); err != nil {
+			t.Fatalf("q%d: stego image is not a valid JPEG: %v", quality, err)
+		}
+
+		stego, err := readJPEGCoefficients(out)
+		if err != nil {
+			t.Fatalf("q%d: readJPEGCoefficients failed: %v", quality, err)
+		}
+		if got := dctCapacity(stego); got != capacity {
+			t.Errorf("q%d: capacity changed from %d to %d after embedding", quality, capacity, got)
+		}
+		got, err := revealFromJPEG(stego, StegoOptions{Density: 1, Password: "hunter2"})
+		if err != nil {
+			t.Fatalf("q%d: revealFromJPEG failed: %v", quality, err)
+		}
+		if got.Filename != p.Filename || !bytes.Equal(got.Data, p.Data) {
+			t.Errorf("q%d: payload did not round trip", quality)
+		}
+	}
+}
+
+func TestDCTStegoTooLarge(t *testing.T) {
+	jc, err := readJPEGCoefficients(photoCover(t, 50))
+	if err != nil {
+		t.Fatalf("readJPEGCoefficients failed: %v", err)
+	}
+	err = hideInJPEG(jc, Payload{Data: make([]byte, dctCapacity(jc)+1)}, DefaultStegoOptions)
+	if !errors.Is(err, ErrPayloadTooLarge) {
+		t.Errorf("hideInJPEG error = %v, want ErrPayloadTooLarge", err)
+	}
+}
+
+func TestHidePayloadDCT(t *testing.T) {
+	tempDir := t.TempDir()
+	cover := filepath.Join("..", "..", "images", "2.jpg") // Progressive, so re-encoded first
+	output := filepath.Join(tempDir, "stego.jpg")
+	opts := StegoOptions{Density: 1, Method: StegoMethodDCT}
+
+	capacity, err := StegoFileCapacity(cover, opts)
+	if err != nil {
+		t.Fatalf("StegoFileCapacity failed: %v", err)
+	}
+	if capacity == 0 {
+		t.Fatal("StegoFileCapacity reported no capacity for a photo")
+	}
+
+	if err := HidePayload(cover, output, Payload{Data: []byte("meet at dawn")}, opts, "png"); err != nil {
+		t.Fatalf("HidePayload failed: %v", err)
+	}
+	if format, err := DetectImageFormat(output); err != nil || format != "jpeg" {
+		t.Fatalf("DCT stego output format = %q, %v; want jpeg", format, err)
+	}
+
+	message, err := RevealMessage(output)
+	if err != nil {
+		t.Fatalf("RevealMessage failed: %v", err)
+	}
+	if message != "meet at dawn" {
+		t.Errorf("RevealMessage = %q, want %q", message, "meet at dawn")
+	}
+}
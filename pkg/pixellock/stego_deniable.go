@@ -0,0 +1,61 @@
+package pixellock
+
+import (
+	"fmt"
+	"image"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Amul-Thantharate/pixellock/pkg/stego"
+)
+
+// DeniableCapacity returns the largest payload, in bytes as reported by
+// PayloadSize, that each of the two payloads of HideDeniable can hold in
+// img with opts.
+func DeniableCapacity(img image.Image, opts StegoOptions) int {
+	return stego.DeniableCapacity(img, opts.engine()...)
+}
+
+// HideDeniable hides two payloads in the image at inputFilename and saves
+// it to outputFilename: decoy, encrypted with decoyPassword and meant to be
+// given up if someone insists, and hidden, encrypted with the key or
+// password in opts. Both are scattered, so revealing with either secret
+// finds only its own payload, and the image statistics do not tell one
+// payload from two. Each gets half of the capacity; ErrPayloadTooLarge is
+// returned if either does not fit in its half.
+func HideDeniable(inputFilename, outputFilename string, decoy, hidden Payload, decoyPassword string, opts StegoOptions, outputFormat string) error {
+	opts.Scatter = true
+	if err := opts.Validate(); err != nil {
+		return err
+	}
+	if opts.Method != "" && opts.Method != StegoMethodLSB {
+		return fmt.Errorf("a decoy payload needs the %s method", StegoMethodLSB)
+	}
+	if strings.EqualFold(outputFormat, "gif") {
+		return fmt.Errorf("a decoy payload cannot be hidden in a GIF")
+	}
+	if err := checkStegoOutputFormat(outputFormat, opts); err != nil {
+		return err
+	}
+	img, err := loadStegoCover(inputFilename)
+	if err != nil {
+		return err
+	}
+	if err := checkStegoCoverAlpha(img, outputFormat); err != nil {
+		return err
+	}
+	stegoImg, err := stego.EmbedDeniable(img, decoy, hidden, decoyPassword, opts.engine()...)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(outputFilename), os.ModeDir|0755) // Ensure output directory exists
+	if err != nil {
+		return fmt.Errorf("failed to create output directory: %w", err)
+	}
+	if err := SaveImage(outputFilename, stegoImg, opts.saveOptions(outputFormat)); err != nil {
+		return fmt.Errorf("failed to encode stego image: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package pixellock
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"math"
+	"path/filepath"
+	"testing"
+
+	"github.com/Amul-Thantharate/pixellock/pkg/stego"
+)
+
+func TestHideDeniable(t *testing.T) {
+	dir := t.TempDir()
+	cover := filepath.Join(dir, "cover.png")
+	if err := SaveImage(cover, newTestNRGBA(64, 64), SaveOptions{Format: "png"}); err != nil {
+		t.Fatalf("SaveImage failed: %v", err)
+	}
+	output := filepath.Join(dir, "stego.png")
+	decoy := Payload{Data: []byte("milk, eggs, bread")}
+	hidden := Payload{Data: binaryFixture(), Filename: "plans.bin"}
+	opts := StegoOptions{Density: 2, Password: "real"}
+	if err := HideDeniable(cover, output, decoy, hidden, "decoy", opts, "png"); err != nil {
+		t.Fatalf("HideDeniable failed: %v", err)
+	}
+
+	got, err := RevealPayload(output, StegoOptions{Password: "decoy"})
+	if err != nil {
+		t.Fatalf("reveal with the decoy password failed: %v", err)
+	}
+	if !bytes.Equal(got.Data, decoy.Data) || got.Filename != "" {
+		t.Errorf("decoy password revealed %q (%q), want the decoy", got.Data, got.Filename)
+	}
+	got, err = RevealPayload(output, StegoOptions{Password: "real"})
+	if err != nil {
+		t.Fatalf("reveal with the real password failed: %v", err)
+	}
+	if !bytes.Equal(got.Data, hidden.Data) || got.Filename != hidden.Filename {
+		t.Error("real password did not reveal the hidden payload")
+	}
+
+	for _, opts := range []StegoOptions{DefaultStegoOptions, {Password: "guess"}} {
+		if _, err := RevealPayload(output, opts); !errors.Is(err, ErrNoPayload) {
+			t.Errorf("reveal with password %q error = %v, want ErrNoPayload", opts.Password, err)
+		}
+	}
+}
+
+func TestHideDeniableTooLarge(t *testing.T) {
+	dir := t.TempDir()
+	cover := filepath.Join(dir, "cover.png")
+	img := newTestNRGBA(32, 32)
+	if err := SaveImage(cover, img, SaveOptions{Format: "png"}); err != nil {
+		t.Fatalf("SaveImage failed: %v", err)
+	}
+	output := filepath.Join(dir, "stego.png")
+	opts := StegoOptions{Density: 1, Password: "real"}
+	overhead, _, err := PayloadSize(Payload{}, opts)
+	if err != nil {
+		t.Fatalf("PayloadSize failed: %v", err)
+	}
+	capacity := DeniableCapacity(img, opts) - overhead
+
+	// Together the payloads fit in the image, but the hidden one overflows
+	// its half and would overlap the decoy.
+	decoy, hidden := Payload{Data: make([]byte, 1)}, Payload{Data: make([]byte, capacity+1)}
+	if StegoCapacity(img, opts) < len(decoy.Data)+len(hidden.Data) {
+		t.Fatal("combined payloads do not fit the whole image")
+	}
+	if err := HideDeniable(cover, output, decoy, hidden, "decoy", opts, "png"); !errors.Is(err, ErrPayloadTooLarge) {
+		t.Errorf("HideDeniable over capacity error = %v, want ErrPayloadTooLarge", err)
+	}
+	hidden.Data = hidden.Data[:capacity]
+	if err := HideDeniable(cover, output, decoy, hidden, "decoy", opts, "png"); err != nil {
+		t.Errorf("HideDeniable at capacity failed: %v", err)
+	}
+	if err := HideDeniable(cover, output, decoy, hidden, "real", opts, "png"); err == nil {
+		t.Error("HideDeniable accepted the same password for both payloads")
+	}
+}
+
+func TestDeniableUndetectable(t *testing.T) {
+	// A detector should score two payloads like one of their combined size.
+	opts := StegoOptions{Density: 1, Password: "real"}
+	half := DeniableCapacity(photoNRGBA(t), opts) - 64
+	decoy, hidden := make([]byte, half), make([]byte, half)
+	rand.Read(decoy)
+	rand.Read(hidden)
+
+	one := photoNRGBA(t)
+	single := opts
+	single.Scatter = true
+	if err := hideInImage(one, Payload{Data: append(append([]byte{}, decoy...), hidden...)}, single); err != nil {
+		t.Fatalf("hideInImage failed: %v", err)
+	}
+	two, err := stego.EmbedDeniable(photoNRGBA(t), Payload{Data: decoy}, Payload{Data: hidden}, "decoy", opts.engine()...)
+	if err != nil {
+		t.Fatalf("EmbedDeniable failed: %v", err)
+	}
+
+	a, b := AnalyzeStego(one), AnalyzeStego(two)
+	if a.Verdict != b.Verdict || a.Pixellock() || b.Pixellock() {
+		t.Errorf("one payload: verdict %s, pixellock %v; two payloads: verdict %s, pixellock %v", a.Verdict, a.Pixellock(), b.Verdict, b.Pixellock())
+	}
+	if math.Abs(a.Score-b.Score) > 0.05 {
+		t.Errorf("one payload scores %.3f, two score %.3f", a.Score, b.Score)
+	}
+}
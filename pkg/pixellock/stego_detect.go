@@ -0,0 +1,384 @@
+package pixellock
+
+import (
+	"image"
+	"math"
+	"os"
+
+	"github.com/Amul-Thantharate/pixellock/pkg/stego"
+)
+
+// Steganalysis verdicts.
+const (
+	VerdictClean       = "clean"
+	VerdictSuspicious  = "suspicious"
+	VerdictLikelyStego = "likely-stego"
+)
+
+// Score thresholds separating the verdicts.
+const (
+	suspiciousScore  = 0.2
+	likelyStegoScore = 0.5
+)
+
+// chiSquareSteps is the number of growing image prefixes the chi-square
+// test is run over. Sequential embedding only equalizes the histogram of
+// the pixels it touched, so a small payload shows up in a short prefix long
+// before it does over the whole image.
+const chiSquareSteps = 20
+
+// minChiSquareSamples is the smallest prefix, in samples, worth testing.
+const minChiSquareSamples = 1024
+
+// channelNames names the RGBA channels in Pix order.
+var channelNames = [4]string{"R", "G", "B", "A"}
+
+// StegoChannelAnalysis is the steganalysis result for one color channel.
+type StegoChannelAnalysis struct {
+	Channel string `json:"channel"`
+	// ChiSquare is the probability, from the chi-square attack on pairs of
+	// values, that the LSBs of the start of the image are random.
+	ChiSquare float64 `json:"chi_square"`
+	// EmbeddedFraction estimates the share of the image, from the start in
+	// raster order, over which the LSBs look random.
+	EmbeddedFraction float64 `json:"embedded_fraction"`
+	// RS is the message length estimated by RS analysis, as a fraction of
+	// the LSBs of the channel.
+	RS        float64 `json:"rs"`
+	Score     float64 `json:"score"`
+	Anomalous bool    `json:"anomalous"`
+}
+
+// StegoAnalysis is the result of AnalyzeStego.
+type StegoAnalysis struct {
+	Score   float64 `json:"score"` // Likelihood of hidden data, from 0 to 1
+	Verdict string  `json:"verdict"`
+	// Channels holds the channels with enough variation to be analyzed;
+	// a constant alpha channel, for example, is left out.
+	Channels []StegoChannelAnalysis `json:"channels"`
+	// PixellockVersion is the version of the pixellock payload header found
+	// at the start of the image or of its visible pixels, or 0. Scattered payloads cannot be found
+	// without their secret.
+	PixellockVersion int `json:"pixellock_version,omitempty"`
+}
+
+// Pixellock reports whether a pixellock payload header was found.
+func (a StegoAnalysis) Pixellock() bool {
+	return a.PixellockVersion != 0
+}
+
+// AnalyzeStego runs chi-square and RS steganalysis over the LSB planes of
+// img and looks for a pixellock payload header.
+func AnalyzeStego(img image.Image) StegoAnalysis {
+	nrgba := asNRGBA(img)
+	var a StegoAnalysis
+	for c := range channelNames {
+		ca, ok := analyzeChannel(nrgba, c)
+		if !ok {
+			continue
+		}
+		a.Channels = append(a.Channels, ca)
+		a.Score = max(a.Score, ca.Score)
+	}
+	a.PixellockVersion = stego.HeaderVersion(nrgba)
+	a.Verdict = stegoVerdict(a.Score)
+	if a.Pixellock() {
+		a.Verdict = VerdictLikelyStego
+	}
+	return a
+}
+
+// AnalyzeStegoFile runs AnalyzeStego on the image at filename. Baseline
+// JPEGs are also checked for a payload hidden with StegoMethodDCT, GIFs for
+// one spread over their frames, and all images for one stored in their
+// metadata, which the pixel analysis cannot see.
+func AnalyzeStegoFile(filename string) (StegoAnalysis, error) {
+	img, err := LoadImage(filename)
+	if err != nil {
+		return StegoAnalysis{}, err
+	}
+	a := AnalyzeStego(img)
+	if !a.Pixellock() {
+		if data, err := os.ReadFile(filename); err == nil {
+			if jc, err := readJPEGCoefficients(data); err == nil {
+				if version, ok := dctPayloadVersion(jc); ok {
+					a.PixellockVersion = version
+					a.Verdict = VerdictLikelyStego
+				}
+			}
+		}
+	}
+	if !a.Pixellock() {
+		if data, err := os.ReadFile(filename); err == nil {
+			if framed, ok := readMetadataPayload(data); ok {
+				if version, ok := stego.FrameVersion(framed); ok {
+					a.PixellockVersion = version
+					a.Verdict = VerdictLikelyStego
+				}
+			}
+		}
+	}
+	if !a.Pixellock() {
+		if c, ok, err := loadPaletteCover(filename); ok && err == nil {
+			if version, ok := c.payloadVersion(); ok {
+				a.PixellockVersion = version
+				a.Verdict = VerdictLikelyStego
+			}
+		}
+	}
+	return a, nil
+}
+
+// AnalyzeStegoFiles runs AnalyzeStegoFile on each input, workers at a time.
+func AnalyzeStegoFiles(inputs []string, workers int) []StegoBatchResult {
+	return runStegoBatch(inputs, workers, func(input string) StegoBatchResult {
+		a, err := AnalyzeStegoFile(input)
+		return StegoBatchResult{Input: input, Analysis: a, Err: err}
+	})
+}
+
+func stegoVerdict(score float64) string {
+	switch {
+	case score >= likelyStegoScore:
+		return VerdictLikelyStego
+	case score >= suspiciousScore:
+		return VerdictSuspicious
+	default:
+		return VerdictClean
+	}
+}
+
+// channelSamples returns the values of channel c of img in raster order.
+func channelSamples(img *image.NRGBA, c int) []int {
+	b := img.Bounds()
+	samples := make([]int, 0, b.Dx()*b.Dy())
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		row := img.Pix[img.PixOffset(b.Min.X, y):]
+		for x := 0; x < b.Dx(); x++ {
+			samples = append(samples, int(row[x*4+c]))
+		}
+	}
+	return samples
+}
+
+// analyzeChannel analyzes channel c of img. ok is false when the channel
+// has too little variation for the tests to say anything.
+func analyzeChannel(img *image.NRGBA, c int) (StegoChannelAnalysis, bool) {
+	samples := channelSamples(img, c)
+	chi, fraction, chiOK := chiSquareAttack(samples)
+	rs, rsOK := rsAnalysis(samples, img.Bounds().Dx())
+	if !chiOK || !rsOK {
+		return StegoChannelAnalysis{}, false
+	}
+
+	ca := StegoChannelAnalysis{
+		Channel:          channelNames[c],
+		ChiSquare:        chi,
+		EmbeddedFraction: fraction,
+		RS:               rs,
+	}
+	ca.Score = max(chi, min(max(rs, 0), 1))
+	ca.Anomalous = ca.Score >= suspiciousScore
+	return ca, true
+}
+
+// chiSquareAttack runs the Westfeld-Pfitzmann chi-square attack over growing
+// prefixes of samples. Embedding random bits in the LSBs evens out the
+// counts of each pair of values 2k and 2k+1; p is the probability that the
+// counts over the first prefix are that even by chance, and fraction the
+// longest prefix, as a share of samples, over which p stays above one half.
+func chiSquareAttack(samples []int) (p, fraction float64, ok bool) {
+	step := max(len(samples)/chiSquareSteps, minChiSquareSamples)
+	var hist [256]int
+	n := 0
+	for end := step; end <= len(samples); end += step {
+		for ; n < end; n++ {
+			hist[samples[n]]++
+		}
+		q, valid := chiSquarePairs(&hist)
+		if !valid {
+			continue
+		}
+		if !ok {
+			p, ok = q, true
+		}
+		if q < 0.5 {
+			break
+		}
+		fraction = float64(end) / float64(len(samples))
+	}
+	return p, fraction, ok
+}
+
+// chiSquarePairs returns the chi-square p-value of the pairs of values in
+// hist, ignoring pairs too rare for the test. valid is false when fewer
+// than two pairs are left.
+func chiSquarePairs(hist *[256]int) (p float64, valid bool) {
+	chi := 0.0
+	categories := 0
+	for k := 0; k < 256; k += 2 {
+		expected := float64(hist[k]+hist[k+1]) / 2
+		if expected < 5 {
+			continue
+		}
+		d := float64(hist[k]) - expected
+		chi += d * d / expected
+		categories++
+	}
+	if categories < 2 {
+		return 0, false
+	}
+	return gammaQ(float64(categories-1)/2, chi/2), true
+}
+
+// rsAnalysis estimates the fraction of LSBs carrying a message by the RS
+// method of Fridrich, Goljan and Du, over groups of four horizontally
+// adjacent samples of an image width pixels wide. ok is false when the
+// samples have no regular or singular groups, as in a flat image.
+func rsAnalysis(samples []int, width int) (float64, bool) {
+	mask := [4]int{0, 1, 1, 0}
+	var r, s [4]float64 // R and S counts for M and -M on the image, then on it with all LSBs flipped
+	groups := 0
+	var g, flipped [4]int
+	for y := 0; y+width <= len(samples); y += width {
+		for x := 0; x+4 <= width; x += 4 {
+			copy(g[:], samples[y+x:y+x+4])
+			for i := range g {
+				flipped[i] = g[i] ^ 1
+			}
+			groups++
+			for i, grp := range [2]*[4]int{&g, &flipped} {
+				for j, sign := range [2]int{1, -1} {
+					switch d := rsFlip(grp, mask, sign) - rsSmoothness(grp); {
+					case d > 0:
+						r[i*2+j]++
+					case d < 0:
+						s[i*2+j]++
+					}
+				}
+			}
+		}
+	}
+	if groups == 0 {
+		return 0, false
+	}
+	for i := range r {
+		r[i] /= float64(groups)
+		s[i] /= float64(groups)
+	}
+	if r[0]+s[0] == 0 {
+		return 0, false
+	}
+
+	d0, dn0 := r[0]-s[0], r[1]-s[1]
+	d1, dn1 := r[2]-s[2], r[3]-s[3]
+	a := 2 * (d1 + d0)
+	b := dn0 - dn1 - d1 - 3*d0
+	c := d0 - dn0
+	var x float64
+	switch {
+	case a != 0:
+		disc := b*b - 4*a*c
+		if disc < 0 {
+			disc = 0
+		}
+		x1 := (-b + math.Sqrt(disc)) / (2 * a)
+		x2 := (-b - math.Sqrt(disc)) / (2 * a)
+		x = x1
+		if math.Abs(x2) < math.Abs(x1) {
+			x = x2
+		}
+	case b != 0:
+		x = -c / b
+	default:
+		return 0, true
+	}
+	if x == 0.5 {
+		return 1, true
+	}
+	return x / (x - 0.5), true
+}
+
+// rsSmoothness is the discrimination function of RS analysis: the total
+// variation of the group.
+func rsSmoothness(g *[4]int) int {
+	f := 0
+	for i := 0; i < 3; i++ {
+		f += abs(g[i+1] - g[i])
+	}
+	return f
+}
+
+// rsFlip returns the smoothness of g after applying the flipping function
+// selected by sign to the samples under mask: F1 swaps 2k and 2k+1, F-1
+// swaps 2k-1 and 2k.
+func rsFlip(g *[4]int, mask [4]int, sign int) int {
+	var f [4]int
+	for i, v := range g {
+		switch {
+		case mask[i] == 0:
+			f[i] = v
+		case sign > 0:
+			f[i] = v ^ 1
+		default:
+			f[i] = ((v + 1) ^ 1) - 1
+		}
+	}
+	return rsSmoothness(&f)
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+// gammaQ returns the regularized upper incomplete gamma function Q(a, x),
+// the survival function of a chi-square distribution with 2a degrees of
+// freedom at 2x.
+func gammaQ(a, x float64) float64 {
+	if x <= 0 {
+		return 1
+	}
+	lg, _ := math.Lgamma(a)
+	prefix := math.Exp(-x + a*math.Log(x) - lg)
+	if x < a+1 {
+		// Series for P(a, x).
+		sum, term := 1/a, 1/a
+		for n := 1.0; n < 1000; n++ {
+			term *= x / (a + n)
+			sum += term
+			if math.Abs(term) < math.Abs(sum)*1e-15 {
+				break
+			}
+		}
+		return math.Max(0, 1-sum*prefix)
+	}
+
+	// Continued fraction for Q(a, x), by the modified Lentz method.
+	const tiny = 1e-300
+	b := x + 1 - a
+	c := 1 / tiny
+	d := 1 / b
+	h := d
+	for i := 1.0; i < 1000; i++ {
+		an := -i * (i - a)
+		b += 2
+		d = an*d + b
+		if math.Abs(d) < tiny {
+			d = tiny
+		}
+		c = b + an/c
+		if math.Abs(c) < tiny {
+			c = tiny
+		}
+		d = 1 / d
+		delta := d * c
+		h *= delta
+		if math.Abs(delta-1) < 1e-15 {
+			break
+		}
+	}
+	return prefix * h
+}
@@ -0,0 +1,96 @@
+package pixellock
+
+import (
+	"bytes"
+	"crypto/rand"
+	"image"
+	"image/jpeg"
+	"testing"
+)
+
+// photoNRGBA decodes the sample photo crop, giving a pristine cover with a
+// natural LSB distribution.
+func photoNRGBA(t *testing.T) *image.NRGBA {
+	t.Helper()
+	img, err := jpeg.Decode(bytes.NewReader(photoCover(t, 90)))
+	if err != nil {
+		t.Fatalf("jpeg.Decode failed: %v", err)
+	}
+	return toNRGBA(img)
+}
+
+func TestAnalyzeStegoClean(t *testing.T) {
+	a := AnalyzeStego(photoNRGBA(t))
+	if a.Verdict != VerdictClean || a.Pixellock() {
+		t.Errorf("pristine photo: score %.3f, verdict %s, pixellock %v; want clean", a.Score, a.Verdict, a.Pixellock())
+	}
+	if len(a.Channels) == 0 {
+		t.Fatal("no channels analyzed")
+	}
+	for _, c := range a.Channels {
+		if c.Anomalous {
+			t.Errorf("pristine photo: channel %s flagged, score %.3f", c.Channel, c.Score)
+		}
+	}
+}
+
+func TestAnalyzeStegoDetectsPayload(t *testing.T) {
+	clean := AnalyzeStego(photoNRGBA(t)).Score
+	for _, density := range []int{1, 2, 4} {
+		for _, fill := range []float64{0.1, 1} {
+			cover := photoNRGBA(t)
+			opts := StegoOptions{Density: density}
+			data := make([]byte, int(float64(StegoCapacity(cover, opts)-8)*fill))
+			rand.Read(data)
+			if err := hideInImage(cover, Payload{Data: data}, opts); err != nil {
+				t.Fatalf("density %d: hideInImage failed: %v", density, err)
+			}
+
+			a := AnalyzeStego(cover)
+			if a.Score <= clean || a.Verdict != VerdictLikelyStego {
+				t.Errorf("density %d, %.0f%% full: score %.3f (clean %.3f), verdict %s; want likely-stego", density, fill*100, a.Score, clean, a.Verdict)
+			}
+			if a.PixellockVersion != StegoVersion {
+				t.Errorf("density %d: PixellockVersion = %d, want %d", density, a.PixellockVersion, StegoVersion)
+			}
+			for _, c := range a.Channels[:3] {
+				if !c.Anomalous || c.EmbeddedFraction < fill/2 {
+					t.Errorf("density %d, %.0f%% full: channel %s anomalous %v, embedded fraction %.2f", density, fill*100, c.Channel, c.Anomalous, c.EmbeddedFraction)
+				}
+			}
+		}
+	}
+}
+
+func TestAnalyzeStegoScatteredPayload(t *testing.T) {
+	// A scattered payload has no header at the start of the image, so only
+	// the statistics can give it away.
+	cover := photoNRGBA(t)
+	opts := StegoOptions{Density: 1, Password: "hunter2", Scatter: true}
+	data := make([]byte, StegoCapacity(cover, opts)-64)
+	rand.Read(data)
+	if err := hideInImage(cover, Payload{Data: data}, opts); err != nil {
+		t.Fatalf("hideInImage failed: %v", err)
+	}
+	a := AnalyzeStego(cover)
+	if a.Pixellock() {
+		t.Error("scattered payload reported as a pixellock header")
+	}
+	if a.Verdict == VerdictClean {
+		t.Errorf("scattered payload: score %.3f, verdict clean", a.Score)
+	}
+}
+
+func TestGammaQ(t *testing.T) {
+	// Chi-square survival function values for 1 and 10 degrees of freedom.
+	tests := []struct{ df, chi, want float64 }{
+		{1, 3.841, 0.05},
+		{10, 18.307, 0.05},
+		{10, 2.558, 0.99},
+	}
+	for _, tt := range tests {
+		if got := gammaQ(tt.df/2, tt.chi/2); got < tt.want-0.001 || got > tt.want+0.001 {
+			t.Errorf("gammaQ(%v, %v) = %v, want %v", tt.df/2, tt.chi/2, got, tt.want)
+		}
+	}
+}
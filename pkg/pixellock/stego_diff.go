@@ -0,0 +1,126 @@
+package pixellock
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"os"
+	"path/filepath"
+)
+
+// heatmapRamp is the color ramp changed pixels are drawn with, from the
+// smallest change to the largest.
+var heatmapRamp = []color.NRGBA{
+	{0, 0, 255, 255},   // Blue
+	{0, 255, 255, 255}, // Cyan
+	{0, 255, 0, 255},   // Green
+	{255, 255, 0, 255}, // Yellow
+	{255, 0, 0, 255},   // Red
+}
+
+// StegoDiff describes how two images of the same size differ.
+type StegoDiff struct {
+	Changed  int     // Pixels with at least one changed channel
+	Pixels   int     // Pixels compared
+	MaxDelta int     // Largest change of a single channel value
+	PSNR     float64 // Peak signal-to-noise ratio in dB; +Inf for identical images
+
+	// Heatmap is black where the pixels are equal and elsewhere shows the
+	// largest channel change on a color ramp from blue to red.
+	Heatmap *image.NRGBA
+}
+
+// DiffImages compares the channels of modified against original, which
+// must have the same size, and renders the differences as a heatmap. The
+// heatmap amplifies changes on a logarithmic scale fixed across images, so
+// a change of one in the lowest bit is plainly visible and heatmaps of
+// different embeddings can be compared side by side.
+func DiffImages(original, modified image.Image, channels StegoChannels) (StegoDiff, error) {
+	ob, mb := original.Bounds(), modified.Bounds()
+	if ob.Dx() != mb.Dx() || ob.Dy() != mb.Dy() {
+		return StegoDiff{}, fmt.Errorf("images differ in size: the original is %dx%d but the modified image is %dx%d; "+
+			"resizing or cropping also changes every pixel, so compare images of the same size", ob.Dx(), ob.Dy(), mb.Dx(), mb.Dy())
+	}
+	if channels == 0 {
+		channels = ChannelsRGBA
+	}
+	o, m := asNRGBA(original), asNRGBA(modified)
+	var offsets []int
+	for i := 0; i < 4; i++ {
+		if channels&(1<<i) != 0 {
+			offsets = append(offsets, i)
+		}
+	}
+
+	d := StegoDiff{Pixels: ob.Dx() * ob.Dy(), Heatmap: image.NewNRGBA(image.Rect(0, 0, ob.Dx(), ob.Dy()))}
+	var squares float64
+	for y := 0; y < ob.Dy(); y++ {
+		for x := 0; x < ob.Dx(); x++ {
+			oi := o.PixOffset(o.Rect.Min.X+x, o.Rect.Min.Y+y)
+			mi := m.PixOffset(m.Rect.Min.X+x, m.Rect.Min.Y+y)
+			delta := 0
+			for _, c := range offsets {
+				dc := abs(int(o.Pix[oi+c]) - int(m.Pix[mi+c]))
+				squares += float64(dc * dc)
+				delta = max(delta, dc)
+			}
+			if delta > 0 {
+				d.Changed++
+				d.MaxDelta = max(d.MaxDelta, delta)
+			}
+			d.Heatmap.SetNRGBA(x, y, heatmapColor(delta))
+		}
+	}
+
+	d.PSNR = math.Inf(1)
+	if samples := d.Pixels * len(offsets); squares > 0 {
+		d.PSNR = 10 * math.Log10(255*255/(squares/float64(samples)))
+	}
+	return d, nil
+}
+
+// heatmapColor returns the heatmap color of a channel change of delta:
+// black for none, otherwise a point on heatmapRamp at log2(delta+1)/8, so
+// each extra bit changed moves one eighth of the way along the ramp.
+func heatmapColor(delta int) color.NRGBA {
+	if delta == 0 {
+		return color.NRGBA{0, 0, 0, 255}
+	}
+	pos := math.Log2(float64(delta)+1) / 8 * float64(len(heatmapRamp)-1)
+	i := min(int(pos), len(heatmapRamp)-2)
+	t := pos - float64(i)
+	lo, hi := heatmapRamp[i], heatmapRamp[i+1]
+	mix := func(a, b uint8) uint8 { return uint8(math.Round(float64(a) + t*(float64(b)-float64(a)))) }
+	return color.NRGBA{mix(lo.R, hi.R), mix(lo.G, hi.G), mix(lo.B, hi.B), 255}
+}
+
+// DiffImageFiles runs DiffImages on the images at originalFilename and
+// modifiedFilename and, unless heatmapFilename is empty, saves the heatmap
+// there as a PNG.
+func DiffImageFiles(originalFilename, modifiedFilename, heatmapFilename string, channels StegoChannels) (StegoDiff, error) {
+	original, err := LoadImage(originalFilename)
+	if err != nil {
+		return StegoDiff{}, err
+	}
+	modified, err := LoadImage(modifiedFilename)
+	if err != nil {
+		return StegoDiff{}, err
+	}
+	d, err := DiffImages(original, modified, channels)
+	if err != nil {
+		return StegoDiff{}, fmt.Errorf("cannot diff %s against %s: %w", modifiedFilename, originalFilename, err)
+	}
+	if heatmapFilename == "" {
+		return d, nil
+	}
+
+	err = os.MkdirAll(filepath.Dir(heatmapFilename), os.ModeDir|0755) // Ensure output directory exists
+	if err != nil {
+		return d, fmt.Errorf("failed to create output directory: %w", err)
+	}
+	if err := SaveImage(heatmapFilename, d.Heatmap, SaveOptions{Format: "png"}); err != nil {
+		return d, fmt.Errorf("failed to encode heatmap: %w", err)
+	}
+	return d, nil
+}
@@ -0,0 +1,88 @@
+package pixellock
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDiffImages(t *testing.T) {
+	original := photoNRGBA(t)
+	modified := image.NewNRGBA(original.Rect)
+	copy(modified.Pix, original.Pix)
+
+	// Flip the low bit of red on a diagonal and add 40 to blue in a square.
+	changed := map[image.Point]bool{}
+	for i := 0; i < 20; i++ {
+		modified.Pix[modified.PixOffset(i, i)] ^= 1
+		changed[image.Pt(i, i)] = true
+	}
+	for y := 30; y < 35; y++ {
+		for x := 40; x < 45; x++ {
+			o := modified.PixOffset(x, y) + 2
+			modified.Pix[o] = uint8((int(modified.Pix[o]) + 40) % 256)
+			changed[image.Pt(x, y)] = true
+		}
+	}
+
+	d, err := DiffImages(original, modified, 0)
+	if err != nil {
+		t.Fatalf("DiffImages failed: %v", err)
+	}
+	b := original.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			black := d.Heatmap.NRGBAAt(x, y) == color.NRGBA{0, 0, 0, 255}
+			if black == changed[image.Pt(x, y)] {
+				t.Fatalf("heatmap at (%d, %d) is %v, changed %v", x, y, d.Heatmap.NRGBAAt(x, y), changed[image.Pt(x, y)])
+			}
+		}
+	}
+
+	var squares float64
+	maxDelta := 0
+	for i := range original.Pix {
+		delta := abs(int(original.Pix[i]) - int(modified.Pix[i]))
+		squares += float64(delta * delta)
+		maxDelta = max(maxDelta, delta)
+	}
+	wantPSNR := 10 * math.Log10(255*255/(squares/float64(len(original.Pix))))
+	if d.Changed != len(changed) || d.MaxDelta != maxDelta || math.Abs(d.PSNR-wantPSNR) > 1e-9 {
+		t.Errorf("changed %d, max delta %d, PSNR %.4f; want %d, %d, %.4f", d.Changed, d.MaxDelta, d.PSNR, len(changed), maxDelta, wantPSNR)
+	}
+	if bigger, smaller := d.Heatmap.NRGBAAt(40, 30), d.Heatmap.NRGBAAt(0, 0); bigger.R <= smaller.R {
+		t.Errorf("a change of 40 is drawn %v, no hotter than a change of 1 drawn %v", bigger, smaller)
+	}
+
+	// Isolating the red channel leaves only the diagonal.
+	red, err := DiffImages(original, modified, ChannelR)
+	if err != nil {
+		t.Fatalf("DiffImages failed: %v", err)
+	}
+	if red.Changed != 20 || red.MaxDelta != 1 {
+		t.Errorf("red channel: changed %d, max delta %d; want 20, 1", red.Changed, red.MaxDelta)
+	}
+
+	same, _ := DiffImages(original, original, 0)
+	if same.Changed != 0 || !math.IsInf(same.PSNR, 1) {
+		t.Errorf("identical images: changed %d, PSNR %v", same.Changed, same.PSNR)
+	}
+}
+
+func TestDiffImageFilesSizeMismatch(t *testing.T) {
+	dir := t.TempDir()
+	a, b := filepath.Join(dir, "a.png"), filepath.Join(dir, "b.png")
+	if err := SaveImage(a, newTestNRGBA(32, 32), SaveOptions{Format: "png"}); err != nil {
+		t.Fatalf("SaveImage failed: %v", err)
+	}
+	if err := SaveImage(b, newTestNRGBA(32, 16), SaveOptions{Format: "png"}); err != nil {
+		t.Fatalf("SaveImage failed: %v", err)
+	}
+	_, err := DiffImageFiles(a, b, filepath.Join(dir, "heatmap.png"), 0)
+	if err == nil || !strings.Contains(err.Error(), "32x32") || !strings.Contains(err.Error(), "32x16") {
+		t.Errorf("DiffImageFiles error = %v, want one naming both sizes", err)
+	}
+}
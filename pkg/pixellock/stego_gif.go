@@ -0,0 +1,72 @@
+package pixellock
+
+import (
+	"bytes"
+	"fmt"
+	"image/gif"
+	"os"
+	"path/filepath"
+)
+
+// gifSignature starts every GIF file.
+var gifSignature = []byte("GIF8")
+
+// loadGIF decodes every frame of the GIF at filename. ok is false when the
+// file is not a GIF.
+func loadGIF(filename string) (g *gif.GIF, ok bool, err error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to open image: %w", err)
+	}
+	return decodeGIF(data)
+}
+
+// decodeGIF is loadGIF for the image file read into data.
+func decodeGIF(data []byte) (g *gif.GIF, ok bool, err error) {
+	if !bytes.HasPrefix(data, gifSignature) {
+		return nil, false, nil
+	}
+	if g, err = gif.DecodeAll(bytes.NewReader(data)); err != nil {
+		return nil, true, fmt.Errorf("failed to decode image: %w", err)
+	}
+	return g, true, nil
+}
+
+// hideGIF implements HidePayload for GIF output. The cover must be a GIF;
+// frames, palettes, delays, disposal methods and the loop count are kept,
+// so an animation plays as before.
+func hideGIF(inputFilename, outputFilename string, p Payload, opts StegoOptions) error {
+	g, ok, err := loadGIF(inputFilename)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("gif output needs a gif cover; %s is not one", inputFilename)
+	}
+	if err := hideInPalette(newPaletteCover(g.Image), p, opts); err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, g); err != nil {
+		return fmt.Errorf("failed to encode stego image: %w", err)
+	}
+	err = os.MkdirAll(filepath.Dir(outputFilename), os.ModeDir|0755) // Ensure output directory exists
+	if err != nil {
+		return fmt.Errorf("failed to create output directory: %w", err)
+	}
+	if err := os.WriteFile(outputFilename, buf.Bytes(), 0644); err != nil {
+		return fmt.Errorf("failed to write stego image: %w", err)
+	}
+	return nil
+}
+
+// gifFileCapacity returns the GIF capacity of the image at filename. ok is
+// false when the file is not a GIF.
+func gifFileCapacity(filename string) (capacity int, ok bool, err error) {
+	g, ok, err := loadGIF(filename)
+	if err != nil || !ok {
+		return 0, ok, err
+	}
+	return newPaletteCover(g.Image).capacity(), true, nil
+}
@@ -0,0 +1,162 @@
+package pixellock
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/gif"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// animatedGIF writes a three frame animation with distinct delays and
+// disposal methods, a transparent color and a local palette on the last
+// frame, and returns its path.
+func animatedGIF(t *testing.T) string {
+	t.Helper()
+	global := color.Palette{color.NRGBA{}} // Index 0 is transparent
+	for i := 1; i < 64; i++ {
+		global = append(global, color.NRGBA{uint8(i * 4), uint8(255 - i*4), uint8(i * 2), 255})
+	}
+	local := append(color.Palette{}, global[1:]...)
+
+	g := &gif.GIF{
+		Delay:     []int{10, 25, 40},
+		Disposal:  []byte{gif.DisposalNone, gif.DisposalBackground, gif.DisposalPrevious},
+		LoopCount: 3,
+		Config:    image.Config{ColorModel: global, Width: 40, Height: 30},
+	}
+	for f := 0; f < 3; f++ {
+		palette := global
+		if f == 2 {
+			palette = local
+		}
+		frame := image.NewPaletted(image.Rect(0, 0, 40, 30), palette)
+		for i := range frame.Pix {
+			frame.Pix[i] = uint8((i*7 + f*13) % len(palette))
+		}
+		g.Image = append(g.Image, frame)
+	}
+
+	path := filepath.Join(t.TempDir(), "cover.gif")
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, g); err != nil {
+		t.Fatalf("gif.EncodeAll failed: %v", err)
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	return path
+}
+
+func decodeGIFFile(t *testing.T, path string) *gif.GIF {
+	t.Helper()
+	g, ok, err := loadGIF(path)
+	if err != nil || !ok {
+		t.Fatalf("loadGIF(%s) = %v, %v", path, ok, err)
+	}
+	return g
+}
+
+func TestGIFRoundTrip(t *testing.T) {
+	input := animatedGIF(t)
+	cover := decodeGIFFile(t, input)
+	frameCapacity := newPaletteCover(cover.Image[:1]).rawCapacity()
+
+	// Longer than one frame holds, so reveal has to join the frames.
+	data := make([]byte, frameCapacity+100)
+	for i := range data {
+		data[i] = byte(i * 37)
+	}
+	output := filepath.Join(t.TempDir(), "stego.gif")
+	if err := HidePayload(input, output, Payload{Data: data, Filename: "clip.bin"}, DefaultStegoOptions, "gif"); err != nil {
+		t.Fatalf("HidePayload failed: %v", err)
+	}
+
+	got, err := RevealPayload(output, DefaultStegoOptions)
+	if err != nil {
+		t.Fatalf("RevealPayload failed: %v", err)
+	}
+	if got.Filename != "clip.bin" || !bytes.Equal(got.Data, data) {
+		t.Error("GIF payload did not round trip")
+	}
+
+	stego := decodeGIFFile(t, output)
+	if len(stego.Image) != len(cover.Image) {
+		t.Fatalf("stego GIF has %d frames, want %d", len(stego.Image), len(cover.Image))
+	}
+	if !slices.Equal(stego.Delay, cover.Delay) || !slices.Equal(stego.Disposal, cover.Disposal) || stego.LoopCount != cover.LoopCount {
+		t.Errorf("timing changed: delays %v disposal %v loop %d, want %v %v %d",
+			stego.Delay, stego.Disposal, stego.LoopCount, cover.Delay, cover.Disposal, cover.LoopCount)
+	}
+	for f := range cover.Image {
+		before, after := cover.Image[f], stego.Image[f]
+		if after.Bounds() != before.Bounds() || len(after.Palette) != len(before.Palette) {
+			t.Fatalf("frame %d changed shape or palette size", f)
+		}
+		for i, index := range before.Pix {
+			if _, _, _, a := before.Palette[index].RGBA(); a == 0 && after.Pix[i] != index {
+				t.Fatalf("frame %d: transparent pixel %d was changed", f, i)
+			}
+		}
+	}
+}
+
+func TestGIFEncryptedCompressed(t *testing.T) {
+	input := animatedGIF(t)
+	output := filepath.Join(t.TempDir(), "stego.gif")
+	message := bytes.Repeat([]byte("looping "), 200)
+	opts := StegoOptions{Density: 1, Password: "gif", Compress: true}
+	if err := HidePayload(input, output, Payload{Data: message}, opts, "gif"); err != nil {
+		t.Fatalf("HidePayload failed: %v", err)
+	}
+	got, err := RevealPayload(output, StegoOptions{Density: 1, Password: "gif"})
+	if err != nil {
+		t.Fatalf("RevealPayload failed: %v", err)
+	}
+	if !bytes.Equal(got.Data, message) {
+		t.Error("encrypted GIF payload did not round trip")
+	}
+}
+
+func TestGIFCapacity(t *testing.T) {
+	input := animatedGIF(t)
+	capacity, err := StegoFileCapacity(input, DefaultStegoOptions)
+	if err != nil {
+		t.Fatalf("StegoFileCapacity failed: %v", err)
+	}
+
+	// Every pixel but the transparent ones of the global palette frames.
+	g := decodeGIFFile(t, input)
+	usable := 0
+	for f, frame := range g.Image {
+		for _, index := range frame.Pix {
+			if f == 2 || index != 0 {
+				usable++
+			}
+		}
+	}
+	if want := usable/8 - StegoHeaderSize; capacity != want {
+		t.Errorf("capacity = %d, want %d summed across frames", capacity, want)
+	}
+
+	output := filepath.Join(t.TempDir(), "stego.gif")
+	err = HidePayload(input, output, Payload{Data: make([]byte, capacity+1)}, DefaultStegoOptions, "gif")
+	if !errors.Is(err, ErrPayloadTooLarge) {
+		t.Errorf("HidePayload over capacity error = %v, want ErrPayloadTooLarge", err)
+	}
+}
+
+func TestGIFOutputNeedsGIFCover(t *testing.T) {
+	input := filepath.Join(t.TempDir(), "cover.png")
+	if err := SaveImage(input, newTestNRGBA(32, 32), SaveOptions{Format: "png"}); err != nil {
+		t.Fatalf("SaveImage failed: %v", err)
+	}
+	output := filepath.Join(t.TempDir(), "stego.gif")
+	if err := HidePayload(input, output, Payload{Data: []byte("hi")}, DefaultStegoOptions, "gif"); err == nil {
+		t.Error("HidePayload wrote a GIF from a PNG cover")
+	}
+}
@@ -0,0 +1,68 @@
+package pixellock
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// keyPayloadName is the filename a key is hidden under by HideKey, which
+// tells RecoverKey the payload is a key rather than some other file.
+const keyPayloadName = "pixellock.key"
+
+// keyStegoOptions are the options keys are hidden with: scattered and
+// encrypted with password, so the image reveals nothing without it.
+func keyStegoOptions(password string) StegoOptions {
+	return StegoOptions{Density: 1, Password: password, Scatter: true, SkipTransparent: true}
+}
+
+// ReadKeyfile reads a base64 encoded key file, as written by keygen.
+func ReadKeyfile(filename string) ([]byte, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key file: %w", err)
+	}
+	return DecodeKey(strings.TrimSpace(string(data)))
+}
+
+// HideKey hides key in the cover image at coverFilename and saves the
+// result to outputFilename, scattered over the image and encrypted with
+// password. Lossy output formats are refused, as they would destroy the
+// key, and the output is read back to make sure the key can be recovered
+// before HideKey returns.
+func HideKey(coverFilename, outputFilename string, key []byte, password, outputFormat string) error {
+	if len(key) != KeySize {
+		return fmt.Errorf("invalid key size: key must be %d bytes", KeySize)
+	}
+	if password == "" {
+		return fmt.Errorf("hiding a key requires a password")
+	}
+	p := Payload{Data: []byte(base64.StdEncoding.EncodeToString(key)), Filename: keyPayloadName}
+	if err := HidePayload(coverFilename, outputFilename, p, keyStegoOptions(password), outputFormat); err != nil {
+		return err
+	}
+
+	recovered, err := RecoverKey(outputFilename, password)
+	if err != nil {
+		return fmt.Errorf("the key cannot be recovered from %s: %w", outputFilename, err)
+	}
+	if !bytes.Equal(recovered, key) {
+		return fmt.Errorf("the key recovered from %s does not match", outputFilename)
+	}
+	return nil
+}
+
+// RecoverKey returns the key hidden by HideKey in the image at
+// imageFilename.
+func RecoverKey(imageFilename, password string) ([]byte, error) {
+	p, err := RevealPayload(imageFilename, keyStegoOptions(password))
+	if err != nil {
+		return nil, err
+	}
+	if p.Filename != keyPayloadName {
+		return nil, fmt.Errorf("%s carries a payload, but not a pixellock key", imageFilename)
+	}
+	return DecodeKey(string(p.Data))
+}
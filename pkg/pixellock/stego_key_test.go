@@ -0,0 +1,81 @@
+package pixellock
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHideKeyRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	key, err := GenerateRandomKey()
+	if err != nil {
+		t.Fatalf("GenerateRandomKey failed: %v", err)
+	}
+	keyfile := filepath.Join(dir, "key.pxk")
+	if err := os.WriteFile(keyfile, []byte(base64.StdEncoding.EncodeToString(key)+"\n"), 0o600); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	cover := filepath.Join(dir, "beach.png")
+	if err := SaveImage(cover, photoNRGBA(t), SaveOptions{Format: "png"}); err != nil {
+		t.Fatalf("SaveImage failed: %v", err)
+	}
+
+	read, err := ReadKeyfile(keyfile)
+	if err != nil {
+		t.Fatalf("ReadKeyfile failed: %v", err)
+	}
+	output := filepath.Join(dir, "beach2.png")
+	if err := HideKey(cover, output, read, "sandcastle", "png"); err != nil {
+		t.Fatalf("HideKey failed: %v", err)
+	}
+	recovered, err := RecoverKey(output, "sandcastle")
+	if err != nil {
+		t.Fatalf("RecoverKey failed: %v", err)
+	}
+	if !bytes.Equal(recovered, key) {
+		t.Fatal("recovered key differs")
+	}
+
+	// The recovered key decrypts what the original encrypted.
+	ciphertext, err := Encrypt(key, []byte("holiday photos"))
+	if err != nil {
+		t.Fatalf("Encrypt failed: %v", err)
+	}
+	plaintext, err := Decrypt(recovered, ciphertext)
+	if err != nil || string(plaintext) != "holiday photos" {
+		t.Errorf("Decrypt with the recovered key = %q, %v", plaintext, err)
+	}
+
+	if _, err := RecoverKey(output, "wrong"); !errors.Is(err, ErrNoPayload) {
+		t.Errorf("RecoverKey with the wrong password error = %v, want ErrNoPayload", err)
+	}
+}
+
+func TestHideKeySafetyChecks(t *testing.T) {
+	dir := t.TempDir()
+	cover := filepath.Join(dir, "cover.png")
+	if err := SaveImage(cover, newTestNRGBA(64, 64), SaveOptions{Format: "png"}); err != nil {
+		t.Fatalf("SaveImage failed: %v", err)
+	}
+	key, _ := GenerateRandomKey()
+
+	if err := HideKey(cover, filepath.Join(dir, "out.jpg"), key, "pw", "jpg"); !errors.Is(err, ErrLossyFormat) {
+		t.Errorf("HideKey to JPEG error = %v, want ErrLossyFormat", err)
+	}
+	if err := HideKey(cover, filepath.Join(dir, "out.png"), key, "", "png"); err == nil {
+		t.Error("HideKey accepted an empty password")
+	}
+
+	// A payload that is not a key is not mistaken for one.
+	other := filepath.Join(dir, "other.png")
+	if err := HidePayload(cover, other, Payload{Data: []byte("not a key")}, keyStegoOptions("pw"), "png"); err != nil {
+		t.Fatalf("HidePayload failed: %v", err)
+	}
+	if _, err := RecoverKey(other, "pw"); err == nil {
+		t.Error("RecoverKey accepted a payload that is not a key")
+	}
+}
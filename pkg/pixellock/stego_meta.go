@@ -0,0 +1,295 @@
+package pixellock
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+
+	"github.com/Amul-Thantharate/pixellock/pkg/stego"
+)
+
+// The exif method stores the framed payload, base64 encoded, as a property
+// of an XMP packet: in an APP1 segment of a JPEG and in an iTXt chunk of a
+// PNG. Pixels are left alone, and the rest of the file is copied byte for
+// byte, so existing metadata survives.
+
+// xmpNamespace starts the APP1 segment of a JPEG that carries XMP.
+const xmpNamespace = "http://ns.adobe.com/xap/1.0/\x00"
+
+// xmpKeyword is the iTXt keyword of a PNG chunk that carries XMP.
+const xmpKeyword = "XML:com.adobe.xmp"
+
+// xmpPayloadAttr is the XMP property holding the payload.
+const xmpPayloadAttr = `pixellock:Payload="`
+
+const (
+	xmpPacketStart = `<?xpacket begin="` + "\ufeff" + `" id="W5M0MpCehiHzreSzNTczkc9d"?>` +
+		`<x:xmpmeta xmlns:x="adobe:ns:meta/"><rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">` +
+		`<rdf:Description rdf:about="" xmlns:pixellock="https://github.com/Amul-Thantharate/pixellock/ns/1.0/" ` + xmpPayloadAttr
+	xmpPacketEnd = `"/></rdf:RDF></x:xmpmeta><?xpacket end="w"?>`
+)
+
+// jpegAPP0 and jpegAPP1 are the JPEG markers of the JFIF and XMP segments.
+const (
+	jpegAPP0 = 0xe0
+	jpegAPP1 = 0xe1
+)
+
+// maxJPEGSegment is the largest body a JPEG marker segment can hold.
+const maxJPEGSegment = 0xffff - 2
+
+// maxPNGMetadata caps the payload of a PNG, whose chunks could hold far
+// more, at a size metadata readers still load comfortably.
+const maxPNGMetadata = 16 << 20
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// xmpPacket returns an XMP packet carrying data.
+func xmpPacket(data []byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(xmpPacketStart)
+	buf.WriteString(base64.StdEncoding.EncodeToString(data))
+	buf.WriteString(xmpPacketEnd)
+	return buf.Bytes()
+}
+
+// xmpPayload returns the data of a packet written by xmpPacket. ok is false
+// for any other XMP.
+func xmpPayload(packet []byte) (data []byte, ok bool) {
+	i := bytes.Index(packet, []byte(xmpPayloadAttr))
+	if i < 0 {
+		return nil, false
+	}
+	encoded := packet[i+len(xmpPayloadAttr):]
+	end := bytes.IndexByte(encoded, '"')
+	if end < 0 {
+		return nil, false
+	}
+	data, err := base64.StdEncoding.DecodeString(string(encoded[:end]))
+	return data, err == nil
+}
+
+// metadataCapacity returns the largest payload, not counting the stego
+// header, that the metadata of an image in format holds.
+func metadataCapacity(format string) (int, error) {
+	var packet int
+	switch format {
+	case "jpeg":
+		packet = maxJPEGSegment - len(xmpNamespace)
+	case "png":
+		packet = maxPNGMetadata
+	default:
+		return 0, fmt.Errorf("the %s method needs a JPEG or PNG cover, not %s", StegoMethodEXIF, format)
+	}
+	raw := base64.StdEncoding.DecodedLen(packet - len(xmpPacketStart) - len(xmpPacketEnd))
+	return raw - StegoHeaderSize, nil
+}
+
+// jpegMetadataSegments calls fn with the marker, start and end offsets of
+// each segment of the JPEG data before its first scan. It stops when fn
+// returns false.
+func jpegMetadataSegments(data []byte, fn func(marker byte, start, end int) bool) error {
+	if len(data) < 2 || data[0] != 0xff || data[1] != jpegSOI {
+		return fmt.Errorf("not a JPEG file")
+	}
+	pos := 2
+	for pos+4 <= len(data) && data[pos] == 0xff {
+		marker := data[pos+1]
+		if marker == jpegSOS || marker == jpegEOI {
+			return nil
+		}
+		end := pos + 2 + int(binary.BigEndian.Uint16(data[pos+2:]))
+		if end < pos+4 || end > len(data) {
+			return fmt.Errorf("JPEG segment truncated")
+		}
+		if !fn(marker, pos, end) {
+			return nil
+		}
+		pos = end
+	}
+	return nil
+}
+
+// pngChunks calls fn with the type and the start and end offsets of each
+// chunk of the PNG data. It stops when fn returns false.
+func pngChunks(data []byte, fn func(typ string, start, end int) bool) error {
+	if !bytes.HasPrefix(data, pngSignature) {
+		return fmt.Errorf("not a PNG file")
+	}
+	pos := len(pngSignature)
+	for pos+12 <= len(data) {
+		end := pos + 12 + int(binary.BigEndian.Uint32(data[pos:]))
+		if end > len(data) || end < pos {
+			return fmt.Errorf("PNG chunk truncated")
+		}
+		if !fn(string(data[pos+4:pos+8]), pos, end) {
+			return nil
+		}
+		pos = end
+	}
+	return nil
+}
+
+// pngITXt returns the body of an uncompressed iTXt chunk with keyword.
+func pngITXt(keyword string, text []byte) []byte {
+	body := append([]byte(keyword), 0, 0, 0, 0, 0) // Null, no compression, method, empty language and translated keyword
+	return append(body, text...)
+}
+
+// pngChunk returns a complete PNG chunk.
+func pngChunk(typ string, body []byte) []byte {
+	chunk := binary.BigEndian.AppendUint32(nil, uint32(len(body)))
+	chunk = append(chunk, typ...)
+	chunk = append(chunk, body...)
+	return binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+}
+
+// readMetadataPayload returns the framed payload stored by
+// writeMetadataPayload in the JPEG or PNG data, if any.
+func readMetadataPayload(data []byte) (framed []byte, ok bool) {
+	switch {
+	case bytes.HasPrefix(data, pngSignature):
+		pngChunks(data, func(typ string, start, end int) bool {
+			if typ == "iTXt" && bytes.HasPrefix(data[start+8:end-4], []byte(xmpKeyword+"\x00")) {
+				framed, ok = xmpPayload(data[start+8 : end-4])
+			}
+			return !ok
+		})
+	default:
+		jpegMetadataSegments(data, func(marker byte, start, end int) bool {
+			if marker == jpegAPP1 && bytes.HasPrefix(data[start+4:end], []byte(xmpNamespace)) {
+				framed, ok = xmpPayload(data[start+4 : end])
+			}
+			return !ok
+		})
+	}
+	return framed, ok
+}
+
+// writeMetadataPayload returns a copy of the JPEG or PNG data with framed
+// stored in its metadata, replacing any payload stored before. The XMP
+// segment of a JPEG goes after its JFIF header, the iTXt chunk of a PNG
+// right before IEND.
+func writeMetadataPayload(data, framed []byte, format string) ([]byte, error) {
+	packet := xmpPacket(framed)
+	var out bytes.Buffer
+	switch format {
+	case "png":
+		out.Write(pngSignature)
+		err := pngChunks(data, func(typ string, start, end int) bool {
+			if typ == "iTXt" {
+				if _, ok := xmpPayload(data[start+8 : end-4]); ok {
+					return true // Drop the previous payload
+				}
+			}
+			if typ == "IEND" {
+				out.Write(pngChunk("iTXt", pngITXt(xmpKeyword, packet)))
+			}
+			out.Write(data[start:end])
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+		return out.Bytes(), nil
+	case "jpeg":
+		segment := append([]byte{0xff, jpegAPP1, 0, 0}, xmpNamespace...)
+		segment = append(segment, packet...)
+		binary.BigEndian.PutUint16(segment[2:], uint16(len(segment)-2))
+
+		out.Write(data[:2])
+		inserted := false
+		pos := 2
+		err := jpegMetadataSegments(data, func(marker byte, start, end int) bool {
+			if !inserted && marker != jpegAPP0 {
+				out.Write(segment)
+				inserted = true
+			}
+			if marker == jpegAPP1 {
+				if _, ok := xmpPayload(data[start:end]); ok {
+					pos = end
+					return true // Drop the previous payload
+				}
+			}
+			out.Write(data[start:end])
+			pos = end
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+		if !inserted {
+			out.Write(segment)
+		}
+		out.Write(data[pos:])
+		return out.Bytes(), nil
+	default:
+		return nil, fmt.Errorf("the %s method needs a JPEG or PNG cover, not %s", StegoMethodEXIF, format)
+	}
+}
+
+// hideMetadata implements HidePayload for StegoMethodEXIF. The output keeps
+// the container format of the cover.
+func hideMetadata(inputFilename, outputFilename string, p Payload, opts StegoOptions) error {
+	format, err := DetectImageFormat(inputFilename)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(inputFilename)
+	if err != nil {
+		return fmt.Errorf("failed to open image: %w", err)
+	}
+	capacity, err := metadataCapacity(format)
+	if err != nil {
+		return err
+	}
+	framed, err := stego.Frame(p, capacity+StegoHeaderSize, opts.engine()...)
+	if err != nil {
+		return err
+	}
+	out, err := writeMetadataPayload(data, framed, format)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(outputFilename), os.ModeDir|0755) // Ensure output directory exists
+	if err != nil {
+		return fmt.Errorf("failed to create output directory: %w", err)
+	}
+	if err := os.WriteFile(outputFilename, out, 0644); err != nil {
+		return fmt.Errorf("failed to write stego image: %w", err)
+	}
+	return nil
+}
+
+// revealMetadata returns the payload stored in the metadata of the image
+// file read into data. ok is false when the file carries none, in which
+// case the caller should fall back to the pixel methods.
+func revealMetadata(data []byte, opts StegoOptions) (p Payload, ok bool, err error) {
+	framed, ok := readMetadataPayload(data)
+	if !ok {
+		return Payload{}, false, nil
+	}
+	if _, ok := stego.FrameVersion(framed); !ok {
+		return Payload{}, false, nil
+	}
+	read := func(off, n int) []byte {
+		return framed[min(off, len(framed)):min(off+n, len(framed))]
+	}
+	p, err = stego.ReadFrame(read, len(framed), opts.engine()...)
+	return p, true, err
+}
+
+// metadataFileCapacity is the StegoMethodEXIF counterpart of
+// StegoFileCapacity.
+func metadataFileCapacity(filename string) (int, error) {
+	format, err := DetectImageFormat(filename)
+	if err != nil {
+		return 0, err
+	}
+	return metadataCapacity(format)
+}
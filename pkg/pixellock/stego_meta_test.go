@@ -0,0 +1,98 @@
+package pixellock
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMetadataRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	pngCover := filepath.Join(dir, "cover.png")
+	if err := SaveImage(pngCover, newTestNRGBA(24, 24), SaveOptions{Format: "png"}); err != nil {
+		t.Fatalf("SaveImage failed: %v", err)
+	}
+	jpegCover := filepath.Join(dir, "cover.jpg")
+	if err := os.WriteFile(jpegCover, photoCover(t, 85), 0o644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+
+	opts := StegoOptions{Density: 1, Method: StegoMethodEXIF, Password: "meta", Compress: true}
+	message := bytes.Repeat([]byte("only in the metadata "), 50)
+	for _, cover := range []string{pngCover, jpegCover} {
+		output := filepath.Join(dir, "stego_"+filepath.Base(cover))
+		if err := HidePayload(cover, output, Payload{Data: message}, opts, "png"); err != nil {
+			t.Fatalf("%s: HidePayload failed: %v", cover, err)
+		}
+		// Hiding again replaces the payload rather than adding another.
+		if err := HidePayload(output, output, Payload{Data: message}, opts, "png"); err != nil {
+			t.Fatalf("%s: HidePayload over a stego image failed: %v", cover, err)
+		}
+
+		got, err := RevealPayload(output, StegoOptions{Density: 1, Password: "meta"})
+		if err != nil {
+			t.Fatalf("%s: RevealPayload failed: %v", cover, err)
+		}
+		if !bytes.Equal(got.Data, message) {
+			t.Errorf("%s: metadata payload did not round trip", cover)
+		}
+		if _, err := RevealPayload(output, DefaultStegoOptions); err == nil {
+			t.Errorf("%s: encrypted payload revealed without the password", cover)
+		}
+
+		// The file still decodes, in its own format, to the same pixels.
+		want, wantFormat := decodeFile(t, cover)
+		img, format := decodeFile(t, output)
+		if format != wantFormat {
+			t.Errorf("%s: stego image is %s, want %s", cover, format, wantFormat)
+		}
+		if !bytes.Equal(toNRGBA(img).Pix, toNRGBA(want).Pix) {
+			t.Errorf("%s: pixels changed", cover)
+		}
+
+		data, _ := os.ReadFile(output)
+		if n := bytes.Count(data, []byte(xmpPayloadAttr)); n != 1 {
+			t.Errorf("%s: %d payloads stored, want 1", cover, n)
+		}
+	}
+}
+
+func decodeFile(t *testing.T, path string) (image.Image, string) {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer f.Close()
+	img, format, err := image.Decode(f)
+	if err != nil {
+		t.Fatalf("%s does not decode: %v", path, err)
+	}
+	return img, format
+}
+
+func TestMetadataCapacity(t *testing.T) {
+	dir := t.TempDir()
+	cover := filepath.Join(dir, "cover.jpg")
+	if err := os.WriteFile(cover, photoCover(t, 85), 0o644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	opts := StegoOptions{Density: 1, Method: StegoMethodEXIF}
+	capacity, err := StegoFileCapacity(cover, opts)
+	if err != nil {
+		t.Fatalf("StegoFileCapacity failed: %v", err)
+	}
+
+	output := filepath.Join(dir, "stego.jpg")
+	if err := HidePayload(cover, output, Payload{Data: make([]byte, capacity)}, opts, "jpg"); err != nil {
+		t.Fatalf("HidePayload at capacity failed: %v", err)
+	}
+	decodeFile(t, output) // A full APP1 segment still leaves a valid JPEG
+	err = HidePayload(cover, output, Payload{Data: make([]byte, capacity+1)}, opts, "jpg")
+	if !errors.Is(err, ErrPayloadTooLarge) {
+		t.Errorf("HidePayload over capacity error = %v, want ErrPayloadTooLarge", err)
+	}
+}
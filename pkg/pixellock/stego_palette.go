@@ -0,0 +1,304 @@
+package pixellock
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+
+	"github.com/Amul-Thantharate/pixellock/pkg/stego"
+)
+
+// maxPaletteSwapDistance is the largest squared RGB distance between two
+// palette colors a pixel may be moved between, about 24 levels in each
+// channel. Farther swaps would show as speckles, so indices without a
+// close enough partner carry no bits.
+const maxPaletteSwapDistance = 3 * 24 * 24
+
+// paletteCover is an indexed image prepared for embedding: the frames of a
+// GIF, or a single paletted PNG. Every frame keeps its palette: a payload
+// bit is the low bit of a pixel's palette index, and a pixel whose index
+// has the wrong parity is moved to the nearest color of the palette whose
+// index has the right one. swaps holds that color for each index of each
+// frame, or -1 where the index cannot carry a bit.
+type paletteCover struct {
+	frames []*image.Paletted
+	swaps  [][]int
+}
+
+// newPaletteCover prepares frames for embedding. An index carries bits when
+// its color is not transparent and the palette has another opaque color of
+// the other parity close to it. Both depend on the palette alone, which
+// embedding never changes, so reveal finds the same pixels.
+func newPaletteCover(frames []*image.Paletted) *paletteCover {
+	c := &paletteCover{frames: frames, swaps: make([][]int, len(frames))}
+	for i, frame := range frames {
+		c.swaps[i] = paletteSwaps(frame.Palette)
+	}
+	return c
+}
+
+// paletteSwaps returns, for each color of p, the index of the nearest opaque
+// color whose index has the other parity, or -1 for transparent colors and
+// when no such color is within maxPaletteSwapDistance. The relation is
+// symmetric enough for reveal: a color with a partner is itself within
+// reach of that partner, so swapped pixels still carry bits.
+func paletteSwaps(p color.Palette) []int {
+	swaps := make([]int, len(p))
+	for i, ci := range p {
+		swaps[i] = -1
+		if opaque(ci) {
+			best := -1
+			for j := (i + 1) % 2; j < len(p); j += 2 {
+				if opaque(p[j]) && (best < 0 || colorDistance(ci, p[j]) < colorDistance(ci, p[best])) {
+					best = j
+				}
+			}
+			if best >= 0 && colorDistance(ci, p[best]) <= maxPaletteSwapDistance {
+				swaps[i] = best
+			}
+		}
+	}
+	return swaps
+}
+
+func opaque(c color.Color) bool {
+	_, _, _, a := c.RGBA()
+	return a != 0
+}
+
+// colorDistance returns the squared RGB distance between a and b.
+func colorDistance(a, b color.Color) int {
+	ar, ag, ab, _ := a.RGBA()
+	br, bg, bb, _ := b.RGBA()
+	dr, dg, db := int(ar>>8)-int(br>>8), int(ag>>8)-int(bg>>8), int(ab>>8)-int(bb>>8)
+	return dr*dr + dg*dg + db*db
+}
+
+// pixels calls fn with each pixel of c that can carry a payload bit, along
+// with the swaps of its frame, in embedding order: frames in order, then
+// pixels in raster order. It stops when fn returns false.
+func (c *paletteCover) pixels(fn func(index *uint8, swaps []int) bool) {
+	for i, frame := range c.frames {
+		swaps := c.swaps[i]
+		b := frame.Bounds()
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			row := frame.Pix[frame.PixOffset(b.Min.X, y) : frame.PixOffset(b.Min.X, y)+b.Dx()]
+			for x := range row {
+				if int(row[x]) < len(swaps) && swaps[row[x]] >= 0 && !fn(&row[x], swaps) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// rawCapacity returns how many whole bytes, header included, fit in c.
+func (c *paletteCover) rawCapacity() int {
+	n := 0
+	c.pixels(func(*uint8, []int) bool { n++; return true })
+	return n / 8
+}
+
+// capacity is the indexed counterpart of StegoCapacity.
+func (c *paletteCover) capacity() int {
+	raw := c.rawCapacity()
+	if raw < StegoHeaderSize {
+		return 0
+	}
+	return raw - StegoHeaderSize
+}
+
+// embed writes data MSB-first into the index parity of the usable pixels
+// of c and returns the number of bytes written.
+func (c *paletteCover) embed(data []byte) int {
+	bit := 0
+	c.pixels(func(index *uint8, swaps []int) bool {
+		if bit == len(data)*8 {
+			return false
+		}
+		if *index&1 != data[bit/8]>>(7-bit%8)&1 {
+			*index = uint8(swaps[*index])
+		}
+		bit++
+		return true
+	})
+	return bit / 8
+}
+
+// extract reads n bytes starting at byte offset off, reversing embed.
+// Fewer bytes are returned if the pixels run out first.
+func (c *paletteCover) extract(off, n int) []byte {
+	out := make([]byte, 0, n)
+	var by byte
+	bit := 0
+	c.pixels(func(index *uint8, _ []int) bool {
+		if bit >= off*8 {
+			by = by<<1 | *index&1
+			if (bit+1)%8 == 0 {
+				out = append(out, by)
+				if len(out) == n {
+					return false
+				}
+			}
+		}
+		bit++
+		return true
+	})
+	return out
+}
+
+// payloadVersion returns the format version of the stego header c starts
+// with, and whether it starts with one.
+func (c *paletteCover) payloadVersion() (int, bool) {
+	return stego.FrameVersion(c.extract(0, stego.FramePrefixSize))
+}
+
+// hasPayload reports whether c starts with a pixellock stego header.
+func (c *paletteCover) hasPayload() bool {
+	_, ok := c.payloadVersion()
+	return ok
+}
+
+// hideInPalette embeds p across the frames of c behind the same stego
+// header used for pixels.
+func hideInPalette(c *paletteCover, p Payload, opts StegoOptions) error {
+	if opts.Scatter {
+		return fmt.Errorf("scatter is not supported for indexed covers")
+	}
+	if opts.Adaptive {
+		return fmt.Errorf("adaptive embedding is not supported for indexed covers")
+	}
+	if opts.hasRegions() {
+		return fmt.Errorf("regions are not supported for indexed covers")
+	}
+	framed, err := stego.Frame(p, c.rawCapacity(), opts.engine()...)
+	if err != nil {
+		return err
+	}
+	c.embed(framed)
+	return nil
+}
+
+// revealFromPalette extracts a payload hidden by hideInPalette.
+func revealFromPalette(c *paletteCover, opts StegoOptions) (Payload, error) {
+	if !c.hasPayload() {
+		return Payload{}, ErrNoPayload
+	}
+	return stego.ReadFrame(c.extract, c.rawCapacity(), opts.engine()...)
+}
+
+// loadPalettedPNG decodes the PNG at filename. ok is false when the file is
+// not a PNG or not an indexed one.
+func loadPalettedPNG(filename string) (img *image.Paletted, ok bool, err error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to open image: %w", err)
+	}
+	return decodePalettedPNG(data)
+}
+
+// decodePalettedPNG is loadPalettedPNG for the image file read into data.
+func decodePalettedPNG(data []byte) (img *image.Paletted, ok bool, err error) {
+	if !bytes.HasPrefix(data, pngSignature) {
+		return nil, false, nil
+	}
+	decoded, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to decode image: %w", err)
+	}
+	img, ok = decoded.(*image.Paletted)
+	return img, ok, nil
+}
+
+// loadPaletteCover prepares the indexed image at filename, every frame of a
+// GIF or a paletted PNG. ok is false for any other image.
+func loadPaletteCover(filename string) (c *paletteCover, ok bool, err error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to open image: %w", err)
+	}
+	return decodePaletteCover(data)
+}
+
+// decodePaletteCover is loadPaletteCover for the image file read into data.
+func decodePaletteCover(data []byte) (c *paletteCover, ok bool, err error) {
+	if g, ok, err := decodeGIF(data); ok || err != nil {
+		if err != nil {
+			return nil, true, err
+		}
+		return newPaletteCover(g.Image), true, nil
+	}
+	img, ok, err := decodePalettedPNG(data)
+	if !ok || err != nil {
+		return nil, false, err
+	}
+	return newPaletteCover([]*image.Paletted{img}), true, nil
+}
+
+// hidePalette implements HidePayload for StegoMethodPalette. The output
+// keeps the format of the cover, which must be a GIF or an indexed PNG,
+// along with its palettes and, for PNGs, its bit depth.
+func hidePalette(inputFilename, outputFilename string, p Payload, opts StegoOptions) error {
+	if _, isGIF, err := loadGIF(inputFilename); err != nil || isGIF {
+		if err != nil {
+			return err
+		}
+		return hideGIF(inputFilename, outputFilename, p, opts)
+	}
+	img, ok, err := loadPalettedPNG(inputFilename)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("the %s method needs a GIF or indexed PNG cover; %s is neither", StegoMethodPalette, inputFilename)
+	}
+	if err := hideInPalette(newPaletteCover([]*image.Paletted{img}), p, opts); err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return fmt.Errorf("failed to encode stego image: %w", err)
+	}
+	err = os.MkdirAll(filepath.Dir(outputFilename), os.ModeDir|0755) // Ensure output directory exists
+	if err != nil {
+		return fmt.Errorf("failed to create output directory: %w", err)
+	}
+	if err := os.WriteFile(outputFilename, buf.Bytes(), 0644); err != nil {
+		return fmt.Errorf("failed to write stego image: %w", err)
+	}
+	return nil
+}
+
+// revealPalette returns the payload hidden in the palette indices of the
+// GIF or indexed PNG file read into data. ok is false when it is not such
+// an image carrying a payload, in which case the caller should fall back to
+// the LSB method.
+func revealPalette(data []byte, opts StegoOptions) (p Payload, ok bool, err error) {
+	c, indexed, err := decodePaletteCover(data)
+	if err != nil || !indexed {
+		return Payload{}, false, err
+	}
+	if !c.hasPayload() {
+		return Payload{}, false, nil
+	}
+	p, err = revealFromPalette(c, opts)
+	return p, true, err
+}
+
+// paletteFileCapacity is the StegoMethodPalette counterpart of
+// StegoFileCapacity.
+func paletteFileCapacity(filename string) (int, error) {
+	c, ok, err := loadPaletteCover(filename)
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		return 0, fmt.Errorf("the %s method needs a GIF or indexed PNG cover; %s is neither", StegoMethodPalette, filename)
+	}
+	return c.capacity(), nil
+}
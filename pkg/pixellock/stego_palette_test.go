@@ -0,0 +1,130 @@
+package pixellock
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// palettedPNG writes an indexed PNG using palette, with every pixel set
+// from a pattern over all of its colors, and returns its path.
+func palettedPNG(t *testing.T, palette color.Palette) string {
+	t.Helper()
+	img := image.NewPaletted(image.Rect(0, 0, 48, 40), palette)
+	for i := range img.Pix {
+		img.Pix[i] = uint8((i*7 + i/48) % len(palette))
+	}
+	path := filepath.Join(t.TempDir(), "cover.png")
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatalf("png.Encode failed: %v", err)
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	return path
+}
+
+// gradientPalette returns n shades in pairs of near colors.
+func gradientPalette(n int) color.Palette {
+	var p color.Palette
+	for i := 0; i < n; i++ {
+		v := uint8(i / 2 * (256 / n) * 2)
+		if i%2 == 1 {
+			v += 4
+		}
+		p = append(p, color.NRGBA{v, 255 - v, v / 2, 255})
+	}
+	return p
+}
+
+// pngBitDepth returns the bit depth recorded in the IHDR chunk of a PNG.
+func pngBitDepth(t *testing.T, path string) byte {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	return data[len(pngSignature)+8+8]
+}
+
+func TestPaletteRoundTrip(t *testing.T) {
+	for _, colors := range []int{16, 256} {
+		input := palettedPNG(t, gradientPalette(colors))
+		output := filepath.Join(t.TempDir(), "stego.png")
+		message := bytes.Repeat([]byte("indexed "), 20)
+		opts := StegoOptions{Density: 1, Method: StegoMethodPalette, Password: "palette"}
+		if err := HidePayload(input, output, Payload{Data: message}, opts, "png"); err != nil {
+			t.Fatalf("%d colors: HidePayload failed: %v", colors, err)
+		}
+
+		got, err := RevealPayload(output, StegoOptions{Density: 1, Password: "palette"})
+		if err != nil {
+			t.Fatalf("%d colors: RevealPayload failed: %v", colors, err)
+		}
+		if !bytes.Equal(got.Data, message) {
+			t.Errorf("%d colors: palette payload did not round trip", colors)
+		}
+
+		img, _ := decodeFile(t, output)
+		stego, ok := img.(*image.Paletted)
+		if !ok {
+			t.Fatalf("%d colors: stego image is %T, want indexed", colors, img)
+		}
+		if len(stego.Palette) != colors {
+			t.Errorf("%d colors: stego palette has %d colors", colors, len(stego.Palette))
+		}
+		if got, want := pngBitDepth(t, output), pngBitDepth(t, input); got != want {
+			t.Errorf("%d colors: bit depth %d, want %d", colors, got, want)
+		}
+	}
+}
+
+func TestPaletteCapacityWithoutClosePairs(t *testing.T) {
+	// Black and white, twice over: no color has a near one of the other
+	// parity.
+	far := color.Palette{color.Black, color.White, color.Gray{0}, color.Gray{255}}
+	input := palettedPNG(t, far)
+	capacity, err := StegoFileCapacity(input, StegoOptions{Density: 1, Method: StegoMethodPalette})
+	if err != nil {
+		t.Fatalf("StegoFileCapacity failed: %v", err)
+	}
+	if capacity != 0 {
+		t.Errorf("capacity = %d, want 0 for a palette without close pairs", capacity)
+	}
+	output := filepath.Join(t.TempDir(), "stego.png")
+	err = HidePayload(input, output, Payload{Data: []byte("hi")}, StegoOptions{Density: 1, Method: StegoMethodPalette}, "png")
+	if !errors.Is(err, ErrPayloadTooLarge) {
+		t.Errorf("HidePayload error = %v, want ErrPayloadTooLarge", err)
+	}
+
+	// Half the colors have a partner, so about half the pixels carry bits.
+	mixed := color.Palette{color.Black, color.White, color.Gray{120}, color.Gray{124}}
+	partial, err := StegoFileCapacity(palettedPNG(t, mixed), StegoOptions{Density: 1, Method: StegoMethodPalette})
+	if err != nil {
+		t.Fatalf("StegoFileCapacity failed: %v", err)
+	}
+	full, _ := StegoFileCapacity(palettedPNG(t, gradientPalette(4)), StegoOptions{Density: 1, Method: StegoMethodPalette})
+	if partial <= 0 || partial >= full*3/4 {
+		t.Errorf("capacity with half the colors paired = %d, want about half of %d", partial, full)
+	}
+}
+
+func TestPaletteNeedsIndexedCover(t *testing.T) {
+	input := filepath.Join(t.TempDir(), "cover.png")
+	if err := SaveImage(input, newTestNRGBA(16, 16), SaveOptions{Format: "png"}); err != nil {
+		t.Fatalf("SaveImage failed: %v", err)
+	}
+	opts := StegoOptions{Density: 1, Method: StegoMethodPalette}
+	if _, err := StegoFileCapacity(input, opts); err == nil {
+		t.Error("StegoFileCapacity accepted a true-color cover")
+	}
+	if err := HidePayload(input, filepath.Join(t.TempDir(), "out.png"), Payload{Data: []byte("hi")}, opts, "png"); err == nil {
+		t.Error("HidePayload accepted a true-color cover")
+	}
+}
@@ -0,0 +1,22 @@
+package pixellock
+
+import (
+	"fmt"
+	"image"
+
+	"github.com/Amul-Thantharate/pixellock/pkg/stego"
+)
+
+// ParseStegoRegion parses a rectangle written as x,y,width,height, for
+// StegoOptions.Regions and ExcludeRegions.
+func ParseStegoRegion(s string) (image.Rectangle, error) {
+	return stego.ParseRegion(s)
+}
+
+// regionRectSize is the encoded size of one rectangle in a region record.
+const regionRectSize = 4 * 2
+
+// regionString formats r the way ParseStegoRegion reads it.
+func regionString(r image.Rectangle) string {
+	return fmt.Sprintf("%d,%d,%d,%d", r.Min.X, r.Min.Y, r.Dx(), r.Dy())
+}
@@ -0,0 +1,31 @@
+package pixellock
+
+import (
+	"image"
+	"path/filepath"
+	"testing"
+)
+
+func TestRegionErrors(t *testing.T) {
+	for _, s := range []string{"1,2,3", "1,2,0,4", "a,2,3,4", "-1,2,3,4"} {
+		if _, err := ParseStegoRegion(s); err == nil {
+			t.Errorf("ParseStegoRegion(%q) succeeded", s)
+		}
+	}
+	if r, err := ParseStegoRegion("5, 6,7,8"); err != nil || r != image.Rect(5, 6, 12, 14) {
+		t.Errorf("ParseStegoRegion = %v, %v", r, err)
+	}
+
+	region := []image.Rectangle{image.Rect(0, 0, 32, 32)}
+	opts := StegoOptions{Density: 1, Password: "pw", Scatter: true, Regions: region}
+	if err := opts.Validate(); err == nil {
+		t.Error("Validate accepted regions with scatter")
+	}
+	input := filepath.Join(t.TempDir(), "cover.png")
+	if err := SaveImage(input, newTestNRGBA(16, 16), SaveOptions{Format: "png"}); err != nil {
+		t.Fatalf("SaveImage failed: %v", err)
+	}
+	if _, err := StegoFileCapacity(input, StegoOptions{Density: 1, Regions: region}); err == nil {
+		t.Error("StegoFileCapacity accepted a region outside the image")
+	}
+}
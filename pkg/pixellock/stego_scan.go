@@ -0,0 +1,30 @@
+package pixellock
+
+import (
+	"image"
+
+	"github.com/Amul-Thantharate/pixellock/pkg/stego"
+)
+
+// Layouts a StegoScanCandidate can be found in; see package stego.
+const (
+	StegoScanHeader     = stego.ScanHeader
+	StegoScanTerminated = stego.ScanTerminated
+	StegoScanLegacy     = stego.ScanLegacy
+)
+
+// DefaultScanMinText is the share of printable bytes a candidate without a
+// pixellock header needs by default.
+const DefaultScanMinText = stego.DefaultScanMinText
+
+// StegoScanOptions controls ScanStego.
+type StegoScanOptions = stego.ScanOptions
+
+// StegoScanCandidate is a possible payload found by ScanStego.
+type StegoScanCandidate = stego.ScanCandidate
+
+// ScanStego searches img for payloads hidden with unknown parameters; see
+// stego.Scan.
+func ScanStego(img image.Image, opts StegoScanOptions) []StegoScanCandidate {
+	return stego.Scan(img, opts)
+}
@@ -0,0 +1,122 @@
+package pixellock
+
+import (
+	"fmt"
+	"image"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/Amul-Thantharate/pixellock/pkg/stego"
+)
+
+// ErrMissingFragment is returned when a split payload cannot be reassembled
+// because some of its fragments were not supplied.
+var ErrMissingFragment = stego.ErrMissingFragment
+
+// StegoImagePaths expands pattern into a sorted list of image files. A
+// directory yields the images directly inside it; anything else is treated
+// as a glob pattern.
+func StegoImagePaths(pattern string) ([]string, error) {
+	var paths []string
+	if info, err := os.Stat(pattern); err == nil && info.IsDir() {
+		entries, err := os.ReadDir(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read directory: %w", err)
+		}
+		for _, entry := range entries {
+			path := filepath.Join(pattern, entry.Name())
+			if !entry.IsDir() && isImageFile(path) {
+				paths = append(paths, path)
+			}
+		}
+	} else {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+		paths = matches
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no images found for %s", pattern)
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// HideSplit hides p across as many of covers as it needs, in order, and
+// saves the stego images into outputDir. Each output is named after its
+// fragment number and cover, for example 002_beach.png. It returns the
+// paths written.
+func HideSplit(covers []string, outputDir string, p Payload, opts StegoOptions, outputFormat string) ([]string, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	if opts.Method == StegoMethodDCT {
+		return nil, fmt.Errorf("splitting a payload is not supported with the %s method", StegoMethodDCT)
+	}
+	if strings.EqualFold(outputFormat, "gif") {
+		return nil, fmt.Errorf("a split payload cannot be hidden in GIFs")
+	}
+	if err := checkStegoOutputFormat(outputFormat, opts); err != nil {
+		return nil, err
+	}
+
+	images := make([]image.Image, len(covers))
+	for i, cover := range covers {
+		img, err := loadStegoCover(cover)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", cover, err)
+		}
+		images[i] = img
+		if err := checkStegoCoverAlpha(images[i], outputFormat); err != nil {
+			return nil, fmt.Errorf("%s: %w", cover, err)
+		}
+	}
+	// All covers share one channel layout, so grayscale ones are saved in
+	// color
+	stegoImgs, used, err := stego.EmbedSplit(images, p, opts.engine()...)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(outputDir, os.ModeDir|0755); err != nil {
+		return nil, fmt.Errorf("failed to create output directory: %w", err)
+	}
+	var written []string
+	for i, c := range used {
+		cover := covers[c]
+		base := strings.TrimSuffix(filepath.Base(cover), filepath.Ext(cover))
+		outputFilename := filepath.Join(outputDir, fmt.Sprintf("%03d_%s.%s", i+1, base, ImageFormatExtension(outputFormat)))
+		if err := SaveImage(outputFilename, stegoImgs[i], opts.saveOptions(outputFormat)); err != nil {
+			return written, fmt.Errorf("failed to encode stego image: %w", err)
+		}
+		written = append(written, outputFilename)
+	}
+	return written, nil
+}
+
+// RevealSplit reassembles a payload split by HideSplit from its stego
+// images, given in any order. It fails with ErrMissingFragment, naming the
+// missing fragments, when the set is incomplete.
+func RevealSplit(inputs []string, opts StegoOptions) (Payload, error) {
+	if len(inputs) == 0 {
+		return Payload{}, fmt.Errorf("no stego images given")
+	}
+	var fragments []Payload
+	for _, input := range inputs {
+		p, err := revealImageFile(input, opts)
+		if err != nil {
+			return Payload{}, fmt.Errorf("%s: %w", input, err)
+		}
+		if _, _, ok := p.Fragment(); !ok {
+			if len(inputs) == 1 {
+				return p, nil
+			}
+			return Payload{}, fmt.Errorf("%s does not hold a fragment of a split payload", input)
+		}
+		fragments = append(fragments, p)
+	}
+	return stego.Assemble(fragments, opts.engine()...)
+}
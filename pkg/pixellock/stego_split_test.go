@@ -0,0 +1,69 @@
+package pixellock
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestHideRevealSplit(t *testing.T) {
+	dir := t.TempDir()
+	var covers []string
+	for i, size := range []int{34, 6, 40} {
+		cover := filepath.Join(dir, string(rune('a'+i))+".png")
+		if err := SaveImage(cover, newTestNRGBA(size, size), SaveOptions{Format: "png"}); err != nil {
+			t.Fatalf("SaveImage failed: %v", err)
+		}
+		covers = append(covers, cover)
+	}
+	p := Payload{Data: bytes.Repeat(binaryFixture(), 3)[:750], Filename: "archive.tar"}
+	outputs, err := HideSplit(covers, filepath.Join(dir, "out"), p, DefaultStegoOptions, "png")
+	if err != nil {
+		t.Fatalf("HideSplit failed: %v", err)
+	}
+	// The 6x6 cover is too small for a fragment and is skipped.
+	want := []string{filepath.Join(dir, "out", "001_a.png"), filepath.Join(dir, "out", "002_c.png")}
+	if !slices.Equal(outputs, want) {
+		t.Fatalf("HideSplit wrote %v, want %v", outputs, want)
+	}
+
+	got, err := RevealSplit([]string{outputs[1], outputs[0]}, DefaultStegoOptions)
+	if err != nil {
+		t.Fatalf("RevealSplit failed: %v", err)
+	}
+	if got.Filename != p.Filename || !bytes.Equal(got.Data, p.Data) {
+		t.Error("split payload did not round trip")
+	}
+	if _, err := RevealSplit(outputs[1:], DefaultStegoOptions); !errors.Is(err, ErrMissingFragment) {
+		t.Errorf("RevealSplit of an incomplete set error = %v, want ErrMissingFragment", err)
+	}
+}
+
+func TestStegoImagePaths(t *testing.T) {
+	tempDir := t.TempDir()
+	for _, name := range []string{"b.png", "a.png"} {
+		if err := SaveImage(filepath.Join(tempDir, name), newTestNRGBA(4, 4), SaveOptions{Format: "png"}); err != nil {
+			t.Fatalf("SaveImage failed: %v", err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(tempDir, "notes.txt"), []byte("not an image"), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+
+	want := []string{filepath.Join(tempDir, "a.png"), filepath.Join(tempDir, "b.png")}
+	for _, pattern := range []string{tempDir, filepath.Join(tempDir, "*.png")} {
+		got, err := StegoImagePaths(pattern)
+		if err != nil {
+			t.Fatalf("StegoImagePaths(%q) failed: %v", pattern, err)
+		}
+		if !slices.Equal(got, want) {
+			t.Errorf("StegoImagePaths(%q) = %v, want %v", pattern, got, want)
+		}
+	}
+	if _, err := StegoImagePaths(filepath.Join(tempDir, "*.gif")); err == nil {
+		t.Error("StegoImagePaths accepted a pattern matching nothing")
+	}
+}
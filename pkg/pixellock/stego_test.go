@@ -0,0 +1,300 @@
+package pixellock
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Amul-Thantharate/pixellock/pkg/stego"
+)
+
+func newTestNRGBA(w, h int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{uint8(x * 7), uint8(y * 13), uint8(x + y), 255})
+		}
+	}
+	return img
+}
+
+// hideInImage embeds p into img in place, as HidePayload does to a decoded
+// cover.
+func hideInImage(img *image.NRGBA, p Payload, opts StegoOptions) error {
+	stegoImg, err := stego.EmbedPayload(img, p, opts.engine()...)
+	if err != nil {
+		return err
+	}
+	draw.Draw(img, img.Bounds(), stegoImg, img.Bounds().Min, draw.Src)
+	return nil
+}
+
+// revealFromImage extracts the payload hidden in img by hideInImage.
+func revealFromImage(img image.Image, opts StegoOptions) (Payload, error) {
+	return stego.ExtractPayload(img, opts.engine()...)
+}
+
+func TestHidePayloadRefusesLossyFormat(t *testing.T) {
+	tempDir := t.TempDir()
+	in := filepath.Join(tempDir, "cover.png")
+	out := filepath.Join(tempDir, "stego.jpg")
+	if err := SaveImage(in, newTestNRGBA(64, 64), SaveOptions{Format: "png"}); err != nil {
+		t.Fatalf("SaveImage failed: %v", err)
+	}
+	payload := Payload{Data: []byte("this will not survive JPEG")}
+
+	for _, format := range []string{"jpg", "JPEG"} {
+		err := HidePayload(in, out, payload, DefaultStegoOptions, format)
+		if !errors.Is(err, ErrLossyFormat) {
+			t.Errorf("HidePayload(%s) error = %v, want ErrLossyFormat", format, err)
+		}
+	}
+	if _, err := os.Stat(out); !os.IsNotExist(err) {
+		t.Errorf("refused hide still wrote %s", out)
+	}
+
+	// Forcing the lossy format demonstrates the failure mode being guarded.
+	opts := DefaultStegoOptions
+	opts.AllowLossy = true
+	if err := HidePayload(in, out, payload, opts, "jpg"); err != nil {
+		t.Fatalf("HidePayload with AllowLossy failed: %v", err)
+	}
+	if format, err := DetectImageFormat(out); err != nil || format != "jpeg" {
+		t.Errorf("DetectImageFormat = %q, %v; want jpeg", format, err)
+	}
+	got, err := RevealPayload(out, DefaultStegoOptions)
+	if err == nil && bytes.Equal(got.Data, payload.Data) {
+		t.Error("payload unexpectedly survived JPEG compression")
+	}
+}
+
+// TestHidePayloadTo hides in memory and checks that the stego image is the
+// one HidePayload writes, and that what needs a cover file is refused.
+func TestHidePayloadTo(t *testing.T) {
+	tempDir := t.TempDir()
+	in, out := filepath.Join(tempDir, "cover.png"), filepath.Join(tempDir, "stego.png")
+	if err := SaveImage(in, newTestNRGBA(64, 64), SaveOptions{Format: "png"}); err != nil {
+		t.Fatalf("SaveImage failed: %v", err)
+	}
+	cover, _ := os.ReadFile(in)
+	payload := Payload{Data: []byte("hidden in memory"), Filename: "memo.txt"}
+	opts := StegoOptions{Density: 2}
+
+	var buf bytes.Buffer
+	if err := HidePayloadTo(&buf, bytes.NewReader(cover), payload, opts, "png"); err != nil {
+		t.Fatalf("HidePayloadTo failed: %v", err)
+	}
+	if err := HidePayload(in, out, payload, opts, "png"); err != nil {
+		t.Fatalf("HidePayload failed: %v", err)
+	}
+	if want, _ := os.ReadFile(out); !bytes.Equal(buf.Bytes(), want) {
+		t.Error("HidePayloadTo wrote another image than HidePayload")
+	}
+	got, err := RevealPayloadFrom(&buf, opts)
+	if err != nil || !bytes.Equal(got.Data, payload.Data) || got.Filename != payload.Filename {
+		t.Errorf("RevealPayloadFrom = %q %q, %v", got.Data, got.Filename, err)
+	}
+
+	for name, err := range map[string]error{
+		"not an image": HidePayloadTo(io.Discard, strings.NewReader("not an image"), payload, opts, "png"),
+		"lossy":        HidePayloadTo(io.Discard, bytes.NewReader(cover), payload, opts, "jpg"),
+		"gif":          HidePayloadTo(io.Discard, bytes.NewReader(cover), payload, opts, "gif"),
+		"dct":          HidePayloadTo(io.Discard, bytes.NewReader(cover), payload, StegoOptions{Density: 1, Method: StegoMethodDCT}, "png"),
+	} {
+		if err == nil {
+			t.Errorf("%s: HidePayloadTo succeeded", name)
+		}
+	}
+	if err := HidePayloadTo(io.Discard, strings.NewReader("not an image"), payload, opts, "png"); !errors.Is(err, ErrUnsupportedFormat) {
+		t.Errorf("HidePayloadTo of text = %v, want ErrUnsupportedFormat", err)
+	}
+}
+
+func TestHidePayloadBMP(t *testing.T) {
+	tempDir := t.TempDir()
+	in := filepath.Join(tempDir, "cover.png")
+	out := filepath.Join(tempDir, "stego.bmp")
+	if err := SaveImage(in, newTestNRGBA(64, 64), SaveOptions{Format: "png"}); err != nil {
+		t.Fatalf("SaveImage failed: %v", err)
+	}
+	payload := Payload{Data: []byte("kept in a bitmap")}
+	if err := HidePayload(in, out, payload, StegoOptions{Density: 2, Password: "pw"}, "bmp"); err != nil {
+		t.Fatalf("HidePayload failed: %v", err)
+	}
+	got, err := RevealPayload(out, StegoOptions{Password: "pw"})
+	if err != nil || !bytes.Equal(got.Data, payload.Data) {
+		t.Errorf("RevealPayload = %q, %v", got.Data, err)
+	}
+
+	// BMP reads back every pixel opaque, losing alpha payload bits and the
+	// transparency the layout follows.
+	if err := HidePayload(in, out, payload, StegoOptions{Density: 1, Channels: ChannelsRGBA}, "bmp"); err == nil {
+		t.Error("HidePayload hid in the alpha channel of a BMP")
+	}
+	transparent := filepath.Join(tempDir, "transparent.png")
+	if err := SaveImage(transparent, newTransparentNRGBA(64, 64), SaveOptions{Format: "png"}); err != nil {
+		t.Fatalf("SaveImage failed: %v", err)
+	}
+	if err := HidePayload(transparent, out, payload, StegoOptions{Density: 1}, "bmp"); err == nil {
+		t.Error("HidePayload accepted a transparent cover for a BMP")
+	}
+}
+
+func TestHidePayloadRefuses16BitCover(t *testing.T) {
+	tempDir := t.TempDir()
+	out := filepath.Join(tempDir, "stego.png")
+	for name, img := range deepTestImages() {
+		in := filepath.Join(tempDir, name+".png")
+		if err := SaveImage(in, img, SaveOptions{Format: "png"}); err != nil {
+			t.Fatalf("SaveImage failed: %v", err)
+		}
+		err := HidePayload(in, out, Payload{Data: []byte("deep")}, DefaultStegoOptions, "png")
+		if !errors.Is(err, Err16BitCover) {
+			t.Errorf("%s: HidePayload error = %v, want Err16BitCover", name, err)
+		}
+	}
+	if _, err := os.Stat(out); !os.IsNotExist(err) {
+		t.Errorf("refused hide still wrote %s", out)
+	}
+}
+
+// TestHidePayloadGrayCover hides in the gray values of a grayscale cover,
+// which must stay grayscale and about its size rather than become RGBA.
+func TestHidePayloadGrayCover(t *testing.T) {
+	tempDir := t.TempDir()
+	in := filepath.Join(tempDir, "cover.png")
+	out := filepath.Join(tempDir, "stego.png")
+	if err := SaveImage(in, grayTestImage(200, 150), SaveOptions{Format: "png"}); err != nil {
+		t.Fatalf("SaveImage failed: %v", err)
+	}
+	opts := StegoOptions{Density: 2, Password: "pw"}
+	capacity, err := StegoFileCapacity(in, opts)
+	if err != nil {
+		t.Fatalf("StegoFileCapacity failed: %v", err)
+	}
+	rgb := opts
+	rgb.Channels = ChannelR
+	if want := StegoCapacity(newTestNRGBA(200, 150), rgb); capacity != want {
+		t.Errorf("StegoFileCapacity = %d, want the gray channel's %d", capacity, want)
+	}
+	payload := Payload{Data: bytes.Repeat([]byte("gray"), capacity/8)}
+	if err := HidePayload(in, out, payload, opts, "png"); err != nil {
+		t.Fatalf("HidePayload failed: %v", err)
+	}
+	stego, err := LoadImage(out)
+	if err != nil {
+		t.Fatalf("LoadImage failed: %v", err)
+	}
+	if _, ok := stego.(*image.Gray); !ok {
+		t.Errorf("stego image decoded as %T, want *image.Gray", stego)
+	}
+	// The payload does not compress, but no more than a byte per pixel is needed
+	info, err := os.Stat(out)
+	if err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+	if info.Size() > 200*150+1024 {
+		t.Errorf("stego image is %d bytes, want at most one byte per pixel", info.Size())
+	}
+	got, err := RevealPayload(out, StegoOptions{Password: "pw"})
+	if err != nil || !bytes.Equal(got.Data, payload.Data) {
+		t.Errorf("RevealPayload = %d bytes, %v", len(got.Data), err)
+	}
+
+	wiped := filepath.Join(tempDir, "wiped.png")
+	if _, err := WipeStego(out, wiped, opts, StegoWipeZero); err != nil {
+		t.Fatalf("WipeStego failed: %v", err)
+	}
+	if img, err := LoadImage(wiped); err != nil || img.ColorModel() != color.GrayModel {
+		t.Errorf("wiped image is %T, %v; want *image.Gray", img, err)
+	}
+	if _, err := RevealPayload(wiped, StegoOptions{Password: "pw"}); err == nil {
+		t.Error("RevealPayload found a payload in the wiped image")
+	}
+}
+
+// newTransparentNRGBA returns a test image whose left 60% is fully
+// transparent, like the margins of a logo.
+func newTransparentNRGBA(w, h int) *image.NRGBA {
+	img := newTestNRGBA(w, h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w*6/10; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{uint8(x), uint8(y), 0, 0})
+		}
+	}
+	return img
+}
+
+func TestRevealPayloadFrom(t *testing.T) {
+	dir := t.TempDir()
+	cover := filepath.Join(dir, "cover.png")
+	if err := SaveImage(cover, newTestNRGBA(64, 64), SaveOptions{Format: "png"}); err != nil {
+		t.Fatalf("SaveImage failed: %v", err)
+	}
+	for _, opts := range []StegoOptions{DefaultStegoOptions, {Density: 1, Method: StegoMethodEXIF}} {
+		output := filepath.Join(dir, "stego.png")
+		if err := HidePayload(cover, output, Payload{Data: []byte("from memory")}, opts, "png"); err != nil {
+			t.Fatalf("%s: HidePayload failed: %v", opts.Method, err)
+		}
+		data, err := os.ReadFile(output)
+		if err != nil {
+			t.Fatalf("ReadFile failed: %v", err)
+		}
+		p, err := RevealPayloadFrom(bytes.NewReader(data), DefaultStegoOptions)
+		if err != nil || string(p.Data) != "from memory" {
+			t.Errorf("%s: RevealPayloadFrom = %q, %v", opts.Method, p.Data, err)
+		}
+	}
+	if _, err := RevealPayloadFrom(strings.NewReader("not an image"), DefaultStegoOptions); !errors.Is(err, ErrUnsupportedFormat) {
+		t.Errorf("RevealPayloadFrom of text = %v, want ErrUnsupportedFormat", err)
+	}
+}
+
+func TestSemiTransparentRoundTrip(t *testing.T) {
+	message := bytes.Repeat([]byte("translucent "), 20)
+	for _, alpha := range []uint8{10, 128, 254} {
+		cover := image.NewNRGBA(image.Rect(0, 0, 48, 48))
+		for y := 0; y < 48; y++ {
+			for x := 0; x < 48; x++ {
+				cover.SetNRGBA(x, y, color.NRGBA{uint8(x * 5), uint8(y * 5), uint8(x ^ y), alpha})
+			}
+		}
+		dir := t.TempDir()
+		input := filepath.Join(dir, "cover.png")
+		output := filepath.Join(dir, "stego.png")
+		if err := SaveImage(input, cover, SaveOptions{Format: "png"}); err != nil {
+			t.Fatalf("SaveImage failed: %v", err)
+		}
+		if err := HidePayload(input, output, Payload{Data: message}, DefaultStegoOptions, "png"); err != nil {
+			t.Fatalf("alpha %d: HidePayload failed: %v", alpha, err)
+		}
+
+		got, err := RevealPayload(output, DefaultStegoOptions)
+		if err != nil {
+			t.Fatalf("alpha %d: RevealPayload failed: %v", alpha, err)
+		}
+		if !bytes.Equal(got.Data, message) {
+			t.Errorf("alpha %d: payload did not round trip", alpha)
+		}
+
+		// Alpha is untouched and colors move by at most the one bit used.
+		img, err := LoadImage(output)
+		if err != nil {
+			t.Fatalf("LoadImage failed: %v", err)
+		}
+		stego := asNRGBA(img)
+		for i := range cover.Pix {
+			d := int(stego.Pix[i]) - int(cover.Pix[i])
+			if i%4 == 3 && d != 0 || d < -1 || d > 1 {
+				t.Fatalf("alpha %d: byte %d changed from %d to %d", alpha, i, cover.Pix[i], stego.Pix[i])
+			}
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package pixellock
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Amul-Thantharate/pixellock/pkg/stego"
+)
+
+// Ways of overwriting the low bits of a stego image; see stego.Wipe.
+const (
+	StegoWipeRandom = stego.WipeRandom
+	StegoWipeZero   = stego.WipeZero
+)
+
+// WipeStego overwrites the low bits of the image at inputFilename that a
+// payload hidden with opts could occupy, in the given mode, and saves the
+// result losslessly as a PNG at outputFilename. Metadata is not carried
+// over, so payloads hidden with StegoMethodEXIF are dropped too. The
+// returned analysis describes the image before wiping and tells whether it
+// carried a pixellock payload.
+func WipeStego(inputFilename, outputFilename string, opts StegoOptions, mode string) (StegoAnalysis, error) {
+	if err := opts.Validate(); err != nil {
+		return StegoAnalysis{}, err
+	}
+	analysis, err := AnalyzeStegoFile(inputFilename)
+	if err != nil {
+		return StegoAnalysis{}, err
+	}
+	img, err := loadStegoCover(inputFilename)
+	if err != nil {
+		return StegoAnalysis{}, err
+	}
+	wiped, err := stego.Wipe(img, mode, opts.engine()...)
+	if err != nil {
+		return StegoAnalysis{}, err
+	}
+
+	err = os.MkdirAll(filepath.Dir(outputFilename), os.ModeDir|0755) // Ensure output directory exists
+	if err != nil {
+		return analysis, fmt.Errorf("failed to create output directory: %w", err)
+	}
+	if err := SaveImage(outputFilename, wiped, SaveOptions{Format: "png"}); err != nil {
+		return analysis, fmt.Errorf("failed to encode wiped image: %w", err)
+	}
+	return analysis, nil
+}
+
+// WipeDirectory wipes every image under inputDir selected by batch, as
+// WipeStego does, writing each to the same relative path under outputDir
+// as a PNG. The analysis of each image before wiping is in its result.
+func WipeDirectory(inputDir, outputDir string, opts StegoOptions, mode string, batch StegoBatchOptions) ([]StegoBatchResult, error) {
+	files, err := StegoBatchFiles(inputDir, batch)
+	if err != nil {
+		return nil, err
+	}
+	return runStegoBatch(files, batch.Workers, func(input string) StegoBatchResult {
+		result := StegoBatchResult{Input: input}
+		relPath, err := filepath.Rel(inputDir, input)
+		if err != nil {
+			result.Err = fmt.Errorf("failed to get relative path: %w", err)
+			return result
+		}
+		output := filepath.Join(outputDir, strings.TrimSuffix(relPath, filepath.Ext(relPath))+".png")
+		if result.Analysis, result.Err = WipeStego(input, output, opts, mode); result.Err == nil {
+			result.Output = output
+		}
+		return result
+	}), nil
+}
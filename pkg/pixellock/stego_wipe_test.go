@@ -0,0 +1,95 @@
+package pixellock
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWipeStego(t *testing.T) {
+	dir := t.TempDir()
+	cover := filepath.Join(dir, "cover.png")
+	if err := SaveImage(cover, newTestNRGBA(64, 64), SaveOptions{Format: "png"}); err != nil {
+		t.Fatalf("SaveImage failed: %v", err)
+	}
+	stego := filepath.Join(dir, "stego.png")
+	opts := StegoOptions{Density: 2, SkipTransparent: true}
+	if err := HidePayload(cover, stego, Payload{Data: binaryFixture(), Filename: "a.bin"}, opts, "png"); err != nil {
+		t.Fatalf("HidePayload failed: %v", err)
+	}
+
+	for _, mode := range []string{StegoWipeRandom, StegoWipeZero} {
+		wiped := filepath.Join(dir, mode+".png")
+		before, err := WipeStego(stego, wiped, opts, mode)
+		if err != nil {
+			t.Fatalf("%s: WipeStego failed: %v", mode, err)
+		}
+		if !before.Pixellock() {
+			t.Errorf("%s: payload not reported before wiping", mode)
+		}
+
+		if _, err := RevealPayload(wiped, DefaultStegoOptions); !errors.Is(err, ErrNoPayload) {
+			t.Errorf("%s: reveal after wipe error = %v, want ErrNoPayload", mode, err)
+		}
+		after, err := AnalyzeStegoFile(wiped)
+		if err != nil {
+			t.Fatalf("AnalyzeStegoFile failed: %v", err)
+		}
+		if after.Pixellock() {
+			t.Errorf("%s: detect still finds a pixellock header", mode)
+		}
+
+		// Only the wiped bits differ from the cover.
+		want, _ := LoadImage(cover)
+		got, _ := LoadImage(wiped)
+		wantPix, gotPix := toNRGBA(want).Pix, toNRGBA(got).Pix
+		for i := range wantPix {
+			if wantPix[i]&^3 != gotPix[i]&^3 || i%4 == 3 && wantPix[i] != gotPix[i] {
+				t.Fatalf("%s: byte %d changed from %#x to %#x", mode, i, wantPix[i], gotPix[i])
+			}
+		}
+	}
+}
+
+func TestWipeDirectory(t *testing.T) {
+	in, out := t.TempDir(), t.TempDir()
+	for _, name := range []string{"a.png", "b.png"} {
+		if err := SaveImage(filepath.Join(in, name), newTestNRGBA(32, 32), SaveOptions{Format: "png"}); err != nil {
+			t.Fatalf("SaveImage failed: %v", err)
+		}
+	}
+	if err := HidePayload(filepath.Join(in, "a.png"), filepath.Join(in, "a.png"), Payload{Data: []byte("hi")}, DefaultStegoOptions, "png"); err != nil {
+		t.Fatalf("HidePayload failed: %v", err)
+	}
+
+	results, err := WipeDirectory(in, out, DefaultStegoOptions, StegoWipeRandom, StegoBatchOptions{})
+	if err != nil {
+		t.Fatalf("WipeDirectory failed: %v", err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("got %d results, want 2", len(results))
+	}
+	for _, r := range results {
+		if r.Err != nil {
+			t.Fatalf("%s: %v", r.Input, r.Err)
+		}
+		if want := filepath.Base(r.Input) == "a.png"; r.Analysis.Pixellock() != want {
+			t.Errorf("%s: payload detected = %v, want %v", r.Input, r.Analysis.Pixellock(), want)
+		}
+		if _, err := os.Stat(r.Output); err != nil {
+			t.Errorf("%s: wiped image not written: %v", r.Input, err)
+		}
+	}
+}
+
+func TestWipeStegoRejectsMode(t *testing.T) {
+	dir := t.TempDir()
+	cover := filepath.Join(dir, "cover.png")
+	if err := SaveImage(cover, newTestNRGBA(8, 8), SaveOptions{Format: "png"}); err != nil {
+		t.Fatalf("SaveImage failed: %v", err)
+	}
+	if _, err := WipeStego(cover, filepath.Join(dir, "out.png"), DefaultStegoOptions, "shred"); err == nil {
+		t.Error("WipeStego accepted an unknown mode")
+	}
+}
@@ -0,0 +1,83 @@
+package pixellock
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// The format of the image an encrypted file holds, as DecryptImage writes
+// it, is recorded between any embedded thumbnail and the tags, so that it
+// can be told without the key or decrypting anything: formatMagic, the
+// length of the format's name as a big-endian uint32, then the name, one
+// of png, gif, tiff or heif. Files encrypted before it was recorded hold a
+// PNG unless they were encrypted from a HEIF image, an animated GIF or a
+// multi-page TIFF.
+
+// formatMagic starts the format recorded in an encrypted file.
+const formatMagic = "PXLKFRMT"
+
+// maxFormatSize bounds the name of a recorded format.
+const maxFormatSize = 16
+
+// storedFormat returns the format of data as encryption stores it: heif,
+// gif or tiff for the images kept in their own format, and png for any
+// other.
+func storedFormat(data []byte) string {
+	switch {
+	case IsHEIFData(data):
+		return "heif"
+	case IsGIFData(data):
+		return "gif"
+	case IsMultiPageTIFFData(data):
+		return "tiff"
+	}
+	return "png"
+}
+
+// formatBlock returns the block recording format.
+func formatBlock(format string) []byte {
+	return append(binary.BigEndian.AppendUint32([]byte(formatMagic), uint32(len(format))), format...)
+}
+
+// embeddedFormatSize returns the size of the block recording the format at
+// the start of r, or 0 when there is none.
+func embeddedFormatSize(r *bufio.Reader) int {
+	header, _ := r.Peek(len(formatMagic) + 4)
+	if len(header) < len(formatMagic)+4 || string(header[:len(formatMagic)]) != formatMagic {
+		return 0
+	}
+	return len(header) + int(binary.BigEndian.Uint32(header[len(formatMagic):]))
+}
+
+// readFormat reads the format recorded at the start of r, or returns an
+// empty string when none is.
+func readFormat(r *bufio.Reader) (string, error) {
+	n := embeddedFormatSize(r)
+	if n == 0 {
+		return "", nil
+	}
+	if n-len(formatMagic)-4 > maxFormatSize {
+		return "", fmt.Errorf("bad format size %d", n-len(formatMagic)-4)
+	}
+	block := make([]byte, n)
+	if _, err := io.ReadFull(r, block); err != nil {
+		return "", fmt.Errorf("failed to read format: %w", err)
+	}
+	return string(block[len(formatMagic)+4:]), nil
+}
+
+// skipFormat returns the encrypted data past the format recorded at its
+// start, if it has one, as SplitThumbnail leaves it.
+func skipFormat(data []byte) []byte {
+	header := len(formatMagic) + 4
+	if len(data) < header || string(data[:len(formatMagic)]) != formatMagic {
+		return data
+	}
+	n := int(binary.BigEndian.Uint32(data[len(formatMagic):]))
+	if n > len(data)-header {
+		return data
+	}
+	return data[header+n:]
+}
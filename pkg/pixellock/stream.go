@@ -0,0 +1,350 @@
+package pixellock
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// A stream is data encrypted in chunks by EncryptStream, so that neither
+// it nor its plaintext need be held in memory whole, as Encrypt needs.
+//
+// It starts with streamMagic, then the header: the ID of the CipherSuite
+// the stream is encrypted with, as a byte, and the size of the chunks as a
+// big-endian uint32. The header is authenticated with every chunk. Next
+// comes the data key, random for every stream, encrypted with the user's
+// key and preceded by its length as a uint32, then the chunks, each of
+// chunk size bytes of plaintext but the last, which is shorter and may be
+// empty, sealed with the data key. A chunk's nonce is its index and a flag
+// set on the last chunk alone, so chunks cannot be reordered, dropped or
+// added after the end.
+
+// streamMagic starts a stream.
+const streamMagic = "PXLKSTRM"
+
+// streamHeaderSize is the size of the magic and header that start a stream.
+const streamHeaderSize = len(streamMagic) + 1 + 4
+
+// streamChunkSize is the plaintext size of the chunks EncryptStream writes.
+const streamChunkSize = 64 << 10
+
+// maxStreamChunkSize bounds the chunks DecryptStream reads, each of which
+// is held in memory.
+const maxStreamChunkSize = 16 << 20
+
+// maxStreamKeySize bounds the encrypted data key of a stream.
+const maxStreamKeySize = 1 << 10
+
+// IsStreamData reports whether data was encrypted by EncryptStream.
+func IsStreamData(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(streamMagic))
+}
+
+// streamHeader returns the magic and header that start a stream encrypted
+// with suite in chunks of chunkSize.
+func streamHeader(suite CipherSuite, chunkSize int) []byte {
+	return binary.BigEndian.AppendUint32(append([]byte(streamMagic), suite.ID()), uint32(chunkSize))
+}
+
+// streamNonce returns the nonce of chunk i, last when it ends the stream.
+func streamNonce(nonce []byte, i uint64, last bool) []byte {
+	binary.BigEndian.PutUint64(nonce[len(nonce)-9:], i)
+	nonce[len(nonce)-1] = 0
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+// EncryptStream encrypts what it reads from src until EOF with AES-256 GCM,
+// writing it to dst as a stream of chunks, holding no more than a chunk in
+// memory. It stops at the first error from src or dst, or when ctx is done,
+// which it checks before each chunk, returning ctx.Err().
+func EncryptStream(ctx context.Context, key []byte, dst io.Writer, src io.Reader) error {
+	return EncryptStreamWith(ctx, AESGCM, key, dst, src)
+}
+
+// EncryptStreamWith is EncryptStream with the cipher suite, which must be
+// registered for DecryptStream to find it, and key of its size.
+func EncryptStreamWith(ctx context.Context, suite CipherSuite, key []byte, dst io.Writer, src io.Reader) error {
+	return encryptStream(ctx, suite, newKeyCipher(key), dst, src)
+}
+
+// encryptStream is EncryptStreamWith with the cipher of the key made by
+// keys.
+func encryptStream(ctx context.Context, suite CipherSuite, keys *keyCipher, dst io.Writer, src io.Reader) error {
+	keyAEAD, err := keys.aead(suite)
+	if err != nil {
+		return err
+	}
+	dataKey := make([]byte, suite.KeySize())
+	if _, err := rand.Read(dataKey); err != nil {
+		return fmt.Errorf("failed to generate data key: %w", err)
+	}
+	header := streamHeader(suite, streamChunkSize)
+	wrapped, err := sealWithAAD(keyAEAD, dataKey, header)
+	if err != nil {
+		return err
+	}
+	aead, err := newSuiteAEAD(suite, dataKey)
+	if err != nil {
+		return err
+	}
+	out := append(header, binary.BigEndian.AppendUint32(nil, uint32(len(wrapped)))...)
+	if _, err := dst.Write(append(out, wrapped...)); err != nil {
+		return fmt.Errorf("failed to write: %w", err)
+	}
+
+	// A byte past each chunk is read ahead to tell whether it is the last
+	bufp, sealedp := getChunkBuffer(streamChunkSize+1), getChunkBuffer(streamChunkSize+aead.Overhead())
+	defer putChunkBuffer(bufp)
+	defer putChunkBuffer(sealedp)
+	buf, sealed := *bufp, *sealedp
+	nonce := make([]byte, aead.NonceSize())
+	n, err := io.ReadFull(src, buf)
+	for i := uint64(0); ; i++ {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		last := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !last {
+			return fmt.Errorf("failed to read: %w", err)
+		}
+		sealed = aead.Seal(sealed[:0], streamNonce(nonce, i, last), buf[:min(n, streamChunkSize)], header)
+		if _, err := dst.Write(sealed); err != nil {
+			return fmt.Errorf("failed to write: %w", err)
+		}
+		if last {
+			return nil
+		}
+		buf[0] = buf[streamChunkSize]
+		n, err = io.ReadFull(src, buf[1:])
+		n++
+	}
+}
+
+// DecryptStream decrypts a stream written by EncryptStream from src to dst,
+// holding no more than a chunk in memory. Each chunk is authenticated
+// before it is written, but dst may be given the chunks before one that
+// fails, or before ctx is done; the stream is only whole when DecryptStream
+// returns nil. Like EncryptStream, it returns ctx.Err() once ctx is done.
+// The stream is decrypted with the cipher suite its header names, and an
+// *UnsupportedCipherError returned if that is not registered.
+func DecryptStream(ctx context.Context, key []byte, dst io.Writer, src io.Reader) error {
+	return decryptStream(ctx, newKeyCipher(key), dst, src)
+}
+
+// A streamKey is what starts a stream: its header, with the suite and
+// chunk size it names, and its data key.
+type streamKey struct {
+	header    []byte
+	suite     CipherSuite
+	chunkSize int
+	dataKey   []byte
+}
+
+// openStreamKey reads the header and data key of the stream src starts
+// with, opening the data key with the cipher of the key made by keys.
+func openStreamKey(keys *keyCipher, src io.Reader) (streamKey, error) {
+	header := make([]byte, streamHeaderSize)
+	if _, err := io.ReadFull(src, header); err != nil || !IsStreamData(header) {
+		return streamKey{}, fmt.Errorf("not an encrypted stream: %w", ErrNotEncryptedFile)
+	}
+	suite, err := LookupCipherSuite(header[len(streamMagic)])
+	if err != nil {
+		return streamKey{}, err
+	}
+	keyAEAD, err := keys.aead(suite)
+	if err != nil {
+		return streamKey{}, err
+	}
+	chunkSize := int(binary.BigEndian.Uint32(header[len(streamMagic)+1:]))
+	if chunkSize <= 0 || chunkSize > maxStreamChunkSize {
+		return streamKey{}, fmt.Errorf("bad stream chunk size %d", chunkSize)
+	}
+	var size [4]byte
+	if _, err := io.ReadFull(src, size[:]); err != nil {
+		return streamKey{}, fmt.Errorf("failed to read stream key: %w", err)
+	}
+	n := int(binary.BigEndian.Uint32(size[:]))
+	if n > maxStreamKeySize {
+		return streamKey{}, fmt.Errorf("bad stream key size %d", n)
+	}
+	wrapped := make([]byte, n)
+	if _, err := io.ReadFull(src, wrapped); err != nil {
+		return streamKey{}, fmt.Errorf("failed to read stream key: %w", err)
+	}
+	dataKey, err := openWithAAD(keyAEAD, wrapped, header)
+	if err != nil {
+		return streamKey{}, err
+	}
+	return streamKey{header: header, suite: suite, chunkSize: chunkSize, dataKey: dataKey}, nil
+}
+
+// decryptStream is DecryptStream with the cipher of the key made by keys.
+func decryptStream(ctx context.Context, keys *keyCipher, dst io.Writer, src io.Reader) error {
+	k, err := openStreamKey(keys, src)
+	if err != nil {
+		return err
+	}
+	aead, err := newSuiteAEAD(k.suite, k.dataKey)
+	if err != nil {
+		return err
+	}
+	header, chunkSize := k.header, k.chunkSize
+
+	sealedSize := chunkSize + aead.Overhead()
+	bufp, plainp := getChunkBuffer(sealedSize+1), getChunkBuffer(chunkSize)
+	defer putChunkBuffer(bufp)
+	defer putChunkBuffer(plainp)
+	buf, plain := *bufp, *plainp
+	nonce := make([]byte, aead.NonceSize())
+	n, err := io.ReadFull(src, buf)
+	for i := uint64(0); ; i++ {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		last := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !last {
+			return fmt.Errorf("failed to read: %w", err)
+		}
+		plain, err = aead.Open(plain[:0], streamNonce(nonce, i, last), buf[:min(n, sealedSize)], header)
+		if err != nil {
+			return fmt.Errorf("failed to decrypt chunk %d: %w", i, ErrAuthenticationFailed)
+		}
+		if _, err := dst.Write(plain); err != nil {
+			return fmt.Errorf("failed to write: %w", err)
+		}
+		if last {
+			return nil
+		}
+		buf[0] = buf[sealedSize]
+		n, err = io.ReadFull(src, buf[1:])
+		n++
+	}
+}
+
+// decryptData decrypts data encrypted whole, by EncryptStream or, as files
+// were before streams, by Encrypt. It returns ErrNotEncryptedFile for an
+// image as it is. The key's ciphers are those of keys.
+func decryptData(keys *keyCipher, data []byte) ([]byte, error) {
+	if isImageData(data) {
+		return nil, ErrNotEncryptedFile
+	}
+	if !IsStreamData(data) {
+		aesGCM, err := keys.aead(AESGCM)
+		if err != nil {
+			return nil, err
+		}
+		return openWithAAD(aesGCM, data, nil)
+	}
+	var buf bytes.Buffer
+	buf.Grow(len(data)) // The plaintext is a little smaller
+	if err := decryptStream(context.Background(), keys, &buf, bytes.NewReader(data)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// DecryptImage reads a file encrypted by EncryptFile or EncryptImage from
+// src, other than a tiled one, and writes the image decrypted with key to
+// dst as encryption stored it: a PNG, or an animated GIF, multi-page TIFF
+// or HEIF image in its own format. Nothing touches the filesystem. As with
+// DecryptStream, data already written to dst when it fails must be
+// discarded. Once ctx is done it returns ctx.Err().
+func DecryptImage(ctx context.Context, key []byte, dst io.Writer, src io.Reader) error {
+	return decryptImage(ctx, newKeyCipher(key), dst, src, 0)
+}
+
+// decryptImage is DecryptImage with the ciphers of the key made by keys.
+func decryptImage(ctx context.Context, keys *keyCipher, dst io.Writer, src io.Reader, maxPixels int64) error {
+	// A stream is decrypted as it is read; redacted and scrambled images
+	// and files encrypted whole are read first
+	r := bufio.NewReader(src)
+	if err := skipHeader(r); err != nil {
+		return err
+	}
+	if magic, _ := r.Peek(len(streamMagic)); IsStreamData(magic) {
+		return decryptStream(ctx, keys, dst, r)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("failed to read encrypted file: %w", err)
+	}
+	switch {
+	case IsRedacted(data):
+		data, err = unredact(keys.key, data, maxPixels)
+	case IsScrambled(data):
+		data, err = unscramble(keys.key, data, maxPixels)
+	default:
+		data, err = decryptData(keys, data)
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := dst.Write(data); err != nil {
+		return fmt.Errorf("failed to write decrypted image: %w", err)
+	}
+	return nil
+}
+
+// StreamCipher returns the cipher suite of the stream data begins with,
+// past an embedded thumbnail and tags, or nil when data is not a stream or
+// its suite is not registered.
+func StreamCipher(data []byte) CipherSuite {
+	r := bufio.NewReader(bytes.NewReader(data))
+	if err := skipHeader(r); err != nil {
+		return nil
+	}
+	return peekStreamSuite(r)
+}
+
+// peekStreamSuite returns the suite of the stream r starts with, without
+// reading past it, or nil as StreamCipher does.
+func peekStreamSuite(r *bufio.Reader) CipherSuite {
+	header, _ := r.Peek(len(streamMagic) + 1)
+	if len(header) <= len(streamMagic) || !IsStreamData(header) {
+		return nil
+	}
+	suite, err := LookupCipherSuite(header[len(streamMagic)])
+	if err != nil {
+		return nil
+	}
+	return suite
+}
+
+// skipHeader reads past the thumbnail embedded at the start of r, the
+// format and the tags after it, if there are any, to the ciphertext.
+func skipHeader(r *bufio.Reader) error {
+	if err := skipThumbnail(r); err != nil {
+		return err
+	}
+	if _, err := readFormat(r); err != nil {
+		return err
+	}
+	_, err := readSealedTags(r)
+	return err
+}
+
+// skipThumbnail reads past the thumbnail embedded at the start of r, if
+// there is one.
+func skipThumbnail(r *bufio.Reader) error {
+	if _, err := r.Discard(embeddedThumbnailSize(r)); err != nil {
+		return fmt.Errorf("failed to read past thumbnail: %w", err)
+	}
+	return nil
+}
+
+// embeddedThumbnailSize returns the size of the thumbnail embedded at the
+// start of r, with its magic and length, or 0 when there is none.
+func embeddedThumbnailSize(r *bufio.Reader) int {
+	header, _ := r.Peek(len(thumbnailMagic) + 4)
+	if len(header) < len(thumbnailMagic)+4 || string(header[:len(thumbnailMagic)]) != thumbnailMagic {
+		return 0
+	}
+	return len(header) + int(binary.BigEndian.Uint32(header[len(thumbnailMagic):]))
+}
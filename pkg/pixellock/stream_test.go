@@ -0,0 +1,429 @@
+package pixellock
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+// streamBenchSize is the size of the synthetic file the stream benchmarks
+// encrypt.
+var streamBenchSize = flag.Int64("stream-bench-size", 1<<30, "size of the input of BenchmarkEncryptMemory")
+
+// streamChunks returns n bytes of plaintext that differ from chunk to chunk.
+func streamChunks(n int) []byte {
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = byte(i / streamChunkSize * 7)
+	}
+	return data
+}
+
+// sealedChunk is the size of a chunk of streamChunkSize once sealed.
+const sealedChunk = streamChunkSize + 16
+
+// encryptTestStream encrypts data with EncryptStream, returning the stream and
+// the offset of its first chunk.
+func encryptTestStream(t *testing.T, key, data []byte) ([]byte, int) {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := EncryptStream(t.Context(), key, &buf, bytes.NewReader(data)); err != nil {
+		t.Fatalf("EncryptStream failed: %v", err)
+	}
+	stream := buf.Bytes()
+	return stream, streamHeaderSize + 4 + int(binary.BigEndian.Uint32(stream[streamHeaderSize:]))
+}
+
+func TestStreamRoundTrip(t *testing.T) {
+	key, _ := GenerateRandomKey()
+	readers := map[string]func(io.Reader) io.Reader{
+		"whole":    func(r io.Reader) io.Reader { return r },
+		"one byte": iotest.OneByteReader,
+		"half":     iotest.HalfReader,
+		"data err": iotest.DataErrReader,
+	}
+	for _, n := range []int{0, 1, streamChunkSize - 1, streamChunkSize, streamChunkSize + 1, 3*streamChunkSize + 100} {
+		data := streamChunks(n)
+		for name, reader := range readers {
+			var stream bytes.Buffer
+			if err := EncryptStream(t.Context(), key, &stream, reader(bytes.NewReader(data))); err != nil {
+				t.Fatalf("%d bytes, %s reader: EncryptStream failed: %v", n, name, err)
+			}
+			if !IsStreamData(stream.Bytes()) {
+				t.Errorf("%d bytes, %s reader: not a stream", n, name)
+			}
+			var out bytes.Buffer
+			if err := DecryptStream(t.Context(), key, &out, reader(bytes.NewReader(stream.Bytes()))); err != nil {
+				t.Fatalf("%d bytes, %s reader: DecryptStream failed: %v", n, name, err)
+			}
+			if !bytes.Equal(out.Bytes(), data) {
+				t.Errorf("%d bytes, %s reader: decrypted %d bytes that differ", n, name, out.Len())
+			}
+		}
+	}
+}
+
+// failingWriter accepts n bytes and then fails.
+type failingWriter struct{ n int }
+
+var errWriter = errors.New("disk full")
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if len(p) > w.n {
+		n := w.n
+		w.n = 0
+		return n, errWriter
+	}
+	w.n -= len(p)
+	return len(p), nil
+}
+
+// countingReader counts the bytes read from r.
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += n
+	return n, err
+}
+
+func TestStreamErrors(t *testing.T) {
+	key, _ := GenerateRandomKey()
+	data := streamChunks(10 * streamChunkSize)
+
+	// A read error is returned, not taken for the end of the data
+	errRead := errors.New("bad sector")
+	src := io.MultiReader(bytes.NewReader(data[:streamChunkSize+5]), iotest.ErrReader(errRead))
+	if err := EncryptStream(t.Context(), key, io.Discard, src); !errors.Is(err, errRead) {
+		t.Errorf("EncryptStream with a failing reader gave %v, want %v", err, errRead)
+	}
+
+	// A write error stops encryption with no more than a chunk read past it
+	src = &countingReader{r: bytes.NewReader(data)}
+	if err := EncryptStream(t.Context(), key, &failingWriter{n: 2 * sealedChunk}, src); !errors.Is(err, errWriter) {
+		t.Errorf("EncryptStream with a failing writer gave %v, want %v", err, errWriter)
+	}
+	if src.(*countingReader).n > 3*streamChunkSize+1 {
+		t.Errorf("EncryptStream read %d bytes after the writer failed", src.(*countingReader).n)
+	}
+
+	stream, _ := encryptTestStream(t, key, data)
+	if err := DecryptStream(t.Context(), key, &failingWriter{n: streamChunkSize}, bytes.NewReader(stream)); !errors.Is(err, errWriter) {
+		t.Errorf("DecryptStream with a failing writer gave %v, want %v", err, errWriter)
+	}
+	src = io.MultiReader(bytes.NewReader(stream[:len(stream)/2]), iotest.ErrReader(errRead))
+	if err := DecryptStream(t.Context(), key, io.Discard, src); !errors.Is(err, errRead) {
+		t.Errorf("DecryptStream with a failing reader gave %v, want %v", err, errRead)
+	}
+}
+
+// cancelingReader reads from r and cancels after reading n bytes.
+type cancelingReader struct {
+	r      io.Reader
+	n      int
+	cancel context.CancelFunc
+}
+
+func (c *cancelingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	if c.n -= n; c.n <= 0 {
+		c.cancel()
+	}
+	return n, err
+}
+
+func TestStreamCancel(t *testing.T) {
+	key, _ := GenerateRandomKey()
+	data := streamChunks(10 * streamChunkSize)
+
+	// Encryption stops at the next chunk, reading no further
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	src := &countingReader{r: &cancelingReader{r: bytes.NewReader(data), n: 2 * streamChunkSize, cancel: cancel}}
+	var stream bytes.Buffer
+	if err := EncryptStream(ctx, key, &stream, src); err != context.Canceled {
+		t.Errorf("EncryptStream gave %v, want %v", err, context.Canceled)
+	}
+	if src.n > 3*streamChunkSize+1 {
+		t.Errorf("EncryptStream read %d bytes after it was canceled", src.n)
+	}
+
+	// Decryption writes no more once canceled
+	full, _ := encryptTestStream(t, key, data)
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	var out bytes.Buffer
+	err := DecryptStream(ctx, key, &out, &cancelingReader{r: bytes.NewReader(full), n: len(full) / 2, cancel: cancel})
+	if err != context.Canceled {
+		t.Errorf("DecryptStream gave %v, want %v", err, context.Canceled)
+	}
+	if out.Len() >= len(data) || !bytes.Equal(out.Bytes(), data[:out.Len()]) {
+		t.Errorf("DecryptStream wrote %d bytes after it was canceled", out.Len())
+	}
+}
+
+func TestStreamTampering(t *testing.T) {
+	key, _ := GenerateRandomKey()
+	data := streamChunks(3*streamChunkSize + 100)
+	stream, start := encryptTestStream(t, key, data)
+	chunk := func(i int) []byte {
+		return stream[start+i*sealedChunk : min(start+(i+1)*sealedChunk, len(stream))]
+	}
+
+	flipped := bytes.Clone(stream)
+	flipped[start+sealedChunk+10] ^= 1
+	swapped := bytes.Clone(stream[:start])
+	swapped = append(append(append(append(swapped, chunk(1)...), chunk(0)...), chunk(2)...), chunk(3)...)
+	dropped := bytes.Clone(stream[:start])
+	dropped = append(append(append(dropped, chunk(0)...), chunk(2)...), chunk(3)...)
+	header := bytes.Clone(stream)
+	header[len(streamMagic)+3] ^= 1
+
+	other, _ := GenerateRandomKey()
+	cases := []struct {
+		name   string
+		key    []byte
+		stream []byte
+		good   int // bytes of plaintext before the bad chunk
+	}{
+		{"flipped bit", key, flipped, streamChunkSize},
+		{"swapped chunks", key, swapped, 0},
+		{"dropped chunk", key, dropped, streamChunkSize},
+		{"truncated at a chunk", key, stream[:start+3*sealedChunk], 2 * streamChunkSize},
+		{"truncated in a chunk", key, stream[:len(stream)-1], 3 * streamChunkSize},
+		{"no chunks", key, stream[:start], 0},
+		{"trailing data", key, append(bytes.Clone(stream), 0), 3 * streamChunkSize},
+		{"changed header", key, header, 0},
+		{"wrong key", other, stream, 0},
+		{"not a stream", key, data, 0},
+	}
+	for _, c := range cases {
+		var out bytes.Buffer
+		if err := DecryptStream(t.Context(), c.key, &out, bytes.NewReader(c.stream)); err == nil {
+			t.Errorf("%s: DecryptStream succeeded", c.name)
+		}
+		// Only chunks that authenticated were written
+		if !bytes.Equal(out.Bytes(), data[:c.good]) {
+			t.Errorf("%s: DecryptStream wrote %d bytes, want the %d before the bad chunk", c.name, out.Len(), c.good)
+		}
+	}
+}
+
+func TestStreamFiles(t *testing.T) {
+	key, _ := GenerateRandomKey()
+	dir := t.TempDir()
+	input := filepath.Join(dir, "in.png")
+	createImageFile(t, input)
+
+	encrypted := filepath.Join(dir, "in.png.enc")
+	if err := EncryptFile(t.Context(), input, encrypted, key, false, EncryptOptions{Thumbnail: 8, EmbedThumbnail: true}); err != nil {
+		t.Fatalf("EncryptFile failed: %v", err)
+	}
+	data, err := os.ReadFile(encrypted)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	_, rest := SplitThumbnail(data)
+	if !bytes.HasPrefix(rest, formatBlock("png")) || !IsStreamData(skipFormat(rest)) {
+		t.Error("EncryptFile did not write the format and a stream")
+	}
+	if err := DecryptFile(t.Context(), encrypted, filepath.Join(dir, "out.png"), key, false, SaveOptions{}); err != nil {
+		t.Fatalf("DecryptFile failed: %v", err)
+	}
+
+	// Files encrypted whole, before streams, still decrypt
+	plaintext, err := ReadImageForEncryption(input, MetadataStrip)
+	if err != nil {
+		t.Fatalf("ReadImageForEncryption failed: %v", err)
+	}
+	ciphertext, err := Encrypt(key, plaintext)
+	if err != nil {
+		t.Fatalf("Encrypt failed: %v", err)
+	}
+	old := filepath.Join(dir, "old.png.enc")
+	if err := os.WriteFile(old, ciphertext, 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	if err := DecryptFile(t.Context(), old, filepath.Join(dir, "old.png"), key, false, SaveOptions{}); err != nil {
+		t.Fatalf("DecryptFile of an old file failed: %v", err)
+	}
+	if _, err := LoadComparable(old, key); err != nil {
+		t.Errorf("LoadComparable of an old file failed: %v", err)
+	}
+}
+
+func TestEncryptDecryptImage(t *testing.T) {
+	key, _ := GenerateRandomKey()
+	dir := t.TempDir()
+	input := filepath.Join(dir, "in.png")
+	createImageFile(t, input)
+	raw, err := os.ReadFile(input)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	want, err := LoadImage(input)
+	if err != nil {
+		t.Fatalf("LoadImage failed: %v", err)
+	}
+
+	// What EncryptImage writes decrypts as a file
+	var encrypted bytes.Buffer
+	if err := EncryptImage(t.Context(), key, &encrypted, bytes.NewReader(raw)); err != nil {
+		t.Fatalf("EncryptImage failed: %v", err)
+	}
+	enc := filepath.Join(dir, "memory.png.enc")
+	if err := os.WriteFile(enc, encrypted.Bytes(), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	output := filepath.Join(dir, "memory.png")
+	if err := DecryptFile(t.Context(), enc, output, key, false, SaveOptions{}); err != nil {
+		t.Fatalf("DecryptFile failed: %v", err)
+	}
+	if got, err := LoadImage(output); err != nil || !samePixels(got, want) {
+		t.Errorf("DecryptFile of EncryptImage output = %v, want the input's pixels", err)
+	}
+
+	// And DecryptImage reads what EncryptFile writes, thumbnail and all
+	file := filepath.Join(dir, "file.png.enc")
+	if err := EncryptFile(t.Context(), input, file, key, false, EncryptOptions{Thumbnail: 8, EmbedThumbnail: true}); err != nil {
+		t.Fatalf("EncryptFile failed: %v", err)
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer f.Close()
+	var decrypted bytes.Buffer
+	if err := DecryptImage(t.Context(), key, &decrypted, f); err != nil {
+		t.Fatalf("DecryptImage failed: %v", err)
+	}
+	if got, err := BytesToImage(decrypted.Bytes()); err != nil || !samePixels(got, want) {
+		t.Errorf("DecryptImage of EncryptFile output = %v, want the input's pixels", err)
+	}
+	if format := OriginalFormat(decrypted.Bytes()); format != "png" {
+		t.Errorf("original format = %q, want png", format)
+	}
+
+	wrongKey, _ := GenerateRandomKey()
+	if err := DecryptImage(t.Context(), wrongKey, io.Discard, bytes.NewReader(encrypted.Bytes())); !errors.Is(err, ErrAuthenticationFailed) {
+		t.Errorf("DecryptImage with the wrong key = %v, want ErrAuthenticationFailed", err)
+	}
+	if err := EncryptImage(t.Context(), key, io.Discard, bytes.NewReader([]byte("not an image"))); !errors.Is(err, ErrUnsupportedFormat) {
+		t.Errorf("EncryptImage of text = %v, want ErrUnsupportedFormat", err)
+	}
+}
+
+// peakHeap returns the most heap in use while f runs beyond what was in
+// use before, sampled every few milliseconds.
+func peakHeap(f func()) uint64 {
+	runtime.GC()
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	base, peak := stats.HeapInuse, stats.HeapInuse
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(5 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			var stats runtime.MemStats
+			runtime.ReadMemStats(&stats)
+			peak = max(peak, stats.HeapInuse)
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	f()
+	close(done)
+	wg.Wait()
+	return peak - base
+}
+
+// BenchmarkEncryptMemory compares the peak heap of encrypting a synthetic
+// file whole, as files were before streams, and as a stream. The file is
+// 1GB unless set with -stream-bench-size.
+func BenchmarkEncryptMemory(b *testing.B) {
+	key, _ := GenerateRandomKey()
+	dir := b.TempDir()
+	input := filepath.Join(dir, "input")
+	f, err := os.Create(input)
+	if err != nil {
+		b.Fatal(err)
+	}
+	block := make([]byte, 1<<20)
+	for n := *streamBenchSize; n > 0; n -= int64(len(block)) {
+		if _, err := f.Write(block[:min(n, int64(len(block)))]); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if err := f.Close(); err != nil {
+		b.Fatal(err)
+	}
+	output := filepath.Join(dir, "output")
+
+	paths := []struct {
+		name    string
+		encrypt func() error
+	}{
+		{"whole", func() error {
+			plaintext, err := os.ReadFile(input)
+			if err != nil {
+				return err
+			}
+			ciphertext, err := Encrypt(key, plaintext)
+			if err != nil {
+				return err
+			}
+			return os.WriteFile(output, ciphertext, 0644)
+		}},
+		{"stream", func() error {
+			in, err := os.Open(input)
+			if err != nil {
+				return err
+			}
+			defer in.Close()
+			out, err := os.Create(output)
+			if err != nil {
+				return err
+			}
+			if err := EncryptStream(b.Context(), key, out, in); err != nil {
+				out.Close()
+				return err
+			}
+			return out.Close()
+		}},
+	}
+	for _, path := range paths {
+		b.Run(path.name, func(b *testing.B) {
+			b.SetBytes(*streamBenchSize)
+			var peak uint64
+			for i := 0; i < b.N; i++ {
+				var err error
+				peak = max(peak, peakHeap(func() { err = path.encrypt() }))
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(peak)/(1<<20), "peak-heap-MB")
+		})
+	}
+}
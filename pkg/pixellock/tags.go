@@ -0,0 +1,284 @@
+package pixellock
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"unicode/utf8"
+)
+
+// Tags label an encrypted file, each with a value, such as client=acme,
+// so that files can be picked out by them without decrypting their
+// images. They are kept in the file between any embedded thumbnail and
+// recorded format, and the ciphertext: tagsMagic, the length of the sealed tags as a big-endian
+// uint32, then the tags as a JSON object sealed with the user's key by
+// AES-256 GCM. They are sealed with tagsMagic and the first tagsBoundSize
+// bytes of the ciphertext, which hold its random data key, as additional
+// data, so that they cannot be moved onto another file. Changing them
+// rewrites them alone, copying the ciphertext as it is.
+type Tags map[string]string
+
+// tagsMagic starts the tags of an encrypted file.
+const tagsMagic = "PXLKTAGS"
+
+// maxTagsSize bounds the tags of a file, as JSON, and maxSealedTagsSize
+// them sealed, with the nonce and authentication tag of the seal.
+const (
+	maxTagsSize       = 64 << 10
+	maxSealedTagsSize = maxTagsSize + 64
+)
+
+// tagsBoundSize is how much of the ciphertext the tags are sealed with.
+const tagsBoundSize = 64
+
+// ParseTags parses tags given as key=value. A key given alone, with no
+// value, stands for any value: for a want of Match, or a tag to remove
+// whatever its value.
+func ParseTags(specs []string) (Tags, error) {
+	tags := Tags{}
+	for _, s := range specs {
+		key, value, _ := strings.Cut(s, "=")
+		if key == "" {
+			return nil, fmt.Errorf("bad tag %q: give it as key=value", s)
+		}
+		if _, ok := tags[key]; ok {
+			return nil, fmt.Errorf("tag %s given twice", key)
+		}
+		tags[key] = value
+	}
+	return tags, nil
+}
+
+// String returns the tags as key=value, in order of their keys, separated
+// by commas.
+func (t Tags) String() string {
+	var s []string
+	for _, key := range slices.Sorted(maps.Keys(t)) {
+		s = append(s, key+"="+t[key])
+	}
+	return strings.Join(s, ", ")
+}
+
+// Check returns an error unless the tags can be written to a file: each
+// with a key without =, and a value, in UTF-8, and no more than 64 KiB
+// of them.
+func (t Tags) Check() error {
+	for _, key := range slices.Sorted(maps.Keys(t)) {
+		switch value := t[key]; {
+		case key == "" || strings.Contains(key, "="):
+			return fmt.Errorf("bad tag key %q", key)
+		case value == "":
+			return fmt.Errorf("tag %s has no value: give it as %s=value", key, key)
+		case !utf8.ValidString(key) || !utf8.ValidString(value):
+			return fmt.Errorf("tag %s is not UTF-8", key)
+		}
+	}
+	if data, _ := json.Marshal(t); len(data) > maxTagsSize {
+		return fmt.Errorf("tags of %d bytes are too large: the most a file has is %d", len(data), maxTagsSize)
+	}
+	return nil
+}
+
+// Match reports whether t has each tag of want, with its value, or with
+// any value when that is empty.
+func (t Tags) Match(want Tags) bool {
+	for key, value := range want {
+		got, ok := t[key]
+		if !ok || value != "" && got != value {
+			return false
+		}
+	}
+	return true
+}
+
+// ReadTags returns the tags of the encrypted file named filename, opened
+// with key, or none when it has none. It reads the file no further than
+// the start of its ciphertext.
+func ReadTags(filename string, key []byte) (Tags, error) {
+	return readTags(OSFS{}, filename, newKeyCipher(key))
+}
+
+// readTags is ReadTags for a file of fsys, with the cipher of the key
+// made by keys.
+func readTags(fsys FileSystem, filename string, keys *keyCipher) (Tags, error) {
+	f, err := fsys.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read encrypted file: %w", err)
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	if err := skipThumbnail(r); err != nil {
+		return nil, err
+	}
+	if _, err := readFormat(r); err != nil {
+		return nil, err
+	}
+	sealed, err := readSealedTags(r)
+	if err != nil || sealed == nil {
+		return nil, err
+	}
+	ciphertext, _ := r.Peek(tagsBoundSize)
+	return openTags(keys, sealed, ciphertext)
+}
+
+// WriteTags replaces the tags of the encrypted file named filename with
+// tags, sealed with key, or removes them when tags is empty. The file is
+// written beside filename and renamed into place, but neither its
+// ciphertext nor its embedded thumbnail and format is touched: they are
+// copied as they are. The key must be the file's, opening the tags it has or, when
+// it has none, the data key of its ciphertext. Only files whose
+// ciphertext is a stream, as encrypt writes it, can be tagged: not
+// redacted, scrambled or tiled images, nor those encrypted before
+// pixellock wrote streams.
+func WriteTags(filename string, key []byte, tags Tags) (err error) {
+	if err := tags.Check(); err != nil {
+		return err
+	}
+	keys := newKeyCipher(key)
+	f, err := os.Open(filename)
+	if err != nil {
+		return fmt.Errorf("failed to read encrypted file: %w", err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to read encrypted file: %w", err)
+	}
+	r := bufio.NewReader(f)
+	thumbnail := embeddedThumbnailSize(r)
+	if _, err := r.Discard(thumbnail); err != nil {
+		return fmt.Errorf("failed to read past thumbnail: %w", err)
+	}
+	format := embeddedFormatSize(r)
+	if _, err := r.Discard(format); err != nil {
+		return fmt.Errorf("failed to read past format: %w", err)
+	}
+	old, err := readSealedTags(r)
+	if err != nil {
+		return err
+	}
+	ciphertext, _ := r.Peek(streamHeaderSize + 4 + maxStreamKeySize)
+	if !IsStreamData(ciphertext) {
+		return errors.New("the file cannot be tagged: only images encrypted as streams, as encrypt writes them, can be")
+	}
+	if old != nil {
+		_, err = openTags(keys, old, ciphertext)
+	} else {
+		_, err = openStreamKey(keys, bytes.NewReader(ciphertext))
+	}
+	if err != nil {
+		return fmt.Errorf("the key is not the file's: %w", err)
+	}
+	if old == nil && len(tags) == 0 {
+		return nil // Nothing to remove
+	}
+	block := []byte(nil)
+	if len(tags) > 0 {
+		aead, err := keys.aead(AESGCM)
+		if err != nil {
+			return err
+		}
+		data, _ := json.Marshal(tags)
+		sealed, err := sealWithAAD(aead, data, tagsAdditionalData(ciphertext))
+		if err != nil {
+			return err
+		}
+		block = binary.BigEndian.AppendUint32([]byte(tagsMagic), uint32(len(sealed)))
+		block = append(block, sealed...)
+	}
+
+	// The thumbnail and format are read again from the start of the file,
+	// and the ciphertext from where the old tags end
+	tmp := filename + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(tmp)
+		}
+	}()
+	w := bufio.NewWriter(out)
+	_, err = io.Copy(w, io.NewSectionReader(f, 0, int64(thumbnail+format)))
+	if err == nil {
+		_, err = w.Write(block)
+	}
+	if err == nil {
+		_, err = io.Copy(w, r)
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
+
+// readSealedTags reads the tags at the start of r, still sealed, or
+// returns nil when there are none.
+func readSealedTags(r *bufio.Reader) ([]byte, error) {
+	header, _ := r.Peek(len(tagsMagic) + 4)
+	if len(header) < len(tagsMagic)+4 || string(header[:len(tagsMagic)]) != tagsMagic {
+		return nil, nil
+	}
+	n := int(binary.BigEndian.Uint32(header[len(tagsMagic):]))
+	if n > maxSealedTagsSize {
+		return nil, fmt.Errorf("bad tags size %d", n)
+	}
+	block := make([]byte, len(header)+n)
+	if _, err := io.ReadFull(r, block); err != nil {
+		return nil, fmt.Errorf("failed to read tags: %w", err)
+	}
+	return block[len(header):], nil
+}
+
+// skipTags returns the encrypted data past the tags at its start, if it
+// has any, as SplitThumbnail leaves it.
+func skipTags(data []byte) []byte {
+	header := len(tagsMagic) + 4
+	if len(data) < header || string(data[:len(tagsMagic)]) != tagsMagic {
+		return data
+	}
+	n := int(binary.BigEndian.Uint32(data[len(tagsMagic):]))
+	if n > len(data)-header {
+		return data
+	}
+	return data[header+n:]
+}
+
+// openTags opens the sealed tags of the file whose ciphertext starts with
+// ciphertext, with the cipher of the key made by keys.
+func openTags(keys *keyCipher, sealed, ciphertext []byte) (Tags, error) {
+	aead, err := keys.aead(AESGCM)
+	if err != nil {
+		return nil, err
+	}
+	data, err := openWithAAD(aead, sealed, tagsAdditionalData(ciphertext))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tags: %w", err)
+	}
+	var tags Tags
+	if err := json.Unmarshal(data, &tags); err != nil {
+		return nil, fmt.Errorf("bad tags: %w", err)
+	}
+	return tags, nil
+}
+
+// tagsAdditionalData returns the additional data the tags of the file
+// whose ciphertext starts with ciphertext are sealed with.
+func tagsAdditionalData(ciphertext []byte) []byte {
+	return append([]byte(tagsMagic), ciphertext[:min(len(ciphertext), tagsBoundSize)]...)
+}
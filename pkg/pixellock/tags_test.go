@@ -0,0 +1,179 @@
+package pixellock
+
+import (
+	"bytes"
+	"image"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestParseTags(t *testing.T) {
+	tags, err := ParseTags([]string{"client=acme", "status", "note=a=b"})
+	if want := (Tags{"client": "acme", "status": "", "note": "a=b"}); err != nil || !maps.Equal(tags, want) {
+		t.Errorf("ParseTags gave %v, %v; want %v", tags, err, want)
+	}
+	for _, specs := range [][]string{{"=acme"}, {""}, {"client=acme", "client=beta"}} {
+		if _, err := ParseTags(specs); err == nil {
+			t.Errorf("ParseTags(%q) succeeded", specs)
+		}
+	}
+	if tags.Check() == nil {
+		t.Error("Check of a tag without a value succeeded")
+	}
+	if err := (Tags{"client": "acme", "status": "reviewed"}).Check(); err != nil {
+		t.Errorf("Check failed: %v", err)
+	}
+	if s := (Tags{"status": "reviewed", "client": "acme"}).String(); s != "client=acme, status=reviewed" {
+		t.Errorf("String gave %q", s)
+	}
+
+	file := Tags{"client": "acme", "status": "reviewed"}
+	for _, test := range []struct {
+		want  Tags
+		match bool
+	}{
+		{nil, true},
+		{Tags{"client": "acme"}, true},
+		{Tags{"client": ""}, true},
+		{Tags{"client": "acme", "status": "reviewed"}, true},
+		{Tags{"client": "beta"}, false},
+		{Tags{"client": "acme", "year": ""}, false},
+	} {
+		if got := file.Match(test.want); got != test.match {
+			t.Errorf("Match(%v) = %v, want %v", test.want, got, test.match)
+		}
+	}
+}
+
+func TestTags(t *testing.T) {
+	key, _ := GenerateRandomKey()
+	other, _ := GenerateRandomKey()
+	dir := t.TempDir()
+	tagged, untagged := filepath.Join(dir, "a.jpg.enc"), filepath.Join(dir, "b.jpg.enc")
+	if err := EncryptFile(t.Context(), faceFixture, tagged, key, false, EncryptOptions{Thumbnail: 32, EmbedThumbnail: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := EncryptFile(t.Context(), faceFixture, untagged, key, false, EncryptOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	original, _ := os.ReadFile(tagged)
+	thumb, ciphertext := SplitThumbnail(original)
+
+	if tags, err := ReadTags(tagged, key); err != nil || tags != nil {
+		t.Errorf("ReadTags of an untagged file gave %v, %v", tags, err)
+	}
+	tags := Tags{"client": "acme", "status": "reviewed"}
+	if err := WriteTags(tagged, key, tags); err != nil {
+		t.Fatalf("WriteTags failed: %v", err)
+	}
+	if got, err := ReadTags(tagged, key); err != nil || !maps.Equal(got, tags) {
+		t.Errorf("ReadTags gave %v, %v; want %v", got, err, tags)
+	}
+
+	// The thumbnail and ciphertext are as they were, around the tags
+	data, _ := os.ReadFile(tagged)
+	gotThumb, rest := SplitThumbnail(data)
+	if !bytes.Equal(gotThumb, thumb) || !bytes.HasPrefix(rest, formatBlock("png")) || !bytes.HasPrefix(skipFormat(rest), []byte(tagsMagic)) || !bytes.Equal(skipTags(skipFormat(rest)), skipFormat(ciphertext)) {
+		t.Fatal("tagging changed the thumbnail or ciphertext")
+	}
+	if info, err := InspectEncrypted(tagged); err != nil || !info.Tagged || info.Thumbnail != image.Pt(25, 32) {
+		t.Errorf("InspectEncrypted gave %+v, %v", info, err)
+	}
+	if _, err := InspectDecrypted(tagged, key); err != nil {
+		t.Errorf("InspectDecrypted of a tagged file failed: %v", err)
+	}
+	if err := DecryptFile(t.Context(), tagged, filepath.Join(dir, "a.png"), key, false, SaveOptions{Format: "png"}); err != nil {
+		t.Errorf("DecryptFile of a tagged file failed: %v", err)
+	}
+	if _, err := RegenerateThumbnail(tagged, key, 16, true); err != nil {
+		t.Errorf("RegenerateThumbnail of a tagged file failed: %v", err)
+	}
+	if got, err := ReadTags(tagged, key); err != nil || !maps.Equal(got, tags) {
+		t.Errorf("after RegenerateThumbnail, ReadTags gave %v, %v", got, err)
+	}
+
+	// Another key neither reads nor writes tags
+	if _, err := ReadTags(tagged, other); err == nil {
+		t.Error("ReadTags with another key succeeded")
+	}
+	for _, name := range []string{tagged, untagged} {
+		if err := WriteTags(name, other, Tags{"x": "y"}); err == nil {
+			t.Errorf("WriteTags of %s with another key succeeded", filepath.Base(name))
+		}
+	}
+
+	// Tags moved onto another file do not open
+	data, _ = os.ReadFile(tagged)
+	_, rest = SplitThumbnail(data)
+	rest = skipFormat(rest)
+	block := rest[:len(rest)-len(skipTags(rest))]
+	other2, _ := os.ReadFile(untagged)
+	moved := filepath.Join(dir, "moved.jpg.enc")
+	os.WriteFile(moved, slices.Concat(formatBlock("png"), block, skipFormat(other2)), 0644)
+	if _, err := ReadTags(moved, key); err == nil {
+		t.Error("ReadTags of tags moved from another file succeeded")
+	}
+
+	// Removing the tags leaves the file as it was, but for the thumbnail
+	// regenerated
+	if err := WriteTags(tagged, key, nil); err != nil {
+		t.Fatalf("WriteTags of no tags failed: %v", err)
+	}
+	data, _ = os.ReadFile(tagged)
+	if _, rest := SplitThumbnail(data); !bytes.Equal(rest, ciphertext) {
+		t.Error("removing the tags left more than the ciphertext")
+	}
+
+	redacted := filepath.Join(dir, "c.png.redacted")
+	if err := EncryptFile(t.Context(), faceFixture, redacted, key, false, EncryptOptions{Regions: []image.Rectangle{image.Rect(0, 0, 10, 10)}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteTags(redacted, key, tags); err == nil {
+		t.Error("WriteTags of a redacted image succeeded")
+	}
+	if err := WriteTags(untagged, key, Tags{"status": ""}); err == nil {
+		t.Error("WriteTags of a tag without a value succeeded")
+	}
+}
+
+func TestDecryptDirectoryTags(t *testing.T) {
+	key, _ := GenerateRandomKey()
+	dir := t.TempDir()
+	for name, tags := range map[string]Tags{"acme.jpg": {"client": "acme"}, "beta.jpg": {"client": "beta"}, "none.jpg": nil} {
+		encrypted := filepath.Join(dir, name+EncryptedExtension)
+		if err := EncryptFile(t.Context(), faceFixture, encrypted, key, false, EncryptOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		if err := WriteTags(encrypted, key, tags); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, test := range []struct {
+		tags Tags
+		want []string
+	}{
+		{Tags{"client": "acme"}, []string{"acme.jpg"}},
+		{Tags{"client": ""}, []string{"acme.jpg", "beta.jpg"}},
+		{nil, []string{"acme.jpg", "beta.jpg", "none.jpg"}},
+	} {
+		out := t.TempDir()
+		d, err := NewDecryptor(WithKey(key), WithTags(test.tags))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := d.ProcessDir(t.Context(), dir, out); err != nil {
+			t.Fatalf("ProcessDir failed: %v", err)
+		}
+		var got []string
+		entries, _ := os.ReadDir(out)
+		for _, e := range entries {
+			got = append(got, e.Name())
+		}
+		if !slices.Equal(got, test.want) {
+			t.Errorf("with tags %v, decrypted %v, want %v", test.tags, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package pixellock
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"os"
+	"time"
+
+	"golang.org/x/image/draw"
+)
+
+// A thumbnail is a small JPEG preview of an encrypted image, left
+// unencrypted on purpose so that a directory of encrypted files can be
+// browsed. It is written next to the encrypted file, named with
+// ThumbnailExtension, or embedded in front of the ciphertext: thumbnailMagic,
+// the length of the JPEG as a big-endian uint32, then the JPEG.
+
+// ThumbnailExtension is appended to an encrypted file for the preview
+// written next to it.
+const ThumbnailExtension = ".thumb.jpg"
+
+// DefaultThumbnailSize is the longer side, in pixels, of the thumbnails the
+// thumbs command writes by default, and maxThumbnailSize the largest one.
+const (
+	DefaultThumbnailSize = 256
+	maxThumbnailSize     = 1024
+)
+
+// thumbnailMagic starts an encrypted file with an embedded thumbnail.
+const thumbnailMagic = "PXLKTHMB"
+
+// thumbnailQuality is the JPEG quality of thumbnails.
+const thumbnailQuality = 70
+
+// CheckThumbnailSize returns an error unless size is a thumbnail size.
+func CheckThumbnailSize(size int) error {
+	if size < 1 || size > maxThumbnailSize {
+		return fmt.Errorf("invalid thumbnail size %d: must be between 1 and %d pixels", size, maxThumbnailSize)
+	}
+	return nil
+}
+
+// ThumbnailPath returns the name of the thumbnail written next to the
+// encrypted file named filename.
+func ThumbnailPath(filename string) string {
+	return filename + ThumbnailExtension
+}
+
+// MakeThumbnail returns a JPEG preview of the image in data, as
+// ReadImageForEncryption gives it, turned upright for its EXIF orientation
+// and downscaled with Catmull-Rom so that its longer side is at most size
+// pixels. Transparent pixels are shown over white. HEIF images, which
+// cannot be decoded, have no thumbnail.
+func MakeThumbnail(data []byte, size int) ([]byte, error) {
+	return makeThumbnail(data, size, 0)
+}
+
+// makeThumbnail is MakeThumbnail of an image of no more pixels than
+// maxPixels allows.
+func makeThumbnail(data []byte, size int, maxPixels int64) ([]byte, error) {
+	if err := CheckThumbnailSize(size); err != nil {
+		return nil, err
+	}
+	if IsHEIFData(data) {
+		return nil, fmt.Errorf("HEIF images cannot be previewed")
+	}
+	img, err := bytesToImage(data, maxPixels) // The first frame of an animated GIF
+	if err != nil {
+		return nil, err
+	}
+	if exif, err := ReadEXIF(data); err == nil && exif != nil {
+		img = Orient(img, EXIFOrientation(exif))
+	}
+
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if longer := max(w, h); longer > size {
+		w, h = max(w*size/longer, 1), max(h*size/longer, 1)
+	}
+	thumb := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(thumb, thumb.Rect, image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.CatmullRom.Scale(thumb, thumb.Rect, img, b, draw.Over, nil)
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, thumb, &jpeg.Options{Quality: thumbnailQuality}); err != nil {
+		return nil, fmt.Errorf("failed to encode thumbnail: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// EmbedThumbnail returns the encrypted data with the JPEG thumb embedded in
+// front of it, replacing any thumbnail embedded already.
+func EmbedThumbnail(thumb, data []byte) []byte {
+	_, data = SplitThumbnail(data)
+	out := append([]byte(thumbnailMagic), binary.BigEndian.AppendUint32(nil, uint32(len(thumb)))...)
+	out = append(out, thumb...)
+	return append(out, data...)
+}
+
+// SplitThumbnail returns the thumbnail embedded in the encrypted data, or
+// nil if there is none, and the data that follows it.
+func SplitThumbnail(data []byte) (thumb, rest []byte) {
+	header := len(thumbnailMagic) + 4
+	if len(data) < header || string(data[:len(thumbnailMagic)]) != thumbnailMagic {
+		return nil, data
+	}
+	n := int(binary.BigEndian.Uint32(data[len(thumbnailMagic):]))
+	if n > len(data)-header {
+		return nil, data
+	}
+	return data[header : header+n], data[header+n:]
+}
+
+// EncryptedFileInfo describes an encrypted file, as the info command shows
+// it without the key.
+type EncryptedFileInfo struct {
+	Kind string // "encrypted", "redacted", "scrambled" or "tiled"
+	Size int64
+
+	// Thumbnail is the size of the thumbnail embedded in the file or, when
+	// ThumbnailFile is set, written next to it; zero when it has none.
+	Thumbnail     image.Point
+	ThumbnailFile string
+
+	// Tagged reports whether the file has tags, which take the key to
+	// read.
+	Tagged bool
+}
+
+// InspectEncrypted returns what can be told about the encrypted file named
+// filename without its key.
+func InspectEncrypted(filename string) (EncryptedFileInfo, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return EncryptedFileInfo{}, fmt.Errorf("failed to read encrypted file: %w", err)
+	}
+	info := EncryptedFileInfo{Kind: "encrypted", Size: int64(len(data))}
+	switch {
+	case IsRedacted(data):
+		info.Kind = "redacted"
+	case IsScrambled(data):
+		info.Kind = "scrambled"
+	case bytes.HasPrefix(data, []byte(tiledMagic)):
+		info.Kind = "tiled"
+	}
+
+	thumb, rest := SplitThumbnail(data)
+	rest = skipFormat(rest)
+	info.Tagged = len(skipTags(rest)) < len(rest)
+	if thumb == nil {
+		sidecar := ThumbnailPath(filename)
+		if thumb, err = os.ReadFile(sidecar); err != nil {
+			return info, nil
+		}
+		info.ThumbnailFile = sidecar
+	}
+	config, err := jpeg.DecodeConfig(bytes.NewReader(thumb))
+	if err != nil {
+		return info, fmt.Errorf("unreadable thumbnail: %w", err)
+	}
+	info.Thumbnail = image.Pt(config.Width, config.Height)
+	return info, nil
+}
+
+// DecryptedImageInfo describes the image inside an encrypted file, as the
+// info command shows it given the key.
+type DecryptedImageInfo struct {
+	Format string      // The format it was encrypted from, as OriginalFormat gives it
+	Size   image.Point // Of its first page; zero when it cannot be decoded, as for HEIF
+	Pages  int         // Of a multi-page TIFF; 1 for any other image
+	Taken  time.Time   // When it was taken, as EXIFTime gives it; zero when its metadata does not say
+}
+
+// InspectDecrypted decrypts the encrypted file named filename with key and
+// describes the image inside it.
+func InspectDecrypted(filename string, key []byte) (DecryptedImageInfo, error) {
+	tiled, data, _, err := decryptFileData(context.Background(), OSFS{}, nil, filename, newKeyCipher(key), SaveOptions{}, false)
+	if err != nil {
+		return DecryptedImageInfo{}, err
+	}
+	if tiled != nil {
+		return DecryptedImageInfo{Format: OriginalFormat(data), Size: tiled.Bounds().Size(), Pages: 1}, nil
+	}
+
+	info := DecryptedImageInfo{Format: OriginalFormat(data), Pages: 1}
+	if IsMultiPageTIFFData(data) {
+		info.Pages, _ = TIFFPageCount(data)
+	}
+	if config, _, err := image.DecodeConfig(bytes.NewReader(data)); err == nil {
+		info.Size = image.Pt(config.Width, config.Height)
+	}
+	if exif, _ := ReadEXIF(data); exif != nil {
+		info.Taken, _ = EXIFTime(exif)
+	}
+	return info, nil
+}
+
+// RegenerateThumbnail decrypts the encrypted file named filename with key
+// and writes a thumbnail of the image with a longer side of size pixels:
+// embedded in the file, in place of any embedded already, when embed is
+// set, and next to it otherwise. It returns the name of the file written.
+func RegenerateThumbnail(filename string, key []byte, size int, embed bool) (string, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return "", fmt.Errorf("failed to read encrypted file: %w", err)
+	}
+	if IsRedacted(data) || IsScrambled(data) {
+		return "", fmt.Errorf("redacted and scrambled images are viewable already")
+	}
+	_, rest := SplitThumbnail(data) // The format and tags, if any, and the ciphertext
+	plaintext, err := decryptData(newKeyCipher(key), skipTags(skipFormat(rest)))
+	if err != nil {
+		return "", err
+	}
+	thumb, err := MakeThumbnail(plaintext, size)
+	if err != nil {
+		return "", err
+	}
+	if !embed {
+		out := ThumbnailPath(filename)
+		return out, os.WriteFile(out, thumb, 0644)
+	}
+
+	// Write the new file beside the old one first, so that a failure
+	// cannot lose the ciphertext
+	tmp := filename + ".tmp"
+	if err := os.WriteFile(tmp, EmbedThumbnail(thumb, rest), 0644); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp, filename); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	return filename, nil
+}
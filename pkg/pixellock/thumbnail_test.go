@@ -0,0 +1,103 @@
+package pixellock
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// thumbnailSize returns the dimensions of the JPEG thumbnail thumb.
+func thumbnailSize(t *testing.T, thumb []byte) image.Point {
+	t.Helper()
+	config, err := jpeg.DecodeConfig(bytes.NewReader(thumb))
+	if err != nil {
+		t.Fatalf("thumbnail is not a JPEG: %v", err)
+	}
+	return image.Pt(config.Width, config.Height)
+}
+
+func TestThumbnail(t *testing.T) {
+	key, err := GenerateRandomKey()
+	if err != nil {
+		t.Fatalf("GenerateRandomKey failed: %v", err)
+	}
+	want := image.Pt(51, 64) // The 320x400 face fixture, 64 pixels high
+
+	for _, embed := range []bool{false, true} {
+		dir := t.TempDir()
+		encrypted := filepath.Join(dir, "face.jpg"+EncryptedExtension)
+		opts := EncryptOptions{Thumbnail: 64, EmbedThumbnail: embed}
+		if err := EncryptFile(t.Context(), faceFixture, encrypted, key, false, opts); err != nil {
+			t.Fatalf("embed %v: EncryptFile failed: %v", embed, err)
+		}
+		data, err := os.ReadFile(encrypted)
+		if err != nil {
+			t.Fatalf("ReadFile failed: %v", err)
+		}
+
+		thumb, ciphertext := SplitThumbnail(data)
+		ciphertext = skipFormat(ciphertext)
+		if embed {
+			if _, err := os.Stat(ThumbnailPath(encrypted)); !os.IsNotExist(err) {
+				t.Errorf("embedded thumbnail also written next to the file: %v", err)
+			}
+		} else {
+			if thumb != nil {
+				t.Error("thumbnail embedded without --thumbnail-embed")
+			}
+			if thumb, err = os.ReadFile(ThumbnailPath(encrypted)); err != nil {
+				t.Fatalf("thumbnail not written: %v", err)
+			}
+		}
+		if got := thumbnailSize(t, thumb); got != want {
+			t.Errorf("embed %v: thumbnail is %v, want %v", embed, got, want)
+		}
+		info, err := InspectEncrypted(encrypted)
+		if err != nil {
+			t.Fatalf("InspectEncrypted failed: %v", err)
+		}
+		if info.Thumbnail != want || (info.ThumbnailFile == "") != embed {
+			t.Errorf("embed %v: InspectEncrypted gave %+v", embed, info)
+		}
+
+		// The image itself stays encrypted
+		if _, err := BytesToImage(ciphertext); err == nil {
+			t.Errorf("embed %v: the payload decodes as an image", embed)
+		}
+		if _, err := decryptData(newKeyCipher(key), ciphertext); err != nil {
+			t.Errorf("embed %v: the payload does not decrypt: %v", embed, err)
+		}
+		restored := filepath.Join(dir, "restored.png")
+		if err := DecryptFile(t.Context(), encrypted, restored, key, false, SaveOptions{Format: "png"}); err != nil {
+			t.Fatalf("embed %v: DecryptFile failed: %v", embed, err)
+		}
+		if got, err := LoadImage(restored); err != nil || !samePixels(asNRGBA(got), faceNRGBA(t)) {
+			t.Errorf("embed %v: decrypted image differs: %v", embed, err)
+		}
+
+		// Thumbnails are regenerated from the encrypted file
+		written, err := RegenerateThumbnail(encrypted, key, 32, embed)
+		if err != nil {
+			t.Fatalf("embed %v: RegenerateThumbnail failed: %v", embed, err)
+		}
+		if info, err := InspectEncrypted(encrypted); err != nil || info.Thumbnail != image.Pt(25, 32) {
+			t.Errorf("embed %v: regenerated thumbnail in %s is %+v, %v", embed, written, info, err)
+		}
+	}
+}
+
+func TestThumbnailOptions(t *testing.T) {
+	for _, opts := range []EncryptOptions{
+		{Thumbnail: -1},
+		{Thumbnail: maxThumbnailSize + 1},
+		{EmbedThumbnail: true},
+		{Thumbnail: 64, Mode: ModeScramble},
+	} {
+		if err := opts.Check(); err == nil {
+			t.Errorf("Check accepted %+v", opts)
+		}
+	}
+}
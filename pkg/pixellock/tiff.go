@@ -0,0 +1,579 @@
+package pixellock
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/image/tiff"
+)
+
+// golang.org/x/image/tiff cannot write LZW, so TIFF images are written
+// here: grayscale, palette-color, RGB or RGB with unassociated alpha, as
+// one strip compressed with no compression, Deflate or LZW. It reads only
+// the first page of a multi-page TIFF, so the others are found here by
+// walking the chain of IFDs.
+
+// TIFF compressions EncodeTIFF accepts.
+const (
+	TIFFCompressionNone    = "none"
+	TIFFCompressionDeflate = "deflate"
+	TIFFCompressionLZW     = "lzw"
+)
+
+// DefaultTIFFCompression is the compression of a "tiff" output format that
+// names none.
+const DefaultTIFFCompression = TIFFCompressionDeflate
+
+// tiffCompressionCodes maps the TIFF compressions to their Compression tag
+// values.
+var tiffCompressionCodes = map[string]uint32{
+	TIFFCompressionNone:    1,
+	TIFFCompressionLZW:     5,
+	TIFFCompressionDeflate: 8,
+}
+
+// TIFF tags and field types written by EncodeTIFF.
+const (
+	tiffImageWidth                = 256
+	tiffImageLength               = 257
+	tiffBitsPerSample             = 258
+	tiffCompression               = 259
+	tiffPhotometricInterpretation = 262
+	tiffStripOffsets              = 273
+	tiffSamplesPerPixel           = 277
+	tiffRowsPerStrip              = 278
+	tiffStripByteCounts           = 279
+	tiffXResolution               = 282
+	tiffYResolution               = 283
+	tiffPlanarConfiguration       = 284
+	tiffResolutionUnit            = 296
+	tiffColorMap                  = 320
+	tiffExtraSamples              = 338
+
+	tiffShort    = 3
+	tiffLong     = 4
+	tiffRational = 5
+)
+
+// checkTIFFCompression returns an error unless compression is one EncodeTIFF
+// accepts.
+func checkTIFFCompression(compression string) error {
+	if _, ok := tiffCompressionCodes[compression]; !ok {
+		return fmt.Errorf("unknown TIFF compression %q (want %s, %s or %s)", compression, TIFFCompressionNone, TIFFCompressionDeflate, TIFFCompressionLZW)
+	}
+	return nil
+}
+
+// EncodeTIFF writes img to w as a TIFF image with the given compression.
+// Grayscale images stay grayscale, and paletted images with an opaque
+// palette stay paletted; other images are written as RGB, with an alpha
+// channel when any pixel is not opaque. Samples are 16 bits for 16-bit
+// images and 8 bits otherwise.
+func EncodeTIFF(w io.Writer, img image.Image, compression string) error {
+	return EncodeTIFFPages(w, []image.Image{img}, compression)
+}
+
+// EncodeTIFFPages writes pages to w as a multi-page TIFF, in order, each
+// written as EncodeTIFF writes a single image. Pages can differ in size and
+// color model.
+func EncodeTIFFPages(w io.Writer, pages []image.Image, compression string) error {
+	if err := checkTIFFCompression(compression); err != nil {
+		return err
+	}
+	if len(pages) == 0 {
+		return fmt.Errorf("a TIFF needs at least one page")
+	}
+	strips := make([][]byte, len(pages))
+	entries := make([][]tiffEntry, len(pages))
+	for i, img := range pages {
+		var err error
+		if strips[i], entries[i], err = tiffPage(img, compression); err != nil {
+			return err
+		}
+	}
+
+	// The header comes first, then for each page its strip, its IFD and
+	// last the values too large to fit in its IFD entries. The offsets of
+	// every IFD are laid out first, so each can point to the next.
+	offsets := make([]uint32, len(pages)+1) // The IFD of each page, then none
+	pos := uint32(8)
+	for i, strip := range strips {
+		entries[i][tiffStripOffsetsEntry].values[0] = pos
+		pos += uint32(len(strip) + len(strip)%2)
+		offsets[i] = pos
+		pos += 2 + uint32(len(entries[i]))*12 + 4 + tiffValuesSize(entries[i])
+	}
+
+	header := binary.LittleEndian.AppendUint32([]byte("II*\x00"), offsets[0])
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	for i, strip := range strips {
+		ifd, values := tiffIFD(entries[i], offsets[i], offsets[i+1])
+		for _, part := range [][]byte{strip, make([]byte, len(strip)%2), ifd, values} {
+			if _, err := w.Write(part); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// tiffEntry is one entry of an IFD written by EncodeTIFFPages.
+type tiffEntry struct {
+	tag, typ uint16
+	values   []uint32
+}
+
+// tiffStripOffsetsEntry is the index of the StripOffsets entry among the
+// entries tiffPage returns, which EncodeTIFFPages fills in.
+const tiffStripOffsetsEntry = 5
+
+// tiffPage returns the one strip of samples of img, compressed, and the
+// entries of its IFD.
+func tiffPage(img image.Image, compression string) ([]byte, []tiffEntry, error) {
+	b := img.Bounds()
+	var samples []byte
+	var photometric, samplesPerPixel uint32
+	var colorMap []uint32
+	bits := uint32(8)
+	if paletted, ok := img.(*image.Paletted); ok && opaquePalette(paletted.Palette) {
+		photometric, samplesPerPixel = 3, 1 // Palette color
+		colorMap = tiffPalette(paletted.Palette)
+		samples = tiffSamples(paletted.Pix[paletted.PixOffset(b.Min.X, b.Min.Y):], paletted.Stride, b.Dx(), b.Dy(), 1, 1, 1)
+	} else if img.ColorModel() == color.GrayModel || img.ColorModel() == color.Gray16Model {
+		photometric, samplesPerPixel = 1, 1 // Black is zero
+		if is16Bit(img) {
+			gray := image.NewGray16(image.Rect(0, 0, b.Dx(), b.Dy()))
+			draw.Draw(gray, gray.Bounds(), img, b.Min, draw.Src)
+			bits = 16
+			samples = tiffSamples(gray.Pix, gray.Stride, b.Dx(), b.Dy(), 1, 1, 2)
+		} else {
+			gray := image.NewGray(image.Rect(0, 0, b.Dx(), b.Dy()))
+			draw.Draw(gray, gray.Bounds(), img, b.Min, draw.Src)
+			samples = tiffSamples(gray.Pix, gray.Stride, b.Dx(), b.Dy(), 1, 1, 1)
+		}
+	} else {
+		photometric, samplesPerPixel = 2, 3 // RGB
+		if is16Bit(img) {
+			nrgba := image.NewNRGBA64(image.Rect(0, 0, b.Dx(), b.Dy()))
+			draw.Draw(nrgba, nrgba.Bounds(), img, b.Min, draw.Src)
+			if !nrgba.Opaque() {
+				samplesPerPixel = 4
+			}
+			bits = 16
+			samples = tiffSamples(nrgba.Pix, nrgba.Stride, b.Dx(), b.Dy(), 4, int(samplesPerPixel), 2)
+		} else {
+			nrgba := asNRGBA(img)
+			if !nrgba.Opaque() {
+				samplesPerPixel = 4
+			}
+			samples = tiffSamples(nrgba.Pix[nrgba.PixOffset(b.Min.X, b.Min.Y):], nrgba.Stride, b.Dx(), b.Dy(), 4, int(samplesPerPixel), 1)
+		}
+	}
+
+	var strip []byte
+	switch compression {
+	case TIFFCompressionNone:
+		strip = samples
+	case TIFFCompressionDeflate:
+		var buf bytes.Buffer
+		zw := zlib.NewWriter(&buf)
+		if _, err := zw.Write(samples); err != nil {
+			return nil, nil, err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, nil, err
+		}
+		strip = buf.Bytes()
+	case TIFFCompressionLZW:
+		strip = tiffLZW(samples)
+	}
+
+	bitsPerSample := make([]uint32, samplesPerPixel)
+	for i := range bitsPerSample {
+		bitsPerSample[i] = bits
+	}
+	entries := []tiffEntry{
+		{tiffImageWidth, tiffLong, []uint32{uint32(b.Dx())}},
+		{tiffImageLength, tiffLong, []uint32{uint32(b.Dy())}},
+		{tiffBitsPerSample, tiffShort, bitsPerSample},
+		{tiffCompression, tiffShort, []uint32{tiffCompressionCodes[compression]}},
+		{tiffPhotometricInterpretation, tiffShort, []uint32{photometric}},
+		{tiffStripOffsets, tiffLong, []uint32{0}}, // At tiffStripOffsetsEntry
+		{tiffSamplesPerPixel, tiffShort, []uint32{samplesPerPixel}},
+		{tiffRowsPerStrip, tiffLong, []uint32{uint32(b.Dy())}},
+		{tiffStripByteCounts, tiffLong, []uint32{uint32(len(strip))}},
+		{tiffXResolution, tiffRational, []uint32{72, 1}},
+		{tiffYResolution, tiffRational, []uint32{72, 1}},
+		{tiffPlanarConfiguration, tiffShort, []uint32{1}}, // Chunky
+		{tiffResolutionUnit, tiffShort, []uint32{2}},      // Inches
+	}
+	if colorMap != nil {
+		entries = append(entries, tiffEntry{tiffColorMap, tiffShort, colorMap})
+	}
+	if samplesPerPixel == 4 {
+		entries = append(entries, tiffEntry{tiffExtraSamples, tiffShort, []uint32{2}}) // Unassociated alpha
+	}
+	return strip, entries, nil
+}
+
+// tiffEntryData returns the values of e, little-endian.
+func tiffEntryData(e tiffEntry) []byte {
+	var data []byte
+	for _, v := range e.values {
+		if e.typ == tiffShort {
+			data = binary.LittleEndian.AppendUint16(data, uint16(v))
+		} else {
+			data = binary.LittleEndian.AppendUint32(data, v)
+		}
+	}
+	return data
+}
+
+// tiffValuesSize returns the size of the values of entries too large to
+// fit in their IFD entries.
+func tiffValuesSize(entries []tiffEntry) uint32 {
+	var size uint32
+	for _, e := range entries {
+		if n := len(tiffEntryData(e)); n > 4 {
+			size += uint32(n)
+		}
+	}
+	return size
+}
+
+// tiffIFD returns the IFD holding entries, written at offset and pointing
+// to the IFD at next, or to none when next is zero, and the values that
+// follow it.
+func tiffIFD(entries []tiffEntry, offset, next uint32) (ifd, values []byte) {
+	valuesOffset := offset + 2 + uint32(len(entries))*12 + 4
+	ifd = binary.LittleEndian.AppendUint16(ifd, uint16(len(entries)))
+	for _, e := range entries {
+		data := tiffEntryData(e)
+		count := len(e.values)
+		if e.typ == tiffRational {
+			count /= 2
+		}
+		ifd = binary.LittleEndian.AppendUint16(ifd, e.tag)
+		ifd = binary.LittleEndian.AppendUint16(ifd, e.typ)
+		ifd = binary.LittleEndian.AppendUint32(ifd, uint32(count))
+		if len(data) <= 4 {
+			ifd = append(ifd, data...)
+			ifd = append(ifd, make([]byte, 4-len(data))...)
+		} else {
+			ifd = binary.LittleEndian.AppendUint32(ifd, valuesOffset+uint32(len(values)))
+			values = append(values, data...)
+		}
+	}
+	ifd = binary.LittleEndian.AppendUint32(ifd, next)
+	return ifd, values
+}
+
+// maxTIFFPages bounds the IFDs tiffIFDOffsets follows, so a corrupt file
+// cannot keep it walking.
+const maxTIFFPages = 1 << 16
+
+// tiffNextIFD returns the offset of the IFD that follows the one at offset
+// in the TIFF data, or zero when it is the last.
+func tiffNextIFD(data []byte, order binary.ByteOrder, offset uint32) (uint32, error) {
+	if uint64(offset)+2 > uint64(len(data)) {
+		return 0, fmt.Errorf("TIFF directory out of range")
+	}
+	at := uint64(offset) + 2 + 12*uint64(order.Uint16(data[offset:]))
+	if at+4 > uint64(len(data)) {
+		return 0, fmt.Errorf("TIFF directory truncated")
+	}
+	return order.Uint32(data[at:]), nil
+}
+
+// tiffIFDOffsets returns the offsets of the IFDs of the TIFF data, one for
+// each page, in order.
+func tiffIFDOffsets(data []byte) ([]uint32, error) {
+	order, offset, err := tiffByteOrder(data)
+	if err != nil {
+		return nil, err
+	}
+	var offsets []uint32
+	seen := make(map[uint32]bool)
+	for offset != 0 {
+		if seen[offset] || len(offsets) == maxTIFFPages {
+			return nil, fmt.Errorf("TIFF directories loop or are too many")
+		}
+		seen[offset] = true
+		offsets = append(offsets, offset)
+		if offset, err = tiffNextIFD(data, order, offset); err != nil {
+			return nil, err
+		}
+	}
+	if len(offsets) == 0 {
+		return nil, fmt.Errorf("TIFF has no directories")
+	}
+	return offsets, nil
+}
+
+// TIFFPageCount returns the number of pages of the TIFF data.
+func TIFFPageCount(data []byte) (int, error) {
+	offsets, err := tiffIFDOffsets(data)
+	return len(offsets), err
+}
+
+// IsMultiPageTIFFData reports whether decrypted data holds a TIFF of more
+// than one page, which encryption keeps as a TIFF, rather than a PNG.
+func IsMultiPageTIFFData(data []byte) bool {
+	n, err := TIFFPageCount(data)
+	return err == nil && n > 1
+}
+
+// tiffPages returns a copy of the TIFF data for each of its pages, with the
+// header pointing to the IFD of the page, so that each decodes as that
+// page alone.
+func tiffPages(data []byte) ([][]byte, error) {
+	offsets, err := tiffIFDOffsets(data)
+	if err != nil {
+		return nil, err
+	}
+	order, _, _ := tiffByteOrder(data)
+	pages := make([][]byte, len(offsets))
+	for i, offset := range offsets {
+		pages[i] = bytes.Clone(data)
+		order.PutUint32(pages[i][4:], offset)
+	}
+	return pages, nil
+}
+
+// DecodeTIFFPages decodes every page of the TIFF data, in order.
+func DecodeTIFFPages(data []byte) ([]image.Image, error) {
+	pages, err := tiffPages(data)
+	if err != nil {
+		return nil, err
+	}
+	imgs := make([]image.Image, len(pages))
+	for i, page := range pages {
+		if imgs[i], err = tiff.Decode(bytes.NewReader(page)); err != nil {
+			return nil, fmt.Errorf("failed to decode TIFF page %d: %w", i+1, err)
+		}
+	}
+	return imgs, nil
+}
+
+// tiffSamples returns the samples of the height rows of pix, each stride
+// bytes apart, keeping the first kept of the channels of each of the width
+// pixels. Samples are size bytes; Go holds 16-bit samples big-endian and
+// they are written little-endian, like the rest of the file.
+func tiffSamples(pix []byte, stride, width, height, channels, kept, size int) []byte {
+	samples := make([]byte, 0, width*height*kept*size)
+	for y := 0; y < height; y++ {
+		row := pix[y*stride : y*stride+width*channels*size]
+		for x := 0; x < len(row); x += channels * size {
+			for c := x; c < x+kept*size; c += size {
+				if size == 2 {
+					samples = append(samples, row[c+1], row[c])
+				} else {
+					samples = append(samples, row[c])
+				}
+			}
+		}
+	}
+	return samples
+}
+
+// opaquePalette reports whether every color of p is opaque. TIFF palettes
+// have no alpha, so other paletted images are written as RGBA.
+func opaquePalette(p color.Palette) bool {
+	for _, c := range p {
+		if _, _, _, a := c.RGBA(); a != 0xffff {
+			return false
+		}
+	}
+	return true
+}
+
+// tiffPalette returns the ColorMap values of an 8-bit palette-color TIFF
+// for p: all 256 red values, then the green and then the blue ones, at 16
+// bits. Entries past the end of p are black.
+func tiffPalette(p color.Palette) []uint32 {
+	values := make([]uint32, 3*256)
+	for i, c := range p {
+		r, g, b, _ := c.RGBA()
+		values[i], values[256+i], values[512+i] = r, g, b
+	}
+	return values
+}
+
+// tiffLZW compresses data with the LZW variant of TIFF: codes are written
+// most significant bit first and widen one code early.
+func tiffLZW(data []byte) []byte {
+	const (
+		clearCode = 256
+		eoiCode   = 257
+		lastCode  = 4093 // The last code before the table is cleared
+		tableSize = 1 << 14
+		tableMask = tableSize - 1
+		empty     = 0
+	)
+	var out []byte
+	var bits uint64
+	var nBits, width uint
+	write := func(code uint32) {
+		bits = bits<<width | uint64(code)
+		for nBits += width; nBits >= 8; nBits -= 8 {
+			out = append(out, byte(bits>>(nBits-8)))
+		}
+	}
+
+	// Each entry of the hash table holds a prefix code and the byte that
+	// follows it in its upper bits and the code of the pair in its low 12
+	// bits, or is empty.
+	var table [tableSize]uint32
+	var hi uint32
+	reset := func() {
+		clear(table[:])
+		width, hi = 9, eoiCode
+	}
+	// next advances hi past the code just written, widening the codes one
+	// code before they stop fitting, and reports whether a new table entry
+	// can be added.
+	next := func() bool {
+		hi++
+		if hi+1 == 1<<width {
+			width++
+		}
+		if hi > lastCode {
+			write(clearCode)
+			reset()
+			return false
+		}
+		return true
+	}
+
+	reset()
+	write(clearCode)
+	if len(data) > 0 {
+		code := uint32(data[0])
+	loop:
+		for _, c := range data[1:] {
+			key := code<<8 | uint32(c)
+			hash := (key>>12 ^ key) & tableMask
+			for t := table[hash]; t != empty; t = table[hash] {
+				if t>>12 == key {
+					code = t & 0xfff
+					continue loop
+				}
+				hash = (hash + 1) & tableMask
+			}
+			write(code)
+			code = uint32(c)
+			if next() {
+				table[hash] = key<<12 | hi
+			}
+		}
+		write(code)
+		next()
+	}
+	write(eoiCode)
+	if nBits > 0 {
+		out = append(out, byte(bits<<(8-nBits)))
+	}
+	return out
+}
+
+// reencodeTIFFPages returns the pages of the TIFF data encoded again with
+// EncodeTIFFPages and compression. The EXIF metadata of the first page is
+// kept unless metadata is MetadataStrip, in which case every page is turned
+// upright for its own orientation instead.
+func reencodeTIFFPages(data []byte, metadata, compression string) ([]byte, error) {
+	pages, err := tiffPages(data)
+	if err != nil {
+		return nil, err
+	}
+	imgs := make([]image.Image, len(pages))
+	var exif []byte
+	for i, page := range pages {
+		if imgs[i], err = tiff.Decode(bytes.NewReader(page)); err != nil {
+			return nil, fmt.Errorf("failed to decode TIFF page %d: %w", i+1, err)
+		}
+		pageEXIF, err := ReadEXIF(page)
+		if err != nil {
+			return nil, err
+		}
+		if metadata == MetadataStrip {
+			imgs[i] = Orient(imgs[i], EXIFOrientation(pageEXIF))
+		} else if i == 0 {
+			exif = pageEXIF
+		}
+	}
+	var buf bytes.Buffer
+	if err := EncodeTIFFPages(&buf, imgs, compression); err != nil {
+		return nil, fmt.Errorf("failed to encode TIFF: %w", err)
+	}
+	if exif == nil {
+		return buf.Bytes(), nil
+	}
+	return AttachEXIF(buf.Bytes(), "tiff", exif)
+}
+
+// PageFilename returns the name of page n, counted from 1, of the image
+// that would be written to filename, in outputFormat: scan.tiff gives
+// scan_p001.png for the first page as a PNG.
+func PageFilename(filename string, n int, outputFormat string) string {
+	ext := filepath.Ext(filename)
+	return WithImageExtension(fmt.Sprintf("%s_p%03d%s", strings.TrimSuffix(filename, ext), n, ext), outputFormat)
+}
+
+// SavePages writes each page of the multi-page TIFF data to its own file,
+// named by PageFilename after filename, with SaveImage and the options of
+// save, and returns the names written. Pages are written as png unless
+// save names another format. Each page keeps the EXIF metadata of its own
+// IFD. Existing files are refused unless overwrite is set.
+func SavePages(filename string, data []byte, overwrite bool, save SaveOptions) ([]string, error) {
+	pages, err := tiffPages(data)
+	if err != nil {
+		return nil, err
+	}
+	if save.Format == "" || strings.EqualFold(save.Format, OriginalOutputFormat) || strings.EqualFold(save.Format, AutoOutputFormat) {
+		save.Format = "png"
+	}
+	names := make([]string, len(pages))
+	for i := range pages {
+		names[i] = PageFilename(filename, i+1, save.Format)
+		if exists(orOS(save.FS), names[i]) && !overwrite {
+			return nil, outputExistsError(names[i])
+		}
+	}
+	for i, page := range pages {
+		img, err := tiff.Decode(bytes.NewReader(page))
+		if err != nil {
+			return names[:i], fmt.Errorf("failed to decode TIFF page %d: %w", i+1, err)
+		}
+		if save.EXIF, err = ReadEXIF(page); err != nil {
+			return names[:i], err
+		}
+		if err := SaveImage(names[i], img, save); err != nil {
+			return names[:i], err
+		}
+	}
+	return names, nil
+}
+
+// SplitImageFormat splits an output format such as "tiff:lzw" into the
+// lowercase format and its option.
+func SplitImageFormat(outputFormat string) (format, option string) {
+	format, option, _ = strings.Cut(strings.ToLower(outputFormat), ":")
+	return format, option
+}
+
+// ImageFormatExtension returns the file extension, without the dot, for
+// files written in outputFormat.
+func ImageFormatExtension(outputFormat string) string {
+	format, _ := SplitImageFormat(outputFormat)
+	return format
+}
@@ -0,0 +1,343 @@
+package pixellock
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/image/tiff"
+)
+
+// grayTestImage returns a grayscale gradient with some noise, so LZW has
+// both runs and fresh strings to code.
+func grayTestImage(w, h int) *image.Gray {
+	img := image.NewGray(image.Rect(0, 0, w, h))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(i%w + i*i%7)
+	}
+	return img
+}
+
+// palettedTestImage returns a w by h image using all 256 colors of the
+// Plan 9 palette.
+func palettedTestImage(w, h int) *image.Paletted {
+	img := image.NewPaletted(image.Rect(0, 0, w, h), palette.Plan9)
+	for i := range img.Pix {
+		img.Pix[i] = uint8(i%w + i/w*3 + i*i%5)
+	}
+	return img
+}
+
+// samePixels reports whether two decoded images hold the same pixels, at
+// 16 bits per channel when either holds that many.
+func samePixels(a, b image.Image) bool {
+	if is16Bit(a) || is16Bit(b) {
+		if !is16Bit(a) || !is16Bit(b) || a.Bounds().Size() != b.Bounds().Size() {
+			return false
+		}
+		d := b.Bounds().Min.Sub(a.Bounds().Min)
+		for y := a.Bounds().Min.Y; y < a.Bounds().Max.Y; y++ {
+			for x := a.Bounds().Min.X; x < a.Bounds().Max.X; x++ {
+				if color.NRGBA64Model.Convert(a.At(x, y)) != color.NRGBA64Model.Convert(b.At(x+d.X, y+d.Y)) {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	if ga, ok := a.(*image.Gray); ok {
+		gb, ok := b.(*image.Gray)
+		return ok && ga.Rect == gb.Rect && bytes.Equal(ga.Pix, gb.Pix)
+	}
+	na, nb := asNRGBA(a), asNRGBA(b)
+	return na.Rect == nb.Rect && bytes.Equal(na.Pix, nb.Pix)
+}
+
+func TestEncodeTIFF(t *testing.T) {
+	for name, img := range map[string]image.Image{
+		"rgb":         photoNRGBA(t),
+		"gray":        grayTestImage(300, 200),
+		"transparent": newTransparentNRGBA(33, 17),
+		"single":      grayTestImage(1, 1),
+		"rgb16":       deepTestImages()["rgba64"],
+		"rgba16":      deepTestImages()["nrgba64"],
+		"gray16":      deepTestImages()["gray16"],
+		"paletted":    palettedTestImage(90, 60),
+	} {
+		for _, compression := range []string{TIFFCompressionNone, TIFFCompressionDeflate, TIFFCompressionLZW} {
+			var buf bytes.Buffer
+			if err := EncodeTIFF(&buf, img, compression); err != nil {
+				t.Fatalf("%s, %s: EncodeTIFF failed: %v", name, compression, err)
+			}
+			got, format, err := image.Decode(&buf)
+			if err != nil || format != "tiff" {
+				t.Fatalf("%s, %s: decoding gave format %q, error %v", name, compression, format, err)
+			}
+			if !samePixels(got, img) {
+				t.Errorf("%s, %s: pixels changed in the TIFF round trip", name, compression)
+			}
+			if _, paletted := img.(*image.Paletted); paletted {
+				if _, ok := got.(*image.Paletted); !ok {
+					t.Errorf("%s, %s: decoded as %T, want a paletted image", name, compression, got)
+				}
+			}
+		}
+	}
+
+	if err := EncodeTIFF(new(bytes.Buffer), grayTestImage(4, 4), "zip"); err == nil {
+		t.Error("EncodeTIFF accepted an unknown compression")
+	}
+}
+
+func TestTIFFEncryptDecrypt(t *testing.T) {
+	key, err := GenerateRandomKey()
+	if err != nil {
+		t.Fatalf("GenerateRandomKey failed: %v", err)
+	}
+	for name, img := range map[string]image.Image{
+		"rgb":  photoNRGBA(t),
+		"gray": grayTestImage(120, 80),
+	} {
+		// The fixtures come from golang.org/x/image/tiff, like a file from
+		// another program would.
+		dir := t.TempDir()
+		scan := filepath.Join(dir, "scan.tiff")
+		f, err := os.Create(scan)
+		if err != nil {
+			t.Fatalf("os.Create failed: %v", err)
+		}
+		if err := tiff.Encode(f, img, &tiff.Options{Compression: tiff.Deflate}); err != nil {
+			t.Fatalf("tiff.Encode failed: %v", err)
+		}
+		f.Close()
+		if !isImageFile(scan) {
+			t.Errorf("%s: isImageFile should return true for TIFF file", name)
+		}
+		want, err := LoadImage(scan)
+		if err != nil {
+			t.Fatalf("%s: LoadImage failed: %v", name, err)
+		}
+
+		encrypted := filepath.Join(dir, "scan.tiff.enc")
+		if err := EncryptFile(t.Context(), scan, encrypted, key, false, EncryptOptions{Metadata: MetadataPreserve}); err != nil {
+			t.Fatalf("%s: EncryptFile failed: %v", name, err)
+		}
+		for _, outputFormat := range []string{OriginalOutputFormat, "tiff:lzw", "tiff:none"} {
+			decrypted := filepath.Join(dir, "decrypted.tiff")
+			if err := DecryptFile(t.Context(), encrypted, decrypted, key, true, SaveOptions{Format: outputFormat}); err != nil {
+				t.Fatalf("%s, %s: DecryptFile failed: %v", name, outputFormat, err)
+			}
+			if format, err := DetectImageFormat(decrypted); err != nil || format != "tiff" {
+				t.Errorf("%s, %s: decrypted format %q, %v; want tiff", name, outputFormat, format, err)
+			}
+			got, err := LoadImage(decrypted)
+			if err != nil {
+				t.Fatalf("%s, %s: LoadImage failed: %v", name, outputFormat, err)
+			}
+			if !samePixels(got, want) {
+				t.Errorf("%s, %s: decrypted TIFF differs from the original", name, outputFormat)
+			}
+		}
+	}
+}
+
+func TestOriginalFormat(t *testing.T) {
+	data, err := ImageToBytes(grayTestImage(8, 8))
+	if err != nil {
+		t.Fatalf("ImageToBytes failed: %v", err)
+	}
+	if f := OriginalFormat(data); f != "png" {
+		t.Errorf("OriginalFormat of untagged data = %q, want png", f)
+	}
+	for format, want := range map[string]string{"tiff": "tiff", "jpeg": "jpeg", "bmp": "bmp", "gif": "gif", "avif": "png"} {
+		tagged, err := SetOriginalFormat(data, format)
+		if err != nil {
+			t.Fatalf("SetOriginalFormat failed: %v", err)
+		}
+		if f := OriginalFormat(tagged); f != want {
+			t.Errorf("OriginalFormat after recording %s = %q, want %q", format, f, want)
+		}
+		if _, err := BytesToImage(tagged); err != nil {
+			t.Errorf("BytesToImage rejects the tagged PNG: %v", err)
+		}
+	}
+}
+
+func TestCheckOutputFormat(t *testing.T) {
+	for format, ok := range map[string]bool{
+		"png": true, "TIFF": true, "tiff:lzw": true, "tif:none": true,
+		"tiff:zip": false, "png:lzw": false,
+	} {
+		if err := CheckOutputFormat(format); (err == nil) != ok {
+			t.Errorf("CheckOutputFormat(%q) = %v", format, err)
+		}
+	}
+	if ext := ImageFormatExtension("TIFF:lzw"); ext != "tiff" {
+		t.Errorf("ImageFormatExtension = %q, want tiff", ext)
+	}
+}
+
+// scan3Sizes are the sizes of the pages of testdata/scan3.tiff, in order:
+// a grayscale, an RGB and a paletted page.
+var scan3Sizes = []image.Point{{16, 12}, {20, 14}, {10, 24}}
+
+// tiffFilePages returns the pages of the TIFF at path.
+func tiffFilePages(t *testing.T, path string) []image.Image {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	pages, err := DecodeTIFFPages(data)
+	if err != nil {
+		t.Fatalf("%s: DecodeTIFFPages failed: %v", path, err)
+	}
+	return pages
+}
+
+// samePages reports whether got holds the pages of want, in order.
+func samePages(got, want []image.Image) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for i := range got {
+		if !samePixels(toNRGBA(got[i]), toNRGBA(want[i])) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestMultiPageTIFF(t *testing.T) {
+	const fixture = "testdata/scan3.tiff"
+	want := tiffFilePages(t, fixture)
+	if len(want) != len(scan3Sizes) {
+		t.Fatalf("%s: %d pages decoded; want %d", fixture, len(want), len(scan3Sizes))
+	}
+	for i, page := range want {
+		if page.Bounds().Size() != scan3Sizes[i] {
+			t.Errorf("page %d is %v; want %v", i+1, page.Bounds().Size(), scan3Sizes[i])
+		}
+	}
+
+	key, err := GenerateRandomKey()
+	if err != nil {
+		t.Fatalf("GenerateRandomKey failed: %v", err)
+	}
+	dir := t.TempDir()
+	encrypted := filepath.Join(dir, "scan3.tiff.enc")
+	if err := EncryptFile(t.Context(), fixture, encrypted, key, false, EncryptOptions{}); err != nil {
+		t.Fatalf("EncryptFile failed: %v", err)
+	}
+	info, err := InspectDecrypted(encrypted, key)
+	if err != nil {
+		t.Fatalf("InspectDecrypted failed: %v", err)
+	}
+	if info != (DecryptedImageInfo{Format: "tiff", Size: scan3Sizes[0], Pages: 3}) {
+		t.Errorf("InspectDecrypted gave %+v", info)
+	}
+
+	// Decrypted to a TIFF again, with every page in order
+	decrypted := filepath.Join(dir, "decrypted", "scan3.png")
+	if err := DecryptFile(t.Context(), encrypted, decrypted, key, false, SaveOptions{}); err != nil {
+		t.Fatalf("DecryptFile failed: %v", err)
+	}
+	if got := tiffFilePages(t, filepath.Join(dir, "decrypted", "scan3.tiff")); !samePages(got, want) {
+		t.Error("the decrypted TIFF does not hold the pages of the original")
+	}
+
+	// Split into a file for each page
+	if err := DecryptFile(t.Context(), encrypted, decrypted, key, false, SaveOptions{SplitPages: true}); err != nil {
+		t.Fatalf("DecryptFile with SplitPages failed: %v", err)
+	}
+	for i, page := range want {
+		name := filepath.Join(dir, "decrypted", fmt.Sprintf("scan3_p%03d.png", i+1))
+		got, err := LoadImage(name)
+		if err != nil {
+			t.Fatalf("page %d: %v", i+1, err)
+		}
+		if !samePixels(toNRGBA(got), toNRGBA(page)) {
+			t.Errorf("%s differs from page %d of the original", name, i+1)
+		}
+	}
+
+	// Other formats take the first page
+	first := filepath.Join(dir, "first.png")
+	if err := DecryptFile(t.Context(), encrypted, first, key, false, SaveOptions{Format: "png"}); err != nil {
+		t.Fatalf("DecryptFile to png failed: %v", err)
+	}
+	if got, err := LoadImage(first); err != nil || !samePixels(toNRGBA(got), toNRGBA(want[0])) {
+		t.Errorf("the png is not the first page (%v)", err)
+	}
+
+	// Converting to TIFF keeps the pages too
+	converted := filepath.Join(dir, "converted.tif")
+	if _, err := ConvertFile(fixture, converted, ConvertOptions{}); err != nil {
+		t.Fatalf("ConvertFile failed: %v", err)
+	}
+	if got := tiffFilePages(t, converted); !samePages(got, want) {
+		t.Error("the converted TIFF does not hold the pages of the original")
+	}
+
+	if err := EncryptFile(t.Context(), fixture, filepath.Join(dir, "tiled.enc"), key, false, EncryptOptions{Tile: 64}); err == nil {
+		t.Error("EncryptFile tiled a multi-page TIFF")
+	}
+}
+
+func TestMultiPageTIFFMetadata(t *testing.T) {
+	data, err := os.ReadFile("testdata/scan3.tiff")
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	// Attaching EXIF to the first page keeps the pages after it
+	if data, err = AttachEXIF(data, "tiff", exifFixture()); err != nil {
+		t.Fatalf("AttachEXIF failed: %v", err)
+	}
+	if n, err := TIFFPageCount(data); err != nil || n != 3 {
+		t.Fatalf("%d pages after AttachEXIF (%v); want 3", n, err)
+	}
+	dir := t.TempDir()
+	scan := filepath.Join(dir, "scan.tiff")
+	if err := os.WriteFile(scan, data, 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+
+	key, err := GenerateRandomKey()
+	if err != nil {
+		t.Fatalf("GenerateRandomKey failed: %v", err)
+	}
+	for _, metadata := range []string{MetadataPreserve, MetadataStrip} {
+		encrypted := filepath.Join(dir, metadata+".tiff.enc")
+		if err := EncryptFile(t.Context(), scan, encrypted, key, false, EncryptOptions{Metadata: metadata}); err != nil {
+			t.Fatalf("%s: EncryptFile failed: %v", metadata, err)
+		}
+		decrypted := filepath.Join(dir, metadata+".tiff")
+		if err := DecryptFile(t.Context(), encrypted, decrypted, key, false, SaveOptions{}); err != nil {
+			t.Fatalf("%s: DecryptFile failed: %v", metadata, err)
+		}
+		pages := tiffFilePages(t, decrypted)
+		orientation, date, ok := fileEXIF(t, decrypted)
+		switch metadata {
+		case MetadataPreserve:
+			if !ok || orientation != 6 || date != testDateTimeOriginal {
+				t.Errorf("preserve: EXIF orientation %d, date %q, %v", orientation, date, ok)
+			}
+			if len(pages) != 3 || pages[0].Bounds().Size() != scan3Sizes[0] {
+				t.Errorf("preserve: %d pages, the first %v", len(pages), pages[0].Bounds().Size())
+			}
+		case MetadataStrip:
+			// Only the first page records an orientation to turn it by
+			if ok {
+				t.Errorf("strip: EXIF kept")
+			}
+			if len(pages) != 3 || pages[0].Bounds().Size() != image.Pt(12, 16) || pages[1].Bounds().Size() != scan3Sizes[1] {
+				t.Errorf("strip: %d pages, the first two %v and %v", len(pages), pages[0].Bounds().Size(), pages[1].Bounds().Size())
+			}
+		}
+	}
+}
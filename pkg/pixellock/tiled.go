@@ -0,0 +1,447 @@
+package pixellock
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"golang.org/x/image/draw"
+)
+
+// A tiled file holds an image too large to encrypt in one piece, such as a
+// stitched panorama, as a grid of tiles, each a PNG encrypted on its own, so
+// that neither the whole image nor its ciphertext is ever held as one
+// buffer, and a region can be decrypted from the tiles covering it alone.
+//
+// It starts with tiledMagic, then the header: the width, height and tile
+// size of the image as big-endian uint32s. The header is not secret, but
+// it is authenticated with everything that follows. Next come the data key,
+// random for every file, encrypted with the user's key, then the metadata,
+// a 1x1 PNG recording the format and EXIF metadata of the image, encrypted
+// with the data key; each is preceded by its length as a uint32. Then the
+// index gives the offset, as a uint64, and length, as a uint32, of every
+// tile in raster order, and the tiles follow. A tile is encrypted with the
+// data key, its rectangle as additional data, so tiles cannot be swapped.
+//
+// Written as a directory, the header, keys and index are in the file
+// tiledIndexName, with zero offsets, and each tile in a file of its own
+// named by tileFileName.
+
+// tiledMagic starts a tiled file and the index of a tiled directory.
+const tiledMagic = "PXLKTILE"
+
+// tiledIndexName is the file of a tiled directory holding its index.
+const tiledIndexName = "index" + EncryptedExtension
+
+// MinTileSize is the smallest tile side --tile takes.
+const MinTileSize = 16
+
+// maxTiles bounds the tiles of a file, which the index is read for up
+// front.
+const maxTiles = 1 << 24
+
+// maxTiledBlobSize bounds the encrypted key and metadata in the header of
+// a tiled file.
+const maxTiledBlobSize = 1 << 24
+
+// tileFileName returns the name of the file a tiled directory holds the
+// tile in column col and row row in.
+func tileFileName(col, row int) string {
+	return fmt.Sprintf("tile-%d-%d%s", col, row, EncryptedExtension)
+}
+
+// tiledHeader is the size of a tiled image and its tiles.
+type tiledHeader struct {
+	Width, Height, TileSize int
+}
+
+// bytes returns the magic and header that start a tiled file.
+func (h tiledHeader) bytes() []byte {
+	b := []byte(tiledMagic)
+	for _, v := range []int{h.Width, h.Height, h.TileSize} {
+		b = binary.BigEndian.AppendUint32(b, uint32(v))
+	}
+	return b
+}
+
+// grid returns the columns and rows of tiles of the image.
+func (h tiledHeader) grid() (cols, rows int) {
+	return (h.Width + h.TileSize - 1) / h.TileSize, (h.Height + h.TileSize - 1) / h.TileSize
+}
+
+// tile returns the rectangle of tile i, counted in raster order; tiles on
+// the right and bottom edges are cut to the image.
+func (h tiledHeader) tile(i int) image.Rectangle {
+	cols, _ := h.grid()
+	min := image.Pt(i%cols*h.TileSize, i/cols*h.TileSize)
+	return image.Rectangle{min, min.Add(image.Pt(h.TileSize, h.TileSize))}.Intersect(image.Rect(0, 0, h.Width, h.Height))
+}
+
+// tileAAD returns the additional data a tile is encrypted with.
+func (h tiledHeader) tileAAD(r image.Rectangle) []byte {
+	b := h.bytes()
+	for _, v := range []int{r.Min.X, r.Min.Y, r.Dx(), r.Dy()} {
+		b = binary.BigEndian.AppendUint32(b, uint32(v))
+	}
+	return b
+}
+
+// IsTiled reports whether filename is a tiled file or directory written by
+// EncryptTiled.
+func IsTiled(filename string) bool {
+	if info, err := os.Stat(filename); err == nil && info.IsDir() {
+		filename = filepath.Join(filename, tiledIndexName)
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	magic := make([]byte, len(tiledMagic))
+	_, err = io.ReadFull(f, magic)
+	return err == nil && string(magic) == tiledMagic
+}
+
+// ParseTileRegion parses a region of a tiled image given as
+// x,y,width,height.
+func ParseTileRegion(s string) (image.Rectangle, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 4 {
+		return image.Rectangle{}, fmt.Errorf("invalid region %q: use x,y,width,height", s)
+	}
+	var v [4]int
+	for i, part := range parts {
+		n, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil || n < 0 {
+			return image.Rectangle{}, fmt.Errorf("invalid region %q: %q is not a number of pixels", s, part)
+		}
+		v[i] = n
+	}
+	if v[2] == 0 || v[3] == 0 {
+		return image.Rectangle{}, fmt.Errorf("invalid region %q: width and height must be positive", s)
+	}
+	return image.Rect(v[0], v[1], v[0]+v[2], v[1]+v[3]), nil
+}
+
+// EncryptTiled encrypts the image at inputFilename into a tiled file at
+// outputFilename, with tiles of opts.Tile pixels a side, or into a tiled
+// directory with opts.TileDir. The image is decoded whole, but encoded and
+// encrypted a tile at a time. Its EXIF metadata is kept, or the image
+// turned upright, as for ReadImageForEncryption.
+func EncryptTiled(inputFilename, outputFilename string, key []byte, opts EncryptOptions) error {
+	if _, ok, err := HEIFBytes(inputFilename); err != nil || ok {
+		if ok {
+			err = fmt.Errorf("HEIF images cannot be tiled; encrypt them whole")
+		}
+		return err
+	}
+	if _, ok, err := AnimatedGIFBytes(inputFilename); err != nil || ok {
+		if ok {
+			err = fmt.Errorf("animated GIFs cannot be tiled; encrypt them whole")
+		}
+		return err
+	}
+
+	img, err := loadImage(OSFS{}, inputFilename, opts.MaxPixels)
+	if err != nil {
+		return err
+	}
+	raw, err := os.ReadFile(inputFilename)
+	if err != nil {
+		return fmt.Errorf("failed to read image: %w", err)
+	}
+	if IsMultiPageTIFFData(raw) {
+		return fmt.Errorf("multi-page TIFFs cannot be tiled; encrypt them whole")
+	}
+	exif, err := ReadEXIF(raw)
+	if err != nil {
+		return err
+	}
+	if exif != nil && opts.Metadata == MetadataStrip {
+		img, exif = Orient(img, EXIFOrientation(exif)), nil
+	}
+
+	// The format and EXIF metadata travel as they do for whole images, in
+	// a PNG, which here holds a single pixel
+	meta, err := ImageToBytes(image.NewGray(image.Rect(0, 0, 1, 1)))
+	if err != nil {
+		return err
+	}
+	if exif != nil {
+		if meta, err = AttachEXIF(meta, "png", exif); err != nil {
+			return err
+		}
+	}
+	if format, err := DetectImageFormat(inputFilename); err == nil {
+		if meta, err = SetOriginalFormat(meta, format); err != nil {
+			return err
+		}
+	}
+
+	b := img.Bounds()
+	h := tiledHeader{Width: b.Dx(), Height: b.Dy(), TileSize: opts.Tile}
+	if cols, rows := h.grid(); cols*rows > maxTiles {
+		return fmt.Errorf("a %dx%d image needs more than %d tiles of %d pixels; use larger tiles", h.Width, h.Height, maxTiles, h.TileSize)
+	}
+	dataKey := make([]byte, KeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return fmt.Errorf("failed to generate the data key: %w", err)
+	}
+	wrappedKey, err := EncryptWithAAD(key, dataKey, h.bytes())
+	if err != nil {
+		return err
+	}
+	encryptedMeta, err := EncryptWithAAD(dataKey, meta, h.bytes())
+	if err != nil {
+		return err
+	}
+	prefix := h.bytes()
+	for _, blob := range [][]byte{wrappedKey, encryptedMeta} {
+		prefix = binary.BigEndian.AppendUint32(prefix, uint32(len(blob)))
+		prefix = append(prefix, blob...)
+	}
+
+	// Write the tiles, into the file past room for the index or into
+	// files of their own, then the index
+	cols, rows := h.grid()
+	index := make([]byte, 12*cols*rows)
+	var f *os.File
+	if opts.TileDir {
+		if err := os.MkdirAll(outputFilename, os.ModeDir|0755); err != nil {
+			return fmt.Errorf("failed to create tile directory: %w", err)
+		}
+	} else {
+		if f, err = os.Create(outputFilename); err != nil {
+			return fmt.Errorf("failed to create encrypted file: %w", err)
+		}
+		defer f.Close()
+		if _, err := f.Write(append(prefix, index...)); err != nil {
+			return fmt.Errorf("failed to write encrypted file: %w", err)
+		}
+	}
+	offset := uint64(len(prefix) + len(index))
+	for i := range cols * rows {
+		r := h.tile(i)
+		tile, err := ImageToBytes(tileImage(img, r.Add(b.Min)))
+		if err != nil {
+			return err
+		}
+		ciphertext, err := EncryptWithAAD(dataKey, tile, h.tileAAD(r))
+		if err != nil {
+			return err
+		}
+		if opts.TileDir {
+			if err := os.WriteFile(filepath.Join(outputFilename, tileFileName(i%cols, i/cols)), ciphertext, 0644); err != nil {
+				return fmt.Errorf("failed to write tile: %w", err)
+			}
+		} else {
+			if _, err := f.Write(ciphertext); err != nil {
+				return fmt.Errorf("failed to write encrypted file: %w", err)
+			}
+			binary.BigEndian.PutUint64(index[12*i:], offset)
+			offset += uint64(len(ciphertext))
+		}
+		binary.BigEndian.PutUint32(index[12*i+8:], uint32(len(ciphertext)))
+	}
+
+	if opts.TileDir {
+		if err := os.WriteFile(filepath.Join(outputFilename, tiledIndexName), append(prefix, index...), 0644); err != nil {
+			return fmt.Errorf("failed to write tile index: %w", err)
+		}
+		return nil
+	}
+	if _, err := f.WriteAt(index, int64(len(prefix))); err != nil {
+		return fmt.Errorf("failed to write encrypted file: %w", err)
+	}
+	return f.Close()
+}
+
+// tileImage returns the part r of img, in a color model that PNG holds at
+// the depth of img.
+func tileImage(img image.Image, r image.Rectangle) image.Image {
+	switch img.(type) {
+	case *image.YCbCr, *image.CMYK:
+		// As in ReadImageForEncryption, JPEGs stay 8 bits per channel
+		nrgbaImg := image.NewNRGBA(image.Rect(0, 0, r.Dx(), r.Dy()))
+		draw.Draw(nrgbaImg, nrgbaImg.Rect, img, r.Min, draw.Src)
+		return nrgbaImg
+	}
+	if sub, ok := img.(interface {
+		SubImage(image.Rectangle) image.Image
+	}); ok {
+		return sub.SubImage(r)
+	}
+	nrgbaImg := image.NewNRGBA(image.Rect(0, 0, r.Dx(), r.Dy()))
+	draw.Draw(nrgbaImg, nrgbaImg.Rect, img, r.Min, draw.Src)
+	return nrgbaImg
+}
+
+// DecryptTiled decrypts the tiled file or directory at filename with key.
+// It returns the image, or only its part within region, decrypting just
+// the tiles covering it, when region is not empty, and the metadata PNG,
+// which OriginalFormat and ReadEXIF read as they do a whole decrypted
+// image.
+func DecryptTiled(filename string, key []byte, region image.Rectangle) (image.Image, []byte, error) {
+	dir := ""
+	if info, err := os.Stat(filename); err != nil {
+		return nil, nil, fmt.Errorf("failed to read encrypted file: %w", err)
+	} else if info.IsDir() {
+		dir, filename = filename, filepath.Join(filename, tiledIndexName)
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read encrypted file: %w", err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read encrypted file: %w", err)
+	}
+
+	// Read and check the header, keys and index, which must fit in the
+	// file before anything is allocated for them
+	fixed := make([]byte, len(tiledMagic)+12)
+	if _, err := io.ReadFull(f, fixed); err != nil || string(fixed[:len(tiledMagic)]) != tiledMagic {
+		return nil, nil, fmt.Errorf("not a tiled file: %w", ErrNotEncryptedFile)
+	}
+	h := tiledHeader{
+		Width:    int(binary.BigEndian.Uint32(fixed[8:])),
+		Height:   int(binary.BigEndian.Uint32(fixed[12:])),
+		TileSize: int(binary.BigEndian.Uint32(fixed[16:])),
+	}
+	cols, rows := 0, 0
+	if h.Width > 0 && h.Height > 0 && h.TileSize > 0 {
+		cols, rows = h.grid()
+	}
+	if cols*rows == 0 || cols*rows > maxTiles {
+		return nil, nil, fmt.Errorf("corrupt tiled file: a %dx%d image in tiles of %d", h.Width, h.Height, h.TileSize)
+	}
+	var blobs [2][]byte
+	for i := range blobs {
+		if blobs[i], err = readTiledBlob(f); err != nil {
+			return nil, nil, err
+		}
+	}
+	dataKey, err := DecryptWithAAD(key, blobs[0], h.bytes())
+	if err != nil {
+		return nil, nil, err
+	}
+	meta, err := DecryptWithAAD(dataKey, blobs[1], h.bytes())
+	if err != nil {
+		return nil, nil, err
+	}
+	if int64(12*cols*rows) > info.Size() {
+		return nil, nil, fmt.Errorf("corrupt tiled file: an index of %d tiles in %d bytes", cols*rows, info.Size())
+	}
+	index, err := readExactly(f, int64(12*cols*rows))
+	if err != nil {
+		return nil, nil, fmt.Errorf("corrupt tiled file: the index is cut short")
+	}
+
+	full := image.Rect(0, 0, h.Width, h.Height)
+	if region.Empty() {
+		region = full
+	} else if region = region.Intersect(full); region.Empty() {
+		return nil, nil, fmt.Errorf("the region lies outside the %dx%d image", h.Width, h.Height)
+	}
+
+	var dst draw.Image
+	for i := range cols * rows {
+		tr := h.tile(i)
+		if !tr.Overlaps(region) {
+			continue
+		}
+		var ciphertext []byte
+		if dir != "" {
+			if ciphertext, err = os.ReadFile(filepath.Join(dir, tileFileName(i%cols, i/cols))); err != nil {
+				return nil, nil, fmt.Errorf("failed to read tile: %w", err)
+			}
+		} else {
+			offset, length := binary.BigEndian.Uint64(index[12*i:]), uint64(binary.BigEndian.Uint32(index[12*i+8:]))
+			if offset > uint64(info.Size()) || length > uint64(info.Size())-offset {
+				return nil, nil, fmt.Errorf("corrupt tiled file: tile %d lies past the end of the file", i)
+			}
+			ciphertext = make([]byte, length)
+			if _, err := f.ReadAt(ciphertext, int64(offset)); err != nil {
+				return nil, nil, fmt.Errorf("corrupt tiled file: tile %d is cut short", i)
+			}
+		}
+		plaintext, err := DecryptWithAAD(dataKey, ciphertext, h.tileAAD(tr))
+		if err != nil {
+			return nil, nil, fmt.Errorf("tile %d: %w", i, err)
+		}
+		tile, err := BytesToImage(plaintext)
+		if err != nil {
+			return nil, nil, fmt.Errorf("tile %d: %w", i, err)
+		}
+		if tile.Bounds().Size() != tr.Size() {
+			return nil, nil, fmt.Errorf("corrupt tiled file: tile %d is %v, want %v", i, tile.Bounds().Size(), tr.Size())
+		}
+		if dst == nil {
+			dst = tiledCanvas(tile, region.Size())
+		}
+		pasteTile(dst, tile, tr.Intersect(region).Sub(region.Min), tr.Intersect(region).Min.Sub(tr.Min))
+	}
+	return dst, meta, nil
+}
+
+// readTiledBlob reads a blob preceded by its length from r.
+func readTiledBlob(r io.Reader) ([]byte, error) {
+	var length [4]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return nil, fmt.Errorf("corrupt tiled file: the header is cut short")
+	}
+	n := binary.BigEndian.Uint32(length[:])
+	if n > maxTiledBlobSize {
+		return nil, fmt.Errorf("corrupt tiled file: a header field of %d bytes", n)
+	}
+	blob, err := readExactly(r, int64(n))
+	if err != nil {
+		return nil, fmt.Errorf("corrupt tiled file: the header is cut short")
+	}
+	return blob, nil
+}
+
+// tiledCanvas returns an image of size to paste tiles like tile into,
+// keeping the color model of grayscale, paletted and 16-bit tiles.
+func tiledCanvas(tile image.Image, size image.Point) draw.Image {
+	r := image.Rectangle{Max: size}
+	switch {
+	case tile.ColorModel() == color.GrayModel:
+		return image.NewGray(r)
+	case tile.ColorModel() == color.Gray16Model:
+		return image.NewGray16(r)
+	case is16Bit(tile):
+		return image.NewNRGBA64(r)
+	}
+	if paletted, ok := tile.(*image.Paletted); ok {
+		return image.NewPaletted(r, paletted.Palette)
+	}
+	return image.NewNRGBA(r)
+}
+
+// pasteTile copies tile, from sp, into r of dst. Pixels are copied as
+// they are when tile has the type of dst, keeping the exact values of
+// semi-transparent and paletted pixels that drawing would convert.
+func pasteTile(dst draw.Image, tile image.Image, r image.Rectangle, sp image.Point) {
+	src, ok := tile.(draw.Image)
+	if !ok || reflect.TypeOf(src) != reflect.TypeOf(dst) {
+		draw.Draw(dst, r, tile, tile.Bounds().Min.Add(sp), draw.Src)
+		return
+	}
+	srcPix, srcStride := pixBuffer(src)
+	dstPix, dstStride := pixBuffer(dst)
+	bpp := dstStride / max(dst.Bounds().Dx(), 1) // Bytes per pixel
+	for y := 0; y < r.Dy(); y++ {
+		s := (sp.Y+y)*srcStride + sp.X*bpp
+		copy(dstPix[(r.Min.Y+y)*dstStride+r.Min.X*bpp:], srcPix[s:s+r.Dx()*bpp])
+	}
+}
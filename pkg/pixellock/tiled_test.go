@@ -0,0 +1,196 @@
+package pixellock
+
+import (
+	"encoding/binary"
+	"image"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// largeTestImage returns a w by h image whose every pixel differs from its
+// neighbors, with semi-transparent ones among them.
+func largeTestImage(w, h int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for i := 0; i < len(img.Pix); i += 4 {
+		p := i / 4
+		img.Pix[i], img.Pix[i+1], img.Pix[i+2], img.Pix[i+3] = uint8(p%w), uint8(p/w), uint8(p*p%251), uint8(255-p%7*16)
+	}
+	return img
+}
+
+func TestTiledRoundTrip(t *testing.T) {
+	key, err := GenerateRandomKey()
+	if err != nil {
+		t.Fatalf("GenerateRandomKey failed: %v", err)
+	}
+	dir := t.TempDir()
+	images := map[string]image.Image{
+		// 1100x700 in tiles of 256 leaves cut tiles on the right and bottom
+		"large.png":    largeTestImage(1100, 700),
+		"gray.png":     grayTestImage(70, 50),
+		"paletted.png": palettedTestImage(70, 50),
+	}
+	for name, img := range deepTestImages() {
+		images[name+".png"] = img
+	}
+
+	for name, img := range images {
+		original := filepath.Join(dir, name)
+		if err := SaveImage(original, img, SaveOptions{Format: "png"}); err != nil {
+			t.Fatalf("SaveImage failed: %v", err)
+		}
+		tile := 256
+		if name != "large.png" {
+			tile = MinTileSize
+		}
+		for _, tileDir := range []bool{false, true} {
+			encrypted := filepath.Join(dir, "encrypted", name+EncryptedExtension)
+			if tileDir {
+				encrypted = filepath.Join(dir, "tiles", name+EncryptedExtension)
+			}
+			if err := EncryptFile(t.Context(), original, encrypted, key, true, EncryptOptions{Tile: tile, TileDir: tileDir}); err != nil {
+				t.Fatalf("%s: EncryptFile failed: %v", name, err)
+			}
+			if !IsTiled(encrypted) {
+				t.Fatalf("%s: not written tiled", name)
+			}
+			decrypted := filepath.Join(dir, "decrypted", name)
+			if err := DecryptFile(t.Context(), encrypted, decrypted, key, true, SaveOptions{}); err != nil {
+				t.Fatalf("%s: DecryptFile failed: %v", name, err)
+			}
+			got, err := LoadImage(decrypted)
+			if err != nil {
+				t.Fatalf("LoadImage failed: %v", err)
+			}
+			if !samePixels(got, img) {
+				t.Errorf("%s (directory %v): reassembled image differs from the original", name, tileDir)
+			}
+		}
+	}
+}
+
+func TestTiledRegion(t *testing.T) {
+	key, err := GenerateRandomKey()
+	if err != nil {
+		t.Fatalf("GenerateRandomKey failed: %v", err)
+	}
+	dir := t.TempDir()
+	img := largeTestImage(1100, 700)
+	original := filepath.Join(dir, "pano.png")
+	if err := SaveImage(original, img, SaveOptions{Format: "png"}); err != nil {
+		t.Fatalf("SaveImage failed: %v", err)
+	}
+	encrypted := filepath.Join(dir, "pano.png.enc")
+	if err := EncryptFile(t.Context(), original, encrypted, key, false, EncryptOptions{Tile: 256}); err != nil {
+		t.Fatalf("EncryptFile failed: %v", err)
+	}
+
+	for _, tc := range []struct {
+		spec string
+		want image.Rectangle
+	}{
+		{"300,200,400,250", image.Rect(300, 200, 700, 450)},    // Across four tiles
+		{"1000,600,500,500", image.Rect(1000, 600, 1100, 700)}, // Past the edges, cut to them
+		{"0,0,10,10", image.Rect(0, 0, 10, 10)},
+	} {
+		region, err := ParseTileRegion(tc.spec)
+		if err != nil {
+			t.Fatalf("ParseTileRegion(%q) failed: %v", tc.spec, err)
+		}
+		decrypted := filepath.Join(dir, "region.png")
+		if err := DecryptFile(t.Context(), encrypted, decrypted, key, true, SaveOptions{Format: "png", TileRegion: region}); err != nil {
+			t.Fatalf("%s: DecryptFile failed: %v", tc.spec, err)
+		}
+		got, err := LoadImage(decrypted)
+		if err != nil {
+			t.Fatalf("LoadImage failed: %v", err)
+		}
+		if !samePixels(got, toNRGBA(img.SubImage(tc.want))) {
+			t.Errorf("%s: region differs from the crop %v of the original", tc.spec, tc.want)
+		}
+	}
+
+	if _, _, err := DecryptTiled(encrypted, key, image.Rect(2000, 0, 2010, 10)); err == nil {
+		t.Error("DecryptTiled accepted a region outside the image")
+	}
+	for _, spec := range []string{"1,2,3", "1,2,0,4", "-1,0,5,5", "a,b,c,d"} {
+		if _, err := ParseTileRegion(spec); err == nil {
+			t.Errorf("ParseTileRegion accepted %q", spec)
+		}
+	}
+
+	// A file that is not tiled has no tiles to pick from
+	whole := filepath.Join(dir, "whole.png.enc")
+	if err := EncryptFile(t.Context(), original, whole, key, false, EncryptOptions{}); err != nil {
+		t.Fatalf("EncryptFile failed: %v", err)
+	}
+	if err := DecryptFile(t.Context(), whole, filepath.Join(dir, "whole.png"), key, true, SaveOptions{TileRegion: image.Rect(0, 0, 10, 10)}); err == nil {
+		t.Error("DecryptFile took a tile region for an image that is not tiled")
+	}
+}
+
+func TestTiledTampering(t *testing.T) {
+	key, err := GenerateRandomKey()
+	if err != nil {
+		t.Fatalf("GenerateRandomKey failed: %v", err)
+	}
+	dir := t.TempDir()
+	original := filepath.Join(dir, "in.png")
+	if err := SaveImage(original, largeTestImage(64, 32), SaveOptions{Format: "png"}); err != nil {
+		t.Fatalf("SaveImage failed: %v", err)
+	}
+	encrypted := filepath.Join(dir, "in.png.enc")
+	if err := EncryptFile(t.Context(), original, encrypted, key, false, EncryptOptions{Tile: 32}); err != nil {
+		t.Fatalf("EncryptFile failed: %v", err)
+	}
+	data, err := os.ReadFile(encrypted)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+
+	other, err := GenerateRandomKey()
+	if err != nil {
+		t.Fatalf("GenerateRandomKey failed: %v", err)
+	}
+	if _, _, err := DecryptTiled(encrypted, other, image.Rectangle{}); err == nil {
+		t.Error("DecryptTiled succeeded with the wrong key")
+	}
+
+	// Swap the index entries of the two tiles, which are encrypted for
+	// their own places
+	h := len(tiledMagic) + 12
+	for range 2 {
+		h += 4 + int(binary.BigEndian.Uint32(data[h:]))
+	}
+	swapped := append([]byte(nil), data...)
+	copy(swapped[h:h+12], data[h+12:h+24])
+	copy(swapped[h+12:h+24], data[h:h+12])
+	if err := os.WriteFile(encrypted, swapped, 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	if _, _, err := DecryptTiled(encrypted, key, image.Rectangle{}); err == nil {
+		t.Error("DecryptTiled accepted swapped tiles")
+	}
+
+	// Changing the size in the header is caught too
+	resized := append([]byte(nil), data...)
+	binary.BigEndian.PutUint32(resized[len(tiledMagic):], 63)
+	if err := os.WriteFile(encrypted, resized, 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	if _, _, err := DecryptTiled(encrypted, key, image.Rectangle{}); err == nil {
+		t.Error("DecryptTiled accepted a changed header")
+	}
+
+	for _, opts := range []EncryptOptions{
+		{Tile: MinTileSize - 1},
+		{TileDir: true},
+		{Tile: 256, Mode: ModeScramble},
+		{Tile: 256, Thumbnail: 64},
+	} {
+		if err := opts.Check(); err == nil {
+			t.Errorf("Check accepted %+v", opts)
+		}
+	}
+}
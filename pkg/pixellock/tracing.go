@@ -0,0 +1,81 @@
+package pixellock
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// The spans encryption and decryption start, with the TracerProvider of
+// their options, or the global one of otel.GetTracerProvider when it is
+// nil, which is a no-op until otel.SetTracerProvider is called. A
+// directory is a span, and each file a span beneath it, or beneath the
+// span of its context when it is encrypted or decrypted alone, with a span
+// each for loading, encrypting or decrypting, and writing it. A stream is
+// written as it is encrypted, and decrypted as it is read, so its encrypt
+// span covers writing all but the last of it, and its decrypt span reading
+// all but its header.
+const (
+	SpanEncryptDirectory = "encrypt_directory"
+	SpanDecryptDirectory = "decrypt_directory"
+	SpanEncryptFile      = "encrypt_file"
+	SpanDecryptFile      = "decrypt_file"
+	SpanLoad             = "load"
+	SpanEncrypt          = "encrypt"
+	SpanDecrypt          = "decrypt"
+	SpanWrite            = "write"
+)
+
+// The attributes of the spans, by the keys they are exported under.
+const (
+	AttrInput        = "pixellock.input"         // The file or directory read, of directories and files
+	AttrOutput       = "pixellock.output"        // The file or directory written, of directories and files
+	AttrFiles        = "pixellock.files"         // The files found, of directories
+	AttrSkipped      = "pixellock.skipped"       // Set on a file whose output existed, so was left alone
+	AttrBytesRead    = "pixellock.bytes_read"    // Of load spans
+	AttrBytesWritten = "pixellock.bytes_written" // Of write spans
+	AttrCipher       = "pixellock.cipher"        // The CipherName of a stream's suite, of encrypt and decrypt spans
+)
+
+// ScopeName is the instrumentation scope of the spans.
+const ScopeName = "github.com/Amul-Thantharate/pixellock"
+
+// tracer returns the Tracer of tp, or of the global TracerProvider when tp
+// is nil.
+func tracer(tp trace.TracerProvider) trace.Tracer {
+	if tp == nil {
+		tp = otel.GetTracerProvider()
+	}
+	return tp.Tracer(ScopeName)
+}
+
+// startPhase starts the span name beneath the span of ctx, with the
+// TracerProvider that started that span, so recording nothing when ctx
+// holds none.
+func startPhase(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return trace.SpanFromContext(ctx).TracerProvider().Tracer(ScopeName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan records err, when it is not nil, as why span failed, and ends
+// span.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// setBytesWritten sets AttrBytesWritten of span to the size of the file
+// name, looked up in fsys only when span is recorded.
+func setBytesWritten(span trace.Span, fsys FileSystem, name string) {
+	if !span.IsRecording() {
+		return
+	}
+	if info, err := fsys.Stat(name); err == nil {
+		span.SetAttributes(attribute.Int64(AttrBytesWritten, info.Size()))
+	}
+}
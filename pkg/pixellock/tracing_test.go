@@ -0,0 +1,149 @@
+package pixellock
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// traceBatch runs fn beneath a root span of a TracerProvider exporting to
+// memory, given the option of it, and returns the spans exported, by ID,
+// and the root's ID.
+func traceBatch(t *testing.T, fn func(ctx context.Context, traced Option)) (map[trace.SpanID]tracetest.SpanStub, trace.SpanID) {
+	t.Helper()
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	ctx, root := tp.Tracer("test").Start(t.Context(), "batch")
+	fn(ctx, WithTracerProvider(tp))
+	root.End()
+	spans := map[trace.SpanID]tracetest.SpanStub{}
+	for _, s := range exporter.GetSpans() {
+		if s.SpanContext.TraceID() != root.SpanContext().TraceID() {
+			t.Errorf("%s is of another trace", s.Name)
+		}
+		spans[s.SpanContext.SpanID()] = s
+	}
+	return spans, root.SpanContext().SpanID()
+}
+
+// children returns the names of the spans beneath parent, and the spans by
+// name.
+func children(spans map[trace.SpanID]tracetest.SpanStub, parent trace.SpanID) map[string][]tracetest.SpanStub {
+	byName := map[string][]tracetest.SpanStub{}
+	for _, s := range spans {
+		if s.Parent.SpanID() == parent {
+			byName[s.Name] = append(byName[s.Name], s)
+		}
+	}
+	return byName
+}
+
+// attr returns the value of the attribute key of s, or nil when it has
+// none.
+func attr(s tracetest.SpanStub, key string) any {
+	for _, kv := range s.Attributes {
+		if kv.Key == attribute.Key(key) {
+			return kv.Value.AsInterface()
+		}
+	}
+	return nil
+}
+
+func TestTraceDirectory(t *testing.T) {
+	fsys, in := progressFixture(t, 2)
+	key, _ := GenerateRandomKey()
+	spans, root := traceBatch(t, func(ctx context.Context, traced Option) {
+		encryptor, _ := NewEncryptor(WithKey(key), WithFS(fsys), traced)
+		decryptor, _ := NewDecryptor(WithKey(key), WithFS(fsys), traced)
+		if err := encryptor.ProcessDir(ctx, in, "enc"); err != nil {
+			t.Fatalf("ProcessDir failed: %v", err)
+		}
+		if err := decryptor.ProcessDir(ctx, "enc", "out"); err != nil {
+			t.Fatalf("ProcessDir failed: %v", err)
+		}
+	})
+
+	for _, op := range []struct {
+		dir, file, crypt string
+		output           string
+	}{
+		{SpanEncryptDirectory, SpanEncryptFile, SpanEncrypt, "enc"},
+		{SpanDecryptDirectory, SpanDecryptFile, SpanDecrypt, "out"},
+	} {
+		dirs := children(spans, root)[op.dir]
+		if len(dirs) != 1 {
+			t.Fatalf("%d %s spans beneath the root, want 1", len(dirs), op.dir)
+		}
+		dir := dirs[0]
+		if n := attr(dir, AttrFiles); n != int64(2) {
+			t.Errorf("%s found %v files, want 2", op.dir, n)
+		}
+		if output := attr(dir, AttrOutput); output != op.output {
+			t.Errorf("%s output = %v", op.dir, output)
+		}
+		files := children(spans, dir.SpanContext.SpanID())[op.file]
+		if len(files) != 2 {
+			t.Fatalf("%d %s spans beneath %s, want 2", len(files), op.file, op.dir)
+		}
+		for _, file := range files {
+			input := attr(file, AttrInput)
+			phases := children(spans, file.SpanContext.SpanID())
+			load, crypt, write := phases[SpanLoad], phases[op.crypt], phases[SpanWrite]
+			if len(load) != 1 || len(crypt) != 1 || len(write) != 1 {
+				t.Errorf("%s of %v has spans %v, want one each of load, %s and write", op.file, input, phases, op.crypt)
+				continue
+			}
+			if n := attr(load[0], AttrBytesRead); n == nil || n.(int64) <= 0 {
+				t.Errorf("load of %v read %v bytes", input, n)
+			}
+			if cipher := attr(crypt[0], AttrCipher); cipher != CipherName(AESGCM) {
+				t.Errorf("%s of %v has cipher %v", op.crypt, input, cipher)
+			}
+			if n := attr(write[0], AttrBytesWritten); n == nil || n.(int64) <= 0 {
+				t.Errorf("write of %v wrote %v bytes", input, n)
+			}
+			if load[0].StartTime.Before(file.StartTime) || write[0].EndTime.After(file.EndTime) || crypt[0].StartTime.Before(load[0].EndTime) {
+				t.Errorf("the phases of %v are out of order", input)
+			}
+		}
+	}
+
+	// A file already encrypted is skipped, and says so
+	spans, root = traceBatch(t, func(ctx context.Context, traced Option) {
+		encryptor, _ := NewEncryptor(WithKey(key), WithFS(fsys), traced)
+		encryptor.ProcessFile(ctx, filepath.Join(in, "img0.png"), filepath.Join("enc", "img0.png.enc"))
+	})
+	files := children(spans, root)[SpanEncryptFile]
+	if len(files) != 1 {
+		t.Fatalf("%d %s spans beneath the root, want 1", len(files), SpanEncryptFile)
+	}
+	if skipped := attr(files[0], AttrSkipped); skipped != true || len(children(spans, files[0].SpanContext.SpanID())) != 0 {
+		t.Errorf("a skipped file has %v set to %v", AttrSkipped, skipped)
+	}
+
+	// A file that fails to decrypt fails its span
+	other, _ := GenerateRandomKey()
+	spans, root = traceBatch(t, func(ctx context.Context, traced Option) {
+		wrongKey, _ := NewDecryptor(WithKey(other), WithFS(fsys), WithOverwritePolicy(OverwriteReplace), traced)
+		wrongKey.ProcessFile(ctx, filepath.Join("enc", "img0.png.enc"), filepath.Join("out", "img0.png"))
+	})
+	files = children(spans, root)[SpanDecryptFile]
+	if len(files) != 1 || files[0].Status.Code != codes.Error {
+		t.Errorf("a file decrypted with the wrong key has spans %v", files)
+	}
+
+	// Without a TracerProvider, the global one records nothing
+	spans, _ = traceBatch(t, func(ctx context.Context, _ Option) {
+		decryptor, _ := NewDecryptor(WithKey(key), WithFS(fsys), WithOverwritePolicy(OverwriteReplace))
+		decryptor.ProcessFile(ctx, filepath.Join("enc", "img0.png.enc"), filepath.Join("out", "img0.png"))
+	})
+	if len(spans) != 1 {
+		t.Errorf("a Decryptor without a TracerProvider exported %d spans beside the root", len(spans)-1)
+	}
+}
@@ -0,0 +1,183 @@
+package pixellock
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// The kinds of TreeDifference.
+const (
+	TreeOnlyLeft    = "only-left"    // In the left tree alone
+	TreeOnlyRight   = "only-right"   // In the right tree alone
+	TreeSize        = "size"         // Files of different sizes
+	TreeHash        = "hash"         // Files of the same size, but different bytes
+	TreeContent     = "content"      // Files whose images, decrypted, differ
+	TreeSameContent = "same-content" // Files that differ, but whose images, decrypted, are the same
+	TreeError       = "error"        // Files that could not be compared
+)
+
+// A TreeDifference is a file of two trees DiffTrees finds is not the same
+// in both.
+type TreeDifference struct {
+	Path string `json:"path"` // Within each tree, / separated
+	Kind string `json:"kind"`
+
+	// LeftSize and RightSize are the sizes of the file in each tree it
+	// is in.
+	LeftSize  int64 `json:"left_size,omitempty"`
+	RightSize int64 `json:"right_size,omitempty"`
+
+	// Detail says more of a difference, such as why the file could not
+	// be compared.
+	Detail string `json:"detail,omitempty"`
+}
+
+// DiffTrees compares the regular files of the directories left and right
+// by their paths within each, and returns the differences, in order of
+// their paths. Files in both trees are compared by size, and by SHA-256
+// hash when their sizes match. With a key, files that differ are both
+// decrypted in memory, and their images compared: the same image
+// encrypted twice differs in its nonces, and is a TreeSameContent rather
+// than a TreeSize or TreeHash difference, while TreeContent ones differ in
+// their images too. Only files named with EncryptedExtension are
+// decrypted; others, such as manifests, are compared by their bytes
+// alone. A file that cannot be read or decrypted is a TreeError
+// difference, rather than failing the whole comparison.
+func DiffTrees(ctx context.Context, left, right string, key []byte) ([]TreeDifference, error) {
+	leftFiles, err := treeFiles(ctx, left)
+	if err != nil {
+		return nil, err
+	}
+	rightFiles, err := treeFiles(ctx, right)
+	if err != nil {
+		return nil, err
+	}
+	var keys *keyCipher
+	if key != nil {
+		keys = newKeyCipher(key)
+	}
+	var diffs []TreeDifference
+	for rel, l := range leftFiles {
+		r, ok := rightFiles[rel]
+		if !ok {
+			diffs = append(diffs, TreeDifference{Path: rel, Kind: TreeOnlyLeft, LeftSize: l.Size()})
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		d := TreeDifference{Path: rel, LeftSize: l.Size(), RightSize: r.Size()}
+		if d.Kind, d.Detail = diffFiles(ctx, keys, filepath.Join(left, filepath.FromSlash(rel)), filepath.Join(right, filepath.FromSlash(rel)), l, r); d.Kind != "" {
+			diffs = append(diffs, d)
+		}
+	}
+	for rel, r := range rightFiles {
+		if _, ok := leftFiles[rel]; !ok {
+			diffs = append(diffs, TreeDifference{Path: rel, Kind: TreeOnlyRight, RightSize: r.Size()})
+		}
+	}
+	slices.SortFunc(diffs, func(a, b TreeDifference) int { return strings.Compare(a.Path, b.Path) })
+	return diffs, nil
+}
+
+// treeFiles returns the regular files of dir and its subdirectories, by
+// their / separated paths within it.
+func treeFiles(ctx context.Context, dir string) (map[string]fs.FileInfo, error) {
+	files := map[string]fs.FileInfo{}
+	err := filepath.WalkDir(dir, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, name)
+		if err != nil {
+			return err
+		}
+		files[filepath.ToSlash(rel)] = info
+		return nil
+	})
+	return files, err
+}
+
+// diffFiles compares the files a and b, of the infos given, returning the
+// kind of their difference, or "" when they are the same, and its detail.
+func diffFiles(ctx context.Context, keys *keyCipher, a, b string, ai, bi fs.FileInfo) (kind, detail string) {
+	kind = TreeSize
+	if ai.Size() == bi.Size() {
+		ha, err := hashTreeFile(a)
+		if err != nil {
+			return TreeError, err.Error()
+		}
+		hb, err := hashTreeFile(b)
+		if err != nil {
+			return TreeError, err.Error()
+		}
+		if ha == hb {
+			return "", ""
+		}
+		kind = TreeHash
+	}
+	if keys == nil || !strings.HasSuffix(a, EncryptedExtension) {
+		return kind, ""
+	}
+	pa, err := plaintextDigest(ctx, keys, a)
+	if err != nil {
+		return TreeError, fmt.Sprintf("left: %v", err)
+	}
+	pb, err := plaintextDigest(ctx, keys, b)
+	if err != nil {
+		return TreeError, fmt.Sprintf("right: %v", err)
+	}
+	if pa != pb {
+		return TreeContent, ""
+	}
+	return TreeSameContent, ""
+}
+
+// hashTreeFile returns the SHA-256 hash of the file name.
+func hashTreeFile(name string) ([sha256.Size]byte, error) {
+	var sum [sha256.Size]byte
+	f, err := os.Open(name)
+	if err != nil {
+		return sum, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return sum, err
+	}
+	h.Sum(sum[:0])
+	return sum, nil
+}
+
+// plaintextDigest returns the SHA-256 hash of the image of the encrypted
+// file name, decrypted with the key of keys: the data encryption stored,
+// or the pixels of a tiled image.
+func plaintextDigest(ctx context.Context, keys *keyCipher, name string) ([sha256.Size]byte, error) {
+	tiled, data, _, err := decryptFileData(ctx, OSFS{}, nil, name, keys, SaveOptions{}, false)
+	if err != nil {
+		return [sha256.Size]byte{}, err
+	}
+	if tiled != nil {
+		if data, err = ImageToBytes(tiled); err != nil {
+			return [sha256.Size]byte{}, err
+		}
+	}
+	return sha256.Sum256(data), nil
+}
@@ -0,0 +1,102 @@
+package pixellock
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// copyTree copies the regular files of src to dst.
+func copyTree(t *testing.T, src, dst string) {
+	t.Helper()
+	for rel := range outputFiles(t, src) {
+		data, err := os.ReadFile(filepath.Join(src, filepath.FromSlash(rel)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		name := filepath.Join(dst, filepath.FromSlash(rel))
+		os.MkdirAll(filepath.Dir(name), 0o755)
+		if err := os.WriteFile(name, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestDiffTrees(t *testing.T) {
+	key, _ := GenerateRandomKey()
+	input, left, right := t.TempDir(), t.TempDir(), t.TempDir()
+	dedupeTree(t, input)
+	if err := EncryptDirectory(t.Context(), input, left, key, true, false, EncryptOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	copyTree(t, left, right)
+
+	if diffs, err := DiffTrees(t.Context(), left, right, key); err != nil || len(diffs) != 0 {
+		t.Fatalf("DiffTrees of copies gave %v, %v", diffs, err)
+	}
+
+	// One of each kind of difference
+	os.Remove(filepath.Join(right, "a", "face.jpg.enc"))
+	os.WriteFile(filepath.Join(right, "extra.txt"), []byte("extra"), 0o644)
+	os.WriteFile(filepath.Join(left, "notes.txt"), []byte("left"), 0o644)
+	os.WriteFile(filepath.Join(right, "notes.txt"), []byte("rite"), 0o644)
+	if err := EncryptFile(t.Context(), filepath.Join(input, "red.png"), filepath.Join(right, "red.png.enc"), key, true, EncryptOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := EncryptFile(t.Context(), filepath.Join(input, "c", "d", "face.jpg"), filepath.Join(right, "e", "red2.png.enc"), key, true, EncryptOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	damaged := filepath.Join(right, "b", "face copy.jpg.enc")
+	data, _ := os.ReadFile(damaged)
+	data[len(data)-1] ^= 0xff
+	os.WriteFile(damaged, data, 0o644)
+
+	for _, tc := range []struct {
+		name string
+		key  []byte
+		want map[string]string
+	}{
+		{"without a key", nil, map[string]string{
+			"a/face.jpg.enc":      TreeOnlyLeft,
+			"b/face copy.jpg.enc": TreeHash,
+			"e/red2.png.enc":      TreeSize,
+			"extra.txt":           TreeOnlyRight,
+			"notes.txt":           TreeHash,
+			"red.png.enc":         TreeHash,
+		}},
+		{"with the key", key, map[string]string{
+			"a/face.jpg.enc":      TreeOnlyLeft,
+			"b/face copy.jpg.enc": TreeError,
+			"e/red2.png.enc":      TreeContent,
+			"extra.txt":           TreeOnlyRight,
+			"notes.txt":           TreeHash,
+			"red.png.enc":         TreeSameContent,
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			diffs, err := DiffTrees(t.Context(), left, right, tc.key)
+			if err != nil {
+				t.Fatalf("DiffTrees failed: %v", err)
+			}
+			got := map[string]string{}
+			for i, d := range diffs {
+				got[d.Path] = d.Kind
+				if i > 0 && diffs[i-1].Path >= d.Path {
+					t.Errorf("differences out of order: %s before %s", diffs[i-1].Path, d.Path)
+				}
+			}
+			if len(got) != len(tc.want) {
+				t.Errorf("DiffTrees gave %v, want %v", got, tc.want)
+			}
+			for path, kind := range tc.want {
+				if got[path] != kind {
+					t.Errorf("%s is %q, want %q", path, got[path], kind)
+				}
+			}
+		})
+	}
+
+	if _, err := DiffTrees(t.Context(), left, filepath.Join(right, "missing"), nil); err == nil {
+		t.Error("DiffTrees of a missing directory succeeded")
+	}
+}
@@ -0,0 +1,191 @@
+package pixellock
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"slices"
+
+	"golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+)
+
+// WatermarkPositions are where a watermark that is not tiled can be placed:
+// the corners, the middles of the edges and the center, as in tl for top
+// left and c for the center.
+var WatermarkPositions = []string{"tl", "t", "tr", "l", "c", "r", "bl", "b", "br"}
+
+// Defaults for the options of a watermark.
+const (
+	DefaultWatermarkPosition = "br"
+	DefaultWatermarkOpacity  = 0.5
+	DefaultWatermarkScale    = 0.3  // Of the image width
+	DefaultWatermarkMargin   = 0.02 // Of the shorter side of the image
+)
+
+// WatermarkOptions describe a visible watermark: a line of text, drawn in
+// white with a dark shadow so it shows on any background, or an overlay
+// image such as a logo.
+type WatermarkOptions struct {
+	Text  string
+	Image string // Path of the overlay image, instead of Text
+
+	Position string  // One of WatermarkPositions; DefaultWatermarkPosition when empty
+	Opacity  float64 // From 0 to 1; DefaultWatermarkOpacity when zero
+	Scale    float64 // Width of the watermark as a fraction of the image width; DefaultWatermarkScale when zero
+	Margin   float64 // Space kept from the edges, as a fraction of the shorter side of the image
+	Tile     bool    // Repeat the watermark across the whole image instead of placing it once
+}
+
+// Check returns an error unless o describes a watermark.
+func (o WatermarkOptions) Check() error {
+	if (o.Text == "") == (o.Image == "") {
+		return fmt.Errorf("a watermark needs either text or an image")
+	}
+	if o.Position != "" && !slices.Contains(WatermarkPositions, o.Position) {
+		return fmt.Errorf("unknown watermark position %q (want one of %v)", o.Position, WatermarkPositions)
+	}
+	if o.Opacity < 0 || o.Opacity > 1 {
+		return fmt.Errorf("invalid watermark opacity %g: must be between 0 and 1", o.Opacity)
+	}
+	if o.Scale < 0 || o.Scale > 1 {
+		return fmt.Errorf("invalid watermark scale %g: must be between 0 and 1", o.Scale)
+	}
+	if o.Margin < 0 || o.Margin >= 0.5 {
+		return fmt.Errorf("invalid watermark margin %g: must be at least 0 and below 0.5", o.Margin)
+	}
+	return nil
+}
+
+// A Watermark is drawn onto images by Apply. It is made once with
+// NewWatermark, which loads its font or overlay image, and then applied to
+// any number of images.
+type Watermark struct {
+	opts    WatermarkOptions
+	overlay image.Image // The overlay image, or nil for text
+	font    *opentype.Font
+}
+
+// NewWatermark returns the watermark described by opts.
+func NewWatermark(opts WatermarkOptions) (*Watermark, error) {
+	if err := opts.Check(); err != nil {
+		return nil, err
+	}
+	if opts.Position == "" {
+		opts.Position = DefaultWatermarkPosition
+	}
+	if opts.Opacity == 0 {
+		opts.Opacity = DefaultWatermarkOpacity
+	}
+	if opts.Scale == 0 {
+		opts.Scale = DefaultWatermarkScale
+	}
+
+	w := &Watermark{opts: opts}
+	var err error
+	if opts.Image != "" {
+		if w.overlay, err = LoadImage(opts.Image); err != nil {
+			return nil, fmt.Errorf("failed to load the watermark image: %w", err)
+		}
+	} else if w.font, err = opentype.Parse(gobold.TTF); err != nil {
+		return nil, fmt.Errorf("failed to load the watermark font: %w", err)
+	}
+	return w, nil
+}
+
+// Apply returns a copy of img with the watermark drawn on it, sized and
+// placed relative to the size of img. Grayscale images stay grayscale
+// under a text watermark, and 16-bit images stay 16-bit.
+func (w *Watermark) Apply(img image.Image) image.Image {
+	b := img.Bounds()
+	var dst draw.Image
+	switch {
+	case w.overlay == nil && img.ColorModel() == color.GrayModel:
+		dst = image.NewGray(b)
+	case w.overlay == nil && img.ColorModel() == color.Gray16Model:
+		dst = image.NewGray16(b)
+	case is16Bit(img):
+		dst = image.NewNRGBA64(b)
+	default:
+		dst = image.NewNRGBA(b)
+	}
+	draw.Draw(dst, b, img, b.Min, draw.Src)
+
+	margin := int(math.Round(w.opts.Margin * float64(min(b.Dx(), b.Dy()))))
+	width := max(int(math.Round(w.opts.Scale*float64(b.Dx()))), 1)
+	stamp := w.stamp(width, max(b.Dy()-2*margin, 1))
+	size := stamp.Rect.Size()
+
+	if !w.opts.Tile {
+		h := slices.Index(WatermarkPositions, w.opts.Position)
+		at := image.Pt(
+			b.Min.X+margin+(b.Dx()-2*margin-size.X)*(h%3)/2,
+			b.Min.Y+margin+(b.Dy()-2*margin-size.Y)*(h/3)/2,
+		)
+		draw.Draw(dst, image.Rectangle{at, at.Add(size)}, stamp, image.Point{}, draw.Over)
+		return dst
+	}
+
+	// Rows of watermarks, each shifted by half a step from the one above
+	step := image.Pt(size.X+max(size.Y*2, margin), size.Y*3)
+	for row, y := 0, b.Min.Y+margin; y < b.Max.Y; row, y = row+1, y+step.Y {
+		x := b.Min.X + margin - (row%2)*step.X/2
+		for ; x < b.Max.X; x += step.X {
+			at := image.Pt(x, y)
+			draw.Draw(dst, image.Rectangle{at, at.Add(size)}, stamp, image.Point{}, draw.Over)
+		}
+	}
+	return dst
+}
+
+// stamp returns the watermark drawn once, with its opacity in its alpha,
+// as wide as width or, for an overlay image, shrunk further to be no taller
+// than height.
+func (w *Watermark) stamp(width, height int) *image.NRGBA {
+	var stamp *image.NRGBA
+	if w.overlay != nil {
+		ob := w.overlay.Bounds()
+		scale := min(float64(width)/float64(ob.Dx()), float64(height)/float64(ob.Dy()))
+		stamp = image.NewNRGBA(image.Rect(0, 0, max(int(math.Round(float64(ob.Dx())*scale)), 1), max(int(math.Round(float64(ob.Dy())*scale)), 1)))
+		draw.CatmullRom.Scale(stamp, stamp.Rect, w.overlay, ob, draw.Src, nil)
+	} else {
+		stamp = w.text(width)
+	}
+	for i := 3; i < len(stamp.Pix); i += 4 {
+		stamp.Pix[i] = uint8(math.Round(float64(stamp.Pix[i]) * w.opts.Opacity))
+	}
+	return stamp
+}
+
+// text returns the text of the watermark drawn about width pixels wide.
+func (w *Watermark) text(width int) *image.NRGBA {
+	// Measure at a reference size, then pick the size that fills width
+	const reference = 100
+	face, err := opentype.NewFace(w.font, &opentype.FaceOptions{Size: reference, DPI: 72})
+	if err != nil {
+		return image.NewNRGBA(image.Rect(0, 0, 1, 1))
+	}
+	advance := font.MeasureString(face, w.opts.Text).Round()
+	face.Close()
+	size := max(float64(reference*width)/float64(max(advance, 1)), 1)
+	if face, err = opentype.NewFace(w.font, &opentype.FaceOptions{Size: size, DPI: 72, Hinting: font.HintingFull}); err != nil {
+		return image.NewNRGBA(image.Rect(0, 0, 1, 1))
+	}
+	defer face.Close()
+
+	bounds, _ := font.BoundString(face, w.opts.Text)
+	shadow := max(int(size/24), 1)
+	stamp := image.NewNRGBA(image.Rect(0, 0,
+		max((bounds.Max.X-bounds.Min.X).Ceil(), 1)+shadow,
+		max((bounds.Max.Y-bounds.Min.Y).Ceil(), 1)+shadow))
+	d := font.Drawer{Dst: stamp, Src: image.Black, Face: face}
+	d.Dot = fixed.Point26_6{X: -bounds.Min.X + fixed.I(shadow), Y: -bounds.Min.Y + fixed.I(shadow)}
+	d.DrawString(w.opts.Text)
+	d.Src, d.Dot = image.White, fixed.Point26_6{X: -bounds.Min.X, Y: -bounds.Min.Y}
+	d.DrawString(w.opts.Text)
+	return stamp
+}
@@ -0,0 +1,160 @@
+package pixellock
+
+import (
+	"image"
+	"image/color"
+	"path/filepath"
+	"testing"
+)
+
+// solidNRGBA returns a w by h image of a single color.
+func solidNRGBA(w, h int, c color.NRGBA) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for i := 0; i < len(img.Pix); i += 4 {
+		img.Pix[i], img.Pix[i+1], img.Pix[i+2], img.Pix[i+3] = c.R, c.G, c.B, c.A
+	}
+	return img
+}
+
+// changedIn reports whether any pixel of got within r differs from want.
+func changedIn(got image.Image, want color.NRGBA, r image.Rectangle) bool {
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			if color.NRGBAModel.Convert(got.At(x, y)) != want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func TestWatermarkText(t *testing.T) {
+	gray := color.NRGBA{128, 128, 128, 255}
+	img := solidNRGBA(200, 100, gray)
+	w, err := NewWatermark(WatermarkOptions{Text: "CONFIDENTIAL", Margin: DefaultWatermarkMargin})
+	if err != nil {
+		t.Fatalf("NewWatermark failed: %v", err)
+	}
+	got := w.Apply(img)
+	if got.Bounds() != img.Rect {
+		t.Fatalf("watermarked bounds %v, want %v", got.Bounds(), img.Rect)
+	}
+
+	// Placed bottom right by default, 60 pixels wide
+	if !changedIn(got, gray, image.Rect(130, 70, 200, 100)) {
+		t.Error("no watermark in the bottom right corner")
+	}
+	for name, r := range map[string]image.Rectangle{
+		"top left":    image.Rect(0, 0, 100, 50),
+		"top right":   image.Rect(100, 0, 200, 50),
+		"bottom left": image.Rect(0, 50, 100, 100),
+	} {
+		if changedIn(got, gray, r) {
+			t.Errorf("the %s corner changed", name)
+		}
+	}
+	if changedIn(img, gray, img.Rect) {
+		t.Error("Apply changed its input")
+	}
+
+	// Tiled, it covers every part of the image
+	w, err = NewWatermark(WatermarkOptions{Text: "CONFIDENTIAL", Tile: true})
+	if err != nil {
+		t.Fatalf("NewWatermark failed: %v", err)
+	}
+	tiled := w.Apply(img)
+	for _, r := range []image.Rectangle{image.Rect(0, 0, 100, 50), image.Rect(100, 0, 200, 50), image.Rect(0, 50, 100, 100), image.Rect(100, 50, 200, 100)} {
+		if !changedIn(tiled, gray, r) {
+			t.Errorf("tiled watermark left %v untouched", r)
+		}
+	}
+
+	// Text stays gray on a grayscale image
+	if _, ok := w.Apply(grayTestImage(64, 48)).(*image.Gray); !ok {
+		t.Error("a grayscale image did not stay grayscale")
+	}
+}
+
+func TestWatermarkImage(t *testing.T) {
+	dir := t.TempDir()
+	logo := filepath.Join(dir, "logo.png")
+	red := color.NRGBA{255, 0, 0, 255}
+	if err := SaveImage(logo, solidNRGBA(20, 10, red), SaveOptions{Format: "png"}); err != nil {
+		t.Fatalf("SaveImage failed: %v", err)
+	}
+	blue := color.NRGBA{0, 0, 255, 255}
+	img := solidNRGBA(100, 100, blue)
+
+	// At full opacity and half the width, the logo covers 50x25 pixels of
+	// the top left, 10 pixels in
+	w, err := NewWatermark(WatermarkOptions{Image: logo, Position: "tl", Opacity: 1, Scale: 0.5, Margin: 0.1})
+	if err != nil {
+		t.Fatalf("NewWatermark failed: %v", err)
+	}
+	got := w.Apply(img)
+	if c := color.NRGBAModel.Convert(got.At(30, 20)); c != red {
+		t.Errorf("inside the logo is %v, want %v", c, red)
+	}
+	if changedIn(got, blue, image.Rect(0, 0, 100, 10)) || changedIn(got, blue, image.Rect(0, 35, 100, 100)) || changedIn(got, blue, image.Rect(60, 0, 100, 100)) {
+		t.Error("pixels outside the logo changed")
+	}
+
+	// Half opacity blends the two
+	w, err = NewWatermark(WatermarkOptions{Image: logo, Position: "c", Opacity: 0.5, Scale: 0.5})
+	if err != nil {
+		t.Fatalf("NewWatermark failed: %v", err)
+	}
+	if c := color.NRGBAModel.Convert(w.Apply(img).At(50, 50)).(color.NRGBA); c.R < 100 || c.R > 155 || c.B < 100 || c.B > 155 {
+		t.Errorf("half-opaque logo over blue is %v", c)
+	}
+
+	for _, opts := range []WatermarkOptions{
+		{},
+		{Text: "a", Image: logo},
+		{Text: "a", Position: "middle"},
+		{Text: "a", Opacity: 1.5},
+		{Text: "a", Scale: -1},
+		{Text: "a", Margin: 0.5},
+		{Image: filepath.Join(dir, "missing.png")},
+	} {
+		if _, err := NewWatermark(opts); err == nil {
+			t.Errorf("NewWatermark accepted %+v", opts)
+		}
+	}
+}
+
+func TestDecryptWatermark(t *testing.T) {
+	key, err := GenerateRandomKey()
+	if err != nil {
+		t.Fatalf("GenerateRandomKey failed: %v", err)
+	}
+	dir := t.TempDir()
+	white := color.NRGBA{255, 255, 255, 255}
+	original := filepath.Join(dir, "page.png")
+	if err := SaveImage(original, solidNRGBA(300, 200, white), SaveOptions{Format: "png"}); err != nil {
+		t.Fatalf("SaveImage failed: %v", err)
+	}
+	encrypted := filepath.Join(dir, "page.png.enc")
+	if err := EncryptFile(t.Context(), original, encrypted, key, false, EncryptOptions{}); err != nil {
+		t.Fatalf("EncryptFile failed: %v", err)
+	}
+
+	w, err := NewWatermark(WatermarkOptions{Text: "DRAFT", Position: "tl"})
+	if err != nil {
+		t.Fatalf("NewWatermark failed: %v", err)
+	}
+	decrypted := filepath.Join(dir, "preview.png")
+	if err := DecryptFile(t.Context(), encrypted, decrypted, key, false, SaveOptions{Format: "png", Watermark: w}); err != nil {
+		t.Fatalf("DecryptFile failed: %v", err)
+	}
+	got, err := LoadImage(decrypted)
+	if err != nil {
+		t.Fatalf("LoadImage failed: %v", err)
+	}
+	if !changedIn(got, white, image.Rect(0, 0, 100, 50)) {
+		t.Error("no watermark in the top left corner")
+	}
+	if changedIn(got, white, image.Rect(150, 100, 300, 200)) {
+		t.Error("the bottom right corner changed")
+	}
+}
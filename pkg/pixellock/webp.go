@@ -0,0 +1,331 @@
+package pixellock
+
+import (
+	"encoding/binary"
+	"fmt"
+	"image"
+	"io"
+	"sort"
+
+	_ "golang.org/x/image/webp" // Register the WebP decoder with image.Decode
+)
+
+// The standard library and golang.org/x/image only decode WebP, so lossless
+// WebP images are written here. The encoder keeps to the simplest valid
+// VP8L stream: the subtract-green transform, then every pixel as four
+// Huffman-coded literals with one set of codes for the whole image. It has
+// no backward references or predictors, so files are larger than those of
+// libwebp, but every pixel value, including the color of fully transparent
+// pixels, survives exactly.
+
+// vp8lMaxSize is the largest width or height a VP8L image can have.
+const vp8lMaxSize = 1 << 14
+
+// vp8lMaxCodeLength is the longest Huffman code VP8L allows, and
+// vp8lMaxCodeLengthCodeLength the longest code of the code length code.
+const (
+	vp8lMaxCodeLength           = 15
+	vp8lMaxCodeLengthCodeLength = 7
+)
+
+// Alphabet sizes of the five Huffman codes of a VP8L image without a color
+// cache: green with the 24 length prefixes, red, blue, alpha and distance.
+var vp8lAlphabetSizes = [5]int{256 + 24, 256, 256, 256, 40}
+
+// vp8lCodeLengthCodeOrder is the order code length code lengths are stored
+// in.
+var vp8lCodeLengthCodeOrder = [19]int{17, 18, 0, 1, 2, 3, 4, 5, 16, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+
+// EncodeWebP writes img to w as a lossless WebP image.
+func EncodeWebP(w io.Writer, img image.Image) error {
+	nrgbaImg := asNRGBA(img)
+	b := nrgbaImg.Bounds()
+	if b.Dx() < 1 || b.Dy() < 1 || b.Dx() > vp8lMaxSize || b.Dy() > vp8lMaxSize {
+		return fmt.Errorf("WebP images must be between 1 and %d pixels on each side, not %dx%d", vp8lMaxSize, b.Dx(), b.Dy())
+	}
+
+	// Subtract green from red and blue, and count the symbols of each code.
+	pixels := make([][4]byte, 0, b.Dx()*b.Dy()) // Green, red, blue, alpha
+	var counts [5][]uint32
+	for i, n := range vp8lAlphabetSizes {
+		counts[i] = make([]uint32, n)
+	}
+	alpha := false
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		row := nrgbaImg.Pix[nrgbaImg.PixOffset(b.Min.X, y) : nrgbaImg.PixOffset(b.Min.X, y)+b.Dx()*4]
+		for x := 0; x < len(row); x += 4 {
+			r, g, bl, a := row[x], row[x+1], row[x+2], row[x+3]
+			p := [4]byte{g, r - g, bl - g, a}
+			for c, v := range p {
+				counts[c][v]++
+			}
+			alpha = alpha || a != 0xff
+			pixels = append(pixels, p)
+		}
+	}
+
+	bw := &vp8lBitWriter{}
+	bw.write(0x2f, 8) // Signature
+	bw.write(uint32(b.Dx()-1), 14)
+	bw.write(uint32(b.Dy()-1), 14)
+	bw.writeBool(alpha)
+	bw.write(0, 3) // Version
+	bw.write(1, 1) // A transform follows:
+	bw.write(2, 2) // subtract green,
+	bw.write(0, 1) // and no other.
+	bw.write(0, 1) // No color cache
+	bw.write(0, 1) // One set of codes for the whole image
+
+	var codes [5]huffmanCode
+	for i := range codes {
+		codes[i] = newHuffmanCode(counts[i], vp8lMaxCodeLength)
+		codes[i].writeTo(bw)
+	}
+	for _, p := range pixels {
+		for c, v := range p {
+			codes[c].writeSymbol(bw, int(v))
+		}
+	}
+
+	data := bw.bytes()
+	header := make([]byte, 0, 20)
+	header = append(header, "RIFF"...)
+	header = binary.LittleEndian.AppendUint32(header, uint32(4+8+len(data)+len(data)%2))
+	header = append(header, "WEBPVP8L"...)
+	header = binary.LittleEndian.AppendUint32(header, uint32(len(data)))
+	if len(data)%2 == 1 {
+		data = append(data, 0) // Chunks are padded to an even size
+	}
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+// vp8lBitWriter writes the least significant bit first stream of a VP8L
+// image.
+type vp8lBitWriter struct {
+	buf  []byte
+	bits uint64
+	n    uint
+}
+
+// write appends the low n bits of v, at most 32.
+func (w *vp8lBitWriter) write(v uint32, n uint) {
+	w.bits |= uint64(v) << w.n
+	for w.n += n; w.n >= 8; w.n -= 8 {
+		w.buf = append(w.buf, byte(w.bits))
+		w.bits >>= 8
+	}
+}
+
+func (w *vp8lBitWriter) writeBool(v bool) {
+	if v {
+		w.write(1, 1)
+	} else {
+		w.write(0, 1)
+	}
+}
+
+// bytes returns the stream, padding the last byte with zero bits.
+func (w *vp8lBitWriter) bytes() []byte {
+	if w.n > 0 {
+		w.buf = append(w.buf, byte(w.bits))
+		w.bits, w.n = 0, 0
+	}
+	return w.buf
+}
+
+// huffmanCode is a canonical Huffman code over an alphabet.
+type huffmanCode struct {
+	lengths []uint8  // Code length of each symbol, 0 for unused ones
+	codes   []uint32 // Code of each symbol, bit reversed for vp8lBitWriter
+	single  bool     // Only one symbol is used; it takes no bits
+}
+
+// newHuffmanCode returns a code for symbols occurring counts times, with
+// codes no longer than maxLength bits.
+func newHuffmanCode(counts []uint32, maxLength int) huffmanCode {
+	h := huffmanCode{lengths: huffmanLengths(counts, maxLength), codes: make([]uint32, len(counts))}
+	used := 0
+	for _, l := range h.lengths {
+		if l > 0 {
+			used++
+		}
+	}
+	h.single = used <= 1
+	if used == 0 {
+		h.lengths[0] = 1 // An unused code still needs a symbol
+	}
+
+	// Assign canonical codes, shortest first and in symbol order within a
+	// length, as the decoder does.
+	var perLength [vp8lMaxCodeLength + 2]uint32
+	for _, l := range h.lengths {
+		perLength[l]++
+	}
+	perLength[0] = 0
+	var next [vp8lMaxCodeLength + 2]uint32
+	code := uint32(0)
+	for l := 1; l < len(next); l++ {
+		code = (code + perLength[l-1]) << 1
+		next[l] = code
+	}
+	for s, l := range h.lengths {
+		if l > 0 {
+			h.codes[s] = reverseBits(next[l], uint(l))
+			next[l]++
+		}
+	}
+	return h
+}
+
+// huffmanLengths returns Huffman code lengths of at most maxLength bits for
+// symbols occurring counts times. Lengths over the limit are avoided by
+// raising the smallest counts until the tree is shallow enough.
+func huffmanLengths(counts []uint32, maxLength int) []uint8 {
+	type node struct {
+		weight      uint64
+		left, right int // Children, or -1 and the symbol for leaves
+	}
+	lengths := make([]uint8, len(counts))
+	for floor := uint64(1); ; floor *= 2 {
+		var nodes []node
+		for s, c := range counts {
+			if c > 0 {
+				nodes = append(nodes, node{weight: max(uint64(c), floor), left: -1, right: s})
+			}
+		}
+		if len(nodes) == 1 {
+			lengths[nodes[0].right] = 1
+			return lengths
+		}
+		if len(nodes) == 0 {
+			return lengths
+		}
+		sort.SliceStable(nodes, func(i, j int) bool { return nodes[i].weight < nodes[j].weight })
+
+		// Merge the two lightest of the leaves and the merged nodes, which
+		// are created in order of weight, until one tree remains.
+		leaves := len(nodes)
+		leaf, merged := 0, leaves
+		lightest := func() int {
+			if leaf < leaves && (merged >= len(nodes) || nodes[leaf].weight <= nodes[merged].weight) {
+				leaf++
+				return leaf - 1
+			}
+			merged++
+			return merged - 1
+		}
+		for len(nodes) < 2*leaves-1 {
+			a, b := lightest(), lightest()
+			nodes = append(nodes, node{weight: nodes[a].weight + nodes[b].weight, left: a, right: b})
+		}
+
+		depth := make([]int, len(nodes))
+		deepest := 0
+		for i := len(nodes) - 1; i >= leaves; i-- {
+			depth[nodes[i].left] = depth[i] + 1
+			depth[nodes[i].right] = depth[i] + 1
+		}
+		for i := 0; i < leaves; i++ {
+			deepest = max(deepest, depth[i])
+		}
+		if deepest > maxLength {
+			continue
+		}
+		for i := 0; i < leaves; i++ {
+			lengths[nodes[i].right] = uint8(depth[i])
+		}
+		return lengths
+	}
+}
+
+// reverseBits returns the low n bits of v in reverse order.
+func reverseBits(v uint32, n uint) uint32 {
+	r := uint32(0)
+	for i := uint(0); i < n; i++ {
+		r = r<<1 | v>>i&1
+	}
+	return r
+}
+
+// writeSymbol writes the code of symbol s.
+func (h huffmanCode) writeSymbol(w *vp8lBitWriter, s int) {
+	if !h.single {
+		w.write(h.codes[s], uint(h.lengths[s]))
+	}
+}
+
+// writeTo writes the code lengths of h: as a simple code when at most two
+// symbols below 256 are used, and otherwise run-length encoded with the code
+// length code.
+func (h huffmanCode) writeTo(w *vp8lBitWriter) {
+	var used []int
+	for s, l := range h.lengths {
+		if l > 0 {
+			used = append(used, s)
+		}
+	}
+	if len(used) <= 2 && used[len(used)-1] < 256 {
+		w.write(1, 1) // Simple code
+		w.write(uint32(len(used)-1), 1)
+		if used[0] < 2 {
+			w.write(0, 1)
+			w.write(uint32(used[0]), 1)
+		} else {
+			w.write(1, 1)
+			w.write(uint32(used[0]), 8)
+		}
+		if len(used) == 2 {
+			w.write(uint32(used[1]), 8)
+		}
+		return
+	}
+
+	// Code 17 writes a run of 3-10 zeros and 18 one of 11-138; the other
+	// lengths are written as they are.
+	type token struct {
+		code      int
+		extra     uint32
+		extraBits uint
+	}
+	var tokens []token
+	var clCounts [19]uint32
+	for i := 0; i < len(h.lengths); {
+		run := 1
+		if h.lengths[i] == 0 {
+			for i+run < len(h.lengths) && h.lengths[i+run] == 0 && run < 138 {
+				run++
+			}
+		}
+		switch {
+		case run >= 11:
+			tokens = append(tokens, token{18, uint32(run - 11), 7})
+		case run >= 3:
+			tokens = append(tokens, token{17, uint32(run - 3), 3})
+		default:
+			run = 1
+			tokens = append(tokens, token{int(h.lengths[i]), 0, 0})
+		}
+		clCounts[tokens[len(tokens)-1].code]++
+		i += run
+	}
+
+	cl := newHuffmanCode(clCounts[:], vp8lMaxCodeLengthCodeLength)
+	n := len(vp8lCodeLengthCodeOrder)
+	for n > 4 && cl.lengths[vp8lCodeLengthCodeOrder[n-1]] == 0 {
+		n--
+	}
+	w.write(0, 1) // Normal code
+	w.write(uint32(n-4), 4)
+	for _, s := range vp8lCodeLengthCodeOrder[:n] {
+		w.write(uint32(cl.lengths[s]), 3)
+	}
+	w.write(0, 1) // Lengths for the whole alphabet follow
+	for _, t := range tokens {
+		cl.writeSymbol(w, t.code)
+		w.write(t.extra, t.extraBits)
+	}
+}
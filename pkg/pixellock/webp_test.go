@@ -0,0 +1,126 @@
+package pixellock
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"path/filepath"
+	"testing"
+)
+
+// webpRoundTrip encodes img as WebP, decodes it again and returns the result
+// as NRGBA.
+func webpRoundTrip(t *testing.T, img image.Image) *image.NRGBA {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := EncodeWebP(&buf, img); err != nil {
+		t.Fatalf("EncodeWebP failed: %v", err)
+	}
+	decoded, format, err := image.Decode(&buf)
+	if err != nil {
+		t.Fatalf("decoding the WebP image failed: %v", err)
+	}
+	if format != "webp" {
+		t.Fatalf("decoded format %q, want webp", format)
+	}
+	return asNRGBA(decoded)
+}
+
+func TestEncodeWebPLossless(t *testing.T) {
+	flat := image.NewNRGBA(image.Rect(0, 0, 7, 5))
+	for i := range flat.Pix {
+		flat.Pix[i] = []byte{12, 200, 7, 255}[i%4]
+	}
+	single := image.NewNRGBA(image.Rect(0, 0, 1, 1))
+	single.SetNRGBA(0, 0, color.NRGBA{1, 2, 3, 4})
+	for name, img := range map[string]*image.NRGBA{
+		"photo":       photoNRGBA(t),
+		"transparent": newTransparentNRGBA(33, 17),
+		"flat":        flat,
+		"single":      single,
+	} {
+		got := webpRoundTrip(t, img)
+		if got.Bounds().Size() != img.Bounds().Size() {
+			t.Errorf("%s: size %v, want %v", name, got.Bounds().Size(), img.Bounds().Size())
+			continue
+		}
+		if !bytes.Equal(got.Pix, img.Pix) {
+			t.Errorf("%s: pixels changed in the WebP round trip", name)
+		}
+	}
+
+	if err := EncodeWebP(new(bytes.Buffer), image.NewNRGBA(image.Rect(0, 0, vp8lMaxSize+1, 1))); err == nil {
+		t.Error("EncodeWebP accepted an image wider than WebP allows")
+	}
+}
+
+func TestWebPFiles(t *testing.T) {
+	dir := t.TempDir()
+	original := filepath.Join(dir, "original.webp")
+	if err := SaveImage(original, photoNRGBA(t), SaveOptions{Format: "webp"}); err != nil {
+		t.Fatalf("SaveImage failed: %v", err)
+	}
+	if !isImageFile(original) {
+		t.Error("isImageFile should return true for WebP file")
+	}
+	if format, err := DetectImageFormat(original); err != nil || format != "webp" {
+		t.Errorf("DetectImageFormat = %q, %v", format, err)
+	}
+
+	key, err := GenerateRandomKey()
+	if err != nil {
+		t.Fatalf("GenerateRandomKey failed: %v", err)
+	}
+	encrypted, decrypted := filepath.Join(dir, "original.enc"), filepath.Join(dir, "decrypted.webp")
+	if err := EncryptFile(t.Context(), original, encrypted, key, false, EncryptOptions{Metadata: MetadataPreserve}); err != nil {
+		t.Fatalf("EncryptFile failed: %v", err)
+	}
+	if err := DecryptFile(t.Context(), encrypted, decrypted, key, false, SaveOptions{Format: "webp"}); err != nil {
+		t.Fatalf("DecryptFile failed: %v", err)
+	}
+	want, err := LoadImage(original)
+	if err != nil {
+		t.Fatalf("LoadImage failed: %v", err)
+	}
+	got, err := LoadImage(decrypted)
+	if err != nil {
+		t.Fatalf("LoadImage failed: %v", err)
+	}
+	if !bytes.Equal(asNRGBA(got).Pix, asNRGBA(want).Pix) {
+		t.Error("decrypted WebP image differs from the original")
+	}
+
+	stego := filepath.Join(dir, "stego.webp")
+	message := []byte("hidden in a WebP")
+	if err := HidePayload(original, stego, Payload{Data: message}, StegoOptions{Density: 1, Password: "pw"}, "webp"); err != nil {
+		t.Fatalf("HidePayload failed: %v", err)
+	}
+	p, err := RevealPayload(stego, StegoOptions{Password: "pw"})
+	if err != nil {
+		t.Fatalf("RevealPayload failed: %v", err)
+	}
+	if !bytes.Equal(p.Data, message) {
+		t.Errorf("revealed %q, want %q", p.Data, message)
+	}
+}
+
+func TestHuffmanLengthsLimit(t *testing.T) {
+	// Fibonacci counts would need a code as long as the alphabet.
+	counts := make([]uint32, 40)
+	a, b := uint32(1), uint32(1)
+	for i := range counts {
+		counts[i] = a
+		a, b = b, a+b
+	}
+	lengths := huffmanLengths(counts, vp8lMaxCodeLength)
+	kraft := 0.0
+	for s, l := range lengths {
+		if l < 1 || l > vp8lMaxCodeLength {
+			t.Fatalf("symbol %d has code length %d", s, l)
+		}
+		kraft += 1 / float64(uint(1)<<l)
+	}
+	if kraft != 1 {
+		t.Errorf("code lengths do not form a complete code: Kraft sum %v", kraft)
+	}
+}
@@ -0,0 +1,474 @@
+// Package s3 is a client of Amazon S3, and of services compatible with
+// it, making the requests pixellock.S3FS needs to read and write images in
+// buckets. Requests are signed with AWS Signature Version 4, and those
+// throttled or failed by the server are retried. LoadConfig finds the
+// region and credentials as the AWS CLI and SDKs do.
+package s3
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Amul-Thantharate/pixellock/pkg/pixellock"
+)
+
+// Defaults of the retries of a Config.
+const (
+	DefaultMaxRetries = 5
+	DefaultRetryDelay = 200 * time.Millisecond
+)
+
+// maxRetryDelay bounds the wait before a retry.
+const maxRetryDelay = 10 * time.Second
+
+// credentialsRefresh is how long before they expire credentials are
+// replaced.
+const credentialsRefresh = 5 * time.Minute
+
+// Config configures a Client.
+type Config struct {
+	Region string
+
+	// Endpoint is the URL of the service; https://s3.Region.amazonaws.com
+	// by default.
+	Endpoint string
+
+	// PathStyle puts the bucket in the path of a request instead of its
+	// host, as services other than S3 often need. Buckets with dots in
+	// their names always are.
+	PathStyle bool
+
+	// Credentials provides the credentials requests are signed with.
+	Credentials CredentialsProvider
+
+	// HTTPClient sends the requests; one keeping a connection open for
+	// each of many concurrent transfers by default.
+	HTTPClient *http.Client
+
+	// MaxRetries is the number of times a request is retried after S3
+	// throttles or fails it, or its connection fails; DefaultMaxRetries
+	// when 0, and none when negative. The first retry waits about
+	// RetryDelay, DefaultRetryDelay when 0, and each after twice as long.
+	MaxRetries int
+	RetryDelay time.Duration
+}
+
+// LoadConfig returns the Config the AWS CLI and SDKs would find: the
+// profile named by AWS_PROFILE, or default; the region in AWS_REGION,
+// AWS_DEFAULT_REGION or the profile's region in the shared config file;
+// the endpoint in AWS_ENDPOINT_URL_S3 or AWS_ENDPOINT_URL, reached in path
+// style; and the credentials of DefaultCredentials.
+func LoadConfig() (Config, error) {
+	profile := os.Getenv("AWS_PROFILE")
+	if profile == "" {
+		profile = "default"
+	}
+	cfg := Config{Credentials: DefaultCredentials(profile)}
+	cfg.Region = os.Getenv("AWS_REGION")
+	if cfg.Region == "" {
+		cfg.Region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if cfg.Region == "" {
+		settings, err := readProfile(configFile(), profile, true)
+		if err != nil {
+			return Config{}, err
+		}
+		cfg.Region = settings["region"]
+	}
+	if cfg.Region == "" {
+		return Config{}, errors.New("no AWS region: set AWS_REGION, or region in ~/.aws/config")
+	}
+	cfg.Endpoint = os.Getenv("AWS_ENDPOINT_URL_S3")
+	if cfg.Endpoint == "" {
+		cfg.Endpoint = os.Getenv("AWS_ENDPOINT_URL")
+	}
+	cfg.PathStyle = cfg.Endpoint != ""
+	return cfg, nil
+}
+
+// A Client makes requests to S3 as its Config says. It is a
+// pixellock.S3Client, and can be used by several goroutines at once.
+type Client struct {
+	cfg      Config
+	endpoint *url.URL
+	http     *http.Client
+
+	mu    sync.Mutex
+	creds Credentials // The latest given by cfg.Credentials
+}
+
+var _ pixellock.S3Client = (*Client)(nil)
+
+// New returns a Client configured by cfg.
+func New(cfg Config) (*Client, error) {
+	if cfg.Region == "" {
+		return nil, errors.New("no AWS region given")
+	}
+	if cfg.Credentials == nil {
+		return nil, errors.New("no AWS credentials given")
+	}
+	if cfg.Endpoint == "" {
+		cfg.Endpoint = "https://s3." + cfg.Region + ".amazonaws.com"
+	}
+	endpoint, err := url.Parse(cfg.Endpoint)
+	if err != nil || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid S3 endpoint %q", cfg.Endpoint)
+	}
+	if cfg.MaxRetries == 0 {
+		cfg.MaxRetries = DefaultMaxRetries
+	}
+	if cfg.RetryDelay <= 0 {
+		cfg.RetryDelay = DefaultRetryDelay
+	}
+	client := cfg.HTTPClient
+	if client == nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.MaxIdleConnsPerHost = 64
+		client = &http.Client{Transport: transport}
+	}
+	return &Client{cfg: cfg, endpoint: endpoint, http: client}, nil
+}
+
+// An Error is a failure S3 responded with.
+type Error struct {
+	StatusCode int
+	Code       string // Such as NoSuchKey or SlowDown
+	Message    string
+	Region     string // Of the bucket, when S3 says it is in another
+}
+
+func (e *Error) Error() string {
+	msg := fmt.Sprintf("S3 %s (%d)", e.Code, e.StatusCode)
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	if e.Region != "" {
+		msg += "; the bucket is in region " + e.Region
+	}
+	return msg
+}
+
+// Is makes an Error for a missing object or bucket match fs.ErrNotExist.
+func (e *Error) Is(target error) bool {
+	return target == fs.ErrNotExist && e.StatusCode == http.StatusNotFound
+}
+
+// retryable reports whether a request failing with err may succeed if
+// retried: S3 throttled it or failed on its side, or its connection
+// failed.
+func retryable(err error) bool {
+	var e *Error
+	if !errors.As(err, &e) {
+		return true
+	}
+	switch e.Code {
+	case "SlowDown", "RequestTimeout", "Throttling", "ThrottlingException", "InternalError":
+		return true
+	}
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500
+}
+
+// s3ErrorBody is the body of an error response.
+type s3ErrorBody struct {
+	XMLName xml.Name `xml:"Error"`
+	Code    string
+	Message string
+	Region  string
+}
+
+// responseError returns the error of resp, closing its body.
+func responseError(resp *http.Response) error {
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	e := &Error{StatusCode: resp.StatusCode, Region: resp.Header.Get("X-Amz-Bucket-Region")}
+	var parsed s3ErrorBody
+	if xml.Unmarshal(body, &parsed) == nil {
+		e.Code, e.Message = parsed.Code, parsed.Message
+		if parsed.Region != "" {
+			e.Region = parsed.Region
+		}
+	}
+	if e.Code == "" {
+		e.Code = strings.ReplaceAll(http.StatusText(resp.StatusCode), " ", "")
+	}
+	return e
+}
+
+// credentials returns the credentials to sign with, asking for more as
+// those held near expiry.
+func (c *Client) credentials() (Credentials, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.creds.AccessKeyID != "" && (c.creds.Expires.IsZero() || time.Until(c.creds.Expires) > credentialsRefresh) {
+		return c.creds, nil
+	}
+	creds, err := c.cfg.Credentials()
+	if err != nil {
+		return Credentials{}, err
+	}
+	c.creds = creds
+	return creds, nil
+}
+
+// url returns the URL of the object key of bucket, or of bucket itself
+// when key is empty, with query.
+func (c *Client) url(bucket, key string, query url.Values) *url.URL {
+	u := *c.endpoint
+	if c.cfg.PathStyle || strings.Contains(bucket, ".") {
+		u.Path = "/" + bucket
+		u.RawPath = "/" + escape(bucket, false)
+		if key != "" {
+			u.Path += "/" + key
+			u.RawPath += "/" + escape(key, true)
+		}
+	} else {
+		u.Host = bucket + "." + u.Host
+		u.Path = "/" + key
+		u.RawPath = "/" + escape(key, true)
+	}
+	u.RawQuery = canonicalQuery(query)
+	return &u
+}
+
+// do sends the request of method for the object key of bucket, or bucket
+// itself when key is empty, with query, header and body, retrying it as
+// the Config says. It returns the response once it succeeds, whose body
+// the caller must close.
+func (c *Client) do(method, bucket, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	u := c.url(bucket, key, query)
+	payloadHash := hexSHA256(body)
+	delay := c.cfg.RetryDelay
+	for attempt := 0; ; attempt++ {
+		creds, err := c.credentials()
+		if err != nil {
+			return nil, err
+		}
+		req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.URL = u
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		sign(req, creds, c.cfg.Region, payloadHash, time.Now())
+		resp, err := c.http.Do(req)
+		if err == nil {
+			if resp.StatusCode < 300 {
+				return resp, nil
+			}
+			err = responseError(resp)
+		}
+		if attempt >= c.cfg.MaxRetries || !retryable(err) {
+			return nil, err
+		}
+		// Wait between half and all of the delay, so that workers
+		// throttled together retry apart
+		time.Sleep(delay/2 + rand.N(delay/2+1))
+		delay = min(delay*2, maxRetryDelay)
+	}
+}
+
+// decodeResult decodes the XML body of resp into v, closing it. S3 may
+// fail a request it has begun to answer with an Error body, returned as
+// an *Error.
+func decodeResult(resp *http.Response, v any) error {
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	var failed s3ErrorBody
+	if xml.Unmarshal(body, &failed) == nil {
+		return &Error{StatusCode: resp.StatusCode, Code: failed.Code, Message: failed.Message}
+	}
+	if v == nil {
+		return nil
+	}
+	return xml.Unmarshal(body, v)
+}
+
+// discard closes the body of resp, of no interest.
+func discard(resp *http.Response) {
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+}
+
+// objectOf returns the object key described by the headers of resp.
+func objectOf(key string, resp *http.Response) pixellock.S3Object {
+	obj := pixellock.S3Object{Key: key, Size: resp.ContentLength}
+	obj.ModTime, _ = http.ParseTime(resp.Header.Get("Last-Modified"))
+	return obj
+}
+
+// listResult is the body of a ListObjectsV2 response.
+type listResult struct {
+	Contents []struct {
+		Key          string
+		Size         int64
+		LastModified time.Time
+	}
+	CommonPrefixes []struct {
+		Prefix string
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+// List lists the objects of bucket under prefix, a page at a time.
+func (c *Client) List(bucket, prefix, delimiter string, limit int) (objects []pixellock.S3Object, prefixes []string, err error) {
+	query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+	if delimiter != "" {
+		query.Set("delimiter", delimiter)
+	}
+	if limit > 0 {
+		query.Set("max-keys", strconv.Itoa(limit))
+	}
+	for {
+		resp, err := c.do(http.MethodGet, bucket, "", query, nil, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		var result listResult
+		if err := decodeResult(resp, &result); err != nil {
+			return nil, nil, err
+		}
+		for _, obj := range result.Contents {
+			objects = append(objects, pixellock.S3Object{Key: obj.Key, Size: obj.Size, ModTime: obj.LastModified})
+		}
+		for _, p := range result.CommonPrefixes {
+			prefixes = append(prefixes, p.Prefix)
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" || (limit > 0 && len(objects)+len(prefixes) >= limit) {
+			return objects, prefixes, nil
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
+
+// Head returns the size and modification time of the object key.
+func (c *Client) Head(bucket, key string) (pixellock.S3Object, error) {
+	resp, err := c.do(http.MethodHead, bucket, key, nil, nil, nil)
+	if err != nil {
+		return pixellock.S3Object{}, err
+	}
+	discard(resp)
+	return objectOf(key, resp), nil
+}
+
+// Get returns the object key, read as it is downloaded.
+func (c *Client) Get(bucket, key string) (io.ReadCloser, pixellock.S3Object, error) {
+	resp, err := c.do(http.MethodGet, bucket, key, nil, nil, nil)
+	if err != nil {
+		return nil, pixellock.S3Object{}, err
+	}
+	return resp.Body, objectOf(key, resp), nil
+}
+
+// Put uploads data to the object key in a single request.
+func (c *Client) Put(bucket, key string, data []byte) error {
+	resp, err := c.do(http.MethodPut, bucket, key, nil, nil, data)
+	if err != nil {
+		return err
+	}
+	discard(resp)
+	return nil
+}
+
+// CreateUpload starts a multipart upload to the object key.
+func (c *Client) CreateUpload(bucket, key string) (string, error) {
+	resp, err := c.do(http.MethodPost, bucket, key, url.Values{"uploads": {""}}, nil, nil)
+	if err != nil {
+		return "", err
+	}
+	var result struct{ UploadId string }
+	if err := decodeResult(resp, &result); err != nil {
+		return "", err
+	}
+	if result.UploadId == "" {
+		return "", errors.New("S3 started an upload without an ID")
+	}
+	return result.UploadId, nil
+}
+
+// UploadPart uploads part of the upload uploadID.
+func (c *Client) UploadPart(bucket, key, uploadID string, part int, data []byte) (string, error) {
+	query := url.Values{"partNumber": {strconv.Itoa(part)}, "uploadId": {uploadID}}
+	resp, err := c.do(http.MethodPut, bucket, key, query, nil, data)
+	if err != nil {
+		return "", err
+	}
+	discard(resp)
+	return resp.Header.Get("ETag"), nil
+}
+
+// completeUpload is the body of a CompleteMultipartUpload request.
+type completeUpload struct {
+	XMLName xml.Name       `xml:"CompleteMultipartUpload"`
+	Parts   []completePart `xml:"Part"`
+}
+
+type completePart struct {
+	PartNumber int
+	ETag       string
+}
+
+// CompleteUpload joins the parts uploaded into the object key.
+func (c *Client) CompleteUpload(bucket, key, uploadID string, etags []string) error {
+	var complete completeUpload
+	for i, etag := range etags {
+		complete.Parts = append(complete.Parts, completePart{PartNumber: i + 1, ETag: etag})
+	}
+	body, err := xml.Marshal(complete)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(http.MethodPost, bucket, key, url.Values{"uploadId": {uploadID}}, nil, body)
+	if err != nil {
+		return err
+	}
+	return decodeResult(resp, nil)
+}
+
+// AbortUpload drops the parts of the upload uploadID.
+func (c *Client) AbortUpload(bucket, key, uploadID string) error {
+	resp, err := c.do(http.MethodDelete, bucket, key, url.Values{"uploadId": {uploadID}}, nil, nil)
+	if err != nil {
+		return err
+	}
+	discard(resp)
+	return nil
+}
+
+// Copy copies an object within S3, without downloading it.
+func (c *Client) Copy(srcBucket, srcKey, dstBucket, dstKey string) error {
+	header := http.Header{"X-Amz-Copy-Source": {"/" + escape(srcBucket, false) + "/" + escape(srcKey, true)}}
+	resp, err := c.do(http.MethodPut, dstBucket, dstKey, nil, header, nil)
+	if err != nil {
+		return err
+	}
+	return decodeResult(resp, nil)
+}
+
+// Delete deletes the object key; one that is not there already is not an
+// error.
+func (c *Client) Delete(bucket, key string) error {
+	resp, err := c.do(http.MethodDelete, bucket, key, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	discard(resp)
+	return nil
+}
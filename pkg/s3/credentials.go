@@ -0,0 +1,266 @@
+package s3
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Credentials sign the requests of a Client.
+type Credentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string    // Of temporary credentials
+	Expires         time.Time // When temporary credentials stop working; zero for never
+}
+
+// A CredentialsProvider returns the credentials to sign requests with. A
+// Client calls it again as the credentials it returned near expiry.
+type CredentialsProvider func() (Credentials, error)
+
+// StaticCredentials returns a provider of creds.
+func StaticCredentials(creds Credentials) CredentialsProvider {
+	return func() (Credentials, error) { return creds, nil }
+}
+
+// errNoCredentials is returned by a provider of DefaultCredentials with no
+// credentials configured for it, so that the next is tried.
+var errNoCredentials = errors.New("no credentials")
+
+// metadataTimeout bounds the requests to the container and instance
+// metadata endpoints, which a host that is neither never answers.
+const metadataTimeout = 2 * time.Second
+
+// DefaultCredentials returns the provider of the credentials the AWS CLI
+// and SDKs find, the first of:
+//
+//   - AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN
+//   - the keys of profile in the shared credentials file,
+//     AWS_SHARED_CREDENTIALS_FILE or ~/.aws/credentials
+//   - the keys of profile in the shared config file, AWS_CONFIG_FILE or
+//     ~/.aws/config
+//   - the role of an ECS task, from AWS_CONTAINER_CREDENTIALS_RELATIVE_URI
+//     or AWS_CONTAINER_CREDENTIALS_FULL_URI
+//   - the role of an EC2 instance, from its metadata service, unless
+//     AWS_EC2_METADATA_DISABLED is true
+//
+// Profiles that assume roles or sign in with SSO are not supported.
+func DefaultCredentials(profile string) CredentialsProvider {
+	return func() (Credentials, error) {
+		for _, provider := range []CredentialsProvider{
+			envCredentials,
+			func() (Credentials, error) { return fileCredentials(credentialsFile(), profile, false) },
+			func() (Credentials, error) { return fileCredentials(configFile(), profile, true) },
+			containerCredentials,
+			instanceCredentials,
+		} {
+			creds, err := provider()
+			if err == nil {
+				return creds, nil
+			}
+			if !errors.Is(err, errNoCredentials) {
+				return Credentials{}, err
+			}
+		}
+		return Credentials{}, errors.New("no AWS credentials found: set AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY, or configure a profile in ~/.aws/credentials")
+	}
+}
+
+func envCredentials() (Credentials, error) {
+	id, secret := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY")
+	if id == "" || secret == "" {
+		return Credentials{}, errNoCredentials
+	}
+	return Credentials{AccessKeyID: id, SecretAccessKey: secret, SessionToken: os.Getenv("AWS_SESSION_TOKEN")}, nil
+}
+
+// sharedFile returns the shared AWS file named by the environment variable
+// env, or the file name in ~/.aws.
+func sharedFile(env, name string) string {
+	if path := os.Getenv(env); path != "" {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".aws", name)
+}
+
+func credentialsFile() string { return sharedFile("AWS_SHARED_CREDENTIALS_FILE", "credentials") }
+func configFile() string      { return sharedFile("AWS_CONFIG_FILE", "config") }
+
+// readProfile returns the settings of profile in the shared AWS file at
+// path, whose sections are named for their profile, or in the config file
+// as "profile" and the name, but for default. A missing file or profile has
+// no settings.
+func readProfile(path, profile string, config bool) (map[string]string, error) {
+	if path == "" {
+		return nil, nil
+	}
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var settings map[string]string
+	in := false
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		if section, ok := strings.CutPrefix(line, "["); ok {
+			section = strings.TrimSpace(strings.TrimSuffix(section, "]"))
+			if config && section != "default" {
+				section, ok = strings.CutPrefix(section, "profile ")
+				section = strings.TrimSpace(section)
+				in = ok && section == profile
+			} else {
+				in = section == profile
+			}
+			if in && settings == nil {
+				settings = map[string]string{}
+			}
+			continue
+		}
+		if name, value, ok := strings.Cut(line, "="); ok && in {
+			settings[strings.ToLower(strings.TrimSpace(name))] = strings.TrimSpace(value)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	return settings, nil
+}
+
+// fileCredentials returns the keys of profile in the shared file at path.
+func fileCredentials(path, profile string, config bool) (Credentials, error) {
+	settings, err := readProfile(path, profile, config)
+	if err != nil {
+		return Credentials{}, err
+	}
+	id, secret := settings["aws_access_key_id"], settings["aws_secret_access_key"]
+	if id == "" || secret == "" {
+		return Credentials{}, errNoCredentials
+	}
+	return Credentials{AccessKeyID: id, SecretAccessKey: secret, SessionToken: settings["aws_session_token"]}, nil
+}
+
+// roleCredentials are the temporary credentials the container and instance
+// metadata endpoints give.
+type roleCredentials struct {
+	AccessKeyID     string `json:"AccessKeyId"`
+	SecretAccessKey string
+	Token           string
+	Expiration      time.Time
+}
+
+// getMetadata returns the body of the response to a request of method to
+// url, with the headers given as name, value pairs.
+func getMetadata(client *http.Client, method, url string, headers ...string) ([]byte, error) {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s %s: %s", method, url, resp.Status)
+	}
+	return body, nil
+}
+
+// parseRoleCredentials parses the credentials of a role from body.
+func parseRoleCredentials(body []byte) (Credentials, error) {
+	var role roleCredentials
+	if err := json.Unmarshal(body, &role); err != nil {
+		return Credentials{}, fmt.Errorf("invalid role credentials: %w", err)
+	}
+	if role.AccessKeyID == "" || role.SecretAccessKey == "" {
+		return Credentials{}, errors.New("invalid role credentials: no keys given")
+	}
+	return Credentials{AccessKeyID: role.AccessKeyID, SecretAccessKey: role.SecretAccessKey, SessionToken: role.Token, Expires: role.Expiration}, nil
+}
+
+// containerCredentials returns the credentials of the role of an ECS task,
+// or of any container run with the same endpoint.
+func containerCredentials() (Credentials, error) {
+	url := os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI")
+	if rel := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); rel != "" {
+		url = "http://169.254.170.2" + rel
+	}
+	if url == "" {
+		return Credentials{}, errNoCredentials
+	}
+	token := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN")
+	if file := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE"); file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return Credentials{}, fmt.Errorf("failed to read container credentials token: %w", err)
+		}
+		token = strings.TrimSpace(string(data))
+	}
+	var headers []string
+	if token != "" {
+		headers = []string{"Authorization", token}
+	}
+	body, err := getMetadata(&http.Client{Timeout: metadataTimeout}, http.MethodGet, url, headers...)
+	if err != nil {
+		return Credentials{}, fmt.Errorf("failed to get container credentials: %w", err)
+	}
+	return parseRoleCredentials(body)
+}
+
+// instanceCredentials returns the credentials of the role of the EC2
+// instance it runs on, from its metadata service with a session token, as
+// IMDSv2 requires. A host with no metadata service has none.
+func instanceCredentials() (Credentials, error) {
+	if strings.EqualFold(os.Getenv("AWS_EC2_METADATA_DISABLED"), "true") {
+		return Credentials{}, errNoCredentials
+	}
+	endpoint := strings.TrimSuffix(os.Getenv("AWS_EC2_METADATA_SERVICE_ENDPOINT"), "/")
+	if endpoint == "" {
+		endpoint = "http://169.254.169.254"
+	}
+	client := &http.Client{Timeout: metadataTimeout}
+	token, err := getMetadata(client, http.MethodPut, endpoint+"/latest/api/token", "X-Aws-Ec2-Metadata-Token-Ttl-Seconds", "21600")
+	if err != nil {
+		return Credentials{}, errNoCredentials
+	}
+	const rolesPath = "/latest/meta-data/iam/security-credentials/"
+	roles, err := getMetadata(client, http.MethodGet, endpoint+rolesPath, "X-Aws-Ec2-Metadata-Token", string(token))
+	if err != nil {
+		return Credentials{}, fmt.Errorf("failed to get the role of the instance: %w", err)
+	}
+	role, _, _ := strings.Cut(strings.TrimSpace(string(roles)), "\n")
+	if role == "" {
+		return Credentials{}, errNoCredentials
+	}
+	body, err := getMetadata(client, http.MethodGet, endpoint+rolesPath+role, "X-Aws-Ec2-Metadata-Token", string(token))
+	if err != nil {
+		return Credentials{}, fmt.Errorf("failed to get instance credentials: %w", err)
+	}
+	return parseRoleCredentials(body)
+}
@@ -0,0 +1,158 @@
+package s3
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// isolate clears the environment DefaultCredentials and LoadConfig read,
+// and points the shared files into a temporary directory, returning it.
+func isolate(t *testing.T) string {
+	dir := t.TempDir()
+	for _, env := range []string{
+		"AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "AWS_SESSION_TOKEN", "AWS_PROFILE",
+		"AWS_REGION", "AWS_DEFAULT_REGION", "AWS_ENDPOINT_URL", "AWS_ENDPOINT_URL_S3",
+		"AWS_CONTAINER_CREDENTIALS_RELATIVE_URI", "AWS_CONTAINER_CREDENTIALS_FULL_URI",
+		"AWS_CONTAINER_AUTHORIZATION_TOKEN", "AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE",
+		"AWS_EC2_METADATA_SERVICE_ENDPOINT",
+	} {
+		t.Setenv(env, "")
+	}
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(dir, "credentials"))
+	t.Setenv("AWS_CONFIG_FILE", filepath.Join(dir, "config"))
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+	return dir
+}
+
+func writeShared(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDefaultCredentials(t *testing.T) {
+	dir := isolate(t)
+	if _, err := DefaultCredentials("default")(); err == nil {
+		t.Error("found credentials where there are none")
+	}
+
+	writeShared(t, filepath.Join(dir, "config"), `
+[default]
+region = eu-west-1
+aws_access_key_id = CONFIGID
+aws_secret_access_key = configsecret
+
+[profile work]
+region = us-west-2
+`)
+	writeShared(t, filepath.Join(dir, "credentials"), `
+# Keys by profile
+[work]
+aws_access_key_id = WORKID
+aws_secret_access_key = worksecret
+aws_session_token = worktoken
+`)
+	creds, err := DefaultCredentials("work")()
+	if err != nil || creds != (Credentials{AccessKeyID: "WORKID", SecretAccessKey: "worksecret", SessionToken: "worktoken"}) {
+		t.Errorf("credentials of the work profile = %+v, %v", creds, err)
+	}
+	if creds, err := DefaultCredentials("default")(); err != nil || creds.AccessKeyID != "CONFIGID" {
+		t.Errorf("credentials of the default profile, in the config file = %+v, %v", creds, err)
+	}
+
+	t.Setenv("AWS_ACCESS_KEY_ID", "ENVID")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "envsecret")
+	if creds, err := DefaultCredentials("work")(); err != nil || creds.AccessKeyID != "ENVID" {
+		t.Errorf("the environment does not come first: %+v, %v", creds, err)
+	}
+
+	t.Setenv("AWS_PROFILE", "work")
+	cfg, err := LoadConfig()
+	if err != nil || cfg.Region != "us-west-2" || cfg.PathStyle {
+		t.Errorf("LoadConfig = %+v, %v", cfg, err)
+	}
+	t.Setenv("AWS_REGION", "ap-south-1")
+	t.Setenv("AWS_ENDPOINT_URL_S3", "http://localhost:9000")
+	if cfg, err := LoadConfig(); err != nil || cfg.Region != "ap-south-1" || cfg.Endpoint != "http://localhost:9000" || !cfg.PathStyle {
+		t.Errorf("LoadConfig from the environment = %+v, %v", cfg, err)
+	}
+}
+
+// roleServer serves the credentials of a role that expire in an hour,
+// requiring the header name to be value, and the session tokens of the
+// instance metadata service.
+func roleServer(t *testing.T, name, value string) *httptest.Server {
+	expires := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/latest/api/token" {
+			if r.Method != http.MethodPut || r.Header.Get("X-Aws-Ec2-Metadata-Token-Ttl-Seconds") == "" {
+				http.Error(w, "bad token request", http.StatusBadRequest)
+				return
+			}
+			fmt.Fprint(w, "session")
+			return
+		}
+		if r.Header.Get(name) != value {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/latest/meta-data/iam/security-credentials/":
+			fmt.Fprint(w, "worker-role\n")
+		default:
+			fmt.Fprintf(w, `{"Code":"Success","AccessKeyId":"ROLEID","SecretAccessKey":"rolesecret","Token":"roletoken","Expiration":%q}`, expires)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestContainerCredentials(t *testing.T) {
+	isolate(t)
+	srv := roleServer(t, "Authorization", "task-token")
+	t.Setenv("AWS_CONTAINER_CREDENTIALS_FULL_URI", srv.URL+"/v2/credentials")
+	if _, err := DefaultCredentials("default")(); err == nil {
+		t.Error("container credentials without the token succeeded")
+	}
+	t.Setenv("AWS_CONTAINER_AUTHORIZATION_TOKEN", "task-token")
+	creds, err := DefaultCredentials("default")()
+	if err != nil || creds.AccessKeyID != "ROLEID" || creds.SessionToken != "roletoken" || creds.Expires.IsZero() {
+		t.Errorf("container credentials = %+v, %v", creds, err)
+	}
+}
+
+func TestInstanceCredentials(t *testing.T) {
+	isolate(t)
+	srv := roleServer(t, "X-Aws-Ec2-Metadata-Token", "session")
+	t.Setenv("AWS_EC2_METADATA_SERVICE_ENDPOINT", srv.URL)
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "")
+	creds, err := DefaultCredentials("default")()
+	if err != nil || creds.AccessKeyID != "ROLEID" || creds.SessionToken != "roletoken" {
+		t.Errorf("instance credentials = %+v, %v", creds, err)
+	}
+}
+
+// TestCredentialsRefresh checks that a Client asks for credentials again
+// as those it holds near expiry.
+func TestCredentialsRefresh(t *testing.T) {
+	calls := 0
+	client, err := New(Config{Region: "us-east-1", Credentials: func() (Credentials, error) {
+		calls++
+		return Credentials{AccessKeyID: "id", SecretAccessKey: "secret", Expires: time.Now().Add(time.Duration(calls) * 4 * time.Minute)}, nil
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.credentials() // Expire within the refresh window, so are replaced
+	client.credentials()
+	client.credentials() // 8 minutes left are kept
+	if calls != 2 {
+		t.Errorf("credentials asked for %d times, want 2", calls)
+	}
+}
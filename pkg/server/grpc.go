@@ -0,0 +1,350 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"runtime/debug"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/Amul-Thantharate/pixellock/pkg/pixellock"
+	"github.com/Amul-Thantharate/pixellock/pkg/server/pixellockv1"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ErrorDomain is the domain of the errdetails.ErrorInfo a failed call
+// carries, whose reason is the pixellock.ErrorCode of the failure.
+const ErrorDomain = "pixellock"
+
+// grpcMessageOverhead is what a unary request may hold beyond the image of
+// Config.MaxBodyBytes: its key, and the framing of its fields.
+const grpcMessageOverhead = 1 << 10
+
+// grpcChunkSize is the most data a StreamResponse carries.
+const grpcChunkSize = 64 << 10
+
+// grpcCodes are the gRPC codes failures of each code are answered with;
+// other codes get codes.Internal.
+var grpcCodes = map[pixellock.ErrorCode]codes.Code{
+	pixellock.CodeKeyMismatch:       codes.InvalidArgument,
+	pixellock.CodeKeyRequired:       codes.InvalidArgument,
+	pixellock.CodeInvalidKey:        codes.InvalidArgument,
+	pixellock.CodeNotEncrypted:      codes.InvalidArgument,
+	pixellock.CodeNotImage:          codes.InvalidArgument,
+	pixellock.CodeUnsupportedCipher: codes.InvalidArgument,
+	pixellock.CodeImageTooLarge:     codes.ResourceExhausted,
+	pixellock.CodeNoPayload:         codes.InvalidArgument,
+	pixellock.CodePayloadTooLarge:   codes.InvalidArgument,
+	pixellock.CodePayloadCorrupted:  codes.InvalidArgument,
+	pixellock.CodeBadRequest:        codes.InvalidArgument,
+	pixellock.CodeRequestTooLarge:   codes.ResourceExhausted,
+	pixellock.CodeBusy:              codes.Unavailable,
+	pixellock.CodeNotFound:          codes.NotFound,
+}
+
+// NewGRPCServer returns a gRPC server of the pixellock.v1 service, which
+// serves what s serves over HTTP, with the same Config: its key and key
+// overrides, bounds and concurrency, logging, metrics and tracing. Unary
+// requests are bounded by Config.MaxBodyBytes, and each message of a
+// stream likewise; a stream as a whole is not. opts are added to the
+// server's own options.
+func NewGRPCServer(s *Server, opts ...grpc.ServerOption) *grpc.Server {
+	opts = append([]grpc.ServerOption{grpc.MaxRecvMsgSize(int(s.cfg.MaxBodyBytes) + grpcMessageOverhead)}, opts...)
+	g := grpc.NewServer(opts...)
+	pixellockv1.RegisterPixellockServer(g, &grpcService{s: s})
+	return g
+}
+
+// ListenAndServeGRPC serves the gRPC service of s on addr until ctx is
+// done, then stops the server, letting the calls being handled finish for
+// as long as ListenAndServe lets requests.
+func ListenAndServeGRPC(ctx context.Context, addr string, s *Server) error {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	g := NewGRPCServer(s)
+	errc := make(chan error, 1)
+	go func() { errc <- g.Serve(lis) }()
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+	stopped := make(chan struct{})
+	go func() {
+		g.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(shutdownTimeout):
+		g.Stop()
+	}
+	return nil
+}
+
+// grpcService is the pixellock.v1 service of a Server.
+type grpcService struct {
+	pixellockv1.UnimplementedPixellockServer
+	s *Server
+}
+
+func (g *grpcService) Encrypt(ctx context.Context, req *pixellockv1.EncryptRequest) (*pixellockv1.EncryptResponse, error) {
+	var resp *pixellockv1.EncryptResponse
+	err := g.s.call(ctx, pixellockv1.Pixellock_Encrypt_FullMethodName, req.GetKey(), func(ctx context.Context, key []byte) error {
+		if len(req.GetImage()) == 0 {
+			return badRequest(http.StatusBadRequest, "no image")
+		}
+		encrypted, err := g.s.encryptImage(ctx, key, req.GetImage())
+		resp = &pixellockv1.EncryptResponse{Encrypted: encrypted}
+		return err
+	})
+	return resp, err
+}
+
+func (g *grpcService) Decrypt(ctx context.Context, req *pixellockv1.DecryptRequest) (*pixellockv1.DecryptResponse, error) {
+	var resp *pixellockv1.DecryptResponse
+	err := g.s.call(ctx, pixellockv1.Pixellock_Decrypt_FullMethodName, req.GetKey(), func(ctx context.Context, key []byte) error {
+		if len(req.GetEncrypted()) == 0 {
+			return badRequest(http.StatusBadRequest, "no encrypted file")
+		}
+		img, err := g.s.decryptImage(ctx, key, req.GetEncrypted())
+		if err != nil {
+			return err
+		}
+		r := imageResponse(img)
+		resp = &pixellockv1.DecryptResponse{Image: r.body, ContentType: r.contentType}
+		return nil
+	})
+	return resp, err
+}
+
+func (g *grpcService) StegoReveal(ctx context.Context, req *pixellockv1.StegoRevealRequest) (*pixellockv1.StegoRevealResponse, error) {
+	var resp *pixellockv1.StegoRevealResponse
+	err := g.s.call(ctx, pixellockv1.Pixellock_StegoReveal_FullMethodName, req.GetKey(), func(ctx context.Context, key []byte) error {
+		if len(req.GetImage()) == 0 {
+			return badRequest(http.StatusBadRequest, "no image")
+		}
+		p, err := pixellock.RevealPayloadFrom(bytes.NewReader(req.GetImage()), g.s.stegoOptions(key))
+		resp = &pixellockv1.StegoRevealResponse{Payload: p.Data, Filename: p.Filename, IsMessage: p.Filename == ""}
+		return err
+	})
+	return resp, err
+}
+
+func (g *grpcService) EncryptStream(stream pixellockv1.Pixellock_EncryptStreamServer) error {
+	return g.s.stream(stream, pixellockv1.Pixellock_EncryptStream_FullMethodName, pixellock.PhaseEncrypt, pixellock.EncryptStream)
+}
+
+func (g *grpcService) DecryptStream(stream pixellockv1.Pixellock_DecryptStreamServer) error {
+	return g.s.stream(stream, pixellockv1.Pixellock_DecryptStream_FullMethodName, pixellock.PhaseDecrypt, pixellock.DecryptStream)
+}
+
+// call runs fn for the call of method with the key given in it, once a
+// slot is free, within a span of the call, returning its error as a gRPC
+// status.
+func (s *Server) call(ctx context.Context, method string, given []byte, fn func(ctx context.Context, key []byte) error) (err error) {
+	ctx, span := s.tracer.Start(extractMetadata(ctx), method,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("rpc.system", "grpc"),
+			attribute.String("rpc.method", method),
+		),
+	)
+	defer span.End()
+	defer func() {
+		if err != nil {
+			err = s.grpcError(span, method, err)
+		}
+	}()
+	defer func() {
+		if v := recover(); v != nil {
+			err = &pixellock.PanicError{Value: v, Stack: debug.Stack()}
+		}
+	}()
+	release, err := s.acquire()
+	if err != nil {
+		return err
+	}
+	defer release()
+	key, err := s.grpcKey(given)
+	if err != nil {
+		return err
+	}
+	return fn(ctx, key)
+}
+
+// stream runs fn, pixellock.EncryptStream or DecryptStream, for the
+// streaming call of method, reading the chunks of its requests and
+// sending what fn writes as they come, so that no more than a chunk or two
+// is held at once. The key may be given in the first request. The call is
+// counted in the metrics of phase.
+func (s *Server) stream(stream grpc.BidiStreamingServer[pixellockv1.StreamRequest, pixellockv1.StreamResponse], method, phase string, fn func(ctx context.Context, key []byte, dst io.Writer, src io.Reader) error) error {
+	first, err := stream.Recv()
+	if err == io.EOF {
+		first, err = &pixellockv1.StreamRequest{}, nil
+	}
+	if err != nil {
+		return err
+	}
+	return s.call(stream.Context(), method, first.GetKey(), func(ctx context.Context, key []byte) error {
+		r := &streamReader{stream: stream, chunk: first.GetChunk()}
+		w := &streamWriter{stream: stream}
+		name, cipher := pixellock.SpanEncrypt, pixellock.CipherName(pixellock.AESGCM)
+		if phase == pixellock.PhaseDecrypt {
+			name, cipher = pixellock.SpanDecrypt, ""
+			if suite := pixellock.StreamCipher(first.GetChunk()); suite != nil {
+				cipher = pixellock.CipherName(suite)
+			}
+		}
+		done := s.cfg.Metrics.Start(phase)
+		_, span := s.tracer.Start(ctx, name, trace.WithAttributes(attribute.String(pixellock.AttrCipher, cipher)))
+		err := fn(ctx, key, w, r)
+		if ctx.Err() != nil {
+			err = ctx.Err() // A failed Recv or Send of a call canceled
+		}
+		span.SetAttributes(attribute.Int64(pixellock.AttrBytesRead, r.read), attribute.Int64(pixellock.AttrBytesWritten, w.written))
+		setError(span, err)
+		span.End()
+		done(r.read, cipher, err)
+		return err
+	})
+}
+
+// A streamReader reads the chunks of the requests of a streaming call, to
+// the end of the client's side of it.
+type streamReader struct {
+	stream grpc.BidiStreamingServer[pixellockv1.StreamRequest, pixellockv1.StreamResponse]
+	chunk  []byte // What is left of the latest chunk
+	read   int64
+}
+
+func (r *streamReader) Read(p []byte) (int, error) {
+	for len(r.chunk) == 0 {
+		req, err := r.stream.Recv()
+		if err != nil {
+			return 0, err // io.EOF once the client is done sending
+		}
+		if len(req.GetKey()) > 0 {
+			return 0, badRequest(http.StatusBadRequest, "a key may only be given in the first request of a stream")
+		}
+		r.chunk = req.GetChunk()
+	}
+	n := copy(p, r.chunk)
+	r.chunk = r.chunk[n:]
+	r.read += int64(n)
+	return n, nil
+}
+
+// A streamWriter sends what is written to it as the chunks of the
+// responses of a streaming call, of at most grpcChunkSize each.
+type streamWriter struct {
+	stream  grpc.BidiStreamingServer[pixellockv1.StreamRequest, pixellockv1.StreamResponse]
+	written int64
+}
+
+func (w *streamWriter) Write(p []byte) (int, error) {
+	var n int
+	for n < len(p) {
+		chunk := p[n:min(len(p), n+grpcChunkSize)]
+		if err := w.stream.Send(&pixellockv1.StreamResponse{Chunk: chunk}); err != nil {
+			return n, err
+		}
+		n += len(chunk)
+		w.written += int64(len(chunk))
+	}
+	return n, nil
+}
+
+// grpcKey returns the key of a call: the one it gives, or the server's.
+func (s *Server) grpcKey(given []byte) ([]byte, error) {
+	switch {
+	case len(given) > 0 && !s.cfg.AllowKeyOverride:
+		return nil, badRequest(http.StatusForbidden, "this server does not take keys in requests")
+	case len(given) > 0 && len(given) != pixellock.KeySize:
+		return nil, pixellock.ErrInvalidKeySize
+	case len(given) > 0:
+		return given, nil
+	case s.cfg.Key == nil:
+		return nil, badRequest(http.StatusBadRequest, "no key: give one in the request")
+	}
+	return s.cfg.Key, nil
+}
+
+// grpcError returns err, from the call of method traced by span, as the
+// gRPC status it is answered with, logging it when it is no fault of the
+// client's.
+func (s *Server) grpcError(span trace.Span, method string, err error) error {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		span.SetAttributes(attribute.String("error.type", string(pixellock.CodeCanceled)))
+		return status.FromContextError(err).Err()
+	}
+	if _, ok := status.FromError(err); ok {
+		return err // A failed Recv or Send, a status already
+	}
+	code, httpStatus := codeOf(err)
+	c, ok := grpcCodes[code]
+	switch {
+	case httpStatus == http.StatusForbidden:
+		c = codes.PermissionDenied
+	case !ok:
+		c = codes.Internal
+	}
+	span.SetAttributes(attribute.String("error.type", string(code)))
+	if c == codes.Internal {
+		setError(span, err)
+		if s.cfg.Logger != nil {
+			s.cfg.Logger.Error("call failed", "method", method, "code", code, "err", err)
+		}
+	}
+	st := status.New(c, err.Error())
+	info := &errdetails.ErrorInfo{Reason: string(code), Domain: ErrorDomain}
+	if code.Retryable() {
+		info.Metadata = map[string]string{"retryable": "true"}
+	}
+	if detailed, err := st.WithDetails(info); err == nil {
+		st = detailed
+	}
+	return st.Err()
+}
+
+// extractMetadata returns a copy of ctx holding the span propagated in the
+// traceparent metadata of the incoming call of ctx, as propagator finds it
+// in a header.
+func extractMetadata(ctx context.Context) context.Context {
+	md, _ := metadata.FromIncomingContext(ctx)
+	h := http.Header{}
+	for _, key := range propagator.Fields() {
+		for _, v := range md.Get(key) {
+			h.Add(key, v)
+		}
+	}
+	return propagator.Extract(ctx, propagation.HeaderCarrier(h))
+}
+
+// GRPCErrorCode returns the pixellock.ErrorCode of an error returned by a
+// call of the pixellock.v1 service, or "" when it carries none.
+func GRPCErrorCode(err error) pixellock.ErrorCode {
+	st, ok := status.FromError(err)
+	if !ok {
+		return ""
+	}
+	for _, d := range st.Details() {
+		if info, ok := d.(*errdetails.ErrorInfo); ok && info.Domain == ErrorDomain {
+			return pixellock.ErrorCode(info.Reason)
+		}
+	}
+	return ""
+}
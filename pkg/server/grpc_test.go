@@ -0,0 +1,270 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"image/png"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	"github.com/Amul-Thantharate/pixellock/pkg/pixellock"
+	"github.com/Amul-Thantharate/pixellock/pkg/server/pixellockv1"
+)
+
+// newGRPCClient serves the gRPC service of s in process, returning a
+// client of it.
+func newGRPCClient(t *testing.T, s *Server) pixellockv1.PixellockClient {
+	t.Helper()
+	lis := bufconn.Listen(1 << 20)
+	g := NewGRPCServer(s)
+	go g.Serve(lis)
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatalf("NewClient failed: %v", err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+		g.Stop()
+	})
+	return pixellockv1.NewPixellockClient(conn)
+}
+
+// errorLogger counts the errors logged to it.
+type errorLogger struct {
+	errors atomic.Int32
+}
+
+func (*errorLogger) Debug(string, ...any)   {}
+func (*errorLogger) Info(string, ...any)    {}
+func (*errorLogger) Warn(string, ...any)    {}
+func (l *errorLogger) Error(string, ...any) { l.errors.Add(1) }
+
+// checkGRPCError checks that err is a status of c carrying code.
+func checkGRPCError(t *testing.T, err error, c codes.Code, code pixellock.ErrorCode) {
+	t.Helper()
+	if got := status.Code(err); got != c {
+		t.Errorf("status %v, want %v: %v", got, c, err)
+	}
+	if got := GRPCErrorCode(err); got != code {
+		t.Errorf("error code %q, want %q: %v", got, code, err)
+	}
+}
+
+func TestGRPCEncryptDecrypt(t *testing.T) {
+	s, _ := newTestServer(t, Config{})
+	client := newGRPCClient(t, s)
+	ctx := t.Context()
+	img := testPNG(t)
+
+	enc, err := client.Encrypt(ctx, &pixellockv1.EncryptRequest{Image: img})
+	if err != nil {
+		t.Fatalf("Encrypt failed: %v", err)
+	}
+	dec, err := client.Decrypt(ctx, &pixellockv1.DecryptRequest{Encrypted: enc.Encrypted})
+	if err != nil {
+		t.Fatalf("Decrypt failed: %v", err)
+	}
+	got, err := png.Decode(bytes.NewReader(dec.Image))
+	if err != nil || dec.ContentType != "image/png" {
+		t.Fatalf("Decrypt gave %d bytes of %s that do not decode: %v", len(dec.Image), dec.ContentType, err)
+	}
+	if want, _ := png.Decode(bytes.NewReader(img)); got.Bounds() != want.Bounds() || got.At(10, 20) != want.At(10, 20) {
+		t.Error("decrypted image differs from the one encrypted")
+	}
+
+	// The file decrypts over HTTP as it does over gRPC
+	if w := post(s, "/v1/decrypt", enc.Encrypted); w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), dec.Image) {
+		t.Errorf("POST /v1/decrypt of the encrypted file gave %d: %s", w.Code, w.Body)
+	}
+
+	other, _ := pixellock.GenerateRandomKey()
+	_, err = client.Decrypt(ctx, &pixellockv1.DecryptRequest{Encrypted: enc.Encrypted, Key: other})
+	checkGRPCError(t, err, codes.PermissionDenied, pixellock.CodeBadRequest)
+	_, err = client.Decrypt(ctx, &pixellockv1.DecryptRequest{Encrypted: img})
+	checkGRPCError(t, err, codes.InvalidArgument, pixellock.CodeNotEncrypted)
+	_, err = client.Encrypt(ctx, &pixellockv1.EncryptRequest{Image: []byte("not an image")})
+	checkGRPCError(t, err, codes.InvalidArgument, pixellock.CodeNotImage)
+}
+
+func TestGRPCKeyOverride(t *testing.T) {
+	s, _ := newTestServer(t, Config{AllowKeyOverride: true})
+	client := newGRPCClient(t, s)
+	ctx := t.Context()
+	key, _ := pixellock.GenerateRandomKey()
+	other, _ := pixellock.GenerateRandomKey()
+
+	_, err := client.Encrypt(ctx, &pixellockv1.EncryptRequest{Image: testPNG(t)})
+	checkGRPCError(t, err, codes.InvalidArgument, pixellock.CodeBadRequest)
+	_, err = client.Encrypt(ctx, &pixellockv1.EncryptRequest{Image: testPNG(t), Key: key[:16]})
+	checkGRPCError(t, err, codes.InvalidArgument, pixellock.CodeInvalidKey)
+	enc, err := client.Encrypt(ctx, &pixellockv1.EncryptRequest{Image: testPNG(t), Key: key})
+	if err != nil {
+		t.Fatalf("Encrypt failed: %v", err)
+	}
+	_, err = client.Decrypt(ctx, &pixellockv1.DecryptRequest{Encrypted: enc.Encrypted, Key: other})
+	checkGRPCError(t, err, codes.InvalidArgument, pixellock.CodeKeyMismatch)
+}
+
+func TestGRPCStegoReveal(t *testing.T) {
+	s, key := newTestServer(t, Config{})
+	client := newGRPCClient(t, s)
+	var stego bytes.Buffer
+	if err := pixellock.HidePayloadTo(&stego, bytes.NewReader(testPNG(t)), pixellock.Payload{Data: []byte("hello")}, s.stegoOptions(key), "png"); err != nil {
+		t.Fatalf("HidePayloadTo failed: %v", err)
+	}
+	resp, err := client.StegoReveal(t.Context(), &pixellockv1.StegoRevealRequest{Image: stego.Bytes()})
+	if err != nil {
+		t.Fatalf("StegoReveal failed: %v", err)
+	}
+	if string(resp.Payload) != "hello" || !resp.IsMessage {
+		t.Errorf("StegoReveal = %q, message %v", resp.Payload, resp.IsMessage)
+	}
+	_, err = client.StegoReveal(t.Context(), &pixellockv1.StegoRevealRequest{Image: testPNG(t)})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("StegoReveal of an image hiding nothing = %v", err)
+	}
+}
+
+// streamCall runs a streaming call, sending data in chunks of chunkSize,
+// the first with key, as it receives what comes back.
+func streamCall(stream grpc.BidiStreamingClient[pixellockv1.StreamRequest, pixellockv1.StreamResponse], key, data []byte, chunkSize int) ([]byte, error) {
+	sent := make(chan error, 1)
+	go func() {
+		for i := 0; i == 0 || i < len(data); i += chunkSize {
+			req := &pixellockv1.StreamRequest{Chunk: data[i:min(len(data), i+chunkSize)]}
+			if i == 0 {
+				req.Key = key
+			}
+			if err := stream.Send(req); err != nil {
+				sent <- err
+				return
+			}
+		}
+		sent <- stream.CloseSend()
+	}()
+	var out bytes.Buffer
+	for {
+		resp, err := stream.Recv()
+		if err == io.EOF {
+			return out.Bytes(), <-sent
+		}
+		if err != nil {
+			return out.Bytes(), err
+		}
+		if len(resp.Chunk) > grpcChunkSize {
+			return nil, errors.New("response chunk over grpcChunkSize")
+		}
+		out.Write(resp.Chunk)
+	}
+}
+
+func TestGRPCStream(t *testing.T) {
+	key, _ := pixellock.GenerateRandomKey()
+	s, _ := newTestServer(t, Config{Key: key, AllowKeyOverride: true})
+	client := newGRPCClient(t, s)
+	ctx := t.Context()
+	data := make([]byte, 1<<20+12345)
+	rand.Read(data)
+
+	enc, err := client.EncryptStream(ctx)
+	if err != nil {
+		t.Fatalf("EncryptStream failed: %v", err)
+	}
+	encrypted, err := streamCall(enc, nil, data, 100<<10)
+	if err != nil {
+		t.Fatalf("EncryptStream call failed: %v", err)
+	}
+
+	// The stream format of the library, which it decrypts
+	var buf bytes.Buffer
+	if err := pixellock.DecryptStream(ctx, key, &buf, bytes.NewReader(encrypted)); err != nil || !bytes.Equal(buf.Bytes(), data) {
+		t.Fatalf("DecryptStream of the stream = %v", err)
+	}
+
+	dec, err := client.DecryptStream(ctx)
+	if err != nil {
+		t.Fatalf("DecryptStream failed: %v", err)
+	}
+	decrypted, err := streamCall(dec, key, encrypted, 7000)
+	if err != nil || !bytes.Equal(decrypted, data) {
+		t.Fatalf("DecryptStream call gave %d bytes: %v", len(decrypted), err)
+	}
+
+	// A tampered stream fails, and a wrong key
+	encrypted[len(encrypted)/2] ^= 1
+	dec, _ = client.DecryptStream(ctx)
+	_, err = streamCall(dec, nil, encrypted, 64<<10)
+	checkGRPCError(t, err, codes.InvalidArgument, pixellock.CodeKeyMismatch)
+	other, _ := pixellock.GenerateRandomKey()
+	dec, _ = client.DecryptStream(ctx)
+	_, err = streamCall(dec, other, encrypted, 64<<10)
+	checkGRPCError(t, err, codes.InvalidArgument, pixellock.CodeKeyMismatch)
+}
+
+func TestGRPCStreamCancel(t *testing.T) {
+	logger := &errorLogger{}
+	s, _ := newTestServer(t, Config{Logger: logger})
+	client := newGRPCClient(t, s)
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+
+	// Cancel once a chunk has come back, with the client still sending
+	stream, err := client.EncryptStream(ctx)
+	if err != nil {
+		t.Fatalf("EncryptStream failed: %v", err)
+	}
+	chunk := make([]byte, 100<<10)
+	for range 2 {
+		if err := stream.Send(&pixellockv1.StreamRequest{Chunk: chunk}); err != nil {
+			t.Fatalf("Send failed: %v", err)
+		}
+	}
+	if _, err := stream.Recv(); err != nil {
+		t.Fatalf("Recv failed: %v", err)
+	}
+	cancel()
+	for {
+		if _, err = stream.Recv(); err != nil {
+			break
+		}
+	}
+	if status.Code(err) != codes.Canceled {
+		t.Errorf("Recv after cancel = %v, want Canceled", err)
+	}
+
+	// The server gives up the call, taking no more slots, and logs nothing
+	deadline := time.Now().Add(5 * time.Second)
+	for len(s.sem) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the canceled call still holds its slot")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := logger.errors.Load(); n > 0 {
+		t.Errorf("a canceled call logged %d errors", n)
+	}
+
+	// A deadline passes into the library likewise
+	short, cancelShort := context.WithTimeout(t.Context(), time.Nanosecond)
+	defer cancelShort()
+	<-short.Done()
+	_, err = client.Encrypt(short, &pixellockv1.EncryptRequest{Image: testPNG(t)})
+	if status.Code(err) != codes.DeadlineExceeded {
+		t.Errorf("Encrypt past its deadline = %v, want DeadlineExceeded", err)
+	}
+}
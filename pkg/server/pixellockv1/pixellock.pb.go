@@ -0,0 +1,538 @@
+// The pixellock.v1 service offers what pixellock serve offers over HTTP,
+// with streaming RPCs for payloads too large to hold in one message.
+
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.12
+// 	protoc        (unknown)
+// source: pixellock/v1/pixellock.proto
+
+package pixellockv1
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type EncryptRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Image         []byte                 `protobuf:"bytes,1,opt,name=image,proto3" json:"image,omitempty"`
+	Key           []byte                 `protobuf:"bytes,2,opt,name=key,proto3" json:"key,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *EncryptRequest) Reset() {
+	*x = EncryptRequest{}
+	mi := &file_pixellock_v1_pixellock_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *EncryptRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*EncryptRequest) ProtoMessage() {}
+
+func (x *EncryptRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_pixellock_v1_pixellock_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use EncryptRequest.ProtoReflect.Descriptor instead.
+func (*EncryptRequest) Descriptor() ([]byte, []int) {
+	return file_pixellock_v1_pixellock_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *EncryptRequest) GetImage() []byte {
+	if x != nil {
+		return x.Image
+	}
+	return nil
+}
+
+func (x *EncryptRequest) GetKey() []byte {
+	if x != nil {
+		return x.Key
+	}
+	return nil
+}
+
+type EncryptResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Encrypted     []byte                 `protobuf:"bytes,1,opt,name=encrypted,proto3" json:"encrypted,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *EncryptResponse) Reset() {
+	*x = EncryptResponse{}
+	mi := &file_pixellock_v1_pixellock_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *EncryptResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*EncryptResponse) ProtoMessage() {}
+
+func (x *EncryptResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_pixellock_v1_pixellock_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use EncryptResponse.ProtoReflect.Descriptor instead.
+func (*EncryptResponse) Descriptor() ([]byte, []int) {
+	return file_pixellock_v1_pixellock_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *EncryptResponse) GetEncrypted() []byte {
+	if x != nil {
+		return x.Encrypted
+	}
+	return nil
+}
+
+type DecryptRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Encrypted     []byte                 `protobuf:"bytes,1,opt,name=encrypted,proto3" json:"encrypted,omitempty"`
+	Key           []byte                 `protobuf:"bytes,2,opt,name=key,proto3" json:"key,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *DecryptRequest) Reset() {
+	*x = DecryptRequest{}
+	mi := &file_pixellock_v1_pixellock_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *DecryptRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*DecryptRequest) ProtoMessage() {}
+
+func (x *DecryptRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_pixellock_v1_pixellock_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use DecryptRequest.ProtoReflect.Descriptor instead.
+func (*DecryptRequest) Descriptor() ([]byte, []int) {
+	return file_pixellock_v1_pixellock_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *DecryptRequest) GetEncrypted() []byte {
+	if x != nil {
+		return x.Encrypted
+	}
+	return nil
+}
+
+func (x *DecryptRequest) GetKey() []byte {
+	if x != nil {
+		return x.Key
+	}
+	return nil
+}
+
+type DecryptResponse struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	Image []byte                 `protobuf:"bytes,1,opt,name=image,proto3" json:"image,omitempty"`
+	// The content type of image, usually image/png.
+	ContentType   string `protobuf:"bytes,2,opt,name=content_type,json=contentType,proto3" json:"content_type,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *DecryptResponse) Reset() {
+	*x = DecryptResponse{}
+	mi := &file_pixellock_v1_pixellock_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *DecryptResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*DecryptResponse) ProtoMessage() {}
+
+func (x *DecryptResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_pixellock_v1_pixellock_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use DecryptResponse.ProtoReflect.Descriptor instead.
+func (*DecryptResponse) Descriptor() ([]byte, []int) {
+	return file_pixellock_v1_pixellock_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *DecryptResponse) GetImage() []byte {
+	if x != nil {
+		return x.Image
+	}
+	return nil
+}
+
+func (x *DecryptResponse) GetContentType() string {
+	if x != nil {
+		return x.ContentType
+	}
+	return ""
+}
+
+// The first StreamRequest of a call may give a key; every request gives
+// the next chunk of the data, of any size up to the server's limit.
+type StreamRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Key           []byte                 `protobuf:"bytes,1,opt,name=key,proto3" json:"key,omitempty"`
+	Chunk         []byte                 `protobuf:"bytes,2,opt,name=chunk,proto3" json:"chunk,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *StreamRequest) Reset() {
+	*x = StreamRequest{}
+	mi := &file_pixellock_v1_pixellock_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *StreamRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*StreamRequest) ProtoMessage() {}
+
+func (x *StreamRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_pixellock_v1_pixellock_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use StreamRequest.ProtoReflect.Descriptor instead.
+func (*StreamRequest) Descriptor() ([]byte, []int) {
+	return file_pixellock_v1_pixellock_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *StreamRequest) GetKey() []byte {
+	if x != nil {
+		return x.Key
+	}
+	return nil
+}
+
+func (x *StreamRequest) GetChunk() []byte {
+	if x != nil {
+		return x.Chunk
+	}
+	return nil
+}
+
+type StreamResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Chunk         []byte                 `protobuf:"bytes,1,opt,name=chunk,proto3" json:"chunk,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *StreamResponse) Reset() {
+	*x = StreamResponse{}
+	mi := &file_pixellock_v1_pixellock_proto_msgTypes[5]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *StreamResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*StreamResponse) ProtoMessage() {}
+
+func (x *StreamResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_pixellock_v1_pixellock_proto_msgTypes[5]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use StreamResponse.ProtoReflect.Descriptor instead.
+func (*StreamResponse) Descriptor() ([]byte, []int) {
+	return file_pixellock_v1_pixellock_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *StreamResponse) GetChunk() []byte {
+	if x != nil {
+		return x.Chunk
+	}
+	return nil
+}
+
+type StegoRevealRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Image         []byte                 `protobuf:"bytes,1,opt,name=image,proto3" json:"image,omitempty"`
+	Key           []byte                 `protobuf:"bytes,2,opt,name=key,proto3" json:"key,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *StegoRevealRequest) Reset() {
+	*x = StegoRevealRequest{}
+	mi := &file_pixellock_v1_pixellock_proto_msgTypes[6]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *StegoRevealRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*StegoRevealRequest) ProtoMessage() {}
+
+func (x *StegoRevealRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_pixellock_v1_pixellock_proto_msgTypes[6]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use StegoRevealRequest.ProtoReflect.Descriptor instead.
+func (*StegoRevealRequest) Descriptor() ([]byte, []int) {
+	return file_pixellock_v1_pixellock_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *StegoRevealRequest) GetImage() []byte {
+	if x != nil {
+		return x.Image
+	}
+	return nil
+}
+
+func (x *StegoRevealRequest) GetKey() []byte {
+	if x != nil {
+		return x.Key
+	}
+	return nil
+}
+
+type StegoRevealResponse struct {
+	state   protoimpl.MessageState `protogen:"open.v1"`
+	Payload []byte                 `protobuf:"bytes,1,opt,name=payload,proto3" json:"payload,omitempty"`
+	// The name of the file hidden, empty for a message.
+	Filename      string `protobuf:"bytes,2,opt,name=filename,proto3" json:"filename,omitempty"`
+	IsMessage     bool   `protobuf:"varint,3,opt,name=is_message,json=isMessage,proto3" json:"is_message,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *StegoRevealResponse) Reset() {
+	*x = StegoRevealResponse{}
+	mi := &file_pixellock_v1_pixellock_proto_msgTypes[7]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *StegoRevealResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*StegoRevealResponse) ProtoMessage() {}
+
+func (x *StegoRevealResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_pixellock_v1_pixellock_proto_msgTypes[7]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use StegoRevealResponse.ProtoReflect.Descriptor instead.
+func (*StegoRevealResponse) Descriptor() ([]byte, []int) {
+	return file_pixellock_v1_pixellock_proto_rawDescGZIP(), []int{7}
+}
+
+func (x *StegoRevealResponse) GetPayload() []byte {
+	if x != nil {
+		return x.Payload
+	}
+	return nil
+}
+
+func (x *StegoRevealResponse) GetFilename() string {
+	if x != nil {
+		return x.Filename
+	}
+	return ""
+}
+
+func (x *StegoRevealResponse) GetIsMessage() bool {
+	if x != nil {
+		return x.IsMessage
+	}
+	return false
+}
+
+var File_pixellock_v1_pixellock_proto protoreflect.FileDescriptor
+
+const file_pixellock_v1_pixellock_proto_rawDesc = "" +
+	"\n" +
+	"\x1cpixellock/v1/pixellock.proto\x12\fpixellock.v1\"8\n" +
+	"\x0eEncryptRequest\x12\x14\n" +
+	"\x05image\x18\x01 \x01(\fR\x05image\x12\x10\n" +
+	"\x03key\x18\x02 \x01(\fR\x03key\"/\n" +
+	"\x0fEncryptResponse\x12\x1c\n" +
+	"\tencrypted\x18\x01 \x01(\fR\tencrypted\"@\n" +
+	"\x0eDecryptRequest\x12\x1c\n" +
+	"\tencrypted\x18\x01 \x01(\fR\tencrypted\x12\x10\n" +
+	"\x03key\x18\x02 \x01(\fR\x03key\"J\n" +
+	"\x0fDecryptResponse\x12\x14\n" +
+	"\x05image\x18\x01 \x01(\fR\x05image\x12!\n" +
+	"\fcontent_type\x18\x02 \x01(\tR\vcontentType\"7\n" +
+	"\rStreamRequest\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\fR\x03key\x12\x14\n" +
+	"\x05chunk\x18\x02 \x01(\fR\x05chunk\"&\n" +
+	"\x0eStreamResponse\x12\x14\n" +
+	"\x05chunk\x18\x01 \x01(\fR\x05chunk\"<\n" +
+	"\x12StegoRevealRequest\x12\x14\n" +
+	"\x05image\x18\x01 \x01(\fR\x05image\x12\x10\n" +
+	"\x03key\x18\x02 \x01(\fR\x03key\"j\n" +
+	"\x13StegoRevealResponse\x12\x18\n" +
+	"\apayload\x18\x01 \x01(\fR\apayload\x12\x1a\n" +
+	"\bfilename\x18\x02 \x01(\tR\bfilename\x12\x1d\n" +
+	"\n" +
+	"is_message\x18\x03 \x01(\bR\tisMessage2\x8f\x03\n" +
+	"\tPixellock\x12F\n" +
+	"\aEncrypt\x12\x1c.pixellock.v1.EncryptRequest\x1a\x1d.pixellock.v1.EncryptResponse\x12F\n" +
+	"\aDecrypt\x12\x1c.pixellock.v1.DecryptRequest\x1a\x1d.pixellock.v1.DecryptResponse\x12N\n" +
+	"\rEncryptStream\x12\x1b.pixellock.v1.StreamRequest\x1a\x1c.pixellock.v1.StreamResponse(\x010\x01\x12N\n" +
+	"\rDecryptStream\x12\x1b.pixellock.v1.StreamRequest\x1a\x1c.pixellock.v1.StreamResponse(\x010\x01\x12R\n" +
+	"\vStegoReveal\x12 .pixellock.v1.StegoRevealRequest\x1a!.pixellock.v1.StegoRevealResponseBJZHgithub.com/Amul-Thantharate/pixellock/pkg/server/pixellockv1;pixellockv1b\x06proto3"
+
+var (
+	file_pixellock_v1_pixellock_proto_rawDescOnce sync.Once
+	file_pixellock_v1_pixellock_proto_rawDescData []byte
+)
+
+func file_pixellock_v1_pixellock_proto_rawDescGZIP() []byte {
+	file_pixellock_v1_pixellock_proto_rawDescOnce.Do(func() {
+		file_pixellock_v1_pixellock_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_pixellock_v1_pixellock_proto_rawDesc), len(file_pixellock_v1_pixellock_proto_rawDesc)))
+	})
+	return file_pixellock_v1_pixellock_proto_rawDescData
+}
+
+var file_pixellock_v1_pixellock_proto_msgTypes = make([]protoimpl.MessageInfo, 8)
+var file_pixellock_v1_pixellock_proto_goTypes = []any{
+	(*EncryptRequest)(nil),      // 0: pixellock.v1.EncryptRequest
+	(*EncryptResponse)(nil),     // 1: pixellock.v1.EncryptResponse
+	(*DecryptRequest)(nil),      // 2: pixellock.v1.DecryptRequest
+	(*DecryptResponse)(nil),     // 3: pixellock.v1.DecryptResponse
+	(*StreamRequest)(nil),       // 4: pixellock.v1.StreamRequest
+	(*StreamResponse)(nil),      // 5: pixellock.v1.StreamResponse
+	(*StegoRevealRequest)(nil),  // 6: pixellock.v1.StegoRevealRequest
+	(*StegoRevealResponse)(nil), // 7: pixellock.v1.StegoRevealResponse
+}
+var file_pixellock_v1_pixellock_proto_depIdxs = []int32{
+	0, // 0: pixellock.v1.Pixellock.Encrypt:input_type -> pixellock.v1.EncryptRequest
+	2, // 1: pixellock.v1.Pixellock.Decrypt:input_type -> pixellock.v1.DecryptRequest
+	4, // 2: pixellock.v1.Pixellock.EncryptStream:input_type -> pixellock.v1.StreamRequest
+	4, // 3: pixellock.v1.Pixellock.DecryptStream:input_type -> pixellock.v1.StreamRequest
+	6, // 4: pixellock.v1.Pixellock.StegoReveal:input_type -> pixellock.v1.StegoRevealRequest
+	1, // 5: pixellock.v1.Pixellock.Encrypt:output_type -> pixellock.v1.EncryptResponse
+	3, // 6: pixellock.v1.Pixellock.Decrypt:output_type -> pixellock.v1.DecryptResponse
+	5, // 7: pixellock.v1.Pixellock.EncryptStream:output_type -> pixellock.v1.StreamResponse
+	5, // 8: pixellock.v1.Pixellock.DecryptStream:output_type -> pixellock.v1.StreamResponse
+	7, // 9: pixellock.v1.Pixellock.StegoReveal:output_type -> pixellock.v1.StegoRevealResponse
+	5, // [5:10] is the sub-list for method output_type
+	0, // [0:5] is the sub-list for method input_type
+	0, // [0:0] is the sub-list for extension type_name
+	0, // [0:0] is the sub-list for extension extendee
+	0, // [0:0] is the sub-list for field type_name
+}
+
+func init() { file_pixellock_v1_pixellock_proto_init() }
+func file_pixellock_v1_pixellock_proto_init() {
+	if File_pixellock_v1_pixellock_proto != nil {
+		return
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_pixellock_v1_pixellock_proto_rawDesc), len(file_pixellock_v1_pixellock_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   8,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_pixellock_v1_pixellock_proto_goTypes,
+		DependencyIndexes: file_pixellock_v1_pixellock_proto_depIdxs,
+		MessageInfos:      file_pixellock_v1_pixellock_proto_msgTypes,
+	}.Build()
+	File_pixellock_v1_pixellock_proto = out.File
+	file_pixellock_v1_pixellock_proto_goTypes = nil
+	file_pixellock_v1_pixellock_proto_depIdxs = nil
+}
@@ -0,0 +1,283 @@
+// The pixellock.v1 service offers what pixellock serve offers over HTTP,
+// with streaming RPCs for payloads too large to hold in one message.
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             (unknown)
+// source: pixellock/v1/pixellock.proto
+
+package pixellockv1
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	Pixellock_Encrypt_FullMethodName       = "/pixellock.v1.Pixellock/Encrypt"
+	Pixellock_Decrypt_FullMethodName       = "/pixellock.v1.Pixellock/Decrypt"
+	Pixellock_EncryptStream_FullMethodName = "/pixellock.v1.Pixellock/EncryptStream"
+	Pixellock_DecryptStream_FullMethodName = "/pixellock.v1.Pixellock/DecryptStream"
+	Pixellock_StegoReveal_FullMethodName   = "/pixellock.v1.Pixellock/StegoReveal"
+)
+
+// PixellockClient is the client API for Pixellock service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type PixellockClient interface {
+	// Encrypt encrypts an image, as POST /v1/encrypt does.
+	Encrypt(ctx context.Context, in *EncryptRequest, opts ...grpc.CallOption) (*EncryptResponse, error)
+	// Decrypt decrypts an encrypted file, as POST /v1/decrypt does.
+	Decrypt(ctx context.Context, in *DecryptRequest, opts ...grpc.CallOption) (*DecryptResponse, error)
+	// EncryptStream encrypts data sent in chunks into the stream format of
+	// EncryptStream in the library, returned in chunks as each is sealed, so
+	// that neither side holds more than a few chunks at once.
+	EncryptStream(ctx context.Context, opts ...grpc.CallOption) (grpc.BidiStreamingClient[StreamRequest, StreamResponse], error)
+	// DecryptStream decrypts a stream sent in chunks, returning each chunk
+	// of plaintext once it is authenticated.
+	DecryptStream(ctx context.Context, opts ...grpc.CallOption) (grpc.BidiStreamingClient[StreamRequest, StreamResponse], error)
+	// StegoReveal extracts the payload hidden in a stego image, as POST
+	// /v1/stego/reveal does.
+	StegoReveal(ctx context.Context, in *StegoRevealRequest, opts ...grpc.CallOption) (*StegoRevealResponse, error)
+}
+
+type pixellockClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewPixellockClient(cc grpc.ClientConnInterface) PixellockClient {
+	return &pixellockClient{cc}
+}
+
+func (c *pixellockClient) Encrypt(ctx context.Context, in *EncryptRequest, opts ...grpc.CallOption) (*EncryptResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(EncryptResponse)
+	err := c.cc.Invoke(ctx, Pixellock_Encrypt_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *pixellockClient) Decrypt(ctx context.Context, in *DecryptRequest, opts ...grpc.CallOption) (*DecryptResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(DecryptResponse)
+	err := c.cc.Invoke(ctx, Pixellock_Decrypt_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *pixellockClient) EncryptStream(ctx context.Context, opts ...grpc.CallOption) (grpc.BidiStreamingClient[StreamRequest, StreamResponse], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Pixellock_ServiceDesc.Streams[0], Pixellock_EncryptStream_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[StreamRequest, StreamResponse]{ClientStream: stream}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Pixellock_EncryptStreamClient = grpc.BidiStreamingClient[StreamRequest, StreamResponse]
+
+func (c *pixellockClient) DecryptStream(ctx context.Context, opts ...grpc.CallOption) (grpc.BidiStreamingClient[StreamRequest, StreamResponse], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Pixellock_ServiceDesc.Streams[1], Pixellock_DecryptStream_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[StreamRequest, StreamResponse]{ClientStream: stream}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Pixellock_DecryptStreamClient = grpc.BidiStreamingClient[StreamRequest, StreamResponse]
+
+func (c *pixellockClient) StegoReveal(ctx context.Context, in *StegoRevealRequest, opts ...grpc.CallOption) (*StegoRevealResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(StegoRevealResponse)
+	err := c.cc.Invoke(ctx, Pixellock_StegoReveal_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// PixellockServer is the server API for Pixellock service.
+// All implementations must embed UnimplementedPixellockServer
+// for forward compatibility.
+type PixellockServer interface {
+	// Encrypt encrypts an image, as POST /v1/encrypt does.
+	Encrypt(context.Context, *EncryptRequest) (*EncryptResponse, error)
+	// Decrypt decrypts an encrypted file, as POST /v1/decrypt does.
+	Decrypt(context.Context, *DecryptRequest) (*DecryptResponse, error)
+	// EncryptStream encrypts data sent in chunks into the stream format of
+	// EncryptStream in the library, returned in chunks as each is sealed, so
+	// that neither side holds more than a few chunks at once.
+	EncryptStream(grpc.BidiStreamingServer[StreamRequest, StreamResponse]) error
+	// DecryptStream decrypts a stream sent in chunks, returning each chunk
+	// of plaintext once it is authenticated.
+	DecryptStream(grpc.BidiStreamingServer[StreamRequest, StreamResponse]) error
+	// StegoReveal extracts the payload hidden in a stego image, as POST
+	// /v1/stego/reveal does.
+	StegoReveal(context.Context, *StegoRevealRequest) (*StegoRevealResponse, error)
+	mustEmbedUnimplementedPixellockServer()
+}
+
+// UnimplementedPixellockServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedPixellockServer struct{}
+
+func (UnimplementedPixellockServer) Encrypt(context.Context, *EncryptRequest) (*EncryptResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Encrypt not implemented")
+}
+func (UnimplementedPixellockServer) Decrypt(context.Context, *DecryptRequest) (*DecryptResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Decrypt not implemented")
+}
+func (UnimplementedPixellockServer) EncryptStream(grpc.BidiStreamingServer[StreamRequest, StreamResponse]) error {
+	return status.Errorf(codes.Unimplemented, "method EncryptStream not implemented")
+}
+func (UnimplementedPixellockServer) DecryptStream(grpc.BidiStreamingServer[StreamRequest, StreamResponse]) error {
+	return status.Errorf(codes.Unimplemented, "method DecryptStream not implemented")
+}
+func (UnimplementedPixellockServer) StegoReveal(context.Context, *StegoRevealRequest) (*StegoRevealResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method StegoReveal not implemented")
+}
+func (UnimplementedPixellockServer) mustEmbedUnimplementedPixellockServer() {}
+func (UnimplementedPixellockServer) testEmbeddedByValue()                   {}
+
+// UnsafePixellockServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to PixellockServer will
+// result in compilation errors.
+type UnsafePixellockServer interface {
+	mustEmbedUnimplementedPixellockServer()
+}
+
+func RegisterPixellockServer(s grpc.ServiceRegistrar, srv PixellockServer) {
+	// If the following call pancis, it indicates UnimplementedPixellockServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&Pixellock_ServiceDesc, srv)
+}
+
+func _Pixellock_Encrypt_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(EncryptRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PixellockServer).Encrypt(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Pixellock_Encrypt_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PixellockServer).Encrypt(ctx, req.(*EncryptRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Pixellock_Decrypt_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DecryptRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PixellockServer).Decrypt(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Pixellock_Decrypt_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PixellockServer).Decrypt(ctx, req.(*DecryptRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Pixellock_EncryptStream_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(PixellockServer).EncryptStream(&grpc.GenericServerStream[StreamRequest, StreamResponse]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Pixellock_EncryptStreamServer = grpc.BidiStreamingServer[StreamRequest, StreamResponse]
+
+func _Pixellock_DecryptStream_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(PixellockServer).DecryptStream(&grpc.GenericServerStream[StreamRequest, StreamResponse]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Pixellock_DecryptStreamServer = grpc.BidiStreamingServer[StreamRequest, StreamResponse]
+
+func _Pixellock_StegoReveal_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(StegoRevealRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PixellockServer).StegoReveal(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Pixellock_StegoReveal_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PixellockServer).StegoReveal(ctx, req.(*StegoRevealRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// Pixellock_ServiceDesc is the grpc.ServiceDesc for Pixellock service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Pixellock_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "pixellock.v1.Pixellock",
+	HandlerType: (*PixellockServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Encrypt",
+			Handler:    _Pixellock_Encrypt_Handler,
+		},
+		{
+			MethodName: "Decrypt",
+			Handler:    _Pixellock_Decrypt_Handler,
+		},
+		{
+			MethodName: "StegoReveal",
+			Handler:    _Pixellock_StegoReveal_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "EncryptStream",
+			Handler:       _Pixellock_EncryptStream_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "DecryptStream",
+			Handler:       _Pixellock_DecryptStream_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "pixellock/v1/pixellock.proto",
+}
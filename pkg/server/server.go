@@ -0,0 +1,538 @@
+// Package server serves pixellock over HTTP: images are encrypted,
+// decrypted, and payloads hidden in and revealed from them, in the bodies
+// of POST requests.
+//
+// The endpoints are:
+//
+//	POST /v1/encrypt       an image in, the encrypted file out
+//	POST /v1/decrypt       an encrypted file in, the image out
+//	POST /v1/stego/hide    a cover image and a payload in, the stego image out
+//	POST /v1/stego/reveal  a stego image in, the payload out
+//	GET  /metrics          the metrics of Config.Metrics, when it is set
+//
+// The image is the request body, or the part named image of a
+// multipart/form-data body. A failed request gets a JSON body with the
+// stable pixellock.ErrorCode of the failure, as ErrorResponse describes.
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/Amul-Thantharate/pixellock/pkg/pixellock"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// KeyHeader is the request header a key, base64 encoded, is given in for
+// that request alone, when Config.AllowKeyOverride lets it be.
+const KeyHeader = "X-Pixellock-Key"
+
+// readHeaderTimeout bounds how long ListenAndServe waits for the headers
+// of a request, and shutdownTimeout how long it lets the requests being
+// handled finish once it is done.
+const (
+	readHeaderTimeout = 10 * time.Second
+	shutdownTimeout   = 30 * time.Second
+)
+
+// DefaultMaxBodyBytes is the largest request body taken when
+// Config.MaxBodyBytes is 0.
+const DefaultMaxBodyBytes = 32 << 20
+
+// A Config configures a Server.
+type Config struct {
+	// Key is the key requests are served with. It may be nil only when
+	// AllowKeyOverride is set, and every request must then give one.
+	Key []byte
+
+	// AllowKeyOverride lets a request give its own key in KeyHeader.
+	// Without it, a request giving one is refused.
+	AllowKeyOverride bool
+
+	// MaxBodyBytes bounds the request body; DefaultMaxBodyBytes when 0.
+	MaxBodyBytes int64
+
+	// MaxConcurrent is the number of requests handled at once, beyond
+	// which they are refused with E_BUSY; runtime.NumCPU() when 0.
+	MaxConcurrent int
+
+	// Stego is how payloads are hidden and revealed. Its Key and Password
+	// are replaced by the key of each request, which payloads are
+	// encrypted with.
+	Stego pixellock.StegoOptions
+
+	// Logger is given the failures of requests that are not the
+	// client's fault; nothing is logged when it is nil.
+	Logger pixellock.Logger
+
+	// Metrics counts the images encrypted and decrypted, and is served
+	// at /metrics for Prometheus; there are no metrics when it is nil.
+	Metrics *pixellock.Metrics
+
+	// TracerProvider traces each request to an endpoint, as a span
+	// beneath the one of its traceparent header when it has one, with
+	// spans beneath it for reading the body, encrypting or decrypting it,
+	// and writing the response; the global one of otel.GetTracerProvider
+	// when nil, which traces nothing until otel.SetTracerProvider is
+	// called.
+	TracerProvider trace.TracerProvider
+}
+
+// propagator reads the span a request is beneath from its traceparent
+// header.
+var propagator = propagation.TraceContext{}
+
+// A Server is the http.Handler of the pixellock endpoints. It can serve
+// several requests at once.
+type Server struct {
+	cfg    Config
+	tracer trace.Tracer
+	sem    chan struct{} // A token for each request being handled
+	mux    *http.ServeMux
+}
+
+// New returns the Server configured by cfg.
+func New(cfg Config) (*Server, error) {
+	if cfg.Key == nil && !cfg.AllowKeyOverride {
+		return nil, fmt.Errorf("%w: a server needs a key unless requests may give their own", pixellock.ErrInvalidKeySize)
+	}
+	if cfg.Key != nil && len(cfg.Key) != pixellock.KeySize {
+		return nil, fmt.Errorf("%w: key must be %d bytes", pixellock.ErrInvalidKeySize, pixellock.KeySize)
+	}
+	if err := cfg.Stego.Validate(); err != nil {
+		return nil, err
+	}
+	if cfg.MaxBodyBytes <= 0 {
+		cfg.MaxBodyBytes = DefaultMaxBodyBytes
+	}
+	if cfg.MaxConcurrent <= 0 {
+		cfg.MaxConcurrent = runtime.NumCPU()
+	}
+	if cfg.TracerProvider == nil {
+		cfg.TracerProvider = otel.GetTracerProvider()
+	}
+	s := &Server{cfg: cfg, sem: make(chan struct{}, cfg.MaxConcurrent), mux: http.NewServeMux()}
+	s.tracer = cfg.TracerProvider.Tracer(pixellock.ScopeName)
+	s.mux.Handle("POST /v1/encrypt", s.endpoint(s.encrypt))
+	s.mux.Handle("POST /v1/decrypt", s.endpoint(s.decrypt))
+	s.mux.Handle("POST /v1/stego/hide", s.endpoint(s.hide))
+	s.mux.Handle("POST /v1/stego/reveal", s.endpoint(s.reveal))
+	if cfg.Metrics != nil {
+		s.mux.HandleFunc("GET /metrics", s.metrics)
+	}
+	s.mux.HandleFunc("/", s.notFound)
+	return s, nil
+}
+
+// ServeHTTP serves the request r.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// ErrorResponse is the JSON body of a failed request.
+type ErrorResponse struct {
+	Code      pixellock.ErrorCode `json:"code"`
+	Message   string              `json:"error"`
+	Retryable bool                `json:"retryable"`
+}
+
+// requestError is a failure of the request itself rather than of what it
+// asked for, with the code and status it is answered with.
+type requestError struct {
+	code   pixellock.ErrorCode
+	status int
+	msg    string
+}
+
+func (e *requestError) Error() string                  { return e.msg }
+func (e *requestError) ErrorCode() pixellock.ErrorCode { return e.code }
+
+// badRequest returns a requestError of E_BAD_REQUEST with status.
+func badRequest(status int, format string, args ...any) error {
+	return &requestError{code: pixellock.CodeBadRequest, status: status, msg: fmt.Sprintf(format, args...)}
+}
+
+// statusCodes are the HTTP statuses failures of each code are answered
+// with; other codes get 500.
+var statusCodes = map[pixellock.ErrorCode]int{
+	pixellock.CodeKeyMismatch:       http.StatusUnprocessableEntity,
+	pixellock.CodeKeyRequired:       http.StatusUnprocessableEntity,
+	pixellock.CodeInvalidKey:        http.StatusBadRequest,
+	pixellock.CodeNotEncrypted:      http.StatusUnprocessableEntity,
+	pixellock.CodeNotImage:          http.StatusUnsupportedMediaType,
+	pixellock.CodeUnsupportedCipher: http.StatusUnprocessableEntity,
+	pixellock.CodeImageTooLarge:     http.StatusRequestEntityTooLarge,
+	pixellock.CodeNoPayload:         http.StatusUnprocessableEntity,
+	pixellock.CodePayloadTooLarge:   http.StatusUnprocessableEntity,
+	pixellock.CodePayloadCorrupted:  http.StatusUnprocessableEntity,
+	pixellock.CodeBadRequest:        http.StatusBadRequest,
+	pixellock.CodeRequestTooLarge:   http.StatusRequestEntityTooLarge,
+	pixellock.CodeBusy:              http.StatusServiceUnavailable,
+	pixellock.CodeCanceled:          http.StatusServiceUnavailable,
+}
+
+// codeOf returns the code and HTTP status of err.
+func codeOf(err error) (pixellock.ErrorCode, int) {
+	var req *requestError
+	if errors.As(err, &req) {
+		return req.code, req.status
+	}
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return pixellock.CodeRequestTooLarge, http.StatusRequestEntityTooLarge
+	}
+	code := pixellock.ErrorCodeOf(err)
+	if status, ok := statusCodes[code]; ok {
+		return code, status
+	}
+	return code, http.StatusInternalServerError
+}
+
+// writeError answers r with err, logging it when it is no fault of the
+// client's.
+func (s *Server) writeError(w http.ResponseWriter, r *http.Request, err error) {
+	code, status := codeOf(err)
+	if status >= 500 && code != pixellock.CodeBusy && s.cfg.Logger != nil {
+		s.cfg.Logger.Error("request failed", "path", r.URL.Path, "code", code, "err", err)
+	}
+	if code.Retryable() {
+		w.Header().Set("Retry-After", "1")
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(ErrorResponse{Code: code, Message: err.Error(), Retryable: code.Retryable()})
+}
+
+// notFound answers requests to no endpoint, and to an endpoint with a
+// method other than POST.
+func (s *Server) notFound(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/v1/encrypt", "/v1/decrypt", "/v1/stego/hide", "/v1/stego/reveal":
+		w.Header().Set("Allow", http.MethodPost)
+		s.writeError(w, r, badRequest(http.StatusMethodNotAllowed, "%s takes POST requests", r.URL.Path))
+	default:
+		s.writeError(w, r, &requestError{code: pixellock.CodeNotFound, status: http.StatusNotFound, msg: "no endpoint " + r.URL.Path})
+	}
+}
+
+// A request is what an endpoint is given: the key and the parts of the
+// body.
+type request struct {
+	*http.Request
+	key   []byte
+	image []byte            // The image, or encrypted file
+	parts map[string][]byte // The other parts of a multipart body, by name
+	names map[string]string // The filenames of those that are files
+}
+
+// A response is what an endpoint answers with.
+type response struct {
+	contentType string
+	filename    string // For Content-Disposition; none when empty
+	body        []byte
+}
+
+// endpoint returns the handler running fn once a slot is free, the key is
+// known and the body read, answering with what fn returns.
+func (s *Server) endpoint(fn func(req *request) (response, error)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, route, _ := strings.Cut(r.Pattern, " ")
+		ctx, span := s.tracer.Start(propagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header)), r.Pattern,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", r.Method),
+				attribute.String("http.route", route),
+				attribute.String("url.path", r.URL.Path),
+			),
+		)
+		defer span.End()
+		r = r.WithContext(ctx)
+
+		err := s.handle(w, r, fn)
+		status := http.StatusOK
+		if err != nil {
+			var code pixellock.ErrorCode
+			code, status = codeOf(err)
+			span.SetAttributes(attribute.String("error.type", string(code)))
+			if status >= 500 {
+				setError(span, err)
+			}
+			s.writeError(w, r, err)
+		}
+		span.SetAttributes(attribute.Int("http.response.status_code", status))
+	})
+}
+
+// setError records err, when it is not nil, as why span failed.
+func setError(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+}
+
+// handle runs fn for r once a slot is free, writing the response it
+// returns to w, or returning why it failed.
+func (s *Server) handle(w http.ResponseWriter, r *http.Request, fn func(req *request) (response, error)) error {
+	release, err := s.acquire()
+	if err != nil {
+		return err
+	}
+	defer release()
+	resp, err := s.serve(w, r, fn)
+	if err != nil {
+		return err
+	}
+	_, span := s.tracer.Start(r.Context(), pixellock.SpanWrite, trace.WithAttributes(attribute.Int(pixellock.AttrBytesWritten, len(resp.body))))
+	defer span.End()
+	w.Header().Set("Content-Type", resp.contentType)
+	if resp.filename != "" {
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": resp.filename}))
+	}
+	_, err = w.Write(resp.body)
+	setError(span, err)
+	return nil
+}
+
+// acquire takes a slot for a request, returning the function giving it
+// back, or fails with E_BUSY when none is free.
+func (s *Server) acquire() (release func(), err error) {
+	select {
+	case s.sem <- struct{}{}:
+		return func() { <-s.sem }, nil
+	default:
+		return nil, &requestError{code: pixellock.CodeBusy, status: http.StatusServiceUnavailable, msg: "the server is busy; try again"}
+	}
+}
+
+// serve reads the request r for fn and runs it, recovering a panic of it
+// as a *pixellock.PanicError.
+func (s *Server) serve(w http.ResponseWriter, r *http.Request, fn func(req *request) (response, error)) (resp response, err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			err = &pixellock.PanicError{Value: v, Stack: debug.Stack()}
+		}
+	}()
+	key, err := s.key(r)
+	if err != nil {
+		return response{}, err
+	}
+	req := &request{Request: r, key: key}
+	_, span := s.tracer.Start(r.Context(), pixellock.SpanLoad)
+	err = req.readBody(http.MaxBytesReader(w, r.Body, s.cfg.MaxBodyBytes))
+	span.SetAttributes(attribute.Int(pixellock.AttrBytesRead, len(req.image)))
+	setError(span, err)
+	span.End()
+	if err != nil {
+		return response{}, err
+	}
+	return fn(req)
+}
+
+// key returns the key of r: the one in KeyHeader, or the server's.
+func (s *Server) key(r *http.Request) ([]byte, error) {
+	header := r.Header.Get(KeyHeader)
+	switch {
+	case header != "" && !s.cfg.AllowKeyOverride:
+		return nil, badRequest(http.StatusForbidden, "this server does not take keys in %s", KeyHeader)
+	case header != "":
+		return pixellock.DecodeKey(header)
+	case s.cfg.Key == nil:
+		return nil, badRequest(http.StatusBadRequest, "no key: give one in %s", KeyHeader)
+	}
+	return s.cfg.Key, nil
+}
+
+// readBody reads the image from body: the body whole or, for a multipart
+// body, its part named image, keeping the other parts.
+func (req *request) readBody(body io.Reader) error {
+	mediaType, params, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if !strings.HasPrefix(mediaType, "multipart/") {
+		data, err := io.ReadAll(body)
+		if err != nil {
+			return fmt.Errorf("failed to read request: %w", err)
+		}
+		req.image = data
+		return req.needImage()
+	}
+	mr := multipart.NewReader(body, params["boundary"])
+	req.parts, req.names = map[string][]byte{}, map[string]string{}
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read request: %w", err)
+		}
+		data, err := io.ReadAll(part)
+		if err != nil {
+			return fmt.Errorf("failed to read request: %w", err)
+		}
+		if name := part.FormName(); name == "image" {
+			req.image = data
+		} else {
+			req.parts[name] = data
+			if part.FileName() != "" {
+				req.names[name] = part.FileName()
+			}
+		}
+	}
+	return req.needImage()
+}
+
+// needImage returns an error when the request has no image.
+func (req *request) needImage() error {
+	if len(req.image) == 0 {
+		return badRequest(http.StatusBadRequest, "no image: send it as the body, or the part named image of a multipart body")
+	}
+	return nil
+}
+
+// imageResponse returns the image data in a response, typed by the format
+// it decodes as.
+func imageResponse(data []byte) response {
+	_, format, _ := image.DecodeConfig(bytes.NewReader(data))
+	return response{contentType: pixellock.ImageMIMEType(format), body: data}
+}
+
+// encrypt encrypts the image.
+func (s *Server) encrypt(req *request) (response, error) {
+	encrypted, err := s.encryptImage(req.Context(), req.key, req.image)
+	if err != nil {
+		return response{}, err
+	}
+	return response{contentType: "application/octet-stream", body: encrypted}, nil
+}
+
+// encryptImage encrypts the image data with key.
+func (s *Server) encryptImage(ctx context.Context, key, data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	done := s.cfg.Metrics.Start(pixellock.PhaseEncrypt)
+	_, span := s.tracer.Start(ctx, pixellock.SpanEncrypt, trace.WithAttributes(attribute.String(pixellock.AttrCipher, pixellock.CipherName(pixellock.AESGCM))))
+	err := pixellock.EncryptImage(ctx, key, &buf, bytes.NewReader(data))
+	setError(span, err)
+	span.End()
+	done(int64(len(data)), pixellock.CipherName(pixellock.AESGCM), err)
+	return buf.Bytes(), err
+}
+
+// decrypt decrypts the encrypted file, answering with the image as it
+// was encrypted: a PNG, or an animated GIF, multi-page TIFF or HEIF image.
+func (s *Server) decrypt(req *request) (response, error) {
+	img, err := s.decryptImage(req.Context(), req.key, req.image)
+	if err != nil {
+		return response{}, err
+	}
+	return imageResponse(img), nil
+}
+
+// decryptImage decrypts the encrypted file data with key.
+func (s *Server) decryptImage(ctx context.Context, key, data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	done := s.cfg.Metrics.Start(pixellock.PhaseDecrypt)
+	_, span := s.tracer.Start(ctx, pixellock.SpanDecrypt)
+	err := pixellock.DecryptImage(ctx, key, &buf, bytes.NewReader(data))
+	var cipher string
+	if suite := pixellock.StreamCipher(data); suite != nil {
+		cipher = pixellock.CipherName(suite)
+		span.SetAttributes(attribute.String(pixellock.AttrCipher, cipher))
+	}
+	setError(span, err)
+	span.End()
+	done(int64(len(data)), cipher, err)
+	return buf.Bytes(), err
+}
+
+// stegoOptions returns the options payloads are hidden and revealed with
+// for a request of key.
+func (s *Server) stegoOptions(key []byte) pixellock.StegoOptions {
+	opts := s.cfg.Stego
+	opts.Key, opts.Password = key, ""
+	return opts
+}
+
+// hide hides the payload in the cover image: the file in the part named
+// payload, or the text of the part named message, or of the message query
+// parameter. The stego image is written in the format query parameter,
+// png by default.
+func (s *Server) hide(req *request) (response, error) {
+	var p pixellock.Payload
+	switch data, ok := req.parts["payload"]; {
+	case ok:
+		p = pixellock.Payload{Data: data, Filename: req.names["payload"]}
+	case req.parts["message"] != nil:
+		p = pixellock.Payload{Data: req.parts["message"]}
+	case req.URL.Query().Has("message"):
+		p = pixellock.Payload{Data: []byte(req.URL.Query().Get("message"))}
+	default:
+		return response{}, badRequest(http.StatusBadRequest, "no payload: give a payload or message part, or a message parameter")
+	}
+	format := req.URL.Query().Get("format")
+	if format == "" {
+		format = "png"
+	}
+	if err := pixellock.CheckOutputFormat(format); err != nil {
+		return response{}, badRequest(http.StatusBadRequest, "%v", err)
+	}
+	var buf bytes.Buffer
+	if err := pixellock.HidePayloadTo(&buf, bytes.NewReader(req.image), p, s.stegoOptions(req.key), format); err != nil {
+		if errors.Is(err, pixellock.ErrLossyFormat) {
+			return response{}, badRequest(http.StatusBadRequest, "%v", err)
+		}
+		return response{}, err
+	}
+	return response{contentType: pixellock.ImageMIMEType(format), body: buf.Bytes()}, nil
+}
+
+// reveal reveals the payload of the stego image: a file, with its
+// filename, or a message as text.
+func (s *Server) reveal(req *request) (response, error) {
+	p, err := pixellock.RevealPayloadFrom(bytes.NewReader(req.image), s.stegoOptions(req.key))
+	if err != nil {
+		return response{}, err
+	}
+	if p.Filename == "" {
+		return response{contentType: "text/plain; charset=utf-8", body: p.Data}, nil
+	}
+	return response{contentType: "application/octet-stream", filename: p.Filename, body: p.Data}, nil
+}
+
+// metrics answers with the metrics of the server, for Prometheus to
+// scrape.
+func (s *Server) metrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", pixellock.MetricsContentType)
+	s.cfg.Metrics.WriteTo(w)
+}
+
+// ListenAndServe serves s on addr until ctx is done, then shuts the
+// server down, letting the requests being handled finish.
+func ListenAndServe(ctx context.Context, addr string, s *Server) error {
+	srv := &http.Server{Addr: addr, Handler: s, ReadHeaderTimeout: readHeaderTimeout}
+	errc := make(chan error, 1)
+	go func() { errc <- srv.ListenAndServe() }()
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+	shutdown, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	return srv.Shutdown(shutdown)
+}
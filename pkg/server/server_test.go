@@ -0,0 +1,364 @@
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/Amul-Thantharate/pixellock/pkg/pixellock"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// testPNG returns a PNG of a small gradient.
+func testPNG(t *testing.T) []byte {
+	t.Helper()
+	img := image.NewNRGBA(image.Rect(0, 0, 64, 48))
+	for y := 0; y < 48; y++ {
+		for x := 0; x < 64; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{uint8(x * 4), uint8(y * 5), uint8(x + y), 255})
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// newTestServer returns a Server with a random key, configured further by
+// cfg, and the key.
+func newTestServer(t *testing.T, cfg Config) (*Server, []byte) {
+	t.Helper()
+	key, _ := pixellock.GenerateRandomKey()
+	if cfg.Key == nil && !cfg.AllowKeyOverride {
+		cfg.Key = key
+	}
+	cfg.Stego = pixellock.DefaultStegoOptions
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	return s, cfg.Key
+}
+
+// post sends body to path of s, with the headers given as name, value
+// pairs.
+func post(s http.Handler, path string, body []byte, headers ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(body))
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	return w
+}
+
+// multipartBody returns a multipart body of the parts, by name; those
+// named with a filename after a slash, such as "payload/notes.txt", are
+// sent as files.
+func multipartBody(t *testing.T, parts map[string][]byte) ([]byte, string) {
+	t.Helper()
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	for name, data := range parts {
+		var w io.Writer
+		var err error
+		if field, filename, ok := strings.Cut(name, "/"); ok {
+			w, err = mw.CreateFormFile(field, filename)
+		} else {
+			w, err = mw.CreateFormField(name)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(data)
+	}
+	mw.Close()
+	return buf.Bytes(), mw.FormDataContentType()
+}
+
+// checkOK checks that w succeeded with contentType.
+func checkOK(t *testing.T, w *httptest.ResponseRecorder, contentType string) {
+	t.Helper()
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	if got := w.Header().Get("Content-Type"); got != contentType {
+		t.Errorf("Content-Type = %q, want %q", got, contentType)
+	}
+}
+
+// checkError checks that w failed with status and a JSON body of code.
+func checkError(t *testing.T, w *httptest.ResponseRecorder, status int, code pixellock.ErrorCode) {
+	t.Helper()
+	if w.Code != status {
+		t.Errorf("status %d, want %d: %s", w.Code, status, w.Body)
+	}
+	if got := w.Header().Get("Content-Type"); got != "application/json" {
+		t.Errorf("error Content-Type = %q", got)
+	}
+	var resp ErrorResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("error body %q is not JSON: %v", w.Body, err)
+	}
+	if resp.Code != code || resp.Message == "" || resp.Retryable != code.Retryable() {
+		t.Errorf("error body %+v, want code %s", resp, code)
+	}
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	s, _ := newTestServer(t, Config{})
+	img := testPNG(t)
+	w := post(s, "/v1/encrypt", img)
+	checkOK(t, w, "application/octet-stream")
+	encrypted := w.Body.Bytes()
+
+	w = post(s, "/v1/decrypt", encrypted)
+	checkOK(t, w, "image/png")
+	got, err := png.Decode(w.Body)
+	if err != nil {
+		t.Fatalf("decrypted image does not decode: %v", err)
+	}
+	want, _ := png.Decode(bytes.NewReader(img))
+	if got.Bounds() != want.Bounds() || got.At(10, 20) != want.At(10, 20) {
+		t.Error("decrypted image differs from the one encrypted")
+	}
+
+	// The image may be the part named image of a multipart body
+	body, contentType := multipartBody(t, map[string][]byte{"image/enc.bin": encrypted})
+	checkOK(t, post(s, "/v1/decrypt", body, "Content-Type", contentType), "image/png")
+}
+
+func TestKeyOverride(t *testing.T) {
+	other, _ := pixellock.GenerateRandomKey()
+	header := base64.StdEncoding.EncodeToString(other)
+	img := testPNG(t)
+
+	// Refused unless allowed
+	s, _ := newTestServer(t, Config{})
+	checkError(t, post(s, "/v1/encrypt", img, KeyHeader, header), http.StatusForbidden, pixellock.CodeBadRequest)
+
+	// Allowed, the header's key is used in place of the server's
+	serverKey, _ := pixellock.GenerateRandomKey()
+	s, _ = newTestServer(t, Config{Key: serverKey, AllowKeyOverride: true})
+	w := post(s, "/v1/encrypt", img, KeyHeader, header)
+	checkOK(t, w, "application/octet-stream")
+	encrypted := w.Body.Bytes()
+	checkError(t, post(s, "/v1/decrypt", encrypted), http.StatusUnprocessableEntity, pixellock.CodeKeyMismatch)
+	checkOK(t, post(s, "/v1/decrypt", encrypted, KeyHeader, header), "image/png")
+	checkError(t, post(s, "/v1/decrypt", encrypted, KeyHeader, "c2hvcnQ="), http.StatusBadRequest, pixellock.CodeInvalidKey)
+
+	// Without a key of its own, every request must give one
+	s, _ = newTestServer(t, Config{AllowKeyOverride: true})
+	checkError(t, post(s, "/v1/encrypt", img), http.StatusBadRequest, pixellock.CodeBadRequest)
+	checkOK(t, post(s, "/v1/encrypt", img, KeyHeader, header), "application/octet-stream")
+
+	if _, err := New(Config{}); err == nil {
+		t.Error("New without a key or key override succeeded")
+	}
+}
+
+func TestStegoHideReveal(t *testing.T) {
+	s, _ := newTestServer(t, Config{})
+	img := testPNG(t)
+
+	// A message in the query, revealed as text
+	w := post(s, "/v1/stego/hide?message=hello+there", img)
+	checkOK(t, w, "image/png")
+	w = post(s, "/v1/stego/reveal", w.Body.Bytes())
+	checkOK(t, w, "text/plain; charset=utf-8")
+	if w.Body.String() != "hello there" {
+		t.Errorf("revealed %q", w.Body)
+	}
+
+	// A file, revealed with its name, in a BMP
+	body, contentType := multipartBody(t, map[string][]byte{"image/cover.png": img, "payload/notes.txt": []byte("secret notes")})
+	w = post(s, "/v1/stego/hide?format=bmp", body, "Content-Type", contentType)
+	checkOK(t, w, "image/bmp")
+	w = post(s, "/v1/stego/reveal", w.Body.Bytes())
+	checkOK(t, w, "application/octet-stream")
+	if w.Body.String() != "secret notes" || !strings.Contains(w.Header().Get("Content-Disposition"), "notes.txt") {
+		t.Errorf("revealed %q as %q", w.Body, w.Header().Get("Content-Disposition"))
+	}
+
+	// Payloads are encrypted with the key
+	other, _ := newTestServer(t, Config{})
+	w = post(s, "/v1/stego/hide?message=keyed", img)
+	checkError(t, post(other, "/v1/stego/reveal", w.Body.Bytes()), http.StatusUnprocessableEntity, pixellock.CodeKeyMismatch)
+}
+
+func TestErrors(t *testing.T) {
+	s, _ := newTestServer(t, Config{MaxBodyBytes: 4 << 10})
+	img := testPNG(t)
+	for _, tc := range []struct {
+		name   string
+		w      *httptest.ResponseRecorder
+		status int
+		code   pixellock.ErrorCode
+	}{
+		{"empty body", post(s, "/v1/encrypt", nil), http.StatusBadRequest, pixellock.CodeBadRequest},
+		{"not an image", post(s, "/v1/encrypt", []byte("plain text, not an image")), http.StatusUnsupportedMediaType, pixellock.CodeNotImage},
+		{"not encrypted", post(s, "/v1/decrypt", img), http.StatusUnprocessableEntity, pixellock.CodeNotEncrypted},
+		{"too large", post(s, "/v1/encrypt", bytes.Repeat([]byte{1}, 5<<10)), http.StatusRequestEntityTooLarge, pixellock.CodeRequestTooLarge},
+		{"no payload", post(s, "/v1/stego/hide", img), http.StatusBadRequest, pixellock.CodeBadRequest},
+		{"lossy stego", post(s, "/v1/stego/hide?message=x&format=jpeg", img), http.StatusBadRequest, pixellock.CodeBadRequest},
+		{"bad format", post(s, "/v1/stego/hide?message=x&format=nope", img), http.StatusBadRequest, pixellock.CodeBadRequest},
+		{"payload too large", post(s, "/v1/stego/hide?message="+strings.Repeat("x", 3000), img), http.StatusUnprocessableEntity, pixellock.CodePayloadTooLarge},
+		{"no payload hidden", post(s, "/v1/stego/reveal", img), http.StatusUnprocessableEntity, pixellock.CodeNoPayload},
+		{"unknown endpoint", post(s, "/v1/nothing", img), http.StatusNotFound, pixellock.CodeNotFound},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			checkError(t, tc.w, tc.status, tc.code)
+		})
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/v1/decrypt", nil)
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	checkError(t, w, http.StatusMethodNotAllowed, pixellock.CodeBadRequest)
+	if w.Header().Get("Allow") != http.MethodPost {
+		t.Errorf("Allow = %q", w.Header().Get("Allow"))
+	}
+}
+
+// TestConcurrencyLimit holds every slot of a server and checks that the
+// next request is refused as busy, and taken once a slot is free.
+func TestConcurrencyLimit(t *testing.T) {
+	s, _ := newTestServer(t, Config{MaxConcurrent: 2})
+	s.sem <- struct{}{}
+	s.sem <- struct{}{}
+	w := post(s, "/v1/encrypt", testPNG(t))
+	checkError(t, w, http.StatusServiceUnavailable, pixellock.CodeBusy)
+	if w.Header().Get("Retry-After") == "" {
+		t.Error("busy response has no Retry-After")
+	}
+	<-s.sem
+	checkOK(t, post(s, "/v1/encrypt", testPNG(t)), "application/octet-stream")
+	if len(s.sem) != 1 {
+		t.Errorf("%d slots held after the request, want 1", len(s.sem))
+	}
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	s, _ := newTestServer(t, Config{})
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("GET /metrics without metrics: status %d, want 404", w.Code)
+	}
+
+	s, _ = newTestServer(t, Config{Metrics: pixellock.NewMetrics()})
+	img := testPNG(t)
+	encrypted := post(s, "/v1/encrypt", img)
+	if encrypted.Code != http.StatusOK {
+		t.Fatalf("encrypt: status %d: %s", encrypted.Code, encrypted.Body)
+	}
+	post(s, "/v1/encrypt", encrypted.Body.Bytes())
+	if w := post(s, "/v1/decrypt", encrypted.Body.Bytes()); w.Code != http.StatusOK {
+		t.Fatalf("decrypt: status %d: %s", w.Code, w.Body)
+	}
+	post(s, "/v1/decrypt", img)
+
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != pixellock.MetricsContentType {
+		t.Fatalf("GET /metrics: status %d, type %q", w.Code, w.Header().Get("Content-Type"))
+	}
+	for _, want := range []string{
+		`pixellock_files_total{op="encrypt",result="ok"} 1`,
+		`pixellock_files_total{op="encrypt",result="failed"} 1`,
+		`pixellock_files_total{op="decrypt",result="ok"} 1`,
+		`pixellock_files_total{op="decrypt",result="failed"} 1`,
+		`pixellock_files_in_flight{op="encrypt"} 0`,
+		`pixellock_file_size_bytes_count{op="encrypt"} 1`,
+		`pixellock_file_size_bytes_sum{op="decrypt"} ` + strconv.Itoa(encrypted.Body.Len()),
+		`pixellock_crypto_operations_total{op="encrypt",cipher="aes-256-gcm"} 1`,
+		`pixellock_crypto_operations_total{op="decrypt",cipher="aes-256-gcm"} 1`,
+	} {
+		if !strings.Contains(w.Body.String(), want+"\n") {
+			t.Errorf("no %s in metrics:\n%s", want, w.Body)
+		}
+	}
+}
+
+func TestTracing(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	s, _ := newTestServer(t, Config{TracerProvider: sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))})
+	const parent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	img := testPNG(t)
+	w := post(s, "/v1/encrypt", img, "traceparent", parent)
+	checkOK(t, w, "application/octet-stream")
+	post(s, "/v1/decrypt", img) // Not encrypted, so fails
+
+	var encrypt, decrypt tracetest.SpanStub
+	beneath := map[trace.SpanID][]tracetest.SpanStub{}
+	for _, span := range exporter.GetSpans() {
+		switch span.Name {
+		case "POST /v1/encrypt":
+			encrypt = span
+		case "POST /v1/decrypt":
+			decrypt = span
+		default:
+			beneath[span.Parent.SpanID()] = append(beneath[span.Parent.SpanID()], span)
+		}
+	}
+	if encrypt.SpanContext.TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" || encrypt.Parent.SpanID().String() != "00f067aa0ba902b7" || encrypt.SpanKind != trace.SpanKindServer {
+		t.Errorf("the encrypt request is not beneath its traceparent: %+v", encrypt)
+	}
+	for key, want := range map[string]any{"http.request.method": "POST", "http.route": "/v1/encrypt", "http.response.status_code": int64(200)} {
+		if got := spanAttr(encrypt, key); got != want {
+			t.Errorf("%s = %v, want %v", key, got, want)
+		}
+	}
+	var names []string
+	for _, span := range beneath[encrypt.SpanContext.SpanID()] {
+		names = append(names, span.Name)
+		switch span.Name {
+		case pixellock.SpanLoad:
+			if n := spanAttr(span, pixellock.AttrBytesRead); n != int64(len(img)) {
+				t.Errorf("the body read was %v bytes, want %d", n, len(img))
+			}
+		case pixellock.SpanWrite:
+			if n := spanAttr(span, pixellock.AttrBytesWritten); n != int64(w.Body.Len()) {
+				t.Errorf("the response written was %v bytes, want %d", n, w.Body.Len())
+			}
+		}
+	}
+	if strings.Join(names, ",") != "load,encrypt,write" {
+		t.Errorf("the spans beneath the encrypt request are %v", names)
+	}
+
+	if decrypt.Parent.IsValid() || decrypt.SpanContext.TraceID() == encrypt.SpanContext.TraceID() {
+		t.Error("a request without a traceparent is not the root of a trace")
+	}
+	if code := spanAttr(decrypt, "error.type"); code != string(pixellock.CodeNotEncrypted) {
+		t.Errorf("the failed request has error.type %v", code)
+	}
+	if failed := beneath[decrypt.SpanContext.SpanID()]; len(failed) != 2 || failed[1].Name != pixellock.SpanDecrypt || failed[1].Status.Code != codes.Error {
+		t.Errorf("the spans beneath the failed request are %+v", failed)
+	}
+}
+
+// spanAttr returns the value of the attribute key of span, or nil when it
+// has none.
+func spanAttr(span tracetest.SpanStub, key string) any {
+	for _, kv := range span.Attributes {
+		if string(kv.Key) == key {
+			return kv.Value.AsInterface()
+		}
+	}
+	return nil
+}
@@ -0,0 +1,530 @@
+// Package sftp reaches SFTP servers over SSH for pixellock.SFTPFS, so that
+// images can be read from and written to them. Servers are authenticated
+// against known_hosts, and users with a key file or the keys of the SSH
+// agent. The files transferred at once share a few connections to each
+// server, rather than opening one each.
+package sftp
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+
+	"github.com/Amul-Thantharate/pixellock/pkg/pixellock"
+)
+
+// Defaults of a Config.
+const (
+	DefaultConnections = 4
+	DefaultTimeout     = 30 * time.Second
+)
+
+// transferBuffer is the size of the buffers files are read and written
+// through, so that each read or write sends many requests at once rather
+// than waiting on one at a time.
+const transferBuffer = 256 << 10
+
+// posixRename is the extension of OpenSSH renaming over a file that
+// exists, which plain SFTP refuses to.
+const posixRename = "posix-rename@openssh.com"
+
+// Config configures a Pool.
+type Config struct {
+	// User is the user of servers named without one; the current user
+	// by default.
+	User string
+
+	// Identity is a private key file to authenticate with, tried before
+	// the keys of the SSH agent SSH_AUTH_SOCK reaches. A key protected by
+	// a passphrase is used through the agent instead.
+	Identity string
+
+	// KnownHosts are the known_hosts files the host keys of servers are
+	// checked against; ~/.ssh/known_hosts by default. A server whose key
+	// is not there, or differs, is refused.
+	KnownHosts []string
+
+	// InsecureIgnoreHostKey accepts the host key of any server unchecked,
+	// leaving what is transferred open to whoever can intercept it.
+	InsecureIgnoreHostKey bool
+
+	// Connections is the most connections kept open to each server, which
+	// the files transferred at once share; DefaultConnections when 0.
+	Connections int
+
+	// Timeout bounds connecting to a server; DefaultTimeout when 0.
+	Timeout time.Duration
+}
+
+// A Pool keeps the connections to the servers of a pixellock.SFTPFS. It
+// is a pixellock.SFTPClient, and can be used by several goroutines at
+// once. A connection is opened to a server as a file is transferred while
+// the others are all busy, up to Connections, and one that drops is
+// replaced by the next file.
+type Pool struct {
+	cfg      Config
+	auth     ssh.AuthMethod
+	hostKeys ssh.HostKeyCallback
+	agent    net.Conn // The connection to the SSH agent, if any
+
+	mu      sync.Mutex
+	servers map[string]*server
+}
+
+var _ pixellock.SFTPClient = (*Pool)(nil)
+
+// New returns a Pool configured by cfg. It fails when there is no key to
+// authenticate with, or no known_hosts file to check servers against.
+func New(cfg Config) (*Pool, error) {
+	if cfg.Connections <= 0 {
+		cfg.Connections = DefaultConnections
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = DefaultTimeout
+	}
+	if cfg.User == "" {
+		if u, err := user.Current(); err == nil {
+			cfg.User = u.Username
+		}
+	}
+	p := &Pool{cfg: cfg, servers: map[string]*server{}}
+
+	var signers []ssh.Signer
+	if cfg.Identity != "" {
+		signer, err := loadIdentity(cfg.Identity)
+		if err != nil {
+			return nil, err
+		}
+		signers = append(signers, signer)
+	}
+	var keyring agent.ExtendedAgent
+	if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+		conn, err := net.Dial("unix", sock)
+		if err != nil && cfg.Identity == "" {
+			return nil, fmt.Errorf("connecting to the SSH agent: %w", err)
+		}
+		if err == nil {
+			p.agent, keyring = conn, agent.NewClient(conn)
+		}
+	}
+	if signers == nil && keyring == nil {
+		return nil, errors.New("no SSH key to authenticate with: give an identity file, or run an SSH agent")
+	}
+	// One method of the keys of both, as a client tries each method once
+	p.auth = ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+		if keyring == nil {
+			return signers, nil
+		}
+		keys, err := keyring.Signers()
+		if err != nil && signers == nil {
+			return nil, fmt.Errorf("reading the keys of the SSH agent: %w", err)
+		}
+		return append(slices.Clip(signers), keys...), nil
+	})
+
+	if cfg.InsecureIgnoreHostKey {
+		p.hostKeys = ssh.InsecureIgnoreHostKey()
+		return p, nil
+	}
+	files := cfg.KnownHosts
+	if len(files) == 0 {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			p.Close()
+			return nil, fmt.Errorf("finding known_hosts: %w", err)
+		}
+		files = []string{filepath.Join(home, ".ssh", "known_hosts")}
+	}
+	hostKeys, err := knownhosts.New(files...)
+	if err != nil {
+		p.Close()
+		return nil, fmt.Errorf("reading known_hosts, which servers are checked against: %w", err)
+	}
+	p.hostKeys = hostKeys
+	return p, nil
+}
+
+// loadIdentity returns the signer of the private key file name.
+func loadIdentity(name string) (ssh.Signer, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.ParsePrivateKey(data)
+	var missing *ssh.PassphraseMissingError
+	if errors.As(err, &missing) {
+		return nil, fmt.Errorf("%s is protected by a passphrase; add it to the SSH agent instead", name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return signer, nil
+}
+
+// Server returns the FileSystem of the files of name, user@host with an
+// optional :port, named by their paths there. The user is Config.User,
+// and the port 22, when not given.
+func (p *Pool) Server(name string) (pixellock.FileSystem, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if s, ok := p.servers[name]; ok {
+		return s, nil
+	}
+	login, host := p.cfg.User, name
+	if i := strings.LastIndex(name, "@"); i >= 0 {
+		login, host = name[:i], name[i+1:]
+	}
+	if login == "" || host == "" {
+		return nil, fmt.Errorf("invalid server %q: want user@host", name)
+	}
+	addr := host
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		addr = net.JoinHostPort(strings.Trim(host, "[]"), "22")
+	}
+	config := &ssh.ClientConfig{
+		User:            login,
+		Auth:            []ssh.AuthMethod{p.auth},
+		HostKeyCallback: p.hostKeys,
+		Timeout:         p.cfg.Timeout,
+	}
+	if !p.cfg.InsecureIgnoreHostKey {
+		config.HostKeyAlgorithms = knownAlgorithms(p.hostKeys, addr)
+	}
+	s := &server{pool: p, addr: addr, config: config}
+	s.dialed = sync.NewCond(&s.mu)
+	p.servers[name] = s
+	return s, nil
+}
+
+// knownAlgorithms returns the algorithms of the keys of addr in
+// known_hosts, for the server to offer one of them rather than another it
+// has, or none when addr is not there.
+func knownAlgorithms(hostKeys ssh.HostKeyCallback, addr string) []string {
+	// Checking a key that cannot be there lists those that are
+	pub, _, _ := ed25519.GenerateKey(rand.Reader)
+	key, _ := ssh.NewPublicKey(pub)
+	var keyErr *knownhosts.KeyError
+	if err := hostKeys(addr, &net.TCPAddr{}, key); !errors.As(err, &keyErr) {
+		return nil
+	}
+	var algorithms []string
+	for _, known := range keyErr.Want {
+		switch known.Key.Type() {
+		case ssh.KeyAlgoRSA:
+			algorithms = append(algorithms, ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA)
+		default:
+			algorithms = append(algorithms, known.Key.Type())
+		}
+	}
+	return algorithms
+}
+
+// Close closes the connections of p, failing the transfers still going.
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, s := range p.servers {
+		s.close()
+	}
+	if p.agent != nil {
+		p.agent.Close()
+	}
+	return nil
+}
+
+// A server is the FileSystem of the files of a server, sharing the
+// connections of a Pool to it.
+type server struct {
+	pool   *Pool
+	addr   string
+	config *ssh.ClientConfig
+
+	mu      sync.Mutex
+	dialed  *sync.Cond // Broadcast when a connection has been opened, or failed to be
+	conns   []*conn
+	dialing int   // Connections being opened, outside mu, which count toward Connections
+	err     error // The failure of the handshake, refusing the user or host, which is not tried again
+}
+
+// A conn is a connection to a server, busy with the number of transfers
+// and requests using it.
+type conn struct {
+	client *sftp.Client
+	busy   int
+	closed atomic.Bool
+}
+
+// acquire returns the connection to s least busy, opening another when
+// all are busy and there are fewer than Connections, counting those being
+// opened. It is opened without holding s.mu, so that transfers on the
+// others go on meanwhile; when there is no other, acquire waits for one
+// being opened. release gives the connection back.
+func (s *server) acquire() (*conn, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for {
+		if s.err != nil {
+			return nil, s.err
+		}
+		least := s.leastBusy()
+		switch {
+		case least != nil && (least.busy == 0 || len(s.conns)+s.dialing >= s.pool.cfg.Connections):
+			least.busy++
+			return least, nil
+		case len(s.conns)+s.dialing < s.pool.cfg.Connections:
+			return s.openConn()
+		}
+		s.dialed.Wait()
+	}
+}
+
+// openConn opens another connection to s, in a slot it reserves for it,
+// and returns it busy, or the least busy of the others when it fails to
+// open. It is called with s.mu held, which it releases while dialing.
+func (s *server) openConn() (*conn, error) {
+	s.dialing++
+	s.mu.Unlock()
+	c, err := s.dial()
+	s.mu.Lock()
+	s.dialing--
+	s.dialed.Broadcast()
+	if err == nil {
+		s.conns = append(s.conns, c)
+		c.busy++
+		return c, nil
+	}
+	var refused *refusedError
+	if errors.As(err, &refused) {
+		s.err = refused.err
+		return nil, s.err
+	}
+	least := s.leastBusy()
+	if least == nil {
+		return nil, err
+	}
+	least.busy++
+	return least, nil
+}
+
+// leastBusy returns the open connection to s least busy, or nil when
+// there is none, dropping those that have closed. s.mu must be held.
+func (s *server) leastBusy() *conn {
+	s.conns = slices.DeleteFunc(s.conns, func(c *conn) bool { return c.closed.Load() })
+	var least *conn
+	for _, c := range s.conns {
+		if least == nil || c.busy < least.busy {
+			least = c
+		}
+	}
+	return least
+}
+
+// A refusedError is the failure of a handshake refusing the user or host,
+// which dial returns for acquire to keep.
+type refusedError struct {
+	err error
+}
+
+func (e *refusedError) Error() string { return e.err.Error() }
+func (e *refusedError) Unwrap() error { return e.err }
+
+func (s *server) release(c *conn) {
+	s.mu.Lock()
+	c.busy--
+	s.mu.Unlock()
+}
+
+// dial opens a connection to s.
+func (s *server) dial() (*conn, error) {
+	nc, err := net.DialTimeout("tcp", s.addr, s.config.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	nc.SetDeadline(time.Now().Add(s.config.Timeout))
+	sc, chans, reqs, err := ssh.NewClientConn(nc, s.addr, s.config)
+	if err != nil {
+		nc.Close()
+		var netErr net.Error
+		if !errors.As(err, &netErr) {
+			return nil, &refusedError{err: fmt.Errorf("%s: %w", s.addr, hostKeyError(err))}
+		}
+		return nil, fmt.Errorf("%s: %w", s.addr, err)
+	}
+	nc.SetDeadline(time.Time{})
+	client, err := sftp.NewClient(ssh.NewClient(sc, chans, reqs), sftp.UseConcurrentWrites(true))
+	if err != nil {
+		sc.Close()
+		return nil, fmt.Errorf("%s: starting SFTP: %w", s.addr, err)
+	}
+	c := &conn{client: client}
+	go func() {
+		client.Wait()
+		c.closed.Store(true)
+		sc.Close()
+	}()
+	return c, nil
+}
+
+// hostKeyError returns the error of a handshake refused for the key of
+// the host as what to do about it, and others as they are.
+func hostKeyError(err error) error {
+	var keyErr *knownhosts.KeyError
+	switch {
+	case !errors.As(err, &keyErr):
+		return err
+	case len(keyErr.Want) == 0:
+		return fmt.Errorf("host is not in known_hosts; connect with ssh once to add it, or ignore host keys insecurely: %w", err)
+	}
+	return fmt.Errorf("host key differs from the one in known_hosts, so the connection may be intercepted: %w", err)
+}
+
+// close closes the connections of s.
+func (s *server) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.conns {
+		c.client.Close()
+	}
+	s.conns = nil
+}
+
+// do calls fn with a connection to s.
+func (s *server) do(fn func(*sftp.Client) error) error {
+	c, err := s.acquire()
+	if err != nil {
+		return err
+	}
+	defer s.release(c)
+	return fn(c.client)
+}
+
+func (s *server) Stat(name string) (fs.FileInfo, error) {
+	var info fs.FileInfo
+	err := s.do(func(c *sftp.Client) (err error) {
+		info, err = c.Stat(name)
+		return err
+	})
+	return info, err
+}
+
+// ReadDir returns the entries of the directory name, sorted by name.
+func (s *server) ReadDir(name string) ([]fs.DirEntry, error) {
+	var infos []fs.FileInfo
+	err := s.do(func(c *sftp.Client) (err error) {
+		infos, err = c.ReadDir(name)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]fs.DirEntry, len(infos))
+	for i, info := range infos {
+		entries[i] = fs.FileInfoToDirEntry(info)
+	}
+	slices.SortFunc(entries, func(a, b fs.DirEntry) int { return strings.Compare(a.Name(), b.Name()) })
+	return entries, nil
+}
+
+// A file is a file of a server open for reading or writing, keeping its
+// connection busy until it is closed.
+type file struct {
+	*sftp.File
+	r       *bufio.Reader
+	w       *bufio.Writer
+	release func()
+}
+
+func (f *file) Read(p []byte) (int, error)  { return f.r.Read(p) }
+func (f *file) Write(p []byte) (int, error) { return f.w.Write(p) }
+
+func (f *file) Close() error {
+	var err error
+	if f.w != nil {
+		err = f.w.Flush()
+	}
+	if cerr := f.File.Close(); err == nil {
+		err = cerr
+	}
+	f.release()
+	return err
+}
+
+// open opens the file name with flag, returning it with its connection.
+func (s *server) open(name string, flag int) (*file, error) {
+	c, err := s.acquire()
+	if err != nil {
+		return nil, err
+	}
+	f, err := c.client.OpenFile(name, flag)
+	if err != nil {
+		s.release(c)
+		return nil, err
+	}
+	var once sync.Once
+	return &file{File: f, release: func() { once.Do(func() { s.release(c) }) }}, nil
+}
+
+// Open opens the file name for reading, which is downloaded as it is
+// read.
+func (s *server) Open(name string) (fs.File, error) {
+	f, err := s.open(name, os.O_RDONLY)
+	if err != nil {
+		return nil, err
+	}
+	f.r = bufio.NewReaderSize(f.File, transferBuffer)
+	return f, nil
+}
+
+// Create creates or truncates the file name, which is uploaded as it is
+// written.
+func (s *server) Create(name string) (io.WriteCloser, error) {
+	f, err := s.open(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return nil, err
+	}
+	f.w = bufio.NewWriterSize(f.File, transferBuffer)
+	return f, nil
+}
+
+// MkdirAll creates the directory name and any parents it needs, with the
+// permissions the server gives them.
+func (s *server) MkdirAll(name string, perm fs.FileMode) error {
+	return s.do(func(c *sftp.Client) error { return c.MkdirAll(name) })
+}
+
+func (s *server) Remove(name string) error {
+	return s.do(func(c *sftp.Client) error { return c.Remove(name) })
+}
+
+// Rename moves the file oldname to newname, replacing any file there:
+// atomically on servers with the extension of OpenSSH for it, and by
+// removing it first on others.
+func (s *server) Rename(oldname, newname string) error {
+	return s.do(func(c *sftp.Client) error {
+		if _, ok := c.HasExtension(posixRename); ok {
+			return c.PosixRename(oldname, newname)
+		}
+		if err := c.Remove(newname); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return c.Rename(oldname, newname)
+	})
+}
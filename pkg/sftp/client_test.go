@@ -0,0 +1,399 @@
+package sftp
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+
+	"github.com/Amul-Thantharate/pixellock/pkg/pixellock"
+)
+
+// testServer is an SSH server on the loopback interface serving SFTP of
+// the files of the operating system to the holder of one key.
+type testServer struct {
+	addr     string
+	hostKey  ssh.Signer
+	attempts atomic.Int32 // Connections made
+	conns    atomic.Int32 // Connections authenticated
+}
+
+// newKey returns a new ed25519 signer.
+func newKey(t *testing.T) ssh.Signer {
+	t.Helper()
+	_, priv, _ := ed25519.GenerateKey(rand.Reader)
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+func newTestServer(t *testing.T, authorized ssh.PublicKey) *testServer {
+	t.Helper()
+	s := &testServer{hostKey: newKey(t)}
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(_ ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if !bytes.Equal(key.Marshal(), authorized.Marshal()) {
+				return nil, errors.New("key not authorized")
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(s.hostKey)
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { lis.Close() })
+	s.addr = lis.Addr().String()
+	go func() {
+		for {
+			nc, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			s.attempts.Add(1)
+			go s.serve(nc, config)
+		}
+	}()
+	return s
+}
+
+// serve serves the SFTP subsystem over the sessions of nc.
+func (s *testServer) serve(nc net.Conn, config *ssh.ServerConfig) {
+	_, chans, reqs, err := ssh.NewServerConn(nc, config)
+	if err != nil {
+		nc.Close()
+		return
+	}
+	s.conns.Add(1)
+	go ssh.DiscardRequests(reqs)
+	for nch := range chans {
+		if nch.ChannelType() != "session" {
+			nch.Reject(ssh.UnknownChannelType, "")
+			continue
+		}
+		ch, reqs, err := nch.Accept()
+		if err != nil {
+			continue
+		}
+		go func() {
+			for req := range reqs {
+				ok := req.Type == "subsystem" && len(req.Payload) > 4 && string(req.Payload[4:]) == "sftp"
+				req.Reply(ok, nil)
+				if ok {
+					server, _ := sftp.NewServer(ch)
+					go func() {
+						server.Serve()
+						ch.Close()
+					}()
+				}
+			}
+		}()
+	}
+}
+
+// knownHosts writes a known_hosts file listing key for the server,
+// returning its name.
+func (s *testServer) knownHosts(t *testing.T, key ssh.PublicKey) string {
+	t.Helper()
+	name := filepath.Join(t.TempDir(), "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize(s.addr)}, key)
+	if err := os.WriteFile(name, []byte(line+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+func newPool(t *testing.T, cfg Config) *Pool {
+	t.Helper()
+	p, err := New(cfg)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	t.Cleanup(func() { p.Close() })
+	return p
+}
+
+func TestAuth(t *testing.T) {
+	t.Setenv("SSH_AUTH_SOCK", "")
+	_, priv, _ := ed25519.GenerateKey(rand.Reader)
+	userKey, _ := ssh.NewSignerFromKey(priv)
+	s := newTestServer(t, userKey.PublicKey())
+	known := s.knownHosts(t, s.hostKey.PublicKey())
+	dir := t.TempDir()
+
+	keyFile := writeKey(t, priv)
+	fsys := &pixellock.SFTPFS{Client: newPool(t, Config{Identity: keyFile, KnownHosts: []string{known}})}
+	if _, err := fsys.Stat("sftp://user@" + s.addr + dir); err != nil {
+		t.Fatalf("Stat with the identity file failed: %v", err)
+	}
+
+	// A key the server does not take fails each file the same, trying
+	// only once
+	_, other, _ := ed25519.GenerateKey(rand.Reader)
+	attempts := s.attempts.Load()
+	fsys = &pixellock.SFTPFS{Client: newPool(t, Config{Identity: writeKey(t, other), KnownHosts: []string{known}})}
+	for range 3 {
+		_, err := fsys.Stat("sftp://user@" + s.addr + dir)
+		if err == nil || !strings.Contains(err.Error(), "unable to authenticate") || !strings.Contains(err.Error(), "sftp://user@"+s.addr) {
+			t.Errorf("Stat with a key not authorized = %v", err)
+		}
+	}
+	if n := s.attempts.Load() - attempts; n != 1 {
+		t.Errorf("the refused key connected %d times, want 1", n)
+	}
+
+	// The keys of the agent
+	keyring := agent.NewKeyring()
+	if err := keyring.Add(agent.AddedKey{PrivateKey: priv}); err != nil {
+		t.Fatal(err)
+	}
+	sock := filepath.Join(t.TempDir(), "agent.sock")
+	lis, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	go func() {
+		for {
+			c, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			go agent.ServeAgent(keyring, c)
+		}
+	}()
+	t.Setenv("SSH_AUTH_SOCK", sock)
+	fsys = &pixellock.SFTPFS{Client: newPool(t, Config{KnownHosts: []string{known}})}
+	if _, err := fsys.Stat("sftp://user@" + s.addr + dir); err != nil {
+		t.Fatalf("Stat with the agent failed: %v", err)
+	}
+
+	t.Setenv("SSH_AUTH_SOCK", "")
+	if _, err := New(Config{KnownHosts: []string{known}}); err == nil {
+		t.Error("New with no key succeeded")
+	}
+}
+
+// writeKey writes priv to a private key file, returning its name.
+func writeKey(t *testing.T, priv ed25519.PrivateKey) string {
+	t.Helper()
+	block, err := ssh.MarshalPrivateKey(priv, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := filepath.Join(t.TempDir(), "id_ed25519")
+	if err := os.WriteFile(name, pem.EncodeToMemory(block), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+func TestHostKey(t *testing.T) {
+	t.Setenv("SSH_AUTH_SOCK", "")
+	_, priv, _ := ed25519.GenerateKey(rand.Reader)
+	userKey, _ := ssh.NewSignerFromKey(priv)
+	s := newTestServer(t, userKey.PublicKey())
+	keyFile := writeKey(t, priv)
+	url := "sftp://user@" + s.addr + t.TempDir()
+	empty := filepath.Join(t.TempDir(), "known_hosts")
+	if err := os.WriteFile(empty, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name  string
+		cfg   Config
+		error string
+	}{
+		{"known", Config{KnownHosts: []string{s.knownHosts(t, s.hostKey.PublicKey())}}, ""},
+		{"changed", Config{KnownHosts: []string{s.knownHosts(t, newKey(t).PublicKey())}}, "host key differs"},
+		{"unknown", Config{KnownHosts: []string{empty}}, "not in known_hosts"},
+		{"ignored", Config{KnownHosts: []string{s.knownHosts(t, newKey(t).PublicKey())}, InsecureIgnoreHostKey: true}, ""},
+	} {
+		test.cfg.Identity = keyFile
+		fsys := &pixellock.SFTPFS{Client: newPool(t, test.cfg)}
+		_, err := fsys.Stat(url)
+		if test.error == "" && err != nil || test.error != "" && (err == nil || !strings.Contains(err.Error(), test.error)) {
+			t.Errorf("%s host key: Stat = %v, want %q", test.name, err, test.error)
+		}
+	}
+
+	if _, err := New(Config{Identity: keyFile, KnownHosts: []string{filepath.Join(t.TempDir(), "missing")}}); err == nil {
+		t.Error("New with no known_hosts file succeeded")
+	}
+}
+
+// writeImages writes PNG images to dir, one in a subdirectory, returning
+// their paths relative to it.
+func writeImages(t *testing.T, dir string, n int) []string {
+	t.Helper()
+	var names []string
+	for i := range n {
+		name := filepath.Join("photos", string(rune('a'+i))+".png")
+		if i == 0 {
+			name = filepath.Join("photos", "2024", "a.png")
+		}
+		img := image.NewRGBA(image.Rect(0, 0, 40, 30))
+		for p := range img.Pix {
+			img.Pix[p] = byte(p*7 + i)
+		}
+		img.Set(0, 0, color.RGBA{A: 255})
+		var buf bytes.Buffer
+		png.Encode(&buf, img)
+		os.MkdirAll(filepath.Join(dir, filepath.Dir(name)), 0o755)
+		if err := os.WriteFile(filepath.Join(dir, name), buf.Bytes(), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+// TestTransfer checks encrypting to a server, creating the directories
+// missing there, resuming by skipping what is there, and decrypting from
+// it, over no more connections than the Config allows.
+func TestTransfer(t *testing.T) {
+	t.Setenv("SSH_AUTH_SOCK", "")
+	_, priv, _ := ed25519.GenerateKey(rand.Reader)
+	userKey, _ := ssh.NewSignerFromKey(priv)
+	s := newTestServer(t, userKey.PublicKey())
+	pool := newPool(t, Config{Identity: writeKey(t, priv), KnownHosts: []string{s.knownHosts(t, s.hostKey.PublicKey())}, Connections: 2})
+	fsys := &pixellock.SFTPFS{Client: pool}
+	key, _ := pixellock.GenerateRandomKey()
+	local := t.TempDir()
+	names := writeImages(t, local, 12)
+	remote := filepath.Join(t.TempDir(), "archive", "encrypted")
+	url := "sftp://user@" + s.addr + remote
+
+	opts := pixellock.EncryptOptions{FS: fsys, Workers: 8}
+	if err := pixellock.EncryptDirectory(t.Context(), local, url, key, true, false, opts); err != nil {
+		t.Fatalf("EncryptDirectory to the server failed: %v", err)
+	}
+	encrypted := map[string][]byte{}
+	for _, name := range names {
+		data, err := os.ReadFile(filepath.Join(remote, name+".enc"))
+		if err != nil {
+			t.Fatalf("%s was not uploaded: %v", name, err)
+		}
+		encrypted[name] = data
+	}
+	if n := s.conns.Load(); n > 2 {
+		t.Errorf("%d connections opened, want at most 2", n)
+	}
+	if tmp, _ := filepath.Glob(filepath.Join(remote, "photos", "*.tmp")); len(tmp) > 0 {
+		t.Errorf("temporary files left: %v", tmp)
+	}
+
+	// An interrupted run is resumed, leaving what is there alone
+	os.Remove(filepath.Join(remote, names[1]+".enc"))
+	if err := pixellock.EncryptDirectory(t.Context(), local, url, key, true, false, opts); err != nil {
+		t.Fatalf("EncryptDirectory resuming failed: %v", err)
+	}
+	for _, name := range names {
+		data, err := os.ReadFile(filepath.Join(remote, name+".enc"))
+		switch {
+		case err != nil:
+			t.Errorf("%s was not uploaded again: %v", name, err)
+		case name != names[1] && !bytes.Equal(data, encrypted[name]):
+			t.Errorf("%s was encrypted again", name)
+		case name == names[1] && bytes.Equal(data, encrypted[name]):
+			t.Errorf("%s was not encrypted again", name)
+		}
+	}
+
+	restored := t.TempDir()
+	save := pixellock.SaveOptions{FS: fsys, Workers: 4}
+	if err := pixellock.DecryptDirectory(t.Context(), url, restored, key, true, pixellock.EncryptedExtension, false, save); err != nil {
+		t.Fatalf("DecryptDirectory from the server failed: %v", err)
+	}
+	for _, name := range names {
+		if _, err := os.Stat(filepath.Join(restored, name)); err != nil {
+			t.Errorf("%s was not decrypted: %v", name, err)
+		}
+	}
+
+	if _, err := fsys.Stat(url + "/missing.png"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Stat of a missing file = %v, want fs.ErrNotExist", err)
+	}
+	if n := s.conns.Load(); n > 2 {
+		t.Errorf("%d connections opened, want at most 2", n)
+	}
+}
+
+func TestAcquireDialsUnlocked(t *testing.T) {
+	t.Setenv("SSH_AUTH_SOCK", "")
+	_, priv, _ := ed25519.GenerateKey(rand.Reader)
+	pool := newPool(t, Config{Identity: writeKey(t, priv), InsecureIgnoreHostKey: true, Connections: 2})
+	// A server that takes connections, but never answers the handshake
+	// until the test is done
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		if nc, err := lis.Accept(); err == nil {
+			accepted <- nc
+		}
+	}()
+	s := &server{pool: pool, addr: lis.Addr().String(), config: &ssh.ClientConfig{User: "user", HostKeyCallback: ssh.InsecureIgnoreHostKey(), Timeout: time.Minute}}
+	s.dialed = sync.NewCond(&s.mu)
+	busy := &conn{busy: 1}
+	s.conns = []*conn{busy}
+
+	// The only connection is busy, so another is opened, which stalls
+	opened := make(chan *conn, 1)
+	go func() {
+		c, _ := s.acquire()
+		opened <- c
+	}()
+	nc := <-accepted
+	defer nc.Close()
+
+	// Meanwhile, with no room for a third, the busy one is shared at once
+	got := make(chan *conn, 1)
+	go func() {
+		c, _ := s.acquire()
+		got <- c
+	}()
+	select {
+	case c := <-got:
+		if c != busy {
+			t.Error("acquire did not share the open connection")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("acquire waited for another connection to be opened")
+	}
+
+	// The server hanging up, the connection is not opened, and its slot
+	// is given up
+	nc.Close()
+	<-opened
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.dialing != 0 || len(s.conns) != 1 {
+		t.Errorf("after the connection failed to open, %d are being opened and %d open, want 0 and 1", s.dialing, len(s.conns))
+	}
+}
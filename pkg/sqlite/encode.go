@@ -0,0 +1,184 @@
+package sqlite
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Encode returns the contents of a file holding db: its tables, each a
+// b-tree of its rows, and their schema, without free pages.
+func Encode(db *Database) ([]byte, error) {
+	w := &writer{pages: [][]byte{nil}} // Page 1, the schema, comes last
+	var schema [][]byte
+	for i, t := range db.Tables {
+		if t.Name == "" || strings.HasPrefix(strings.ToLower(t.Name), "sqlite_") && !strings.EqualFold(t.Name, "sqlite_sequence") {
+			return nil, fmt.Errorf("bad table name %q", t.Name)
+		}
+		for _, u := range db.Tables[:i] {
+			if strings.EqualFold(u.Name, t.Name) {
+				return nil, fmt.Errorf("table %s twice", t.Name)
+			}
+		}
+		root, err := w.table(t.Rows)
+		if err != nil {
+			return nil, fmt.Errorf("table %s: %w", t.Name, err)
+		}
+		record, err := appendRecord(nil, []any{"table", t.Name, t.Name, int64(root), t.SQL})
+		if err != nil {
+			return nil, err
+		}
+		schema = append(schema, w.cell(int64(i+1), record))
+	}
+
+	// The schema has to fit in page 1, as it does unless it has very many
+	// tables
+	used := headerSize + 8
+	for _, c := range schema {
+		used += len(c) + 2
+	}
+	if used > pageSize {
+		return nil, errors.New("too many tables to fit the schema in one page")
+	}
+	page1 := btreePage(headerSize, leafTable, schema, 0)
+	h := page1[:headerSize]
+	copy(h, magic)
+	binary.BigEndian.PutUint16(h[16:], pageSize)
+	h[18], h[19] = 1, 1 // Rollback journal, not WAL
+	h[20] = 0           // No space reserved at the end of pages
+	h[21], h[22], h[23] = 64, 32, 32
+	binary.BigEndian.PutUint32(h[24:], 1) // File change counter
+	binary.BigEndian.PutUint32(h[28:], uint32(len(w.pages)))
+	binary.BigEndian.PutUint32(h[40:], 1) // Schema cookie
+	binary.BigEndian.PutUint32(h[44:], schemaFormat)
+	binary.BigEndian.PutUint32(h[56:], encodingUTF8)
+	binary.BigEndian.PutUint32(h[60:], db.UserVersion)
+	binary.BigEndian.PutUint32(h[68:], db.ApplicationID)
+	binary.BigEndian.PutUint32(h[92:], 1) // The change counter the size is valid for
+	binary.BigEndian.PutUint32(h[96:], sqliteVersion)
+	w.pages[0] = page1
+
+	out := make([]byte, 0, len(w.pages)*pageSize)
+	for _, p := range w.pages {
+		out = append(out, p...)
+	}
+	return out, nil
+}
+
+// writer lays out the pages of a file.
+type writer struct {
+	pages [][]byte
+}
+
+// add adds page p, returning its number.
+func (w *writer) add(p []byte) uint32 {
+	w.pages = append(w.pages, p)
+	return uint32(len(w.pages))
+}
+
+// cell returns the table leaf cell of the row id with the record payload,
+// putting what does not fit in its page on overflow pages.
+func (w *writer) cell(id int64, payload []byte) []byte {
+	c := appendVarint(nil, uint64(len(payload)))
+	c = appendVarint(c, uint64(id))
+	local := localSize(pageSize, len(payload))
+	c = append(c, payload[:local]...)
+	if local == len(payload) {
+		return c
+	}
+	rest := payload[local:]
+	first := uint32(len(w.pages) + 1)
+	c = binary.BigEndian.AppendUint32(c, first)
+	for len(rest) > 0 {
+		p := make([]byte, pageSize)
+		n := copy(p[4:], rest)
+		if rest = rest[n:]; len(rest) > 0 {
+			binary.BigEndian.PutUint32(p, uint32(len(w.pages)+2))
+		}
+		w.add(p)
+	}
+	return c
+}
+
+// table writes the b-tree of rows, returning the number of its root page.
+func (w *writer) table(rows []Row) (uint32, error) {
+	// A child of an interior page, and the largest rowid beneath it
+	type child struct {
+		page  uint32
+		maxID int64
+	}
+	var level []child
+	var cells [][]byte
+	used := 8
+	for i, row := range rows {
+		if i > 0 && row.ID <= rows[i-1].ID {
+			return 0, fmt.Errorf("row %d is out of order, after row %d", row.ID, rows[i-1].ID)
+		}
+		record, err := appendRecord(nil, row.Values)
+		if err != nil {
+			return 0, fmt.Errorf("row %d: %w", row.ID, err)
+		}
+		c := w.cell(row.ID, record)
+		if used+len(c)+2 > pageSize {
+			level = append(level, child{w.add(btreePage(0, leafTable, cells, 0)), rows[i-1].ID})
+			cells, used = nil, 8
+		}
+		cells = append(cells, c)
+		used += len(c) + 2
+	}
+	if len(cells) > 0 || len(level) == 0 {
+		var last int64
+		if len(rows) > 0 {
+			last = rows[len(rows)-1].ID
+		}
+		level = append(level, child{w.add(btreePage(0, leafTable, cells, 0)), last})
+	}
+
+	// Each interior page has a cell of each child but the last, the
+	// right-most, whose number is in its header
+	for len(level) > 1 {
+		var up []child
+		for len(level) > 0 {
+			n, used := 1, 12
+			for n < len(level) {
+				cost := 4 + len(appendVarint(nil, uint64(level[n-1].maxID))) + 2
+				if used+cost > pageSize {
+					break
+				}
+				used += cost
+				n++
+			}
+			var cells [][]byte
+			for _, c := range level[:n-1] {
+				cells = append(cells, appendVarint(binary.BigEndian.AppendUint32(nil, c.page), uint64(c.maxID)))
+			}
+			right := level[n-1]
+			up = append(up, child{w.add(btreePage(0, interiorTable, cells, right.page)), right.maxID})
+			level = level[n:]
+		}
+		level = up
+	}
+	return level[0].page, nil
+}
+
+// btreePage returns a b-tree page of type typ with cells, and right as its
+// right-most child when it is an interior page, its header at offset h.
+func btreePage(h int, typ byte, cells [][]byte, right uint32) []byte {
+	p := make([]byte, pageSize)
+	p[h] = typ
+	binary.BigEndian.PutUint16(p[h+3:], uint16(len(cells)))
+	ptrs := h + 8
+	if typ == interiorTable {
+		binary.BigEndian.PutUint32(p[h+8:], right)
+		ptrs = h + 12
+	}
+	content := pageSize
+	for i, c := range cells {
+		content -= len(c)
+		copy(p[content:], c)
+		binary.BigEndian.PutUint16(p[ptrs+2*i:], uint16(content))
+	}
+	binary.BigEndian.PutUint16(p[h+5:], uint16(content))
+	return p
+}
@@ -0,0 +1,483 @@
+// Package sqlite reads and writes SQLite database files, in the file
+// format of SQLite 3, without SQLite itself. It has no SQL: a Database is
+// read whole, as the rows of its tables, and written whole. That suits a
+// small database one program keeps, such as a catalog, that the sqlite3
+// shell and other programs can then query.
+//
+// Only tables are kept, so a file whose schema has anything else, an
+// index, view, trigger or virtual table, is refused with
+// ErrUnsupportedSchema rather than read and written back without it, and
+// a table that needs an index, as a UNIQUE constraint or a PRIMARY KEY
+// other than an INTEGER PRIMARY KEY does, cannot be written. A file in WAL
+// mode, or in a text encoding other than UTF-8, is refused too. Other
+// programs should take the files written as read-only: one that creates
+// an index in one, or turns on WAL, leaves it unreadable here.
+package sqlite
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+)
+
+// A Database is the tables of a database file.
+type Database struct {
+	Tables []*Table
+
+	// UserVersion and ApplicationID are the integers PRAGMA user_version
+	// and PRAGMA application_id set, for a program to tell its files and
+	// their versions apart.
+	UserVersion   uint32
+	ApplicationID uint32
+}
+
+// Table returns the table named name, which like SQLite's names is not
+// case sensitive, or nil when db has none.
+func (db *Database) Table(name string) *Table {
+	for _, t := range db.Tables {
+		if strings.EqualFold(t.Name, name) {
+			return t
+		}
+	}
+	return nil
+}
+
+// A Table is a table of a database, and its rows.
+type Table struct {
+	Name string
+
+	// SQL is the CREATE TABLE statement of the table.
+	SQL string
+
+	// Rows are in the order of their IDs, which are unique.
+	Rows []Row
+}
+
+// A Row is a row of a table: its rowid, and the values of its columns in
+// the order the table declares them. A value is nil, an int64, a float64,
+// a string or a []byte; Encode also takes an int or a bool. A row written
+// before a column was added has fewer values than the table has columns,
+// and a column declared INTEGER PRIMARY KEY is nil, its value being the
+// rowid.
+type Row struct {
+	ID     int64
+	Values []any
+}
+
+// ErrNotDatabase is returned for data that is not an SQLite database.
+var ErrNotDatabase = errors.New("not an SQLite database")
+
+// ErrUnsupportedSchema is returned for a database whose schema has more
+// than the tables a Database holds, which writing it would lose.
+var ErrUnsupportedSchema = errors.New("database schema has more than tables")
+
+// The format of a file, as SQLite's file format documentation describes it.
+const (
+	magic          = "SQLite format 3\x00"
+	headerSize     = 100 // Of the file, at the start of page 1
+	pageSize       = 4096
+	leafTable      = 0x0d
+	interiorTable  = 0x05
+	schemaFormat   = 4
+	encodingUTF8   = 1
+	sqliteVersion  = 3046000 // The SQLite release whose format is written
+	maxDepth       = 20      // Of a b-tree, beyond which it is taken to loop
+	maxPayloadSize = 1 << 30 // SQLite's own limit on a string or blob
+)
+
+// ReadFile reads the database file named name. A file that does not
+// exist, as an empty file, is an empty database.
+func ReadFile(name string) (*Database, error) {
+	data, err := os.ReadFile(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return &Database{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	db, err := Decode(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return db, nil
+}
+
+// WriteFile writes db to the file named name, replacing it only once the
+// whole of db is written, so that a failure leaves the old file whole.
+func WriteFile(name string, db *Database) error {
+	data, err := Encode(db)
+	if err != nil {
+		return err
+	}
+	tmp := name + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, name); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// Decode returns the database held by data, the contents of a file.
+func Decode(data []byte) (*Database, error) {
+	if len(data) == 0 {
+		return &Database{}, nil
+	}
+	if len(data) < headerSize || string(data[:len(magic)]) != magic {
+		return nil, ErrNotDatabase
+	}
+	size := int(binary.BigEndian.Uint16(data[16:]))
+	if size == 1 {
+		size = 65536
+	}
+	if size < 512 || size&(size-1) != 0 {
+		return nil, fmt.Errorf("%w: bad page size %d", ErrNotDatabase, size)
+	}
+	if data[18] == 2 || data[19] == 2 {
+		return nil, errors.New("database is in WAL mode, which is not supported; run PRAGMA journal_mode=DELETE on it")
+	}
+	if data[19] > 2 {
+		return nil, fmt.Errorf("database file format %d is not supported", data[19])
+	}
+	if enc := binary.BigEndian.Uint32(data[56:]); enc != 0 && enc != encodingUTF8 {
+		return nil, errors.New("database is not UTF-8 encoded, which is all that is supported")
+	}
+	r := &reader{data: data, pageSize: size, usable: size - int(data[20]), pages: len(data) / size}
+	if r.usable < 480 {
+		return nil, fmt.Errorf("%w: bad reserved space", ErrNotDatabase)
+	}
+	db := &Database{
+		UserVersion:   binary.BigEndian.Uint32(data[60:]),
+		ApplicationID: binary.BigEndian.Uint32(data[68:]),
+	}
+
+	// sqlite_schema, in page 1, has a row of type, name, tbl_name,
+	// rootpage and sql for each table, index, view and trigger
+	var schema [][]any
+	err := r.rows(1, 0, func(_ int64, values []any) error {
+		schema = append(schema, values)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("schema: %w", err)
+	}
+	for _, values := range schema {
+		if len(values) < 5 {
+			return nil, fmt.Errorf("%w: short schema row", ErrNotDatabase)
+		}
+		typ, _ := values[0].(string)
+		name, _ := values[1].(string)
+		root, _ := values[3].(int64)
+		sql, _ := values[4].(string)
+		switch {
+		case typ != "table":
+			return nil, fmt.Errorf("%w: it has the %s %s", ErrUnsupportedSchema, typ, name)
+		case root == 0:
+			return nil, fmt.Errorf("%w: %s is a virtual table", ErrUnsupportedSchema, name)
+		}
+		t := &Table{Name: name, SQL: sql}
+		err := r.rows(root, 0, func(id int64, values []any) error {
+			t.Rows = append(t.Rows, Row{ID: id, Values: values})
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("table %s: %w", name, err)
+		}
+		db.Tables = append(db.Tables, t)
+	}
+	return db, nil
+}
+
+// reader reads the b-trees of a database.
+type reader struct {
+	data     []byte
+	pageSize int
+	usable   int // Of each page, less the space reserved at its end
+	pages    int
+}
+
+func (r *reader) corrupt(format string, args ...any) error {
+	return fmt.Errorf("%w: corrupt: %s", ErrNotDatabase, fmt.Sprintf(format, args...))
+}
+
+// page returns page number n, counting from 1.
+func (r *reader) page(n int64) ([]byte, error) {
+	if n < 1 || n > int64(r.pages) {
+		return nil, r.corrupt("page %d out of range", n)
+	}
+	start := int(n-1) * r.pageSize
+	return r.data[start : start+r.usable], nil
+}
+
+// rows calls fn with the rowid and values of each row of the table b-tree
+// whose root is page root, at depth in the tree, in rowid order.
+func (r *reader) rows(root int64, depth int, fn func(id int64, values []any) error) error {
+	if depth > maxDepth {
+		return r.corrupt("b-tree too deep")
+	}
+	p, err := r.page(root)
+	if err != nil {
+		return err
+	}
+	h := 0
+	if root == 1 {
+		h = headerSize
+	}
+	typ := p[h]
+	cells := int(binary.BigEndian.Uint16(p[h+3:]))
+	ptrs := h + 8
+	if typ == interiorTable {
+		ptrs = h + 12
+	}
+	if ptrs+2*cells > len(p) {
+		return r.corrupt("page %d has too many cells", root)
+	}
+
+	for i := range cells {
+		off := int(binary.BigEndian.Uint16(p[ptrs+2*i:]))
+		if off >= len(p) {
+			return r.corrupt("cell out of page %d", root)
+		}
+		switch typ {
+		case leafTable:
+			size, n := varint(p[off:])
+			id, m := varint(p[off+n:])
+			if n == 0 || m == 0 {
+				return r.corrupt("cell of page %d truncated", root)
+			}
+			payload, err := r.payload(p, off+n+m, size)
+			if err != nil {
+				return err
+			}
+			values, err := decodeRecord(payload)
+			if err != nil {
+				return r.corrupt("row %d: %v", int64(id), err)
+			}
+			if err := fn(int64(id), values); err != nil {
+				return err
+			}
+		case interiorTable:
+			if off+4 > len(p) {
+				return r.corrupt("cell of page %d truncated", root)
+			}
+			if err := r.rows(int64(binary.BigEndian.Uint32(p[off:])), depth+1, fn); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("page %d is not of a table with rowids (type %#x); WITHOUT ROWID tables are not supported", root, typ)
+		}
+	}
+	if typ == interiorTable {
+		return r.rows(int64(binary.BigEndian.Uint32(p[h+8:])), depth+1, fn)
+	}
+	return nil
+}
+
+// payload returns the payload of size bytes of a cell of page p starting
+// at start, following it onto overflow pages when it does not fit.
+func (r *reader) payload(p []byte, start int, size uint64) ([]byte, error) {
+	if size > maxPayloadSize || size > uint64(len(r.data)) {
+		return nil, r.corrupt("payload of %d bytes", size)
+	}
+	local := localSize(r.usable, int(size))
+	if start+local > len(p) || local < int(size) && start+local+4 > len(p) {
+		return nil, r.corrupt("payload overruns its page")
+	}
+	if local == int(size) {
+		return p[start : start+local], nil
+	}
+	out := make([]byte, 0, size)
+	out = append(out, p[start:start+local]...)
+	next := int64(binary.BigEndian.Uint32(p[start+local:]))
+	for visited := 0; len(out) < int(size); visited++ {
+		if next == 0 || visited > r.pages {
+			return nil, r.corrupt("overflow chain broken")
+		}
+		op, err := r.page(next)
+		if err != nil {
+			return nil, err
+		}
+		next = int64(binary.BigEndian.Uint32(op))
+		n := min(r.usable-4, int(size)-len(out))
+		out = append(out, op[4:4+n]...)
+	}
+	return out, nil
+}
+
+// localSize returns how much of a payload of size bytes a table leaf cell
+// holds in its page, of usable bytes, the rest going to overflow pages.
+func localSize(usable, size int) int {
+	maxLocal := usable - 35
+	if size <= maxLocal {
+		return size
+	}
+	minLocal := (usable-12)*32/255 - 23
+	local := minLocal + (size-minLocal)%(usable-4)
+	if local > maxLocal {
+		local = minLocal
+	}
+	return local
+}
+
+// varint decodes the variable-length integer at the start of b, returning
+// it and its length, or a length of 0 when b is too short to hold it.
+func varint(b []byte) (uint64, int) {
+	var v uint64
+	for i := 0; i < 8; i++ {
+		if i >= len(b) {
+			return 0, 0
+		}
+		v = v<<7 | uint64(b[i]&0x7f)
+		if b[i]&0x80 == 0 {
+			return v, i + 1
+		}
+	}
+	if len(b) < 9 {
+		return 0, 0
+	}
+	return v<<8 | uint64(b[8]), 9
+}
+
+// appendVarint appends the variable-length encoding of v to b.
+func appendVarint(b []byte, v uint64) []byte {
+	if v > 1<<56-1 {
+		var buf [9]byte
+		buf[8] = byte(v)
+		v >>= 8
+		for i := 7; i >= 0; i-- {
+			buf[i] = byte(v&0x7f) | 0x80
+			v >>= 7
+		}
+		return append(b, buf[:]...)
+	}
+	var buf [8]byte
+	n := len(buf)
+	for last := true; last || v > 0; last = false {
+		n--
+		buf[n] = byte(v & 0x7f)
+		if !last {
+			buf[n] |= 0x80
+		}
+		v >>= 7
+	}
+	return append(b, buf[n:]...)
+}
+
+// intSizes are the sizes of the integers of serial types 1 to 6.
+var intSizes = [...]int{1: 1, 2: 2, 3: 3, 4: 4, 5: 6, 6: 8}
+
+// decodeRecord returns the values of a record: a header of its size and
+// the serial type of each value, then the values.
+func decodeRecord(b []byte) ([]any, error) {
+	size, n := varint(b)
+	if n == 0 || size < uint64(n) || size > uint64(len(b)) {
+		return nil, errors.New("bad record header")
+	}
+	header, body := b[n:size], b[size:]
+	var values []any
+	for len(header) > 0 {
+		typ, n := varint(header)
+		if n == 0 {
+			return nil, errors.New("bad record header")
+		}
+		header = header[n:]
+		var length int
+		switch {
+		case typ >= 1 && typ <= 6:
+			length = intSizes[typ]
+		case typ == 7:
+			length = 8
+		case typ == 10 || typ == 11:
+			return nil, fmt.Errorf("reserved serial type %d", typ)
+		case typ >= 12:
+			length = int((typ - 12) / 2)
+		}
+		if length > len(body) {
+			return nil, errors.New("record truncated")
+		}
+		v := body[:length]
+		body = body[length:]
+		switch {
+		case typ == 0:
+			values = append(values, nil)
+		case typ <= 6:
+			i := int64(int8(v[0]))
+			for _, c := range v[1:] {
+				i = i<<8 | int64(c)
+			}
+			values = append(values, i)
+		case typ == 7:
+			values = append(values, math.Float64frombits(binary.BigEndian.Uint64(v)))
+		case typ == 8, typ == 9:
+			values = append(values, int64(typ-8))
+		case typ%2 == 0:
+			values = append(values, bytes.Clone(v))
+		default:
+			values = append(values, string(v))
+		}
+	}
+	return values, nil
+}
+
+// appendRecord appends the record of values to b.
+func appendRecord(b []byte, values []any) ([]byte, error) {
+	var types, body []byte
+	for _, v := range values {
+		var typ uint64
+		switch v := v.(type) {
+		case nil:
+			typ = 0
+		case bool:
+			typ = 8
+			if v {
+				typ = 9
+			}
+		case int:
+			typ, body = appendInt(body, int64(v))
+		case int64:
+			typ, body = appendInt(body, v)
+		case float64:
+			typ, body = 7, binary.BigEndian.AppendUint64(body, math.Float64bits(v))
+		case string:
+			typ, body = uint64(13+2*len(v)), append(body, v...)
+		case []byte:
+			typ, body = uint64(12+2*len(v)), append(body, v...)
+		default:
+			return nil, fmt.Errorf("cannot store a %T", v)
+		}
+		types = appendVarint(types, typ)
+	}
+	// The size of the header counts itself
+	size := len(types) + 1
+	if len(appendVarint(nil, uint64(size))) > 1 {
+		size++
+	}
+	b = appendVarint(b, uint64(size))
+	b = append(b, types...)
+	return append(b, body...), nil
+}
+
+// appendInt appends i to b in the fewest bytes, returning its serial type.
+func appendInt(b []byte, i int64) (uint64, []byte) {
+	switch {
+	case i == 0 || i == 1:
+		return uint64(8 + i), b
+	case i >= math.MinInt8 && i <= math.MaxInt8:
+		return 1, append(b, byte(i))
+	case i >= math.MinInt16 && i <= math.MaxInt16:
+		return 2, binary.BigEndian.AppendUint16(b, uint16(i))
+	case i >= -1<<23 && i < 1<<23:
+		return 3, append(b, byte(i>>16), byte(i>>8), byte(i))
+	case i >= math.MinInt32 && i <= math.MaxInt32:
+		return 4, binary.BigEndian.AppendUint32(b, uint32(i))
+	case i >= -1<<47 && i < 1<<47:
+		return 5, append(b, byte(i>>40), byte(i>>32), byte(i>>24), byte(i>>16), byte(i>>8), byte(i))
+	}
+	return 6, binary.BigEndian.AppendUint64(b, uint64(i))
+}
@@ -0,0 +1,217 @@
+package sqlite
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testDatabase returns a database of several thousand rows, enough for
+// its b-tree to have interior pages, with values of every type, and rows
+// big enough to overflow their pages.
+func testDatabase() *Database {
+	files := &Table{Name: "files", SQL: "CREATE TABLE files (name TEXT, size INTEGER, ratio REAL, data BLOB)"}
+	for i := range 5000 {
+		data := []byte{}
+		switch i % 1000 {
+		case 7:
+			data = bytes.Repeat([]byte{byte(i)}, 10000)
+		case 8:
+			data = bytes.Repeat([]byte("overflow"), 20000)
+		}
+		files.Rows = append(files.Rows, Row{ID: int64(i*3 - 100), Values: []any{
+			fmt.Sprintf("photo-%d.jpg", i), int64(i) * int64(i) * int64(i) * 1e6 * int64(1-2*(i%2)), float64(i) / 7, data,
+		}})
+	}
+	edge := &Table{Name: "Edge", SQL: "CREATE TABLE Edge (v)"}
+	for i, v := range []any{nil, int64(0), int64(1), int64(-1), int64(127), int64(-129), int64(1 << 23), int64(math.MinInt32), int64(1 << 40), int64(math.MaxInt64), int64(math.MinInt64), 0.5, math.Inf(-1), "", "héllo", []byte{}} {
+		edge.Rows = append(edge.Rows, Row{ID: int64(i) + math.MaxInt64 - 100, Values: []any{v}})
+	}
+	return &Database{
+		Tables:        []*Table{files, edge, {Name: "empty", SQL: "CREATE TABLE empty (x)"}},
+		UserVersion:   7,
+		ApplicationID: 0x504c4b00,
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	db := testDatabase()
+	name := filepath.Join(t.TempDir(), "test.db")
+	if err := WriteFile(name, db); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	got, err := ReadFile(name)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	if !reflect.DeepEqual(got, db) {
+		for i := range db.Tables {
+			if i < len(got.Tables) && !reflect.DeepEqual(got.Tables[i], db.Tables[i]) {
+				t.Errorf("table %s read back differs", db.Tables[i].Name)
+			}
+		}
+		t.Fatalf("database read back differs")
+	}
+	if got.Table("FILES") != got.Tables[0] || got.Table("missing") != nil {
+		t.Error("Table does not find tables by name regardless of case")
+	}
+
+	empty, err := ReadFile(filepath.Join(t.TempDir(), "missing.db"))
+	if err != nil || len(empty.Tables) != 0 {
+		t.Errorf("a missing file read as %+v, %v; want an empty database", empty, err)
+	}
+}
+
+func TestEncodeErrors(t *testing.T) {
+	for _, db := range []*Database{
+		{Tables: []*Table{{Name: "t", Rows: []Row{{ID: 2}, {ID: 1}}}}},
+		{Tables: []*Table{{Name: "t", Rows: []Row{{ID: 1, Values: []any{struct{}{}}}}}}},
+		{Tables: []*Table{{Name: "t"}, {Name: "T"}}},
+		{Tables: []*Table{{Name: "sqlite_schema"}}},
+	} {
+		if _, err := Encode(db); err == nil {
+			t.Errorf("Encode of %+v succeeded", db.Tables)
+		}
+	}
+}
+
+func TestVarint(t *testing.T) {
+	for _, v := range []uint64{0, 1, 127, 128, 240, 2287, 16383, 16384, 1<<56 - 1, 1 << 56, math.MaxUint64} {
+		b := appendVarint(nil, v)
+		if got, n := varint(b); got != v || n != len(b) {
+			t.Errorf("varint %d encoded as %x decodes to %d of %d bytes", v, b, got, n)
+		}
+		if _, n := varint(b[:len(b)-1]); n != 0 {
+			t.Errorf("truncated varint %d decoded", v)
+		}
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	data, err := Encode(testDatabase())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Decode([]byte("not a database at all, but long enough to have a header: ............................................")); !errors.Is(err, ErrNotDatabase) {
+		t.Errorf("Decode of text returned %v, want ErrNotDatabase", err)
+	}
+	wal := bytes.Clone(data)
+	wal[18], wal[19] = 2, 2
+	if _, err := Decode(wal); err == nil || !strings.Contains(err.Error(), "WAL") {
+		t.Errorf("Decode of a WAL database returned %v", err)
+	}
+	if _, err := Decode(data[:len(data)/2]); err == nil {
+		t.Error("Decode of half a database succeeded")
+	}
+	// A table made an index, which a Database cannot hold
+	index := bytes.Clone(data)
+	i := headerSize + bytes.Index(index[headerSize:], []byte("table"))
+	copy(index[i:], "index")
+	if _, err := Decode(index); !errors.Is(err, ErrUnsupportedSchema) {
+		t.Errorf("Decode of a database with an index returned %v, want ErrUnsupportedSchema", err)
+	}
+
+	// Corrupt data fails, and does not panic
+	rng := rand.New(rand.NewPCG(1, 2))
+	for range 400 {
+		corrupt := bytes.Clone(data)
+		for range 1 + rng.IntN(8) {
+			i := rng.IntN(len(corrupt))
+			if rng.IntN(4) == 0 {
+				i = headerSize + rng.IntN(64) // A page 1 header or cell pointer
+			}
+			corrupt[i] = byte(rng.Uint32())
+		}
+		Decode(corrupt)
+	}
+}
+
+// sqlite3 runs the sqlite3 shell on the database file name with sql,
+// skipping t when it is not installed, and returns its output.
+func sqlite3(t *testing.T, name, sql string) string {
+	t.Helper()
+	if _, err := exec.LookPath("sqlite3"); err != nil {
+		t.Skip("sqlite3 is not installed")
+	}
+	out, err := exec.Command("sqlite3", name, sql).CombinedOutput()
+	if err != nil {
+		t.Fatalf("sqlite3 %q failed: %v: %s", sql, err, out)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+func TestSQLite3(t *testing.T) {
+	dir := t.TempDir()
+	written := filepath.Join(dir, "written.db")
+	if err := WriteFile(written, testDatabase()); err != nil {
+		t.Fatal(err)
+	}
+	if out := sqlite3(t, written, "PRAGMA integrity_check"); out != "ok" {
+		t.Errorf("integrity_check of a written database: %s", out)
+	}
+	want := "5000|850000|10|1347177216"
+	if out := sqlite3(t, written, "SELECT count(*), sum(length(data)), (SELECT count(*) FROM edge WHERE typeof(v) = 'integer'), (SELECT application_id FROM pragma_application_id) FROM files"); out != want {
+		t.Errorf("sqlite3 read a written database as %s, want %s", out, want)
+	}
+
+	// A database SQLite wrote, with rows deleted, reads back
+	created := filepath.Join(dir, "created.db")
+	sqlite3(t, created, `
+		CREATE TABLE t (id INTEGER PRIMARY KEY, name TEXT, data BLOB);
+		WITH RECURSIVE n(i) AS (SELECT 1 UNION ALL SELECT i+1 FROM n WHERE i < 3000)
+		INSERT INTO t SELECT i, 'row ' || i, randomblob(CASE WHEN i % 500 = 1 THEN 9000 ELSE 20 END) FROM n;
+		DELETE FROM t WHERE id % 10 = 0;
+		PRAGMA user_version = 3;`)
+	db, err := ReadFile(created)
+	if err != nil {
+		t.Fatalf("ReadFile of a database SQLite wrote failed: %v", err)
+	}
+	if len(db.Tables) != 1 || db.UserVersion != 3 {
+		t.Fatalf("read %d tables of user version %d, want 1 of 3", len(db.Tables), db.UserVersion)
+	}
+	rows := db.Tables[0].Rows
+	if len(rows) != 2700 {
+		t.Fatalf("read %d rows, want 2700", len(rows))
+	}
+	for _, row := range rows {
+		if row.Values[0] != nil || row.Values[1] != fmt.Sprint("row ", row.ID) {
+			t.Fatalf("row %d read as %v", row.ID, row.Values[:2])
+		}
+		if size := len(row.Values[2].([]byte)); size != 20 && (size != 9000 || row.ID%500 != 1) {
+			t.Fatalf("row %d has %d bytes of data", row.ID, size)
+		}
+	}
+
+	// And written back, keeps its rows
+	if err := WriteFile(created, db); err != nil {
+		t.Fatal(err)
+	}
+	if out := sqlite3(t, created, "PRAGMA integrity_check; SELECT count(*), sum(length(data)) FROM t"); out != "ok\n2700|107880" {
+		t.Errorf("sqlite3 read the database written back as %q", out)
+	}
+
+	// But once given an index, a view, a trigger or a virtual table, it is
+	// refused rather than written back without it
+	for _, sql := range []string{
+		"CREATE INDEX t_name ON t (name)",
+		"CREATE VIEW v AS SELECT name FROM t",
+		"CREATE TRIGGER t_insert AFTER INSERT ON t BEGIN SELECT 1; END",
+		"CREATE VIRTUAL TABLE r USING rtree(id, x0, x1)",
+	} {
+		changed := filepath.Join(dir, "changed.db")
+		if err := WriteFile(changed, db); err != nil {
+			t.Fatal(err)
+		}
+		sqlite3(t, changed, sql)
+		if _, err := ReadFile(changed); !errors.Is(err, ErrUnsupportedSchema) {
+			t.Errorf("ReadFile after %s returned %v, want ErrUnsupportedSchema", sql, err)
+		}
+	}
+}
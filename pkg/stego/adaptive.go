@@ -0,0 +1,79 @@
+package stego
+
+import (
+	"cmp"
+	"image"
+	"slices"
+)
+
+// Adaptive embedding ranks pixels by how much they differ from their
+// neighbors and fills the busiest first. The ranking only looks at the
+// bits above the embedding density, which hiding never changes, so reveal
+// computes the same order from the stego image as hide did from the cover.
+
+// textureMap returns, for each pixel of img in raster order, the sum of the
+// absolute differences between its red, green and blue values and those of
+// its four neighbors, ignoring the low density bits. Pixels that are
+// transparent or could become so count as black.
+func textureMap(img *image.NRGBA, density int) []int {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	texture := make([]int, w*h)
+	value := func(x, y, c int) int {
+		off := img.PixOffset(b.Min.X+x, b.Min.Y+y)
+		if img.Pix[off+3]>>density == 0 {
+			return 0 // Optimizers may clear the color of invisible pixels
+		}
+		return int(img.Pix[off+c] >> density)
+	}
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var sum int
+			for c := 0; c < 3; c++ {
+				if x+1 < w {
+					d := abs(value(x, y, c) - value(x+1, y, c))
+					sum += d
+					texture[y*w+x+1] += d
+				}
+				if y+1 < h {
+					d := abs(value(x, y, c) - value(x, y+1, c))
+					sum += d
+					texture[(y+1)*w+x] += d
+				}
+			}
+			texture[y*w+x] += sum
+		}
+	}
+	return texture
+}
+
+// adaptivePixels returns the pixels of base, or of the whole image when base
+// is nil, that an adaptive body is embedded into, most textured first. The
+// first skip pixels, which carry the header, and pixels in perfectly flat
+// areas are left out. Pixels of equal texture keep their raster order.
+func adaptivePixels(img *image.NRGBA, base []int32, skip, density int) []int32 {
+	texture := textureMap(img, density)
+	if base == nil {
+		base = make([]int32, len(texture))
+		for i := range base {
+			base[i] = int32(i)
+		}
+	}
+	pixels := make([]int32, 0, len(base))
+	for _, p := range base[min(skip, len(base)):] {
+		if texture[p] > 0 {
+			pixels = append(pixels, p)
+		}
+	}
+	slices.SortStableFunc(pixels, func(a, b int32) int {
+		return cmp.Compare(texture[b], texture[a])
+	})
+	return pixels
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
@@ -0,0 +1,85 @@
+package stego
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"image"
+	"testing"
+)
+
+func TestAdaptiveRoundTrip(t *testing.T) {
+	for _, opts := range []options{
+		{Density: 1, Adaptive: true},
+		{Density: 2, Channels: ChannelsRGBA, Adaptive: true, Password: "textured"},
+	} {
+		cover := newTexturedNRGBA(320, 240)
+		data := make([]byte, imageCapacity(cover, opts)/2)
+		rand.Read(data)
+		if err := hideInImage(cover, Payload{Data: data}, opts); err != nil {
+			t.Fatalf("density %d: hideInImage failed: %v", opts.Density, err)
+		}
+		got, err := revealFromImage(cover, options{Password: opts.Password})
+		if err != nil {
+			t.Fatalf("density %d: revealFromImage failed: %v", opts.Density, err)
+		}
+		if !bytes.Equal(got.Data, data) {
+			t.Errorf("density %d: adaptive payload did not round trip", opts.Density)
+		}
+	}
+}
+
+func TestAdaptiveSkipsFlatAreas(t *testing.T) {
+	// The left half is flat, the right half a busy pattern.
+	img := image.NewNRGBA(image.Rect(0, 0, 64, 64))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			v := byte(128)
+			if x >= 32 {
+				v = byte(x*37 ^ y*91)
+			}
+			i := img.PixOffset(x, y)
+			copy(img.Pix[i:], []byte{v, v / 2, 255 - v, 255})
+		}
+	}
+	cover := image.NewNRGBA(img.Bounds())
+	copy(cover.Pix, img.Pix)
+
+	opts := options{Density: 1, Adaptive: true}
+	capacity := imageCapacity(img, opts)
+	if sequential := imageCapacity(img, options{Density: 1}); capacity >= sequential*3/4 {
+		t.Errorf("adaptive capacity %d, want well under the sequential %d", capacity, sequential)
+	}
+	if err := hideInImage(img, Payload{Data: make([]byte, capacity)}, opts); err != nil {
+		t.Fatalf("hideInImage at capacity failed: %v", err)
+	}
+	for y := 1; y < 64; y++ { // Row 0 carries the header
+		for x := 0; x < 31; x++ {
+			i := img.PixOffset(x, y)
+			if !bytes.Equal(img.Pix[i:i+4], cover.Pix[i:i+4]) {
+				t.Fatalf("flat pixel (%d, %d) was changed", x, y)
+			}
+		}
+	}
+	if err := hideInImage(img, Payload{Data: make([]byte, capacity+1)}, opts); !errors.Is(err, ErrPayloadTooLarge) {
+		t.Errorf("hideInImage over capacity error = %v, want ErrPayloadTooLarge", err)
+	}
+}
+
+func TestAdaptiveTransparent(t *testing.T) {
+	img := newTransparentNRGBA(48, 48)
+	opts := options{Density: 2, Adaptive: true, SkipTransparent: true}
+	if err := hideInImage(img, Payload{Data: []byte("around the hole")}, opts); err != nil {
+		t.Fatalf("hideInImage failed: %v", err)
+	}
+	// Optimizers clearing invisible pixels must not change the order.
+	for i := 0; i < len(img.Pix); i += 4 {
+		if img.Pix[i+3] == 0 {
+			copy(img.Pix[i:i+3], []byte{0, 0, 0})
+		}
+	}
+	got, err := revealFromImage(img, defaultOptions)
+	if err != nil || string(got.Data) != "around the hole" {
+		t.Errorf("revealFromImage = %q, %v", got.Data, err)
+	}
+}
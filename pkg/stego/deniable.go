@@ -0,0 +1,144 @@
+package stego
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+
+	"github.com/Amul-Thantharate/pixellock/pkg/internal/scatter"
+)
+
+// EmbedDeniable splits the usable pixels of the cover into interleaved
+// halves, one per payload, and scatters each payload over its half in the
+// order derived from its own secret. The halves never share a pixel, so the
+// payloads cannot overwrite each other, and reveal finds each one only when
+// given its own secret.
+
+// deniableSlots is the number of payloads EmbedDeniable hides, each in its
+// own half of the pixels.
+const deniableSlots = 2
+
+// deniableNames names the payload in each slot in errors.
+var deniableNames = [deniableSlots]string{"decoy", "hidden"}
+
+// slot returns the pixels of s making up half slot of it: every other
+// pixel, starting at the first for slot 0 and at the second for slot 1, so
+// both halves are spread evenly over the image.
+func (s pixelSet) slot(b image.Rectangle, slot int) pixelSet {
+	n := s.len(b)
+	pixels := make([]int32, 0, (n+1)/deniableSlots)
+	for i := slot; i < n; i += deniableSlots {
+		if s.pixels != nil {
+			pixels = append(pixels, s.pixels[i])
+		} else {
+			pixels = append(pixels, int32(i))
+		}
+	}
+	return pixelSet{pixels: pixels, skipped: s.skipped}
+}
+
+// hideDeniable embeds payloads[i] into half i of img with opts[i]. Both
+// options must be encrypted, with different secrets, and share the same
+// layout. Nothing is written unless both payloads fit.
+func hideDeniable(img *image.NRGBA, payloads [deniableSlots]Payload, opts [deniableSlots]options) error {
+	b := img.Bounds()
+	var seeds [deniableSlots][32]byte
+	var layouts [deniableSlots][2]stegoLayout
+	var framed [deniableSlots][2][]byte
+	for slot := range deniableSlots {
+		o := opts[slot].forImage(img)
+		if !o.encrypted() {
+			return fmt.Errorf("the %s payload needs a key or password", deniableNames[slot])
+		}
+		if o.layoutByte() != opts[0].forImage(img).layoutByte() {
+			return fmt.Errorf("both payloads must use the same density, channels and transparency handling")
+		}
+		seed, err := scatterSeed(o)
+		if err != nil {
+			return err
+		}
+		if slot > 0 && seed == seeds[0] {
+			return fmt.Errorf("the decoy and hidden payloads need different passwords or keys")
+		}
+		seeds[slot] = seed
+
+		set := pixelSet{}
+		if o.SkipTransparent {
+			set = pixelSet{pixels: visiblePixels(img), skipped: true}
+		}
+		set = set.slot(b, slot)
+		order := scatter.New(seed, set.len(b))
+		hl, bl := headerLayout(o.channels()), bodyLayout(o)
+		hl.pixels, hl.order = set.pixels, order
+		bl.pixels, bl.order = set.pixels, order
+		if hl.capacity(b) < HeaderSize {
+			return fmt.Errorf("image cannot hold the %d byte payload header: %w", HeaderSize, ErrPayloadTooLarge)
+		}
+		header, body, err := framePayload(payloads[slot], o, bl.capacity(b), o.layoutByte())
+		if err != nil {
+			return fmt.Errorf("the %s payload does not fit in its half of the image: %w", deniableNames[slot], err)
+		}
+		layouts[slot] = [2]stegoLayout{hl, bl}
+		framed[slot] = [2][]byte{header.marshal(), body}
+	}
+
+	for slot := range deniableSlots {
+		embedBits(img, layouts[slot][0], framed[slot][0])
+		embedBits(img, layouts[slot][1], framed[slot][1])
+	}
+	return nil
+}
+
+// DeniableCapacity returns the largest payload, in bytes as reported by
+// PayloadSize, that each of the two payloads of EmbedDeniable can hold in
+// img with opts.
+func DeniableCapacity(img image.Image, opts ...Option) int {
+	o := newOptions(opts)
+	if img.ColorModel() == color.GrayModel {
+		o = o.forGray()
+	}
+	nrgbaImg := asNRGBA(img)
+	o = o.forImage(nrgbaImg)
+	set := pixelSet{}
+	if o.SkipTransparent {
+		set = pixelSet{pixels: visiblePixels(nrgbaImg), skipped: true}
+	}
+	l := bodyLayout(o)
+	l.pixels = set.slot(nrgbaImg.Bounds(), deniableSlots-1).pixels // The smaller half
+	return o.fillLimit(l.capacity(nrgbaImg.Bounds()))
+}
+
+// EmbedDeniable returns a copy of img hiding two payloads: decoy,
+// encrypted with decoyPassword and meant to be given up if someone insists,
+// and hidden, encrypted with the key or password in opts. Both are
+// scattered, so extracting with either secret finds only its own payload,
+// and the image statistics do not tell one payload from two. Each gets half
+// of the capacity; ErrPayloadTooLarge is returned if either does not fit in
+// its half.
+func EmbedDeniable(img image.Image, decoy, hidden Payload, decoyPassword string, opts ...Option) (image.Image, error) {
+	o := newOptions(opts)
+	if o.hasRegions() {
+		return nil, fmt.Errorf("a decoy payload cannot be kept to regions")
+	}
+	o.Scatter = true
+	if err := o.validate(); err != nil {
+		return nil, err
+	}
+	if o.Adaptive {
+		return nil, fmt.Errorf("a decoy payload cannot be combined with adaptive embedding")
+	}
+	if decoyPassword == "" {
+		return nil, fmt.Errorf("the decoy payload needs a password")
+	}
+	c, err := newCover(img)
+	if err != nil {
+		return nil, err
+	}
+	o = c.options(o)
+	decoyOpts := o
+	decoyOpts.Key, decoyOpts.Password = nil, decoyPassword
+	if err := hideDeniable(c.img, [deniableSlots]Payload{decoy, hidden}, [deniableSlots]options{decoyOpts, o}); err != nil {
+		return nil, err
+	}
+	return c.image(), nil
+}
@@ -0,0 +1,80 @@
+package stego
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestEmbedDeniable(t *testing.T) {
+	decoy := Payload{Data: []byte("milk, eggs, bread")}
+	hidden := Payload{Data: binaryFixture(), Filename: "plans.bin"}
+	img, err := EmbedDeniable(newTestNRGBA(64, 64), decoy, hidden, "decoy", WithDensity(2), WithPassword("real"))
+	if err != nil {
+		t.Fatalf("EmbedDeniable failed: %v", err)
+	}
+
+	got, err := ExtractPayload(img, WithPassword("decoy"))
+	if err != nil {
+		t.Fatalf("extract with the decoy password failed: %v", err)
+	}
+	if !bytes.Equal(got.Data, decoy.Data) || got.Filename != "" {
+		t.Errorf("decoy password revealed %q (%q), want the decoy", got.Data, got.Filename)
+	}
+	got, err = ExtractPayload(img, WithPassword("real"))
+	if err != nil {
+		t.Fatalf("extract with the real password failed: %v", err)
+	}
+	if !bytes.Equal(got.Data, hidden.Data) || got.Filename != hidden.Filename {
+		t.Error("real password did not reveal the hidden payload")
+	}
+
+	for _, password := range []string{"", "guess"} {
+		if _, err := ExtractPayload(img, WithPassword(password)); !errors.Is(err, ErrNoPayload) {
+			t.Errorf("extract with password %q error = %v, want ErrNoPayload", password, err)
+		}
+	}
+}
+
+func TestHideDeniableTransparent(t *testing.T) {
+	img := newTransparentNRGBA(48, 48)
+	opts := options{Density: 1, Password: "real", SkipTransparent: true}
+	if err := hideDeniable(img, [deniableSlots]Payload{{Data: []byte("decoy")}, {Data: []byte("hidden")}},
+		[deniableSlots]options{{Density: 1, Password: "decoy", SkipTransparent: true}, opts}); err != nil {
+		t.Fatalf("hideDeniable failed: %v", err)
+	}
+	got, err := revealFromImage(img, opts)
+	if err != nil || string(got.Data) != "hidden" {
+		t.Errorf("revealFromImage = %q, %v; want the hidden payload", got.Data, err)
+	}
+}
+
+func TestEmbedDeniableTooLarge(t *testing.T) {
+	img := newTestNRGBA(32, 32)
+	opts := options{Density: 1, Password: "real"}
+	overhead, _, err := PayloadSize(Payload{}, withOptions(opts))
+	if err != nil {
+		t.Fatalf("PayloadSize failed: %v", err)
+	}
+	capacity := DeniableCapacity(img, withOptions(opts)) - overhead
+
+	// Together the payloads fit in the image, but the hidden one overflows
+	// its half and would overlap the decoy.
+	decoy, hidden := Payload{Data: make([]byte, 1)}, Payload{Data: make([]byte, capacity+1)}
+	if imageCapacity(img, opts) < len(decoy.Data)+len(hidden.Data) {
+		t.Fatal("combined payloads do not fit the whole image")
+	}
+	if _, err := EmbedDeniable(img, decoy, hidden, "decoy", withOptions(opts)); !errors.Is(err, ErrPayloadTooLarge) {
+		t.Errorf("EmbedDeniable over capacity error = %v, want ErrPayloadTooLarge", err)
+	}
+	hidden.Data = hidden.Data[:capacity]
+	if _, err := EmbedDeniable(img, decoy, hidden, "decoy", withOptions(opts)); err != nil {
+		t.Errorf("EmbedDeniable at capacity failed: %v", err)
+	}
+	if _, err := EmbedDeniable(img, decoy, hidden, "real", withOptions(opts)); err == nil {
+		t.Error("EmbedDeniable accepted the same password for both payloads")
+	}
+	if _, err := EmbedDeniable(img, decoy, hidden, "", withOptions(opts)); err == nil {
+		t.Error("EmbedDeniable accepted a decoy without a password")
+	}
+}
@@ -0,0 +1,771 @@
+package stego
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/draw"
+	"runtime"
+	"strings"
+
+	"github.com/Amul-Thantharate/pixellock/pkg/internal/scatter"
+)
+
+// Payload format versions.
+//
+// Version 1 images predate the magic marker: each pixel carried only the top
+// four bits of a message byte (bits 7-4 in R, G, B, A), so the low nibble was
+// lost. Version 2 images start with stegoMagic followed by the version byte
+// and store all eight bits of every byte across two pixels, ending the
+// message with a null terminator. Version 3 replaces the terminator with a
+// stegoHeader carrying the exact payload length, so payloads may contain any
+// byte value. Version 4 adds a CRC32 to the header so damage to the image
+// after embedding is detected instead of producing garbage. Version 5 adds a
+// layout byte recording the channels carrying the payload, and embeds the
+// header in those channels only, so the others are never touched.
+const (
+	VersionLegacy     = 1
+	VersionTerminated = 2
+	VersionLength     = 3
+	VersionChecksum   = 4
+	Version           = 5
+)
+
+// stegoMagic marks the start of a pixellock stego payload.
+var stegoMagic = []byte("PXLK")
+
+// HeaderSize is the encoded size of a current stegoHeader: magic,
+// version, flags, layout, a big-endian uint32 payload length and a
+// big-endian CRC32.
+const HeaderSize = 4 + 1 + 1 + 1 + 4 + 4
+
+// stegoHeaderSize returns the encoded size of a header of the given version.
+// Version 3 headers have neither layout byte nor checksum, version 4 headers
+// no layout byte.
+func stegoHeaderSize(version byte) int {
+	switch version {
+	case VersionLength:
+		return HeaderSize - 5
+	case VersionChecksum:
+		return HeaderSize - 1
+	}
+	return HeaderSize
+}
+
+var (
+	// ErrPayloadTooLarge is returned when a payload does not fit in the
+	// cover image.
+	ErrPayloadTooLarge = errors.New("payload too large for image")
+	// Err16BitCover is returned when a cover has 16 bits per channel, which
+	// hiding would reduce to 8.
+	Err16BitCover = errors.New("16-bit covers are not supported")
+	// ErrNoPayload is returned when an image carries no payload that can be
+	// found with the given options.
+	ErrNoPayload = errors.New("no pixellock payload found")
+)
+
+// stegoHeader precedes every version 3 and later payload.
+type stegoHeader struct {
+	Version  byte
+	Flags    byte
+	Layout   byte // Body layout (version 5); see options.layoutByte
+	Length   uint32
+	Checksum uint32 // CRC32 of the other fields and the body (version 4 and later)
+
+	// Regions and ExcludeRegions are the region record following a header
+	// flagged with FlagRegion; see region.go.
+	Regions, ExcludeRegions []image.Rectangle
+}
+
+// marshal encodes h, including the magic marker.
+func (h stegoHeader) marshal() []byte {
+	buf := make([]byte, 0, HeaderSize)
+	buf = append(buf, stegoMagic...)
+	buf = append(buf, h.Version, h.Flags)
+	if h.Version >= Version {
+		buf = append(buf, h.Layout)
+	}
+	buf = binary.BigEndian.AppendUint32(buf, h.Length)
+	if h.Version == VersionLength {
+		return buf
+	}
+	buf = binary.BigEndian.AppendUint32(buf, h.Checksum)
+	if h.hasRegionRecord() {
+		buf = h.appendRegionRecord(buf)
+	}
+	return buf
+}
+
+// hasRegionRecord reports whether a region record follows h.
+func (h stegoHeader) hasRegionRecord() bool {
+	return h.Version >= Version && h.Flags&FlagRegion != 0
+}
+
+// checksum returns the CRC32 of the version, flags, layout, length and
+// region record of h followed by body. Covering the header fields means a
+// corrupted length is caught as well as corrupted data.
+func (h stegoHeader) checksum(body []byte) uint32 {
+	crc := crc32.NewIEEE()
+	crc.Write([]byte{h.Version, h.Flags})
+	if h.Version >= Version {
+		crc.Write([]byte{h.Layout})
+	}
+	crc.Write(binary.BigEndian.AppendUint32(nil, h.Length))
+	if h.hasRegionRecord() {
+		crc.Write(h.appendRegionRecord(nil))
+	}
+	crc.Write(body)
+	return crc.Sum32()
+}
+
+// size returns the encoded size of h.
+func (h stegoHeader) size() int {
+	if h.hasRegionRecord() {
+		return HeaderSize + regionRecordSize(len(h.Regions), len(h.ExcludeRegions))
+	}
+	return stegoHeaderSize(h.Version)
+}
+
+// parseStegoHeader decodes a header produced by marshal, without its region
+// record; see readStegoHeader. The caller is expected to have checked the
+// magic already.
+func parseStegoHeader(b []byte) (stegoHeader, error) {
+	if len(b) < len(stegoMagic)+1 || len(b) < stegoHeaderSize(b[4]) {
+		return stegoHeader{}, fmt.Errorf("stego header truncated")
+	}
+	h := stegoHeader{Version: b[4], Flags: b[5]}
+	b = b[6:]
+	if h.Version >= Version {
+		h.Layout, b = b[0], b[1:]
+	}
+	h.Length = binary.BigEndian.Uint32(b)
+	if h.Version != VersionLength {
+		h.Checksum = binary.BigEndian.Uint32(b[4:])
+	}
+	return h, nil
+}
+
+// Channels is a set of color channels of a pixel.
+type Channels byte
+
+// Color channels, combined into a Channels mask.
+const (
+	ChannelR Channels = 1 << iota
+	ChannelG
+	ChannelB
+	ChannelA
+
+	ChannelsRGB  = ChannelR | ChannelG | ChannelB
+	ChannelsRGBA = ChannelsRGB | ChannelA
+)
+
+// stegoChannelLetters names the channels in R, G, B, A order.
+const stegoChannelLetters = "rgba"
+
+// ParseChannels parses a set of channels written as letters, such as
+// "rgb" or "b".
+func ParseChannels(s string) (Channels, error) {
+	var c Channels
+	for _, r := range strings.ToLower(s) {
+		i := strings.IndexRune(stegoChannelLetters, r)
+		if i < 0 {
+			return 0, fmt.Errorf("invalid channel %q in %q: use r, g, b and a", r, s)
+		}
+		if c&(1<<i) != 0 {
+			return 0, fmt.Errorf("channel %q repeated in %q", r, s)
+		}
+		c |= 1 << i
+	}
+	if c == 0 {
+		return 0, fmt.Errorf("no channels given")
+	}
+	return c, nil
+}
+
+// String returns the letters of the channels in c, in R, G, B, A order.
+func (c Channels) String() string {
+	var b strings.Builder
+	for i := range stegoChannelLetters {
+		if c&(1<<i) != 0 {
+			b.WriteByte(stegoChannelLetters[i])
+		}
+	}
+	return b.String()
+}
+
+// offsets returns the Pix offsets of the channels in c within a pixel.
+func (c Channels) offsets() []int {
+	var offsets []int
+	for i := 0; i < 4; i++ {
+		if c&(1<<i) != 0 {
+			offsets = append(offsets, i)
+		}
+	}
+	return offsets
+}
+
+// imageCapacity returns the largest payload, in bytes, that fits in img
+// with opts once the payload header has been accounted for. It returns 0
+// when the image cannot even hold the header.
+func imageCapacity(img image.Image, opts options) int {
+	nrgbaImg := asNRGBA(img)
+	opts.Scatter = false // The pixel order does not change the capacity
+	_, l, _ := stegoLayouts(nrgbaImg, opts.forImage(nrgbaImg))
+	return l.capacity(nrgbaImg.Bounds())
+}
+
+// rawCapacity returns how many whole bytes, header included, fit in an
+// image with bounds b when every byte uses the legacy header layout.
+// Version 2 payloads were written this way.
+func rawCapacity(b image.Rectangle) int {
+	return legacyHeaderLayout.capacity(b)
+}
+
+// grayCover returns the grayscale image whose gray values are the red
+// channel of img, into which a grayscale cover's payload was hidden.
+func grayCover(img *image.NRGBA) *image.Gray {
+	b := img.Bounds()
+	gray := image.NewGray(image.Rect(0, 0, b.Dx(), b.Dy()))
+	for y := 0; y < b.Dy(); y++ {
+		row := img.Pix[img.PixOffset(b.Min.X, b.Min.Y+y):]
+		for x := 0; x < b.Dx(); x++ {
+			gray.Pix[y*gray.Stride+x] = row[x*4]
+		}
+	}
+	return gray
+}
+
+// toNRGBA copies img into a new NRGBA image anchored at the origin. Stego
+// works on non-premultiplied values, as PNG stores them: premultiplying
+// would shift the colors of semi-transparent pixels and, at low alpha,
+// collapse the bits hidden in them.
+func toNRGBA(img image.Image) *image.NRGBA {
+	b := img.Bounds()
+	nrgbaImg := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(nrgbaImg, nrgbaImg.Bounds(), img, b.Min, draw.Src)
+	return nrgbaImg
+}
+
+// asNRGBA returns img itself when it is already an *image.NRGBA, avoiding the
+// copy made by toNRGBA when the image is only read.
+func asNRGBA(img image.Image) *image.NRGBA {
+	if nrgbaImg, ok := img.(*image.NRGBA); ok {
+		return nrgbaImg
+	}
+	return toNRGBA(img)
+}
+
+// stegoLayout describes which bits of an image carry a stream of payload
+// bits. Pixels are visited in raster order from start; within a pixel the
+// bits fill each carrying channel in R, G, B, A order, using the low density
+// bits of the channel from the highest to the lowest. With a scatter order,
+// the pixels are visited in that order instead of raster order. With a
+// pixel list, only the listed pixels are visited, and the order permutes
+// positions in the list.
+type stegoLayout struct {
+	start    int   // Index of the first pixel, in raster or scatter order
+	channels []int // Pix offsets of the channels carrying bits, in R, G, B, A order
+	density  int   // Low bits used per channel (1-4)
+	order    *scatter.Order
+	pixels   []int32 // Raster indices of the usable pixels; nil means all
+	workers  int     // Goroutines for the bits of large images; runtime.NumCPU() when 0
+}
+
+// legacyHeaderLayout carries the stegoHeader of version 3 and 4 images, and
+// the whole payload of version 2 images, in all four channels of the first
+// pixels.
+var legacyHeaderLayout = headerLayout(ChannelsRGBA)
+
+// headerLayout returns the layout of a version 5 stegoHeader embedded in
+// channels c. The header always uses one bit per channel, so reveal can
+// find it by trying each channel mask without being told how the payload
+// was embedded.
+func headerLayout(c Channels) stegoLayout {
+	return stegoLayout{channels: c.offsets(), density: 1}
+}
+
+// stegoHeaderPixels returns the number of pixels occupied by a version 3 or
+// 4 header; the body starts right after them.
+func stegoHeaderPixels(version byte) int {
+	return legacyHeaderLayout.pixelsFor(stegoHeaderSize(version))
+}
+
+// bodyLayout returns the layout of the payload body embedded with opts.
+func bodyLayout(opts options) stegoLayout {
+	c := opts.channels()
+	return stegoLayout{start: headerLayout(c).pixelsFor(HeaderSize), channels: c.offsets(), density: opts.Density, workers: opts.Workers}
+}
+
+// stegoLayouts returns the header and body layouts for embedding into img
+// with opts, which must have been resolved with forImage.
+func stegoLayouts(img *image.NRGBA, opts options) (hl, bl stegoLayout, err error) {
+	if opts.hasRegions() {
+		headerPixels := regionHeaderPixels(opts.channels(), len(opts.Regions), len(opts.ExcludeRegions))
+		hl, bl, err = regionLayouts(img, opts.Regions, opts.ExcludeRegions, opts.SkipTransparent, opts.channels(), headerPixels)
+		bl.density = opts.Density
+	} else {
+		hl, bl, err = stegoLayoutsAll(img, opts)
+	}
+	if err == nil && opts.Adaptive {
+		bl.pixels, bl.start = adaptivePixels(img, bl.pixels, bl.start, opts.Density), 0
+	}
+	return hl, bl, err
+}
+
+// stegoLayoutsAll returns the layouts of stegoLayouts for a payload free to
+// use every pixel.
+func stegoLayoutsAll(img *image.NRGBA, opts options) (hl, bl stegoLayout, err error) {
+	hl, bl = headerLayout(opts.channels()), bodyLayout(opts)
+	b := img.Bounds()
+	pixels := b.Dx() * b.Dy()
+	if opts.SkipTransparent {
+		hl.pixels = visiblePixels(img)
+		bl.pixels = hl.pixels
+		pixels = len(hl.pixels)
+	}
+	if opts.Scatter {
+		if hl.order, err = newScatterOrder(opts, pixels); err != nil {
+			return hl, bl, err
+		}
+		bl.order = hl.order
+	}
+	return hl, bl, nil
+}
+
+// hasTransparentPixels reports whether img has any fully transparent pixel.
+func hasTransparentPixels(img *image.NRGBA) bool {
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		row := img.Pix[img.PixOffset(b.Min.X, y) : img.PixOffset(b.Min.X, y)+b.Dx()*4]
+		for i := 3; i < len(row); i += 4 {
+			if row[i] == 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// visiblePixels returns the raster indices of the pixels of img that are
+// not fully transparent. The embedding leaves their alpha alone, so reveal
+// finds the same pixels.
+func visiblePixels(img *image.NRGBA) []int32 {
+	b := img.Bounds()
+	pixels := make([]int32, 0, b.Dx()*b.Dy())
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		row := img.Pix[img.PixOffset(b.Min.X, y) : img.PixOffset(b.Min.X, y)+b.Dx()*4]
+		for x := 0; x < b.Dx(); x++ {
+			if row[x*4+3] != 0 {
+				pixels = append(pixels, int32((y-b.Min.Y)*b.Dx()+x))
+			}
+		}
+	}
+	return pixels
+}
+
+// layoutByte returns the header layout byte recording the body layout of
+// opts.
+func (o options) layoutByte() byte {
+	layout := byte(o.channels()) | byte(o.Density-1)<<stegoLayoutDensityShift&stegoLayoutDensityMask
+	if o.SkipTransparent {
+		layout |= stegoLayoutSkipTransparent
+	}
+	if o.Adaptive {
+		layout |= stegoLayoutAdaptive
+	}
+	return layout
+}
+
+// optionsFromHeader returns the layout options recorded in h, reversing
+// options.layoutByte. Version 3 and 4 headers keep the density and
+// alpha use in their flags.
+func optionsFromHeader(h stegoHeader) options {
+	if h.Version < Version {
+		opts := options{
+			Density:  int(h.Flags&stegoDensityMask>>stegoDensityShift) + 1,
+			Channels: ChannelsRGBA,
+		}
+		if h.Flags&FlagSkipAlpha != 0 {
+			opts.Channels = ChannelsRGB
+		}
+		return opts
+	}
+	return options{
+		Density:         int(h.Layout&stegoLayoutDensityMask>>stegoLayoutDensityShift) + 1,
+		Channels:        Channels(h.Layout & stegoLayoutChannels),
+		SkipTransparent: h.Layout&stegoLayoutSkipTransparent != 0,
+		Adaptive:        h.Layout&stegoLayoutAdaptive != 0,
+	}
+}
+
+// layoutFromHeader returns the body layout recorded in h.
+func layoutFromHeader(h stegoHeader) stegoLayout {
+	l := bodyLayout(optionsFromHeader(h))
+	if h.Version < Version {
+		l.start = stegoHeaderPixels(h.Version)
+	}
+	return l
+}
+
+func (l stegoLayout) bitsPerPixel() int {
+	return len(l.channels) * l.density
+}
+
+// pixelsFor returns the number of pixels needed to hold n bytes.
+func (l stegoLayout) pixelsFor(n int) int {
+	bpp := l.bitsPerPixel()
+	return (n*8 + bpp - 1) / bpp
+}
+
+// capacity returns how many whole bytes fit in an image with bounds b.
+func (l stegoLayout) capacity(b image.Rectangle) int {
+	pixels := b.Dx() * b.Dy()
+	if l.pixels != nil {
+		pixels = len(l.pixels)
+	}
+	pixels -= l.start
+	if pixels <= 0 {
+		return 0
+	}
+	return pixels * l.bitsPerPixel() / 8
+}
+
+// pixelOffset returns the Pix offset of stream pixel k of l.
+func (l stegoLayout) pixelOffset(img *image.NRGBA, k int) int {
+	b := img.Bounds()
+	p := l.start + k
+	if l.order != nil {
+		p = l.order.At(p)
+	}
+	if l.pixels != nil {
+		p = int(l.pixels[p])
+	}
+	return img.PixOffset(b.Min.X+p%b.Dx(), b.Min.Y+p/b.Dx())
+}
+
+// bitPositions returns, for each bit a pixel carries in l, the offset of
+// its channel from the pixel's and its bit position in the channel.
+func (l stegoLayout) bitPositions() (channels []int, shifts []uint) {
+	for _, c := range l.channels {
+		for d := l.density - 1; d >= 0; d-- {
+			channels, shifts = append(channels, c), append(shifts, uint(d))
+		}
+	}
+	return channels, shifts
+}
+
+// minParallelPixels is the fewest pixels whose bits are spread over
+// several goroutines; fewer are done faster on one.
+const minParallelPixels = 1 << 16
+
+// bands calls fn with consecutive ranges [lo, hi) of the stream bits of l
+// from first up to end, on l.workers goroutines at once when they span
+// enough pixels. Each range starts on a pixel and on a byte of the stream,
+// so no two share a byte of img or of the data.
+func (l stegoLayout) bands(first, end int, fn func(lo, hi int)) {
+	bpp := l.bitsPerPixel()
+	workers := l.workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	if workers == 1 || (end-first)/bpp < minParallelPixels {
+		fn(first, end)
+		return
+	}
+	// The scatter order is drawn on demand; draw it all here, so the
+	// goroutines only read it
+	if l.order != nil {
+		l.order.At(l.start + (end-1)/bpp)
+	}
+	align := 8 * bpp
+	base := first / align * align
+	size := ((end-base)/workers + align - 1) / align * align
+	runParallel((end-base+size-1)/size, workers, func(i int) {
+		fn(max(first, base+i*size), min(end, base+(i+1)*size))
+	})
+}
+
+// embedBits writes data MSB-first into the bits of img selected by l. It
+// returns the number of bytes written, which is less than len(data) when the
+// image is too small.
+func embedBits(img *image.NRGBA, l stegoLayout, data []byte) int {
+	n := min(len(data), l.capacity(img.Bounds()))
+	channels, shifts := l.bitPositions()
+	bpp := len(channels)
+	l.bands(0, n*8, func(lo, hi int) {
+		k, rem := lo/bpp, lo%bpp
+		pix := l.pixelOffset(img, k)
+		for i := lo; i < hi; i++ {
+			bit := data[i/8] >> (7 - i%8) & 1
+			off, shift := pix+channels[rem], shifts[rem]
+			img.Pix[off] = img.Pix[off]&^(1<<shift) | bit<<shift
+			if rem++; rem == bpp && i+1 < hi {
+				k, rem = k+1, 0
+				pix = l.pixelOffset(img, k)
+			}
+		}
+	})
+	return n
+}
+
+// extractBits reads n bytes starting at byte offset off of the stream
+// selected by l, reversing embedBits. Fewer bytes are returned if the image
+// ends first.
+func extractBits(img *image.NRGBA, l stegoLayout, off, n int) []byte {
+	n = max(0, min(n, l.capacity(img.Bounds())-off))
+	out := make([]byte, n)
+	channels, shifts := l.bitPositions()
+	bpp := len(channels)
+	l.bands(off*8, (off+n)*8, func(lo, hi int) {
+		k, rem := lo/bpp, lo%bpp
+		pix := l.pixelOffset(img, k)
+		for i := lo; i < hi; i++ {
+			j := i - off*8
+			out[j/8] |= (img.Pix[pix+channels[rem]] >> shifts[rem] & 1) << (7 - j%8)
+			if rem++; rem == bpp && i+1 < hi {
+				k, rem = k+1, 0
+				pix = l.pixelOffset(img, k)
+			}
+		}
+	})
+	return out
+}
+
+// hideInImage embeds p into img: a stegoHeader in the header layout
+// followed by the body in the layout selected by opts. It fails with
+// ErrPayloadTooLarge rather than truncating.
+func hideInImage(img *image.NRGBA, p Payload, opts options) error {
+	opts = opts.forImage(img)
+	if err := opts.checkRegions(img); err != nil {
+		return err
+	}
+	header, body, err := framePayload(p, opts, imageCapacity(img, opts), opts.layoutByte())
+	if err != nil {
+		return err
+	}
+	return embedFramed(img, header, body, opts)
+}
+
+// embedFramed writes a framed payload into img with the layout of opts,
+// which must have been resolved with forImage. The regions of opts are
+// added to the header, and its checksum updated to cover them.
+func embedFramed(img *image.NRGBA, header stegoHeader, body []byte, opts options) error {
+	hl, bl, err := stegoLayouts(img, opts)
+	if err != nil {
+		return err
+	}
+	if opts.hasRegions() {
+		header.Flags |= FlagRegion
+		header.Regions, header.ExcludeRegions = opts.Regions, opts.ExcludeRegions
+		header.Checksum = header.checksum(body)
+	}
+	if hl.capacity(img.Bounds()) < header.size() {
+		return fmt.Errorf("image cannot hold the %d byte payload header: %w", header.size(), ErrPayloadTooLarge)
+	}
+	embedBits(img, hl, header.marshal())
+	embedBits(img, bl, body)
+	return nil
+}
+
+// extractTerminated reads a null-terminated payload starting at byte offset
+// off, a chunk at a time so that only the bytes up to the terminator are
+// decoded.
+func extractTerminated(img *image.NRGBA, l stegoLayout, off int) []byte {
+	const chunkSize = 256
+	capacity := l.capacity(img.Bounds())
+	var data []byte
+	for ; off < capacity; off += chunkSize {
+		chunk := extractBits(img, l, off, chunkSize)
+		if i := bytes.IndexByte(chunk, 0); i >= 0 {
+			return append(data, chunk[:i]...)
+		}
+		data = append(data, chunk...)
+	}
+	return data
+}
+
+// hasMagic reports whether prefix starts with stegoMagic and a version byte.
+func hasMagic(prefix []byte) bool {
+	return len(prefix) >= len(stegoMagic)+1 && bytes.Equal(prefix[:len(stegoMagic)], stegoMagic)
+}
+
+// stegoHeaderMasks lists the channel masks tried when looking for a header,
+// most likely first: the default RGB, then RGBA, where version 2 to 4
+// headers live too, then every other mask.
+var stegoHeaderMasks = func() []Channels {
+	masks := []Channels{ChannelsRGB, ChannelsRGBA}
+	for c := ChannelR; c < ChannelsRGBA; c++ {
+		if c != ChannelsRGB {
+			masks = append(masks, c)
+		}
+	}
+	return masks
+}()
+
+// findStegoHeader returns the layout of the stego header in img along with
+// the magic and version read from it. The header is looked for in each
+// channel mask, starting at the first pixel and, if some pixels are fully
+// transparent, at the first visible one, and then in a header block of a
+// region payload anywhere in the image. When opts carries a key or
+// password, the scatter orders derived from it are tried next, over those
+// pixels and over each half of them EmbedDeniable writes to; version 1
+// images never carry a key, so not finding the header there is an error.
+// Otherwise, when no header is found, the prefix returned lacks the magic.
+func findStegoHeader(img *image.NRGBA, opts options) (stegoLayout, []byte, error) {
+	b := img.Bounds()
+	sets := []pixelSet{{}}
+	if hasTransparentPixels(img) {
+		sets = append(sets, pixelSet{pixels: visiblePixels(img), skipped: true})
+	}
+	search := func(sets []pixelSet, seed *[32]byte) (stegoLayout, []byte, bool) {
+		for _, set := range sets {
+			var order *scatter.Order
+			if seed != nil {
+				order = scatter.New(*seed, set.len(b))
+			}
+			for _, mask := range stegoHeaderMasks {
+				l := headerLayout(mask)
+				l.pixels, l.order = set.pixels, order
+				if prefix, ok := readStegoPrefix(img, l, mask, set); ok {
+					return l, prefix, true
+				}
+			}
+		}
+		return stegoLayout{}, nil, false
+	}
+
+	if l, prefix, ok := search(sets, nil); ok {
+		return l, prefix, nil
+	}
+	if l, prefix, ok := findRegionHeader(img); ok {
+		return l, prefix, nil
+	}
+	if !opts.encrypted() {
+		return legacyHeaderLayout, extractBits(img, legacyHeaderLayout, 0, len(stegoMagic)+1), nil
+	}
+	seed, err := scatterSeed(opts)
+	if err != nil {
+		return stegoLayout{}, nil, err
+	}
+	for _, set := range sets {
+		for slot := range deniableSlots {
+			sets = append(sets, set.slot(b, slot))
+		}
+	}
+	if l, prefix, ok := search(sets, &seed); ok {
+		return l, prefix, nil
+	}
+	return stegoLayout{}, nil, fmt.Errorf("%w: wrong key or password, or the image was modified", ErrNoPayload)
+}
+
+// pixelSet is a set of pixels findStegoHeader searches for a header.
+type pixelSet struct {
+	pixels  []int32 // Raster indices; nil means all pixels
+	skipped bool    // Whether fully transparent pixels were left out
+}
+
+// len returns the number of pixels in the set for an image with bounds b.
+func (s pixelSet) len(b image.Rectangle) int {
+	if s.pixels == nil {
+		return b.Dx() * b.Dy()
+	}
+	return len(s.pixels)
+}
+
+// readStegoPrefix returns the magic and version of a header carried by the
+// header layout l in channels mask over the pixels of set. ok is false
+// unless the header is one that could have been embedded there: version 2
+// to 4 headers always used all four channels of every pixel, and version 5
+// headers record their channels and whether transparent pixels were
+// skipped.
+func readStegoPrefix(img *image.NRGBA, l stegoLayout, mask Channels, set pixelSet) (prefix []byte, ok bool) {
+	prefix = extractBits(img, l, 0, len(stegoMagic)+1)
+	if !hasMagic(prefix) {
+		return nil, false
+	}
+	switch version := prefix[len(stegoMagic)]; {
+	case version < Version:
+		return prefix, mask == ChannelsRGBA && set.pixels == nil
+	case version > Version:
+		return prefix, true // Reported as unsupported by the caller
+	}
+	h, err := parseStegoHeader(extractBits(img, l, 0, HeaderSize))
+	if err != nil {
+		return nil, false
+	}
+	if h.Flags&FlagRegion != 0 {
+		return nil, false // Region headers are found by findRegionHeader
+	}
+	skipped := h.Layout&stegoLayoutSkipTransparent != 0
+	return prefix, Channels(h.Layout&stegoLayoutChannels) == mask && skipped == set.skipped
+}
+
+// revealFromImage extracts a payload from img. Version 3 to 5 payloads are read
+// to exactly their recorded length using the layout recorded in their
+// header, version 2 payloads up to their null terminator, and, if
+// opts.Legacy is set, images without the magic marker with the version 1
+// layout; otherwise they get ErrNoPayload. The header is located by
+// findStegoHeader. Encrypted payloads are decrypted with the key or
+// password in opts.
+func revealFromImage(img *image.NRGBA, opts options) (Payload, error) {
+	hl, prefix, err := findStegoHeader(img, opts)
+	if err != nil {
+		return Payload{}, err
+	}
+	if !hasMagic(prefix) {
+		if !opts.Legacy {
+			return Payload{}, ErrNoPayload
+		}
+		return Payload{Data: revealLegacy(img), Legacy: true}, nil
+	}
+
+	switch prefix[len(stegoMagic)] {
+	case Version, VersionChecksum, VersionLength:
+		header, err := readStegoHeader(img, hl, prefix[len(stegoMagic)])
+		if err != nil {
+			return Payload{}, err
+		}
+		layout := layoutFromHeader(header)
+		layout.order, layout.pixels = hl.order, hl.pixels
+		if header.hasRegionRecord() {
+			o := optionsFromHeader(header)
+			headerPixels := hl.pixelsFor(header.size())
+			if _, layout, err = regionLayouts(img, header.Regions, header.ExcludeRegions, o.SkipTransparent, o.channels(), headerPixels); err != nil {
+				return Payload{}, err
+			}
+			layout.density = o.Density
+		}
+		if header.Version == Version && header.Layout&stegoLayoutAdaptive != 0 {
+			layout.pixels, layout.start = adaptivePixels(img, layout.pixels, layout.start, layout.density), 0
+		}
+		if err := header.checkLength(layout.capacity(img.Bounds())); err != nil {
+			return Payload{}, err
+		}
+		return openFramedPayload(header, extractBits(img, layout, 0, int(header.Length)), opts)
+	case VersionTerminated:
+		return Payload{Data: extractTerminated(img, hl, len(prefix))}, nil
+	default:
+		return Payload{}, fmt.Errorf("unsupported stego payload version %d", prefix[len(stegoMagic)])
+	}
+}
+
+// revealLegacy decodes a version 1 payload: one pixel per byte carrying only
+// bits 7-4, terminated by a null byte. The scan stops at the terminator.
+func revealLegacy(img *image.NRGBA) []byte {
+	b := img.Bounds()
+	var message []byte
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		row := img.Pix[img.PixOffset(b.Min.X, y) : img.PixOffset(b.Max.X-1, y)+4]
+		for i := 0; i < len(row); i += 4 {
+			by := (row[i]&1)<<7 | (row[i+1]&1)<<6 | (row[i+2]&1)<<5 | (row[i+3]&1)<<4
+			if by == 0 {
+				return message
+			}
+			message = append(message, by)
+		}
+	}
+	return message
+}
@@ -0,0 +1,870 @@
+package stego
+
+import (
+	"bytes"
+	cryptorand "crypto/rand"
+	"errors"
+	"image"
+	"image/color"
+	"math/rand/v2"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/Amul-Thantharate/pixellock/pkg/internal/scatter"
+)
+
+func newTestNRGBA(w, h int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{uint8(x * 7), uint8(y * 13), uint8(x + y), 255})
+		}
+	}
+	return img
+}
+
+// newTexturedNRGBA returns a test image with the variety of a photo: smooth
+// gradients, flat patches and areas of fine noise.
+func newTexturedNRGBA(w, h int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	rng := rand.New(rand.NewPCG(uint64(w), uint64(h)))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			noise := 0
+			if (x/40+y/30)%3 != 0 { // A third of the blocks stay smooth
+				noise = rng.IntN(48) - 24
+			}
+			clamp := func(v int) uint8 { return uint8(max(0, min(255, v))) }
+			img.SetNRGBA(x, y, color.NRGBA{
+				clamp(x*200/w + 30 + noise),
+				clamp(y*180/h + 40 + noise/2),
+				clamp((x+y)*120/(w+h) + 60 - noise),
+				255,
+			})
+		}
+	}
+	return img
+}
+
+// randomKey returns a fresh AES-256 key.
+func randomKey(t *testing.T) []byte {
+	t.Helper()
+	key := make([]byte, keySize)
+	if _, err := cryptorand.Read(key); err != nil {
+		t.Fatalf("rand.Read failed: %v", err)
+	}
+	return key
+}
+
+// withOptions sets all of o at once, for the exported functions.
+func withOptions(o options) Option {
+	return func(dst *options) { *dst = o }
+}
+
+func TestEmbedExtractFullByteRange(t *testing.T) {
+	data := make([]byte, 256)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	img := newTestNRGBA(32, 32)
+	if n := embedBits(img, legacyHeaderLayout, data); n != len(data) {
+		t.Fatalf("embedBits wrote %d bytes, want %d", n, len(data))
+	}
+	got := extractBits(img, legacyHeaderLayout, 0, len(data))
+	if !bytes.Equal(got, data) {
+		t.Errorf("extractBits mismatch:\n got %v\nwant %v", got, data)
+	}
+}
+
+func TestHideRevealDistinguishesLowNibble(t *testing.T) {
+	// 'a' (0x61) and 'q' (0x71) share a high nibble with other letters; only
+	// the low nibble tells them apart.
+	for _, msg := range []string{"a", "q", "aq", "qa"} {
+		img := newTestNRGBA(16, 16)
+		if err := hideInImage(img, Payload{Data: []byte(msg)}, defaultOptions); err != nil {
+			t.Fatalf("hideInImage failed: %v", err)
+		}
+		got, err := revealFromImage(img, defaultOptions)
+		if err != nil {
+			t.Fatalf("revealFromImage failed: %v", err)
+		}
+		if string(got.Data) != msg {
+			t.Errorf("round trip of %q returned %q", msg, got.Data)
+		}
+	}
+}
+
+func TestHideRevealFullByteRange(t *testing.T) {
+	msg := make([]byte, 0, 256)
+	for i := 0; i <= 0xff; i++ {
+		msg = append(msg, byte(i))
+	}
+	img := newTestNRGBA(32, 32)
+	if err := hideInImage(img, Payload{Data: msg}, defaultOptions); err != nil {
+		t.Fatalf("hideInImage failed: %v", err)
+	}
+	got, err := revealFromImage(img, defaultOptions)
+	if err != nil {
+		t.Fatalf("revealFromImage failed: %v", err)
+	}
+	if !bytes.Equal(got.Data, msg) {
+		t.Errorf("round trip mismatch:\n got %v\nwant %v", got.Data, msg)
+	}
+}
+
+func TestHideRevealBinaryExactLength(t *testing.T) {
+	payloads := [][]byte{
+		{},
+		{0x00},
+		{0x00, 0x00, 0x00},
+		{'a', 0x00, 'b', 0xff, 0x00},
+		{0xff, 0xfe, 0x80, 0x00, 0x7f},
+	}
+	for _, payload := range payloads {
+		img := newTestNRGBA(16, 16)
+		// Leave non-zero garbage after the payload so reading past the
+		// recorded length would be noticed.
+		embedBits(img, legacyHeaderLayout, bytes.Repeat([]byte{0xaa}, rawCapacity(img.Bounds())))
+		if err := hideInImage(img, Payload{Data: payload}, defaultOptions); err != nil {
+			t.Fatalf("hideInImage failed: %v", err)
+		}
+		got, err := revealFromImage(img, defaultOptions)
+		if err != nil {
+			t.Fatalf("revealFromImage failed: %v", err)
+		}
+		if !bytes.Equal(got.Data, payload) {
+			t.Errorf("round trip of %v returned %v", payload, got.Data)
+		}
+	}
+}
+
+func TestHideInImageTooLarge(t *testing.T) {
+	img := newTestNRGBA(4, 4) // 8 bytes of capacity, less than the header
+	if err := hideInImage(img, Payload{Data: []byte("x")}, defaultOptions); !errors.Is(err, ErrPayloadTooLarge) {
+		t.Errorf("hideInImage error = %v, want ErrPayloadTooLarge", err)
+	}
+}
+
+func TestPayloadCheckedAgainstCapacity(t *testing.T) {
+	message := bytes.Repeat([]byte("0123456789abcdef"), 32) // 512 bytes
+
+	icon := newTestNRGBA(32, 32)
+	err := hideInImage(icon, Payload{Data: message}, defaultOptions)
+	if !errors.Is(err, ErrPayloadTooLarge) {
+		t.Fatalf("hideInImage into a 32x32 icon error = %v, want ErrPayloadTooLarge", err)
+	}
+	// The error gives both the payload size and the capacity.
+	size, _, _ := PayloadSize(Payload{Data: message})
+	for _, n := range []int{size, imageCapacity(icon, defaultOptions)} {
+		if !strings.Contains(err.Error(), strconv.Itoa(n)) {
+			t.Errorf("error %q does not mention %d", err, n)
+		}
+	}
+
+	photo := newTestNRGBA(256, 256)
+	long := bytes.Repeat(message, 16) // 8 KiB
+	if err := hideInImage(photo, Payload{Data: long}, defaultOptions); err != nil {
+		t.Fatalf("hideInImage into a 256x256 image failed: %v", err)
+	}
+	got, err := revealFromImage(photo, defaultOptions)
+	if err != nil {
+		t.Fatalf("revealFromImage failed: %v", err)
+	}
+	if !bytes.Equal(got.Data, long) {
+		t.Error("multi-kilobyte message did not round trip")
+	}
+}
+
+func TestMaxFill(t *testing.T) {
+	img := newTestNRGBA(64, 64)
+	capacity := imageCapacity(img, defaultOptions)
+	half := defaultOptions
+	half.MaxFill = 0.5
+
+	fits := Payload{Data: make([]byte, capacity/2)}
+	if err := hideInImage(img, fits, half); err != nil {
+		t.Errorf("hideInImage of half the capacity failed: %v", err)
+	}
+	over := Payload{Data: make([]byte, capacity/2+10)}
+	if err := hideInImage(img, over, half); !errors.Is(err, ErrPayloadTooLarge) {
+		t.Errorf("hideInImage over the max fill error = %v, want ErrPayloadTooLarge", err)
+	}
+	if err := hideInImage(img, over, defaultOptions); err != nil {
+		t.Errorf("hideInImage without max fill failed: %v", err)
+	}
+
+	for _, bad := range []float64{-0.1, 1.5} {
+		opts := defaultOptions
+		opts.MaxFill = bad
+		if opts.validate() == nil {
+			t.Errorf("Validate accepted max fill %g", bad)
+		}
+	}
+}
+
+func TestRevealRejectsOversizedLength(t *testing.T) {
+	img := newTestNRGBA(16, 16)
+	header := stegoHeader{Version: Version, Layout: options{Density: 1}.layoutByte(), Length: 1 << 30}
+	embedBits(img, headerLayout(ChannelsRGB), header.marshal())
+	if _, err := revealFromImage(img, defaultOptions); err == nil {
+		t.Error("revealFromImage accepted a length larger than the image")
+	}
+}
+
+func TestRevealTerminatedImage(t *testing.T) {
+	img := newTestNRGBA(16, 16)
+	payload := append(append([]byte{}, stegoMagic...), VersionTerminated)
+	payload = append(payload, "hello\x00world"...)
+	embedBits(img, legacyHeaderLayout, payload)
+	got, err := revealFromImage(img, defaultOptions)
+	if err != nil {
+		t.Fatalf("revealFromImage failed: %v", err)
+	}
+	if string(got.Data) != "hello" {
+		t.Errorf("revealFromImage = %q, want %q", got.Data, "hello")
+	}
+}
+
+func TestHideRevealUTF8(t *testing.T) {
+	for _, msg := range []string{"héllo wörld", "— 秘密のメッセージ —", "🔐🗝️"} {
+		img := newTestNRGBA(64, 64)
+		if err := hideInImage(img, Payload{Data: []byte(msg)}, defaultOptions); err != nil {
+			t.Fatalf("hideInImage failed: %v", err)
+		}
+		got, err := revealFromImage(img, defaultOptions)
+		if err != nil {
+			t.Fatalf("revealFromImage failed: %v", err)
+		}
+		if string(got.Data) != msg {
+			t.Errorf("round trip of %q returned %q", msg, got.Data)
+		}
+	}
+}
+
+// embedLegacy writes msg and its terminator in the version 1 layout.
+func embedLegacy(img *image.NRGBA, msg []byte) {
+	width := img.Bounds().Dx()
+	for i, by := range append(msg, 0) {
+		x, y := i%width, i/width
+		c := img.NRGBAAt(x, y)
+		c.R = (c.R &^ 1) | (by>>7)&1
+		c.G = (c.G &^ 1) | (by>>6)&1
+		c.B = (c.B &^ 1) | (by>>5)&1
+		c.A = (c.A &^ 1) | (by>>4)&1
+		img.SetNRGBA(x, y, c)
+	}
+}
+
+func TestRevealLegacyImage(t *testing.T) {
+	// Version 1 images stored bits 7-4 of each byte in a single pixel.
+	msg := []byte("PIXEL") // low nibbles are lost by the legacy layout
+	img := newTestNRGBA(16, 16)
+	embedLegacy(img, msg)
+
+	if _, err := revealFromImage(img, defaultOptions); !errors.Is(err, ErrNoPayload) {
+		t.Errorf("reveal without Legacy error = %v, want ErrNoPayload", err)
+	}
+
+	want := make([]byte, len(msg))
+	for i, by := range msg {
+		want[i] = by & 0xf0
+	}
+	got, err := revealFromImage(img, options{Density: 1, Legacy: true})
+	if err != nil {
+		t.Fatalf("revealFromImage failed: %v", err)
+	}
+	if !got.Legacy || !bytes.Equal(got.Data, want) {
+		t.Errorf("legacy reveal = %v (Legacy %v), want %v", got.Data, got.Legacy, want)
+	}
+}
+
+func TestRevealCleanImage(t *testing.T) {
+	img := newTestNRGBA(32, 32)
+	if _, err := revealFromImage(img, defaultOptions); !errors.Is(err, ErrNoPayload) {
+		t.Errorf("reveal of a clean image error = %v, want ErrNoPayload", err)
+	}
+}
+
+func TestHeaderFlagCombinations(t *testing.T) {
+	key := randomKey(t)
+	text := bytes.Repeat([]byte("all work and no play "), 20)
+	cases := []struct {
+		name string
+		p    Payload
+		opts options
+	}{
+		{"plain", Payload{Data: text}, options{Density: 1}},
+		{"file", Payload{Data: binaryFixture(), Filename: "a.bin"}, options{Density: 2}},
+		{"compressed", Payload{Data: text}, options{Density: 1, Compress: true}},
+		{"encrypted", Payload{Data: text}, options{Density: 1, Key: key}},
+		{"password", Payload{Data: text, Filename: "t.txt"}, options{Density: 1, Password: "pw"}},
+		{"scattered compressed", Payload{Data: text}, options{Density: 3, Key: key, Scatter: true, Compress: true}},
+		{"blue", Payload{Data: text}, options{Density: 4, Channels: ChannelB, Compress: true}},
+	}
+	for _, tc := range cases {
+		img := newTestNRGBA(64, 64)
+		if err := hideInImage(img, tc.p, tc.opts); err != nil {
+			t.Fatalf("%s: hideInImage failed: %v", tc.name, err)
+		}
+		got, err := revealFromImage(img, options{Density: 1, Key: tc.opts.Key, Password: tc.opts.Password})
+		if err != nil {
+			t.Fatalf("%s: revealFromImage failed: %v", tc.name, err)
+		}
+		if got.Legacy || got.Filename != tc.p.Filename || !bytes.Equal(got.Data, tc.p.Data) {
+			t.Errorf("%s: payload did not round trip", tc.name)
+		}
+	}
+}
+
+func TestStegoCapacityMatchesHide(t *testing.T) {
+	for _, size := range [][2]int{{8, 8}, {16, 9}, {33, 17}, {64, 64}} {
+		img := newTestNRGBA(size[0], size[1])
+		capacity := imageCapacity(img, defaultOptions)
+
+		payload := bytes.Repeat([]byte{0x5a}, capacity)
+		if err := hideInImage(img, Payload{Data: payload}, defaultOptions); err != nil {
+			t.Fatalf("%dx%d: payload of exactly capacity %d rejected: %v", size[0], size[1], capacity, err)
+		}
+		got, err := revealFromImage(img, defaultOptions)
+		if err != nil {
+			t.Fatalf("%dx%d: revealFromImage failed: %v", size[0], size[1], err)
+		}
+		if !bytes.Equal(got.Data, payload) {
+			t.Errorf("%dx%d: payload of capacity %d did not round trip", size[0], size[1], capacity)
+		}
+
+		err = hideInImage(newTestNRGBA(size[0], size[1]), Payload{Data: append(payload, 0)}, defaultOptions)
+		if !errors.Is(err, ErrPayloadTooLarge) {
+			t.Errorf("%dx%d: payload of capacity+1 error = %v, want ErrPayloadTooLarge", size[0], size[1], err)
+		}
+	}
+}
+
+func TestStegoCapacityOptions(t *testing.T) {
+	img := newTestNRGBA(10, 10) // 100 pixels, 40 of them holding the header in RGB
+	tests := []struct {
+		opts options
+		want int
+	}{
+		{options{Density: 1}, 60 * 3 / 8},
+		{options{Density: 2}, 60 * 3 * 2 / 8},
+		{options{Density: 4}, 60 * 3 * 4 / 8},
+		{options{Density: 1, Channels: ChannelsRGBA}, 70 * 4 / 8},
+		{options{Density: 3, Channels: ChannelsRGBA}, 70 * 4 * 3 / 8},
+		{options{Density: 4, Channels: ChannelR | ChannelB}, 40 * 2 * 4 / 8},
+		{options{Density: 4, Channels: ChannelB}, 0}, // The header alone needs 120 pixels
+	}
+	for _, tt := range tests {
+		if got := imageCapacity(img, tt.opts); got != tt.want {
+			t.Errorf("imageCapacity(%+v) = %d, want %d", tt.opts, got, tt.want)
+		}
+	}
+
+	if got := imageCapacity(newTestNRGBA(2, 2), defaultOptions); got != 0 {
+		t.Errorf("imageCapacity of image smaller than header = %d, want 0", got)
+	}
+	if err := (options{Density: 5}).validate(); err == nil {
+		t.Error("Validate accepted density 5")
+	}
+}
+
+func TestDensityRoundTrip(t *testing.T) {
+	payload := binaryFixture()
+	for density := 1; density <= 4; density++ {
+		for _, channels := range []Channels{ChannelsRGB, ChannelsRGBA} {
+			opts := options{Density: density, Channels: channels}
+			img := newTestNRGBA(40, 40)
+			if err := hideInImage(img, Payload{Data: payload}, opts); err != nil {
+				t.Fatalf("%+v: hideInImage failed: %v", opts, err)
+			}
+
+			// The density is read from the header, not from the options.
+			got, err := revealFromImage(img, defaultOptions)
+			if err != nil {
+				t.Fatalf("%+v: revealFromImage failed: %v", opts, err)
+			}
+			if !bytes.Equal(got.Data, payload) {
+				t.Errorf("%+v: payload did not round trip", opts)
+			}
+		}
+	}
+}
+
+func TestDensityChangesOnlyLowBits(t *testing.T) {
+	for density := 1; density <= 4; density++ {
+		cover := newTestNRGBA(40, 40)
+		img := toNRGBA(cover)
+		opts := options{Density: density}
+		if err := hideInImage(img, Payload{Data: bytes.Repeat([]byte{0xff, 0x00, 0x5a}, imageCapacity(img, opts)/3)}, opts); err != nil {
+			t.Fatalf("density %d: hideInImage failed: %v", density, err)
+		}
+
+		mask := byte(1<<density - 1)
+		for i := range img.Pix {
+			if diff := img.Pix[i] ^ cover.Pix[i]; diff&^mask != 0 {
+				t.Fatalf("density %d changed byte %d from %08b to %08b", density, i, cover.Pix[i], img.Pix[i])
+			}
+		}
+	}
+}
+
+func TestDensityCapacity(t *testing.T) {
+	img := newTestNRGBA(20, 20)
+	for density := 1; density <= 4; density++ {
+		opts := options{Density: density}
+		capacity := imageCapacity(img, opts)
+		if err := hideInImage(toNRGBA(img), Payload{Data: make([]byte, capacity)}, opts); err != nil {
+			t.Errorf("density %d: payload of exactly capacity %d rejected: %v", density, capacity, err)
+		}
+		err := hideInImage(toNRGBA(img), Payload{Data: make([]byte, capacity+1)}, opts)
+		if !errors.Is(err, ErrPayloadTooLarge) {
+			t.Errorf("density %d: payload of capacity+1 error = %v, want ErrPayloadTooLarge", density, err)
+		}
+	}
+}
+
+func TestChecksumDetectsModifiedPixels(t *testing.T) {
+	img := newTestNRGBA(32, 32)
+	if err := hideInImage(img, Payload{Data: []byte("the eagle has landed")}, defaultOptions); err != nil {
+		t.Fatalf("hideInImage failed: %v", err)
+	}
+	// Flip the low bit of a few channels inside the body.
+	for _, p := range []int{40, 41, 47} {
+		img.Pix[p*4] ^= 1
+	}
+	if _, err := revealFromImage(img, defaultOptions); !errors.Is(err, ErrPayloadCorrupted) {
+		t.Errorf("revealFromImage error = %v, want ErrPayloadCorrupted", err)
+	}
+}
+
+func TestChecksumCoversLength(t *testing.T) {
+	img := newTestNRGBA(32, 32)
+	if err := hideInImage(img, Payload{Data: []byte("the eagle has landed")}, defaultOptions); err != nil {
+		t.Fatalf("hideInImage failed: %v", err)
+	}
+	// The low bit of the length is carried by the red channel of pixel 29.
+	img.Pix[29*4] ^= 1
+	if _, err := revealFromImage(img, defaultOptions); !errors.Is(err, ErrPayloadCorrupted) {
+		t.Errorf("revealFromImage error = %v, want ErrPayloadCorrupted", err)
+	}
+}
+
+func TestIgnoreChecksum(t *testing.T) {
+	img := newTestNRGBA(32, 32)
+	message := []byte("the eagle has landed")
+	if err := hideInImage(img, Payload{Data: message}, defaultOptions); err != nil {
+		t.Fatalf("hideInImage failed: %v", err)
+	}
+	img.Pix[bodyLayout(defaultOptions).start*4] ^= 1 // Top bit of the first body byte
+
+	got, err := revealFromImage(img, options{Density: 1, IgnoreChecksum: true})
+	if err != nil {
+		t.Fatalf("revealFromImage with IgnoreChecksum failed: %v", err)
+	}
+	if !got.ChecksumFailed {
+		t.Error("ChecksumFailed not set for a corrupted payload")
+	}
+	if want := append([]byte{message[0] ^ 0x80}, message[1:]...); !bytes.Equal(got.Data, want) {
+		t.Errorf("raw body = %q, want %q", got.Data, want)
+	}
+
+	clean := newTestNRGBA(32, 32)
+	if err := hideInImage(clean, Payload{Data: message}, defaultOptions); err != nil {
+		t.Fatalf("hideInImage failed: %v", err)
+	}
+	if got, err := revealFromImage(clean, options{Density: 1, IgnoreChecksum: true}); err != nil || got.ChecksumFailed {
+		t.Errorf("IgnoreChecksum on an intact payload = %+v, %v", got, err)
+	}
+}
+
+func TestRevealVersion3Image(t *testing.T) {
+	// Version 3 headers have no checksum, and the body follows them directly.
+	img := newTestNRGBA(16, 16)
+	header := stegoHeader{Version: VersionLength, Length: 5}
+	embedBits(img, legacyHeaderLayout, append(header.marshal(), "hello"...))
+	got, err := revealFromImage(img, defaultOptions)
+	if err != nil {
+		t.Fatalf("revealFromImage failed: %v", err)
+	}
+	if string(got.Data) != "hello" {
+		t.Errorf("revealFromImage = %q, want %q", got.Data, "hello")
+	}
+}
+
+func TestRevealVersion4Image(t *testing.T) {
+	// Version 4 headers have no layout byte and always use all four
+	// channels; the density of the body is kept in the flags.
+	img := newTestNRGBA(16, 16)
+	body := []byte("hello")
+	header := stegoHeader{Version: VersionChecksum, Flags: 1 << stegoDensityShift, Length: uint32(len(body))}
+	header.Checksum = header.checksum(body)
+	embedBits(img, legacyHeaderLayout, header.marshal())
+	l := legacyHeaderLayout
+	l.start, l.density = stegoHeaderPixels(VersionChecksum), 2
+	embedBits(img, l, body)
+
+	got, err := revealFromImage(img, defaultOptions)
+	if err != nil {
+		t.Fatalf("revealFromImage failed: %v", err)
+	}
+	if string(got.Data) != "hello" {
+		t.Errorf("revealFromImage = %q, want %q", got.Data, "hello")
+	}
+}
+
+func TestChannelsRoundTrip(t *testing.T) {
+	payload := binaryFixture()
+	for _, spec := range []string{"rgb", "rgba", "b", "rb", "ga", "a"} {
+		channels, err := ParseChannels(spec)
+		if err != nil {
+			t.Fatalf("ParseChannels(%q) failed: %v", spec, err)
+		}
+		if channels.String() != spec {
+			t.Errorf("ParseChannels(%q).String() = %q", spec, channels.String())
+		}
+
+		cover := newTestNRGBA(60, 60)
+		img := toNRGBA(cover)
+		opts := options{Density: 2, Channels: channels}
+		if err := hideInImage(img, Payload{Data: payload}, opts); err != nil {
+			t.Fatalf("%s: hideInImage failed: %v", spec, err)
+		}
+		got, err := revealFromImage(img, defaultOptions)
+		if err != nil {
+			t.Fatalf("%s: revealFromImage failed: %v", spec, err)
+		}
+		if !bytes.Equal(got.Data, payload) {
+			t.Errorf("%s: payload did not round trip", spec)
+		}
+
+		// Channels outside the mask, alpha by default, are untouched,
+		// header included.
+		for i := range img.Pix {
+			if channels&(1<<(i%4)) == 0 && img.Pix[i] != cover.Pix[i] {
+				t.Fatalf("%s: unselected channel %c of pixel %d changed", spec, stegoChannelLetters[i%4], i/4)
+			}
+		}
+	}
+
+	for _, bad := range []string{"", "rgbx", "rr"} {
+		if _, err := ParseChannels(bad); err == nil {
+			t.Errorf("ParseChannels(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestRevealLegacyStopsAtTerminator(t *testing.T) {
+	// The message wraps onto a second row, and the pixels after the
+	// terminator carry non-zero bits that must not be read.
+	img := newTestNRGBA(16, 16)
+	embedLegacy(img, bytes.Repeat([]byte{0xf0}, 100))
+	msg := bytes.Repeat([]byte{0xa0}, 20)
+	embedLegacy(img, msg)
+
+	got, err := revealFromImage(img, options{Density: 1, Legacy: true})
+	if err != nil {
+		t.Fatalf("revealFromImage failed: %v", err)
+	}
+	if !bytes.Equal(got.Data, msg) {
+		t.Errorf("legacy reveal = %v, want %v", got.Data, msg)
+	}
+}
+
+func TestRevealTerminatedLongAndUnterminated(t *testing.T) {
+	prefix := append(append([]byte{}, stegoMagic...), VersionTerminated)
+
+	// A message longer than one read chunk.
+	img := newTestNRGBA(64, 64)
+	long := bytes.Repeat([]byte("0123456789"), 70)
+	embedBits(img, legacyHeaderLayout, append(append(append([]byte{}, prefix...), long...), 0, 'x'))
+	got, err := revealFromImage(img, defaultOptions)
+	if err != nil {
+		t.Fatalf("revealFromImage failed: %v", err)
+	}
+	if !bytes.Equal(got.Data, long) {
+		t.Errorf("long terminated message returned %d bytes, want %d", len(got.Data), len(long))
+	}
+
+	// Without a terminator the message runs to the end of the image.
+	img = newTestNRGBA(16, 16)
+	fill := bytes.Repeat([]byte{'z'}, rawCapacity(img.Bounds())-len(prefix))
+	embedBits(img, legacyHeaderLayout, append(append([]byte{}, prefix...), fill...))
+	if got, err = revealFromImage(img, defaultOptions); err != nil || !bytes.Equal(got.Data, fill) {
+		t.Errorf("unterminated message = %d bytes, %v; want %d bytes", len(got.Data), err, len(fill))
+	}
+}
+
+// newTransparentNRGBA returns a test image whose left 60% is fully
+// transparent, like the margins of a logo.
+func newTransparentNRGBA(w, h int) *image.NRGBA {
+	img := newTestNRGBA(w, h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w*6/10; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{uint8(x), uint8(y), 0, 0})
+		}
+	}
+	return img
+}
+
+// zeroTransparent mimics image optimizers that discard the color of fully
+// transparent pixels.
+func zeroTransparent(img *image.NRGBA) {
+	for i := 0; i < len(img.Pix); i += 4 {
+		if img.Pix[i+3] == 0 {
+			img.Pix[i], img.Pix[i+1], img.Pix[i+2] = 0, 0, 0
+		}
+	}
+}
+
+func TestSkipTransparentSurvivesOptimizer(t *testing.T) {
+	message := []byte("hidden in the visible part")
+	for _, opts := range []options{
+		{Density: 1, SkipTransparent: true},
+		{Density: 2, SkipTransparent: true, Password: "hunter2", Scatter: true},
+	} {
+		img := newTransparentNRGBA(40, 30)
+		original := toNRGBA(img)
+		if err := hideInImage(img, Payload{Data: message}, opts); err != nil {
+			t.Fatalf("%+v: hideInImage failed: %v", opts, err)
+		}
+		for i := 3; i < len(img.Pix); i += 4 {
+			if img.Pix[i] != original.Pix[i] {
+				t.Fatalf("%+v: alpha of pixel %d changed", opts, i/4)
+			}
+		}
+
+		zeroTransparent(img)
+		p, err := revealFromImage(img, options{Density: 1, Password: opts.Password})
+		if err != nil {
+			t.Fatalf("%+v: revealFromImage failed: %v", opts, err)
+		}
+		if !bytes.Equal(p.Data, message) {
+			t.Errorf("%+v: revealed %q, want %q", opts, p.Data, message)
+		}
+	}
+}
+
+func TestWithoutSkipTransparentOptimizerDestroysPayload(t *testing.T) {
+	img := newTransparentNRGBA(40, 30)
+	if err := hideInImage(img, Payload{Data: []byte("hidden everywhere")}, options{Density: 1}); err != nil {
+		t.Fatalf("hideInImage failed: %v", err)
+	}
+	zeroTransparent(img)
+	if p, err := revealFromImage(img, defaultOptions); err == nil && string(p.Data) == "hidden everywhere" {
+		t.Error("payload in transparent pixels survived zeroing their color; the test no longer shows the problem")
+	}
+}
+
+func TestSkipTransparentCapacity(t *testing.T) {
+	img := newTransparentNRGBA(40, 30)
+	visible := 40 * 30 * 4 / 10
+	want := (visible - headerLayout(ChannelsRGB).pixelsFor(HeaderSize)) * 3 / 8
+	if got := imageCapacity(img, options{Density: 1, SkipTransparent: true}); got != want {
+		t.Errorf("capacity skipping transparent pixels = %d, want %d", got, want)
+	}
+	if err := hideInImage(img, Payload{Data: make([]byte, want+1)}, defaultOptions); !errors.Is(err, ErrPayloadTooLarge) {
+		t.Errorf("payload of capacity+1 error = %v, want ErrPayloadTooLarge", err)
+	}
+
+	// Opaque covers are embedded as before, so the option costs nothing.
+	opaque := newTestNRGBA(40, 30)
+	if got, want := imageCapacity(opaque, defaultOptions), imageCapacity(opaque, options{Density: 1}); got != want {
+		t.Errorf("opaque capacity with SkipTransparent = %d, want %d", got, want)
+	}
+}
+
+// BenchmarkRevealLargeImage reveals a short message from a 40 megapixel
+// image. Reveal should only touch the pixels holding the message, so the
+// time and allocations stay flat as the image grows.
+func BenchmarkRevealLargeImage(b *testing.B) {
+	img := image.NewNRGBA(image.Rect(0, 0, 8000, 5000))
+	for i := range img.Pix {
+		img.Pix[i] = byte(i * 7)
+	}
+	message := []byte("twenty chars message")
+
+	// Each format overwrites the start of the image left by the previous one.
+	formats := []struct {
+		name  string
+		embed func(img *image.NRGBA)
+	}{
+		{"current", func(img *image.NRGBA) {
+			if err := hideInImage(img, Payload{Data: message}, defaultOptions); err != nil {
+				b.Fatalf("hideInImage failed: %v", err)
+			}
+		}},
+		{"terminated", func(img *image.NRGBA) {
+			payload := append(append([]byte{}, stegoMagic...), VersionTerminated)
+			embedBits(img, legacyHeaderLayout, append(append(payload, message...), 0))
+		}},
+		{"legacy", func(img *image.NRGBA) {
+			embedLegacy(img, bytes.Repeat([]byte{0xf0}, len(message)))
+		}},
+	}
+	for _, format := range formats {
+		b.Run(format.name, func(b *testing.B) {
+			format.embed(img)
+			b.ReportAllocs()
+			b.ResetTimer()
+			opts := defaultOptions
+			opts.Legacy = true
+			for i := 0; i < b.N; i++ {
+				if _, err := revealFromImage(img, opts); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// locateScalar is the reference for the bits of a layout: the Pix offset
+// and bit position of stream bit i, worked out alone.
+func locateScalar(img *image.NRGBA, l stegoLayout, i int) (int, uint) {
+	b := img.Bounds()
+	bpp := l.bitsPerPixel()
+	p := l.start + i/bpp
+	if l.order != nil {
+		p = l.order.At(p)
+	}
+	if l.pixels != nil {
+		p = int(l.pixels[p])
+	}
+	rem := i % bpp
+	x, y := b.Min.X+p%b.Dx(), b.Min.Y+p/b.Dx()
+	return img.PixOffset(x, y) + l.channels[rem/l.density], uint(l.density - 1 - rem%l.density)
+}
+
+func embedBitsScalar(img *image.NRGBA, l stegoLayout, data []byte) int {
+	n := min(len(data), l.capacity(img.Bounds()))
+	for i := 0; i < n*8; i++ {
+		bit := data[i/8] >> (7 - i%8) & 1
+		off, shift := locateScalar(img, l, i)
+		img.Pix[off] = img.Pix[off]&^(1<<shift) | bit<<shift
+	}
+	return n
+}
+
+func extractBitsScalar(img *image.NRGBA, l stegoLayout, off, n int) []byte {
+	n = max(0, min(n, l.capacity(img.Bounds())-off))
+	out := make([]byte, n)
+	for i := 0; i < n*8; i++ {
+		pix, shift := locateScalar(img, l, off*8+i)
+		out[i/8] |= (img.Pix[pix] >> shift & 1) << (7 - i%8)
+	}
+	return out
+}
+
+// TestBitsMatchScalar checks embedBits and extractBits against the
+// reference bit by bit, for every kind of layout, on sub-images and on
+// images large enough to be split between goroutines.
+func TestBitsMatchScalar(t *testing.T) {
+	full := newTexturedNRGBA(420, 330)
+	sub := full.SubImage(image.Rect(37, 21, 401, 300)).(*image.NRGBA)
+	small := newTexturedNRGBA(61, 47).SubImage(image.Rect(3, 5, 58, 40)).(*image.NRGBA)
+	var seed [32]byte
+	seed[0] = 7
+
+	type layoutCase struct {
+		name   string
+		layout func(b image.Rectangle) stegoLayout
+	}
+	var layouts []layoutCase
+	for _, c := range []Channels{ChannelsRGB, ChannelsRGBA, ChannelR | ChannelB, ChannelA} {
+		for density := 1; density <= 4; density++ {
+			layouts = append(layouts, layoutCase{"raster/" + c.String() + "/" + strconv.Itoa(density), func(image.Rectangle) stegoLayout {
+				return stegoLayout{start: 3, channels: c.offsets(), density: density}
+			}})
+		}
+	}
+	layouts = append(layouts,
+		layoutCase{"scatter", func(b image.Rectangle) stegoLayout {
+			return stegoLayout{start: 11, channels: ChannelsRGB.offsets(), density: 2, order: scatter.New(seed, b.Dx()*b.Dy())}
+		}},
+		layoutCase{"pixels", func(b image.Rectangle) stegoLayout {
+			var pixels []int32
+			for p := 0; p < b.Dx()*b.Dy(); p += 3 {
+				pixels = append(pixels, int32(p))
+			}
+			return stegoLayout{channels: ChannelsRGB.offsets(), density: 3, pixels: pixels}
+		}},
+		layoutCase{"scattered pixels", func(b image.Rectangle) stegoLayout {
+			var pixels []int32
+			for p := 1; p < b.Dx()*b.Dy(); p += 2 {
+				pixels = append(pixels, int32(p))
+			}
+			return stegoLayout{channels: ChannelsRGBA.offsets(), density: 1, pixels: pixels, order: scatter.New(seed, len(pixels))}
+		}},
+	)
+
+	for _, cover := range []struct {
+		name string
+		img  *image.NRGBA
+	}{{"full", full}, {"sub", sub}, {"small", small}} {
+		for _, lc := range layouts {
+			for _, workers := range []int{1, 4, 0} {
+				t.Run(cover.name+"/"+lc.name+"/workers="+strconv.Itoa(workers), func(t *testing.T) {
+					b := cover.img.Bounds()
+					l := lc.layout(b)
+					l.workers = workers
+					ref := lc.layout(b)
+					data := make([]byte, l.capacity(b)+5)
+					cryptorand.Read(data)
+
+					want := cloneNRGBA(cover.img)
+					got := cloneNRGBA(cover.img)
+					wn, gn := embedBitsScalar(want, ref, data), embedBits(got, l, data)
+					if wn != gn || !bytes.Equal(want.Pix, got.Pix) {
+						t.Fatalf("embedBits differs from the reference (wrote %d bytes, want %d)", gn, wn)
+					}
+					for _, span := range [][2]int{{0, len(data)}, {5, 1000}, {1, 7}, {len(data) - 9, 20}} {
+						if w, g := extractBitsScalar(want, ref, span[0], span[1]), extractBits(got, l, span[0], span[1]); !bytes.Equal(w, g) {
+							t.Errorf("extractBits(%d, %d) differs from the reference", span[0], span[1])
+						}
+					}
+				})
+			}
+		}
+	}
+}
+
+// cloneNRGBA returns a copy of img with its own pixels and the same bounds.
+func cloneNRGBA(img *image.NRGBA) *image.NRGBA {
+	return &image.NRGBA{Pix: bytes.Clone(img.Pix), Stride: img.Stride, Rect: img.Rect}
+}
+
+// BenchmarkBits embeds into and extracts from a 4000x3000 image, with the
+// reference and with embedBits and extractBits on one goroutine and on
+// all of them.
+func BenchmarkBits(b *testing.B) {
+	img := image.NewNRGBA(image.Rect(0, 0, 4000, 3000))
+	l := bodyLayout(defaultOptions)
+	data := make([]byte, l.capacity(img.Bounds()))
+	cryptorand.Read(data)
+	for _, impl := range []struct {
+		name    string
+		workers int
+		embed   func(*image.NRGBA, stegoLayout, []byte) int
+		extract func(*image.NRGBA, stegoLayout, int, int) []byte
+	}{
+		{"scalar", 1, embedBitsScalar, extractBitsScalar},
+		{"pix", 1, embedBits, extractBits},
+		{"parallel", 0, embedBits, extractBits},
+	} {
+		l.workers = impl.workers
+		b.Run("embed/"+impl.name, func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				impl.embed(img, l, data)
+			}
+		})
+		b.Run("extract/"+impl.name, func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				impl.extract(img, l, 0, len(data))
+			}
+		})
+	}
+}
@@ -0,0 +1,40 @@
+package stego
+
+import "testing"
+
+// FuzzReadFrame opens arbitrary framed payloads, which must fail cleanly
+// rather than panic or allocate without bound.
+func FuzzReadFrame(f *testing.F) {
+	payload := Payload{Data: []byte("a hidden message, long enough to compress well well well well"), Filename: "notes.txt"}
+	for _, opts := range [][]Option{nil, {WithCompression(true)}, {WithPassword("hunter2")}} {
+		frame, err := Frame(payload, 512, opts...)
+		if err != nil {
+			f.Fatalf("Frame failed: %v", err)
+		}
+		f.Add(frame)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		read := func(off, n int) []byte {
+			if off >= len(data) {
+				return nil
+			}
+			return data[off:min(off+n, len(data))]
+		}
+		ReadFrame(read, len(data))
+		ReadFrame(read, len(data), WithPassword("hunter2"))
+
+		// The checksum is fixed up, so that mutations reach the payload
+		// parsers behind it
+		if !hasMagic(data) {
+			return
+		}
+		h, err := parseStegoHeader(data)
+		if err != nil || h.hasRegionRecord() {
+			return
+		}
+		body := data[stegoHeaderSize(h.Version):]
+		h.Checksum = h.checksum(body)
+		openFramedPayload(h, body, options{})
+	})
+}
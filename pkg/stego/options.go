@@ -0,0 +1,247 @@
+package stego
+
+import (
+	"fmt"
+	"image"
+)
+
+// options controls which pixels and bits carry a payload and how the
+// payload is protected. The Options passed to Embed and the other
+// functions set its fields.
+type options struct {
+	Density  int      // Low bits used per channel (1-4)
+	Channels Channels // Channels carrying payload bits; ChannelsRGB when zero
+	Key      []byte   // AES-256 key used to encrypt the payload
+	Password string   // Password used to derive the payload key (takes precedence over Key)
+
+	// Scatter spreads the payload over pixels in an order derived from the
+	// key or password instead of filling them from the top-left.
+	Scatter bool
+
+	// SkipTransparent leaves fully transparent pixels out of the embedding,
+	// so optimizers that zero the color of invisible pixels do not destroy
+	// the payload. It only has an effect on covers with transparent pixels,
+	// and there also keeps the payload out of the alpha channel.
+	SkipTransparent bool
+
+	// Adaptive embeds the body into the most textured pixels first and
+	// leaves flat areas, where changes stand out to steganalysis,
+	// untouched. The capacity then depends on the image content.
+	Adaptive bool
+
+	// Regions restricts embedding to the pixels inside these rectangles,
+	// and ExcludeRegions keeps it out of the pixels inside those. Both are
+	// in pixels from the top-left corner of the image, and are recorded in
+	// the payload header so reveal walks the same pixels unprompted.
+	Regions        []image.Rectangle
+	ExcludeRegions []image.Rectangle
+
+	// Compress deflates the payload before encrypting and embedding it,
+	// unless that would barely make it smaller.
+	Compress bool
+
+	// MaxFill caps the share of the capacity a payload may use, between 0
+	// and 1; 0 means no cap.
+	MaxFill float64
+
+	// Legacy reads images without a payload header as version 1 payloads.
+	Legacy bool
+
+	// IgnoreChecksum returns the raw body of a payload that fails its
+	// checksum instead of an error.
+	IgnoreChecksum bool
+
+	// Workers is the number of goroutines the bits of a large image are
+	// embedded and extracted on; runtime.NumCPU() when 0.
+	Workers int
+}
+
+// defaultOptions is the layout used when no Option says otherwise.
+var defaultOptions = options{Density: 1, SkipTransparent: true}
+
+// Option configures Embed, Extract and the other functions of the package.
+// Options a function has no use for, such as WithDensity when extracting,
+// are ignored.
+type Option func(*options)
+
+// newOptions returns defaultOptions with opts applied.
+func newOptions(opts []Option) options {
+	o := defaultOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// WithDensity sets the number of low bits of each channel, from 1 to 4,
+// carrying payload bits; 1 by default. Higher densities hold more at the
+// cost of more visible, and more detectable, changes. Extract reads the
+// density from the payload header.
+func WithDensity(density int) Option {
+	return func(o *options) { o.Density = density }
+}
+
+// WithChannels sets the channels carrying payload bits; ChannelsRGB by
+// default, or when c is 0.
+func WithChannels(c Channels) Option {
+	return func(o *options) { o.Channels = c }
+}
+
+// WithKey encrypts the payload with AES-256 GCM under key, which must be
+// 32 bytes, and decrypts it with key when extracting.
+func WithKey(key []byte) Option {
+	return func(o *options) { o.Key = key }
+}
+
+// WithPassword encrypts the payload under a key derived from password,
+// taking precedence over WithKey, and decrypts it with that password when
+// extracting.
+func WithPassword(password string) Option {
+	return func(o *options) { o.Password = password }
+}
+
+// WithScatter spreads the payload over the pixels in an order derived from
+// the key or password instead of filling them from the top-left. Extract
+// finds scattered payloads from the key or password alone.
+func WithScatter(scatter bool) Option {
+	return func(o *options) { o.Scatter = scatter }
+}
+
+// WithSkipTransparent sets whether fully transparent pixels, whose color
+// image optimizers may discard, are left out of the embedding; true by
+// default. On covers with transparent pixels, skipping them also keeps the
+// payload out of the alpha channel.
+func WithSkipTransparent(skip bool) Option {
+	return func(o *options) { o.SkipTransparent = skip }
+}
+
+// WithAdaptive embeds the body into the most textured pixels first,
+// leaving flat areas, where changes stand out to steganalysis, untouched.
+// The capacity then depends on the image content.
+func WithAdaptive(adaptive bool) Option {
+	return func(o *options) { o.Adaptive = adaptive }
+}
+
+// WithRegions restricts embedding to the pixels inside rs, given in pixels
+// from the top-left corner of the image. The regions are recorded in the
+// payload header, so Extract needs no option to find them.
+func WithRegions(rs ...image.Rectangle) Option {
+	return func(o *options) { o.Regions = rs }
+}
+
+// WithExcludeRegions keeps embedding out of the pixels inside rs, as
+// WithRegions keeps it in.
+func WithExcludeRegions(rs ...image.Rectangle) Option {
+	return func(o *options) { o.ExcludeRegions = rs }
+}
+
+// WithCompression deflates the payload before encrypting and embedding it,
+// unless that would barely make it smaller.
+func WithCompression(compress bool) Option {
+	return func(o *options) { o.Compress = compress }
+}
+
+// WithMaxFill caps the share of the capacity a payload may use, between 0
+// and 1; 0, the default, means no cap. Altering fewer pixels makes the
+// payload harder to detect.
+func WithMaxFill(fill float64) Option {
+	return func(o *options) { o.MaxFill = fill }
+}
+
+// WithLegacy makes Extract read images without a payload header as
+// version 1 payloads, the null-terminated layout written before the header
+// existed. Any image yields some bytes that way, so without it such images
+// get ErrNoPayload.
+func WithLegacy(legacy bool) Option {
+	return func(o *options) { o.Legacy = legacy }
+}
+
+// WithIgnoreChecksum makes Extract return the raw body of a payload that
+// fails its checksum instead of ErrPayloadCorrupted, for forensic
+// inspection; see Payload.ChecksumFailed.
+func WithIgnoreChecksum(ignore bool) Option {
+	return func(o *options) { o.IgnoreChecksum = ignore }
+}
+
+// WithWorkers sets the number of goroutines the bits of a large image are
+// embedded and extracted on; runtime.NumCPU() by default, or when n is 0.
+// The result is the same for any number.
+func WithWorkers(n int) Option {
+	return func(o *options) { o.Workers = n }
+}
+
+// Validate reports whether opts describe a supported layout, as Embed
+// checks before touching the image.
+func Validate(opts ...Option) error {
+	return newOptions(opts).validate()
+}
+
+func (o options) validate() error {
+	if o.Density < 1 || o.Density > 4 {
+		return fmt.Errorf("invalid density %d: must be between 1 and 4", o.Density)
+	}
+	if o.Channels&^ChannelsRGBA != 0 {
+		return fmt.Errorf("invalid channel mask %#x", byte(o.Channels))
+	}
+	if o.SkipTransparent && o.channels() == ChannelA {
+		return fmt.Errorf("embedding in the alpha channel only requires keeping transparent pixels")
+	}
+	if o.MaxFill < 0 || o.MaxFill > 1 {
+		return fmt.Errorf("invalid max fill %g: must be between 0 and 1", o.MaxFill)
+	}
+	if o.Scatter && !o.encrypted() {
+		return fmt.Errorf("scatter requires a key or password")
+	}
+	if o.Adaptive && o.Scatter {
+		return fmt.Errorf("adaptive embedding cannot be combined with scatter")
+	}
+	if o.Key != nil && len(o.Key) != keySize {
+		return fmt.Errorf("invalid key size: key must be %d bytes", keySize)
+	}
+	return o.validateRegions()
+}
+
+// fillLimit returns how many of capacity bytes a payload may use under
+// MaxFill.
+func (o options) fillLimit(capacity int) int {
+	if o.MaxFill == 0 {
+		return capacity
+	}
+	return int(float64(capacity) * o.MaxFill)
+}
+
+// encrypted reports whether o asks for the payload to be encrypted.
+func (o options) encrypted() bool {
+	return o.Key != nil || o.Password != ""
+}
+
+// forImage resolves the options that depend on the cover img. Skipping
+// transparent pixels is dropped for images without any, and otherwise
+// implies leaving the alpha channel alone: changing its low bits could turn
+// a barely visible pixel fully transparent and lose its payload bits.
+func (o options) forImage(img *image.NRGBA) options {
+	if o.SkipTransparent {
+		if hasTransparentPixels(img) {
+			o.Channels = o.channels() &^ ChannelA
+		} else {
+			o.SkipTransparent = false
+		}
+	}
+	return o
+}
+
+// channels returns the channels that carry payload bits.
+func (o options) channels() Channels {
+	if o.Channels == 0 {
+		return ChannelsRGB
+	}
+	return o.Channels
+}
+
+// forGray returns o hiding in the single channel of a grayscale cover. It
+// reads back as equal red, green and blue, so the red channel stands for it
+// and grayCover saves it as the gray value.
+func (o options) forGray() options {
+	o.Channels = ChannelR
+	return o
+}
@@ -0,0 +1,465 @@
+package stego
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+)
+
+// Payload header flags.
+const (
+	// FlagFile marks a payload carrying a file: the body starts with
+	// the original filename and a SHA-256 of the file contents.
+	FlagFile byte = 1 << 0
+	// FlagEncrypted marks a body sealed with AES-256 GCM.
+	FlagEncrypted byte = 1 << 1
+	// FlagPassword marks an encrypted body whose key was derived from a
+	// password; the body starts with the KDF salt.
+	FlagPassword byte = 1 << 2
+	// FlagCompressed marks a body deflated before encryption. It is
+	// only used in version 5 headers; older ones kept the density there.
+	FlagCompressed byte = 1 << 3
+	// FlagSkipAlpha marks a version 3 or 4 body embedded in the R, G
+	// and B channels only.
+	FlagSkipAlpha byte = 1 << 5
+	// FlagFragment marks a body carrying one fragment of a payload
+	// split across several images; see payloadFragment.
+	FlagFragment byte = 1 << 6
+	// FlagRegion marks a version 5 payload kept to regions of the
+	// image; a region record follows the header.
+	FlagRegion byte = 1 << 7
+)
+
+// Bits 3-4 of the header flags of version 3 and 4 payloads hold the body's
+// embedding density minus one, so headers written before density was
+// configurable read as density 1.
+const (
+	stegoDensityShift      = 3
+	stegoDensityMask  byte = 3 << stegoDensityShift
+)
+
+// Version 5 headers record the body layout in a byte of their own: the
+// Channels mask in bits 0-3, the density minus one in bits 4-5,
+// whether fully transparent pixels were skipped in bit 6 and whether the
+// body was embedded adaptively in bit 7.
+const (
+	stegoLayoutChannels        byte = 0x0f
+	stegoLayoutDensityShift         = 4
+	stegoLayoutDensityMask     byte = 3 << stegoLayoutDensityShift
+	stegoLayoutSkipTransparent byte = 1 << 6
+	stegoLayoutAdaptive        byte = 1 << 7
+)
+
+var (
+	// ErrPayloadHashMismatch is returned when an extracted file does not
+	// match the hash recorded when it was embedded.
+	ErrPayloadHashMismatch = errors.New("payload hash mismatch")
+	// ErrPayloadEncrypted is returned when revealing an encrypted payload
+	// without a key or password.
+	ErrPayloadEncrypted = errors.New("payload is encrypted, key required")
+	// ErrPayloadCorrupted is returned when a payload fails its checksum.
+	ErrPayloadCorrupted = errors.New("payload corrupted or image was modified after embedding")
+	// ErrAuthenticationFailed is returned when an encrypted payload cannot
+	// be decrypted, either because the key or password is wrong or the
+	// payload was modified.
+	ErrAuthenticationFailed = errors.New("authentication failed: wrong key or corrupted data")
+)
+
+// Encrypted payloads are sealed with AES-256 GCM, the nonce ahead of the
+// ciphertext, under the key given or one derived from a password with
+// PBKDF2-SHA256 and a random salt stored ahead of both.
+const (
+	keySize       = 32
+	saltSize      = 16
+	kdfIterations = 200_000
+)
+
+// Payload is the content carried by a stego image.
+type Payload struct {
+	Data     []byte
+	Filename string // Original filename for file payloads, empty for messages
+
+	// ChecksumFailed is set when the payload failed its checksum and was
+	// returned anyway because of WithIgnoreChecksum. Data then holds the
+	// raw embedded body, still encrypted and encoded.
+	ChecksumFailed bool
+
+	// Legacy is set when no payload header was found and, as asked by
+	// WithLegacy, the data was read with the version 1 layout, which any
+	// image yields something for.
+	Legacy bool
+
+	// fragment is set when the image held one fragment of a payload split
+	// across several covers.
+	fragment *payloadFragment
+}
+
+// IsFile reports whether p carries a file rather than a text message.
+func (p Payload) IsFile() bool {
+	return p.Filename != ""
+}
+
+// Fragment reports whether p is one fragment of a payload split across
+// several images, and if so its position (from 1) and the fragment count.
+func (p Payload) Fragment() (index, total int, ok bool) {
+	if p.fragment == nil {
+		return 0, 0, false
+	}
+	return p.fragment.index + 1, p.fragment.total, true
+}
+
+// encode returns the header flags and body bytes for p. File payloads are
+// prefixed with a uint16 filename length, the filename and a SHA-256 of the
+// data.
+func (p Payload) encode() (byte, []byte, error) {
+	if !p.IsFile() {
+		return 0, p.Data, nil
+	}
+
+	name := filepath.Base(p.Filename)
+	if len(name) > 0xffff {
+		return 0, nil, fmt.Errorf("filename too long: %d bytes", len(name))
+	}
+	sum := sha256.Sum256(p.Data)
+
+	body := make([]byte, 0, 2+len(name)+len(sum)+len(p.Data))
+	body = binary.BigEndian.AppendUint16(body, uint16(len(name)))
+	body = append(body, name...)
+	body = append(body, sum[:]...)
+	body = append(body, p.Data...)
+	return FlagFile, body, nil
+}
+
+// decodePayload reverses Payload.encode, verifying the file hash when one
+// is present.
+func decodePayload(flags byte, body []byte) (Payload, error) {
+	if flags&FlagFile == 0 {
+		return Payload{Data: body}, nil
+	}
+
+	if len(body) < 2 {
+		return Payload{}, fmt.Errorf("file payload truncated")
+	}
+	nameLen := int(binary.BigEndian.Uint16(body))
+	body = body[2:]
+	if len(body) < nameLen+sha256.Size {
+		return Payload{}, fmt.Errorf("file payload truncated")
+	}
+	name := string(body[:nameLen])
+	sum := body[nameLen : nameLen+sha256.Size]
+	data := body[nameLen+sha256.Size:]
+
+	actual := sha256.Sum256(data)
+	if !bytes.Equal(sum, actual[:]) {
+		return Payload{}, fmt.Errorf("%w for %q", ErrPayloadHashMismatch, name)
+	}
+	return Payload{Data: data, Filename: name}, nil
+}
+
+// maxInflatedSize bounds the size of a decompressed payload, so a crafted
+// image cannot make reveal inflate gigabytes.
+const maxInflatedSize = 1 << 30
+
+// compressBody deflates body, returning the updated flags. Bodies that do
+// not shrink by at least an eighth, such as JPEGs and other already
+// compressed files, are left as they are: the few bytes saved are not worth
+// making reveal depend on inflating them.
+func compressBody(flags byte, body []byte) (byte, []byte, error) {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.BestCompression)
+	if err != nil {
+		return 0, nil, err
+	}
+	if _, err := w.Write(body); err != nil {
+		return 0, nil, fmt.Errorf("failed to compress payload: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return 0, nil, fmt.Errorf("failed to compress payload: %w", err)
+	}
+	if buf.Len() > len(body)-len(body)/8 {
+		return flags, body, nil
+	}
+	return flags | FlagCompressed, buf.Bytes(), nil
+}
+
+// inflateBody reverses compressBody.
+func inflateBody(flags byte, body []byte) ([]byte, error) {
+	if flags&FlagCompressed == 0 {
+		return body, nil
+	}
+	r := flate.NewReader(bytes.NewReader(body))
+	defer r.Close()
+	data, err := io.ReadAll(io.LimitReader(r, maxInflatedSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress payload: %w", err)
+	}
+	if len(data) > maxInflatedSize {
+		return nil, fmt.Errorf("decompressed payload larger than %d bytes", maxInflatedSize)
+	}
+	return data, nil
+}
+
+// sealPayload encodes p and, as opts asks, compresses and encrypts it,
+// returning the header flags and the body to embed.
+func sealPayload(p Payload, opts options) (byte, []byte, error) {
+	flags, body, err := p.encode()
+	if err != nil {
+		return 0, nil, err
+	}
+	if opts.Compress {
+		if flags, body, err = compressBody(flags, body); err != nil {
+			return 0, nil, err
+		}
+	}
+	return sealBody(flags, body, opts)
+}
+
+// openPayload reverses sealPayload.
+func openPayload(flags byte, body []byte, opts options) (Payload, error) {
+	body, err := openBody(flags, body, opts)
+	if err != nil {
+		return Payload{}, err
+	}
+	if body, err = inflateBody(flags, body); err != nil {
+		return Payload{}, err
+	}
+	return decodePayload(flags, body)
+}
+
+// PayloadSize returns the number of bytes p occupies once encoded,
+// compressed and encrypted for embedding with opts, not counting the
+// payload header, and whether compression was applied: it is skipped when
+// it would barely make the payload smaller.
+func PayloadSize(p Payload, opts ...Option) (size int, compressed bool, err error) {
+	flags, body, err := sealPayload(p, newOptions(opts))
+	if err != nil {
+		return 0, false, err
+	}
+	return len(body), flags&FlagCompressed != 0, nil
+}
+
+// sealBody encrypts body when opts carries a key or password, returning the
+// updated flags. Password-derived keys use a fresh salt stored ahead of the
+// ciphertext.
+func sealBody(flags byte, body []byte, opts options) (byte, []byte, error) {
+	if !opts.encrypted() {
+		return flags, body, nil
+	}
+
+	key := opts.Key
+	var prefix []byte
+	if opts.Password != "" {
+		prefix = make([]byte, saltSize)
+		if _, err := rand.Read(prefix); err != nil {
+			return 0, nil, fmt.Errorf("failed to generate salt: %w", err)
+		}
+		var err error
+		if key, err = deriveKey(opts.Password, prefix); err != nil {
+			return 0, nil, err
+		}
+		flags |= FlagPassword
+	}
+
+	ciphertext, err := encrypt(key, body)
+	if err != nil {
+		return 0, nil, err
+	}
+	return flags | FlagEncrypted, append(prefix, ciphertext...), nil
+}
+
+// openBody reverses sealBody.
+func openBody(flags byte, body []byte, opts options) ([]byte, error) {
+	if flags&FlagEncrypted == 0 {
+		return body, nil
+	}
+	if !opts.encrypted() {
+		return nil, ErrPayloadEncrypted
+	}
+
+	key := opts.Key
+	if flags&FlagPassword != 0 {
+		if opts.Password == "" {
+			return nil, fmt.Errorf("%w: payload was encrypted with a password", ErrPayloadEncrypted)
+		}
+		if len(body) < saltSize {
+			return nil, fmt.Errorf("encrypted payload truncated")
+		}
+		var err error
+		if key, err = deriveKey(opts.Password, body[:saltSize]); err != nil {
+			return nil, err
+		}
+		body = body[saltSize:]
+	} else if key == nil {
+		return nil, fmt.Errorf("%w: payload was encrypted with a key", ErrPayloadEncrypted)
+	}
+
+	plaintext, err := decrypt(key, body)
+	if err != nil {
+		return nil, ErrAuthenticationFailed
+	}
+	return plaintext, nil
+}
+
+// deriveKey derives an AES key from a password using PBKDF2-SHA256.
+func deriveKey(password string, salt []byte) ([]byte, error) {
+	key, err := pbkdf2.Key(sha256.New, password, salt, kdfIterations, keySize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive key: %w", err)
+	}
+	return key, nil
+}
+
+// newGCM returns AES-256 GCM under key.
+func newGCM(key []byte) (cipher.AEAD, error) {
+	if len(key) != keySize {
+		return nil, fmt.Errorf("invalid key size: key must be %d bytes", keySize)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encrypt seals plaintext under key and a random nonce, which it returns in
+// front of the ciphertext.
+func encrypt(key, plaintext []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to create nonce: %w", err)
+	}
+	return aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// decrypt opens ciphertext sealed by encrypt.
+func decrypt(key, ciphertext []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, fmt.Errorf("ciphertext too short")
+	}
+	nonce, ciphertext := ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, nil)
+}
+
+// framePayload encodes and seals p, returning the stegoHeader describing it
+// and the body to embed after the header. layout is recorded in the header
+// before the checksum is computed. capacity is the number of
+// body bytes the carrier holds; framePayload fails with ErrPayloadTooLarge
+// rather than truncating, or when the body exceeds opts.MaxFill of it.
+func framePayload(p Payload, opts options, capacity int, layout byte) (stegoHeader, []byte, error) {
+	flags, body, err := sealPayload(p, opts)
+	if err != nil {
+		return stegoHeader{}, nil, err
+	}
+	if limit := opts.fillLimit(capacity); len(body) > limit && len(body) <= capacity {
+		return stegoHeader{}, nil, fmt.Errorf("payload needs %d bytes but max fill allows %d of the image capacity of %d: %w", len(body), limit, capacity, ErrPayloadTooLarge)
+	}
+	return frameBody(flags, layout, body, capacity)
+}
+
+// frameBody returns the header for an already encoded body.
+func frameBody(flags, layout byte, body []byte, capacity int) (stegoHeader, []byte, error) {
+	if len(body) > capacity {
+		return stegoHeader{}, nil, fmt.Errorf("payload needs %d bytes but image capacity is %d: %w", len(body), capacity, ErrPayloadTooLarge)
+	}
+	header := stegoHeader{Version: Version, Flags: flags, Layout: layout, Length: uint32(len(body))}
+	header.Checksum = header.checksum(body)
+	return header, body, nil
+}
+
+// checkLength rejects a header claiming more body bytes than the carrier
+// holds, which means the header is corrupt or not ours.
+func (h stegoHeader) checkLength(capacity int) error {
+	if int64(h.Length) > int64(capacity) {
+		return fmt.Errorf("stego header claims %d bytes but image holds at most %d", h.Length, capacity)
+	}
+	return nil
+}
+
+// openFramedPayload reverses framePayload for a body read from a carrier,
+// verifying the checksum of version 4 payloads first.
+func openFramedPayload(h stegoHeader, body []byte, opts options) (Payload, error) {
+	if h.Version != VersionLength && h.checksum(body) != h.Checksum {
+		if !opts.IgnoreChecksum {
+			return Payload{}, ErrPayloadCorrupted
+		}
+		return Payload{Data: body, ChecksumFailed: true}, nil
+	}
+	if h.Flags&FlagFragment != 0 {
+		f, err := parseFragment(body)
+		if err != nil {
+			return Payload{}, err
+		}
+		return Payload{fragment: f}, nil
+	}
+
+	flags := h.Flags
+	if h.Version < Version {
+		flags &^= stegoDensityMask | FlagSkipAlpha // Layout bits, not payload flags
+	}
+	return openPayload(flags, body, opts)
+}
+
+// FramePrefixSize is the number of bytes at the start of a frame that
+// FrameVersion needs: the magic and the version byte.
+const FramePrefixSize = 4 + 1
+
+// Frame encodes and seals p with opts, as Embed does, behind the payload
+// header, for carriers other than the pixels of an image, such as JPEG
+// coefficients or metadata. size is the number of bytes the carrier holds,
+// header included; Frame fails with ErrPayloadTooLarge rather than
+// truncating. Only the encryption, compression and max fill options apply.
+func Frame(p Payload, size int, opts ...Option) ([]byte, error) {
+	header, body, err := framePayload(p, newOptions(opts), max(size-HeaderSize, 0), 0)
+	if err != nil {
+		return nil, err
+	}
+	return append(header.marshal(), body...), nil
+}
+
+// FrameVersion returns the format version of the frame starting with
+// prefix, the first FramePrefixSize bytes of a carrier, and whether it is
+// one ReadFrame can open: a frame written by Frame, or by an earlier
+// version with a length in its header.
+func FrameVersion(prefix []byte) (version int, ok bool) {
+	if !hasMagic(prefix) {
+		return 0, false
+	}
+	version = int(prefix[len(stegoMagic)])
+	return version, version >= VersionLength && version <= Version
+}
+
+// ReadFrame opens the frame written by Frame to a carrier of size bytes,
+// reading it through read, which returns the n bytes of the carrier at
+// offset off. It returns ErrNoPayload when the carrier does not start with
+// a frame.
+func ReadFrame(read func(off, n int) []byte, size int, opts ...Option) (Payload, error) {
+	version, ok := FrameVersion(read(0, FramePrefixSize))
+	if !ok {
+		return Payload{}, ErrNoPayload
+	}
+	header, err := parseStegoHeader(read(0, stegoHeaderSize(byte(version))))
+	if err != nil {
+		return Payload{}, err
+	}
+	if err := header.checkLength(size - header.size()); err != nil {
+		return Payload{}, err
+	}
+	return openFramedPayload(header, read(header.size(), int(header.Length)), newOptions(opts))
+}
@@ -0,0 +1,190 @@
+package stego
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"image"
+	"strings"
+	"testing"
+)
+
+func binaryFixture() []byte {
+	data := make([]byte, 300)
+	for i := range data {
+		data[i] = byte(i * 31)
+	}
+	data[10], data[11] = 0x00, 0x00
+	return data
+}
+
+func TestFilePayloadRoundTrip(t *testing.T) {
+	data := binaryFixture()
+	img := newTestNRGBA(48, 48)
+	if err := hideInImage(img, Payload{Data: data, Filename: "/some/dir/report.pdf"}, defaultOptions); err != nil {
+		t.Fatalf("hideInImage failed: %v", err)
+	}
+
+	got, err := revealFromImage(img, defaultOptions)
+	if err != nil {
+		t.Fatalf("revealFromImage failed: %v", err)
+	}
+	if !got.IsFile() || got.Filename != "report.pdf" {
+		t.Errorf("Filename = %q, want %q", got.Filename, "report.pdf")
+	}
+	if !bytes.Equal(got.Data, data) {
+		t.Errorf("file payload data did not round trip")
+	}
+}
+
+func TestFilePayloadHashMismatch(t *testing.T) {
+	flags, body, err := Payload{Data: binaryFixture(), Filename: "a.bin"}.encode()
+	if err != nil {
+		t.Fatalf("encode failed: %v", err)
+	}
+	body[len(body)-1] ^= 0x01
+	if _, err := decodePayload(flags, body); !errors.Is(err, ErrPayloadHashMismatch) {
+		t.Errorf("decodePayload error = %v, want ErrPayloadHashMismatch", err)
+	}
+}
+
+func TestFilePayloadCountsTowardCapacity(t *testing.T) {
+	img := newTestNRGBA(16, 16)
+	capacity := imageCapacity(img, defaultOptions)
+	err := hideInImage(img, Payload{Data: make([]byte, capacity), Filename: "big.bin"}, defaultOptions)
+	if !errors.Is(err, ErrPayloadTooLarge) {
+		t.Errorf("hideInImage error = %v, want ErrPayloadTooLarge", err)
+	}
+}
+
+func TestEncryptedPayloadRoundTrip(t *testing.T) {
+	key := randomKey(t)
+	secrets := []options{
+		{Density: 1, Key: key},
+		{Density: 1, Password: "correct horse battery staple"},
+	}
+	for _, opts := range secrets {
+		img := newTestNRGBA(48, 48)
+		p := Payload{Data: binaryFixture(), Filename: "secret.bin"}
+		if err := hideInImage(img, p, opts); err != nil {
+			t.Fatalf("hideInImage failed: %v", err)
+		}
+		if bytes.Contains(extractBits(img, headerLayout(ChannelsRGB), 0, rawCapacity(img.Bounds())), []byte("secret.bin")) {
+			t.Error("filename of an encrypted payload is visible in the image")
+		}
+
+		got, err := revealFromImage(img, opts)
+		if err != nil {
+			t.Fatalf("revealFromImage failed: %v", err)
+		}
+		if got.Filename != p.Filename || !bytes.Equal(got.Data, p.Data) {
+			t.Errorf("encrypted payload did not round trip")
+		}
+	}
+}
+
+func TestEncryptedAndPlainPayloadsCoexist(t *testing.T) {
+	opts := options{Density: 1, Password: "hunter2"}
+	plain := newTestNRGBA(32, 32)
+	secret := newTestNRGBA(32, 32)
+	if err := hideInImage(plain, Payload{Data: []byte("public")}, defaultOptions); err != nil {
+		t.Fatalf("hideInImage failed: %v", err)
+	}
+	if err := hideInImage(secret, Payload{Data: []byte("private")}, opts); err != nil {
+		t.Fatalf("hideInImage failed: %v", err)
+	}
+
+	// Supplying a password must not break revealing a plaintext payload.
+	for img, want := range map[*image.NRGBA]string{plain: "public", secret: "private"} {
+		got, err := revealFromImage(img, opts)
+		if err != nil {
+			t.Fatalf("revealFromImage failed: %v", err)
+		}
+		if string(got.Data) != want {
+			t.Errorf("revealFromImage = %q, want %q", got.Data, want)
+		}
+	}
+}
+
+func TestEncryptedPayloadRequiresKey(t *testing.T) {
+	img := newTestNRGBA(32, 32)
+	if err := hideInImage(img, Payload{Data: []byte("private")}, options{Density: 1, Password: "hunter2"}); err != nil {
+		t.Fatalf("hideInImage failed: %v", err)
+	}
+
+	if _, err := revealFromImage(img, defaultOptions); !errors.Is(err, ErrPayloadEncrypted) {
+		t.Errorf("reveal without key error = %v, want ErrPayloadEncrypted", err)
+	}
+	if _, err := revealFromImage(img, options{Density: 1, Password: "wrong"}); !errors.Is(err, ErrAuthenticationFailed) {
+		t.Errorf("reveal with wrong password error = %v, want ErrAuthenticationFailed", err)
+	}
+
+	wrongKey := randomKey(t)
+	keyed := newTestNRGBA(32, 32)
+	key := randomKey(t)
+	if err := hideInImage(keyed, Payload{Data: []byte("private")}, options{Density: 1, Key: key}); err != nil {
+		t.Fatalf("hideInImage failed: %v", err)
+	}
+	if _, err := revealFromImage(keyed, options{Density: 1, Key: wrongKey}); !errors.Is(err, ErrAuthenticationFailed) {
+		t.Errorf("reveal with wrong key error = %v, want ErrAuthenticationFailed", err)
+	}
+}
+
+func TestCompressedPayloadFitsOnlyWhenCompressed(t *testing.T) {
+	text := []byte(strings.Repeat("All work and no play makes Jack a dull boy.\n", 200))
+	img := newTestNRGBA(64, 64)
+	if len(text) <= imageCapacity(img, defaultOptions) {
+		t.Fatalf("test text of %d bytes fits uncompressed", len(text))
+	}
+	if err := hideInImage(toNRGBA(img), Payload{Data: text}, defaultOptions); !errors.Is(err, ErrPayloadTooLarge) {
+		t.Fatalf("uncompressed hideInImage error = %v, want ErrPayloadTooLarge", err)
+	}
+
+	for _, opts := range []options{
+		{Density: 1, Compress: true},
+		{Density: 1, Compress: true, Password: "hunter2"},
+	} {
+		size, compressed, err := PayloadSize(Payload{Data: text, Filename: "jack.txt"}, withOptions(opts))
+		if err != nil || !compressed || size >= len(text)/5 {
+			t.Errorf("%+v: PayloadSize = %d, %v, %v; want compressed to under a fifth", opts, size, compressed, err)
+		}
+
+		stego := toNRGBA(img)
+		if err := hideInImage(stego, Payload{Data: text, Filename: "jack.txt"}, opts); err != nil {
+			t.Fatalf("%+v: hideInImage failed: %v", opts, err)
+		}
+		got, err := revealFromImage(stego, options{Density: 1, Password: opts.Password})
+		if err != nil {
+			t.Fatalf("%+v: revealFromImage failed: %v", opts, err)
+		}
+		if got.Filename != "jack.txt" || !bytes.Equal(got.Data, text) {
+			t.Errorf("%+v: compressed payload did not round trip", opts)
+		}
+	}
+}
+
+func TestCompressionSkippedForIncompressible(t *testing.T) {
+	data := make([]byte, 20000)
+	rand.Read(data) // Like an already compressed file, random bytes do not deflate
+	opts := options{Density: 1, Compress: true}
+	size, compressed, err := PayloadSize(Payload{Data: data, Filename: "photo.jpg"}, withOptions(opts))
+	if err != nil {
+		t.Fatalf("PayloadSize failed: %v", err)
+	}
+	plain, _, _ := PayloadSize(Payload{Data: data, Filename: "photo.jpg"}, withOptions(options{Density: 1}))
+	if compressed || size != plain {
+		t.Errorf("incompressible payload: size %d, compressed %v; want it stored raw in %d bytes", size, compressed, plain)
+	}
+
+	img := newTestNRGBA(256, 256)
+	if err := hideInImage(img, Payload{Data: data, Filename: "photo.jpg"}, opts); err != nil {
+		t.Fatalf("hideInImage failed: %v", err)
+	}
+	got, err := revealFromImage(img, defaultOptions)
+	if err != nil {
+		t.Fatalf("revealFromImage failed: %v", err)
+	}
+	if !bytes.Equal(got.Data, data) {
+		t.Error("incompressible payload did not round trip")
+	}
+}
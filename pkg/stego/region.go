@@ -0,0 +1,344 @@
+package stego
+
+import (
+	"encoding/binary"
+	"fmt"
+	"image"
+	"strconv"
+	"strings"
+)
+
+// Region-constrained payloads keep to the pixels inside options.Regions
+// and outside options.ExcludeRegions. Their header carries
+// FlagRegion and is followed by a region record listing both sets of
+// rectangles: a count of each, then every rectangle as big-endian uint16 x,
+// y, width and height. Header and record are written row by row into a
+// block regionHeaderWidth pixels wide, at the first allowed pixel in raster
+// order where the block is allowed throughout, so nothing outside the
+// regions is touched, and the body fills the other allowed pixels in raster
+// order. Reveal looks for such a block at every pixel when there is no
+// header at the start of the image.
+
+// maxStegoRegions is the most rectangles of each kind a region record holds.
+const maxStegoRegions = 0xff
+
+// regionRectSize is the encoded size of one rectangle in a region record.
+const regionRectSize = 4 * 2
+
+// regionHeaderWidth is the width of the block holding the header of a
+// region payload. Narrow enough for small regions, and wide enough that the
+// magic alone spans two rows, which makes a chance match unlikely.
+const regionHeaderWidth = 8
+
+// ParseRegion parses a rectangle written as x,y,width,height.
+func ParseRegion(s string) (image.Rectangle, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 4 {
+		return image.Rectangle{}, fmt.Errorf("invalid region %q: use x,y,width,height", s)
+	}
+	var v [4]int
+	for i, part := range parts {
+		n, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil || n < 0 || n > 0xffff {
+			return image.Rectangle{}, fmt.Errorf("invalid region %q: %q is not a number between 0 and 65535", s, part)
+		}
+		v[i] = n
+	}
+	if v[2] == 0 || v[3] == 0 {
+		return image.Rectangle{}, fmt.Errorf("invalid region %q: width and height must not be zero", s)
+	}
+	return image.Rect(v[0], v[1], v[0]+v[2], v[1]+v[3]), nil
+}
+
+// regionString formats r the way ParseRegion reads it.
+func regionString(r image.Rectangle) string {
+	return fmt.Sprintf("%d,%d,%d,%d", r.Min.X, r.Min.Y, r.Dx(), r.Dy())
+}
+
+// hasRegions reports whether o constrains embedding to regions.
+func (o options) hasRegions() bool {
+	return len(o.Regions) > 0 || len(o.ExcludeRegions) > 0
+}
+
+// validateRegions checks the rectangles of o that do not depend on the
+// image.
+func (o options) validateRegions() error {
+	if !o.hasRegions() {
+		return nil
+	}
+	if o.Scatter {
+		return fmt.Errorf("regions cannot be combined with scatter")
+	}
+	for _, rs := range [][]image.Rectangle{o.Regions, o.ExcludeRegions} {
+		if len(rs) > maxStegoRegions {
+			return fmt.Errorf("too many regions: at most %d of each kind", maxStegoRegions)
+		}
+		for _, r := range rs {
+			if r.Empty() {
+				return fmt.Errorf("region %s is empty", regionString(r))
+			}
+			if r.Min.X < 0 || r.Min.Y < 0 || r.Dx() > 0xffff || r.Dy() > 0xffff || r.Min.X > 0xffff || r.Min.Y > 0xffff {
+				return fmt.Errorf("region %s is out of range", regionString(r))
+			}
+		}
+	}
+	return nil
+}
+
+// checkRegions reports whether the regions of o fit in img and leave room
+// for the payload header. o must have been resolved with forImage.
+func (o options) checkRegions(img *image.NRGBA) error {
+	if !o.hasRegions() {
+		return nil
+	}
+	b := img.Bounds()
+	frame := image.Rect(0, 0, b.Dx(), b.Dy())
+	for _, rs := range [][]image.Rectangle{o.Regions, o.ExcludeRegions} {
+		for _, r := range rs {
+			if !r.In(frame) {
+				return fmt.Errorf("region %s lies outside the %dx%d image", regionString(r), b.Dx(), b.Dy())
+			}
+		}
+	}
+	if len(regionPixels(img, o.Regions, o.ExcludeRegions, o.SkipTransparent)) == 0 {
+		return fmt.Errorf("the regions leave no pixels to embed in")
+	}
+	headerPixels := regionHeaderPixels(o.channels(), len(o.Regions), len(o.ExcludeRegions))
+	_, _, err := regionLayouts(img, o.Regions, o.ExcludeRegions, o.SkipTransparent, o.channels(), headerPixels)
+	return err
+}
+
+// regionRecordSize returns the encoded size of a region record listing
+// include and exclude rectangles.
+func regionRecordSize(include, exclude int) int {
+	return 2 + (include+exclude)*regionRectSize
+}
+
+// regionHeaderPixels returns the number of consecutive pixels a header with
+// a region record takes in channels c.
+func regionHeaderPixels(c Channels, include, exclude int) int {
+	return headerLayout(c).pixelsFor(HeaderSize + regionRecordSize(include, exclude))
+}
+
+// appendRegionRecord appends the region record of h to buf.
+func (h stegoHeader) appendRegionRecord(buf []byte) []byte {
+	buf = append(buf, byte(len(h.Regions)), byte(len(h.ExcludeRegions)))
+	for _, rs := range [][]image.Rectangle{h.Regions, h.ExcludeRegions} {
+		for _, r := range rs {
+			for _, v := range []int{r.Min.X, r.Min.Y, r.Dx(), r.Dy()} {
+				buf = binary.BigEndian.AppendUint16(buf, uint16(v))
+			}
+		}
+	}
+	return buf
+}
+
+// parseRegionRecord decodes the region record at the start of b into h.
+func (h *stegoHeader) parseRegionRecord(b []byte) error {
+	if len(b) < 2 || len(b) < regionRecordSize(int(b[0]), int(b[1])) {
+		return fmt.Errorf("stego region record truncated")
+	}
+	include, exclude := int(b[0]), int(b[1])
+	b = b[2:]
+	rects := make([]image.Rectangle, include+exclude)
+	for i := range rects {
+		v := func(j int) int { return int(binary.BigEndian.Uint16(b[i*regionRectSize+j*2:])) }
+		rects[i] = image.Rect(v(0), v(1), v(0)+v(2), v(1)+v(3))
+	}
+	h.Regions, h.ExcludeRegions = rects[:include:include], rects[include:]
+	return nil
+}
+
+// readStegoHeader reads the header of the given version carried by l,
+// including its region record if it has one.
+func readStegoHeader(img *image.NRGBA, l stegoLayout, version byte) (stegoHeader, error) {
+	h, err := parseStegoHeader(extractBits(img, l, 0, stegoHeaderSize(version)))
+	if err != nil || h.Version != Version || h.Flags&FlagRegion == 0 {
+		return h, err
+	}
+	counts := extractBits(img, l, HeaderSize, 2)
+	if len(counts) < 2 {
+		return h, fmt.Errorf("stego region record truncated")
+	}
+	record := extractBits(img, l, HeaderSize, regionRecordSize(int(counts[0]), int(counts[1])))
+	return h, h.parseRegionRecord(record)
+}
+
+// regionPixels returns the raster indices of the pixels of img inside one
+// of include, or anywhere when include is empty, and inside none of
+// exclude. Fully transparent pixels are left out when skipTransparent is
+// set.
+func regionPixels(img *image.NRGBA, include, exclude []image.Rectangle, skipTransparent bool) []int32 {
+	b := img.Bounds()
+	if len(include) == 0 {
+		include = []image.Rectangle{image.Rect(0, 0, b.Dx(), b.Dy())}
+	}
+	inAny := func(rs []image.Rectangle, p image.Point) bool {
+		for _, r := range rs {
+			if p.In(r) {
+				return true
+			}
+		}
+		return false
+	}
+	var pixels []int32
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			p := image.Pt(x, y)
+			if !inAny(include, p) || inAny(exclude, p) {
+				continue
+			}
+			if skipTransparent && img.Pix[img.PixOffset(b.Min.X+x, b.Min.Y+y)+3] == 0 {
+				continue
+			}
+			pixels = append(pixels, int32(y*b.Dx()+x))
+		}
+	}
+	return pixels
+}
+
+// regionHeaderBlock returns the raster indices of the first n pixels of the
+// header block whose top-left pixel has raster index at in an image with
+// bounds b, or nil if the block does not fit.
+func regionHeaderBlock(b image.Rectangle, at, n int) []int32 {
+	x, y := at%b.Dx(), at/b.Dx()
+	if x+regionHeaderWidth > b.Dx() || y+(n+regionHeaderWidth-1)/regionHeaderWidth > b.Dy() {
+		return nil
+	}
+	block := make([]int32, n)
+	for i := range block {
+		block[i] = int32(at + i/regionHeaderWidth*b.Dx() + i%regionHeaderWidth)
+	}
+	return block
+}
+
+// regionLayouts returns the header and body layouts of a payload with the
+// given regions: the header in the first header block of headerPixels
+// allowed pixels, and the body over the other allowed pixels.
+func regionLayouts(img *image.NRGBA, include, exclude []image.Rectangle, skipTransparent bool, c Channels, headerPixels int) (hl, bl stegoLayout, err error) {
+	b := img.Bounds()
+	pixels := regionPixels(img, include, exclude, skipTransparent)
+	allowed := make([]bool, b.Dx()*b.Dy())
+	for _, p := range pixels {
+		allowed[p] = true
+	}
+	var block []int32
+	for _, p := range pixels {
+		if block = regionHeaderBlock(b, int(p), headerPixels); block == nil {
+			continue
+		}
+		for _, q := range block {
+			if !allowed[q] {
+				block = nil
+				break
+			}
+		}
+		if block != nil {
+			break
+		}
+	}
+	if block == nil {
+		return hl, bl, fmt.Errorf("the regions have no %d pixel wide area tall enough for the payload header: %w", regionHeaderWidth, ErrPayloadTooLarge)
+	}
+
+	for _, q := range block {
+		allowed[q] = false
+	}
+	body := make([]int32, 0, len(pixels)-len(block))
+	for _, p := range pixels {
+		if allowed[p] {
+			body = append(body, p)
+		}
+	}
+	hl = headerLayout(c)
+	hl.pixels = block
+	return hl, stegoLayout{channels: c.offsets(), pixels: body}, nil
+}
+
+// regionProbe matches the magic and version of a region header in the low
+// bits of a header block in one channel mask: nibbles holds the low bits
+// each pixel of the block must have, care the bits that matter, and offsets
+// where the pixel lies from the top-left of the block.
+type regionProbe struct {
+	mask          Channels
+	nibbles, care []byte
+	offsets       []int
+	rows          int
+}
+
+// newRegionProbe returns the probe for want in mask in an image w pixels
+// wide.
+func newRegionProbe(want []byte, mask Channels, w int) regionProbe {
+	channels := mask.offsets()
+	bpp := len(channels)
+	n := (len(want)*8 + bpp - 1) / bpp
+	pr := regionProbe{mask: mask, nibbles: make([]byte, n), care: make([]byte, n), offsets: make([]int, n)}
+	for i := 0; i < len(want)*8; i++ {
+		k := i / bpp
+		pr.nibbles[k] |= want[i/8] >> (7 - i%8) & 1 << channels[i%bpp]
+		pr.care[k] |= 1 << channels[i%bpp]
+	}
+	for k := range pr.offsets {
+		pr.offsets[k] = k/regionHeaderWidth*w + k%regionHeaderWidth
+	}
+	pr.rows = (n + regionHeaderWidth - 1) / regionHeaderWidth
+	return pr
+}
+
+// matches reports whether the low bits at pixel p of lsb fit the probe from
+// its pixel from on.
+func (pr regionProbe) matches(lsb []byte, p, from int) bool {
+	for k := from; k < len(pr.offsets); k++ {
+		if (lsb[p+pr.offsets[k]]^pr.nibbles[k])&pr.care[k] != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// findRegionHeader looks for a version 5 header with a region record in a
+// header block at any pixel of img, in each channel mask. The low bits of
+// the first two pixels of a block select the masks whose magic they could
+// start, which rules out almost every position with a single lookup.
+func findRegionHeader(img *image.NRGBA) (stegoLayout, []byte, bool) {
+	b := img.Bounds()
+	w := b.Dx()
+	if w < regionHeaderWidth {
+		return stegoLayout{}, nil, false
+	}
+	lsb := make([]byte, 0, w*b.Dy())
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		row := img.Pix[img.PixOffset(b.Min.X, y) : img.PixOffset(b.Min.X, y)+w*4]
+		for x := 0; x < len(row); x += 4 {
+			lsb = append(lsb, row[x]&1|row[x+1]&1<<1|row[x+2]&1<<2|row[x+3]&1<<3)
+		}
+	}
+
+	want := append(append([]byte{}, stegoMagic...), Version)
+	var starts [256][]*regionProbe
+	for _, mask := range stegoHeaderMasks {
+		pr := newRegionProbe(want, mask, w)
+		for key := range starts {
+			if (byte(key)^pr.nibbles[0])&pr.care[0] == 0 && (byte(key>>4)^pr.nibbles[1])&pr.care[1] == 0 {
+				starts[key] = append(starts[key], &pr)
+			}
+		}
+	}
+
+	for y := 0; y < b.Dy(); y++ {
+		for p := y * w; p <= y*w+w-regionHeaderWidth; p++ {
+			for _, pr := range starts[lsb[p]|lsb[p+1]<<4] {
+				if y+pr.rows > b.Dy() || !pr.matches(lsb, p, 2) {
+					continue
+				}
+				l := headerLayout(pr.mask)
+				l.pixels = regionHeaderBlock(b, p, (b.Dy()-y)*regionHeaderWidth)
+				h, err := parseStegoHeader(extractBits(img, l, 0, HeaderSize))
+				if err == nil && h.Flags&FlagRegion != 0 && Channels(h.Layout&stegoLayoutChannels) == pr.mask {
+					return l, want, true
+				}
+			}
+		}
+	}
+	return stegoLayout{}, nil, false
+}
@@ -0,0 +1,117 @@
+package stego
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"testing"
+)
+
+func TestRegionRoundTrip(t *testing.T) {
+	include := []image.Rectangle{image.Rect(200, 200, 320, 280), image.Rect(100, 300, 160, 360)}
+	exclude := []image.Rectangle{image.Rect(250, 220, 270, 240)}
+	allowed := func(p image.Point) bool {
+		return (p.In(include[0]) || p.In(include[1])) && !p.In(exclude[0])
+	}
+	for _, tc := range []struct {
+		name string
+		opts options
+	}{
+		{"sequential", options{Density: 2}},
+		{"encrypted", options{Density: 1, Password: "faces"}},
+		{"adaptive", options{Density: 1, Adaptive: true}},
+	} {
+		cover := newTexturedNRGBA(640, 480)
+		img := image.NewNRGBA(cover.Rect)
+		copy(img.Pix, cover.Pix)
+		opts := tc.opts
+		opts.Regions, opts.ExcludeRegions = include, exclude
+
+		capacity := imageCapacity(img, opts)
+		if full := imageCapacity(img, tc.opts); capacity <= 0 || capacity >= full/2 {
+			t.Fatalf("%s: region capacity %d, want a small part of %d", tc.name, capacity, full)
+		}
+		overhead, _, _ := PayloadSize(Payload{}, withOptions(opts))
+		message := bytes.Repeat([]byte("R"), capacity-overhead)
+		if err := hideInImage(img, Payload{Data: message}, opts); err != nil {
+			t.Fatalf("%s: hideInImage failed: %v", tc.name, err)
+		}
+
+		b := img.Bounds()
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				if allowed(image.Pt(x, y)) {
+					continue
+				}
+				if o := img.PixOffset(x, y); !bytes.Equal(img.Pix[o:o+4], cover.Pix[o:o+4]) {
+					t.Fatalf("%s: pixel (%d, %d) outside the regions changed", tc.name, x, y)
+				}
+			}
+		}
+
+		got, err := revealFromImage(img, options{Password: tc.opts.Password})
+		if err != nil {
+			t.Fatalf("%s: revealFromImage failed: %v", tc.name, err)
+		}
+		if !bytes.Equal(got.Data, message) {
+			t.Errorf("%s: region payload did not round trip", tc.name)
+		}
+		if v := HeaderVersion(img); v != Version {
+			t.Errorf("%s: HeaderVersion = %d, want %d", tc.name, v, Version)
+		}
+
+		if err := hideInImage(img, Payload{Data: append(message, 'R')}, opts); !errors.Is(err, ErrPayloadTooLarge) {
+			t.Errorf("%s: hiding past the region capacity error = %v, want ErrPayloadTooLarge", tc.name, err)
+		}
+	}
+}
+
+func TestRegionTransparent(t *testing.T) {
+	img := newTransparentNRGBA(80, 40)
+	// The region straddles the transparent margin; only its visible part
+	// is used.
+	opts := options{Density: 1, SkipTransparent: true, Regions: []image.Rectangle{image.Rect(40, 0, 70, 30)}}
+	if err := hideInImage(img, Payload{Data: []byte("inside the logo")}, opts); err != nil {
+		t.Fatalf("hideInImage failed: %v", err)
+	}
+	zeroTransparent(img)
+	got, err := revealFromImage(img, options{})
+	if err != nil || string(got.Data) != "inside the logo" {
+		t.Errorf("revealFromImage = %q, %v", got.Data, err)
+	}
+}
+
+func TestRegionErrors(t *testing.T) {
+	for _, s := range []string{"1,2,3", "1,2,0,4", "a,2,3,4", "-1,2,3,4"} {
+		if _, err := ParseRegion(s); err == nil {
+			t.Errorf("ParseRegion(%q) succeeded", s)
+		}
+	}
+	if r, err := ParseRegion("5, 6,7,8"); err != nil || r != image.Rect(5, 6, 12, 14) {
+		t.Errorf("ParseRegion = %v, %v", r, err)
+	}
+
+	region := []image.Rectangle{image.Rect(0, 0, 32, 32)}
+	for name, opts := range map[string]options{
+		"out of bounds": {Density: 1, Regions: []image.Rectangle{image.Rect(50, 50, 70, 70)}},
+		"empty":         {Density: 1, Regions: region, ExcludeRegions: region},
+		"too narrow":    {Density: 1, Regions: []image.Rectangle{image.Rect(0, 0, 2, 64)}},
+	} {
+		img := newTestNRGBA(64, 64)
+		want := append([]byte(nil), img.Pix...)
+		if err := hideInImage(img, Payload{Data: []byte("hi")}, opts); err == nil {
+			t.Errorf("%s: hideInImage succeeded", name)
+		}
+		if !bytes.Equal(img.Pix, want) {
+			t.Errorf("%s: the image changed before the error", name)
+		}
+	}
+
+	opts := options{Density: 1, Password: "pw", Scatter: true, Regions: region}
+	if err := opts.validate(); err == nil {
+		t.Error("validate accepted regions with scatter")
+	}
+	if _, err := Capacity(newTestNRGBA(16, 16), WithRegions(region...)); err == nil {
+		t.Error("Capacity accepted a region outside the image")
+	}
+}
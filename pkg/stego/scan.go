@@ -0,0 +1,285 @@
+package stego
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"runtime"
+	"sync"
+
+	"github.com/Amul-Thantharate/pixellock/pkg/internal/scatter"
+)
+
+// Layouts a ScanCandidate can be found in.
+const (
+	// ScanHeader is a payload behind a pixellock header, opened and
+	// checked the way reveal does.
+	ScanHeader = "header"
+	// ScanTerminated is null-terminated text read with a density and
+	// channel mask from the first pixel, or in a scatter order, as simple
+	// LSB tools write it.
+	ScanTerminated = "terminated"
+	// ScanLegacy is null-terminated text in the version 1 layout.
+	ScanLegacy = "legacy"
+)
+
+// DefaultScanMinText is the share of printable bytes a candidate without a
+// pixellock header needs by default.
+const DefaultScanMinText = 0.95
+
+const (
+	// scanMinTextLength is the shortest text reported, as shorter runs of
+	// printable bytes turn up by chance.
+	scanMinTextLength = 8
+	// scanMaxText caps how much of a headerless candidate is read.
+	scanMaxText = 64 << 10
+)
+
+// ScanOptions controls Scan.
+type ScanOptions struct {
+	Passwords []string // Passwords to try for scattered and encrypted payloads, besides none
+	Workers   int      // Combinations tried concurrently; runtime.NumCPU() when 0
+	MinText   float64  // Printable share a headerless candidate needs; DefaultScanMinText when 0
+
+	// Progress, when set, is called after each combination is tried with
+	// the number done so far and the total. Calls never overlap.
+	Progress func(done, total int)
+}
+
+// ScanCandidate is a possible payload found by Scan.
+type ScanCandidate struct {
+	Layout          string // ScanHeader, ScanTerminated or ScanLegacy
+	Density         int
+	Channels        Channels
+	SkipTransparent bool
+	Scattered       bool
+	Password        string  // Password that found or decrypted it, if any
+	TextScore       float64 // Share of printable bytes, for headerless candidates
+	Payload         Payload
+
+	// Err tells why a payload behind a header could not be opened, such as
+	// ErrPayloadEncrypted when none of the passwords fits.
+	Err error
+}
+
+// Verified reports whether the candidate carries a pixellock header and
+// passed its checksum.
+func (c ScanCandidate) Verified() bool {
+	return c.Layout == ScanHeader && c.Err == nil
+}
+
+// Scan searches img for payloads hidden with unknown parameters. It
+// looks for a pixellock header with no password and with each of
+// opts.Passwords, and for null-terminated text under every density, channel
+// mask, set of pixels and pixel order (sequential, and scattered with each
+// password), plus the version 1 layout. Headerless text counts when at
+// least opts.MinText of it is printable. Candidates are returned in that
+// order, each distinct payload once.
+func Scan(img image.Image, opts ScanOptions) []ScanCandidate {
+	nrgbaImg := asNRGBA(img)
+	minText := opts.MinText
+	if minText == 0 {
+		minText = DefaultScanMinText
+	}
+	b := nrgbaImg.Bounds()
+
+	secrets := append([]string{""}, opts.Passwords...)
+	seeds := make([]*[32]byte, len(secrets))
+	runParallel(len(secrets)-1, opts.Workers, func(i int) {
+		if seed, err := scatterSeed(options{Password: secrets[i+1]}); err == nil {
+			seeds[i+1] = &seed
+		}
+	})
+
+	sets := []pixelSet{{}}
+	if hasTransparentPixels(nrgbaImg) {
+		sets = append(sets, pixelSet{pixels: visiblePixels(nrgbaImg), skipped: true})
+	}
+
+	var jobs []func() []ScanCandidate
+	for _, password := range secrets {
+		jobs = append(jobs, func() []ScanCandidate {
+			return scanHeader(nrgbaImg, password)
+		})
+	}
+	jobs = append(jobs, func() []ScanCandidate {
+		return scanText(revealLegacy(nrgbaImg), minText, ScanCandidate{Layout: ScanLegacy, Density: 1, Channels: ChannelsRGBA})
+	})
+	for i, seed := range seeds {
+		if i > 0 && seed == nil {
+			continue
+		}
+		for _, set := range sets {
+			for density := 1; density <= 4; density++ {
+				for _, mask := range stegoHeaderMasks {
+					jobs = append(jobs, func() []ScanCandidate {
+						l := stegoLayout{channels: mask.offsets(), density: density, pixels: set.pixels}
+						c := ScanCandidate{Layout: ScanTerminated, Density: density, Channels: mask, SkipTransparent: set.skipped}
+						if seed != nil {
+							l.order = scatter.New(*seed, set.len(b))
+							c.Scattered, c.Password = true, secrets[i]
+						}
+						return scanText(scanTerminated(nrgbaImg, l, minText), minText, c)
+					})
+				}
+			}
+		}
+	}
+
+	found := make([][]ScanCandidate, len(jobs))
+	var mu sync.Mutex
+	done := 0
+	runParallel(len(jobs), opts.Workers, func(i int) {
+		found[i] = jobs[i]()
+		if opts.Progress != nil {
+			mu.Lock()
+			done++
+			opts.Progress(done, len(jobs))
+			mu.Unlock()
+		}
+	})
+
+	var candidates []ScanCandidate
+	for _, cs := range found {
+		for _, c := range cs {
+			if !containsCandidate(candidates, c) {
+				candidates = append(candidates, c)
+			}
+		}
+	}
+	return dropUnopened(candidates)
+}
+
+// scanHeader looks for a pixellock header with password, or with no secret
+// when it is empty. With a password only payloads it decrypts, or scattered
+// ones it finds, are returned; the rest are found without it.
+func scanHeader(img *image.NRGBA, password string) []ScanCandidate {
+	opts := options{Password: password}
+	hl, prefix, err := findStegoHeader(img, opts)
+	if err != nil || !hasMagic(prefix) {
+		return nil
+	}
+	c := ScanCandidate{Layout: ScanHeader, Density: 1, Channels: ChannelsRGBA, Scattered: hl.order != nil, Password: password}
+	if version := prefix[len(stegoMagic)]; version != VersionTerminated {
+		if h, err := parseStegoHeader(extractBits(img, hl, 0, stegoHeaderSize(version))); err == nil {
+			o := optionsFromHeader(h)
+			c.Density, c.Channels, c.SkipTransparent = o.Density, o.Channels, o.SkipTransparent
+		}
+	}
+	c.Payload, c.Err = revealFromImage(img, opts)
+	if password != "" && c.Err != nil && !c.Scattered {
+		return nil // A wrong guess at the password of a sequential payload
+	}
+	return []ScanCandidate{c}
+}
+
+// scanTerminated reads null-terminated text in layout l, giving up as soon
+// as the bytes read so far fall short of minText.
+func scanTerminated(img *image.NRGBA, l stegoLayout, minText float64) []byte {
+	const chunkSize = 256
+	var data []byte
+	for off := 0; off < scanMaxText; off += chunkSize {
+		chunk := extractBits(img, l, off, chunkSize)
+		if i := bytes.IndexByte(chunk, 0); i >= 0 {
+			return append(data, chunk[:i]...)
+		}
+		data = append(data, chunk...)
+		if len(chunk) < chunkSize || textScore(data) < minText {
+			return nil
+		}
+	}
+	return nil
+}
+
+// scanText returns c carrying data when data looks like text.
+func scanText(data []byte, minText float64, c ScanCandidate) []ScanCandidate {
+	if len(data) < scanMinTextLength || 3*maxByteCount(data) > len(data) {
+		return nil // A few repeating values come from smooth areas, not text
+	}
+	if c.TextScore = textScore(data); c.TextScore < minText {
+		return nil
+	}
+	c.Payload = Payload{Data: data}
+	return []ScanCandidate{c}
+}
+
+// textScore returns the share of data that is printable ASCII or white
+// space.
+func textScore(data []byte) float64 {
+	if len(data) == 0 {
+		return 0
+	}
+	printable := 0
+	for _, b := range data {
+		if b >= 0x20 && b < 0x7f || b == '\t' || b == '\n' || b == '\r' {
+			printable++
+		}
+	}
+	return float64(printable) / float64(len(data))
+}
+
+// maxByteCount returns how often the most frequent byte occurs in data.
+func maxByteCount(data []byte) int {
+	var counts [256]int
+	n := 0
+	for _, b := range data {
+		counts[b]++
+		n = max(n, counts[b])
+	}
+	return n
+}
+
+// containsCandidate reports whether cs already holds the payload of c.
+func containsCandidate(cs []ScanCandidate, c ScanCandidate) bool {
+	for _, other := range cs {
+		if other.Layout == c.Layout && other.Err == nil && c.Err == nil && bytes.Equal(other.Payload.Data, c.Payload.Data) {
+			return true
+		}
+	}
+	return false
+}
+
+// dropUnopened removes the encrypted sequential header candidate found
+// without a password when one of the passwords opened it.
+func dropUnopened(cs []ScanCandidate) []ScanCandidate {
+	opened := false
+	for _, c := range cs {
+		if c.Verified() && !c.Scattered && c.Password != "" {
+			opened = true
+		}
+	}
+	if !opened {
+		return cs
+	}
+	kept := cs[:0]
+	for _, c := range cs {
+		if !(c.Layout == ScanHeader && !c.Scattered && errors.Is(c.Err, ErrPayloadEncrypted)) {
+			kept = append(kept, c)
+		}
+	}
+	return kept
+}
+
+// runParallel calls fn with each of 0 to n-1 on a pool of workers;
+// runtime.NumCPU() of them when workers is 0.
+func runParallel(n, workers int, fn func(i int)) {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < min(workers, n); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				fn(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+}
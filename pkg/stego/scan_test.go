@@ -0,0 +1,85 @@
+package stego
+
+import (
+	"bytes"
+	"image"
+	"testing"
+)
+
+func TestScanStego(t *testing.T) {
+	// A plain LSB tool writing null-terminated text with density 3 in the
+	// red and green channels, no pixellock header.
+	raw := newTexturedNRGBA(320, 240)
+	text := []byte("meet at the usual place at noon\x00")
+	embedBits(raw, stegoLayout{channels: (ChannelR | ChannelG).offsets(), density: 3}, text)
+
+	header := newTexturedNRGBA(320, 240)
+	if err := hideInImage(header, Payload{Data: binaryFixture(), Filename: "a.bin"}, options{Density: 2, Channels: ChannelB}); err != nil {
+		t.Fatalf("hideInImage failed: %v", err)
+	}
+
+	scattered := newTexturedNRGBA(320, 240)
+	secret := []byte("scattered and encrypted")
+	if err := hideInImage(scattered, Payload{Data: secret}, options{Density: 1, Password: "tiger", Scatter: true}); err != nil {
+		t.Fatalf("hideInImage failed: %v", err)
+	}
+
+	opts := ScanOptions{Passwords: []string{"lion", "tiger"}, Workers: 4}
+	for _, tc := range []struct {
+		name string
+		img  *image.NRGBA
+		want ScanCandidate
+	}{
+		{"raw", raw, ScanCandidate{Layout: ScanTerminated, Density: 3, Channels: ChannelR | ChannelG, Payload: Payload{Data: text[:len(text)-1]}}},
+		{"header", header, ScanCandidate{Layout: ScanHeader, Density: 2, Channels: ChannelB, Payload: Payload{Data: binaryFixture(), Filename: "a.bin"}}},
+		{"scattered", scattered, ScanCandidate{Layout: ScanHeader, Density: 1, Channels: ChannelsRGB, Scattered: true, Password: "tiger", Payload: Payload{Data: secret}}},
+	} {
+		calls := 0
+		opts.Progress = func(done, total int) {
+			calls++
+			if done != calls || done > total {
+				t.Errorf("%s: progress %d of %d after %d calls", tc.name, done, total, calls)
+			}
+		}
+		found := Scan(tc.img, opts)
+		if calls == 0 {
+			t.Errorf("%s: no progress reported", tc.name)
+		}
+		if len(found) != 1 {
+			t.Fatalf("%s: found %d candidates, want 1: %+v", tc.name, len(found), found)
+		}
+		got, want := found[0], tc.want
+		if got.Layout != want.Layout || got.Density != want.Density || got.Channels != want.Channels ||
+			got.Scattered != want.Scattered || got.Password != want.Password || got.Err != nil {
+			t.Errorf("%s: found %s density %d channels %s scattered %v password %q err %v, want %+v",
+				tc.name, got.Layout, got.Density, got.Channels, got.Scattered, got.Password, got.Err, want)
+		}
+		if !bytes.Equal(got.Payload.Data, want.Payload.Data) || got.Payload.Filename != want.Payload.Filename {
+			t.Errorf("%s: found payload %q, want %q", tc.name, got.Payload.Data, want.Payload.Data)
+		}
+	}
+}
+
+func TestScanStegoClean(t *testing.T) {
+	opts := ScanOptions{Passwords: []string{"lion", "tiger"}}
+	for name, img := range map[string]*image.NRGBA{"photo": newTexturedNRGBA(320, 240), "flat": newTestNRGBA(64, 64), "transparent": newTransparentNRGBA(64, 64)} {
+		if found := Scan(img, opts); len(found) != 0 {
+			t.Errorf("%s: clean image yields %d candidates: %+v", name, len(found), found)
+		}
+	}
+}
+
+func TestScanStegoEncrypted(t *testing.T) {
+	img := newTexturedNRGBA(320, 240)
+	if err := hideInImage(img, Payload{Data: []byte("locked")}, options{Density: 1, Password: "tiger"}); err != nil {
+		t.Fatalf("hideInImage failed: %v", err)
+	}
+	found := Scan(img, ScanOptions{Passwords: []string{"lion"}})
+	if len(found) != 1 || found[0].Verified() || found[0].Err == nil {
+		t.Fatalf("without the password: %+v, want one unopened header", found)
+	}
+	found = Scan(img, ScanOptions{Passwords: []string{"lion", "tiger"}})
+	if len(found) != 1 || !found[0].Verified() || found[0].Password != "tiger" || string(found[0].Payload.Data) != "locked" {
+		t.Errorf("with the password: %+v, want the opened payload", found)
+	}
+}
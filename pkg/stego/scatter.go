@@ -0,0 +1,42 @@
+package stego
+
+import (
+	"crypto/pbkdf2"
+	"crypto/sha256"
+	"fmt"
+
+	"github.com/Amul-Thantharate/pixellock/pkg/internal/scatter"
+)
+
+// scatterSalt separates the scatter seed from keys derived from the same
+// password for other purposes. It has to be fixed: reveal needs the seed
+// before it can read anything from the image.
+var scatterSalt = []byte("pixellock scatter")
+
+// scatterSeed derives the permutation seed from the password or key in opts.
+func scatterSeed(opts options) ([32]byte, error) {
+	var seed [32]byte
+	switch {
+	case opts.Password != "":
+		key, err := pbkdf2.Key(sha256.New, opts.Password, scatterSalt, kdfIterations, len(seed))
+		if err != nil {
+			return seed, fmt.Errorf("failed to derive scatter seed: %w", err)
+		}
+		copy(seed[:], key)
+	case opts.Key != nil:
+		seed = sha256.Sum256(append(append([]byte{}, scatterSalt...), opts.Key...))
+	default:
+		return seed, fmt.Errorf("scatter requires a key or password")
+	}
+	return seed, nil
+}
+
+// newScatterOrder returns the pseudorandom order of pixels pixels derived
+// from the key or password in opts.
+func newScatterOrder(opts options, pixels int) (*scatter.Order, error) {
+	seed, err := scatterSeed(opts)
+	if err != nil {
+		return nil, err
+	}
+	return scatter.New(seed, pixels), nil
+}
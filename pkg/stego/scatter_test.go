@@ -0,0 +1,86 @@
+package stego
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestScatterOrderIsPermutation(t *testing.T) {
+	const n = 1000
+	order, err := newScatterOrder(options{Key: make([]byte, keySize)}, n)
+	if err != nil {
+		t.Fatalf("newScatterOrder failed: %v", err)
+	}
+	seen := make([]bool, n)
+	sequential := 0
+	for i := 0; i < n; i++ {
+		p := order.At(i)
+		if p < 0 || p >= n || seen[p] {
+			t.Fatalf("position %d maps to %d, which is out of range or repeated", i, p)
+		}
+		seen[p] = true
+		if p == i {
+			sequential++
+		}
+	}
+	if sequential > n/10 {
+		t.Errorf("%d of %d positions unmoved, order is not scattered", sequential, n)
+	}
+}
+
+func TestScatterRoundTrip(t *testing.T) {
+	key := randomKey(t)
+	secrets := []options{
+		{Density: 1, Scatter: true, Password: "correct horse battery staple"},
+		{Density: 2, Scatter: true, Key: key},
+		{Density: 1, Scatter: true, Channels: ChannelsRGBA, Key: key},
+	}
+	for _, opts := range secrets {
+		img := newTestNRGBA(64, 64)
+		p := Payload{Data: binaryFixture(), Filename: "notes.bin"}
+		if err := hideInImage(img, p, opts); err != nil {
+			t.Fatalf("%+v: hideInImage failed: %v", opts, err)
+		}
+		if _, prefix, _ := findStegoHeader(img, options{}); hasMagic(prefix) {
+			t.Errorf("%+v: scattered payload header is at the start of the image", opts)
+		}
+
+		reveal := options{Density: 1, Key: opts.Key, Password: opts.Password}
+		got, err := revealFromImage(img, reveal)
+		if err != nil {
+			t.Fatalf("%+v: revealFromImage failed: %v", opts, err)
+		}
+		if got.Filename != p.Filename || !bytes.Equal(got.Data, p.Data) {
+			t.Errorf("%+v: scattered payload did not round trip", opts)
+		}
+	}
+}
+
+func TestScatterWrongSecret(t *testing.T) {
+	img := newTestNRGBA(64, 64)
+	message := []byte("meet at the usual place")
+	if err := hideInImage(img, Payload{Data: message}, options{Density: 1, Scatter: true, Password: "hunter2"}); err != nil {
+		t.Fatalf("hideInImage failed: %v", err)
+	}
+
+	if _, err := revealFromImage(img, options{Density: 1, Password: "hunter3"}); !errors.Is(err, ErrNoPayload) {
+		t.Errorf("reveal with wrong password error = %v, want ErrNoPayload", err)
+	}
+	wrongKey := randomKey(t)
+	if _, err := revealFromImage(img, options{Density: 1, Key: wrongKey}); !errors.Is(err, ErrNoPayload) {
+		t.Errorf("reveal with wrong key error = %v, want ErrNoPayload", err)
+	}
+
+	// Without a secret the sequential reader only finds noise.
+	got, err := revealFromImage(img, defaultOptions)
+	if err == nil && bytes.Contains(got.Data, message) {
+		t.Error("scattered message revealed without the password")
+	}
+}
+
+func TestScatterRequiresSecret(t *testing.T) {
+	if err := (options{Density: 1, Scatter: true}).validate(); err == nil {
+		t.Error("Validate accepted scatter without a key or password")
+	}
+}
@@ -0,0 +1,201 @@
+package stego
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"strings"
+)
+
+// ErrMissingFragment is returned when a split payload cannot be reassembled
+// because some of its fragments were not supplied.
+var ErrMissingFragment = errors.New("missing payload fragment")
+
+// fragmentHeaderSize is the size of the fragment header at the start of a
+// fragment body: set ID, uint16 index, uint16 count and the payload flags.
+const fragmentHeaderSize = 8 + 2 + 2 + 1
+
+// maxFragments bounds the number of covers a payload can be split across.
+const maxFragments = 0xffff
+
+// payloadFragment is one piece of a payload split across several images.
+// The payload is encoded and sealed once, as for a single image, and the
+// resulting body is cut into consecutive fragments.
+type payloadFragment struct {
+	setID [8]byte // Random ID shared by all fragments of one payload
+	index int     // Position of this fragment, from 0
+	total int     // Number of fragments in the set
+	flags byte    // Header flags of the whole payload
+	data  []byte
+}
+
+func (f *payloadFragment) marshal() []byte {
+	buf := make([]byte, 0, fragmentHeaderSize+len(f.data))
+	buf = append(buf, f.setID[:]...)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(f.index))
+	buf = binary.BigEndian.AppendUint16(buf, uint16(f.total))
+	buf = append(buf, f.flags)
+	return append(buf, f.data...)
+}
+
+func parseFragment(body []byte) (*payloadFragment, error) {
+	if len(body) < fragmentHeaderSize {
+		return nil, fmt.Errorf("payload fragment truncated")
+	}
+	f := &payloadFragment{
+		index: int(binary.BigEndian.Uint16(body[8:])),
+		total: int(binary.BigEndian.Uint16(body[10:])),
+		flags: body[12],
+		data:  body[fragmentHeaderSize:],
+	}
+	copy(f.setID[:], body)
+	if f.total == 0 || f.index >= f.total {
+		return nil, fmt.Errorf("invalid payload fragment %d of %d", f.index+1, f.total)
+	}
+	return f, nil
+}
+
+// set identifies the set of f in error messages.
+func (f *payloadFragment) set() string {
+	return hex.EncodeToString(f.setID[:])
+}
+
+// assembleFragments joins the fragments of one payload, in any order, and
+// decodes the result.
+func assembleFragments(fragments []*payloadFragment, opts options) (Payload, error) {
+	sets := make(map[[8]byte][]*payloadFragment)
+	for _, f := range fragments {
+		sets[f.setID] = append(sets[f.setID], f)
+	}
+	if len(sets) > 1 {
+		return Payload{}, fmt.Errorf("inputs hold fragments of %d different payloads", len(sets))
+	}
+
+	first := fragments[0]
+	ordered := make([]*payloadFragment, first.total)
+	for _, f := range fragments {
+		if f.total != first.total || f.flags != first.flags {
+			return Payload{}, fmt.Errorf("fragments of set %s disagree about the payload", first.set())
+		}
+		ordered[f.index] = f
+	}
+
+	var missing []string
+	var body []byte
+	for i, f := range ordered {
+		if f == nil {
+			missing = append(missing, fmt.Sprint(i+1))
+			continue
+		}
+		body = append(body, f.data...)
+	}
+	if len(missing) > 0 {
+		return Payload{}, fmt.Errorf("%w: fragment %s of %d from set %s", ErrMissingFragment, strings.Join(missing, ", "), first.total, first.set())
+	}
+
+	return openPayload(first.flags, body, opts)
+}
+
+// hideSplit hides p across as many of covers as it needs, in order, and
+// returns the indexes of the covers used, in fragment order. Each cover
+// gets one fragment, filling it to capacity; covers too small to hold a
+// fragment are skipped.
+func hideSplit(covers []*image.NRGBA, p Payload, opts options) ([]int, error) {
+	flags, body, err := sealPayload(p, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	// Plan the split before embedding, since every fragment records the
+	// total count.
+	var parts [][]byte
+	var used []int
+	available := 0
+	remaining := body
+	for i, img := range covers {
+		if len(remaining) == 0 {
+			break
+		}
+		n := min(opts.fillLimit(imageCapacity(img, opts))-fragmentHeaderSize, len(remaining))
+		if n <= 0 {
+			continue
+		}
+		available += n
+		parts = append(parts, remaining[:n])
+		used = append(used, i)
+		remaining = remaining[n:]
+	}
+	if len(remaining) > 0 {
+		return nil, fmt.Errorf("payload needs %d bytes but the %d covers hold %d: %w", len(body), len(covers), available, ErrPayloadTooLarge)
+	}
+	if len(parts) > maxFragments {
+		return nil, fmt.Errorf("payload would need %d covers, more than the maximum of %d", len(parts), maxFragments)
+	}
+
+	var setID [8]byte
+	if _, err := rand.Read(setID[:]); err != nil {
+		return nil, fmt.Errorf("failed to generate fragment set ID: %w", err)
+	}
+	for i, data := range parts {
+		f := &payloadFragment{setID: setID, index: i, total: len(parts), flags: flags, data: data}
+		img := covers[used[i]]
+		coverOpts := opts.forImage(img)
+		header, fragBody, err := frameBody(FlagFragment, coverOpts.layoutByte(), f.marshal(), imageCapacity(img, coverOpts))
+		if err != nil {
+			return nil, err
+		}
+		if err := embedFramed(img, header, fragBody, coverOpts); err != nil {
+			return nil, err
+		}
+	}
+	return used, nil
+}
+
+// EmbedSplit hides p across as many of covers as it needs, in order, and
+// returns copies of the covers used, in fragment order, along with their
+// indexes in covers. Each cover gets one fragment, filling it to capacity;
+// covers too small to hold a fragment are skipped. All fragments share one
+// channel layout, so grayscale covers come back in color.
+func EmbedSplit(covers []image.Image, p Payload, opts ...Option) ([]image.Image, []int, error) {
+	o := newOptions(opts)
+	if err := o.validate(); err != nil {
+		return nil, nil, err
+	}
+	images := make([]*image.NRGBA, len(covers))
+	for i, cover := range covers {
+		if is16Bit(cover) {
+			return nil, nil, fmt.Errorf("cover %d: %w", i, Err16BitCover)
+		}
+		images[i] = toNRGBA(cover)
+	}
+	used, err := hideSplit(images, p, o)
+	if err != nil {
+		return nil, nil, err
+	}
+	stegoImgs := make([]image.Image, len(used))
+	for i, c := range used {
+		stegoImgs[i] = images[c]
+	}
+	return stegoImgs, used, nil
+}
+
+// Assemble reassembles a payload split by EmbedSplit from its fragments,
+// as returned by ExtractPayload, in any order. It fails with
+// ErrMissingFragment, naming the missing fragments, when the set is
+// incomplete.
+func Assemble(fragments []Payload, opts ...Option) (Payload, error) {
+	if len(fragments) == 0 {
+		return Payload{}, fmt.Errorf("no fragments given")
+	}
+	fs := make([]*payloadFragment, len(fragments))
+	for i, p := range fragments {
+		if p.fragment == nil {
+			return Payload{}, fmt.Errorf("payload %d is not a fragment of a split payload", i)
+		}
+		fs[i] = p.fragment
+	}
+	return assembleFragments(fs, newOptions(opts))
+}
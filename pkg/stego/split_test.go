@@ -0,0 +1,90 @@
+package stego
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"math/rand/v2"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func splitFixture(t *testing.T, opts options) ([]*image.NRGBA, []int, Payload) {
+	t.Helper()
+	covers := []*image.NRGBA{newTestNRGBA(34, 34), newTestNRGBA(6, 6), newTestNRGBA(40, 20), newTestNRGBA(25, 25), newTestNRGBA(50, 50)}
+	data := bytes.Repeat(binaryFixture(), 3)[:750]
+	p := Payload{Data: data, Filename: "archive.tar"}
+	used, err := hideSplit(covers, p, opts)
+	if err != nil {
+		t.Fatalf("hideSplit failed: %v", err)
+	}
+	return covers, used, p
+}
+
+func revealFragments(t *testing.T, covers []*image.NRGBA, used []int, opts options) []*payloadFragment {
+	t.Helper()
+	var fragments []*payloadFragment
+	for _, i := range used {
+		p, err := revealFromImage(covers[i], opts)
+		if err != nil {
+			t.Fatalf("revealFromImage of cover %d failed: %v", i, err)
+		}
+		if p.fragment == nil {
+			t.Fatalf("cover %d does not hold a fragment", i)
+		}
+		fragments = append(fragments, p.fragment)
+	}
+	return fragments
+}
+
+func TestSplitAcrossCovers(t *testing.T) {
+	for _, opts := range []options{defaultOptions, {Density: 1, Password: "hunter2"}} {
+		covers, used, p := splitFixture(t, opts)
+		// The 6x6 cover is too small for a fragment and must be skipped; the
+		// payload needs the three covers after it.
+		if want := []int{0, 2, 3}; !slices.Equal(used, want) {
+			t.Fatalf("covers used = %v, want %v", used, want)
+		}
+
+		fragments := revealFragments(t, covers, used, opts)
+		rand.Shuffle(len(fragments), func(i, j int) { fragments[i], fragments[j] = fragments[j], fragments[i] })
+		got, err := assembleFragments(fragments, opts)
+		if err != nil {
+			t.Fatalf("assembleFragments failed: %v", err)
+		}
+		if got.Filename != p.Filename || !bytes.Equal(got.Data, p.Data) {
+			t.Error("split payload did not round trip")
+		}
+	}
+}
+
+func TestSplitMissingFragment(t *testing.T) {
+	covers, used, _ := splitFixture(t, defaultOptions)
+	fragments := revealFragments(t, covers, used, defaultOptions)
+
+	_, err := assembleFragments([]*payloadFragment{fragments[2], fragments[0]}, defaultOptions)
+	if !errors.Is(err, ErrMissingFragment) {
+		t.Fatalf("assembleFragments error = %v, want ErrMissingFragment", err)
+	}
+	if !strings.Contains(err.Error(), "fragment 2 of 3") {
+		t.Errorf("error %q does not name the missing fragment", err)
+	}
+}
+
+func TestSplitRejectsMixedSets(t *testing.T) {
+	a, usedA, _ := splitFixture(t, defaultOptions)
+	b, usedB, _ := splitFixture(t, defaultOptions)
+	fragments := append(revealFragments(t, a, usedA[:1], defaultOptions), revealFragments(t, b, usedB[1:], defaultOptions)...)
+	if _, err := assembleFragments(fragments, defaultOptions); err == nil || errors.Is(err, ErrMissingFragment) {
+		t.Errorf("assembleFragments of two sets error = %v, want a mixed set error", err)
+	}
+}
+
+func TestSplitTooLarge(t *testing.T) {
+	covers := []*image.NRGBA{newTestNRGBA(16, 16), newTestNRGBA(16, 16)}
+	_, err := hideSplit(covers, Payload{Data: make([]byte, 1000)}, defaultOptions)
+	if !errors.Is(err, ErrPayloadTooLarge) {
+		t.Errorf("hideSplit error = %v, want ErrPayloadTooLarge", err)
+	}
+}
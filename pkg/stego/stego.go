@@ -0,0 +1,138 @@
+// Package stego hides payloads in the low bits of image pixels and extracts
+// them again. It is the engine behind the pixellock hide and reveal
+// commands, usable on its own: it works on decoded images in memory and
+// returns new ones, leaving decoding and encoding files to the caller.
+//
+// Every payload is framed by a header recording its length, checksum and
+// layout, so Extract needs no options beyond the key or password of an
+// encrypted payload:
+//
+//	stegoImg, err := stego.Embed(cover, []byte("secret"), stego.WithPassword("hunter2"))
+//	...
+//	data, err := stego.Extract(stegoImg, stego.WithPassword("hunter2"))
+//
+// Stego images must be saved in a lossless format such as PNG: lossy
+// compression destroys the low bits carrying the payload.
+package stego
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+)
+
+// cover is an image being embedded into, copied to non-premultiplied RGBA.
+type cover struct {
+	img  *image.NRGBA
+	gray bool // Whether the original was grayscale, and hides in red only
+}
+
+// newCover copies img for embedding. 16-bit images are refused, as the
+// copy would reduce them to 8 bits per channel.
+func newCover(img image.Image) (cover, error) {
+	if is16Bit(img) {
+		return cover{}, fmt.Errorf("%w: hiding would reduce the image to 8 bits per channel; convert it to 8 bits first", Err16BitCover)
+	}
+	return cover{img: toNRGBA(img), gray: img.ColorModel() == color.GrayModel}, nil
+}
+
+// options returns o adjusted to the color model of c.
+func (c cover) options(o options) options {
+	if c.gray {
+		return o.forGray()
+	}
+	return o
+}
+
+// image returns the embedded image, in the color model of the original.
+func (c cover) image() image.Image {
+	if c.gray {
+		return grayCover(c.img)
+	}
+	return c.img
+}
+
+// is16Bit reports whether img has 16 bits per channel.
+func is16Bit(img image.Image) bool {
+	switch img.ColorModel() {
+	case color.RGBA64Model, color.NRGBA64Model, color.Gray16Model:
+		return true
+	}
+	return false
+}
+
+// Embed returns a copy of img with data hidden in it, laid out and
+// protected as opts say. Grayscale images come back grayscale, with the
+// payload in their single channel, and everything else as *image.NRGBA. It
+// fails with ErrPayloadTooLarge rather than truncating.
+func Embed(img image.Image, data []byte, opts ...Option) (image.Image, error) {
+	return EmbedPayload(img, Payload{Data: data}, opts...)
+}
+
+// EmbedPayload is Embed for a Payload, which can also carry a file name.
+func EmbedPayload(img image.Image, p Payload, opts ...Option) (image.Image, error) {
+	o := newOptions(opts)
+	if err := o.validate(); err != nil {
+		return nil, err
+	}
+	c, err := newCover(img)
+	if err != nil {
+		return nil, err
+	}
+	if err := hideInImage(c.img, p, c.options(o)); err != nil {
+		return nil, err
+	}
+	return c.image(), nil
+}
+
+// Extract returns the data hidden in img by Embed. The layout is read from
+// the payload header; opts only need to carry the key or password of an
+// encrypted payload. Images without a payload get ErrNoPayload.
+func Extract(img image.Image, opts ...Option) ([]byte, error) {
+	p, err := ExtractPayload(img, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if _, _, ok := p.Fragment(); ok {
+		if p, err = Assemble([]Payload{p}, opts...); err != nil {
+			return nil, err
+		}
+	}
+	return p.Data, nil
+}
+
+// ExtractPayload is Extract returning the whole Payload. A fragment of a
+// payload split by EmbedSplit is returned as is, to be passed to Assemble
+// with the others.
+func ExtractPayload(img image.Image, opts ...Option) (Payload, error) {
+	return revealFromImage(asNRGBA(img), newOptions(opts))
+}
+
+// Capacity returns the largest payload, in bytes as reported by
+// PayloadSize, that Embed can hide in img with opts once the payload
+// header has been accounted for. It returns 0 when the image cannot even
+// hold the header.
+func Capacity(img image.Image, opts ...Option) (int, error) {
+	o := newOptions(opts)
+	o.Scatter = false // The pixel order does not change the capacity
+	if err := o.validate(); err != nil {
+		return 0, err
+	}
+	if img.ColorModel() == color.GrayModel {
+		o = o.forGray()
+	}
+	nrgbaImg := asNRGBA(img)
+	if err := o.forImage(nrgbaImg).checkRegions(nrgbaImg); err != nil {
+		return 0, err
+	}
+	return imageCapacity(nrgbaImg, o), nil
+}
+
+// HeaderVersion returns the format version of the payload header found in
+// img without a key or password, or 0 when there is none.
+func HeaderVersion(img image.Image) int {
+	if _, prefix, _ := findStegoHeader(asNRGBA(img), options{}); hasMagic(prefix) {
+		return int(prefix[len(stegoMagic)])
+	}
+	return 0
+}
@@ -0,0 +1,237 @@
+package stego
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestEmbedExtract(t *testing.T) {
+	data := binaryFixture()
+	for name, opts := range map[string][]Option{
+		"default":  nil,
+		"density":  {WithDensity(3), WithChannels(ChannelR | ChannelB)},
+		"password": {WithPassword("hunter2"), WithScatter(true)},
+		"compress": {WithCompression(true), WithDensity(2)},
+		"adaptive": {WithAdaptive(true), WithDensity(2)},
+		"region":   {WithRegions(image.Rect(8, 8, 120, 120))},
+		"max fill": {WithMaxFill(0.5), WithDensity(2)},
+		"opaque":   {WithSkipTransparent(false)},
+	} {
+		cover := newTexturedNRGBA(160, 160)
+		original := append([]byte(nil), cover.Pix...)
+		img, err := Embed(cover, data, opts...)
+		if err != nil {
+			t.Fatalf("%s: Embed failed: %v", name, err)
+		}
+		if !bytes.Equal(cover.Pix, original) {
+			t.Errorf("%s: Embed modified the cover", name)
+		}
+		if _, ok := img.(*image.NRGBA); !ok {
+			t.Errorf("%s: Embed returned %T, want *image.NRGBA", name, img)
+		}
+		got, err := Extract(img, opts...)
+		if err != nil {
+			t.Fatalf("%s: Extract failed: %v", name, err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("%s: payload did not round trip", name)
+		}
+		// A scattered header can only be found with the secret.
+		want := Version
+		if name == "password" {
+			want = 0
+		}
+		if v := HeaderVersion(img); v != want {
+			t.Errorf("%s: HeaderVersion = %d, want %d", name, v, want)
+		}
+	}
+}
+
+func TestExtractWrongPassword(t *testing.T) {
+	img, err := Embed(newTestNRGBA(64, 64), []byte("locked"), WithPassword("hunter2"))
+	if err != nil {
+		t.Fatalf("Embed failed: %v", err)
+	}
+	if _, err := Extract(img); !errors.Is(err, ErrPayloadEncrypted) {
+		t.Errorf("Extract without a password error = %v, want ErrPayloadEncrypted", err)
+	}
+	if _, err := Extract(img, WithPassword("hunter3")); !errors.Is(err, ErrAuthenticationFailed) {
+		t.Errorf("Extract with the wrong password error = %v, want ErrAuthenticationFailed", err)
+	}
+	if _, err := Extract(newTestNRGBA(64, 64)); !errors.Is(err, ErrNoPayload) {
+		t.Errorf("Extract of a clean image error = %v, want ErrNoPayload", err)
+	}
+}
+
+func TestEmbedGray(t *testing.T) {
+	cover := image.NewGray(image.Rect(0, 0, 80, 60))
+	for i := range cover.Pix {
+		cover.Pix[i] = uint8(i * 7)
+	}
+	opts := []Option{WithDensity(2)}
+	capacity, err := Capacity(cover, opts...)
+	if err != nil {
+		t.Fatalf("Capacity failed: %v", err)
+	}
+	red, _ := Capacity(newTestNRGBA(80, 60), WithDensity(2), WithChannels(ChannelR))
+	if capacity != red {
+		t.Errorf("gray capacity = %d, want the red channel's %d", capacity, red)
+	}
+
+	data := bytes.Repeat([]byte("gray"), capacity/8)
+	img, err := Embed(cover, data, opts...)
+	if err != nil {
+		t.Fatalf("Embed failed: %v", err)
+	}
+	if _, ok := img.(*image.Gray); !ok {
+		t.Fatalf("Embed returned %T, want *image.Gray", img)
+	}
+	if got, err := Extract(img); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("Extract = %d bytes, %v", len(got), err)
+	}
+}
+
+func TestEmbedRefuses16Bit(t *testing.T) {
+	for _, img := range []image.Image{
+		image.NewNRGBA64(image.Rect(0, 0, 32, 32)),
+		image.NewRGBA64(image.Rect(0, 0, 32, 32)),
+		image.NewGray16(image.Rect(0, 0, 32, 32)),
+	} {
+		if _, err := Embed(img, []byte("deep")); !errors.Is(err, Err16BitCover) {
+			t.Errorf("%T: Embed error = %v, want Err16BitCover", img, err)
+		}
+	}
+}
+
+func TestEmbedTooLarge(t *testing.T) {
+	img := newTestNRGBA(32, 32)
+	capacity, err := Capacity(img)
+	if err != nil {
+		t.Fatalf("Capacity failed: %v", err)
+	}
+	if _, err := Embed(img, make([]byte, capacity)); err != nil {
+		t.Errorf("Embed at capacity failed: %v", err)
+	}
+	if _, err := Embed(img, make([]byte, capacity+1)); !errors.Is(err, ErrPayloadTooLarge) {
+		t.Errorf("Embed over capacity error = %v, want ErrPayloadTooLarge", err)
+	}
+	if n, err := Capacity(newTestNRGBA(2, 2)); err != nil || n != 0 {
+		t.Errorf("Capacity of a tiny image = %d, %v; want 0", n, err)
+	}
+}
+
+func TestInvalidOptions(t *testing.T) {
+	for name, opts := range map[string][]Option{
+		"density":  {WithDensity(9)},
+		"channels": {WithChannels(0x10)},
+		"scatter":  {WithScatter(true)},
+		"key":      {WithKey([]byte("short"))},
+		"max fill": {WithMaxFill(1.5)},
+	} {
+		if err := Validate(opts...); err == nil {
+			t.Errorf("%s: Validate succeeded", name)
+		}
+		if _, err := Embed(newTestNRGBA(32, 32), []byte("hi"), opts...); err == nil {
+			t.Errorf("%s: Embed succeeded", name)
+		}
+		if _, err := Capacity(newTestNRGBA(32, 32), opts...); err == nil && name != "scatter" {
+			t.Errorf("%s: Capacity succeeded", name)
+		}
+	}
+}
+
+func TestEmbedSplitAssemble(t *testing.T) {
+	covers := []image.Image{newTestNRGBA(34, 34), newTestNRGBA(6, 6), image.NewGray(image.Rect(0, 0, 40, 40))}
+	data := bytes.Repeat(binaryFixture(), 3)[:600]
+	opts := []Option{WithPassword("hunter2")}
+	imgs, used, err := EmbedSplit(covers, Payload{Data: data}, opts...)
+	if err != nil {
+		t.Fatalf("EmbedSplit failed: %v", err)
+	}
+	if len(imgs) != len(used) || len(used) != 2 || used[0] != 0 || used[1] != 2 {
+		t.Fatalf("EmbedSplit used covers %v for %d images, want [0 2]", used, len(imgs))
+	}
+
+	var fragments []Payload
+	for i := len(imgs) - 1; i >= 0; i-- {
+		p, err := ExtractPayload(imgs[i], opts...)
+		if err != nil {
+			t.Fatalf("ExtractPayload of fragment %d failed: %v", i, err)
+		}
+		fragments = append(fragments, p)
+	}
+	got, err := Assemble(fragments, opts...)
+	if err != nil {
+		t.Fatalf("Assemble failed: %v", err)
+	}
+	if !bytes.Equal(got.Data, data) {
+		t.Error("split payload did not round trip")
+	}
+	if _, err := Assemble(fragments[:1], opts...); !errors.Is(err, ErrMissingFragment) {
+		t.Errorf("Assemble of one fragment error = %v, want ErrMissingFragment", err)
+	}
+	if _, err := Extract(imgs[0], opts...); !errors.Is(err, ErrMissingFragment) {
+		t.Errorf("Extract of one fragment error = %v, want ErrMissingFragment", err)
+	}
+}
+
+func TestFrameReadFrame(t *testing.T) {
+	p := Payload{Data: binaryFixture(), Filename: "a.bin"}
+	for _, opts := range [][]Option{nil, {WithPassword("hunter2"), WithCompression(true)}} {
+		size := 2048
+		frame, err := Frame(p, size, opts...)
+		if err != nil {
+			t.Fatalf("Frame failed: %v", err)
+		}
+		if v, ok := FrameVersion(frame[:FramePrefixSize]); !ok || v != Version {
+			t.Errorf("FrameVersion = %d, %v; want %d", v, ok, Version)
+		}
+		carrier := append(frame, make([]byte, size-len(frame))...)
+		read := func(off, n int) []byte { return carrier[off : off+n] }
+		got, err := ReadFrame(read, size, opts...)
+		if err != nil {
+			t.Fatalf("ReadFrame failed: %v", err)
+		}
+		if !bytes.Equal(got.Data, p.Data) || got.Filename != p.Filename {
+			t.Error("framed payload did not round trip")
+		}
+	}
+
+	if _, err := Frame(p, 64); !errors.Is(err, ErrPayloadTooLarge) {
+		t.Errorf("Frame into a small carrier error = %v, want ErrPayloadTooLarge", err)
+	}
+	if _, ok := FrameVersion([]byte("PNG\x00\x05")); ok {
+		t.Error("FrameVersion accepted a prefix without the magic")
+	}
+	empty := make([]byte, 256)
+	if _, err := ReadFrame(func(off, n int) []byte { return empty[off : off+n] }, len(empty)); !errors.Is(err, ErrNoPayload) {
+		t.Errorf("ReadFrame of an empty carrier error = %v, want ErrNoPayload", err)
+	}
+}
+
+func TestEmbedPayloadKeepsAlpha(t *testing.T) {
+	cover := image.NewNRGBA(image.Rect(0, 0, 48, 48))
+	for i := range cover.Pix {
+		cover.Pix[i] = uint8(i)
+	}
+	for i := 3; i < len(cover.Pix); i += 4 {
+		cover.Pix[i] = 128
+	}
+	img, err := Embed(cover, bytes.Repeat([]byte("translucent "), 20))
+	if err != nil {
+		t.Fatalf("Embed failed: %v", err)
+	}
+	stego := img.(*image.NRGBA)
+	for i := range cover.Pix {
+		d := int(stego.Pix[i]) - int(cover.Pix[i])
+		if i%4 == 3 && d != 0 || d < -1 || d > 1 {
+			t.Fatalf("byte %d changed from %d to %d", i, cover.Pix[i], stego.Pix[i])
+		}
+	}
+	if got := color.NRGBAModel.Convert(img.At(0, 0)).(color.NRGBA).A; got != 128 {
+		t.Errorf("alpha = %d, want 128", got)
+	}
+}
@@ -0,0 +1,61 @@
+package stego
+
+import (
+	"fmt"
+	"image"
+	"math/rand/v2"
+)
+
+// Ways of overwriting the low bits of an image.
+const (
+	// WipeRandom replaces the low bits with random ones, so the image
+	// looks like any other noisy cover.
+	WipeRandom = "random"
+	// WipeZero clears the low bits.
+	WipeZero = "zero"
+)
+
+// wipeImage overwrites the low opts.Density bits of every channel of img
+// that hide would embed into with opts, in the given mode. opts must have
+// been resolved with forImage.
+func wipeImage(img *image.NRGBA, opts options, mode string) {
+	mask := byte(1)<<opts.Density - 1
+	channels := opts.channels().offsets()
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		row := img.Pix[img.PixOffset(b.Min.X, y) : img.PixOffset(b.Min.X, y)+b.Dx()*4]
+		for x := 0; x < len(row); x += 4 {
+			if opts.SkipTransparent && row[x+3] == 0 {
+				continue
+			}
+			for _, c := range channels {
+				var bits byte
+				if mode == WipeRandom {
+					bits = byte(rand.Uint32())
+				}
+				row[x+c] = row[x+c]&^mask | bits&mask
+			}
+		}
+	}
+}
+
+// Wipe returns a copy of img with the low bits that a payload embedded
+// with opts could occupy overwritten in the given mode, WipeRandom or
+// WipeZero, destroying any payload there without changing how the image
+// looks.
+func Wipe(img image.Image, mode string, opts ...Option) (image.Image, error) {
+	o := newOptions(opts)
+	if err := o.validate(); err != nil {
+		return nil, err
+	}
+	if mode != WipeRandom && mode != WipeZero {
+		return nil, fmt.Errorf("invalid wipe mode %q: must be %s or %s", mode, WipeRandom, WipeZero)
+	}
+	c, err := newCover(img)
+	if err != nil {
+		return nil, err
+	}
+	o = c.options(o)
+	wipeImage(c.img, o.forImage(c.img), mode)
+	return c.image(), nil
+}
@@ -0,0 +1,42 @@
+package stego
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestWipe(t *testing.T) {
+	cover := newTestNRGBA(64, 64)
+	opts := []Option{WithDensity(2)}
+	img, err := EmbedPayload(cover, Payload{Data: binaryFixture(), Filename: "a.bin"}, opts...)
+	if err != nil {
+		t.Fatalf("EmbedPayload failed: %v", err)
+	}
+
+	for _, mode := range []string{WipeRandom, WipeZero} {
+		wiped, err := Wipe(img, mode, opts...)
+		if err != nil {
+			t.Fatalf("%s: Wipe failed: %v", mode, err)
+		}
+		if _, err := ExtractPayload(wiped); !errors.Is(err, ErrNoPayload) {
+			t.Errorf("%s: extract after wipe error = %v, want ErrNoPayload", mode, err)
+		}
+		if v := HeaderVersion(wiped); v != 0 {
+			t.Errorf("%s: HeaderVersion after wipe = %d, want 0", mode, v)
+		}
+
+		// Only the wiped bits differ from the cover.
+		wantPix, gotPix := cover.Pix, toNRGBA(wiped).Pix
+		for i := range wantPix {
+			if wantPix[i]&^3 != gotPix[i]&^3 || i%4 == 3 && wantPix[i] != gotPix[i] {
+				t.Fatalf("%s: byte %d changed from %#x to %#x", mode, i, wantPix[i], gotPix[i])
+			}
+		}
+	}
+}
+
+func TestWipeRejectsMode(t *testing.T) {
+	if _, err := Wipe(newTestNRGBA(8, 8), "shred"); err == nil {
+		t.Error("Wipe accepted an unknown mode")
+	}
+}
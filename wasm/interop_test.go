@@ -0,0 +1,102 @@
+//go:build !js
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"image"
+	"image/draw"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Amul-Thantharate/pixellock/pkg/pixellock"
+)
+
+// faceFixture is a photo from the library's test data.
+const faceFixture = "../pkg/pixellock/testdata/face.jpg"
+
+// run runs name with args in dir, with env added to the environment, and
+// fails the test unless it succeeds.
+func run(t *testing.T, dir string, env []string, name string, args ...string) {
+	t.Helper()
+	cmd := exec.Command(name, args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), env...)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("%s %s failed: %v\n%s", name, strings.Join(args, " "), err, out)
+	}
+}
+
+// nrgba returns the pixels of the image file at filename.
+func nrgba(t *testing.T, filename string) *image.NRGBA {
+	t.Helper()
+	img, err := pixellock.LoadImage(filename)
+	if err != nil {
+		t.Fatalf("LoadImage failed: %v", err)
+	}
+	dst := image.NewNRGBA(img.Bounds())
+	draw.Draw(dst, dst.Bounds(), img, img.Bounds().Min, draw.Src)
+	return dst
+}
+
+// TestInterop round trips files between the native CLI and the wasm
+// module, run under Node.js by interop_test.js.
+func TestInterop(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds the CLI and the wasm module")
+	}
+	node, err := exec.LookPath("node")
+	if err != nil {
+		t.Skip("node is not installed")
+	}
+	goroot, err := exec.Command("go", "env", "GOROOT").Output()
+	if err != nil {
+		t.Fatalf("go env GOROOT failed: %v", err)
+	}
+	wasmExec := filepath.Join(strings.TrimSpace(string(goroot)), "lib", "wasm", "wasm_exec.js")
+
+	dir := t.TempDir()
+	cli, wasm := filepath.Join(dir, "pixellock"), filepath.Join(dir, "pixellock.wasm")
+	run(t, ".", nil, "go", "build", "-o", cli, "..")
+	run(t, ".", []string{"GOOS=js", "GOARCH=wasm"}, "go", "build", "-o", wasm, ".")
+
+	face, err := os.ReadFile(faceFixture)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "face.jpg"), face, 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	key := make([]byte, pixellock.KeySize)
+	rand.Read(key)
+	keyBase64 := base64.StdEncoding.EncodeToString(key)
+	run(t, dir, nil, cli, "encrypt", "-i", "face.jpg", "-o", "cli.enc", "-k", keyBase64)
+	if err := pixellock.SaveImage(filepath.Join(dir, "cover.png"), nrgba(t, faceFixture), pixellock.SaveOptions{Format: "png"}); err != nil {
+		t.Fatalf("SaveImage failed: %v", err)
+	}
+	run(t, dir, nil, cli, "stego", "hide", "-i", "cover.png", "-o", "stego.png", "-m", "meet at noon", "--password", "hunter2")
+
+	run(t, ".", nil, node, "interop_test.js", wasmExec, wasm, dir, keyBase64)
+
+	// The wasm module decrypts what the CLI encrypted
+	want := nrgba(t, faceFixture)
+	if got := nrgba(t, filepath.Join(dir, "wasm-decrypted.png")); !bytes.Equal(got.Pix, want.Pix) {
+		t.Error("wasm decryption of the CLI's file differs from the original")
+	}
+
+	// The CLI decrypts what the wasm module encrypted
+	run(t, dir, nil, cli, "decrypt", "-i", "wasm.enc", "-o", "cli-decrypted.png", "-k", keyBase64, "--output-format", "png")
+	if got := nrgba(t, filepath.Join(dir, "cli-decrypted.png")); !bytes.Equal(got.Pix, want.Pix) {
+		t.Error("CLI decryption of the wasm module's file differs from the original")
+	}
+
+	revealed, err := os.ReadFile(filepath.Join(dir, "revealed.txt"))
+	if err != nil || string(revealed) != "meet at noon" {
+		t.Errorf("wasm stegoReveal = %q, %v; want the CLI's message", revealed, err)
+	}
+}
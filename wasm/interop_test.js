@@ -0,0 +1,52 @@
+// interop_test.js is run by TestInterop under Node.js, as
+//
+//	node interop_test.js wasm_exec.js pixellock.wasm dir key
+//
+// It decrypts dir/cli.enc and reveals the payload of dir/stego.png, both
+// written by the native CLI, and encrypts dir/face.jpg for the CLI to
+// decrypt, leaving the results in dir for the Go test to check.
+"use strict";
+
+const fs = require("fs");
+const path = require("path");
+
+const [wasmExec, wasm, dir, key] = process.argv.slice(2);
+require(path.resolve(wasmExec));
+const { loadPixellock } = require("./pixellock.js");
+
+function expectThrow(name, fn) {
+	try {
+		fn();
+	} catch (err) {
+		if (!(err instanceof Error) || !err.message) {
+			throw new Error(`${name} threw ${err}, want an Error with a message`);
+		}
+		return;
+	}
+	throw new Error(`${name} did not throw`);
+}
+
+(async () => {
+	const px = await loadPixellock(fs.readFileSync(wasm));
+	const read = (name) => new Uint8Array(fs.readFileSync(path.join(dir, name)));
+
+	const png = px.decrypt(read("cli.enc"), key);
+	if (!(png instanceof Uint8Array)) {
+		throw new Error("decrypt did not return a Uint8Array");
+	}
+	fs.writeFileSync(path.join(dir, "wasm-decrypted.png"), png);
+
+	fs.writeFileSync(path.join(dir, "wasm.enc"), px.encrypt(read("face.jpg"), Buffer.from(key, "base64")));
+
+	fs.writeFileSync(path.join(dir, "revealed.txt"), px.stegoReveal(read("stego.png"), "hunter2"));
+
+	const wrongKey = Buffer.alloc(32).toString("base64");
+	expectThrow("decrypt with the wrong key", () => px.decrypt(read("cli.enc"), wrongKey));
+	expectThrow("decrypt with a short key", () => px.decrypt(read("cli.enc"), "c2hvcnQ="));
+	expectThrow("decrypt of a string", () => px.decrypt("not bytes", key));
+	expectThrow("stegoReveal without the password", () => px.stegoReveal(read("stego.png")));
+	process.exit(0);
+})().catch((err) => {
+	console.error(err.stack || err);
+	process.exit(1);
+});
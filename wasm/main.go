@@ -0,0 +1,131 @@
+//go:build js && wasm
+
+// Command wasm exposes pixellock to JavaScript, so that a web page can
+// decrypt images in the browser without the plaintext leaving it. Build it
+// with
+//
+//	GOOS=js GOARCH=wasm go build -o pixellock.wasm ./wasm
+//
+// and load it with pixellock.js, beside Go's wasm_exec.js. It defines a
+// global pixellock object with three functions:
+//
+//	encrypt(bytes, key)            the encrypted file, as pixellock encrypt writes it
+//	decrypt(bytes, key)            the decrypted image, as encryption stored it
+//	stegoReveal(bytes[, password]) the payload hidden in a stego image
+//
+// bytes is a Uint8Array holding a file, and key the base64 key the CLI
+// prints, or its 32 bytes as a Uint8Array. Each function returns a
+// Uint8Array, or an Error for pixellock.js to throw.
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"syscall/js"
+
+	"github.com/Amul-Thantharate/pixellock/pkg/pixellock"
+)
+
+func main() {
+	js.Global().Set("pixellock", js.ValueOf(map[string]any{
+		"encrypt":     js.FuncOf(encrypt),
+		"decrypt":     js.FuncOf(decrypt),
+		"stegoReveal": js.FuncOf(stegoReveal),
+	}))
+	select {} // Keep the functions callable
+}
+
+// encrypt implements pixellock.encrypt.
+func encrypt(this js.Value, args []js.Value) any {
+	data, key, err := fileAndKey(args)
+	if err != nil {
+		return jsError(err)
+	}
+	var out bytes.Buffer
+	if err := pixellock.EncryptImage(context.Background(), key, &out, bytes.NewReader(data)); err != nil {
+		return jsError(err)
+	}
+	return uint8Array(out.Bytes())
+}
+
+// decrypt implements pixellock.decrypt.
+func decrypt(this js.Value, args []js.Value) any {
+	data, key, err := fileAndKey(args)
+	if err != nil {
+		return jsError(err)
+	}
+	var out bytes.Buffer
+	if err := pixellock.DecryptImage(context.Background(), key, &out, bytes.NewReader(data)); err != nil {
+		return jsError(err)
+	}
+	return uint8Array(out.Bytes())
+}
+
+// stegoReveal implements pixellock.stegoReveal.
+func stegoReveal(this js.Value, args []js.Value) any {
+	if len(args) < 1 || len(args) > 2 {
+		return jsError(fmt.Errorf("stegoReveal takes an image and an optional password"))
+	}
+	data, err := goBytes(args[0], "image")
+	if err != nil {
+		return jsError(err)
+	}
+	opts := pixellock.DefaultStegoOptions
+	if len(args) == 2 && !args[1].IsUndefined() && !args[1].IsNull() {
+		if args[1].Type() != js.TypeString {
+			return jsError(fmt.Errorf("password must be a string"))
+		}
+		opts.Password = args[1].String()
+	}
+	p, err := pixellock.RevealPayloadFrom(bytes.NewReader(data), opts)
+	if err != nil {
+		return jsError(err)
+	}
+	return uint8Array(p.Data)
+}
+
+// fileAndKey returns the file and key arguments of encrypt and decrypt.
+func fileAndKey(args []js.Value) ([]byte, []byte, error) {
+	if len(args) != 2 {
+		return nil, nil, fmt.Errorf("expected a file and a key, got %d arguments", len(args))
+	}
+	data, err := goBytes(args[0], "file")
+	if err != nil {
+		return nil, nil, err
+	}
+	if args[1].Type() == js.TypeString {
+		key, err := pixellock.DecodeKey(args[1].String())
+		return data, key, err
+	}
+	key, err := goBytes(args[1], "key")
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(key) != pixellock.KeySize {
+		return nil, nil, fmt.Errorf("%w: key must be %d bytes", pixellock.ErrInvalidKeySize, pixellock.KeySize)
+	}
+	return data, key, nil
+}
+
+// goBytes copies the Uint8Array v, the argument named name.
+func goBytes(v js.Value, name string) ([]byte, error) {
+	if !v.InstanceOf(js.Global().Get("Uint8Array")) {
+		return nil, fmt.Errorf("%s must be a Uint8Array", name)
+	}
+	b := make([]byte, v.Length())
+	js.CopyBytesToGo(b, v)
+	return b, nil
+}
+
+// uint8Array copies b into a new Uint8Array.
+func uint8Array(b []byte) js.Value {
+	v := js.Global().Get("Uint8Array").New(len(b))
+	js.CopyBytesToJS(v, b)
+	return v
+}
+
+// jsError returns err as a JavaScript Error.
+func jsError(err error) js.Value {
+	return js.Global().Get("Error").New(err.Error())
+}
@@ -0,0 +1,45 @@
+// pixellock.js loads pixellock.wasm, built from this directory, and wraps
+// the functions it defines so that they throw their errors. Go's
+// wasm_exec.js, from $(go env GOROOT)/lib/wasm, must be loaded first. In a
+// page:
+//
+//	<script src="wasm_exec.js"></script>
+//	<script src="pixellock.js"></script>
+//	<script>
+//	  const px = await loadPixellock(fetch("pixellock.wasm"));
+//	  const png = px.decrypt(new Uint8Array(await file.arrayBuffer()), key);
+//	</script>
+//
+// In Node.js, require both files and give loadPixellock the bytes of the
+// module. The functions run on the calling thread; decrypting large images
+// belongs in a Web Worker.
+"use strict";
+
+(() => {
+	async function loadPixellock(source) {
+		const go = new Go();
+		source = await source;
+		const { instance } = typeof Response !== "undefined" && source instanceof Response
+			? await WebAssembly.instantiateStreaming(source, go.importObject)
+			: await WebAssembly.instantiate(source, go.importObject);
+		go.run(instance); // Returns once the module exits, which it never does
+		const api = globalThis.pixellock;
+		const throwing = (fn) => (...args) => {
+			const result = fn(...args);
+			if (result instanceof Error) {
+				throw result;
+			}
+			return result;
+		};
+		return {
+			encrypt: throwing(api.encrypt),
+			decrypt: throwing(api.decrypt),
+			stegoReveal: throwing(api.stegoReveal),
+		};
+	}
+
+	globalThis.loadPixellock = loadPixellock;
+	if (typeof module !== "undefined") {
+		module.exports = { loadPixellock };
+	}
+})();